@@ -0,0 +1,697 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+var indexctlCommand = &cli.Command{
+	Name:  "indexctl",
+	Usage: "Administer a running indexing service through its admin endpoints",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "url",
+			EnvVars: []string{"INDEXING_SERVICE_URL"},
+			Value:   "http://localhost:9000",
+			Usage:   "URL of the indexing service",
+		},
+		&cli.StringFlag{
+			Name:     "admin-token",
+			EnvVars:  []string{"ADMIN_TOKEN"},
+			Required: true,
+			Usage:    "bearer token authorizing the admin endpoints",
+		},
+	},
+	Subcommands: []*cli.Command{
+		{
+			Name:      "import",
+			Usage:     "import the claims in a CAR file of delegations",
+			ArgsUsage: "<car-file>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "mode",
+					Value: "cache",
+					Usage: "how claims are imported, either cache or publish",
+				},
+				&cli.StringSliceFlag{
+					Name:  "trusted-issuer",
+					Usage: "DID of an issuer whose claims are imported, all issuers if not set (may be repeated)",
+				},
+				&cli.BoolFlag{
+					Name:  "verbose",
+					Usage: "print the outcome of imported claims, not only of those that weren't imported",
+				},
+			},
+			Action: importClaims,
+		},
+		{
+			Name:      "remove-provider",
+			Usage:     "remove every record of a provider, advertise their removal and keep them from being cached again; an interrupted removal resumes when run again",
+			ArgsUsage: "<peer-id>",
+			Action:    removeProvider,
+		},
+		{
+			Name:      "export-chain",
+			Usage:     "export the advertisement chain as a CAR file, for indexers to bootstrap from",
+			ArgsUsage: "<car-file>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "from",
+					Usage: "CID of the advertisement to export from, the head if not set",
+				},
+				&cli.StringFlag{
+					Name:  "to",
+					Usage: "CID of an advertisement the importer already has, to stop the export before, the tail if not set",
+				},
+			},
+			Action: exportChain,
+		},
+		{
+			Name:      "export-providers",
+			Usage:     "export the cached provider records, a row per record with its multihash, provider, claim protocols, context ID and seconds to live; an interrupted export resumes from the cursor it printed",
+			ArgsUsage: "<file>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "format",
+					Value: "ndjson",
+					Usage: "row format, either ndjson or csv",
+				},
+				&cli.IntFlag{
+					Name:  "page-size",
+					Value: 10000,
+					Usage: "number of hashes requested at a time",
+				},
+				&cli.StringFlag{
+					Name:  "cursor",
+					Usage: "cursor printed by an interrupted export, to append the rest of the export to the file",
+				},
+			},
+			Action: exportProviders,
+		},
+		{
+			Name:      "import-chain",
+			Usage:     "import an advertisement chain exported as a CAR file, moving the head if it extends the chain",
+			ArgsUsage: "<car-file>",
+			Action:    importChain,
+		},
+		{
+			Name:  "sync",
+			Usage: "copy the provider records this deployment is missing from another, fetching only the ranges of hashes whose digests don't match; passes are repeated until one writes nothing, and an interrupted pass resumes from the cursor it printed",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "from",
+					Required: true,
+					Usage:    "URL of the indexing service to sync from",
+				},
+				&cli.StringFlag{
+					Name:    "from-token",
+					EnvVars: []string{"SYNC_FROM_TOKEN"},
+					Usage:   "bearer token authorizing the admin endpoints of the indexing service synced from",
+				},
+				&cli.StringFlag{
+					Name:  "cursor",
+					Usage: "cursor printed by an interrupted pass, to resume it",
+				},
+				&cli.IntFlag{
+					Name:  "passes",
+					Value: 2,
+					Usage: "most passes made, stopping early once one writes nothing",
+				},
+			},
+			Action: syncProviders,
+		},
+		{
+			Name:  "selfcheck",
+			Usage: "publish a synthetic claim for a throwaway multihash, wait for it to be cached and ingested, query it back and remove it, printing how long each stage took",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "provider-url",
+					Required: true,
+					Usage:    "URL with {claim} in its path that the synthetic claim is advertised at",
+				},
+				&cli.DurationFlag{
+					Name:  "cache-wait",
+					Usage: "how long the claim has to be cached in (10s if not set)",
+				},
+				&cli.DurationFlag{
+					Name:  "ipni-wait",
+					Usage: "how long IPNI has to ingest the claim in (the IPNI stage is skipped if not set)",
+				},
+			},
+			Action: selfCheck,
+		},
+		{
+			Name:      "refresh",
+			Usage:     "drop everything cached for a multihash, its provider records, the claims they refer to and the query results that looked it up, and resolve it afresh, printing what was dropped from each store",
+			ArgsUsage: "<multihash>",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "resolve",
+					Value: true,
+					Usage: "query the multihash once refreshed, so that the caches are populated again",
+				},
+			},
+			Action: refreshHash,
+		},
+		{
+			Name:  "advert",
+			Usage: "examine the advertisements of the chain",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "inspect",
+					Usage:     "print a stored advertisement decoded field by field, with its metadata protocols, extended providers, entry count and whether its signature is valid",
+					ArgsUsage: "<advert-cid>",
+					Flags: []cli.Flag{
+						&cli.IntFlag{
+							Name:  "chunks",
+							Value: -1,
+							Usage: "how many entries chunks to walk counting entries, 0 not to count them (1000 if not set)",
+						},
+					},
+					Action: inspectAdvert,
+				},
+			},
+		},
+	},
+}
+
+type importLine struct {
+	Claim      string `json:"claim"`
+	Type       string `json:"type"`
+	Status     string `json:"status"`
+	Reason     string `json:"reason"`
+	ClockSkew  string `json:"clockSkew"`
+	Imported   *int   `json:"imported"`
+	Duplicates int    `json:"duplicates"`
+	Invalid    int    `json:"invalid"`
+	Failed     int    `json:"failed"`
+	Error      string `json:"error"`
+}
+
+func importClaims(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("expected a CAR file to import")
+	}
+	f, err := os.Open(cCtx.Args().First())
+	if err != nil {
+		return fmt.Errorf("opening CAR file: %w", err)
+	}
+	defer f.Close()
+
+	params := url.Values{"mode": {cCtx.String("mode")}, "trustedIssuer": cCtx.StringSlice("trusted-issuer")}
+	endpoint := strings.TrimSuffix(cCtx.String("url"), "/") + "/claims/import?" + params.Encode()
+	req, err := http.NewRequestWithContext(cCtx.Context, http.MethodPost, endpoint, f)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cCtx.String("admin-token"))
+	req.Header.Set("Content-Type", "application/vnd.ipld.car")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending import: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("import failed with status %d", resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var line importLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return fmt.Errorf("decoding import response: %w", err)
+		}
+		if line.Imported != nil {
+			fmt.Printf("imported %d, duplicates %d, invalid %d, failed %d\n", *line.Imported, line.Duplicates, line.Invalid, line.Failed)
+			if line.Error != "" {
+				return fmt.Errorf("import stopped: %s", line.Error)
+			}
+			return nil
+		}
+		if line.Status != "imported" || cCtx.Bool("verbose") {
+			fmt.Printf("%s\t%s\t%s\t%s\n", line.Claim, line.Type, line.Status, line.Reason)
+		}
+		if line.ClockSkew != "" && cCtx.Bool("verbose") {
+			fmt.Printf("%s\tclock skew: %s\n", line.Claim, line.ClockSkew)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading import response: %w", err)
+	}
+	return fmt.Errorf("import response ended before its totals")
+}
+
+type removalLine struct {
+	Provider string  `json:"provider"`
+	Finished *string `json:"finished"`
+	Adverts  int     `json:"adverts"`
+	Swept    int     `json:"swept"`
+	Hashes   int     `json:"hashes"`
+	Records  int     `json:"records"`
+	Claims   int     `json:"claims"`
+	Error    string  `json:"error"`
+}
+
+func removeProvider(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("expected the peer ID of the provider to remove")
+	}
+	endpoint := strings.TrimSuffix(cCtx.String("url"), "/") + "/providers/" + url.PathEscape(cCtx.Args().First())
+	req, err := http.NewRequestWithContext(cCtx.Context, http.MethodDelete, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cCtx.String("admin-token"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending removal: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("removal failed with status %d", resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var line removalLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return fmt.Errorf("decoding removal response: %w", err)
+		}
+		fmt.Printf("adverts removed %d, hashes swept %d, hashes purged %d, records removed %d, claims evicted %d\n", line.Adverts, line.Swept, line.Hashes, line.Records, line.Claims)
+		if line.Error != "" {
+			return fmt.Errorf("removal stopped, run again to resume: %s", line.Error)
+		}
+		if line.Finished != nil {
+			fmt.Printf("removed %s\n", line.Provider)
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading removal response: %w", err)
+	}
+	return fmt.Errorf("removal response ended before it finished, run again to resume")
+}
+
+type syncLine struct {
+	Cursor     string `json:"cursor"`
+	Ranges     int    `json:"ranges"`
+	Mismatched int    `json:"mismatched"`
+	Fetched    int    `json:"fetched"`
+	Written    int    `json:"written"`
+	Records    int    `json:"records"`
+	Done       bool   `json:"done"`
+	Error      string `json:"error"`
+}
+
+func syncProviders(cCtx *cli.Context) error {
+	cursor := cCtx.String("cursor")
+	for pass := 1; pass <= cCtx.Int("passes"); pass++ {
+		last, err := syncPass(cCtx, cursor)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("pass %d wrote records of %d hashes\n", pass, last.Written)
+		if last.Written == 0 {
+			fmt.Println("converged")
+			return nil
+		}
+		cursor = ""
+	}
+	fmt.Println("not converged yet, run again to make more passes")
+	return nil
+}
+
+// syncPass makes a pass from the cursor, returning its final progress
+func syncPass(cCtx *cli.Context, cursor string) (syncLine, error) {
+	body, err := json.Marshal(map[string]string{"from": cCtx.String("from"), "token": cCtx.String("from-token"), "cursor": cursor})
+	if err != nil {
+		return syncLine{}, err
+	}
+	endpoint := strings.TrimSuffix(cCtx.String("url"), "/") + "/sync"
+	req, err := http.NewRequestWithContext(cCtx.Context, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return syncLine{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+cCtx.String("admin-token"))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return syncLine{}, fmt.Errorf("sending sync: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return syncLine{}, fmt.Errorf("sync failed with status %d", resp.StatusCode)
+	}
+
+	var line syncLine
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line = syncLine{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return syncLine{}, fmt.Errorf("decoding sync response: %w", err)
+		}
+		fmt.Printf("ranges compared %d, mismatched %d, hashes fetched %d, hashes written %d, records written %d\n", line.Ranges, line.Mismatched, line.Fetched, line.Written, line.Records)
+		if line.Error != "" {
+			return syncLine{}, fmt.Errorf("sync stopped, resume with --cursor %q: %s", line.Cursor, line.Error)
+		}
+		if line.Done {
+			return line, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return syncLine{}, fmt.Errorf("reading sync response: %w", err)
+	}
+	return syncLine{}, fmt.Errorf("sync response ended before it finished, resume with --cursor %q", line.Cursor)
+}
+
+func exportChain(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("expected a CAR file to export to")
+	}
+	params := url.Values{}
+	if from := cCtx.String("from"); from != "" {
+		params.Set("from", from)
+	}
+	if to := cCtx.String("to"); to != "" {
+		params.Set("to", to)
+	}
+	endpoint := strings.TrimSuffix(cCtx.String("url"), "/") + "/publisher/chain?" + params.Encode()
+	req, err := http.NewRequestWithContext(cCtx.Context, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cCtx.String("admin-token"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending export: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("export failed with status %d", resp.StatusCode)
+	}
+
+	f, err := os.Create(cCtx.Args().First())
+	if err != nil {
+		return fmt.Errorf("creating CAR file: %w", err)
+	}
+	n, err := io.Copy(f, resp.Body)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("writing CAR file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing CAR file: %w", err)
+	}
+	fmt.Printf("exported %d bytes\n", n)
+	return nil
+}
+
+func exportProviders(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("expected a file to export to")
+	}
+	cursor := cCtx.String("cursor")
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if cursor != "" {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(cCtx.Args().First(), flags, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening export file: %w", err)
+	}
+	defer f.Close()
+
+	pages := 0
+	for {
+		params := url.Values{"format": {cCtx.String("format")}, "limit": {strconv.Itoa(cCtx.Int("page-size"))}}
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+		next, err := exportProvidersPage(cCtx, f, params)
+		if err != nil {
+			if cursor != "" {
+				return fmt.Errorf("export stopped, resume with --cursor %s: %w", cursor, err)
+			}
+			return fmt.Errorf("export stopped: %w", err)
+		}
+		pages++
+		if next == "" {
+			fmt.Printf("exported %d pages\n", pages)
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// exportProvidersPage appends a page of the export to the file, returning the
+// cursor of the next. A page that fails part way through is truncated from the
+// file, so that the export can be resumed from its cursor
+func exportProvidersPage(cCtx *cli.Context, f *os.File, params url.Values) (string, error) {
+	start, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	endpoint := strings.TrimSuffix(cCtx.String("url"), "/") + "/providers/export?" + params.Encode()
+	req, err := http.NewRequestWithContext(cCtx.Context, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+cCtx.String("admin-token"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("sending export: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		if terr := f.Truncate(start); terr != nil {
+			return "", fmt.Errorf("truncating partial page: %w", terr)
+		}
+		return "", fmt.Errorf("reading export: %w", err)
+	}
+	// the trailer is only read once the body has been
+	return resp.Trailer.Get("Next-Cursor"), nil
+}
+
+type chainSummaryLine struct {
+	Head    string `json:"head"`
+	Adverts uint64 `json:"adverts"`
+	Entries int64  `json:"entries"`
+}
+
+func importChain(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("expected a CAR file to import")
+	}
+	f, err := os.Open(cCtx.Args().First())
+	if err != nil {
+		return fmt.Errorf("opening CAR file: %w", err)
+	}
+	defer f.Close()
+
+	endpoint := strings.TrimSuffix(cCtx.String("url"), "/") + "/publisher/chain"
+	req, err := http.NewRequestWithContext(cCtx.Context, http.MethodPost, endpoint, f)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cCtx.String("admin-token"))
+	req.Header.Set("Content-Type", "application/vnd.ipld.car")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending import: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("import failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var summary chainSummaryLine
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		return fmt.Errorf("decoding import response: %w", err)
+	}
+	fmt.Printf("head %s, adverts %d, entries %d\n", summary.Head, summary.Adverts, summary.Entries)
+	return nil
+}
+
+type selfCheckLine struct {
+	Passed   bool   `json:"passed"`
+	Hash     string `json:"hash"`
+	Provider string `json:"provider"`
+	Claim    string `json:"claim"`
+	Stages   []struct {
+		Stage    string `json:"stage"`
+		Status   string `json:"status"`
+		Duration string `json:"duration"`
+		Reason   string `json:"reason"`
+		Error    string `json:"error"`
+	} `json:"stages"`
+}
+
+func selfCheck(cCtx *cli.Context) error {
+	params := url.Values{"providerURL": {cCtx.String("provider-url")}}
+	if d := cCtx.Duration("cache-wait"); d > 0 {
+		params.Set("cacheWait", d.String())
+	}
+	if d := cCtx.Duration("ipni-wait"); d > 0 {
+		params.Set("ipniWait", d.String())
+	}
+	endpoint := strings.TrimSuffix(cCtx.String("url"), "/") + "/selfcheck?" + params.Encode()
+	req, err := http.NewRequestWithContext(cCtx.Context, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cCtx.String("admin-token"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending self check: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("self check failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var report selfCheckLine
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return fmt.Errorf("decoding self check report: %w", err)
+	}
+	fmt.Printf("hash %s, provider %s, claim %s\n", report.Hash, report.Provider, report.Claim)
+	for _, s := range report.Stages {
+		switch {
+		case s.Error != "":
+			fmt.Printf("%s\t%s\t%s\t%s\n", s.Stage, s.Status, s.Duration, s.Error)
+		case s.Reason != "":
+			fmt.Printf("%s\t%s\t%s\n", s.Stage, s.Status, s.Reason)
+		default:
+			fmt.Printf("%s\t%s\t%s\n", s.Stage, s.Status, s.Duration)
+		}
+	}
+	if !report.Passed {
+		return fmt.Errorf("self check failed")
+	}
+	return nil
+}
+
+type refreshLine struct {
+	Hash       string   `json:"hash"`
+	Negative   bool     `json:"negative"`
+	Tombstoned []string `json:"tombstoned"`
+	Stores     []struct {
+		Store   string `json:"store"`
+		Deleted int    `json:"deleted"`
+		Skipped string `json:"skipped"`
+		Error   string `json:"error"`
+	} `json:"stores"`
+	Resolution *struct {
+		Claims   []string `json:"claims"`
+		Indexes  []string `json:"indexes"`
+		Duration string   `json:"duration"`
+		Error    string   `json:"error"`
+	} `json:"resolution"`
+}
+
+func refreshHash(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("expected the multihash to refresh")
+	}
+	params := url.Values{"resolve": {strconv.FormatBool(cCtx.Bool("resolve"))}}
+	endpoint := strings.TrimSuffix(cCtx.String("url"), "/") + "/admin/refresh/" + url.PathEscape(cCtx.Args().First()) + "?" + params.Encode()
+	req, err := http.NewRequestWithContext(cCtx.Context, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cCtx.String("admin-token"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending refresh: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("refresh failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var report refreshLine
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return fmt.Errorf("decoding refresh report: %w", err)
+	}
+	fmt.Printf("hash %s\n", report.Hash)
+	if report.Negative {
+		fmt.Println("cached as unknown to IPNI")
+	}
+	for _, provider := range report.Tombstoned {
+		fmt.Printf("removed provider %s stays removed\n", provider)
+	}
+	for _, s := range report.Stores {
+		switch {
+		case s.Error != "":
+			fmt.Printf("%s\tfailed\t%d deleted\t%s\n", s.Store, s.Deleted, s.Error)
+		case s.Skipped != "":
+			fmt.Printf("%s\tskipped\t%s\n", s.Store, s.Skipped)
+		default:
+			fmt.Printf("%s\t%d deleted\n", s.Store, s.Deleted)
+		}
+	}
+	if res := report.Resolution; res != nil {
+		if res.Error != "" {
+			fmt.Printf("resolution failed after %s: %s\n", res.Duration, res.Error)
+		} else {
+			fmt.Printf("resolved in %s, %d claims, %d indexes\n", res.Duration, len(res.Claims), len(res.Indexes))
+			for _, claim := range res.Claims {
+				fmt.Printf("claim\t%s\n", claim)
+			}
+			for _, index := range res.Indexes {
+				fmt.Printf("index\t%s\n", index)
+			}
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("refresh failed")
+	}
+	return nil
+}
+
+func inspectAdvert(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("expected the CID of the advertisement to inspect")
+	}
+	params := url.Values{}
+	if chunks := cCtx.Int("chunks"); chunks >= 0 {
+		params.Set("chunks", strconv.Itoa(chunks))
+	}
+	endpoint := strings.TrimSuffix(cCtx.String("url"), "/") + "/publisher/advert/" + url.PathEscape(cCtx.Args().First()) + "?" + params.Encode()
+	req, err := http.NewRequestWithContext(cCtx.Context, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cCtx.String("admin-token"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending inspection: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading inspection: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("inspection failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, body, "", "  "); err != nil {
+		return fmt.Errorf("decoding inspection: %w", err)
+	}
+	fmt.Println(out.String())
+	return nil
+}
@@ -1,15 +1,32 @@
 package main
 
 import (
+	"encoding/base64"
 	"fmt"
+	"net/netip"
 	"os"
+	"strconv"
+	"strings"
 
+	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
 	"github.com/storacha/go-ucanto/did"
 	ed25519 "github.com/storacha/go-ucanto/principal/ed25519/signer"
 	"github.com/storacha/go-ucanto/principal/signer"
+	"github.com/storacha/indexing-service/pkg/publisher"
 	"github.com/storacha/indexing-service/pkg/server"
 	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/deadletter"
+	"github.com/storacha/indexing-service/pkg/service/httppool"
+	"github.com/storacha/indexing-service/pkg/service/liveness"
+	"github.com/storacha/indexing-service/pkg/service/prommetrics"
+	"github.com/storacha/indexing-service/pkg/service/providercacher"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
 	"github.com/urfave/cli/v2"
 )
 
@@ -57,6 +74,11 @@ func main() {
 								EnvVars: []string{"REDIS_PASSWD"},
 								Usage:   "passwd for redis",
 							},
+							&cli.StringFlag{
+								Name:    "redis-replica-url",
+								EnvVars: []string{"REDIS_REPLICA_URL"},
+								Usage:   "url for a redis replica to send cache reads to",
+							},
 							&cli.IntFlag{
 								Name:    "provider-redis-db",
 								Aliases: []string{"prd"},
@@ -75,6 +97,11 @@ func main() {
 								Usage:   "database number for indexes cache",
 								Value:   2,
 							},
+							&cli.IntFlag{
+								Name:  "spaces-redis-db",
+								Usage: "database number for the claims of each space",
+								Value: 3,
+							},
 							&cli.StringFlag{
 								Name:        "ipni-endpoint",
 								Aliases:     []string{"ipni"},
@@ -82,6 +109,379 @@ func main() {
 								Value:       "https://cid.contact",
 								Usage:       "HTTP endpoint of the IPNI instance used to discover providers.",
 							},
+							&cli.Float64Flag{
+								Name:  "cache-ttl-jitter",
+								Value: service.DefaultCacheTTLJitter,
+								Usage: "fraction cache expirations are randomized by, to spread out expiry (negative to disable)",
+							},
+							&cli.BoolFlag{
+								Name:  "disable-location-cache-warming",
+								Usage: "don't cache location commitments discovered while handling queries",
+							},
+							&cli.IntFlag{
+								Name:  "prefetch-shards",
+								Usage: "number of following shards of an index to prefetch locations for in the background (0 to disable)",
+							},
+							&cli.IntFlag{
+								Name:  "max-index-depth",
+								Usage: "number of levels of nested indexes to follow below an index (0 for the default, negative to follow none)",
+							},
+							&cli.BoolFlag{
+								Name:  "bind-space-commitments",
+								Usage: "bind spaces to location commitments already published under another space, instead of publishing them again",
+							},
+							&cli.DurationFlag{
+								Name:  "space-binding-window",
+								Usage: "how far apart the expirations of location commitments may be for them to be bound",
+							},
+							&cli.IntFlag{
+								Name:  "recent-results",
+								Usage: "number of the results of the last IPNI lookups kept in memory, and answered from before reading the providers cache (0 keeps none)",
+							},
+							&cli.DurationFlag{
+								Name:  "recent-results-ttl",
+								Value: providerindex.DefaultRecentResultsTTL,
+								Usage: "how long the results of IPNI lookups are kept in memory, up to " + providerindex.MaxRecentResultsTTL.String(),
+							},
+							&cli.IntFlag{
+								Name:  "max-find-records",
+								Usage: "most provider records kept of an IPNI find response for a hash, read as it arrives, preferring records of different providers (0 keeps all)",
+							},
+							&cli.IntFlag{
+								Name:  "result-cache",
+								Usage: "number of the results of the last queries without spaces kept in memory, and answered from before walking the query (0 keeps none)",
+							},
+							&cli.DurationFlag{
+								Name:  "result-cache-ttl",
+								Value: service.DefaultResultCacheTTL,
+								Usage: "how long the results of queries are kept in memory, up to " + service.MaxResultCacheTTL.String(),
+							},
+							&cli.BoolFlag{
+								Name:  "record-containing-indexes",
+								Usage: "record the indexes the blocks of fetched indexes are in, for looking up which DAGs contain a block",
+							},
+							&cli.IntFlag{
+								Name:  "max-containing-indexes",
+								Usage: "number of most recent indexes recorded for each block (0 for the default)",
+							},
+							&cli.IntFlag{
+								Name:  "index-caching-concurrency",
+								Value: providercacher.DefaultConcurrency,
+								Usage: "number of fetched indexes whose provider records are cached at once",
+							},
+							&cli.IntFlag{
+								Name:  "index-caching-buffer",
+								Value: providercacher.DefaultBuffer,
+								Usage: "number of fetched indexes that may wait for their provider records to be cached, past which they are dropped",
+							},
+							&cli.IntFlag{
+								Name:  "index-expansion-workers",
+								Usage: "number of workers indexes that aren't cached are expanded by in the background, with their jobs kept in the datastore and listed at /expansions with the admin token (0 has queries fetch indexes themselves)",
+							},
+							&cli.DurationFlag{
+								Name:  "index-expansion-wait",
+								Value: service.DefaultIndexExpansionWait,
+								Usage: "how long a query waits for the expansion of an index before going on without it",
+							},
+							&cli.DurationFlag{
+								Name:  "dead-letter-max-age",
+								Value: deadletter.DefaultMaxAge,
+								Usage: "how long failed background cache writes are retried for before they are dropped",
+							},
+							&cli.BoolFlag{
+								Name:  "audit-log",
+								Usage: "keep an audit trail of publishes, caches and provider removals in the datastore, readable at /audit with the admin token",
+							},
+							&cli.StringFlag{
+								Name:  "audit-log-file",
+								Usage: "file to append audit entries to as JSON lines",
+							},
+							&cli.StringFlag{
+								Name:  "cache-events-file",
+								Usage: "file to append the events of the caches to as JSON lines, with keys hashed, for analyzing the caches offline",
+							},
+							&cli.StringFlag{
+								Name:  "self-check-url",
+								Usage: "URL with {claim} in its path that the canary's synthetic claims are advertised at; the canary only runs self checks if set",
+							},
+							&cli.DurationFlag{
+								Name:  "self-check-interval",
+								Usage: "how often the canary runs a self check (10m if not set)",
+							},
+							&cli.DurationFlag{
+								Name:  "self-check-ipni-wait",
+								Usage: "how long the canary's self checks wait for IPNI to ingest their claims (the IPNI stage is skipped if not set)",
+							},
+							&cli.IntFlag{
+								Name:  "max-in-flight-queries",
+								Usage: "number of queries in flight beyond which expensive queries are shed (0 for unlimited)",
+							},
+							&cli.DurationFlag{
+								Name:  "max-query-p95",
+								Usage: "p95 query duration beyond which expensive queries are shed (0 for unlimited)",
+							},
+							&cli.Float64Flag{
+								Name:  "shard-filter-fp-rate",
+								Usage: "false positive rate of the shard filters cached for large indexes (0 to not use shard filters)",
+							},
+							&cli.IntFlag{
+								Name:  "max-response-size",
+								Usage: "approximate maximum size in bytes of a query response, beyond which results are split (0 for unlimited)",
+							},
+							&cli.IntFlag{
+								Name:  "continuation-cache-size",
+								Value: server.DefaultContinuationCacheSize,
+								Usage: "most bytes of split query results kept for their continuations, beyond which the least recently used are evicted",
+							},
+							&cli.StringFlag{
+								Name:    "admin-token",
+								EnvVars: []string{"ADMIN_TOKEN"},
+								Usage:   "bearer token authorizing the admin endpoints, which are disabled if not set",
+							},
+							&cli.StringSliceFlag{
+								Name:  "webhook-url",
+								Usage: "URL notified with a JSON event for every published or cached claim (may be repeated)",
+							},
+							&cli.StringFlag{
+								Name:    "webhook-secret",
+								EnvVars: []string{"WEBHOOK_SECRET"},
+								Usage:   "secret used to sign webhook request bodies",
+							},
+							&cli.StringSliceFlag{
+								Name:  "context-id-hash",
+								Usage: "multihash function context IDs are derived with, e.g. sha2-256. The first is used for publishing, and all are matched when filtering by space (may be repeated)",
+							},
+							&cli.StringFlag{
+								Name:    "context-id-key",
+								EnvVars: []string{"CONTEXT_ID_KEY"},
+								Usage:   "base64 encoded secret of at least 32 bytes context IDs are derived with, so that spaces can't be recovered from published advertisements. Context IDs derived with the context ID hash functions are still matched when filtering by space",
+							},
+							&cli.StringSliceFlag{
+								Name:    "previous-context-id-key",
+								EnvVars: []string{"PREVIOUS_CONTEXT_ID_KEYS"},
+								Usage:   "base64 encoded context ID key rotated out, still matched when filtering by space until it is dropped (may be repeated)",
+							},
+							&cli.StringFlag{
+								Name:    "publisher-key",
+								EnvVars: []string{"PUBLISHER_KEY"},
+								Usage:   "base64 encoded libp2p private key advertisements are signed with. Advertisements are not published if not set",
+							},
+							&cli.BoolFlag{
+								Name:  "sign-results",
+								Usage: "sign receipts for the results of queries asking to attest them with the publisher key, which must be an Ed25519 key",
+							},
+							&cli.BoolFlag{
+								Name:  "reconstruct-indexes",
+								Usage: "allow lost indexes to be reconstructed by scanning the shards they index, republishing them with the publisher key if it is an Ed25519 key",
+							},
+							&cli.Uint64Flag{
+								Name:  "max-reconstruct-shard-size",
+								Value: service.DefaultMaxShardSize,
+								Usage: "size in bytes of the largest shard scanned to reconstruct an index",
+							},
+							&cli.StringSliceFlag{
+								Name:  "reconstruct-index",
+								Usage: "index=shard CIDs of a shard of an index reconstructed in the background when the index can't be fetched (may be repeated)",
+							},
+							&cli.StringSliceFlag{
+								Name:  "publisher-addr",
+								Usage: "multiaddr advertisements can be fetched from, sent with every announcement (may be repeated)",
+							},
+							&cli.StringSliceFlag{
+								Name:  "claim-addr",
+								Usage: "multiaddr with a {claim} path that claims published or cached through the service are fetched from (may be repeated)",
+							},
+							&cli.StringSliceFlag{
+								Name:  "announce-url",
+								Usage: "HTTP announce endpoint of an indexer published advertisements are announced to (may be repeated)",
+							},
+							&cli.StringSliceFlag{
+								Name:  "required-announce-url",
+								Usage: "announce endpoint that must confirm an advertisement for it to count as announced under the all-required policy (may be repeated)",
+							},
+							&cli.StringFlag{
+								Name:  "announce-policy",
+								Value: "any",
+								Usage: "when an advertisement counts as announced: once \"any\" endpoint confirms it, or once \"all-required\" endpoints do",
+							},
+							&cli.StringSliceFlag{
+								Name:  "announce-route",
+								Usage: "kind=url announcing advertisements carrying claims of the kind (equals, index or location, or default for the rest) to the announce URL, or to none if the URL is empty (may be repeated)",
+							},
+							&cli.StringSliceFlag{
+								Name:  "lag-check-url",
+								Usage: "base URL of an indexer checked for how far behind the head of the advertisement chain it is (may be repeated)",
+							},
+							&cli.IntFlag{
+								Name:  "max-advertisement-lag",
+								Value: publisher.DefaultMaxLag,
+								Usage: "number of advertisements an indexer may be behind the head of the chain before the service reports it as lagging",
+							},
+							&cli.DurationFlag{
+								Name:  "lag-check-interval",
+								Value: publisher.DefaultLagCheckInterval,
+								Usage: "how often indexers are checked for advertisement lag",
+							},
+							&cli.DurationFlag{
+								Name:  "probe-budget",
+								Value: liveness.DefaultBudget,
+								Usage: "how long the liveness probes of the location URLs of a query asking for them may take altogether",
+							},
+							&cli.StringFlag{
+								Name:  "region",
+								Usage: "name of the region this service runs in, required for replication",
+							},
+							&cli.StringSliceFlag{
+								Name:  "replication-peer",
+								Usage: "base URL of an indexing service in another region that published cache writes are replicated to (may be repeated)",
+							},
+							&cli.StringFlag{
+								Name:    "replication-token",
+								EnvVars: []string{"REPLICATION_TOKEN"},
+								Usage:   "bearer token authorizing replication between regions, which is disabled if not set",
+							},
+							&cli.StringFlag{
+								Name:  "shadow-url",
+								Usage: "base URL of a secondary indexing service that published cache writes are copied to and sampled queries are compared with, for validating a migration",
+							},
+							&cli.StringFlag{
+								Name:    "shadow-token",
+								EnvVars: []string{"SHADOW_TOKEN"},
+								Usage:   "bearer token authorizing writes copied to the secondary indexing service",
+							},
+							&cli.Float64Flag{
+								Name:  "shadow-read-rate",
+								Usage: "share of queries, from 0 to 1, also run against the secondary indexing service to compare results",
+							},
+							&cli.Float64Flag{
+								Name:  "sync-rate-limit",
+								Usage: "hashes per second whose provider records are fetched when syncing from another indexing service, unlimited if not set",
+							},
+							&cli.BoolFlag{
+								Name:  "allow-private-addresses",
+								Usage: "fetch claims and indexes from providers at loopback, link-local and private addresses, for development",
+							},
+							&cli.StringSliceFlag{
+								Name:  "allowed-address-range",
+								Usage: "CIDR range claims and indexes may be fetched from even though it is not publicly routable (may be repeated)",
+							},
+							&cli.StringFlag{
+								Name:  "doh-endpoint",
+								Usage: "DNS-over-HTTPS endpoint to resolve provider addresses with, instead of the system resolver",
+							},
+							&cli.IntFlag{
+								Name:  "max-conns-per-host",
+								Value: httppool.DefaultMaxConnsPerHost,
+								Usage: "number of connections that may be open to a provider or indexer at once, or -1 for unlimited",
+							},
+							&cli.IntFlag{
+								Name:  "max-idle-conns-per-host",
+								Value: httppool.DefaultMaxIdleConnsPerHost,
+								Usage: "number of idle connections kept open to a provider or indexer",
+							},
+							&cli.DurationFlag{
+								Name:  "idle-conn-timeout",
+								Value: httppool.DefaultIdleConnTimeout,
+								Usage: "how long idle connections to providers and indexers are kept open",
+							},
+							&cli.BoolFlag{
+								Name:  "disable-http2",
+								Usage: "stop HTTP/2 being negotiated with providers and indexers",
+							},
+							&cli.BoolFlag{
+								Name:  "disable-host-cooldowns",
+								Usage: "keep sending requests to providers and indexers that throttle or fail repeatedly, rather than leaving them alone for a while",
+							},
+							&cli.DurationFlag{
+								Name:  "max-host-cooldown",
+								Value: httppool.DefaultMaxCooldown,
+								Usage: "longest a provider or indexer is left alone for, however long it asks for with Retry-After",
+							},
+							&cli.StringSliceFlag{
+								Name:  "provider-host-limit",
+								Usage: "host=n limit of requests in flight at once to a provider host known to throttle (may be repeated)",
+							},
+							&cli.StringFlag{
+								Name:  "http-proxy",
+								Usage: "URL of the proxy outbound requests to providers, indexers and the DoH endpoint are sent through, with any credentials it requires",
+							},
+							&cli.StringSliceFlag{
+								Name:  "proxy-rule",
+								Usage: "pattern=proxy rule sending requests to hosts matching the pattern (a host, *.domain or *) through another proxy URL, or \"direct\" to connect directly, the first match winning (may be repeated)",
+							},
+							&cli.BoolFlag{
+								Name:  "hedge-fetches",
+								Usage: "fetch claims and indexes from the next URL as well when a fetch is slow, using whichever completes first",
+							},
+							&cli.DurationFlag{
+								Name:  "hedge-delay",
+								Usage: "how long a fetch is given before it is hedged (0 hedges after the p95 of recent fetches from the host)",
+							},
+							&cli.IntFlag{
+								Name:  "max-hedges-per-query",
+								Value: service.DefaultMaxHedges,
+								Usage: "number of hedged fetches a query may launch",
+							},
+							&cli.IntFlag{
+								Name:  "max-claim-proof-depth",
+								Value: claimlookup.DefaultMaxProofDepth,
+								Usage: "deepest chain of proofs a fetched or imported claim may have",
+							},
+							&cli.IntFlag{
+								Name:  "max-claim-size",
+								Value: claimlookup.DefaultMaxClaimSize,
+								Usage: "most bytes of a fetched or imported claim and its proofs",
+							},
+							&cli.IntFlag{
+								Name:  "max-claim-capabilities",
+								Value: claimlookup.DefaultMaxCapabilities,
+								Usage: "most capabilities of any delegation of a fetched or imported claim",
+							},
+							&cli.Int64Flag{
+								Name:  "claim-cache-budget",
+								Usage: "size in bytes of the claim cache, past which fetched claims are only cached once requested often, or 0 to cache every fetched claim",
+							},
+							&cli.IntFlag{
+								Name:  "claim-admission-threshold",
+								Value: claimlookup.DefaultAdmissionThreshold,
+								Usage: "estimated requests for a claim after which it is cached with the claim cache budget full",
+							},
+							&cli.DurationFlag{
+								Name:  "claim-validation-timeout",
+								Value: claimlookup.DefaultValidationTimeout,
+								Usage: "how long checking a fetched or imported claim against the limits may take",
+							},
+							&cli.DurationFlag{
+								Name:  "clock-skew-tolerance",
+								Usage: "how far the clocks of claim issuers may be off from ours when checking claim expirations",
+							},
+							&cli.BoolFlag{
+								Name:  "strict-metadata",
+								Usage: "leave out location commitments whose provider record range or shard disagrees with the claim, rather than following the claim",
+							},
+							&cli.StringFlag{
+								Name:  "advertised-filter",
+								Value: "off",
+								Usage: "keep a filter of every hash advertised, and on a miss either only record it (\"advisory\") or skip asking IPNI and legacy systems (\"authoritative\"), or \"off\"",
+							},
+							&cli.IntFlag{
+								Name:  "advertised-filter-capacity",
+								Value: publisher.DefaultAdvertisedFilterCapacity,
+								Usage: "number of hashes the first stage of the advertised filter holds before it grows",
+							},
+							&cli.Float64Flag{
+								Name:  "advertised-filter-fp-rate",
+								Value: publisher.DefaultAdvertisedFilterFalsePositiveRate,
+								Usage: "rate the advertised filter stays under of reporting a hash that was never advertised",
+							},
+							&cli.BoolFlag{
+								Name:  "prometheus-metrics",
+								Usage: "serve metrics for scraping in the Prometheus format at /metrics",
+							},
+							&cli.IntFlag{
+								Name:  "prometheus-provider-buckets",
+								Usage: "label claim fetch metrics with one of this many buckets providers are hashed into (0 omits the label)",
+							},
 						},
 						Action: func(cCtx *cli.Context) error {
 							addr := fmt.Sprintf(":%d", cCtx.Int("port"))
@@ -106,10 +506,237 @@ func main() {
 							var sc service.ServiceConfig
 							sc.RedisURL = cCtx.String("redis-url")
 							sc.RedisPasswd = cCtx.String("redis-passwd")
+							sc.RedisReplicaURL = cCtx.String("redis-replica-url")
 							sc.ProvidersDB = cCtx.Int("providers-redis-db")
 							sc.ClaimsDB = cCtx.Int("claims-redis-db")
 							sc.IndexesDB = cCtx.Int("indexes-redis-db")
+							sc.SpacesDB = cCtx.Int("spaces-redis-db")
 							sc.IndexerURL = cCtx.String("ipni-endpoint")
+							sc.CacheTTLJitter = cCtx.Float64("cache-ttl-jitter")
+							sc.DisableLocationCacheWarming = cCtx.Bool("disable-location-cache-warming")
+							sc.PrefetchShards = cCtx.Int("prefetch-shards")
+							sc.MaxIndexDepth = cCtx.Int("max-index-depth")
+							sc.BindSpaceCommitments = cCtx.Bool("bind-space-commitments")
+							sc.SpaceBindingWindow = cCtx.Duration("space-binding-window")
+							sc.RecentResults = cCtx.Int("recent-results")
+							sc.RecentResultsTTL = cCtx.Duration("recent-results-ttl")
+							sc.MaxFindRecords = cCtx.Int("max-find-records")
+							sc.ResultCache = cCtx.Int("result-cache")
+							sc.ResultCacheTTL = cCtx.Duration("result-cache-ttl")
+							sc.RecordContainingIndexes = cCtx.Bool("record-containing-indexes")
+							sc.MaxContainingIndexes = cCtx.Int("max-containing-indexes")
+							sc.IndexCachingConcurrency = cCtx.Int("index-caching-concurrency")
+							sc.IndexCachingBuffer = cCtx.Int("index-caching-buffer")
+							sc.IndexExpansionWorkers = cCtx.Int("index-expansion-workers")
+							sc.IndexExpansionWait = cCtx.Duration("index-expansion-wait")
+							sc.DeadLetterMaxAge = cCtx.Duration("dead-letter-max-age")
+							sc.AuditLog = cCtx.Bool("audit-log")
+							sc.AuditLogFile = cCtx.String("audit-log-file")
+							sc.CacheEventsFile = cCtx.String("cache-events-file")
+							sc.SelfCheckURL = cCtx.String("self-check-url")
+							sc.SelfCheckInterval = cCtx.Duration("self-check-interval")
+							sc.SelfCheckIPNIWait = cCtx.Duration("self-check-ipni-wait")
+							sc.MaxInFlightQueries = cCtx.Int("max-in-flight-queries")
+							sc.MaxQueryP95 = cCtx.Duration("max-query-p95")
+							sc.ShardFilterFalsePositiveRate = cCtx.Float64("shard-filter-fp-rate")
+							sc.WebhookURLs = cCtx.StringSlice("webhook-url")
+							sc.WebhookSecret = cCtx.String("webhook-secret")
+							if names := cCtx.StringSlice("context-id-hash"); len(names) > 0 {
+								schemes := make([]types.ContextIDCodec, 0, len(names))
+								for _, name := range names {
+									code, ok := multihash.Names[name]
+									if !ok {
+										return fmt.Errorf("unknown context ID hash function: %s", name)
+									}
+									schemes = append(schemes, types.NewMultihashContextIDCodec(code))
+								}
+								sc.ContextIDCodec = types.NewMultiContextIDCodec(schemes[0], schemes[1:]...)
+							}
+							if encodedKey := cCtx.String("context-id-key"); encodedKey != "" {
+								key, err := base64.StdEncoding.DecodeString(encodedKey)
+								if err != nil {
+									return fmt.Errorf("decoding context ID key: %w", err)
+								}
+								var previous [][]byte
+								for _, encoded := range cCtx.StringSlice("previous-context-id-key") {
+									k, err := base64.StdEncoding.DecodeString(encoded)
+									if err != nil {
+										return fmt.Errorf("decoding previous context ID key: %w", err)
+									}
+									previous = append(previous, k)
+								}
+								keyed, err := types.NewKeyedContextIDCodec(key, previous...)
+								if err != nil {
+									return fmt.Errorf("creating keyed context ID scheme: %w", err)
+								}
+								// plainly derived records are still matched during the transition
+								plain := sc.ContextIDCodec
+								if plain == nil {
+									plain = types.DefaultContextIDCodec
+								}
+								sc.ContextIDCodec = types.NewMultiContextIDCodec(keyed, plain)
+							}
+							sc.AllowPrivateAddresses = cCtx.Bool("allow-private-addresses")
+							sc.DoHEndpoint = cCtx.String("doh-endpoint")
+							for _, r := range cCtx.StringSlice("allowed-address-range") {
+								prefix, err := netip.ParsePrefix(r)
+								if err != nil {
+									return fmt.Errorf("parsing allowed address range: %w", err)
+								}
+								sc.AllowedAddressRanges = append(sc.AllowedAddressRanges, prefix)
+							}
+							if cCtx.String("publisher-key") != "" {
+								data, err := base64.StdEncoding.DecodeString(cCtx.String("publisher-key"))
+								if err != nil {
+									return fmt.Errorf("decoding publisher key: %w", err)
+								}
+								sc.PublisherKey, err = crypto.UnmarshalPrivateKey(data)
+								if err != nil {
+									return fmt.Errorf("parsing publisher key: %w", err)
+								}
+							}
+							sc.SignResults = cCtx.Bool("sign-results")
+							sc.ReconstructIndexes = cCtx.Bool("reconstruct-indexes")
+							sc.MaxReconstructShardSize = cCtx.Uint64("max-reconstruct-shard-size")
+							for _, r := range cCtx.StringSlice("reconstruct-index") {
+								index, shard, ok := strings.Cut(r, "=")
+								if !ok {
+									return fmt.Errorf("parsing reconstructed index: %q is not index=shard", r)
+								}
+								indexCid, err := cid.Parse(index)
+								if err != nil {
+									return fmt.Errorf("parsing reconstructed index: %w", err)
+								}
+								shardCid, err := cid.Parse(shard)
+								if err != nil {
+									return fmt.Errorf("parsing reconstructed index shard: %w", err)
+								}
+								if sc.ReconstructOnFetchFailure == nil {
+									sc.ReconstructOnFetchFailure = map[cid.Cid][]cid.Cid{}
+								}
+								sc.ReconstructOnFetchFailure[indexCid] = append(sc.ReconstructOnFetchFailure[indexCid], shardCid)
+							}
+							for _, addr := range cCtx.StringSlice("publisher-addr") {
+								ma, err := multiaddr.NewMultiaddr(addr)
+								if err != nil {
+									return fmt.Errorf("parsing publisher address: %w", err)
+								}
+								sc.PublisherAddrs = append(sc.PublisherAddrs, ma)
+							}
+							for _, addr := range cCtx.StringSlice("claim-addr") {
+								ma, err := multiaddr.NewMultiaddr(addr)
+								if err != nil {
+									return fmt.Errorf("parsing claim address: %w", err)
+								}
+								sc.ClaimAddrs = append(sc.ClaimAddrs, ma)
+							}
+							sc.AnnounceURLs = cCtx.StringSlice("announce-url")
+							sc.RequiredAnnounceURLs = cCtx.StringSlice("required-announce-url")
+							for _, r := range cCtx.StringSlice("announce-route") {
+								kind, u, ok := strings.Cut(r, "=")
+								if !ok {
+									return fmt.Errorf("parsing announce route: %q is not kind=url", r)
+								}
+								if kind == "default" {
+									if u != "" {
+										sc.AnnounceRoutes.Default = append(sc.AnnounceRoutes.Default, u)
+									}
+									continue
+								}
+								if sc.AnnounceRoutes.Kinds == nil {
+									sc.AnnounceRoutes.Kinds = map[string][]string{}
+								}
+								urls := sc.AnnounceRoutes.Kinds[kind]
+								if urls == nil {
+									urls = []string{}
+								}
+								if u != "" {
+									urls = append(urls, u)
+								}
+								sc.AnnounceRoutes.Kinds[kind] = urls
+							}
+							if err := sc.AnnounceRoutes.Validate(); err != nil {
+								return err
+							}
+							sc.LagCheckURLs = cCtx.StringSlice("lag-check-url")
+							sc.MaxAdvertisementLag = cCtx.Int("max-advertisement-lag")
+							sc.LagCheckInterval = cCtx.Duration("lag-check-interval")
+							sc.ProbeBudget = cCtx.Duration("probe-budget")
+							sc.MaxConnsPerHost = cCtx.Int("max-conns-per-host")
+							sc.MaxIdleConnsPerHost = cCtx.Int("max-idle-conns-per-host")
+							sc.IdleConnTimeout = cCtx.Duration("idle-conn-timeout")
+							sc.DisableHTTP2 = cCtx.Bool("disable-http2")
+							sc.DisableHostCooldowns = cCtx.Bool("disable-host-cooldowns")
+							sc.MaxHostCooldown = cCtx.Duration("max-host-cooldown")
+							for _, l := range cCtx.StringSlice("provider-host-limit") {
+								host, n, ok := strings.Cut(l, "=")
+								limit, err := strconv.Atoi(n)
+								if !ok || err != nil || limit <= 0 {
+									return fmt.Errorf("parsing provider host limit: %q is not host=n", l)
+								}
+								if sc.ProviderHostLimits == nil {
+									sc.ProviderHostLimits = map[string]int{}
+								}
+								sc.ProviderHostLimits[host] = limit
+							}
+							if proxy := cCtx.String("http-proxy"); proxy != "" {
+								u, err := httppool.ParseProxyURL(proxy)
+								if err != nil {
+									return err
+								}
+								sc.HTTPProxy = u
+							}
+							for _, r := range cCtx.StringSlice("proxy-rule") {
+								rule, err := httppool.ParseProxyRule(r)
+								if err != nil {
+									return err
+								}
+								sc.ProxyRules = append(sc.ProxyRules, rule)
+							}
+							sc.HedgeFetches = cCtx.Bool("hedge-fetches")
+							sc.HedgeDelay = cCtx.Duration("hedge-delay")
+							sc.MaxHedgesPerQuery = cCtx.Int("max-hedges-per-query")
+							sc.ClaimLimits = claimlookup.Limits{
+								MaxProofDepth:   cCtx.Int("max-claim-proof-depth"),
+								MaxSize:         cCtx.Int("max-claim-size"),
+								MaxCapabilities: cCtx.Int("max-claim-capabilities"),
+								Timeout:         cCtx.Duration("claim-validation-timeout"),
+							}
+							sc.ClaimCacheBudget = cCtx.Int64("claim-cache-budget")
+							sc.ClaimAdmissionThreshold = cCtx.Int("claim-admission-threshold")
+							sc.ClockSkewTolerance = cCtx.Duration("clock-skew-tolerance")
+							sc.StrictMetadata = cCtx.Bool("strict-metadata")
+							switch cCtx.String("advertised-filter") {
+							case "off":
+							case "advisory":
+								sc.AdvertisedFilter, sc.AdvertisedFilterMode = true, providerindex.FilterAdvisory
+							case "authoritative":
+								sc.AdvertisedFilter, sc.AdvertisedFilterMode = true, providerindex.FilterAuthoritative
+							default:
+								return fmt.Errorf("unknown advertised filter mode: %s", cCtx.String("advertised-filter"))
+							}
+							sc.AdvertisedFilterCapacity = cCtx.Int("advertised-filter-capacity")
+							sc.AdvertisedFilterFalsePositiveRate = cCtx.Float64("advertised-filter-fp-rate")
+							if cCtx.Bool("prometheus-metrics") {
+								sc.PrometheusMetrics = prommetrics.New(prommetrics.WithProviderBuckets(cCtx.Int("prometheus-provider-buckets")))
+							}
+							switch cCtx.String("announce-policy") {
+							case "any":
+								sc.AnnouncePolicy = publisher.AnnounceAny
+							case "all-required":
+								sc.AnnouncePolicy = publisher.AnnounceAllRequired
+							default:
+								return fmt.Errorf("unknown announce policy: %s", cCtx.String("announce-policy"))
+							}
+							if cCtx.String("replication-token") != "" {
+								sc.Region = cCtx.String("region")
+								sc.ReplicationPeers = cCtx.StringSlice("replication-peer")
+								sc.ReplicationToken = cCtx.String("replication-token")
+							}
+							sc.ShadowURL = cCtx.String("shadow-url")
+							sc.ShadowToken = cCtx.String("shadow-token")
+							sc.ShadowReadRate = cCtx.Float64("shadow-read-rate")
+							sc.SyncRateLimit = cCtx.Float64("sync-rate-limit")
 							indexingService, shutdown, err := service.Construct(sc)
 							if err != nil {
 								return err
@@ -118,11 +745,22 @@ func main() {
 								shutdown(cCtx.Context)
 							}()
 							opts = append(opts, server.WithService(indexingService))
+							if cCtx.Int("max-response-size") > 0 {
+								opts = append(opts, server.WithMaxResponseSize(cCtx.Int("max-response-size")))
+							}
+							opts = append(opts, server.WithContinuationCacheSize(cCtx.Int("continuation-cache-size")))
+							if cCtx.String("admin-token") != "" {
+								opts = append(opts, server.WithAdminToken(cCtx.String("admin-token")))
+							}
+							if sc.ReplicationToken != "" {
+								opts = append(opts, server.WithReplicationToken(sc.ReplicationToken))
+							}
 							return server.ListenAndServe(addr, opts...)
 						},
 					},
 				},
 			},
+			indexctlCommand,
 		},
 	}
 
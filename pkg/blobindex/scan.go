@@ -0,0 +1,139 @@
+package blobindex
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/multiformats/go-multicodec"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+	"github.com/storacha/go-ucanto/core/ipld"
+)
+
+// maxCARHeaderSize limits the size in bytes of the header of a scanned CAR
+const maxCARHeaderSize = 1 << 20
+
+// ErrShardDigestMismatch is returned from FromShard when the bytes read don't
+// hash to the shard's multihash, such as when the shard is truncated at the end
+// of a block
+var ErrShardDigestMismatch = errors.New("shard digest mismatch")
+
+// FromShard creates a sharded DAG index of the blocks in a CAR shard, read from
+// the reader one block header at a time, so that neither the shard nor its
+// blocks are held in memory. Every byte read must hash to the shard's
+// multihash. If content is nil, the index is for the first root of the CAR, or
+// the shard itself if it has none
+func FromShard(r io.Reader, shard mh.Multihash, content ipld.Link) (ShardedDagIndexView, error) {
+	decoded, err := mh.Decode(shard)
+	if err != nil {
+		return nil, fmt.Errorf("decoding shard multihash: %w", err)
+	}
+	hasher, err := mh.GetHasher(decoded.Code)
+	if err != nil {
+		return nil, fmt.Errorf("hashing shard: %w", err)
+	}
+	br := bufio.NewReader(io.TeeReader(r, hasher))
+
+	roots, offset, err := readCARHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if content == nil {
+		content = cidlink.Link{Cid: cid.NewCidV1(uint64(multicodec.Car), shard)}
+		if len(roots) > 0 {
+			content = cidlink.Link{Cid: roots[0]}
+		}
+	}
+	index := NewShardedDagIndexView(content, 1)
+	for {
+		size, err := varint.ReadUvarint(br)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading block at %d: %w", offset, unexpectedEOF(err))
+		}
+		n, c, err := cid.CidFromReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("reading block CID at %d: %w", offset, unexpectedEOF(err))
+		}
+		if uint64(n) > size {
+			return nil, fmt.Errorf("reading block at %d: CID longer than the block", offset)
+		}
+		length := size - uint64(n)
+		if _, err := io.CopyN(io.Discard, br, int64(length)); err != nil {
+			return nil, fmt.Errorf("reading block %s at %d: %w", c, offset, unexpectedEOF(err))
+		}
+		index.SetSlice(shard, c.Hash(), Position{Offset: offset + uint64(varint.UvarintSize(size)+n), Length: length})
+		offset += uint64(varint.UvarintSize(size)) + size
+	}
+	sum := hasher.Sum(nil)
+	digest, err := mh.Encode(sum[:min(decoded.Length, len(sum))], decoded.Code)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(digest, shard) {
+		return nil, fmt.Errorf("%w: read %d bytes hashing to %s", ErrShardDigestMismatch, offset, mh.Multihash(digest).B58String())
+	}
+	return index, nil
+}
+
+// readCARHeader reads the header of a CARv1, returning its roots and its size
+func readCARHeader(br *bufio.Reader) ([]cid.Cid, uint64, error) {
+	size, err := varint.ReadUvarint(br)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading CAR header: %w", unexpectedEOF(err))
+	}
+	if size == 0 || size > maxCARHeaderSize {
+		return nil, 0, fmt.Errorf("reading CAR header: invalid size %d", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return nil, 0, fmt.Errorf("reading CAR header: %w", unexpectedEOF(err))
+	}
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := dagcbor.Decode(nb, bytes.NewReader(data)); err != nil {
+		return nil, 0, fmt.Errorf("decoding CAR header: %w", err)
+	}
+	header := nb.Build()
+	version, err := header.LookupByString("version")
+	if err != nil {
+		return nil, 0, fmt.Errorf("decoding CAR header: %w", err)
+	}
+	if v, err := version.AsInt(); err != nil || v != 1 {
+		return nil, 0, fmt.Errorf("decoding CAR header: unsupported version")
+	}
+	var roots []cid.Cid
+	if list, err := header.LookupByString("roots"); err == nil {
+		for it := list.ListIterator(); it != nil && !it.Done(); {
+			_, root, err := it.Next()
+			if err != nil {
+				return nil, 0, fmt.Errorf("decoding CAR header: %w", err)
+			}
+			link, err := root.AsLink()
+			if err != nil {
+				return nil, 0, fmt.Errorf("decoding CAR header: %w", err)
+			}
+			if cl, ok := link.(cidlink.Link); ok {
+				roots = append(roots, cl.Cid)
+			}
+		}
+	}
+	return roots, uint64(varint.UvarintSize(size)) + size, nil
+}
+
+// unexpectedEOF reports the end of the shard part way through a header or block
+// as such
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
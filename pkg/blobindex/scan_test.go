@@ -0,0 +1,95 @@
+package blobindex_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+	"github.com/storacha/go-ucanto/core/car"
+	"github.com/storacha/go-ucanto/core/ipld/block"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/stretchr/testify/require"
+)
+
+// multiBlockCAR returns a CAR of blocks of the given sizes, rooted at the first
+func multiBlockCAR(t *testing.T, sizes ...int) []byte {
+	var blocks []block.Block
+	for _, size := range sizes {
+		data := randomBytes(size)
+		c, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: mh.SHA2_256, MhLength: -1}.Sum(data)
+		require.NoError(t, err)
+		blocks = append(blocks, block.NewBlock(cidlink.Link{Cid: c}, data))
+	}
+	r := car.Encode([]datamodel.Link{blocks[0].Link()}, func(yield func(block.Block, error) bool) {
+		for _, b := range blocks {
+			if !yield(b, nil) {
+				return
+			}
+		}
+	})
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return data
+}
+
+func TestFromShard(t *testing.T) {
+	shard := multiBlockCAR(t, 10, 300, 1, 70000, 128)
+	digest, err := mh.Sum(shard, mh.SHA2_256, -1)
+	require.NoError(t, err)
+	roots, _, err := car.Decode(bytes.NewReader(shard))
+	require.NoError(t, err)
+	want, err := blobindex.FromShardArchives(roots[0], [][]byte{shard})
+	require.NoError(t, err)
+
+	t.Run("matches the index of the whole shard", func(t *testing.T) {
+		// a byte at a time, as a slow stream would be read
+		index, err := blobindex.FromShard(iotest.OneByteReader(bytes.NewReader(shard)), digest, nil)
+		require.NoError(t, err)
+		require.Equal(t, roots[0], index.Content())
+		require.Equal(t, 1, index.Shards().Size())
+		got := index.Shards().Get(digest)
+		require.NotNil(t, got)
+		require.Equal(t, want.Shards().Get(digest).Size(), got.Size())
+		for slice, position := range want.Shards().Get(digest).Iterator() {
+			require.Equal(t, position, got.Get(slice))
+			// positions are of the bytes of the block
+			sum, err := mh.Sum(shard[position.Offset:position.Offset+position.Length], mh.SHA2_256, -1)
+			require.NoError(t, err)
+			require.Equal(t, slice, sum)
+		}
+	})
+
+	t.Run("content can be given", func(t *testing.T) {
+		content := randomCID()
+		index, err := blobindex.FromShard(bytes.NewReader(shard), digest, content)
+		require.NoError(t, err)
+		require.Equal(t, content, index.Content())
+	})
+
+	t.Run("truncated shards fail", func(t *testing.T) {
+		// part way through the last block
+		_, err := blobindex.FromShard(bytes.NewReader(shard[:len(shard)-10]), digest, nil)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		// at the end of a block, which only the digest catches
+		last := want.Shards().Get(digest).Get(roots[0].(cidlink.Link).Cid.Hash())
+		end := last.Offset + last.Length
+		_, err = blobindex.FromShard(bytes.NewReader(shard[:end]), digest, nil)
+		require.ErrorIs(t, err, blobindex.ErrShardDigestMismatch)
+		// part way through the header
+		_, err = blobindex.FromShard(bytes.NewReader(shard[:varint.UvarintSize(uint64(len(shard)))+2]), digest, nil)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+
+	t.Run("other bytes fail", func(t *testing.T) {
+		_, err := blobindex.FromShard(bytes.NewReader(multiBlockCAR(t, 10, 20)), digest, nil)
+		require.ErrorIs(t, err, blobindex.ErrShardDigestMismatch)
+		_, err = blobindex.FromShard(bytes.NewReader(randomBytes(100)), digest, nil)
+		require.Error(t, err)
+	})
+}
@@ -19,7 +19,8 @@ import (
 	dm "github.com/storacha/indexing-service/pkg/blobindex/datamodel"
 )
 
-// ExtractError is a union type of UnknownFormatError and DecodeFailureErorr
+// ExtractError is a union type of UnknownFormatError, DecodeFailureErorr and
+// ErrUnsupportedIndexVersion
 type ExtractError interface {
 	error
 	isExtractError()
@@ -64,11 +65,27 @@ func decodeCar(r io.Reader) (decodedCar, error) {
 	return decodedCar{roots[0], blockMap}, nil
 }
 
+// View reads a sharded dag index from its root and the blocks it links to, with
+// the decoder of its version. Indexes of versions that can't be read fail with
+// ErrUnsupportedIndexVersion
 func View(root ipld.Link, blockMap map[ipld.Link]ipld.Block) (ShardedDagIndexView, ExtractError) {
 	rootBlock, ok := blockMap[root]
 	if !ok {
 		return nil, NewDecodeFailureError(fmt.Errorf("missing root block: %s", root))
 	}
+	version, verr := indexVersion(rootBlock)
+	if verr != nil {
+		return nil, verr
+	}
+	decode, ok := decoders[version]
+	if !ok {
+		return nil, NewUnsupportedIndexVersionError(version)
+	}
+	return decode(rootBlock, blockMap)
+}
+
+// viewV0_1 decodes a version 0.1 sharded dag index
+func viewV0_1(rootBlock ipld.Block, blockMap map[ipld.Link]ipld.Block) (ShardedDagIndexView, ExtractError) {
 	var shardedDagIndexData dm.ShardedDagIndexModel
 	err := cbor.Decode(rootBlock.Bytes(), &shardedDagIndexData, dm.ShardedDagIndexSchema())
 	if err != nil {
@@ -77,7 +94,7 @@ func View(root ipld.Link, blockMap map[ipld.Link]ipld.Block) (ShardedDagIndexVie
 	if shardedDagIndexData.DagO_1 == nil {
 		return nil, NewUnknownFormatError(fmt.Errorf("unknown index version"))
 	}
-	dagIndex := NewShardedDagIndexView(root, len(shardedDagIndexData.DagO_1.Shards))
+	dagIndex := &shardedDagIndex{shardedDagIndexData.DagO_1.Content, NewMultihashMap[MultihashMap[Position]](len(shardedDagIndexData.DagO_1.Shards)), nil}
 	for _, shardLink := range shardedDagIndexData.DagO_1.Shards {
 		shard, ok := blockMap[shardLink]
 		if !ok {
@@ -92,6 +109,7 @@ func View(root ipld.Link, blockMap map[ipld.Link]ipld.Block) (ShardedDagIndexVie
 			blobIndex.Set(blobSlice.Multihash, blobSlice.Position)
 		}
 		dagIndex.Shards().Set(blobIndexData.Multihash, blobIndex)
+		dagIndex.order = append(dagIndex.order, blobIndexData.Multihash)
 	}
 	return dagIndex, nil
 }
@@ -99,13 +117,33 @@ func View(root ipld.Link, blockMap map[ipld.Link]ipld.Block) (ShardedDagIndexVie
 type shardedDagIndex struct {
 	content ipld.Link
 	shards  MultihashMap[MultihashMap[Position]]
+	// order is the order the shards were read in, for an extracted index
+	order []mh.Multihash
 }
 
 // NewShardedDagIndexView constructs an empty ShardedDagIndexView
 //   - content sets the content link
 //     -- shardSizeHint is used to preallocate the number of shards that will be used. Set to -1 for unknown
 func NewShardedDagIndexView(content ipld.Link, shardSizeHint int) ShardedDagIndexView {
-	return &shardedDagIndex{content, NewMultihashMap[MultihashMap[Position]](shardSizeHint)}
+	return &shardedDagIndex{content, NewMultihashMap[MultihashMap[Position]](shardSizeHint), nil}
+}
+
+// ShardOrder returns the shards of an index in the order they are encoded in
+// it: the order they were read in for an index that was extracted, and
+// otherwise the order Archive writes them in
+func ShardOrder(index ShardedDagIndex) []mh.Multihash {
+	if sdi, ok := index.(*shardedDagIndex); ok && len(sdi.order) == index.Shards().Size() &&
+		!slices.ContainsFunc(sdi.order, func(shard mh.Multihash) bool { return !index.Shards().Has(shard) }) {
+		return slices.Clone(sdi.order)
+	}
+	shards := make([]mh.Multihash, 0, index.Shards().Size())
+	for shard := range index.Shards().Iterator() {
+		shards = append(shards, shard)
+	}
+	if err := sortByMultihash(shards, func(shard mh.Multihash) mh.Multihash { return shard }); err != nil {
+		slices.SortFunc(shards, func(a, b mh.Multihash) int { return bytes.Compare(a, b) })
+	}
+	return shards
 }
 
 func (sdi *shardedDagIndex) Content() ipld.Link {
@@ -179,7 +217,7 @@ func Archive(model ShardedDagIndex) (io.Reader, error) {
 	blobIndexDatas, err := toList(model.Shards(), func(shardHash mh.Multihash, shard MultihashMap[Position]) (dm.BlobIndexModel, error) {
 		// assemble blob slices
 		blobSliceDatas, err := toList(shard, func(sliceHash mh.Multihash, pos Position) (dm.BlobSliceModel, error) {
-			return dm.BlobSliceModel{sliceHash, pos}, nil
+			return dm.BlobSliceModel{Multihash: sliceHash, Position: pos}, nil
 		})
 		if err != nil {
 			return dm.BlobIndexModel{}, err
@@ -1,8 +1,10 @@
 package blobindex_test
 
 import (
+	"bytes"
 	"crypto/rand"
 	"io"
+	"slices"
 	"testing"
 
 	"github.com/ipfs/go-cid"
@@ -11,7 +13,11 @@ import (
 	mh "github.com/multiformats/go-multihash"
 	"github.com/storacha/go-ucanto/core/car"
 	"github.com/storacha/go-ucanto/core/ipld/block"
+	"github.com/storacha/go-ucanto/core/ipld/codec/cbor"
+	"github.com/storacha/go-ucanto/core/ipld/hash/sha256"
 	"github.com/storacha/indexing-service/pkg/blobindex"
+	dm "github.com/storacha/indexing-service/pkg/blobindex/datamodel"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
 	"github.com/stretchr/testify/require"
 )
 
@@ -24,6 +30,8 @@ func TestFromToArchive(t *testing.T) {
 	require.NoError(t, err)
 	newIndex, err := blobindex.Extract(r)
 	require.NoError(t, err)
+	// the archive root is the index block, not the content it indexes
+	require.Equal(t, index.Content(), newIndex.Content())
 	require.NotZero(t, newIndex.Shards().Size())
 	require.Equal(t, index.Shards().Size(), newIndex.Shards().Size())
 	for key, shard := range newIndex.Shards().Iterator() {
@@ -32,6 +40,58 @@ func TestFromToArchive(t *testing.T) {
 	}
 }
 
+func TestShardOrder(t *testing.T) {
+	shards := make([]mh.Multihash, 0, 3)
+	for range 3 {
+		shards = append(shards, randomCID().(cidlink.Link).Hash())
+	}
+	sorted := slices.Clone(shards)
+	slices.SortFunc(sorted, func(a, b mh.Multihash) int { return bytes.Compare(a, b) })
+
+	t.Run("built indexes are in the order they are archived in", func(t *testing.T) {
+		index := blobindex.NewShardedDagIndexView(randomCID(), len(shards))
+		for _, shard := range shards {
+			index.SetSlice(shard, randomCID().(cidlink.Link).Hash(), blobindex.Position{Length: 10})
+		}
+		require.Equal(t, sorted, blobindex.ShardOrder(index))
+		extracted, err := blobindex.Extract(testutil.Must(index.Archive())(t))
+		require.NoError(t, err)
+		require.Equal(t, sorted, blobindex.ShardOrder(extracted))
+	})
+
+	t.Run("extracted indexes are in the order they are encoded in", func(t *testing.T) {
+		// the shards of the archive, in the reverse of the order Archive writes
+		ordered := slices.Clone(sorted)
+		slices.Reverse(ordered)
+		var blks []block.Block
+		var links []datamodel.Link
+		for _, shard := range ordered {
+			blk := testutil.Must(block.Encode(&dm.BlobIndexModel{Multihash: shard, Slices: []dm.BlobSliceModel{{Multihash: randomCID().(cidlink.Link).Hash(), Position: blobindex.Position{Length: 10}}}},
+				dm.BlobIndexSchema(), cbor.Codec, sha256.Hasher))(t)
+			blks = append(blks, blk)
+			links = append(links, blk.Link())
+		}
+		root := testutil.Must(block.Encode(&dm.ShardedDagIndexModel{DagO_1: &dm.ShardedDagIndexModel_0_1{Content: randomCID(), Shards: links}},
+			dm.ShardedDagIndexSchema(), cbor.Codec, sha256.Hasher))(t)
+		archive := car.Encode([]datamodel.Link{root.Link()}, func(yield func(block.Block, error) bool) {
+			for _, blk := range append(blks, root) {
+				if !yield(blk, nil) {
+					return
+				}
+			}
+		})
+		index, err := blobindex.Extract(archive)
+		require.NoError(t, err)
+		require.Equal(t, ordered, blobindex.ShardOrder(index))
+
+		// shards added since are in the order they are archived in
+		index.SetSlice(randomCID().(cidlink.Link).Hash(), randomCID().(cidlink.Link).Hash(), blobindex.Position{Length: 10})
+		order := blobindex.ShardOrder(index)
+		require.Len(t, order, len(ordered)+1)
+		require.True(t, slices.IsSortedFunc(order, func(a, b mh.Multihash) int { return bytes.Compare(a, b) }))
+	})
+}
+
 func randomBytes(size int) []byte {
 	bytes := make([]byte, size)
 	_, _ = rand.Reader.Read(bytes)
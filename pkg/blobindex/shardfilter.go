@@ -0,0 +1,250 @@
+package blobindex
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+
+	mh "github.com/multiformats/go-multihash"
+)
+
+const (
+	// DefaultShardFilterFalsePositiveRate is the rate at which shard filters
+	// report a shard may contain a multihash it doesn't
+	DefaultShardFilterFalsePositiveRate = 0.01
+	// ShardFilterMinSlices is the number of slices below which an index is
+	// searched directly, without shard filters
+	ShardFilterMinSlices = 10_000
+)
+
+// shardFiltersFormat is the version of the encoding of shard filters
+const shardFiltersFormat = 1
+
+// ErrStaleShardFilters is returned when shard filters were built for another
+// version of an index
+var ErrStaleShardFilters = errors.New("shard filters are for another version of the index")
+
+// ShardFilters are a bloom filter of the slices of each shard of an index, for
+// finding the shards containing a multihash without searching every shard of a
+// large index. Filters never miss a shard containing a multihash, but may report
+// shards that don't, so reported shards are checked against the index
+type ShardFilters struct {
+	version []byte
+	hashes  int
+	shards  []mh.Multihash
+	filters [][]uint64
+}
+
+// IndexVersion returns a fingerprint of the content and shards of an index,
+// and the number of slices in each, for telling the filters built for it apart
+// from those of an index fetched again since
+func IndexVersion(index ShardedDagIndex) []byte {
+	shards := make([]mh.Multihash, 0, index.Shards().Size())
+	sizes := map[string]int{}
+	for shard, positions := range index.Shards().Iterator() {
+		shards = append(shards, shard)
+		sizes[string(shard)] = positions.Size()
+	}
+	slices.SortFunc(shards, func(a, b mh.Multihash) int { return bytes.Compare(a, b) })
+	h := sha256.New()
+	if index.Content() != nil {
+		h.Write([]byte(index.Content().Binary()))
+	}
+	for _, shard := range shards {
+		h.Write(binary.AppendUvarint(nil, uint64(len(shard))))
+		h.Write(shard)
+		h.Write(binary.AppendUvarint(nil, uint64(sizes[string(shard)])))
+	}
+	return h.Sum(nil)
+}
+
+// SliceCount returns the number of slices across all shards of an index
+func SliceCount(index ShardedDagIndex) int {
+	var n int
+	for _, positions := range index.Shards().Iterator() {
+		n += positions.Size()
+	}
+	return n
+}
+
+// NewShardFilters builds a filter for each shard of the index, sized so that
+// each reports a multihash not in the shard at the given false positive rate
+func NewShardFilters(index ShardedDagIndex, falsePositiveRate float64) (*ShardFilters, error) {
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil, fmt.Errorf("false positive rate must be between 0 and 1: %v", falsePositiveRate)
+	}
+	f := &ShardFilters{
+		version: IndexVersion(index),
+		hashes:  max(1, int(math.Round(-math.Log2(falsePositiveRate)))),
+	}
+	for shard, positions := range index.Shards().Iterator() {
+		// optimal bits per element for the rate is -ln(p)/ln(2)^2
+		nbits := int(math.Ceil(float64(max(positions.Size(), 1)) * -math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+		filter := make([]uint64, (nbits+63)/64)
+		for slice := range positions.Iterator() {
+			h1, h2 := filterHashes(slice)
+			m := uint64(len(filter)) * 64
+			for i := range f.hashes {
+				bit := (h1 + uint64(i)*h2) % m
+				filter[bit/64] |= 1 << (bit % 64)
+			}
+		}
+		f.shards = append(f.shards, shard)
+		f.filters = append(f.filters, filter)
+	}
+	return f, nil
+}
+
+// filterHashes returns the two hashes of a multihash the bits set for it are
+// derived from
+func filterHashes(hash mh.Multihash) (uint64, uint64) {
+	// FNV-1a, inlined as it is hashed for every lookup
+	h1 := uint64(14695981039346656037)
+	for _, b := range hash {
+		h1 ^= uint64(b)
+		h1 *= 1099511628211
+	}
+	// a second hash is mixed from the first, and odd so it cycles all bits
+	h2 := h1 ^ (h1 >> 31)
+	h2 *= 0xbf58476d1ce4e5b9
+	h2 ^= h2 >> 27
+	return h1, h2 | 1
+}
+
+// Version returns the fingerprint of the index the filters were built for
+func (f *ShardFilters) Version() []byte {
+	return f.version
+}
+
+// Check returns ErrStaleShardFilters if the filters were not built for the
+// index
+func (f *ShardFilters) Check(index ShardedDagIndex) error {
+	if !bytes.Equal(f.version, IndexVersion(index)) {
+		return ErrStaleShardFilters
+	}
+	return nil
+}
+
+// MayContain returns the shards that may contain the multihash
+func (f *ShardFilters) MayContain(hash mh.Multihash) []mh.Multihash {
+	h1, h2 := filterHashes(hash)
+	var shards []mh.Multihash
+	for i, filter := range f.filters {
+		if mayContain(filter, f.hashes, h1, h2) {
+			shards = append(shards, f.shards[i])
+		}
+	}
+	return shards
+}
+
+func mayContain(filter []uint64, hashes int, h1, h2 uint64) bool {
+	m := uint64(len(filter)) * 64
+	for i := range hashes {
+		bit := (h1 + uint64(i)*h2) % m
+		if filter[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// MarshalBinary encodes the filters compactly, for caching alongside the index
+func (f *ShardFilters) MarshalBinary() ([]byte, error) {
+	size := 0
+	for _, filter := range f.filters {
+		size += len(filter) * 8
+	}
+	data := make([]byte, 0, size+64)
+	data = binary.AppendUvarint(data, shardFiltersFormat)
+	data = appendBytes(data, f.version)
+	data = binary.AppendUvarint(data, uint64(f.hashes))
+	data = binary.AppendUvarint(data, uint64(len(f.shards)))
+	for i, shard := range f.shards {
+		data = appendBytes(data, shard)
+		data = binary.AppendUvarint(data, uint64(len(f.filters[i])))
+		for _, word := range f.filters[i] {
+			data = binary.LittleEndian.AppendUint64(data, word)
+		}
+	}
+	return data, nil
+}
+
+func appendBytes(data []byte, b []byte) []byte {
+	data = binary.AppendUvarint(data, uint64(len(b)))
+	return append(data, b...)
+}
+
+// UnmarshalBinary decodes filters encoded with MarshalBinary
+func (f *ShardFilters) UnmarshalBinary(data []byte) error {
+	r := filterReader{data: data}
+	if format := r.uvarint(); r.err == nil && format != shardFiltersFormat {
+		return fmt.Errorf("unknown shard filters format: %d", format)
+	}
+	version := r.bytes()
+	hashes := r.uvarint()
+	count := r.uvarint()
+	if r.err == nil && count > uint64(len(r.data)) {
+		r.err = errors.New("truncated shard filters")
+	}
+	var shards []mh.Multihash
+	var filters [][]uint64
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		shard := r.bytes()
+		words := r.uvarint()
+		if r.err == nil && (words == 0 || words > uint64(len(r.data))/8) {
+			r.err = errors.New("truncated shard filters")
+			break
+		}
+		filter := make([]uint64, words)
+		for j := range filter {
+			filter[j] = binary.LittleEndian.Uint64(r.data[j*8:])
+		}
+		r.data = r.data[words*8:]
+		shards = append(shards, shard)
+		filters = append(filters, filter)
+	}
+	if r.err != nil {
+		return fmt.Errorf("decoding shard filters: %w", r.err)
+	}
+	if hashes == 0 || hashes > 64 {
+		return fmt.Errorf("decoding shard filters: invalid hash count: %d", hashes)
+	}
+	*f = ShardFilters{version: version, hashes: int(hashes), shards: shards, filters: filters}
+	return nil
+}
+
+type filterReader struct {
+	data []byte
+	err  error
+}
+
+func (r *filterReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errors.New("truncated shard filters")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *filterReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)) {
+		r.err = errors.New("truncated shard filters")
+		return nil
+	}
+	b := bytes.Clone(r.data[:n])
+	r.data = r.data[n:]
+	return b
+}
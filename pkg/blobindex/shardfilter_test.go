@@ -0,0 +1,121 @@
+package blobindex_test
+
+import (
+	"testing"
+
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/stretchr/testify/require"
+)
+
+// syntheticIndex returns an index of the given number of shards, each with the
+// given number of slices, along with the slices of each shard
+func syntheticIndex(shards, slicesPerShard int) (blobindex.ShardedDagIndexView, map[string][]mh.Multihash) {
+	index := blobindex.NewShardedDagIndexView(randomCID(), shards)
+	slices := map[string][]mh.Multihash{}
+	for range shards {
+		shard := randomMultihash()
+		for i := range slicesPerShard {
+			slice := randomMultihash()
+			index.SetSlice(shard, slice, blobindex.Position{Offset: uint64(i), Length: 1})
+			slices[string(shard)] = append(slices[string(shard)], slice)
+		}
+	}
+	return index, slices
+}
+
+func randomMultihash() mh.Multihash {
+	hash, _ := mh.Sum(randomBytes(32), mh.SHA2_256, -1)
+	return hash
+}
+
+func TestShardFilters(t *testing.T) {
+	index, slices := syntheticIndex(20, 1000)
+	filters, err := blobindex.NewShardFilters(index, 0.01)
+	require.NoError(t, err)
+
+	t.Run("no false negatives", func(t *testing.T) {
+		for shard, hashes := range slices {
+			for _, hash := range hashes {
+				require.Contains(t, filters.MayContain(hash), mh.Multihash(shard))
+			}
+		}
+	})
+
+	t.Run("false positive rate", func(t *testing.T) {
+		var positives int
+		const lookups = 10_000
+		for range lookups {
+			positives += len(filters.MayContain(randomMultihash()))
+		}
+		// each of 20 shards is checked per lookup
+		require.Less(t, float64(positives)/(lookups*20), 0.02)
+	})
+
+	t.Run("encoding round trip", func(t *testing.T) {
+		data, err := filters.MarshalBinary()
+		require.NoError(t, err)
+		var decoded blobindex.ShardFilters
+		require.NoError(t, decoded.UnmarshalBinary(data))
+		require.Equal(t, filters, &decoded)
+		require.Error(t, decoded.UnmarshalBinary(data[:len(data)/2]))
+	})
+
+	t.Run("versioned with the index", func(t *testing.T) {
+		require.NoError(t, filters.Check(index))
+		for shard := range slices {
+			index.SetSlice(mh.Multihash(shard), randomMultihash(), blobindex.Position{})
+			break
+		}
+		require.ErrorIs(t, filters.Check(index), blobindex.ErrStaleShardFilters)
+	})
+
+	t.Run("invalid false positive rate", func(t *testing.T) {
+		_, err := blobindex.NewShardFilters(index, 0)
+		require.Error(t, err)
+		_, err = blobindex.NewShardFilters(index, 1)
+		require.Error(t, err)
+	})
+}
+
+// BenchmarkContainingShards finds the shards of a 100k block index containing
+// a hash, either by checking every shard or by checking the shards the filters
+// report
+func BenchmarkContainingShards(b *testing.B) {
+	index, slices := syntheticIndex(1000, 100)
+	filters, err := blobindex.NewShardFilters(index, blobindex.DefaultShardFilterFalsePositiveRate)
+	require.NoError(b, err)
+	var hashes []mh.Multihash
+	for _, shardSlices := range slices {
+		hashes = append(hashes, shardSlices[0])
+		if len(hashes) == 100 {
+			break
+		}
+	}
+
+	b.Run("scan", func(b *testing.B) {
+		for i := range b.N {
+			hash := hashes[i%len(hashes)]
+			var found int
+			for _, shard := range index.Shards().Iterator() {
+				if shard.Has(hash) {
+					found++
+				}
+			}
+			require.Equal(b, 1, found)
+		}
+	})
+
+	b.Run("filters", func(b *testing.B) {
+		for i := range b.N {
+			hash := hashes[i%len(hashes)]
+			var found int
+			for _, shard := range filters.MayContain(hash) {
+				if index.Shards().Get(shard).Has(hash) {
+					found++
+				}
+			}
+			require.Equal(b, 1, found)
+		}
+	})
+}
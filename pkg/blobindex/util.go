@@ -2,6 +2,7 @@ package blobindex
 
 import (
 	"bytes"
+	"iter"
 
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	mh "github.com/multiformats/go-multihash"
@@ -34,3 +35,29 @@ func FromShardArchives(content ipld.Link, shards [][]byte) (ShardedDagIndexView,
 	}
 	return index, nil
 }
+
+// Multihashes iterates the multihashes an index is advertised under: the digest
+// of each shard, followed by the digests of its slices. Each multihash is
+// yielded once, even if it is in several shards
+func Multihashes(index ShardedDagIndex) iter.Seq[mh.Multihash] {
+	return func(yield func(mh.Multihash) bool) {
+		seen := NewMultihashMap[struct{}](-1)
+		once := func(hash mh.Multihash) bool {
+			if seen.Has(hash) {
+				return true
+			}
+			seen.Set(hash, struct{}{})
+			return yield(hash)
+		}
+		for shard, positions := range index.Shards().Iterator() {
+			if !once(shard) {
+				return
+			}
+			for slice := range positions.Iterator() {
+				if !once(slice) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package blobindex
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/storacha/go-ucanto/core/ipld"
+	"github.com/storacha/go-ucanto/core/result/failure"
+)
+
+// IndexFormat is the format the root of a sharded dag index is keyed by, the
+// version following it as "index/sharded/dag@<version>"
+const IndexFormat = "index/sharded/dag"
+
+// decoder reads a sharded dag index of one version from its root block and the
+// blocks it links to
+type decoder func(root ipld.Block, blockMap map[ipld.Link]ipld.Block) (ShardedDagIndexView, ExtractError)
+
+// decoders are the decoders of the index versions that can be read, by version.
+// Every version here has a golden fixture decoded in the tests, so dropping one
+// is deliberate
+var decoders = map[string]decoder{
+	"0.1": viewV0_1,
+}
+
+// SupportedVersions returns the index versions that can be read, in order
+func SupportedVersions() []string {
+	versions := make([]string, 0, len(decoders))
+	for version := range decoders {
+		versions = append(versions, version)
+	}
+	slices.Sort(versions)
+	return versions
+}
+
+// ErrUnsupportedIndexVersion is returned for sharded dag indexes of a version
+// that can't be read, such as one newer than this service. The index isn't
+// read any further, as its layout is unknown
+type ErrUnsupportedIndexVersion struct {
+	failure.NamedWithStackTrace
+	// Found is the version of the index
+	Found string
+	// Supported are the versions that can be read
+	Supported []string
+}
+
+// NewUnsupportedIndexVersionError returns an ExtractError for an index of the
+// given version
+func NewUnsupportedIndexVersionError(found string) ExtractError {
+	return ErrUnsupportedIndexVersion{failure.NamedWithCurrentStackTrace("UnsupportedIndexVersion"), found, SupportedVersions()}
+}
+
+func (e ErrUnsupportedIndexVersion) isExtractError() {}
+
+func (e ErrUnsupportedIndexVersion) Error() string {
+	return fmt.Sprintf("unsupported index version %s (supported: %s), the indexing service needs upgrading to read it", e.Found, strings.Join(e.Supported, ", "))
+}
+
+// indexVersion reads the version of a sharded dag index from the single key of
+// its root block, without decoding the rest of it
+func indexVersion(root ipld.Block) (string, ExtractError) {
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := dagcbor.Decode(nb, bytes.NewReader(root.Bytes())); err != nil {
+		return "", NewDecodeFailureError(err)
+	}
+	node := nb.Build()
+	if node.Kind() != datamodel.Kind_Map || node.Length() != 1 {
+		return "", NewUnknownFormatError(fmt.Errorf("root is not a keyed %s", IndexFormat))
+	}
+	key, _, err := node.MapIterator().Next()
+	if err != nil {
+		return "", NewDecodeFailureError(err)
+	}
+	format, err := key.AsString()
+	if err != nil {
+		return "", NewDecodeFailureError(err)
+	}
+	version, ok := strings.CutPrefix(format, IndexFormat+"@")
+	if !ok || version == "" {
+		return "", NewUnknownFormatError(fmt.Errorf("unknown index format: %s", format))
+	}
+	return version, nil
+}
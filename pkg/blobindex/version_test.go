@@ -0,0 +1,84 @@
+package blobindex_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/car"
+	"github.com/storacha/go-ucanto/core/ipld/block"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// goldenIndex is what the golden fixture of an index version decodes to, with
+// multihashes as base58btc strings and positions as offset and length
+type goldenIndex struct {
+	Content string                          `json:"content"`
+	Shards  map[string]map[string][2]uint64 `json:"shards"`
+}
+
+func TestSupportedVersions(t *testing.T) {
+	// each supported version has a golden fixture, testdata/index-v<version>.car,
+	// decoded to what testdata/index-v<version>.json holds
+	for _, version := range blobindex.SupportedVersions() {
+		t.Run(version, func(t *testing.T) {
+			fixture := testutil.Must(os.Open(filepath.Join("testdata", "index-v"+version+".car")))(t)
+			defer fixture.Close()
+			var golden goldenIndex
+			require.NoError(t, json.Unmarshal(testutil.Must(os.ReadFile(filepath.Join("testdata", "index-v"+version+".json")))(t), &golden))
+
+			index := testutil.Must(blobindex.Extract(fixture))(t)
+			require.Equal(t, golden.Content, index.Content().String())
+			decoded := map[string]map[string][2]uint64{}
+			for shard, slices := range index.Shards().Iterator() {
+				decoded[shard.B58String()] = map[string][2]uint64{}
+				for slice, pos := range slices.Iterator() {
+					decoded[shard.B58String()][slice.B58String()] = [2]uint64{pos.Offset, pos.Length}
+				}
+			}
+			require.Equal(t, golden.Shards, decoded)
+		})
+	}
+}
+
+func TestUnsupportedVersions(t *testing.T) {
+	t.Run("indexes of a future version fail with the version found", func(t *testing.T) {
+		fixture := testutil.Must(os.Open(filepath.Join("testdata", "index-v0.2.car")))(t)
+		defer fixture.Close()
+
+		_, err := blobindex.Extract(fixture)
+		var unsupported blobindex.ErrUnsupportedIndexVersion
+		require.ErrorAs(t, err, &unsupported)
+		require.Equal(t, "0.2", unsupported.Found)
+		require.Equal(t, blobindex.SupportedVersions(), unsupported.Supported)
+		require.False(t, errors.As(err, &blobindex.DecodeFailureErorr{}))
+	})
+
+	t.Run("roots of other formats are unknown", func(t *testing.T) {
+		root := testutil.Must(qp.BuildMap(basicnode.Prototype.Any, 1, func(ma datamodel.MapAssembler) {
+			qp.MapEntry(ma, "index/flat@1.0", qp.Map(0, func(datamodel.MapAssembler) {}))
+		}))(t)
+		var buf bytes.Buffer
+		require.NoError(t, dagcbor.Encode(root, &buf))
+		link := cidlink.Link{Cid: cid.NewCidV1(cid.DagCBOR, testutil.Must(mh.Sum(buf.Bytes(), mh.SHA2_256, -1))(t))}
+		archive := car.Encode([]datamodel.Link{link}, func(yield func(block.Block, error) bool) {
+			yield(block.NewBlock(link, buf.Bytes()), nil)
+		})
+
+		_, err := blobindex.Extract(archive)
+		require.ErrorAs(t, err, &blobindex.UnknownFormatError{})
+		require.False(t, errors.As(err, &blobindex.ErrUnsupportedIndexVersion{}))
+	})
+}
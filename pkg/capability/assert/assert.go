@@ -174,13 +174,17 @@ var Inclusion = validator.NewCapability(InclusionAbility, schema.DIDString(),
 type IndexCaveats struct {
 	Content ipld.Link
 	Index   ipld.Link
+	// Supersedes is the index claim for the same content this one replaces, if
+	// it replaces one
+	Supersedes *ipld.Link
 }
 
 func (ic IndexCaveats) ToIPLD() (datamodel.Node, error) {
 
 	md := &adm.IndexCaveatsModel{
-		Content: ic.Content,
-		Index:   ic.Index,
+		Content:    ic.Content,
+		Index:      ic.Index,
+		Supersedes: ic.Supersedes,
 	}
 	return ipld.WrapWithRecovery(md, adm.IndexCaveatsType())
 }
@@ -199,7 +203,18 @@ var Index = validator.NewCapability(
 		if err != nil {
 			return IndexCaveats{}, err
 		}
-		return IndexCaveats{content, index}, nil
+		supersedes := model.Supersedes
+		if supersedes != nil {
+			output, err := schema.Link(schema.WithVersion(1)).Read(*model.Supersedes)
+			if err != nil {
+				return IndexCaveats{}, err
+			}
+			supersedes = &output
+		}
+		return IndexCaveats{
+			Content:    content,
+			Index:      index,
+			Supersedes: supersedes}, nil
 	}),
 	nil,
 )
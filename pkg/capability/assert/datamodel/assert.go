@@ -72,8 +72,9 @@ type InclusionCaveatsModel struct {
 }
 
 type IndexCaveatsModel struct {
-	Content ipld.Link
-	Index   ipld.Link
+	Content    ipld.Link
+	Index      ipld.Link
+	Supersedes *ipld.Link
 }
 
 type PartitionCaveatsModel struct {
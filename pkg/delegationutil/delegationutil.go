@@ -0,0 +1,93 @@
+// Package delegationutil encodes delegations the same way however they were
+// archived when they arrived, so that their bytes can be compared, counted and
+// cached as one
+package delegationutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/storacha/go-ucanto/core/dag/blockstore"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/core/ipld"
+)
+
+// ErrRootChanged means the canonical archive of a delegation decodes to a
+// different delegation than was archived
+var ErrRootChanged = errors.New("canonicalization changed the delegation root")
+
+// Canonicalize returns the canonical archive of the delegation: a CARv1 with the
+// archive root first, followed by the blocks of the delegation and the proofs
+// it holds, in the order of their CIDs. Blocks the delegation doesn't link to
+// are left out. Archives of the same delegation canonicalize to the same bytes
+func Canonicalize(d delegation.Delegation) ([]byte, error) {
+	archive, _, err := canonicalize(d)
+	return archive, err
+}
+
+// Canonical returns the delegation as read from its canonical archive, so that
+// its blocks are those of the archive, in the same order
+func Canonical(d delegation.Delegation) (delegation.Delegation, error) {
+	_, canonical, err := canonicalize(d)
+	return canonical, err
+}
+
+func canonicalize(d delegation.Delegation) ([]byte, delegation.Delegation, error) {
+	blocks, err := blockstore.NewBlockReader(blockstore.WithBlocksIterator(d.Blocks()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading delegation blocks: %w", err)
+	}
+	linked := map[string]ipld.Block{}
+	if err := collect(d.Root(), blocks, linked); err != nil {
+		return nil, nil, err
+	}
+	sorted := make([]ipld.Block, 0, len(linked))
+	for _, blk := range linked {
+		sorted = append(sorted, blk)
+	}
+	slices.SortFunc(sorted, func(a, b ipld.Block) int {
+		return bytes.Compare([]byte(a.Link().Binary()), []byte(b.Link().Binary()))
+	})
+	reader, err := blockstore.NewBlockReader(blockstore.WithBlocks(sorted))
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading canonical blocks: %w", err)
+	}
+	archive, err := io.ReadAll(delegation.Archive(delegation.NewDelegation(d.Root(), reader)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("archiving delegation: %w", err)
+	}
+	canonical, err := delegation.Extract(archive)
+	if err != nil {
+		return nil, nil, fmt.Errorf("extracting canonical archive: %w", err)
+	}
+	if canonical.Link().String() != d.Link().String() {
+		return nil, nil, fmt.Errorf("%w: %s became %s", ErrRootChanged, d.Link(), canonical.Link())
+	}
+	return archive, canonical, nil
+}
+
+// collect adds the block of a delegation, and those of the proofs it holds, to
+// the linked blocks. Proofs only referenced by their CID are skipped
+func collect(root ipld.Block, blocks blockstore.BlockReader, linked map[string]ipld.Block) error {
+	key := root.Link().Binary()
+	if _, ok := linked[key]; ok {
+		return nil
+	}
+	linked[key] = root
+	for _, proof := range delegation.NewDelegation(root, blocks).Proofs() {
+		blk, ok, err := blocks.Get(proof)
+		if err != nil {
+			return fmt.Errorf("reading proof %s: %w", proof, err)
+		}
+		if !ok {
+			continue
+		}
+		if err := collect(blk, blocks, linked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
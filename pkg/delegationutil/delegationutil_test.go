@@ -0,0 +1,53 @@
+package delegationutil_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/delegationutil"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalize(t *testing.T) {
+	// the fixture holds a proof, so that it has more than one block to order
+	proof := testutil.RandomLocationDelegation()
+	claim := testutil.Must(delegation.Delegate(testutil.Service, testutil.Alice, []ucan.Capability[assert.LocationCaveats]{testutil.RandomLocationClaim()}, delegation.WithProof(delegation.FromDelegation(proof))))(t)
+	archives := [][]byte{
+		testutil.Must(io.ReadAll(claim.Archive()))(t),
+		testutil.ReorderedArchive(t, claim),
+	}
+	require.NotEqual(t, archives[0], archives[1])
+
+	var canonical [][]byte
+	for _, archive := range archives {
+		extracted := testutil.Must(delegation.Extract(archive))(t)
+		canonical = append(canonical, testutil.Must(delegationutil.Canonicalize(extracted))(t))
+	}
+	require.Equal(t, canonical[0], canonical[1])
+	// the block the delegation doesn't link to is left out
+	require.Less(t, len(canonical[1]), len(archives[1]))
+
+	// the canonical archive is the same delegation, and canonicalizes to itself
+	extracted := testutil.Must(delegation.Extract(canonical[0]))(t)
+	require.Equal(t, claim.Link(), extracted.Link())
+	testutil.RequireEqualDelegation(t, claim, extracted)
+	require.Equal(t, canonical[0], testutil.Must(delegationutil.Canonicalize(extracted))(t))
+
+	// the canonical delegation holds the blocks of the canonical archive
+	var blocks bytes.Buffer
+	for blk, err := range testutil.Must(delegationutil.Canonical(testutil.Must(delegation.Extract(archives[1]))(t)))(t).Blocks() {
+		require.NoError(t, err)
+		blocks.Write(blk.Bytes())
+	}
+	var expected bytes.Buffer
+	for blk, err := range extracted.Blocks() {
+		require.NoError(t, err)
+		expected.Write(blk.Bytes())
+	}
+	require.Equal(t, expected.Bytes(), blocks.Bytes())
+}
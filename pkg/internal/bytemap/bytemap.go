@@ -11,16 +11,22 @@ type byteMap[K ~[]byte, T any] struct {
 	data map[string]T
 }
 
-// ByteMap is a generic for mapping byte array like types to arbitrary data types
-type ByteMap[K ~[]byte, T any] interface {
+// ReadOnlyByteMap is the part of a ByteMap that reads it. A read-only map made
+// by Freeze is safe to share between goroutines
+type ReadOnlyByteMap[K ~[]byte, T any] interface {
 	Get(K) T
 	Has(K) bool
-	Set(K, T)
-	Delete(K) bool
 	Size() int
 	Iterator() iter.Seq2[K, T]
 }
 
+// ByteMap is a generic for mapping byte array like types to arbitrary data types
+type ByteMap[K ~[]byte, T any] interface {
+	ReadOnlyByteMap[K, T]
+	Set(K, T)
+	Delete(K) bool
+}
+
 // NewByteMap returns a new map of multihash to a data type
 func NewByteMap[K ~[]byte, T any](sizeHint int) ByteMap[K, T] {
 	var stringMap map[string]T
@@ -60,3 +66,44 @@ func (bm *byteMap[K, T]) Iterator() iter.Seq2[K, T] {
 		return K(str), t
 	}, maps.All(bm.data))
 }
+
+// Clone returns a copy of the map, which is empty if the map is nil
+func Clone[K ~[]byte, T any](bm ReadOnlyByteMap[K, T]) ByteMap[K, T] {
+	if bm == nil {
+		return NewByteMap[K, T](-1)
+	}
+	c := NewByteMap[K, T](bm.Size())
+	for k, t := range bm.Iterator() {
+		c.Set(k, t)
+	}
+	return c
+}
+
+type frozenByteMap[K ~[]byte, T any] struct {
+	bm ByteMap[K, T]
+}
+
+// Freeze returns a read-only copy of the map, which later changes to the map
+// don't affect, so it can be read from several goroutines at once
+func Freeze[K ~[]byte, T any](bm ReadOnlyByteMap[K, T]) ReadOnlyByteMap[K, T] {
+	if frozen, ok := bm.(frozenByteMap[K, T]); ok {
+		return frozen
+	}
+	return frozenByteMap[K, T]{Clone(bm)}
+}
+
+func (f frozenByteMap[K, T]) Get(b K) T {
+	return f.bm.Get(b)
+}
+
+func (f frozenByteMap[K, T]) Has(b K) bool {
+	return f.bm.Has(b)
+}
+
+func (f frozenByteMap[K, T]) Size() int {
+	return f.bm.Size()
+}
+
+func (f frozenByteMap[K, T]) Iterator() iter.Seq2[K, T] {
+	return f.bm.Iterator()
+}
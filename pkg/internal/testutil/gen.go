@@ -24,6 +24,7 @@ import (
 	"github.com/storacha/go-ucanto/ucan"
 	"github.com/storacha/indexing-service/pkg/blobindex"
 	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/metadata"
 )
 
 func RandomBytes(size int) []byte {
@@ -130,10 +131,22 @@ func RandomIndexDelegation() delegation.Delegation {
 	return delegation
 }
 
+// RandomMetadata returns encoded location commitment metadata for a random
+// claim. Random bytes aren't used, as they can decode as a protocol of enormous
+// length
+func RandomMetadata() []byte {
+	md := metadata.MetadataContext.New(&metadata.LocationCommitmentMetadata{Claim: RandomCID().(cidlink.Link).Cid})
+	data, err := md.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
 func RandomProviderResult() model.ProviderResult {
 	return model.ProviderResult{
 		ContextID: RandomBytes(10),
-		Metadata:  RandomBytes(10),
+		Metadata:  RandomMetadata(),
 		Provider: &peer.AddrInfo{
 			ID: RandomPeer(),
 			Addrs: []multiaddr.Multiaddr{
@@ -1,9 +1,17 @@
 package testutil
 
 import (
+	"io"
+	"slices"
 	"testing"
 
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/car"
 	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/core/ipld"
+	"github.com/storacha/go-ucanto/core/ipld/block"
 	"github.com/storacha/indexing-service/pkg/blobindex"
 	"github.com/stretchr/testify/require"
 )
@@ -32,6 +40,7 @@ func RequireEqualIndex(t *testing.T, expectedIndex blobindex.ShardedDagIndexView
 		require.Nil(t, actualIndex)
 		return
 	}
+	require.Equal(t, expectedIndex.Content(), actualIndex.Content())
 	require.NotZero(t, actualIndex.Shards().Size())
 	require.Equal(t, expectedIndex.Shards().Size(), actualIndex.Shards().Size())
 	for key, shard := range actualIndex.Shards().Iterator() {
@@ -45,6 +54,32 @@ func RequireEqualIndex(t *testing.T, expectedIndex blobindex.ShardedDagIndexView
 	}
 }
 
+// ReorderedArchive archives the delegation as a client other than go-ucanto
+// might: its blocks in reverse order, followed by a block it doesn't link to.
+// The archive extracts to the same delegation, but differs in bytes from its
+// own archive
+func ReorderedArchive(t *testing.T, d delegation.Delegation) []byte {
+	roots, blocks := Must2(car.Decode(d.Archive()))(t)
+	var blks []ipld.Block
+	for blk, err := range blocks {
+		require.NoError(t, err)
+		blks = append(blks, blk)
+	}
+	slices.Reverse(blks)
+	padding := RandomBytes(16)
+	paddingCid := Must(cid.Prefix{Version: 1, Codec: cid.Raw, MhType: mh.SHA2_256, MhLength: -1}.Sum(padding))(t)
+	blks = append(blks, block.NewBlock(cidlink.Link{Cid: paddingCid}, padding))
+	archive := Must(io.ReadAll(car.Encode(roots, func(yield func(ipld.Block, error) bool) {
+		for _, blk := range blks {
+			if !yield(blk, nil) {
+				return
+			}
+		}
+	})))(t)
+	require.NotEqual(t, Must(io.ReadAll(d.Archive()))(t), archive)
+	return archive
+}
+
 // RequireEqualDelegation compares two delegations to verify their equality
 func RequireEqualDelegation(t *testing.T, expectedDelegation delegation.Delegation, actualDelegation delegation.Delegation) {
 	if expectedDelegation == nil {
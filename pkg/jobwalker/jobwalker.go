@@ -0,0 +1,107 @@
+// Package jobwalker defines a traversal over jobs that spawn other jobs, all
+// while modifying a shared state. Implementations are in the singlewalk and
+// parallelwalk packages, and must pass the conformance suite in jobwalkertest
+package jobwalker
+
+import (
+	"context"
+	"errors"
+)
+
+// WrappedState is a wrapper around any state to enable atomic access and modification
+type WrappedState[State any] interface {
+	Access() State
+	Modify(func(State) State)
+	// CmpSwap calls the "willModify" function (potentially multiple times) and calls modify if it returns true
+	CmpSwap(willModify func(State) bool, modify func(State) State) bool
+}
+
+// JobHandler handles the specified job and uses the passed in function to spawn more
+// jobs.
+// The handler should stop processing if spawn errors, returning the error from spawn
+type JobHandler[Job any, State any] func(ctx context.Context, j Job, spawn func(Job) error, state WrappedState[State]) error
+
+// JobWalker processes a set of jobs that spawn other jobs, all while modifying a final state
+type JobWalker[Job, State any] func(ctx context.Context, initial []Job, initialState State, handler JobHandler[Job, State]) (State, error)
+
+// Prioritized is implemented by jobs that should be handled ahead of others.
+// Of the jobs waiting to be handled, the one with the highest priority is
+// handled next. Jobs that don't implement Prioritized have priority 0
+type Prioritized interface {
+	Priority() int
+}
+
+// ErrorPolicy decides what a walk does when a handler returns an error
+type ErrorPolicy int
+
+const (
+	// FailFast stops the walk at the first handler error, which is returned
+	FailFast ErrorPolicy = iota
+	// CollectErrors carries on handling the remaining jobs when a handler
+	// errors, and returns all handler errors joined once the walk is done
+	CollectErrors
+)
+
+var (
+	// ErrNoJobs is returned when a walk is started without any initial jobs
+	ErrNoJobs = errors.New("must provide at least one initial job")
+	// ErrTooManyPending is returned from spawn when the maximum number of jobs
+	// waiting to be handled has been reached
+	ErrTooManyPending = errors.New("too many pending jobs")
+)
+
+// Config is the configuration of a walker, built from options
+type Config struct {
+	// Concurrency is the maximum number of jobs handled at once
+	Concurrency int
+	// MaxPending is the maximum number of jobs waiting to be handled. Zero means
+	// unlimited
+	MaxPending int
+	// ErrorPolicy decides what happens when a handler errors
+	ErrorPolicy ErrorPolicy
+}
+
+// Option configures a walker
+type Option func(*Config)
+
+// WithConcurrency sets the maximum number of jobs handled at once. Walkers that
+// handle jobs sequentially ignore it
+func WithConcurrency(concurrency int) Option {
+	return func(c *Config) {
+		c.Concurrency = concurrency
+	}
+}
+
+// WithMaxPending limits the number of jobs waiting to be handled. Beyond the
+// limit, spawn returns ErrTooManyPending
+func WithMaxPending(maxPending int) Option {
+	return func(c *Config) {
+		c.MaxPending = maxPending
+	}
+}
+
+// WithErrorPolicy sets what happens when a handler errors. The default is FailFast
+func WithErrorPolicy(policy ErrorPolicy) Option {
+	return func(c *Config) {
+		c.ErrorPolicy = policy
+	}
+}
+
+// NewConfig applies options on top of the defaults
+func NewConfig(opts ...Option) Config {
+	c := Config{Concurrency: 1}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	c.Concurrency = max(c.Concurrency, 1)
+	c.MaxPending = max(c.MaxPending, 0)
+	return c
+}
+
+// PriorityOf returns the priority of a job
+func PriorityOf[Job any](j Job) int {
+	if p, ok := any(j).(Prioritized); ok {
+		return p.Priority()
+	}
+	return 0
+}
@@ -0,0 +1,252 @@
+// Package jobwalkertest is a conformance suite for jobwalker.JobWalker
+// implementations.
+//
+// An implementation passes the suite when it:
+//   - handles every initial and spawned job exactly once, unless the handler
+//     deduplicates with CmpSwap, in which case the handler sees each job once
+//   - returns jobwalker.ErrNoJobs when there are no initial jobs
+//   - stops at the first handler error with jobwalker.FailFast, the default
+//   - handles all other jobs and returns every handler error with
+//     jobwalker.CollectErrors
+//   - rejects spawns beyond jobwalker.WithMaxPending with
+//     jobwalker.ErrTooManyPending
+//   - handles waiting jobs in priority order when they are handled one at a time
+//   - never handles more jobs at once than jobwalker.WithConcurrency allows
+//   - returns the context error when the context is cancelled
+//
+// Implementations run the suite from their tests:
+//
+//	jobwalkertest.Run(t, parallelwalk.NewParallelWalk[jobwalkertest.Job, jobwalkertest.State])
+package jobwalkertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/storacha/indexing-service/pkg/jobwalker"
+	"github.com/stretchr/testify/require"
+)
+
+// Job is the job type used by the suite
+type Job struct {
+	ID   int
+	Prio int
+}
+
+var _ jobwalker.Prioritized = Job{}
+
+// Priority implements jobwalker.Prioritized
+func (j Job) Priority() int {
+	return j.Prio
+}
+
+// State is the state type used by the suite
+type State struct {
+	// Handled counts how many times each job was handled
+	Handled map[int]int
+	// Order is the order jobs were handled in
+	Order []int
+	// Visited is the set of jobs claimed with CmpSwap. It is replaced rather
+	// than modified, as CmpSwap may read it outside the lock
+	Visited map[int]struct{}
+}
+
+// Factory returns a walker with the given options
+type Factory func(opts ...jobwalker.Option) jobwalker.JobWalker[Job, State]
+
+var errJob = errors.New("job failed")
+
+func newState() State {
+	return State{Handled: map[int]int{}, Visited: map[int]struct{}{}}
+}
+
+func record(state jobwalker.WrappedState[State], j Job) {
+	state.Modify(func(s State) State {
+		s.Handled[j.ID]++
+		s.Order = append(s.Order, j.ID)
+		return s
+	})
+}
+
+// tree spawns a binary tree of jobs with IDs from 0 to n-1
+func tree(n int, handle func(j Job) error) jobwalker.JobHandler[Job, State] {
+	return func(ctx context.Context, j Job, spawn func(Job) error, state jobwalker.WrappedState[State]) error {
+		record(state, j)
+		if err := handle(j); err != nil {
+			return err
+		}
+		for _, child := range []int{2*j.ID + 1, 2*j.ID + 2} {
+			if child < n {
+				if err := spawn(Job{ID: child}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+func requireHandledOnce(t *testing.T, state State, n int) {
+	require.Len(t, state.Handled, n)
+	for id := range n {
+		require.Equal(t, 1, state.Handled[id], "job %d", id)
+	}
+}
+
+// Run runs the conformance suite against the walkers returned by newWalker
+func Run(t *testing.T, newWalker Factory) {
+	ctx := context.Background()
+
+	t.Run("handles every spawned job once", func(t *testing.T) {
+		for _, concurrency := range []int{1, 4} {
+			t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+				walk := newWalker(jobwalker.WithConcurrency(concurrency))
+				state, err := walk(ctx, []Job{{ID: 0}}, newState(), tree(100, func(Job) error { return nil }))
+				require.NoError(t, err)
+				requireHandledOnce(t, state, 100)
+			})
+		}
+	})
+
+	t.Run("deduplicates with CmpSwap", func(t *testing.T) {
+		const n = 50
+		walk := newWalker(jobwalker.WithConcurrency(4))
+		state, err := walk(ctx, []Job{{ID: 0}, {ID: 0}}, newState(), func(ctx context.Context, j Job, spawn func(Job) error, state jobwalker.WrappedState[State]) error {
+			if !state.CmpSwap(func(s State) bool {
+				_, ok := s.Visited[j.ID]
+				return !ok
+			}, func(s State) State {
+				s.Visited = maps.Clone(s.Visited)
+				s.Visited[j.ID] = struct{}{}
+				return s
+			}) {
+				return nil
+			}
+			record(state, j)
+			// every job spawns jobs that have already been or will be spawned
+			for _, next := range []int{(j.ID + 1) % n, (j.ID + 2) % n} {
+				if err := spawn(Job{ID: next}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		requireHandledOnce(t, state, n)
+	})
+
+	t.Run("no initial jobs", func(t *testing.T) {
+		walk := newWalker()
+		_, err := walk(ctx, nil, newState(), tree(1, func(Job) error { return nil }))
+		require.ErrorIs(t, err, jobwalker.ErrNoJobs)
+	})
+
+	t.Run("fails fast by default", func(t *testing.T) {
+		walk := newWalker(jobwalker.WithConcurrency(2))
+		_, err := walk(ctx, []Job{{ID: 0}}, newState(), tree(100, func(j Job) error {
+			if j.ID == 5 {
+				return errJob
+			}
+			return nil
+		}))
+		require.ErrorIs(t, err, errJob)
+	})
+
+	t.Run("collects errors", func(t *testing.T) {
+		walk := newWalker(jobwalker.WithConcurrency(2), jobwalker.WithErrorPolicy(jobwalker.CollectErrors))
+		failing := map[int]error{3: fmt.Errorf("job 3: %w", errJob), 7: fmt.Errorf("job 7: %w", errJob)}
+		state, err := walk(ctx, []Job{{ID: 0}}, newState(), func(ctx context.Context, j Job, spawn func(Job) error, state jobwalker.WrappedState[State]) error {
+			record(state, j)
+			if j.ID < 9 {
+				if err := spawn(Job{ID: j.ID + 1}); err != nil {
+					return err
+				}
+			}
+			return failing[j.ID]
+		})
+		requireHandledOnce(t, state, 10)
+		require.ErrorIs(t, err, failing[3])
+		require.ErrorIs(t, err, failing[7])
+	})
+
+	t.Run("limits pending jobs", func(t *testing.T) {
+		walk := newWalker(jobwalker.WithConcurrency(1), jobwalker.WithMaxPending(1))
+		var spawnErrs []error
+		_, err := walk(ctx, []Job{{ID: 0}}, newState(), func(ctx context.Context, j Job, spawn func(Job) error, state jobwalker.WrappedState[State]) error {
+			if j.ID != 0 {
+				return nil
+			}
+			for id := 1; id <= 3; id++ {
+				spawnErrs = append(spawnErrs, spawn(Job{ID: id}))
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.NoError(t, spawnErrs[0])
+		require.ErrorIs(t, spawnErrs[1], jobwalker.ErrTooManyPending)
+		require.ErrorIs(t, spawnErrs[2], jobwalker.ErrTooManyPending)
+	})
+
+	t.Run("handles higher priority jobs first", func(t *testing.T) {
+		walk := newWalker(jobwalker.WithConcurrency(1))
+		state, err := walk(ctx, []Job{{ID: 0, Prio: 0}, {ID: 1, Prio: 5}, {ID: 2, Prio: 3}}, newState(), func(ctx context.Context, j Job, spawn func(Job) error, state jobwalker.WrappedState[State]) error {
+			record(state, j)
+			if j.ID == 1 {
+				// spawned jobs are ordered with the jobs already waiting
+				if err := spawn(Job{ID: 3, Prio: 4}); err != nil {
+					return err
+				}
+				return spawn(Job{ID: 4, Prio: -1})
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, []int{1, 3, 2, 0, 4}, state.Order)
+	})
+
+	t.Run("respects concurrency", func(t *testing.T) {
+		const concurrency = 3
+		walk := newWalker(jobwalker.WithConcurrency(concurrency))
+		var active, maxActive atomic.Int32
+		initial := make([]Job, 0, 20)
+		for id := range 20 {
+			initial = append(initial, Job{ID: id})
+		}
+		state, err := walk(ctx, initial, newState(), func(ctx context.Context, j Job, spawn func(Job) error, state jobwalker.WrappedState[State]) error {
+			n := active.Add(1)
+			defer active.Add(-1)
+			for {
+				m := maxActive.Load()
+				if n <= m || maxActive.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			record(state, j)
+			return nil
+		})
+		require.NoError(t, err)
+		requireHandledOnce(t, state, 20)
+		require.LessOrEqual(t, maxActive.Load(), int32(concurrency))
+	})
+
+	t.Run("stops when the context is cancelled", func(t *testing.T) {
+		walk := newWalker(jobwalker.WithConcurrency(2))
+		cctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		_, err := walk(cctx, []Job{{ID: 0}}, newState(), func(ctx context.Context, j Job, spawn func(Job) error, state jobwalker.WrappedState[State]) error {
+			record(state, j)
+			if j.ID == 10 {
+				cancel()
+			}
+			// an endless chain of jobs
+			return spawn(Job{ID: j.ID + 1})
+		})
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
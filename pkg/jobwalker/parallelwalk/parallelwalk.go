@@ -1,3 +1,5 @@
+// Package parallelwalk implements a jobwalker.JobWalker that handles jobs in
+// parallel
 package parallelwalk
 
 import (
@@ -5,7 +7,7 @@ import (
 	"errors"
 	"sync"
 
-	"github.com/storacha/indexing-service/pkg/internal/jobwalker"
+	"github.com/storacha/indexing-service/pkg/jobwalker"
 )
 
 type threadSafeState[State any] struct {
@@ -42,97 +44,93 @@ func (ts *threadSafeState[State]) CmpSwap(willModify func(State) bool, modify fu
 	return true
 }
 
+type spawnRequest[Job any] struct {
+	job   Job
+	reply chan error
+}
+
 // NewParallelWalk generates a function to handle a series of jobs that may spawn more jobs
-// It will execute jobs in parallel, with the specified concurrency until all initial jobs
+// It will execute jobs in parallel, with the configured concurrency until all initial jobs
 // and all spawned jobs (recursively) are handled, or a job errors
 // This code is adapted from https://github.com/ipfs/go-merkledag/blob/master/merkledag.go#L464C6-L584
-func NewParallelWalk[Job, State any](concurrency int) jobwalker.JobWalker[Job, State] {
+func NewParallelWalk[Job, State any](opts ...jobwalker.Option) jobwalker.JobWalker[Job, State] {
+	cfg := jobwalker.NewConfig(opts...)
 	return func(ctx context.Context, initial []Job, initialState State, handler jobwalker.JobHandler[Job, State]) (State, error) {
 		if len(initial) == 0 {
-			return initialState, errors.New("must provide at least one initial job")
+			return initialState, jobwalker.ErrNoJobs
 		}
 		jobFeed := make(chan Job)
-		spawnedJobs := make(chan Job)
-		jobFinishes := make(chan struct{})
+		spawnedJobs := make(chan spawnRequest[Job])
+		jobFinishes := make(chan error)
 
 		state := &threadSafeState[State]{
 			state: initialState,
 		}
 		var wg sync.WaitGroup
 
-		errChan := make(chan error)
-
 		jobFeedCtx, cancel := context.WithCancel(ctx)
 
 		defer wg.Wait()
 		defer cancel()
-		for i := 0; i < concurrency; i++ {
+		for i := 0; i < cfg.Concurrency; i++ {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				for job := range jobFeed {
-
-					err := handler(jobFeedCtx, job, func(next Job) error {
-						select {
-						case spawnedJobs <- next:
-							return nil
-						case <-jobFeedCtx.Done():
-							return jobFeedCtx.Err()
-						}
-					}, state)
-
-					if err != nil {
-						select {
-						case errChan <- err:
-						case <-jobFeedCtx.Done():
-						}
-						return
+				reply := make(chan error, 1)
+				spawn := func(next Job) error {
+					select {
+					case spawnedJobs <- spawnRequest[Job]{next, reply}:
+					case <-jobFeedCtx.Done():
+						return jobFeedCtx.Err()
 					}
-
+					return <-reply
+				}
+				for job := range jobFeed {
+					err := handler(jobFeedCtx, job, spawn, state)
 					select {
-					case jobFinishes <- struct{}{}:
+					case jobFinishes <- err:
 					case <-jobFeedCtx.Done():
+						return
 					}
 				}
 			}()
 		}
 		defer close(jobFeed)
 
-		jobProcessor := jobFeed
-		nextJob, queuedJobs := initial[0], initial[1:]
-
+		pending := jobwalker.NewQueue(initial)
 		var inProgress int
-
-		hasNextJob := func() bool {
-			return jobProcessor != nil
-		}
+		var errs []error
 
 		for {
+			// only offer a job to the workers when there is one
+			var jobProcessor chan Job
+			var nextJob Job
+			if pending.Len() > 0 {
+				jobProcessor = jobFeed
+				nextJob = pending.Peek()
+			}
 			select {
 			case jobProcessor <- nextJob:
+				pending.Pop()
 				inProgress++
-				if len(queuedJobs) > 0 {
-					nextJob = queuedJobs[0]
-					queuedJobs = queuedJobs[1:]
-				} else {
-					var empty Job
-					nextJob = empty
-					jobProcessor = nil
-				}
-			case <-jobFinishes:
+			case err := <-jobFinishes:
 				inProgress--
-				if inProgress == 0 && !hasNextJob() {
-					return state.Access(), nil
+				if err != nil {
+					if cfg.ErrorPolicy == jobwalker.FailFast {
+						return state.Access(), err
+					}
+					errs = append(errs, err)
+				}
+				if inProgress == 0 && pending.Len() == 0 {
+					return state.Access(), errors.Join(errs...)
 				}
-			case queued := <-spawnedJobs:
-				if !hasNextJob() {
-					nextJob = queued
-					jobProcessor = jobFeed
+			case req := <-spawnedJobs:
+				if cfg.MaxPending > 0 && pending.Len() >= cfg.MaxPending {
+					req.reply <- jobwalker.ErrTooManyPending
 				} else {
-					queuedJobs = append(queuedJobs, queued)
+					pending.Push(req.job)
+					req.reply <- nil
 				}
-			case err := <-errChan:
-				return state.Access(), err
 			case <-ctx.Done():
 				return state.Access(), ctx.Err()
 			}
@@ -0,0 +1,12 @@
+package parallelwalk_test
+
+import (
+	"testing"
+
+	"github.com/storacha/indexing-service/pkg/jobwalker/jobwalkertest"
+	"github.com/storacha/indexing-service/pkg/jobwalker/parallelwalk"
+)
+
+func TestParallelWalk__Conformance(t *testing.T) {
+	jobwalkertest.Run(t, parallelwalk.NewParallelWalk[jobwalkertest.Job, jobwalkertest.State])
+}
@@ -0,0 +1,86 @@
+package jobwalker
+
+// Pending is a queue of jobs waiting to be handled, ordered by priority. Jobs of
+// equal priority are taken first in first out, or last in first out for a
+// stack. It is not safe for concurrent use
+type Pending[Job any] struct {
+	jobs        []Job
+	stack       bool
+	prioritized bool
+}
+
+// NewQueue returns a first in first out queue of the given jobs
+func NewQueue[Job any](jobs []Job) *Pending[Job] {
+	p := &Pending[Job]{}
+	for _, j := range jobs {
+		p.Push(j)
+	}
+	return p
+}
+
+// NewStack returns a last in first out queue of the given jobs
+func NewStack[Job any](jobs []Job) *Pending[Job] {
+	p := &Pending[Job]{stack: true}
+	for _, j := range jobs {
+		p.Push(j)
+	}
+	return p
+}
+
+// Len returns the number of pending jobs
+func (p *Pending[Job]) Len() int {
+	return len(p.jobs)
+}
+
+// Push adds a job
+func (p *Pending[Job]) Push(j Job) {
+	if _, ok := any(j).(Prioritized); ok {
+		p.prioritized = true
+	}
+	p.jobs = append(p.jobs, j)
+}
+
+// Peek returns the job that would be taken next. It must not be called when
+// there are no pending jobs
+func (p *Pending[Job]) Peek() Job {
+	return p.jobs[p.next()]
+}
+
+// Pop takes the next job. It must not be called when there are no pending jobs
+func (p *Pending[Job]) Pop() Job {
+	i := p.next()
+	j := p.jobs[i]
+	var empty Job
+	switch {
+	case i == len(p.jobs)-1:
+		p.jobs[i] = empty
+		p.jobs = p.jobs[:i]
+	case i == 0:
+		p.jobs[0] = empty
+		p.jobs = p.jobs[1:]
+	default:
+		p.jobs = append(p.jobs[:i], p.jobs[i+1:]...)
+	}
+	return j
+}
+
+func (p *Pending[Job]) next() int {
+	if !p.prioritized {
+		if p.stack {
+			return len(p.jobs) - 1
+		}
+		return 0
+	}
+	best := -1
+	bestPriority := 0
+	for n := range p.jobs {
+		i := n
+		if p.stack {
+			i = len(p.jobs) - 1 - n
+		}
+		if priority := PriorityOf(p.jobs[i]); best < 0 || priority > bestPriority {
+			best, bestPriority = i, priority
+		}
+	}
+	return best
+}
@@ -0,0 +1,75 @@
+// Package singlewalk implements a jobwalker.JobWalker that handles jobs
+// sequentially in a single goroutine
+package singlewalk
+
+import (
+	"context"
+	"errors"
+
+	"github.com/storacha/indexing-service/pkg/jobwalker"
+)
+
+type singleState[State any] struct {
+	m State
+}
+
+// Access implements jobwalker.WrappedState.
+func (s *singleState[State]) Access() State {
+	return s.m
+}
+
+// CmpSwap implements jobwalker.WrappedState.
+func (s *singleState[State]) CmpSwap(willModify func(State) bool, modify func(State) State) bool {
+	if !willModify(s.m) {
+		return false
+	}
+	s.m = modify(s.m)
+	return true
+}
+
+// Modify implements jobwalker.WrappedState.
+func (s *singleState[State]) Modify(modify func(State) State) {
+	s.m = modify(s.m)
+}
+
+var _ jobwalker.WrappedState[any] = &singleState[any]{}
+
+// NewSingleWalk returns a walker that processes jobs that spawn more jobs
+// sequentially, depth first, in a single goroutine. The concurrency option is
+// ignored
+func NewSingleWalk[Job, State any](opts ...jobwalker.Option) jobwalker.JobWalker[Job, State] {
+	cfg := jobwalker.NewConfig(opts...)
+	return func(ctx context.Context, initial []Job, initialState State, handler jobwalker.JobHandler[Job, State]) (State, error) {
+		if len(initial) == 0 {
+			return initialState, jobwalker.ErrNoJobs
+		}
+		pending := jobwalker.NewStack(initial)
+		state := &singleState[State]{initialState}
+		spawn := func(j Job) error {
+			if cfg.MaxPending > 0 && pending.Len() >= cfg.MaxPending {
+				return jobwalker.ErrTooManyPending
+			}
+			pending.Push(j)
+			return nil
+		}
+		var errs []error
+		for pending.Len() > 0 {
+			if err := ctx.Err(); err != nil {
+				return state.Access(), err
+			}
+			if err := handler(ctx, pending.Pop(), spawn, state); err != nil {
+				if cfg.ErrorPolicy == jobwalker.FailFast {
+					return state.Access(), err
+				}
+				errs = append(errs, err)
+			}
+		}
+		return state.Access(), errors.Join(errs...)
+	}
+}
+
+// SingleWalker processes jobs that spawn more jobs, sequentially depth first in a
+// single thread, with the default options
+func SingleWalker[Job, State any](ctx context.Context, initial []Job, initialState State, handler jobwalker.JobHandler[Job, State]) (State, error) {
+	return NewSingleWalk[Job, State]()(ctx, initial, initialState, handler)
+}
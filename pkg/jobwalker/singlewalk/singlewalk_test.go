@@ -0,0 +1,12 @@
+package singlewalk_test
+
+import (
+	"testing"
+
+	"github.com/storacha/indexing-service/pkg/jobwalker/jobwalkertest"
+	"github.com/storacha/indexing-service/pkg/jobwalker/singlewalk"
+)
+
+func TestSingleWalk__Conformance(t *testing.T) {
+	jobwalkertest.Run(t, singlewalk.NewSingleWalk[jobwalkertest.Job, jobwalkertest.State])
+}
@@ -0,0 +1,82 @@
+package metadata
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+
+	ipnimd "github.com/ipni/go-libipni/metadata"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-varint"
+)
+
+// ErrUnknownProtocol is the error of a decoded protocol that isn't known
+var ErrUnknownProtocol = errors.New("unknown metadata protocol")
+
+// protocols are the factories of the protocols that can be decoded, the claim
+// protocols along with the retrieval transports IPNI defines
+var protocols = map[multicodec.Code]func() ipnimd.Protocol{
+	multicodec.TransportBitswap:             func() ipnimd.Protocol { return &ipnimd.Bitswap{} },
+	multicodec.TransportGraphsyncFilecoinv1: func() ipnimd.Protocol { return &ipnimd.GraphsyncFilecoinV1{} },
+	multicodec.TransportIpfsGatewayHttp:     func() ipnimd.Protocol { return &ipnimd.IpfsGatewayHttp{} },
+	IndexClaimID:                            func() ipnimd.Protocol { return &IndexClaimMetadata{} },
+	EqualsClaimID:                           func() ipnimd.Protocol { return &EqualsClaimMetadata{} },
+	LocationCommitmentID:                    func() ipnimd.Protocol { return &LocationCommitmentMetadata{} },
+}
+
+// ProtocolName returns a human readable name for the protocol, or an empty
+// string if it has none
+func ProtocolName(code multicodec.Code) string {
+	switch ClaimKind(code) {
+	case IndexKind:
+		return "index-claim"
+	case EqualsKind:
+		return "equals-claim"
+	case LocationKind:
+		return "location-commitment"
+	}
+	if slices.Contains(multicodec.KnownCodes(), code) {
+		return code.String()
+	}
+	return ""
+}
+
+// DecodedProtocol is one of the protocols of encoded metadata
+type DecodedProtocol struct {
+	Code multicodec.Code
+	// Protocol is the decoded protocol, or nil if it couldn't be decoded
+	Protocol ipnimd.Protocol
+	// Raw is the encoding of the protocol if it couldn't be decoded. Protocols
+	// aren't length prefixed, so it runs to the end of the metadata
+	Raw []byte
+	// Err is why the protocol couldn't be decoded
+	Err error
+}
+
+// DecodeProtocols decodes the protocols of the metadata one by one, so that the
+// protocols before one that can't be decoded are still returned. As protocols
+// aren't length prefixed, decoding stops at the first protocol that is unknown
+// or can't be decoded, which is returned with the rest of the metadata
+func DecodeProtocols(data []byte) []DecodedProtocol {
+	var decoded []DecodedProtocol
+	for len(data) > 0 {
+		v, _, err := varint.FromUvarint(data)
+		if err != nil {
+			return append(decoded, DecodedProtocol{Raw: data, Err: fmt.Errorf("reading protocol code: %w", err)})
+		}
+		code := multicodec.Code(v)
+		factory, ok := protocols[code]
+		if !ok {
+			return append(decoded, DecodedProtocol{Code: code, Raw: data, Err: ErrUnknownProtocol})
+		}
+		protocol := factory()
+		n, err := protocol.ReadFrom(bytes.NewReader(data))
+		if err != nil {
+			return append(decoded, DecodedProtocol{Code: code, Raw: data, Err: fmt.Errorf("decoding %s: %w", ProtocolName(code), err)})
+		}
+		decoded = append(decoded, DecodedProtocol{Code: code, Protocol: protocol})
+		data = data[n:]
+	}
+	return decoded
+}
@@ -0,0 +1,115 @@
+package metadata
+
+import (
+	"slices"
+
+	ipnimd "github.com/ipni/go-libipni/metadata"
+	"github.com/multiformats/go-multicodec"
+)
+
+// Kind is the kind of content claim a metadata protocol publishes
+type Kind int
+
+const (
+	// UnknownKind is the kind of protocols that aren't content claims
+	UnknownKind Kind = iota
+	// EqualsKind is the kind of equals claims
+	EqualsKind
+	// IndexKind is the kind of index claims
+	IndexKind
+	// LocationKind is the kind of location commitments
+	LocationKind
+)
+
+func (k Kind) String() string {
+	switch k {
+	case EqualsKind:
+		return "equals"
+	case IndexKind:
+		return "index"
+	case LocationKind:
+		return "location"
+	default:
+		return "unknown"
+	}
+}
+
+// claimKinds are the kinds of the claim protocols, in order of their codes
+var claimKinds = []struct {
+	code multicodec.Code
+	kind Kind
+}{
+	{IndexClaimID, IndexKind},
+	{EqualsClaimID, EqualsKind},
+	{LocationCommitmentID, LocationKind},
+}
+
+// ClaimKind returns the kind of claim published with the protocol, or
+// UnknownKind if it isn't a claim protocol
+func ClaimKind(code multicodec.Code) Kind {
+	for _, ck := range claimKinds {
+		if ck.code == code {
+			return ck.kind
+		}
+	}
+	return UnknownKind
+}
+
+// IsClaimProtocol returns true if the protocol publishes a content claim
+func IsClaimProtocol(code multicodec.Code) bool {
+	return ClaimKind(code) != UnknownKind
+}
+
+// ClaimCodes returns the codes of the claim protocols of the given kinds, in
+// order. With no kinds, the codes of every claim protocol are returned
+func ClaimCodes(kinds ...Kind) []multicodec.Code {
+	var codes []multicodec.Code
+	for _, ck := range claimKinds {
+		if len(kinds) == 0 || slices.Contains(kinds, ck.kind) {
+			codes = append(codes, ck.code)
+		}
+	}
+	return codes
+}
+
+// FilterClaimProtocols returns the claim protocols of the metadata of the given
+// kinds, in the order of the metadata. With no kinds, every claim protocol is
+// returned
+func FilterClaimProtocols(md ipnimd.Metadata, kinds ...Kind) []ipnimd.Protocol {
+	var protocols []ipnimd.Protocol
+	for _, code := range md.Protocols() {
+		kind := ClaimKind(code)
+		if kind == UnknownKind || (len(kinds) > 0 && !slices.Contains(kinds, kind)) {
+			continue
+		}
+		if protocol := md.Get(code); protocol != nil {
+			protocols = append(protocols, protocol)
+		}
+	}
+	return protocols
+}
+
+// ParseKind returns the kind of claim with the given name, or UnknownKind if
+// there is none
+func ParseKind(name string) Kind {
+	for _, ck := range claimKinds {
+		if ck.kind.String() == name {
+			return ck.kind
+		}
+	}
+	return UnknownKind
+}
+
+// ClaimKinds returns the kinds of the claim protocols of the encoded metadata,
+// each once, in order of their codes. Protocols that can't be decoded are
+// skipped
+func ClaimKinds(data []byte) []Kind {
+	decoded := DecodeProtocols(data)
+	var kinds []Kind
+	for _, ck := range claimKinds {
+		if slices.ContainsFunc(decoded, func(p DecodedProtocol) bool { return p.Code == ck.code && p.Err == nil }) {
+			kinds = append(kinds, ck.kind)
+		}
+	}
+	return kinds
+}
@@ -42,10 +42,13 @@ import (
 	_ "embed"
 	"fmt"
 	"io"
+	"math"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
 	"github.com/ipld/go-ipld-prime/node/bindnode"
 	"github.com/ipld/go-ipld-prime/schema"
 	ipnimd "github.com/ipni/go-libipni/metadata"
@@ -70,9 +73,33 @@ func init() {
 	}
 	indexClaimMetadata = bindnode.Prototype((*IndexClaimMetadata)(nil), typeSystem.TypeByName("IndexClaimMetadata"))
 	equalsClaimMetadata = bindnode.Prototype((*EqualsClaimMetadata)(nil), typeSystem.TypeByName("EqualsClaimMetadata"))
-	locationCommitmentMetadata = bindnode.Prototype((*LocationCommitmentMetadata)(nil), typeSystem.TypeByName("LocationCommitmentMetadata"))
+	locationCommitmentMetadata = bindnode.Prototype((*LocationCommitmentMetadata)(nil), typeSystem.TypeByName("LocationCommitmentMetadata"), uint64Converter)
+	nodePrototypes = map[multicodec.Code]schema.TypedPrototype{
+		IndexClaimID:         indexClaimMetadata,
+		EqualsClaimID:        equalsClaimMetadata,
+		LocationCommitmentID: locationCommitmentMetadata,
+	}
 }
 
+// uint64Converter binds schema Ints to uint64 fields. Without it, bindnode
+// can't decode a nullable Int into a *uint64, such as the length of a range
+var uint64Converter = bindnode.TypedIntConverter((*uint64)(nil),
+	func(i int64) (interface{}, error) {
+		if i < 0 {
+			return nil, fmt.Errorf("cannot assign negative integer %d to uint64", i)
+		}
+		u := uint64(i)
+		return &u, nil
+	},
+	func(v interface{}) (int64, error) {
+		u := *v.(*uint64)
+		if u > math.MaxInt64 {
+			return 0, fmt.Errorf("integer %d overflows int64", u)
+		}
+		return int64(u), nil
+	},
+)
+
 // metadata identifiers
 // currently we just use experimental codecs for now
 
@@ -85,11 +112,8 @@ const EqualsClaimID = 0x3E0001
 // LocationCommitmentID is the multicodec for location commitments
 const LocationCommitmentID = 0x3E0002
 
-var nodePrototypes = map[multicodec.Code]schema.TypedPrototype{
-	IndexClaimID:         indexClaimMetadata,
-	EqualsClaimID:        equalsClaimMetadata,
-	LocationCommitmentID: locationCommitmentMetadata,
-}
+// nodePrototypes is populated once the schema is loaded
+var nodePrototypes map[multicodec.Code]schema.TypedPrototype
 
 var MetadataContext ipnimd.MetadataContext
 
@@ -163,10 +187,14 @@ type LocationCommitmentMetadata struct {
 	Expiration int64
 	// Claim indicates the cid of the claim - the claim should be fetchable by combining the http multiaddr of the provider with the claim cid
 	Claim cid.Cid
+	// Template is an optional URL pattern for retrieving blobs from the provider,
+	// such as "https://sp.example/{blobCID}/blob", used in place of the
+	// provider's addresses
+	Template *string
 }
 
 func (l *LocationCommitmentMetadata) ID() multicodec.Code {
-	return EqualsClaimID
+	return LocationCommitmentID
 }
 func (l *LocationCommitmentMetadata) MarshalBinary() ([]byte, error) { return marshalBinary(l) }
 func (l *LocationCommitmentMetadata) UnmarshalBinary(data []byte) error {
@@ -187,7 +215,7 @@ type hasID[T any] interface {
 func marshalBinary(metadata ipnimd.Protocol) ([]byte, error) {
 	buf := bytes.NewBuffer(varint.ToUvarint(uint64(metadata.ID())))
 	nd := bindnode.Wrap(metadata, nodePrototypes[metadata.ID()].Type())
-	if err := dagcbor.Encode(nd, buf); err != nil {
+	if err := dagcbor.Encode(nd.Representation(), buf); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
@@ -195,8 +223,13 @@ func marshalBinary(metadata ipnimd.Protocol) ([]byte, error) {
 
 func unmarshalBinary[PT hasID[T], T any](val PT, data []byte) error {
 	r := bytes.NewReader(data)
-	_, err := readFrom(val, r)
-	return err
+	if _, err := readFrom(val, r); err != nil {
+		return err
+	}
+	if r.Len() > 0 {
+		return fmt.Errorf("%d bytes after %s metadata", r.Len(), val.ID())
+	}
+	return nil
 }
 
 func readFrom[PT hasID[T], T any](val PT, r io.Reader) (int64, error) {
@@ -210,17 +243,75 @@ func readFrom[PT hasID[T], T any](val PT, r io.Reader) (int64, error) {
 		return cr.readCount, fmt.Errorf("transport id does not match %s: %s", val.ID(), id)
 	}
 
-	nb := nodePrototypes[val.ID()].NewBuilder()
-	err = dagcbor.Decode(nb, cr)
+	raw := basicnode.Prototype.Any.NewBuilder()
+	// the protocols of metadata follow one another, so reading stops at the end
+	// of this one
+	err = dagcbor.DecodeOptions{AllowLinks: true, DontParseBeyondEnd: true}.Decode(raw, cr)
 	if err != nil {
 		return cr.readCount, err
 	}
-	nd := nb.Build()
+	nd, err := buildMetadata(nodePrototypes[val.ID()], raw.Build())
+	if err != nil {
+		return cr.readCount, fmt.Errorf("decoding %s metadata: %w", val.ID(), err)
+	}
 	read := bindnode.Unwrap(nd).(PT)
 	*val = *read
 	return cr.readCount, nil
 }
 
+// buildMetadata reads decoded metadata in its representation, falling back to
+// the type-level form, with full field names and absent optional fields
+// written as null, that was encoded before the representation was
+func buildMetadata(proto schema.TypedPrototype, decoded datamodel.Node) (datamodel.Node, error) {
+	nb := proto.Representation().NewBuilder()
+	err := datamodel.Copy(decoded, nb)
+	if err == nil {
+		return nb.Build(), nil
+	}
+	legacy := proto.NewBuilder()
+	if copyTypeLevel(decoded, proto.Type(), legacy) != nil {
+		return nil, err
+	}
+	return legacy.Build(), nil
+}
+
+// copyTypeLevel copies a node of the type-level form of a struct type, leaving
+// out the optional fields that are null
+func copyTypeLevel(n datamodel.Node, typ schema.Type, na datamodel.NodeAssembler) error {
+	st, ok := typ.(*schema.TypeStruct)
+	if !ok || n.Kind() != datamodel.Kind_Map {
+		return datamodel.Copy(n, na)
+	}
+	ma, err := na.BeginMap(n.Length())
+	if err != nil {
+		return err
+	}
+	for it := n.MapIterator(); !it.Done(); {
+		k, v, err := it.Next()
+		if err != nil {
+			return err
+		}
+		name, err := k.AsString()
+		if err != nil {
+			return err
+		}
+		field := st.Field(name)
+		if field == nil {
+			return fmt.Errorf("unknown field %q", name)
+		}
+		if v.IsNull() && field.IsOptional() && !field.IsNullable() {
+			continue
+		}
+		if err := ma.AssembleKey().AssignString(name); err != nil {
+			return err
+		}
+		if err := copyTypeLevel(v, field.Type(), ma.AssembleValue()); err != nil {
+			return err
+		}
+	}
+	return ma.Finish()
+}
+
 // copied from go-libipni
 var (
 	_ io.Reader     = (*countingReader)(nil)
@@ -0,0 +1,370 @@
+package metadata_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	ipnimd "github.com/ipni/go-libipni/metadata"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/stretchr/testify/require"
+)
+
+// fixed CIDs, so that the wire format of fixtures doesn't vary between runs
+var (
+	claimCid = fixedCid(cid.DagCBOR, "claim")
+	indexCid = fixedCid(uint64(multicodec.Car), "index")
+	shardCid = fixedCid(uint64(multicodec.Car), "shard")
+)
+
+func fixedCid(codec uint64, data string) cid.Cid {
+	digest, err := multihash.Sum([]byte(data), multihash.SHA2_256, -1)
+	if err != nil {
+		panic(err)
+	}
+	return cid.NewCidV1(codec, digest)
+}
+
+func randomCid() cid.Cid {
+	return testutil.RandomCID().(cidlink.Link).Cid
+}
+
+func TestMetadata__Prototypes(t *testing.T) {
+	// the prototypes claim metadata is encoded with are those of the loaded
+	// schema, which are only set once the schema is loaded
+	for _, protocol := range []ipnimd.Protocol{
+		&metadata.IndexClaimMetadata{Index: randomCid(), Expiration: 1700000000, Claim: randomCid()},
+		&metadata.EqualsClaimMetadata{Equals: randomCid(), Expiration: 1700000000, Claim: randomCid()},
+	} {
+		data := testutil.Must(protocol.MarshalBinary())(t)
+		md := metadata.MetadataContext.New()
+		require.NoError(t, md.UnmarshalBinary(data))
+		require.Equal(t, protocol, md.Get(protocol.ID()))
+	}
+}
+
+func TestLocationCommitmentMetadata__ID(t *testing.T) {
+	// location commitments were identified as equals claims, so they were
+	// encoded with the wrong prototype
+	shard := randomCid()
+	location := &metadata.LocationCommitmentMetadata{Shard: &shard, Expiration: 1700000000, Claim: randomCid()}
+	require.Equal(t, multicodec.Code(metadata.LocationCommitmentID), location.ID())
+	data := testutil.Must(location.MarshalBinary())(t)
+	id, _ := testutil.Must2(varint.FromUvarint(data))(t)
+	require.Equal(t, uint64(metadata.LocationCommitmentID), id)
+}
+
+func TestMetadata__RoundTrip(t *testing.T) {
+	length := uint64(512)
+	template := "https://sp.example/{blobCID}/blob"
+	testCases := []struct {
+		name     string
+		protocol ipnimd.Protocol
+		// golden is the hex encoded wire format, which must not change
+		golden string
+	}{
+		{
+			name:     "index claim",
+			protocol: &metadata.IndexClaimMetadata{Index: indexCid, Expiration: 1700000000, Claim: claimCid},
+			golden:   "8080f801a36163d82a58250001711220dd1b3c312cf7d816130354452e9629ce39355b0c534129dd26a08cd9a4502ede61651a6553f1006169d82a58260001820412201bc04b5291c26a46d918139138b992d2de976d6851d0893b0476b85bfbdfc6e6",
+		},
+		{
+			name:     "index claim without expiration",
+			protocol: &metadata.IndexClaimMetadata{Index: indexCid, Claim: claimCid},
+			golden:   "8080f801a36163d82a58250001711220dd1b3c312cf7d816130354452e9629ce39355b0c534129dd26a08cd9a4502ede6165006169d82a58260001820412201bc04b5291c26a46d918139138b992d2de976d6851d0893b0476b85bfbdfc6e6",
+		},
+		{
+			name:     "equals claim",
+			protocol: &metadata.EqualsClaimMetadata{Equals: shardCid, Expiration: 1700000000, Claim: claimCid},
+			golden:   "8180f801a3613dd82a5826000182041220df3598cd66f1bb5bc4e2c17be89b7c7ecf0c81e53939f471a6b72db8d139edae6163d82a58250001711220dd1b3c312cf7d816130354452e9629ce39355b0c534129dd26a08cd9a4502ede61651a6553f100",
+		},
+		{
+			name:     "equals claim without expiration",
+			protocol: &metadata.EqualsClaimMetadata{Equals: shardCid, Claim: claimCid},
+			golden:   "8180f801a3613dd82a5826000182041220df3598cd66f1bb5bc4e2c17be89b7c7ecf0c81e53939f471a6b72db8d139edae6163d82a58250001711220dd1b3c312cf7d816130354452e9629ce39355b0c534129dd26a08cd9a4502ede616500",
+		},
+		{
+			name:     "location commitment with no optional fields",
+			protocol: &metadata.LocationCommitmentMetadata{Claim: claimCid},
+			golden:   "8280f801a26163d82a58250001711220dd1b3c312cf7d816130354452e9629ce39355b0c534129dd26a08cd9a4502ede616500",
+		},
+		{
+			name:     "location commitment with every optional field",
+			protocol: &metadata.LocationCommitmentMetadata{Shard: &shardCid, Range: &metadata.Range{Offset: 128, Length: &length}, Expiration: 1700000000, Claim: claimCid, Template: &template},
+			golden:   "8280f801a56163d82a58250001711220dd1b3c312cf7d816130354452e9629ce39355b0c534129dd26a08cd9a4502ede61651a6553f10061728218801902006173d82a5826000182041220df3598cd66f1bb5bc4e2c17be89b7c7ecf0c81e53939f471a6b72db8d139edae6175782168747470733a2f2f73702e6578616d706c652f7b626c6f624349447d2f626c6f62",
+		},
+		{
+			name:     "location commitment with an open ended range",
+			protocol: &metadata.LocationCommitmentMetadata{Range: &metadata.Range{Offset: 128}, Claim: claimCid},
+			golden:   "8280f801a36163d82a58250001711220dd1b3c312cf7d816130354452e9629ce39355b0c534129dd26a08cd9a4502ede6165006172821880f6",
+		},
+		{
+			name:     "location commitment with a shard only",
+			protocol: &metadata.LocationCommitmentMetadata{Shard: &shardCid, Claim: claimCid},
+			golden:   "8280f801a36163d82a58250001711220dd1b3c312cf7d816130354452e9629ce39355b0c534129dd26a08cd9a4502ede6165006173d82a5826000182041220df3598cd66f1bb5bc4e2c17be89b7c7ecf0c81e53939f471a6b72db8d139edae",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := testutil.Must(tc.protocol.MarshalBinary())(t)
+			require.Equal(t, tc.golden, hex.EncodeToString(data))
+
+			// the fixture decodes, both alone and as metadata
+			golden := testutil.Must(hex.DecodeString(tc.golden))(t)
+			decoded := metadata.MetadataContext.New()
+			require.NoError(t, decoded.UnmarshalBinary(golden))
+			require.Equal(t, []multicodec.Code{tc.protocol.ID()}, decoded.Protocols())
+			require.Equal(t, tc.protocol, decoded.Get(tc.protocol.ID()))
+			reread := reflect.New(reflect.TypeOf(tc.protocol).Elem()).Interface().(ipnimd.Protocol)
+			require.NoError(t, reread.UnmarshalBinary(golden))
+			require.Equal(t, tc.protocol, reread)
+		})
+	}
+}
+
+func TestMetadata__WrongProtocol(t *testing.T) {
+	data := testutil.Must((&metadata.IndexClaimMetadata{Index: indexCid, Claim: claimCid}).MarshalBinary())(t)
+	require.Error(t, (&metadata.EqualsClaimMetadata{}).UnmarshalBinary(data))
+	require.Error(t, (&metadata.LocationCommitmentMetadata{}).UnmarshalBinary(data[:len(data)-1]))
+}
+
+func TestClaimKind(t *testing.T) {
+	testCases := []struct {
+		code multicodec.Code
+		kind metadata.Kind
+	}{
+		{metadata.IndexClaimID, metadata.IndexKind},
+		{metadata.EqualsClaimID, metadata.EqualsKind},
+		{metadata.LocationCommitmentID, metadata.LocationKind},
+		{multicodec.TransportBitswap, metadata.UnknownKind},
+		{multicodec.TransportGraphsyncFilecoinv1, metadata.UnknownKind},
+		{multicodec.TransportIpfsGatewayHttp, metadata.UnknownKind},
+		{metadata.LocationCommitmentID + 1, metadata.UnknownKind},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.code.String(), func(t *testing.T) {
+			require.Equal(t, tc.kind, metadata.ClaimKind(tc.code))
+			require.Equal(t, tc.kind != metadata.UnknownKind, metadata.IsClaimProtocol(tc.code))
+		})
+	}
+
+	// every protocol of the metadata context is a claim protocol of a distinct
+	// kind, so adding one without a kind is caught
+	kinds := map[metadata.Kind]bool{}
+	for _, code := range metadata.ClaimCodes() {
+		kind := metadata.ClaimKind(code)
+		require.NotEqual(t, metadata.UnknownKind, kind)
+		require.False(t, kinds[kind], "duplicate kind %s", kind)
+		kinds[kind] = true
+	}
+	require.Len(t, kinds, 3)
+	require.Equal(t, []multicodec.Code{metadata.LocationCommitmentID}, metadata.ClaimCodes(metadata.LocationKind))
+	require.Equal(t, []multicodec.Code{metadata.IndexClaimID, metadata.LocationCommitmentID}, metadata.ClaimCodes(metadata.LocationKind, metadata.IndexKind))
+}
+
+func TestFilterClaimProtocols(t *testing.T) {
+	index := &metadata.IndexClaimMetadata{Index: indexCid, Claim: claimCid}
+	equals := &metadata.EqualsClaimMetadata{Equals: shardCid, Claim: claimCid}
+	location := &metadata.LocationCommitmentMetadata{Claim: claimCid}
+	md := metadata.MetadataContext.New(location, &ipnimd.Bitswap{}, equals, index)
+
+	testCases := []struct {
+		name     string
+		kinds    []metadata.Kind
+		expected []ipnimd.Protocol
+	}{
+		{name: "every claim protocol", expected: []ipnimd.Protocol{index, equals, location}},
+		{name: "one kind", kinds: []metadata.Kind{metadata.EqualsKind}, expected: []ipnimd.Protocol{equals}},
+		{name: "several kinds", kinds: []metadata.Kind{metadata.LocationKind, metadata.IndexKind}, expected: []ipnimd.Protocol{index, location}},
+		{name: "unknown kind", kinds: []metadata.Kind{metadata.UnknownKind}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, metadata.FilterClaimProtocols(md, tc.kinds...))
+		})
+	}
+	require.Empty(t, metadata.FilterClaimProtocols(metadata.MetadataContext.New(&ipnimd.Bitswap{})))
+}
+
+func TestClaimKinds(t *testing.T) {
+	encode := func(protocols ...ipnimd.Protocol) []byte {
+		md := metadata.MetadataContext.New(protocols...)
+		return testutil.Must(md.MarshalBinary())(t)
+	}
+	location := encode(&metadata.LocationCommitmentMetadata{Claim: claimCid}, &ipnimd.Bitswap{})
+	both := encode(&metadata.LocationCommitmentMetadata{Claim: claimCid}, &metadata.IndexClaimMetadata{Index: indexCid, Claim: claimCid})
+	require.Equal(t, []metadata.Kind{metadata.LocationKind}, metadata.ClaimKinds(location))
+	require.Equal(t, []metadata.Kind{metadata.IndexKind, metadata.LocationKind}, metadata.ClaimKinds(both))
+	require.Empty(t, metadata.ClaimKinds(encode(&ipnimd.Bitswap{})))
+	require.Empty(t, metadata.ClaimKinds([]byte{0xff}))
+
+	for _, kind := range []metadata.Kind{metadata.EqualsKind, metadata.IndexKind, metadata.LocationKind} {
+		require.Equal(t, kind, metadata.ParseKind(kind.String()))
+	}
+	require.Equal(t, metadata.UnknownKind, metadata.ParseKind("unknown"))
+}
+
+func TestDecodeProtocols(t *testing.T) {
+	index := &metadata.IndexClaimMetadata{Index: indexCid, Claim: claimCid}
+	location := &metadata.LocationCommitmentMetadata{Claim: claimCid}
+	encode := func(protocols ...ipnimd.Protocol) []byte {
+		var data []byte
+		for _, p := range protocols {
+			data = append(data, testutil.Must(p.MarshalBinary())(t)...)
+		}
+		return data
+	}
+	unknown := append(varint.ToUvarint(0x3f0000), 1, 2, 3)
+
+	t.Run("every protocol", func(t *testing.T) {
+		decoded := metadata.DecodeProtocols(encode(&ipnimd.Bitswap{}, index, location))
+		require.Len(t, decoded, 3)
+		require.Equal(t, multicodec.TransportBitswap, decoded[0].Code)
+		require.Equal(t, index, decoded[1].Protocol)
+		require.Equal(t, location, decoded[2].Protocol)
+		for _, d := range decoded {
+			require.NoError(t, d.Err)
+			require.Empty(t, d.Raw)
+		}
+	})
+
+	t.Run("decoding stops at an unknown protocol", func(t *testing.T) {
+		decoded := metadata.DecodeProtocols(append(encode(index), unknown...))
+		require.Len(t, decoded, 2)
+		require.Equal(t, index, decoded[0].Protocol)
+		require.Equal(t, multicodec.Code(0x3f0000), decoded[1].Code)
+		require.Nil(t, decoded[1].Protocol)
+		require.ErrorIs(t, decoded[1].Err, metadata.ErrUnknownProtocol)
+		require.Equal(t, unknown, decoded[1].Raw)
+	})
+
+	t.Run("decoding stops at a corrupt protocol", func(t *testing.T) {
+		data := encode(index, location)
+		decoded := metadata.DecodeProtocols(data[:len(data)-1])
+		require.Len(t, decoded, 2)
+		require.Equal(t, index, decoded[0].Protocol)
+		require.Equal(t, multicodec.Code(metadata.LocationCommitmentID), decoded[1].Code)
+		require.Error(t, decoded[1].Err)
+		require.NotEmpty(t, decoded[1].Raw)
+	})
+
+	t.Run("names", func(t *testing.T) {
+		require.Equal(t, "index-claim", metadata.ProtocolName(metadata.IndexClaimID))
+		require.Equal(t, "location-commitment", metadata.ProtocolName(metadata.LocationCommitmentID))
+		require.Equal(t, "transport-bitswap", metadata.ProtocolName(multicodec.TransportBitswap))
+		require.Empty(t, metadata.ProtocolName(0x3f0000))
+	})
+}
+
+func TestMetadata__TypeLevelForm(t *testing.T) {
+	// metadata was encoded in the type-level form of its schema before it was
+	// encoded in its representation, with full field names and absent optional
+	// fields written as null
+	encode := func(t *testing.T, id uint64, fields func(ma datamodel.MapAssembler)) []byte {
+		nd := testutil.Must(qp.BuildMap(basicnode.Prototype.Any, -1, fields))(t)
+		var buf bytes.Buffer
+		buf.Write(varint.ToUvarint(id))
+		require.NoError(t, dagcbor.Encode(nd, &buf))
+		return buf.Bytes()
+	}
+	length := uint64(512)
+	testCases := []struct {
+		name     string
+		data     func(t *testing.T) []byte
+		protocol ipnimd.Protocol
+	}{
+		{
+			name: "index claim",
+			data: func(t *testing.T) []byte {
+				return encode(t, uint64(metadata.IndexClaimID), func(ma datamodel.MapAssembler) {
+					qp.MapEntry(ma, "index", qp.Link(cidlink.Link{Cid: indexCid}))
+					qp.MapEntry(ma, "expiration", qp.Int(1700000000))
+					qp.MapEntry(ma, "claim", qp.Link(cidlink.Link{Cid: claimCid}))
+				})
+			},
+			protocol: &metadata.IndexClaimMetadata{Index: indexCid, Expiration: 1700000000, Claim: claimCid},
+		},
+		{
+			name: "equals claim",
+			data: func(t *testing.T) []byte {
+				return encode(t, uint64(metadata.EqualsClaimID), func(ma datamodel.MapAssembler) {
+					qp.MapEntry(ma, "equals", qp.Link(cidlink.Link{Cid: shardCid}))
+					qp.MapEntry(ma, "expiration", qp.Int(1700000000))
+					qp.MapEntry(ma, "claim", qp.Link(cidlink.Link{Cid: claimCid}))
+				})
+			},
+			protocol: &metadata.EqualsClaimMetadata{Equals: shardCid, Expiration: 1700000000, Claim: claimCid},
+		},
+		{
+			name: "location commitment without a range",
+			data: func(t *testing.T) []byte {
+				return encode(t, uint64(metadata.LocationCommitmentID), func(ma datamodel.MapAssembler) {
+					qp.MapEntry(ma, "shard", qp.Link(cidlink.Link{Cid: shardCid}))
+					qp.MapEntry(ma, "range", qp.Null())
+					qp.MapEntry(ma, "expiration", qp.Int(0))
+					qp.MapEntry(ma, "claim", qp.Link(cidlink.Link{Cid: claimCid}))
+					qp.MapEntry(ma, "template", qp.Null())
+				})
+			},
+			protocol: &metadata.LocationCommitmentMetadata{Shard: &shardCid, Claim: claimCid},
+		},
+		{
+			name: "location commitment with a range",
+			data: func(t *testing.T) []byte {
+				return encode(t, uint64(metadata.LocationCommitmentID), func(ma datamodel.MapAssembler) {
+					qp.MapEntry(ma, "shard", qp.Null())
+					qp.MapEntry(ma, "range", qp.Map(2, func(ma datamodel.MapAssembler) {
+						qp.MapEntry(ma, "offset", qp.Int(128))
+						qp.MapEntry(ma, "length", qp.Int(512))
+					}))
+					qp.MapEntry(ma, "expiration", qp.Int(1700000000))
+					qp.MapEntry(ma, "claim", qp.Link(cidlink.Link{Cid: claimCid}))
+					qp.MapEntry(ma, "template", qp.Null())
+				})
+			},
+			protocol: &metadata.LocationCommitmentMetadata{Range: &metadata.Range{Offset: 128, Length: &length}, Expiration: 1700000000, Claim: claimCid},
+		},
+		{
+			name: "location commitment with an open ended range",
+			data: func(t *testing.T) []byte {
+				return encode(t, uint64(metadata.LocationCommitmentID), func(ma datamodel.MapAssembler) {
+					qp.MapEntry(ma, "shard", qp.Null())
+					qp.MapEntry(ma, "range", qp.Map(2, func(ma datamodel.MapAssembler) {
+						qp.MapEntry(ma, "offset", qp.Int(128))
+						qp.MapEntry(ma, "length", qp.Null())
+					}))
+					qp.MapEntry(ma, "expiration", qp.Int(0))
+					qp.MapEntry(ma, "claim", qp.Link(cidlink.Link{Cid: claimCid}))
+					qp.MapEntry(ma, "template", qp.Null())
+				})
+			},
+			protocol: &metadata.LocationCommitmentMetadata{Range: &metadata.Range{Offset: 128}, Claim: claimCid},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := tc.data(t)
+			decoded := metadata.MetadataContext.New()
+			require.NoError(t, decoded.UnmarshalBinary(data))
+			require.Equal(t, tc.protocol, decoded.Get(tc.protocol.ID()))
+
+			// it is written back in its representation
+			reencoded := testutil.Must(decoded.Get(tc.protocol.ID()).(ipnimd.Protocol).MarshalBinary())(t)
+			require.NotEqual(t, data, reencoded)
+			reread := reflect.New(reflect.TypeOf(tc.protocol).Elem()).Interface().(ipnimd.Protocol)
+			require.NoError(t, reread.UnmarshalBinary(reencoded))
+			require.Equal(t, tc.protocol, reread)
+		})
+	}
+}
@@ -5,7 +5,10 @@ import (
 	"bytes"
 	// for importing schema
 	_ "embed"
+	"errors"
 	"fmt"
+	"slices"
+	"time"
 
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/codec/dagcbor"
@@ -14,6 +17,7 @@ import (
 	"github.com/ipni/go-libipni/find/model"
 	peer "github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
 )
 
 var (
@@ -22,14 +26,75 @@ var (
 	peerIDConverter      = bindnode.NamedBytesConverter("PeerID", bytesToPeerID, peerIDtoBytes)
 	multiaddrConverter   = bindnode.NamedBytesConverter("Multiaddr", bytesToMultiaddr, multiaddrToBytes)
 	providerResultsType  schema.Type
+	providerRecordsType  schema.Type
 )
 
+// RecordsVersion is the version of the provider records envelope written by
+// MarshalRecordsCBOR
+const RecordsVersion = 1
+
+// Record is a provider result along with when it was last seen
+type Record struct {
+	model.ProviderResult
+	// SeenAt is when the record was last observed in IPNI, successfully fetched
+	// from or published. Zero if unknown
+	SeenAt time.Time
+}
+
+// Entry is the provider records cached for a hash
+type Entry struct {
+	Records []Record
+	// Complete is set when the records are every record IPNI had for the hash
+	// when they were cached. Entries built up from records cached one at a time,
+	// such as from publishes or fetched claims, are not complete, and only
+	// cover the claim types of the records they hold
+	Complete bool
+	// Claims are the claim types the records were filtered to when read from
+	// IPNI, as not every record was kept. Such entries only cover those claim
+	// types, or every claim type if Claims is empty and the entry is Truncated
+	Claims []multicodec.Code
+	// Truncated is set when IPNI had more records for the claim types than
+	// were kept
+	Truncated bool
+}
+
+// Clone returns a copy of the entry that can be changed without changing the
+// entry
+func (e Entry) Clone() Entry {
+	e.Records = slices.Clone(e.Records)
+	e.Claims = slices.Clone(e.Claims)
+	return e
+}
+
+// Results returns the provider results of the given records
+func Results(records []Record) []model.ProviderResult {
+	if records == nil {
+		return nil
+	}
+	results := make([]model.ProviderResult, 0, len(records))
+	for _, r := range records {
+		results = append(results, r.ProviderResult)
+	}
+	return results
+}
+
+// providerRecords is the encoded form of the ProviderRecords envelope
+type providerRecords struct {
+	Version   int64
+	Results   []model.ProviderResult
+	SeenAt    []*int64
+	Complete  *bool
+	Claims    *[]int64
+	Truncated *bool
+}
+
 func init() {
 	typeSystem, err := ipld.LoadSchemaBytes(providerResultsBytes)
 	if err != nil {
 		panic(fmt.Errorf("failed to load schema: %w", err))
 	}
 	providerResultsType = typeSystem.TypeByName("ProviderResults")
+	providerRecordsType = typeSystem.TypeByName("ProviderRecords")
 }
 
 func bytesToPeerID(data []byte) (interface{}, error) {
@@ -50,14 +115,109 @@ func multiaddrToBytes(ma interface{}) ([]byte, error) {
 	return (*ma.(*multiaddr.Multiaddr)).Bytes(), nil
 }
 
-// UnmarshalCBOR decodes a list provider results from CBOR-encoded bytes
+// UnmarshalCBOR decodes a list provider results from CBOR-encoded bytes, in
+// either the bare list or the versioned records format
 func UnmarshalCBOR(data []byte) ([]model.ProviderResult, error) {
-	var records []model.ProviderResult
-	_, err := ipld.Unmarshal([]byte(data), dagcbor.Decode, &records, providerResultsType, peerIDConverter, multiaddrConverter)
+	records, err := UnmarshalRecordsCBOR(data)
+	if err != nil {
+		return nil, err
+	}
+	return Results(records), nil
+}
+
+// UnmarshalRecordsCBOR decodes provider records from CBOR-encoded bytes. Results
+// encoded as a bare list, as written by MarshalCBOR, have no seen at times
+func UnmarshalRecordsCBOR(data []byte) ([]Record, error) {
+	entry, err := UnmarshalEntryCBOR(data)
 	if err != nil {
 		return nil, err
 	}
-	return records, nil
+	return entry.Records, nil
+}
+
+// UnmarshalEntryCBOR decodes a cached entry of provider records from
+// CBOR-encoded bytes. Entries encoded as a bare list, or before completeness
+// was recorded, are not complete
+func UnmarshalEntryCBOR(data []byte) (Entry, error) {
+	// a CBOR array is the bare list, anything else should be the envelope
+	if len(data) > 0 && data[0]>>5 == 4 {
+		var results []model.ProviderResult
+		_, err := ipld.Unmarshal(data, dagcbor.Decode, &results, providerResultsType, peerIDConverter, multiaddrConverter)
+		if err != nil {
+			return Entry{}, err
+		}
+		records := make([]Record, 0, len(results))
+		for _, result := range results {
+			records = append(records, Record{ProviderResult: result})
+		}
+		return Entry{Records: records}, nil
+	}
+	var envelope providerRecords
+	_, err := ipld.Unmarshal(data, dagcbor.Decode, &envelope, providerRecordsType, peerIDConverter, multiaddrConverter)
+	if err != nil {
+		return Entry{}, err
+	}
+	if envelope.Version != RecordsVersion {
+		return Entry{}, fmt.Errorf("unsupported provider records version: %d", envelope.Version)
+	}
+	if len(envelope.SeenAt) != len(envelope.Results) {
+		return Entry{}, errors.New("provider records seen at times do not match results")
+	}
+	records := make([]Record, 0, len(envelope.Results))
+	for i, result := range envelope.Results {
+		record := Record{ProviderResult: result}
+		if seenAt := envelope.SeenAt[i]; seenAt != nil {
+			record.SeenAt = time.Unix(*seenAt, 0)
+		}
+		records = append(records, record)
+	}
+	entry := Entry{Records: records, Complete: envelope.Complete != nil && *envelope.Complete, Truncated: envelope.Truncated != nil && *envelope.Truncated}
+	if envelope.Claims != nil {
+		for _, code := range *envelope.Claims {
+			entry.Claims = append(entry.Claims, multicodec.Code(code))
+		}
+	}
+	return entry, nil
+}
+
+// MarshalRecordsCBOR encodes provider records in CBOR, in the versioned records
+// format. Seen at times are kept to the second
+func MarshalRecordsCBOR(records []Record) ([]byte, error) {
+	return MarshalEntryCBOR(Entry{Records: records})
+}
+
+// MarshalEntryCBOR encodes a cached entry of provider records in CBOR, in the
+// versioned records format
+func MarshalEntryCBOR(entry Entry) ([]byte, error) {
+	records := entry.Records
+	envelope := providerRecords{
+		Version: RecordsVersion,
+		Results: make([]model.ProviderResult, 0, len(records)),
+		SeenAt:  make([]*int64, 0, len(records)),
+	}
+	for _, record := range records {
+		envelope.Results = append(envelope.Results, record.ProviderResult)
+		var seenAt *int64
+		if !record.SeenAt.IsZero() {
+			s := record.SeenAt.Unix()
+			seenAt = &s
+		}
+		envelope.SeenAt = append(envelope.SeenAt, seenAt)
+	}
+	if entry.Complete {
+		envelope.Complete = &entry.Complete
+	}
+	if len(entry.Claims) > 0 {
+		claims := make([]int64, 0, len(entry.Claims))
+		for _, code := range entry.Claims {
+			claims = append(claims, int64(code))
+		}
+		envelope.Claims = &claims
+	}
+	if entry.Truncated {
+		envelope.Truncated = &entry.Truncated
+	}
+	return ipld.Marshal(dagcbor.Encode, &envelope, providerRecordsType, peerIDConverter, multiaddrConverter)
 }
 
 // MarshalCBOR encodes a list provider results in CBOR
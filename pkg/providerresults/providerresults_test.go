@@ -2,11 +2,14 @@ package providerresults_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/ipni/go-libipni/find/model"
 	peer "github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
 	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
 	"github.com/storacha/indexing-service/pkg/providerresults"
 	"github.com/stretchr/testify/require"
 )
@@ -56,3 +59,72 @@ func TestProviderResults__Equals(t *testing.T) {
 		})
 	}
 }
+
+func TestProviderResults__Records(t *testing.T) {
+	results := []model.ProviderResult{testutil.RandomProviderResult(), testutil.RandomProviderResult()}
+	seenAt := time.Unix(time.Now().Unix(), 0)
+
+	t.Run("round trip", func(t *testing.T) {
+		records := []providerresults.Record{
+			{ProviderResult: results[0], SeenAt: seenAt},
+			{ProviderResult: results[1]},
+		}
+		data := testutil.Must(providerresults.MarshalRecordsCBOR(records))(t)
+		decoded := testutil.Must(providerresults.UnmarshalRecordsCBOR(data))(t)
+		require.Len(t, decoded, 2)
+		require.True(t, providerresults.Equals(results[0], decoded[0].ProviderResult))
+		require.True(t, seenAt.Equal(decoded[0].SeenAt))
+		require.True(t, providerresults.Equals(results[1], decoded[1].ProviderResult))
+		require.True(t, decoded[1].SeenAt.IsZero())
+
+		// readers that only want results can read the records format
+		decodedResults := testutil.Must(providerresults.UnmarshalCBOR(data))(t)
+		require.Equal(t, providerresults.Results(decoded), decodedResults)
+	})
+
+	t.Run("reads results written before seen at times", func(t *testing.T) {
+		data := testutil.Must(providerresults.MarshalCBOR(results))(t)
+		decoded := testutil.Must(providerresults.UnmarshalRecordsCBOR(data))(t)
+		require.Len(t, decoded, 2)
+		for i, record := range decoded {
+			require.True(t, providerresults.Equals(results[i], record.ProviderResult))
+			require.True(t, record.SeenAt.IsZero())
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		data := testutil.Must(providerresults.MarshalRecordsCBOR(nil))(t)
+		decoded := testutil.Must(providerresults.UnmarshalRecordsCBOR(data))(t)
+		require.Empty(t, decoded)
+	})
+
+	t.Run("complete entries", func(t *testing.T) {
+		records := []providerresults.Record{{ProviderResult: results[0], SeenAt: seenAt}}
+		data := testutil.Must(providerresults.MarshalEntryCBOR(providerresults.Entry{Records: records, Complete: true}))(t)
+		entry := testutil.Must(providerresults.UnmarshalEntryCBOR(data))(t)
+		require.True(t, entry.Complete)
+		require.Len(t, entry.Records, 1)
+		require.Len(t, testutil.Must(providerresults.UnmarshalRecordsCBOR(data))(t), 1)
+
+		// records written without completeness, and bare lists, are not complete
+		data = testutil.Must(providerresults.MarshalRecordsCBOR(records))(t)
+		require.False(t, testutil.Must(providerresults.UnmarshalEntryCBOR(data))(t).Complete)
+		data = testutil.Must(providerresults.MarshalCBOR(results))(t)
+		require.False(t, testutil.Must(providerresults.UnmarshalEntryCBOR(data))(t).Complete)
+	})
+
+	t.Run("truncated entries", func(t *testing.T) {
+		records := []providerresults.Record{{ProviderResult: results[0], SeenAt: seenAt}}
+		claims := []multicodec.Code{metadata.LocationCommitmentID, metadata.IndexClaimID}
+		data := testutil.Must(providerresults.MarshalEntryCBOR(providerresults.Entry{Records: records, Claims: claims, Truncated: true}))(t)
+		entry := testutil.Must(providerresults.UnmarshalEntryCBOR(data))(t)
+		require.False(t, entry.Complete)
+		require.True(t, entry.Truncated)
+		require.Equal(t, claims, entry.Claims)
+		require.Len(t, entry.Records, 1)
+
+		entry = testutil.Must(providerresults.UnmarshalEntryCBOR(testutil.Must(providerresults.MarshalRecordsCBOR(records))(t)))(t)
+		require.False(t, entry.Truncated)
+		require.Empty(t, entry.Claims)
+	})
+}
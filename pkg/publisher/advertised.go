@@ -0,0 +1,439 @@
+package publisher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+const (
+	// DefaultAdvertisedFilterCapacity is the number of multihashes the first
+	// stage of the advertised filter holds before another is added
+	DefaultAdvertisedFilterCapacity = 1 << 20
+	// DefaultAdvertisedFilterFalsePositiveRate is the rate the advertised filter
+	// stays under of reporting a multihash that was never advertised
+	DefaultAdvertisedFilterFalsePositiveRate = 0.001
+	// DefaultAdvertisedFilterCheckpoint is the number of advertisements
+	// published between checkpoints of the advertised filter
+	DefaultAdvertisedFilterCheckpoint = 100
+)
+
+// advertisedFilterFormat is the version of the encoding of the checkpoint of
+// the advertised filter
+const advertisedFilterFormat = 1
+
+// advertisedFilterRetry is how long after the advertised filter failed to load
+// or update it is tried again
+const advertisedFilterRetry = time.Minute
+
+var advertisedFilterKey = datastore.NewKey("advertised-filter")
+
+var (
+	// ErrAdvertisedFilterDisabled is returned when using the advertised filter
+	// of a publisher that doesn't keep one
+	ErrAdvertisedFilterDisabled = errors.New("advertised filter is not enabled")
+	// errNotAncestor is returned when the head the advertised filter was built
+	// for isn't in the chain
+	errNotAncestor = errors.New("filter head is not in the chain")
+)
+
+// advertisedFilter is the filter of every multihash advertised in the chain, as
+// of the head it covers
+type advertisedFilter struct {
+	capacity   int
+	rate       float64
+	checkpoint int
+
+	// refresh is held while bringing the filter up to date with the chain
+	refresh sync.Mutex
+	lk      sync.RWMutex
+	filter  *bloomFilter
+	head    ipld.Link
+	// published is the number of advertisements published since the last
+	// checkpoint
+	published int
+	loading   bool
+	failed    time.Time
+}
+
+// WithAdvertisedFilter keeps a scalable bloom filter of every multihash
+// advertised in the chain, for telling that a multihash was never advertised
+// without asking indexers. Its first stage holds the given number of
+// multihashes, and it stays under the given false positive rate however many
+// are added
+func WithAdvertisedFilter(capacity int, falsePositiveRate float64) Option {
+	return func(p *Publisher) {
+		p.advertised = &advertisedFilter{capacity: capacity, rate: falsePositiveRate, checkpoint: DefaultAdvertisedFilterCheckpoint}
+	}
+}
+
+// WithAdvertisedFilterCheckpoint sets the number of advertisements published
+// between checkpoints of the advertised filter. If not set,
+// DefaultAdvertisedFilterCheckpoint is used. Must be given after
+// WithAdvertisedFilter
+func WithAdvertisedFilterCheckpoint(n int) Option {
+	return func(p *Publisher) {
+		if p.advertised != nil {
+			p.advertised.checkpoint = max(1, n)
+		}
+	}
+}
+
+// AdvertisedFilterStats describes the advertised filter
+type AdvertisedFilterStats struct {
+	// Loaded is false until the filter is loaded, when the rest is unset
+	Loaded bool
+	// Head is the advertisement the filter covers the chain up to
+	Head ipld.Link
+	// Hashes is the number of distinct multihashes added to the filter
+	Hashes uint64
+	// Stages is the number of bloom filters the filter has grown to
+	Stages int
+	// Bytes is the size of the bits of the filter
+	Bytes int
+	// FillRatio is the fraction of the bits of the filter that are set
+	FillRatio float64
+	// FalsePositiveRate is the estimated rate of reporting a multihash that was
+	// never advertised, from the bits set
+	FalsePositiveRate float64
+}
+
+// AdvertisedFilterStats returns the stats of the advertised filter
+func (p *Publisher) AdvertisedFilterStats() (AdvertisedFilterStats, error) {
+	af := p.advertised
+	if af == nil {
+		return AdvertisedFilterStats{}, ErrAdvertisedFilterDisabled
+	}
+	af.lk.RLock()
+	defer af.lk.RUnlock()
+	if af.filter == nil {
+		return AdvertisedFilterStats{}, nil
+	}
+	return AdvertisedFilterStats{
+		Loaded:            true,
+		Head:              af.head,
+		Hashes:            af.filter.count(),
+		Stages:            len(af.filter.stages),
+		Bytes:             af.filter.size(),
+		FillRatio:         af.filter.fillRatio(),
+		FalsePositiveRate: af.filter.falsePositiveRate(),
+	}, nil
+}
+
+// MayHaveAdvertised returns false if the multihash was definitely never
+// advertised in the chain, and true if it may have been. A miss is only
+// reported once the filter covers the head of the chain, so that
+// advertisements written by other publishers sharing the datastore, or
+// imported, are never missed.
+//
+// The filter is loaded in the background on first use, and until it is, or
+// while it can't be brought up to date with the chain, true is returned
+func (p *Publisher) MayHaveAdvertised(ctx context.Context, hash mh.Multihash) (bool, error) {
+	af := p.advertised
+	if af == nil {
+		return true, ErrAdvertisedFilterDisabled
+	}
+	af.lk.RLock()
+	loaded, covered, failed := af.filter != nil, af.head, af.failed
+	may := !loaded || af.filter.mayContain(hash)
+	af.lk.RUnlock()
+	if !loaded {
+		p.loadAdvertisedFilter()
+		return true, nil
+	}
+	if may || p.now().Sub(failed) < advertisedFilterRetry {
+		return true, nil
+	}
+	head, err := p.Head(ctx)
+	if err != nil {
+		return true, err
+	}
+	if sameLink(head, covered) {
+		return false, nil
+	}
+	if err := p.refreshAdvertisedFilter(ctx); err != nil {
+		return true, err
+	}
+	af.lk.RLock()
+	defer af.lk.RUnlock()
+	return af.filter.mayContain(hash), nil
+}
+
+// LoadAdvertisedFilter loads the advertised filter from its checkpoint and
+// brings it up to date with the chain. The filter is rebuilt from the chain if
+// there is no checkpoint, or the checkpoint is corrupt, was made with other
+// parameters or for a chain the head no longer descends from
+func (p *Publisher) LoadAdvertisedFilter(ctx context.Context) error {
+	if p.advertised == nil {
+		return ErrAdvertisedFilterDisabled
+	}
+	return p.refreshAdvertisedFilter(ctx)
+}
+
+// RebuildAdvertisedFilter rebuilds the advertised filter from the chain,
+// ignoring its checkpoint
+func (p *Publisher) RebuildAdvertisedFilter(ctx context.Context) (AdvertisedFilterStats, error) {
+	af := p.advertised
+	if af == nil {
+		return AdvertisedFilterStats{}, ErrAdvertisedFilterDisabled
+	}
+	af.refresh.Lock()
+	err := p.updateAdvertisedFilter(ctx, nil, nil)
+	af.refresh.Unlock()
+	if err != nil {
+		return AdvertisedFilterStats{}, err
+	}
+	return p.AdvertisedFilterStats()
+}
+
+// loadAdvertisedFilter starts loading the advertised filter in the background,
+// unless it is already loading or recently failed to
+func (p *Publisher) loadAdvertisedFilter() {
+	af := p.advertised
+	af.lk.Lock()
+	defer af.lk.Unlock()
+	if af.loading || p.now().Sub(af.failed) < advertisedFilterRetry {
+		return
+	}
+	af.loading = true
+	go func() {
+		if err := p.refreshAdvertisedFilter(context.Background()); err != nil {
+			log.Errorw("loading advertised filter", "error", err)
+		}
+		af.lk.Lock()
+		af.loading = false
+		af.lk.Unlock()
+	}()
+}
+
+// refreshAdvertisedFilter brings the advertised filter up to date with the head
+// of the chain, loading it first if it isn't loaded
+func (p *Publisher) refreshAdvertisedFilter(ctx context.Context) error {
+	af := p.advertised
+	af.refresh.Lock()
+	defer af.refresh.Unlock()
+
+	af.lk.RLock()
+	filter, covered := af.filter, af.head
+	af.lk.RUnlock()
+	if filter == nil {
+		var err error
+		filter, covered, err = p.readAdvertisedFilter(ctx)
+		if err != nil {
+			log.Warnw("rebuilding advertised filter from the chain", "error", err)
+			filter, covered = nil, nil
+		}
+	}
+	err := p.updateAdvertisedFilter(ctx, filter, covered)
+	if err != nil {
+		af.lk.Lock()
+		af.failed = p.now()
+		af.lk.Unlock()
+	}
+	return err
+}
+
+// updateAdvertisedFilter adds the multihashes of the advertisements from the
+// head back to the covered advertisement to the filter, and makes it the
+// advertised filter. A nil filter is rebuilt from the whole chain, as is one
+// whose covered advertisement isn't in the chain. The filter is checkpointed
+// if anything was added
+func (p *Publisher) updateAdvertisedFilter(ctx context.Context, filter *bloomFilter, covered ipld.Link) error {
+	af := p.advertised
+	head, err := p.Head(ctx)
+	if err != nil {
+		return err
+	}
+	if filter != nil && sameLink(head, covered) {
+		return p.setAdvertisedFilter(ctx, filter, head, false)
+	}
+	if filter != nil {
+		err := p.addAdvertised(ctx, filter, head, covered)
+		if err == nil {
+			return p.setAdvertisedFilter(ctx, filter, head, true)
+		}
+		if !errors.Is(err, errNotAncestor) {
+			return err
+		}
+		log.Warnw("rebuilding advertised filter from the chain", "error", err, "filterHead", covered, "head", head)
+	}
+	filter, err = newBloomFilter(af.capacity, af.rate)
+	if err != nil {
+		return err
+	}
+	if err := p.addAdvertised(ctx, filter, head, nil); err != nil {
+		return err
+	}
+	return p.setAdvertisedFilter(ctx, filter, head, true)
+}
+
+// addAdvertised walks the chain from the head back to the covered
+// advertisement, or the tail if it is nil, adding the multihashes of each
+// advertisement to the filter. Entries are streamed a chunk at a time, so
+// memory is bounded by the size of the filter
+func (p *Publisher) addAdvertised(ctx context.Context, filter *bloomFilter, head, covered ipld.Link) error {
+	af := p.advertised
+	for link := head; link != nil; {
+		if sameLink(link, covered) {
+			return nil
+		}
+		adv, err := p.advertisement(ctx, link)
+		if err != nil {
+			return err
+		}
+		for hash, err := range Entries(ctx, p.ds, adv.Entries) {
+			if err != nil {
+				return fmt.Errorf("reading entries of advertisement %s: %w", link, err)
+			}
+			// the filter may already be in use
+			af.lk.Lock()
+			filter.add(hash)
+			af.lk.Unlock()
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		link = adv.PreviousID
+	}
+	if covered != nil {
+		return errNotAncestor
+	}
+	return nil
+}
+
+// setAdvertisedFilter makes the filter the advertised filter, covering the
+// chain up to the head, and checkpoints it if asked to
+func (p *Publisher) setAdvertisedFilter(ctx context.Context, filter *bloomFilter, head ipld.Link, checkpoint bool) error {
+	af := p.advertised
+	af.lk.Lock()
+	af.filter, af.head, af.failed = filter, head, time.Time{}
+	var data []byte
+	if checkpoint {
+		data = encodeAdvertisedFilter(filter, head)
+		af.published = 0
+	}
+	af.lk.Unlock()
+	if data == nil {
+		return nil
+	}
+	if err := p.ds.Put(ctx, advertisedFilterKey, data); err != nil {
+		return fmt.Errorf("writing advertised filter: %w", err)
+	}
+	return nil
+}
+
+// advertisedPublished adds the multihashes of an advertisement just published
+// on top of the previous head to the advertised filter. The filter only covers
+// the new head if it covered the previous one, otherwise the advertisements
+// in between are added the next time it is brought up to date
+func (p *Publisher) advertisedPublished(ctx context.Context, previous, link ipld.Link, hashes []mh.Multihash) {
+	af := p.advertised
+	if af == nil {
+		return
+	}
+	af.lk.Lock()
+	if af.filter == nil {
+		af.lk.Unlock()
+		return
+	}
+	for _, hash := range hashes {
+		af.filter.add(hash)
+	}
+	var data []byte
+	if sameLink(af.head, previous) {
+		af.head = link
+		af.published++
+		if af.published >= af.checkpoint {
+			data = encodeAdvertisedFilter(af.filter, link)
+			af.published = 0
+		}
+	}
+	af.lk.Unlock()
+	if data == nil {
+		return
+	}
+	// a checkpoint that fails to be written only means more of the chain is
+	// walked when the filter is next loaded
+	if err := p.ds.Put(ctx, advertisedFilterKey, data); err != nil {
+		log.Warnw("writing advertised filter", "error", err)
+	}
+}
+
+// encodeAdvertisedFilter encodes the checkpoint of the filter as the format,
+// the head it covers and the filter, followed by a SHA-256 checksum of them
+func encodeAdvertisedFilter(filter *bloomFilter, head ipld.Link) []byte {
+	encoded, _ := filter.MarshalBinary()
+	var headBytes []byte
+	if head != nil {
+		headBytes = head.(cidlink.Link).Cid.Bytes()
+	}
+	data := make([]byte, 0, len(encoded)+len(headBytes)+sha256.Size+16)
+	data = binary.AppendUvarint(data, advertisedFilterFormat)
+	data = binary.AppendUvarint(data, uint64(len(headBytes)))
+	data = append(data, headBytes...)
+	data = append(data, encoded...)
+	sum := sha256.Sum256(data)
+	return append(data, sum[:]...)
+}
+
+// readAdvertisedFilter reads the checkpoint of the advertised filter, returning
+// an error if there is none, or it is corrupt or for other parameters
+func (p *Publisher) readAdvertisedFilter(ctx context.Context) (*bloomFilter, ipld.Link, error) {
+	af := p.advertised
+	data, err := p.ds.Get(ctx, advertisedFilterKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading advertised filter: %w", err)
+	}
+	if len(data) < sha256.Size {
+		return nil, nil, fmt.Errorf("decoding advertised filter: %w", errTruncatedFilter)
+	}
+	data, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if expected := sha256.Sum256(data); !bytes.Equal(sum, expected[:]) {
+		return nil, nil, errors.New("decoding advertised filter: checksum mismatch")
+	}
+	r := bloomReader{data: data}
+	if format := r.uvarint(); r.err == nil && format != advertisedFilterFormat {
+		return nil, nil, fmt.Errorf("unknown advertised filter format: %d", format)
+	}
+	n := r.uvarint()
+	if r.err == nil && n > uint64(len(r.data)) {
+		r.err = errTruncatedFilter
+	}
+	if r.err != nil {
+		return nil, nil, fmt.Errorf("decoding advertised filter: %w", r.err)
+	}
+	var head ipld.Link
+	if n > 0 {
+		c, err := cid.Cast(r.data[:n])
+		if err != nil {
+			return nil, nil, fmt.Errorf("decoding advertised filter head: %w", err)
+		}
+		head = cidlink.Link{Cid: c}
+	}
+	var filter bloomFilter
+	if err := filter.UnmarshalBinary(r.data[n:]); err != nil {
+		return nil, nil, fmt.Errorf("decoding advertised filter: %w", err)
+	}
+	if filter.capacity != af.capacity || filter.rate != af.rate {
+		return nil, nil, fmt.Errorf("advertised filter was made with capacity %d and false positive rate %v", filter.capacity, filter.rate)
+	}
+	return &filter, head, nil
+}
+
+func sameLink(a, b ipld.Link) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.String() == b.String()
+}
@@ -0,0 +1,173 @@
+package publisher_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublisher__AdvertisedFilter(t *testing.T) {
+	ctx := context.Background()
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	provider := peer.AddrInfo{ID: testutil.RandomPeer()}
+	const capacity, rate = 100, 0.01
+
+	newPublisher := func(ds datastore.Batching, opts ...publisher.Option) *publisher.Publisher {
+		opts = append([]publisher.Option{publisher.WithAdvertisedFilter(capacity, rate)}, opts...)
+		return publisher.New(ds, key, opts...)
+	}
+	publish := func(t *testing.T, p *publisher.Publisher, sizes ...int) []mh.Multihash {
+		var published []mh.Multihash
+		for _, size := range sizes {
+			hashes := testutil.RandomMultihashes(size)
+			testutil.Must(p.Publish(ctx, provider, testutil.RandomBytes(10), testutil.RandomBytes(10), hashes))(t)
+			published = append(published, hashes...)
+		}
+		return published
+	}
+	requireAdvertised := func(t *testing.T, p *publisher.Publisher, hashes []mh.Multihash) {
+		for _, hash := range hashes {
+			require.True(t, testutil.Must(p.MayHaveAdvertised(ctx, hash))(t), hash.B58String())
+		}
+	}
+	falsePositives := func(t *testing.T, p *publisher.Publisher) int {
+		var n int
+		for _, hash := range testutil.RandomMultihashes(10_000) {
+			if testutil.Must(p.MayHaveAdvertised(ctx, hash))(t) {
+				n++
+			}
+		}
+		return n
+	}
+
+	t.Run("advertised hashes are reported and others are mostly missed", func(t *testing.T) {
+		p := newPublisher(dssync.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, p.LoadAdvertisedFilter(ctx))
+		published := publish(t, p, 100, 150, 250)
+		requireAdvertised(t, p, published)
+		require.Less(t, falsePositives(t, p), int(10_000*rate*2))
+
+		stats := testutil.Must(p.AdvertisedFilterStats())(t)
+		require.True(t, stats.Loaded)
+		require.Equal(t, testutil.Must(p.Head(ctx))(t), stats.Head)
+		require.InDelta(t, len(published), stats.Hashes, 10)
+		require.Greater(t, stats.Stages, 1)
+		require.Greater(t, stats.FillRatio, 0.0)
+		require.Less(t, stats.FillRatio, 1.0)
+		require.Greater(t, stats.FalsePositiveRate, 0.0)
+		require.Less(t, stats.FalsePositiveRate, rate)
+
+		summary := testutil.Must(p.ChainSummary(ctx))(t)
+		require.Equal(t, &stats, summary.Advertised)
+	})
+
+	t.Run("restored from its checkpoint", func(t *testing.T) {
+		ds := &countingDatastore{Batching: dssync.MutexWrap(datastore.NewMapDatastore())}
+		p := newPublisher(ds, publisher.WithAdvertisedFilterCheckpoint(2))
+		require.NoError(t, p.LoadAdvertisedFilter(ctx))
+		published := publish(t, p, 50, 50, 50)
+		stats := testutil.Must(p.AdvertisedFilterStats())(t)
+
+		// the checkpoint covers the first two advertisements, so only the
+		// third and its entries are read to bring it up to date
+		reads := ds.advertReads()
+		restored := newPublisher(ds)
+		require.NoError(t, restored.LoadAdvertisedFilter(ctx))
+		require.Equal(t, 2, ds.advertReads()-reads)
+		requireAdvertised(t, restored, published)
+		require.Equal(t, stats, testutil.Must(restored.AdvertisedFilterStats())(t))
+	})
+
+	t.Run("rebuilt from the chain when the checkpoint is corrupt", func(t *testing.T) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		p := newPublisher(ds, publisher.WithAdvertisedFilterCheckpoint(1))
+		require.NoError(t, p.LoadAdvertisedFilter(ctx))
+		published := publish(t, p, 30, 40)
+		data := testutil.Must(ds.Get(ctx, datastore.NewKey("advertised-filter")))(t)
+		data[len(data)/2] ^= 0xff
+		require.NoError(t, ds.Put(ctx, datastore.NewKey("advertised-filter"), data))
+
+		restored := newPublisher(ds)
+		require.NoError(t, restored.LoadAdvertisedFilter(ctx))
+		requireAdvertised(t, restored, published)
+		// the rebuilt filter is checkpointed in place of the corrupt one
+		require.False(t, bytes.Equal(data, testutil.Must(ds.Get(ctx, datastore.NewKey("advertised-filter")))(t)))
+	})
+
+	t.Run("rebuilt from the chain when made with other parameters", func(t *testing.T) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		p := newPublisher(ds, publisher.WithAdvertisedFilterCheckpoint(1))
+		require.NoError(t, p.LoadAdvertisedFilter(ctx))
+		published := publish(t, p, 30)
+
+		restored := publisher.New(ds, key, publisher.WithAdvertisedFilter(capacity*2, rate))
+		require.NoError(t, restored.LoadAdvertisedFilter(ctx))
+		requireAdvertised(t, restored, published)
+		require.Equal(t, 1, testutil.Must(restored.AdvertisedFilterStats())(t).Stages)
+	})
+
+	t.Run("a rebuild is equivalent to the filter kept while publishing", func(t *testing.T) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		p := publisher.New(ds, key, publisher.WithAdvertisedFilter(10_000, rate))
+		require.NoError(t, p.LoadAdvertisedFilter(ctx))
+		published := publish(t, p, 20, 0, 300, 45)
+		testutil.Must(p.Remove(ctx, provider, testutil.RandomBytes(10)))(t)
+		published = append(published, publish(t, p, 10)...)
+		kept := testutil.Must(p.AdvertisedFilterStats())(t)
+
+		rebuilt := testutil.Must(p.RebuildAdvertisedFilter(ctx))(t)
+		requireAdvertised(t, p, published)
+		require.Equal(t, kept.Head, rebuilt.Head)
+		require.Equal(t, kept.Bytes, rebuilt.Bytes)
+		// the bits set don't depend on the order the hashes were added in
+		require.Equal(t, kept.FillRatio, rebuilt.FillRatio)
+		require.Equal(t, kept.FalsePositiveRate, rebuilt.FalsePositiveRate)
+	})
+
+	t.Run("advertisements of other publishers sharing the datastore are not missed", func(t *testing.T) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		p := newPublisher(ds)
+		require.NoError(t, p.LoadAdvertisedFilter(ctx))
+		other := newPublisher(ds)
+		published := publish(t, other, 20)
+		requireAdvertised(t, p, published)
+		require.Equal(t, testutil.Must(other.Head(ctx))(t), testutil.Must(p.AdvertisedFilterStats())(t).Head)
+		// its own publishes on top of them are then covered too
+		published = append(published, publish(t, p, 20)...)
+		requireAdvertised(t, p, published)
+		require.Equal(t, testutil.Must(p.Head(ctx))(t), testutil.Must(p.AdvertisedFilterStats())(t).Head)
+	})
+
+	t.Run("loaded in the background on first use", func(t *testing.T) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		published := publish(t, newPublisher(ds), 20)
+		p := newPublisher(ds)
+		require.False(t, testutil.Must(p.AdvertisedFilterStats())(t).Loaded)
+		// everything may have been advertised until the filter is loaded
+		require.True(t, testutil.Must(p.MayHaveAdvertised(ctx, testutil.RandomMultihash()))(t))
+		require.Eventually(t, func() bool {
+			return testutil.Must(p.AdvertisedFilterStats())(t).Loaded
+		}, time.Second, 10*time.Millisecond)
+		requireAdvertised(t, p, published)
+		require.Less(t, falsePositives(t, p), int(10_000*rate*2))
+	})
+
+	t.Run("publishers without a filter", func(t *testing.T) {
+		p := publisher.New(dssync.MutexWrap(datastore.NewMapDatastore()), key)
+		may, err := p.MayHaveAdvertised(ctx, testutil.RandomMultihash())
+		require.ErrorIs(t, err, publisher.ErrAdvertisedFilterDisabled)
+		require.True(t, may)
+		require.ErrorIs(t, p.LoadAdvertisedFilter(ctx), publisher.ErrAdvertisedFilterDisabled)
+		require.Nil(t, testutil.Must(p.ChainSummary(ctx))(t).Advertised)
+	})
+}
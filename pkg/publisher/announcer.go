@@ -0,0 +1,561 @@
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipni/go-libipni/announce"
+	"github.com/ipni/go-libipni/announce/message"
+	"github.com/multiformats/go-multiaddr"
+)
+
+var log = logging.Logger("publisher")
+
+var journalPrefix = datastore.NewKey("announcements")
+
+// AnnouncePolicy decides when an advertisement counts as announced
+type AnnouncePolicy int
+
+const (
+	// AnnounceAny counts an advertisement as announced once any endpoint
+	// confirms it
+	AnnounceAny AnnouncePolicy = iota
+	// AnnounceAllRequired counts an advertisement as announced once every
+	// required endpoint confirms it. If no endpoint is required, every endpoint is
+	AnnounceAllRequired
+)
+
+type (
+	// AnnouncerOption configures an Announcer
+	AnnouncerOption func(*announcerConfig)
+
+	announcerConfig struct {
+		policy     AnnouncePolicy
+		addrs      []multiaddr.Multiaddr
+		minBackoff time.Duration
+		maxBackoff time.Duration
+		metrics    AnnounceMetrics
+		routes     AnnounceRoutes
+	}
+
+	// AnnounceMetrics is told about every announcement sent
+	AnnounceMetrics interface {
+		// AnnounceSent is called after an announcement is sent to the named
+		// endpoint, with the error if it failed
+		AnnounceSent(endpoint string, err error)
+	}
+
+	noopAnnounceMetrics struct{}
+
+	// AnnounceEndpoint is an indexer advertisements are announced to
+	AnnounceEndpoint struct {
+		// Name identifies the endpoint in the journal, so it must stay the same
+		// across restarts
+		Name     string
+		Sender   announce.Sender
+		Required bool
+	}
+
+	// Announcer announces published advertisements to a set of indexers. Each
+	// endpoint has its own worker, retry backoff and health, so an endpoint that
+	// is down doesn't hold up the others. Advertisements are journaled with the
+	// endpoints that confirmed them, so that after a restart they are only
+	// announced again to the endpoints that hadn't.
+	//
+	// An indexer syncs the chain back from the announced head, so an endpoint is
+	// only sent the newest advertisement it hasn't confirmed, and confirming it
+	// confirms every older one
+	Announcer struct {
+		*announcerConfig
+		journal   datastore.Batching
+		contexts  datastore.Batching
+		current   atomic.Pointer[AnnounceRoutes]
+		endpoints []*endpoint
+		seq       atomic.Uint64
+		lk        sync.Mutex
+		closing   chan struct{}
+		closed    sync.WaitGroup
+	}
+
+	// Announcement is a journaled advertisement not yet confirmed by every
+	// endpoint
+	Announcement struct {
+		Seq  uint64
+		Link cid.Cid
+		// Targets are the names of the endpoints the advertisement is announced
+		// to, or nil if it is announced to every endpoint
+		Targets []string
+		// Confirmed are the names of the endpoints that confirmed the
+		// advertisement
+		Confirmed []string
+		// Announced is true once the confirmations satisfy the announce policy
+		Announced bool
+		Added     time.Time
+	}
+
+	// EndpointHealth describes the recent announcements to an endpoint
+	EndpointHealth struct {
+		Name     string
+		Required bool
+		// Pending is the number of journaled advertisements announced to the
+		// endpoint that it hasn't confirmed
+		Pending             int
+		ConsecutiveFailures int
+		LastSuccess         time.Time
+		LastFailure         time.Time
+		LastError           string
+		NextAttempt         time.Time
+	}
+
+	// AnnouncerStats describes the state of the announcer
+	AnnouncerStats struct {
+		// Pending is the number of advertisements not yet announced under the
+		// announce policy
+		Pending int
+		// Unconfirmed is the number of advertisements not yet confirmed by every
+		// endpoint
+		Unconfirmed int
+		Endpoints   []EndpointHealth
+	}
+
+	endpoint struct {
+		AnnounceEndpoint
+		wake   chan struct{}
+		lk     sync.Mutex
+		health EndpointHealth
+	}
+
+	storedAnnouncement struct {
+		Link      string    `json:"link"`
+		Targets   []string  `json:"targets,omitempty"`
+		Confirmed []string  `json:"confirmed"`
+		Announced bool      `json:"announced"`
+		Added     time.Time `json:"added"`
+	}
+)
+
+// WithAnnouncePolicy sets when an advertisement counts as announced. If not set,
+// AnnounceAny is used
+func WithAnnouncePolicy(policy AnnouncePolicy) AnnouncerOption {
+	return func(c *announcerConfig) {
+		c.policy = policy
+	}
+}
+
+// WithAnnounceAddrs sets the addresses advertisements can be fetched from, which
+// are sent with every announcement
+func WithAnnounceAddrs(addrs ...multiaddr.Multiaddr) AnnouncerOption {
+	return func(c *announcerConfig) {
+		c.addrs = addrs
+	}
+}
+
+// WithAnnounceBackoff sets the minimum and maximum delay between announcement
+// attempts to an endpoint that is failing
+func WithAnnounceBackoff(min, max time.Duration) AnnouncerOption {
+	return func(c *announcerConfig) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// WithAnnounceMetrics reports every announcement sent to the given metrics
+func WithAnnounceMetrics(m AnnounceMetrics) AnnouncerOption {
+	return func(c *announcerConfig) {
+		c.metrics = m
+	}
+}
+
+// WithAnnounceRoutes sets the endpoints advertisements are announced to by the
+// kinds of claims they carry. If not set, every advertisement is announced to
+// every endpoint
+func WithAnnounceRoutes(routes AnnounceRoutes) AnnouncerOption {
+	return func(c *announcerConfig) {
+		c.routes = routes
+	}
+}
+
+func (noopAnnounceMetrics) AnnounceSent(string, error) {}
+
+// NewAnnouncer returns an announcer sending to the given endpoints, using the
+// given datastore for its journal
+func NewAnnouncer(ds datastore.Batching, endpoints []AnnounceEndpoint, opts ...AnnouncerOption) (*Announcer, error) {
+	c := &announcerConfig{
+		policy:     AnnounceAny,
+		minBackoff: time.Second,
+		maxBackoff: 5 * time.Minute,
+		metrics:    noopAnnounceMetrics{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	journal := namespace.Wrap(ds, journalPrefix)
+	seq, err := lastSequence(journal)
+	if err != nil {
+		return nil, fmt.Errorf("reading announcement journal: %w", err)
+	}
+	a := &Announcer{
+		announcerConfig: c,
+		journal:         journal,
+		contexts:        namespace.Wrap(ds, routesPrefix),
+		closing:         make(chan struct{}),
+	}
+	for _, e := range endpoints {
+		a.endpoints = append(a.endpoints, &endpoint{
+			AnnounceEndpoint: e,
+			wake:             make(chan struct{}, 1),
+			health:           EndpointHealth{Name: e.Name, Required: e.Required},
+		})
+	}
+	if err := a.SetRoutes(c.routes); err != nil {
+		return nil, err
+	}
+	a.seq.Store(seq)
+	return a, nil
+}
+
+// Announce journals the advertisement for announcement to the endpoints it is
+// routed to, which are every endpoint unless routes are set
+func (a *Announcer) Announce(ctx context.Context, link ipld.Link, opts ...AnnounceOption) error {
+	c := &announceConfig{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	routes := a.current.Load()
+	targets := a.route(routes, c.kinds)
+	// without routes every context ID is announced to every endpoint, which is
+	// what is assumed of those not remembered
+	if c.contextID != nil && !routes.zero() {
+		if err := a.putRoute(ctx, c.provider, c.contextID, targets); err != nil {
+			return err
+		}
+	}
+	if len(targets) == 0 {
+		log.Debugw("advertisement routed to no endpoint", "advertisement", link, "kinds", c.kinds)
+		return nil
+	}
+	return a.journalAnnouncement(ctx, link, targets)
+}
+
+// journalAnnouncement journals the advertisement for announcement to the named
+// endpoints
+func (a *Announcer) journalAnnouncement(ctx context.Context, link ipld.Link, targets []string) error {
+	data, err := json.Marshal(storedAnnouncement{Link: link.String(), Targets: targets, Confirmed: []string{}, Added: time.Now().UTC()})
+	if err != nil {
+		return fmt.Errorf("encoding announcement: %w", err)
+	}
+	if err := a.journal.Put(ctx, journalKey(a.seq.Add(1)), data); err != nil {
+		return fmt.Errorf("writing announcement journal: %w", err)
+	}
+	for _, e := range a.endpoints {
+		if slices.Contains(targets, e.Name) {
+			e.notify()
+		}
+	}
+	return nil
+}
+
+// Announcements returns the advertisements not yet confirmed by every endpoint,
+// oldest first
+func (a *Announcer) Announcements(ctx context.Context) ([]Announcement, error) {
+	results, err := a.journal.Query(ctx, query.Query{Orders: []query.Order{query.OrderByKey{}}})
+	if err != nil {
+		return nil, fmt.Errorf("reading announcement journal: %w", err)
+	}
+	stored, err := results.Rest()
+	if err != nil {
+		return nil, fmt.Errorf("reading announcement journal: %w", err)
+	}
+	announcements := make([]Announcement, 0, len(stored))
+	for _, result := range stored {
+		ann, err := decodeAnnouncement(result)
+		if err != nil {
+			return nil, err
+		}
+		announcements = append(announcements, ann)
+	}
+	return announcements, nil
+}
+
+// Stats returns the number of journaled advertisements and the health of every
+// endpoint
+func (a *Announcer) Stats(ctx context.Context) (AnnouncerStats, error) {
+	announcements, err := a.Announcements(ctx)
+	if err != nil {
+		return AnnouncerStats{}, err
+	}
+	stats := AnnouncerStats{Unconfirmed: len(announcements)}
+	for _, ann := range announcements {
+		if !ann.Announced {
+			stats.Pending++
+		}
+	}
+	for _, e := range a.endpoints {
+		e.lk.Lock()
+		health := e.health
+		e.lk.Unlock()
+		for _, ann := range announcements {
+			if ann.routedTo(e.Name) && !slices.Contains(ann.Confirmed, e.Name) {
+				health.Pending++
+			}
+		}
+		stats.Endpoints = append(stats.Endpoints, health)
+	}
+	return stats, nil
+}
+
+// Startup starts a worker for every endpoint in the background (returns
+// immediately). Journaled advertisements are announced to the endpoints that
+// haven't confirmed them
+func (a *Announcer) Startup() {
+	for _, e := range a.endpoints {
+		e.notify()
+		a.closed.Add(1)
+		go a.run(e)
+	}
+}
+
+// Shutdown stops announcing, returning when every worker stops or the passed
+// context cancels. Unconfirmed advertisements remain in the journal
+func (a *Announcer) Shutdown(ctx context.Context) error {
+	close(a.closing)
+	closed := make(chan struct{})
+	go func() {
+		a.closed.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *endpoint) notify() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (a *Announcer) run(e *endpoint) {
+	defer a.closed.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-a.closing
+		cancel()
+	}()
+	timer := time.NewTimer(0)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-a.closing:
+			return
+		case <-timer.C:
+		case <-e.wake:
+		}
+		e.lk.Lock()
+		wait := time.Until(e.health.NextAttempt)
+		e.lk.Unlock()
+		if wait <= 0 {
+			retry, err := a.announceTo(ctx, e)
+			if err != nil && ctx.Err() == nil {
+				log.Errorw("announcing advertisement", "endpoint", e.Name, "error", err)
+			}
+			if !retry {
+				continue
+			}
+			e.lk.Lock()
+			wait = time.Until(e.health.NextAttempt)
+			e.lk.Unlock()
+		}
+		timer.Reset(wait)
+	}
+}
+
+// announceTo sends the newest advertisement announced to the endpoint that it
+// hasn't confirmed, returning true if it should be retried after the endpoint
+// backoff
+func (a *Announcer) announceTo(ctx context.Context, e *endpoint) (bool, error) {
+	announcements, err := a.Announcements(ctx)
+	if err != nil {
+		return false, err
+	}
+	i := len(announcements) - 1
+	for ; i >= 0 && (!announcements[i].routedTo(e.Name) || slices.Contains(announcements[i].Confirmed, e.Name)); i-- {
+	}
+	if i < 0 {
+		return false, nil
+	}
+	ann := announcements[i]
+	msg := message.Message{Cid: ann.Link}
+	msg.SetAddrs(a.addrs)
+	now := time.Now()
+	if err := e.Sender.Send(ctx, msg); err != nil {
+		if ctx.Err() != nil {
+			return false, nil
+		}
+		a.metrics.AnnounceSent(e.Name, err)
+		e.lk.Lock()
+		e.health.ConsecutiveFailures++
+		e.health.LastFailure = now
+		e.health.LastError = err.Error()
+		e.health.NextAttempt = now.Add(a.backoff(e.health.ConsecutiveFailures))
+		attempts := e.health.ConsecutiveFailures
+		e.lk.Unlock()
+		log.Warnw("announcement failed", "endpoint", e.Name, "advertisement", ann.Link, "attempts", attempts, "error", err)
+		return true, nil
+	}
+	a.metrics.AnnounceSent(e.Name, nil)
+	e.lk.Lock()
+	e.health.ConsecutiveFailures = 0
+	e.health.LastSuccess = now
+	e.health.NextAttempt = time.Time{}
+	e.lk.Unlock()
+	return false, a.confirm(ctx, e.Name, ann.Seq)
+}
+
+// confirm records that the endpoint confirmed every advertisement announced to
+// it up to seq, removing the advertisements every endpoint they were announced
+// to has confirmed
+func (a *Announcer) confirm(ctx context.Context, name string, seq uint64) error {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	announcements, err := a.Announcements(ctx)
+	if err != nil {
+		return err
+	}
+	batch, err := a.journal.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	for _, ann := range announcements {
+		if ann.Seq > seq || !ann.routedTo(name) || slices.Contains(ann.Confirmed, name) {
+			continue
+		}
+		ann.Confirmed = append(ann.Confirmed, name)
+		if !ann.Announced && a.satisfied(ann) {
+			ann.Announced = true
+			log.Infow("advertisement announced", "advertisement", ann.Link, "confirmed", ann.Confirmed)
+		}
+		key := journalKey(ann.Seq)
+		if a.allConfirmed(ann) {
+			if err := batch.Delete(ctx, key); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := json.Marshal(storedAnnouncement{Link: ann.Link.String(), Targets: ann.Targets, Confirmed: ann.Confirmed, Announced: ann.Announced, Added: ann.Added})
+		if err != nil {
+			return fmt.Errorf("encoding announcement: %w", err)
+		}
+		if err := batch.Put(ctx, key, data); err != nil {
+			return err
+		}
+	}
+	if err := batch.Commit(ctx); err != nil {
+		return fmt.Errorf("writing announcement journal: %w", err)
+	}
+	return nil
+}
+
+// satisfied returns true if the advertisement counts as announced under the
+// announce policy. Only the endpoints it is announced to count, so one
+// announced to a few endpoints doesn't wait on the health of the others
+func (a *Announcer) satisfied(ann Announcement) bool {
+	if a.policy == AnnounceAny {
+		return len(ann.Confirmed) > 0
+	}
+	required := slices.ContainsFunc(a.endpoints, func(e *endpoint) bool { return e.Required && ann.routedTo(e.Name) })
+	for _, e := range a.endpoints {
+		if ann.routedTo(e.Name) && (e.Required || !required) && !slices.Contains(ann.Confirmed, e.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *Announcer) allConfirmed(ann Announcement) bool {
+	for _, e := range a.endpoints {
+		if ann.routedTo(e.Name) && !slices.Contains(ann.Confirmed, e.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// routedTo returns true if the advertisement is announced to the named endpoint
+func (ann Announcement) routedTo(name string) bool {
+	return ann.Targets == nil || slices.Contains(ann.Targets, name)
+}
+
+func (a *Announcer) backoff(attempts int) time.Duration {
+	backoff := a.minBackoff
+	for i := 1; i < attempts && backoff < a.maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, a.maxBackoff)
+}
+
+func decodeAnnouncement(result query.Entry) (Announcement, error) {
+	var stored storedAnnouncement
+	if err := json.Unmarshal(result.Value, &stored); err != nil {
+		return Announcement{}, fmt.Errorf("decoding announcement %s: %w", result.Key, err)
+	}
+	link, err := cid.Decode(stored.Link)
+	if err != nil {
+		return Announcement{}, fmt.Errorf("decoding announcement %s: %w", result.Key, err)
+	}
+	seq, err := strconv.ParseUint(strings.TrimPrefix(result.Key, "/"), 10, 64)
+	if err != nil {
+		return Announcement{}, fmt.Errorf("decoding announcement %s: %w", result.Key, err)
+	}
+	return Announcement{
+		Seq:       seq,
+		Link:      link,
+		Targets:   stored.Targets,
+		Confirmed: stored.Confirmed,
+		Announced: stored.Announced,
+		Added:     stored.Added,
+	}, nil
+}
+
+func journalKey(seq uint64) datastore.Key {
+	return datastore.NewKey(fmt.Sprintf("%020d", seq))
+}
+
+func lastSequence(journal datastore.Batching) (uint64, error) {
+	results, err := journal.Query(context.Background(), query.Query{
+		KeysOnly: true,
+		Orders:   []query.Order{query.OrderByKeyDescending{}},
+		Limit:    1,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer results.Close()
+	result, ok := results.NextSync()
+	if !ok {
+		return 0, nil
+	}
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return strconv.ParseUint(strings.TrimPrefix(result.Key, "/"), 10, 64)
+}
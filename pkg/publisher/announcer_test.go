@@ -0,0 +1,244 @@
+package publisher_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/announce/message"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSender struct {
+	lk      sync.Mutex
+	failing bool
+	sent    []cid.Cid
+}
+
+func (f *fakeSender) setFailing(failing bool) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	f.failing = failing
+}
+
+func (f *fakeSender) received() []cid.Cid {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	return append([]cid.Cid{}, f.sent...)
+}
+
+func (f *fakeSender) Close() error { return nil }
+
+func (f *fakeSender) Send(ctx context.Context, msg message.Message) error {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	if f.failing {
+		return errors.New("connection refused")
+	}
+	f.sent = append(f.sent, msg.Cid)
+	return nil
+}
+
+func TestAnnouncer(t *testing.T) {
+	ctx := context.Background()
+	links := []cidlink.Link{testutil.RandomCID().(cidlink.Link), testutil.RandomCID().(cidlink.Link)}
+
+	start := func(t *testing.T, ds datastore.Batching, policy publisher.AnnouncePolicy, stable, flapping *fakeSender) *publisher.Announcer {
+		a := testutil.Must(publisher.NewAnnouncer(ds, []publisher.AnnounceEndpoint{
+			{Name: "stable", Sender: stable},
+			{Name: "flapping", Sender: flapping, Required: true},
+		}, publisher.WithAnnouncePolicy(policy), publisher.WithAnnounceBackoff(5*time.Millisecond, 10*time.Millisecond)))(t)
+		a.Startup()
+		return a
+	}
+	confirmedBy := func(t *testing.T, a *publisher.Announcer, names ...string) func() bool {
+		return func() bool {
+			announcements := testutil.Must(a.Announcements(ctx))(t)
+			if len(announcements) != len(links) {
+				return false
+			}
+			for _, ann := range announcements {
+				if !slices.Equal(ann.Confirmed, names) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	t.Run("endpoints progress independently and resume from the journal", func(t *testing.T) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		stable, flapping := &fakeSender{}, &fakeSender{failing: true}
+		a := start(t, ds, publisher.AnnounceAny, stable, flapping)
+		for _, link := range links {
+			require.NoError(t, a.Announce(ctx, link))
+		}
+
+		require.Eventually(t, confirmedBy(t, a, "stable"), time.Second, 5*time.Millisecond)
+		require.Contains(t, stable.received(), links[1].Cid)
+		require.Eventually(t, func() bool {
+			stats := testutil.Must(a.Stats(ctx))(t)
+			return stats.Endpoints[1].ConsecutiveFailures > 1
+		}, time.Second, 5*time.Millisecond)
+		stats := testutil.Must(a.Stats(ctx))(t)
+		require.Zero(t, stats.Pending)
+		require.Equal(t, 2, stats.Unconfirmed)
+		require.Zero(t, stats.Endpoints[0].ConsecutiveFailures)
+		require.False(t, stats.Endpoints[0].LastSuccess.IsZero())
+		require.Equal(t, "connection refused", stats.Endpoints[1].LastError)
+		for _, ann := range testutil.Must(a.Announcements(ctx))(t) {
+			require.True(t, ann.Announced)
+		}
+		require.NoError(t, a.Shutdown(ctx))
+
+		// after a restart, only the endpoint that hadn't confirmed is announced to,
+		// and only with the head
+		restarted, recovered := &fakeSender{}, &fakeSender{}
+		a = start(t, ds, publisher.AnnounceAny, restarted, recovered)
+		t.Cleanup(func() { a.Shutdown(ctx) })
+		require.Eventually(t, func() bool {
+			return len(testutil.Must(a.Announcements(ctx))(t)) == 0
+		}, time.Second, 5*time.Millisecond)
+		require.Equal(t, []cid.Cid{links[1].Cid}, recovered.received())
+		require.Empty(t, restarted.received())
+	})
+
+	t.Run("required endpoints hold back the announced state", func(t *testing.T) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		stable, flapping := &fakeSender{}, &fakeSender{failing: true}
+		a := start(t, ds, publisher.AnnounceAllRequired, stable, flapping)
+		t.Cleanup(func() { a.Shutdown(ctx) })
+		for _, link := range links {
+			require.NoError(t, a.Announce(ctx, link))
+		}
+
+		require.Eventually(t, confirmedBy(t, a, "stable"), time.Second, 5*time.Millisecond)
+		for _, ann := range testutil.Must(a.Announcements(ctx))(t) {
+			require.False(t, ann.Announced)
+		}
+		require.Equal(t, 2, testutil.Must(a.Stats(ctx))(t).Pending)
+
+		flapping.setFailing(false)
+		require.Eventually(t, func() bool {
+			return len(testutil.Must(a.Announcements(ctx))(t)) == 0
+		}, time.Second, 5*time.Millisecond)
+		require.Equal(t, []cid.Cid{links[1].Cid}, flapping.received())
+		require.Zero(t, testutil.Must(a.Stats(ctx))(t).Endpoints[1].ConsecutiveFailures)
+	})
+}
+
+func TestAnnouncer__Routes(t *testing.T) {
+	ctx := context.Background()
+	start := func(t *testing.T, routes publisher.AnnounceRoutes, public, private *fakeSender) *publisher.Announcer {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		a := testutil.Must(publisher.NewAnnouncer(ds, []publisher.AnnounceEndpoint{
+			{Name: "public", Sender: public, Required: true},
+			{Name: "private", Sender: private},
+		}, publisher.WithAnnouncePolicy(publisher.AnnounceAllRequired), publisher.WithAnnounceRoutes(routes), publisher.WithAnnounceBackoff(5*time.Millisecond, 10*time.Millisecond)))(t)
+		a.Startup()
+		t.Cleanup(func() { a.Shutdown(ctx) })
+		return a
+	}
+	link := func() cidlink.Link { return testutil.RandomCID().(cidlink.Link) }
+	received := func(f *fakeSender, links ...cidlink.Link) func() bool {
+		return func() bool {
+			want := make([]cid.Cid, 0, len(links))
+			for _, l := range links {
+				want = append(want, l.Cid)
+			}
+			return slices.Equal(f.received(), want)
+		}
+	}
+
+	t.Run("disjoint, overlapping and default routes", func(t *testing.T) {
+		public, private := &fakeSender{failing: true}, &fakeSender{}
+		a := start(t, publisher.AnnounceRoutes{
+			Kinds: map[string][]string{
+				"location": {"private"},
+				"index":    {"public", "private"},
+				"equals":   {},
+			},
+			Default: []string{"public"},
+		}, public, private)
+
+		// a private advertisement never waits on the failing public endpoint
+		location := link()
+		require.NoError(t, a.Announce(ctx, location, publisher.WithClaimKinds(metadata.LocationKind)))
+		require.Eventually(t, received(private, location), time.Second, 5*time.Millisecond)
+		require.Eventually(t, func() bool {
+			return len(testutil.Must(a.Announcements(ctx))(t)) == 0
+		}, time.Second, 5*time.Millisecond)
+
+		index, equals, unclaimed := link(), link(), link()
+		require.NoError(t, a.Announce(ctx, index, publisher.WithClaimKinds(metadata.IndexKind)))
+		require.NoError(t, a.Announce(ctx, equals, publisher.WithClaimKinds(metadata.EqualsKind)))
+		require.NoError(t, a.Announce(ctx, unclaimed))
+		require.Eventually(t, received(private, location, index), time.Second, 5*time.Millisecond)
+		announcements := testutil.Must(a.Announcements(ctx))(t)
+		require.Len(t, announcements, 2)
+		require.Equal(t, index.Cid, announcements[0].Link)
+		require.Equal(t, []string{"public", "private"}, announcements[0].Targets)
+		require.Equal(t, []string{"private"}, announcements[0].Confirmed)
+		require.False(t, announcements[0].Announced)
+		require.Equal(t, unclaimed.Cid, announcements[1].Link)
+		require.Equal(t, []string{"public"}, announcements[1].Targets)
+		stats := testutil.Must(a.Stats(ctx))(t)
+		require.Equal(t, 2, stats.Pending)
+		require.Equal(t, 2, stats.Endpoints[0].Pending)
+		require.Zero(t, stats.Endpoints[1].Pending)
+
+		public.setFailing(false)
+		require.Eventually(t, received(public, unclaimed), time.Second, 5*time.Millisecond)
+		require.Eventually(t, func() bool {
+			return len(testutil.Must(a.Announcements(ctx))(t)) == 0
+		}, time.Second, 5*time.Millisecond)
+		require.Equal(t, []cid.Cid{location.Cid, index.Cid}, private.received())
+	})
+
+	t.Run("removals follow the routes of their context IDs", func(t *testing.T) {
+		public, private := &fakeSender{}, &fakeSender{}
+		a := start(t, publisher.AnnounceRoutes{
+			Kinds: map[string][]string{"location": {"private"}, "index": {"public"}},
+		}, public, private)
+		provider := testutil.RandomPeer()
+		contextIDs := [][]byte{testutil.RandomBytes(10), testutil.RandomBytes(10), testutil.RandomBytes(10)}
+
+		location, index := link(), link()
+		require.NoError(t, a.Announce(ctx, location, publisher.WithClaimKinds(metadata.LocationKind), publisher.ForContextID(provider, contextIDs[0])))
+		require.Eventually(t, received(private, location), time.Second, 5*time.Millisecond)
+		require.NoError(t, a.Announce(ctx, index, publisher.WithClaimKinds(metadata.IndexKind), publisher.ForContextID(provider, contextIDs[1])))
+		require.Eventually(t, received(public, index), time.Second, 5*time.Millisecond)
+
+		removals := []publisher.RemovalAnnouncement{{ContextID: contextIDs[0], Link: link()}, {ContextID: contextIDs[1], Link: link()}}
+		require.NoError(t, a.AnnounceRemovals(ctx, provider, removals))
+		require.Eventually(t, received(private, location, removals[0].Link.(cidlink.Link)), time.Second, 5*time.Millisecond)
+		require.Eventually(t, received(public, index, removals[1].Link.(cidlink.Link)), time.Second, 5*time.Millisecond)
+
+		// context IDs whose routes weren't remembered are removed everywhere
+		unknown := []publisher.RemovalAnnouncement{{ContextID: contextIDs[2], Link: link()}}
+		require.NoError(t, a.AnnounceRemovals(ctx, provider, unknown))
+		require.Eventually(t, received(private, location, removals[0].Link.(cidlink.Link), unknown[0].Link.(cidlink.Link)), time.Second, 5*time.Millisecond)
+		require.Eventually(t, received(public, index, removals[1].Link.(cidlink.Link), unknown[0].Link.(cidlink.Link)), time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("invalid routes", func(t *testing.T) {
+		a := start(t, publisher.AnnounceRoutes{}, &fakeSender{}, &fakeSender{})
+		require.ErrorContains(t, a.SetRoutes(publisher.AnnounceRoutes{Kinds: map[string][]string{"location": {"nowhere"}}}), "unknown endpoint")
+		require.ErrorContains(t, a.SetRoutes(publisher.AnnounceRoutes{Kinds: map[string][]string{"locations": {"public"}}}), "unknown claim kind")
+		require.ErrorContains(t, a.SetRoutes(publisher.AnnounceRoutes{Default: []string{"nowhere"}}), "unknown endpoint")
+		routes := publisher.AnnounceRoutes{Kinds: map[string][]string{"location": {"private"}}}
+		require.NoError(t, a.SetRoutes(routes))
+		routes.Kinds["location"][0] = "public"
+		require.Equal(t, []string{"private"}, a.Routes().Kinds["location"])
+	})
+}
@@ -0,0 +1,264 @@
+package publisher
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+
+	mh "github.com/multiformats/go-multihash"
+)
+
+const (
+	// bloomGrowth is how many times larger the capacity of each stage of a
+	// scalable filter is than the one before it
+	bloomGrowth = 2
+	// bloomTightening is how many times lower the false positive rate of each
+	// stage is than the one before it, so that the rate of the whole filter
+	// stays under twice the rate of its first stage however many stages there
+	// are
+	bloomTightening = 0.5
+)
+
+// bloomFilter is a scalable bloom filter: a series of bloom filters, each
+// larger and with a lower false positive rate than the last, so that it can
+// hold any number of multihashes without knowing how many in advance. A
+// multihash is added to the last stage, and a new stage started once the last
+// is full
+type bloomFilter struct {
+	capacity int
+	rate     float64
+	stages   []bloomStage
+}
+
+type bloomStage struct {
+	hashes   int
+	capacity int
+	count    int
+	bits     []uint64
+}
+
+// newBloomFilter returns a filter whose first stage holds capacity multihashes,
+// and whose false positive rate stays under the given rate
+func newBloomFilter(capacity int, falsePositiveRate float64) (*bloomFilter, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("filter capacity must be positive: %d", capacity)
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil, fmt.Errorf("false positive rate must be between 0 and 1: %v", falsePositiveRate)
+	}
+	return &bloomFilter{capacity: capacity, rate: falsePositiveRate}, nil
+}
+
+func newBloomStage(capacity int, falsePositiveRate float64) bloomStage {
+	// optimal bits per element for the rate is -ln(p)/ln(2)^2
+	nbits := int(math.Ceil(float64(capacity) * -math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	return bloomStage{
+		hashes:   max(1, int(math.Round(-math.Log2(falsePositiveRate)))),
+		capacity: capacity,
+		bits:     make([]uint64, (nbits+63)/64),
+	}
+}
+
+// add adds the multihash to the filter, returning false if the filter already
+// reported it may contain it, in which case nothing is added
+func (f *bloomFilter) add(hash mh.Multihash) bool {
+	h1, h2 := bloomHashes(hash)
+	for _, s := range f.stages {
+		if s.mayContain(h1, h2) {
+			return false
+		}
+	}
+	if len(f.stages) == 0 || f.stages[len(f.stages)-1].count >= f.stages[len(f.stages)-1].capacity {
+		n := len(f.stages)
+		capacity := f.capacity * int(math.Pow(bloomGrowth, float64(n)))
+		f.stages = append(f.stages, newBloomStage(capacity, f.rate*(1-bloomTightening)*math.Pow(bloomTightening, float64(n))))
+	}
+	s := &f.stages[len(f.stages)-1]
+	m := uint64(len(s.bits)) * 64
+	for i := range s.hashes {
+		bit := (h1 + uint64(i)*h2) % m
+		s.bits[bit/64] |= 1 << (bit % 64)
+	}
+	s.count++
+	return true
+}
+
+// mayContain returns false if the multihash was never added to the filter
+func (f *bloomFilter) mayContain(hash mh.Multihash) bool {
+	h1, h2 := bloomHashes(hash)
+	for _, s := range f.stages {
+		if s.mayContain(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s bloomStage) mayContain(h1, h2 uint64) bool {
+	m := uint64(len(s.bits)) * 64
+	for i := range s.hashes {
+		bit := (h1 + uint64(i)*h2) % m
+		if s.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHashes returns the two hashes of a multihash the bits set for it are
+// derived from, with the same construction as the shard filters of indexes
+func bloomHashes(hash mh.Multihash) (uint64, uint64) {
+	h1 := uint64(14695981039346656037)
+	for _, b := range hash {
+		h1 ^= uint64(b)
+		h1 *= 1099511628211
+	}
+	h2 := h1 ^ (h1 >> 31)
+	h2 *= 0xbf58476d1ce4e5b9
+	h2 ^= h2 >> 27
+	return h1, h2 | 1
+}
+
+// count returns the number of multihashes added to the filter
+func (f *bloomFilter) count() uint64 {
+	var n uint64
+	for _, s := range f.stages {
+		n += uint64(s.count)
+	}
+	return n
+}
+
+// size returns the number of bytes of bits in the filter
+func (f *bloomFilter) size() int {
+	var n int
+	for _, s := range f.stages {
+		n += len(s.bits) * 8
+	}
+	return n
+}
+
+// fillRatio returns the fraction of the bits of the filter that are set
+func (f *bloomFilter) fillRatio() float64 {
+	var set, total int
+	for _, s := range f.stages {
+		set += s.set()
+		total += len(s.bits) * 64
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(set) / float64(total)
+}
+
+// falsePositiveRate estimates the rate at which the filter reports it may
+// contain a multihash that was never added, from the bits set in each stage
+func (f *bloomFilter) falsePositiveRate() float64 {
+	miss := 1.0
+	for _, s := range f.stages {
+		fill := float64(s.set()) / float64(len(s.bits)*64)
+		miss *= 1 - math.Pow(fill, float64(s.hashes))
+	}
+	return 1 - miss
+}
+
+func (s bloomStage) set() int {
+	var n int
+	for _, word := range s.bits {
+		n += bits.OnesCount64(word)
+	}
+	return n
+}
+
+// MarshalBinary encodes the filter as its parameters followed by each stage
+func (f *bloomFilter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, f.size()+64)
+	data = binary.AppendUvarint(data, uint64(f.capacity))
+	data = binary.LittleEndian.AppendUint64(data, math.Float64bits(f.rate))
+	data = binary.AppendUvarint(data, uint64(len(f.stages)))
+	for _, s := range f.stages {
+		data = binary.AppendUvarint(data, uint64(s.hashes))
+		data = binary.AppendUvarint(data, uint64(s.capacity))
+		data = binary.AppendUvarint(data, uint64(s.count))
+		data = binary.AppendUvarint(data, uint64(len(s.bits)))
+		for _, word := range s.bits {
+			data = binary.LittleEndian.AppendUint64(data, word)
+		}
+	}
+	return data, nil
+}
+
+var errTruncatedFilter = errors.New("truncated filter")
+
+// UnmarshalBinary decodes a filter encoded with MarshalBinary
+func (f *bloomFilter) UnmarshalBinary(data []byte) error {
+	r := bloomReader{data: data}
+	capacity := r.uvarint()
+	rate := math.Float64frombits(r.uint64())
+	count := r.uvarint()
+	if r.err == nil && count > uint64(len(r.data)) {
+		r.err = errTruncatedFilter
+	}
+	var stages []bloomStage
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		s := bloomStage{hashes: int(r.uvarint()), capacity: int(r.uvarint()), count: int(r.uvarint())}
+		words := r.uvarint()
+		if r.err == nil && (words == 0 || words > uint64(len(r.data))/8) {
+			r.err = errTruncatedFilter
+			break
+		}
+		if r.err == nil && (s.hashes == 0 || s.hashes > 64) {
+			r.err = fmt.Errorf("invalid hash count: %d", s.hashes)
+			break
+		}
+		s.bits = make([]uint64, words)
+		for j := range s.bits {
+			s.bits[j] = binary.LittleEndian.Uint64(r.data[j*8:])
+		}
+		r.data = r.data[words*8:]
+		stages = append(stages, s)
+	}
+	if r.err == nil && len(r.data) > 0 {
+		r.err = errors.New("unexpected data after filter")
+	}
+	if r.err != nil {
+		return fmt.Errorf("decoding filter: %w", r.err)
+	}
+	if capacity == 0 || rate <= 0 || rate >= 1 {
+		return fmt.Errorf("decoding filter: invalid parameters: %d, %v", capacity, rate)
+	}
+	*f = bloomFilter{capacity: int(capacity), rate: rate, stages: stages}
+	return nil
+}
+
+type bloomReader struct {
+	data []byte
+	err  error
+}
+
+func (r *bloomReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errTruncatedFilter
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *bloomReader) uint64() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) < 8 {
+		r.err = errTruncatedFilter
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return v
+}
@@ -0,0 +1,276 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/ingest/schema"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/go-ucanto/core/car"
+	"github.com/storacha/go-ucanto/core/ipld/block"
+)
+
+// ErrNothingToExport is returned when exporting a chain nothing was published to
+var ErrNothingToExport = errors.New("nothing published to export")
+
+// DivergentChainError is returned when importing a chain that neither extends
+// nor matches the chain already in the datastore
+type DivergentChainError struct {
+	Head     ipld.Link
+	Imported ipld.Link
+}
+
+func (de DivergentChainError) Error() string {
+	return fmt.Sprintf("imported chain at %s diverges from the chain at %s", de.Imported, de.Head)
+}
+
+// ExportChain writes the advertisement chain to w as a CARv1, for indexers to
+// bootstrap from. The CAR is rooted at from, or the head if it is nil, and
+// holds each advertisement followed by its entries chunks, walking back until
+// to, which isn't exported, or the tail if it is nil. Entries chunks shared
+// with an advertisement exported earlier are only exported once. Blocks are
+// streamed as they are read from the datastore
+func (p *Publisher) ExportChain(ctx context.Context, w io.Writer, from, to ipld.Link) error {
+	if from == nil {
+		head, err := p.Head(ctx)
+		if err != nil {
+			return err
+		}
+		if head == nil {
+			return ErrNothingToExport
+		}
+		from = head
+	}
+	r := car.Encode([]ipld.Link{from}, p.chainBlocks(ctx, from, to))
+	// stop the encoder if the writer fails
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("exporting chain: %w", err)
+	}
+	return nil
+}
+
+// chainBlocks iterates the blocks of the chain from one advertisement back
+// until another, in the order they are exported
+func (p *Publisher) chainBlocks(ctx context.Context, from, to ipld.Link) iter.Seq2[block.Block, error] {
+	return func(yield func(block.Block, error) bool) {
+		exported := map[cid.Cid]struct{}{}
+		for link := from; link != nil; {
+			if to != nil && link.String() == to.String() {
+				return
+			}
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+			data, err := p.ds.Get(ctx, dsKey(link))
+			if err != nil {
+				yield(nil, fmt.Errorf("reading advertisement %s: %w", link, err))
+				return
+			}
+			adv, err := schema.BytesToAdvertisement(link.(cidlink.Link).Cid, data)
+			if err != nil {
+				yield(nil, fmt.Errorf("decoding advertisement %s: %w", link, err))
+				return
+			}
+			if !yield(block.NewBlock(link, data), nil) {
+				return
+			}
+			for entries := adv.Entries; !isEnd(entries); {
+				c := entries.(cidlink.Link).Cid
+				// the rest of the entries chain was exported already
+				if _, ok := exported[c]; ok {
+					break
+				}
+				exported[c] = struct{}{}
+				data, err := p.ds.Get(ctx, dsKey(entries))
+				if err != nil {
+					yield(nil, fmt.Errorf("reading entries chunk %s: %w", entries, err))
+					return
+				}
+				chunk, err := schema.BytesToEntryChunk(c, data)
+				if err != nil {
+					yield(nil, fmt.Errorf("decoding entries chunk %s: %w", entries, err))
+					return
+				}
+				if !yield(block.NewBlock(entries, data), nil) {
+					return
+				}
+				entries = chunk.Next
+			}
+			link = adv.PreviousID
+		}
+		if to != nil {
+			yield(nil, fmt.Errorf("advertisement %s is not in the chain", to))
+		}
+	}
+}
+
+// ImportChain loads a CAR written by ExportChain into the datastore. Blocks are
+// written as they are read, once they are checked to be the next block the
+// chain links to and, for advertisements, to be signed by the publisher's key.
+// The chain in the CAR may end at an advertisement already in the datastore.
+//
+// The head is then moved to the root of the CAR if it extends the chain in the
+// datastore, and the chain summary rebuilt. A chain the datastore already
+// holds leaves the head where it is, and a chain that diverges from it is
+// refused with a DivergentChainError
+func (p *Publisher) ImportChain(ctx context.Context, r io.Reader) error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	signer, err := peer.IDFromPrivateKey(p.key)
+	if err != nil {
+		return fmt.Errorf("reading publisher key: %w", err)
+	}
+	roots, blocks, err := car.Decode(r)
+	if err != nil {
+		return fmt.Errorf("reading chain: %w", err)
+	}
+	if len(roots) != 1 {
+		return fmt.Errorf("reading chain: expected 1 root, got %d", len(roots))
+	}
+	root := roots[0]
+
+	// blocks are exported in chain order, so only the next advertisement, or
+	// the next chunk of its entries, is expected at a time
+	advert, chunk, previous := root, ipld.Link(nil), ipld.Link(nil)
+	for blk, err := range blocks {
+		if err != nil {
+			return fmt.Errorf("reading chain: %w", err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		link := blk.Link()
+		if chunk != nil && link.String() != chunk.String() {
+			// the rest of the entries chain was imported with an earlier
+			// advertisement
+			if err := p.requireBlock(ctx, chunk, "entries chunk"); err != nil {
+				return err
+			}
+			advert, chunk = previous, nil
+		}
+		c := link.(cidlink.Link).Cid
+		switch {
+		case chunk != nil:
+			ec, err := schema.BytesToEntryChunk(c, blk.Bytes())
+			if err != nil {
+				return fmt.Errorf("decoding entries chunk %s: %w", link, err)
+			}
+			chunk = ec.Next
+			if isEnd(chunk) {
+				advert, chunk = previous, nil
+			}
+		case advert != nil && link.String() == advert.String():
+			adv, err := schema.BytesToAdvertisement(c, blk.Bytes())
+			if err != nil {
+				return fmt.Errorf("decoding advertisement %s: %w", link, err)
+			}
+			id, err := adv.VerifySignature()
+			if err != nil {
+				return fmt.Errorf("verifying advertisement %s: %w", link, err)
+			}
+			if id != signer {
+				return fmt.Errorf("verifying advertisement %s: signed by %s, not the publisher", link, id)
+			}
+			previous = adv.PreviousID
+			if isEnd(adv.Entries) {
+				advert = previous
+			} else {
+				advert, chunk = nil, adv.Entries
+			}
+		default:
+			return fmt.Errorf("importing chain: unexpected block %s", link)
+		}
+		if err := p.ds.Put(ctx, dsKey(link), blk.Bytes()); err != nil {
+			return fmt.Errorf("writing block %s: %w", link, err)
+		}
+	}
+	// the chain in the CAR may continue in the datastore
+	if chunk != nil {
+		if err := p.requireBlock(ctx, chunk, "entries chunk"); err != nil {
+			return err
+		}
+		advert = previous
+	}
+	if advert != nil {
+		if err := p.requireBlock(ctx, advert, "advertisement"); err != nil {
+			return err
+		}
+	}
+
+	head, current, err := p.head(ctx)
+	if err != nil {
+		return err
+	}
+	if head != nil {
+		if head.String() == root.String() {
+			return nil
+		}
+		extends, err := p.descends(ctx, root, head)
+		if err != nil {
+			return err
+		}
+		if !extends {
+			behind, err := p.descends(ctx, head, root)
+			if err != nil {
+				return err
+			}
+			if behind {
+				return nil
+			}
+			return DivergentChainError{Head: head, Imported: root}
+		}
+	}
+	batch, err := p.headBatch(ctx, current)
+	if err != nil {
+		return err
+	}
+	if err := batch.Put(ctx, headKey, root.(cidlink.Link).Cid.Bytes()); err != nil {
+		return err
+	}
+	if err := batch.Commit(ctx); err != nil {
+		return fmt.Errorf("moving head: %w", err)
+	}
+	if _, err := p.rebuildSummary(ctx); err != nil {
+		return fmt.Errorf("rebuilding chain summary: %w", err)
+	}
+	return nil
+}
+
+// requireBlock returns an error if the block isn't in the datastore
+func (p *Publisher) requireBlock(ctx context.Context, link ipld.Link, kind string) error {
+	has, err := p.ds.Has(ctx, dsKey(link))
+	if err != nil {
+		return fmt.Errorf("reading %s %s: %w", kind, link, err)
+	}
+	if !has {
+		return fmt.Errorf("importing chain: %s %s is missing", kind, link)
+	}
+	return nil
+}
+
+// descends returns true if the ancestor is reached walking back from the
+// advertisement
+func (p *Publisher) descends(ctx context.Context, link, ancestor ipld.Link) (bool, error) {
+	for link != nil {
+		if link.String() == ancestor.String() {
+			return true, nil
+		}
+		adv, err := p.advertisement(ctx, link)
+		if err != nil {
+			return false, err
+		}
+		link = adv.PreviousID
+	}
+	return false, nil
+}
@@ -0,0 +1,137 @@
+package publisher_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipni/go-libipni/ingest/schema"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChainCAR(t *testing.T) {
+	ctx := context.Background()
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	provider := peer.AddrInfo{ID: testutil.RandomPeer()}
+	newPublisher := func(key crypto.PrivKey) (*publisher.Publisher, datastore.Batching) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		return publisher.New(ds, key, publisher.WithEntriesChunkSize(3)), ds
+	}
+	publish := func(t *testing.T, p *publisher.Publisher, size int) ipld.Link {
+		return testutil.Must(p.Publish(ctx, provider, testutil.RandomBytes(10), testutil.RandomBytes(10), testutil.RandomMultihashes(size)))(t)
+	}
+	export := func(t *testing.T, p *publisher.Publisher, from, to ipld.Link) *bytes.Buffer {
+		var buf bytes.Buffer
+		require.NoError(t, p.ExportChain(ctx, &buf, from, to))
+		return &buf
+	}
+	type advertEntries struct {
+		Advert  schema.Advertisement
+		Entries []mh.Multihash
+	}
+	chain := func(t *testing.T, p *publisher.Publisher, ds datastore.Batching) []advertEntries {
+		var adverts []advertEntries
+		for adv, err := range p.Advertisements(ctx) {
+			require.NoError(t, err)
+			var entries []mh.Multihash
+			for hash, err := range publisher.Entries(ctx, ds, adv.Entries) {
+				require.NoError(t, err)
+				entries = append(entries, hash)
+			}
+			adverts = append(adverts, advertEntries{adv, entries})
+		}
+		return adverts
+	}
+
+	source, sourceDS := newPublisher(key)
+	var mid ipld.Link
+	for i := range 48 {
+		size := i % 5
+		if i == 20 {
+			// a long entries chain
+			size = 3000
+		}
+		link := publish(t, source, size)
+		if i == 30 {
+			mid = link
+		}
+	}
+	// an advertisement sharing its entries with the one before it
+	contextID, metadata, hashes := testutil.RandomBytes(10), testutil.RandomBytes(10), testutil.RandomMultihashes(7)
+	testutil.Must(source.Publish(ctx, provider, contextID, metadata, hashes))(t)
+	testutil.Must(source.Publish(ctx, provider, contextID, metadata, hashes, publisher.ForceRepublish()))(t)
+	head := testutil.Must(source.Head(ctx))(t)
+
+	t.Run("round trip", func(t *testing.T) {
+		car := export(t, source, nil, nil)
+		dest, destDS := newPublisher(key)
+		require.NoError(t, dest.ImportChain(ctx, car))
+
+		require.Equal(t, head, testutil.Must(dest.Head(ctx))(t))
+		imported := chain(t, dest, destDS)
+		require.Len(t, imported, 50)
+		require.Equal(t, chain(t, source, sourceDS), imported)
+		summary := testutil.Must(dest.ChainSummary(ctx))(t)
+		require.Equal(t, uint64(50), summary.Adverts)
+		require.Equal(t, testutil.Must(source.ChainSummary(ctx))(t).Entries, summary.Entries)
+
+		// importing the same chain again changes nothing
+		require.NoError(t, dest.ImportChain(ctx, export(t, source, nil, nil)))
+		require.Equal(t, head, testutil.Must(dest.Head(ctx))(t))
+	})
+
+	t.Run("extends the chain", func(t *testing.T) {
+		extended, extendedDS := newPublisher(key)
+		require.NoError(t, extended.ImportChain(ctx, export(t, source, nil, nil)))
+		dest, destDS := newPublisher(key)
+		require.NoError(t, dest.ImportChain(ctx, export(t, source, nil, nil)))
+
+		publish(t, extended, 4)
+		newHead := publish(t, extended, 2)
+		require.NoError(t, dest.ImportChain(ctx, export(t, extended, nil, head)))
+		require.Equal(t, newHead, testutil.Must(dest.Head(ctx))(t))
+		require.Equal(t, chain(t, extended, extendedDS), chain(t, dest, destDS))
+		require.Equal(t, uint64(52), testutil.Must(dest.ChainSummary(ctx))(t).Adverts)
+
+		// the part of the chain already held leaves the head where it is
+		require.NoError(t, dest.ImportChain(ctx, export(t, source, nil, nil)))
+		require.Equal(t, newHead, testutil.Must(dest.Head(ctx))(t))
+	})
+
+	t.Run("refuses divergent chains", func(t *testing.T) {
+		dest, _ := newPublisher(key)
+		own := publish(t, dest, 3)
+		err := dest.ImportChain(ctx, export(t, source, nil, nil))
+		var divergent publisher.DivergentChainError
+		require.ErrorAs(t, err, &divergent)
+		require.Equal(t, own, divergent.Head)
+		require.Equal(t, head, divergent.Imported)
+		require.Equal(t, own, testutil.Must(dest.Head(ctx))(t))
+	})
+
+	t.Run("refuses incomplete chains", func(t *testing.T) {
+		dest, _ := newPublisher(key)
+		require.ErrorContains(t, dest.ImportChain(ctx, export(t, source, nil, mid)), "missing")
+		require.Nil(t, testutil.Must(dest.Head(ctx))(t))
+	})
+
+	t.Run("refuses advertisements signed by another key", func(t *testing.T) {
+		other, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+		dest, _ := newPublisher(other)
+		require.ErrorContains(t, dest.ImportChain(ctx, export(t, source, nil, nil)), "not the publisher")
+		require.Nil(t, testutil.Must(dest.Head(ctx))(t))
+	})
+
+	t.Run("nothing to export", func(t *testing.T) {
+		empty, _ := newPublisher(key)
+		require.ErrorIs(t, empty.ExportChain(ctx, &bytes.Buffer{}, nil, nil), publisher.ErrNothingToExport)
+	})
+}
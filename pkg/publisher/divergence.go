@@ -0,0 +1,338 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/ingest/schema"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ChainRelation is how the chain an indexer ingested relates to the chain in
+// the datastore
+type ChainRelation string
+
+const (
+	// RelationInSync is an indexer whose last advertisement is the head
+	RelationInSync ChainRelation = "in-sync"
+	// RelationBehind is an indexer whose last advertisement is before the head,
+	// which it will catch up from
+	RelationBehind ChainRelation = "behind"
+	// RelationAhead is an indexer whose last advertisement is after the head, or
+	// that ingested advertisements missing from the datastore. It can only be
+	// if the datastore lost them
+	RelationAhead ChainRelation = "ahead"
+	// RelationForked is an indexer whose last advertisement is on a chain that
+	// forked from the one in the datastore. Advertisements published on top of
+	// the head are refused by the indexer as an unknown chain
+	RelationForked ChainRelation = "forked"
+)
+
+// IndexerDivergence is how the chain an indexer ingested relates to the chain
+// in the datastore
+type IndexerDivergence struct {
+	Name string
+	// Head is the head of the chain when the indexer was checked
+	Head cid.Cid
+	// LastAdvertisement is the last advertisement the indexer ingested,
+	// undefined if it has ingested none
+	LastAdvertisement cid.Cid
+	Relation          ChainRelation
+	// Ancestor is the newest advertisement in both chains, undefined if none
+	// was found within the walk limit
+	Ancestor cid.Cid
+	// Behind is the number of advertisements from Ancestor to Head, which the
+	// indexer hasn't ingested
+	Behind int
+	// Ahead is the number of advertisements from LastAdvertisement to Ancestor
+	// that aren't in the chain in the datastore. If Ancestor is undefined, it
+	// is the number walked before one was missing or the walk limit was reached
+	Ahead int
+	// CheckError is why the indexer could not be checked
+	CheckError string
+	Checked    time.Time
+}
+
+// Divergence checks how the chain each indexer ingested relates to the chain in
+// the datastore, returning their relations in the order the indexers were
+// given. It only reports, a fork or lost advertisements are repaired with
+// RebaseChain
+func (m *LagMonitor) Divergence(ctx context.Context) ([]IndexerDivergence, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	head, err := m.publisher.Head(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading chain head: %w", err)
+	}
+	divergences := make([]IndexerDivergence, 0, len(m.endpoints))
+	for _, e := range m.endpoints {
+		d, err := m.diverge(ctx, e, head)
+		if err != nil {
+			log.Warnw("checking indexer divergence", "indexer", e.Name, "error", err)
+			d = IndexerDivergence{Name: e.Name, CheckError: err.Error(), Checked: time.Now().UTC()}
+		}
+		divergences = append(divergences, d)
+	}
+	return divergences, nil
+}
+
+// diverge works out the relation of an indexer's chain to the chain in the
+// datastore. The chain from the head is walked as it is to work out lag, then
+// the indexer's chain is walked back from its last advertisement until it
+// meets it
+func (m *LagMonitor) diverge(ctx context.Context, e LagEndpoint, head ipld.Link) (IndexerDivergence, error) {
+	info, err := m.providerInfo(ctx, e)
+	if err != nil {
+		return IndexerDivergence{}, err
+	}
+	last := info.LastAdvertisement
+	d := IndexerDivergence{Name: e.Name, LastAdvertisement: last, Checked: time.Now().UTC()}
+	behind := 0
+	var ours map[cid.Cid]int
+	if head != nil {
+		d.Head = head.(cidlink.Link).Cid
+		var found bool
+		behind, found, err = m.distance(ctx, d.Head, last)
+		if err != nil {
+			return IndexerDivergence{}, err
+		}
+		ours = m.walk.distance
+		if found || !last.Defined() {
+			d.Relation, d.Ancestor, d.Behind = RelationBehind, last, behind
+			if behind == 0 {
+				d.Relation = RelationInSync
+			}
+			return d, nil
+		}
+	} else if !last.Defined() {
+		d.Relation = RelationInSync
+		return d, nil
+	}
+
+	d.Relation = RelationForked
+	for link := ipld.Link(cidlink.Link{Cid: last}); d.Ahead < m.maxWalk; d.Ahead++ {
+		c := link.(cidlink.Link).Cid
+		if distance, ok := ours[c]; ok {
+			d.Ancestor, d.Behind = c, distance
+			if distance == 0 {
+				d.Relation = RelationAhead
+			}
+			return d, nil
+		}
+		adv, err := m.publisher.advertisement(ctx, link)
+		if errors.Is(err, datastore.ErrNotFound) {
+			d.Relation = RelationAhead
+			return d, nil
+		}
+		if err != nil {
+			return IndexerDivergence{}, err
+		}
+		if adv.PreviousID == nil {
+			// the chains share no advertisement
+			d.Ahead, d.Behind = d.Ahead+1, behind
+			if head == nil {
+				d.Relation = RelationAhead
+			}
+			return d, nil
+		}
+		link = adv.PreviousID
+	}
+	d.Behind = behind
+	return d, nil
+}
+
+type (
+	// RebaseOption configures a rebase of the chain
+	RebaseOption func(*rebaseConfig)
+
+	rebaseConfig struct {
+		dryRun bool
+	}
+
+	// RebasedAdvert is an advertisement published again by a rebase
+	RebasedAdvert struct {
+		// Original is the advertisement in the chain before the rebase
+		Original  cid.Cid
+		ContextID []byte
+		Removal   bool
+		// Rebased is the advertisement published in its place, undefined for a
+		// dry run
+		Rebased cid.Cid
+	}
+
+	// RebaseReport describes a rebase of the chain
+	RebaseReport struct {
+		// Head is the head before the rebase
+		Head cid.Cid
+		Onto cid.Cid
+		// Ancestor is the newest advertisement in both the chain from the head
+		// and the chain from onto, undefined if they share none
+		Ancestor cid.Cid
+		// Adverts are those in the chain from the head after the ancestor, which
+		// are published again on top of onto, oldest first
+		Adverts []RebasedAdvert
+		// NewHead is the head after the rebase, undefined for a dry run
+		NewHead cid.Cid
+		DryRun  bool
+	}
+)
+
+// RebaseDryRun works out what a rebase would publish without writing anything
+func RebaseDryRun() RebaseOption {
+	return func(c *rebaseConfig) {
+		c.dryRun = true
+	}
+}
+
+// RebaseChain repairs a chain that diverged from the one an indexer ingested,
+// given the last advertisement the indexer ingested. The advertisements in the
+// chain from the head that aren't in the chain from onto are published again
+// on top of it, oldest first, with the advertisements and entries they were
+// first published with, and the head moved to the newest. Their publishes are
+// recorded in the operation log, and the chain summary, fingerprints and
+// timeline rebuilt from the new head. If the head is before onto, the head is
+// moved to it. The advertisements left behind stay in the datastore.
+//
+// Onto and the chain before it must be in the datastore, so advertisements an
+// indexer ingested that the datastore lost are imported with ImportChain
+// first. Nothing in the chain is ever rebased unless this is called
+func (p *Publisher) RebaseChain(ctx context.Context, onto ipld.Link, opts ...RebaseOption) (RebaseReport, error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	c := &rebaseConfig{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	head, current, err := p.head(ctx)
+	if err != nil {
+		return RebaseReport{}, err
+	}
+	report := RebaseReport{Onto: onto.(cidlink.Link).Cid, DryRun: c.dryRun}
+	if head != nil {
+		report.Head = head.(cidlink.Link).Cid
+	}
+
+	known := map[cid.Cid]struct{}{}
+	for link := onto; link != nil; {
+		known[link.(cidlink.Link).Cid] = struct{}{}
+		adv, err := p.advertisement(ctx, link)
+		if errors.Is(err, datastore.ErrNotFound) {
+			return RebaseReport{}, fmt.Errorf("reading chain from %s: %w: %s", onto, ErrAdvertNotFound, link)
+		}
+		if err != nil {
+			return RebaseReport{}, err
+		}
+		link = adv.PreviousID
+	}
+	var adverts []schema.Advertisement
+	for link := head; link != nil; {
+		lc := link.(cidlink.Link).Cid
+		if _, ok := known[lc]; ok {
+			report.Ancestor = lc
+			break
+		}
+		adv, err := p.advertisement(ctx, link)
+		if err != nil {
+			return RebaseReport{}, err
+		}
+		if adv.ExtendedProvider != nil {
+			return RebaseReport{}, fmt.Errorf("rebasing advertisement %s: extended providers can't be signed again", link)
+		}
+		adverts = append(adverts, adv)
+		report.Adverts = append(report.Adverts, RebasedAdvert{Original: lc, ContextID: adv.ContextID, Removal: adv.IsRm})
+		link = adv.PreviousID
+	}
+	// an indexer that is only behind catches up without a rebase
+	if report.Ancestor == report.Onto {
+		report.Adverts = nil
+		if !c.dryRun {
+			report.NewHead = report.Head
+		}
+		return report, nil
+	}
+	slices.Reverse(adverts)
+	slices.Reverse(report.Adverts)
+	if c.dryRun {
+		return report, nil
+	}
+
+	batch, err := p.headBatch(ctx, current)
+	if err != nil {
+		return RebaseReport{}, err
+	}
+	seq, err := p.opSeq(ctx)
+	if err != nil {
+		return RebaseReport{}, err
+	}
+	lsys := linkSystem(p.ds, batch, nil)
+	previous := onto
+	for i, adv := range adverts {
+		rebased := schema.Advertisement{
+			PreviousID: previous,
+			Provider:   adv.Provider,
+			Addresses:  adv.Addresses,
+			Entries:    adv.Entries,
+			ContextID:  adv.ContextID,
+			Metadata:   adv.Metadata,
+			IsRm:       adv.IsRm,
+		}
+		if err := rebased.Sign(p.key); err != nil {
+			return RebaseReport{}, fmt.Errorf("signing advertisement: %w", err)
+		}
+		nd, err := rebased.ToNode()
+		if err != nil {
+			return RebaseReport{}, fmt.Errorf("encoding advertisement: %w", err)
+		}
+		link, err := lsys.Store(ipld.LinkContext{Ctx: ctx}, schema.Linkproto, nd)
+		if err != nil {
+			return RebaseReport{}, fmt.Errorf("writing advertisement: %w", err)
+		}
+		provider, err := peer.Decode(adv.Provider)
+		if err != nil {
+			return RebaseReport{}, fmt.Errorf("decoding provider of advertisement %s: %w", report.Adverts[i].Original, err)
+		}
+		op := Operation{Seq: seq + uint64(i) + 1, Kind: OpPublish, Provider: provider, Addrs: adv.Addresses, ContextID: adv.ContextID, Metadata: adv.Metadata, Advert: link.(cidlink.Link).Cid, At: p.now().UTC()}
+		if adv.IsRm {
+			op.Kind = OpRemove
+		}
+		if err := writeOperation(ctx, batch, op); err != nil {
+			return RebaseReport{}, err
+		}
+		report.Adverts[i].Rebased = op.Advert
+		previous = link
+	}
+	report.NewHead = previous.(cidlink.Link).Cid
+	if err := batch.Put(ctx, headKey, report.NewHead.Bytes()); err != nil {
+		return RebaseReport{}, err
+	}
+	if err := batch.Commit(ctx); err != nil {
+		return RebaseReport{}, fmt.Errorf("moving head: %w", err)
+	}
+	if _, err := p.rebuildSummary(ctx); err != nil {
+		return RebaseReport{}, fmt.Errorf("rebuilding chain summary: %w", err)
+	}
+	return report, nil
+}
+
+// logDivergence logs the indexers whose chain diverges from the chain in the
+// datastore
+func (m *LagMonitor) logDivergence(ctx context.Context) {
+	divergences, err := m.Divergence(ctx)
+	if err != nil {
+		log.Errorw("checking indexer divergence", "error", err)
+		return
+	}
+	for _, d := range divergences {
+		if d.Relation == RelationAhead || d.Relation == RelationForked {
+			log.Errorw("indexer chain diverges from the datastore, rebase to repair", "indexer", d.Name, "relation", d.Relation, "head", d.Head, "lastAdvertisement", d.LastAdvertisement, "ancestor", d.Ancestor)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package publisher_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	ipnifind "github.com/ipni/go-libipni/find/client"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDivergence(t *testing.T) {
+	ctx := context.Background()
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	provider := peer.AddrInfo{ID: testutil.RandomPeer()}
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	p := publisher.New(ds, key)
+	publish := func(t *testing.T) cid.Cid {
+		link := testutil.Must(p.Publish(ctx, provider, testutil.RandomBytes(10), testutil.RandomBytes(10), testutil.RandomMultihashes(2)))(t)
+		return link.(cidlink.Link).Cid
+	}
+	// rewind moves the head back, as a partial restore of the datastore does
+	rewind := func(t *testing.T, head cid.Cid) {
+		require.NoError(t, ds.Put(ctx, datastore.NewKey("head"), head.Bytes()))
+	}
+	var chain []cid.Cid
+	for range 5 {
+		chain = append(chain, publish(t))
+	}
+
+	indexers := map[string]*fakeIndexer{}
+	var endpoints []publisher.LagEndpoint
+	for _, name := range []string{"in-sync", "behind", "new", "ahead", "lost"} {
+		indexers[name] = &fakeIndexer{provider: provider.ID}
+		srv := httptest.NewServer(indexers[name])
+		t.Cleanup(srv.Close)
+		endpoints = append(endpoints, publisher.LagEndpoint{Name: name, Finder: testutil.Must(ipnifind.New(srv.URL))(t)})
+	}
+	m := publisher.NewLagMonitor(p, provider.ID, endpoints)
+	lost := testutil.RandomCID().(cidlink.Link).Cid
+	indexers["behind"].set(&model.ProviderInfo{LastAdvertisement: chain[1]}, false)
+	indexers["ahead"].set(&model.ProviderInfo{LastAdvertisement: chain[4]}, false)
+	indexers["lost"].set(&model.ProviderInfo{LastAdvertisement: lost}, false)
+	check := func(t *testing.T) map[string]publisher.IndexerDivergence {
+		divergences := map[string]publisher.IndexerDivergence{}
+		for _, d := range testutil.Must(m.Divergence(ctx))(t) {
+			require.Empty(t, d.CheckError)
+			divergences[d.Name] = d
+		}
+		return divergences
+	}
+	type relation struct {
+		Relation publisher.ChainRelation
+		Ancestor cid.Cid
+		Behind   int
+		Ahead    int
+	}
+	relations := func(t *testing.T) map[string]relation {
+		got := map[string]relation{}
+		for name, d := range check(t) {
+			got[name] = relation{d.Relation, d.Ancestor, d.Behind, d.Ahead}
+		}
+		return got
+	}
+
+	rewind(t, chain[2])
+	indexers["in-sync"].set(&model.ProviderInfo{LastAdvertisement: chain[2]}, false)
+	require.Equal(t, map[string]relation{
+		"in-sync": {publisher.RelationInSync, chain[2], 0, 0},
+		"behind":  {publisher.RelationBehind, chain[1], 1, 0},
+		"new":     {publisher.RelationBehind, cid.Undef, 3, 0},
+		"ahead":   {publisher.RelationAhead, chain[2], 0, 2},
+		"lost":    {publisher.RelationAhead, cid.Undef, 0, 0},
+	}, relations(t))
+
+	// publishing on top of the restored head forks the chain
+	fork := publish(t)
+	indexers["in-sync"].set(&model.ProviderInfo{LastAdvertisement: fork}, false)
+	require.Equal(t, map[string]relation{
+		"in-sync": {publisher.RelationInSync, fork, 0, 0},
+		"behind":  {publisher.RelationBehind, chain[1], 2, 0},
+		"new":     {publisher.RelationBehind, cid.Undef, 4, 0},
+		"ahead":   {publisher.RelationForked, chain[2], 1, 2},
+		"lost":    {publisher.RelationAhead, cid.Undef, 0, 0},
+	}, relations(t))
+
+	t.Run("a dry run rebase writes nothing", func(t *testing.T) {
+		report := testutil.Must(p.RebaseChain(ctx, cidlink.Link{Cid: chain[4]}, publisher.RebaseDryRun()))(t)
+		require.True(t, report.DryRun)
+		require.Equal(t, fork, report.Head)
+		require.Equal(t, chain[2], report.Ancestor)
+		require.Len(t, report.Adverts, 1)
+		require.Equal(t, fork, report.Adverts[0].Original)
+		require.False(t, report.Adverts[0].Rebased.Defined())
+		require.False(t, report.NewHead.Defined())
+		require.Equal(t, cidlink.Link{Cid: fork}, testutil.Must(p.Head(ctx))(t))
+	})
+
+	t.Run("rebasing onto an advertisement before the head does nothing", func(t *testing.T) {
+		report := testutil.Must(p.RebaseChain(ctx, cidlink.Link{Cid: chain[1]}))(t)
+		require.Empty(t, report.Adverts)
+		require.Equal(t, fork, report.NewHead)
+		require.Equal(t, cidlink.Link{Cid: fork}, testutil.Must(p.Head(ctx))(t))
+	})
+
+	t.Run("rebasing onto a missing advertisement fails", func(t *testing.T) {
+		_, err := p.RebaseChain(ctx, cidlink.Link{Cid: lost})
+		require.ErrorIs(t, err, publisher.ErrAdvertNotFound)
+	})
+
+	t.Run("a forked chain is rebased onto the indexer's advertisement", func(t *testing.T) {
+		forked := testutil.Must(p.InspectAdvert(ctx, cidlink.Link{Cid: fork}, 0))(t)
+		report := testutil.Must(p.RebaseChain(ctx, cidlink.Link{Cid: chain[4]}))(t)
+		require.Len(t, report.Adverts, 1)
+		rebased := report.Adverts[0].Rebased
+		require.Equal(t, rebased, report.NewHead)
+		require.Equal(t, cidlink.Link{Cid: rebased}, testutil.Must(p.Head(ctx))(t))
+
+		adv := testutil.Must(p.InspectAdvert(ctx, cidlink.Link{Cid: rebased}, 0))(t)
+		require.Equal(t, testutil.Must(peer.IDFromPrivateKey(key))(t), adv.Signer)
+		require.Equal(t, chain[4], adv.PreviousID.(cidlink.Link).Cid)
+		require.Equal(t, forked.ContextID, adv.ContextID)
+		require.Equal(t, forked.Metadata, adv.Metadata)
+		require.Equal(t, forked.Entries, adv.Entries)
+
+		summary := testutil.Must(p.ChainSummary(ctx))(t)
+		require.Equal(t, uint64(6), summary.Adverts)
+		var last publisher.Operation
+		for op, err := range p.Operations(ctx) {
+			require.NoError(t, err)
+			last = op
+		}
+		require.Equal(t, publisher.OpPublish, last.Kind)
+		require.Equal(t, rebased, last.Advert)
+
+		divergences := check(t)
+		require.Equal(t, publisher.RelationBehind, divergences["ahead"].Relation)
+		require.Equal(t, 1, divergences["ahead"].Behind)
+	})
+
+	t.Run("a head before the indexer's advertisement is moved to it", func(t *testing.T) {
+		rewind(t, chain[2])
+		report := testutil.Must(p.RebaseChain(ctx, cidlink.Link{Cid: chain[4]}))(t)
+		require.Empty(t, report.Adverts)
+		require.Equal(t, chain[4], report.NewHead)
+		require.Equal(t, ipld.Link(cidlink.Link{Cid: chain[4]}), testutil.Must(p.Head(ctx))(t))
+		require.Equal(t, uint64(5), testutil.Must(p.ChainSummary(ctx))(t).Adverts)
+	})
+}
@@ -0,0 +1,254 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/ingest/schema"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// DefaultEntriesChunkSize is the maximum number of multihashes in a single
+// entries chunk
+const DefaultEntriesChunkSize = 16384
+
+// ChunkError describes an entries chunk that could not be read
+type ChunkError struct {
+	Link ipld.Link
+	Err  error
+}
+
+func (ce ChunkError) Error() string {
+	return fmt.Sprintf("entries chunk %s: %s", ce.Link, ce.Err)
+}
+
+func (ce ChunkError) Unwrap() error {
+	return ce.Err
+}
+
+// EntriesReport describes the state of an entries chain
+type EntriesReport struct {
+	// Entries is the number of multihashes in the intact part of the chain
+	Entries int
+	// Chunks is the number of intact chunks, read from the head of the chain
+	Chunks int
+	// Bytes is the total encoded size of the intact chunks
+	Bytes int64
+	// Broken is the first chunk that is missing, does not match its link, or
+	// could not be decoded. It is nil if the chain is complete
+	Broken *ChunkError
+}
+
+// Complete returns true if every chunk in the chain was read intact
+func (er EntriesReport) Complete() bool {
+	return er.Broken == nil
+}
+
+// PutEntries writes the multihashes to the datastore as a chain of entries
+// chunks, returning the link to the head of the chain. The counts of the chain
+// and its chunks are written alongside it, and an index of its multihashes if
+// it has more than DefaultEntriesIndexThreshold
+func PutEntries(ctx context.Context, ds datastore.Batching, hashes []mh.Multihash, chunkSize int) (ipld.Link, error) {
+	link, _, err := putEntries(ctx, ds, hashes, chunkSize, DefaultEntriesIndexThreshold)
+	return link, err
+}
+
+// putEntries is PutEntries with the given index threshold, also reporting the
+// size of the chain written
+func putEntries(ctx context.Context, ds datastore.Batching, hashes []mh.Multihash, chunkSize int, indexThreshold int) (ipld.Link, EntriesReport, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultEntriesChunkSize
+	}
+	report := EntriesReport{Entries: len(hashes)}
+	lsys := linkSystem(ds, ds, func(size int) {
+		report.Chunks++
+		report.Bytes += int64(size)
+	})
+	var next ipld.Link
+	// build the chain from the tail, so each chunk can link to the one after it
+	for end := len(hashes); end > 0; end -= chunkSize {
+		start := max(end-chunkSize, 0)
+		chunk := schema.EntryChunk{Entries: hashes[start:end], Next: next}
+		nd, err := chunk.ToNode()
+		if err != nil {
+			return nil, EntriesReport{}, fmt.Errorf("encoding entries chunk: %w", err)
+		}
+		next, err = lsys.Store(ipld.LinkContext{Ctx: ctx}, schema.Linkproto, nd)
+		if err != nil {
+			return nil, EntriesReport{}, fmt.Errorf("writing entries chunk: %w", err)
+		}
+		cc := chunkCount{entries: len(chunk.Entries), next: chunk.Next}
+		if err := ds.Put(ctx, chunkCountKey(next), cc.encode()); err != nil {
+			return nil, EntriesReport{}, fmt.Errorf("writing entries count of chunk %s: %w", next, err)
+		}
+	}
+	if next == nil {
+		return schema.NoEntries, report, nil
+	}
+	if len(hashes) > indexThreshold {
+		digests := make([]indexDigest, 0, len(hashes))
+		for _, hash := range hashes {
+			digests = append(digests, digestOf(hash))
+		}
+		if err := putEntriesIndex(ctx, ds, next, digests); err != nil {
+			return nil, EntriesReport{}, err
+		}
+	}
+	if err := putEntriesTotal(ctx, ds, next, int64(len(hashes))); err != nil {
+		return nil, EntriesReport{}, err
+	}
+	return next, report, nil
+}
+
+type entriesConfig struct {
+	onCorrupt func(ChunkError)
+	offset    int
+	limit     int
+}
+
+// EntriesOption configures iteration of an entries chain
+type EntriesOption func(*entriesConfig)
+
+// WithSkipCorrupt skips chunks that are missing, do not match their link, or
+// cannot be decoded, reporting each to the given function, instead of ending
+// iteration with an error. When a skipped chunk can still be decoded, iteration
+// continues with the chunk it links to. Otherwise iteration ends, as the rest of
+// the chain cannot be found
+func WithSkipCorrupt(onCorrupt func(ChunkError)) EntriesOption {
+	return func(c *entriesConfig) {
+		c.onCorrupt = onCorrupt
+	}
+}
+
+// WithEntriesRange skips the first offset multihashes of the chain, and ends
+// iteration after limit more, or at the end of the chain if limit is zero.
+// Chunks wholly before the offset are skipped without being read if their
+// counts were kept. The entries of skipped corrupt chunks aren't counted
+func WithEntriesRange(offset, limit int) EntriesOption {
+	return func(c *entriesConfig) {
+		c.offset = offset
+		c.limit = limit
+	}
+}
+
+// Entries iterates the multihashes in the entries chain starting at the given
+// link
+func Entries(ctx context.Context, ds datastore.Batching, root ipld.Link, opts ...EntriesOption) iter.Seq2[mh.Multihash, error] {
+	c := &entriesConfig{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return func(yield func(mh.Multihash, error) bool) {
+		skip, remaining := c.offset, c.limit
+		for link := root; !isEnd(link); {
+			if skip > 0 {
+				cc, ok, err := readChunkCount(ctx, ds, link)
+				if err != nil {
+					yield(nil, err)
+					return
+				}
+				if ok && cc.entries <= skip {
+					skip -= cc.entries
+					link = cc.next
+					continue
+				}
+			}
+			chunk, _, err := readChunk(ctx, ds, link)
+			if err != nil {
+				var ce ChunkError
+				if c.onCorrupt == nil || !errors.As(err, &ce) {
+					yield(nil, err)
+					return
+				}
+				c.onCorrupt(ce)
+				if chunk == nil {
+					return
+				}
+				link = chunk.Next
+				continue
+			}
+			entries := chunk.Entries
+			if skip > 0 {
+				n := min(skip, len(entries))
+				entries, skip = entries[n:], skip-n
+			}
+			for _, hash := range entries {
+				if !yield(hash, nil) {
+					return
+				}
+				if c.limit > 0 {
+					if remaining--; remaining == 0 {
+						return
+					}
+				}
+			}
+			link = chunk.Next
+		}
+	}
+}
+
+// VerifyEntries walks the entries chain starting at the given link, checking
+// each chunk's bytes against its link. Broken chains are described by the
+// report, an error is only returned if the chain could not be checked
+func VerifyEntries(ctx context.Context, ds datastore.Batching, root ipld.Link) (EntriesReport, error) {
+	var report EntriesReport
+	for link := root; !isEnd(link); {
+		chunk, size, err := readChunk(ctx, ds, link)
+		if err != nil {
+			var ce ChunkError
+			if !errors.As(err, &ce) {
+				return report, err
+			}
+			report.Broken = &ce
+			return report, nil
+		}
+		report.Chunks++
+		report.Entries += len(chunk.Entries)
+		report.Bytes += int64(size)
+		link = chunk.Next
+	}
+	return report, nil
+}
+
+func isEnd(link ipld.Link) bool {
+	return link == nil || link == schema.NoEntries
+}
+
+// readChunk reads and verifies a single entries chunk, returning it along with
+// its encoded size. It returns a ChunkError for chunks that are missing or
+// corrupt, in which case the decoded chunk is also returned if the bytes could
+// be decoded despite not matching the link
+func readChunk(ctx context.Context, ds datastore.Batching, link ipld.Link) (*schema.EntryChunk, int, error) {
+	cl, ok := link.(cidlink.Link)
+	if !ok {
+		return nil, 0, ChunkError{link, errors.New("not a CID link")}
+	}
+	data, err := ds.Get(ctx, dsKey(link))
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return nil, 0, ChunkError{link, errors.New("missing")}
+		}
+		return nil, 0, fmt.Errorf("reading entries chunk %s: %w", link, err)
+	}
+	chunk, decodeErr := schema.BytesToEntryChunk(cl.Cid, data)
+	actual, err := cl.Cid.Prefix().Sum(data)
+	if err != nil {
+		return nil, 0, ChunkError{link, fmt.Errorf("hashing: %w", err)}
+	}
+	if !actual.Equals(cl.Cid) {
+		err := ChunkError{link, fmt.Errorf("hash mismatch, content hashes to %s", actual)}
+		if decodeErr != nil {
+			return nil, 0, err
+		}
+		return &chunk, len(data), err
+	}
+	if decodeErr != nil {
+		return nil, 0, ChunkError{link, fmt.Errorf("decoding: %w", decodeErr)}
+	}
+	return &chunk, len(data), nil
+}
@@ -0,0 +1,154 @@
+package publisher_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/ingest/schema"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntries(t *testing.T) {
+	ctx := context.Background()
+	// 5 chunks of 2 entries each
+	hashes := testutil.RandomMultihashes(10)
+
+	// newChain returns the links of each chunk, from the head
+	newChain := func(t *testing.T) (datastore.Batching, []ipld.Link) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		root := testutil.Must(publisher.PutEntries(ctx, ds, hashes, 2))(t)
+		var links []ipld.Link
+		for link := root; link != nil; {
+			links = append(links, link)
+			data := testutil.Must(ds.Get(ctx, datastore.NewKey(link.String())))(t)
+			chunk := testutil.Must(schema.BytesToEntryChunk(link.(cidlink.Link).Cid, data))(t)
+			link = chunk.Next
+		}
+		require.Len(t, links, 5)
+		return ds, links
+	}
+	collect := func(t *testing.T, seq func(yield func(mh.Multihash, error) bool)) ([]mh.Multihash, error) {
+		var got []mh.Multihash
+		for hash, err := range seq {
+			if err != nil {
+				return got, err
+			}
+			got = append(got, hash)
+		}
+		return got, nil
+	}
+
+	t.Run("intact chain", func(t *testing.T) {
+		ds, links := newChain(t)
+		got, err := collect(t, publisher.Entries(ctx, ds, links[0]))
+		require.NoError(t, err)
+		require.Equal(t, hashes, got)
+
+		report := testutil.Must(publisher.VerifyEntries(ctx, ds, links[0]))(t)
+		require.True(t, report.Complete())
+		require.Equal(t, 10, report.Entries)
+		require.Equal(t, 5, report.Chunks)
+	})
+
+	t.Run("undecodable middle chunk", func(t *testing.T) {
+		ds, links := newChain(t)
+		require.NoError(t, ds.Put(ctx, datastore.NewKey(links[2].String()), []byte("garbage")))
+
+		report := testutil.Must(publisher.VerifyEntries(ctx, ds, links[0]))(t)
+		require.False(t, report.Complete())
+		require.Equal(t, 4, report.Entries)
+		require.Equal(t, 2, report.Chunks)
+		require.Equal(t, links[2], report.Broken.Link)
+
+		got, err := collect(t, publisher.Entries(ctx, ds, links[0]))
+		require.ErrorAs(t, err, &publisher.ChunkError{})
+		require.Equal(t, hashes[:4], got)
+
+		// the rest of the chain can't be found so skipping ends iteration
+		var corrupt []publisher.ChunkError
+		got, err = collect(t, publisher.Entries(ctx, ds, links[0], publisher.WithSkipCorrupt(func(ce publisher.ChunkError) {
+			corrupt = append(corrupt, ce)
+		})))
+		require.NoError(t, err)
+		require.Equal(t, hashes[:4], got)
+		require.Len(t, corrupt, 1)
+		require.Equal(t, links[2], corrupt[0].Link)
+	})
+
+	t.Run("tampered middle chunk", func(t *testing.T) {
+		ds, links := newChain(t)
+		// replace the chunk with a valid chunk that doesn't match its link
+		tampered := schema.EntryChunk{Entries: testutil.RandomMultihashes(2), Next: links[3]}
+		nd := testutil.Must(tampered.ToNode())(t)
+		scratch := dssync.MutexWrap(datastore.NewMapDatastore())
+		lsys := publisher.NewLinkSystem(scratch)
+		tamperedLink := testutil.Must(lsys.Store(ipld.LinkContext{Ctx: ctx}, schema.Linkproto, nd))(t)
+		data := testutil.Must(scratch.Get(ctx, datastore.NewKey(tamperedLink.String())))(t)
+		require.NoError(t, ds.Put(ctx, datastore.NewKey(links[2].String()), data))
+
+		report := testutil.Must(publisher.VerifyEntries(ctx, ds, links[0]))(t)
+		require.False(t, report.Complete())
+		require.Equal(t, 4, report.Entries)
+		require.Equal(t, links[2], report.Broken.Link)
+
+		// skipping omits the chunk's entries and carries on down the chain
+		var corrupt []publisher.ChunkError
+		got, err := collect(t, publisher.Entries(ctx, ds, links[0], publisher.WithSkipCorrupt(func(ce publisher.ChunkError) {
+			corrupt = append(corrupt, ce)
+		})))
+		require.NoError(t, err)
+		require.Equal(t, append(append([]mh.Multihash{}, hashes[:4]...), hashes[6:]...), got)
+		require.Len(t, corrupt, 1)
+	})
+
+	t.Run("missing middle chunk", func(t *testing.T) {
+		ds, links := newChain(t)
+		require.NoError(t, ds.Delete(ctx, datastore.NewKey(links[3].String())))
+
+		report := testutil.Must(publisher.VerifyEntries(ctx, ds, links[0]))(t)
+		require.False(t, report.Complete())
+		require.Equal(t, 6, report.Entries)
+		require.Equal(t, 3, report.Chunks)
+		require.Equal(t, links[3], report.Broken.Link)
+	})
+
+	t.Run("range", func(t *testing.T) {
+		ds, links := newChain(t)
+		got, err := collect(t, publisher.Entries(ctx, ds, links[0], publisher.WithEntriesRange(3, 4)))
+		require.NoError(t, err)
+		require.Equal(t, hashes[3:7], got)
+		got, err = collect(t, publisher.Entries(ctx, ds, links[0], publisher.WithEntriesRange(0, 1)))
+		require.NoError(t, err)
+		require.Equal(t, hashes[:1], got)
+
+		// counted chunks before the offset aren't read
+		require.NoError(t, ds.Put(ctx, datastore.NewKey(links[0].String()), []byte("garbage")))
+		got, err = collect(t, publisher.Entries(ctx, ds, links[0], publisher.WithEntriesRange(2, 0)))
+		require.NoError(t, err)
+		require.Equal(t, hashes[2:], got)
+	})
+
+	t.Run("range of a legacy chain", func(t *testing.T) {
+		ds, links := newChain(t)
+		stripEntriesSideData(t, ds)
+		got, err := collect(t, publisher.Entries(ctx, ds, links[0], publisher.WithEntriesRange(3, 0)))
+		require.NoError(t, err)
+		require.Equal(t, hashes[3:], got)
+	})
+
+	t.Run("no entries", func(t *testing.T) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		root := testutil.Must(publisher.PutEntries(ctx, ds, nil, 2))(t)
+		require.Equal(t, schema.NoEntries, root)
+		report := testutil.Must(publisher.VerifyEntries(ctx, ds, root))(t)
+		require.True(t, report.Complete())
+		require.Zero(t, report.Entries)
+	})
+}
@@ -0,0 +1,349 @@
+package publisher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// DefaultEntriesIndexThreshold is the number of entries above which an entries
+// chain is written with an index of its multihashes
+const DefaultEntriesIndexThreshold = 4 * DefaultEntriesChunkSize
+
+// entriesIndexFormat is the version of the encoding of entries indexes
+const entriesIndexFormat = 1
+
+const (
+	// indexDigestSize is the size of the truncated SHA-256 digests of the
+	// multihashes in an entries index. Distinct multihashes share one with
+	// negligible probability
+	indexDigestSize = 16
+	// indexPageDigests is the number of digests in each page of an entries
+	// index, keeping pages well within the item size limit of DynamoDB
+	indexPageDigests = 16384
+)
+
+var (
+	chunkCountPrefix   = datastore.NewKey("entries/chunks")
+	entriesTotalPrefix = datastore.NewKey("entries/totals")
+	entriesIndexPrefix = datastore.NewKey("entries/indexes")
+)
+
+// ErrEntriesScanLimit is returned when looking for a multihash in an entries
+// chain without an index stops at the scan limit before the end of the chain
+var ErrEntriesScanLimit = errors.New("entries scan limit reached")
+
+// WithEntriesIndexThreshold writes an index of the multihashes of entries
+// chains of more than the given number of entries, for finding a multihash in
+// them without reading the chain. If not set, DefaultEntriesIndexThreshold is
+// used
+func WithEntriesIndexThreshold(entries int) Option {
+	return func(p *Publisher) {
+		p.indexThreshold = entries
+	}
+}
+
+// WithEntriesScanLimit sets the number of entries read to find a multihash in
+// an entries chain without an index, before giving up with
+// ErrEntriesScanLimit. If not set, the entries index threshold is used, so that
+// chains written without an index are always read to the end
+func WithEntriesScanLimit(entries int) Option {
+	return func(p *Publisher) {
+		p.scanLimit = entries
+	}
+}
+
+// chunkCount is the number of entries in an entries chunk and the link to the
+// next, kept so that chains can be counted and skipped through without reading
+// their chunks
+type chunkCount struct {
+	entries int
+	next    ipld.Link
+}
+
+func (cc chunkCount) encode() []byte {
+	data := binary.AppendUvarint(nil, uint64(cc.entries))
+	if !isEnd(cc.next) {
+		data = append(data, cc.next.(cidlink.Link).Cid.Bytes()...)
+	}
+	return data
+}
+
+func decodeChunkCount(data []byte) (chunkCount, error) {
+	entries, n := binary.Uvarint(data)
+	if n <= 0 {
+		return chunkCount{}, errors.New("invalid entries count")
+	}
+	cc := chunkCount{entries: int(entries)}
+	if len(data) > n {
+		c, err := cid.Cast(data[n:])
+		if err != nil {
+			return chunkCount{}, fmt.Errorf("decoding next chunk: %w", err)
+		}
+		cc.next = cidlink.Link{Cid: c}
+	}
+	return cc, nil
+}
+
+func chunkCountKey(link ipld.Link) datastore.Key {
+	return chunkCountPrefix.ChildString(link.String())
+}
+
+func entriesTotalKey(root ipld.Link) datastore.Key {
+	return entriesTotalPrefix.ChildString(root.String())
+}
+
+func entriesIndexKey(root ipld.Link) datastore.Key {
+	return entriesIndexPrefix.ChildString(root.String())
+}
+
+func entriesIndexPageKey(root ipld.Link, page int) datastore.Key {
+	return entriesIndexKey(root).ChildString(strconv.Itoa(page))
+}
+
+// readChunkCount reads the count kept for the entries chunk, returning false if
+// there isn't one
+func readChunkCount(ctx context.Context, ds datastore.Read, link ipld.Link) (chunkCount, bool, error) {
+	data, err := ds.Get(ctx, chunkCountKey(link))
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return chunkCount{}, false, nil
+		}
+		return chunkCount{}, false, fmt.Errorf("reading entries count of chunk %s: %w", link, err)
+	}
+	cc, err := decodeChunkCount(data)
+	if err != nil {
+		return chunkCount{}, false, fmt.Errorf("decoding entries count of chunk %s: %w", link, err)
+	}
+	return cc, true, nil
+}
+
+// countChunk returns the count kept for the entries chunk, or counts it by
+// reading the chunk if there isn't one
+func countChunk(ctx context.Context, ds datastore.Batching, link ipld.Link) (chunkCount, error) {
+	cc, ok, err := readChunkCount(ctx, ds, link)
+	if err != nil || ok {
+		return cc, err
+	}
+	chunk, _, err := readChunk(ctx, ds, link)
+	if err != nil {
+		return chunkCount{}, err
+	}
+	return chunkCount{entries: len(chunk.Entries), next: chunk.Next}, nil
+}
+
+// readEntriesTotal reads the count kept for the entries chain, returning false
+// if there isn't one
+func readEntriesTotal(ctx context.Context, ds datastore.Read, root ipld.Link) (int64, bool, error) {
+	data, err := ds.Get(ctx, entriesTotalKey(root))
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("reading entries count of %s: %w", root, err)
+	}
+	total, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, false, fmt.Errorf("decoding entries count of %s: invalid count", root)
+	}
+	return int64(total), true, nil
+}
+
+// putEntriesTotal writes the count of the entries chain. It is written after
+// the rest of the chain's side data, so chains with a total are known to have
+// their counts, and their index if they are above the threshold
+func putEntriesTotal(ctx context.Context, ds datastore.Write, root ipld.Link, total int64) error {
+	if err := ds.Put(ctx, entriesTotalKey(root), binary.AppendUvarint(nil, uint64(total))); err != nil {
+		return fmt.Errorf("writing entries count of %s: %w", root, err)
+	}
+	return nil
+}
+
+type indexDigest [indexDigestSize]byte
+
+func digestOf(hash mh.Multihash) indexDigest {
+	sum := sha256.Sum256(hash)
+	return indexDigest(sum[:indexDigestSize])
+}
+
+// putEntriesIndex writes the sorted digests of the multihashes of the entries
+// chain in pages, after a header holding the first digest of each page
+func putEntriesIndex(ctx context.Context, ds datastore.Write, root ipld.Link, digests []indexDigest) error {
+	slices.SortFunc(digests, func(a, b indexDigest) int { return bytes.Compare(a[:], b[:]) })
+	digests = slices.Compact(digests)
+	header := []byte{entriesIndexFormat}
+	for page := 0; page*indexPageDigests < len(digests); page++ {
+		digests := digests[page*indexPageDigests : min((page+1)*indexPageDigests, len(digests))]
+		data := make([]byte, 0, len(digests)*indexDigestSize)
+		for _, d := range digests {
+			data = append(data, d[:]...)
+		}
+		if err := ds.Put(ctx, entriesIndexPageKey(root, page), data); err != nil {
+			return fmt.Errorf("writing entries index page %d of %s: %w", page, root, err)
+		}
+		header = append(header, digests[0][:]...)
+	}
+	if err := ds.Put(ctx, entriesIndexKey(root), header); err != nil {
+		return fmt.Errorf("writing entries index of %s: %w", root, err)
+	}
+	return nil
+}
+
+// lookupEntriesIndex looks the multihash up in the index of the entries chain,
+// returning whether it was found and whether the chain has an index
+func lookupEntriesIndex(ctx context.Context, ds datastore.Read, root ipld.Link, hash mh.Multihash) (bool, bool, error) {
+	header, err := ds.Get(ctx, entriesIndexKey(root))
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return false, false, nil
+		}
+		return false, false, fmt.Errorf("reading entries index of %s: %w", root, err)
+	}
+	if len(header) == 0 || header[0] != entriesIndexFormat || (len(header)-1)%indexDigestSize != 0 {
+		return false, false, fmt.Errorf("decoding entries index of %s: unknown format", root)
+	}
+	d := digestOf(hash)
+	firsts := header[1:]
+	pages := len(firsts) / indexDigestSize
+	// the page holding the digest is the last one starting at or before it
+	page := sort.Search(pages, func(i int) bool {
+		return bytes.Compare(firsts[i*indexDigestSize:(i+1)*indexDigestSize], d[:]) > 0
+	}) - 1
+	if page < 0 {
+		return false, true, nil
+	}
+	data, err := ds.Get(ctx, entriesIndexPageKey(root, page))
+	if err != nil {
+		return false, true, fmt.Errorf("reading entries index page %d of %s: %w", page, root, err)
+	}
+	if len(data)%indexDigestSize != 0 {
+		return false, true, fmt.Errorf("decoding entries index page %d of %s: truncated", page, root)
+	}
+	n := len(data) / indexDigestSize
+	i := sort.Search(n, func(i int) bool {
+		return bytes.Compare(data[i*indexDigestSize:(i+1)*indexDigestSize], d[:]) >= 0
+	})
+	return i < n && bytes.Equal(data[i*indexDigestSize:(i+1)*indexDigestSize], d[:]), true, nil
+}
+
+// EntryCount returns the number of multihashes in the entries chain starting at
+// the given link. It uses the count kept for the chain when it was written or
+// backfilled, or else walks the chain, using the counts kept for its chunks and
+// reading those without one
+func (p *Publisher) EntryCount(ctx context.Context, root ipld.Link) (int64, error) {
+	if isEnd(root) {
+		return 0, nil
+	}
+	total, ok, err := readEntriesTotal(ctx, p.ds, root)
+	if err != nil || ok {
+		return total, err
+	}
+	for link := root; !isEnd(link); {
+		cc, err := countChunk(ctx, p.ds, link)
+		if err != nil {
+			return 0, err
+		}
+		total += int64(cc.entries)
+		link = cc.next
+	}
+	return total, nil
+}
+
+// ContainsEntry returns true if the multihash is in the entries chain starting
+// at the given link. Chains with an index are looked up in it, others are read
+// up to the scan limit, returning ErrEntriesScanLimit if the multihash wasn't
+// found before it
+func (p *Publisher) ContainsEntry(ctx context.Context, root ipld.Link, hash mh.Multihash) (bool, error) {
+	if isEnd(root) {
+		return false, nil
+	}
+	found, indexed, err := lookupEntriesIndex(ctx, p.ds, root, hash)
+	if err != nil || indexed {
+		return found, err
+	}
+	scanned := 0
+	for link := root; !isEnd(link); {
+		if scanned >= p.scanLimit {
+			return false, fmt.Errorf("%w after %d entries of %s", ErrEntriesScanLimit, scanned, root)
+		}
+		chunk, _, err := readChunk(ctx, p.ds, link)
+		if err != nil {
+			return false, err
+		}
+		for _, entry := range chunk.Entries {
+			if bytes.Equal(entry, hash) {
+				return true, nil
+			}
+		}
+		scanned += len(chunk.Entries)
+		link = chunk.Next
+	}
+	return false, nil
+}
+
+// BackfillEntries writes the counts, and the index if above the threshold, of
+// the entries chains of advertisements in the chain published without them,
+// returning the number of entries chains backfilled. Entries chains that can't
+// be read are skipped
+func (p *Publisher) BackfillEntries(ctx context.Context) (int, error) {
+	backfilled := 0
+	for adv, err := range p.Advertisements(ctx) {
+		if err != nil {
+			return backfilled, err
+		}
+		if isEnd(adv.Entries) {
+			continue
+		}
+		if _, ok, err := readEntriesTotal(ctx, p.ds, adv.Entries); err != nil {
+			return backfilled, err
+		} else if ok {
+			continue
+		}
+		if err := p.backfillEntries(ctx, adv.Entries); err != nil {
+			var ce ChunkError
+			if !errors.As(err, &ce) {
+				return backfilled, err
+			}
+			log.Warnw("skipping backfill of broken entries chain", "entries", adv.Entries, "error", err)
+			continue
+		}
+		backfilled++
+	}
+	return backfilled, nil
+}
+
+func (p *Publisher) backfillEntries(ctx context.Context, root ipld.Link) error {
+	var digests []indexDigest
+	for link := root; !isEnd(link); {
+		chunk, _, err := readChunk(ctx, p.ds, link)
+		if err != nil {
+			return err
+		}
+		for _, hash := range chunk.Entries {
+			digests = append(digests, digestOf(hash))
+		}
+		cc := chunkCount{entries: len(chunk.Entries), next: chunk.Next}
+		if err := p.ds.Put(ctx, chunkCountKey(link), cc.encode()); err != nil {
+			return fmt.Errorf("writing entries count of chunk %s: %w", link, err)
+		}
+		link = chunk.Next
+	}
+	if len(digests) > p.indexThreshold {
+		if err := putEntriesIndex(ctx, p.ds, root, digests); err != nil {
+			return err
+		}
+	}
+	return putEntriesTotal(ctx, p.ds, root, int64(len(digests)))
+}
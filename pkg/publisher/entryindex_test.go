@@ -0,0 +1,154 @@
+package publisher_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/ingest/schema"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/stretchr/testify/require"
+)
+
+// chunkLinks returns the links of each chunk of the entries chain, from the head
+func chunkLinks(t *testing.T, ds datastore.Batching, root ipld.Link) []ipld.Link {
+	var links []ipld.Link
+	for link := root; link != nil && link != schema.NoEntries; {
+		links = append(links, link)
+		data := testutil.Must(ds.Get(context.Background(), datastore.NewKey(link.String())))(t)
+		chunk := testutil.Must(schema.BytesToEntryChunk(link.(cidlink.Link).Cid, data))(t)
+		link = chunk.Next
+	}
+	return links
+}
+
+// stripEntriesSideData deletes the counts and indexes of every entries chain, as
+// if the chains were written before they were kept
+func stripEntriesSideData(t *testing.T, ds datastore.Batching) {
+	ctx := context.Background()
+	results := testutil.Must(ds.Query(ctx, query.Query{Prefix: "/entries", KeysOnly: true}))(t)
+	entries := testutil.Must(results.Rest())(t)
+	require.NotEmpty(t, entries)
+	for _, entry := range entries {
+		require.NoError(t, ds.Delete(ctx, datastore.NewKey(entry.Key)))
+	}
+}
+
+func TestPublisher__EntryIndex(t *testing.T) {
+	ctx := context.Background()
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	provider := peer.AddrInfo{ID: testutil.RandomPeer()}
+
+	newPublisher := func(opts ...publisher.Option) (datastore.Batching, *publisher.Publisher) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		return ds, publisher.New(ds, key, append([]publisher.Option{publisher.WithEntriesChunkSize(2)}, opts...)...)
+	}
+	// publish returns the link to the entries of the advertisement published
+	publish := func(t *testing.T, ds datastore.Batching, p *publisher.Publisher, hashes []mh.Multihash) ipld.Link {
+		link := testutil.Must(p.Publish(ctx, provider, testutil.RandomBytes(10), testutil.RandomBytes(10), hashes))(t)
+		data := testutil.Must(ds.Get(ctx, datastore.NewKey(link.String())))(t)
+		return testutil.Must(schema.BytesToAdvertisement(link.(cidlink.Link).Cid, data))(t).Entries
+	}
+	deleteChunks := func(t *testing.T, ds datastore.Batching, links []ipld.Link) {
+		for _, link := range links {
+			require.NoError(t, ds.Delete(ctx, datastore.NewKey(link.String())))
+		}
+	}
+
+	t.Run("counted chains are counted without reading their chunks", func(t *testing.T) {
+		ds, p := newPublisher()
+		root := publish(t, ds, p, testutil.RandomMultihashes(7))
+		deleteChunks(t, ds, chunkLinks(t, ds, root))
+		require.Equal(t, int64(7), testutil.Must(p.EntryCount(ctx, root))(t))
+		require.Zero(t, testutil.Must(p.EntryCount(ctx, schema.NoEntries))(t))
+	})
+
+	t.Run("legacy chains are counted by walking them", func(t *testing.T) {
+		ds, p := newPublisher()
+		root := publish(t, ds, p, testutil.RandomMultihashes(7))
+		links := chunkLinks(t, ds, root)
+		stripEntriesSideData(t, ds)
+		require.Equal(t, int64(7), testutil.Must(p.EntryCount(ctx, root))(t))
+
+		deleteChunks(t, ds, links[2:3])
+		_, err := p.EntryCount(ctx, root)
+		require.ErrorAs(t, err, &publisher.ChunkError{})
+	})
+
+	t.Run("indexed chains are looked up without reading their chunks", func(t *testing.T) {
+		ds, p := newPublisher(publisher.WithEntriesIndexThreshold(4))
+		hashes := testutil.RandomMultihashes(10)
+		root := publish(t, ds, p, hashes)
+		deleteChunks(t, ds, chunkLinks(t, ds, root))
+		for _, hash := range hashes {
+			require.True(t, testutil.Must(p.ContainsEntry(ctx, root, hash))(t))
+		}
+		for _, hash := range testutil.RandomMultihashes(10) {
+			require.False(t, testutil.Must(p.ContainsEntry(ctx, root, hash))(t))
+		}
+	})
+
+	t.Run("indexes span pages", func(t *testing.T) {
+		ds, p := newPublisher(publisher.WithEntriesChunkSize(1000), publisher.WithEntriesIndexThreshold(0))
+		hashes := testutil.RandomMultihashes(40000)
+		root := publish(t, ds, p, hashes)
+		deleteChunks(t, ds, chunkLinks(t, ds, root))
+		for _, hash := range hashes {
+			require.True(t, testutil.Must(p.ContainsEntry(ctx, root, hash))(t))
+		}
+		for _, hash := range testutil.RandomMultihashes(100) {
+			require.False(t, testutil.Must(p.ContainsEntry(ctx, root, hash))(t))
+		}
+	})
+
+	t.Run("unindexed chains are scanned up to the limit", func(t *testing.T) {
+		hashes := testutil.RandomMultihashes(10)
+		ds, p := newPublisher(publisher.WithEntriesIndexThreshold(100), publisher.WithEntriesScanLimit(4))
+		root := publish(t, ds, p, hashes)
+		require.True(t, testutil.Must(p.ContainsEntry(ctx, root, hashes[0]))(t))
+		require.True(t, testutil.Must(p.ContainsEntry(ctx, root, hashes[3]))(t))
+		_, err := p.ContainsEntry(ctx, root, hashes[4])
+		require.ErrorIs(t, err, publisher.ErrEntriesScanLimit)
+		_, err = p.ContainsEntry(ctx, root, testutil.RandomMultihash())
+		require.ErrorIs(t, err, publisher.ErrEntriesScanLimit)
+
+		// chains under the threshold are read to the end by default
+		ds, p = newPublisher(publisher.WithEntriesIndexThreshold(100))
+		root = publish(t, ds, p, hashes)
+		require.True(t, testutil.Must(p.ContainsEntry(ctx, root, hashes[9]))(t))
+		require.False(t, testutil.Must(p.ContainsEntry(ctx, root, testutil.RandomMultihash()))(t))
+	})
+
+	t.Run("legacy chains are backfilled", func(t *testing.T) {
+		ds, p := newPublisher(publisher.WithEntriesIndexThreshold(4), publisher.WithEntriesScanLimit(2))
+		small, large, broken := testutil.RandomMultihashes(3), testutil.RandomMultihashes(9), testutil.RandomMultihashes(5)
+		smallRoot := publish(t, ds, p, small)
+		largeRoot := publish(t, ds, p, large)
+		brokenRoot := publish(t, ds, p, broken)
+		publish(t, ds, p, nil)
+		stripEntriesSideData(t, ds)
+		deleteChunks(t, ds, chunkLinks(t, ds, brokenRoot)[1:2])
+
+		// without an index the large chain is only scanned up to the limit
+		_, err := p.ContainsEntry(ctx, largeRoot, large[8])
+		require.ErrorIs(t, err, publisher.ErrEntriesScanLimit)
+
+		require.Equal(t, 2, testutil.Must(p.BackfillEntries(ctx))(t))
+		require.Zero(t, testutil.Must(p.BackfillEntries(ctx))(t))
+
+		deleteChunks(t, ds, chunkLinks(t, ds, largeRoot))
+		require.Equal(t, int64(9), testutil.Must(p.EntryCount(ctx, largeRoot))(t))
+		require.True(t, testutil.Must(p.ContainsEntry(ctx, largeRoot, large[8]))(t))
+		require.False(t, testutil.Must(p.ContainsEntry(ctx, largeRoot, small[0]))(t))
+		deleteChunks(t, ds, chunkLinks(t, ds, smallRoot))
+		require.Equal(t, int64(3), testutil.Must(p.EntryCount(ctx, smallRoot))(t))
+	})
+}
@@ -0,0 +1,81 @@
+package publisher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/ingest/schema"
+)
+
+var fingerprintPrefix = datastore.NewKey("fingerprints")
+
+type publishConfig struct {
+	force bool
+	// removal writes a removal advertisement, set by Remove
+	removal bool
+}
+
+// PublishOption configures a single publish
+type PublishOption func(*publishConfig)
+
+// ForceRepublish writes a new advertisement even if an identical one was
+// already published, for deliberately refreshing an advertisement
+func ForceRepublish() PublishOption {
+	return func(c *publishConfig) {
+		c.force = true
+	}
+}
+
+// fingerprint identifies the content of an advertisement: its provider,
+// context ID, metadata and entries. Advertisements with the same fingerprint
+// are duplicates
+func fingerprint(provider string, addrs []string, contextID []byte, metadata []byte, entries ipld.Link) datastore.Key {
+	h := sha256.New()
+	field := func(b []byte) {
+		h.Write(binary.AppendUvarint(nil, uint64(len(b))))
+		h.Write(b)
+	}
+	field([]byte(provider))
+	h.Write(binary.AppendUvarint(nil, uint64(len(addrs))))
+	for _, addr := range addrs {
+		field([]byte(addr))
+	}
+	field(contextID)
+	field(metadata)
+	if entries != nil {
+		field(entries.(cidlink.Link).Cid.Bytes())
+	} else {
+		field(nil)
+	}
+	return fingerprintPrefix.ChildString(hex.EncodeToString(h.Sum(nil)))
+}
+
+// advertFingerprint returns the fingerprint of a published advertisement
+func advertFingerprint(adv schema.Advertisement) datastore.Key {
+	return fingerprint(adv.Provider, adv.Addresses, adv.ContextID, adv.Metadata, adv.Entries)
+}
+
+// published returns the link to the advertisement published with the
+// fingerprint, or nil if there is none
+func (p *Publisher) published(ctx context.Context, key datastore.Key) (ipld.Link, error) {
+	data, err := p.ds.Get(ctx, key)
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading advertisement fingerprint: %w", err)
+	}
+	c, err := cid.Cast(data)
+	if err != nil {
+		return nil, fmt.Errorf("decoding advertisement fingerprint: %w", err)
+	}
+	return cidlink.Link{Cid: c}, nil
+}
@@ -0,0 +1,321 @@
+package publisher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	ipldmc "github.com/ipld/go-ipld-prime/multicodec"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipni/go-libipni/ingest/schema"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/indexing-service/pkg/metadata"
+)
+
+// DefaultInspectChunks bounds the entries chunks walked to count the entries of
+// an inspected advertisement
+const DefaultInspectChunks = 1000
+
+// ErrAdvertNotFound is returned when inspecting an advertisement that isn't
+// stored
+var ErrAdvertNotFound = errors.New("advertisement not found")
+
+// InspectedProvider is an extended provider of an inspected advertisement
+type InspectedProvider struct {
+	ID        string
+	Addresses []string
+	Metadata  []byte
+	Protocols []metadata.DecodedProtocol
+}
+
+// InspectedEntries counts the entries of an inspected advertisement
+type InspectedEntries struct {
+	EntriesReport
+	// Truncated is whether counting stopped at the chunk limit before the end
+	// of the entries chain
+	Truncated bool
+}
+
+// AdvertInspection is a stored advertisement decoded field by field. A field
+// that can't be decoded is left unset and the error decoding it is recorded,
+// so that a partially corrupt advertisement can still be inspected
+type AdvertInspection struct {
+	Link cid.Cid
+	// Size is the size of the advertisement block
+	Size       int
+	PreviousID ipld.Link
+	Provider   string
+	Addresses  []string
+	Entries    ipld.Link
+	// EntriesCount is nil unless the entries were counted
+	EntriesCount *InspectedEntries
+	ContextID    []byte
+	Metadata     []byte
+	Protocols    []metadata.DecodedProtocol
+	IsRm         bool
+	// Override and ExtendedProviders are set from the extended providers of
+	// the advertisement, if it has any
+	ExtendedProvider  bool
+	Override          bool
+	ExtendedProviders []InspectedProvider
+	// Signer is the peer that signed the advertisement. The signature is valid
+	// if it is the provider and SignatureErr is nil
+	Signer       peer.ID
+	SignatureErr error
+	// Errors are the errors decoding the fields, by field name
+	Errors map[string]error
+}
+
+// SignatureValid is whether the advertisement is validly signed by its provider
+func (ai AdvertInspection) SignatureValid() bool {
+	return ai.SignatureErr == nil && ai.Signer != "" && ai.Signer.String() == ai.Provider
+}
+
+// InspectAdvert decodes the stored advertisement field by field, counting the
+// entries it links to up to maxChunks chunks, or not at all if it is zero. An
+// error is only returned if the advertisement couldn't be read
+func (p *Publisher) InspectAdvert(ctx context.Context, link ipld.Link, maxChunks int) (AdvertInspection, error) {
+	cl, ok := link.(cidlink.Link)
+	if !ok {
+		return AdvertInspection{}, fmt.Errorf("advertisement %s is not a CID link", link)
+	}
+	data, err := p.ds.Get(ctx, dsKey(link))
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return AdvertInspection{}, ErrAdvertNotFound
+		}
+		return AdvertInspection{}, fmt.Errorf("reading advertisement %s: %w", link, err)
+	}
+	ai := AdvertInspection{Link: cl.Cid, Size: len(data), Errors: map[string]error{}}
+	if actual, err := cl.Cid.Prefix().Sum(data); err != nil {
+		ai.Errors["Link"] = fmt.Errorf("hashing: %w", err)
+	} else if !actual.Equals(cl.Cid) {
+		ai.Errors["Link"] = fmt.Errorf("hash mismatch, content hashes to %s", actual)
+	}
+
+	nd, err := decodeNode(cl.Cid, data)
+	if err != nil {
+		ai.Errors["Advertisement"] = err
+		ai.SignatureErr = err
+		return ai, nil
+	}
+	f := fields{nd: nd, errs: ai.Errors}
+	ai.PreviousID = f.link("PreviousID", true)
+	ai.Provider = f.string("Provider")
+	ai.Addresses = f.strings("Addresses")
+	ai.Entries = f.link("Entries", false)
+	ai.ContextID = f.bytes("ContextID")
+	ai.Metadata = f.bytes("Metadata")
+	ai.Protocols = metadata.DecodeProtocols(ai.Metadata)
+	ai.IsRm = f.bool("IsRm")
+	if ep := f.optional("ExtendedProvider"); ep != nil {
+		ai.ExtendedProvider = true
+		ai.Override, ai.ExtendedProviders = inspectExtendedProvider(ep, ai.Errors)
+	}
+
+	adv, err := schema.BytesToAdvertisement(cl.Cid, data)
+	if err != nil {
+		ai.SignatureErr = fmt.Errorf("decoding advertisement: %w", err)
+	} else {
+		ai.Signer, ai.SignatureErr = adv.VerifySignature()
+		if ai.SignatureErr == nil && ai.Signer.String() != ai.Provider {
+			ai.SignatureErr = fmt.Errorf("signed by %s rather than the provider", ai.Signer)
+		}
+	}
+
+	if maxChunks > 0 && ai.Entries != nil {
+		count, err := p.countEntries(ctx, ai.Entries, maxChunks)
+		if err != nil {
+			ai.Errors["EntriesCount"] = err
+		} else {
+			ai.EntriesCount = &count
+		}
+	}
+	return ai, nil
+}
+
+// countEntries walks the entries chain up to maxChunks chunks
+func (p *Publisher) countEntries(ctx context.Context, root ipld.Link, maxChunks int) (InspectedEntries, error) {
+	var count InspectedEntries
+	for link := root; !isEnd(link); {
+		if count.Chunks == maxChunks {
+			count.Truncated = true
+			break
+		}
+		chunk, size, err := readChunk(ctx, p.ds, link)
+		if err != nil {
+			var ce ChunkError
+			if !errors.As(err, &ce) {
+				return count, err
+			}
+			count.Broken = &ce
+			break
+		}
+		count.Chunks++
+		count.Entries += len(chunk.Entries)
+		count.Bytes += int64(size)
+		link = chunk.Next
+	}
+	return count, nil
+}
+
+// decodeNode decodes the advertisement without its schema, so that the fields
+// that match the schema can be read despite those that don't
+func decodeNode(c cid.Cid, data []byte) (datamodel.Node, error) {
+	decoder, err := ipldmc.LookupDecoder(c.Prefix().Codec)
+	if err != nil {
+		return nil, fmt.Errorf("decoding: %w", err)
+	}
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := decoder(nb, bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("decoding: %w", err)
+	}
+	nd := nb.Build()
+	if nd.Kind() != datamodel.Kind_Map {
+		return nil, fmt.Errorf("decoding: expected a map, got a %s", nd.Kind())
+	}
+	return nd, nil
+}
+
+func inspectExtendedProvider(ep datamodel.Node, errs map[string]error) (bool, []InspectedProvider) {
+	f := fields{nd: ep, errs: errs, prefix: "ExtendedProvider."}
+	override := f.bool("Override")
+	list := f.field("Providers")
+	if list == nil {
+		return override, nil
+	}
+	if list.Kind() != datamodel.Kind_List {
+		errs["ExtendedProvider.Providers"] = fmt.Errorf("expected a list, got a %s", list.Kind())
+		return override, nil
+	}
+	var providers []InspectedProvider
+	for it := list.ListIterator(); !it.Done(); {
+		i, nd, err := it.Next()
+		if err != nil {
+			errs["ExtendedProvider.Providers"] = err
+			break
+		}
+		if nd.Kind() != datamodel.Kind_Map {
+			errs[fmt.Sprintf("ExtendedProvider.Providers.%d", i)] = fmt.Errorf("expected a map, got a %s", nd.Kind())
+			continue
+		}
+		pf := fields{nd: nd, errs: errs, prefix: fmt.Sprintf("ExtendedProvider.Providers.%d.", i)}
+		provider := InspectedProvider{ID: pf.string("ID"), Addresses: pf.strings("Addresses"), Metadata: pf.bytes("Metadata")}
+		provider.Protocols = metadata.DecodeProtocols(provider.Metadata)
+		providers = append(providers, provider)
+	}
+	return override, providers
+}
+
+// fields reads the fields of a map node, recording the errors of those that
+// are missing or of the wrong kind
+type fields struct {
+	nd     datamodel.Node
+	errs   map[string]error
+	prefix string
+}
+
+// optional returns the field, or nil if it is missing or null
+func (f fields) optional(name string) datamodel.Node {
+	nd, err := f.nd.LookupByString(name)
+	if err != nil || nd.IsNull() || nd.IsAbsent() {
+		return nil
+	}
+	return nd
+}
+
+// field returns the field, recording an error if it is missing
+func (f fields) field(name string) datamodel.Node {
+	nd := f.optional(name)
+	if nd == nil {
+		f.errs[f.prefix+name] = errors.New("missing")
+	}
+	return nd
+}
+
+func (f fields) fail(name string, err error) {
+	f.errs[f.prefix+name] = err
+}
+
+func (f fields) string(name string) string {
+	nd := f.field(name)
+	if nd == nil {
+		return ""
+	}
+	s, err := nd.AsString()
+	if err != nil {
+		f.fail(name, err)
+	}
+	return s
+}
+
+func (f fields) strings(name string) []string {
+	nd := f.field(name)
+	if nd == nil {
+		return nil
+	}
+	if nd.Kind() != datamodel.Kind_List {
+		f.fail(name, fmt.Errorf("expected a list, got a %s", nd.Kind()))
+		return nil
+	}
+	var ss []string
+	for it := nd.ListIterator(); !it.Done(); {
+		_, item, err := it.Next()
+		if err != nil {
+			f.fail(name, err)
+			return ss
+		}
+		s, err := item.AsString()
+		if err != nil {
+			f.fail(name, err)
+			return ss
+		}
+		ss = append(ss, s)
+	}
+	return ss
+}
+
+func (f fields) bytes(name string) []byte {
+	nd := f.field(name)
+	if nd == nil {
+		return nil
+	}
+	b, err := nd.AsBytes()
+	if err != nil {
+		f.fail(name, err)
+	}
+	return b
+}
+
+func (f fields) bool(name string) bool {
+	nd := f.field(name)
+	if nd == nil {
+		return false
+	}
+	b, err := nd.AsBool()
+	if err != nil {
+		f.fail(name, err)
+	}
+	return b
+}
+
+func (f fields) link(name string, optional bool) ipld.Link {
+	nd := f.optional(name)
+	if nd == nil {
+		if !optional {
+			f.fail(name, errors.New("missing"))
+		}
+		return nil
+	}
+	l, err := nd.AsLink()
+	if err != nil {
+		f.fail(name, err)
+	}
+	return l
+}
@@ -0,0 +1,187 @@
+package publisher_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/ingest/schema"
+	ipnimd "github.com/ipni/go-libipni/metadata"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublisher__InspectAdvert(t *testing.T) {
+	ctx := context.Background()
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	keyPeer := testutil.Must(peer.IDFromPrivateKey(key))(t)
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	p := publisher.New(ds, key, publisher.WithEntriesChunkSize(2))
+	lsys := publisher.NewLinkSystem(ds)
+	claim := &metadata.IndexClaimMetadata{Index: testutil.RandomCID().(cidlink.Link).Cid, Expiration: 1700000000, Claim: testutil.RandomCID().(cidlink.Link).Cid}
+	claimBytes := testutil.Must(claim.MarshalBinary())(t)
+	unknown := append(varint.ToUvarint(0x3f0000), 1, 2, 3)
+
+	store := func(t *testing.T, adv schema.Advertisement) ipld.Link {
+		nd := testutil.Must(adv.ToNode())(t)
+		return testutil.Must(lsys.Store(ipld.LinkContext{Ctx: ctx}, schema.Linkproto, nd))(t)
+	}
+	storeRaw := func(t *testing.T, data string) ipld.Link {
+		c := testutil.Must(cid.Prefix{Version: 1, Codec: cid.DagJSON, MhType: multihash.SHA2_256, MhLength: -1}.Sum([]byte(data)))(t)
+		require.NoError(t, ds.Put(ctx, datastore.NewKey(c.String()), []byte(data)))
+		return cidlink.Link{Cid: c}
+	}
+
+	provider := peer.AddrInfo{ID: keyPeer, Addrs: []multiaddr.Multiaddr{testutil.RandomMultiaddr()}}
+	contextID := testutil.RandomBytes(10)
+	published := testutil.Must(p.Publish(ctx, provider, contextID, claimBytes, testutil.RandomMultihashes(5)))(t)
+
+	t.Run("published advertisement", func(t *testing.T) {
+		ai := testutil.Must(p.InspectAdvert(ctx, published, publisher.DefaultInspectChunks))(t)
+		require.Empty(t, ai.Errors)
+		require.Equal(t, published.String(), ai.Link.String())
+		require.Nil(t, ai.PreviousID)
+		require.Equal(t, keyPeer.String(), ai.Provider)
+		require.Equal(t, []string{provider.Addrs[0].String()}, ai.Addresses)
+		require.Equal(t, contextID, ai.ContextID)
+		require.False(t, ai.IsRm)
+		require.False(t, ai.ExtendedProvider)
+		require.Len(t, ai.Protocols, 1)
+		require.Equal(t, claim, ai.Protocols[0].Protocol)
+		require.True(t, ai.SignatureValid())
+		require.Equal(t, publisher.InspectedEntries{EntriesReport: publisher.EntriesReport{Chunks: 3, Entries: 5, Bytes: ai.EntriesCount.Bytes}}, *ai.EntriesCount)
+	})
+
+	t.Run("counting entries stops at the chunk limit", func(t *testing.T) {
+		ai := testutil.Must(p.InspectAdvert(ctx, published, 2))(t)
+		require.True(t, ai.EntriesCount.Truncated)
+		require.Equal(t, 2, ai.EntriesCount.Chunks)
+		require.Less(t, ai.EntriesCount.Entries, 5)
+
+		ai = testutil.Must(p.InspectAdvert(ctx, published, 0))(t)
+		require.Nil(t, ai.EntriesCount)
+	})
+
+	t.Run("extended providers", func(t *testing.T) {
+		otherKey, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+		otherPeer := testutil.Must(peer.IDFromPrivateKey(otherKey))(t)
+		bitswap := testutil.Must((&ipnimd.Bitswap{}).MarshalBinary())(t)
+		adv := schema.Advertisement{
+			PreviousID: published,
+			Provider:   keyPeer.String(),
+			Addresses:  []string{provider.Addrs[0].String()},
+			Entries:    testutil.Must(publisher.PutEntries(ctx, ds, testutil.RandomMultihashes(3), 10))(t),
+			ContextID:  contextID,
+			Metadata:   claimBytes,
+			ExtendedProvider: &schema.ExtendedProvider{
+				Override: true,
+				Providers: []schema.Provider{
+					{ID: keyPeer.String(), Addresses: []string{provider.Addrs[0].String()}, Metadata: claimBytes},
+					{ID: otherPeer.String(), Addresses: []string{testutil.RandomMultiaddr().String()}, Metadata: append(bitswap, unknown...)},
+				},
+			},
+		}
+		require.NoError(t, adv.SignWithExtendedProviders(key, func(string) (crypto.PrivKey, error) { return otherKey, nil }))
+		link := store(t, adv)
+
+		ai := testutil.Must(p.InspectAdvert(ctx, link, publisher.DefaultInspectChunks))(t)
+		require.Empty(t, ai.Errors)
+		require.Equal(t, published.String(), ai.PreviousID.String())
+		require.True(t, ai.SignatureValid())
+		require.True(t, ai.ExtendedProvider)
+		require.True(t, ai.Override)
+		require.Len(t, ai.ExtendedProviders, 2)
+		require.Equal(t, claim, ai.ExtendedProviders[0].Protocols[0].Protocol)
+		other := ai.ExtendedProviders[1]
+		require.Equal(t, otherPeer.String(), other.ID)
+		require.Len(t, other.Protocols, 2)
+		require.Equal(t, multicodec.TransportBitswap, other.Protocols[0].Code)
+		require.ErrorIs(t, other.Protocols[1].Err, metadata.ErrUnknownProtocol)
+		require.Equal(t, unknown, other.Protocols[1].Raw)
+		require.Equal(t, 3, ai.EntriesCount.Entries)
+	})
+
+	t.Run("unknown metadata codes", func(t *testing.T) {
+		adv := schema.Advertisement{
+			Provider:  keyPeer.String(),
+			Addresses: []string{},
+			Entries:   schema.NoEntries,
+			ContextID: contextID,
+			Metadata:  append(claimBytes, unknown...),
+			IsRm:      true,
+		}
+		require.NoError(t, adv.Sign(key))
+		ai := testutil.Must(p.InspectAdvert(ctx, store(t, adv), publisher.DefaultInspectChunks))(t)
+		require.Empty(t, ai.Errors)
+		require.True(t, ai.IsRm)
+		require.True(t, ai.SignatureValid())
+		require.Len(t, ai.Protocols, 2)
+		require.Equal(t, claim, ai.Protocols[0].Protocol)
+		require.Equal(t, multicodec.Code(0x3f0000), ai.Protocols[1].Code)
+		require.Equal(t, unknown, ai.Protocols[1].Raw)
+		require.Zero(t, ai.EntriesCount.Entries)
+	})
+
+	t.Run("partially corrupt advertisements degrade field by field", func(t *testing.T) {
+		link := storeRaw(t, fmt.Sprintf(`{"Provider":%q,"Addresses":["/ip4/127.0.0.1/tcp/80",7],"Signature":{"/":{"bytes":""}},"Entries":"not a link","ContextID":{"/":{"bytes":"AQID"}},"Metadata":{"/":{"bytes":"gID8AQ"}},"IsRm":"no"}`, keyPeer))
+		ai := testutil.Must(p.InspectAdvert(ctx, link, publisher.DefaultInspectChunks))(t)
+		require.Equal(t, keyPeer.String(), ai.Provider)
+		require.Equal(t, []string{"/ip4/127.0.0.1/tcp/80"}, ai.Addresses)
+		require.Equal(t, []byte{1, 2, 3}, ai.ContextID)
+		require.Len(t, ai.Protocols, 1)
+		require.ErrorIs(t, ai.Protocols[0].Err, metadata.ErrUnknownProtocol)
+		require.Nil(t, ai.Entries)
+		require.Nil(t, ai.EntriesCount)
+		for _, field := range []string{"Addresses", "Entries", "IsRm"} {
+			require.Error(t, ai.Errors[field], field)
+		}
+		require.NotContains(t, ai.Errors, "Provider")
+		require.NotContains(t, ai.Errors, "Link")
+		require.Error(t, ai.SignatureErr)
+		require.False(t, ai.SignatureValid())
+	})
+
+	t.Run("undecodable advertisements", func(t *testing.T) {
+		ai := testutil.Must(p.InspectAdvert(ctx, storeRaw(t, `["not", "a", "map"]`), 0))(t)
+		require.Error(t, ai.Errors["Advertisement"])
+		require.False(t, ai.SignatureValid())
+	})
+
+	t.Run("blocks that don't match their CID", func(t *testing.T) {
+		data := testutil.Must(ds.Get(ctx, datastore.NewKey(published.String())))(t)
+		link := cidlink.Link{Cid: cid.NewCidV1(cid.DagJSON, testutil.RandomMultihash())}
+		require.NoError(t, ds.Put(ctx, datastore.NewKey(link.String()), data))
+		ai := testutil.Must(p.InspectAdvert(ctx, link, 0))(t)
+		require.Error(t, ai.Errors["Link"])
+		require.Equal(t, keyPeer.String(), ai.Provider)
+	})
+
+	t.Run("tampered advertisements fail verification", func(t *testing.T) {
+		adv := schema.Advertisement{Provider: keyPeer.String(), Addresses: []string{}, Entries: schema.NoEntries, ContextID: contextID, Metadata: claimBytes}
+		require.NoError(t, adv.Sign(key))
+		// the signature covers the metadata, not the context ID
+		adv.Metadata = append(adv.Metadata, unknown...)
+		ai := testutil.Must(p.InspectAdvert(ctx, store(t, adv), 0))(t)
+		require.Empty(t, ai.Errors)
+		require.Error(t, ai.SignatureErr)
+		require.False(t, ai.SignatureValid())
+	})
+
+	t.Run("missing advertisements", func(t *testing.T) {
+		_, err := p.InspectAdvert(ctx, testutil.RandomCID(), 0)
+		require.ErrorIs(t, err, publisher.ErrAdvertNotFound)
+	})
+}
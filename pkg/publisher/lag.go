@@ -0,0 +1,384 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/apierror"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// DefaultLagCheckInterval is how often indexers are checked for how far
+	// behind the head of the chain they are
+	DefaultLagCheckInterval = 5 * time.Minute
+	// DefaultMaxLag is the number of advertisements an indexer may be behind the
+	// head of the chain before it is lagging
+	DefaultMaxLag = 100
+	// DefaultMaxLagWalk is the number of advertisements walked back from the head
+	// looking for the last one an indexer ingested
+	DefaultMaxLagWalk = 10_000
+)
+
+type (
+	// LagOption configures a LagMonitor
+	LagOption func(*lagConfig)
+
+	lagConfig struct {
+		interval time.Duration
+		maxLag   int
+		maxWalk  int
+		onAlert  func(IndexerLag)
+	}
+
+	// ProviderInfoFinder reads what an indexer knows of a provider
+	ProviderInfoFinder interface {
+		GetProvider(ctx context.Context, provider peer.ID) (*model.ProviderInfo, error)
+	}
+
+	// LagEndpoint is an indexer whose ingestion of the chain is checked
+	LagEndpoint struct {
+		Name   string
+		Finder ProviderInfoFinder
+	}
+
+	// IndexerLag is how far behind the head of the chain an indexer was when it
+	// was last checked
+	IndexerLag struct {
+		Name string
+		// Head is the head of the chain when the indexer was checked
+		Head cid.Cid
+		// LastAdvertisement is the last advertisement the indexer ingested,
+		// undefined if it has ingested none
+		LastAdvertisement cid.Cid
+		// Lag is the number of advertisements between LastAdvertisement and Head.
+		// If Exact is false, LastAdvertisement wasn't found in the part of the
+		// chain walked, and Lag is the number of advertisements walked, so the
+		// indexer is at least that far behind
+		Lag   int
+		Exact bool
+		// IngestError is the ingestion error the indexer reports for the chain,
+		// if it occurred since it last ingested an advertisement
+		IngestError string
+		// CheckError is why the indexer could not be checked. The lag of the
+		// check before is kept
+		CheckError string
+		// Lagging is true when the indexer is more than the maximum lag behind,
+		// or reports an ingestion error
+		Lagging bool
+		Checked time.Time
+	}
+
+	// LagMonitor periodically asks indexers for the last advertisement of the
+	// provider they ingested, and works out how far behind the head of the
+	// chain they are. An alert is raised when an indexer starts lagging.
+	//
+	// Distances from the head are remembered as the chain is walked, so checks
+	// while the head stays the same don't walk it again, and after the head moves
+	// only the advertisements published since are walked
+	LagMonitor struct {
+		*lagConfig
+		publisher *Publisher
+		provider  peer.ID
+		endpoints []LagEndpoint
+		lk        sync.Mutex
+		lags      map[string]IndexerLag
+		walk      chainWalk
+		closing   chan struct{}
+		closed    sync.WaitGroup
+	}
+
+	// chainWalk is the part of the chain walked back from head, with the
+	// distance of each advertisement from it
+	chainWalk struct {
+		head     cid.Cid
+		distance map[cid.Cid]int
+		// next is the advertisement the walk continues from, nil at the end of
+		// the chain
+		next ipld.Link
+	}
+)
+
+// WithLagCheckInterval sets how often indexers are checked. If not set,
+// DefaultLagCheckInterval is used
+func WithLagCheckInterval(interval time.Duration) LagOption {
+	return func(c *lagConfig) {
+		c.interval = interval
+	}
+}
+
+// WithMaxLag sets the number of advertisements an indexer may be behind the
+// head before it is lagging. If not set, DefaultMaxLag is used
+func WithMaxLag(advertisements int) LagOption {
+	return func(c *lagConfig) {
+		c.maxLag = advertisements
+	}
+}
+
+// WithMaxLagWalk sets the number of advertisements walked back from the head
+// looking for the last one an indexer ingested. If not set, DefaultMaxLagWalk
+// is used
+func WithMaxLagWalk(advertisements int) LagOption {
+	return func(c *lagConfig) {
+		c.maxWalk = advertisements
+	}
+}
+
+// WithLagAlert is called with the lag of an indexer when it starts lagging, or
+// starts lagging for a different reason
+func WithLagAlert(onAlert func(IndexerLag)) LagOption {
+	return func(c *lagConfig) {
+		c.onAlert = onAlert
+	}
+}
+
+// NewLagMonitor returns a monitor checking how far behind the head of the
+// publisher's chain the indexers are in ingesting it for the provider
+func NewLagMonitor(p *Publisher, provider peer.ID, endpoints []LagEndpoint, opts ...LagOption) *LagMonitor {
+	c := &lagConfig{
+		interval: DefaultLagCheckInterval,
+		maxLag:   DefaultMaxLag,
+		maxWalk:  DefaultMaxLagWalk,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return &LagMonitor{
+		lagConfig: c,
+		publisher: p,
+		provider:  provider,
+		endpoints: endpoints,
+		lags:      map[string]IndexerLag{},
+		closing:   make(chan struct{}),
+	}
+}
+
+// Check checks every indexer once, returning their lags in the order the
+// indexers were given
+func (m *LagMonitor) Check(ctx context.Context) ([]IndexerLag, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	head, err := m.publisher.Head(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading chain head: %w", err)
+	}
+	lags := make([]IndexerLag, 0, len(m.endpoints))
+	for _, e := range m.endpoints {
+		lag, err := m.check(ctx, e, head)
+		if err != nil {
+			log.Warnw("checking indexer lag", "indexer", e.Name, "error", err)
+			lag = m.lags[e.Name]
+			lag.Name = e.Name
+			lag.CheckError = err.Error()
+			lag.Checked = time.Now().UTC()
+		}
+		previous, checked := m.lags[e.Name]
+		m.lags[e.Name] = lag
+		lags = append(lags, lag)
+		if lag.Lagging && (!checked || !previous.Lagging || previous.IngestError != lag.IngestError) {
+			log.Errorw("indexer is lagging", "indexer", e.Name, "lag", lag.Lag, "ingestError", lag.IngestError)
+			if m.onAlert != nil {
+				m.onAlert(lag)
+			}
+		}
+	}
+	return lags, nil
+}
+
+// check works out the lag of an indexer
+func (m *LagMonitor) check(ctx context.Context, e LagEndpoint, head ipld.Link) (IndexerLag, error) {
+	info, err := m.providerInfo(ctx, e)
+	if err != nil {
+		return IndexerLag{}, err
+	}
+	lag := IndexerLag{Name: e.Name, LastAdvertisement: info.LastAdvertisement, Checked: time.Now().UTC()}
+	if head != nil {
+		lag.Head = head.(cidlink.Link).Cid
+		lag.Lag, lag.Exact, err = m.distance(ctx, lag.Head, info.LastAdvertisement)
+		if err != nil {
+			return IndexerLag{}, err
+		}
+	} else {
+		lag.Exact = !info.LastAdvertisement.Defined()
+	}
+	if ingestErrorSince(info) {
+		lag.IngestError = info.LastError
+	}
+	lag.Lagging = lag.Lag > m.maxLag || lag.IngestError != ""
+	return lag, nil
+}
+
+// providerInfo reads what the indexer knows of the provider, which is nothing
+// if it never ingested the chain
+func (m *LagMonitor) providerInfo(ctx context.Context, e LagEndpoint) (*model.ProviderInfo, error) {
+	info, err := e.Finder.GetProvider(ctx, m.provider)
+	var apiErr *apierror.Error
+	if errors.As(err, &apiErr) && apiErr.Status() == http.StatusNotFound {
+		// an indexer that never ingested the chain doesn't know the provider
+		info, err = &model.ProviderInfo{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading provider info: %w", err)
+	}
+	if info == nil {
+		info = &model.ProviderInfo{}
+	}
+	return info, nil
+}
+
+// ingestErrorSince returns true if the indexer reports an ingestion error that
+// occurred since it last ingested an advertisement. An error whose time can't
+// be compared counts
+func ingestErrorSince(info *model.ProviderInfo) bool {
+	if info.LastError == "" {
+		return false
+	}
+	errorTime, err := time.Parse(time.RFC3339Nano, info.LastErrorTime)
+	if err != nil {
+		return true
+	}
+	advertTime, err := time.Parse(time.RFC3339Nano, info.LastAdvertisementTime)
+	if err != nil {
+		return true
+	}
+	return !errorTime.Before(advertTime)
+}
+
+// distance returns the number of advertisements from the head to the target,
+// walking the chain as far as is needed and not walked before, and whether it
+// is exact. If the target isn't found within the walk limit, the number walked
+// is returned. An undefined target is the end of the chain
+func (m *LagMonitor) distance(ctx context.Context, head cid.Cid, target cid.Cid) (int, bool, error) {
+	if err := m.moveHead(ctx, head); err != nil {
+		return 0, false, err
+	}
+	w := &m.walk
+	for {
+		if d, ok := w.distance[target]; ok {
+			return d, true, nil
+		}
+		if w.next == nil || len(w.distance) >= m.maxWalk {
+			return len(w.distance), w.next == nil && !target.Defined(), nil
+		}
+		adv, err := m.publisher.advertisement(ctx, w.next)
+		if err != nil {
+			return 0, false, err
+		}
+		w.distance[w.next.(cidlink.Link).Cid] = len(w.distance)
+		w.next = adv.PreviousID
+	}
+}
+
+// moveHead starts the walk from a new head. The advertisements published since
+// the old head are walked, and the distances already worked out shifted by
+// their number. If the old head isn't found within the walk limit, the walk
+// starts over
+func (m *LagMonitor) moveHead(ctx context.Context, head cid.Cid) error {
+	w := &m.walk
+	if w.head == head {
+		return nil
+	}
+	fresh := chainWalk{head: head, distance: map[cid.Cid]int{}, next: cidlink.Link{Cid: head}}
+	if w.head.Defined() {
+		var added []cid.Cid
+		for link := ipld.Link(cidlink.Link{Cid: head}); link != nil && len(added)+len(w.distance) < m.maxWalk; {
+			c := link.(cidlink.Link).Cid
+			if c == w.head {
+				n := len(added)
+				for prev, d := range w.distance {
+					fresh.distance[prev] = d + n
+				}
+				for i, c := range added {
+					fresh.distance[c] = i
+				}
+				fresh.next = w.next
+				break
+			}
+			adv, err := m.publisher.advertisement(ctx, link)
+			if err != nil {
+				return err
+			}
+			added = append(added, c)
+			link = adv.PreviousID
+		}
+	}
+	m.walk = fresh
+	return nil
+}
+
+// Lags returns the lag of every indexer as of its last check
+func (m *LagMonitor) Lags() []IndexerLag {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	lags := make([]IndexerLag, 0, len(m.endpoints))
+	for _, e := range m.endpoints {
+		if lag, ok := m.lags[e.Name]; ok {
+			lags = append(lags, lag)
+		}
+	}
+	return lags
+}
+
+// Lagging returns true if any indexer was lagging when last checked
+func (m *LagMonitor) Lagging() bool {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	for _, lag := range m.lags {
+		if lag.Lagging {
+			return true
+		}
+	}
+	return false
+}
+
+// Startup checks the indexers in the background every check interval, starting
+// straight away (returns immediately). They are checked for divergence from the
+// chain once first, which is logged but never repaired
+func (m *LagMonitor) Startup() {
+	m.closed.Add(1)
+	go func() {
+		defer m.closed.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), m.interval)
+		m.logDivergence(ctx)
+		cancel()
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), m.interval)
+			if _, err := m.Check(ctx); err != nil {
+				log.Errorw("checking indexer lag", "error", err)
+			}
+			cancel()
+			select {
+			case <-m.closing:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Shutdown stops checking, returning when the check in progress finishes or
+// the passed context cancels
+func (m *LagMonitor) Shutdown(ctx context.Context) error {
+	close(m.closing)
+	closed := make(chan struct{})
+	go func() {
+		m.closed.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
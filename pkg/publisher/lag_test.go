@@ -0,0 +1,212 @@
+package publisher_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	ipnifind "github.com/ipni/go-libipni/find/client"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeIndexer serves the provider info of a single provider, or fails
+type fakeIndexer struct {
+	lk       sync.Mutex
+	provider peer.ID
+	info     *model.ProviderInfo
+	failing  bool
+}
+
+func (f *fakeIndexer) set(info *model.ProviderInfo, failing bool) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	f.info = info
+	f.failing = failing
+}
+
+func (f *fakeIndexer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	if f.failing {
+		http.Error(w, "indexer unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Path != "/providers/"+f.provider.String() || f.info == nil {
+		http.NotFound(w, r)
+		return
+	}
+	info := *f.info
+	info.AddrInfo = peer.AddrInfo{ID: f.provider}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// countingDatastore counts the advertisements read from it
+type countingDatastore struct {
+	datastore.Batching
+	lk    sync.Mutex
+	reads int
+}
+
+func (c *countingDatastore) Get(ctx context.Context, key datastore.Key) ([]byte, error) {
+	if _, err := cid.Decode(key.BaseNamespace()); err == nil {
+		c.lk.Lock()
+		c.reads++
+		c.lk.Unlock()
+	}
+	return c.Batching.Get(ctx, key)
+}
+
+func (c *countingDatastore) advertReads() int {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.reads
+}
+
+func TestLagMonitor(t *testing.T) {
+	ctx := context.Background()
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	provider := peer.AddrInfo{ID: testutil.RandomPeer()}
+	ds := &countingDatastore{Batching: dssync.MutexWrap(datastore.NewMapDatastore())}
+	p := publisher.New(ds, key)
+	var chain []cid.Cid
+	publish := func(t *testing.T) {
+		link := testutil.Must(p.Publish(ctx, provider, testutil.RandomBytes(10), testutil.RandomBytes(10), testutil.RandomMultihashes(1)))(t)
+		chain = append(chain, link.(cidlink.Link).Cid)
+	}
+	for range 5 {
+		publish(t)
+	}
+
+	inSync, lagging, erroring := &fakeIndexer{provider: provider.ID}, &fakeIndexer{provider: provider.ID}, &fakeIndexer{provider: provider.ID}
+	var endpoints []publisher.LagEndpoint
+	for name, indexer := range map[string]*fakeIndexer{"in-sync": inSync, "lagging": lagging, "erroring": erroring} {
+		srv := httptest.NewServer(indexer)
+		t.Cleanup(srv.Close)
+		endpoints = append(endpoints, publisher.LagEndpoint{Name: name, Finder: testutil.Must(ipnifind.New(srv.URL))(t)})
+	}
+	var alertsLk sync.Mutex
+	var alerts []publisher.IndexerLag
+	m := publisher.NewLagMonitor(p, provider.ID, endpoints, publisher.WithMaxLag(2), publisher.WithLagAlert(func(lag publisher.IndexerLag) {
+		alertsLk.Lock()
+		defer alertsLk.Unlock()
+		alerts = append(alerts, lag)
+	}))
+	check := func(t *testing.T) map[string]publisher.IndexerLag {
+		lags := map[string]publisher.IndexerLag{}
+		for _, lag := range testutil.Must(m.Check(ctx))(t) {
+			lags[lag.Name] = lag
+		}
+		return lags
+	}
+	alerted := func() []string {
+		alertsLk.Lock()
+		defer alertsLk.Unlock()
+		var names []string
+		for _, lag := range alerts {
+			names = append(names, lag.Name)
+		}
+		return names
+	}
+
+	advertised := time.Now().UTC()
+	inSync.set(&model.ProviderInfo{LastAdvertisement: chain[4], LastAdvertisementTime: advertised.Format(time.RFC3339)}, false)
+	lagging.set(&model.ProviderInfo{LastAdvertisement: chain[1], LastAdvertisementTime: advertised.Format(time.RFC3339)}, false)
+	erroring.set(&model.ProviderInfo{
+		LastAdvertisement:     chain[4],
+		LastAdvertisementTime: advertised.Format(time.RFC3339),
+		LastError:             "failed to sync: signature mismatch",
+		LastErrorTime:         advertised.Add(time.Minute).Format(time.RFC3339),
+	}, false)
+
+	lags := check(t)
+	require.Equal(t, 0, lags["in-sync"].Lag)
+	require.True(t, lags["in-sync"].Exact)
+	require.False(t, lags["in-sync"].Lagging)
+	require.Equal(t, chain[4], lags["in-sync"].Head)
+
+	require.Equal(t, 3, lags["lagging"].Lag)
+	require.True(t, lags["lagging"].Lagging)
+
+	require.Equal(t, 0, lags["erroring"].Lag)
+	require.Equal(t, "failed to sync: signature mismatch", lags["erroring"].IngestError)
+	require.True(t, lags["erroring"].Lagging)
+
+	require.ElementsMatch(t, []string{"lagging", "erroring"}, alerted())
+	require.True(t, m.Lagging())
+	require.Len(t, m.Lags(), 3)
+
+	t.Run("lagging indexers are only alerted on once", func(t *testing.T) {
+		check(t)
+		require.Len(t, alerted(), 2)
+	})
+
+	t.Run("the chain is not walked again for the same head", func(t *testing.T) {
+		reads := ds.advertReads()
+		check(t)
+		require.Equal(t, reads, ds.advertReads())
+
+		// once the head moves, only the new advertisement is read
+		publish(t)
+		reads = ds.advertReads()
+		lags := check(t)
+		require.Equal(t, 1, lags["in-sync"].Lag)
+		require.Equal(t, 4, lags["lagging"].Lag)
+		require.Equal(t, reads+1, ds.advertReads())
+	})
+
+	t.Run("errors before the last ingested advertisement are old", func(t *testing.T) {
+		erroring.set(&model.ProviderInfo{
+			LastAdvertisement:     chain[5],
+			LastAdvertisementTime: advertised.Add(time.Hour).Format(time.RFC3339),
+			LastError:             "failed to sync: signature mismatch",
+			LastErrorTime:         advertised.Add(time.Minute).Format(time.RFC3339),
+		}, false)
+		lag := check(t)["erroring"]
+		require.Empty(t, lag.IngestError)
+		require.False(t, lag.Lagging)
+	})
+
+	t.Run("indexers that can't be checked keep their last lag", func(t *testing.T) {
+		lagging.set(nil, true)
+		lag := check(t)["lagging"]
+		require.NotEmpty(t, lag.CheckError)
+		require.Equal(t, 4, lag.Lag)
+		require.True(t, lag.Lagging)
+	})
+
+	t.Run("indexers that don't know the provider are behind by the whole chain", func(t *testing.T) {
+		lagging.set(nil, false)
+		lag := check(t)["lagging"]
+		require.Empty(t, lag.CheckError)
+		require.Equal(t, len(chain), lag.Lag)
+		require.True(t, lag.Exact)
+		require.False(t, lag.LastAdvertisement.Defined())
+	})
+
+	t.Run("last advertisements beyond the walk limit are a lower bound", func(t *testing.T) {
+		limited := publisher.NewLagMonitor(p, provider.ID, endpoints, publisher.WithMaxLagWalk(2))
+		lagging.set(&model.ProviderInfo{LastAdvertisement: chain[0]}, false)
+		lags := map[string]publisher.IndexerLag{}
+		for _, lag := range testutil.Must(limited.Check(ctx))(t) {
+			lags[lag.Name] = lag
+		}
+		require.Equal(t, 2, lags["lagging"].Lag)
+		require.False(t, lags["lagging"].Exact)
+		require.Equal(t, 1, lags["in-sync"].Lag)
+		require.True(t, lags["in-sync"].Exact)
+	})
+}
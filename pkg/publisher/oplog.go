@@ -0,0 +1,271 @@
+package publisher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"strconv"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var (
+	opPrefix        = datastore.NewKey("oplog/ops")
+	opSeqKey        = datastore.NewKey("oplog/seq")
+	namespacePrefix = datastore.NewKey("oplog/namespaces")
+)
+
+// OpKind is the kind of state-mutating operation recorded in the operation log
+type OpKind string
+
+const (
+	// OpPublish is an advertisement for a provider's records
+	OpPublish OpKind = "publish"
+	// OpRemove is a removal advertisement for a provider's records
+	OpRemove OpKind = "remove"
+	// OpCache is a claim cached without being advertised
+	OpCache OpKind = "cache"
+)
+
+// Operation is a state-mutating operation recorded in the operation log, with
+// the inputs needed to apply it again
+type Operation struct {
+	// Seq is the position of the operation in the log, from 1. Operations
+	// recorded at once by publishers sharing a datastore may share a position,
+	// in which case they are ordered by their digests
+	Seq  uint64
+	Kind OpKind
+	// Claim is the CID of the claim the operation is for, if any
+	Claim cid.Cid
+	// Archive is the archived claim, for operations on claims that aren't
+	// advertised and so can't be fetched from their provider again
+	Archive []byte
+	// Provider is the provider the operation is on behalf of, if any
+	Provider peer.ID
+	// Addrs are the addresses of the provider, as advertised
+	Addrs []string
+	// ContextID and Metadata are those of the advertisement, for publishes
+	// and removals
+	ContextID []byte
+	Metadata  []byte
+	// Advert is the link to the advertisement, for publishes and removals
+	Advert cid.Cid
+	// At is when the operation was recorded
+	At time.Time
+}
+
+type storedOperation struct {
+	Seq       uint64    `json:"seq"`
+	Kind      OpKind    `json:"kind"`
+	Claim     string    `json:"claim,omitempty"`
+	Archive   []byte    `json:"archive,omitempty"`
+	Provider  string    `json:"provider,omitempty"`
+	Addrs     []string  `json:"addrs,omitempty"`
+	ContextID []byte    `json:"contextID,omitempty"`
+	Metadata  []byte    `json:"metadata,omitempty"`
+	Advert    string    `json:"advert,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+func encodeOperation(op Operation) ([]byte, error) {
+	stored := storedOperation{
+		Seq:       op.Seq,
+		Kind:      op.Kind,
+		Archive:   op.Archive,
+		Addrs:     op.Addrs,
+		ContextID: op.ContextID,
+		Metadata:  op.Metadata,
+		At:        op.At,
+	}
+	if op.Claim.Defined() {
+		stored.Claim = op.Claim.String()
+	}
+	if op.Provider != "" {
+		stored.Provider = op.Provider.String()
+	}
+	if op.Advert.Defined() {
+		stored.Advert = op.Advert.String()
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return nil, fmt.Errorf("encoding operation: %w", err)
+	}
+	return data, nil
+}
+
+func decodeOperation(data []byte) (Operation, error) {
+	var stored storedOperation
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return Operation{}, fmt.Errorf("decoding operation: %w", err)
+	}
+	op := Operation{
+		Seq:       stored.Seq,
+		Kind:      stored.Kind,
+		Archive:   stored.Archive,
+		Addrs:     stored.Addrs,
+		ContextID: stored.ContextID,
+		Metadata:  stored.Metadata,
+		At:        stored.At,
+	}
+	var err error
+	if stored.Claim != "" {
+		if op.Claim, err = cid.Decode(stored.Claim); err != nil {
+			return Operation{}, fmt.Errorf("decoding operation claim: %w", err)
+		}
+	}
+	if stored.Provider != "" {
+		if op.Provider, err = peer.Decode(stored.Provider); err != nil {
+			return Operation{}, fmt.Errorf("decoding operation provider: %w", err)
+		}
+	}
+	if stored.Advert != "" {
+		if op.Advert, err = cid.Decode(stored.Advert); err != nil {
+			return Operation{}, fmt.Errorf("decoding operation advertisement: %w", err)
+		}
+	}
+	return op, nil
+}
+
+// putOperation writes the operation as the next in the log, in the given batch
+// so that it is recorded along with its effect or not at all
+func (p *Publisher) putOperation(ctx context.Context, w datastore.Write, op Operation) error {
+	seq, err := p.opSeq(ctx)
+	if err != nil {
+		return err
+	}
+	op.Seq = seq + 1
+	return writeOperation(ctx, w, op)
+}
+
+// writeOperation writes the operation at its position in the log, moving the
+// position of the log to it
+func writeOperation(ctx context.Context, w datastore.Write, op Operation) error {
+	if op.At.IsZero() {
+		op.At = time.Now().UTC()
+	}
+	data, err := encodeOperation(op)
+	if err != nil {
+		return err
+	}
+	if err := w.Put(ctx, operationKey(op.Seq, data), data); err != nil {
+		return err
+	}
+	return w.Put(ctx, opSeqKey, binary.BigEndian.AppendUint64(nil, op.Seq))
+}
+
+// operationKey orders operations by position, then by digest, so that those
+// given the same position by publishers sharing the datastore are all kept
+func operationKey(seq uint64, data []byte) datastore.Key {
+	digest := sha256.Sum256(data)
+	return opPrefix.ChildString(fmt.Sprintf("%020d-%s", seq, hex.EncodeToString(digest[:8])))
+}
+
+func (p *Publisher) opSeq(ctx context.Context) (uint64, error) {
+	data, err := p.ds.Get(ctx, opSeqKey)
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("reading operation log position: %w", err)
+	}
+	if len(data) != 8 {
+		return 0, fmt.Errorf("decoding operation log position: %d bytes", len(data))
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+// RecordOperation appends an operation that has no advertisement to the
+// operation log. Publishes and removals are recorded with the advertisements
+// they write, in the same batch
+func (p *Publisher) RecordOperation(ctx context.Context, op Operation) error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	batch, err := p.ds.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	if err := p.putOperation(ctx, batch, op); err != nil {
+		return err
+	}
+	if err := batch.Commit(ctx); err != nil {
+		return fmt.Errorf("writing operation: %w", err)
+	}
+	return nil
+}
+
+// Operations iterates the operation log from the first operation recorded
+func (p *Publisher) Operations(ctx context.Context) iter.Seq2[Operation, error] {
+	return func(yield func(Operation, error) bool) {
+		results, err := p.ds.Query(ctx, query.Query{Prefix: opPrefix.String(), Orders: []query.Order{query.OrderByKey{}}})
+		if err != nil {
+			yield(Operation{}, fmt.Errorf("querying operation log: %w", err))
+			return
+		}
+		defer results.Close()
+		for r := range results.Next() {
+			if r.Error != nil {
+				yield(Operation{}, fmt.Errorf("reading operation log: %w", r.Error))
+				return
+			}
+			op, err := decodeOperation(r.Value)
+			if !yield(op, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// ActiveNamespace returns the namespace a derived store was last rebuilt into,
+// or "" if it has never been rebuilt
+func (p *Publisher) ActiveNamespace(ctx context.Context, store string) (string, error) {
+	data, err := p.ds.Get(ctx, namespacePrefix.ChildString(store))
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return "", nil
+		}
+		return "", fmt.Errorf("reading namespace of %s: %w", store, err)
+	}
+	return string(data), nil
+}
+
+// NextNamespace returns a namespace a derived store has never been rebuilt
+// into, so that a rebuild starts from an empty store even if an earlier one
+// was abandoned part way
+func (p *Publisher) NextNamespace(ctx context.Context, store string) (string, error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	key := namespacePrefix.ChildString(store).ChildString("generation")
+	var generation uint64
+	data, err := p.ds.Get(ctx, key)
+	switch {
+	case errors.Is(err, datastore.ErrNotFound):
+	case err != nil:
+		return "", fmt.Errorf("reading namespace generation of %s: %w", store, err)
+	case len(data) != 8:
+		return "", fmt.Errorf("decoding namespace generation of %s: %d bytes", store, len(data))
+	default:
+		generation = binary.BigEndian.Uint64(data)
+	}
+	generation++
+	if err := p.ds.Put(ctx, key, binary.BigEndian.AppendUint64(nil, generation)); err != nil {
+		return "", fmt.Errorf("writing namespace generation of %s: %w", store, err)
+	}
+	return strconv.FormatUint(generation, 10), nil
+}
+
+// SetActiveNamespace records the namespace a derived store was rebuilt into
+func (p *Publisher) SetActiveNamespace(ctx context.Context, store string, namespace string) error {
+	if err := p.ds.Put(ctx, namespacePrefix.ChildString(store), []byte(namespace)); err != nil {
+		return fmt.Errorf("writing namespace of %s: %w", store, err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package publisher_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/stretchr/testify/require"
+)
+
+// failingCommits is a datastore whose batches fail to commit once failing is
+// set
+type failingCommits struct {
+	datastore.Batching
+	failing bool
+}
+
+type failingBatch struct {
+	datastore.Batch
+}
+
+func (failingBatch) Commit(context.Context) error {
+	return errors.New("commit failed")
+}
+
+func (f *failingCommits) Batch(ctx context.Context) (datastore.Batch, error) {
+	b, err := f.Batching.Batch(ctx)
+	if err != nil || !f.failing {
+		return b, err
+	}
+	return failingBatch{b}, nil
+}
+
+func TestPublisher__Operations(t *testing.T) {
+	ctx := context.Background()
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	ds := &failingCommits{Batching: dssync.MutexWrap(datastore.NewMapDatastore())}
+	p := publisher.New(ds, key)
+	provider := peer.AddrInfo{ID: testutil.RandomPeer(), Addrs: []multiaddr.Multiaddr{testutil.Must(multiaddr.NewMultiaddr("/dns/example.com/tcp/443/https"))(t)}}
+	operations := func(t *testing.T) []publisher.Operation {
+		var ops []publisher.Operation
+		for op, err := range p.Operations(ctx) {
+			require.NoError(t, err)
+			ops = append(ops, op)
+		}
+		return ops
+	}
+
+	contextID, metadata := testutil.RandomBytes(10), testutil.RandomBytes(10)
+	published := testutil.Must(p.Publish(ctx, provider, contextID, metadata, testutil.RandomMultihashes(2)))(t)
+	claim := testutil.RandomLocationDelegation()
+	archive := testutil.Must(io.ReadAll(claim.Archive()))(t)
+	require.NoError(t, p.RecordOperation(ctx, publisher.Operation{Kind: publisher.OpCache, Claim: claim.Link().(cidlink.Link).Cid, Archive: archive}))
+	// publishing the same advertisement again writes nothing, so records nothing
+	testutil.Must(p.Publish(ctx, provider, contextID, metadata, testutil.RandomMultihashes(2)))(t)
+	removed := testutil.Must(p.Remove(ctx, provider, contextID))(t)
+
+	ops := operations(t)
+	require.Len(t, ops, 4)
+	for i, op := range ops {
+		require.Equal(t, uint64(i+1), op.Seq)
+		require.False(t, op.At.IsZero())
+	}
+	require.Equal(t, publisher.OpPublish, ops[0].Kind)
+	require.Equal(t, provider.ID, ops[0].Provider)
+	require.Equal(t, []string{provider.Addrs[0].String()}, ops[0].Addrs)
+	require.Equal(t, contextID, ops[0].ContextID)
+	require.Equal(t, metadata, ops[0].Metadata)
+	require.Equal(t, published.(cidlink.Link).Cid, ops[0].Advert)
+	require.Equal(t, publisher.OpCache, ops[1].Kind)
+	require.Equal(t, claim.Link().(cidlink.Link).Cid, ops[1].Claim)
+	require.Equal(t, archive, ops[1].Archive)
+	require.Equal(t, publisher.OpPublish, ops[2].Kind)
+	require.Equal(t, publisher.OpRemove, ops[3].Kind)
+	require.Equal(t, removed.(cidlink.Link).Cid, ops[3].Advert)
+
+	t.Run("operations are written with their effect or not at all", func(t *testing.T) {
+		head := testutil.Must(p.Head(ctx))(t)
+		ds.failing = true
+		defer func() { ds.failing = false }()
+		_, err := p.Publish(ctx, provider, testutil.RandomBytes(10), metadata, testutil.RandomMultihashes(2))
+		require.Error(t, err)
+		require.Error(t, p.RecordOperation(ctx, publisher.Operation{Kind: publisher.OpCache, Claim: claim.Link().(cidlink.Link).Cid, Archive: archive}))
+		require.Equal(t, head, testutil.Must(p.Head(ctx))(t))
+		require.Len(t, operations(t), 4)
+	})
+
+	t.Run("namespaces", func(t *testing.T) {
+		require.Empty(t, testutil.Must(p.ActiveNamespace(ctx, "store"))(t))
+		first := testutil.Must(p.NextNamespace(ctx, "store"))(t)
+		// a namespace is never handed out twice, even if it is never activated
+		second := testutil.Must(p.NextNamespace(ctx, "store"))(t)
+		require.NotEqual(t, first, second)
+		require.NoError(t, p.SetActiveNamespace(ctx, "store", second))
+		require.Equal(t, second, testutil.Must(p.ActiveNamespace(ctx, "store"))(t))
+		require.Empty(t, testutil.Must(p.ActiveNamespace(ctx, "other"))(t))
+		require.Equal(t, first, testutil.Must(p.NextNamespace(ctx, "other"))(t))
+	})
+}
@@ -0,0 +1,282 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/ingest/schema"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// DefaultRecentAdverts is the number of most recent advertisement summaries
+// included in a chain summary
+const DefaultRecentAdverts = 10
+
+// maxPublishAttempts bounds how many times writing an advertisement is retried
+// after another publisher sharing the datastore moved the head first
+const maxPublishAttempts = 10
+
+var headKey = datastore.NewKey("head")
+
+// ErrConditionFailed is returned from committing a conditional batch when the
+// key it is conditional on no longer holds the expected value
+var ErrConditionFailed = errors.New("condition failed")
+
+// ConditionalDatastore is implemented by datastores that can be shared by
+// several publishers at once. The head of the chain is moved with a batch that
+// only commits if no other publisher moved it first, otherwise the
+// advertisement is written again on top of the new head
+type ConditionalDatastore interface {
+	// BatchIf returns a batch that only commits if the key still holds the
+	// expected value, or doesn't exist if the expected value is nil. Otherwise
+	// Commit returns ErrConditionFailed and nothing in the batch is written
+	BatchIf(ctx context.Context, key datastore.Key, expected []byte) (datastore.Batch, error)
+}
+
+type (
+	// Option configures a Publisher
+	Option func(*Publisher)
+
+	// Publisher writes signed IPNI advertisements, and the entries chunks they
+	// link to, to the head of a chain in a datastore. It keeps a summary of the
+	// chain as it goes
+	Publisher struct {
+		ds            datastore.Batching
+		key           crypto.PrivKey
+		chunkSize     int
+		recentAdverts int
+		// indexThreshold and scanLimit are in entries
+		indexThreshold int
+		scanLimit      int
+		now            func() time.Time
+		advertised     *advertisedFilter
+		lk             sync.Mutex
+	}
+)
+
+// WithEntriesChunkSize sets the maximum number of multihashes in a single
+// entries chunk. If not set, DefaultEntriesChunkSize is used
+func WithEntriesChunkSize(size int) Option {
+	return func(p *Publisher) {
+		p.chunkSize = size
+	}
+}
+
+// WithRecentAdverts sets the number of most recent advertisement summaries
+// included in a chain summary. If not set, DefaultRecentAdverts is used
+func WithRecentAdverts(n int) Option {
+	return func(p *Publisher) {
+		p.recentAdverts = n
+	}
+}
+
+// WithClock sets the source of the time advertisements are published at
+func WithClock(now func() time.Time) Option {
+	return func(p *Publisher) {
+		p.now = now
+	}
+}
+
+// New returns a publisher that writes to the given datastore, signing
+// advertisements with the given key
+func New(ds datastore.Batching, key crypto.PrivKey, opts ...Option) *Publisher {
+	p := &Publisher{
+		ds:             ds,
+		key:            key,
+		chunkSize:      DefaultEntriesChunkSize,
+		recentAdverts:  DefaultRecentAdverts,
+		indexThreshold: DefaultEntriesIndexThreshold,
+		now:            time.Now,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.scanLimit == 0 {
+		p.scanLimit = p.indexThreshold
+	}
+	return p
+}
+
+// Head returns the link to the most recently published advertisement, or nil if
+// nothing has been published
+func (p *Publisher) Head(ctx context.Context) (ipld.Link, error) {
+	head, _, err := p.head(ctx)
+	return head, err
+}
+
+// head returns the head along with the value it is stored as, which is nil if
+// nothing has been published
+func (p *Publisher) head(ctx context.Context) (ipld.Link, []byte, error) {
+	data, err := p.ds.Get(ctx, headKey)
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("reading head: %w", err)
+	}
+	c, err := cid.Cast(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding head: %w", err)
+	}
+	return cidlink.Link{Cid: c}, data, nil
+}
+
+// headBatch returns a batch for moving the head from its current value. If the
+// datastore is shared, the batch only commits if the head hasn't moved since
+func (p *Publisher) headBatch(ctx context.Context, current []byte) (datastore.Batch, error) {
+	if cds, ok := p.ds.(ConditionalDatastore); ok {
+		return cds.BatchIf(ctx, headKey, current)
+	}
+	return p.ds.Batch(ctx)
+}
+
+// Publish writes the multihashes as an entries chain, then an advertisement for
+// them on behalf of the provider to the head of the chain. The advertisement,
+// the new head, the updated chain summary and the operation log entry for the
+// publish, and the advertisement's place on the timeline of the chain are
+// written together.
+//
+// Publishing is idempotent: if an advertisement with the same provider, context
+// ID, metadata and entries was already published, its link is returned and
+// nothing is written, unless ForceRepublish is given
+func (p *Publisher) Publish(ctx context.Context, provider peer.AddrInfo, contextID []byte, metadata []byte, hashes []mh.Multihash, opts ...PublishOption) (ipld.Link, error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	c := &publishConfig{}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	entries, report, err := putEntries(ctx, p.ds, hashes, p.chunkSize, p.indexThreshold)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 1; ; attempt++ {
+		link, err := p.putAdvert(ctx, provider, contextID, metadata, entries, report, hashes, c)
+		if !errors.Is(err, ErrConditionFailed) || attempt == maxPublishAttempts {
+			return link, err
+		}
+		log.Debugw("head moved while publishing, retrying", "attempt", attempt)
+	}
+}
+
+// putAdvert writes an advertisement for the entries to the head of the chain,
+// or returns the existing advertisement if an identical one was published,
+// has not been removed since, and force is not set. The hashes of the entries
+// are added to the advertised filter once the advertisement is written
+func (p *Publisher) putAdvert(ctx context.Context, provider peer.AddrInfo, contextID []byte, metadata []byte, entries ipld.Link, report EntriesReport, hashes []mh.Multihash, c *publishConfig) (ipld.Link, error) {
+	addrs := make([]string, 0, len(provider.Addrs))
+	for _, addr := range provider.Addrs {
+		addrs = append(addrs, addr.String())
+	}
+	fp := fingerprint(provider.ID.String(), addrs, contextID, metadata, entries)
+	rk := removalKey(provider.ID.String(), contextID)
+	head, current, err := p.head(ctx)
+	if err != nil {
+		return nil, err
+	}
+	removed, err := p.removal(ctx, rk)
+	if err != nil {
+		return nil, err
+	}
+	if !c.force && !c.removal && removed == nil {
+		existing, err := p.published(ctx, fp)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			log.Debugw("advertisement already published", "link", existing)
+			return existing, nil
+		}
+	}
+	totals, err := p.totals(ctx)
+	if err != nil {
+		return nil, err
+	}
+	latest, err := p.timelineLatest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	adv := schema.Advertisement{
+		PreviousID: head,
+		Provider:   provider.ID.String(),
+		Addresses:  addrs,
+		Entries:    entries,
+		ContextID:  contextID,
+		Metadata:   metadata,
+		IsRm:       c.removal,
+	}
+	if err := adv.Sign(p.key); err != nil {
+		return nil, fmt.Errorf("signing advertisement: %w", err)
+	}
+	nd, err := adv.ToNode()
+	if err != nil {
+		return nil, fmt.Errorf("encoding advertisement: %w", err)
+	}
+
+	batch, err := p.headBatch(ctx, current)
+	if err != nil {
+		return nil, err
+	}
+	lsys := linkSystem(p.ds, batch, nil)
+	link, err := lsys.Store(ipld.LinkContext{Ctx: ctx}, schema.Linkproto, nd)
+	if err != nil {
+		return nil, fmt.Errorf("writing advertisement: %w", err)
+	}
+	summary := AdvertSummary{
+		Seq:       totals.Adverts + 1,
+		Link:      link.(cidlink.Link).Cid,
+		ContextID: contextID,
+		Entries:   report.Entries,
+		Chunks:    report.Chunks,
+		Bytes:     report.Bytes,
+		Published: p.now().UTC(),
+		Removal:   c.removal,
+	}
+	totals.add(summary)
+	if err := putSummary(ctx, batch, summary, totals); err != nil {
+		return nil, err
+	}
+	if err := putTimeline(ctx, batch, summary, timelineAt(summary.Published, latest)); err != nil {
+		return nil, err
+	}
+	op := Operation{Kind: OpPublish, Provider: provider.ID, Addrs: addrs, ContextID: contextID, Metadata: metadata, Advert: summary.Link, At: summary.Published}
+	if c.removal {
+		op.Kind = OpRemove
+	}
+	if err := p.putOperation(ctx, batch, op); err != nil {
+		return nil, err
+	}
+	// a removal is remembered until the context ID is published again, so
+	// that publishing it again isn't mistaken for a duplicate
+	if c.removal {
+		err = batch.Put(ctx, rk, summary.Link.Bytes())
+	} else {
+		err = batch.Put(ctx, fp, summary.Link.Bytes())
+		if err == nil && removed != nil {
+			err = batch.Delete(ctx, rk)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := batch.Put(ctx, headKey, summary.Link.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := batch.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("writing advertisement: %w", err)
+	}
+	p.advertisedPublished(ctx, head, link, hashes)
+	return link, nil
+}
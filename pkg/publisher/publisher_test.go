@@ -0,0 +1,132 @@
+package publisher_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/ingest/schema"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublisher(t *testing.T) {
+	ctx := context.Background()
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	provider := peer.AddrInfo{ID: testutil.RandomPeer()}
+
+	publish := func(t *testing.T, ds datastore.Batching, sizes ...int) *publisher.Publisher {
+		p := publisher.New(ds, key, publisher.WithEntriesChunkSize(3), publisher.WithRecentAdverts(2))
+		for _, size := range sizes {
+			testutil.Must(p.Publish(ctx, provider, testutil.RandomBytes(10), testutil.RandomBytes(10), testutil.RandomMultihashes(size)))(t)
+		}
+		return p
+	}
+
+	t.Run("chain links and signatures", func(t *testing.T) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		p := publish(t, ds, 2, 5)
+		head := testutil.Must(p.Head(ctx))(t)
+		var count int
+		for link := head; link != nil; count++ {
+			data := testutil.Must(ds.Get(ctx, datastore.NewKey(link.String())))(t)
+			adv := testutil.Must(schema.BytesToAdvertisement(link.(cidlink.Link).Cid, data))(t)
+			signer := testutil.Must(adv.VerifySignature())(t)
+			require.True(t, signer.MatchesPrivateKey(key))
+			require.Equal(t, provider.ID.String(), adv.Provider)
+			link = adv.PreviousID
+		}
+		require.Equal(t, 2, count)
+	})
+
+	t.Run("totals match a rebuild", func(t *testing.T) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		p := publish(t, ds, 1, 3, 7, 0, 10)
+
+		summary := testutil.Must(p.ChainSummary(ctx))(t)
+		require.Equal(t, uint64(5), summary.Adverts)
+		require.Equal(t, int64(21), summary.Entries)
+		require.Equal(t, int64(1+1+3+0+4), summary.Chunks)
+		require.Len(t, summary.Recent, 2)
+		require.Equal(t, uint64(5), summary.Recent[0].Seq)
+		require.Equal(t, 10, summary.Recent[0].Entries)
+		require.Equal(t, summary.Head.(cidlink.Link).Cid, summary.Recent[0].Link)
+		require.False(t, summary.First.IsZero())
+
+		rebuilt := testutil.Must(p.RebuildSummary(ctx))(t)
+		require.Equal(t, summary, rebuilt)
+		require.Equal(t, summary, testutil.Must(p.ChainSummary(ctx))(t))
+	})
+
+	t.Run("rebuild recovers missing summaries", func(t *testing.T) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		p := publish(t, ds, 4, 2, 9)
+		summary := testutil.Must(p.ChainSummary(ctx))(t)
+
+		results := testutil.Must(ds.Query(ctx, query.Query{Prefix: "/summary", KeysOnly: true}))(t)
+		for result := range results.Next() {
+			require.NoError(t, ds.Delete(ctx, datastore.NewKey(result.Key)))
+		}
+		missing := testutil.Must(p.ChainSummary(ctx))(t)
+		require.Zero(t, missing.Adverts)
+		require.Empty(t, missing.Recent)
+
+		rebuilt := testutil.Must(p.RebuildSummary(ctx))(t)
+		require.Equal(t, summary.Head, rebuilt.Head)
+		require.Equal(t, summary.Adverts, rebuilt.Adverts)
+		require.Equal(t, summary.Entries, rebuilt.Entries)
+		require.Equal(t, summary.Chunks, rebuilt.Chunks)
+		require.Equal(t, summary.Bytes, rebuilt.Bytes)
+		require.Len(t, rebuilt.Recent, 2)
+		for i, s := range rebuilt.Recent {
+			require.True(t, s.Published.IsZero())
+			s.Published = summary.Recent[i].Published
+			require.Equal(t, summary.Recent[i], s)
+		}
+	})
+
+	t.Run("duplicate publishes", func(t *testing.T) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		p := publisher.New(ds, key, publisher.WithEntriesChunkSize(3))
+		contextID, metadata, hashes := testutil.RandomBytes(10), testutil.RandomBytes(10), testutil.RandomMultihashes(5)
+
+		first := testutil.Must(p.Publish(ctx, provider, contextID, metadata, hashes))(t)
+		second := testutil.Must(p.Publish(ctx, provider, contextID, metadata, hashes))(t)
+		require.Equal(t, first, second)
+		require.Equal(t, uint64(1), testutil.Must(p.ChainSummary(ctx))(t).Adverts)
+
+		forced := testutil.Must(p.Publish(ctx, provider, contextID, metadata, hashes, publisher.ForceRepublish()))(t)
+		require.NotEqual(t, first, forced)
+		require.Equal(t, uint64(2), testutil.Must(p.ChainSummary(ctx))(t).Adverts)
+		// later publishes return the newest duplicate
+		require.Equal(t, forced, testutil.Must(p.Publish(ctx, provider, contextID, metadata, hashes))(t))
+
+		// different metadata is not a duplicate
+		testutil.Must(p.Publish(ctx, provider, contextID, testutil.RandomBytes(10), hashes))(t)
+		require.Equal(t, uint64(3), testutil.Must(p.ChainSummary(ctx))(t).Adverts)
+	})
+
+	t.Run("rebuild backfills fingerprints", func(t *testing.T) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		p := publisher.New(ds, key)
+		contextID, metadata, hashes := testutil.RandomBytes(10), testutil.RandomBytes(10), testutil.RandomMultihashes(5)
+		link := testutil.Must(p.Publish(ctx, provider, contextID, metadata, hashes))(t)
+		publish(t, ds, 3)
+
+		// chains published before fingerprints were kept have none
+		results := testutil.Must(ds.Query(ctx, query.Query{Prefix: "/fingerprints", KeysOnly: true}))(t)
+		for result := range results.Next() {
+			require.NoError(t, ds.Delete(ctx, datastore.NewKey(result.Key)))
+		}
+		testutil.Must(p.RebuildSummary(ctx))(t)
+
+		require.Equal(t, link, testutil.Must(p.Publish(ctx, provider, contextID, metadata, hashes))(t))
+		require.Equal(t, uint64(2), testutil.Must(p.ChainSummary(ctx))(t).Adverts)
+	})
+}
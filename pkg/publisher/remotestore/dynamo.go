@@ -0,0 +1,214 @@
+package remotestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/storacha/indexing-service/pkg/publisher"
+)
+
+const (
+	// MaxTransactItems is the most items a DynamoDB client is asked to write in
+	// a single transaction
+	MaxTransactItems = 100
+	// dynamoQueryLimit is the number of items read for each page of a query
+	dynamoQueryLimit = 100
+)
+
+// DynamoItem is an item of the DynamoDB table, holding the value of a key
+type DynamoItem struct {
+	Key   string
+	Value []byte
+}
+
+// DynamoCondition requires an item to hold a value, or not to exist if the
+// value is nil
+type DynamoCondition struct {
+	Key   string
+	Value []byte
+}
+
+// DynamoClient is the subset of DynamoDB operations used by the DynamoDB
+// datastore, against a single table. Keys are sort keys within one partition,
+// so that items can be queried by key prefix and read in key order
+type DynamoClient interface {
+	// GetItem returns the value of an item, or datastore.ErrNotFound if there is
+	// none with the key
+	GetItem(ctx context.Context, key string) ([]byte, error)
+	PutItem(ctx context.Context, item DynamoItem) error
+	DeleteItem(ctx context.Context, key string) error
+	// QueryItems returns up to limit items whose keys begin with the prefix in
+	// key order, starting after the given key
+	QueryItems(ctx context.Context, prefix string, startAfter string, limit int) ([]DynamoItem, error)
+	// TransactWriteItems puts and deletes up to MaxTransactItems items together,
+	// only if every condition holds. A condition on an item that is put applies
+	// to the put itself. A failed condition returns
+	// publisher.ErrConditionFailed, and nothing is written
+	TransactWriteItems(ctx context.Context, puts []DynamoItem, deletes []string, conditions []DynamoCondition) error
+}
+
+// DynamoDatastore keeps each value as an item of a DynamoDB table. It suits the
+// head of the chain, its summary and other small records, and supports the
+// conditional batches publishers sharing a datastore need
+type DynamoDatastore struct {
+	client DynamoClient
+}
+
+var (
+	_ datastore.Batching             = (*DynamoDatastore)(nil)
+	_ publisher.ConditionalDatastore = (*DynamoDatastore)(nil)
+)
+
+// NewDynamoDatastore returns a datastore keeping values as items of a table
+func NewDynamoDatastore(client DynamoClient) *DynamoDatastore {
+	return &DynamoDatastore{client: client}
+}
+
+func (d *DynamoDatastore) Get(ctx context.Context, key datastore.Key) ([]byte, error) {
+	return d.client.GetItem(ctx, key.String())
+}
+
+func (d *DynamoDatastore) Has(ctx context.Context, key datastore.Key) (bool, error) {
+	_, err := d.Get(ctx, key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *DynamoDatastore) GetSize(ctx context.Context, key datastore.Key) (int, error) {
+	value, err := d.Get(ctx, key)
+	if err != nil {
+		return -1, err
+	}
+	return len(value), nil
+}
+
+func (d *DynamoDatastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	return d.client.PutItem(ctx, DynamoItem{Key: key.String(), Value: value})
+}
+
+func (d *DynamoDatastore) Delete(ctx context.Context, key datastore.Key) error {
+	return d.client.DeleteItem(ctx, key.String())
+}
+
+// Query reads the items under the prefix a page at a time
+func (d *DynamoDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	prefix := datastore.NewKey(q.Prefix).String()
+	if prefix != "/" {
+		prefix += "/"
+	}
+	var page []DynamoItem
+	var startAfter string
+	more := true
+	next := func() (query.Result, bool) {
+		for len(page) == 0 {
+			if !more {
+				return query.Result{}, false
+			}
+			var err error
+			page, err = d.client.QueryItems(ctx, prefix, startAfter, dynamoQueryLimit)
+			if err != nil {
+				more = false
+				return query.Result{Error: fmt.Errorf("querying items: %w", err)}, true
+			}
+			more = len(page) == dynamoQueryLimit
+			if len(page) > 0 {
+				startAfter = page[len(page)-1].Key
+			}
+		}
+		item := page[0]
+		page = page[1:]
+		entry := query.Entry{Key: item.Key, Size: len(item.Value)}
+		if !q.KeysOnly {
+			entry.Value = item.Value
+		}
+		return query.Result{Entry: entry}, true
+	}
+	naive := q
+	naive.Prefix = ""
+	return query.NaiveQueryApply(naive, query.ResultsFromIterator(q, query.Iterator{Next: next})), nil
+}
+
+func (d *DynamoDatastore) Sync(ctx context.Context, prefix datastore.Key) error {
+	return nil
+}
+
+func (d *DynamoDatastore) Close() error {
+	return nil
+}
+
+// Batch returns a batch written in transactions of up to MaxTransactItems
+// items. A larger batch is not atomic as a whole
+func (d *DynamoDatastore) Batch(ctx context.Context) (datastore.Batch, error) {
+	return newDynamoBatch(d, nil), nil
+}
+
+// BatchIf returns a batch that is written in a single transaction, only if the
+// key still holds the expected value. It fails to commit if it writes more than
+// MaxTransactItems items
+func (d *DynamoDatastore) BatchIf(ctx context.Context, key datastore.Key, expected []byte) (datastore.Batch, error) {
+	return newDynamoBatch(d, &DynamoCondition{Key: key.String(), Value: expected}), nil
+}
+
+type dynamoBatch struct {
+	d         *DynamoDatastore
+	condition *DynamoCondition
+	puts      map[string][]byte
+	deletes   map[string]struct{}
+}
+
+func newDynamoBatch(d *DynamoDatastore, condition *DynamoCondition) *dynamoBatch {
+	return &dynamoBatch{d: d, condition: condition, puts: map[string][]byte{}, deletes: map[string]struct{}{}}
+}
+
+func (b *dynamoBatch) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	delete(b.deletes, key.String())
+	b.puts[key.String()] = value
+	return nil
+}
+
+func (b *dynamoBatch) Delete(ctx context.Context, key datastore.Key) error {
+	delete(b.puts, key.String())
+	b.deletes[key.String()] = struct{}{}
+	return nil
+}
+
+func (b *dynamoBatch) Commit(ctx context.Context) error {
+	puts := make([]DynamoItem, 0, len(b.puts))
+	for k, v := range b.puts {
+		puts = append(puts, DynamoItem{Key: k, Value: v})
+	}
+	deletes := make([]string, 0, len(b.deletes))
+	for k := range b.deletes {
+		deletes = append(deletes, k)
+	}
+	if b.condition != nil {
+		if len(puts)+len(deletes) > MaxTransactItems {
+			return fmt.Errorf("conditional batch of %d items exceeds the transaction limit of %d", len(puts)+len(deletes), MaxTransactItems)
+		}
+		return b.d.client.TransactWriteItems(ctx, puts, deletes, []DynamoCondition{*b.condition})
+	}
+	for len(puts)+len(deletes) > 0 {
+		np := min(len(puts), MaxTransactItems)
+		nd := min(len(deletes), MaxTransactItems-np)
+		if err := b.d.client.TransactWriteItems(ctx, puts[:np], deletes[:nd], nil); err != nil {
+			return fmt.Errorf("writing items: %w", err)
+		}
+		puts, deletes = puts[np:], deletes[nd:]
+	}
+	return nil
+}
+
+// Holds reports whether a stored value satisfies the condition, for clients
+// that check conditions themselves
+func (c DynamoCondition) Holds(value []byte, exists bool) bool {
+	if c.Value == nil {
+		return !exists
+	}
+	return exists && bytes.Equal(c.Value, value)
+}
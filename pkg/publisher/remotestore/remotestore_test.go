@@ -0,0 +1,267 @@
+package remotestore_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/storacha/indexing-service/pkg/publisher/remotestore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerlessDatastore(t *testing.T) {
+	ctx := context.Background()
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	provider := peer.AddrInfo{ID: testutil.RandomPeer()}
+
+	newPublisher := func(ds datastore.Batching) *publisher.Publisher {
+		return publisher.New(ds, key, publisher.WithEntriesChunkSize(3), publisher.WithRecentAdverts(2))
+	}
+	publish := func(t *testing.T, p *publisher.Publisher, sizes ...int) {
+		for _, size := range sizes {
+			testutil.Must(p.Publish(ctx, provider, testutil.RandomBytes(10), testutil.RandomBytes(10), testutil.RandomMultihashes(size)))(t)
+		}
+	}
+	chainLength := func(t *testing.T, p *publisher.Publisher) int {
+		var count int
+		for _, err := range p.Advertisements(ctx) {
+			require.NoError(t, err)
+			count++
+		}
+		return count
+	}
+
+	t.Run("blocks in S3, records in DynamoDB", func(t *testing.T) {
+		s3, dynamo := newFakeS3(), newFakeDynamo()
+		p := newPublisher(remotestore.NewServerlessDatastore(s3, "adverts", dynamo))
+		publish(t, p, 2, 5, 1)
+
+		require.Equal(t, 3, chainLength(t, p))
+		for k := range s3.objects {
+			require.True(t, strings.HasPrefix(k, "adverts/bag"), k)
+		}
+		// 3 adverts and 1+2+1 entries chunks
+		require.Len(t, s3.objects, 7)
+		require.Contains(t, dynamo.items, "/head")
+		for k := range dynamo.items {
+			require.False(t, strings.HasPrefix(k, "/bag"), k)
+		}
+	})
+
+	t.Run("rebuild queries and replaces summaries", func(t *testing.T) {
+		s3, dynamo := newFakeS3(), newFakeDynamo()
+		ds := remotestore.NewServerlessDatastore(s3, "", dynamo)
+		p := newPublisher(ds)
+		publish(t, p, 1, 3, 7, 0, 10)
+		summary := testutil.Must(p.ChainSummary(ctx))(t)
+
+		results := testutil.Must(ds.Query(ctx, query.Query{KeysOnly: true}))(t)
+		all := testutil.Must(results.Rest())(t)
+		require.Len(t, all, len(s3.objects)+len(dynamo.items))
+
+		rebuilt := testutil.Must(p.RebuildSummary(ctx))(t)
+		require.Equal(t, summary, rebuilt)
+		require.Equal(t, summary, testutil.Must(p.ChainSummary(ctx))(t))
+	})
+
+	t.Run("publishers sharing the datastore", func(t *testing.T) {
+		s3, dynamo := newFakeS3(), newFakeDynamo()
+		publishers := []*publisher.Publisher{
+			newPublisher(remotestore.NewServerlessDatastore(s3, "", dynamo)),
+			newPublisher(remotestore.NewServerlessDatastore(s3, "", dynamo)),
+		}
+		var wg sync.WaitGroup
+		for _, p := range publishers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				publish(t, p, 1, 2, 3, 4, 5)
+			}()
+		}
+		wg.Wait()
+
+		require.Equal(t, 10, chainLength(t, publishers[0]))
+		summary := testutil.Must(publishers[1].ChainSummary(ctx))(t)
+		require.Equal(t, uint64(10), summary.Adverts)
+		require.Equal(t, int64(30), summary.Entries)
+		require.Equal(t, uint64(10), summary.Recent[0].Seq)
+		require.Equal(t, summary, testutil.Must(publishers[0].RebuildSummary(ctx))(t))
+	})
+
+	t.Run("condition failure writes nothing", func(t *testing.T) {
+		dynamo := newFakeDynamo()
+		ds := remotestore.NewDynamoDatastore(dynamo)
+		require.NoError(t, ds.Put(ctx, datastore.NewKey("head"), []byte("a")))
+
+		batch := testutil.Must(ds.BatchIf(ctx, datastore.NewKey("head"), []byte("b")))(t)
+		require.NoError(t, batch.Put(ctx, datastore.NewKey("head"), []byte("c")))
+		require.NoError(t, batch.Put(ctx, datastore.NewKey("other"), []byte("c")))
+		require.ErrorIs(t, batch.Commit(ctx), publisher.ErrConditionFailed)
+		require.Equal(t, []byte("a"), testutil.Must(ds.Get(ctx, datastore.NewKey("head")))(t))
+		_, err := ds.Get(ctx, datastore.NewKey("other"))
+		require.ErrorIs(t, err, datastore.ErrNotFound)
+	})
+
+	t.Run("large batches", func(t *testing.T) {
+		s3, dynamo := newFakeS3(), newFakeDynamo()
+		for _, ds := range []datastore.Batching{remotestore.NewS3Datastore(s3, ""), remotestore.NewDynamoDatastore(dynamo)} {
+			batch := testutil.Must(ds.Batch(ctx))(t)
+			for i := range 2500 {
+				require.NoError(t, batch.Put(ctx, datastore.NewKey(fmt.Sprint(i)), []byte{1}))
+			}
+			require.NoError(t, batch.Commit(ctx))
+			results := testutil.Must(ds.Query(ctx, query.Query{KeysOnly: true}))(t)
+			require.Len(t, testutil.Must(results.Rest())(t), 2500)
+
+			batch = testutil.Must(ds.Batch(ctx))(t)
+			for i := range 2500 {
+				require.NoError(t, batch.Delete(ctx, datastore.NewKey(fmt.Sprint(i))))
+			}
+			require.NoError(t, batch.Commit(ctx))
+		}
+		require.Empty(t, s3.objects)
+		require.Empty(t, dynamo.items)
+	})
+}
+
+// fakeS3ListLimit is small so queries read several pages
+const fakeS3ListLimit = 5
+
+type fakeS3 struct {
+	lk      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string][]byte{}}
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, key string) ([]byte, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	data, ok := f.objects[key]
+	if !ok {
+		return nil, datastore.ErrNotFound
+	}
+	return data, nil
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, key string) (int64, error) {
+	data, err := f.GetObject(ctx, key)
+	return int64(len(data)), err
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, key string, data []byte) error {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	f.objects[key] = data
+	return nil
+}
+
+func (f *fakeS3) DeleteObjects(ctx context.Context, keys []string) error {
+	if len(keys) > remotestore.MaxDeleteObjects {
+		return fmt.Errorf("too many objects: %d", len(keys))
+	}
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	for _, k := range keys {
+		delete(f.objects, k)
+	}
+	return nil
+}
+
+func (f *fakeS3) ListObjects(ctx context.Context, prefix string, startAfter string) ([]string, bool, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	keys := sortedKeys(f.objects, prefix, startAfter)
+	if len(keys) > fakeS3ListLimit {
+		return keys[:fakeS3ListLimit], true, nil
+	}
+	return keys, false, nil
+}
+
+type fakeDynamo struct {
+	lk    sync.Mutex
+	items map[string][]byte
+}
+
+func newFakeDynamo() *fakeDynamo {
+	return &fakeDynamo{items: map[string][]byte{}}
+}
+
+func (f *fakeDynamo) GetItem(ctx context.Context, key string) ([]byte, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	value, ok := f.items[key]
+	if !ok {
+		return nil, datastore.ErrNotFound
+	}
+	return value, nil
+}
+
+func (f *fakeDynamo) PutItem(ctx context.Context, item remotestore.DynamoItem) error {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	f.items[item.Key] = item.Value
+	return nil
+}
+
+func (f *fakeDynamo) DeleteItem(ctx context.Context, key string) error {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	delete(f.items, key)
+	return nil
+}
+
+func (f *fakeDynamo) QueryItems(ctx context.Context, prefix string, startAfter string, limit int) ([]remotestore.DynamoItem, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	keys := sortedKeys(f.items, prefix, startAfter)
+	items := make([]remotestore.DynamoItem, 0, min(len(keys), limit))
+	for _, k := range keys[:min(len(keys), limit)] {
+		items = append(items, remotestore.DynamoItem{Key: k, Value: f.items[k]})
+	}
+	return items, nil
+}
+
+func (f *fakeDynamo) TransactWriteItems(ctx context.Context, puts []remotestore.DynamoItem, deletes []string, conditions []remotestore.DynamoCondition) error {
+	if len(puts)+len(deletes) > remotestore.MaxTransactItems {
+		return errors.New("too many items")
+	}
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	for _, c := range conditions {
+		value, exists := f.items[c.Key]
+		if !c.Holds(value, exists) {
+			return publisher.ErrConditionFailed
+		}
+	}
+	for _, item := range puts {
+		f.items[item.Key] = item.Value
+	}
+	for _, k := range deletes {
+		delete(f.items, k)
+	}
+	return nil
+}
+
+func sortedKeys(values map[string][]byte, prefix string, startAfter string) []string {
+	var keys []string
+	for k := range values {
+		if strings.HasPrefix(k, prefix) && k > startAfter {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,218 @@
+// Package remotestore provides datastores for running the publisher without a
+// local disk, as in serverless deployments. Blocks are kept as objects in S3,
+// and the head of the chain and other small records in DynamoDB, which lets
+// publishers sharing the datastore move the head with conditional writes.
+//
+// The datastores are written against the small client interfaces S3Client and
+// DynamoClient, which an AWS SDK client is adapted to
+package remotestore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+const (
+	// MaxDeleteObjects is the most objects an S3 client is asked to delete at once
+	MaxDeleteObjects = 1000
+	// s3PutConcurrency is the number of objects a batch puts at once
+	s3PutConcurrency = 8
+)
+
+// S3Client is the subset of S3 operations used by the S3 datastore, against a
+// single bucket
+type S3Client interface {
+	// GetObject returns the data of an object, or datastore.ErrNotFound if there
+	// is none with the key
+	GetObject(ctx context.Context, key string) ([]byte, error)
+	// HeadObject returns the size of an object, or datastore.ErrNotFound if there
+	// is none with the key
+	HeadObject(ctx context.Context, key string) (int64, error)
+	PutObject(ctx context.Context, key string, data []byte) error
+	// DeleteObjects deletes up to MaxDeleteObjects objects. Keys with no object
+	// are ignored
+	DeleteObjects(ctx context.Context, keys []string) error
+	// ListObjects returns the keys of objects beginning with the prefix in key
+	// order, starting after the given key, and whether there are more
+	ListObjects(ctx context.Context, prefix string, startAfter string) ([]string, bool, error)
+}
+
+// S3Datastore keeps each value as an S3 object, keyed by the datastore key
+// under a prefix. It suits the blocks of the advertisement chain, which are
+// written once and never change
+type S3Datastore struct {
+	client S3Client
+	prefix string
+}
+
+var _ datastore.Batching = (*S3Datastore)(nil)
+
+// NewS3Datastore returns a datastore keeping values as objects, with keys under
+// the given prefix of the bucket
+func NewS3Datastore(client S3Client, prefix string) *S3Datastore {
+	return &S3Datastore{client: client, prefix: strings.Trim(prefix, "/")}
+}
+
+func (s *S3Datastore) objectKey(key datastore.Key) string {
+	if s.prefix == "" {
+		return strings.TrimPrefix(key.String(), "/")
+	}
+	return s.prefix + key.String()
+}
+
+func (s *S3Datastore) datastoreKey(objectKey string) datastore.Key {
+	return datastore.NewKey(strings.TrimPrefix(objectKey, s.prefix))
+}
+
+func (s *S3Datastore) Get(ctx context.Context, key datastore.Key) ([]byte, error) {
+	return s.client.GetObject(ctx, s.objectKey(key))
+}
+
+func (s *S3Datastore) Has(ctx context.Context, key datastore.Key) (bool, error) {
+	_, err := s.GetSize(ctx, key)
+	if err == datastore.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *S3Datastore) GetSize(ctx context.Context, key datastore.Key) (int, error) {
+	size, err := s.client.HeadObject(ctx, s.objectKey(key))
+	if err != nil {
+		return -1, err
+	}
+	return int(size), nil
+}
+
+func (s *S3Datastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	return s.client.PutObject(ctx, s.objectKey(key), value)
+}
+
+func (s *S3Datastore) Delete(ctx context.Context, key datastore.Key) error {
+	return s.client.DeleteObjects(ctx, []string{s.objectKey(key)})
+}
+
+// Query lists the objects under the prefix a page at a time, fetching each
+// value as it is read unless only keys are wanted
+func (s *S3Datastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	prefix := s.objectKey(datastore.NewKey(q.Prefix))
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	var page []string
+	var startAfter string
+	more := true
+	next := func() (query.Result, bool) {
+		for len(page) == 0 {
+			if !more {
+				return query.Result{}, false
+			}
+			var err error
+			page, more, err = s.client.ListObjects(ctx, prefix, startAfter)
+			if err != nil {
+				more = false
+				return query.Result{Error: fmt.Errorf("listing objects: %w", err)}, true
+			}
+			if len(page) > 0 {
+				startAfter = page[len(page)-1]
+			}
+		}
+		objectKey := page[0]
+		page = page[1:]
+		entry := query.Entry{Key: s.datastoreKey(objectKey).String()}
+		if !q.KeysOnly {
+			value, err := s.client.GetObject(ctx, objectKey)
+			if err != nil {
+				return query.Result{Error: fmt.Errorf("reading object %s: %w", objectKey, err)}, true
+			}
+			entry.Value = value
+			entry.Size = len(value)
+		}
+		return query.Result{Entry: entry}, true
+	}
+	// the prefix is applied by listing, the rest of the query naively
+	naive := q
+	naive.Prefix = ""
+	return query.NaiveQueryApply(naive, query.ResultsFromIterator(q, query.Iterator{Next: next})), nil
+}
+
+func (s *S3Datastore) Sync(ctx context.Context, prefix datastore.Key) error {
+	return nil
+}
+
+func (s *S3Datastore) Close() error {
+	return nil
+}
+
+// Batch returns a batch that puts objects concurrently and deletes them with as
+// few requests as it can. S3 has no transactions, so a batch that fails part
+// way through may have written some of its objects
+func (s *S3Datastore) Batch(ctx context.Context) (datastore.Batch, error) {
+	return &s3Batch{s: s, puts: map[string][]byte{}, deletes: map[string]struct{}{}}, nil
+}
+
+type s3Batch struct {
+	s       *S3Datastore
+	puts    map[string][]byte
+	deletes map[string]struct{}
+}
+
+func (b *s3Batch) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	k := b.s.objectKey(key)
+	delete(b.deletes, k)
+	b.puts[k] = value
+	return nil
+}
+
+func (b *s3Batch) Delete(ctx context.Context, key datastore.Key) error {
+	k := b.s.objectKey(key)
+	delete(b.puts, k)
+	b.deletes[k] = struct{}{}
+	return nil
+}
+
+func (b *s3Batch) Commit(ctx context.Context) error {
+	if err := b.s.putObjects(ctx, b.puts); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(b.deletes))
+	for k := range b.deletes {
+		keys = append(keys, k)
+	}
+	for len(keys) > 0 {
+		n := min(len(keys), MaxDeleteObjects)
+		if err := b.s.client.DeleteObjects(ctx, keys[:n]); err != nil {
+			return fmt.Errorf("deleting objects: %w", err)
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// putObjects puts objects concurrently, returning the first error
+func (s *S3Datastore) putObjects(ctx context.Context, objects map[string][]byte) error {
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	sem := make(chan struct{}, s3PutConcurrency)
+	for k, v := range objects {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := s.client.PutObject(ctx, k, v); err != nil {
+				errOnce.Do(func() { firstErr = fmt.Errorf("putting object %s: %w", k, err) })
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
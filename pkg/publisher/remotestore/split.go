@@ -0,0 +1,188 @@
+package remotestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/storacha/indexing-service/pkg/publisher"
+)
+
+// SplitDatastore keeps the blocks of the advertisement chain, whose keys are
+// CIDs, in one datastore and every other record in another. Blocks are written
+// before the records of the same batch, so the head never links to a block that
+// hasn't been written
+type SplitDatastore struct {
+	blocks  datastore.Batching
+	records datastore.Batching
+}
+
+var (
+	_ datastore.Batching             = (*SplitDatastore)(nil)
+	_ publisher.ConditionalDatastore = (*SplitDatastore)(nil)
+)
+
+// NewSplitDatastore returns a datastore keeping blocks in one datastore and
+// other records in another
+func NewSplitDatastore(blocks datastore.Batching, records datastore.Batching) *SplitDatastore {
+	return &SplitDatastore{blocks: blocks, records: records}
+}
+
+// NewServerlessDatastore returns a datastore for the publisher keeping blocks as
+// S3 objects under the prefix, and other records in DynamoDB
+func NewServerlessDatastore(s3 S3Client, prefix string, dynamo DynamoClient) *SplitDatastore {
+	return NewSplitDatastore(NewS3Datastore(s3, prefix), NewDynamoDatastore(dynamo))
+}
+
+func isBlockKey(key datastore.Key) bool {
+	if !key.IsTopLevel() {
+		return false
+	}
+	_, err := cid.Decode(key.Name())
+	return err == nil
+}
+
+func (s *SplitDatastore) route(key datastore.Key) datastore.Batching {
+	if isBlockKey(key) {
+		return s.blocks
+	}
+	return s.records
+}
+
+func (s *SplitDatastore) Get(ctx context.Context, key datastore.Key) ([]byte, error) {
+	return s.route(key).Get(ctx, key)
+}
+
+func (s *SplitDatastore) Has(ctx context.Context, key datastore.Key) (bool, error) {
+	return s.route(key).Has(ctx, key)
+}
+
+func (s *SplitDatastore) GetSize(ctx context.Context, key datastore.Key) (int, error) {
+	return s.route(key).GetSize(ctx, key)
+}
+
+func (s *SplitDatastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	return s.route(key).Put(ctx, key, value)
+}
+
+func (s *SplitDatastore) Delete(ctx context.Context, key datastore.Key) error {
+	return s.route(key).Delete(ctx, key)
+}
+
+// Query reads from the records, unless the query is for every key, in which
+// case the blocks are read after the records
+func (s *SplitDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	if datastore.NewKey(q.Prefix).String() != "/" {
+		return s.records.Query(ctx, q)
+	}
+	// orders, offsets and limits apply across both, so are applied here
+	inner := query.Query{KeysOnly: q.KeysOnly, ReturnsSizes: q.ReturnsSizes}
+	records, err := s.records.Query(ctx, inner)
+	if err != nil {
+		return nil, err
+	}
+	var blocks query.Results
+	next := func() (query.Result, bool) {
+		if records != nil {
+			if r, ok := records.NextSync(); ok {
+				return r, true
+			}
+			records.Close()
+			records = nil
+			blocks, err = s.blocks.Query(ctx, inner)
+			if err != nil {
+				return query.Result{Error: err}, true
+			}
+		}
+		if blocks == nil {
+			return query.Result{}, false
+		}
+		return blocks.NextSync()
+	}
+	closeAll := func() error {
+		var errs []error
+		if records != nil {
+			errs = append(errs, records.Close())
+		}
+		if blocks != nil {
+			errs = append(errs, blocks.Close())
+		}
+		return errors.Join(errs...)
+	}
+	naive := q
+	naive.Prefix = ""
+	return query.NaiveQueryApply(naive, query.ResultsFromIterator(q, query.Iterator{Next: next, Close: closeAll})), nil
+}
+
+func (s *SplitDatastore) Sync(ctx context.Context, prefix datastore.Key) error {
+	return errors.Join(s.blocks.Sync(ctx, prefix), s.records.Sync(ctx, prefix))
+}
+
+func (s *SplitDatastore) Close() error {
+	return errors.Join(s.blocks.Close(), s.records.Close())
+}
+
+func (s *SplitDatastore) Batch(ctx context.Context) (datastore.Batch, error) {
+	records, err := s.records.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.newBatch(ctx, records)
+}
+
+// BatchIf returns a batch whose records are only written if the key still holds
+// the expected value. The key must be a record, in a datastore supporting
+// conditional batches. Blocks are written regardless, as a block nothing links
+// to is harmless
+func (s *SplitDatastore) BatchIf(ctx context.Context, key datastore.Key, expected []byte) (datastore.Batch, error) {
+	if isBlockKey(key) {
+		return nil, fmt.Errorf("conditional batch on a block: %s", key)
+	}
+	cds, ok := s.records.(publisher.ConditionalDatastore)
+	if !ok {
+		return nil, errors.New("records datastore doesn't support conditional batches")
+	}
+	records, err := cds.BatchIf(ctx, key, expected)
+	if err != nil {
+		return nil, err
+	}
+	return s.newBatch(ctx, records)
+}
+
+func (s *SplitDatastore) newBatch(ctx context.Context, records datastore.Batch) (datastore.Batch, error) {
+	blocks, err := s.blocks.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &splitBatch{blocks: blocks, records: records}, nil
+}
+
+type splitBatch struct {
+	blocks  datastore.Batch
+	records datastore.Batch
+}
+
+func (b *splitBatch) route(key datastore.Key) datastore.Batch {
+	if isBlockKey(key) {
+		return b.blocks
+	}
+	return b.records
+}
+
+func (b *splitBatch) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	return b.route(key).Put(ctx, key, value)
+}
+
+func (b *splitBatch) Delete(ctx context.Context, key datastore.Key) error {
+	return b.route(key).Delete(ctx, key)
+}
+
+func (b *splitBatch) Commit(ctx context.Context) error {
+	if err := b.blocks.Commit(ctx); err != nil {
+		return fmt.Errorf("writing blocks: %w", err)
+	}
+	return b.records.Commit(ctx)
+}
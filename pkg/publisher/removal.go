@@ -0,0 +1,102 @@
+package publisher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/ingest/schema"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var removalPrefix = datastore.NewKey("removals")
+
+// removalKey is where the removal of a provider's advertisements for a context
+// ID is remembered
+func removalKey(provider string, contextID []byte) datastore.Key {
+	return removalPrefix.ChildString(contextHash(provider, contextID))
+}
+
+// contextHash identifies a provider's context ID in a datastore key
+func contextHash(provider string, contextID []byte) string {
+	h := sha256.New()
+	h.Write(binary.AppendUvarint(nil, uint64(len(provider))))
+	h.Write([]byte(provider))
+	h.Write(contextID)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// removal returns the link to the removal advertisement remembered at the key,
+// or nil if there is none
+func (p *Publisher) removal(ctx context.Context, key datastore.Key) (ipld.Link, error) {
+	data, err := p.ds.Get(ctx, key)
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading advertisement removal: %w", err)
+	}
+	c, err := cid.Cast(data)
+	if err != nil {
+		return nil, fmt.Errorf("decoding advertisement removal: %w", err)
+	}
+	return cidlink.Link{Cid: c}, nil
+}
+
+// Remove writes a removal advertisement to the head of the chain on behalf of
+// the provider, so that indexers drop every multihash advertised for the
+// context ID. If the context ID was already removed and hasn't been published
+// since, the link to the earlier removal is returned and nothing is written.
+// Publishing the context ID again after it is removed writes a new
+// advertisement even if it is identical to one published before
+func (p *Publisher) Remove(ctx context.Context, provider peer.AddrInfo, contextID []byte) (ipld.Link, error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	existing, err := p.removal(ctx, removalKey(provider.ID.String(), contextID))
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		log.Debugw("advertisement already removed", "link", existing)
+		return existing, nil
+	}
+	c := &publishConfig{removal: true}
+	for attempt := 1; ; attempt++ {
+		link, err := p.putAdvert(ctx, provider, contextID, nil, schema.NoEntries, EntriesReport{}, nil, c)
+		if !errors.Is(err, ErrConditionFailed) || attempt == maxPublishAttempts {
+			return link, err
+		}
+		log.Debugw("head moved while removing, retrying", "attempt", attempt)
+	}
+}
+
+// AdvertisedContextIDs returns the context IDs the provider has advertisements
+// in the chain for that have not since been removed, most recently advertised
+// first. The whole chain is walked
+func (p *Publisher) AdvertisedContextIDs(ctx context.Context, provider peer.ID) ([][]byte, error) {
+	id := provider.String()
+	seen := map[string]bool{}
+	var contextIDs [][]byte
+	for adv, err := range p.Advertisements(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		if adv.Provider != id || seen[string(adv.ContextID)] {
+			continue
+		}
+		// the newest advertisement for a context ID says whether it is removed
+		seen[string(adv.ContextID)] = true
+		if !adv.IsRm {
+			contextIDs = append(contextIDs, adv.ContextID)
+		}
+	}
+	return contextIDs, nil
+}
@@ -0,0 +1,65 @@
+package publisher_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/ingest/schema"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublisher__Remove(t *testing.T) {
+	ctx := context.Background()
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	provider, other := peer.AddrInfo{ID: testutil.RandomPeer()}, peer.AddrInfo{ID: testutil.RandomPeer()}
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	p := publisher.New(ds, key)
+
+	contextIDs := [][]byte{testutil.RandomBytes(10), testutil.RandomBytes(10)}
+	metadata, hashes := testutil.RandomBytes(10), testutil.RandomMultihashes(3)
+	published := testutil.Must(p.Publish(ctx, provider, contextIDs[0], metadata, hashes))(t)
+	testutil.Must(p.Publish(ctx, provider, contextIDs[1], metadata, hashes))(t)
+	otherContextID := testutil.RandomBytes(10)
+	testutil.Must(p.Publish(ctx, other, otherContextID, metadata, hashes))(t)
+	require.Equal(t, [][]byte{contextIDs[1], contextIDs[0]}, testutil.Must(p.AdvertisedContextIDs(ctx, provider.ID))(t))
+
+	removal := testutil.Must(p.Remove(ctx, provider, contextIDs[0]))(t)
+	data := testutil.Must(ds.Get(ctx, datastore.NewKey(removal.String())))(t)
+	adv := testutil.Must(schema.BytesToAdvertisement(removal.(cidlink.Link).Cid, data))(t)
+	require.True(t, adv.IsRm)
+	require.Equal(t, contextIDs[0], adv.ContextID)
+	require.Equal(t, schema.NoEntries, adv.Entries)
+	signer := testutil.Must(adv.VerifySignature())(t)
+	require.True(t, signer.MatchesPrivateKey(key))
+
+	require.Equal(t, [][]byte{contextIDs[1]}, testutil.Must(p.AdvertisedContextIDs(ctx, provider.ID))(t))
+	require.Equal(t, [][]byte{otherContextID}, testutil.Must(p.AdvertisedContextIDs(ctx, other.ID))(t))
+
+	t.Run("removing again writes nothing", func(t *testing.T) {
+		require.Equal(t, removal, testutil.Must(p.Remove(ctx, provider, contextIDs[0]))(t))
+		require.Equal(t, removal, testutil.Must(p.Head(ctx))(t))
+	})
+
+	t.Run("publishing again after a removal is not a duplicate", func(t *testing.T) {
+		republished := testutil.Must(p.Publish(ctx, provider, contextIDs[0], metadata, hashes))(t)
+		require.NotEqual(t, published, republished)
+		require.Equal(t, republished, testutil.Must(p.Head(ctx))(t))
+		require.Equal(t, [][]byte{contextIDs[0], contextIDs[1]}, testutil.Must(p.AdvertisedContextIDs(ctx, provider.ID))(t))
+		// and can be removed again
+		require.NotEqual(t, removal, testutil.Must(p.Remove(ctx, provider, contextIDs[0]))(t))
+	})
+
+	t.Run("removals survive a rebuild", func(t *testing.T) {
+		summary := testutil.Must(p.RebuildSummary(ctx))(t)
+		require.True(t, summary.Recent[0].Removal)
+		head := testutil.Must(p.Head(ctx))(t)
+		require.Equal(t, head, testutil.Must(p.Remove(ctx, provider, contextIDs[0]))(t))
+	})
+}
@@ -0,0 +1,239 @@
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/indexing-service/pkg/metadata"
+)
+
+var routesPrefix = datastore.NewKey("announce-routes")
+
+// AnnounceRoutes decide the endpoints an advertisement is announced to by the
+// kinds of claims it carries. An advertisement carrying several kinds is
+// announced to the endpoints of each, and one carrying no kind with a route of
+// its own to the default endpoints. The zero value announces every
+// advertisement to every endpoint.
+//
+// Routes decide which indexers are told of an advertisement, not which can read
+// it. Every advertisement is in the same chain, and an indexer syncing back from
+// a head announced to it reads the older advertisements too, so claims that
+// must never reach an indexer need a publisher of their own
+type AnnounceRoutes struct {
+	// Kinds are the names of the endpoints advertisements carrying each kind of
+	// claim are announced to, by the name of the kind: equals, index or
+	// location. A kind with no endpoints is announced to none
+	Kinds map[string][]string `json:"kinds,omitempty"`
+	// Default are the names of the endpoints advertisements carrying no kind
+	// with a route are announced to. If empty, every endpoint is
+	Default []string `json:"default,omitempty"`
+}
+
+// Validate checks the routes are for known kinds of claims
+func (r AnnounceRoutes) Validate() error {
+	for name := range r.Kinds {
+		if metadata.ParseKind(name) == metadata.UnknownKind {
+			return fmt.Errorf("invalid announce route: unknown claim kind %q", name)
+		}
+	}
+	return nil
+}
+
+// Clone returns a copy of the routes sharing nothing with them
+func (r AnnounceRoutes) Clone() AnnounceRoutes {
+	clone := AnnounceRoutes{Default: slices.Clone(r.Default)}
+	if r.Kinds != nil {
+		clone.Kinds = make(map[string][]string, len(r.Kinds))
+		for kind, names := range r.Kinds {
+			clone.Kinds[kind] = slices.Clone(names)
+		}
+	}
+	return clone
+}
+
+// names returns every endpoint name the routes refer to
+func (r AnnounceRoutes) names() []string {
+	names := slices.Clone(r.Default)
+	for _, kind := range r.Kinds {
+		names = append(names, kind...)
+	}
+	return names
+}
+
+type (
+	// AnnounceOption configures the announcement of a single advertisement
+	AnnounceOption func(*announceConfig)
+
+	announceConfig struct {
+		kinds    []metadata.Kind
+		provider peer.ID
+		// contextID is remembered with the endpoints the advertisement is
+		// routed to if it is set
+		contextID []byte
+	}
+
+	// RemovalAnnouncement is a removal advertisement published for a context ID
+	// of a provider
+	RemovalAnnouncement struct {
+		ContextID []byte
+		Link      ipld.Link
+	}
+)
+
+// WithClaimKinds routes the advertisement by the kinds of claims it carries.
+// Without it, the advertisement is announced to the default endpoints
+func WithClaimKinds(kinds ...metadata.Kind) AnnounceOption {
+	return func(c *announceConfig) {
+		c.kinds = kinds
+	}
+}
+
+// ForContextID remembers the endpoints the advertisement is announced to as
+// those of the provider's context ID, so that its removal is announced to them
+// too
+func ForContextID(provider peer.ID, contextID []byte) AnnounceOption {
+	return func(c *announceConfig) {
+		c.provider = provider
+		c.contextID = contextID
+	}
+}
+
+// SetRoutes replaces the routes of advertisements announced from now on.
+// Advertisements already journaled keep the endpoints they were routed to
+func (a *Announcer) SetRoutes(routes AnnounceRoutes) error {
+	if err := routes.Validate(); err != nil {
+		return err
+	}
+	for _, name := range routes.names() {
+		if !slices.ContainsFunc(a.endpoints, func(e *endpoint) bool { return e.Name == name }) {
+			return fmt.Errorf("invalid announce route: unknown endpoint %q", name)
+		}
+	}
+	routes = routes.Clone()
+	a.current.Store(&routes)
+	return nil
+}
+
+// Routes returns the routes of advertisements announced from now on
+func (a *Announcer) Routes() AnnounceRoutes {
+	return a.current.Load().Clone()
+}
+
+// zero returns true if the routes announce every advertisement to every
+// endpoint
+func (r *AnnounceRoutes) zero() bool {
+	return len(r.Kinds) == 0 && len(r.Default) == 0
+}
+
+// route returns the names of the endpoints an advertisement carrying the kinds
+// of claims is announced to, in the order of the endpoints
+func (a *Announcer) route(routes *AnnounceRoutes, kinds []metadata.Kind) []string {
+	names := []string{}
+	unrouted := len(kinds) == 0
+	for _, kind := range kinds {
+		kindNames, ok := routes.Kinds[kind.String()]
+		if !ok {
+			unrouted = true
+		}
+		names = append(names, kindNames...)
+	}
+	if unrouted {
+		if len(routes.Default) == 0 {
+			return a.ordered(nil)
+		}
+		names = append(names, routes.Default...)
+	}
+	return a.ordered(names)
+}
+
+// ordered returns the names of the endpoints in the given names, or of every
+// endpoint if names is nil, in the order of the endpoints
+func (a *Announcer) ordered(names []string) []string {
+	ordered := []string{}
+	for _, e := range a.endpoints {
+		if names == nil || slices.Contains(names, e.Name) {
+			ordered = append(ordered, e.Name)
+		}
+	}
+	return ordered
+}
+
+// routeKey is where the endpoints the advertisements of a provider's context ID
+// were announced to are remembered
+func routeKey(provider peer.ID, contextID []byte) datastore.Key {
+	return datastore.NewKey(contextHash(provider.String(), contextID))
+}
+
+func (a *Announcer) putRoute(ctx context.Context, provider peer.ID, contextID []byte, names []string) error {
+	data, err := json.Marshal(names)
+	if err != nil {
+		return fmt.Errorf("encoding announce route: %w", err)
+	}
+	if err := a.contexts.Put(ctx, routeKey(provider, contextID), data); err != nil {
+		return fmt.Errorf("writing announce route: %w", err)
+	}
+	return nil
+}
+
+// remembered returns the names of the endpoints the advertisements of the
+// provider's context ID were announced to, or nil if they weren't remembered
+func (a *Announcer) remembered(ctx context.Context, provider peer.ID, contextID []byte) ([]string, error) {
+	data, err := a.contexts.Get(ctx, routeKey(provider, contextID))
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading announce route: %w", err)
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return nil, fmt.Errorf("decoding announce route: %w", err)
+	}
+	return names, nil
+}
+
+// AnnounceRemovals journals removal advertisements of the provider's context
+// IDs, given in the order they were published, for announcement to the
+// endpoints the context IDs were announced to, or every endpoint for those
+// announced before it was remembered. Only the newest removal of the context
+// IDs announced to the same endpoints is journaled, since an indexer syncs
+// the older ones along with it
+func (a *Announcer) AnnounceRemovals(ctx context.Context, provider peer.ID, removals []RemovalAnnouncement) error {
+	type group struct {
+		names []string
+		last  int
+	}
+	groups := map[string]*group{}
+	for i, r := range removals {
+		names, err := a.remembered(ctx, provider, r.ContextID)
+		if err != nil {
+			return err
+		}
+		names = a.ordered(names)
+		key := strings.Join(names, "\n")
+		if g, ok := groups[key]; ok {
+			g.last = i
+			continue
+		}
+		groups[key] = &group{names: names, last: i}
+	}
+	ordered := make([]*group, 0, len(groups))
+	for _, g := range groups {
+		ordered = append(ordered, g)
+	}
+	// journaled in chain order, so that confirming a removal confirms the older
+	slices.SortFunc(ordered, func(a, b *group) int { return a.last - b.last })
+	for _, g := range ordered {
+		if err := a.journalAnnouncement(ctx, removals[g.last].Link, g.names); err != nil {
+			return err
+		}
+	}
+	return nil
+}
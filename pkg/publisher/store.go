@@ -0,0 +1,50 @@
+// Package publisher stores the IPNI advertisements and entries chunks published
+// by the indexing service, so they can be served to and synced by indexers
+package publisher
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+// NewLinkSystem returns a link system that reads and writes blocks in the given
+// datastore
+func NewLinkSystem(ds datastore.Batching) ipld.LinkSystem {
+	return linkSystem(ds, ds, nil)
+}
+
+// linkSystem returns a link system that reads blocks from r and writes them to
+// w, calling onWrite with the size of each block written
+func linkSystem(r datastore.Read, w datastore.Write, onWrite func(size int)) ipld.LinkSystem {
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageReadOpener = func(lctx linking.LinkContext, l ipld.Link) (io.Reader, error) {
+		data, err := r.Get(lctx.Ctx, dsKey(l))
+		if err != nil {
+			return nil, fmt.Errorf("reading block %s: %w", l, err)
+		}
+		return bytes.NewReader(data), nil
+	}
+	lsys.StorageWriteOpener = func(lctx linking.LinkContext) (io.Writer, linking.BlockWriteCommitter, error) {
+		buf := bytes.NewBuffer(nil)
+		return buf, func(l ipld.Link) error {
+			if err := w.Put(lctx.Ctx, dsKey(l), buf.Bytes()); err != nil {
+				return err
+			}
+			if onWrite != nil {
+				onWrite(buf.Len())
+			}
+			return nil
+		}, nil
+	}
+	return lsys
+}
+
+func dsKey(l ipld.Link) datastore.Key {
+	return datastore.NewKey(l.String())
+}
@@ -0,0 +1,376 @@
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"slices"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/ingest/schema"
+)
+
+var (
+	summaryPrefix = datastore.NewKey("summary/adverts")
+	totalsKey     = datastore.NewKey("summary/totals")
+)
+
+// AdvertSummary describes a single published advertisement
+type AdvertSummary struct {
+	// Seq is the position of the advertisement in the chain, from 1 at the tail
+	Seq       uint64
+	Link      cid.Cid
+	ContextID []byte
+	// Entries is the number of multihashes advertised
+	Entries int
+	// Chunks is the number of entries chunks
+	Chunks int
+	// Bytes is the total encoded size of the entries chunks
+	Bytes int64
+	// Published is when the advertisement was published. It is zero for
+	// advertisements summarized by walking the chain
+	Published time.Time
+	// Removal is whether the advertisement removes those published before it
+	// for the context ID
+	Removal bool
+}
+
+// Totals are the running totals over every advertisement in the chain
+type Totals struct {
+	Adverts uint64
+	Entries int64
+	Chunks  int64
+	Bytes   int64
+	// First and Last are when the first and last advertisements with a known
+	// publish time were published
+	First time.Time
+	Last  time.Time
+}
+
+func (t *Totals) add(s AdvertSummary) {
+	t.Adverts++
+	t.Entries += int64(s.Entries)
+	t.Chunks += int64(s.Chunks)
+	t.Bytes += s.Bytes
+	if s.Published.IsZero() {
+		return
+	}
+	if t.First.IsZero() || s.Published.Before(t.First) {
+		t.First = s.Published
+	}
+	if s.Published.After(t.Last) {
+		t.Last = s.Published
+	}
+}
+
+// EntriesPerDay is the average number of entries advertised per day between the
+// first and last advertisements with a known publish time
+func (t Totals) EntriesPerDay() float64 {
+	elapsed := t.Last.Sub(t.First)
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(t.Entries) / (float64(elapsed) / float64(24*time.Hour))
+}
+
+// Summary describes the size of the advertisement chain
+type Summary struct {
+	Head ipld.Link
+	Totals
+	// Recent are the most recent advertisements, newest first
+	Recent []AdvertSummary
+	// Advertised are the stats of the advertised filter, if the publisher
+	// keeps one
+	Advertised *AdvertisedFilterStats
+}
+
+type storedAdvertSummary struct {
+	Seq       uint64    `json:"seq"`
+	Link      string    `json:"link"`
+	ContextID []byte    `json:"contextID"`
+	Entries   int       `json:"entries"`
+	Chunks    int       `json:"chunks"`
+	Bytes     int64     `json:"bytes"`
+	Published time.Time `json:"published"`
+	Removal   bool      `json:"removal,omitempty"`
+}
+
+func summaryKey(seq uint64) datastore.Key {
+	return summaryPrefix.ChildString(fmt.Sprintf("%020d", seq))
+}
+
+func putSummary(ctx context.Context, w datastore.Write, s AdvertSummary, totals Totals) error {
+	data, err := json.Marshal(storedAdvertSummary{
+		Seq:       s.Seq,
+		Link:      s.Link.String(),
+		ContextID: s.ContextID,
+		Entries:   s.Entries,
+		Chunks:    s.Chunks,
+		Bytes:     s.Bytes,
+		Published: s.Published,
+		Removal:   s.Removal,
+	})
+	if err != nil {
+		return fmt.Errorf("encoding advertisement summary: %w", err)
+	}
+	if err := w.Put(ctx, summaryKey(s.Seq), data); err != nil {
+		return err
+	}
+	data, err = json.Marshal(totals)
+	if err != nil {
+		return fmt.Errorf("encoding chain totals: %w", err)
+	}
+	return w.Put(ctx, totalsKey, data)
+}
+
+func decodeSummary(data []byte) (AdvertSummary, error) {
+	var stored storedAdvertSummary
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return AdvertSummary{}, fmt.Errorf("decoding advertisement summary: %w", err)
+	}
+	link, err := cid.Decode(stored.Link)
+	if err != nil {
+		return AdvertSummary{}, fmt.Errorf("decoding advertisement summary: %w", err)
+	}
+	return AdvertSummary{
+		Seq:       stored.Seq,
+		Link:      link,
+		ContextID: stored.ContextID,
+		Entries:   stored.Entries,
+		Chunks:    stored.Chunks,
+		Bytes:     stored.Bytes,
+		Published: stored.Published,
+		Removal:   stored.Removal,
+	}, nil
+}
+
+func (p *Publisher) totals(ctx context.Context) (Totals, error) {
+	var totals Totals
+	data, err := p.ds.Get(ctx, totalsKey)
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return totals, nil
+		}
+		return totals, fmt.Errorf("reading chain totals: %w", err)
+	}
+	if err := json.Unmarshal(data, &totals); err != nil {
+		return totals, fmt.Errorf("decoding chain totals: %w", err)
+	}
+	return totals, nil
+}
+
+// ChainSummary returns the totals over the advertisement chain, along with the
+// most recent advertisements and the stats of the advertised filter
+func (p *Publisher) ChainSummary(ctx context.Context) (Summary, error) {
+	head, err := p.Head(ctx)
+	if err != nil {
+		return Summary{}, err
+	}
+	totals, err := p.totals(ctx)
+	if err != nil {
+		return Summary{}, err
+	}
+	results, err := p.ds.Query(ctx, query.Query{
+		Prefix: summaryPrefix.String(),
+		Orders: []query.Order{query.OrderByKeyDescending{}},
+		Limit:  p.recentAdverts,
+	})
+	if err != nil {
+		return Summary{}, fmt.Errorf("reading advertisement summaries: %w", err)
+	}
+	stored, err := results.Rest()
+	if err != nil {
+		return Summary{}, fmt.Errorf("reading advertisement summaries: %w", err)
+	}
+	recent := make([]AdvertSummary, 0, len(stored))
+	for _, result := range stored {
+		s, err := decodeSummary(result.Value)
+		if err != nil {
+			return Summary{}, err
+		}
+		recent = append(recent, s)
+	}
+	summary := Summary{Head: head, Totals: totals, Recent: recent}
+	if stats, err := p.AdvertisedFilterStats(); err == nil {
+		summary.Advertised = &stats
+	}
+	return summary, nil
+}
+
+// RebuildSummary recomputes the chain summary by walking the advertisement
+// chain from its head, for chains published before summaries were kept or
+// whose summaries were lost. Publish times are kept for advertisements that
+// already have a summary, and are otherwise unknown. The fingerprints that
+// publishes are checked against for duplicates are written for every
+// advertisement too, pointing at the newest of any duplicates. The timeline of
+// the chain is rebuilt along with it, backfilling unknown publish times from
+// the operation log where it has them
+func (p *Publisher) RebuildSummary(ctx context.Context) (Summary, error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return p.rebuildSummary(ctx)
+}
+
+func (p *Publisher) rebuildSummary(ctx context.Context) (Summary, error) {
+	published := map[cid.Cid]time.Time{}
+	results, err := p.ds.Query(ctx, query.Query{Prefix: summaryPrefix.String()})
+	if err != nil {
+		return Summary{}, fmt.Errorf("reading advertisement summaries: %w", err)
+	}
+	existing, err := results.Rest()
+	if err != nil {
+		return Summary{}, fmt.Errorf("reading advertisement summaries: %w", err)
+	}
+	for _, result := range existing {
+		if s, err := decodeSummary(result.Value); err == nil {
+			published[s.Link] = s.Published
+		}
+	}
+
+	head, err := p.Head(ctx)
+	if err != nil {
+		return Summary{}, err
+	}
+	// walk from the head, then number from the tail
+	var summaries []AdvertSummary
+	var fingerprints, removals []datastore.Key
+	for link := head; link != nil; {
+		adv, err := p.advertisement(ctx, link)
+		if err != nil {
+			return Summary{}, err
+		}
+		report, err := VerifyEntries(ctx, p.ds, adv.Entries)
+		if err != nil {
+			return Summary{}, fmt.Errorf("reading entries of advertisement %s: %w", link, err)
+		}
+		if !report.Complete() {
+			return Summary{}, fmt.Errorf("reading entries of advertisement %s: %w", link, report.Broken)
+		}
+		c := link.(cidlink.Link).Cid
+		summaries = append(summaries, AdvertSummary{
+			Link:      c,
+			ContextID: adv.ContextID,
+			Entries:   report.Entries,
+			Chunks:    report.Chunks,
+			Bytes:     report.Bytes,
+			Published: published[c],
+			Removal:   adv.IsRm,
+		})
+		fingerprints = append(fingerprints, advertFingerprint(adv))
+		removals = append(removals, removalKey(adv.Provider, adv.ContextID))
+		link = adv.PreviousID
+	}
+	slices.Reverse(summaries)
+	slices.Reverse(fingerprints)
+	slices.Reverse(removals)
+
+	batch, err := p.ds.Batch(ctx)
+	if err != nil {
+		return Summary{}, err
+	}
+	for _, result := range existing {
+		if err := batch.Delete(ctx, datastore.NewKey(result.Key)); err != nil {
+			return Summary{}, err
+		}
+	}
+	results, err = p.ds.Query(ctx, query.Query{Prefix: timelinePrefix.String(), KeysOnly: true})
+	if err != nil {
+		return Summary{}, fmt.Errorf("reading timeline: %w", err)
+	}
+	timeline, err := results.Rest()
+	if err != nil {
+		return Summary{}, fmt.Errorf("reading timeline: %w", err)
+	}
+	for _, result := range timeline {
+		if err := batch.Delete(ctx, datastore.NewKey(result.Key)); err != nil {
+			return Summary{}, err
+		}
+	}
+	logged, err := p.publishTimes(ctx)
+	if err != nil {
+		return Summary{}, err
+	}
+	var totals Totals
+	var latest time.Time
+	for i := range summaries {
+		summaries[i].Seq = uint64(i + 1)
+		totals.add(summaries[i])
+		if err := putSummary(ctx, batch, summaries[i], totals); err != nil {
+			return Summary{}, err
+		}
+		published := summaries[i].Published
+		if published.IsZero() {
+			published = logged[summaries[i].Link]
+		}
+		latest = timelineAt(published, latest)
+		if err := putTimeline(ctx, batch, summaries[i], latest); err != nil {
+			return Summary{}, err
+		}
+		// written tail first, so the newest of any duplicates wins, and only
+		// removals not followed by a publish are remembered
+		if summaries[i].Removal {
+			err = batch.Put(ctx, removals[i], summaries[i].Link.Bytes())
+		} else {
+			err = batch.Put(ctx, fingerprints[i], summaries[i].Link.Bytes())
+			if err == nil {
+				err = batch.Delete(ctx, removals[i])
+			}
+		}
+		if err != nil {
+			return Summary{}, err
+		}
+	}
+	if len(summaries) == 0 {
+		if err := batch.Delete(ctx, totalsKey); err != nil {
+			return Summary{}, err
+		}
+	}
+	if err := batch.Commit(ctx); err != nil {
+		return Summary{}, fmt.Errorf("writing advertisement summaries: %w", err)
+	}
+
+	recent := summaries[max(len(summaries)-p.recentAdverts, 0):]
+	slices.Reverse(recent)
+	return Summary{Head: head, Totals: totals, Recent: recent}, nil
+}
+
+// Advertisements iterates the advertisement chain from its head, newest first
+func (p *Publisher) Advertisements(ctx context.Context) iter.Seq2[schema.Advertisement, error] {
+	return func(yield func(schema.Advertisement, error) bool) {
+		head, err := p.Head(ctx)
+		if err != nil {
+			yield(schema.Advertisement{}, err)
+			return
+		}
+		for link := head; link != nil; {
+			adv, err := p.advertisement(ctx, link)
+			if err != nil {
+				yield(schema.Advertisement{}, err)
+				return
+			}
+			if !yield(adv, nil) {
+				return
+			}
+			link = adv.PreviousID
+		}
+	}
+}
+
+func (p *Publisher) advertisement(ctx context.Context, link ipld.Link) (schema.Advertisement, error) {
+	data, err := p.ds.Get(ctx, dsKey(link))
+	if err != nil {
+		return schema.Advertisement{}, fmt.Errorf("reading advertisement %s: %w", link, err)
+	}
+	adv, err := schema.BytesToAdvertisement(link.(cidlink.Link).Cid, data)
+	if err != nil {
+		return schema.Advertisement{}, fmt.Errorf("decoding advertisement %s: %w", link, err)
+	}
+	return adv, nil
+}
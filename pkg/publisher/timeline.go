@@ -0,0 +1,248 @@
+package publisher
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/ingest/schema"
+)
+
+var timelinePrefix = datastore.NewKey("timeline")
+
+// TimedAdvert is the summary of an advertisement along with the time it is
+// indexed at on the timeline of the chain
+type TimedAdvert struct {
+	AdvertSummary
+	// At is when the advertisement was published. Times are kept in chain
+	// order despite clock skew, so it is the latest publish time of the
+	// advertisement and those before it in the chain, which is also the time of
+	// those whose own publish time is unknown
+	At time.Time
+}
+
+// Window summarizes the advertisements published in a window of time
+type Window struct {
+	From, To time.Time
+	// Head is the head of the chain at the end of the window, or nil if nothing
+	// was published before it
+	Head ipld.Link
+	// Adverts are the advertisements published in the window, oldest first, up
+	// to the limit asked for
+	Adverts []TimedAdvert
+	// Truncated is whether there were more advertisements than those listed.
+	// The totals are over every advertisement in the window
+	Truncated  bool
+	Total      int
+	Entries    int64
+	Removals   int
+	ContextIDs int
+}
+
+// timelineKey orders advertisements by time, then by position in the chain
+func timelineKey(at time.Time, seq uint64) datastore.Key {
+	return timelinePrefix.ChildString(fmt.Sprintf("%020d-%020d", timelineNanos(at), seq))
+}
+
+func timelineNanos(at time.Time) int64 {
+	if at.IsZero() || at.UnixNano() < 0 {
+		return 0
+	}
+	return at.UnixNano()
+}
+
+func parseTimelineKey(key string) (time.Time, uint64, error) {
+	at, seq, ok := strings.Cut(datastore.NewKey(key).BaseNamespace(), "-")
+	if !ok {
+		return time.Time{}, 0, fmt.Errorf("invalid timeline key %q", key)
+	}
+	nanos, err := strconv.ParseInt(at, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid timeline key %q: %w", key, err)
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid timeline key %q: %w", key, err)
+	}
+	return time.Unix(0, nanos).UTC(), n, nil
+}
+
+// timelineAt returns the time an advertisement is indexed at, given its publish
+// time, which may be unknown, and the time of the advertisement before it
+func timelineAt(published, latest time.Time) time.Time {
+	if latest.After(published) {
+		return latest
+	}
+	return published
+}
+
+func putTimeline(ctx context.Context, w datastore.Write, s AdvertSummary, at time.Time) error {
+	return w.Put(ctx, timelineKey(at, s.Seq), s.Link.Bytes())
+}
+
+// timelineLatest returns the time of the newest advertisement on the timeline,
+// or the zero time if there is none
+func (p *Publisher) timelineLatest(ctx context.Context) (time.Time, error) {
+	results, err := p.ds.Query(ctx, query.Query{
+		Prefix:   timelinePrefix.String(),
+		Orders:   []query.Order{query.OrderByKeyDescending{}},
+		Limit:    1,
+		KeysOnly: true,
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("reading timeline: %w", err)
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("reading timeline: %w", err)
+	}
+	if len(entries) == 0 {
+		return time.Time{}, nil
+	}
+	at, _, err := parseTimelineKey(entries[0].Key)
+	return at, err
+}
+
+// ChainAt returns the head of the chain as of the time, which is the newest
+// advertisement published at or before it, or nil if there was none
+func (p *Publisher) ChainAt(ctx context.Context, t time.Time) (ipld.Link, error) {
+	return p.chainBefore(ctx, t.Add(time.Nanosecond))
+}
+
+// chainBefore returns the newest advertisement published before the time
+func (p *Publisher) chainBefore(ctx context.Context, t time.Time) (ipld.Link, error) {
+	results, err := p.ds.Query(ctx, query.Query{
+		Prefix:  timelinePrefix.String(),
+		Filters: []query.Filter{query.FilterKeyCompare{Op: query.LessThan, Key: timelineKey(t, 0).String()}},
+		Orders:  []query.Order{query.OrderByKeyDescending{}},
+		Limit:   1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading timeline: %w", err)
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, fmt.Errorf("reading timeline: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	c, err := cid.Cast(entries[0].Value)
+	if err != nil {
+		return nil, fmt.Errorf("decoding timeline entry: %w", err)
+	}
+	return cidlink.Link{Cid: c}, nil
+}
+
+// timeline iterates the advertisements published at or after from and before
+// to, oldest first
+func (p *Publisher) timeline(ctx context.Context, from, to time.Time) iter.Seq2[TimedAdvert, error] {
+	return func(yield func(TimedAdvert, error) bool) {
+		results, err := p.ds.Query(ctx, query.Query{
+			Prefix: timelinePrefix.String(),
+			Filters: []query.Filter{
+				query.FilterKeyCompare{Op: query.GreaterThanOrEqual, Key: timelineKey(from, 0).String()},
+				query.FilterKeyCompare{Op: query.LessThan, Key: timelineKey(to, 0).String()},
+			},
+			Orders: []query.Order{query.OrderByKey{}},
+		})
+		if err != nil {
+			yield(TimedAdvert{}, fmt.Errorf("reading timeline: %w", err))
+			return
+		}
+		defer results.Close()
+		for result := range results.Next() {
+			if result.Error != nil {
+				yield(TimedAdvert{}, fmt.Errorf("reading timeline: %w", result.Error))
+				return
+			}
+			at, seq, err := parseTimelineKey(result.Key)
+			if err != nil {
+				yield(TimedAdvert{}, err)
+				return
+			}
+			data, err := p.ds.Get(ctx, summaryKey(seq))
+			if err != nil {
+				yield(TimedAdvert{}, fmt.Errorf("reading advertisement summary %d: %w", seq, err))
+				return
+			}
+			s, err := decodeSummary(data)
+			if !yield(TimedAdvert{AdvertSummary: s, At: at}, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// AdvertsBetween iterates the advertisements published at or after from and
+// before to, oldest first
+func (p *Publisher) AdvertsBetween(ctx context.Context, from, to time.Time) iter.Seq2[schema.Advertisement, error] {
+	return func(yield func(schema.Advertisement, error) bool) {
+		for timed, err := range p.timeline(ctx, from, to) {
+			if err != nil {
+				yield(schema.Advertisement{}, err)
+				return
+			}
+			adv, err := p.advertisement(ctx, cidlink.Link{Cid: timed.Link})
+			if !yield(adv, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Window summarizes the advertisements published at or after from and before
+// to, listing up to limit of them, or all of them if it is zero
+func (p *Publisher) Window(ctx context.Context, from, to time.Time, limit int) (Window, error) {
+	head, err := p.chainBefore(ctx, to)
+	if err != nil {
+		return Window{}, err
+	}
+	w := Window{From: from, To: to, Head: head, Adverts: []TimedAdvert{}}
+	contextIDs := map[string]struct{}{}
+	for timed, err := range p.timeline(ctx, from, to) {
+		if err != nil {
+			return Window{}, err
+		}
+		w.Total++
+		w.Entries += int64(timed.Entries)
+		if timed.Removal {
+			w.Removals++
+		}
+		contextIDs[string(timed.ContextID)] = struct{}{}
+		if limit > 0 && len(w.Adverts) == limit {
+			w.Truncated = true
+			continue
+		}
+		w.Adverts = append(w.Adverts, timed)
+	}
+	w.ContextIDs = len(contextIDs)
+	return w, nil
+}
+
+// publishTimes returns when each advertisement was published according to the
+// operation log, for backfilling the timeline of chains whose summaries are
+// missing publish times
+func (p *Publisher) publishTimes(ctx context.Context) (map[cid.Cid]time.Time, error) {
+	times := map[cid.Cid]time.Time{}
+	for op, err := range p.Operations(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		if !op.Advert.Defined() {
+			continue
+		}
+		if _, ok := times[op.Advert]; !ok {
+			times[op.Advert] = op.At
+		}
+	}
+	return times, nil
+}
@@ -0,0 +1,133 @@
+package publisher_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeline(t *testing.T) {
+	ctx := context.Background()
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	provider := peer.AddrInfo{ID: testutil.RandomPeer()}
+	at := func(s int64) time.Time { return time.Unix(s, 0).UTC() }
+
+	// the third advertisement is published by a clock behind the others
+	times := []time.Time{at(1000), at(2000), at(1500), at(3000)}
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	var next int
+	p := publisher.New(ds, key, publisher.WithClock(func() time.Time {
+		next++
+		return times[next-1]
+	}))
+	var links []ipld.Link
+	var contextIDs [][]byte
+	for i := range times {
+		contextIDs = append(contextIDs, testutil.RandomBytes(10))
+		links = append(links, testutil.Must(p.Publish(ctx, provider, contextIDs[i], testutil.RandomBytes(10), testutil.RandomMultihashes(i+1)))(t))
+	}
+	// removals are on the timeline too
+	times = append(times, at(4000))
+	links = append(links, testutil.Must(p.Remove(ctx, provider, contextIDs[0]))(t))
+	contextIDs = append(contextIDs, contextIDs[0])
+
+	chainAt := func(t *testing.T, p *publisher.Publisher) map[int64]ipld.Link {
+		heads := map[int64]ipld.Link{}
+		for _, s := range []int64{999, 1000, 1500, 1999, 2000, 2999, 3000, 4000, 5000} {
+			heads[s] = testutil.Must(p.ChainAt(ctx, at(s)))(t)
+		}
+		return heads
+	}
+	between := func(t *testing.T, from, to int64) [][]byte {
+		var ids [][]byte
+		for adv, err := range p.AdvertsBetween(ctx, at(from), at(to)) {
+			require.NoError(t, err)
+			ids = append(ids, adv.ContextID)
+		}
+		return ids
+	}
+
+	t.Run("head as of a time", func(t *testing.T) {
+		require.Equal(t, map[int64]ipld.Link{
+			999:  nil,
+			1000: links[0],
+			// the skewed advertisement isn't before the one it follows
+			1500: links[0],
+			1999: links[0],
+			2000: links[2],
+			2999: links[2],
+			3000: links[3],
+			4000: links[4],
+			5000: links[4],
+		}, chainAt(t, p))
+	})
+
+	t.Run("advertisements between times", func(t *testing.T) {
+		require.Empty(t, between(t, 0, 1000))
+		require.Equal(t, contextIDs[:1], between(t, 1000, 2000))
+		require.Equal(t, contextIDs[:3], between(t, 1000, 2001))
+		require.Equal(t, contextIDs[1:3], between(t, 1500, 3000))
+		require.Equal(t, contextIDs[3:4], between(t, 3000, 4000))
+		require.Equal(t, contextIDs, between(t, 0, 5000))
+	})
+
+	t.Run("window summary", func(t *testing.T) {
+		w := testutil.Must(p.Window(ctx, at(2000), at(5000), 2))(t)
+		require.Equal(t, links[4], w.Head)
+		require.Equal(t, 4, w.Total)
+		require.True(t, w.Truncated)
+		require.Len(t, w.Adverts, 2)
+		require.Equal(t, links[1].String(), w.Adverts[0].Link.String())
+		require.Equal(t, at(2000), w.Adverts[0].At)
+		require.Equal(t, at(2000), w.Adverts[1].At)
+		require.Equal(t, at(1500), w.Adverts[1].Published)
+		require.Equal(t, int64(2+3+4), w.Entries)
+		require.Equal(t, 1, w.Removals)
+		require.Equal(t, 4, w.ContextIDs)
+
+		empty := testutil.Must(p.Window(ctx, at(0), at(1000), 0))(t)
+		require.Nil(t, empty.Head)
+		require.Zero(t, empty.Total)
+		require.Empty(t, empty.Adverts)
+	})
+
+	deleteAll := func(t *testing.T, prefix string) {
+		results := testutil.Must(ds.Query(ctx, query.Query{Prefix: prefix, KeysOnly: true}))(t)
+		for result := range results.Next() {
+			require.NoError(t, ds.Delete(ctx, datastore.NewKey(result.Key)))
+		}
+	}
+
+	t.Run("rebuild backfills times from the operation log", func(t *testing.T) {
+		expected := chainAt(t, p)
+		deleteAll(t, "/summary")
+		deleteAll(t, "/timeline")
+		require.Nil(t, testutil.Must(p.ChainAt(ctx, at(5000)))(t))
+
+		testutil.Must(p.RebuildSummary(ctx))(t)
+		require.Equal(t, expected, chainAt(t, p))
+	})
+
+	t.Run("rebuild falls back to chain order", func(t *testing.T) {
+		deleteAll(t, "/summary")
+		deleteAll(t, "/timeline")
+		deleteAll(t, "/oplog")
+
+		testutil.Must(p.RebuildSummary(ctx))(t)
+		// with no known times, every advertisement is as old as can be
+		for _, head := range chainAt(t, p) {
+			require.Equal(t, links[4], head)
+		}
+		require.Equal(t, contextIDs, between(t, 0, 1))
+	})
+}
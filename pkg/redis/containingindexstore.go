@@ -0,0 +1,126 @@
+package redis
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	multihash "github.com/multiformats/go-multihash"
+	"github.com/redis/go-redis/v9"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// DefaultMaxContainingIndexes is the number of indexes kept for each block by
+// a containing index store, if not otherwise configured
+const DefaultMaxContainingIndexes = 16
+
+// ContainingIndexClient is the subset of functions from the golang redis client
+// used by the containing index store
+type ContainingIndexClient interface {
+	ZAdd(ctx context.Context, key string, members ...redis.Z) *redis.IntCmd
+	ZRemRangeByRank(ctx context.Context, key string, start, stop int64) *redis.IntCmd
+	ZRemRangeByScore(ctx context.Context, key, min, max string) *redis.IntCmd
+	ZRevRangeByScore(ctx context.Context, key string, opt *redis.ZRangeBy) *redis.StringSliceCmd
+	Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd
+}
+
+var (
+	_ ContainingIndexClient      = (*redis.Client)(nil)
+	_ types.ContainingIndexStore = (*ContainingIndexStore)(nil)
+)
+
+// ContainingIndexStore records the indexes each block was found in, in a sorted
+// set per block scored by when each entry expires. Entries expire after
+// DefaultExpire, as the indexes they refer to do, and only the entries expiring
+// last are kept once a block is in more than the maximum number of indexes
+type ContainingIndexStore struct {
+	client     ContainingIndexClient
+	maxIndexes int
+}
+
+// NewContainingIndexStore returns a new containing index store using the given
+// redis client, keeping up to maxIndexes indexes per block. If maxIndexes is
+// zero, DefaultMaxContainingIndexes is used
+func NewContainingIndexStore(client ContainingIndexClient, maxIndexes int) *ContainingIndexStore {
+	if maxIndexes <= 0 {
+		maxIndexes = DefaultMaxContainingIndexes
+	}
+	return &ContainingIndexStore{client: client, maxIndexes: maxIndexes}
+}
+
+// Add records that the blocks are in the index
+func (s *ContainingIndexStore) Add(ctx context.Context, ref types.IndexRef, hashes []multihash.Multihash) error {
+	member := indexRefMember(ref)
+	now := time.Now()
+	expires := float64(now.Add(DefaultExpire).UnixMicro())
+	for _, hash := range hashes {
+		key := containingIndexesKey(hash)
+		if err := s.client.ZAdd(ctx, key, redis.Z{Score: expires, Member: member}).Err(); err != nil {
+			return fmt.Errorf("error accessing redis: %w", err)
+		}
+		// drop all but the entries expiring last, which were added most recently
+		if err := s.client.ZRemRangeByRank(ctx, key, 0, -int64(s.maxIndexes)-1).Err(); err != nil {
+			return fmt.Errorf("error accessing redis: %w", err)
+		}
+		if err := s.client.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(now.UnixMicro(), 10)).Err(); err != nil {
+			return fmt.Errorf("error accessing redis: %w", err)
+		}
+		// the set outlives none of its entries
+		if err := s.client.Expire(ctx, key, DefaultExpire).Err(); err != nil {
+			return fmt.Errorf("error accessing redis: %w", err)
+		}
+	}
+	return nil
+}
+
+// Get returns the unexpired indexes the block is in, most recently added first
+func (s *ContainingIndexStore) Get(ctx context.Context, hash multihash.Multihash) ([]types.IndexRef, error) {
+	members, err := s.client.ZRevRangeByScore(ctx, containingIndexesKey(hash), &redis.ZRangeBy{
+		Min: strconv.FormatInt(time.Now().UnixMicro(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error accessing redis: %w", err)
+	}
+	refs := make([]types.IndexRef, 0, len(members))
+	for _, member := range members {
+		ref, err := parseIndexRefMember(member)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+func containingIndexesKey(hash multihash.Multihash) string {
+	return "containing:" + string(hash)
+}
+
+// indexRefMember encodes a reference as a sorted set member. A reference always
+// encodes to the same member, so adding it again only renews it
+func indexRefMember(ref types.IndexRef) string {
+	return base64.RawStdEncoding.EncodeToString(ref.ContextID) + " " + ref.Content.B58String()
+}
+
+func parseIndexRefMember(member string) (types.IndexRef, error) {
+	contextID, content, ok := strings.Cut(member, " ")
+	if !ok {
+		return types.IndexRef{}, fmt.Errorf("decoding containing index entry: %q", member)
+	}
+	decoded, err := base64.RawStdEncoding.DecodeString(contextID)
+	if err != nil {
+		return types.IndexRef{}, fmt.Errorf("decoding containing index entry: %w", err)
+	}
+	ref := types.IndexRef{ContextID: decoded}
+	if content != "" {
+		ref.Content, err = multihash.FromB58String(content)
+		if err != nil {
+			return types.IndexRef{}, fmt.Errorf("decoding containing index entry: %w", err)
+		}
+	}
+	return ref, nil
+}
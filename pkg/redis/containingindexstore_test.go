@@ -0,0 +1,142 @@
+package redis_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainingIndexStore(t *testing.T) {
+	ctx := context.Background()
+	newRef := func() types.IndexRef {
+		return types.IndexRef{ContextID: testutil.RandomBytes(16), Content: testutil.RandomMultihash()}
+	}
+
+	t.Run("most recent first", func(t *testing.T) {
+		sets := NewMockSortedSets()
+		store := redis.NewContainingIndexStore(sets, 0)
+		block := testutil.RandomMultihash()
+		refs := []types.IndexRef{newRef(), newRef(), newRef()}
+		for _, ref := range refs {
+			require.NoError(t, store.Add(ctx, ref, []multihash.Multihash{block, testutil.RandomMultihash()}))
+			time.Sleep(time.Millisecond)
+		}
+		found := testutil.Must(store.Get(ctx, block))(t)
+		require.Equal(t, []types.IndexRef{refs[2], refs[1], refs[0]}, found)
+		require.Contains(t, sets.expiries, "containing:"+string(block))
+	})
+
+	t.Run("adding again renews", func(t *testing.T) {
+		store := redis.NewContainingIndexStore(NewMockSortedSets(), 0)
+		block := testutil.RandomMultihash()
+		first, second := newRef(), newRef()
+		require.NoError(t, store.Add(ctx, first, []multihash.Multihash{block}))
+		time.Sleep(time.Millisecond)
+		require.NoError(t, store.Add(ctx, second, []multihash.Multihash{block}))
+		time.Sleep(time.Millisecond)
+		require.NoError(t, store.Add(ctx, first, []multihash.Multihash{block}))
+		found := testutil.Must(store.Get(ctx, block))(t)
+		require.Equal(t, []types.IndexRef{first, second}, found)
+	})
+
+	t.Run("keeps the most recent indexes", func(t *testing.T) {
+		store := redis.NewContainingIndexStore(NewMockSortedSets(), 2)
+		block := testutil.RandomMultihash()
+		refs := []types.IndexRef{newRef(), newRef(), newRef(), newRef()}
+		for _, ref := range refs {
+			require.NoError(t, store.Add(ctx, ref, []multihash.Multihash{block}))
+			time.Sleep(time.Millisecond)
+		}
+		found := testutil.Must(store.Get(ctx, block))(t)
+		require.Equal(t, []types.IndexRef{refs[3], refs[2]}, found)
+	})
+
+	t.Run("index without content", func(t *testing.T) {
+		store := redis.NewContainingIndexStore(NewMockSortedSets(), 0)
+		block := testutil.RandomMultihash()
+		ref := types.IndexRef{ContextID: testutil.RandomBytes(16)}
+		require.NoError(t, store.Add(ctx, ref, []multihash.Multihash{block}))
+		found := testutil.Must(store.Get(ctx, block))(t)
+		require.Len(t, found, 1)
+		require.Equal(t, ref.ContextID, found[0].ContextID)
+		require.Empty(t, found[0].Content)
+	})
+
+	t.Run("unknown block", func(t *testing.T) {
+		store := redis.NewContainingIndexStore(NewMockSortedSets(), 0)
+		found := testutil.Must(store.Get(ctx, testutil.RandomMultihash()))(t)
+		require.Empty(t, found)
+	})
+}
+
+var _ redis.ContainingIndexClient = (*MockSortedSets)(nil)
+
+func (m *MockSortedSets) ZRemRangeByRank(ctx context.Context, key string, start, stop int64) *goredis.IntCmd {
+	members := m.zrange(ctx, key, &goredis.ZRangeBy{}, func(string, float64) bool { return true }).Val()
+	n := int64(len(members))
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if stop < 0 {
+		stop = n + stop
+	}
+	stop = min(stop, n-1)
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	var removed int64
+	for i := start; i <= stop; i++ {
+		delete(m.sets[key], members[i])
+		removed++
+	}
+	cmd := goredis.NewIntCmd(ctx)
+	cmd.SetVal(removed)
+	return cmd
+}
+
+func (m *MockSortedSets) ZRemRangeByScore(ctx context.Context, key, min, max string) *goredis.IntCmd {
+	members := m.zrange(ctx, key, &goredis.ZRangeBy{}, func(_ string, score float64) bool {
+		return scoreInRange(score, min, max)
+	}).Val()
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	for _, member := range members {
+		delete(m.sets[key], member)
+	}
+	cmd := goredis.NewIntCmd(ctx)
+	cmd.SetVal(int64(len(members)))
+	return cmd
+}
+
+func (m *MockSortedSets) ZRevRangeByScore(ctx context.Context, key string, opt *goredis.ZRangeBy) *goredis.StringSliceCmd {
+	cmd := m.zrange(ctx, key, &goredis.ZRangeBy{}, func(_ string, score float64) bool {
+		return scoreInRange(score, opt.Min, opt.Max)
+	})
+	members := cmd.Val()
+	slices.Reverse(members)
+	members = members[min(int(opt.Offset), len(members)):]
+	if opt.Count > 0 {
+		members = members[:min(int(opt.Count), len(members))]
+	}
+	cmd.SetVal(members)
+	return cmd
+}
+
+func (m *MockSortedSets) Expire(ctx context.Context, key string, expiration time.Duration) *goredis.BoolCmd {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if m.expiries == nil {
+		m.expiries = map[string]time.Duration{}
+	}
+	m.expiries[key] = expiration
+	cmd := goredis.NewBoolCmd(ctx)
+	cmd.SetVal(true)
+	return cmd
+}
@@ -1,10 +1,14 @@
 package redis
 
 import (
-	"io"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
 
 	cid "github.com/ipfs/go-cid"
 	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/delegationutil"
 	"github.com/storacha/indexing-service/pkg/types"
 )
 
@@ -12,25 +16,62 @@ var (
 	_ types.ContentClaimsStore = (*ContentClaimsStore)(nil)
 )
 
+// claimEnvelopeMagic starts every enveloped claim. The archive of a claim is a
+// CARv1, which starts with the length of its header: a varint whose first
+// byte is below 0x80 for any header with a single root, so the two can't be
+// confused
+const claimEnvelopeMagic = 0xc1
+
+// claimEnvelopeFormat is the version of the claim envelope written
+const claimEnvelopeFormat = 1
+
 // ContentClaimsStore is a RedisStore for storing content claims that implements types.ContentClaimsStore
 type ContentClaimsStore = Store[cid.Cid, delegation.Delegation]
 
 // NewContentClaimsStore returns a new instance of a Content Claims Store using the given redis client
-func NewContentClaimsStore(client Client) *ContentClaimsStore {
-	return &Store[cid.Cid, delegation.Delegation]{delegationFromRedis, delegationToRedis, cidKeyString, client}
+func NewContentClaimsStore(client Client, opts ...Option) *ContentClaimsStore {
+	return NewStore(delegationFromRedis, delegationToRedis, cidKeyString, client, opts...)
 }
 
+// delegationFromRedis reads an enveloped claim, checking its format and
+// checksum. Claims cached before they were enveloped are read as the plain
+// archive they were cached as
 func delegationFromRedis(data string) (delegation.Delegation, error) {
-	return delegation.Extract([]byte(data))
+	if len(data) == 0 || data[0] != claimEnvelopeMagic {
+		return delegation.Extract([]byte(data))
+	}
+	raw := []byte(data[1:])
+	if len(raw) < sha256.Size {
+		return nil, fmt.Errorf("%w: truncated claim envelope", types.ErrCorruptEntry)
+	}
+	raw, sum := raw[:len(raw)-sha256.Size], raw[len(raw)-sha256.Size:]
+	if expected := sha256.Sum256(raw); !bytes.Equal(sum, expected[:]) {
+		return nil, fmt.Errorf("%w: claim checksum mismatch", types.ErrCorruptEntry)
+	}
+	format, n := binary.Uvarint(raw)
+	if n <= 0 {
+		return nil, fmt.Errorf("%w: truncated claim envelope", types.ErrCorruptEntry)
+	}
+	if format != claimEnvelopeFormat {
+		return nil, fmt.Errorf("unknown claim envelope format: %d", format)
+	}
+	return delegation.Extract(raw[n:])
 }
 
+// delegationToRedis stores the canonical archive, so that every archive of a
+// claim is cached as the same entry, in an envelope of its format and a
+// SHA-256 checksum
 func delegationToRedis(d delegation.Delegation) (string, error) {
-	r := delegation.Archive(d)
-	data, err := io.ReadAll(r)
+	archive, err := delegationutil.Canonicalize(d)
 	if err != nil {
 		return "", err
 	}
-	return string(data), nil
+	data := make([]byte, 0, len(archive)+sha256.Size+3)
+	data = append(data, claimEnvelopeMagic)
+	data = binary.AppendUvarint(data, claimEnvelopeFormat)
+	data = append(data, archive...)
+	sum := sha256.Sum256(data[1:])
+	return string(append(data, sum[:]...)), nil
 }
 
 func cidKeyString(c cid.Cid) string {
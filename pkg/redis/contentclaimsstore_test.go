@@ -7,13 +7,16 @@ import (
 	"testing"
 
 	cid "github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	mh "github.com/multiformats/go-multihash"
 	"github.com/storacha/go-ucanto/core/delegation"
 	"github.com/storacha/go-ucanto/ucan"
 	"github.com/storacha/indexing-service/pkg/capability/assert"
 	adm "github.com/storacha/indexing-service/pkg/capability/assert/datamodel"
+	"github.com/storacha/indexing-service/pkg/delegationutil"
 	"github.com/storacha/indexing-service/pkg/internal/testutil"
 	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/types"
 	"github.com/stretchr/testify/require"
 )
 
@@ -51,3 +54,60 @@ func TestContentClaimsStore(t *testing.T) {
 	testutil.RequireEqualDelegation(t, delegation1, returnedDelegation1)
 	testutil.RequireEqualDelegation(t, delegation2, returnedDelegation2)
 }
+
+func TestContentClaimsStore__Envelope(t *testing.T) {
+	ctx := context.Background()
+	claim := testutil.RandomLocationDelegation()
+	claimCid := testutil.RandomCID().(cidlink.Link).Cid
+	entry := func(mockRedis *MockRedis) *redisValue {
+		require.Len(t, mockRedis.data, 1)
+		for _, value := range mockRedis.data {
+			return value
+		}
+		return nil
+	}
+
+	t.Run("claims are checked against their checksum", func(t *testing.T) {
+		mockRedis := NewMockRedis()
+		store := redis.NewContentClaimsStore(mockRedis)
+		require.NoError(t, store.Set(ctx, claimCid, claim, false))
+		testutil.RequireEqualDelegation(t, claim, testutil.Must(store.Get(ctx, claimCid))(t))
+
+		value := entry(mockRedis)
+		corrupt := []byte(value.data)
+		corrupt[len(corrupt)/2] ^= 0xff
+		value.data = string(corrupt)
+		_, err := store.Get(ctx, claimCid)
+		require.ErrorIs(t, err, types.ErrCorruptEntry)
+
+		value.data = value.data[:10]
+		_, err = store.Get(ctx, claimCid)
+		require.ErrorIs(t, err, types.ErrCorruptEntry)
+	})
+
+	t.Run("claims cached before they were enveloped are read", func(t *testing.T) {
+		mockRedis := NewMockRedis()
+		store := redis.NewContentClaimsStore(mockRedis)
+		require.NoError(t, store.Set(ctx, claimCid, claim, false))
+		entry(mockRedis).data = string(testutil.Must(delegationutil.Canonicalize(claim))(t))
+		testutil.RequireEqualDelegation(t, claim, testutil.Must(store.Get(ctx, claimCid))(t))
+	})
+}
+
+func TestContentClaimsStore__CanonicalEntries(t *testing.T) {
+	ctx := context.Background()
+	claim := testutil.RandomLocationDelegation()
+	claimCid := testutil.RandomCID().(cidlink.Link).Cid
+	// the same claim, as archived by two clients
+	var entries []string
+	for _, archive := range [][]byte{testutil.Must(io.ReadAll(claim.Archive()))(t), testutil.ReorderedArchive(t, claim)} {
+		mockRedis := NewMockRedis()
+		store := redis.NewContentClaimsStore(mockRedis)
+		require.NoError(t, store.Set(ctx, claimCid, testutil.Must(delegation.Extract(archive))(t), false))
+		require.Len(t, mockRedis.data, 1)
+		for _, value := range mockRedis.data {
+			entries = append(entries, value.data)
+		}
+	}
+	require.Equal(t, entries[0], entries[1])
+}
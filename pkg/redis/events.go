@@ -0,0 +1,324 @@
+package redis
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("redis")
+
+const (
+	// DefaultEventBuffer is the number of cache events waiting for the sink
+	// when not otherwise configured
+	DefaultEventBuffer = 1024
+	// DefaultTrackedExpiries is the number of expiring keys each store
+	// remembers the expire time of, to tell expired keys from missing ones,
+	// when not otherwise configured
+	DefaultTrackedExpiries = 100_000
+)
+
+// CacheEventType is the kind of a cache event
+type CacheEventType string
+
+const (
+	// EventReadHit is a read that found a value
+	EventReadHit CacheEventType = "read-hit"
+	// EventReadMiss is a read that found no value
+	EventReadMiss CacheEventType = "read-miss"
+	// EventWrite is a value written
+	EventWrite CacheEventType = "write"
+	// EventWriteSkipped is a value not written because the cache's admission
+	// policy rejected it
+	EventWriteSkipped CacheEventType = "write-skipped-by-admission"
+	// EventDelete is a value deleted
+	EventDelete CacheEventType = "delete"
+	// EventExpireDetected is a read that found no value where the store had
+	// written one that has since expired
+	EventExpireDetected CacheEventType = "expire-detected"
+	// EventCorruptionDetected is a read that found a value that couldn't be
+	// decoded
+	EventCorruptionDetected CacheEventType = "corruption-detected"
+)
+
+// CacheEvent is an event in the lifecycle of a cached value
+type CacheEvent struct {
+	Type CacheEventType
+	// Store is the name of the store, such as types.ProvidersCache
+	Store string
+	// Key is the hex encoded sha256 digest of the redis key, so that events do
+	// not reveal what was cached
+	Key string
+	// Size is the size in bytes of the encoded value, if there is one
+	Size int
+	// TTL is the time to live of written values, zero if they don't expire
+	TTL  time.Duration
+	Time time.Time
+}
+
+// CacheEventSink receives cache events. It is called from a single goroutine,
+// and events are dropped while it is slow to return
+type CacheEventSink interface {
+	CacheEvent(event CacheEvent)
+}
+
+// CacheEventMetrics is told of cache events dropped because the sink fell
+// behind
+type CacheEventMetrics interface {
+	CacheEventDropped()
+}
+
+type noopCacheEventMetrics struct{}
+
+func (noopCacheEventMetrics) CacheEventDropped() {}
+
+// CacheEventsOption configures CacheEvents
+type CacheEventsOption func(*CacheEvents)
+
+// WithEventBuffer sets the number of events that may wait for the sink, past
+// which they are dropped. If not set, DefaultEventBuffer is used
+func WithEventBuffer(n int) CacheEventsOption {
+	return func(e *CacheEvents) {
+		e.buffer = n
+	}
+}
+
+// WithTrackedExpiries sets the number of expiring keys each store remembers
+// the expire time of. If not set, DefaultTrackedExpiries is used
+func WithTrackedExpiries(n int) CacheEventsOption {
+	return func(e *CacheEvents) {
+		e.tracked = n
+	}
+}
+
+// WithEventMetrics reports the events dropped
+func WithEventMetrics(m CacheEventMetrics) CacheEventsOption {
+	return func(e *CacheEvents) {
+		e.metrics = m
+	}
+}
+
+// WithEventClock sets the clock events are timed by
+func WithEventClock(now func() time.Time) CacheEventsOption {
+	return func(e *CacheEvents) {
+		e.now = now
+	}
+}
+
+// CacheEvents delivers the events of the stores given it with WithCacheEvents
+// to a sink, in the background through a bounded buffer, so that a slow sink
+// never slows down the stores
+type CacheEvents struct {
+	sink    CacheEventSink
+	buffer  int
+	tracked int
+	metrics CacheEventMetrics
+	now     func() time.Time
+	dropped atomic.Uint64
+	queue   chan CacheEvent
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+// NewCacheEvents returns events delivered to the sink once started
+func NewCacheEvents(sink CacheEventSink, opts ...CacheEventsOption) *CacheEvents {
+	e := &CacheEvents{
+		sink:    sink,
+		buffer:  DefaultEventBuffer,
+		tracked: DefaultTrackedExpiries,
+		metrics: noopCacheEventMetrics{},
+		now:     time.Now,
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	e.queue = make(chan CacheEvent, e.buffer)
+	return e
+}
+
+// Dropped returns the number of events dropped because the buffer was full
+func (e *CacheEvents) Dropped() uint64 {
+	return e.dropped.Load()
+}
+
+// Startup starts delivering events in the background (returns immediately)
+func (e *CacheEvents) Startup() {
+	go e.run()
+}
+
+// Shutdown stops delivering events once those buffered are, returning when
+// they are or the passed context cancels
+func (e *CacheEvents) Shutdown(ctx context.Context) error {
+	close(e.closing)
+	select {
+	case <-e.closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *CacheEvents) run() {
+	defer close(e.closed)
+	for {
+		select {
+		case event := <-e.queue:
+			e.sink.CacheEvent(event)
+		case <-e.closing:
+			for {
+				select {
+				case event := <-e.queue:
+					e.sink.CacheEvent(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *CacheEvents) emit(event CacheEvent) {
+	select {
+	case e.queue <- event:
+	default:
+		e.dropped.Add(1)
+		e.metrics.CacheEventDropped()
+	}
+}
+
+// WithCacheEvents emits the events of the store, under the name given, to the
+// events
+func WithCacheEvents(events *CacheEvents, store string) Option {
+	return func(c *storeConfig) {
+		c.events = events
+		c.storeName = store
+	}
+}
+
+// storeEvents emits the events of a store, remembering the expire times of the
+// keys it wrote so that reads missing them after can be told apart
+type storeEvents struct {
+	*CacheEvents
+	store    string
+	lk       sync.Mutex
+	expiring *simplelru.LRU[string, time.Time]
+}
+
+func newStoreEvents(events *CacheEvents, store string) *storeEvents {
+	expiring, err := simplelru.NewLRU[string, time.Time](max(events.tracked, 1), nil)
+	if err != nil {
+		panic(err)
+	}
+	return &storeEvents{CacheEvents: events, store: store, expiring: expiring}
+}
+
+func (se *storeEvents) event(t CacheEventType, key string, size int, ttl time.Duration) CacheEvent {
+	digest := sha256.Sum256([]byte(key))
+	return CacheEvent{Type: t, Store: se.store, Key: hex.EncodeToString(digest[:]), Size: size, TTL: ttl, Time: se.now()}
+}
+
+func (se *storeEvents) hit(key string, size int) {
+	se.emit(se.event(EventReadHit, key, size, 0))
+}
+
+func (se *storeEvents) miss(key string) {
+	t := EventReadMiss
+	se.lk.Lock()
+	if expires, ok := se.expiring.Peek(key); ok {
+		if !se.now().Before(expires) {
+			t = EventExpireDetected
+		}
+		se.expiring.Remove(key)
+	}
+	se.lk.Unlock()
+	se.emit(se.event(t, key, 0, 0))
+}
+
+func (se *storeEvents) corrupt(key string, size int) {
+	se.emit(se.event(EventCorruptionDetected, key, size, 0))
+}
+
+// written emits a write of a value that expires after ttl, or never if it is
+// zero. A negative ttl keeps the expire time of the value it replaces
+func (se *storeEvents) written(key string, size int, ttl time.Duration) {
+	if ttl >= 0 {
+		se.expires(key, ttl)
+	}
+	se.emit(se.event(EventWrite, key, size, max(ttl, 0)))
+}
+
+func (se *storeEvents) skipped(key string, size int) {
+	se.emit(se.event(EventWriteSkipped, key, size, 0))
+}
+
+func (se *storeEvents) deleted(key string) {
+	se.lk.Lock()
+	se.expiring.Remove(key)
+	se.lk.Unlock()
+	se.emit(se.event(EventDelete, key, 0, 0))
+}
+
+// expires remembers the key expires after ttl, or never if it is zero
+func (se *storeEvents) expires(key string, ttl time.Duration) {
+	se.lk.Lock()
+	defer se.lk.Unlock()
+	if ttl == 0 {
+		se.expiring.Remove(key)
+		return
+	}
+	se.expiring.Add(key, se.now().Add(ttl))
+}
+
+// NDJSONSink writes each cache event as a line of JSON
+type NDJSONSink struct {
+	lk sync.Mutex
+	w  io.Writer
+}
+
+var _ CacheEventSink = (*NDJSONSink)(nil)
+
+// NewNDJSONSink returns a sink writing events to w
+func NewNDJSONSink(w io.Writer) *NDJSONSink {
+	return &NDJSONSink{w: w}
+}
+
+type cacheEventJSON struct {
+	Type  CacheEventType `json:"type"`
+	Store string         `json:"store"`
+	Key   string         `json:"key"`
+	Size  int            `json:"size,omitempty"`
+	// TTL is in seconds
+	TTL  float64   `json:"ttl,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// CacheEvent writes the event as a line of JSON. Failed writes are logged
+func (s *NDJSONSink) CacheEvent(event CacheEvent) {
+	line, err := json.Marshal(cacheEventJSON{
+		Type:  event.Type,
+		Store: event.Store,
+		Key:   event.Key,
+		Size:  event.Size,
+		TTL:   event.TTL.Seconds(),
+		Time:  event.Time,
+	})
+	if err != nil {
+		log.Errorw("encoding cache event", "error", err)
+		return
+	}
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		log.Errorw("writing cache event", "error", err)
+	}
+}
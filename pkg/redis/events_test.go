@@ -0,0 +1,164 @@
+package redis_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheEvents(t *testing.T) {
+	ctx := context.Background()
+	digest := func(key string) string {
+		d := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(d[:])
+	}
+	// values that are "corrupt" can't be decoded
+	fromRedis := func(data string) (string, error) {
+		if data == "corrupt" {
+			return "", errors.New("corrupt value")
+		}
+		return data, nil
+	}
+	newStore := func(client redis.Client, events *redis.CacheEvents) *redis.Store[string, string] {
+		return redis.NewStore(fromRedis, func(v string) (string, error) { return v, nil }, func(k string) string { return k }, client, redis.WithCacheEvents(events, "test"))
+	}
+
+	t.Run("a scripted flow emits its events in order", func(t *testing.T) {
+		now := time.Now()
+		sink := &recordingSink{}
+		events := redis.NewCacheEvents(sink, redis.WithEventClock(func() time.Time { return now }))
+		events.Startup()
+		mockRedis := NewMockRedis()
+		store := newStore(mockRedis, events)
+
+		_, err := store.Get(ctx, "key1")
+		require.ErrorIs(t, err, types.ErrKeyNotFound)
+		require.NoError(t, store.Set(ctx, "key1", "value1", true))
+		testutil.Must(store.Get(ctx, "key1"))(t)
+		require.NoError(t, store.Delete(ctx, "key1"))
+
+		require.NoError(t, store.SetWithTTL(ctx, "key2", "value22", time.Minute))
+		// redis expires the key once its TTL has passed
+		now = now.Add(2 * time.Minute)
+		mockRedis.Del(ctx, "key2")
+		_, err = store.Get(ctx, "key2")
+		require.ErrorIs(t, err, types.ErrKeyNotFound)
+
+		require.NoError(t, store.Set(ctx, "key3", "corrupt", false))
+		_, err = store.Get(ctx, "key3")
+		require.Error(t, err)
+		store.WriteSkipped("key4", 10)
+		require.NoError(t, events.Shutdown(ctx))
+
+		type event struct {
+			Type redis.CacheEventType
+			Key  string
+			Size int
+			TTL  time.Duration
+		}
+		var got []event
+		for _, e := range sink.events {
+			require.Equal(t, "test", e.Store)
+			got = append(got, event{e.Type, e.Key, e.Size, e.TTL})
+		}
+		require.Equal(t, []event{
+			{redis.EventReadMiss, digest("key1"), 0, 0},
+			{redis.EventWrite, digest("key1"), len("value1"), redis.DefaultExpire},
+			{redis.EventReadHit, digest("key1"), len("value1"), 0},
+			{redis.EventDelete, digest("key1"), 0, 0},
+			{redis.EventWrite, digest("key2"), len("value22"), time.Minute},
+			{redis.EventExpireDetected, digest("key2"), 0, 0},
+			{redis.EventWrite, digest("key3"), len("corrupt"), 0},
+			{redis.EventCorruptionDetected, digest("key3"), len("corrupt"), 0},
+			{redis.EventWriteSkipped, digest("key4"), 10, 0},
+		}, got)
+		require.Zero(t, events.Dropped())
+	})
+
+	t.Run("events are dropped while the sink is blocked", func(t *testing.T) {
+		sink := &blockedSink{received: make(chan struct{}, 1), release: make(chan struct{})}
+		metrics := &eventMetrics{}
+		events := redis.NewCacheEvents(sink, redis.WithEventBuffer(2), redis.WithEventMetrics(metrics))
+		events.Startup()
+		store := newStore(NewMockRedis(), events)
+
+		require.NoError(t, store.Set(ctx, "key", "value", true))
+		// the sink blocks on the first event
+		<-sink.received
+		for range 9 {
+			testutil.Must(store.Get(ctx, "key"))(t)
+		}
+		require.Equal(t, uint64(7), events.Dropped())
+		require.Equal(t, 7, metrics.dropped)
+
+		close(sink.release)
+		require.NoError(t, events.Shutdown(ctx))
+		require.Equal(t, 3, sink.count)
+	})
+
+	t.Run("the NDJSON sink writes a line an event", func(t *testing.T) {
+		var buf bytes.Buffer
+		at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		sink := redis.NewNDJSONSink(&buf)
+		sink.CacheEvent(redis.CacheEvent{Type: redis.EventWrite, Store: types.ClaimsCache, Key: digest("key"), Size: 5, TTL: time.Hour, Time: at})
+		sink.CacheEvent(redis.CacheEvent{Type: redis.EventReadMiss, Store: types.ClaimsCache, Key: digest("key"), Time: at})
+
+		decoder := json.NewDecoder(&buf)
+		var lines []map[string]any
+		for decoder.More() {
+			var line map[string]any
+			require.NoError(t, decoder.Decode(&line))
+			lines = append(lines, line)
+		}
+		require.Equal(t, []map[string]any{
+			{"type": "write", "store": "claims", "key": digest("key"), "size": 5.0, "ttl": 3600.0, "time": "2024-01-02T03:04:05Z"},
+			{"type": "read-miss", "store": "claims", "key": digest("key"), "time": "2024-01-02T03:04:05Z"},
+		}, lines)
+	})
+}
+
+type recordingSink struct {
+	events []redis.CacheEvent
+}
+
+func (s *recordingSink) CacheEvent(event redis.CacheEvent) {
+	s.events = append(s.events, event)
+}
+
+// blockedSink blocks on every event until released
+type blockedSink struct {
+	received chan struct{}
+	release  chan struct{}
+	count    int
+}
+
+func (s *blockedSink) CacheEvent(event redis.CacheEvent) {
+	select {
+	case s.received <- struct{}{}:
+	default:
+	}
+	<-s.release
+	s.count++
+}
+
+type eventMetrics struct {
+	lk      sync.Mutex
+	dropped int
+}
+
+func (m *eventMetrics) CacheEventDropped() {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.dropped++
+}
@@ -0,0 +1,70 @@
+package redis
+
+import (
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+var (
+	_ types.IndexBlobStore        = (*IndexBlobStore)(nil)
+	_ types.IndexDigestStore      = (*IndexDigestStore)(nil)
+	_ types.PopulationMarkerStore = (*PopulationMarkerStore)(nil)
+)
+
+// the key prefixes keep index blobs, the digests of context IDs and population
+// markers apart from the indexes cached by context ID
+const (
+	indexBlobKeyPrefix        = "indexblobs/"
+	indexDigestKeyPrefix      = "indexdigests/"
+	populationMarkerKeyPrefix = "populated/"
+)
+
+// IndexBlobStore is a RedisStore for storing sharded dag indexes by the digest of their blob that implements types.IndexBlobStore
+type IndexBlobStore = Store[mh.Multihash, blobindex.ShardedDagIndexView]
+
+// NewIndexBlobStore returns a new instance of an index blob store using the given redis client. It can share the
+// client of a ShardedDagIndexStore
+func NewIndexBlobStore(client Client, opts ...Option) *IndexBlobStore {
+	return NewStore(shardedDagIndexFromRedis, shardedDagIndexToRedis, indexBlobKeyString, client, opts...)
+}
+
+// IndexDigestStore is a RedisStore for storing the index blob digest of each context ID that implements types.IndexDigestStore
+type IndexDigestStore = Store[types.EncodedContextID, mh.Multihash]
+
+// NewIndexDigestStore returns a new instance of an index digest store using the given redis client. It can share the
+// client of a ShardedDagIndexStore
+func NewIndexDigestStore(client Client, opts ...Option) *IndexDigestStore {
+	return NewStore(indexDigestFromRedis, indexDigestToRedis, indexDigestKeyString, client, opts...)
+}
+
+// PopulationMarkerStore is a RedisStore for storing the index blob digest of each context ID whose provider records were
+// cached, that implements types.PopulationMarkerStore
+type PopulationMarkerStore = Store[types.EncodedContextID, mh.Multihash]
+
+// NewPopulationMarkerStore returns a new instance of a population marker store using the given redis client. It can share
+// the client of a ProviderStore, so that markers expire alongside the records they mark
+func NewPopulationMarkerStore(client Client, opts ...Option) *PopulationMarkerStore {
+	return NewStore(indexDigestFromRedis, indexDigestToRedis, populationMarkerKeyString, client, opts...)
+}
+
+func indexBlobKeyString(digest mh.Multihash) string {
+	return indexBlobKeyPrefix + string(digest)
+}
+
+func indexDigestKeyString(contextID types.EncodedContextID) string {
+	return indexDigestKeyPrefix + string(contextID)
+}
+
+func populationMarkerKeyString(contextID types.EncodedContextID) string {
+	return populationMarkerKeyPrefix + string(contextID)
+}
+
+func indexDigestFromRedis(data string) (mh.Multihash, error) {
+	_, digest, err := mh.MHFromBytes([]byte(data))
+	return digest, err
+}
+
+func indexDigestToRedis(digest mh.Multihash) (string, error) {
+	return string(digest), nil
+}
@@ -0,0 +1,34 @@
+package redis_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexBlobStore(t *testing.T) {
+	ctx := context.Background()
+	// the stores share a client with the indexes cached by context ID
+	mockRedis := NewMockRedis()
+	indexes := redis.NewShardedDagIndexStore(mockRedis)
+	blobs := redis.NewIndexBlobStore(mockRedis)
+	digests := redis.NewIndexDigestStore(mockRedis)
+	markers := redis.NewPopulationMarkerStore(mockRedis)
+
+	root, index := testutil.RandomShardedDagIndexView(32)
+	contextID := types.EncodedContextID(root.Hash())
+	digest := testutil.RandomMultihash()
+	require.NoError(t, blobs.Set(ctx, digest, index, true))
+	require.NoError(t, digests.Set(ctx, contextID, digest, true))
+
+	testutil.RequireEqualIndex(t, index, testutil.Must(blobs.Get(ctx, digest))(t))
+	require.Equal(t, digest, testutil.Must(digests.Get(ctx, contextID))(t))
+	_, err := indexes.Get(ctx, contextID)
+	require.ErrorIs(t, err, types.ErrKeyNotFound)
+	_, err = markers.Get(ctx, contextID)
+	require.ErrorIs(t, err, types.ErrKeyNotFound)
+}
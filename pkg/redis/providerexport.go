@@ -0,0 +1,257 @@
+package redis
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/multiformats/go-multibase"
+	multihash "github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+const (
+	// exportScanCount is the number of keys asked for by each SCAN of an export
+	exportScanCount = 100
+	// exportDedupWindow is the number of most recently exported keys carried in
+	// the cursor, so that keys SCAN returns again soon after aren't exported
+	// twice across calls
+	exportDedupWindow = 256
+)
+
+// ExportRow is a cached provider record, as written by an export
+type ExportRow struct {
+	// Multihash is the base58btc multibase multihash the record is cached for
+	Multihash string `json:"multihash"`
+	Provider  string `json:"provider"`
+	// Protocols are the names of the metadata protocols of the record, or their
+	// codes in hex for protocols without a name
+	Protocols []string `json:"protocols"`
+	// ContextID is the context ID of the record in hex
+	ContextID string `json:"contextID"`
+	// TTL is the seconds until the record expires, or -1 if it doesn't
+	TTL int64 `json:"ttl"`
+}
+
+var exportCSVHeader = []string{"multihash", "provider", "protocols", "contextID", "ttl"}
+
+// ExportProviderRecords writes a row for each cached provider record of up to
+// about limit hashes, starting at the cursor, and returns the cursor to
+// continue from. An empty cursor starts an export, and an empty next cursor is
+// returned once the export is done. A limit of zero or less exports every hash
+// in one call. CSV rows are preceded by a header row only at the start of an
+// export, so that the rows of successive calls can be concatenated.
+//
+// Hashes are iterated with SCAN, so every hash cached throughout an export is
+// exported, while hashes cached or evicted during it may or may not be. SCAN
+// may also return a hash more than once, particularly while redis resizes its
+// keyspace. A hash is exported at most once per call, and the most recently
+// exported hashes are carried in the cursor so that they aren't exported again
+// by the next call either, but a hash SCAN returns again much later is. A
+// call stops at the end of the SCAN batch in which the limit is reached, so it
+// may export up to a batch more than the limit. The client must be a
+// ScanClient and a TTLClient
+func (ps *ProviderStore) ExportProviderRecords(ctx context.Context, w io.Writer, format types.ExportFormat, cursor string, limit int) (string, error) {
+	sc, ok := ps.client.(ScanClient)
+	if !ok {
+		return "", fmt.Errorf("scanning: %w", ErrUnsupported)
+	}
+	tc, ok := ps.client.(TTLClient)
+	if !ok {
+		return "", fmt.Errorf("reading TTLs: %w", ErrUnsupported)
+	}
+	cur, err := decodeExportCursor(cursor)
+	if err != nil {
+		return "", err
+	}
+	rows, err := newExportWriter(w, format, cursor == "")
+	if err != nil {
+		return "", err
+	}
+	seen := make(map[uint64]struct{}, len(cur.recent))
+	for _, h := range cur.recent {
+		seen[h] = struct{}{}
+	}
+
+	exported := 0
+	for {
+		keys, next, err := sc.Scan(ctx, cur.scan, "", exportScanCount).Result()
+		if err != nil {
+			return "", fmt.Errorf("error accessing redis: %w", err)
+		}
+		for _, key := range keys {
+			hash, err := multihash.Cast([]byte(key))
+			if err != nil {
+				continue
+			}
+			h := keyHash(key)
+			if _, ok := seen[h]; ok {
+				continue
+			}
+			seen[h] = struct{}{}
+			cur.add(h)
+			n, err := ps.exportHash(ctx, tc, rows, hash)
+			if err != nil {
+				return "", err
+			}
+			exported += n
+		}
+		if err := rows.flush(); err != nil {
+			return "", fmt.Errorf("writing export: %w", err)
+		}
+		cur.scan = next
+		if next == 0 {
+			return "", nil
+		}
+		if limit > 0 && exported >= limit {
+			return cur.encode(), nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+	}
+}
+
+// exportHash writes the rows of the records of a hash, returning the number of
+// hashes exported, which is zero if it was evicted since it was scanned
+func (ps *ProviderStore) exportHash(ctx context.Context, tc TTLClient, rows *exportWriter, hash multihash.Multihash) (int, error) {
+	entry, err := ps.Store.Get(ctx, hash)
+	if err != nil {
+		if errors.Is(err, types.ErrKeyNotFound) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("reading records of %s: %w", hash.B58String(), err)
+	}
+	ttl, err := tc.TTL(ctx, multihashKeyString(hash)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("error accessing redis: %w", err)
+	}
+	// TTL replies with -2 for a key that doesn't exist and -1 for one that
+	// doesn't expire
+	if ttl == -2 {
+		return 0, nil
+	}
+	seconds := int64(-1)
+	if ttl >= 0 {
+		seconds = int64(ttl / time.Second)
+	}
+	encoded, err := multibase.Encode(multibase.Base58BTC, hash)
+	if err != nil {
+		return 0, fmt.Errorf("encoding multihash: %w", err)
+	}
+	for _, record := range entry.Records {
+		row := ExportRow{Multihash: encoded, Protocols: []string{}, ContextID: hex.EncodeToString(record.ContextID), TTL: seconds}
+		if record.Provider != nil {
+			row.Provider = record.Provider.ID.String()
+		}
+		for _, p := range metadata.DecodeProtocols(record.Metadata) {
+			name := metadata.ProtocolName(p.Code)
+			if name == "" {
+				name = "0x" + strconv.FormatUint(uint64(p.Code), 16)
+			}
+			row.Protocols = append(row.Protocols, name)
+		}
+		if err := rows.write(row); err != nil {
+			return 0, fmt.Errorf("writing export: %w", err)
+		}
+	}
+	return 1, nil
+}
+
+// exportWriter writes export rows in a format
+type exportWriter struct {
+	json *json.Encoder
+	csv  *csv.Writer
+}
+
+func newExportWriter(w io.Writer, format types.ExportFormat, start bool) (*exportWriter, error) {
+	switch format {
+	case types.ExportNDJSON:
+		return &exportWriter{json: json.NewEncoder(w)}, nil
+	case types.ExportCSV:
+		ew := &exportWriter{csv: csv.NewWriter(w)}
+		if start {
+			if err := ew.csv.Write(exportCSVHeader); err != nil {
+				return nil, fmt.Errorf("writing export: %w", err)
+			}
+		}
+		return ew, nil
+	}
+	return nil, fmt.Errorf("%w: %q", types.ErrInvalidExportFormat, format)
+}
+
+func (ew *exportWriter) write(row ExportRow) error {
+	if ew.json != nil {
+		return ew.json.Encode(row)
+	}
+	return ew.csv.Write([]string{row.Multihash, row.Provider, strings.Join(row.Protocols, ";"), row.ContextID, strconv.FormatInt(row.TTL, 10)})
+}
+
+func (ew *exportWriter) flush() error {
+	if ew.csv == nil {
+		return nil
+	}
+	ew.csv.Flush()
+	return ew.csv.Error()
+}
+
+// exportCursor is where an export continues from: the SCAN cursor, and hashes
+// of the keys most recently exported, oldest first
+type exportCursor struct {
+	scan   uint64
+	recent []uint64
+}
+
+func (c *exportCursor) add(h uint64) {
+	c.recent = append(c.recent, h)
+	if len(c.recent) > exportDedupWindow {
+		c.recent = c.recent[len(c.recent)-exportDedupWindow:]
+	}
+}
+
+// encode encodes the cursor as the uvarint SCAN cursor followed by the big
+// endian key hashes, in unpadded URL safe base64
+func (c *exportCursor) encode() string {
+	buf := binary.AppendUvarint(nil, c.scan)
+	for _, h := range c.recent {
+		buf = binary.BigEndian.AppendUint64(buf, h)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func decodeExportCursor(s string) (exportCursor, error) {
+	if s == "" {
+		return exportCursor{}, nil
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return exportCursor{}, types.ErrInvalidCursor
+	}
+	scan, n := binary.Uvarint(buf)
+	// the SCAN cursor of an export that isn't done is never zero
+	if n <= 0 || scan == 0 || (len(buf)-n)%8 != 0 || (len(buf)-n)/8 > exportDedupWindow {
+		return exportCursor{}, types.ErrInvalidCursor
+	}
+	c := exportCursor{scan: scan}
+	for buf = buf[n:]; len(buf) > 0; buf = buf[8:] {
+		c.recent = append(c.recent, binary.BigEndian.Uint64(buf))
+	}
+	return c, nil
+}
+
+func keyHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
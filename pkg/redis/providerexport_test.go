@@ -0,0 +1,177 @@
+package redis_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderStore__ExportProviderRecords(t *testing.T) {
+	ctx := context.Background()
+	seed := func(t *testing.T, providerStore *redis.ProviderStore, n int) map[string]model.ProviderResult {
+		seeded := map[string]model.ProviderResult{}
+		for range n {
+			hash, result := testutil.RandomMultihash(), testutil.RandomProviderResult()
+			require.NoError(t, providerStore.Set(ctx, hash, []model.ProviderResult{result}, true))
+			seeded[testutil.Must(multibase.Encode(multibase.Base58BTC, hash))(t)] = result
+		}
+		return seeded
+	}
+	exportAll := func(t *testing.T, providerStore *redis.ProviderStore, limit int, between func()) []redis.ExportRow {
+		var rows []redis.ExportRow
+		cursor := ""
+		for {
+			var buf bytes.Buffer
+			next, err := providerStore.ExportProviderRecords(ctx, &buf, types.ExportNDJSON, cursor, limit)
+			require.NoError(t, err)
+			dec := json.NewDecoder(&buf)
+			for dec.More() {
+				var row redis.ExportRow
+				require.NoError(t, dec.Decode(&row))
+				rows = append(rows, row)
+			}
+			if next == "" {
+				return rows
+			}
+			cursor = next
+			if between != nil {
+				between()
+			}
+		}
+	}
+
+	t.Run("rows in NDJSON", func(t *testing.T) {
+		mockRedis := NewMockRedis()
+		providerStore := redis.NewProviderStore(mockRedis)
+		seeded := seed(t, providerStore, 3)
+		// keys of other stores sharing the database are skipped
+		require.NoError(t, redis.NewTombstoneStore(mockRedis).Set(ctx, testutil.RandomPeer(), types.ProviderTombstone{}, false))
+		persistent := testutil.RandomMultihash()
+		require.NoError(t, providerStore.Set(ctx, persistent, []model.ProviderResult{testutil.RandomProviderResult()}, false))
+
+		rows := exportAll(t, providerStore, 0, nil)
+		require.Len(t, rows, 4)
+		for _, row := range rows {
+			result, ok := seeded[row.Multihash]
+			if !ok {
+				require.Equal(t, testutil.Must(multibase.Encode(multibase.Base58BTC, persistent))(t), row.Multihash)
+				require.Equal(t, int64(-1), row.TTL)
+				continue
+			}
+			require.Equal(t, redis.ExportRow{
+				Multihash: row.Multihash,
+				Provider:  result.Provider.ID.String(),
+				Protocols: []string{"location-commitment"},
+				ContextID: hex.EncodeToString(result.ContextID),
+				TTL:       int64(redis.DefaultExpire.Seconds()),
+			}, row)
+		}
+	})
+
+	t.Run("rows in CSV", func(t *testing.T) {
+		providerStore := redis.NewProviderStore(NewMockRedis())
+		seeded := seed(t, providerStore, 250)
+		var out bytes.Buffer
+		cursor := ""
+		for pages := 1; ; pages++ {
+			next, err := providerStore.ExportProviderRecords(ctx, &out, types.ExportCSV, cursor, 1)
+			require.NoError(t, err)
+			if next == "" {
+				require.Equal(t, 3, pages)
+				break
+			}
+			cursor = next
+		}
+		lines := testutil.Must(csv.NewReader(&out).ReadAll())(t)
+		require.Equal(t, []string{"multihash", "provider", "protocols", "contextID", "ttl"}, lines[0])
+		require.Len(t, lines, 251)
+		for _, line := range lines[1:] {
+			result, ok := seeded[line[0]]
+			require.True(t, ok)
+			require.Equal(t, []string{line[0], result.Provider.ID.String(), "location-commitment", hex.EncodeToString(result.ContextID), "3600"}, line)
+		}
+	})
+
+	t.Run("resuming from the cursor makes progress without duplicates", func(t *testing.T) {
+		providerStore := redis.NewProviderStore(NewMockRedis())
+		seeded := seed(t, providerStore, 300)
+		rows := exportAll(t, providerStore, 50, nil)
+		exported := map[string]int{}
+		for _, row := range rows {
+			exported[row.Multihash]++
+		}
+		require.Len(t, exported, len(seeded))
+		for hash, n := range exported {
+			require.Equal(t, 1, n, hash)
+		}
+	})
+
+	t.Run("concurrent writes and evictions", func(t *testing.T) {
+		mockRedis := NewMockRedis()
+		providerStore := redis.NewProviderStore(mockRedis)
+		seeded := seed(t, providerStore, 300)
+		var added []string
+		evicted := map[string]struct{}{}
+		rows := exportAll(t, providerStore, 50, func() {
+			// keys written sort anywhere in the keyspace, moving the mock's
+			// cursor back over keys already exported
+			for hash := range seed(t, providerStore, 20) {
+				added = append(added, hash)
+			}
+			for hash := range seeded {
+				if _, ok := evicted[hash]; ok {
+					continue
+				}
+				_, decoded := testutil.Must2(multibase.Decode(hash))(t)
+				mh := testutil.Must(multihash.Cast(decoded))(t)
+				require.NoError(t, providerStore.Delete(ctx, mh))
+				evicted[hash] = struct{}{}
+				break
+			}
+		})
+		exported := map[string]int{}
+		for _, row := range rows {
+			exported[row.Multihash]++
+		}
+		for hash, n := range exported {
+			require.Equal(t, 1, n, hash)
+		}
+		// every hash cached throughout the export is exported
+		for hash := range seeded {
+			if _, ok := evicted[hash]; !ok {
+				require.Contains(t, exported, hash)
+			}
+		}
+		require.NotEmpty(t, added)
+	})
+
+	t.Run("invalid cursors and formats", func(t *testing.T) {
+		providerStore := redis.NewProviderStore(NewMockRedis())
+		var buf bytes.Buffer
+		for _, cursor := range []string{"not base64!", "AA", strings.Repeat("A", 20)} {
+			_, err := providerStore.ExportProviderRecords(ctx, &buf, types.ExportNDJSON, cursor, 1)
+			require.ErrorIs(t, err, types.ErrInvalidCursor, cursor)
+		}
+		_, err := providerStore.ExportProviderRecords(ctx, &buf, types.ExportFormat("xml"), "", 1)
+		require.ErrorIs(t, err, types.ErrInvalidExportFormat)
+		require.Zero(t, buf.Len())
+	})
+
+	t.Run("clients that can't scan", func(t *testing.T) {
+		providerStore := redis.NewProviderStore(struct{ redis.Client }{NewMockRedis()})
+		_, err := providerStore.ExportProviderRecords(ctx, &bytes.Buffer{}, types.ExportNDJSON, "", 1)
+		require.ErrorIs(t, err, redis.ErrUnsupported)
+	})
+}
@@ -2,7 +2,10 @@ package redis
 
 import (
 	// imported for embedding
+	"context"
 	_ "embed"
+	"fmt"
+	"time"
 
 	"github.com/ipni/go-libipni/find/model"
 	multihash "github.com/multiformats/go-multihash"
@@ -14,20 +17,173 @@ var (
 	_ types.ProviderStore = (*ProviderStore)(nil)
 )
 
-// ProviderStore is a RedisStore for storing IPNI data that implements types.ProviderStore
-type ProviderStore = Store[multihash.Multihash, []model.ProviderResult]
+// ProviderStore is a RedisStore for storing IPNI data that implements types.ProviderStore.
+// Records are stored along with when they were last seen, which can be read and
+// written with GetRecords and SetRecords, and whether they are every record IPNI
+// had for the hash, which can be read and written with GetEntry and SetEntry
+type ProviderStore struct {
+	*Store[multihash.Multihash, providerresults.Entry]
+}
 
 // NewProviderStore returns a new instance of an IPNI store using the given redis client
-func NewProviderStore(client Client) *ProviderStore {
-	return NewStore(providerResultsFromRedis, providerResultsToRedis, multihashKeyString, client)
+func NewProviderStore(client Client, opts ...Option) *ProviderStore {
+	return &ProviderStore{NewStore(providerEntryFromRedis, providerEntryToRedis, multihashKeyString, client, opts...)}
+}
+
+// Get returns the provider results stored for a hash
+func (ps *ProviderStore) Get(ctx context.Context, hash multihash.Multihash) ([]model.ProviderResult, error) {
+	entry, err := ps.Store.Get(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	return providerresults.Results(entry.Records), nil
+}
+
+// GetPrimary is the same as Get, reading from the primary
+func (ps *ProviderStore) GetPrimary(ctx context.Context, hash multihash.Multihash) ([]model.ProviderResult, error) {
+	entry, err := ps.Store.GetPrimary(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	return providerresults.Results(entry.Records), nil
+}
+
+// Set stores the provider results for a hash, keeping the seen at times of any
+// results that were already stored, and whether the entry is complete
+func (ps *ProviderStore) Set(ctx context.Context, hash multihash.Multihash, results []model.ProviderResult, expires bool) error {
+	entry, err := ps.withSeenAt(ctx, hash, results)
+	if err != nil {
+		return err
+	}
+	return ps.Store.Set(ctx, hash, entry, expires)
+}
+
+// SetWithTTL is the same as Set, with the given expire time
+func (ps *ProviderStore) SetWithTTL(ctx context.Context, hash multihash.Multihash, results []model.ProviderResult, ttl time.Duration) error {
+	entry, err := ps.withSeenAt(ctx, hash, results)
+	if err != nil {
+		return err
+	}
+	return ps.Store.SetWithTTL(ctx, hash, entry, ttl)
+}
+
+// GetRecords returns the provider records stored for a hash, with when each was
+// last seen
+func (ps *ProviderStore) GetRecords(ctx context.Context, hash multihash.Multihash) ([]providerresults.Record, error) {
+	entry, err := ps.Store.Get(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Records, nil
+}
+
+// SetRecords stores the provider records for a hash, as an entry that is not
+// complete
+func (ps *ProviderStore) SetRecords(ctx context.Context, hash multihash.Multihash, records []providerresults.Record, expires bool) error {
+	return ps.Store.Set(ctx, hash, providerresults.Entry{Records: records}, expires)
+}
+
+// SetRecordsWithTTL stores the provider records for a hash with the given expire
+// time, as an entry that is not complete
+func (ps *ProviderStore) SetRecordsWithTTL(ctx context.Context, hash multihash.Multihash, records []providerresults.Record, ttl time.Duration) error {
+	return ps.Store.SetWithTTL(ctx, hash, providerresults.Entry{Records: records}, ttl)
+}
+
+// GetEntry returns the entry of provider records stored for a hash
+func (ps *ProviderStore) GetEntry(ctx context.Context, hash multihash.Multihash) (providerresults.Entry, error) {
+	return ps.Store.Get(ctx, hash)
+}
+
+// GetEntryPrimary is the same as GetEntry, reading from the primary
+func (ps *ProviderStore) GetEntryPrimary(ctx context.Context, hash multihash.Multihash) (providerresults.Entry, error) {
+	return ps.Store.GetPrimary(ctx, hash)
+}
+
+// SetEntry stores the entry of provider records for a hash
+func (ps *ProviderStore) SetEntry(ctx context.Context, hash multihash.Multihash, entry providerresults.Entry, expires bool) error {
+	return ps.Store.Set(ctx, hash, entry, expires)
+}
+
+// MergeEntry stores an entry of provider records for a hash that holds the
+// records of the entry it replaces, without extending how long those are kept.
+// The entry expires after ttl, or DefaultExpire if ttl is zero, unless the
+// entry it replaces expires sooner or doesn't expire, in which case its expire
+// time is kept. Clients that aren't TTLClients always expire it after ttl
+func (ps *ProviderStore) MergeEntry(ctx context.Context, hash multihash.Multihash, entry providerresults.Entry, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = DefaultExpire
+	}
+	if tc, ok := ps.client.(TTLClient); ok {
+		remaining, err := tc.TTL(ctx, multihashKeyString(hash)).Result()
+		if err != nil {
+			return fmt.Errorf("error accessing redis: %w", err)
+		}
+		// TTL replies with -2 for a key that doesn't exist and -1 for one that
+		// doesn't expire
+		if remaining == -1 || (remaining > 0 && remaining <= ttl) {
+			return ps.Store.Replace(ctx, hash, entry)
+		}
+	}
+	return ps.Store.SetWithTTL(ctx, hash, entry, ttl)
+}
+
+// ReplaceEntry stores the entry of provider records for a hash, keeping the
+// expire time of the entry it replaces
+func (ps *ProviderStore) ReplaceEntry(ctx context.Context, hash multihash.Multihash, entry providerresults.Entry) error {
+	return ps.Store.Replace(ctx, hash, entry)
+}
+
+// Scan returns a batch of about count of the hashes stored, starting at the
+// cursor, along with the cursor of the next batch. Iteration starts at cursor 0
+// and is over when the next cursor returned is 0. Hashes stored throughout the
+// iteration are returned at least once. Keys that aren't multihashes are
+// skipped, and the client must be a ScanClient
+func (ps *ProviderStore) Scan(ctx context.Context, cursor uint64, count int) ([]multihash.Multihash, uint64, error) {
+	sc, ok := ps.client.(ScanClient)
+	if !ok {
+		return nil, 0, fmt.Errorf("scanning: %w", ErrUnsupported)
+	}
+	keys, next, err := sc.Scan(ctx, cursor, "", int64(count)).Result()
+	if err != nil {
+		return nil, 0, fmt.Errorf("error accessing redis: %w", err)
+	}
+	hashes := make([]multihash.Multihash, 0, len(keys))
+	for _, key := range keys {
+		hash, err := multihash.Cast([]byte(key))
+		if err != nil {
+			continue
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, next, nil
+}
+
+func (ps *ProviderStore) withSeenAt(ctx context.Context, hash multihash.Multihash, results []model.ProviderResult) (providerresults.Entry, error) {
+	existing, err := ps.Store.GetPrimary(ctx, hash)
+	if err != nil && err != types.ErrKeyNotFound {
+		return providerresults.Entry{}, err
+	}
+	records := make([]providerresults.Record, 0, len(results))
+	for _, result := range results {
+		record := providerresults.Record{ProviderResult: result}
+		for _, e := range existing.Records {
+			if providerresults.Equals(e.ProviderResult, result) {
+				record.SeenAt = e.SeenAt
+				break
+			}
+		}
+		records = append(records, record)
+	}
+	existing.Records = records
+	return existing, nil
 }
 
-func providerResultsFromRedis(data string) ([]model.ProviderResult, error) {
-	return providerresults.UnmarshalCBOR([]byte(data))
+func providerEntryFromRedis(data string) (providerresults.Entry, error) {
+	return providerresults.UnmarshalEntryCBOR([]byte(data))
 }
 
-func providerResultsToRedis(records []model.ProviderResult) (string, error) {
-	data, err := providerresults.MarshalCBOR(records)
+func providerEntryToRedis(entry providerresults.Entry) (string, error) {
+	data, err := providerresults.MarshalEntryCBOR(entry)
 	return string(data), err
 }
 
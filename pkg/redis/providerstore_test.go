@@ -3,12 +3,15 @@ package redis_test
 import (
 	"context"
 	"testing"
+	"time"
 
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipni/go-libipni/find/model"
 	"github.com/multiformats/go-multihash"
 	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/providerresults"
 	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/types"
 	"github.com/stretchr/testify/require"
 )
 
@@ -28,6 +31,118 @@ func TestProviderStore(t *testing.T) {
 	require.Equal(t, results2, returnedResults2)
 }
 
+func TestProviderStore__Records(t *testing.T) {
+	ctx := context.Background()
+	seenAt := time.Unix(time.Now().Unix(), 0)
+
+	t.Run("keeps seen at times of results already stored", func(t *testing.T) {
+		providerStore := redis.NewProviderStore(NewMockRedis())
+		hash, results := testutil.Must2(randomProviderResults(2))(t)
+		require.NoError(t, providerStore.SetRecords(ctx, hash, []providerresults.Record{{ProviderResult: results[0], SeenAt: seenAt}}, true))
+
+		require.NoError(t, providerStore.Set(ctx, hash, results, true))
+		records := testutil.Must(providerStore.GetRecords(ctx, hash))(t)
+		require.Len(t, records, 2)
+		require.True(t, seenAt.Equal(records[0].SeenAt))
+		require.True(t, records[1].SeenAt.IsZero())
+		require.Equal(t, results, testutil.Must(providerStore.Get(ctx, hash))(t))
+	})
+
+	t.Run("keeps seen at times written to the primary", func(t *testing.T) {
+		primary, replica := NewMockRedis(), NewMockRedis()
+		providerStore := redis.NewProviderStore(primary, redis.WithReadClient(replica))
+		hash, results := testutil.Must2(randomProviderResults(2))(t)
+		require.NoError(t, redis.NewProviderStore(primary).SetRecords(ctx, hash, []providerresults.Record{{ProviderResult: results[0], SeenAt: seenAt}}, true))
+
+		require.NoError(t, providerStore.Set(ctx, hash, results, true))
+		records := testutil.Must(providerStore.GetRecords(ctx, hash))(t)
+		require.Len(t, records, 2)
+		require.True(t, seenAt.Equal(records[0].SeenAt))
+		require.Equal(t, results, testutil.Must(providerStore.GetPrimary(ctx, hash))(t))
+	})
+
+	t.Run("reads results stored before seen at times", func(t *testing.T) {
+		mockRedis := NewMockRedis()
+		providerStore := redis.NewProviderStore(mockRedis)
+		hash, results := testutil.Must2(randomProviderResults(2))(t)
+		data := testutil.Must(providerresults.MarshalCBOR(results))(t)
+		mockRedis.data[string(hash)] = &redisValue{string(data), 0}
+
+		require.Equal(t, results, testutil.Must(providerStore.Get(ctx, hash))(t))
+		records := testutil.Must(providerStore.GetRecords(ctx, hash))(t)
+		require.Len(t, records, 2)
+		for _, record := range records {
+			require.True(t, record.SeenAt.IsZero())
+		}
+	})
+}
+
+func TestProviderStore__MergeEntry(t *testing.T) {
+	ctx := context.Background()
+	testCases := []struct {
+		name     string
+		existing time.Duration
+		stored   bool
+		ttl      time.Duration
+		expected time.Duration
+	}{
+		{name: "new entries expire after the ttl", ttl: time.Minute, expected: time.Minute},
+		{name: "new entries expire after the default without a ttl", expected: redis.DefaultExpire},
+		{name: "entries that expire sooner keep their expire time", existing: time.Minute, stored: true, ttl: time.Hour, expected: time.Minute},
+		{name: "entries that expire later expire after the ttl", existing: time.Hour, stored: true, ttl: time.Minute, expected: time.Minute},
+		{name: "entries that don't expire keep not expiring", stored: true, ttl: time.Minute},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockRedis := NewMockRedis()
+			providerStore := redis.NewProviderStore(mockRedis)
+			hash, results := testutil.Must2(randomProviderResults(2))(t)
+			if tc.stored {
+				require.NoError(t, providerStore.SetRecordsWithTTL(ctx, hash, []providerresults.Record{{ProviderResult: results[0]}}, tc.existing))
+				if tc.existing == 0 {
+					require.NoError(t, providerStore.SetExpirable(ctx, hash, false))
+				}
+			}
+
+			entry := providerresults.Entry{Records: []providerresults.Record{{ProviderResult: results[0]}, {ProviderResult: results[1]}}}
+			require.NoError(t, providerStore.MergeEntry(ctx, hash, entry, tc.ttl))
+			require.Equal(t, results, testutil.Must(providerStore.Get(ctx, hash))(t))
+			require.Equal(t, tc.expected, mockRedis.data[string(hash)].expires)
+		})
+	}
+}
+
+func TestProviderStore__Scan(t *testing.T) {
+	ctx := context.Background()
+	mockRedis := NewMockRedis()
+	providerStore := redis.NewProviderStore(mockRedis)
+	hashes := testutil.RandomMultihashes(5)
+	for _, hash := range hashes {
+		require.NoError(t, providerStore.Set(ctx, hash, []model.ProviderResult{testutil.RandomProviderResult()}, true))
+	}
+	// keys of other stores sharing the database are skipped
+	require.NoError(t, redis.NewTombstoneStore(mockRedis).Set(ctx, testutil.RandomPeer(), types.ProviderTombstone{}, false))
+
+	var scanned []multihash.Multihash
+	var batches int
+	for cursor := uint64(0); ; batches++ {
+		batch, next := testutil.Must2(providerStore.Scan(ctx, cursor, 2))(t)
+		scanned = append(scanned, batch...)
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	require.ElementsMatch(t, hashes, scanned)
+	require.Equal(t, 2, batches)
+
+	t.Run("clients that can't scan", func(t *testing.T) {
+		providerStore := redis.NewProviderStore(struct{ redis.Client }{mockRedis})
+		_, _, err := providerStore.Scan(ctx, 0, 2)
+		require.ErrorIs(t, err, redis.ErrUnsupported)
+	})
+}
+
 func randomProviderResults(num int) (multihash.Multihash, []model.ProviderResult, error) {
 	randomHash := testutil.RandomCID().(cidlink.Link).Cid.Hash()
 	providerResults := make([]model.ProviderResult, 0, num)
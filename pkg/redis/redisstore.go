@@ -2,7 +2,10 @@ package redis
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -12,6 +15,10 @@ import (
 // DefaultExpire is the expire time we set on Redis when Set/SetExpiration are called with expire=true
 const DefaultExpire = time.Hour
 
+// DefaultRecentWriteWindow is how long keys are read from the write client
+// after they are written, when a separate read client is configured
+const DefaultRecentWriteWindow = 5 * time.Second
+
 // Client is a subset of functions from the golang redis client that we need to implement our cache
 type Client interface {
 	Get(context.Context, string) *redis.StringCmd
@@ -20,6 +27,77 @@ type Client interface {
 	Persist(ctx context.Context, key string) *redis.BoolCmd
 }
 
+// DeleteClient is implemented by clients that can delete keys
+type DeleteClient interface {
+	Del(ctx context.Context, keys ...string) *redis.IntCmd
+}
+
+// ScanClient is implemented by clients that can iterate the keys of a database
+type ScanClient interface {
+	Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd
+}
+
+// TTLClient is implemented by clients that can read the time to live of keys
+type TTLClient interface {
+	TTL(ctx context.Context, key string) *redis.DurationCmd
+}
+
+var (
+	_ DeleteClient = (*redis.Client)(nil)
+	_ ScanClient   = (*redis.Client)(nil)
+	_ TTLClient    = (*redis.Client)(nil)
+)
+
+// ErrUnsupported is returned by operations the redis client of a store doesn't
+// implement
+var ErrUnsupported = errors.New("unsupported by the redis client")
+
+// Option configures a Store
+type Option func(*storeConfig)
+
+type storeConfig struct {
+	ttlJitter         float64
+	randSrc           rand.Source
+	readClient        Client
+	recentWriteWindow time.Duration
+	events            *CacheEvents
+	storeName         string
+}
+
+// WithTTLJitter randomizes every expiration applied by the store within
+// ±fraction of the expire time (i.e. 0.1 for 10%), so that entries written
+// together do not all expire together
+func WithTTLJitter(fraction float64) Option {
+	return func(c *storeConfig) {
+		c.ttlJitter = fraction
+	}
+}
+
+// WithRandSource sets the source of randomness used for TTL jitter
+func WithRandSource(src rand.Source) Option {
+	return func(c *storeConfig) {
+		c.randSrc = src
+	}
+}
+
+// WithReadClient routes reads to a separate client, typically connected to a
+// replica, while writes continue to go to the client passed to NewStore. Reads
+// fall back to the write client if the read client fails
+func WithReadClient(client Client) Option {
+	return func(c *storeConfig) {
+		c.readClient = client
+	}
+}
+
+// WithRecentWriteWindow sets how long keys are read from the write client after
+// they are written, so that replica lag does not hide a write from the reads
+// that immediately follow it. Defaults to DefaultRecentWriteWindow
+func WithRecentWriteWindow(window time.Duration) Option {
+	return func(c *storeConfig) {
+		c.recentWriteWindow = window
+	}
+}
+
 // Store wraps the go redis client to implement our general purpose cache interface,
 // using the providedserialization/deserialization functions
 type Store[Key, Value any] struct {
@@ -27,6 +105,14 @@ type Store[Key, Value any] struct {
 	toRedis   func(Value) (string, error)
 	keyString func(Key) string
 	client    Client
+	ttlJitter float64
+	randLk    sync.Mutex
+	rand      *rand.Rand
+	// readClient is nil when reads go to the write client
+	readClient   Client
+	recentWrites *recentWrites
+	// events is nil when the store's events aren't emitted
+	events *storeEvents
 }
 
 var (
@@ -39,22 +125,83 @@ func NewStore[Key, Value any](
 	fromRedis func(string) (Value, error),
 	toRedis func(Value) (string, error),
 	keyString func(Key) string,
-	client Client) *Store[Key, Value] {
-	return &Store[Key, Value]{fromRedis, toRedis, keyString, client}
+	client Client,
+	opts ...Option) *Store[Key, Value] {
+	c := &storeConfig{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.randSrc == nil {
+		c.randSrc = rand.NewSource(time.Now().UnixNano())
+	}
+	if c.recentWriteWindow == 0 {
+		c.recentWriteWindow = DefaultRecentWriteWindow
+	}
+	rs := &Store[Key, Value]{
+		fromRedis: fromRedis,
+		toRedis:   toRedis,
+		keyString: keyString,
+		client:    client,
+		ttlJitter: min(max(c.ttlJitter, 0), 1),
+		rand:      rand.New(c.randSrc),
+	}
+	if c.readClient != nil && c.readClient != client {
+		rs.readClient = c.readClient
+		rs.recentWrites = newRecentWrites(c.recentWriteWindow)
+	}
+	if c.events != nil {
+		rs.events = newStoreEvents(c.events, c.storeName)
+	}
+	return rs
 }
 
 // Get returns deserialized values from redis
 func (rs *Store[Key, Value]) Get(ctx context.Context, key Key) (Value, error) {
-	data, err := rs.client.Get(ctx, rs.keyString(key)).Result()
+	k := rs.keyString(key)
+	var data string
+	var err error
+	if rs.readClient != nil && !rs.recentWrites.contains(k) {
+		data, err = rs.readClient.Get(ctx, k).Result()
+		// the replica is unavailable, try the primary instead
+		if err != nil && err != redis.Nil && ctx.Err() == nil {
+			data, err = rs.client.Get(ctx, k).Result()
+		}
+	} else {
+		data, err = rs.client.Get(ctx, k).Result()
+	}
+	return rs.decode(k, data, err)
+}
+
+// GetPrimary is the same as Get, but always reads from the write client, so
+// that a value read to write back a change to it has every write made to it,
+// by any instance, however far behind the replica is
+func (rs *Store[Key, Value]) GetPrimary(ctx context.Context, key Key) (Value, error) {
+	k := rs.keyString(key)
+	data, err := rs.client.Get(ctx, k).Result()
+	return rs.decode(k, data, err)
+}
 
+// decode deserializes the result of reading a key
+func (rs *Store[Key, Value]) decode(k string, data string, err error) (Value, error) {
 	if err != nil {
 		var v Value
 		if err == redis.Nil {
+			if rs.events != nil {
+				rs.events.miss(k)
+			}
 			return v, types.ErrKeyNotFound
 		}
 		return v, fmt.Errorf("error accessing redis: %w", err)
 	}
-	return rs.fromRedis(data)
+	v, err := rs.fromRedis(data)
+	if rs.events != nil {
+		if err != nil {
+			rs.events.corrupt(k, len(data))
+		} else {
+			rs.events.hit(k, len(data))
+		}
+	}
+	return v, err
 }
 
 // Set saves a serialized value to redis
@@ -65,25 +212,169 @@ func (rs *Store[Key, Value]) Set(ctx context.Context, key Key, value Value, expi
 	}
 	duration := time.Duration(0)
 	if expires {
-		duration = DefaultExpire
+		duration = rs.expiration()
+	}
+	k := rs.keyString(key)
+	rs.recentWrites.add(k)
+	err = rs.client.Set(ctx, k, data, duration).Err()
+	if err != nil {
+		return fmt.Errorf("error accessing redis: %w", err)
+	}
+	if rs.events != nil {
+		rs.events.written(k, len(data), duration)
+	}
+	return nil
+}
+
+// SetWithTTL saves a serialized value to redis that expires after the given
+// time, with jitter applied
+func (rs *Store[Key, Value]) SetWithTTL(ctx context.Context, key Key, value Value, ttl time.Duration) error {
+	data, err := rs.toRedis(value)
+	if err != nil {
+		return err
+	}
+	k := rs.keyString(key)
+	rs.recentWrites.add(k)
+	ttl = rs.jitter(ttl)
+	err = rs.client.Set(ctx, k, data, ttl).Err()
+	if err != nil {
+		return fmt.Errorf("error accessing redis: %w", err)
+	}
+	if rs.events != nil {
+		rs.events.written(k, len(data), ttl)
+	}
+	return nil
+}
+
+// Replace saves a serialized value to redis, keeping the expire time of the
+// value it replaces, if any
+func (rs *Store[Key, Value]) Replace(ctx context.Context, key Key, value Value) error {
+	data, err := rs.toRedis(value)
+	if err != nil {
+		return err
 	}
-	err = rs.client.Set(ctx, rs.keyString(key), data, duration).Err()
+	k := rs.keyString(key)
+	rs.recentWrites.add(k)
+	err = rs.client.Set(ctx, k, data, redis.KeepTTL).Err()
 	if err != nil {
 		return fmt.Errorf("error accessing redis: %w", err)
 	}
+	if rs.events != nil {
+		rs.events.written(k, len(data), redis.KeepTTL)
+	}
+	return nil
+}
+
+// Delete removes a value from redis. Deleting a key that doesn't exist is not
+// an error. The client must be a DeleteClient
+func (rs *Store[Key, Value]) Delete(ctx context.Context, key Key) error {
+	dc, ok := rs.client.(DeleteClient)
+	if !ok {
+		return fmt.Errorf("deleting: %w", ErrUnsupported)
+	}
+	k := rs.keyString(key)
+	rs.recentWrites.add(k)
+	if err := dc.Del(ctx, k).Err(); err != nil {
+		return fmt.Errorf("error accessing redis: %w", err)
+	}
+	if rs.events != nil {
+		rs.events.deleted(k)
+	}
 	return nil
 }
 
+// WriteSkipped emits the event of a value of the size in bytes not written
+// under the key, because the cache's admission policy rejected it
+func (rs *Store[Key, Value]) WriteSkipped(key Key, size int) {
+	if rs.events != nil {
+		rs.events.skipped(rs.keyString(key), size)
+	}
+}
+
 // SetExpirable changes the expiration property for a given key
 func (rs *Store[Key, Value]) SetExpirable(ctx context.Context, key Key, expires bool) error {
 	var err error
+	k := rs.keyString(key)
+	rs.recentWrites.add(k)
+	ttl := time.Duration(0)
 	if expires {
-		err = rs.client.Expire(ctx, rs.keyString(key), DefaultExpire).Err()
+		ttl = rs.expiration()
+		err = rs.client.Expire(ctx, k, ttl).Err()
 	} else {
-		err = rs.client.Persist(ctx, rs.keyString(key)).Err()
+		err = rs.client.Persist(ctx, k).Err()
 	}
 	if err != nil {
 		return fmt.Errorf("error accessing redis: %w", err)
 	}
+	if rs.events != nil {
+		rs.events.expires(k, ttl)
+	}
 	return nil
 }
+
+// expiration returns the default expire time to apply to a write, with jitter applied
+func (rs *Store[Key, Value]) expiration() time.Duration {
+	return rs.jitter(DefaultExpire)
+}
+
+func (rs *Store[Key, Value]) jitter(ttl time.Duration) time.Duration {
+	if rs.ttlJitter > 0 {
+		rs.randLk.Lock()
+		offset := (2*rs.rand.Float64() - 1) * rs.ttlJitter
+		rs.randLk.Unlock()
+		ttl = time.Duration(float64(ttl) * (1 + offset))
+	}
+	// never produce a zero or negative expire time, which redis would treat as
+	// no expiry or an immediate delete
+	return max(ttl, time.Second)
+}
+
+// recentWrites remembers keys written in the last window, so reads of them can
+// be sent to the primary until replicas have caught up. A nil recentWrites
+// remembers nothing
+type recentWrites struct {
+	lk        sync.Mutex
+	window    time.Duration
+	keys      map[string]time.Time
+	lastSweep time.Time
+}
+
+func newRecentWrites(window time.Duration) *recentWrites {
+	return &recentWrites{window: window, keys: map[string]time.Time{}, lastSweep: time.Now()}
+}
+
+func (rw *recentWrites) add(key string) {
+	if rw == nil {
+		return
+	}
+	rw.lk.Lock()
+	defer rw.lk.Unlock()
+	now := time.Now()
+	rw.keys[key] = now.Add(rw.window)
+	// sweep at most once a window, so the memory is bounded by the write rate
+	if now.Sub(rw.lastSweep) >= rw.window {
+		for k, until := range rw.keys {
+			if now.After(until) {
+				delete(rw.keys, k)
+			}
+		}
+		rw.lastSweep = now
+	}
+}
+
+func (rw *recentWrites) contains(key string) bool {
+	if rw == nil {
+		return false
+	}
+	rw.lk.Lock()
+	defer rw.lk.Unlock()
+	until, ok := rw.keys[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(rw.keys, key)
+		return false
+	}
+	return true
+}
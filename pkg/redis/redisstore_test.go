@@ -3,6 +3,10 @@ package redis_test
 import (
 	"context"
 	"errors"
+	"maps"
+	"math/rand"
+	"slices"
+	"strconv"
 	"testing"
 	"time"
 
@@ -44,6 +48,16 @@ func TestRedisStore(t *testing.T) {
 				"key4": {"value4", redis.DefaultExpire},
 			},
 		},
+		{
+			name: "set with ttl",
+			behavior: func(t *testing.T, store *redis.Store[string, string]) {
+				require.NoError(t, store.SetWithTTL(ctx, "key1", "value1", time.Minute))
+				require.Equal(t, "value1", testutil.Must(store.Get(ctx, "key1"))(t))
+			},
+			finalState: map[string]*redisValue{
+				"key1": {"value1", time.Minute},
+			},
+		},
 		{
 			name: "get errors",
 			opts: []MockOption{WithErrorOnGet(errors.New("something went wrong"))},
@@ -87,6 +101,172 @@ func TestRedisStore(t *testing.T) {
 	}
 }
 
+func TestRedisStore__TTLJitter(t *testing.T) {
+	ctx := context.Background()
+	const writes = 1000
+	newStore := func(mockRedis *MockRedis, fraction float64) *redis.Store[string, string] {
+		return redis.NewStore[string, string](
+			func(s string) (string, error) { return s, nil },
+			func(s string) (string, error) { return s, nil },
+			func(s string) string { return s },
+			mockRedis,
+			redis.WithTTLJitter(fraction),
+			redis.WithRandSource(rand.NewSource(1)))
+	}
+
+	t.Run("spreads expirations within bounds", func(t *testing.T) {
+		mockRedis := NewMockRedis()
+		store := newStore(mockRedis, 0.1)
+		for i := range writes {
+			key := strconv.Itoa(i)
+			if i%2 == 0 {
+				require.NoError(t, store.Set(ctx, key, "value", true))
+			} else {
+				require.NoError(t, store.Set(ctx, key, "value", false))
+				require.NoError(t, store.SetExpirable(ctx, key, true))
+			}
+		}
+		lower := redis.DefaultExpire * 9 / 10
+		upper := redis.DefaultExpire * 11 / 10
+		minExpire, maxExpire := upper, lower
+		var total time.Duration
+		for _, val := range mockRedis.data {
+			require.GreaterOrEqual(t, val.expires, lower)
+			require.LessOrEqual(t, val.expires, upper)
+			minExpire = min(minExpire, val.expires)
+			maxExpire = max(maxExpire, val.expires)
+			total += val.expires
+		}
+		// the spread should cover most of the range, centered on the default
+		require.Less(t, minExpire, redis.DefaultExpire*91/100)
+		require.Greater(t, maxExpire, redis.DefaultExpire*109/100)
+		require.InDelta(t, float64(redis.DefaultExpire), float64(total/writes), float64(redis.DefaultExpire)*0.01)
+	})
+
+	t.Run("never produces non-positive expirations", func(t *testing.T) {
+		mockRedis := NewMockRedis()
+		store := newStore(mockRedis, 1)
+		for i := range writes {
+			require.NoError(t, store.Set(ctx, strconv.Itoa(i), "value", true))
+		}
+		for _, val := range mockRedis.data {
+			require.Positive(t, val.expires)
+		}
+	})
+
+	t.Run("non-expirable writes are not jittered", func(t *testing.T) {
+		mockRedis := NewMockRedis()
+		store := newStore(mockRedis, 0.1)
+		require.NoError(t, store.Set(ctx, "key1", "value1", false))
+		require.NoError(t, store.Set(ctx, "key2", "value2", true))
+		require.NoError(t, store.SetExpirable(ctx, "key2", false))
+		require.Equal(t, time.Duration(0), mockRedis.data["key1"].expires)
+		require.Equal(t, time.Duration(0), mockRedis.data["key2"].expires)
+	})
+}
+
+func TestRedisStore__DeleteAndReplace(t *testing.T) {
+	ctx := context.Background()
+	mockRedis := NewMockRedis()
+	store := redis.NewStore(func(s string) (string, error) { return s, nil }, func(s string) (string, error) { return s, nil }, func(s string) string { return s }, mockRedis)
+	require.NoError(t, store.Set(ctx, "key1", "value1", true))
+	require.NoError(t, store.Set(ctx, "key2", "value2", false))
+	expires := mockRedis.data["key1"].expires
+
+	// replacing keeps the expire time
+	require.NoError(t, store.Replace(ctx, "key1", "replaced"))
+	require.Equal(t, &redisValue{"replaced", expires}, mockRedis.data["key1"])
+	require.NoError(t, store.Replace(ctx, "key2", "replaced"))
+	require.Equal(t, &redisValue{"replaced", 0}, mockRedis.data["key2"])
+
+	require.NoError(t, store.Delete(ctx, "key1"))
+	_, err := store.Get(ctx, "key1")
+	require.ErrorIs(t, err, types.ErrKeyNotFound)
+	require.NoError(t, store.Delete(ctx, "key1"))
+	require.Equal(t, "replaced", testutil.Must(store.Get(ctx, "key2"))(t))
+
+	t.Run("clients that can't delete", func(t *testing.T) {
+		store := redis.NewStore(func(s string) (string, error) { return s, nil }, func(s string) (string, error) { return s, nil }, func(s string) string { return s }, struct{ redis.Client }{mockRedis})
+		require.ErrorIs(t, store.Delete(ctx, "key2"), redis.ErrUnsupported)
+	})
+}
+
+func TestRedisStore__ReadClient(t *testing.T) {
+	ctx := context.Background()
+	newStore := func(primary, replica *MockRedis, opts ...redis.Option) *redis.Store[string, string] {
+		return redis.NewStore[string, string](
+			func(s string) (string, error) { return s, nil },
+			func(s string) (string, error) { return s, nil },
+			func(s string) string { return s },
+			primary,
+			append([]redis.Option{redis.WithReadClient(replica)}, opts...)...)
+	}
+
+	t.Run("routes reads to the read client and writes to the write client", func(t *testing.T) {
+		primary, replica := NewMockRedis(), NewMockRedis()
+		primary.data["key1"] = &redisValue{"primary", 0}
+		replica.data["key1"] = &redisValue{"replica", 0}
+		store := newStore(primary, replica)
+		require.Equal(t, "replica", testutil.Must(store.Get(ctx, "key1"))(t))
+
+		require.NoError(t, store.Set(ctx, "key2", "value2", true))
+		require.NoError(t, store.SetWithTTL(ctx, "key3", "value3", time.Minute))
+		require.NoError(t, store.SetExpirable(ctx, "key1", true))
+		require.Equal(t, map[string]*redisValue{
+			"key1": {"primary", redis.DefaultExpire},
+			"key2": {"value2", redis.DefaultExpire},
+			"key3": {"value3", time.Minute},
+		}, primary.data)
+		require.Equal(t, map[string]*redisValue{"key1": {"replica", 0}}, replica.data)
+	})
+
+	t.Run("misses on the read client are not retried", func(t *testing.T) {
+		primary, replica := NewMockRedis(), NewMockRedis()
+		primary.data["key1"] = &redisValue{"primary", 0}
+		store := newStore(primary, replica)
+		_, err := store.Get(ctx, "key1")
+		require.ErrorIs(t, err, types.ErrKeyNotFound)
+	})
+
+	t.Run("falls back to the write client when the read client fails", func(t *testing.T) {
+		primary, replica := NewMockRedis(), NewMockRedis(WithErrorOnGet(errors.New("connection refused")))
+		primary.data["key1"] = &redisValue{"primary", 0}
+		store := newStore(primary, replica)
+		require.Equal(t, "primary", testutil.Must(store.Get(ctx, "key1"))(t))
+
+		primary.errGet = errors.New("something went wrong")
+		_, err := store.Get(ctx, "key1")
+		require.EqualError(t, err, "error accessing redis: something went wrong")
+	})
+
+	t.Run("reads recently written keys from the write client", func(t *testing.T) {
+		primary, replica := NewMockRedis(), NewMockRedis()
+		replica.data["key1"] = &redisValue{"stale", 0}
+		replica.data["key2"] = &redisValue{"replica", 0}
+		store := newStore(primary, replica, redis.WithRecentWriteWindow(50*time.Millisecond))
+		require.NoError(t, store.Set(ctx, "key1", "fresh", true))
+		require.Equal(t, "fresh", testutil.Must(store.Get(ctx, "key1"))(t))
+		// keys not written are still read from the replica
+		require.Equal(t, "replica", testutil.Must(store.Get(ctx, "key2"))(t))
+
+		time.Sleep(100 * time.Millisecond)
+		require.Equal(t, "stale", testutil.Must(store.Get(ctx, "key1"))(t))
+	})
+
+	t.Run("reads for writes go to the write client", func(t *testing.T) {
+		// another instance wrote the key, which the replica hasn't caught up with
+		primary, replica := NewMockRedis(), NewMockRedis()
+		primary.data["key1"] = &redisValue{"fresh", 0}
+		replica.data["key1"] = &redisValue{"stale", 0}
+		store := newStore(primary, replica)
+		require.Equal(t, "fresh", testutil.Must(store.GetPrimary(ctx, "key1"))(t))
+		require.Equal(t, "fresh", testutil.Must(types.GetForWrite[string, string](ctx, store, "key1"))(t))
+		require.Equal(t, "stale", testutil.Must(store.Get(ctx, "key1"))(t))
+		_, err := store.GetPrimary(ctx, "key2")
+		require.ErrorIs(t, err, types.ErrKeyNotFound)
+	})
+}
+
 type redisValue struct {
 	data    string
 	expires time.Duration
@@ -99,7 +279,12 @@ type MockRedis struct {
 	errSetExpiration error
 }
 
-var _ redis.Client = (*MockRedis)(nil)
+var (
+	_ redis.Client       = (*MockRedis)(nil)
+	_ redis.DeleteClient = (*MockRedis)(nil)
+	_ redis.ScanClient   = (*MockRedis)(nil)
+	_ redis.TTLClient    = (*MockRedis)(nil)
+)
 
 type MockOption func(*MockRedis)
 
@@ -182,6 +367,53 @@ func (m *MockRedis) Set(ctx context.Context, key string, value interface{}, expi
 		cmd.SetErr(m.errSet)
 		return cmd
 	}
+	if existing, ok := m.data[key]; ok && expiration == goredis.KeepTTL {
+		expiration = existing.expires
+	}
 	m.data[key] = &redisValue{value.(string), expiration}
 	return cmd
 }
+
+// Del implements redis.DeleteClient.
+func (m *MockRedis) Del(ctx context.Context, keys ...string) *goredis.IntCmd {
+	cmd := goredis.NewIntCmd(ctx, nil)
+	var deleted int64
+	for _, key := range keys {
+		if _, ok := m.data[key]; ok {
+			delete(m.data, key)
+			deleted++
+		}
+	}
+	cmd.SetVal(deleted)
+	return cmd
+}
+
+// TTL implements redis.TTLClient, replying -2 for keys that don't exist and -1
+// for keys that don't expire, as redis does
+func (m *MockRedis) TTL(ctx context.Context, key string) *goredis.DurationCmd {
+	cmd := goredis.NewDurationCmd(ctx, time.Second)
+	val, ok := m.data[key]
+	switch {
+	case !ok:
+		cmd.SetVal(-2)
+	case val.expires == 0:
+		cmd.SetVal(-1)
+	default:
+		cmd.SetVal(val.expires)
+	}
+	return cmd
+}
+
+// Scan implements redis.ScanClient, with the cursor being the position of the
+// next key in key order
+func (m *MockRedis) Scan(ctx context.Context, cursor uint64, match string, count int64) *goredis.ScanCmd {
+	cmd := goredis.NewScanCmd(ctx, nil)
+	keys := slices.Sorted(maps.Keys(m.data))
+	end := min(int(cursor)+int(count), len(keys))
+	next := uint64(end)
+	if end == len(keys) {
+		next = 0
+	}
+	cmd.SetVal(keys[min(int(cursor), end):end], next)
+	return cmd
+}
@@ -0,0 +1,43 @@
+package redis
+
+import (
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+var (
+	_ types.ShardFilterStore = (*ShardFilterStore)(nil)
+)
+
+// shardFilterKeyPrefix keeps shard filters apart from the indexes they are
+// cached alongside
+const shardFilterKeyPrefix = "shardfilters/"
+
+// ShardFilterStore is a RedisStore for storing the shard filters of sharded dag indexes that implements types.ShardFilterStore
+type ShardFilterStore = Store[types.EncodedContextID, *blobindex.ShardFilters]
+
+// NewShardFilterStore returns a new instance of a shard filter store using the given redis client. It can share the
+// client of a ShardedDagIndexStore
+func NewShardFilterStore(client Client, opts ...Option) *ShardFilterStore {
+	return NewStore(shardFiltersFromRedis, shardFiltersToRedis, shardFilterKeyString, client, opts...)
+}
+
+func shardFiltersFromRedis(data string) (*blobindex.ShardFilters, error) {
+	var filters blobindex.ShardFilters
+	if err := filters.UnmarshalBinary([]byte(data)); err != nil {
+		return nil, err
+	}
+	return &filters, nil
+}
+
+func shardFiltersToRedis(filters *blobindex.ShardFilters) (string, error) {
+	data, err := filters.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func shardFilterKeyString(encodedContextID types.EncodedContextID) string {
+	return shardFilterKeyPrefix + string(encodedContextID)
+}
@@ -0,0 +1,72 @@
+package redis
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+var (
+	_ types.SpaceBindingStore = (*SpaceBindingStore)(nil)
+)
+
+// spaceBindingPrefix keeps space bindings apart from provider records when they
+// share a database
+const spaceBindingPrefix = "binding/"
+
+// SpaceBindingStore is a RedisStore for storing the space bindings of location
+// commitments that implements types.SpaceBindingStore
+type SpaceBindingStore = Store[mh.Multihash, []types.SpaceBinding]
+
+// NewSpaceBindingStore returns a new instance of a space binding store using
+// the given redis client
+func NewSpaceBindingStore(client Client, opts ...Option) *SpaceBindingStore {
+	return NewStore(spaceBindingsFromRedis, spaceBindingsToRedis, spaceBindingKeyString, client, opts...)
+}
+
+type storedSpaceBinding struct {
+	ContextID  []byte `json:"contextID"`
+	Claim      string `json:"claim"`
+	Expiration int64  `json:"expiration,omitempty"`
+}
+
+func spaceBindingsFromRedis(data string) ([]types.SpaceBinding, error) {
+	var stored []storedSpaceBinding
+	if err := json.Unmarshal([]byte(data), &stored); err != nil {
+		return nil, err
+	}
+	bindings := make([]types.SpaceBinding, 0, len(stored))
+	for _, s := range stored {
+		claim, err := cid.Decode(s.Claim)
+		if err != nil {
+			return nil, fmt.Errorf("decoding space binding claim: %w", err)
+		}
+		b := types.SpaceBinding{ContextID: s.ContextID, Claim: claim}
+		if s.Expiration != 0 {
+			b.Expiration = time.Unix(s.Expiration, 0)
+		}
+		bindings = append(bindings, b)
+	}
+	return bindings, nil
+}
+
+func spaceBindingsToRedis(bindings []types.SpaceBinding) (string, error) {
+	stored := make([]storedSpaceBinding, 0, len(bindings))
+	for _, b := range bindings {
+		s := storedSpaceBinding{ContextID: b.ContextID, Claim: b.Claim.String()}
+		if !b.Expiration.IsZero() {
+			s.Expiration = b.Expiration.Unix()
+		}
+		stored = append(stored, s)
+	}
+	data, err := json.Marshal(stored)
+	return string(data), err
+}
+
+func spaceBindingKeyString(hash mh.Multihash) string {
+	return spaceBindingPrefix + string(hash)
+}
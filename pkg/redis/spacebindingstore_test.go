@@ -0,0 +1,31 @@
+package redis_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpaceBindingStore(t *testing.T) {
+	ctx := context.Background()
+	store := redis.NewSpaceBindingStore(NewMockRedis())
+	hash := testutil.RandomMultihash()
+	_, err := store.Get(ctx, hash)
+	require.ErrorIs(t, err, types.ErrKeyNotFound)
+
+	bindings := []types.SpaceBinding{
+		{ContextID: testutil.RandomBytes(32), Claim: testutil.RandomCID().(cidlink.Link).Cid, Expiration: time.Unix(time.Now().Add(time.Hour).Unix(), 0)},
+		// bindings to commitments that never expire
+		{ContextID: testutil.RandomBytes(32), Claim: testutil.RandomCID().(cidlink.Link).Cid},
+	}
+	require.NoError(t, store.SetWithTTL(ctx, hash, bindings, time.Hour))
+	require.Equal(t, bindings, testutil.Must(store.Get(ctx, hash))(t))
+	require.False(t, bindings[1].Expired(time.Now().Add(time.Hour)))
+	require.True(t, bindings[0].Expired(time.Now().Add(time.Hour)))
+}
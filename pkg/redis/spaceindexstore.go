@@ -0,0 +1,184 @@
+package redis
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	multihash "github.com/multiformats/go-multihash"
+	"github.com/redis/go-redis/v9"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// SortedSetClient is the subset of functions from the golang redis client used
+// for sorted sets
+type SortedSetClient interface {
+	ZAdd(ctx context.Context, key string, members ...redis.Z) *redis.IntCmd
+	ZRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+	ZRangeByLex(ctx context.Context, key string, opt *redis.ZRangeBy) *redis.StringSliceCmd
+	ZRangeByScore(ctx context.Context, key string, opt *redis.ZRangeBy) *redis.StringSliceCmd
+}
+
+var (
+	_ SortedSetClient       = (*redis.Client)(nil)
+	_ types.SpaceIndexStore = (*SpaceIndexStore)(nil)
+)
+
+// SpaceIndexStore records the claims bound to each space in two sorted sets per
+// space. One orders the claims by CID for paging through them, and the other
+// by expiration for pruning them. Each member encodes the whole entry, so
+// listing a page is a single range read
+type SpaceIndexStore struct {
+	client SortedSetClient
+	prefix string
+}
+
+// SpaceIndexOption configures a SpaceIndexStore
+type SpaceIndexOption func(*SpaceIndexStore)
+
+// WithSpaceNamespace keeps the space index under its own keys, apart from the
+// space index of any other namespace, so that one can be rebuilt from scratch
+// alongside another in use. The empty namespace is the default
+func WithSpaceNamespace(namespace string) SpaceIndexOption {
+	return func(s *SpaceIndexStore) {
+		s.prefix = "spaces:"
+		if namespace != "" {
+			s.prefix = "spaces@" + namespace + ":"
+		}
+	}
+}
+
+// NewSpaceIndexStore returns a new space index using the given redis client
+func NewSpaceIndexStore(client SortedSetClient, opts ...SpaceIndexOption) *SpaceIndexStore {
+	s := &SpaceIndexStore{client: client, prefix: "spaces:"}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Add records a claim bound to the space
+func (s *SpaceIndexStore) Add(ctx context.Context, space did.DID, claim types.SpaceClaim) error {
+	member := spaceClaimMember(claim)
+	expires := math.Inf(1)
+	if !claim.Expiration.IsZero() {
+		expires = float64(claim.Expiration.Unix())
+	}
+	// write the expiry first, so a claim can't be listed without being prunable
+	if err := s.client.ZAdd(ctx, s.spaceExpiryKey(space), redis.Z{Score: expires, Member: member}).Err(); err != nil {
+		return fmt.Errorf("error accessing redis: %w", err)
+	}
+	if err := s.client.ZAdd(ctx, s.spaceClaimsKey(space), redis.Z{Member: member}).Err(); err != nil {
+		return fmt.Errorf("error accessing redis: %w", err)
+	}
+	return nil
+}
+
+// List returns up to limit claims bound to the space in CID order, following
+// the given cursor. Expired claims are pruned first
+func (s *SpaceIndexStore) List(ctx context.Context, space did.DID, cursor string, limit int) ([]types.SpaceClaim, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid page limit: %d", limit)
+	}
+	min := "-"
+	if cursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, "", types.ErrInvalidCursor
+		}
+		min = "(" + string(after)
+	}
+	if _, err := s.Prune(ctx, space, time.Now()); err != nil {
+		return nil, "", err
+	}
+	// read one more than the page, to know if there is a next page
+	members, err := s.client.ZRangeByLex(ctx, s.spaceClaimsKey(space), &redis.ZRangeBy{Min: min, Max: "+", Count: int64(limit) + 1}).Result()
+	if err != nil {
+		return nil, "", fmt.Errorf("error accessing redis: %w", err)
+	}
+	var next string
+	if len(members) > limit {
+		members = members[:limit]
+		next = base64.RawURLEncoding.EncodeToString([]byte(members[limit-1]))
+	}
+	claims := make([]types.SpaceClaim, 0, len(members))
+	for _, member := range members {
+		claim, err := parseSpaceClaimMember(member)
+		if err != nil {
+			return nil, "", err
+		}
+		claims = append(claims, claim)
+	}
+	return claims, next, nil
+}
+
+// Prune removes the claims bound to the space that expired before now
+func (s *SpaceIndexStore) Prune(ctx context.Context, space did.DID, now time.Time) (int, error) {
+	expired, err := s.client.ZRangeByScore(ctx, s.spaceExpiryKey(space), &redis.ZRangeBy{Min: "-inf", Max: "(" + strconv.FormatInt(now.Unix(), 10)}).Result()
+	if err != nil {
+		return 0, fmt.Errorf("error accessing redis: %w", err)
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	members := make([]interface{}, 0, len(expired))
+	for _, member := range expired {
+		members = append(members, member)
+	}
+	// remove from the listing first, so a claim is never listed unprunable
+	if err := s.client.ZRem(ctx, s.spaceClaimsKey(space), members...).Err(); err != nil {
+		return 0, fmt.Errorf("error accessing redis: %w", err)
+	}
+	if err := s.client.ZRem(ctx, s.spaceExpiryKey(space), members...).Err(); err != nil {
+		return 0, fmt.Errorf("error accessing redis: %w", err)
+	}
+	return len(expired), nil
+}
+
+func (s *SpaceIndexStore) spaceClaimsKey(space did.DID) string {
+	return s.prefix + space.String() + ":claims"
+}
+
+func (s *SpaceIndexStore) spaceExpiryKey(space did.DID) string {
+	return s.prefix + space.String() + ":expiry"
+}
+
+// spaceClaimMember encodes a claim as a sorted set member that orders by claim
+// CID. A claim always encodes to the same member, so adding it again is a no-op
+func spaceClaimMember(claim types.SpaceClaim) string {
+	var expires int64
+	if !claim.Expiration.IsZero() {
+		expires = claim.Expiration.Unix()
+	}
+	return strings.Join([]string{claim.Claim.String(), claim.Type, claim.Hash.B58String(), strconv.FormatInt(expires, 10)}, " ")
+}
+
+func parseSpaceClaimMember(member string) (types.SpaceClaim, error) {
+	fields := strings.Split(member, " ")
+	if len(fields) != 4 {
+		return types.SpaceClaim{}, fmt.Errorf("decoding space index entry: %q", member)
+	}
+	claim, err := cid.Decode(fields[0])
+	if err != nil {
+		return types.SpaceClaim{}, fmt.Errorf("decoding space index entry: %w", err)
+	}
+	hash, err := multihash.FromB58String(fields[2])
+	if err != nil {
+		return types.SpaceClaim{}, fmt.Errorf("decoding space index entry: %w", err)
+	}
+	expires, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return types.SpaceClaim{}, fmt.Errorf("decoding space index entry: %w", err)
+	}
+	sc := types.SpaceClaim{Claim: claim, Type: fields[1], Hash: hash}
+	if expires != 0 {
+		sc.Expiration = time.Unix(expires, 0)
+	}
+	return sc, nil
+}
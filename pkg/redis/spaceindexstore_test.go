@@ -0,0 +1,259 @@
+package redis_test
+
+import (
+	"context"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpaceIndexStore(t *testing.T) {
+	ctx := context.Background()
+	space := testutil.Alice.DID()
+	newClaim := func(expiration time.Time) types.SpaceClaim {
+		return types.SpaceClaim{
+			Claim:      testutil.RandomCID().(cidlink.Link).Cid,
+			Type:       "assert/location",
+			Hash:       testutil.RandomMultihash(),
+			Expiration: expiration,
+		}
+	}
+	listAll := func(t *testing.T, store *redis.SpaceIndexStore, limit int) ([]types.SpaceClaim, int) {
+		var claims []types.SpaceClaim
+		var pages int
+		cursor := ""
+		for {
+			page, next := testutil.Must2(store.List(ctx, space, cursor, limit))(t)
+			require.LessOrEqual(t, len(page), limit)
+			claims = append(claims, page...)
+			pages++
+			if next == "" {
+				return claims, pages
+			}
+			cursor = next
+		}
+	}
+
+	t.Run("pages through claims in CID order", func(t *testing.T) {
+		store := redis.NewSpaceIndexStore(NewMockSortedSets())
+		var claims []types.SpaceClaim
+		for range 6 {
+			claim := newClaim(time.Time{})
+			claims = append(claims, claim)
+			require.NoError(t, store.Add(ctx, space, claim))
+		}
+		// adding a claim again doesn't duplicate it
+		require.NoError(t, store.Add(ctx, space, claims[0]))
+		slices.SortFunc(claims, func(a, b types.SpaceClaim) int { return strings.Compare(a.Claim.String(), b.Claim.String()) })
+
+		for _, tc := range []struct {
+			limit int
+			pages int
+		}{{1, 6}, {2, 3}, {5, 2}, {6, 1}, {7, 1}} {
+			listed, pages := listAll(t, store, tc.limit)
+			require.Equal(t, claims, listed, "limit %d", tc.limit)
+			require.Equal(t, tc.pages, pages, "limit %d", tc.limit)
+		}
+
+		listed, next := testutil.Must2(redis.NewSpaceIndexStore(NewMockSortedSets()).List(ctx, space, "", 10))(t)
+		require.Empty(t, listed)
+		require.Empty(t, next)
+
+		_, _, err := store.List(ctx, space, "not a cursor!", 10)
+		require.ErrorIs(t, err, types.ErrInvalidCursor)
+	})
+
+	t.Run("prunes expired claims", func(t *testing.T) {
+		store := redis.NewSpaceIndexStore(NewMockSortedSets())
+		expired := newClaim(time.Now().Add(-time.Hour).Truncate(time.Second))
+		later := newClaim(time.Now().Add(time.Hour).Truncate(time.Second))
+		forever := newClaim(time.Time{})
+		for _, claim := range []types.SpaceClaim{expired, later, forever} {
+			require.NoError(t, store.Add(ctx, space, claim))
+		}
+
+		listed, _ := listAll(t, store, 10)
+		require.ElementsMatch(t, []types.SpaceClaim{later, forever}, listed)
+
+		pruned := testutil.Must(store.Prune(ctx, space, time.Now().Add(2*time.Hour)))(t)
+		require.Equal(t, 1, pruned)
+		remaining, _ := testutil.Must2(store.List(ctx, space, "", 10))(t)
+		require.Equal(t, []types.SpaceClaim{forever}, remaining)
+	})
+
+	t.Run("concurrent adds to one space", func(t *testing.T) {
+		store := redis.NewSpaceIndexStore(NewMockSortedSets())
+		claims := make([]types.SpaceClaim, 50)
+		var wg sync.WaitGroup
+		for i := range claims {
+			claims[i] = newClaim(time.Time{})
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				require.NoError(t, store.Add(ctx, space, claims[i]))
+			}()
+		}
+		wg.Wait()
+		listed, _ := listAll(t, store, 7)
+		require.ElementsMatch(t, claims, listed)
+	})
+
+	t.Run("namespaces are kept apart", func(t *testing.T) {
+		sets := NewMockSortedSets()
+		current, rebuilt := redis.NewSpaceIndexStore(sets), redis.NewSpaceIndexStore(sets, redis.WithSpaceNamespace("2"))
+		claim := newClaim(time.Time{})
+		require.NoError(t, current.Add(ctx, space, claim))
+		listed, _ := testutil.Must2(rebuilt.List(ctx, space, "", 10))(t)
+		require.Empty(t, listed)
+		require.NoError(t, rebuilt.Add(ctx, space, claim))
+		listed, _ = testutil.Must2(rebuilt.List(ctx, space, "", 10))(t)
+		require.Equal(t, []types.SpaceClaim{claim}, listed)
+		// the default namespace keeps its keys
+		_, ok := sets.sets["spaces:"+space.String()+":claims"]
+		require.True(t, ok)
+		_, ok = sets.sets["spaces@2:"+space.String()+":claims"]
+		require.True(t, ok)
+	})
+}
+
+// MockSortedSets is an in memory implementation of the sorted set commands
+type MockSortedSets struct {
+	lk       sync.Mutex
+	sets     map[string]map[string]float64
+	expiries map[string]time.Duration
+}
+
+var _ redis.SortedSetClient = (*MockSortedSets)(nil)
+
+func NewMockSortedSets() *MockSortedSets {
+	return &MockSortedSets{sets: map[string]map[string]float64{}}
+}
+
+func (m *MockSortedSets) ZAdd(ctx context.Context, key string, members ...goredis.Z) *goredis.IntCmd {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	set, ok := m.sets[key]
+	if !ok {
+		set = map[string]float64{}
+		m.sets[key] = set
+	}
+	var added int64
+	for _, z := range members {
+		member := z.Member.(string)
+		if _, ok := set[member]; !ok {
+			added++
+		}
+		set[member] = z.Score
+	}
+	cmd := goredis.NewIntCmd(ctx)
+	cmd.SetVal(added)
+	return cmd
+}
+
+func (m *MockSortedSets) ZRem(ctx context.Context, key string, members ...interface{}) *goredis.IntCmd {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	var removed int64
+	for _, member := range members {
+		if _, ok := m.sets[key][member.(string)]; ok {
+			delete(m.sets[key], member.(string))
+			removed++
+		}
+	}
+	cmd := goredis.NewIntCmd(ctx)
+	cmd.SetVal(removed)
+	return cmd
+}
+
+func (m *MockSortedSets) ZRangeByLex(ctx context.Context, key string, opt *goredis.ZRangeBy) *goredis.StringSliceCmd {
+	return m.zrange(ctx, key, opt, func(member string, _ float64) bool {
+		return lexAbove(member, opt.Min) && lexBelow(member, opt.Max)
+	})
+}
+
+func (m *MockSortedSets) ZRangeByScore(ctx context.Context, key string, opt *goredis.ZRangeBy) *goredis.StringSliceCmd {
+	return m.zrange(ctx, key, opt, func(_ string, score float64) bool {
+		return scoreInRange(score, opt.Min, opt.Max)
+	})
+}
+
+func (m *MockSortedSets) zrange(ctx context.Context, key string, opt *goredis.ZRangeBy, include func(string, float64) bool) *goredis.StringSliceCmd {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	set := m.sets[key]
+	members := make([]string, 0, len(set))
+	for member, score := range set {
+		if include(member, score) {
+			members = append(members, member)
+		}
+	}
+	slices.SortFunc(members, func(a, b string) int {
+		if set[a] != set[b] {
+			return int(math.Copysign(1, set[a]-set[b]))
+		}
+		return strings.Compare(a, b)
+	})
+	members = members[min(int(opt.Offset), len(members)):]
+	if opt.Count > 0 {
+		members = members[:min(int(opt.Count), len(members))]
+	}
+	cmd := goredis.NewStringSliceCmd(ctx)
+	cmd.SetVal(members)
+	return cmd
+}
+
+func lexAbove(member, bound string) bool {
+	switch {
+	case bound == "-":
+		return true
+	case strings.HasPrefix(bound, "("):
+		return member > bound[1:]
+	default:
+		return member >= bound[1:]
+	}
+}
+
+func lexBelow(member, bound string) bool {
+	switch {
+	case bound == "+":
+		return true
+	case strings.HasPrefix(bound, "("):
+		return member < bound[1:]
+	default:
+		return member <= bound[1:]
+	}
+}
+
+func scoreInRange(score float64, lower, upper string) bool {
+	above := score >= parseScore(lower)
+	if strings.HasPrefix(lower, "(") {
+		above = score > parseScore(lower[1:])
+	}
+	below := score <= parseScore(upper)
+	if strings.HasPrefix(upper, "(") {
+		below = score < parseScore(upper[1:])
+	}
+	return above && below
+}
+
+func parseScore(s string) float64 {
+	switch s {
+	case "-inf":
+		return math.Inf(-1)
+	case "+inf":
+		return math.Inf(1)
+	}
+	v, _ := strconv.ParseFloat(s, 64)
+	return v
+}
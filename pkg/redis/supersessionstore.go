@@ -0,0 +1,41 @@
+package redis
+
+import (
+	"encoding/json"
+
+	"github.com/ipfs/go-cid"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+var (
+	_ types.SupersessionStore = (*SupersessionStore)(nil)
+)
+
+// supersessionPrefix keeps supersessions apart from claims when they share a
+// database, as both are keyed by claim CIDs
+const supersessionPrefix = "superseded/"
+
+// SupersessionStore is a RedisStore for storing the supersessions of index
+// claims that implements types.SupersessionStore
+type SupersessionStore = Store[cid.Cid, types.Supersession]
+
+// NewSupersessionStore returns a new instance of a supersession store using the
+// given redis client
+func NewSupersessionStore(client Client, opts ...Option) *SupersessionStore {
+	return NewStore(supersessionFromRedis, supersessionToRedis, supersessionKeyString, client, opts...)
+}
+
+func supersessionFromRedis(data string) (types.Supersession, error) {
+	var s types.Supersession
+	err := json.Unmarshal([]byte(data), &s)
+	return s, err
+}
+
+func supersessionToRedis(s types.Supersession) (string, error) {
+	data, err := json.Marshal(s)
+	return string(data), err
+}
+
+func supersessionKeyString(claim cid.Cid) string {
+	return supersessionPrefix + claim.String()
+}
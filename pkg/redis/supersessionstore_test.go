@@ -0,0 +1,34 @@
+package redis_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSupersessionStore(t *testing.T) {
+	ctx := context.Background()
+	store := redis.NewSupersessionStore(NewMockRedis())
+	claim := testutil.RandomCID().(cidlink.Link).Cid
+	_, err := store.Get(ctx, claim)
+	require.ErrorIs(t, err, types.ErrKeyNotFound)
+
+	now := time.Unix(time.Now().Unix(), 0).UTC()
+	supersession := types.Supersession{
+		By:         testutil.RandomCID().(cidlink.Link).Cid,
+		Issuer:     testutil.Service.DID().String(),
+		Content:    testutil.RandomMultihash(),
+		Expiration: now.Add(time.Hour),
+	}
+	require.NoError(t, store.Set(ctx, claim, supersession, false))
+	require.Equal(t, supersession, testutil.Must(store.Get(ctx, claim))(t))
+	require.True(t, supersession.Live(now))
+	require.False(t, supersession.Live(now.Add(time.Hour)))
+	require.True(t, types.Supersession{}.Live(now))
+}
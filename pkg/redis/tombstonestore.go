@@ -0,0 +1,41 @@
+package redis
+
+import (
+	"encoding/json"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+var (
+	_ types.TombstoneStore = (*TombstoneStore)(nil)
+)
+
+// tombstonePrefix keeps tombstones apart from provider records when they share
+// a database, as their keys are never multihashes
+const tombstonePrefix = "tombstone/"
+
+// TombstoneStore is a RedisStore for storing the tombstones of removed
+// providers that implements types.TombstoneStore
+type TombstoneStore = Store[peer.ID, types.ProviderTombstone]
+
+// NewTombstoneStore returns a new instance of a tombstone store using the given
+// redis client
+func NewTombstoneStore(client Client, opts ...Option) *TombstoneStore {
+	return NewStore(tombstoneFromRedis, tombstoneToRedis, tombstoneKeyString, client, opts...)
+}
+
+func tombstoneFromRedis(data string) (types.ProviderTombstone, error) {
+	var t types.ProviderTombstone
+	err := json.Unmarshal([]byte(data), &t)
+	return t, err
+}
+
+func tombstoneToRedis(t types.ProviderTombstone) (string, error) {
+	data, err := json.Marshal(t)
+	return string(data), err
+}
+
+func tombstoneKeyString(id peer.ID) string {
+	return tombstonePrefix + id.String()
+}
@@ -0,0 +1,34 @@
+package redis_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTombstoneStore(t *testing.T) {
+	ctx := context.Background()
+	store := redis.NewTombstoneStore(NewMockRedis())
+	provider := testutil.RandomPeer()
+	_, err := store.Get(ctx, provider)
+	require.ErrorIs(t, err, types.ErrKeyNotFound)
+
+	tombstone := types.ProviderTombstone{
+		Provider: provider,
+		Started:  time.Unix(time.Now().Unix(), 0).UTC(),
+		Cursor:   42,
+		Swept:    100,
+		Hashes:   10,
+		Records:  12,
+		Claims:   3,
+		Adverts:  2,
+	}
+	require.NoError(t, store.Set(ctx, provider, tombstone, false))
+	require.Equal(t, tombstone, testutil.Must(store.Get(ctx, provider))(t))
+	require.False(t, tombstone.Done())
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/bytemap"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// ContinuationHeader is the response header carrying the token used to fetch
+// the remainder of a query result that exceeded the maximum response size
+const ContinuationHeader = "X-Continuation-Token"
+
+// DefaultContinuationTTL is how long the remainder of a split query result is
+// kept for follow up requests
+const DefaultContinuationTTL = 5 * time.Minute
+
+// DefaultContinuationCacheSize is the most bytes of split query results kept
+// for follow up requests at once
+const DefaultContinuationCacheSize = 256 << 20
+
+var (
+	errContinuationExpired = errors.New("continuation token expired, re-run the query")
+	errInvalidContinuation = errors.New("invalid continuation token")
+)
+
+// resultItem is a single claim or index in a query result, with its encoded size
+type resultItem struct {
+	claim     cid.Cid
+	contextID types.EncodedContextID
+	size      int
+}
+
+// splitResult is a query result that was too large to return in a single
+// response
+type splitResult struct {
+	claims  map[cid.Cid]delegation.Delegation
+	indexes bytemap.ByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView]
+	// confirmed and indexRefs are sent with the first part
+	confirmed []cid.Cid
+	indexRefs bytemap.ReadOnlyByteMap[types.EncodedContextID, queryresult.IndexRef]
+	items     []resultItem
+	expires   time.Time
+}
+
+// continuationToken identifies the items of a split result still to be sent
+type continuationToken struct {
+	Query      string   `json:"q"`
+	Claims     []string `json:"c,omitempty"`
+	ContextIDs [][]byte `json:"i,omitempty"`
+}
+
+// cachedSplit is a split result in the result cache, with its encoded size
+type cachedSplit struct {
+	digest string
+	result *splitResult
+	size   int
+}
+
+// resultCache holds split results for a short while, keyed by the digest of
+// the query that produced them. Beyond its size in bytes, the least recently
+// used results are evicted, and their continuations are gone
+type resultCache struct {
+	lk       sync.Mutex
+	ttl      time.Duration
+	maxBytes int
+	bytes    int
+	results  map[string]*list.Element
+	// order holds the cached results, most recently used first
+	order *list.List
+}
+
+func newResultCache(ttl time.Duration, maxBytes int) *resultCache {
+	return &resultCache{ttl: ttl, maxBytes: maxBytes, results: map[string]*list.Element{}, order: list.New()}
+}
+
+// put caches the split result, returning false if it is larger than the cache
+// and so isn't cached
+func (rc *resultCache) put(digest string, result *splitResult) bool {
+	rc.lk.Lock()
+	defer rc.lk.Unlock()
+	rc.evictExpired()
+	if e, ok := rc.results[digest]; ok {
+		rc.remove(e)
+	}
+	entry := &cachedSplit{digest: digest, result: result, size: size(result.items)}
+	if entry.size > rc.maxBytes {
+		return false
+	}
+	result.expires = time.Now().Add(rc.ttl)
+	rc.results[digest] = rc.order.PushFront(entry)
+	rc.bytes += entry.size
+	for rc.bytes > rc.maxBytes {
+		rc.remove(rc.order.Back())
+	}
+	return true
+}
+
+func (rc *resultCache) get(digest string) (*splitResult, bool) {
+	rc.lk.Lock()
+	defer rc.lk.Unlock()
+	rc.evictExpired()
+	e, ok := rc.results[digest]
+	if !ok {
+		return nil, false
+	}
+	rc.order.MoveToFront(e)
+	return e.Value.(*cachedSplit).result, true
+}
+
+func (rc *resultCache) remove(e *list.Element) {
+	entry := rc.order.Remove(e).(*cachedSplit)
+	delete(rc.results, entry.digest)
+	rc.bytes -= entry.size
+}
+
+func (rc *resultCache) evictExpired() {
+	now := time.Now()
+	for e := rc.order.Front(); e != nil; {
+		next := e.Next()
+		if now.After(e.Value.(*cachedSplit).result.expires) {
+			rc.remove(e)
+		}
+		e = next
+	}
+}
+
+// queryDigest is the canonical digest of a query, as hex
+func queryDigest(q service.Query) string {
+	return hex.EncodeToString(service.QueryDigest(q))
+}
+
+// newSplitResult orders the claims and indexes of a query result for sending:
+// claims first, then indexes by ascending size
+func newSplitResult(qr queryresult.QueryResult) (*splitResult, error) {
+	claims, indexes, err := queryresult.Parts(qr)
+	if err != nil {
+		return nil, err
+	}
+	sr := &splitResult{claims: claims, indexes: indexes, indexRefs: qr.IndexReferences()}
+	for _, link := range qr.Confirmed() {
+		sr.confirmed = append(sr.confirmed, link.(cidlink.Link).Cid)
+	}
+	claimItems := make([]resultItem, 0, len(claims))
+	for c, claim := range claims {
+		size := 0
+		for blk, err := range claim.Blocks() {
+			if err != nil {
+				return nil, err
+			}
+			size += len(blk.Bytes())
+		}
+		claimItems = append(claimItems, resultItem{claim: c, size: size})
+	}
+	slices.SortFunc(claimItems, func(a, b resultItem) int {
+		return bytes.Compare(a.claim.Bytes(), b.claim.Bytes())
+	})
+	indexItems := make([]resultItem, 0, indexes.Size())
+	for contextID, index := range indexes.Iterator() {
+		r, err := index.Archive()
+		if err != nil {
+			return nil, err
+		}
+		size, err := io.Copy(io.Discard, r)
+		if err != nil {
+			return nil, err
+		}
+		indexItems = append(indexItems, resultItem{contextID: contextID, size: int(size)})
+	}
+	slices.SortStableFunc(indexItems, func(a, b resultItem) int {
+		if a.size != b.size {
+			return a.size - b.size
+		}
+		return bytes.Compare(a.contextID, b.contextID)
+	})
+	sr.items = append(claimItems, indexItems...)
+	return sr, nil
+}
+
+// size is the total encoded size of the given items
+func size(items []resultItem) int {
+	total := 0
+	for _, item := range items {
+		total += item.size
+	}
+	return total
+}
+
+// remaining returns the items named by a continuation token, in send order
+func (sr *splitResult) remaining(token continuationToken) ([]resultItem, error) {
+	claims := map[string]struct{}{}
+	for _, c := range token.Claims {
+		claims[c] = struct{}{}
+	}
+	contextIDs := map[string]struct{}{}
+	for _, contextID := range token.ContextIDs {
+		contextIDs[string(contextID)] = struct{}{}
+	}
+	var items []resultItem
+	for _, item := range sr.items {
+		if item.contextID != nil {
+			if _, ok := contextIDs[string(item.contextID)]; ok {
+				items = append(items, item)
+				delete(contextIDs, string(item.contextID))
+			}
+			continue
+		}
+		if _, ok := claims[item.claim.String()]; ok {
+			items = append(items, item)
+			delete(claims, item.claim.String())
+		}
+	}
+	// the cached result doesn't match the token, most likely because the query
+	// was re-run in the meantime
+	if len(claims) > 0 || len(contextIDs) > 0 {
+		return nil, errContinuationExpired
+	}
+	return items, nil
+}
+
+// page builds a query result from as many of the items as fit within the
+// maximum size, always including at least one item, and returns the items left
+// over. The first page also lists the confirmed claims and index references
+func (sr *splitResult) page(items []resultItem, maxSize int, first bool) (queryresult.QueryResult, []resultItem, error) {
+	claims := map[cid.Cid]delegation.Delegation{}
+	indexes := bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1)
+	total, n := 0, 0
+	for _, item := range items {
+		if n > 0 && total+item.size > maxSize {
+			break
+		}
+		if item.contextID != nil {
+			indexes.Set(item.contextID, sr.indexes.Get(item.contextID))
+		} else {
+			claims[item.claim] = sr.claims[item.claim]
+		}
+		total += item.size
+		n++
+	}
+	var opts []queryresult.Option
+	if first {
+		opts = append(opts, queryresult.WithConfirmed(sr.confirmed...), queryresult.WithIndexRefs(sr.indexRefs))
+	}
+	qr, err := queryresult.Build(claims, indexes, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return qr, items[n:], nil
+}
+
+func encodeContinuation(digest string, items []resultItem) (string, error) {
+	token := continuationToken{Query: digest}
+	for _, item := range items {
+		if item.contextID != nil {
+			token.ContextIDs = append(token.ContextIDs, item.contextID)
+		} else {
+			token.Claims = append(token.Claims, item.claim.String())
+		}
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeContinuation(s string) (continuationToken, error) {
+	var token continuationToken
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return token, errInvalidContinuation
+	}
+	if err := json.Unmarshal(data, &token); err != nil || token.Query == "" {
+		return token, errInvalidContinuation
+	}
+	return token, nil
+}
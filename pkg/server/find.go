@@ -0,0 +1,236 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/mr-tron/base58"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/service"
+)
+
+// ndjsonContentType is the media type the IPNI find API streams provider
+// records as, one JSON object per line
+const ndjsonContentType = "application/x-ndjson"
+
+// findRequestJSON is the body of a batch find, as the IPNI find API takes it
+type findRequestJSON struct {
+	Multihashes []multihash.Multihash `json:"Multihashes"`
+}
+
+// getFindCidHandler serves the provider records of the multihash of a CID when
+// a GET request is sent to "/cid/{cid}", as the IPNI find API does.
+func getFindCidHandler(s FindService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := cid.Decode(r.PathValue("cid"))
+		if err != nil {
+			writeError(w, fmt.Sprintf("invalid cid: %s", err), http.StatusBadRequest)
+			return
+		}
+		findProviders(w, r, s, c.Hash())
+	}
+}
+
+// getFindMultihashHandler serves the provider records of a multihash when a GET
+// request is sent to "/multihash/{multihash}", as the IPNI find API does.
+func getFindMultihashHandler(s FindService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash, err := parseFindMultihash(r.PathValue("multihash"))
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		findProviders(w, r, s, hash)
+	}
+}
+
+// postFindBatchHandler serves the provider records of each multihash of a batch
+// when a POST request is sent to "/multihash". Records are streamed as a
+// multihash result per line if NDJSON is accepted.
+func postFindBatchHandler(s FindService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		includeLegacy, ok := parseIncludeLegacy(w, r)
+		if !ok {
+			return
+		}
+		var req findRequestJSON
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, fmt.Sprintf("decoding find request: %s", err), http.StatusBadRequest)
+			return
+		}
+		for _, hash := range req.Multihashes {
+			if _, err := multihash.Decode(hash); err != nil {
+				writeError(w, fmt.Sprintf("invalid multihash: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+		nd := acceptsNDJSON(r)
+		var resp model.FindResponse
+		for _, hash := range req.Multihashes {
+			results, err := s.FindProviders(r.Context(), hash, includeLegacy)
+			if err != nil {
+				if len(resp.MultihashResults) > 0 && nd {
+					// the status has been written, so the stream is cut short
+					log.Errorw("finding providers", "hash", hash, "error", err)
+					return
+				}
+				writeFindError(w, err)
+				return
+			}
+			if len(results) == 0 {
+				continue
+			}
+			result := model.MultihashResult{Multihash: hash, ProviderResults: results}
+			resp.MultihashResults = append(resp.MultihashResults, result)
+			if nd {
+				if len(resp.MultihashResults) == 1 {
+					w.Header().Set("Content-Type", ndjsonContentType)
+					w.Header().Set("X-Content-Type-Options", "nosniff")
+				}
+				if err := json.NewEncoder(w).Encode(result); err != nil {
+					log.Errorw("encoding find result", "error", err)
+					return
+				}
+				if f, ok := w.(http.Flusher); ok {
+					f.Flush()
+				}
+			}
+		}
+		if len(resp.MultihashResults) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !nd {
+			writeFindResponse(w, resp)
+		}
+	}
+}
+
+// findProviders writes the provider records of the hash as a find response, or
+// as a record per line if NDJSON is accepted. A hash without records is not
+// found
+func findProviders(w http.ResponseWriter, r *http.Request, s FindService, hash multihash.Multihash) {
+	includeLegacy, ok := parseIncludeLegacy(w, r)
+	if !ok {
+		return
+	}
+	results, err := s.FindProviders(r.Context(), hash, includeLegacy)
+	if err != nil {
+		writeFindError(w, err)
+		return
+	}
+	if len(results) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !acceptsNDJSON(r) {
+		writeFindResponse(w, model.FindResponse{MultihashResults: []model.MultihashResult{{Multihash: hash, ProviderResults: results}}})
+		return
+	}
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	encoder := json.NewEncoder(w)
+	for _, result := range results {
+		if err := encoder.Encode(result); err != nil {
+			log.Errorw("encoding provider result", "error", err)
+			return
+		}
+	}
+}
+
+func writeFindResponse(w http.ResponseWriter, resp model.FindResponse) {
+	data, err := model.MarshalFindResponse(&resp)
+	if err != nil {
+		writeError(w, fmt.Sprintf("encoding find response: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		log.Errorw("writing find response", "error", err)
+	}
+}
+
+// writeFindError writes a failed find, which is the service's failure unless
+// it is rate limited
+func writeFindError(w http.ResponseWriter, err error) {
+	if errors.Is(err, service.ErrQueryRateLimited) {
+		writeError(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	writeError(w, fmt.Sprintf("finding providers: %s", err), http.StatusInternalServerError)
+}
+
+func parseIncludeLegacy(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	includeLegacy, err := parseBoolParam(r.URL.Query(), "includeLegacy", false)
+	if err != nil {
+		writeParamError(w, err)
+		return false, false
+	}
+	return includeLegacy, true
+}
+
+// parseFindMultihash decodes a multihash as the IPNI find API takes it: base58
+// encoded without a multibase prefix, or as hex. Multibase strings are accepted
+// too, if the string isn't a multihash either of those ways. A string can
+// decode to a multihash more than one way, since multibase strings are often
+// valid base58, so a multihash of a known hash function, with the length of its
+// digests, is preferred to one that merely decodes
+func parseFindMultihash(s string) (multihash.Multihash, error) {
+	s = strings.TrimSpace(s)
+	var candidates []multihash.Multihash
+	if data, err := base58.Decode(s); err == nil {
+		candidates = append(candidates, data)
+	}
+	if data, err := hex.DecodeString(s); err == nil {
+		candidates = append(candidates, data)
+	}
+	if _, data, err := multibase.Decode(s); err == nil {
+		candidates = append(candidates, data)
+	}
+	var found multihash.Multihash
+	for _, data := range candidates {
+		decoded, err := multihash.Decode(data)
+		if err != nil {
+			continue
+		}
+		if knownHash(decoded) {
+			return data, nil
+		}
+		if found == nil {
+			found = data
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("invalid multihash: %s", s)
+	}
+	return found, nil
+}
+
+// knownHash returns true if the multihash is of a known hash function, and has
+// the length of its digests if they have a fixed length
+func knownHash(decoded *multihash.DecodedMultihash) bool {
+	if _, ok := multihash.Codes[decoded.Code]; !ok {
+		return false
+	}
+	length, ok := multihash.DefaultLengths[decoded.Code]
+	return !ok || length < 0 || length == decoded.Length
+}
+
+// acceptsNDJSON returns true if the request accepts NDJSON
+func acceptsNDJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == ndjsonContentType {
+			return true
+		}
+	}
+	return false
+}
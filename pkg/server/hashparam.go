@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+)
+
+// hashFnParam is the query parameter naming the hash function of bare hex
+// digests sent in place of multihashes
+const hashFnParam = "hashfn"
+
+// paramError is a request parameter that could not be decoded. It is written
+// as the problem of a 400 response
+type paramError struct {
+	Param   string
+	Value   string
+	Problem string
+}
+
+func (e *paramError) Error() string {
+	return fmt.Sprintf("invalid %s %q: %s", e.Param, e.Value, e.Problem)
+}
+
+// writeParamError writes a 400 response for a parameter that could not be
+// decoded, naming the parameter if the error is a paramError
+func writeParamError(w http.ResponseWriter, err error) {
+	var pe *paramError
+	if !errors.As(err, &pe) {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p := newProblem(pe.Error(), http.StatusBadRequest)
+	p.Code, p.Param, p.Value, p.Reason = CodeInvalidParameter, pe.Param, pe.Value, pe.Problem
+	writeProblem(w, p)
+}
+
+type hashKind int
+
+const (
+	// multihashKind is a multibase encoded multihash
+	multihashKind hashKind = iota
+	// cidKind is a CID, of which the multihash is used
+	cidKind
+	// hexKind is a bare hex digest, with the hash function named separately
+	hexKind
+)
+
+// hashForm is the form a hash was sent in, so that hashes can be written back
+// to the caller the way it sends them
+type hashForm struct {
+	kind     hashKind
+	encoding multibase.Encoding
+	// version and codec are those of a CID
+	version uint64
+	codec   uint64
+	// hashFn is the hash function of a hex digest
+	hashFn uint64
+}
+
+// defaultHashForm is the form hashes are written in when there is no form to
+// follow: base58btc multibase multihashes
+var defaultHashForm = hashForm{kind: multihashKind, encoding: multibase.Base58BTC}
+
+// hashParam is a hash decoded from a request parameter, along with the string
+// it was sent as and the form of that string
+type hashParam struct {
+	hash  multihash.Multihash
+	input string
+	form  hashForm
+}
+
+// parseHashParam decodes a hash sent as the named parameter. Accepted are
+// multibase encoded multihashes, CIDv0 and CIDv1 strings, whose multihash is
+// used, and bare hex digests when the hashfn query parameter names the hash
+// function, which it then does for every hash of the request. The decoded
+// multihash is validated
+func parseHashParam(param, value string, query url.Values) (hashParam, error) {
+	fail := func(format string, args ...any) (hashParam, error) {
+		return hashParam{}, &paramError{Param: param, Value: value, Problem: fmt.Sprintf(format, args...)}
+	}
+	if value == "" {
+		return fail("empty hash")
+	}
+	if name := query.Get(hashFnParam); name != "" {
+		code, ok := multihash.Names[name]
+		if !ok {
+			return fail("unknown hash function %q", name)
+		}
+		digest, err := hex.DecodeString(value)
+		if err != nil {
+			return fail("not a hex digest: %s", err)
+		}
+		hash, err := multihash.Encode(digest, code)
+		if err != nil {
+			return fail("not a %s digest: %s", name, err)
+		}
+		return hashParam{hash, value, hashForm{kind: hexKind, hashFn: code}}, nil
+	}
+	// CIDv0 is a base58btc multihash without a multibase prefix
+	if len(value) == 46 && strings.HasPrefix(value, "Qm") {
+		c, err := cid.Decode(value)
+		if err != nil {
+			return fail("not a CIDv0: %s", err)
+		}
+		return hashParam{c.Hash(), value, hashForm{kind: cidKind, encoding: multibase.Base58BTC, codec: cid.DagProtobuf}}, nil
+	}
+	encoding, bytes, err := multibase.Decode(value)
+	if err != nil {
+		return fail("not a multibase string, CID, or hex digest with %s set: %s", hashFnParam, err)
+	}
+	// no hash function has the code of CIDv1, which CID bytes start with
+	if len(bytes) > 0 && bytes[0] == 1 {
+		n, c, err := cid.CidFromBytes(bytes)
+		if err != nil {
+			return fail("not a CID: %s", err)
+		}
+		if n != len(bytes) {
+			return fail("not a CID: %d trailing bytes", len(bytes)-n)
+		}
+		return hashParam{c.Hash(), value, hashForm{kind: cidKind, encoding: encoding, version: 1, codec: c.Prefix().Codec}}, nil
+	}
+	hash, err := multihash.Cast(bytes)
+	if err != nil {
+		return fail("not a multihash: %s", err)
+	}
+	return hashParam{hash, value, hashForm{kind: multihashKind, encoding: encoding}}, nil
+}
+
+// parseHashParams decodes all the hashes sent as the named query parameter
+func parseHashParams(param string, query url.Values) ([]hashParam, error) {
+	values := query[param]
+	params := make([]hashParam, 0, len(values))
+	for _, value := range values {
+		p, err := parseHashParam(param, value, query)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, p)
+	}
+	return params, nil
+}
+
+// encode writes a hash in the form, or as a base58btc multibase multihash if it
+// can't be written that way
+func (f hashForm) encode(hash multihash.Multihash) (string, error) {
+	decoded, err := multihash.Decode(hash)
+	if err != nil {
+		return "", err
+	}
+	switch f.kind {
+	case hexKind:
+		if decoded.Code == f.hashFn {
+			return hex.EncodeToString(decoded.Digest), nil
+		}
+	case cidKind:
+		if f.version == 0 {
+			if decoded.Code == multihash.SHA2_256 && decoded.Length == 32 {
+				return cid.NewCidV0(hash).String(), nil
+			}
+			break
+		}
+		return cid.NewCidV1(f.codec, hash).Encode(multibase.MustNewEncoder(f.encoding)), nil
+	case multihashKind:
+		return multibase.Encode(f.encoding, hash)
+	}
+	return defaultHashForm.encode(hash)
+}
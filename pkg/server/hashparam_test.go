@@ -0,0 +1,257 @@
+package server_test
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/bytemap"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/server"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// hashEncodings are the forms a hash is accepted in, each with the query
+// parameters it needs
+var hashEncodings = []struct {
+	name   string
+	encode func(multihash.Multihash) string
+	params url.Values
+}{
+	{
+		name:   "base58btc multihash",
+		encode: func(h multihash.Multihash) string { return must(multibase.Encode(multibase.Base58BTC, h)) },
+	},
+	{
+		name:   "base32 multihash",
+		encode: func(h multihash.Multihash) string { return must(multibase.Encode(multibase.Base32, h)) },
+	},
+	{
+		name:   "base64url multihash",
+		encode: func(h multihash.Multihash) string { return must(multibase.Encode(multibase.Base64url, h)) },
+	},
+	{
+		name:   "CIDv0",
+		encode: func(h multihash.Multihash) string { return cid.NewCidV0(h).String() },
+	},
+	{
+		name:   "base32 CIDv1",
+		encode: func(h multihash.Multihash) string { return cid.NewCidV1(cid.Raw, h).String() },
+	},
+	{
+		name: "base58btc CIDv1",
+		encode: func(h multihash.Multihash) string {
+			return cid.NewCidV1(cid.DagCBOR, h).Encode(multibase.MustNewEncoder(multibase.Base58BTC))
+		},
+	},
+	{
+		name: "hex digest",
+		encode: func(h multihash.Multihash) string {
+			return hex.EncodeToString(must(multihash.Decode(h)).Digest)
+		},
+		params: url.Values{"hashfn": {"sha2-256"}},
+	},
+}
+
+// malformedHashes are hash inputs that are rejected, with the query parameters
+// sent with them
+var malformedHashes = []struct {
+	name   string
+	value  string
+	params url.Values
+}{
+	{name: "not multibase", value: "not-a-hash"},
+	{name: "bad multibase", value: "z0OIl"},
+	{name: "truncated multihash", value: must(multibase.Encode(multibase.Base58BTC, testutil.RandomMultihash()[:20]))},
+	{name: "truncated CID", value: must(multibase.Encode(multibase.Base32, testutil.RandomCID().(cidlink.Link).Cid.Bytes()[:20]))},
+	{name: "CID with trailing bytes", value: must(multibase.Encode(multibase.Base32, append(testutil.RandomCID().(cidlink.Link).Cid.Bytes(), 0, 1)))},
+	{name: "bad CIDv0", value: "Qm" + string(make([]byte, 44))},
+	{name: "hex digest without hash function", value: "83" + hex.EncodeToString(testutil.RandomBytes(31))},
+	{name: "unknown hash function", value: hex.EncodeToString(testutil.RandomBytes(32)), params: url.Values{"hashfn": {"not-a-hash-function"}}},
+	{name: "not a hex digest", value: "xyz", params: url.Values{"hashfn": {"sha2-256"}}},
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func requireParamError(t *testing.T, resp *http.Response, param, value string) {
+	t.Helper()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, server.ProblemContentType, resp.Header.Get("Content-Type"))
+	var body server.Problem
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Equal(t, server.CodeInvalidParameter, body.Code)
+	require.Equal(t, param, body.Param)
+	require.Equal(t, value, body.Value)
+	require.NotEmpty(t, body.Reason)
+	require.Contains(t, body.Detail, body.Reason)
+}
+
+func TestHashParams__Query(t *testing.T) {
+	hash := testutil.RandomMultihash()
+	qr := testutil.Must(queryresult.Build(map[cid.Cid]delegation.Delegation{}, bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1), queryresult.WithDiagnostics(map[string]queryresult.HashDiagnosis{
+		must(multibase.Encode(multibase.Base58BTC, hash)): {Outcome: queryresult.OutcomeUnknown},
+	})))(t)
+	s := &mockService{qr: qr}
+	srv := httptest.NewServer(server.NewServer(server.WithService(s)))
+	t.Cleanup(srv.Close)
+	get := func(t *testing.T, params url.Values) *http.Response {
+		req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+"/claims?"+params.Encode(), nil))(t)
+		req.Header.Set("Accept", "application/json")
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	for _, tc := range hashEncodings {
+		t.Run(tc.name, func(t *testing.T) {
+			input := tc.encode(hash)
+			params := url.Values{"multihash": {input}, "diagnose": {"true"}}
+			for k, v := range tc.params {
+				params[k] = v
+			}
+			resp := get(t, params)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, []multihash.Multihash{hash}, s.q.Hashes)
+			// diagnoses are keyed by the hash as it was queried
+			var body struct {
+				Diagnostics map[string]json.RawMessage `json:"diagnostics"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			require.Contains(t, body.Diagnostics, input)
+		})
+	}
+	for _, tc := range malformedHashes {
+		t.Run(tc.name, func(t *testing.T) {
+			// the first hash that can't be decoded is named
+			params := url.Values{"multihash": {tc.value, testutil.RandomCID().String()}}
+			for k, v := range tc.params {
+				params[k] = v
+			}
+			requireParamError(t, get(t, params), "multihash", tc.value)
+		})
+	}
+}
+
+func TestHashParams__Aliases(t *testing.T) {
+	s := &mockAliasService{aliases: testutil.RandomMultihashes(2)}
+	srv := httptest.NewServer(server.NewServer(server.WithService(s)))
+	t.Cleanup(srv.Close)
+	get := func(t *testing.T, value string, params url.Values) *http.Response {
+		resp := testutil.Must(http.Get(srv.URL + "/aliases/" + url.PathEscape(value) + "?" + params.Encode()))(t)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	for _, tc := range hashEncodings {
+		t.Run(tc.name, func(t *testing.T) {
+			input := tc.encode(testutil.RandomMultihash())
+			resp := get(t, input, tc.params)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var body struct {
+				Hash    string   `json:"hash"`
+				Aliases []string `json:"aliases"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			// aliases are written in the form the hash was sent in
+			require.Equal(t, input, body.Hash)
+			require.Equal(t, []string{tc.encode(s.aliases[0]), tc.encode(s.aliases[1])}, body.Aliases)
+		})
+	}
+	for _, tc := range malformedHashes {
+		t.Run(tc.name, func(t *testing.T) {
+			requireParamError(t, get(t, tc.value, tc.params), "multihash", tc.value)
+		})
+	}
+
+	t.Run("aliases that can't be written in the form", func(t *testing.T) {
+		s.aliases = []multihash.Multihash{testutil.Must(multihash.Sum([]byte("alias"), multihash.SHA2_512, -1))(t)}
+		resp := get(t, cid.NewCidV0(testutil.RandomMultihash()).String(), nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body := string(testutil.Must(io.ReadAll(resp.Body))(t))
+		require.Contains(t, body, must(multibase.Encode(multibase.Base58BTC, s.aliases[0])))
+	})
+}
+
+func TestHashParams__Containing(t *testing.T) {
+	s := &mockContainingService{refs: []types.IndexRef{{ContextID: testutil.RandomBytes(10), Content: testutil.RandomMultihash()}}}
+	srv := httptest.NewServer(server.NewServer(server.WithService(s), server.WithAdminToken("secret")))
+	t.Cleanup(srv.Close)
+	get := func(t *testing.T, value string, params url.Values) *http.Response {
+		req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+"/containing/"+url.PathEscape(value)+"?"+params.Encode(), nil))(t)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	for _, tc := range hashEncodings {
+		t.Run(tc.name, func(t *testing.T) {
+			input := tc.encode(testutil.RandomMultihash())
+			resp := get(t, input, tc.params)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var body struct {
+				Hash    string `json:"hash"`
+				Indexes []struct {
+					Content string `json:"content"`
+				} `json:"indexes"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			require.Equal(t, input, body.Hash)
+			require.Equal(t, tc.encode(s.refs[0].Content), body.Indexes[0].Content)
+		})
+	}
+	for _, tc := range malformedHashes {
+		t.Run(tc.name, func(t *testing.T) {
+			requireParamError(t, get(t, tc.value, tc.params), "multihash", tc.value)
+		})
+	}
+}
+
+func TestQueryParams(t *testing.T) {
+	qr := testutil.Must(queryresult.Build(map[cid.Cid]delegation.Delegation{}, bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1)))(t)
+	s := &mockService{qr: qr}
+	srv := httptest.NewServer(server.NewServer(server.WithService(s)))
+	t.Cleanup(srv.Close)
+	get := func(t *testing.T, params url.Values) *http.Response {
+		params.Set("multihash", testutil.RandomCID().String())
+		resp := testutil.Must(http.Get(srv.URL + "/claims?" + params.Encode()))(t)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := get(t, url.Values{"fresh": {"true"}, "maxResultsPerHash": {"3"}, "prefetch": {"-1"}, "maxProviderAge": {"1h"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.True(t, s.q.Fresh)
+	require.Equal(t, 3, s.q.MaxResultsPerHash)
+	require.Equal(t, -1, s.q.Prefetch)
+	require.Equal(t, time.Hour, s.q.MaxProviderAge)
+
+	for param, value := range map[string]string{
+		"fresh":             "sometimes",
+		"maxResultsPerHash": "-1",
+		"prefetch":          "many",
+		"maxProviderAge":    "-1h",
+	} {
+		t.Run(param, func(t *testing.T) {
+			requireParamError(t, get(t, url.Values{param: {value}}), param, value)
+		})
+	}
+}
@@ -0,0 +1,806 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/go-ucanto/core/car"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	cachesync "github.com/storacha/indexing-service/pkg/sync"
+)
+
+// OpenAPIVersion is the version of the OpenAPI specification the description
+// of the server follows
+const OpenAPIVersion = "3.0.3"
+
+const (
+	adminTokenScheme       = "adminToken"
+	replicationTokenScheme = "replicationToken"
+)
+
+// apiParam is a parameter of an operation
+type apiParam struct {
+	name string
+	// in is "path" or "query"
+	in          string
+	required    bool
+	description string
+	schema      map[string]any
+}
+
+func pathParam(name, description string) apiParam {
+	return apiParam{name: name, in: "path", required: true, description: description, schema: stringSchema()}
+}
+
+func queryParam(name string, schema map[string]any, description string) apiParam {
+	return apiParam{name: name, in: "query", description: description, schema: schema}
+}
+
+func stringSchema() map[string]any { return map[string]any{"type": "string"} }
+
+func integerSchema() map[string]any { return map[string]any{"type": "integer"} }
+
+func booleanSchema() map[string]any { return map[string]any{"type": "boolean"} }
+
+func dateTimeSchema() map[string]any { return map[string]any{"type": "string", "format": "date-time"} }
+
+func repeatedSchema() map[string]any { return map[string]any{"type": "array", "items": stringSchema()} }
+
+// anyOf is the body of content that is any one of the values' types
+type anyOf []any
+
+// apiContent is a body of a media type, whose schema is that of the JSON
+// encoding of the body's type. Bodies of opaque media types are nil
+type apiContent struct {
+	mediaType string
+	body      any
+}
+
+type apiResponse struct {
+	status      int
+	description string
+	content     []apiContent
+	// headers are the descriptions of the response headers, by name
+	headers map[string]string
+}
+
+// apiOperation is the OpenAPI description of a route. Every operation may also
+// fail with a Problem
+type apiOperation struct {
+	id      string
+	summary string
+	// security is the scheme the route is authorized with, if it is
+	security  string
+	params    []apiParam
+	request   []apiContent
+	responses []apiResponse
+}
+
+func jsonResponse(description string, body any) []apiResponse {
+	return []apiResponse{{status: http.StatusOK, description: description, content: []apiContent{{"application/json", body}}}}
+}
+
+// findResponses are the responses of the IPNI find API, whose records are
+// streamed as the NDJSON lines if they are accepted
+func findResponses(description string, line any) []apiResponse {
+	return []apiResponse{
+		{status: http.StatusOK, description: description, content: []apiContent{{"application/json", model.FindResponse{}}, {ndjsonContentType, line}}},
+		{status: http.StatusNotFound, description: "No providers were found"},
+	}
+}
+
+var hashParams = []apiParam{
+	queryParam(hashFnParam, stringSchema(), "Name or code of the hash function of hashes sent as bare hex digests"),
+}
+
+var pageParams = []apiParam{
+	queryParam("cursor", stringSchema(), "Cursor of the page, returned with the previous one"),
+	queryParam("limit", integerSchema(), "Most entries in the page"),
+}
+
+// apiOperations describes every route the server may serve, by pattern
+var apiOperations = map[string]apiOperation{
+	"GET /": {
+		id:        "getVersion",
+		summary:   "Version and identity of the service",
+		responses: []apiResponse{{status: http.StatusOK, description: "Version info", content: []apiContent{{"text/plain", ""}}}},
+	},
+	"POST /claims": {
+		id:      "publishClaims",
+		summary: "Invoke the ucanto service to publish or cache claims",
+		request: []apiContent{{car.ContentType, nil}},
+		// errors decoding invocations are written by ucanto rather than as problems
+		responses: []apiResponse{
+			{status: http.StatusOK, description: "Receipts of the invocations", content: []apiContent{{car.ContentType, nil}}},
+			{status: http.StatusBadRequest, description: "The body could not be decoded", content: []apiContent{{"text/plain", ""}}},
+			{status: http.StatusUnsupportedMediaType, description: "The body is not of a supported media type", content: []apiContent{{"text/plain", ""}}},
+		},
+	},
+	"GET /claims": {
+		id:      "queryClaims",
+		summary: "Query the claims for hashes",
+		params: append([]apiParam{
+			queryParam("multihash", repeatedSchema(), "Hashes queried, as multibase multihashes, CIDs or hex digests"),
+			queryParam("spaces", repeatedSchema(), "DIDs of the spaces the claims are bound to"),
+			queryParam("strictSpaces", booleanSchema(), "Leave out location commitments not scoped to a space"),
+			queryParam("maxProviderAge", stringSchema(), "Oldest provider records used, as a duration"),
+			queryParam("prefetch", integerSchema(), "Fewer shards to prefetch the locations of than the service is set to, or negative for none"),
+			queryParam("includeSuperseded", booleanSchema(), "Include claims superseded by newer ones"),
+			queryParam("canonicalizeAliases", booleanSchema(), "Attribute what is found for hashes equal to a queried hash to a canonical one"),
+			queryParam("firstLocationWins", booleanSchema(), "Stop at the first location found for each hash"),
+			queryParam("maxResultsPerHash", integerSchema(), "Most provider records used for each hash"),
+			queryParam("knownClaim", repeatedSchema(), "CIDs of claims the caller already has"),
+			queryParam("knownIndex", repeatedSchema(), "Multibase context IDs of indexes the caller already has"),
+			queryParam("diagnose", booleanSchema(), "Diagnose hashes that found nothing, in JSON responses"),
+			queryParam("probe", booleanSchema(), "Probe the liveness of locations, in JSON responses"),
+			queryParam("fresh", booleanSchema(), "Skip results of recent lookups held in memory"),
+			queryParam("attest", booleanSchema(), "Sign a receipt for the result"),
+			queryParam("tiered", booleanSchema(), "Answer from cache first, refining the answer in the background"),
+			queryParam("continuation", stringSchema(), "Token of the next part of a split result"),
+			queryParam("refinement", stringSchema(), "Token of the complete result of a tiered query"),
+		}, hashParams...),
+		responses: []apiResponse{{
+			status:      http.StatusOK,
+			description: "The claims and indexes found, as a CAR, or summarized in JSON if asked for in the Accept header",
+			content:     []apiContent{{car.ContentType, nil}, {"application/json", queryResultJSON{}}},
+			headers: map[string]string{
+				ContinuationHeader: "Token of the next part of a split result",
+				RefinementHeader:   "Token of the complete result of a tiered query",
+				ReceiptHeader:      "Signed receipt for the result",
+				StatsHeader:        "Summary of the work done to answer the query, for CAR responses",
+			},
+		}},
+	},
+	"GET /health": {
+		id:        "getHealth",
+		summary:   "Whether the service is degraded",
+		responses: jsonResponse("Health of the service", healthJSON{}),
+	},
+	"GET /metrics": {
+		id:        "getMetrics",
+		summary:   "Metrics for scraping",
+		responses: []apiResponse{{status: http.StatusOK, description: "Metrics in the Prometheus text format", content: []apiContent{{"text/plain", ""}}}},
+	},
+	"GET /openapi.json": {
+		id:        "getOpenAPI",
+		summary:   "This description of the routes served",
+		responses: jsonResponse("OpenAPI description", map[string]any{}),
+	},
+	"GET /admission": {
+		id:        "getAdmission",
+		summary:   "Load on the service and whether queries are being shed",
+		security:  adminTokenScheme,
+		responses: jsonResponse("Admission stats", admissionJSON{}),
+	},
+	"GET /aliases/{multihash}": {
+		id:      "getAliases",
+		summary: "Hashes equivalent to a hash through equals claims",
+		params: append([]apiParam{
+			pathParam("multihash", "Hash whose aliases are listed"),
+			queryParam("spaces", repeatedSchema(), "DIDs of the spaces the equals claims are bound to"),
+		}, hashParams...),
+		responses: jsonResponse("Aliases of the hash", aliasesJSON{}),
+	},
+	"GET /cid/{cid}": {
+		id:      "findCid",
+		summary: "Provider records of the multihash of a CID, as the IPNI find API serves them",
+		params: []apiParam{
+			pathParam("cid", "CID whose multihash's providers are found"),
+			queryParam("includeLegacy", booleanSchema(), "Whether records read from the legacy systems are included"),
+		},
+		responses: findResponses("The providers of the hash, or a record per line if NDJSON is accepted", model.ProviderResult{}),
+	},
+	"GET /multihash/{multihash}": {
+		id:      "findMultihash",
+		summary: "Provider records of a multihash, as the IPNI find API serves them",
+		params: []apiParam{
+			pathParam("multihash", "Base58 or hex encoded multihash whose providers are found"),
+			queryParam("includeLegacy", booleanSchema(), "Whether records read from the legacy systems are included"),
+		},
+		responses: findResponses("The providers of the hash, or a record per line if NDJSON is accepted", model.ProviderResult{}),
+	},
+	"POST /multihash": {
+		id:      "findBatch",
+		summary: "Provider records of a batch of multihashes, as the IPNI find API serves them",
+		params: []apiParam{
+			queryParam("includeLegacy", booleanSchema(), "Whether records read from the legacy systems are included"),
+		},
+		request:   []apiContent{{"application/json", findRequestJSON{}}},
+		responses: findResponses("The providers of each hash found, or a hash per line if NDJSON is accepted", model.MultihashResult{}),
+	},
+	"GET /containing/{multihash}": {
+		id:        "getContainingIndexes",
+		summary:   "Indexes a block was found in, most recently found first",
+		security:  adminTokenScheme,
+		params:    append([]apiParam{pathParam("multihash", "Hash of the block")}, hashParams...),
+		responses: jsonResponse("Indexes containing the block", containingJSON{}),
+	},
+	"POST /claims/import": {
+		id:       "importClaims",
+		summary:  "Import claims in bulk from a CAR of delegations",
+		security: adminTokenScheme,
+		params: []apiParam{
+			queryParam("mode", stringSchema(), `"cache" or "publish"`),
+			queryParam("trustedIssuer", repeatedSchema(), "DIDs of issuers whose claims are imported"),
+		},
+		request: []apiContent{{car.ContentType, nil}},
+		responses: []apiResponse{{
+			status:      http.StatusOK,
+			description: "A line for the outcome of each claim, followed by a line with the totals",
+			content:     []apiContent{{"application/x-ndjson", anyOf{importOutcomeJSON{}, importReportJSON{}}}},
+		}},
+	},
+	"GET /providers/export": {
+		id:       "exportProviderRecords",
+		summary:  "Export a page of the cached provider records",
+		security: adminTokenScheme,
+		params: append([]apiParam{
+			queryParam("format", stringSchema(), `"ndjson" or "csv"`),
+		}, pageParams...),
+		responses: []apiResponse{{
+			status:      http.StatusOK,
+			description: "Rows of the page, with the cursor of the next page in the Next-Cursor trailer",
+			content:     []apiContent{{"application/x-ndjson", redis.ExportRow{}}, {"text/csv", ""}},
+			headers:     map[string]string{"Next-Cursor": "Cursor of the next page, sent as a trailer, empty after the last page"},
+		}},
+	},
+	"GET /sync/manifest": {
+		id:        "getSyncManifest",
+		summary:   "Describe a page of the ranges of the provider cache, for syncing other deployments",
+		security:  adminTokenScheme,
+		params:    pageParams,
+		responses: jsonResponse("A page of the manifest", cachesync.ManifestPage{}),
+	},
+	"GET /sync/records": {
+		id:       "getSyncRecords",
+		summary:  "Provider records of a page of the hashes in some ranges, for syncing other deployments",
+		security: adminTokenScheme,
+		params: append([]apiParam{
+			queryParam("ranges", stringSchema(), "Ranges separated by commas"),
+		}, pageParams...),
+		responses: []apiResponse{{
+			status:      http.StatusOK,
+			description: "Records of a hash per line, with the cursor of the next page in the Next-Cursor trailer",
+			content:     []apiContent{{"application/x-ndjson", cachesync.RecordsRow{}}},
+			headers:     map[string]string{"Next-Cursor": "Cursor of the next page, sent as a trailer, empty after the last page"},
+		}},
+	},
+	"POST /sync": {
+		id:       "syncProviderCache",
+		summary:  "Make a pass syncing the provider cache from another deployment",
+		security: adminTokenScheme,
+		request:  []apiContent{{"application/json", syncRequestJSON{}}},
+		responses: []apiResponse{{
+			status:      http.StatusOK,
+			description: "A line for the progress of the pass, the last of which is done or has the error",
+			content:     []apiContent{{"application/x-ndjson", syncProgressJSON{}}},
+		}},
+	},
+	"DELETE /providers/{peer}": {
+		id:       "removeProvider",
+		summary:  "Remove every record of a provider",
+		security: adminTokenScheme,
+		params:   []apiParam{pathParam("peer", "Peer ID of the provider")},
+		responses: []apiResponse{{
+			status:      http.StatusOK,
+			description: "A line for the progress of the removal, the last of which has the finish time or error",
+			content:     []apiContent{{"application/x-ndjson", tombstoneJSON{}}},
+		}},
+	},
+	"GET /audit": {
+		id:       "getAuditLog",
+		summary:  "List audit entries",
+		security: adminTokenScheme,
+		params: append([]apiParam{
+			queryParam("operation", stringSchema(), "Operation of the entries"),
+			queryParam("actor", stringSchema(), "Actor of the entries"),
+			queryParam("outcome", stringSchema(), "Outcome of the entries"),
+			queryParam("since", dateTimeSchema(), "Earliest time of the entries"),
+			queryParam("until", dateTimeSchema(), "Latest time of the entries"),
+		}, pageParams...),
+		responses: jsonResponse("A page of audit entries", auditLogJSON{}),
+	},
+	"GET /spaces/{did}/claims": {
+		id:        "listSpaceClaims",
+		summary:   "List a page of the claims bound to a space",
+		params:    append([]apiParam{pathParam("did", "DID of the space")}, pageParams...),
+		responses: jsonResponse("A page of the claims", spaceClaimsJSON{}),
+	},
+	"POST /spaces/backfill": {
+		id:        "backfillSpaceIndex",
+		summary:   "Index the claims in the advertisement chain by space",
+		security:  adminTokenScheme,
+		responses: jsonResponse("Number of claims indexed", backfillJSON{}),
+	},
+	"POST /selfcheck": {
+		id:       "runSelfCheck",
+		summary:  "Check the publish, cache, query and removal paths with a synthetic claim",
+		security: adminTokenScheme,
+		params: []apiParam{
+			queryParam("providerURL", stringSchema(), "URL the claim is advertised at, with {claim} in its path"),
+			queryParam("cacheWait", stringSchema(), "How long to wait for the claim to be cached, as a duration"),
+			queryParam("ipniWait", stringSchema(), "How long to wait for the claim on IPNI, as a duration"),
+		},
+		responses: []apiResponse{
+			{status: http.StatusOK, description: "Report of the passed check", content: []apiContent{{"application/json", selfCheckJSON{}}}},
+			{status: http.StatusServiceUnavailable, description: "Report of the failed check", content: []apiContent{{"application/json", selfCheckJSON{}}}},
+		},
+	},
+	"POST /admin/refresh/{multihash}": {
+		id:       "refreshHash",
+		summary:  "Drop everything cached for a hash and resolve it afresh",
+		security: adminTokenScheme,
+		params: append([]apiParam{
+			pathParam("multihash", "Hash to refresh"),
+			queryParam("resolve", booleanSchema(), "Whether the hash is resolved once refreshed, true if not set"),
+		}, hashParams...),
+		responses: []apiResponse{
+			{status: http.StatusOK, description: "Report of the refresh", content: []apiContent{{"application/json", refreshJSON{}}}},
+			{status: http.StatusServiceUnavailable, description: "Report of the refresh, with the stores that couldn't be refreshed", content: []apiContent{{"application/json", refreshJSON{}}}},
+		},
+	},
+	"POST /rebuild": {
+		id:        "rebuild",
+		summary:   "Rebuild derived stores from scratch",
+		security:  adminTokenScheme,
+		params:    []apiParam{queryParam("target", repeatedSchema(), "Stores to rebuild")},
+		responses: jsonResponse("Stores rebuilt", rebuildJSON{}),
+	},
+	"POST /indexes/reconstruct": {
+		id:       "reconstructIndex",
+		summary:  "Reconstruct the index of a shard by scanning it from its location commitment",
+		security: adminTokenScheme,
+		params: []apiParam{
+			queryParam("shard", stringSchema(), "CID of the shard"),
+			queryParam("contextID", stringSchema(), "Multibase context ID of the lost index to cache the reconstructed index as"),
+			queryParam("content", stringSchema(), "CID of the content the index is for, defaulting to the root of the shard"),
+			queryParam("republish", booleanSchema(), "Publish an index claim for the reconstructed index"),
+		},
+		// without a body, a location commitment for the shard is looked up
+		request:   []apiContent{{car.ContentType, nil}},
+		responses: jsonResponse("Summary of the reconstructed index", reconstructJSON{}),
+	},
+	"GET /config": {
+		id:        "getConfig",
+		summary:   "Effective runtime configuration",
+		security:  adminTokenScheme,
+		responses: jsonResponse("Runtime configuration", service.DynamicConfig{}),
+	},
+	"PUT /config": {
+		id:        "putConfig",
+		summary:   "Apply runtime configuration, keeping the fields not sent",
+		security:  adminTokenScheme,
+		request:   []apiContent{{"application/json", service.DynamicConfig{}}},
+		responses: jsonResponse("Runtime configuration", service.DynamicConfig{}),
+	},
+	"GET /deadletters": {
+		id:        "getDeadLetters",
+		summary:   "Failed background cache writes waiting to be replayed",
+		security:  adminTokenScheme,
+		responses: jsonResponse("Dead letters", deadLettersJSON{}),
+	},
+	"DELETE /deadletters": {
+		id:        "purgeDeadLetters",
+		summary:   "Discard every failed background cache write",
+		security:  adminTokenScheme,
+		responses: jsonResponse("Number of dead letters discarded", purgeJSON{}),
+	},
+	"GET /expansions": {
+		id:        "getExpansions",
+		summary:   "Indexes queued, being expanded, or that failed to expand",
+		security:  adminTokenScheme,
+		responses: jsonResponse("Index expansions", expansionsJSON{}),
+	},
+	"GET /identities/conflicts": {
+		id:        "getIdentityConflicts",
+		summary:   "Pairs of claim issuer and advertising peer that disagree with the identity mapping",
+		security:  adminTokenScheme,
+		responses: jsonResponse("Identity conflicts", identityConflictsJSON{}),
+	},
+	"GET /publisher/summary": {
+		id:        "getPublisherSummary",
+		summary:   "Size of the advertisement chain",
+		security:  adminTokenScheme,
+		responses: jsonResponse("Chain summary", publisherSummaryJSON{}),
+	},
+	"POST /publisher/summary/rebuild": {
+		id:        "rebuildPublisherSummary",
+		summary:   "Recompute the advertisement chain summary from the chain",
+		security:  adminTokenScheme,
+		responses: jsonResponse("Chain summary", publisherSummaryJSON{}),
+	},
+	"GET /publisher/chain": {
+		id:       "exportPublisherChain",
+		summary:  "Export the advertisement chain as a CAR",
+		security: adminTokenScheme,
+		params: []apiParam{
+			queryParam("from", stringSchema(), "CID of the advertisement to export from, defaulting to the head"),
+			queryParam("at", dateTimeSchema(), "Export from the head as of this time"),
+			queryParam("to", stringSchema(), "CID of the advertisement to export back to, defaulting to the tail"),
+		},
+		responses: []apiResponse{{status: http.StatusOK, description: "The advertisements and their entries", content: []apiContent{{car.ContentType, nil}}}},
+	},
+	"POST /publisher/chain": {
+		id:        "importPublisherChain",
+		summary:   "Import an advertisement chain from a CAR",
+		security:  adminTokenScheme,
+		request:   []apiContent{{car.ContentType, nil}},
+		responses: jsonResponse("Chain summary", publisherSummaryJSON{}),
+	},
+	"GET /publisher/timeline": {
+		id:       "getPublisherTimeline",
+		summary:  "Advertisements published in a window of time",
+		security: adminTokenScheme,
+		params: []apiParam{
+			queryParam("from", dateTimeSchema(), "Start of the window, defaulting to the start of time"),
+			queryParam("to", dateTimeSchema(), "End of the window, defaulting to now"),
+			queryParam("limit", integerSchema(), "Most advertisements listed"),
+		},
+		responses: jsonResponse("Timeline of the window", timelineJSON{}),
+	},
+	"GET /publisher/advert/{cid}": {
+		id:       "inspectPublisherAdvert",
+		summary:  "A stored advertisement decoded field by field",
+		security: adminTokenScheme,
+		params: []apiParam{
+			pathParam("cid", "CID of the advertisement"),
+			queryParam("chunks", integerSchema(), "Most entries chunks walked to count the entries"),
+		},
+		responses: jsonResponse("Inspection of the advertisement", advertInspectionJSON{}),
+	},
+	"GET /publisher/announcer": {
+		id:        "getAnnouncer",
+		summary:   "Health of the announce endpoints",
+		security:  adminTokenScheme,
+		responses: jsonResponse("Announcer stats", announcerJSON{}),
+	},
+	"GET /publisher/lag": {
+		id:        "getPublisherLag",
+		summary:   "How far behind the head of the advertisement chain each indexer is",
+		security:  adminTokenScheme,
+		responses: jsonResponse("Lag of each indexer", []lagJSON{}),
+	},
+	"GET /publisher/divergence": {
+		id:        "getPublisherDivergence",
+		summary:   "How the chain each indexer ingested relates to the advertisement chain",
+		security:  adminTokenScheme,
+		responses: jsonResponse("Divergence of each indexer", []divergenceJSON{}),
+	},
+	"POST /publisher/rebase": {
+		id:       "rebasePublisherChain",
+		summary:  "Publish the advertisements of a divergent chain again on top of an indexer's",
+		security: adminTokenScheme,
+		params: []apiParam{
+			queryParam("onto", stringSchema(), "CID of the last advertisement the indexer ingested"),
+			queryParam("dryRun", booleanSchema(), "Report what would be published without writing anything"),
+		},
+		responses: jsonResponse("Advertisements rebased", rebaseJSON{}),
+	},
+	"POST /replicate": {
+		id:        "replicate",
+		summary:   "Apply a batch of cache writes from another region",
+		security:  replicationTokenScheme,
+		request:   []apiContent{{"application/cbor", nil}},
+		responses: []apiResponse{{status: http.StatusNoContent, description: "The batch was applied"}},
+	},
+}
+
+// router is an http.ServeMux that only registers documented routes, keeping
+// their patterns for the OpenAPI description
+type router struct {
+	*http.ServeMux
+	patterns []string
+}
+
+func newRouter() *router {
+	return &router{ServeMux: http.NewServeMux()}
+}
+
+func (rt *router) Handle(pattern string, handler http.Handler) {
+	if _, ok := apiOperations[pattern]; !ok {
+		panic(fmt.Sprintf("route %q has no OpenAPI description", pattern))
+	}
+	rt.patterns = append(rt.patterns, pattern)
+	rt.ServeMux.Handle(pattern, handler)
+}
+
+func (rt *router) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	rt.Handle(pattern, http.HandlerFunc(handler))
+}
+
+// getOpenAPIHandler describes the routes served when a GET request is sent to
+// "/openapi.json".
+func getOpenAPIHandler(rt *router) func(http.ResponseWriter, *http.Request) {
+	// routes are all registered before the first request
+	document := sync.OnceValues(func() ([]byte, error) {
+		return json.Marshal(openAPIDocument(rt.patterns))
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := document()
+		if err != nil {
+			writeError(w, fmt.Sprintf("encoding OpenAPI description: %s", err.Error()), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}
+}
+
+// openAPIDocument returns the OpenAPI description of the routes with the
+// patterns
+func openAPIDocument(patterns []string) map[string]any {
+	s := newSchemas()
+	problem := s.of(reflect.TypeOf(Problem{}))
+	paths := map[string]map[string]any{}
+	for _, pattern := range patterns {
+		method, path, _ := strings.Cut(pattern, " ")
+		op := apiOperations[pattern]
+		responses := map[string]any{
+			"default": map[string]any{
+				"description": "Error",
+				"content":     map[string]any{ProblemContentType: map[string]any{"schema": problem}},
+			},
+		}
+		for _, r := range op.responses {
+			response := map[string]any{"description": r.description}
+			if len(r.content) > 0 {
+				response["content"] = s.content(r.content)
+			}
+			if len(r.headers) > 0 {
+				headers := map[string]any{}
+				for name, description := range r.headers {
+					headers[name] = map[string]any{"description": description, "schema": stringSchema()}
+				}
+				response["headers"] = headers
+			}
+			responses[strconv.Itoa(r.status)] = response
+		}
+		operation := map[string]any{"operationId": op.id, "summary": op.summary, "responses": responses}
+		if len(op.params) > 0 {
+			params := make([]map[string]any, 0, len(op.params))
+			for _, p := range op.params {
+				params = append(params, map[string]any{"name": p.name, "in": p.in, "required": p.required, "description": p.description, "schema": p.schema})
+			}
+			operation["parameters"] = params
+		}
+		if len(op.request) > 0 {
+			operation["requestBody"] = map[string]any{"required": true, "content": s.content(op.request)}
+		}
+		if op.security != "" {
+			operation["security"] = []map[string][]string{{op.security: {}}}
+		}
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path][strings.ToLower(method)] = operation
+	}
+	return map[string]any{
+		"openapi": OpenAPIVersion,
+		"info":    map[string]any{"title": "indexing-service", "version": "0.0.0"},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": s.components,
+			"securitySchemes": map[string]any{
+				adminTokenScheme:       map[string]any{"type": "http", "scheme": "bearer"},
+				replicationTokenScheme: map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// claimSummarySchema is encoded the same as queryresult.ClaimSummary
+type claimSummarySchema struct {
+	Type        string            `json:"type"`
+	Space       string            `json:"space,omitempty"`
+	Content     []string          `json:"content,omitempty"`
+	Index       string            `json:"index,omitempty"`
+	Equals      string            `json:"equals,omitempty"`
+	Location    []string          `json:"location,omitempty"`
+	Unfetchable bool              `json:"unfetchable,omitempty"`
+	Range       *claimRangeSchema `json:"range,omitempty"`
+	Expiration  *time.Time        `json:"expiration,omitempty"`
+}
+
+type claimRangeSchema struct {
+	Offset uint64  `json:"offset"`
+	Length *uint64 `json:"length,omitempty"`
+}
+
+// locationProbeSchema is encoded the same as queryresult.LocationProbe
+type locationProbeSchema struct {
+	Status  queryresult.ProbeStatus `json:"status"`
+	Code    int                     `json:"code,omitempty"`
+	Latency string                  `json:"latency,omitempty"`
+	Error   string                  `json:"error,omitempty"`
+	Cached  bool                    `json:"cached,omitempty"`
+}
+
+// statsSchema is encoded the same as queryresult.Stats
+type statsSchema struct {
+	Jobs            int            `json:"jobs"`
+	CacheHits       map[string]int `json:"cacheHits,omitempty"`
+	CacheMisses     map[string]int `json:"cacheMisses,omitempty"`
+	Fetches         map[string]int `json:"fetches,omitempty"`
+	IndexesExpanded int            `json:"indexesExpanded"`
+	WallTime        string         `json:"wallTime"`
+	Truncated       []string       `json:"truncated,omitempty"`
+}
+
+// addrInfoSchema is encoded the same as peer.AddrInfo
+type addrInfoSchema struct {
+	ID    string   `json:"ID"`
+	Addrs []string `json:"Addrs"`
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	// schemaMirrors are the types whose schemas are those of other types,
+	// because they have their own JSON encoding
+	schemaMirrors = map[reflect.Type]reflect.Type{
+		reflect.TypeOf(queryresult.ClaimSummary{}):  reflect.TypeOf(claimSummarySchema{}),
+		reflect.TypeOf(queryresult.LocationProbe{}): reflect.TypeOf(locationProbeSchema{}),
+		reflect.TypeOf(queryresult.Stats{}):         reflect.TypeOf(statsSchema{}),
+		reflect.TypeOf(peer.AddrInfo{}):             reflect.TypeOf(addrInfoSchema{}),
+	}
+)
+
+// schemas builds the JSON schemas of the JSON encodings of types, with named
+// structs as components referred to by name
+type schemas struct {
+	components map[string]any
+	types      map[string]reflect.Type
+}
+
+func newSchemas() *schemas {
+	return &schemas{components: map[string]any{}, types: map[string]reflect.Type{}}
+}
+
+func (s *schemas) content(content []apiContent) map[string]any {
+	media := map[string]any{}
+	for _, c := range content {
+		var schema map[string]any
+		switch body := c.body.(type) {
+		case nil:
+			schema = map[string]any{"type": "string", "format": "binary"}
+		case anyOf:
+			options := make([]map[string]any, 0, len(body))
+			for _, b := range body {
+				options = append(options, s.of(reflect.TypeOf(b)))
+			}
+			schema = map[string]any{"anyOf": options}
+		default:
+			schema = s.of(reflect.TypeOf(body))
+		}
+		media[c.mediaType] = map[string]any{"schema": schema}
+	}
+	return media
+}
+
+func (s *schemas) of(t reflect.Type) map[string]any {
+	if t.Kind() == reflect.Pointer {
+		return s.of(t.Elem())
+	}
+	if mirror, ok := schemaMirrors[t]; ok {
+		return s.named(schemaName(t), mirror)
+	}
+	if t == timeType {
+		return dateTimeSchema()
+	}
+	if t.Implements(marshalerType) {
+		panic(fmt.Sprintf("%s has its own JSON encoding, and no schema mirror", t))
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return booleanSchema()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return integerSchema()
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return stringSchema()
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": s.of(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.of(t.Elem())}
+	case reflect.Interface:
+		return map[string]any{}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		return s.named(schemaName(t), t)
+	}
+	panic(fmt.Sprintf("no schema for %s", t))
+}
+
+// named returns a reference to the component with the schema of the struct
+func (s *schemas) named(name string, t reflect.Type) map[string]any {
+	if seen, ok := s.types[name]; !ok {
+		s.types[name] = t
+		s.components[name] = s.object(t)
+	} else if seen != t {
+		panic(fmt.Sprintf("schema %s is both %s and %s", name, seen, t))
+	}
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+func (s *schemas) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	s.fields(t, properties, &required)
+	schema := map[string]any{"type": "object", "properties": properties, "additionalProperties": false}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// fields adds the schemas of the fields of the struct, and those of structs it
+// embeds, as encoding/json encodes them
+func (s *schemas) fields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			s.fields(f.Type, properties, required)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		omitempty := strings.Contains(opts, "omitempty")
+		schema := s.of(f.Type)
+		switch f.Type.Kind() {
+		case reflect.Slice, reflect.Map, reflect.Pointer:
+			// nil values are encoded as null unless they are left out
+			if !omitempty {
+				schema = map[string]any{"allOf": []any{schema}, "nullable": true}
+			}
+		}
+		properties[name] = schema
+		if !omitempty || !omittable(f.Type) {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// omittable returns true for the types of fields encoding/json leaves out when
+// they are empty and tagged omitempty
+func omittable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Struct:
+		return false
+	case reflect.Array:
+		return t.Len() == 0
+	}
+	return true
+}
+
+// schemaName is the name of the component for a struct, without the suffix of
+// the types written for encoding
+func schemaName(t reflect.Type) string {
+	name := strings.TrimSuffix(strings.TrimSuffix(t.Name(), "JSON"), "Schema")
+	runes := []rune(name)
+	runes[0] = unicode.ToUpper(runes[0])
+	return string(runes)
+}
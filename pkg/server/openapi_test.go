@@ -0,0 +1,624 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/client"
+	"github.com/storacha/go-ucanto/core/car"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/core/invocation"
+	"github.com/storacha/go-ucanto/did"
+	ed25519 "github.com/storacha/go-ucanto/principal/ed25519/signer"
+	ucanhttp "github.com/storacha/go-ucanto/transport/http"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/internal/bytemap"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/server"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/admission"
+	"github.com/storacha/indexing-service/pkg/service/audit"
+	"github.com/storacha/indexing-service/pkg/service/claimimport"
+	"github.com/storacha/indexing-service/pkg/service/deadletter"
+	"github.com/storacha/indexing-service/pkg/service/expansion"
+	"github.com/storacha/indexing-service/pkg/service/identity"
+	"github.com/storacha/indexing-service/pkg/service/prommetrics"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/service/replication"
+	cachesync "github.com/storacha/indexing-service/pkg/sync"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// documentedService is a service with every optional feature, so that the
+// server serves every route
+type documentedService struct {
+	mockService
+	published   []delegation.Delegation
+	config      service.DynamicConfig
+	admission   *admission.Controller
+	publisher   *publisher.Publisher
+	announcer   *publisher.Announcer
+	lag         *publisher.LagMonitor
+	deadLetters *deadletter.Queue
+	expansions  *expansion.Pool
+	identities  *identity.Mapping
+	replicator  *replication.Replicator
+	auditLog    *audit.Log
+	syncStore   *memSyncStore
+}
+
+func (m *documentedService) PublishClaim(ctx context.Context, claim delegation.Delegation) error {
+	m.published = append(m.published, claim)
+	return nil
+}
+
+func (m *documentedService) Config() service.DynamicConfig { return m.config }
+
+func (m *documentedService) Reconfigure(cfg service.DynamicConfig) error {
+	m.config = cfg
+	return nil
+}
+
+func (m *documentedService) DeadLetters() *deadletter.Queue { return m.deadLetters }
+
+func (m *documentedService) Expansions() *expansion.Pool { return m.expansions }
+
+func (m *documentedService) Replicator() *replication.Replicator { return m.replicator }
+
+func (m *documentedService) Announcer() *publisher.Announcer { return m.announcer }
+
+func (m *documentedService) SyncSource() *cachesync.Source { return cachesync.NewSource(m.syncStore) }
+
+func (m *documentedService) Syncer() *cachesync.Syncer { return cachesync.NewSyncer(m.syncStore) }
+
+func (m *documentedService) LagMonitor() *publisher.LagMonitor { return m.lag }
+
+func (m *documentedService) MetricsHandler() http.Handler { return prommetrics.New().Handler() }
+
+func (m *documentedService) Admission() *admission.Controller { return m.admission }
+
+func (m *documentedService) Aliases(ctx context.Context, mh multihash.Multihash, match service.Match) ([]multihash.Multihash, []cid.Cid, error) {
+	return testutil.RandomMultihashes(1), []cid.Cid{testutil.RandomCID().(cidlink.Link).Cid}, nil
+}
+
+func (m *documentedService) FindProviders(ctx context.Context, hash multihash.Multihash, includeLegacy bool) ([]model.ProviderResult, error) {
+	return []model.ProviderResult{testutil.RandomProviderResult()}, nil
+}
+
+func (m *documentedService) ContainingIndexes(ctx context.Context, hash multihash.Multihash) ([]types.IndexRef, error) {
+	return []types.IndexRef{{ContextID: testutil.RandomBytes(10), Content: testutil.RandomMultihash()}}, nil
+}
+
+func (m *documentedService) ListClaims(ctx context.Context, space did.DID, cursor string, limit int) ([]types.SpaceClaim, string, error) {
+	claim := types.SpaceClaim{Claim: testutil.RandomCID().(cidlink.Link).Cid, Type: assert.LocationAbility, Hash: testutil.RandomMultihash(), Expiration: time.Now()}
+	return []types.SpaceClaim{claim}, "next", nil
+}
+
+func (m *documentedService) BackfillSpaceIndex(ctx context.Context) (int, error) { return 1, nil }
+
+func (m *documentedService) Rebuild(ctx context.Context, targets ...service.RebuildTarget) error {
+	return nil
+}
+
+func (m *documentedService) ReconstructIndex(ctx context.Context, shard cid.Cid, location delegation.Delegation, opts ...service.ReconstructOption) (blobindex.ShardedDagIndexView, error) {
+	_, index := testutil.RandomShardedDagIndexView(1)
+	return index, nil
+}
+
+func (m *documentedService) ImportClaims(ctx context.Context, r io.Reader, opts service.ImportOptions) (service.ImportReport, error) {
+	opts.OnOutcome(claimimport.Outcome{Claim: testutil.RandomCID().(cidlink.Link).Cid, Type: assert.LocationAbility, Status: claimimport.StatusImported})
+	return service.ImportReport{Imported: 1}, nil
+}
+
+func (m *documentedService) RemoveProvider(ctx context.Context, provider peer.ID, onProgress func(types.ProviderTombstone)) error {
+	onProgress(types.ProviderTombstone{Provider: provider, Started: time.Now()})
+	onProgress(types.ProviderTombstone{Provider: provider, Started: time.Now(), Finished: time.Now(), Hashes: 1})
+	return nil
+}
+
+func (m *documentedService) ExportProviderRecords(ctx context.Context, w io.Writer, format types.ExportFormat, cursor string, limit int) (string, error) {
+	if format == types.ExportCSV {
+		_, err := io.WriteString(w, "multihash,provider,protocols,contextID,ttl\n")
+		return "", err
+	}
+	return "", json.NewEncoder(w).Encode(redis.ExportRow{Multihash: testutil.RandomMultihash().B58String(), Provider: testutil.RandomPeer().String(), Protocols: []string{"location-commitment"}, TTL: -1})
+}
+
+func (m *documentedService) Audit(ctx context.Context, entry types.AuditEntry) error {
+	return nil
+}
+
+func (m *documentedService) AuditLog() types.AuditLog { return m.auditLog }
+
+func (m *documentedService) SelfCheck(ctx context.Context, opts service.SelfCheckOptions) (service.SelfCheckReport, error) {
+	return service.SelfCheckReport{Started: time.Now(), Stages: []service.SelfCheckResult{{Stage: service.SelfCheckPublish, Status: service.SelfCheckPassed}}}, nil
+}
+
+func (m *documentedService) Refresh(ctx context.Context, hash multihash.Multihash, opts service.RefreshOptions) (service.RefreshReport, error) {
+	report := service.RefreshReport{Hash: hash, Stores: []service.RefreshStoreResult{{Store: service.RefreshProviders, Deleted: 1}}}
+	if opts.Resolve {
+		report.Resolution = &service.RefreshResolution{Claims: []cid.Cid{testutil.RandomCID().(cidlink.Link).Cid}}
+	}
+	return report, nil
+}
+
+func (m *documentedService) Identities() *identity.Mapping { return m.identities }
+
+func (m *documentedService) Publisher() *publisher.Publisher { return m.publisher }
+
+// openAPIClient calls operations of a server by their IDs, as described by the
+// OpenAPI description it serves, checking the responses match the description
+type openAPIClient struct {
+	url        string
+	tokens     map[string]string
+	operations map[string]openAPIOperation
+	schemas    map[string]map[string]any
+}
+
+type openAPIParameter struct {
+	Name     string `json:"name"`
+	In       string `json:"in"`
+	Required bool   `json:"required"`
+}
+
+type openAPIOperation struct {
+	method      string
+	path        string
+	OperationID string             `json:"operationId"`
+	Parameters  []openAPIParameter `json:"parameters"`
+	RequestBody *struct {
+		Content map[string]any `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]struct {
+		Content map[string]struct {
+			Schema map[string]any `json:"schema"`
+		} `json:"content"`
+	} `json:"responses"`
+	Security []map[string][]string `json:"security"`
+}
+
+func newOpenAPIClient(t *testing.T, serverURL string, tokens map[string]string) *openAPIClient {
+	resp := testutil.Must(http.Get(serverURL + "/openapi.json"))(t)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var doc struct {
+		OpenAPI    string                                 `json:"openapi"`
+		Paths      map[string]map[string]openAPIOperation `json:"paths"`
+		Components struct {
+			Schemas map[string]map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&doc))
+	require.Equal(t, server.OpenAPIVersion, doc.OpenAPI)
+	c := &openAPIClient{url: serverURL, tokens: tokens, operations: map[string]openAPIOperation{}, schemas: doc.Components.Schemas}
+	for path, methods := range doc.Paths {
+		for method, op := range methods {
+			op.method, op.path = strings.ToUpper(method), path
+			require.NotContains(t, c.operations, op.OperationID)
+			c.operations[op.OperationID] = op
+		}
+	}
+	return c
+}
+
+type openAPICall struct {
+	path   map[string]string
+	query  url.Values
+	accept string
+	// body is sent as the first media type of the request body
+	body []byte
+	// anonymous calls are sent without the token of the operation
+	anonymous bool
+	status    int
+}
+
+// call calls the operation, failing if the call or its response don't match
+// the description, and returns the response body
+func (c *openAPIClient) call(t *testing.T, id string, call openAPICall) (*http.Response, []byte) {
+	t.Helper()
+	op, ok := c.operations[id]
+	require.True(t, ok, "operation %s is not described", id)
+	path := op.path
+	for _, p := range op.Parameters {
+		switch p.In {
+		case "path":
+			require.Contains(t, call.path, p.Name)
+			path = strings.ReplaceAll(path, "{"+p.Name+"}", url.PathEscape(call.path[p.Name]))
+		case "query":
+			if p.Required {
+				require.Contains(t, call.query, p.Name)
+			}
+		}
+	}
+	for name := range call.query {
+		require.True(t, slices.Contains(op.Parameters, openAPIParameter{Name: name, In: "query"}), "parameter %s of %s is not described", name, id)
+	}
+	target := c.url + path
+	if len(call.query) > 0 {
+		target += "?" + call.query.Encode()
+	}
+	var body io.Reader
+	if call.body != nil {
+		body = bytes.NewReader(call.body)
+	}
+	req := testutil.Must(http.NewRequest(op.method, target, body))(t)
+	if call.body != nil {
+		require.NotNil(t, op.RequestBody, "%s has no request body", id)
+		req.Header.Set("Content-Type", slices.Sorted(maps.Keys(op.RequestBody.Content))[0])
+	}
+	if call.accept != "" {
+		req.Header.Set("Accept", call.accept)
+	}
+	for _, scheme := range op.Security {
+		for name := range scheme {
+			if !call.anonymous {
+				req.Header.Set("Authorization", "Bearer "+c.tokens[name])
+			}
+		}
+	}
+	resp := testutil.Must(http.DefaultClient.Do(req))(t)
+	t.Cleanup(func() { resp.Body.Close() })
+	data := testutil.Must(io.ReadAll(resp.Body))(t)
+	require.Equal(t, call.status, resp.StatusCode, "%s: %s", id, data)
+
+	response, ok := op.Responses[strconv.Itoa(resp.StatusCode)]
+	if !ok {
+		response, ok = op.Responses["default"]
+	}
+	require.True(t, ok, "status %d of %s is not described", resp.StatusCode, id)
+	if len(data) == 0 {
+		return resp, data
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	content, ok := response.Content[mediaType]
+	require.True(t, ok, "%s responses of %s with status %d are not described", mediaType, id, resp.StatusCode)
+	switch mediaType {
+	case "application/json", server.ProblemContentType:
+		var v any
+		require.NoError(t, json.Unmarshal(data, &v))
+		require.NoError(t, c.validate(content.Schema, v, id), "%s", data)
+	case "application/x-ndjson":
+		lines := bufio.NewScanner(bytes.NewReader(data))
+		for lines.Scan() {
+			var v any
+			require.NoError(t, json.Unmarshal(lines.Bytes(), &v))
+			require.NoError(t, c.validate(content.Schema, v, id), "%s", lines.Bytes())
+		}
+	}
+	return resp, data
+}
+
+// validate checks the decoded JSON value against the schema
+func (c *openAPIClient) validate(schema map[string]any, v any, at string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		component, ok := c.schemas[name]
+		if !ok {
+			return fmt.Errorf("%s: no schema %s", at, name)
+		}
+		return c.validate(component, v, at)
+	}
+	if v == nil {
+		if len(schema) == 0 || schema["nullable"] == true {
+			return nil
+		}
+		return fmt.Errorf("%s: unexpected null", at)
+	}
+	if all, ok := schema["allOf"].([]any); ok {
+		for _, s := range all {
+			if err := c.validate(s.(map[string]any), v, at); err != nil {
+				return err
+			}
+		}
+	}
+	if options, ok := schema["anyOf"].([]any); ok {
+		var errs []string
+		for _, s := range options {
+			err := c.validate(s.(map[string]any), v, at)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err.Error())
+		}
+		return fmt.Errorf("%s: matches none of %s", at, strings.Join(errs, "; "))
+	}
+	switch schema["type"] {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: %v is not an object", at, v)
+		}
+		for _, name := range asSlice(schema["required"]) {
+			if _, ok := obj[name.(string)]; !ok {
+				return fmt.Errorf("%s: missing %s", at, name)
+			}
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		for name, pv := range obj {
+			if ps, ok := properties[name]; ok {
+				if err := c.validate(ps.(map[string]any), pv, at+"."+name); err != nil {
+					return err
+				}
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					return fmt.Errorf("%s: undescribed property %s", at, name)
+				}
+			case map[string]any:
+				if err := c.validate(additional, pv, at+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	case "array":
+		items, ok := v.([]any)
+		if !ok {
+			return fmt.Errorf("%s: %v is not an array", at, v)
+		}
+		for i, item := range items {
+			if err := c.validate(schema["items"].(map[string]any), item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s: %v is not a string", at, v)
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				return fmt.Errorf("%s: %w", at, err)
+			}
+		}
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != math.Trunc(n) {
+			return fmt.Errorf("%s: %v is not an integer", at, v)
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return fmt.Errorf("%s: %v is not a number", at, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: %v is not a boolean", at, v)
+		}
+	}
+	return nil
+}
+
+func asSlice(v any) []any {
+	s, _ := v.([]any)
+	return s
+}
+
+func newDocumentedServer(t *testing.T) (*documentedService, string) {
+	ctx := context.Background()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	provider := peer.AddrInfo{ID: testutil.Must(peer.IDFromPrivateKey(key))(t)}
+	p := publisher.New(ds, key)
+	head := testutil.Must(p.Publish(ctx, provider, testutil.RandomBytes(10), testutil.RandomBytes(10), testutil.RandomMultihashes(2)))(t)
+	lag := publisher.NewLagMonitor(p, provider.ID, []publisher.LagEndpoint{
+		{Name: "indexer", Finder: staticFinder{&model.ProviderInfo{LastAdvertisement: head.(cidlink.Link).Cid}}},
+	})
+	testutil.Must(lag.Check(ctx))(t)
+	deadLetters := testutil.Must(deadletter.NewQueue(nil, ds))(t)
+	require.NoError(t, deadLetters.Add(ctx, testutil.RandomMultihash(), []model.ProviderResult{testutil.RandomProviderResult()}, true))
+	expansions := testutil.Must(expansion.NewPool(ds, nil))(t)
+	require.NoError(t, expansions.Enqueue(ctx, expansion.Task{ContextID: testutil.RandomBytes(10), Index: testutil.RandomCID().(cidlink.Link).Cid, Provider: testutil.RandomProviderResult(), Reason: expansion.ReasonQuery}))
+
+	claim := testutil.RandomLocationDelegation()
+	claimCid := claim.Link().(cidlink.Link).Cid
+	refs := bytemap.NewByteMap[types.EncodedContextID, queryresult.IndexRef](-1)
+	refs.Set(testutil.RandomBytes(10), queryresult.IndexRef{Index: testutil.RandomCID().(cidlink.Link).Cid, Provider: testutil.RandomPeer()})
+	qr := testutil.Must(queryresult.Build(
+		map[cid.Cid]delegation.Delegation{claimCid: claim},
+		bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1),
+		queryresult.WithIndexRefs(refs),
+		queryresult.WithProbes(map[string]queryresult.LocationProbe{testutil.TestURL.String(): {Status: queryresult.ProbeLive, Code: 200, Latency: time.Millisecond}}),
+		queryresult.WithDiagnostics(map[string]queryresult.HashDiagnosis{
+			testutil.RandomMultihash().B58String(): {Outcome: queryresult.OutcomeUnknown, Lookups: []queryresult.LookupDiagnosis{{JobType: "standard", Source: "ipni"}}},
+		}),
+	))(t)
+
+	s := &documentedService{
+		mockService: mockService{qr: qr},
+		config:      service.DefaultDynamicConfig(),
+		admission:   admission.New(),
+		publisher:   p,
+		announcer:   testutil.Must(publisher.NewAnnouncer(ds, nil))(t),
+		lag:         lag,
+		deadLetters: deadLetters,
+		expansions:  expansions,
+		identities:  testutil.Must(identity.NewMapping(ctx, ds))(t),
+		replicator:  testutil.Must(replication.NewReplicator("local", nil, nil, nil, ds))(t),
+		auditLog:    testutil.Must(audit.NewLog(ds))(t),
+		syncStore:   newMemSyncStore(t, 5),
+	}
+	require.NoError(t, s.auditLog.Record(ctx, types.AuditEntry{Operation: types.AuditRemoveProvider, Outcome: types.AuditSucceeded, Time: time.Now()}))
+	srv := httptest.NewServer(server.NewServer(
+		server.WithIdentity(testutil.Service),
+		server.WithService(s),
+		server.WithAdminToken("secret"),
+		server.WithReplicationToken("replica"),
+	))
+	t.Cleanup(srv.Close)
+	return s, srv.URL
+}
+
+func TestOpenAPI(t *testing.T) {
+	s, serverURL := newDocumentedServer(t)
+	c := newOpenAPIClient(t, serverURL, map[string]string{"adminToken": "secret", "replicationToken": "replica"})
+	hash := testutil.RandomMultihash().B58String()
+	advert := testutil.Must(s.publisher.Head(context.Background()))(t).String()
+	batch := testutil.Must(replication.MarshalBatch(replication.Batch{Origin: "remote"}))(t)
+
+	calls := map[string][]openAPICall{
+		"getVersion":    {{status: http.StatusOK}},
+		"publishClaims": {{body: []byte("not a CAR"), status: http.StatusBadRequest}},
+		"queryClaims": {
+			{query: url.Values{"multihash": {hash}}, status: http.StatusOK},
+			{query: url.Values{"multihash": {hash}, "probe": {"true"}, "diagnose": {"true"}}, accept: "application/json", status: http.StatusOK},
+			{query: url.Values{"multihash": {"not-a-hash"}}, status: http.StatusBadRequest},
+			{query: url.Values{"continuation": {"expired"}}, status: http.StatusBadRequest},
+			{query: url.Values{"refinement": {"unknown"}}, status: http.StatusNotFound},
+		},
+		"getHealth":            {{status: http.StatusOK}},
+		"getMetrics":           {{status: http.StatusOK}},
+		"getOpenAPI":           {{status: http.StatusOK}},
+		"getAdmission":         {{status: http.StatusOK}, {anonymous: true, status: http.StatusUnauthorized}},
+		"getAliases":           {{path: map[string]string{"multihash": hash}, status: http.StatusOK}},
+		"getContainingIndexes": {{path: map[string]string{"multihash": hash}, status: http.StatusOK}},
+		"findCid": {
+			{path: map[string]string{"cid": testutil.RandomCID().String()}, status: http.StatusOK},
+			{path: map[string]string{"cid": "not-a-cid"}, status: http.StatusBadRequest},
+		},
+		"findMultihash": {
+			{path: map[string]string{"multihash": hash}, status: http.StatusOK},
+			{path: map[string]string{"multihash": hash}, query: url.Values{"includeLegacy": {"true"}}, accept: "application/x-ndjson", status: http.StatusOK},
+		},
+		"findBatch": {
+			{body: testutil.Must(json.Marshal(map[string]any{"Multihashes": testutil.RandomMultihashes(2)}))(t), status: http.StatusOK},
+			{body: testutil.Must(json.Marshal(map[string]any{"Multihashes": testutil.RandomMultihashes(2)}))(t), accept: "application/x-ndjson", status: http.StatusOK},
+			{body: []byte(`{"Multihashes": ["AAAA"]}`), status: http.StatusBadRequest},
+		},
+		"importClaims": {{query: url.Values{"mode": {"cache"}}, body: []byte{}, status: http.StatusOK}},
+		"exportProviderRecords": {
+			{query: url.Values{"format": {"ndjson"}}, status: http.StatusOK},
+			{query: url.Values{"format": {"csv"}}, status: http.StatusOK},
+			{query: url.Values{"format": {"xml"}}, status: http.StatusBadRequest},
+		},
+		"removeProvider":     {{path: map[string]string{"peer": testutil.RandomPeer().String()}, status: http.StatusOK}},
+		"getAuditLog":        {{query: url.Values{"limit": {"10"}}, status: http.StatusOK}},
+		"listSpaceClaims":    {{path: map[string]string{"did": testutil.Service.DID().String()}, status: http.StatusOK}},
+		"backfillSpaceIndex": {{status: http.StatusOK}},
+		"runSelfCheck": {
+			{query: url.Values{"providerURL": {"https://example.com/claims/{claim}"}}, status: http.StatusOK},
+			{status: http.StatusBadRequest},
+		},
+		"refreshHash": {
+			{path: map[string]string{"multihash": hash}, status: http.StatusOK},
+			{path: map[string]string{"multihash": hash}, query: url.Values{"resolve": {"false"}}, status: http.StatusOK},
+			{path: map[string]string{"multihash": "not-a-hash"}, status: http.StatusBadRequest},
+		},
+		"rebuild": {{query: url.Values{"target": {"space-index"}}, status: http.StatusOK}},
+		"reconstructIndex": {
+			{query: url.Values{"shard": {testutil.RandomCID().String()}}, status: http.StatusOK},
+			{query: url.Values{"shard": {"not-a-cid"}}, status: http.StatusBadRequest},
+		},
+		"getConfig":               {{status: http.StatusOK}},
+		"putConfig":               {{body: []byte(`{"queryRateLimit": 10}`), status: http.StatusOK}, {body: []byte(`{`), status: http.StatusBadRequest}},
+		"getDeadLetters":          {{status: http.StatusOK}},
+		"purgeDeadLetters":        {{status: http.StatusOK}},
+		"getExpansions":           {{status: http.StatusOK}},
+		"getIdentityConflicts":    {{status: http.StatusOK}},
+		"getPublisherSummary":     {{status: http.StatusOK}},
+		"rebuildPublisherSummary": {{status: http.StatusOK}},
+		"exportPublisherChain":    {{status: http.StatusOK}},
+		"importPublisherChain":    {{body: []byte("not a CAR"), status: http.StatusBadRequest}},
+		"getPublisherTimeline":    {{status: http.StatusOK}},
+		"inspectPublisherAdvert":  {{path: map[string]string{"cid": advert}, status: http.StatusOK}},
+		"getAnnouncer":            {{status: http.StatusOK}},
+		"getPublisherLag":         {{status: http.StatusOK}},
+		"getPublisherDivergence":  {{status: http.StatusOK}},
+		"rebasePublisherChain":    {{query: url.Values{"onto": {advert}, "dryRun": {"true"}}, status: http.StatusOK}, {status: http.StatusBadRequest}},
+		"getSyncManifest":         {{query: url.Values{"limit": {"10"}}, status: http.StatusOK}, {query: url.Values{"cursor": {"x"}}, status: http.StatusBadRequest}},
+		"getSyncRecords":          {{query: url.Values{"ranges": {"1,2"}}, status: http.StatusOK}, {query: url.Values{"ranges": {"x"}}, status: http.StatusBadRequest}},
+		"syncProviderCache":       {{body: []byte(fmt.Sprintf(`{"from": %q, "token": "secret"}`, serverURL)), status: http.StatusOK}, {body: []byte(`{}`), status: http.StatusBadRequest}},
+		"replicate":               {{body: batch, status: http.StatusNoContent}, {body: batch, anonymous: true, status: http.StatusUnauthorized}},
+	}
+
+	t.Run("every route is described", func(t *testing.T) {
+		require.ElementsMatch(t, slices.Collect(maps.Keys(calls)), slices.Collect(maps.Keys(c.operations)))
+	})
+
+	for id, calls := range calls {
+		t.Run(id+" matches its description", func(t *testing.T) {
+			for _, call := range calls {
+				c.call(t, id, call)
+			}
+		})
+	}
+
+	t.Run("errors are problems with codes", func(t *testing.T) {
+		resp, data := c.call(t, "queryClaims", openAPICall{query: url.Values{"multihash": {"not-a-hash"}}, status: http.StatusBadRequest})
+		require.Equal(t, server.ProblemContentType, resp.Header.Get("Content-Type"))
+		var problem server.Problem
+		require.NoError(t, json.Unmarshal(data, &problem))
+		require.Equal(t, server.CodeInvalidParameter, problem.Code)
+		require.Equal(t, http.StatusBadRequest, problem.Status)
+		require.Equal(t, "multihash", problem.Param)
+
+		_, data = c.call(t, "getAdmission", openAPICall{anonymous: true, status: http.StatusUnauthorized})
+		require.NoError(t, json.Unmarshal(data, &problem))
+		require.Equal(t, server.CodeUnauthorized, problem.Code)
+	})
+}
+
+func TestOpenAPI__Client(t *testing.T) {
+	s, serverURL := newDocumentedServer(t)
+	c := newOpenAPIClient(t, serverURL, nil)
+
+	t.Run("queries", func(t *testing.T) {
+		_, data := c.call(t, "queryClaims", openAPICall{query: url.Values{"multihash": {testutil.RandomMultihash().B58String()}}, accept: "application/json", status: http.StatusOK})
+		var body struct {
+			Claims []struct {
+				Claim string `json:"claim"`
+			} `json:"claims"`
+		}
+		require.NoError(t, json.Unmarshal(data, &body))
+		require.Len(t, body.Claims, 1)
+		require.Equal(t, s.qr.Claims()[0].String(), body.Claims[0].Claim)
+
+		_, data = c.call(t, "queryClaims", openAPICall{query: url.Values{"multihash": {testutil.RandomMultihash().B58String()}}, status: http.StatusOK})
+		roots, _ := testutil.Must2(car.Decode(bytes.NewReader(data)))(t)
+		require.Equal(t, []ipld.Link{s.qr.Root().Link()}, roots)
+	})
+
+	t.Run("publishes", func(t *testing.T) {
+		op := c.operations["publishClaims"]
+		require.Equal(t, http.MethodPost, op.method)
+		require.Contains(t, op.RequestBody.Content, car.ContentType)
+		endpoint := testutil.Must(url.Parse(c.url + op.path))(t)
+		conn := testutil.Must(client.NewConnection(testutil.Service, ucanhttp.NewHTTPChannel(endpoint)))(t)
+		issuer := testutil.Must(ed25519.Generate())(t)
+		inv := testutil.Must(assert.Location.Invoke(issuer, testutil.Service, issuer.DID().String(), testutil.RandomLocationClaim().Nb()))(t)
+		res := testutil.Must(client.Execute([]invocation.Invocation{inv}, conn))(t)
+		_, ok := res.Get(inv.Link())
+		require.True(t, ok)
+		require.Len(t, s.published, 1)
+		require.Equal(t, inv.Link(), s.published[0].Link())
+	})
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ProblemContentType is the content type of error responses
+const ProblemContentType = "application/problem+json"
+
+// ErrorCode is the machine readable kind of an error response, stable across
+// changes to the wording of its detail
+type ErrorCode string
+
+const (
+	// CodeInvalidRequest is for requests that are malformed or can't be
+	// answered as asked
+	CodeInvalidRequest ErrorCode = "invalid_request"
+	// CodeInvalidParameter is for request parameters that could not be decoded,
+	// named by the problem's param
+	CodeInvalidParameter ErrorCode = "invalid_parameter"
+	// CodeUnauthorized is for requests to admin endpoints without the token
+	CodeUnauthorized ErrorCode = "unauthorized"
+	// CodeNotFound is for things that don't exist, or aren't kept by this
+	// service
+	CodeNotFound ErrorCode = "not_found"
+	// CodeConflict is for requests that conflict with the state of the service
+	CodeConflict ErrorCode = "conflict"
+	// CodeExpired is for continuations of query results that are no longer held
+	CodeExpired ErrorCode = "expired"
+	// CodeRateLimited is for queries over the query rate limit
+	CodeRateLimited ErrorCode = "rate_limited"
+	// CodeOverloaded is for queries shed by admission control. The response has
+	// a Retry-After header
+	CodeOverloaded ErrorCode = "overloaded"
+	// CodeNotImplemented is for features this service isn't configured for
+	CodeNotImplemented ErrorCode = "not_implemented"
+	// CodeInternal is for failures of the service
+	CodeInternal ErrorCode = "internal"
+)
+
+// Problem is the body of every error response, in the problem details format
+// of RFC 9457
+type Problem struct {
+	Type   string    `json:"type"`
+	Title  string    `json:"title"`
+	Status int       `json:"status"`
+	Detail string    `json:"detail,omitempty"`
+	Code   ErrorCode `json:"code"`
+	// Param, Value and Reason describe a request parameter that could not be
+	// decoded
+	Param  string `json:"param,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Reason string `json:"problem,omitempty"`
+}
+
+// statusCodes are the codes of errors that are told apart by their status alone
+var statusCodes = map[int]ErrorCode{
+	http.StatusBadRequest:          CodeInvalidRequest,
+	http.StatusUnauthorized:        CodeUnauthorized,
+	http.StatusNotFound:            CodeNotFound,
+	http.StatusConflict:            CodeConflict,
+	http.StatusGone:                CodeExpired,
+	http.StatusTooManyRequests:     CodeRateLimited,
+	http.StatusNotImplemented:      CodeNotImplemented,
+	http.StatusServiceUnavailable:  CodeOverloaded,
+	http.StatusInternalServerError: CodeInternal,
+}
+
+func newProblem(detail string, status int) Problem {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = CodeInvalidRequest
+		if status >= 500 {
+			code = CodeInternal
+		}
+	}
+	return Problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Detail: detail, Code: code}
+}
+
+// writeError replies to the request with the detail and status, whose code is
+// that of errors with the status. It is http.Error for problem details
+func writeError(w http.ResponseWriter, detail string, status int) {
+	writeProblem(w, newProblem(detail, status))
+}
+
+func writeProblem(w http.ResponseWriter, p Problem) {
+	h := w.Header()
+	// the headers of the response that failed no longer apply
+	h.Del("Content-Length")
+	h.Set("Content-Type", ProblemContentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		log.Errorw("encoding problem", "error", err)
+	}
+}
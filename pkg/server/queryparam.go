@@ -0,0 +1,61 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// parseBoolParam decodes the named boolean query parameter, which is def if it
+// isn't set
+func parseBoolParam(query url.Values, param string, def bool) (bool, error) {
+	value := query.Get(param)
+	if value == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, &paramError{Param: param, Value: value, Problem: "not a boolean"}
+	}
+	return b, nil
+}
+
+// parseIntParam decodes the named integer query parameter, which is def if it
+// isn't set, and must be between min and max
+func parseIntParam(query url.Values, param string, def, min, max int) (int, error) {
+	value := query.Get(param)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, &paramError{Param: param, Value: value, Problem: "not an integer"}
+	}
+	if n < min || n > max {
+		problem := fmt.Sprintf("must be between %d and %d", min, max)
+		if max == math.MaxInt {
+			problem = fmt.Sprintf("must be %d or more", min)
+		}
+		return 0, &paramError{Param: param, Value: value, Problem: problem}
+	}
+	return n, nil
+}
+
+// parseDurationParam decodes the named duration query parameter, which is zero
+// if it isn't set, and can't be negative
+func parseDurationParam(query url.Values, param string) (time.Duration, error) {
+	value := query.Get(param)
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, &paramError{Param: param, Value: value, Problem: "not a duration"}
+	}
+	if d < 0 {
+		return 0, &paramError{Param: param, Value: value, Problem: "must not be negative"}
+	}
+	return d, nil
+}
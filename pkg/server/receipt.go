@@ -0,0 +1,34 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+)
+
+// ReceiptHeader is the response header carrying the service's signed receipt
+// for a query result, as the unpadded base64url of its binary encoding, when
+// the query asked for one with "attest"
+const ReceiptHeader = "X-Query-Receipt"
+
+// encodedReceipt returns the encoded receipt of the result, or "" if it has none
+func encodedReceipt(qr queryresult.QueryResult) string {
+	receipt, ok := qr.Receipt()
+	if !ok {
+		return ""
+	}
+	data, err := receipt.MarshalBinary()
+	if err != nil {
+		log.Errorw("encoding query receipt", "error", err)
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// setReceiptHeader sets the receipt header if the result has a receipt
+func setReceiptHeader(w http.ResponseWriter, qr queryresult.QueryResult) {
+	if receipt := encodedReceipt(qr); receipt != "" {
+		w.Header().Set(ReceiptHeader, receipt)
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+)
+
+// RefinementHeader is the response header carrying the token used to fetch the
+// complete result of a tiered query, once its answer from cache has been sent
+const RefinementHeader = "X-Refinement-Token"
+
+// refinement is the complete result of a tiered query, pending until its full
+// walk finishes
+type refinement struct {
+	done    chan struct{}
+	qr      queryresult.QueryResult
+	err     error
+	queried []hashParam
+	expires time.Time
+}
+
+// refinementCache holds the refinements of tiered queries until they are
+// fetched or expire, keyed by random tokens
+type refinementCache struct {
+	lk          sync.Mutex
+	ttl         time.Duration
+	refinements map[string]*refinement
+}
+
+func newRefinementCache(ttl time.Duration) *refinementCache {
+	return &refinementCache{ttl: ttl, refinements: map[string]*refinement{}}
+}
+
+// add starts a pending refinement, returning its token and the function that
+// completes it
+func (rc *refinementCache) add(queried []hashParam) (string, func(queryresult.QueryResult, error)) {
+	random := make([]byte, 16)
+	rand.Read(random)
+	token := hex.EncodeToString(random)
+	ref := &refinement{done: make(chan struct{}), queried: queried}
+	rc.lk.Lock()
+	defer rc.lk.Unlock()
+	rc.evictExpired()
+	rc.refinements[token] = ref
+	return token, func(qr queryresult.QueryResult, err error) {
+		rc.lk.Lock()
+		ref.qr, ref.err = qr, err
+		ref.expires = time.Now().Add(rc.ttl)
+		rc.lk.Unlock()
+		close(ref.done)
+	}
+}
+
+func (rc *refinementCache) get(token string) (*refinement, bool) {
+	rc.lk.Lock()
+	defer rc.lk.Unlock()
+	rc.evictExpired()
+	ref, ok := rc.refinements[token]
+	return ref, ok
+}
+
+func (rc *refinementCache) evictExpired() {
+	now := time.Now()
+	for token, ref := range rc.refinements {
+		// pending refinements don't expire until they complete
+		select {
+		case <-ref.done:
+		default:
+			continue
+		}
+		if now.After(ref.expires) {
+			delete(rc.refinements, token)
+		}
+	}
+}
+
+// queryTiered sends the answer of a tiered query from cache, with the token to
+// fetch its complete result with once the full walk finishes. The answer is
+// sent whole, however large
+func queryTiered(w http.ResponseWriter, r *http.Request, s TieredService, q service.Query, queried []hashParam, refinements *refinementCache) {
+	token, complete := refinements.add(queried)
+	qr, err := s.QueryTiered(r.Context(), q, complete)
+	if err != nil {
+		// the refinement is never started, so is completed with the failure
+		complete(nil, err)
+		writeQueryError(w, err)
+		return
+	}
+	w.Header().Set(RefinementHeader, token)
+	if acceptsJSON(r) {
+		writeQueryResultJSON(w, qr, queried)
+		return
+	}
+	writeQueryResult(w, qr)
+}
+
+// getRefinement sends the complete result of a tiered query, waiting for its
+// full walk to finish
+func getRefinement(w http.ResponseWriter, r *http.Request, token string, refinements *refinementCache) {
+	ref, ok := refinements.get(token)
+	if !ok {
+		writeError(w, "refinement not found or expired, re-run the query", http.StatusNotFound)
+		return
+	}
+	select {
+	case <-ref.done:
+	case <-r.Context().Done():
+		return
+	}
+	if ref.err != nil {
+		writeQueryError(w, ref.err)
+		return
+	}
+	if acceptsJSON(r) {
+		writeQueryResultJSON(w, ref.qr, ref.queried)
+		return
+	}
+	writeQueryResult(w, ref.qr)
+}
@@ -2,13 +2,29 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multibase"
 	"github.com/multiformats/go-multihash"
 	"github.com/storacha/go-ucanto/core/car"
@@ -18,22 +34,191 @@ import (
 	ed25519 "github.com/storacha/go-ucanto/principal/ed25519/signer"
 	"github.com/storacha/go-ucanto/principal/signer"
 	ucanhttp "github.com/storacha/go-ucanto/transport/http"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/publisher"
 	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/admission"
+	"github.com/storacha/indexing-service/pkg/service/audit"
+	"github.com/storacha/indexing-service/pkg/service/claimimport"
 	"github.com/storacha/indexing-service/pkg/service/contentclaims"
+	"github.com/storacha/indexing-service/pkg/service/deadletter"
+	"github.com/storacha/indexing-service/pkg/service/expansion"
+	"github.com/storacha/indexing-service/pkg/service/identity"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
 	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/service/replication"
+	cachesync "github.com/storacha/indexing-service/pkg/sync"
+	"github.com/storacha/indexing-service/pkg/types"
 )
 
 var log = logging.Logger("server")
 
+// maxReplicationBatchSize limits the size in bytes of replicated batches
+const maxReplicationBatchSize = 64 << 20
+
 type Service interface {
 	CacheClaim(ctx context.Context, claim delegation.Delegation) error
 	PublishClaim(ctx context.Context, claim delegation.Delegation) error
 	Query(ctx context.Context, q service.Query) (queryresult.QueryResult, error)
 }
 
+// ConfigurableService is a service whose settings can be changed at runtime
+type ConfigurableService interface {
+	Config() service.DynamicConfig
+	Reconfigure(cfg service.DynamicConfig) error
+}
+
+// DeadLetterService is a service that keeps failed background cache writes
+type DeadLetterService interface {
+	DeadLetters() *deadletter.Queue
+}
+
+// ExpansionService is a service that expands indexes in a pool of workers
+type ExpansionService interface {
+	Expansions() *expansion.Pool
+}
+
+// TieredService is a service that answers queries from cache first, and
+// refines the answer with the full walk of the query in the background
+type TieredService interface {
+	QueryTiered(ctx context.Context, q service.Query, refine func(queryresult.QueryResult, error)) (queryresult.QueryResult, error)
+}
+
+// StreamingService is a service whose query results can be streamed from their
+// sources rather than built in memory
+type StreamingService interface {
+	QuerySources(ctx context.Context, q service.Query) (queryresult.Sources, error)
+}
+
+// ReplicatingService is a service that exchanges cache writes with other regions
+type ReplicatingService interface {
+	Replicator() *replication.Replicator
+}
+
+// AnnouncingService is a service that announces its advertisement chain to
+// indexers
+type AnnouncingService interface {
+	Announcer() *publisher.Announcer
+}
+
+// LagMonitoringService is a service that monitors how far behind the head of
+// its advertisement chain indexers are
+type LagMonitoringService interface {
+	LagMonitor() *publisher.LagMonitor
+}
+
+// MetricsService is a service that serves its metrics for scraping
+type MetricsService interface {
+	MetricsHandler() http.Handler
+}
+
+// AdmittingService is a service that sheds expensive queries under overload
+type AdmittingService interface {
+	Admission() *admission.Controller
+}
+
+// AliasService is a service that resolves the hashes equivalent to a hash
+type AliasService interface {
+	Aliases(ctx context.Context, mh multihash.Multihash, match service.Match) ([]multihash.Multihash, []cid.Cid, error)
+}
+
+// FindService is a service that finds provider records as an IPNI indexer does
+type FindService interface {
+	FindProviders(ctx context.Context, hash multihash.Multihash, includeLegacy bool) ([]model.ProviderResult, error)
+}
+
+// ContainingIndexService is a service that looks up the indexes a block was
+// found in
+type ContainingIndexService interface {
+	ContainingIndexes(ctx context.Context, hash multihash.Multihash) ([]types.IndexRef, error)
+}
+
+// SpaceClaimsService is a service that lists the claims bound to a space
+type SpaceClaimsService interface {
+	ListClaims(ctx context.Context, space did.DID, cursor string, limit int) ([]types.SpaceClaim, string, error)
+	BackfillSpaceIndex(ctx context.Context) (int, error)
+}
+
+// RebuildingService is a service that can rebuild its derived stores from
+// scratch
+type RebuildingService interface {
+	Rebuild(ctx context.Context, targets ...service.RebuildTarget) error
+}
+
+// ReconstructingService is a service that can reconstruct lost indexes from the
+// shards they index
+type ReconstructingService interface {
+	ReconstructIndex(ctx context.Context, shard cid.Cid, location delegation.Delegation, opts ...service.ReconstructOption) (blobindex.ShardedDagIndexView, error)
+}
+
+// ImportingService is a service that imports claims in bulk from a CAR file
+type ImportingService interface {
+	ImportClaims(ctx context.Context, r io.Reader, opts service.ImportOptions) (service.ImportReport, error)
+}
+
+// ProviderRemovalService is a service that removes every record of a provider
+type ProviderRemovalService interface {
+	RemoveProvider(ctx context.Context, provider peer.ID, onProgress func(types.ProviderTombstone)) error
+}
+
+// ExportingService is a service that exports its cached provider records in
+// bulk
+type ExportingService interface {
+	ExportProviderRecords(ctx context.Context, w io.Writer, format types.ExportFormat, cursor string, limit int) (string, error)
+}
+
+// SyncingService is a service whose provider cache can be synced to and from
+// other deployments
+type SyncingService interface {
+	SyncSource() *cachesync.Source
+	Syncer() *cachesync.Syncer
+}
+
+// AuditingService is a service that audits the publishes, caches and removals
+// it makes, and records the ones rejected before reaching it
+type AuditingService interface {
+	Audit(ctx context.Context, entry types.AuditEntry) error
+	AuditLog() types.AuditLog
+}
+
+// SelfCheckingService is a service that can check its publish, cache, query
+// and removal paths end to end with a synthetic claim
+type SelfCheckingService interface {
+	SelfCheck(ctx context.Context, opts service.SelfCheckOptions) (service.SelfCheckReport, error)
+}
+
+// RefreshingService is a service that can drop everything cached for a hash,
+// and resolve it afresh
+type RefreshingService interface {
+	Refresh(ctx context.Context, hash multihash.Multihash, opts service.RefreshOptions) (service.RefreshReport, error)
+}
+
+// CanaryService is a service that runs self checks on a schedule
+type CanaryService interface {
+	Canary() *service.Canary
+}
+
+// IdentityService is a service that maps the DIDs claims are issued by to the
+// peers advertising them
+type IdentityService interface {
+	Identities() *identity.Mapping
+}
+
+// PublishingService is a service that writes its own advertisement chain
+type PublishingService interface {
+	Publisher() *publisher.Publisher
+}
+
 type config struct {
-	id      principal.Signer
-	service Service
+	id               principal.Signer
+	service          Service
+	adminToken       string
+	replicationToken string
+	maxResponseSize  int
+	continuationTTL  time.Duration
+	// continuationSize is the most bytes of split results kept for continuations
+	continuationSize int
 }
 
 type Option func(*config)
@@ -51,6 +236,49 @@ func WithService(service Service) Option {
 	}
 }
 
+// WithAdminToken enables the admin endpoints, authorized with the given bearer
+// token. Admin endpoints are not served if no token is set
+func WithAdminToken(token string) Option {
+	return func(c *config) {
+		c.adminToken = token
+	}
+}
+
+// WithReplicationToken enables the replication endpoint, authorized with the
+// given bearer token. Replicated batches are not accepted if no token is set
+func WithReplicationToken(token string) Option {
+	return func(c *config) {
+		c.replicationToken = token
+	}
+}
+
+// WithMaxResponseSize limits the approximate size in bytes of query responses.
+// Results that exceed it are split, with the remainder retrievable using a
+// continuation token. Zero means unlimited
+func WithMaxResponseSize(size int) Option {
+	return func(c *config) {
+		c.maxResponseSize = size
+	}
+}
+
+// WithContinuationTTL sets how long the remainder of a split query result can
+// be retrieved for
+func WithContinuationTTL(ttl time.Duration) Option {
+	return func(c *config) {
+		c.continuationTTL = ttl
+	}
+}
+
+// WithContinuationCacheSize sets the most bytes of split query results kept
+// for their remainders to be retrieved. Beyond it, the least recently used
+// results are evicted, and their continuations answer 410 Gone. A result
+// larger than the cache is sent whole rather than split
+func WithContinuationCacheSize(size int) Option {
+	return func(c *config) {
+		c.continuationSize = size
+	}
+}
+
 // ListenAndServe creates a new indexing service HTTP server, and starts it up.
 func ListenAndServe(addr string, opts ...Option) error {
 	srv := &http.Server{
@@ -67,7 +295,7 @@ func ListenAndServe(addr string, opts ...Option) error {
 
 // NewServer creates a new indexing service HTTP server.
 func NewServer(opts ...Option) *http.ServeMux {
-	c := &config{}
+	c := &config{continuationTTL: DefaultContinuationTTL, continuationSize: DefaultContinuationCacheSize}
 	for _, opt := range opts {
 		opt(c)
 	}
@@ -87,11 +315,123 @@ func NewServer(opts ...Option) *http.ServeMux {
 		log.Infof("Server ID: %s", c.id.DID())
 	}
 
-	mux := http.NewServeMux()
+	mux := newRouter()
 	mux.HandleFunc("GET /", getRootHandler(c.id))
-	mux.HandleFunc("POST /claims", postClaimsHandler(c.id))
-	mux.HandleFunc("GET /claims", getClaimsHandler(c.service))
-	return mux
+	mux.HandleFunc("POST /claims", postClaimsHandler(c.id, c.service))
+	mux.HandleFunc("GET /claims", getClaimsHandler(c.service, c.maxResponseSize, newResultCache(c.continuationTTL, c.continuationSize), newRefinementCache(c.continuationTTL)))
+	var controller *admission.Controller
+	if as, ok := c.service.(AdmittingService); ok {
+		controller = as.Admission()
+	}
+	var lag *publisher.LagMonitor
+	if ls, ok := c.service.(LagMonitoringService); ok {
+		lag = ls.LagMonitor()
+	}
+	var canary *service.Canary
+	if cs, ok := c.service.(CanaryService); ok {
+		canary = cs.Canary()
+	}
+	mux.HandleFunc("GET /health", getHealthHandler(controller, lag, canary))
+	if ms, ok := c.service.(MetricsService); ok && ms.MetricsHandler() != nil {
+		mux.Handle("GET /metrics", ms.MetricsHandler())
+	}
+	if controller != nil && c.adminToken != "" {
+		mux.HandleFunc("GET /admission", requireAdmin(c.adminToken, getAdmissionHandler(controller)))
+	}
+	if as, ok := c.service.(AliasService); ok {
+		mux.HandleFunc("GET /aliases/{multihash}", getAliasesHandler(as))
+	}
+	if fs, ok := c.service.(FindService); ok {
+		mux.HandleFunc("GET /cid/{cid}", getFindCidHandler(fs))
+		mux.HandleFunc("GET /multihash/{multihash}", getFindMultihashHandler(fs))
+		mux.HandleFunc("POST /multihash", postFindBatchHandler(fs))
+	}
+	if cs, ok := c.service.(ContainingIndexService); ok && c.adminToken != "" {
+		mux.HandleFunc("GET /containing/{multihash}", requireAdmin(c.adminToken, getContainingHandler(cs)))
+	}
+	auditor, _ := c.service.(AuditingService)
+	if is, ok := c.service.(ImportingService); ok && c.adminToken != "" {
+		if auditor != nil {
+			mux.HandleFunc("POST /claims/import", auditImports(c.adminToken, auditor, postImportClaimsHandler(is)))
+		} else {
+			mux.HandleFunc("POST /claims/import", requireAdmin(c.adminToken, postImportClaimsHandler(is)))
+		}
+	}
+	if es, ok := c.service.(ExportingService); ok && c.adminToken != "" {
+		mux.HandleFunc("GET /providers/export", requireAdmin(c.adminToken, getProviderExportHandler(es)))
+	}
+	if ss, ok := c.service.(SyncingService); ok && c.adminToken != "" {
+		if ss.SyncSource() != nil {
+			mux.HandleFunc("GET /sync/manifest", requireAdmin(c.adminToken, getSyncManifestHandler(ss.SyncSource())))
+			mux.HandleFunc("GET /sync/records", requireAdmin(c.adminToken, getSyncRecordsHandler(ss.SyncSource())))
+		}
+		if ss.Syncer() != nil {
+			mux.HandleFunc("POST /sync", requireAdmin(c.adminToken, postSyncHandler(ss.Syncer())))
+		}
+	}
+	if rs, ok := c.service.(ProviderRemovalService); ok && c.adminToken != "" {
+		if auditor != nil {
+			mux.HandleFunc("DELETE /providers/{peer}", auditProviderRemovals(c.adminToken, auditor, deleteProviderHandler(rs)))
+		} else {
+			mux.HandleFunc("DELETE /providers/{peer}", requireAdmin(c.adminToken, deleteProviderHandler(rs)))
+		}
+	}
+	if auditor != nil && auditor.AuditLog() != nil && c.adminToken != "" {
+		mux.HandleFunc("GET /audit", requireAdmin(c.adminToken, getAuditHandler(auditor.AuditLog())))
+	}
+	if ss, ok := c.service.(SpaceClaimsService); ok {
+		mux.HandleFunc("GET /spaces/{did}/claims", getSpaceClaimsHandler(ss))
+		if c.adminToken != "" {
+			mux.HandleFunc("POST /spaces/backfill", requireAdmin(c.adminToken, postSpaceBackfillHandler(ss)))
+		}
+	}
+	if ss, ok := c.service.(SelfCheckingService); ok && c.adminToken != "" {
+		mux.HandleFunc("POST /selfcheck", requireAdmin(c.adminToken, postSelfCheckHandler(ss)))
+	}
+	if rs, ok := c.service.(RefreshingService); ok && c.adminToken != "" {
+		mux.HandleFunc("POST /admin/refresh/{multihash}", requireAdmin(c.adminToken, postRefreshHandler(rs)))
+	}
+	if rs, ok := c.service.(RebuildingService); ok && c.adminToken != "" {
+		mux.HandleFunc("POST /rebuild", requireAdmin(c.adminToken, postRebuildHandler(rs)))
+	}
+	if rs, ok := c.service.(ReconstructingService); ok && c.adminToken != "" {
+		mux.HandleFunc("POST /indexes/reconstruct", requireAdmin(c.adminToken, postReconstructIndexHandler(rs)))
+	}
+	if cs, ok := c.service.(ConfigurableService); ok && c.adminToken != "" {
+		mux.HandleFunc("GET /config", requireAdmin(c.adminToken, getConfigHandler(cs)))
+		mux.HandleFunc("PUT /config", requireAdmin(c.adminToken, putConfigHandler(cs)))
+	}
+	if ds, ok := c.service.(DeadLetterService); ok && ds.DeadLetters() != nil && c.adminToken != "" {
+		mux.HandleFunc("GET /deadletters", requireAdmin(c.adminToken, getDeadLettersHandler(ds.DeadLetters())))
+		mux.HandleFunc("DELETE /deadletters", requireAdmin(c.adminToken, deleteDeadLettersHandler(ds.DeadLetters())))
+	}
+	if es, ok := c.service.(ExpansionService); ok && es.Expansions() != nil && c.adminToken != "" {
+		mux.HandleFunc("GET /expansions", requireAdmin(c.adminToken, getExpansionsHandler(es.Expansions())))
+	}
+	if is, ok := c.service.(IdentityService); ok && is.Identities() != nil && c.adminToken != "" {
+		mux.HandleFunc("GET /identities/conflicts", requireAdmin(c.adminToken, getIdentityConflictsHandler(is.Identities())))
+	}
+	if ps, ok := c.service.(PublishingService); ok && ps.Publisher() != nil && c.adminToken != "" {
+		mux.HandleFunc("GET /publisher/summary", requireAdmin(c.adminToken, getPublisherSummaryHandler(ps.Publisher())))
+		mux.HandleFunc("POST /publisher/summary/rebuild", requireAdmin(c.adminToken, postRebuildPublisherSummaryHandler(ps.Publisher())))
+		mux.HandleFunc("GET /publisher/chain", requireAdmin(c.adminToken, getPublisherChainHandler(ps.Publisher())))
+		mux.HandleFunc("GET /publisher/timeline", requireAdmin(c.adminToken, getPublisherTimelineHandler(ps.Publisher())))
+		mux.HandleFunc("GET /publisher/advert/{cid}", requireAdmin(c.adminToken, getPublisherAdvertHandler(ps.Publisher())))
+		mux.HandleFunc("POST /publisher/chain", requireAdmin(c.adminToken, postPublisherChainHandler(ps.Publisher())))
+		mux.HandleFunc("POST /publisher/rebase", requireAdmin(c.adminToken, postRebaseHandler(ps.Publisher())))
+	}
+	if as, ok := c.service.(AnnouncingService); ok && as.Announcer() != nil && c.adminToken != "" {
+		mux.HandleFunc("GET /publisher/announcer", requireAdmin(c.adminToken, getAnnouncerHandler(as.Announcer())))
+	}
+	if lag != nil && c.adminToken != "" {
+		mux.HandleFunc("GET /publisher/lag", requireAdmin(c.adminToken, getLagHandler(lag)))
+		mux.HandleFunc("GET /publisher/divergence", requireAdmin(c.adminToken, getDivergenceHandler(lag)))
+	}
+	if rs, ok := c.service.(ReplicatingService); ok && rs.Replicator() != nil && c.replicationToken != "" {
+		mux.HandleFunc("POST /replicate", requireAdmin(c.replicationToken, postReplicateHandler(rs.Replicator())))
+	}
+	mux.HandleFunc("GET /openapi.json", getOpenAPIHandler(mux))
+	return mux.ServeMux
 }
 
 // getRootHandler displays version info when a GET request is sent to "/".
@@ -108,9 +448,14 @@ func getRootHandler(id principal.Signer) func(http.ResponseWriter, *http.Request
 }
 
 // postClaimsHandler invokes the ucanto service when a POST request is sent to
-// "/claims".
-func postClaimsHandler(id principal.Signer) func(http.ResponseWriter, *http.Request) {
-	server, err := contentclaims.NewServer(id)
+// "/claims". Authorized claims are published with the service, and the others
+// audited as rejected if the service audits.
+func postClaimsHandler(id principal.Signer, s Service) func(http.ResponseWriter, *http.Request) {
+	opts := []contentclaims.Option{contentclaims.WithClaimService(s)}
+	if as, ok := s.(AuditingService); ok {
+		opts = append(opts, contentclaims.WithAuditor(as))
+	}
+	server, err := contentclaims.NewServer(id, opts...)
 	if err != nil {
 		log.Fatalf("creating ucanto server: %s", err)
 	}
@@ -134,41 +479,2332 @@ func postClaimsHandler(id principal.Signer) func(http.ResponseWriter, *http.Requ
 
 // getClaimsHandler retrieves content claims when a GET request is sent to
 // "/claims/{multihash}".
-func getClaimsHandler(s Service) func(http.ResponseWriter, *http.Request) {
+func getClaimsHandler(s Service, maxResponseSize int, results *resultCache, refinements *refinementCache) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		mhStrings := r.URL.Query()["multihash"]
-		hashes := make([]multihash.Multihash, 0, len(mhStrings))
-		for _, mhString := range mhStrings {
-			_, bytes, err := multibase.Decode(mhString)
+		if token := r.URL.Query().Get("continuation"); token != "" {
+			continueQuery(w, token, maxResponseSize, results)
+			return
+		}
+		if token := r.URL.Query().Get("refinement"); token != "" {
+			getRefinement(w, r, token, refinements)
+			return
+		}
+		params, err := parseHashParams("multihash", r.URL.Query())
+		if err != nil {
+			writeParamError(w, err)
+			return
+		}
+		hashes := make([]multihash.Multihash, 0, len(params))
+		for _, p := range params {
+			hashes = append(hashes, p.hash)
+		}
+		spaces, err := parseSpaces(r)
+		if err != nil {
+			writeError(w, err.Error(), 400)
+			return
+		}
+
+		query := r.URL.Query()
+		maxProviderAge, err := parseDurationParam(query, "maxProviderAge")
+		if err != nil {
+			writeParamError(w, err)
+			return
+		}
+		prefetch, err := parseIntParam(query, "prefetch", 0, math.MinInt, math.MaxInt)
+		if err != nil {
+			writeParamError(w, err)
+			return
+		}
+		maxResultsPerHash, err := parseIntParam(query, "maxResultsPerHash", 0, 0, math.MaxInt)
+		if err != nil {
+			writeParamError(w, err)
+			return
+		}
+		var includeSuperseded, canonicalizeAliases, firstLocationWins, strictSpaces, diagnose, probe, fresh, attest, tiered bool
+		for _, f := range []struct {
+			param string
+			flag  *bool
+		}{
+			{"includeSuperseded", &includeSuperseded},
+			{"canonicalizeAliases", &canonicalizeAliases},
+			{"firstLocationWins", &firstLocationWins},
+			{"strictSpaces", &strictSpaces},
+			{"diagnose", &diagnose},
+			{"probe", &probe},
+			{"fresh", &fresh},
+			{"attest", &attest},
+			{"tiered", &tiered},
+		} {
+			if *f.flag, err = parseBoolParam(query, f.param, false); err != nil {
+				writeParamError(w, err)
+				return
+			}
+		}
+
+		knownClaimStrings := r.URL.Query()["knownClaim"]
+		knownClaims := make([]cid.Cid, 0, len(knownClaimStrings))
+		for _, c := range knownClaimStrings {
+			claimCid, err := cid.Decode(c)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("invalid multibase encoding: %s", err.Error()), 400)
+				writeError(w, fmt.Sprintf("invalid known claim: %s", err.Error()), 400)
 				return
 			}
-			hashes = append(hashes, bytes)
+			knownClaims = append(knownClaims, claimCid)
 		}
-		spaceStrings := r.URL.Query()["spaces"]
-		spaces := make([]did.DID, 0, len(spaceStrings))
-		for _, spaceString := range spaceStrings {
-			space, err := did.Parse(spaceString)
+		knownIndexStrings := r.URL.Query()["knownIndex"]
+		knownIndexes := make([]types.EncodedContextID, 0, len(knownIndexStrings))
+		for _, contextID := range knownIndexStrings {
+			_, bytes, err := multibase.Decode(contextID)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("invalid did: %s", err.Error()), 400)
+				writeError(w, fmt.Sprintf("invalid known index: %s", err.Error()), 400)
 				return
 			}
-			spaces = append(spaces, space)
+			knownIndexes = append(knownIndexes, bytes)
 		}
 
-		qr, err := s.Query(r.Context(), service.Query{
+		q := service.Query{
 			Hashes: hashes,
 			Match: service.Match{
 				Subject: spaces,
 			},
-		})
+			StrictSpaces:        strictSpaces,
+			MaxProviderAge:      maxProviderAge,
+			Prefetch:            prefetch,
+			IncludeSuperseded:   includeSuperseded,
+			CanonicalizeAliases: canonicalizeAliases,
+			FirstLocationWins:   firstLocationWins,
+			MaxResultsPerHash:   maxResultsPerHash,
+			KnownClaims:         knownClaims,
+			KnownIndexes:        knownIndexes,
+			// diagnoses are only part of JSON responses
+			Diagnose: diagnose && acceptsJSON(r),
+			// as are probes
+			ProbeLocations: probe && acceptsJSON(r),
+			Fresh:          fresh,
+			Attest:         attest,
+		}
+		// receipts attest to the full result, so are not given to tiered
+		// answers or streamed results
+		if ts, ok := s.(TieredService); ok && tiered && !attest {
+			queryTiered(w, r, ts, q, params, refinements)
+			return
+		}
+		if acceptsJSON(r) {
+			qr, err := s.Query(r.Context(), q)
+			if err != nil {
+				writeQueryError(w, err)
+				return
+			}
+			writeQueryResultJSON(w, qr, params)
+			return
+		}
+		// split results need every part's size up front, so are built in memory
+		if ss, ok := s.(StreamingService); ok && maxResponseSize <= 0 && !attest {
+			streamQueryResult(w, r, ss, q)
+			return
+		}
+		qr, err := s.Query(r.Context(), q)
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		if maxResponseSize > 0 {
+			sr, err := newSplitResult(qr)
+			if err != nil {
+				writeError(w, fmt.Sprintf("processing queury: %s", err.Error()), 500)
+				return
+			}
+			if size(sr.items) > maxResponseSize {
+				digest := queryDigest(q)
+				if results.put(digest, sr) {
+					setReceiptHeader(w, qr)
+					writePage(w, digest, sr, sr.items, maxResponseSize, true)
+					return
+				}
+				// the remainder couldn't be kept for continuations
+				log.Warnw("sending whole result too large to keep for continuations", "query", digest, "size", size(sr.items))
+			}
+		}
+
+		writeQueryResult(w, qr)
+	}
+}
+
+// continueQuery sends the next part of a split query result
+func continueQuery(w http.ResponseWriter, tokenString string, maxResponseSize int, results *resultCache) {
+	token, err := decodeContinuation(tokenString)
+	if err != nil {
+		writeError(w, err.Error(), 400)
+		return
+	}
+	sr, ok := results.get(token.Query)
+	if !ok {
+		writeError(w, errContinuationExpired.Error(), http.StatusGone)
+		return
+	}
+	items, err := sr.remaining(token)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusGone)
+		return
+	}
+	writePage(w, token.Query, sr, items, maxResponseSize, false)
+}
+
+func writePage(w http.ResponseWriter, digest string, sr *splitResult, items []resultItem, maxResponseSize int, first bool) {
+	qr, rest, err := sr.page(items, maxResponseSize, first)
+	if err != nil {
+		writeError(w, fmt.Sprintf("building result: %s", err.Error()), 500)
+		return
+	}
+	if len(rest) > 0 {
+		token, err := encodeContinuation(digest, rest)
+		if err != nil {
+			writeError(w, fmt.Sprintf("building result: %s", err.Error()), 500)
+			return
+		}
+		w.Header().Set(ContinuationHeader, token)
+	}
+	writeQueryResult(w, qr)
+}
+
+func parseSpaces(r *http.Request) ([]did.DID, error) {
+	spaceStrings := r.URL.Query()["spaces"]
+	spaces := make([]did.DID, 0, len(spaceStrings))
+	for _, spaceString := range spaceStrings {
+		space, err := did.Parse(spaceString)
+		if err != nil {
+			return nil, fmt.Errorf("invalid did: %w", err)
+		}
+		spaces = append(spaces, space)
+	}
+	return spaces, nil
+}
+
+type aliasesJSON struct {
+	Hash    string   `json:"hash"`
+	Aliases []string `json:"aliases"`
+	Claims  []string `json:"claims"`
+}
+
+// getAliasesHandler lists the hashes known to be equivalent to a hash through
+// equals claims when a GET request is sent to "/aliases/{multihash}".
+func getAliasesHandler(s AliasService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := parseHashParam("multihash", r.PathValue("multihash"), r.URL.Query())
+		if err != nil {
+			writeParamError(w, err)
+			return
+		}
+		spaces, err := parseSpaces(r)
+		if err != nil {
+			writeError(w, err.Error(), 400)
+			return
+		}
+		aliases, claims, err := s.Aliases(r.Context(), p.hash, service.Match{Subject: spaces})
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+		body := aliasesJSON{
+			Hash:    p.input,
+			Aliases: make([]string, 0, len(aliases)),
+			Claims:  make([]string, 0, len(claims)),
+		}
+		for _, alias := range aliases {
+			encoded, err := p.form.encode(alias)
+			if err != nil {
+				writeError(w, fmt.Sprintf("encoding alias: %s", err.Error()), 500)
+				return
+			}
+			body.Aliases = append(body.Aliases, encoded)
+		}
+		for _, claim := range claims {
+			body.Claims = append(body.Claims, claim.String())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			log.Errorw("encoding aliases", "error", err)
+		}
+	}
+}
+
+const (
+	defaultSpaceClaimsLimit = 100
+	maxSpaceClaimsLimit     = 1000
+)
+
+type spaceClaimJSON struct {
+	Claim      string     `json:"claim"`
+	Type       string     `json:"type"`
+	Hash       string     `json:"hash"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+}
+
+type spaceClaimsJSON struct {
+	Claims []spaceClaimJSON `json:"claims"`
+	Cursor string           `json:"cursor,omitempty"`
+}
+
+type containingIndexJSON struct {
+	ContextID string `json:"contextID"`
+	Content   string `json:"content,omitempty"`
+}
+
+type containingJSON struct {
+	Hash    string                `json:"hash"`
+	Indexes []containingIndexJSON `json:"indexes"`
+}
+
+// getContainingHandler lists the indexes a block was found in, most recently
+// found first, when a GET request is sent to "/containing/{multihash}".
+func getContainingHandler(s ContainingIndexService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := parseHashParam("multihash", r.PathValue("multihash"), r.URL.Query())
+		if err != nil {
+			writeParamError(w, err)
+			return
+		}
+		refs, err := s.ContainingIndexes(r.Context(), p.hash)
+		if err != nil {
+			if errors.Is(err, service.ErrContainingIndexesDisabled) {
+				writeError(w, err.Error(), 404)
+				return
+			}
+			writeError(w, fmt.Sprintf("looking up containing indexes: %s", err.Error()), 500)
+			return
+		}
+		body := containingJSON{Hash: p.input, Indexes: make([]containingIndexJSON, 0, len(refs))}
+		for _, ref := range refs {
+			index := containingIndexJSON{ContextID: base64.StdEncoding.EncodeToString(ref.ContextID)}
+			if ref.Content != nil {
+				index.Content, err = p.form.encode(ref.Content)
+				if err != nil {
+					writeError(w, fmt.Sprintf("encoding content hash: %s", err.Error()), 500)
+					return
+				}
+			}
+			body.Indexes = append(body.Indexes, index)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			log.Errorw("encoding containing indexes", "error", err)
+		}
+	}
+}
+
+// getSpaceClaimsHandler lists a page of the claims bound to a space when a GET
+// request is sent to "/spaces/{did}/claims". The next page is requested with the
+// returned cursor in the "cursor" query parameter.
+func getSpaceClaimsHandler(s SpaceClaimsService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		space, err := did.Parse(r.PathValue("did"))
+		if err != nil {
+			writeError(w, fmt.Sprintf("invalid did: %s", err.Error()), 400)
+			return
+		}
+		limit, err := parseIntParam(r.URL.Query(), "limit", defaultSpaceClaimsLimit, 1, maxSpaceClaimsLimit)
+		if err != nil {
+			writeParamError(w, err)
+			return
+		}
+		claims, cursor, err := s.ListClaims(r.Context(), space, r.URL.Query().Get("cursor"), limit)
+		if err != nil {
+			switch {
+			case errors.Is(err, types.ErrInvalidCursor):
+				writeError(w, err.Error(), 400)
+			case errors.Is(err, service.ErrSpaceIndexDisabled):
+				writeError(w, err.Error(), 404)
+			default:
+				writeError(w, fmt.Sprintf("listing space claims: %s", err.Error()), 500)
+			}
+			return
+		}
+		body := spaceClaimsJSON{Claims: make([]spaceClaimJSON, 0, len(claims)), Cursor: cursor}
+		for _, claim := range claims {
+			hash, err := multibase.Encode(multibase.Base58BTC, claim.Hash)
+			if err != nil {
+				writeError(w, fmt.Sprintf("encoding hash: %s", err.Error()), 500)
+				return
+			}
+			sc := spaceClaimJSON{Claim: claim.Claim.String(), Type: claim.Type, Hash: hash}
+			if !claim.Expiration.IsZero() {
+				sc.Expiration = &claim.Expiration
+			}
+			body.Claims = append(body.Claims, sc)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			log.Errorw("encoding space claims", "error", err)
+		}
+	}
+}
+
+type backfillJSON struct {
+	Indexed int `json:"indexed"`
+}
+
+// postSpaceBackfillHandler indexes the claims in the advertisement chain by
+// space when a POST request is sent to "/spaces/backfill".
+func postSpaceBackfillHandler(s SpaceClaimsService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		indexed, err := s.BackfillSpaceIndex(r.Context())
 		if err != nil {
-			http.Error(w, fmt.Sprintf("processing queury: %s", err.Error()), 400)
+			if errors.Is(err, service.ErrSpaceIndexDisabled) {
+				writeError(w, err.Error(), 404)
+				return
+			}
+			writeError(w, fmt.Sprintf("backfilling space index: %s", err.Error()), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(backfillJSON{Indexed: indexed}); err != nil {
+			log.Errorw("encoding backfill result", "error", err)
+		}
+	}
+}
+
+type rebuildJSON struct {
+	Rebuilt []service.RebuildTarget `json:"rebuilt"`
+}
+
+// postRebuildHandler rebuilds the derived stores named by the "target" query
+// parameters from scratch when a POST request is sent to "/rebuild".
+func postRebuildHandler(s RebuildingService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var targets []service.RebuildTarget
+		for _, target := range r.URL.Query()["target"] {
+			targets = append(targets, service.RebuildTarget(target))
+		}
+		if len(targets) == 0 {
+			writeError(w, "no rebuild target", 400)
+			return
+		}
+		if err := s.Rebuild(r.Context(), targets...); err != nil {
+			switch {
+			case errors.Is(err, service.ErrRebuildUnsupported):
+				writeError(w, err.Error(), 400)
+			case errors.Is(err, service.ErrSpaceIndexDisabled):
+				writeError(w, err.Error(), 404)
+			case errors.Is(err, service.ErrRebuildInProgress):
+				writeError(w, err.Error(), 409)
+			default:
+				writeError(w, fmt.Sprintf("rebuilding: %s", err.Error()), 500)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(rebuildJSON{Rebuilt: targets}); err != nil {
+			log.Errorw("encoding rebuild result", "error", err)
 		}
+	}
+}
+
+type reconstructJSON struct {
+	Content string `json:"content"`
+	Shard   string `json:"shard"`
+	Slices  int    `json:"slices"`
+}
 
-		body := car.Encode([]datamodel.Link{qr.Root().Link()}, qr.Blocks())
-		w.WriteHeader(http.StatusOK)
-		io.Copy(w, body)
+// postReconstructIndexHandler reconstructs the index of the shard named by the
+// "shard" query parameter from the location commitment archived in the body,
+// or one looked up if the body is empty, when a POST request is sent to
+// "/indexes/reconstruct".
+func postReconstructIndexHandler(s ReconstructingService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		shard, err := cid.Parse(query.Get("shard"))
+		if err != nil {
+			writeError(w, fmt.Sprintf("invalid shard: %s", err.Error()), 400)
+			return
+		}
+		var opts []service.ReconstructOption
+		if contextID := query.Get("contextID"); contextID != "" {
+			_, bytes, err := multibase.Decode(contextID)
+			if err != nil {
+				writeError(w, fmt.Sprintf("invalid context ID: %s", err.Error()), 400)
+				return
+			}
+			opts = append(opts, service.ReconstructedFor(bytes))
+		}
+		if content := query.Get("content"); content != "" {
+			c, err := cid.Parse(content)
+			if err != nil {
+				writeError(w, fmt.Sprintf("invalid content: %s", err.Error()), 400)
+				return
+			}
+			opts = append(opts, service.ReconstructedContent(cidlink.Link{Cid: c}))
+		}
+		republish, err := parseBoolParam(query, "republish", false)
+		if err != nil {
+			writeParamError(w, err)
+			return
+		}
+		if republish {
+			opts = append(opts, service.RepublishReconstructed())
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, fmt.Sprintf("reading location commitment: %s", err.Error()), 400)
+			return
+		}
+		var location delegation.Delegation
+		if len(body) > 0 {
+			location, err = delegation.Extract(body)
+			if err != nil {
+				writeError(w, fmt.Sprintf("decoding location commitment: %s", err.Error()), 400)
+				return
+			}
+		}
+		index, err := s.ReconstructIndex(r.Context(), shard, location, opts...)
+		if err != nil {
+			switch {
+			case errors.Is(err, service.ErrReconstructionDisabled):
+				writeError(w, err.Error(), 404)
+			case errors.Is(err, service.ErrShardTooLarge):
+				writeError(w, err.Error(), 413)
+			default:
+				writeError(w, fmt.Sprintf("reconstructing index: %s", err.Error()), 500)
+			}
+			return
+		}
+		count := 0
+		for _, positions := range index.Shards().Iterator() {
+			count += positions.Size()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(reconstructJSON{Content: index.Content().String(), Shard: shard.String(), Slices: count}); err != nil {
+			log.Errorw("encoding reconstruct result", "error", err)
+		}
+	}
+}
+
+func writeQueryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, service.ErrQueryRateLimited) {
+		writeError(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if errors.Is(err, service.ErrNoResultSigner) {
+		writeError(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	var overload *admission.OverloadError
+	if errors.As(err, &overload) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(overload.RetryAfter.Seconds()))))
+		writeError(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeError(w, fmt.Sprintf("processing queury: %s", err.Error()), 400)
+}
+
+// streamQueryResult writes a query result as it is read from its sources, with
+// the digest of the CAR as the ETag trailer. A failure part way through aborts
+// the response, so the client sees the body end without the final chunk
+func streamQueryResult(w http.ResponseWriter, r *http.Request, s StreamingService, q service.Query) {
+	src, err := s.QuerySources(r.Context(), q)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", car.ContentType)
+	w.Header().Set(StatsHeader, src.Stats.String())
+	w.Header().Set("Trailer", "ETag")
+	w.WriteHeader(http.StatusOK)
+	// send the headers now, so that an abort is seen as a broken body
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		log.Warnw("flushing query result headers", "error", err)
+	}
+	digest, err := queryresult.Write(w, src)
+	if err != nil {
+		log.Errorw("streaming query result", "error", err)
+		panic(http.ErrAbortHandler)
+	}
+	w.Header().Set("ETag", `"`+hex.EncodeToString(digest)+`"`)
+}
+
+// StatsHeader is the response header summing up the stats of the query a CAR
+// result answers, in the form of queryresult.Stats.String
+const StatsHeader = "X-Query-Stats"
+
+func writeQueryResult(w http.ResponseWriter, qr queryresult.QueryResult) {
+	body := car.Encode([]datamodel.Link{qr.Root().Link()}, qr.Blocks())
+	setReceiptHeader(w, qr)
+	w.Header().Set(StatsHeader, qr.Stats().String())
+	w.Header().Set("Content-Type", car.ContentType)
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, body)
+}
+
+// acceptsJSON returns true if the request asks for a JSON response rather than
+// a CAR
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+type queryClaimJSON struct {
+	Claim   string                   `json:"claim"`
+	Summary queryresult.ClaimSummary `json:"summary"`
+	// Probes are the liveness probes of the locations of the claim, keyed by URL
+	Probes map[string]queryresult.LocationProbe `json:"probes,omitempty"`
+}
+
+type queryIndexRefJSON struct {
+	ContextID string `json:"contextID"`
+	Index     string `json:"index"`
+	Provider  string `json:"provider"`
+	Error     string `json:"error,omitempty"`
+}
+
+type queryHashJSON struct {
+	Aliases   []string `json:"aliases"`
+	Claims    []string `json:"claims"`
+	Indexes   []string `json:"indexes"`
+	IndexRefs []string `json:"indexRefs"`
+}
+
+type queryResultJSON struct {
+	Claims      []queryClaimJSON                     `json:"claims"`
+	Indexes     []string                             `json:"indexes"`
+	IndexRefs   []queryIndexRefJSON                  `json:"indexRefs,omitempty"`
+	Confirmed   []string                             `json:"confirmed,omitempty"`
+	Diagnostics map[string]queryresult.HashDiagnosis `json:"diagnostics,omitempty"`
+	// Hashes are the claims and indexes found for each alias cluster of the
+	// queried hashes, keyed by the canonical hash as queried
+	Hashes map[string]queryHashJSON `json:"hashes,omitempty"`
+	// Receipt is the signed receipt for the result, encoded as in ReceiptHeader
+	Receipt string `json:"receipt,omitempty"`
+	// Stats count the work done to answer the query. They are left out of
+	// results that weren't answered by a query, which took no time
+	Stats *queryresult.Stats `json:"stats,omitempty"`
+}
+
+// writeQueryResultJSON writes a summary of each claim in a query result, in
+// order of claim CID, with the probes of its locations if asked for, along
+// with the links to its indexes, references to the indexes of its index claims
+// by context ID, and the diagnoses of hashes that found nothing, what was found
+// for each alias cluster and the receipt of the result, if asked for, and the
+// stats of the query. Diagnoses and clusters are keyed by the hashes as queried
+func writeQueryResultJSON(w http.ResponseWriter, qr queryresult.QueryResult, queried []hashParam) {
+	body := queryResultJSON{Claims: []queryClaimJSON{}, Indexes: []string{}, Diagnostics: queriedDiagnostics(qr.HashDiagnoses(), queried), Hashes: queriedHashes(qr.HashResults(), queried)}
+	if stats := qr.Stats(); stats.WallTime > 0 {
+		body.Stats = &stats
+	}
+	if body.Receipt = encodedReceipt(qr); body.Receipt != "" {
+		w.Header().Set(ReceiptHeader, body.Receipt)
+	}
+	probes := qr.LocationProbes()
+	for claim, summary := range qr.ClaimSummaries().All() {
+		body.Claims = append(body.Claims, queryClaimJSON{Claim: claim.String(), Summary: summary, Probes: locationProbes(summary, probes)})
+	}
+	slices.SortFunc(body.Claims, func(a, b queryClaimJSON) int { return strings.Compare(a.Claim, b.Claim) })
+	for _, index := range qr.Indexes() {
+		body.Indexes = append(body.Indexes, index.String())
+	}
+	for contextID, ref := range qr.IndexReferences().Iterator() {
+		body.IndexRefs = append(body.IndexRefs, queryIndexRefJSON{
+			ContextID: base64.StdEncoding.EncodeToString(contextID),
+			Index:     ref.Index.String(),
+			Provider:  ref.Provider.String(),
+			Error:     ref.Error,
+		})
+	}
+	slices.SortFunc(body.IndexRefs, func(a, b queryIndexRefJSON) int { return strings.Compare(a.ContextID, b.ContextID) })
+	for _, confirmed := range qr.Confirmed() {
+		body.Confirmed = append(body.Confirmed, confirmed.String())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Errorw("encoding query result", "error", err)
+	}
+}
+
+// locationProbes returns the probes of the locations of a claim, or nil if none
+// of them were probed
+func locationProbes(summary queryresult.ClaimSummary, probes queryresult.Map[string, queryresult.LocationProbe]) map[string]queryresult.LocationProbe {
+	var found map[string]queryresult.LocationProbe
+	for _, u := range summary.Location {
+		probe, ok := probes.Get(u.String())
+		if !ok {
+			continue
+		}
+		if found == nil {
+			found = map[string]queryresult.LocationProbe{}
+		}
+		found[u.String()] = probe
+	}
+	return found
+}
+
+// queriedDiagnostics rekeys the diagnoses of hashes, which are keyed by the
+// base58btc multibase string of each hash, by the strings they were queried as
+func queriedDiagnostics(diagnostics queryresult.Map[string, queryresult.HashDiagnosis], queried []hashParam) map[string]queryresult.HashDiagnosis {
+	rekeyed := diagnostics.Clone()
+	if len(rekeyed) == 0 {
+		return rekeyed
+	}
+	for _, p := range queried {
+		key, err := defaultHashForm.encode(p.hash)
+		if err != nil || key == p.input {
+			continue
+		}
+		if d, ok := diagnostics.Get(key); ok {
+			delete(rekeyed, key)
+			rekeyed[p.input] = d
+		}
+	}
+	return rekeyed
+}
+
+// queriedHashes encodes what was found for each alias cluster, keyed by the
+// canonical hash as it was queried
+func queriedHashes(results queryresult.Map[string, queryresult.HashResult], queried []hashParam) map[string]queryHashJSON {
+	if results.Len() == 0 {
+		return nil
+	}
+	inputs := map[string]string{}
+	for _, p := range queried {
+		if key, err := defaultHashForm.encode(p.hash); err == nil {
+			inputs[key] = p.input
+		}
+	}
+	hashes := map[string]queryHashJSON{}
+	for key, r := range results.All() {
+		h := queryHashJSON{Aliases: r.Aliases, Claims: []string{}, Indexes: []string{}, IndexRefs: []string{}}
+		for _, claim := range r.Claims {
+			h.Claims = append(h.Claims, claim.String())
+		}
+		for _, contextID := range r.Indexes {
+			h.Indexes = append(h.Indexes, base64.StdEncoding.EncodeToString(contextID))
+		}
+		for _, contextID := range r.IndexRefs {
+			h.IndexRefs = append(h.IndexRefs, base64.StdEncoding.EncodeToString(contextID))
+		}
+		if input, ok := inputs[key]; ok {
+			key = input
+		}
+		hashes[key] = h
+	}
+	return hashes
+}
+
+// requireAdmin only calls the handler for requests bearing the admin token
+func requireAdmin(token string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasAdminToken(token, r) {
+			writeError(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func hasAdminToken(token string, r *http.Request) bool {
+	auth := []byte(r.Header.Get("Authorization"))
+	return subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) == 1
+}
+
+// auditProviderRemovals is requireAdmin for provider removals, which are
+// audited as made by the admin. Requests without the admin token are audited as
+// rejected
+func auditProviderRemovals(token string, s AuditingService, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if hasAdminToken(token, r) {
+			handler(w, r.WithContext(types.WithAuditActor(r.Context(), types.AuditAdminActor)))
+			return
+		}
+		entry := types.AuditEntry{Operation: types.AuditRemoveProvider, Outcome: types.AuditRejected, Error: "unauthorized"}
+		if provider, err := peer.Decode(r.PathValue("peer")); err == nil {
+			entry.Provider = &provider
+		}
+		if err := s.Audit(r.Context(), entry); err != nil {
+			log.Errorw("recording rejected provider removal", "error", err)
+		}
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// auditImports is requireAdmin for claim imports, whose caches and publishes
+// are audited as made by the admin. Requests without the admin token are
+// audited as a rejected cache or publish, as the mode asks for
+func auditImports(token string, s AuditingService, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if hasAdminToken(token, r) {
+			handler(w, r.WithContext(types.WithAuditActor(r.Context(), types.AuditAdminActor)))
+			return
+		}
+		entry := types.AuditEntry{Operation: types.AuditCache, Outcome: types.AuditRejected, Error: "unauthorized"}
+		if r.URL.Query().Get("mode") == "publish" {
+			entry.Operation = types.AuditPublish
+		}
+		if err := s.Audit(r.Context(), entry); err != nil {
+			log.Errorw("recording rejected claim import", "error", err)
+		}
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// getConfigHandler reports the effective runtime configuration when a GET
+// request is sent to "/config".
+func getConfigHandler(s ConfigurableService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeConfig(w, s.Config())
+	}
+}
+
+// putConfigHandler applies runtime configuration when a PUT request is sent to
+// "/config". Fields not present in the request body keep their current values.
+// Requests are applied one at a time, so that concurrent changes to different
+// fields are all kept.
+func putConfigHandler(s ConfigurableService) func(http.ResponseWriter, *http.Request) {
+	var lk sync.Mutex
+	return func(w http.ResponseWriter, r *http.Request) {
+		lk.Lock()
+		defer lk.Unlock()
+		cfg := s.Config()
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			writeError(w, fmt.Sprintf("invalid config: %s", err.Error()), 400)
+			return
+		}
+		if err := s.Reconfigure(cfg); err != nil {
+			writeError(w, fmt.Sprintf("invalid config: %s", err.Error()), 400)
+			return
+		}
+		writeConfig(w, s.Config())
+	}
+}
+
+type deadLetterJSON struct {
+	Key         string    `json:"key"`
+	Hash        string    `json:"hash"`
+	Providers   []string  `json:"providers"`
+	Attempts    int       `json:"attempts"`
+	Added       time.Time `json:"added"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+type deadLettersJSON struct {
+	Depth   int              `json:"depth"`
+	Dropped uint64           `json:"dropped"`
+	Entries []deadLetterJSON `json:"entries"`
+}
+
+// getDeadLettersHandler reports the failed background cache writes waiting to be
+// replayed when a GET request is sent to "/deadletters".
+func getDeadLettersHandler(q *deadletter.Queue) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := q.Stats(r.Context())
+		if err != nil {
+			writeError(w, fmt.Sprintf("reading dead letters: %s", err.Error()), 500)
+			return
+		}
+		entries, err := q.Entries(r.Context())
+		if err != nil {
+			writeError(w, fmt.Sprintf("reading dead letters: %s", err.Error()), 500)
+			return
+		}
+		body := deadLettersJSON{Depth: stats.Depth, Dropped: stats.Dropped, Entries: make([]deadLetterJSON, 0, len(entries))}
+		for _, entry := range entries {
+			providers := make([]string, 0, len(entry.Results))
+			for _, result := range entry.Results {
+				if result.Provider != nil {
+					providers = append(providers, result.Provider.ID.String())
+				}
+			}
+			body.Entries = append(body.Entries, deadLetterJSON{
+				Key:         entry.Key,
+				Hash:        entry.Hash.B58String(),
+				Providers:   providers,
+				Attempts:    entry.Attempts,
+				Added:       entry.Added,
+				NextAttempt: entry.NextAttempt,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			log.Errorw("encoding dead letters", "error", err)
+		}
+	}
+}
+
+type purgeJSON struct {
+	Purged int `json:"purged"`
+}
+
+// deleteDeadLettersHandler discards every failed background cache write when a
+// DELETE request is sent to "/deadletters".
+func deleteDeadLettersHandler(q *deadletter.Queue) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		purged, err := q.Purge(r.Context())
+		if err != nil {
+			writeError(w, fmt.Sprintf("purging dead letters: %s", err.Error()), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(purgeJSON{Purged: purged}); err != nil {
+			log.Errorw("encoding purge result", "error", err)
+		}
+	}
+}
+
+type expansionJSON struct {
+	Key          string    `json:"key"`
+	ContextID    string    `json:"contextID"`
+	Index        string    `json:"index"`
+	Provider     string    `json:"provider,omitempty"`
+	Reason       string    `json:"reason"`
+	State        string    `json:"state"`
+	Owner        string    `json:"owner,omitempty"`
+	Attempts     int       `json:"attempts"`
+	Added        time.Time `json:"added"`
+	NextAttempt  time.Time `json:"nextAttempt"`
+	LeaseExpires time.Time `json:"leaseExpires"`
+	Error        string    `json:"error,omitempty"`
+}
+
+type expansionsJSON struct {
+	Depth    int             `json:"depth"`
+	InFlight int             `json:"inFlight"`
+	Failed   int             `json:"failed"`
+	Jobs     []expansionJSON `json:"jobs"`
+}
+
+// getExpansionsHandler reports the indexes queued, being expanded, or that
+// failed to expand when a GET request is sent to "/expansions".
+func getExpansionsHandler(p *expansion.Pool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := p.Stats(r.Context())
+		if err != nil {
+			writeError(w, fmt.Sprintf("reading expansions: %s", err.Error()), 500)
+			return
+		}
+		jobs, err := p.Jobs(r.Context())
+		if err != nil {
+			writeError(w, fmt.Sprintf("reading expansions: %s", err.Error()), 500)
+			return
+		}
+		body := expansionsJSON{Depth: stats.Depth, InFlight: stats.InFlight, Failed: stats.Failed, Jobs: make([]expansionJSON, 0, len(jobs))}
+		for _, job := range jobs {
+			ej := expansionJSON{
+				Key:          job.Key,
+				ContextID:    base64.StdEncoding.EncodeToString(job.ContextID),
+				Index:        job.Index.String(),
+				Reason:       string(job.Reason),
+				State:        string(job.State),
+				Owner:        job.Owner,
+				Attempts:     job.Attempts,
+				Added:        job.Added,
+				NextAttempt:  job.NextAttempt,
+				LeaseExpires: job.LeaseExpires,
+				Error:        job.Error,
+			}
+			if job.Provider.Provider != nil {
+				ej.Provider = job.Provider.Provider.ID.String()
+			}
+			body.Jobs = append(body.Jobs, ej)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			log.Errorw("encoding expansions", "error", err)
+		}
+	}
+}
+
+type identityConflictJSON struct {
+	DID        string    `json:"did"`
+	Peer       string    `json:"peer"`
+	MappedPeer string    `json:"mappedPeer,omitempty"`
+	MappedDID  string    `json:"mappedDid,omitempty"`
+	First      time.Time `json:"first"`
+	Last       time.Time `json:"last"`
+	Count      int       `json:"count"`
+}
+
+type identityConflictsJSON struct {
+	Conflicts []identityConflictJSON `json:"conflicts"`
+}
+
+// getIdentityConflictsHandler reports the observed pairs of claim issuer and
+// advertising peer that disagree with the identity mapping when a GET request
+// is sent to "/identities/conflicts".
+func getIdentityConflictsHandler(ids *identity.Mapping) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conflicts := ids.Conflicts()
+		body := make([]identityConflictJSON, 0, len(conflicts))
+		for _, c := range conflicts {
+			conflict := identityConflictJSON{
+				DID:   c.DID.String(),
+				Peer:  c.Peer.String(),
+				First: c.First,
+				Last:  c.Last,
+				Count: c.Count,
+			}
+			if c.MappedPeer != "" {
+				conflict.MappedPeer = c.MappedPeer.String()
+			}
+			if c.MappedDID.Defined() {
+				conflict.MappedDID = c.MappedDID.String()
+			}
+			body = append(body, conflict)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(identityConflictsJSON{Conflicts: body}); err != nil {
+			log.Errorw("encoding identity conflicts", "error", err)
+		}
+	}
+}
+
+type auditEntryJSON struct {
+	Operation types.AuditOperation `json:"operation"`
+	Actor     string               `json:"actor,omitempty"`
+	Claim     string               `json:"claim,omitempty"`
+	Space     string               `json:"space,omitempty"`
+	Provider  string               `json:"provider,omitempty"`
+	HashCount int                  `json:"hashCount,omitempty"`
+	Outcome   types.AuditOutcome   `json:"outcome"`
+	Error     string               `json:"error,omitempty"`
+	Time      time.Time            `json:"time"`
+}
+
+type auditLogJSON struct {
+	Entries []auditEntryJSON `json:"entries"`
+	Cursor  string           `json:"cursor,omitempty"`
+}
+
+// getAuditHandler lists audit entries, filtered by the operation, actor,
+// outcome, since and until parameters, when a GET request is sent to "/audit".
+func getAuditHandler(l types.AuditLog) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		filter := types.AuditFilter{
+			Operation: types.AuditOperation(params.Get("operation")),
+			Actor:     params.Get("actor"),
+			Outcome:   types.AuditOutcome(params.Get("outcome")),
+		}
+		for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+			if v := params.Get(name); v != "" {
+				parsed, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					writeError(w, fmt.Sprintf("invalid %s: %s", name, err.Error()), 400)
+					return
+				}
+				*t = parsed
+			}
+		}
+		limit, err := parseIntParam(params, "limit", 0, 1, audit.MaxLimit)
+		if err != nil {
+			writeParamError(w, err)
+			return
+		}
+		filter.Limit = limit
+		entries, cursor, err := l.AuditLog(r.Context(), filter, params.Get("cursor"))
+		if err != nil {
+			if errors.Is(err, types.ErrInvalidCursor) {
+				writeError(w, err.Error(), 400)
+				return
+			}
+			writeError(w, fmt.Sprintf("reading audit log: %s", err.Error()), 500)
+			return
+		}
+		body := auditLogJSON{Entries: make([]auditEntryJSON, 0, len(entries)), Cursor: cursor}
+		for _, entry := range entries {
+			e := auditEntryJSON{
+				Operation: entry.Operation,
+				Actor:     entry.Actor,
+				HashCount: entry.HashCount,
+				Outcome:   entry.Outcome,
+				Error:     entry.Error,
+				Time:      entry.Time,
+			}
+			if entry.Claim.Defined() {
+				e.Claim = entry.Claim.String()
+			}
+			if entry.Space != nil {
+				e.Space = entry.Space.String()
+			}
+			if entry.Provider != nil {
+				e.Provider = entry.Provider.String()
+			}
+			body.Entries = append(body.Entries, e)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			log.Errorw("encoding audit log", "error", err)
+		}
+	}
+}
+
+type advertSummaryJSON struct {
+	Seq       uint64    `json:"seq"`
+	Link      string    `json:"link"`
+	ContextID string    `json:"contextID"`
+	Entries   int       `json:"entries"`
+	Chunks    int       `json:"chunks"`
+	Bytes     int64     `json:"bytes"`
+	Published time.Time `json:"published,omitempty"`
+	Removal   bool      `json:"removal,omitempty"`
+}
+
+type publisherSummaryJSON struct {
+	Head          string              `json:"head,omitempty"`
+	Adverts       uint64              `json:"adverts"`
+	Entries       int64               `json:"entries"`
+	Chunks        int64               `json:"chunks"`
+	Bytes         int64               `json:"bytes"`
+	EntriesPerDay float64             `json:"entriesPerDay"`
+	First         time.Time           `json:"first,omitempty"`
+	Last          time.Time           `json:"last,omitempty"`
+	Recent        []advertSummaryJSON `json:"recent"`
+	// AdvertisedFilter is set if the publisher keeps an advertised filter
+	AdvertisedFilter *advertisedFilterJSON `json:"advertisedFilter,omitempty"`
+}
+
+type advertisedFilterJSON struct {
+	Loaded            bool    `json:"loaded"`
+	Head              string  `json:"head,omitempty"`
+	Hashes            uint64  `json:"hashes"`
+	Stages            int     `json:"stages"`
+	Bytes             int     `json:"bytes"`
+	FillRatio         float64 `json:"fillRatio"`
+	FalsePositiveRate float64 `json:"falsePositiveRate"`
+}
+
+// getPublisherSummaryHandler reports the size of the advertisement chain when a
+// GET request is sent to "/publisher/summary".
+func getPublisherSummaryHandler(p *publisher.Publisher) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		summary, err := p.ChainSummary(r.Context())
+		if err != nil {
+			writeError(w, fmt.Sprintf("reading chain summary: %s", err.Error()), 500)
+			return
+		}
+		writePublisherSummary(w, summary)
+	}
+}
+
+// postRebuildPublisherSummaryHandler recomputes the advertisement chain summary
+// from the chain when a POST request is sent to "/publisher/summary/rebuild".
+func postRebuildPublisherSummaryHandler(p *publisher.Publisher) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		summary, err := p.RebuildSummary(r.Context())
+		if err != nil {
+			writeError(w, fmt.Sprintf("rebuilding chain summary: %s", err.Error()), 500)
+			return
+		}
+		writePublisherSummary(w, summary)
+	}
+}
+
+// getPublisherChainHandler exports the advertisement chain as a CAR when a GET
+// request is sent to "/publisher/chain". The chain is exported from the "from"
+// advertisement, the head as of the "at" time, or the head, back to the "to"
+// advertisement, or the tail.
+func getPublisherChainHandler(p *publisher.Publisher) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, err := advertParam(r, "from")
+		if err != nil {
+			writeError(w, err.Error(), 400)
+			return
+		}
+		to, err := advertParam(r, "to")
+		if err != nil {
+			writeError(w, err.Error(), 400)
+			return
+		}
+		if v := r.URL.Query().Get("at"); v != "" && from == nil {
+			at, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeError(w, fmt.Sprintf("invalid at: %s", err.Error()), 400)
+				return
+			}
+			from, err = p.ChainAt(r.Context(), at)
+			if err != nil {
+				writeError(w, fmt.Sprintf("reading timeline: %s", err.Error()), 500)
+				return
+			}
+			if from == nil {
+				writeError(w, fmt.Sprintf("nothing published as of %s", at.Format(time.RFC3339)), 404)
+				return
+			}
+		}
+		if from == nil {
+			from, err = p.Head(r.Context())
+			if err != nil {
+				writeError(w, fmt.Sprintf("reading head: %s", err.Error()), 500)
+				return
+			}
+			if from == nil {
+				writeError(w, publisher.ErrNothingToExport.Error(), 404)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", car.ContentType)
+		// once streaming has begun, a failure can only cut the CAR short
+		if err := p.ExportChain(r.Context(), w, from, to); err != nil {
+			log.Errorw("exporting advertisement chain", "error", err)
+		}
+	}
+}
+
+// advertParam parses the advertisement CID in a query parameter, returning nil
+// if it isn't set
+func advertParam(r *http.Request, param string) (datamodel.Link, error) {
+	v := r.URL.Query().Get(param)
+	if v == "" {
+		return nil, nil
+	}
+	c, err := cid.Decode(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s advertisement: %w", param, err)
+	}
+	return cidlink.Link{Cid: c}, nil
+}
+
+// postPublisherChainHandler imports an advertisement chain from the CAR in the
+// body when a POST request is sent to "/publisher/chain".
+func postPublisherChainHandler(p *publisher.Publisher) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := p.ImportChain(r.Context(), r.Body); err != nil {
+			status := 400
+			var divergent publisher.DivergentChainError
+			if errors.As(err, &divergent) {
+				status = 409
+			}
+			writeError(w, fmt.Sprintf("importing chain: %s", err.Error()), status)
+			return
+		}
+		summary, err := p.ChainSummary(r.Context())
+		if err != nil {
+			writeError(w, fmt.Sprintf("reading chain summary: %s", err.Error()), 500)
+			return
+		}
+		writePublisherSummary(w, summary)
+	}
+}
+
+type rebasedAdvertJSON struct {
+	Original  string `json:"original"`
+	ContextID []byte `json:"contextID"`
+	Removal   bool   `json:"removal,omitempty"`
+	Rebased   string `json:"rebased,omitempty"`
+}
+
+type rebaseJSON struct {
+	Head     string              `json:"head,omitempty"`
+	Onto     string              `json:"onto"`
+	Ancestor string              `json:"ancestor,omitempty"`
+	Adverts  []rebasedAdvertJSON `json:"adverts"`
+	NewHead  string              `json:"newHead,omitempty"`
+	DryRun   bool                `json:"dryRun"`
+}
+
+// postRebaseHandler publishes the advertisements of a chain that diverged from
+// the one an indexer ingested again on top of the "onto" advertisement when a
+// POST request is sent to "/publisher/rebase". Nothing is written if "dryRun"
+// is set.
+func postRebaseHandler(p *publisher.Publisher) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		onto, err := advertParam(r, "onto")
+		if err != nil {
+			writeError(w, err.Error(), 400)
+			return
+		}
+		if onto == nil {
+			writeError(w, "missing onto advertisement", 400)
+			return
+		}
+		var opts []publisher.RebaseOption
+		dryRun, err := parseBoolParam(r.URL.Query(), "dryRun", false)
+		if err != nil {
+			writeParamError(w, err)
+			return
+		}
+		if dryRun {
+			opts = append(opts, publisher.RebaseDryRun())
+		}
+		report, err := p.RebaseChain(r.Context(), onto, opts...)
+		if err != nil {
+			status := 500
+			if errors.Is(err, publisher.ErrAdvertNotFound) {
+				status = 404
+			}
+			writeError(w, fmt.Sprintf("rebasing chain: %s", err.Error()), status)
+			return
+		}
+		body := rebaseJSON{
+			Onto:    report.Onto.String(),
+			Adverts: make([]rebasedAdvertJSON, 0, len(report.Adverts)),
+			DryRun:  report.DryRun,
+		}
+		if report.Head.Defined() {
+			body.Head = report.Head.String()
+		}
+		if report.Ancestor.Defined() {
+			body.Ancestor = report.Ancestor.String()
+		}
+		if report.NewHead.Defined() {
+			body.NewHead = report.NewHead.String()
+		}
+		for _, adv := range report.Adverts {
+			a := rebasedAdvertJSON{Original: adv.Original.String(), ContextID: adv.ContextID, Removal: adv.Removal}
+			if adv.Rebased.Defined() {
+				a.Rebased = adv.Rebased.String()
+			}
+			body.Adverts = append(body.Adverts, a)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			log.Errorw("encoding rebase", "error", err)
+		}
+	}
+}
+
+func writePublisherSummary(w http.ResponseWriter, summary publisher.Summary) {
+	body := publisherSummaryJSON{
+		Adverts:       summary.Adverts,
+		Entries:       summary.Entries,
+		Chunks:        summary.Chunks,
+		Bytes:         summary.Bytes,
+		EntriesPerDay: summary.EntriesPerDay(),
+		First:         summary.First,
+		Last:          summary.Last,
+		Recent:        make([]advertSummaryJSON, 0, len(summary.Recent)),
+	}
+	if summary.Head != nil {
+		body.Head = summary.Head.String()
+	}
+	for _, s := range summary.Recent {
+		body.Recent = append(body.Recent, newAdvertSummaryJSON(s))
+	}
+	if f := summary.Advertised; f != nil {
+		body.AdvertisedFilter = &advertisedFilterJSON{
+			Loaded:            f.Loaded,
+			Hashes:            f.Hashes,
+			Stages:            f.Stages,
+			Bytes:             f.Bytes,
+			FillRatio:         f.FillRatio,
+			FalsePositiveRate: f.FalsePositiveRate,
+		}
+		if f.Head != nil {
+			body.AdvertisedFilter.Head = f.Head.String()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Errorw("encoding chain summary", "error", err)
+	}
+}
+
+func newAdvertSummaryJSON(s publisher.AdvertSummary) advertSummaryJSON {
+	return advertSummaryJSON{
+		Seq:       s.Seq,
+		Link:      s.Link.String(),
+		ContextID: base64.StdEncoding.EncodeToString(s.ContextID),
+		Entries:   s.Entries,
+		Chunks:    s.Chunks,
+		Bytes:     s.Bytes,
+		Published: s.Published,
+		Removal:   s.Removal,
+	}
+}
+
+const (
+	defaultTimelineLimit = 100
+	maxTimelineLimit     = 1000
+)
+
+type timedAdvertJSON struct {
+	advertSummaryJSON
+	At time.Time `json:"at"`
+}
+
+type timelineJSON struct {
+	From       time.Time         `json:"from"`
+	To         time.Time         `json:"to"`
+	Head       string            `json:"head,omitempty"`
+	Total      int               `json:"total"`
+	Entries    int64             `json:"entries"`
+	Removals   int               `json:"removals"`
+	ContextIDs int               `json:"contextIDs"`
+	Truncated  bool              `json:"truncated,omitempty"`
+	Adverts    []timedAdvertJSON `json:"adverts"`
+}
+
+// getPublisherTimelineHandler summarizes the advertisements published between
+// the "from" and "to" times, and the head of the chain at the end of them, when
+// a GET request is sent to "/publisher/timeline". The window runs from the
+// start of time and until now if they aren't set, listing up to "limit"
+// advertisements.
+func getPublisherTimelineHandler(p *publisher.Publisher) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		from, to := time.Time{}, time.Now().UTC()
+		for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+			if v := params.Get(name); v != "" {
+				parsed, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					writeError(w, fmt.Sprintf("invalid %s: %s", name, err.Error()), 400)
+					return
+				}
+				*t = parsed
+			}
+		}
+		limit, err := parseIntParam(params, "limit", defaultTimelineLimit, 1, maxTimelineLimit)
+		if err != nil {
+			writeParamError(w, err)
+			return
+		}
+		window, err := p.Window(r.Context(), from, to, limit)
+		if err != nil {
+			writeError(w, fmt.Sprintf("reading timeline: %s", err.Error()), 500)
+			return
+		}
+		body := timelineJSON{
+			From:       window.From,
+			To:         window.To,
+			Total:      window.Total,
+			Entries:    window.Entries,
+			Removals:   window.Removals,
+			ContextIDs: window.ContextIDs,
+			Truncated:  window.Truncated,
+			Adverts:    make([]timedAdvertJSON, 0, len(window.Adverts)),
+		}
+		if window.Head != nil {
+			body.Head = window.Head.String()
+		}
+		for _, a := range window.Adverts {
+			body.Adverts = append(body.Adverts, timedAdvertJSON{newAdvertSummaryJSON(a.AdvertSummary), a.At})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			log.Errorw("encoding timeline", "error", err)
+		}
+	}
+}
+
+type endpointHealthJSON struct {
+	Name                string    `json:"name"`
+	Required            bool      `json:"required"`
+	Pending             int       `json:"pending"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastSuccess         time.Time `json:"lastSuccess,omitempty"`
+	LastFailure         time.Time `json:"lastFailure,omitempty"`
+	LastError           string    `json:"lastError,omitempty"`
+	NextAttempt         time.Time `json:"nextAttempt,omitempty"`
+}
+
+type announcerJSON struct {
+	Pending     int                  `json:"pending"`
+	Unconfirmed int                  `json:"unconfirmed"`
+	Endpoints   []endpointHealthJSON `json:"endpoints"`
+}
+
+// getAnnouncerHandler reports the health of every announce endpoint and the
+// number of advertisements waiting to be announced when a GET request is sent
+// to "/publisher/announcer".
+func getAnnouncerHandler(a *publisher.Announcer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := a.Stats(r.Context())
+		if err != nil {
+			writeError(w, fmt.Sprintf("reading announcer stats: %s", err.Error()), 500)
+			return
+		}
+		body := announcerJSON{Pending: stats.Pending, Unconfirmed: stats.Unconfirmed, Endpoints: make([]endpointHealthJSON, 0, len(stats.Endpoints))}
+		for _, e := range stats.Endpoints {
+			body.Endpoints = append(body.Endpoints, endpointHealthJSON(e))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			log.Errorw("encoding announcer stats", "error", err)
+		}
+	}
+}
+
+type lagJSON struct {
+	Indexer           string    `json:"indexer"`
+	Head              string    `json:"head,omitempty"`
+	LastAdvertisement string    `json:"lastAdvertisement,omitempty"`
+	Lag               int       `json:"lag"`
+	Exact             bool      `json:"exact"`
+	IngestError       string    `json:"ingestError,omitempty"`
+	CheckError        string    `json:"checkError,omitempty"`
+	Lagging           bool      `json:"lagging"`
+	Checked           time.Time `json:"checked"`
+}
+
+// getLagHandler lists how far behind the head of the advertisement chain each
+// indexer was when last checked when a GET request is sent to
+// "/publisher/lag"
+func getLagHandler(m *publisher.LagMonitor) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lags := m.Lags()
+		body := make([]lagJSON, 0, len(lags))
+		for _, lag := range lags {
+			l := lagJSON{
+				Indexer:     lag.Name,
+				Lag:         lag.Lag,
+				Exact:       lag.Exact,
+				IngestError: lag.IngestError,
+				CheckError:  lag.CheckError,
+				Lagging:     lag.Lagging,
+				Checked:     lag.Checked,
+			}
+			if lag.Head.Defined() {
+				l.Head = lag.Head.String()
+			}
+			if lag.LastAdvertisement.Defined() {
+				l.LastAdvertisement = lag.LastAdvertisement.String()
+			}
+			body = append(body, l)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			log.Errorw("encoding indexer lag", "error", err)
+		}
+	}
+}
+
+type divergenceJSON struct {
+	Indexer           string    `json:"indexer"`
+	Head              string    `json:"head,omitempty"`
+	LastAdvertisement string    `json:"lastAdvertisement,omitempty"`
+	Relation          string    `json:"relation,omitempty"`
+	Ancestor          string    `json:"ancestor,omitempty"`
+	Behind            int       `json:"behind"`
+	Ahead             int       `json:"ahead"`
+	CheckError        string    `json:"checkError,omitempty"`
+	Checked           time.Time `json:"checked"`
+}
+
+// getDivergenceHandler checks how the chain each indexer ingested relates to
+// the advertisement chain when a GET request is sent to
+// "/publisher/divergence". Divergent chains are only reported, and repaired by
+// a rebase.
+func getDivergenceHandler(m *publisher.LagMonitor) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		divergences, err := m.Divergence(r.Context())
+		if err != nil {
+			writeError(w, fmt.Sprintf("checking divergence: %s", err.Error()), 500)
+			return
+		}
+		body := make([]divergenceJSON, 0, len(divergences))
+		for _, d := range divergences {
+			dj := divergenceJSON{
+				Indexer:    d.Name,
+				Relation:   string(d.Relation),
+				Behind:     d.Behind,
+				Ahead:      d.Ahead,
+				CheckError: d.CheckError,
+				Checked:    d.Checked,
+			}
+			if d.Head.Defined() {
+				dj.Head = d.Head.String()
+			}
+			if d.LastAdvertisement.Defined() {
+				dj.LastAdvertisement = d.LastAdvertisement.String()
+			}
+			if d.Ancestor.Defined() {
+				dj.Ancestor = d.Ancestor.String()
+			}
+			body = append(body, dj)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			log.Errorw("encoding indexer divergence", "error", err)
+		}
+	}
+}
+
+type healthJSON struct {
+	Status   string `json:"status"`
+	Shedding bool   `json:"shedding"`
+	Lagging  bool   `json:"lagging"`
+	// SelfCheck is the outcome of the canary's last self check, if it has run
+	SelfCheck *selfCheckJSON `json:"selfCheck,omitempty"`
+}
+
+// getHealthHandler reports whether the service is shedding queries, indexers
+// are lagging behind its advertisement chain, or the canary's last self check
+// failed, when a GET request is sent to "/health". Any of them makes the
+// service degraded rather than down, since queries are still served
+func getHealthHandler(controller *admission.Controller, lag *publisher.LagMonitor, canary *service.Canary) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := healthJSON{Status: "ok"}
+		if controller != nil && controller.Shedding() {
+			body.Shedding = true
+		}
+		if lag != nil && lag.Lagging() {
+			body.Lagging = true
+		}
+		failing := false
+		if canary != nil {
+			if report, ok := canary.Last(); ok {
+				sc := newSelfCheckJSON(report)
+				body.SelfCheck = &sc
+				failing = !sc.Passed
+			}
+		}
+		if body.Shedding || body.Lagging || failing {
+			body.Status = "degraded"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			log.Errorw("encoding health", "error", err)
+		}
+	}
+}
+
+type admissionJSON struct {
+	InFlight int       `json:"inFlight"`
+	P95      string    `json:"p95"`
+	Shedding bool      `json:"shedding"`
+	Since    time.Time `json:"since"`
+	Rejected uint64    `json:"rejected"`
+}
+
+// getAdmissionHandler reports the load on the service and whether queries are
+// being shed when a GET request is sent to "/admission".
+func getAdmissionHandler(controller *admission.Controller) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := controller.Stats()
+		body := admissionJSON{
+			InFlight: stats.InFlight,
+			P95:      stats.P95.String(),
+			Shedding: stats.Shedding,
+			Since:    stats.Since,
+			Rejected: stats.Rejected,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			log.Errorw("encoding admission stats", "error", err)
+		}
+	}
+}
+
+type importOutcomeJSON struct {
+	Claim     string `json:"claim"`
+	Type      string `json:"type,omitempty"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+	ClockSkew string `json:"clockSkew,omitempty"`
+}
+
+type importReportJSON struct {
+	Imported   int    `json:"imported"`
+	Duplicates int    `json:"duplicates"`
+	Invalid    int    `json:"invalid"`
+	Failed     int    `json:"failed"`
+	Error      string `json:"error,omitempty"`
+}
+
+// postImportClaimsHandler imports the claims in a CAR file of delegations sent
+// as the body of a POST request to "/claims/import". The "mode" parameter is
+// "cache" or "publish", and "trustedIssuer" may be given for each issuer whose
+// claims are imported. The outcome of each claim is streamed back as a line of
+// JSON as it is imported, followed by a line with the totals.
+func postImportClaimsHandler(s ImportingService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var opts service.ImportOptions
+		switch mode := r.URL.Query().Get("mode"); mode {
+		case "", "cache":
+			opts.Mode = claimimport.ModeCache
+		case "publish":
+			opts.Mode = claimimport.ModePublish
+		default:
+			writeError(w, fmt.Sprintf("invalid mode: %s", mode), 400)
+			return
+		}
+		for _, issuer := range r.URL.Query()["trustedIssuer"] {
+			id, err := did.Parse(issuer)
+			if err != nil {
+				writeError(w, fmt.Sprintf("invalid trusted issuer: %s", err.Error()), 400)
+				return
+			}
+			opts.TrustedIssuers = append(opts.TrustedIssuers, id)
+		}
+		// outcomes are written while the body is still being read
+		if err := http.NewResponseController(w).EnableFullDuplex(); err != nil {
+			log.Warnw("streaming import outcomes", "error", err)
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		opts.OnOutcome = func(o claimimport.Outcome) {
+			if err := enc.Encode(importOutcomeJSON{Claim: o.Claim.String(), Type: o.Type, Status: string(o.Status), Reason: o.Reason, ClockSkew: o.ClockSkew}); err != nil {
+				log.Errorw("encoding import outcome", "error", err)
+			}
+		}
+		report, err := s.ImportClaims(r.Context(), r.Body, opts)
+		body := importReportJSON{Imported: report.Imported, Duplicates: report.Duplicates, Invalid: report.Invalid, Failed: report.Failed}
+		if err != nil {
+			body.Error = err.Error()
+		}
+		if err := enc.Encode(body); err != nil {
+			log.Errorw("encoding import report", "error", err)
+		}
+	}
+}
+
+type tombstoneJSON struct {
+	Provider string     `json:"provider"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Adverts  int        `json:"adverts"`
+	Swept    int        `json:"swept"`
+	Hashes   int        `json:"hashes"`
+	Records  int        `json:"records"`
+	Claims   int        `json:"claims"`
+	Error    string     `json:"error,omitempty"`
+}
+
+func newTombstoneJSON(t types.ProviderTombstone) tombstoneJSON {
+	body := tombstoneJSON{
+		Provider: t.Provider.String(),
+		Started:  t.Started,
+		Adverts:  t.Adverts,
+		Swept:    t.Swept,
+		Hashes:   t.Hashes,
+		Records:  t.Records,
+		Claims:   t.Claims,
+	}
+	if t.Done() {
+		body.Finished = &t.Finished
+	}
+	return body
+}
+
+// deleteProviderHandler removes every record of a provider when a DELETE
+// request is sent to "/providers/{peer}". The progress of the removal is
+// streamed back as lines of JSON, the last of which has the finish time, or
+// the error the removal stopped with. A removal that stopped is resumed by
+// sending the request again.
+func deleteProviderHandler(s ProviderRemovalService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider, err := peer.Decode(r.PathValue("peer"))
+		if err != nil {
+			writeError(w, fmt.Sprintf("invalid peer ID: %s", err.Error()), 400)
+			return
+		}
+		enc := json.NewEncoder(w)
+		var last *tombstoneJSON
+		onProgress := func(t types.ProviderTombstone) {
+			if last == nil {
+				w.Header().Set("Content-Type", "application/x-ndjson")
+			}
+			body := newTombstoneJSON(t)
+			last = &body
+			if err := enc.Encode(body); err != nil {
+				log.Errorw("encoding provider removal progress", "error", err)
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+		err = s.RemoveProvider(r.Context(), provider, onProgress)
+		if err == nil {
+			return
+		}
+		if last == nil {
+			if errors.Is(err, providerindex.ErrRemovalUnsupported) {
+				writeError(w, err.Error(), 404)
+				return
+			}
+			writeError(w, fmt.Sprintf("removing provider: %s", err.Error()), 500)
+			return
+		}
+		last.Error = err.Error()
+		if err := enc.Encode(last); err != nil {
+			log.Errorw("encoding provider removal error", "error", err)
+		}
+	}
+}
+
+const defaultExportLimit = 10_000
+
+// exportContentTypes are the content types of the export formats
+var exportContentTypes = map[types.ExportFormat]string{
+	types.ExportNDJSON: "application/x-ndjson",
+	types.ExportCSV:    "text/csv",
+}
+
+// exportWriter sends the response headers with the first write, so that an
+// export that fails before writing anything can still respond with an error
+type exportWriter struct {
+	w     http.ResponseWriter
+	wrote bool
+}
+
+func (ew *exportWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if !ew.wrote {
+		ew.wrote = true
+		ew.w.WriteHeader(http.StatusOK)
+		// send the headers now, so that an abort is seen as a broken body
+		if err := http.NewResponseController(ew.w).Flush(); err != nil {
+			log.Warnw("flushing export headers", "error", err)
+		}
+	}
+	return ew.w.Write(p)
+}
+
+// getProviderExportHandler streams a page of the cached provider records when
+// a GET request is sent to "/providers/export", as rows in the "format" query
+// parameter, either ndjson or csv. The page covers about "limit" hashes, or
+// every hash if it is 0, and the cursor of the next page is sent in the
+// Next-Cursor trailer, to be passed in the "cursor" query parameter. The
+// trailer is empty after the last page. A failure part way through aborts the
+// response, so the client sees the body end without the final chunk.
+func getProviderExportHandler(s ExportingService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := types.ExportFormat(r.URL.Query().Get("format"))
+		if format == "" {
+			format = types.ExportNDJSON
+		}
+		contentType, ok := exportContentTypes[format]
+		if !ok {
+			writeError(w, fmt.Sprintf("invalid format: must be %s or %s", types.ExportNDJSON, types.ExportCSV), 400)
+			return
+		}
+		limit, err := parseIntParam(r.URL.Query(), "limit", defaultExportLimit, 0, math.MaxInt)
+		if err != nil {
+			writeParamError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Trailer", "Next-Cursor")
+		ew := &exportWriter{w: w}
+		next, err := s.ExportProviderRecords(r.Context(), ew, format, r.URL.Query().Get("cursor"), limit)
+		if err != nil {
+			if ew.wrote {
+				log.Errorw("exporting provider records", "error", err)
+				panic(http.ErrAbortHandler)
+			}
+			w.Header().Del("Trailer")
+			switch {
+			case errors.Is(err, types.ErrInvalidCursor):
+				writeError(w, err.Error(), 400)
+			case errors.Is(err, providerindex.ErrExportUnsupported):
+				writeError(w, err.Error(), 404)
+			default:
+				writeError(w, fmt.Sprintf("exporting provider records: %s", err.Error()), 500)
+			}
+			return
+		}
+		if !ew.wrote {
+			w.WriteHeader(http.StatusOK)
+		}
+		w.Header().Set("Next-Cursor", next)
+	}
+}
+
+// getSyncManifestHandler describes a page of the ranges of the provider cache
+// when a GET request is sent to "/sync/manifest". The page covers "limit"
+// ranges, or every range if it is 0, starting at the "cursor" query parameter,
+// and has the cursor of the next page.
+func getSyncManifestHandler(s *cachesync.Source) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, ok := syncLimit(w, r, cachesync.DefaultManifestPageSize)
+		if !ok {
+			return
+		}
+		page, err := s.Manifest(r.Context(), r.URL.Query().Get("cursor"), limit)
+		if err != nil {
+			if errors.Is(err, types.ErrInvalidCursor) {
+				writeError(w, err.Error(), 400)
+				return
+			}
+			writeError(w, fmt.Sprintf("describing provider cache: %s", err.Error()), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(page); err != nil {
+			log.Errorw("encoding sync manifest", "error", err)
+		}
+	}
+}
+
+// getSyncRecordsHandler streams the provider records of a page of the hashes
+// in the ranges listed in the "ranges" query parameter, separated by commas,
+// when a GET request is sent to "/sync/records". The page covers about
+// "limit" hashes, or every hash if it is 0, and the cursor of the next page is
+// sent in the Next-Cursor trailer, empty after the last page. A failure part
+// way through aborts the response.
+func getSyncRecordsHandler(s *cachesync.Source) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ranges []int
+		for _, v := range strings.Split(r.URL.Query().Get("ranges"), ",") {
+			rng, err := strconv.Atoi(v)
+			if err != nil {
+				writeError(w, "invalid ranges: must be a list of range numbers separated by commas", 400)
+				return
+			}
+			ranges = append(ranges, rng)
+		}
+		limit, ok := syncLimit(w, r, cachesync.DefaultRecordsPageSize)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Trailer", "Next-Cursor")
+		ew := &exportWriter{w: w}
+		enc := json.NewEncoder(ew)
+		next, err := s.Records(r.Context(), ranges, r.URL.Query().Get("cursor"), limit, func(row cachesync.RecordsRow) error {
+			return enc.Encode(row)
+		})
+		if err != nil {
+			if ew.wrote {
+				log.Errorw("sending provider records to sync", "error", err)
+				panic(http.ErrAbortHandler)
+			}
+			w.Header().Del("Trailer")
+			switch {
+			case errors.Is(err, types.ErrInvalidCursor), errors.Is(err, cachesync.ErrInvalidRanges):
+				writeError(w, err.Error(), 400)
+			default:
+				writeError(w, fmt.Sprintf("reading provider records: %s", err.Error()), 500)
+			}
+			return
+		}
+		if !ew.wrote {
+			w.WriteHeader(http.StatusOK)
+		}
+		w.Header().Set("Next-Cursor", next)
+	}
+}
+
+// syncLimit parses the "limit" query parameter, writing an error response if
+// it is invalid
+func syncLimit(w http.ResponseWriter, r *http.Request, def int) (int, bool) {
+	limit, err := parseIntParam(r.URL.Query(), "limit", def, 0, math.MaxInt)
+	if err != nil {
+		writeParamError(w, err)
+		return 0, false
+	}
+	return limit, true
+}
+
+type syncRequestJSON struct {
+	// From is the base URL of the deployment synced from
+	From string `json:"from"`
+	// Token is the admin token of the deployment synced from
+	Token  string `json:"token,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+type syncProgressJSON struct {
+	Cursor     string `json:"cursor"`
+	Ranges     int    `json:"ranges"`
+	Mismatched int    `json:"mismatched"`
+	Fetched    int    `json:"fetched"`
+	Written    int    `json:"written"`
+	Records    int    `json:"records"`
+	Done       bool   `json:"done"`
+	Error      string `json:"error,omitempty"`
+}
+
+func newSyncProgressJSON(p cachesync.Progress) syncProgressJSON {
+	return syncProgressJSON{
+		Cursor:     p.Cursor,
+		Ranges:     p.Ranges,
+		Mismatched: p.Mismatched,
+		Fetched:    p.Fetched,
+		Written:    p.Written,
+		Records:    p.Records,
+		Done:       p.Done(),
+	}
+}
+
+// postSyncHandler makes a pass syncing the provider cache from the deployment
+// at the "from" URL of the JSON body when a POST request is sent to "/sync",
+// starting at its "cursor". The progress of the pass is streamed back as lines
+// of JSON after each page of ranges, the last of which is done, or has the
+// error the pass stopped with and the cursor to resume it from.
+func postSyncHandler(s *cachesync.Syncer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body syncRequestJSON
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, fmt.Sprintf("invalid sync request: %s", err.Error()), 400)
+			return
+		}
+		from, err := url.Parse(body.From)
+		if err != nil || (from.Scheme != "http" && from.Scheme != "https") || from.Host == "" {
+			writeError(w, "invalid or missing from: must be an http or https URL", 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		onProgress := func(p cachesync.Progress) {
+			if err := enc.Encode(newSyncProgressJSON(p)); err != nil {
+				log.Errorw("encoding sync progress", "error", err)
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+		progress, err := s.Sync(r.Context(), cachesync.NewHTTPRemote(body.From, body.Token, nil), body.Cursor, onProgress)
+		if err == nil {
+			return
+		}
+		// a pass stopped on its first page resumes from the empty cursor too
+		last := newSyncProgressJSON(progress)
+		last.Done = false
+		last.Error = err.Error()
+		if err := enc.Encode(last); err != nil {
+			log.Errorw("encoding sync error", "error", err)
+		}
+	}
+}
+
+// postReplicateHandler applies a CBOR encoded batch of cache writes from another
+// region when a POST request is sent to "/replicate".
+func postReplicateHandler(r *replication.Replicator) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		data, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxReplicationBatchSize))
+		if err != nil {
+			writeError(w, fmt.Sprintf("reading batch: %s", err.Error()), 400)
+			return
+		}
+		batch, err := replication.UnmarshalBatch(data)
+		if err != nil {
+			writeError(w, fmt.Sprintf("invalid batch: %s", err.Error()), 400)
+			return
+		}
+		if err := r.ApplyReplicated(req.Context(), batch); err != nil {
+			if errors.Is(err, replication.ErrOwnOrigin) {
+				writeError(w, err.Error(), 400)
+				return
+			}
+			writeError(w, fmt.Sprintf("applying batch: %s", err.Error()), 500)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeConfig(w http.ResponseWriter, cfg service.DynamicConfig) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(cfg); err != nil {
+		log.Errorw("encoding config", "error", err)
+	}
+}
+
+type selfCheckStageJSON struct {
+	Stage    service.SelfCheckStage  `json:"stage"`
+	Status   service.SelfCheckStatus `json:"status"`
+	Duration string                  `json:"duration"`
+	Reason   string                  `json:"reason,omitempty"`
+	Error    string                  `json:"error,omitempty"`
+}
+
+type selfCheckJSON struct {
+	Passed   bool                 `json:"passed"`
+	Hash     string               `json:"hash,omitempty"`
+	Provider string               `json:"provider,omitempty"`
+	Claim    string               `json:"claim,omitempty"`
+	Started  time.Time            `json:"started"`
+	Stages   []selfCheckStageJSON `json:"stages"`
+}
+
+func newSelfCheckJSON(report service.SelfCheckReport) selfCheckJSON {
+	body := selfCheckJSON{Passed: report.Passed(), Started: report.Started, Stages: make([]selfCheckStageJSON, 0, len(report.Stages))}
+	if report.Hash != nil {
+		body.Hash = report.Hash.B58String()
+	}
+	if report.Provider != "" {
+		body.Provider = report.Provider.String()
+	}
+	if report.Claim.Defined() {
+		body.Claim = report.Claim.String()
+	}
+	for _, s := range report.Stages {
+		stage := selfCheckStageJSON{Stage: s.Stage, Status: s.Status, Duration: s.Duration.String(), Reason: s.Reason}
+		if s.Err != nil {
+			stage.Error = s.Err.Error()
+		}
+		body.Stages = append(body.Stages, stage)
+	}
+	return body
+}
+
+// postSelfCheckHandler runs a self check when a POST request is sent to
+// "/selfcheck", publishing a synthetic claim advertised at the "providerURL"
+// parameter, which must have "{claim}" in its path. The "cacheWait" and
+// "ipniWait" parameters are durations the stages waiting for the claim are
+// given, the IPNI stage being skipped without an ipniWait. The report is
+// returned whether or not the check passed, with status 503 if it failed.
+func postSelfCheckHandler(s SelfCheckingService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		providerURL, err := url.Parse(params.Get("providerURL"))
+		if err != nil || params.Get("providerURL") == "" {
+			writeError(w, "invalid or missing providerURL", 400)
+			return
+		}
+		opts := service.SelfCheckOptions{ProviderURL: *providerURL}
+		for name, d := range map[string]*time.Duration{"cacheWait": &opts.CacheWait, "ipniWait": &opts.IPNIWait} {
+			if *d, err = parseDurationParam(params, name); err != nil {
+				writeParamError(w, err)
+				return
+			}
+		}
+		report, err := s.SelfCheck(r.Context(), opts)
+		if err != nil && report.Stages == nil {
+			writeError(w, fmt.Sprintf("starting self check: %s", err.Error()), 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(newSelfCheckJSON(report)); err != nil {
+			log.Errorw("encoding self check report", "error", err)
+		}
+	}
+}
+
+type refreshStoreJSON struct {
+	Store   string `json:"store"`
+	Deleted int    `json:"deleted"`
+	Skipped string `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type refreshResolutionJSON struct {
+	Claims   []string `json:"claims"`
+	Indexes  []string `json:"indexes"`
+	Duration string   `json:"duration"`
+	Error    string   `json:"error,omitempty"`
+}
+
+type refreshJSON struct {
+	Hash       string                 `json:"hash"`
+	Negative   bool                   `json:"negative"`
+	Tombstoned []string               `json:"tombstoned"`
+	Stores     []refreshStoreJSON     `json:"stores"`
+	Resolution *refreshResolutionJSON `json:"resolution,omitempty"`
+}
+
+func newRefreshJSON(input string, report service.RefreshReport) refreshJSON {
+	body := refreshJSON{Hash: input, Negative: report.Negative, Tombstoned: make([]string, 0, len(report.Tombstoned)), Stores: make([]refreshStoreJSON, 0, len(report.Stores))}
+	for _, provider := range report.Tombstoned {
+		body.Tombstoned = append(body.Tombstoned, provider.String())
+	}
+	for _, s := range report.Stores {
+		store := refreshStoreJSON{Store: s.Store, Deleted: s.Deleted, Skipped: s.Skipped}
+		if s.Err != nil {
+			store.Error = s.Err.Error()
+		}
+		body.Stores = append(body.Stores, store)
+	}
+	if res := report.Resolution; res != nil {
+		resolution := refreshResolutionJSON{Claims: make([]string, 0, len(res.Claims)), Indexes: make([]string, 0, len(res.Indexes)), Duration: res.Duration.String()}
+		for _, claim := range res.Claims {
+			resolution.Claims = append(resolution.Claims, claim.String())
+		}
+		for _, index := range res.Indexes {
+			resolution.Indexes = append(resolution.Indexes, index.String())
+		}
+		if res.Err != nil {
+			resolution.Error = res.Err.Error()
+		}
+		body.Resolution = &resolution
+	}
+	return body
+}
+
+// postRefreshHandler drops everything cached for the hash and, unless the
+// "resolve" query parameter is false, resolves it afresh, when a POST request is
+// sent to "/admin/refresh/{multihash}". The report is sent with a 503 status if
+// any store couldn't be refreshed, or the hash couldn't be resolved.
+func postRefreshHandler(s RefreshingService) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := parseHashParam("multihash", r.PathValue("multihash"), r.URL.Query())
+		if err != nil {
+			writeParamError(w, err)
+			return
+		}
+		resolve, err := parseBoolParam(r.URL.Query(), "resolve", true)
+		if err != nil {
+			writeParamError(w, err)
+			return
+		}
+		opts := service.RefreshOptions{Resolve: resolve}
+		report, err := s.Refresh(r.Context(), p.hash, opts)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(newRefreshJSON(p.input, report)); err != nil {
+			log.Errorw("encoding refresh report", "error", err)
+		}
+	}
+}
+
+// maxInspectChunks bounds the entries chunks an advertisement inspection may
+// ask to count
+const maxInspectChunks = 100_000
+
+type protocolJSON struct {
+	Code   string `json:"code"`
+	Name   string `json:"name,omitempty"`
+	Kind   string `json:"kind,omitempty"`
+	Fields any    `json:"fields,omitempty"`
+	// Hex is the encoding of a protocol that wasn't decoded, through to the end
+	// of the metadata
+	Hex   string `json:"hex,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type extendedProviderJSON struct {
+	ID        string         `json:"id"`
+	Addresses []string       `json:"addresses"`
+	Metadata  string         `json:"metadata"`
+	Protocols []protocolJSON `json:"protocols"`
+}
+
+type extendedProvidersJSON struct {
+	Override  bool                   `json:"override"`
+	Providers []extendedProviderJSON `json:"providers"`
+}
+
+type entriesCountJSON struct {
+	Chunks    int    `json:"chunks"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	Truncated bool   `json:"truncated"`
+	Broken    string `json:"broken,omitempty"`
+}
+
+type signatureJSON struct {
+	Valid  bool   `json:"valid"`
+	Signer string `json:"signer,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type advertInspectionJSON struct {
+	Link             string                 `json:"link"`
+	Size             int                    `json:"size"`
+	PreviousID       string                 `json:"previousID,omitempty"`
+	Provider         string                 `json:"provider"`
+	Addresses        []string               `json:"addresses"`
+	Entries          string                 `json:"entries,omitempty"`
+	EntriesCount     *entriesCountJSON      `json:"entriesCount,omitempty"`
+	ContextID        string                 `json:"contextID"`
+	Metadata         string                 `json:"metadata"`
+	Protocols        []protocolJSON         `json:"protocols"`
+	IsRm             bool                   `json:"isRm"`
+	ExtendedProvider *extendedProvidersJSON `json:"extendedProvider,omitempty"`
+	Signature        signatureJSON          `json:"signature"`
+	Errors           map[string]string      `json:"errors,omitempty"`
+}
+
+func newProtocolsJSON(decoded []metadata.DecodedProtocol) []protocolJSON {
+	protocols := make([]protocolJSON, 0, len(decoded))
+	for _, d := range decoded {
+		pj := protocolJSON{Code: fmt.Sprintf("0x%x", uint64(d.Code)), Name: metadata.ProtocolName(d.Code)}
+		if kind := metadata.ClaimKind(d.Code); kind != metadata.UnknownKind {
+			pj.Kind = kind.String()
+		}
+		if d.Protocol != nil {
+			pj.Fields = d.Protocol
+		}
+		if d.Err != nil {
+			pj.Hex = hex.EncodeToString(d.Raw)
+			pj.Error = d.Err.Error()
+		}
+		protocols = append(protocols, pj)
+	}
+	return protocols
+}
+
+func newAdvertInspectionJSON(ai publisher.AdvertInspection) advertInspectionJSON {
+	body := advertInspectionJSON{
+		Link:      ai.Link.String(),
+		Size:      ai.Size,
+		Provider:  ai.Provider,
+		Addresses: ai.Addresses,
+		ContextID: base64.StdEncoding.EncodeToString(ai.ContextID),
+		Metadata:  hex.EncodeToString(ai.Metadata),
+		Protocols: newProtocolsJSON(ai.Protocols),
+		IsRm:      ai.IsRm,
+		Signature: signatureJSON{Valid: ai.SignatureValid()},
+	}
+	if body.Addresses == nil {
+		body.Addresses = []string{}
+	}
+	if ai.PreviousID != nil {
+		body.PreviousID = ai.PreviousID.String()
+	}
+	if ai.Entries != nil {
+		body.Entries = ai.Entries.String()
+	}
+	if c := ai.EntriesCount; c != nil {
+		body.EntriesCount = &entriesCountJSON{Chunks: c.Chunks, Entries: c.Entries, Bytes: c.Bytes, Truncated: c.Truncated}
+		if c.Broken != nil {
+			body.EntriesCount.Broken = c.Broken.Error()
+		}
+	}
+	if ai.ExtendedProvider {
+		body.ExtendedProvider = &extendedProvidersJSON{Override: ai.Override, Providers: make([]extendedProviderJSON, 0, len(ai.ExtendedProviders))}
+		for _, ep := range ai.ExtendedProviders {
+			body.ExtendedProvider.Providers = append(body.ExtendedProvider.Providers, extendedProviderJSON{
+				ID:        ep.ID,
+				Addresses: ep.Addresses,
+				Metadata:  hex.EncodeToString(ep.Metadata),
+				Protocols: newProtocolsJSON(ep.Protocols),
+			})
+		}
+	}
+	if ai.Signer != "" {
+		body.Signature.Signer = ai.Signer.String()
+	}
+	if ai.SignatureErr != nil {
+		body.Signature.Error = ai.SignatureErr.Error()
+	}
+	if len(ai.Errors) > 0 {
+		body.Errors = map[string]string{}
+		for field, err := range ai.Errors {
+			body.Errors[field] = err.Error()
+		}
+	}
+	return body
+}
+
+// getPublisherAdvertHandler responds with a stored advertisement decoded field
+// by field when a GET request is sent to "/publisher/advert/{cid}". Fields that
+// can't be decoded are listed with their errors rather than failing the
+// request. Up to "chunks" entries chunks are walked to count the entries, none
+// if it is zero.
+func getPublisherAdvertHandler(p *publisher.Publisher) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := cid.Decode(r.PathValue("cid"))
+		if err != nil {
+			writeError(w, fmt.Sprintf("invalid advertisement: %s", err.Error()), 400)
+			return
+		}
+		chunks, err := parseIntParam(r.URL.Query(), "chunks", publisher.DefaultInspectChunks, 0, maxInspectChunks)
+		if err != nil {
+			writeParamError(w, err)
+			return
+		}
+		ai, err := p.InspectAdvert(r.Context(), cidlink.Link{Cid: c}, chunks)
+		if err != nil {
+			status := 500
+			if errors.Is(err, publisher.ErrAdvertNotFound) {
+				status = 404
+			}
+			writeError(w, fmt.Sprintf("inspecting advertisement: %s", err.Error()), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(newAdvertInspectionJSON(ai)); err != nil {
+			log.Errorw("encoding advertisement inspection", "error", err)
+		}
 	}
 }
@@ -0,0 +1,2063 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	findclient "github.com/ipni/go-libipni/find/client"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mr-tron/base58"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/client"
+	"github.com/storacha/go-ucanto/core/car"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/core/invocation"
+	ucanipld "github.com/storacha/go-ucanto/core/ipld"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/go-ucanto/principal"
+	ed25519 "github.com/storacha/go-ucanto/principal/ed25519/signer"
+	ucanhttp "github.com/storacha/go-ucanto/transport/http"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/delegationutil"
+	"github.com/storacha/indexing-service/pkg/internal/bytemap"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/providerresults"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/storacha/indexing-service/pkg/server"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/audit"
+	"github.com/storacha/indexing-service/pkg/service/expansion"
+	"github.com/storacha/indexing-service/pkg/service/identity"
+	"github.com/storacha/indexing-service/pkg/service/prommetrics"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	cachesync "github.com/storacha/indexing-service/pkg/sync"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetClaims__Continuation(t *testing.T) {
+	claims := map[cid.Cid]delegation.Delegation{}
+	for range 3 {
+		claim := testutil.RandomIndexDelegation()
+		claims[claim.Link().(cidlink.Link).Cid] = claim
+	}
+	// indexes of roughly 4KB, 8KB and 12KB
+	indexes := bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1)
+	for i := range 3 {
+		index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 1)
+		shard := testutil.RandomMultihash()
+		for j, slice := range testutil.RandomMultihashes(100 * (i + 1)) {
+			index.SetSlice(shard, slice, blobindex.Position{Offset: uint64(j), Length: 1})
+		}
+		indexes.Set(testutil.RandomBytes(10), index)
+	}
+	qr := testutil.Must(queryresult.Build(claims, indexes))(t)
+	expectedClaims := qr.Claims()
+	expectedIndexes := qr.Indexes()
+
+	query := func(t *testing.T, serverURL string) *http.Response {
+		return testutil.Must(http.Get(serverURL + "/claims?multihash=" + testutil.RandomCID().String()))(t)
+	}
+	continuation := func(t *testing.T, serverURL string, token string) *http.Response {
+		return testutil.Must(http.Get(serverURL + "/claims?continuation=" + url.QueryEscape(token)))(t)
+	}
+
+	t.Run("splits a large result across continuations", func(t *testing.T) {
+		srv := httptest.NewServer(server.NewServer(server.WithService(&mockService{qr: qr}), server.WithMaxResponseSize(10_000)))
+		defer srv.Close()
+
+		var gotClaims, gotIndexes []ipld.Link
+		resp := query(t, srv.URL)
+		pages := 0
+		for {
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			pages++
+			page := testutil.Must(queryresult.Extract(resp.Body))(t)
+			resp.Body.Close()
+			gotClaims = append(gotClaims, page.Claims()...)
+			gotIndexes = append(gotIndexes, page.Indexes()...)
+			token := resp.Header.Get(server.ContinuationHeader)
+			if token == "" {
+				break
+			}
+			resp = continuation(t, srv.URL, token)
+		}
+		require.Equal(t, 3, pages)
+		require.ElementsMatch(t, expectedClaims, gotClaims)
+		require.ElementsMatch(t, expectedIndexes, gotIndexes)
+	})
+
+	t.Run("queries differing in options that change results continue separately", func(t *testing.T) {
+		ms := &mockService{qr: qr}
+		srv := httptest.NewServer(server.NewServer(server.WithService(ms), server.WithMaxResponseSize(10_000)))
+		defer srv.Close()
+
+		hash := testutil.RandomCID().String()
+		resp := testutil.Must(http.Get(srv.URL + "/claims?multihash=" + hash))(t)
+		resp.Body.Close()
+		token := resp.Header.Get(server.ContinuationHeader)
+		require.NotEmpty(t, token)
+
+		// the same hashes with a result limit give another result, split too
+		otherIndexes := bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1)
+		for range 2 {
+			index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 1)
+			shard := testutil.RandomMultihash()
+			for j, slice := range testutil.RandomMultihashes(300) {
+				index.SetSlice(shard, slice, blobindex.Position{Offset: uint64(j), Length: 1})
+			}
+			otherIndexes.Set(testutil.RandomBytes(10), index)
+		}
+		ms.qr = testutil.Must(queryresult.Build(map[cid.Cid]delegation.Delegation{}, otherIndexes))(t)
+		for _, option := range []string{"firstLocationWins=true", "maxResultsPerHash=1", "strictSpaces=true"} {
+			resp = testutil.Must(http.Get(srv.URL + "/claims?multihash=" + hash + "&" + option))(t)
+			resp.Body.Close()
+			require.NotEmpty(t, resp.Header.Get(server.ContinuationHeader))
+		}
+
+		resp = continuation(t, srv.URL, token)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		page := testutil.Must(queryresult.Extract(resp.Body))(t)
+		require.Subset(t, expectedIndexes, page.Indexes())
+		require.NotEmpty(t, page.Indexes())
+	})
+
+	t.Run("results within the limit are not split", func(t *testing.T) {
+		srv := httptest.NewServer(server.NewServer(server.WithService(&mockService{qr: qr}), server.WithMaxResponseSize(1_000_000)))
+		defer srv.Close()
+
+		resp := query(t, srv.URL)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Empty(t, resp.Header.Get(server.ContinuationHeader))
+		page := testutil.Must(queryresult.Extract(resp.Body))(t)
+		require.ElementsMatch(t, expectedClaims, page.Claims())
+		require.ElementsMatch(t, expectedIndexes, page.Indexes())
+	})
+
+	t.Run("expired continuation is gone", func(t *testing.T) {
+		srv := httptest.NewServer(server.NewServer(
+			server.WithService(&mockService{qr: qr}),
+			server.WithMaxResponseSize(10_000),
+			server.WithContinuationTTL(time.Millisecond),
+		))
+		defer srv.Close()
+
+		resp := query(t, srv.URL)
+		resp.Body.Close()
+		token := resp.Header.Get(server.ContinuationHeader)
+		require.NotEmpty(t, token)
+		time.Sleep(5 * time.Millisecond)
+		resp = continuation(t, srv.URL, token)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusGone, resp.StatusCode)
+		body := testutil.Must(io.ReadAll(resp.Body))(t)
+		require.Contains(t, string(body), "re-run the query")
+	})
+
+	t.Run("evicted continuation is gone", func(t *testing.T) {
+		resultSize := 0
+		for _, index := range indexes.Iterator() {
+			resultSize += len(testutil.Must(io.ReadAll(testutil.Must(index.Archive())(t)))(t))
+		}
+		// the cache holds one result, but not two
+		srv := httptest.NewServer(server.NewServer(
+			server.WithService(&mockService{qr: qr}),
+			server.WithMaxResponseSize(10_000),
+			server.WithContinuationCacheSize(resultSize*3/2),
+		))
+		defer srv.Close()
+
+		first := query(t, srv.URL)
+		first.Body.Close()
+		second := query(t, srv.URL)
+		second.Body.Close()
+		resp := continuation(t, srv.URL, first.Header.Get(server.ContinuationHeader))
+		resp.Body.Close()
+		require.Equal(t, http.StatusGone, resp.StatusCode)
+		resp = continuation(t, srv.URL, second.Header.Get(server.ContinuationHeader))
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("results too large to keep are sent whole", func(t *testing.T) {
+		srv := httptest.NewServer(server.NewServer(
+			server.WithService(&mockService{qr: qr}),
+			server.WithMaxResponseSize(10_000),
+			server.WithContinuationCacheSize(1_000),
+		))
+		defer srv.Close()
+
+		resp := query(t, srv.URL)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Empty(t, resp.Header.Get(server.ContinuationHeader))
+		page := testutil.Must(queryresult.Extract(resp.Body))(t)
+		require.ElementsMatch(t, expectedClaims, page.Claims())
+		require.ElementsMatch(t, expectedIndexes, page.Indexes())
+	})
+
+	t.Run("malformed continuation", func(t *testing.T) {
+		srv := httptest.NewServer(server.NewServer(server.WithService(&mockService{qr: qr}), server.WithMaxResponseSize(10_000)))
+		defer srv.Close()
+
+		resp := continuation(t, srv.URL, "not a token")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestGetClaims__CanonicalClaims(t *testing.T) {
+	claim, other := testutil.RandomLocationDelegation(), testutil.RandomIndexDelegation()
+	getClaims := func(t *testing.T, archive []byte) []byte {
+		// claims are canonicalized as they are fetched, before they are served
+		claims := map[cid.Cid]delegation.Delegation{}
+		for _, d := range []delegation.Delegation{testutil.Must(delegation.Extract(archive))(t), other} {
+			claims[d.Link().(cidlink.Link).Cid] = testutil.Must(delegationutil.Canonical(d))(t)
+		}
+		qr := testutil.Must(queryresult.Build(claims, bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1)))(t)
+		srv := httptest.NewServer(server.NewServer(server.WithService(&mockService{qr: qr})))
+		defer srv.Close()
+		resp := testutil.Must(http.Get(srv.URL + "/claims?multihash=" + testutil.RandomCID().String()))(t)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return testutil.Must(io.ReadAll(resp.Body))(t)
+	}
+
+	// the same claim archived by two clients is served as the same bytes
+	expected := getClaims(t, testutil.Must(io.ReadAll(claim.Archive()))(t))
+	for range 5 {
+		require.Equal(t, expected, getClaims(t, testutil.ReorderedArchive(t, claim)))
+	}
+}
+
+func TestGetClaims__JSON(t *testing.T) {
+	claim := testutil.RandomLocationDelegation()
+	claimCid := claim.Link().(cidlink.Link).Cid
+	qr := testutil.Must(queryresult.Build(map[cid.Cid]delegation.Delegation{claimCid: claim}, bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1)))(t)
+	srv := httptest.NewServer(server.NewServer(server.WithService(&mockStreamingService{mockService: mockService{qr: qr}})))
+	defer srv.Close()
+
+	req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+"/claims?multihash="+testutil.RandomCID().String(), nil))(t)
+	req.Header.Set("Accept", "application/json")
+	resp := testutil.Must(http.DefaultClient.Do(req))(t)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var body struct {
+		Claims []struct {
+			Claim   string `json:"claim"`
+			Summary struct {
+				Type     string   `json:"type"`
+				Location []string `json:"location"`
+			} `json:"summary"`
+		} `json:"claims"`
+		Indexes []string `json:"indexes"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Len(t, body.Claims, 1)
+	require.Equal(t, claimCid.String(), body.Claims[0].Claim)
+	require.Equal(t, assert.LocationAbility, body.Claims[0].Summary.Type)
+	require.Equal(t, []string{testutil.TestURL.String()}, body.Claims[0].Summary.Location)
+	require.Empty(t, body.Indexes)
+}
+
+func TestGetClaims__IndexRefs(t *testing.T) {
+	contextID := testutil.RandomBytes(10)
+	ref := queryresult.IndexRef{Index: testutil.RandomCID().(cidlink.Link).Cid, Provider: testutil.RandomPeer(), Error: "failure response fetching index. status: 500"}
+	refs := bytemap.NewByteMap[types.EncodedContextID, queryresult.IndexRef](-1)
+	refs.Set(contextID, ref)
+	qr := testutil.Must(queryresult.Build(map[cid.Cid]delegation.Delegation{}, bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1), queryresult.WithIndexRefs(refs)))(t)
+	srv := httptest.NewServer(server.NewServer(server.WithService(&mockService{qr: qr})))
+	defer srv.Close()
+
+	req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+"/claims?multihash="+testutil.RandomCID().String(), nil))(t)
+	req.Header.Set("Accept", "application/json")
+	resp := testutil.Must(http.DefaultClient.Do(req))(t)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.JSONEq(t, `{
+		"claims": [],
+		"indexes": [],
+		"indexRefs": [{
+			"contextID": "`+base64.StdEncoding.EncodeToString(contextID)+`",
+			"index": "`+ref.Index.String()+`",
+			"provider": "`+ref.Provider.String()+`",
+			"error": "`+ref.Error+`"
+		}]
+	}`, string(testutil.Must(io.ReadAll(resp.Body))(t)))
+
+	resp = testutil.Must(http.Get(srv.URL + "/claims?multihash=" + testutil.RandomCID().String()))(t)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	extracted := testutil.Must(queryresult.Extract(resp.Body))(t)
+	require.Equal(t, ref, extracted.IndexRefs().Get(contextID))
+}
+
+func TestGetClaims__Diagnostics(t *testing.T) {
+	hash := testutil.RandomMultihash()
+	encoded := testutil.Must(multibase.Encode(multibase.Base58BTC, hash))(t)
+	diagnostics := map[string]queryresult.HashDiagnosis{
+		encoded: {Outcome: queryresult.OutcomeUnknown, Lookups: []queryresult.LookupDiagnosis{{Hash: encoded, JobType: "standard", Source: "ipni"}}},
+	}
+	qr := testutil.Must(queryresult.Build(map[cid.Cid]delegation.Delegation{}, bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1), queryresult.WithDiagnostics(diagnostics)))(t)
+	s := &mockService{qr: qr}
+	srv := httptest.NewServer(server.NewServer(server.WithService(s)))
+	defer srv.Close()
+
+	req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+"/claims?diagnose=true&multihash="+encoded, nil))(t)
+	req.Header.Set("Accept", "application/json")
+	resp := testutil.Must(http.DefaultClient.Do(req))(t)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.True(t, s.q.Diagnose)
+	require.JSONEq(t, `{
+		"claims": [],
+		"indexes": [],
+		"diagnostics": {
+			"`+encoded+`": {
+				"outcome": "unknown",
+				"lookups": [{"hash": "`+encoded+`", "jobType": "standard", "source": "ipni", "records": 0, "claimMatches": 0, "matches": 0}]
+			}
+		}
+	}`, string(testutil.Must(io.ReadAll(resp.Body))(t)))
+
+	resp = testutil.Must(http.Get(srv.URL + "/claims?diagnose=yes&multihash=" + encoded))(t)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestGetClaims__CanonicalizeAliases(t *testing.T) {
+	hash, alias := testutil.RandomMultihash(), testutil.RandomMultihash()
+	encoded := testutil.Must(multibase.Encode(multibase.Base58BTC, hash))(t)
+	encodedAlias := testutil.Must(multibase.Encode(multibase.Base58BTC, alias))(t)
+	claim := testutil.RandomCID().(cidlink.Link).Cid
+	contextID := testutil.RandomBytes(10)
+	results := map[string]queryresult.HashResult{
+		encoded: {Aliases: []string{encodedAlias}, Claims: []cid.Cid{claim}, Indexes: []types.EncodedContextID{contextID}, IndexRefs: []types.EncodedContextID{}},
+	}
+	qr := testutil.Must(queryresult.Build(map[cid.Cid]delegation.Delegation{}, bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1), queryresult.WithHashResults(results)))(t)
+	s := &mockService{qr: qr}
+	srv := httptest.NewServer(server.NewServer(server.WithService(s)))
+	defer srv.Close()
+
+	// keyed by the hash as queried
+	queried := cid.NewCidV1(cid.Raw, hash).String()
+	req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+"/claims?canonicalizeAliases=true&multihash="+queried, nil))(t)
+	req.Header.Set("Accept", "application/json")
+	resp := testutil.Must(http.DefaultClient.Do(req))(t)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.True(t, s.q.CanonicalizeAliases)
+	require.JSONEq(t, `{
+		"claims": [],
+		"indexes": [],
+		"hashes": {
+			"`+queried+`": {
+				"aliases": ["`+encodedAlias+`"],
+				"claims": ["`+claim.String()+`"],
+				"indexes": ["`+base64.StdEncoding.EncodeToString(contextID)+`"],
+				"indexRefs": []
+			}
+		}
+	}`, string(testutil.Must(io.ReadAll(resp.Body))(t)))
+
+	resp = testutil.Must(http.Get(srv.URL + "/claims?canonicalizeAliases=yes&multihash=" + encoded))(t)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestGetClaims__Receipt(t *testing.T) {
+	id := testutil.Must(ed25519.Generate())(t)
+	claim := testutil.RandomLocationDelegation()
+	qr := testutil.Must(queryresult.Build(map[cid.Cid]delegation.Delegation{claim.Link().(cidlink.Link).Cid: claim}, bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1)))(t)
+	receipt := testutil.Must(queryresult.SignReceipt(id, qr.Root().Link(), testutil.RandomBytes(32), time.Now()))(t)
+	s := &mockStreamingService{mockService: mockService{qr: queryresult.WithReceipt(qr, receipt)}}
+	srv := httptest.NewServer(server.NewServer(server.WithService(s)))
+	defer srv.Close()
+	decodeReceipt := func(t *testing.T, encoded string) queryresult.Receipt {
+		var decoded queryresult.Receipt
+		require.NoError(t, decoded.UnmarshalBinary(testutil.Must(base64.RawURLEncoding.DecodeString(encoded))(t)))
+		return decoded
+	}
+
+	t.Run("CAR responses carry the receipt in a header", func(t *testing.T) {
+		resp := testutil.Must(http.Get(srv.URL + "/claims?attest=true&multihash=" + testutil.RandomCID().String()))(t)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.True(t, s.q.Attest)
+		extracted := testutil.Must(queryresult.Extract(resp.Body))(t)
+		require.NoError(t, queryresult.VerifyReceipt(decodeReceipt(t, resp.Header.Get(server.ReceiptHeader)), extracted.Root().Link(), id.DID()))
+	})
+
+	t.Run("JSON responses carry it in the body too", func(t *testing.T) {
+		req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+"/claims?attest=true&multihash="+testutil.RandomCID().String(), nil))(t)
+		req.Header.Set("Accept", "application/json")
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		defer resp.Body.Close()
+		var body struct {
+			Receipt string `json:"receipt"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		require.Equal(t, receipt, decodeReceipt(t, body.Receipt))
+		require.Equal(t, body.Receipt, resp.Header.Get(server.ReceiptHeader))
+	})
+
+	t.Run("results without a receipt have none", func(t *testing.T) {
+		s := &mockService{qr: qr}
+		srv := httptest.NewServer(server.NewServer(server.WithService(s)))
+		defer srv.Close()
+		resp := testutil.Must(http.Get(srv.URL + "/claims?multihash=" + testutil.RandomCID().String()))(t)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.False(t, s.q.Attest)
+		require.Empty(t, resp.Header.Get(server.ReceiptHeader))
+	})
+
+	t.Run("invalid attest values are rejected", func(t *testing.T) {
+		resp := testutil.Must(http.Get(srv.URL + "/claims?attest=maybe&multihash=" + testutil.RandomCID().String()))(t)
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+type mockService struct {
+	qr queryresult.QueryResult
+	// q is the last query made
+	q service.Query
+}
+
+func (m *mockService) CacheClaim(ctx context.Context, claim delegation.Delegation) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (m *mockService) PublishClaim(ctx context.Context, claim delegation.Delegation) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (m *mockService) Query(ctx context.Context, q service.Query) (queryresult.QueryResult, error) {
+	m.q = q
+	return m.qr, nil
+}
+
+type mockStreamingService struct {
+	mockService
+	src queryresult.Sources
+}
+
+func (m *mockStreamingService) QuerySources(ctx context.Context, q service.Query) (queryresult.Sources, error) {
+	return m.src, nil
+}
+
+func TestGetClaims__Streaming(t *testing.T) {
+	claim := testutil.RandomLocationDelegation()
+	_, index := testutil.RandomShardedDagIndexView(32)
+	source := testutil.Must(queryresult.IndexSourceFromView(testutil.RandomBytes(10), index))(t)
+	query := func(t *testing.T, src queryresult.Sources) (*http.Response, []byte, error) {
+		srv := httptest.NewServer(server.NewServer(server.WithService(&mockStreamingService{src: src})))
+		t.Cleanup(srv.Close)
+		resp := testutil.Must(http.Get(srv.URL + "/claims?multihash=" + testutil.RandomCID().String()))(t)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp, body, err
+	}
+
+	t.Run("streams the result with its digest as the ETag trailer", func(t *testing.T) {
+		stats := queryresult.Stats{Jobs: 2, WallTime: time.Millisecond}
+		resp, body, err := query(t, queryresult.Sources{Claims: []delegation.Delegation{claim}, Indexes: queryresult.IndexSources(source), Stats: stats})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, stats.String(), resp.Header.Get(server.StatsHeader))
+		sum := sha256.Sum256(body)
+		require.Equal(t, `"`+hex.EncodeToString(sum[:])+`"`, resp.Trailer.Get("ETag"))
+		qr := testutil.Must(queryresult.Extract(bytes.NewReader(body)))(t)
+		require.Equal(t, []ipld.Link{claim.Link()}, qr.Claims())
+		require.Equal(t, []ipld.Link{source.Link}, qr.Indexes())
+	})
+
+	t.Run("a failure part way through aborts the response", func(t *testing.T) {
+		failing := source
+		failing.Open = func() (io.ReadCloser, error) {
+			r, err := source.Open()
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(io.MultiReader(io.LimitReader(r, int64(source.Size)/2), iotest.ErrReader(errors.New("connection reset")))), nil
+		}
+		resp, _, err := query(t, queryresult.Sources{Claims: []delegation.Delegation{claim}, Indexes: queryresult.IndexSources(failing)})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		require.Empty(t, resp.Trailer.Get("ETag"))
+	})
+}
+
+func TestGetClaims__Stats(t *testing.T) {
+	stats := queryresult.Stats{
+		Jobs:        3,
+		CacheHits:   map[string]int{types.ClaimsCache: 1},
+		CacheMisses: map[string]int{types.ProvidersCache: 2},
+		Fetches:     map[string]int{types.FetchIPNI: 2},
+		WallTime:    12 * time.Millisecond,
+		Truncated:   []string{"maxFindRecords"},
+	}
+	qr := testutil.Must(queryresult.Build(map[cid.Cid]delegation.Delegation{}, bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1), queryresult.WithStats(stats)))(t)
+	srv := httptest.NewServer(server.NewServer(server.WithService(&mockService{qr: qr})))
+	defer srv.Close()
+
+	req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+"/claims?multihash="+testutil.RandomCID().String(), nil))(t)
+	req.Header.Set("Accept", "application/json")
+	resp := testutil.Must(http.DefaultClient.Do(req))(t)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.JSONEq(t, `{
+		"claims": [],
+		"indexes": [],
+		"stats": {
+			"jobs": 3,
+			"cacheHits": {"claims": 1},
+			"cacheMisses": {"providers": 2},
+			"fetches": {"ipni": 2},
+			"indexesExpanded": 0,
+			"wallTime": "12ms",
+			"truncated": ["maxFindRecords"]
+		}
+	}`, string(testutil.Must(io.ReadAll(resp.Body))(t)))
+
+	// CAR responses sum the stats up in a header
+	resp = testutil.Must(http.Get(srv.URL + "/claims?multihash=" + testutil.RandomCID().String()))(t)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "jobs=3; hits=1; misses=2; fetches=2; expanded=0; wall=12ms; truncated=maxFindRecords", resp.Header.Get(server.StatsHeader))
+}
+
+type mockAliasService struct {
+	mockService
+	aliases []multihash.Multihash
+	claims  []cid.Cid
+	match   service.Match
+}
+
+func (m *mockAliasService) Aliases(ctx context.Context, mh multihash.Multihash, match service.Match) ([]multihash.Multihash, []cid.Cid, error) {
+	m.match = match
+	return m.aliases, m.claims, nil
+}
+
+type mockSpaceClaimsService struct {
+	mockService
+	claims []types.SpaceClaim
+}
+
+func (m *mockSpaceClaimsService) ListClaims(ctx context.Context, space did.DID, cursor string, limit int) ([]types.SpaceClaim, string, error) {
+	start := 0
+	if cursor != "" {
+		var err error
+		if start, err = strconv.Atoi(cursor); err != nil {
+			return nil, "", types.ErrInvalidCursor
+		}
+	}
+	end := min(start+limit, len(m.claims))
+	var next string
+	if end < len(m.claims) {
+		next = strconv.Itoa(end)
+	}
+	return m.claims[start:end], next, nil
+}
+
+func (m *mockSpaceClaimsService) BackfillSpaceIndex(ctx context.Context) (int, error) {
+	return len(m.claims), nil
+}
+
+func TestGetSpaceClaims(t *testing.T) {
+	s := &mockSpaceClaimsService{}
+	for i := range 3 {
+		claim := types.SpaceClaim{
+			Claim: testutil.RandomCID().(cidlink.Link).Cid,
+			Type:  "assert/index",
+			Hash:  testutil.RandomMultihash(),
+		}
+		if i == 0 {
+			claim.Expiration = time.Now().Add(time.Hour).Truncate(time.Second)
+		}
+		s.claims = append(s.claims, claim)
+	}
+	srv := httptest.NewServer(server.NewServer(server.WithService(s)))
+	t.Cleanup(srv.Close)
+	space := testutil.Alice.DID().String()
+
+	type page struct {
+		Claims []struct {
+			Claim      string     `json:"claim"`
+			Type       string     `json:"type"`
+			Hash       string     `json:"hash"`
+			Expiration *time.Time `json:"expiration"`
+		} `json:"claims"`
+		Cursor string `json:"cursor"`
+	}
+	var listed []string
+	cursor := ""
+	for pages := 1; ; pages++ {
+		resp := testutil.Must(http.Get(srv.URL + "/spaces/" + space + "/claims?limit=2&cursor=" + cursor))(t)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var body page
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		require.LessOrEqual(t, len(body.Claims), 2)
+		for _, c := range body.Claims {
+			listed = append(listed, c.Claim)
+		}
+		if pages == 1 {
+			require.True(t, s.claims[0].Expiration.Equal(*body.Claims[0].Expiration))
+			require.Nil(t, body.Claims[1].Expiration)
+			_, hash := testutil.Must2(multibase.Decode(body.Claims[0].Hash))(t)
+			require.Equal(t, []byte(s.claims[0].Hash), hash)
+		}
+		if body.Cursor == "" {
+			require.Equal(t, 2, pages)
+			break
+		}
+		cursor = body.Cursor
+	}
+	require.Equal(t, []string{s.claims[0].Claim.String(), s.claims[1].Claim.String(), s.claims[2].Claim.String()}, listed)
+
+	for _, path := range []string{
+		"/spaces/not-a-did/claims",
+		"/spaces/" + space + "/claims?cursor=not-a-cursor",
+		"/spaces/" + space + "/claims?limit=0",
+	} {
+		resp := testutil.Must(http.Get(srv.URL + path))(t)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, path)
+	}
+}
+
+func TestGetAliases(t *testing.T) {
+	s := &mockAliasService{
+		aliases: testutil.RandomMultihashes(2),
+		claims:  []cid.Cid{testutil.RandomCID().(cidlink.Link).Cid},
+	}
+	srv := httptest.NewServer(server.NewServer(server.WithService(s)))
+	t.Cleanup(srv.Close)
+	hash := testutil.Must(multibase.Encode(multibase.Base58BTC, testutil.RandomMultihash()))(t)
+	space := testutil.Alice.DID()
+
+	resp := testutil.Must(http.Get(srv.URL + "/aliases/" + hash + "?spaces=" + space.String()))(t)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var body struct {
+		Hash    string   `json:"hash"`
+		Aliases []string `json:"aliases"`
+		Claims  []string `json:"claims"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Equal(t, hash, body.Hash)
+	require.Len(t, body.Aliases, 2)
+	for i, alias := range body.Aliases {
+		_, decoded := testutil.Must2(multibase.Decode(alias))(t)
+		require.Equal(t, []byte(s.aliases[i]), decoded)
+	}
+	require.Equal(t, []string{s.claims[0].String()}, body.Claims)
+	require.Equal(t, []did.DID{space}, s.match.Subject)
+
+	resp = testutil.Must(http.Get(srv.URL + "/aliases/not-a-hash"))(t)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+type mockFindService struct {
+	mockService
+	records       map[string][]model.ProviderResult
+	includeLegacy []bool
+}
+
+func (m *mockFindService) FindProviders(ctx context.Context, hash multihash.Multihash, includeLegacy bool) ([]model.ProviderResult, error) {
+	m.includeLegacy = append(m.includeLegacy, includeLegacy)
+	return m.records[string(hash)], nil
+}
+
+func TestFind(t *testing.T) {
+	hashes := testutil.RandomMultihashes(2)
+	missing := testutil.RandomMultihash()
+	s := &mockFindService{records: map[string][]model.ProviderResult{
+		string(hashes[0]): {testutil.RandomProviderResult(), testutil.RandomProviderResult()},
+		string(hashes[1]): {testutil.RandomProviderResult()},
+	}}
+	srv := httptest.NewServer(server.NewServer(server.WithService(s)))
+	t.Cleanup(srv.Close)
+	requireEqualResults := func(t *testing.T, expected, actual []model.ProviderResult) {
+		require.Len(t, actual, len(expected))
+		for i := range expected {
+			require.True(t, providerresults.Equals(expected[i], actual[i]), "record %d round trips", i)
+		}
+	}
+
+	t.Run("records round trip through the IPNI find client", func(t *testing.T) {
+		c := testutil.Must(findclient.New(srv.URL))(t)
+		for _, hash := range hashes {
+			resp := testutil.Must(c.Find(context.Background(), hash))(t)
+			require.Len(t, resp.MultihashResults, 1)
+			require.Equal(t, hash, resp.MultihashResults[0].Multihash)
+			requireEqualResults(t, s.records[string(hash)], resp.MultihashResults[0].ProviderResults)
+		}
+
+		resp := testutil.Must(c.Find(context.Background(), missing))(t)
+		require.Empty(t, resp.MultihashResults)
+	})
+
+	t.Run("a miss has no content", func(t *testing.T) {
+		resp := testutil.Must(http.Get(srv.URL + "/multihash/" + missing.B58String()))(t)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+		require.Empty(t, testutil.Must(io.ReadAll(resp.Body))(t))
+	})
+
+	t.Run("hashes are found by CID, hex and multibase", func(t *testing.T) {
+		for _, path := range []string{
+			"/cid/" + cid.NewCidV1(cid.Raw, hashes[0]).String(),
+			"/multihash/" + hex.EncodeToString(hashes[0]),
+			"/multihash/" + testutil.Must(multibase.Encode(multibase.Base32, hashes[0]))(t),
+		} {
+			resp := testutil.Must(http.Get(srv.URL + path))(t)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode, path)
+			found := testutil.Must(model.UnmarshalFindResponse(testutil.Must(io.ReadAll(resp.Body))(t)))(t)
+			require.Len(t, found.MultihashResults, 1, path)
+			requireEqualResults(t, s.records[string(hashes[0])], found.MultihashResults[0].ProviderResults)
+		}
+		resp := testutil.Must(http.Get(srv.URL + "/cid/not-a-cid"))(t)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("multibase strings that are also base58 multihashes are found", func(t *testing.T) {
+		// a multibase string is also valid base58, which now and then decodes to a
+		// multihash of an unknown hash function
+		var hash multihash.Multihash
+		var encoded string
+		for range 100_000 {
+			hash = testutil.RandomMultihash()
+			encoded = testutil.Must(multibase.Encode(multibase.Base32, hash))(t)
+			if data, err := base58.Decode(encoded); err == nil {
+				if decoded, err := multihash.Decode(data); err == nil {
+					if _, known := multihash.Codes[decoded.Code]; !known {
+						break
+					}
+				}
+			}
+			hash = nil
+		}
+		require.NotNil(t, hash)
+		s.records[string(hash)] = []model.ProviderResult{testutil.RandomProviderResult()}
+		t.Cleanup(func() { delete(s.records, string(hash)) })
+
+		resp := testutil.Must(http.Get(srv.URL + "/multihash/" + encoded))(t)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		found := testutil.Must(model.UnmarshalFindResponse(testutil.Must(io.ReadAll(resp.Body))(t)))(t)
+		require.Len(t, found.MultihashResults, 1)
+		require.Equal(t, hash, found.MultihashResults[0].Multihash)
+	})
+
+	t.Run("records are streamed a line each", func(t *testing.T) {
+		s.includeLegacy = nil
+		req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+"/multihash/"+hashes[0].B58String()+"?includeLegacy=true", nil))(t)
+		req.Header.Set("Accept", "application/x-ndjson")
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+		var streamed []model.ProviderResult
+		decoder := json.NewDecoder(resp.Body)
+		for decoder.More() {
+			var result model.ProviderResult
+			require.NoError(t, decoder.Decode(&result))
+			streamed = append(streamed, result)
+		}
+		requireEqualResults(t, s.records[string(hashes[0])], streamed)
+		require.Equal(t, []bool{true}, s.includeLegacy)
+	})
+
+	t.Run("batches are found", func(t *testing.T) {
+		body := testutil.Must(json.Marshal(map[string]any{"Multihashes": append(slices.Clone(hashes), missing)}))(t)
+		resp := testutil.Must(http.Post(srv.URL+"/multihash", "application/json", bytes.NewReader(body)))(t)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		found := testutil.Must(model.UnmarshalFindResponse(testutil.Must(io.ReadAll(resp.Body))(t)))(t)
+		require.Len(t, found.MultihashResults, len(hashes))
+		for i, result := range found.MultihashResults {
+			require.Equal(t, hashes[i], result.Multihash)
+			requireEqualResults(t, s.records[string(hashes[i])], result.ProviderResults)
+		}
+
+		req := testutil.Must(http.NewRequest(http.MethodPost, srv.URL+"/multihash", bytes.NewReader(body)))(t)
+		req.Header.Set("Accept", "application/x-ndjson")
+		resp = testutil.Must(http.DefaultClient.Do(req))(t)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		decoder := json.NewDecoder(resp.Body)
+		var streamed []model.MultihashResult
+		for decoder.More() {
+			var result model.MultihashResult
+			require.NoError(t, decoder.Decode(&result))
+			streamed = append(streamed, result)
+		}
+		require.Len(t, streamed, len(hashes))
+		for i, result := range streamed {
+			require.Equal(t, hashes[i], result.Multihash)
+			requireEqualResults(t, s.records[string(hashes[i])], result.ProviderResults)
+		}
+
+		body = testutil.Must(json.Marshal(map[string]any{"Multihashes": []multihash.Multihash{missing}}))(t)
+		resp = testutil.Must(http.Post(srv.URL+"/multihash", "application/json", bytes.NewReader(body)))(t)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+type mockContainingService struct {
+	mockService
+	refs []types.IndexRef
+}
+
+func (m *mockContainingService) ContainingIndexes(ctx context.Context, hash multihash.Multihash) ([]types.IndexRef, error) {
+	return m.refs, nil
+}
+
+type mockRemovalService struct {
+	mockService
+	progress []types.ProviderTombstone
+	err      error
+	removed  []peer.ID
+}
+
+func (m *mockRemovalService) RemoveProvider(ctx context.Context, provider peer.ID, onProgress func(types.ProviderTombstone)) error {
+	m.removed = append(m.removed, provider)
+	for _, t := range m.progress {
+		onProgress(t)
+	}
+	return m.err
+}
+
+// slowConfigService takes a while to apply config, so that config requests
+// overlap
+type slowConfigService struct {
+	mockService
+	lk     sync.Mutex
+	config service.DynamicConfig
+}
+
+func (m *slowConfigService) Config() service.DynamicConfig {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.config
+}
+
+func (m *slowConfigService) Reconfigure(cfg service.DynamicConfig) error {
+	time.Sleep(10 * time.Millisecond)
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.config = cfg
+	return nil
+}
+
+func TestPutConfig(t *testing.T) {
+	s := &slowConfigService{config: service.DefaultDynamicConfig()}
+	srv := httptest.NewServer(server.NewServer(server.WithService(s), server.WithAdminToken("secret")))
+	t.Cleanup(srv.Close)
+
+	// concurrent changes to different fields are all kept
+	var wg sync.WaitGroup
+	for _, body := range []string{`{"queryRateLimit": 5}`, `{"locationCacheWarming": true}`, `{"shadowReadRate": 0.5}`} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := testutil.Must(http.NewRequest(http.MethodPut, srv.URL+"/config", strings.NewReader(body)))(t)
+			req.Header.Set("Authorization", "Bearer secret")
+			resp := testutil.Must(http.DefaultClient.Do(req))(t)
+			resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+		}()
+	}
+	wg.Wait()
+	cfg := s.Config()
+	require.Equal(t, 5.0, cfg.QueryRateLimit)
+	require.True(t, cfg.LocationCacheWarming)
+	require.Equal(t, 0.5, cfg.ShadowReadRate)
+}
+
+func TestDeleteProvider(t *testing.T) {
+	provider := testutil.RandomPeer()
+	started := time.Now().UTC().Truncate(time.Second)
+	s := &mockRemovalService{progress: []types.ProviderTombstone{
+		{Provider: provider, Started: started},
+		{Provider: provider, Started: started, Cursor: 10, Swept: 1000, Hashes: 3, Records: 4},
+		{Provider: provider, Started: started, Finished: started.Add(time.Minute), Adverts: 2, Swept: 2000, Hashes: 5, Records: 6, Claims: 1},
+	}}
+	srv := httptest.NewServer(server.NewServer(server.WithService(s), server.WithAdminToken("secret")))
+	t.Cleanup(srv.Close)
+	remove := func(id string, token string) *http.Response {
+		req := testutil.Must(http.NewRequest(http.MethodDelete, srv.URL+"/providers/"+id, nil))(t)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	type line struct {
+		Provider string     `json:"provider"`
+		Finished *time.Time `json:"finished"`
+		Swept    int        `json:"swept"`
+		Records  int        `json:"records"`
+		Claims   int        `json:"claims"`
+		Error    string     `json:"error"`
+	}
+	lines := func(resp *http.Response) []line {
+		var lines []line
+		dec := json.NewDecoder(resp.Body)
+		for dec.More() {
+			var l line
+			require.NoError(t, dec.Decode(&l))
+			lines = append(lines, l)
+		}
+		return lines
+	}
+
+	resp := remove(provider.String(), "secret")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	progress := lines(resp)
+	require.Len(t, progress, 3)
+	require.Equal(t, []peer.ID{provider}, s.removed)
+	require.Equal(t, provider.String(), progress[0].Provider)
+	require.Nil(t, progress[1].Finished)
+	require.Equal(t, 1000, progress[1].Swept)
+	last := progress[2]
+	require.True(t, started.Add(time.Minute).Equal(*last.Finished))
+	require.Equal(t, 6, last.Records)
+	require.Equal(t, 1, last.Claims)
+	require.Empty(t, last.Error)
+
+	t.Run("stopped removals end with the error", func(t *testing.T) {
+		s.progress, s.err = s.progress[:2], errors.New("connection reset")
+		progress := lines(remove(provider.String(), "secret"))
+		require.Len(t, progress, 3)
+		require.Equal(t, progress[1].Swept, progress[2].Swept)
+		require.Nil(t, progress[2].Finished)
+		require.Equal(t, "connection reset", progress[2].Error)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		s.progress, s.err = nil, providerindex.ErrRemovalUnsupported
+		require.Equal(t, http.StatusNotFound, remove(provider.String(), "secret").StatusCode)
+	})
+
+	require.Equal(t, http.StatusBadRequest, remove("not-a-peer", "secret").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, remove(provider.String(), "").StatusCode)
+}
+
+type mockExportService struct {
+	mockService
+	formats []types.ExportFormat
+	limits  []int
+	// pages are the rows written for each cursor, and the next cursor
+	pages map[string][2]string
+	err   error
+}
+
+func (m *mockExportService) ExportProviderRecords(ctx context.Context, w io.Writer, format types.ExportFormat, cursor string, limit int) (string, error) {
+	m.formats = append(m.formats, format)
+	m.limits = append(m.limits, limit)
+	page, ok := m.pages[cursor]
+	if !ok {
+		return "", types.ErrInvalidCursor
+	}
+	if _, err := io.WriteString(w, page[0]); err != nil {
+		return "", err
+	}
+	return page[1], m.err
+}
+
+func TestProviderExport(t *testing.T) {
+	s := &mockExportService{pages: map[string][2]string{
+		"":     {"{\"multihash\":\"a\"}\n", "next"},
+		"next": {"{\"multihash\":\"b\"}\n", ""},
+		"none": {"", ""},
+	}}
+	srv := httptest.NewServer(server.NewServer(server.WithService(s), server.WithAdminToken("secret")))
+	t.Cleanup(srv.Close)
+	get := func(query string, token string) *http.Response {
+		req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+"/providers/export?"+query, nil))(t)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	var rows string
+	cursor := ""
+	for pages := 1; ; pages++ {
+		resp := get("limit=5&cursor="+cursor, "secret")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+		rows += string(testutil.Must(io.ReadAll(resp.Body))(t))
+		cursor = resp.Trailer.Get("Next-Cursor")
+		if cursor == "" {
+			require.Equal(t, 2, pages)
+			break
+		}
+	}
+	require.Equal(t, "{\"multihash\":\"a\"}\n{\"multihash\":\"b\"}\n", rows)
+	require.Equal(t, []types.ExportFormat{types.ExportNDJSON, types.ExportNDJSON}, s.formats)
+	require.Equal(t, []int{5, 5}, s.limits)
+
+	t.Run("formats and limits", func(t *testing.T) {
+		resp := get("format=csv", "secret")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+		require.Equal(t, types.ExportCSV, s.formats[len(s.formats)-1])
+		require.Equal(t, 10_000, s.limits[len(s.limits)-1])
+
+		require.Equal(t, http.StatusBadRequest, get("format=xml", "secret").StatusCode)
+		require.Equal(t, http.StatusBadRequest, get("limit=-1", "secret").StatusCode)
+	})
+
+	t.Run("empty exports", func(t *testing.T) {
+		resp := get("cursor=none", "secret")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Empty(t, testutil.Must(io.ReadAll(resp.Body))(t))
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, get("cursor=unknown", "secret").StatusCode)
+
+		s.err = errors.New("connection reset")
+		resp := get("", "secret")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		// the export failed after rows were written, so the response is aborted
+		_, err := io.ReadAll(resp.Body)
+		require.Error(t, err)
+
+		s.err = providerindex.ErrExportUnsupported
+		require.Equal(t, http.StatusNotFound, get("cursor=none", "secret").StatusCode)
+	})
+
+	require.Equal(t, http.StatusUnauthorized, get("", "").StatusCode)
+}
+
+// memSyncStore is a provider store scanned in key order
+type memSyncStore struct {
+	lk      sync.Mutex
+	results map[string][]model.ProviderResult
+}
+
+func newMemSyncStore(t *testing.T, hashes int) *memSyncStore {
+	s := &memSyncStore{results: map[string][]model.ProviderResult{}}
+	for _, hash := range testutil.RandomMultihashes(hashes) {
+		s.results[string(hash)] = []model.ProviderResult{testutil.RandomProviderResult()}
+	}
+	return s
+}
+
+func (s *memSyncStore) Get(ctx context.Context, hash multihash.Multihash) ([]model.ProviderResult, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	results, ok := s.results[string(hash)]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return results, nil
+}
+
+func (s *memSyncStore) Set(ctx context.Context, hash multihash.Multihash, results []model.ProviderResult, expires bool) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.results[string(hash)] = results
+	return nil
+}
+
+func (s *memSyncStore) SetExpirable(ctx context.Context, hash multihash.Multihash, expires bool) error {
+	return nil
+}
+
+func (s *memSyncStore) Scan(ctx context.Context, cursor uint64, count int) ([]multihash.Multihash, uint64, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	keys := slices.Sorted(maps.Keys(s.results))
+	start := min(int(cursor), len(keys))
+	end := min(start+count, len(keys))
+	var hashes []multihash.Multihash
+	for _, key := range keys[start:end] {
+		hashes = append(hashes, multihash.Multihash(key))
+	}
+	if end == len(keys) {
+		return hashes, 0, nil
+	}
+	return hashes, uint64(end), nil
+}
+
+type mockSyncingService struct {
+	mockService
+	source *cachesync.Source
+	syncer *cachesync.Syncer
+}
+
+func (m *mockSyncingService) SyncSource() *cachesync.Source { return m.source }
+
+func (m *mockSyncingService) Syncer() *cachesync.Syncer { return m.syncer }
+
+func TestSync(t *testing.T) {
+	newServer := func(t *testing.T, store *memSyncStore) string {
+		s := &mockSyncingService{source: cachesync.NewSource(store, cachesync.WithRangeBits(6)), syncer: cachesync.NewSyncer(store, cachesync.WithManifestPageSize(16))}
+		srv := httptest.NewServer(server.NewServer(server.WithService(s), server.WithAdminToken("secret")))
+		t.Cleanup(srv.Close)
+		return srv.URL
+	}
+	type progress struct {
+		Cursor  string `json:"cursor"`
+		Ranges  int    `json:"ranges"`
+		Written int    `json:"written"`
+		Done    bool   `json:"done"`
+		Error   string `json:"error"`
+	}
+	post := func(t *testing.T, destURL string, body string) []progress {
+		req := testutil.Must(http.NewRequest(http.MethodPost, destURL+"/sync", strings.NewReader(body)))(t)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+		var lines []progress
+		dec := json.NewDecoder(resp.Body)
+		for dec.More() {
+			var p progress
+			require.NoError(t, dec.Decode(&p))
+			lines = append(lines, p)
+		}
+		return lines
+	}
+
+	src, dst := newMemSyncStore(t, 50), newMemSyncStore(t, 10)
+	sourceURL, destURL := newServer(t, src), newServer(t, dst)
+	request := fmt.Sprintf(`{"from": %q, "token": "secret"}`, sourceURL)
+	lines := post(t, destURL, request)
+	require.Len(t, lines, 4)
+	require.Equal(t, progress{Ranges: 64, Written: 50, Done: true}, lines[3])
+	for key, results := range src.results {
+		require.Equal(t, results, testutil.Must(dst.Get(context.Background(), multihash.Multihash(key)))(t))
+	}
+	lines = post(t, destURL, request)
+	require.Zero(t, lines[len(lines)-1].Written)
+
+	t.Run("resumes from the cursor", func(t *testing.T) {
+		dst := newMemSyncStore(t, 0)
+		lines := post(t, newServer(t, dst), fmt.Sprintf(`{"from": %q, "token": "secret", "cursor": "48"}`, sourceURL))
+		require.Len(t, lines, 1)
+		require.Equal(t, 16, lines[0].Ranges)
+		require.Less(t, len(dst.results), 50)
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		lines := post(t, destURL, fmt.Sprintf(`{"from": %q, "token": "wrong"}`, sourceURL))
+		require.Len(t, lines, 1)
+		require.Contains(t, lines[0].Error, "401")
+		require.False(t, lines[0].Done)
+
+		for _, r := range []struct{ method, path, body string }{
+			{http.MethodPost, destURL + "/sync", `{"from": "ftp://example.com"}`},
+			{http.MethodPost, destURL + "/sync", `{`},
+			{http.MethodGet, sourceURL + "/sync/manifest?cursor=64", ""},
+			{http.MethodGet, sourceURL + "/sync/records?ranges=64", ""},
+			{http.MethodGet, sourceURL + "/sync/records?ranges=a", ""},
+			{http.MethodGet, sourceURL + "/sync/records?ranges=1&cursor=0", ""},
+			{http.MethodGet, sourceURL + "/sync/records?ranges=1&limit=-1", ""},
+		} {
+			req := testutil.Must(http.NewRequest(r.method, r.path, strings.NewReader(r.body)))(t)
+			req.Header.Set("Authorization", "Bearer secret")
+			resp := testutil.Must(http.DefaultClient.Do(req))(t)
+			resp.Body.Close()
+			require.Equal(t, http.StatusBadRequest, resp.StatusCode, r.path)
+		}
+	})
+}
+
+func TestGetContaining(t *testing.T) {
+	s := &mockContainingService{refs: []types.IndexRef{
+		{ContextID: testutil.RandomBytes(10), Content: testutil.RandomMultihash()},
+		{ContextID: testutil.RandomBytes(10)},
+	}}
+	srv := httptest.NewServer(server.NewServer(server.WithService(s), server.WithAdminToken("secret")))
+	t.Cleanup(srv.Close)
+	hash := testutil.Must(multibase.Encode(multibase.Base58BTC, testutil.RandomMultihash()))(t)
+	get := func(path string, token string) *http.Response {
+		req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+path, nil))(t)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := get("/containing/"+hash, "secret")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var body struct {
+		Hash    string `json:"hash"`
+		Indexes []struct {
+			ContextID string `json:"contextID"`
+			Content   string `json:"content"`
+		} `json:"indexes"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Equal(t, hash, body.Hash)
+	require.Len(t, body.Indexes, 2)
+	for i, index := range body.Indexes {
+		require.Equal(t, base64.StdEncoding.EncodeToString(s.refs[i].ContextID), index.ContextID)
+	}
+	_, content := testutil.Must2(multibase.Decode(body.Indexes[0].Content))(t)
+	require.Equal(t, []byte(s.refs[0].Content), content)
+	require.Empty(t, body.Indexes[1].Content)
+
+	require.Equal(t, http.StatusBadRequest, get("/containing/not-a-hash", "secret").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, get("/containing/"+hash, "").StatusCode)
+}
+
+type mockLagService struct {
+	mockService
+	monitor *publisher.LagMonitor
+}
+
+func (m *mockLagService) LagMonitor() *publisher.LagMonitor {
+	return m.monitor
+}
+
+// staticFinder reports the same provider info for every provider
+type staticFinder struct {
+	info *model.ProviderInfo
+}
+
+func (f staticFinder) GetProvider(ctx context.Context, provider peer.ID) (*model.ProviderInfo, error) {
+	return f.info, nil
+}
+
+func TestGetLag(t *testing.T) {
+	ctx := context.Background()
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	provider := peer.AddrInfo{ID: testutil.RandomPeer()}
+	p := publisher.New(dssync.MutexWrap(datastore.NewMapDatastore()), key)
+	first := testutil.Must(p.Publish(ctx, provider, testutil.RandomBytes(10), testutil.RandomBytes(10), testutil.RandomMultihashes(1)))(t)
+	var head ipld.Link
+	for range 2 {
+		head = testutil.Must(p.Publish(ctx, provider, testutil.RandomBytes(10), testutil.RandomBytes(10), testutil.RandomMultihashes(1)))(t)
+	}
+	m := publisher.NewLagMonitor(p, provider.ID, []publisher.LagEndpoint{
+		{Name: "in-sync", Finder: staticFinder{&model.ProviderInfo{LastAdvertisement: head.(cidlink.Link).Cid}}},
+		{Name: "lagging", Finder: staticFinder{&model.ProviderInfo{LastAdvertisement: first.(cidlink.Link).Cid}}},
+	}, publisher.WithMaxLag(1))
+	srv := httptest.NewServer(server.NewServer(server.WithService(&mockLagService{monitor: m}), server.WithAdminToken("secret")))
+	t.Cleanup(srv.Close)
+	get := func(path string, token string) *http.Response {
+		req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+path, nil))(t)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	health := func(t *testing.T) (status string, lagging bool) {
+		var body struct {
+			Status  string `json:"status"`
+			Lagging bool   `json:"lagging"`
+		}
+		require.NoError(t, json.NewDecoder(get("/health", "").Body).Decode(&body))
+		return body.Status, body.Lagging
+	}
+
+	// not checked yet
+	status, lagging := health(t)
+	require.Equal(t, "ok", status)
+	require.False(t, lagging)
+
+	testutil.Must(m.Check(ctx))(t)
+	status, lagging = health(t)
+	require.Equal(t, "degraded", status)
+	require.True(t, lagging)
+
+	resp := get("/publisher/lag", "secret")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var lags []struct {
+		Indexer           string `json:"indexer"`
+		Head              string `json:"head"`
+		LastAdvertisement string `json:"lastAdvertisement"`
+		Lag               int    `json:"lag"`
+		Exact             bool   `json:"exact"`
+		Lagging           bool   `json:"lagging"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&lags))
+	require.Len(t, lags, 2)
+	require.Equal(t, "in-sync", lags[0].Indexer)
+	require.Zero(t, lags[0].Lag)
+	require.False(t, lags[0].Lagging)
+	require.Equal(t, head.String(), lags[0].Head)
+	require.Equal(t, "lagging", lags[1].Indexer)
+	require.Equal(t, 2, lags[1].Lag)
+	require.True(t, lags[1].Exact)
+	require.True(t, lags[1].Lagging)
+	require.Equal(t, first.String(), lags[1].LastAdvertisement)
+	require.Equal(t, head.String(), lags[1].Head)
+
+	require.Equal(t, http.StatusUnauthorized, get("/publisher/lag", "").StatusCode)
+}
+
+type mockPublishingService struct {
+	mockService
+	publisher *publisher.Publisher
+}
+
+func (m *mockPublishingService) Publisher() *publisher.Publisher {
+	return m.publisher
+}
+
+func TestPublisherChain(t *testing.T) {
+	ctx := context.Background()
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	provider := peer.AddrInfo{ID: testutil.RandomPeer()}
+	newServer := func(t *testing.T) (*publisher.Publisher, string) {
+		p := publisher.New(dssync.MutexWrap(datastore.NewMapDatastore()), key)
+		srv := httptest.NewServer(server.NewServer(server.WithService(&mockPublishingService{publisher: p}), server.WithAdminToken("secret")))
+		t.Cleanup(srv.Close)
+		return p, srv.URL
+	}
+	do := func(t *testing.T, method, url string, body io.Reader) *http.Response {
+		req := testutil.Must(http.NewRequest(method, url+"/publisher/chain", body))(t)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	source, sourceURL := newServer(t)
+	require.Equal(t, http.StatusNotFound, do(t, http.MethodGet, sourceURL, nil).StatusCode)
+	var head ipld.Link
+	for range 3 {
+		head = testutil.Must(source.Publish(ctx, provider, testutil.RandomBytes(10), testutil.RandomBytes(10), testutil.RandomMultihashes(5)))(t)
+	}
+	resp := do(t, http.MethodGet, sourceURL, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	exported := testutil.Must(io.ReadAll(resp.Body))(t)
+
+	dest, destURL := newServer(t)
+	resp = do(t, http.MethodPost, destURL, bytes.NewReader(exported))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var summary struct {
+		Head    string `json:"head"`
+		Adverts uint64 `json:"adverts"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&summary))
+	require.Equal(t, head.String(), summary.Head)
+	require.Equal(t, uint64(3), summary.Adverts)
+	require.Equal(t, head, testutil.Must(dest.Head(ctx))(t))
+
+	divergent, divergentURL := newServer(t)
+	testutil.Must(divergent.Publish(ctx, provider, testutil.RandomBytes(10), testutil.RandomBytes(10), testutil.RandomMultihashes(5)))(t)
+	require.Equal(t, http.StatusConflict, do(t, http.MethodPost, divergentURL, bytes.NewReader(exported)).StatusCode)
+}
+
+func TestPublisherTimeline(t *testing.T) {
+	ctx := context.Background()
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	provider := peer.AddrInfo{ID: testutil.RandomPeer()}
+	at := func(s int64) time.Time { return time.Unix(s, 0).UTC() }
+	var next int64
+	p := publisher.New(dssync.MutexWrap(datastore.NewMapDatastore()), key, publisher.WithClock(func() time.Time {
+		next += 1000
+		return at(next)
+	}))
+	var links []ipld.Link
+	for range 3 {
+		links = append(links, testutil.Must(p.Publish(ctx, provider, testutil.RandomBytes(10), testutil.RandomBytes(10), testutil.RandomMultihashes(2)))(t))
+	}
+	srv := httptest.NewServer(server.NewServer(server.WithService(&mockPublishingService{publisher: p}), server.WithAdminToken("secret")))
+	t.Cleanup(srv.Close)
+	get := func(t *testing.T, path string) *http.Response {
+		req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+path, nil))(t)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	rfc3339 := func(s int64) string { return url.QueryEscape(at(s).Format(time.RFC3339)) }
+
+	resp := get(t, "/publisher/timeline?from="+rfc3339(2000)+"&to="+rfc3339(3000))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var window struct {
+		Head    string `json:"head"`
+		Total   int    `json:"total"`
+		Entries int64  `json:"entries"`
+		Adverts []struct {
+			Link string    `json:"link"`
+			At   time.Time `json:"at"`
+		} `json:"adverts"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&window))
+	require.Equal(t, links[1].String(), window.Head)
+	require.Equal(t, 1, window.Total)
+	require.Equal(t, int64(2), window.Entries)
+	require.Equal(t, links[1].String(), window.Adverts[0].Link)
+	require.Equal(t, at(2000), window.Adverts[0].At)
+
+	require.Equal(t, http.StatusBadRequest, get(t, "/publisher/timeline?from=yesterday").StatusCode)
+	require.Equal(t, http.StatusBadRequest, get(t, "/publisher/timeline?limit=0").StatusCode)
+
+	// the chain as of a time is exported from the head as of then
+	resp = get(t, "/publisher/chain?at="+rfc3339(2500))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	roots, _ := testutil.Must2(car.Decode(resp.Body))(t)
+	require.Equal(t, []ipld.Link{links[1]}, roots)
+	require.Equal(t, http.StatusNotFound, get(t, "/publisher/chain?at="+rfc3339(999)).StatusCode)
+}
+
+func TestPublisherAdvert(t *testing.T) {
+	ctx := context.Background()
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	provider := peer.AddrInfo{ID: testutil.Must(peer.IDFromPrivateKey(key))(t)}
+	p := publisher.New(dssync.MutexWrap(datastore.NewMapDatastore()), key, publisher.WithEntriesChunkSize(2))
+	claim := &metadata.LocationCommitmentMetadata{Claim: testutil.RandomCID().(cidlink.Link).Cid, Expiration: 1700000000}
+	md := append(testutil.Must(claim.MarshalBinary())(t), 0x80, 0x80, 0xfc, 0x01, 0xff)
+	link := testutil.Must(p.Publish(ctx, provider, []byte{1, 2, 3}, md, testutil.RandomMultihashes(5)))(t)
+	srv := httptest.NewServer(server.NewServer(server.WithService(&mockPublishingService{publisher: p}), server.WithAdminToken("secret")))
+	t.Cleanup(srv.Close)
+	get := func(t *testing.T, path string) *http.Response {
+		req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+path, nil))(t)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := get(t, "/publisher/advert/"+link.String()+"?chunks=2")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var inspection struct {
+		Link         string `json:"link"`
+		Provider     string `json:"provider"`
+		ContextID    string `json:"contextID"`
+		EntriesCount struct {
+			Chunks    int  `json:"chunks"`
+			Truncated bool `json:"truncated"`
+		} `json:"entriesCount"`
+		Protocols []struct {
+			Code   string `json:"code"`
+			Name   string `json:"name"`
+			Kind   string `json:"kind"`
+			Fields struct {
+				Claim      map[string]string `json:"Claim"`
+				Expiration int64             `json:"Expiration"`
+			} `json:"fields"`
+			Hex   string `json:"hex"`
+			Error string `json:"error"`
+		} `json:"protocols"`
+		Signature struct {
+			Valid bool `json:"valid"`
+		} `json:"signature"`
+		Errors map[string]string `json:"errors"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&inspection))
+	require.Equal(t, link.String(), inspection.Link)
+	require.Equal(t, provider.ID.String(), inspection.Provider)
+	require.Equal(t, "AQID", inspection.ContextID)
+	require.Equal(t, 2, inspection.EntriesCount.Chunks)
+	require.True(t, inspection.EntriesCount.Truncated)
+	require.True(t, inspection.Signature.Valid)
+	require.Empty(t, inspection.Errors)
+	require.Len(t, inspection.Protocols, 2)
+	location := inspection.Protocols[0]
+	require.Equal(t, "0x3e0002", location.Code)
+	require.Equal(t, "location-commitment", location.Name)
+	require.Equal(t, "location", location.Kind)
+	require.Equal(t, claim.Claim.String(), location.Fields.Claim["/"])
+	require.Equal(t, int64(1700000000), location.Fields.Expiration)
+	unknown := inspection.Protocols[1]
+	require.Equal(t, "0x3f0000", unknown.Code)
+	require.Empty(t, unknown.Name)
+	require.Equal(t, "8080fc01ff", unknown.Hex)
+	require.NotEmpty(t, unknown.Error)
+
+	require.Equal(t, http.StatusNotFound, get(t, "/publisher/advert/"+testutil.RandomCID().String()).StatusCode)
+	require.Equal(t, http.StatusBadRequest, get(t, "/publisher/advert/not-a-cid").StatusCode)
+	require.Equal(t, http.StatusBadRequest, get(t, "/publisher/advert/"+link.String()+"?chunks=-1").StatusCode)
+}
+
+type mockTieredService struct {
+	mockService
+	fast    queryresult.QueryResult
+	refines chan func(queryresult.QueryResult, error)
+}
+
+func (m *mockTieredService) QueryTiered(ctx context.Context, q service.Query, refine func(queryresult.QueryResult, error)) (queryresult.QueryResult, error) {
+	m.refines <- refine
+	return m.fast, nil
+}
+
+func TestGetClaims__Tiered(t *testing.T) {
+	emptyIndexes := bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1)
+	claim := testutil.RandomLocationDelegation()
+	claimCid := claim.Link().(cidlink.Link).Cid
+	fast := testutil.Must(queryresult.Build(map[cid.Cid]delegation.Delegation{}, emptyIndexes))(t)
+	full := testutil.Must(queryresult.Build(map[cid.Cid]delegation.Delegation{claimCid: claim}, emptyIndexes))(t)
+	s := &mockTieredService{mockService: mockService{qr: full}, fast: fast, refines: make(chan func(queryresult.QueryResult, error), 1)}
+	srv := httptest.NewServer(server.NewServer(server.WithService(s)))
+	t.Cleanup(srv.Close)
+	get := func(t *testing.T, query string) *http.Response {
+		req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+"/claims?"+query, nil))(t)
+		req.Header.Set("Accept", "application/json")
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	claimsOf := func(t *testing.T, resp *http.Response) []string {
+		var body struct {
+			Claims []struct {
+				Claim string `json:"claim"`
+			} `json:"claims"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		var claims []string
+		for _, c := range body.Claims {
+			claims = append(claims, c.Claim)
+		}
+		return claims
+	}
+	hash := testutil.RandomCID().String()
+
+	resp := get(t, "multihash="+hash+"&tiered=true")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, claimsOf(t, resp))
+	token := resp.Header.Get(server.RefinementHeader)
+	require.NotEmpty(t, token)
+	refine := <-s.refines
+
+	// fetching the refinement waits for the full walk to finish
+	refined := make(chan *http.Response, 1)
+	go func() {
+		req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+"/claims?refinement="+token, nil))(t)
+		req.Header.Set("Accept", "application/json")
+		refined <- testutil.Must(http.DefaultClient.Do(req))(t)
+	}()
+	select {
+	case <-refined:
+		t.Fatal("refinement was sent before the full walk finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	refine(full, nil)
+	resp = <-refined
+	t.Cleanup(func() { resp.Body.Close() })
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, []string{claimCid.String()}, claimsOf(t, resp))
+
+	t.Run("failed refinements are query errors", func(t *testing.T) {
+		token := get(t, "multihash="+hash+"&tiered=true").Header.Get(server.RefinementHeader)
+		(<-s.refines)(nil, service.ErrQueryRateLimited)
+		require.Equal(t, http.StatusTooManyRequests, get(t, "refinement="+token).StatusCode)
+	})
+
+	t.Run("untiered queries are answered in full", func(t *testing.T) {
+		resp := get(t, "multihash="+hash)
+		require.Empty(t, resp.Header.Get(server.RefinementHeader))
+		require.Equal(t, []string{claimCid.String()}, claimsOf(t, resp))
+	})
+
+	require.Equal(t, http.StatusNotFound, get(t, "refinement=unknown").StatusCode)
+	require.Equal(t, http.StatusBadRequest, get(t, "multihash="+hash+"&tiered=maybe").StatusCode)
+}
+
+type mockMetricsService struct {
+	mockService
+	handler http.Handler
+}
+
+func (m *mockMetricsService) MetricsHandler() http.Handler {
+	return m.handler
+}
+
+func TestGetMetrics(t *testing.T) {
+	exporter := prommetrics.New()
+	exporter.CacheRead(types.ClaimsCache, true)
+	srv := httptest.NewServer(server.NewServer(server.WithService(&mockMetricsService{handler: exporter.Handler()})))
+	t.Cleanup(srv.Close)
+
+	resp := testutil.Must(http.Get(srv.URL + "/metrics"))(t)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body := testutil.Must(io.ReadAll(resp.Body))(t)
+	require.Contains(t, string(body), `indexing_cache_reads_total{outcome="hit",store="claims"} 1`)
+}
+
+type removableProviderIndex struct {
+	service.ProviderIndex
+	err error
+}
+
+func (m *removableProviderIndex) RemoveProvider(ctx context.Context, provider peer.ID, opts ...providerindex.RemoveOption) error {
+	return m.err
+}
+
+// recordingProviderIndex is a removableProviderIndex that claims can be
+// published and cached to, and no records are found in
+type recordingProviderIndex struct {
+	removableProviderIndex
+}
+
+func (m *recordingProviderIndex) FindDetailed(ctx context.Context, qk providerindex.QueryKey) (providerindex.FindResult, error) {
+	return providerindex.FindResult{}, nil
+}
+
+func (m *recordingProviderIndex) CacheProviderResult(ctx context.Context, hash multihash.Multihash, result model.ProviderResult, expiration time.Time) error {
+	return nil
+}
+
+func (m *recordingProviderIndex) Publish(ctx context.Context, digests []multihash.Multihash, result model.ProviderResult, opts ...providerindex.PublishOption) error {
+	return nil
+}
+
+func TestAudit(t *testing.T) {
+	auditLog := testutil.Must(audit.NewLog(dssync.MutexWrap(datastore.NewMapDatastore())))(t)
+	claimProvider := testutil.RandomPeer()
+	is := testutil.Must(service.NewIndexingService(nil, nil, &recordingProviderIndex{}, service.WithAuditSinks(auditLog),
+		service.WithClaimProvider(peer.AddrInfo{ID: claimProvider})))(t)
+	srv := httptest.NewServer(server.NewServer(server.WithIdentity(testutil.Service), server.WithService(is), server.WithAdminToken("secret")))
+	t.Cleanup(srv.Close)
+	conn := testutil.Must(client.NewConnection(testutil.Service, ucanhttp.NewHTTPChannel(testutil.Must(url.Parse(srv.URL+"/claims"))(t))))(t)
+	publish := func(issuer principal.Signer, with string) ipld.Link {
+		claim := testutil.RandomLocationClaim()
+		inv := testutil.Must(assert.Location.Invoke(issuer, testutil.Service, with, claim.Nb()))(t)
+		res := testutil.Must(client.Execute([]invocation.Invocation{inv}, conn))(t)
+		_, ok := res.Get(inv.Link())
+		require.True(t, ok)
+		return inv.Link()
+	}
+	importClaim := func(claim delegation.Delegation, token string) int {
+		roots := []ipld.Link{claim.Link()}
+		body := car.Encode(roots, func(yield func(ucanipld.Block, error) bool) { yield(claim.Root(), nil) })
+		req := testutil.Must(http.NewRequest(http.MethodPost, srv.URL+"/claims/import?mode=cache", body))(t)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		defer resp.Body.Close()
+		testutil.Must(io.ReadAll(resp.Body))(t)
+		return resp.StatusCode
+	}
+	removeProvider := func(provider peer.ID, token string) int {
+		req := testutil.Must(http.NewRequest(http.MethodDelete, srv.URL+"/providers/"+provider.String(), nil))(t)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	type entry struct {
+		Operation string `json:"operation"`
+		Actor     string `json:"actor"`
+		Claim     string `json:"claim"`
+		Space     string `json:"space"`
+		Provider  string `json:"provider"`
+		Outcome   string `json:"outcome"`
+		Error     string `json:"error"`
+	}
+	type page struct {
+		Entries []entry `json:"entries"`
+		Cursor  string  `json:"cursor"`
+	}
+	readLog := func(query string) page {
+		req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+"/audit?"+query, nil))(t)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var p page
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&p))
+		return p
+	}
+
+	issuer := testutil.Must(ed25519.Generate())(t)
+	published := publish(issuer, issuer.DID().String())
+	// the issuer isn't authorized for a resource that isn't theirs
+	other := testutil.Must(ed25519.Generate())(t)
+	rejected := publish(issuer, other.DID().String())
+	// claims are cached by importing them with the admin token
+	cached := testutil.RandomLocationDelegation()
+	require.Equal(t, http.StatusOK, importClaim(cached, "secret"))
+	require.Equal(t, http.StatusUnauthorized, importClaim(testutil.RandomLocationDelegation(), "wrong"))
+	provider := testutil.RandomPeer()
+	require.Equal(t, http.StatusOK, removeProvider(provider, "secret"))
+	require.Equal(t, http.StatusUnauthorized, removeProvider(provider, "wrong"))
+
+	entries := readLog("").Entries
+	require.Len(t, entries, 6)
+	require.Equal(t, entry{Operation: "publish", Actor: issuer.DID().String(), Claim: published.String(), Space: issuer.DID().String(), Provider: claimProvider.String(), Outcome: "succeeded"}, entries[0])
+	require.Equal(t, "publish", entries[1].Operation)
+	require.Equal(t, issuer.DID().String(), entries[1].Actor)
+	require.Equal(t, rejected.String(), entries[1].Claim)
+	require.Equal(t, "rejected", entries[1].Outcome)
+	require.NotEmpty(t, entries[1].Error)
+	require.Equal(t, entry{Operation: "cache", Actor: types.AuditAdminActor, Claim: cached.Link().String(), Space: testutil.Service.DID().String(), Provider: claimProvider.String(), Outcome: "succeeded"}, entries[2])
+	require.Equal(t, entry{Operation: "cache", Outcome: "rejected", Error: "unauthorized"}, entries[3])
+	require.Equal(t, entry{Operation: "remove-provider", Actor: types.AuditAdminActor, Provider: provider.String(), Outcome: "succeeded"}, entries[4])
+	require.Equal(t, entry{Operation: "remove-provider", Provider: provider.String(), Outcome: "rejected", Error: "unauthorized"}, entries[5])
+
+	t.Run("filters and pages", func(t *testing.T) {
+		first := readLog("outcome=rejected&limit=1")
+		require.Len(t, first.Entries, 1)
+		require.Equal(t, "publish", first.Entries[0].Operation)
+		require.NotEmpty(t, first.Cursor)
+		second := readLog("outcome=rejected&limit=1&cursor=" + first.Cursor)
+		require.Len(t, second.Entries, 1)
+		require.Equal(t, "cache", second.Entries[0].Operation)
+		third := readLog("outcome=rejected&limit=1&cursor=" + second.Cursor)
+		require.Len(t, third.Entries, 1)
+		require.Equal(t, "remove-provider", third.Entries[0].Operation)
+		require.Empty(t, third.Cursor)
+
+		require.Len(t, readLog("actor="+url.QueryEscape(issuer.DID().String())).Entries, 2)
+		require.Len(t, readLog("actor="+types.AuditAdminActor).Entries, 2)
+		require.Len(t, readLog("operation=remove-provider&outcome=succeeded").Entries, 1)
+	})
+
+	t.Run("the log requires the admin token", func(t *testing.T) {
+		resp := testutil.Must(http.Get(srv.URL + "/audit"))(t)
+		resp.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
+
+type mockSelfCheckService struct {
+	mockService
+	report service.SelfCheckReport
+	err    error
+	// opts are those of the last self check
+	opts service.SelfCheckOptions
+}
+
+func (m *mockSelfCheckService) SelfCheck(ctx context.Context, opts service.SelfCheckOptions) (service.SelfCheckReport, error) {
+	m.opts = opts
+	return m.report, m.err
+}
+
+func TestSelfCheck(t *testing.T) {
+	type stageJSON struct {
+		Stage  string `json:"stage"`
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+		Error  string `json:"error"`
+	}
+	type reportJSON struct {
+		Passed bool        `json:"passed"`
+		Claim  string      `json:"claim"`
+		Stages []stageJSON `json:"stages"`
+	}
+	post := func(t *testing.T, srv *httptest.Server, params string) *http.Response {
+		req := testutil.Must(http.NewRequest(http.MethodPost, srv.URL+"/selfcheck?"+params, nil))(t)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	claim := testutil.RandomCID().(cidlink.Link).Cid
+
+	t.Run("reports every stage", func(t *testing.T) {
+		s := &mockSelfCheckService{report: service.SelfCheckReport{Claim: claim, Stages: []service.SelfCheckResult{
+			{Stage: service.SelfCheckPublish, Status: service.SelfCheckPassed, Duration: time.Millisecond},
+			{Stage: service.SelfCheckIPNI, Status: service.SelfCheckSkipped, Reason: "IPNI wait disabled"},
+			{Stage: service.SelfCheckRemove, Status: service.SelfCheckPassed},
+		}}}
+		srv := httptest.NewServer(server.NewServer(server.WithService(s), server.WithAdminToken("secret")))
+		t.Cleanup(srv.Close)
+		resp := post(t, srv, url.Values{"providerURL": {"https://example.com/claims/{claim}"}, "cacheWait": {"2s"}}.Encode())
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var report reportJSON
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+		require.True(t, report.Passed)
+		require.Equal(t, claim.String(), report.Claim)
+		require.Equal(t, []stageJSON{
+			{Stage: "publish", Status: "passed"},
+			{Stage: "ipni", Status: "skipped", Reason: "IPNI wait disabled"},
+			{Stage: "remove", Status: "passed"},
+		}, report.Stages)
+		require.Equal(t, "/claims/{claim}", s.opts.ProviderURL.Path)
+		require.Equal(t, 2*time.Second, s.opts.CacheWait)
+		require.Zero(t, s.opts.IPNIWait)
+	})
+
+	t.Run("failed checks are reported with 503", func(t *testing.T) {
+		err := errors.New("injected")
+		s := &mockSelfCheckService{report: service.SelfCheckReport{Stages: []service.SelfCheckResult{
+			{Stage: service.SelfCheckPublish, Status: service.SelfCheckFailed, Err: err},
+			{Stage: service.SelfCheckRemove, Status: service.SelfCheckPassed},
+		}}, err: err}
+		srv := httptest.NewServer(server.NewServer(server.WithService(s), server.WithAdminToken("secret")))
+		t.Cleanup(srv.Close)
+		resp := post(t, srv, url.Values{"providerURL": {"https://example.com/claims/{claim}"}}.Encode())
+		require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		var report reportJSON
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+		require.False(t, report.Passed)
+		require.Equal(t, "injected", report.Stages[0].Error)
+
+		require.Equal(t, http.StatusBadRequest, post(t, srv, "").StatusCode)
+		require.Equal(t, http.StatusBadRequest, post(t, srv, url.Values{"providerURL": {"https://example.com/claims/{claim}"}, "ipniWait": {"soon"}}.Encode()).StatusCode)
+	})
+
+	t.Run("failing canaries degrade health", func(t *testing.T) {
+		// the canary has no provider URL, so its self checks fail
+		is := testutil.Must(service.NewIndexingService(nil, nil, &removableProviderIndex{}, service.WithCanary(time.Hour, service.SelfCheckOptions{})))(t)
+		srv := httptest.NewServer(server.NewServer(server.WithService(is)))
+		t.Cleanup(srv.Close)
+		health := func(t *testing.T) (string, *reportJSON) {
+			resp := testutil.Must(http.Get(srv.URL + "/health"))(t)
+			defer resp.Body.Close()
+			var body struct {
+				Status    string      `json:"status"`
+				SelfCheck *reportJSON `json:"selfCheck"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			return body.Status, body.SelfCheck
+		}
+		status, report := health(t)
+		require.Equal(t, "ok", status)
+		require.Nil(t, report)
+
+		_, err := is.Canary().Check(context.Background())
+		require.Error(t, err)
+		status, report = health(t)
+		require.Equal(t, "degraded", status)
+		require.False(t, report.Passed)
+	})
+}
+
+type mockRefreshService struct {
+	mockService
+	report service.RefreshReport
+	err    error
+	// hash and opts are those of the last refresh
+	hash multihash.Multihash
+	opts service.RefreshOptions
+}
+
+func (m *mockRefreshService) Refresh(ctx context.Context, hash multihash.Multihash, opts service.RefreshOptions) (service.RefreshReport, error) {
+	m.hash, m.opts = hash, opts
+	return m.report, m.err
+}
+
+func TestRefresh(t *testing.T) {
+	type storeJSON struct {
+		Store   string `json:"store"`
+		Deleted int    `json:"deleted"`
+		Skipped string `json:"skipped"`
+		Error   string `json:"error"`
+	}
+	type reportJSON struct {
+		Hash       string      `json:"hash"`
+		Negative   bool        `json:"negative"`
+		Tombstoned []string    `json:"tombstoned"`
+		Stores     []storeJSON `json:"stores"`
+		Resolution *struct {
+			Claims []string `json:"claims"`
+		} `json:"resolution"`
+	}
+	hash := testutil.RandomMultihash()
+	claim := testutil.RandomCID().(cidlink.Link).Cid
+	provider := testutil.RandomPeer()
+	s := &mockRefreshService{}
+	srv := httptest.NewServer(server.NewServer(server.WithService(s), server.WithAdminToken("secret")))
+	t.Cleanup(srv.Close)
+	post := func(t *testing.T, hash string, params string, token string) *http.Response {
+		req := testutil.Must(http.NewRequest(http.MethodPost, srv.URL+"/admin/refresh/"+hash+"?"+params, nil))(t)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	t.Run("reports what was dropped from each store", func(t *testing.T) {
+		s.report = service.RefreshReport{
+			Hash:       hash,
+			Tombstoned: []peer.ID{provider},
+			Stores: []service.RefreshStoreResult{
+				{Store: service.RefreshProviders, Deleted: 2},
+				{Store: service.RefreshClaims, Deleted: 1},
+				{Store: service.RefreshResults, Skipped: "no result cache"},
+			},
+			Resolution: &service.RefreshResolution{Claims: []cid.Cid{claim}},
+		}
+		s.err = nil
+		resp := post(t, hash.B58String(), "", "secret")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var report reportJSON
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+		require.Equal(t, hash.B58String(), report.Hash)
+		require.Equal(t, []string{provider.String()}, report.Tombstoned)
+		require.Equal(t, []storeJSON{
+			{Store: "providers", Deleted: 2},
+			{Store: "claims", Deleted: 1},
+			{Store: "results", Skipped: "no result cache"},
+		}, report.Stores)
+		require.Equal(t, []string{claim.String()}, report.Resolution.Claims)
+		require.Equal(t, hash, s.hash)
+		// hashes are resolved unless asked not to be
+		require.True(t, s.opts.Resolve)
+
+		require.Equal(t, http.StatusOK, post(t, hash.B58String(), "resolve=false", "secret").StatusCode)
+		require.False(t, s.opts.Resolve)
+	})
+
+	t.Run("stores that couldn't be refreshed are reported with 503", func(t *testing.T) {
+		s.err = errors.New("connection refused")
+		s.report = service.RefreshReport{Hash: hash, Stores: []service.RefreshStoreResult{
+			{Store: service.RefreshProviders, Err: s.err},
+			{Store: service.RefreshResults, Deleted: 1},
+		}}
+		resp := post(t, hash.B58String(), "", "secret")
+		require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		var report reportJSON
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+		require.Equal(t, "connection refused", report.Stores[0].Error)
+		require.Equal(t, 1, report.Stores[1].Deleted)
+	})
+
+	t.Run("bad requests", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, post(t, "not-a-hash", "", "secret").StatusCode)
+		require.Equal(t, http.StatusBadRequest, post(t, hash.B58String(), "resolve=maybe", "secret").StatusCode)
+		require.Equal(t, http.StatusUnauthorized, post(t, hash.B58String(), "", "wrong").StatusCode)
+	})
+}
+
+type mockIdentityService struct {
+	mockService
+	ids *identity.Mapping
+}
+
+func (m *mockIdentityService) Identities() *identity.Mapping {
+	return m.ids
+}
+
+func TestIdentityConflicts(t *testing.T) {
+	ctx := context.Background()
+	ids := testutil.Must(identity.NewMapping(ctx, dssync.MutexWrap(datastore.NewMapDatastore())))(t)
+	webDID := testutil.Must(did.Parse("did:web:provider.example.com"))(t)
+	first, second := testutil.RandomPeer(), testutil.RandomPeer()
+	require.NoError(t, ids.Observe(ctx, webDID, first))
+	require.NoError(t, ids.Observe(ctx, webDID, second))
+	srv := httptest.NewServer(server.NewServer(server.WithService(&mockIdentityService{ids: ids}), server.WithAdminToken("secret")))
+	t.Cleanup(srv.Close)
+
+	resp := testutil.Must(http.Get(srv.URL + "/identities/conflicts"))(t)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+"/identities/conflicts", nil))(t)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp = testutil.Must(http.DefaultClient.Do(req))(t)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var body struct {
+		Conflicts []struct {
+			DID        string `json:"did"`
+			Peer       string `json:"peer"`
+			MappedPeer string `json:"mappedPeer"`
+			Count      int    `json:"count"`
+		} `json:"conflicts"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Len(t, body.Conflicts, 1)
+	require.Equal(t, webDID.String(), body.Conflicts[0].DID)
+	require.Equal(t, second.String(), body.Conflicts[0].Peer)
+	require.Equal(t, first.String(), body.Conflicts[0].MappedPeer)
+	require.Equal(t, 1, body.Conflicts[0].Count)
+}
+
+type mockExpansionService struct {
+	mockService
+	pool *expansion.Pool
+}
+
+func (m *mockExpansionService) Expansions() *expansion.Pool {
+	return m.pool
+}
+
+func TestExpansions(t *testing.T) {
+	ctx := context.Background()
+	pool := testutil.Must(expansion.NewPool(dssync.MutexWrap(datastore.NewMapDatastore()), nil))(t)
+	task := expansion.Task{
+		ContextID: testutil.RandomBytes(10),
+		Index:     testutil.RandomCID().(cidlink.Link).Cid,
+		Provider:  testutil.RandomProviderResult(),
+		Reason:    expansion.ReasonPrefetch,
+	}
+	require.NoError(t, pool.Enqueue(ctx, task))
+	srv := httptest.NewServer(server.NewServer(server.WithService(&mockExpansionService{pool: pool}), server.WithAdminToken("secret")))
+	t.Cleanup(srv.Close)
+
+	resp := testutil.Must(http.Get(srv.URL + "/expansions"))(t)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req := testutil.Must(http.NewRequest(http.MethodGet, srv.URL+"/expansions", nil))(t)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp = testutil.Must(http.DefaultClient.Do(req))(t)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var body struct {
+		Depth int `json:"depth"`
+		Jobs  []struct {
+			ContextID string `json:"contextID"`
+			Index     string `json:"index"`
+			Provider  string `json:"provider"`
+			Reason    string `json:"reason"`
+			State     string `json:"state"`
+			Attempts  int    `json:"attempts"`
+		} `json:"jobs"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Equal(t, 1, body.Depth)
+	require.Len(t, body.Jobs, 1)
+	require.Equal(t, base64.StdEncoding.EncodeToString(task.ContextID), body.Jobs[0].ContextID)
+	require.Equal(t, task.Index.String(), body.Jobs[0].Index)
+	require.Equal(t, task.Provider.Provider.ID.String(), body.Jobs[0].Provider)
+	require.Equal(t, "prefetch", body.Jobs[0].Reason)
+	require.Equal(t, "queued", body.Jobs[0].State)
+	require.Zero(t, body.Jobs[0].Attempts)
+}
@@ -0,0 +1,183 @@
+// Package addrpolicy decides which network addresses the service may fetch from,
+// so that provider records can't direct requests at loopback, link-local,
+// private or other networks that aren't publicly routable
+package addrpolicy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// ErrDisallowedAddress means an address is loopback, link-local, private,
+// unspecified or in another range that isn't publicly routable, and not in the
+// allowlist
+var ErrDisallowedAddress = errors.New("address is not publicly routable")
+
+// reservedPrefixes are the special purpose ranges that aren't publicly routable
+// and aren't covered by the netip.Addr predicates, from the IANA special
+// purpose address registries
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // this network
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, and broadcast
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use IPv4/IPv6 translation
+	netip.MustParsePrefix("100::/64"),        // discard-only
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4, which can embed any IPv4 address
+	netip.MustParsePrefix("3fff::/20"),       // documentation
+}
+
+// Resolver looks up the IP addresses of a host. *net.Resolver implements it
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+type (
+	// Option configures a Policy
+	Option func(*Policy)
+
+	// Policy allows publicly routable addresses, and addresses in an allowlist
+	Policy struct {
+		allowed      []netip.Prefix
+		allowPrivate bool
+		resolver     Resolver
+		dialer       *net.Dialer
+	}
+)
+
+// WithAllowedPrefixes allows addresses in the given ranges even if they are not
+// publicly routable
+func WithAllowedPrefixes(prefixes ...netip.Prefix) Option {
+	return func(p *Policy) {
+		p.allowed = append(p.allowed, prefixes...)
+	}
+}
+
+// WithAllowPrivate allows every address, for development and testing
+func WithAllowPrivate(allow bool) Option {
+	return func(p *Policy) {
+		p.allowPrivate = allow
+	}
+}
+
+// WithResolver sets the resolver used to look up host names. If not set,
+// net.DefaultResolver is used
+func WithResolver(r Resolver) Option {
+	return func(p *Policy) {
+		p.resolver = r
+	}
+}
+
+// New returns an address policy. By default, only publicly routable addresses
+// are allowed
+func New(opts ...Option) *Policy {
+	p := &Policy{
+		resolver: net.DefaultResolver,
+		dialer:   &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// AllowedIP returns true if requests may be sent to the IP address
+func (p *Policy) AllowedIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if p.allowPrivate {
+		return true
+	}
+	for _, prefix := range p.allowed {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	if !ip.IsValid() ||
+		ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Resolve returns the allowed IP addresses of a host, which is either a literal
+// IP address or a name to look up. It fails with ErrDisallowedAddress if there
+// are none
+func (p *Policy) Resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip}
+	} else {
+		ips, err = p.resolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s: %w", host, err)
+		}
+	}
+	allowed := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		if p.AllowedIP(ip) {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrDisallowedAddress, host)
+	}
+	return allowed, nil
+}
+
+// CheckHost returns an error if requests may not be sent to the host
+func (p *Policy) CheckHost(ctx context.Context, host string) error {
+	_, err := p.Resolve(ctx, host)
+	return err
+}
+
+// DialContext resolves the host being dialed and connects only to an allowed
+// address it resolves to, so a name can't be rebound to a disallowed address
+// between being checked and being connected to
+func (p *Policy) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := p.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, ip := range ips {
+		conn, err := p.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// HTTPClient returns an HTTP client that only connects to allowed addresses
+func (p *Policy) HTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = p.DialContext
+	// a proxy would connect on our behalf without the policy
+	transport.Proxy = nil
+	return &http.Client{Transport: transport}
+}
@@ -0,0 +1,135 @@
+package addrpolicy_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/addrpolicy"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeResolver map[string][]netip.Addr
+
+func (r fakeResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	ips, ok := r[host]
+	if !ok {
+		return nil, fmt.Errorf("no such host: %s", host)
+	}
+	return ips, nil
+}
+
+func TestAllowedIP(t *testing.T) {
+	testCases := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"100.128.0.1", true},
+		{"0.1.2.3", false},
+		{"192.0.0.8", false},
+		{"192.0.2.1", false},
+		{"198.18.0.1", false},
+		{"198.51.100.1", false},
+		{"203.0.113.1", false},
+		{"224.0.0.1", false},
+		{"239.1.2.3", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:100.64.0.1", false},
+		{"64:ff9b:1::1", false},
+		{"100::1", false},
+		{"2001:db8::1", false},
+		{"2002:a00:1::1", false},
+		{"3fff::1", false},
+		{"ff02::1", false},
+		{"ff0e::1", false},
+	}
+	policy := addrpolicy.New()
+	for _, testCase := range testCases {
+		t.Run(testCase.ip, func(t *testing.T) {
+			require.Equal(t, testCase.allowed, policy.AllowedIP(netip.MustParseAddr(testCase.ip)))
+		})
+	}
+
+	t.Run("allowlisted ranges", func(t *testing.T) {
+		policy := addrpolicy.New(addrpolicy.WithAllowedPrefixes(netip.MustParsePrefix("10.0.0.0/16")))
+		require.True(t, policy.AllowedIP(netip.MustParseAddr("10.0.5.1")))
+		require.False(t, policy.AllowedIP(netip.MustParseAddr("10.1.0.1")))
+		require.False(t, policy.AllowedIP(netip.MustParseAddr("127.0.0.1")))
+	})
+
+	t.Run("dev override", func(t *testing.T) {
+		policy := addrpolicy.New(addrpolicy.WithAllowPrivate(true))
+		require.True(t, policy.AllowedIP(netip.MustParseAddr("127.0.0.1")))
+		require.True(t, policy.AllowedIP(netip.MustParseAddr("192.168.1.1")))
+	})
+}
+
+func TestResolve(t *testing.T) {
+	resolver := fakeResolver{
+		"public.example":  {netip.MustParseAddr("93.184.216.34")},
+		"private.example": {netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("127.0.0.1")},
+		"mixed.example":   {netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("93.184.216.34")},
+	}
+	policy := addrpolicy.New(addrpolicy.WithResolver(resolver))
+	ctx := context.Background()
+
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("93.184.216.34")}, testutil.Must(policy.Resolve(ctx, "public.example"))(t))
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("93.184.216.34")}, testutil.Must(policy.Resolve(ctx, "mixed.example"))(t))
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("93.184.216.34")}, testutil.Must(policy.Resolve(ctx, "93.184.216.34"))(t))
+
+	_, err := policy.Resolve(ctx, "private.example")
+	require.ErrorIs(t, err, addrpolicy.ErrDisallowedAddress)
+	_, err = policy.Resolve(ctx, "192.168.0.1")
+	require.ErrorIs(t, err, addrpolicy.ErrDisallowedAddress)
+	_, err = policy.Resolve(ctx, "unknown.example")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, addrpolicy.ErrDisallowedAddress)
+}
+
+func TestHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	serverURL := testutil.Must(url.Parse(server.URL))(t)
+	// the name only resolves through the fake resolver, so a request to it can
+	// only succeed by connecting to the address the policy resolved
+	resolver := fakeResolver{"provider.example": {netip.MustParseAddr(serverURL.Hostname())}}
+	named := "http://provider.example:" + serverURL.Port()
+
+	t.Run("rejects names resolving to loopback", func(t *testing.T) {
+		client := addrpolicy.New(addrpolicy.WithResolver(resolver)).HTTPClient()
+		_, err := client.Get(named)
+		require.ErrorIs(t, err, addrpolicy.ErrDisallowedAddress)
+		_, err = client.Get(server.URL)
+		require.ErrorIs(t, err, addrpolicy.ErrDisallowedAddress)
+	})
+
+	t.Run("connects to the resolved address when allowed", func(t *testing.T) {
+		client := addrpolicy.New(addrpolicy.WithResolver(resolver), addrpolicy.WithAllowedPrefixes(netip.MustParsePrefix("127.0.0.0/8"))).HTTPClient()
+		resp := testutil.Must(client.Get(named))(t)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	})
+}
@@ -0,0 +1,146 @@
+package service_test
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/addrpolicy"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/stretchr/testify/require"
+)
+
+type staticResolver map[string][]netip.Addr
+
+func (r staticResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return r[host], nil
+}
+
+func TestIndexingService__AddressPolicy(t *testing.T) {
+	f := newClaimFixture(t)
+	serverURL := testutil.Must(url.Parse(f.server.URL))(t)
+	resolver := staticResolver{"provider.example": {netip.MustParseAddr(serverURL.Hostname())}}
+
+	// one provider has a literal loopback address, the other a DNS name that
+	// resolves to it
+	literalHash, literalClaim := testutil.RandomMultihash(), f.newClaim(t)
+	dnsHash, dnsClaim := testutil.RandomMultihash(), f.newClaim(t)
+	dnsProvider := &peer.AddrInfo{
+		ID:    testutil.RandomPeer(),
+		Addrs: []multiaddr.Multiaddr{testutil.Must(multiaddr.NewMultiaddr("/dns/provider.example/tcp/" + serverURL.Port() + "/http/http-path/%2Fclaims%2F%7Bclaim%7D"))(t)},
+	}
+	dnsResult := f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: dnsClaim})
+	dnsResult.Provider = dnsProvider
+	results := map[string][]model.ProviderResult{
+		string(literalHash): {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: literalClaim})},
+		string(dnsHash):     {dnsResult},
+	}
+
+	testCases := []struct {
+		name      string
+		opts      []addrpolicy.Option
+		reachable bool
+	}{
+		{name: "default policy", reachable: false},
+		{name: "allowlisted range", opts: []addrpolicy.Option{addrpolicy.WithAllowedPrefixes(netip.MustParsePrefix("127.0.0.0/8"))}, reachable: true},
+		{name: "dev override", opts: []addrpolicy.Option{addrpolicy.WithAllowPrivate(true)}, reachable: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			policy := addrpolicy.New(append([]addrpolicy.Option{addrpolicy.WithResolver(resolver)}, testCase.opts...)...)
+			providers := &mockProviderStore{results: map[string][]model.ProviderResult{}}
+			claims := newMockClaimStore()
+			providerIndex := providerindex.NewProviderIndex(providers, &countingFinder{results: results, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+			is := testutil.Must(service.NewIndexingService(
+				&mockBlobIndexLookup{},
+				claimlookup.WithCache(claimlookup.NewClaimLookup(policy.HTTPClient()), claims),
+				providerIndex,
+				service.WithAddressPolicy(policy),
+			))(t)
+
+			for hash, claimCid := range map[string]cid.Cid{string(literalHash): literalClaim, string(dnsHash): dnsClaim} {
+				found, _ := queriedClaims(t, is, []byte(hash))
+				_, cacheErr := claims.Get(context.Background(), claimCid)
+				if testCase.reachable {
+					require.Equal(t, []cid.Cid{claimCid}, found)
+					require.NoError(t, cacheErr)
+				} else {
+					require.Empty(t, found)
+					require.Error(t, cacheErr, "nothing is cached from a disallowed provider")
+				}
+			}
+		})
+	}
+}
+
+// dnsaddrResolver also answers the TXT records of dnsaddr names
+type dnsaddrResolver struct {
+	staticResolver
+	txt map[string][]string
+}
+
+func (r dnsaddrResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := r.txt[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func TestIndexingService__DNSAddr(t *testing.T) {
+	f := newClaimFixture(t)
+	serverURL := testutil.Must(url.Parse(f.server.URL))(t)
+	resolver := dnsaddrResolver{
+		staticResolver: staticResolver{"provider.example": {netip.MustParseAddr(serverURL.Hostname())}},
+		txt: map[string][]string{
+			"_dnsaddr.provider.example": {"dnsaddr=/dns/provider.example/tcp/" + serverURL.Port() + "/http/http-path/%2Fclaims%2F%7Bclaim%7D"},
+		},
+	}
+	hash, claimCid := testutil.RandomMultihash(), f.newClaim(t)
+	result := f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: claimCid})
+	result.Provider = &peer.AddrInfo{
+		ID:    testutil.RandomPeer(),
+		Addrs: []multiaddr.Multiaddr{testutil.Must(multiaddr.NewMultiaddr("/dnsaddr/provider.example"))(t)},
+	}
+	results := map[string][]model.ProviderResult{string(hash): {result}}
+
+	testCases := []struct {
+		name      string
+		opts      []addrpolicy.Option
+		reachable bool
+	}{
+		{name: "resolved addresses are checked", reachable: false},
+		{name: "allowlisted range", opts: []addrpolicy.Option{addrpolicy.WithAllowedPrefixes(netip.MustParsePrefix("127.0.0.0/8"))}, reachable: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			policy := addrpolicy.New(append([]addrpolicy.Option{addrpolicy.WithResolver(resolver)}, testCase.opts...)...)
+			providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: results, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+			is := testutil.Must(service.NewIndexingService(
+				&mockBlobIndexLookup{},
+				claimlookup.NewClaimLookup(policy.HTTPClient()),
+				providerIndex,
+				service.WithAddressPolicy(policy),
+				service.WithResolver(resolver),
+			))(t)
+
+			found, _ := queriedClaims(t, is, hash)
+			if testCase.reachable {
+				require.Equal(t, []cid.Cid{claimCid}, found)
+			} else {
+				require.Empty(t, found)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+// Package admission sheds the most expensive queries while the service is
+// overloaded, so that cheap queries are still served rather than every query
+// slowing down until it times out
+package admission
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrOverloaded is returned when a query is shed because the service is
+// overloaded
+var ErrOverloaded = errors.New("service overloaded")
+
+// OverloadError is returned for a shed query, with how long to wait before
+// trying again
+type OverloadError struct {
+	RetryAfter time.Duration
+}
+
+func (e *OverloadError) Error() string {
+	return ErrOverloaded.Error()
+}
+
+func (e *OverloadError) Is(target error) bool {
+	return target == ErrOverloaded
+}
+
+const (
+	// DefaultCheapCost is the cost of queries that are still admitted while
+	// shedding when not otherwise configured
+	DefaultCheapCost = 1
+	// DefaultWindow is how far back query durations are kept for the rolling p95
+	// when not otherwise configured
+	DefaultWindow = time.Minute
+	// DefaultRetryAfter is how long shed queries are told to wait when not
+	// otherwise configured
+	DefaultRetryAfter = 5 * time.Second
+	// recoveryFraction is how far below its threshold a signal must fall before
+	// shedding stops, so that shedding doesn't flap at the threshold
+	recoveryFraction = 0.8
+	// maxSamples bounds the query durations kept for the rolling p95
+	maxSamples = 1024
+)
+
+// Metrics receives the decisions of the controller
+type Metrics interface {
+	// SheddingChanged is called when shedding starts or stops
+	SheddingChanged(shedding bool)
+	// Rejected is called when a query of the given cost is shed
+	Rejected(cost int)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) SheddingChanged(bool) {}
+func (noopMetrics) Rejected(int)         {}
+
+type (
+	// Option configures a Controller
+	Option func(*Controller)
+
+	// Controller admits queries unless the service is overloaded, which is when
+	// too many queries are in flight or the p95 of recent query durations is too
+	// high. While overloaded, queries costing more than the cheap cost are shed
+	// and cheap ones are still admitted
+	Controller struct {
+		maxInFlight int
+		maxP95      time.Duration
+		cheapCost   int
+		window      time.Duration
+		retryAfter  time.Duration
+		now         func() time.Time
+		metrics     Metrics
+
+		lk       sync.Mutex
+		inFlight int
+		samples  []sample
+		shedding bool
+		since    time.Time
+		rejected uint64
+	}
+
+	sample struct {
+		at       time.Time
+		duration time.Duration
+	}
+
+	// Stats describes the load on the service and whether queries are being shed
+	Stats struct {
+		InFlight int
+		P95      time.Duration
+		Shedding bool
+		// Since is when shedding last started or stopped
+		Since time.Time
+		// Rejected is the number of queries shed since startup
+		Rejected uint64
+	}
+)
+
+// WithMaxInFlight sheds queries when more than the given number are in flight.
+// Zero disables the limit
+func WithMaxInFlight(n int) Option {
+	return func(c *Controller) {
+		c.maxInFlight = n
+	}
+}
+
+// WithMaxP95 sheds queries when the p95 of recent query durations exceeds the
+// given duration. Zero disables the limit
+func WithMaxP95(d time.Duration) Option {
+	return func(c *Controller) {
+		c.maxP95 = d
+	}
+}
+
+// WithCheapCost sets the cost at or below which queries are admitted while
+// shedding
+func WithCheapCost(cost int) Option {
+	return func(c *Controller) {
+		c.cheapCost = cost
+	}
+}
+
+// WithWindow sets how far back query durations are kept for the rolling p95
+func WithWindow(window time.Duration) Option {
+	return func(c *Controller) {
+		c.window = window
+	}
+}
+
+// WithRetryAfter sets how long shed queries are told to wait before retrying
+func WithRetryAfter(d time.Duration) Option {
+	return func(c *Controller) {
+		c.retryAfter = d
+	}
+}
+
+// WithClock sets the source of the current time
+func WithClock(now func() time.Time) Option {
+	return func(c *Controller) {
+		c.now = now
+	}
+}
+
+// WithMetrics reports the decisions of the controller to the given metrics
+func WithMetrics(m Metrics) Option {
+	return func(c *Controller) {
+		c.metrics = m
+	}
+}
+
+// New returns a new admission controller
+func New(opts ...Option) *Controller {
+	c := &Controller{
+		cheapCost:  DefaultCheapCost,
+		window:     DefaultWindow,
+		retryAfter: DefaultRetryAfter,
+		now:        time.Now,
+		metrics:    noopMetrics{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.since = c.now()
+	return c
+}
+
+// Admit decides whether to run a query of the given cost. If it is admitted,
+// done must be called once the query finishes. Otherwise an *OverloadError is
+// returned
+func (c *Controller) Admit(cost int) (done func(), err error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.update()
+	if c.shedding && cost > c.cheapCost {
+		c.rejected++
+		c.metrics.Rejected(cost)
+		return nil, &OverloadError{RetryAfter: c.retryAfter}
+	}
+	c.inFlight++
+	c.update()
+	start := c.now()
+	var once sync.Once
+	return func() {
+		once.Do(func() { c.finish(start) })
+	}, nil
+}
+
+// Shedding returns true while queries are being shed, so that background work
+// can be paused
+func (c *Controller) Shedding() bool {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.update()
+	return c.shedding
+}
+
+// Stats reports the load on the service and whether queries are being shed
+func (c *Controller) Stats() Stats {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.update()
+	return Stats{
+		InFlight: c.inFlight,
+		P95:      c.p95(),
+		Shedding: c.shedding,
+		Since:    c.since,
+		Rejected: c.rejected,
+	}
+}
+
+func (c *Controller) finish(start time.Time) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	now := c.now()
+	c.inFlight--
+	c.samples = append(c.samples, sample{now, now.Sub(start)})
+	if len(c.samples) > maxSamples {
+		c.samples = slices.Delete(c.samples, 0, len(c.samples)-maxSamples)
+	}
+	c.update()
+}
+
+// update starts shedding when a signal exceeds its threshold, and stops it
+// once every signal is comfortably below its threshold
+func (c *Controller) update() {
+	cutoff := c.now().Add(-c.window)
+	expired := 0
+	for expired < len(c.samples) && c.samples[expired].at.Before(cutoff) {
+		expired++
+	}
+	c.samples = slices.Delete(c.samples, 0, expired)
+
+	p95 := c.p95()
+	overloaded := (c.maxInFlight > 0 && c.inFlight > c.maxInFlight) ||
+		(c.maxP95 > 0 && p95 > c.maxP95)
+	recovered := (c.maxInFlight <= 0 || float64(c.inFlight) <= recoveryFraction*float64(c.maxInFlight)) &&
+		(c.maxP95 <= 0 || float64(p95) <= recoveryFraction*float64(c.maxP95))
+	switch {
+	case !c.shedding && overloaded:
+		c.setShedding(true)
+	case c.shedding && recovered:
+		c.setShedding(false)
+	}
+}
+
+func (c *Controller) setShedding(shedding bool) {
+	c.shedding = shedding
+	c.since = c.now()
+	c.metrics.SheddingChanged(shedding)
+}
+
+func (c *Controller) p95() time.Duration {
+	if len(c.samples) == 0 {
+		return 0
+	}
+	durations := make([]time.Duration, 0, len(c.samples))
+	for _, s := range c.samples {
+		durations = append(durations, s.duration)
+	}
+	slices.Sort(durations)
+	return durations[(len(durations)*95-1)/100]
+}
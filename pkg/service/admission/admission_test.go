@@ -0,0 +1,122 @@
+package admission_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/storacha/indexing-service/pkg/service/admission"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+type mockMetrics struct {
+	transitions []bool
+	rejected    []int
+}
+
+func (m *mockMetrics) SheddingChanged(shedding bool) {
+	m.transitions = append(m.transitions, shedding)
+}
+
+func (m *mockMetrics) Rejected(cost int) {
+	m.rejected = append(m.rejected, cost)
+}
+
+func TestController__InFlight(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	metrics := &mockMetrics{}
+	c := admission.New(
+		admission.WithMaxInFlight(5),
+		admission.WithCheapCost(1),
+		admission.WithRetryAfter(3*time.Second),
+		admission.WithClock(clock.Now),
+		admission.WithMetrics(metrics))
+
+	var done []func()
+	admit := func(t *testing.T, cost int) {
+		d, err := c.Admit(cost)
+		require.NoError(t, err)
+		done = append(done, d)
+	}
+	for range 6 {
+		admit(t, 10)
+	}
+	require.True(t, c.Shedding())
+	require.Equal(t, []bool{true}, metrics.transitions)
+
+	// expensive queries are shed while cheap ones are still served
+	_, err := c.Admit(10)
+	require.ErrorIs(t, err, admission.ErrOverloaded)
+	var overload *admission.OverloadError
+	require.ErrorAs(t, err, &overload)
+	require.Equal(t, 3*time.Second, overload.RetryAfter)
+	admit(t, 1)
+	require.Equal(t, []int{10}, metrics.rejected)
+
+	// shedding continues until in flight queries fall well below the limit
+	clock.Advance(time.Second)
+	for len(done) > 5 {
+		done[0]()
+		done = done[1:]
+	}
+	require.True(t, c.Shedding())
+	done[0]()
+	done = done[1:]
+	require.False(t, c.Shedding())
+	require.Equal(t, []bool{true, false}, metrics.transitions)
+	admit(t, 10)
+
+	stats := c.Stats()
+	require.Equal(t, 5, stats.InFlight)
+	require.False(t, stats.Shedding)
+	require.Equal(t, clock.Now(), stats.Since)
+	require.Equal(t, uint64(1), stats.Rejected)
+}
+
+func TestController__P95(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	c := admission.New(
+		admission.WithMaxP95(time.Second),
+		admission.WithWindow(time.Minute),
+		admission.WithClock(clock.Now))
+
+	query := func(t *testing.T, d time.Duration) {
+		done, err := c.Admit(1)
+		require.NoError(t, err)
+		clock.Advance(d)
+		done()
+	}
+	for range 10 {
+		query(t, 100*time.Millisecond)
+	}
+	require.False(t, c.Shedding())
+	for range 5 {
+		query(t, 2*time.Second)
+	}
+	require.True(t, c.Shedding())
+	require.Equal(t, 2*time.Second, c.Stats().P95)
+	_, err := c.Admit(2)
+	require.ErrorIs(t, err, admission.ErrOverloaded)
+
+	// slow queries age out of the window
+	clock.Advance(time.Minute)
+	query(t, 100*time.Millisecond)
+	require.False(t, c.Shedding())
+	require.Equal(t, 100*time.Millisecond, c.Stats().P95)
+}
+
+func TestController__Unlimited(t *testing.T) {
+	c := admission.New()
+	for range 100 {
+		_, err := c.Admit(100)
+		require.NoError(t, err)
+	}
+	require.False(t, c.Shedding())
+}
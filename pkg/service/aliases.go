@@ -0,0 +1,278 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/jobwalker"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// DefaultMaxAliasDepth is the number of equals claims followed away from the
+// queried hash when resolving aliases
+const DefaultMaxAliasDepth = 8
+
+// WithMaxAliasDepth sets the number of equals claims followed away from the
+// queried hash when resolving aliases. If not set, DefaultMaxAliasDepth is used
+func WithMaxAliasDepth(depth int) Option {
+	return func(is *IndexingService) {
+		is.maxAliasDepth = depth
+	}
+}
+
+// Aliases returns the hashes known to be equivalent to the given hash through
+// equals claims, along with the CIDs of the claims that link them. Only equals
+// records are read, and each equals claim is fetched from the providers that
+// advertised it before it is followed, as it is when a query follows it. No
+// locations or indexes are fetched. The walk follows at most the configured
+// number of hops and stops at hashes it has already seen, so cycles of claims
+// terminate
+func (is *IndexingService) Aliases(ctx context.Context, mh multihash.Multihash, match Match) ([]multihash.Multihash, []cid.Cid, error) {
+	cfg := is.config.Load()
+	if !cfg.allowQuery() {
+		return nil, nil, ErrQueryRateLimited
+	}
+	return is.resolveAliases(ctx, cfg, mh, match)
+}
+
+func (is *IndexingService) resolveAliases(ctx context.Context, cfg *runtimeConfig, mh multihash.Multihash, match Match) ([]multihash.Multihash, []cid.Cid, error) {
+	seen := map[string]struct{}{string(mh): {}}
+	seenClaims := map[cid.Cid]struct{}{}
+	// verified records whether each equals claim met could be followed
+	verified := map[cid.Cid]bool{}
+	var aliases []multihash.Multihash
+	var claims []cid.Cid
+	frontier := []multihash.Multihash{mh}
+	for depth := 0; depth < is.maxAliasDepth && len(frontier) > 0; depth++ {
+		var next []multihash.Multihash
+		for _, hash := range frontier {
+			fr, err := is.providerIndex.FindDetailed(ctx, providerindex.QueryKey{
+				Hash:         hash,
+				Spaces:       match.Subject,
+				TargetClaims: metadata.ClaimCodes(metadata.EqualsKind),
+			})
+			if err != nil {
+				return nil, nil, fmt.Errorf("finding equals claims for %s: %w", hash.B58String(), err)
+			}
+			type equalsRecord struct {
+				result model.ProviderResult
+				equals *metadata.EqualsClaimMetadata
+			}
+			var records []equalsRecord
+			candidates := map[cid.Cid][]claimCandidate{}
+			for _, result := range fr.Results {
+				if cfg.isDenied(result.Provider, is.identities) || !is.allowedProvider(ctx, result.Provider) {
+					continue
+				}
+				md := is.metadataContext.New()
+				if err := md.UnmarshalBinary(result.Metadata); err != nil {
+					return nil, nil, err
+				}
+				protocols := metadata.FilterClaimProtocols(md, metadata.EqualsKind)
+				if len(protocols) == 0 {
+					continue
+				}
+				equals, ok := protocols[0].(*metadata.EqualsClaimMetadata)
+				if !ok {
+					continue
+				}
+				records = append(records, equalsRecord{result, equals})
+				urls, err := is.fetchClaimURLs(ctx, *result.Provider, equals.Claim)
+				if err != nil {
+					log.Warnw("provider has no claim endpoint", "claim", equals.Claim, "provider", result.Provider.ID, "error", err)
+					continue
+				}
+				for _, url := range urls {
+					candidates[equals.Claim] = append(candidates[equals.Claim], claimCandidate{*result.Provider, &url, result, time.Time{}})
+				}
+			}
+			for _, record := range records {
+				ok, err := is.verifyEqualsClaim(ctx, cfg, record.equals.Claim, candidates[record.equals.Claim], verified)
+				if err != nil {
+					return nil, nil, err
+				}
+				if !ok {
+					continue
+				}
+				// equals claims are published on both sides, so the alias is
+				// whichever side wasn't looked up
+				other := record.equals.Equals.Hash()
+				if string(other) == string(hash) {
+					other = multihash.Multihash(record.result.ContextID)
+				}
+				if _, ok := seenClaims[record.equals.Claim]; !ok {
+					seenClaims[record.equals.Claim] = struct{}{}
+					claims = append(claims, record.equals.Claim)
+				}
+				if _, ok := seen[string(other)]; ok {
+					continue
+				}
+				seen[string(other)] = struct{}{}
+				aliases = append(aliases, other)
+				next = append(next, other)
+			}
+		}
+		frontier = next
+	}
+	return aliases, claims, nil
+}
+
+// verifyEqualsClaim fetches an equals claim from the providers that advertised
+// it, reporting whether it can be followed. A claim that can't be fetched, or
+// whose issuer is denied, is not followed. The outcome for each claim is kept
+// in verified, so that a claim met on both of its sides is only fetched once
+func (is *IndexingService) verifyEqualsClaim(ctx context.Context, cfg *runtimeConfig, claimCid cid.Cid, candidates []claimCandidate, verified map[cid.Cid]bool) (bool, error) {
+	if ok, done := verified[claimCid]; done {
+		return ok, nil
+	}
+	claim, from, err := is.fetchClaim(ctx, claimCid, metadata.EqualsKind, candidates)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		log.Warnw("fetching equals claim failed from all providers", "claim", claimCid, "error", err)
+		verified[claimCid] = false
+		return false, nil
+	}
+	is.observeIssuer(ctx, claim, from.provider.ID)
+	verified[claimCid] = !cfg.isIssuerDenied(claim.Issuer().DID(), is.identities)
+	return verified[claimCid], nil
+}
+
+// aliasCluster is a set of hashes equivalent through equals claims, at least
+// one of which was queried
+type aliasCluster struct {
+	// canonical is the lowest of the queried hashes in the cluster, which what
+	// is found for any of them is attributed to
+	canonical multihash.Multihash
+	// members are the hashes of the cluster, canonical first and the rest in
+	// order
+	members []multihash.Multihash
+}
+
+// aliasClusters resolves the aliases of each queried hash, merging the
+// clusters of queried hashes that share any hash
+func (is *IndexingService) aliasClusters(ctx context.Context, cfg *runtimeConfig, q Query) ([]aliasCluster, error) {
+	var clusters [][]multihash.Multihash
+	clusterOf := map[string]int{}
+	for _, hash := range q.Hashes {
+		if _, ok := clusterOf[string(hash)]; ok {
+			continue
+		}
+		aliases, _, err := is.resolveAliases(ctx, cfg, hash, q.Match)
+		if err != nil {
+			return nil, fmt.Errorf("resolving aliases of %s: %w", hash.B58String(), err)
+		}
+		members := []multihash.Multihash{hash}
+		for _, alias := range aliases {
+			i, ok := clusterOf[string(alias)]
+			if !ok {
+				members = append(members, alias)
+				continue
+			}
+			// the alias was reached from an earlier queried hash, whose cluster
+			// this one is merged into
+			members = append(members, clusters[i]...)
+			clusters[i] = nil
+		}
+		members = slices.CompactFunc(sortHashes(members), func(a, b multihash.Multihash) bool { return bytes.Equal(a, b) })
+		clusters = append(clusters, members)
+		for _, m := range members {
+			clusterOf[string(m)] = len(clusters) - 1
+		}
+	}
+	queried := map[string]struct{}{}
+	for _, hash := range q.Hashes {
+		queried[string(hash)] = struct{}{}
+	}
+	var resolved []aliasCluster
+	for _, members := range clusters {
+		if members == nil {
+			continue
+		}
+		// members are in order, so the first queried one is the lowest
+		i := slices.IndexFunc(members, func(m multihash.Multihash) bool {
+			_, ok := queried[string(m)]
+			return ok
+		})
+		canonical := members[i]
+		ordered := append([]multihash.Multihash{canonical}, slices.Delete(slices.Clone(members), i, i+1)...)
+		resolved = append(resolved, aliasCluster{canonical: canonical, members: ordered})
+	}
+	return resolved, nil
+}
+
+func sortHashes(hashes []multihash.Multihash) []multihash.Multihash {
+	slices.SortFunc(hashes, func(a, b multihash.Multihash) int { return bytes.Compare(a, b) })
+	return hashes
+}
+
+// attribution is what a query found on behalf of an origin hash
+type attribution struct {
+	claims    map[cid.Cid]struct{}
+	indexes   map[string]struct{}
+	indexRefs map[string]struct{}
+}
+
+// attribute records something found by the job on behalf of its origin, when
+// the query canonicalizes aliases
+func attribute(state jobwalker.WrappedState[queryState], j job, found func(*attribution)) {
+	if state.Access().qr.attributed == nil {
+		return
+	}
+	state.Modify(func(qs queryState) queryState {
+		a, ok := qs.qr.attributed[string(j.origin)]
+		if !ok {
+			a = &attribution{claims: map[cid.Cid]struct{}{}, indexes: map[string]struct{}{}, indexRefs: map[string]struct{}{}}
+			qs.qr.attributed[string(j.origin)] = a
+		}
+		found(a)
+		return qs
+	})
+}
+
+// hashResults assembles what was found for each cluster, leaving out what
+// didn't make it into the result, such as superseded claims and indexes the
+// client already has
+func hashResults(clusters []aliasCluster, qr *queryResult) map[string]queryresult.HashResult {
+	results := make(map[string]queryresult.HashResult, len(clusters))
+	for _, c := range clusters {
+		r := queryresult.HashResult{Aliases: []string{}, Claims: []cid.Cid{}, Indexes: []types.EncodedContextID{}, IndexRefs: []types.EncodedContextID{}}
+		for _, alias := range c.members[1:] {
+			r.Aliases = append(r.Aliases, encodeHash(alias))
+		}
+		if a, ok := qr.attributed[string(c.canonical)]; ok {
+			for claim := range a.claims {
+				_, included := qr.Claims[claim]
+				_, confirmed := qr.Confirmed[claim]
+				if included || confirmed {
+					r.Claims = append(r.Claims, claim)
+				}
+			}
+			for contextID := range a.indexes {
+				if qr.Indexes.Has(types.EncodedContextID(contextID)) {
+					r.Indexes = append(r.Indexes, types.EncodedContextID(contextID))
+				}
+			}
+			for contextID := range a.indexRefs {
+				if qr.IndexRefs.Has(types.EncodedContextID(contextID)) {
+					r.IndexRefs = append(r.IndexRefs, types.EncodedContextID(contextID))
+				}
+			}
+		}
+		slices.SortFunc(r.Claims, func(a, b cid.Cid) int { return bytes.Compare(a.Bytes(), b.Bytes()) })
+		slices.SortFunc(r.Indexes, func(a, b types.EncodedContextID) int { return bytes.Compare(a, b) })
+		slices.SortFunc(r.IndexRefs, func(a, b types.EncodedContextID) int { return bytes.Compare(a, b) })
+		results[encodeHash(c.canonical)] = r
+	}
+	return results
+}
@@ -0,0 +1,179 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexingService__Aliases(t *testing.T) {
+	f := newClaimFixture(t)
+
+	// equals publishes a claim that a equals b on both sides of it
+	equals := func(results map[string][]model.ProviderResult, a, b multihash.Multihash) cid.Cid {
+		claim := f.addClaim(t, equalsDelegation(t, a, cid.NewCidV1(cid.Raw, b)))
+		result := f.result(t, a, &metadata.EqualsClaimMetadata{Equals: cid.NewCidV1(cid.Raw, b), Claim: claim})
+		results[string(a)] = append(results[string(a)], result)
+		results[string(b)] = append(results[string(b)], result)
+		return claim
+	}
+	newService := func(results map[string][]model.ProviderResult, opts ...service.Option) *service.IndexingService {
+		providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: results, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		return testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex, opts...))(t)
+	}
+
+	hashes := testutil.RandomMultihashes(4)
+	chain := map[string][]model.ProviderResult{}
+	ab := equals(chain, hashes[0], hashes[1])
+	bc := equals(chain, hashes[1], hashes[2])
+	cd := equals(chain, hashes[2], hashes[3])
+
+	testCases := []struct {
+		name    string
+		opts    []service.Option
+		hash    multihash.Multihash
+		aliases []multihash.Multihash
+		claims  []cid.Cid
+	}{
+		{
+			name:    "three hop chain",
+			hash:    hashes[0],
+			aliases: hashes[1:],
+			claims:  []cid.Cid{ab, bc, cd},
+		},
+		{
+			name:    "from the middle of the chain",
+			hash:    hashes[2],
+			aliases: []multihash.Multihash{hashes[0], hashes[1], hashes[3]},
+			claims:  []cid.Cid{ab, bc, cd},
+		},
+		{
+			name:    "bounded depth",
+			opts:    []service.Option{service.WithMaxAliasDepth(2)},
+			hash:    hashes[0],
+			aliases: hashes[1:3],
+			claims:  []cid.Cid{ab, bc},
+		},
+		{
+			name: "no equals claims",
+			hash: testutil.RandomMultihash(),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			aliases, claims, err := newService(chain, tc.opts...).Aliases(context.Background(), tc.hash, service.Match{})
+			require.NoError(t, err)
+			require.ElementsMatch(t, tc.aliases, aliases)
+			require.ElementsMatch(t, tc.claims, claims)
+		})
+	}
+
+	t.Run("cycle", func(t *testing.T) {
+		cycle := map[string][]model.ProviderResult{}
+		hashes := testutil.RandomMultihashes(3)
+		claims := []cid.Cid{
+			equals(cycle, hashes[0], hashes[1]),
+			equals(cycle, hashes[1], hashes[2]),
+			equals(cycle, hashes[2], hashes[0]),
+		}
+		aliases, found, err := newService(cycle).Aliases(context.Background(), hashes[0], service.Match{})
+		require.NoError(t, err)
+		require.ElementsMatch(t, hashes[1:], aliases)
+		require.ElementsMatch(t, claims, found)
+	})
+
+	t.Run("claims that can't be fetched aren't followed", func(t *testing.T) {
+		results := map[string][]model.ProviderResult{}
+		hashes := testutil.RandomMultihashes(3)
+		claim := equals(results, hashes[0], hashes[1])
+		// the second claim is advertised but not served
+		unserved := testutil.RandomCID().(cidlink.Link).Cid
+		result := f.result(t, hashes[1], &metadata.EqualsClaimMetadata{Equals: cid.NewCidV1(cid.Raw, hashes[2]), Claim: unserved})
+		results[string(hashes[1])] = append(results[string(hashes[1])], result)
+		results[string(hashes[2])] = append(results[string(hashes[2])], result)
+
+		aliases, found, err := newService(results).Aliases(context.Background(), hashes[0], service.Match{})
+		require.NoError(t, err)
+		require.Equal(t, []multihash.Multihash{hashes[1]}, aliases)
+		require.Equal(t, []cid.Cid{claim}, found)
+	})
+
+	t.Run("claims of denied issuers aren't followed", func(t *testing.T) {
+		is := newService(chain, service.WithDynamicConfig(service.DynamicConfig{DeniedProviders: []string{testutil.Service.DID().String()}}))
+		aliases, found, err := is.Aliases(context.Background(), hashes[0], service.Match{})
+		require.NoError(t, err)
+		require.Empty(t, aliases)
+		require.Empty(t, found)
+	})
+}
+
+func TestIndexingService__CanonicalizeAliases(t *testing.T) {
+	f := newClaimFixture(t)
+
+	// a equals b, and only b has a location
+	hashes := testutil.RandomMultihashes(2)
+	slices.SortFunc(hashes, func(a, b multihash.Multihash) int { return bytes.Compare(a, b) })
+	low, high := hashes[0], hashes[1]
+	equalsClaim, location := f.newClaim(t), f.newClaim(t)
+	equalsResult := f.result(t, high, &metadata.EqualsClaimMetadata{Equals: cid.NewCidV1(cid.Raw, low), Claim: equalsClaim})
+	results := map[string][]model.ProviderResult{
+		string(high): {equalsResult},
+		string(low):  {equalsResult, f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: location})},
+	}
+	providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: results, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+	is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex))(t)
+	encode := func(hash multihash.Multihash) string {
+		return testutil.Must(multibase.Encode(multibase.Base58BTC, hash))(t)
+	}
+
+	testCases := []struct {
+		name      string
+		hashes    []multihash.Multihash
+		canonical multihash.Multihash
+		alias     multihash.Multihash
+	}{
+		{name: "keyed by the queried hash", hashes: []multihash.Multihash{high}, canonical: high, alias: low},
+		{name: "keyed by the lowest queried hash", hashes: []multihash.Multihash{high, low}, canonical: low, alias: high},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			qr := testutil.Must(is.Query(context.Background(), service.Query{Hashes: tc.hashes, CanonicalizeAliases: true}))(t)
+			results := qr.HashResults().Clone()
+			require.Equal(t, map[string]queryresult.HashResult{
+				encode(tc.canonical): {
+					Aliases:   []string{encode(tc.alias)},
+					Claims:    sortedCids(equalsClaim, location),
+					Indexes:   []types.EncodedContextID{},
+					IndexRefs: []types.EncodedContextID{},
+				},
+			}, results)
+		})
+	}
+
+	t.Run("opt in", func(t *testing.T) {
+		qr := testutil.Must(is.Query(context.Background(), service.Query{Hashes: []multihash.Multihash{high}}))(t)
+		require.Zero(t, qr.HashResults().Len())
+		require.Len(t, qr.Claims(), 2)
+	})
+}
+
+func sortedCids(cids ...cid.Cid) []cid.Cid {
+	slices.SortFunc(cids, func(a, b cid.Cid) int { return bytes.Compare(a.Bytes(), b.Bytes()) })
+	return cids
+}
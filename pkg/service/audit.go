@@ -0,0 +1,100 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/service/claimevents"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// WithAuditSinks records an audit entry in each of the sinks for every
+// publish, cache and provider removal
+func WithAuditSinks(sinks ...types.AuditSink) Option {
+	return func(is *IndexingService) {
+		is.auditSinks = append(is.auditSinks, sinks...)
+	}
+}
+
+// Audit records the entry in every audit sink, returning once it is durable in
+// all of them. It is for operations rejected before reaching the service, which
+// audits the operations it makes itself. The time of the entry is set if it
+// isn't already
+func (is *IndexingService) Audit(ctx context.Context, entry types.AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	var errs []error
+	for _, sink := range is.auditSinks {
+		if err := sink.Record(ctx, entry); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AuditLog returns the first audit sink whose entries can be read back, or nil
+// if there is none
+func (is *IndexingService) AuditLog() types.AuditLog {
+	for _, sink := range is.auditSinks {
+		if l, ok := sink.(types.AuditLog); ok {
+			return l
+		}
+	}
+	return nil
+}
+
+// auditClaim records the outcome of publishing or caching a claim, as made by
+// the actor of the context. The operation is only acknowledged once it has been
+// audited, so failing to record a success fails the operation. Failing to
+// record a failure is logged, and the operation's own error returned
+func (is *IndexingService) auditClaim(ctx context.Context, op types.AuditOperation, claim delegation.Delegation, evt claimevents.ClaimEvent, opErr error) error {
+	if len(is.auditSinks) == 0 {
+		return opErr
+	}
+	if !evt.Claim.Defined() {
+		evt = claimevents.NewClaimEvent(claim)
+	}
+	entry := types.AuditEntry{
+		Operation: op,
+		Actor:     types.AuditActor(ctx),
+		Claim:     evt.Claim,
+		Space:     evt.Space,
+		Provider:  evt.Provider,
+		HashCount: evt.HashCount,
+	}
+	return is.auditOutcome(ctx, entry, opErr)
+}
+
+// auditRemoval records the outcome of removing every record of a provider
+func (is *IndexingService) auditRemoval(ctx context.Context, provider peer.ID, opErr error) error {
+	if len(is.auditSinks) == 0 {
+		return opErr
+	}
+	entry := types.AuditEntry{
+		Operation: types.AuditRemoveProvider,
+		Actor:     types.AuditActor(ctx),
+		Provider:  &provider,
+	}
+	return is.auditOutcome(ctx, entry, opErr)
+}
+
+func (is *IndexingService) auditOutcome(ctx context.Context, entry types.AuditEntry, opErr error) error {
+	entry.Outcome = types.AuditSucceeded
+	if opErr != nil {
+		entry.Outcome = types.AuditFailed
+		entry.Error = opErr.Error()
+	}
+	if err := is.Audit(ctx, entry); err != nil {
+		if opErr != nil {
+			log.Errorw("recording audit entry", "operation", entry.Operation, "claim", entry.Claim, "error", err)
+			return opErr
+		}
+		return fmt.Errorf("recording audit entry: %w", err)
+	}
+	return opErr
+}
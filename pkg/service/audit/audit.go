@@ -0,0 +1,260 @@
+// Package audit records who published, cached or removed what and when, apart
+// from the debug logs, for compliance and abuse handling
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+const (
+	// DefaultLimit is the most entries read back at once when a filter doesn't
+	// set a limit
+	DefaultLimit = 100
+	// MaxLimit is the most entries read back at once, whatever the filter asks
+	MaxLimit = 1000
+)
+
+var logPrefix = datastore.NewKey("audit")
+
+// entryJSON is the encoding of an entry, both in JSON lines and in the log
+type entryJSON struct {
+	Operation types.AuditOperation `json:"operation"`
+	Actor     string               `json:"actor,omitempty"`
+	Claim     string               `json:"claim,omitempty"`
+	Space     string               `json:"space,omitempty"`
+	Provider  string               `json:"provider,omitempty"`
+	HashCount int                  `json:"hashCount,omitempty"`
+	Outcome   types.AuditOutcome   `json:"outcome"`
+	Error     string               `json:"error,omitempty"`
+	Time      time.Time            `json:"time"`
+}
+
+func encodeEntry(entry types.AuditEntry) ([]byte, error) {
+	body := entryJSON{
+		Operation: entry.Operation,
+		Actor:     entry.Actor,
+		HashCount: entry.HashCount,
+		Outcome:   entry.Outcome,
+		Error:     entry.Error,
+		Time:      entry.Time.UTC(),
+	}
+	if entry.Claim.Defined() {
+		body.Claim = entry.Claim.String()
+	}
+	if entry.Space != nil {
+		body.Space = entry.Space.String()
+	}
+	if entry.Provider != nil {
+		body.Provider = entry.Provider.String()
+	}
+	return json.Marshal(body)
+}
+
+func decodeEntry(data []byte) (types.AuditEntry, error) {
+	var body entryJSON
+	if err := json.Unmarshal(data, &body); err != nil {
+		return types.AuditEntry{}, err
+	}
+	entry := types.AuditEntry{
+		Operation: body.Operation,
+		Actor:     body.Actor,
+		HashCount: body.HashCount,
+		Outcome:   body.Outcome,
+		Error:     body.Error,
+		Time:      body.Time,
+	}
+	if body.Claim != "" {
+		c, err := cid.Parse(body.Claim)
+		if err != nil {
+			return types.AuditEntry{}, fmt.Errorf("parsing claim: %w", err)
+		}
+		entry.Claim = c
+	}
+	if body.Space != "" {
+		space, err := did.Parse(body.Space)
+		if err != nil {
+			return types.AuditEntry{}, fmt.Errorf("parsing space: %w", err)
+		}
+		entry.Space = &space
+	}
+	if body.Provider != "" {
+		provider, err := peer.Decode(body.Provider)
+		if err != nil {
+			return types.AuditEntry{}, fmt.Errorf("parsing provider: %w", err)
+		}
+		entry.Provider = &provider
+	}
+	return entry, nil
+}
+
+// JSONLines writes entries to a writer as JSON, one entry per line
+type JSONLines struct {
+	lk sync.Mutex
+	w  io.Writer
+}
+
+var _ types.AuditSink = (*JSONLines)(nil)
+
+// NewJSONLines returns a sink writing entries to w. Writers with a Sync method,
+// such as files, are synced after each entry
+func NewJSONLines(w io.Writer) *JSONLines {
+	return &JSONLines{w: w}
+}
+
+// Record writes the entry as a line of JSON
+func (j *JSONLines) Record(ctx context.Context, entry types.AuditEntry) error {
+	line, err := encodeEntry(entry)
+	if err != nil {
+		return fmt.Errorf("encoding audit entry: %w", err)
+	}
+	j.lk.Lock()
+	defer j.lk.Unlock()
+	if _, err := j.w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing audit entry: %w", err)
+	}
+	if s, ok := j.w.(interface{ Sync() error }); ok {
+		if err := s.Sync(); err != nil {
+			return fmt.Errorf("syncing audit entry: %w", err)
+		}
+	}
+	return nil
+}
+
+// Log is an append only log of entries in a datastore, that can be read back
+type Log struct {
+	lk      sync.Mutex
+	entries datastore.Batching
+	seq     uint64
+}
+
+var _ types.AuditLog = (*Log)(nil)
+
+// NewLog returns a log keeping its entries in the given datastore
+func NewLog(ds datastore.Batching) (*Log, error) {
+	entries := namespace.Wrap(ds, logPrefix)
+	seq, err := lastSequence(entries)
+	if err != nil {
+		return nil, fmt.Errorf("reading audit log: %w", err)
+	}
+	return &Log{entries: entries, seq: seq}, nil
+}
+
+// Record appends the entry to the log, and syncs it to disk
+func (l *Log) Record(ctx context.Context, entry types.AuditEntry) error {
+	data, err := encodeEntry(entry)
+	if err != nil {
+		return fmt.Errorf("encoding audit entry: %w", err)
+	}
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	key := entryKey(l.seq + 1)
+	if err := l.entries.Put(ctx, key, data); err != nil {
+		return fmt.Errorf("writing audit log: %w", err)
+	}
+	if err := l.entries.Sync(ctx, key); err != nil {
+		return fmt.Errorf("syncing audit log: %w", err)
+	}
+	l.seq++
+	return nil
+}
+
+// AuditLog returns the entries matching the filter, oldest first, starting
+// after the cursor. It returns types.ErrInvalidCursor for cursors that it
+// didn't return
+func (l *Log) AuditLog(ctx context.Context, filter types.AuditFilter, cursor string) ([]types.AuditEntry, string, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	limit = min(limit, MaxLimit)
+	q := query.Query{Orders: []query.Order{query.OrderByKey{}}}
+	if cursor != "" {
+		seq, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, "", types.ErrInvalidCursor
+		}
+		q.Filters = []query.Filter{query.FilterKeyCompare{Op: query.GreaterThan, Key: entryKey(seq).String()}}
+	}
+	results, err := l.entries.Query(ctx, q)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading audit log: %w", err)
+	}
+	defer results.Close()
+	var entries []types.AuditEntry
+	var last string
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, "", fmt.Errorf("reading audit log: %w", result.Error)
+		}
+		entry, err := decodeEntry(result.Value)
+		if err != nil {
+			return nil, "", fmt.Errorf("decoding audit entry %s: %w", result.Key, err)
+		}
+		if !matches(filter, entry) {
+			continue
+		}
+		if len(entries) == limit {
+			return entries, last, nil
+		}
+		entries = append(entries, entry)
+		last = strings.TrimPrefix(result.Key, "/")
+	}
+	return entries, "", nil
+}
+
+// matches returns true if the entry matches every field of the filter that is
+// set
+func matches(filter types.AuditFilter, entry types.AuditEntry) bool {
+	switch {
+	case filter.Operation != "" && entry.Operation != filter.Operation:
+		return false
+	case filter.Actor != "" && entry.Actor != filter.Actor:
+		return false
+	case filter.Outcome != "" && entry.Outcome != filter.Outcome:
+		return false
+	case !filter.Since.IsZero() && entry.Time.Before(filter.Since):
+		return false
+	case !filter.Until.IsZero() && !entry.Time.Before(filter.Until):
+		return false
+	}
+	return true
+}
+
+func entryKey(seq uint64) datastore.Key {
+	return datastore.NewKey(fmt.Sprintf("%020d", seq))
+}
+
+func lastSequence(entries datastore.Batching) (uint64, error) {
+	results, err := entries.Query(context.Background(), query.Query{
+		KeysOnly: true,
+		Orders:   []query.Order{query.OrderByKeyDescending{}},
+		Limit:    1,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer results.Close()
+	result, ok := results.NextSync()
+	if !ok {
+		return 0, nil
+	}
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return strconv.ParseUint(strings.TrimPrefix(result.Key, "/"), 10, 64)
+}
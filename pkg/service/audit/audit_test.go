@@ -0,0 +1,129 @@
+package audit_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/storacha/go-ucanto/principal/ed25519/signer"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/audit"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func randomEntry(t *testing.T, op types.AuditOperation, outcome types.AuditOutcome, at time.Time) types.AuditEntry {
+	space := testutil.Must(signer.Generate())(t).DID()
+	provider := testutil.RandomPeer()
+	return types.AuditEntry{
+		Operation: op,
+		Actor:     testutil.Must(signer.Generate())(t).DID().String(),
+		Claim:     testutil.RandomCID().(cidlink.Link).Cid,
+		Space:     &space,
+		Provider:  &provider,
+		HashCount: 3,
+		Outcome:   outcome,
+		Time:      at.UTC(),
+	}
+}
+
+func TestJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	sink := audit.NewJSONLines(&buf)
+	now := time.Now().Truncate(time.Second)
+	entries := []types.AuditEntry{
+		randomEntry(t, types.AuditPublish, types.AuditSucceeded, now),
+		{Operation: types.AuditRemoveProvider, Outcome: types.AuditRejected, Error: "unauthorized", Time: now.UTC()},
+	}
+	for _, entry := range entries {
+		require.NoError(t, sink.Record(context.Background(), entry))
+	}
+	scanner := bufio.NewScanner(&buf)
+	var lines []map[string]any
+	for scanner.Scan() {
+		var line map[string]any
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	require.Len(t, lines, 2)
+	require.Equal(t, "publish", lines[0]["operation"])
+	require.Equal(t, entries[0].Actor, lines[0]["actor"])
+	require.Equal(t, entries[0].Claim.String(), lines[0]["claim"])
+	require.Equal(t, entries[0].Provider.String(), lines[0]["provider"])
+	require.Equal(t, map[string]any{"operation": "remove-provider", "outcome": "rejected", "error": "unauthorized", "time": now.UTC().Format(time.RFC3339)}, lines[1])
+}
+
+func TestLog(t *testing.T) {
+	ctx := context.Background()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	l := testutil.Must(audit.NewLog(ds))(t)
+	start := time.Now().Truncate(time.Second)
+	var entries []types.AuditEntry
+	for i := range 10 {
+		outcome := types.AuditSucceeded
+		if i%2 == 1 {
+			outcome = types.AuditFailed
+		}
+		entry := randomEntry(t, types.AuditPublish, outcome, start.Add(time.Duration(i)*time.Minute))
+		require.NoError(t, l.Record(ctx, entry))
+		entries = append(entries, entry)
+	}
+
+	t.Run("entries are read back in order", func(t *testing.T) {
+		read, cursor := testutil.Must2(l.AuditLog(ctx, types.AuditFilter{}, ""))(t)
+		require.Equal(t, entries, read)
+		require.Empty(t, cursor)
+	})
+
+	t.Run("filters", func(t *testing.T) {
+		testCases := []struct {
+			name   string
+			filter types.AuditFilter
+			want   []types.AuditEntry
+		}{
+			{"outcome", types.AuditFilter{Outcome: types.AuditFailed}, []types.AuditEntry{entries[1], entries[3], entries[5], entries[7], entries[9]}},
+			{"actor", types.AuditFilter{Actor: entries[4].Actor}, []types.AuditEntry{entries[4]}},
+			{"operation", types.AuditFilter{Operation: types.AuditCache}, nil},
+			{"time", types.AuditFilter{Since: entries[2].Time, Until: entries[5].Time}, entries[2:5]},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				read, _ := testutil.Must2(l.AuditLog(ctx, tc.filter, ""))(t)
+				require.Equal(t, tc.want, read)
+			})
+		}
+	})
+
+	t.Run("pages", func(t *testing.T) {
+		var read []types.AuditEntry
+		cursor := ""
+		for pages := 1; ; pages++ {
+			page, next := testutil.Must2(l.AuditLog(ctx, types.AuditFilter{Outcome: types.AuditSucceeded, Limit: 2}, cursor))(t)
+			read = append(read, page...)
+			if next == "" {
+				require.Equal(t, 3, pages)
+				break
+			}
+			cursor = next
+		}
+		require.Equal(t, []types.AuditEntry{entries[0], entries[2], entries[4], entries[6], entries[8]}, read)
+
+		_, _, err := l.AuditLog(ctx, types.AuditFilter{}, "not a cursor")
+		require.ErrorIs(t, err, types.ErrInvalidCursor)
+	})
+
+	t.Run("reopened logs append after their last entry", func(t *testing.T) {
+		reopened := testutil.Must(audit.NewLog(ds))(t)
+		entry := randomEntry(t, types.AuditCache, types.AuditSucceeded, start.Add(time.Hour))
+		require.NoError(t, reopened.Record(ctx, entry))
+		read, _ := testutil.Must2(reopened.AuditLog(ctx, types.AuditFilter{Limit: audit.MaxLimit}, ""))(t)
+		require.Len(t, read, 11)
+		require.Equal(t, entry, read[10])
+	})
+}
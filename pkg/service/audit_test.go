@@ -0,0 +1,74 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+type removableProviderIndex struct {
+	service.ProviderIndex
+	err error
+}
+
+func (m *removableProviderIndex) RemoveProvider(ctx context.Context, provider peer.ID, opts ...providerindex.RemoveOption) error {
+	return m.err
+}
+
+type recordingAuditSink struct {
+	entries []types.AuditEntry
+	err     error
+}
+
+func (m *recordingAuditSink) Record(ctx context.Context, entry types.AuditEntry) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.entries = append(m.entries, entry)
+	return nil
+}
+
+func TestIndexingService__Audit(t *testing.T) {
+	provider := testutil.RandomPeer()
+	ctx := types.WithAuditActor(context.Background(), "did:key:actor")
+
+	t.Run("operations are audited as made by the actor of the context", func(t *testing.T) {
+		sink := &recordingAuditSink{}
+		is := testutil.Must(service.NewIndexingService(nil, nil, &removableProviderIndex{}, service.WithAuditSinks(sink)))(t)
+		require.NoError(t, is.RemoveProvider(ctx, provider, nil))
+		require.Len(t, sink.entries, 1)
+		require.Equal(t, types.AuditRemoveProvider, sink.entries[0].Operation)
+		require.Equal(t, "did:key:actor", sink.entries[0].Actor)
+		require.Equal(t, provider, *sink.entries[0].Provider)
+		require.Equal(t, types.AuditSucceeded, sink.entries[0].Outcome)
+		require.False(t, sink.entries[0].Time.IsZero())
+	})
+
+	t.Run("failures are audited with their error", func(t *testing.T) {
+		sink := &recordingAuditSink{}
+		removalErr := errors.New("sweep failed")
+		is := testutil.Must(service.NewIndexingService(nil, nil, &removableProviderIndex{err: removalErr}, service.WithAuditSinks(sink)))(t)
+		require.ErrorIs(t, is.RemoveProvider(ctx, provider, nil), removalErr)
+		require.Equal(t, types.AuditFailed, sink.entries[0].Outcome)
+		require.Equal(t, "sweep failed", sink.entries[0].Error)
+
+		claim := testutil.RandomLocationDelegation()
+		require.Error(t, is.CacheClaim(ctx, claim))
+		require.Equal(t, types.AuditCache, sink.entries[1].Operation)
+		require.Equal(t, claim.Link().String(), sink.entries[1].Claim.String())
+		require.Equal(t, types.AuditFailed, sink.entries[1].Outcome)
+	})
+
+	t.Run("operations aren't acknowledged until audited", func(t *testing.T) {
+		sinkErr := errors.New("disk full")
+		is := testutil.Must(service.NewIndexingService(nil, nil, &removableProviderIndex{}, service.WithAuditSinks(&recordingAuditSink{err: sinkErr})))(t)
+		require.ErrorIs(t, is.RemoveProvider(ctx, provider, nil), sinkErr)
+	})
+}
@@ -0,0 +1,150 @@
+// Package blobindexlookuptest is a conformance suite for
+// service.BlobIndexLookup implementations.
+//
+// An implementation passes the suite when it:
+//   - reads indexes from its cache by context ID before fetching them from the
+//     URL, and caches the indexes it fetches
+//   - fetches only the range of the blob asked for, when one is given
+//   - fails with types.ErrOriginNotFound when the origin doesn't have the
+//     index, and fetches it again once it does
+//   - fails with types.ErrOriginUnavailable when the origin fails or can't be
+//     reached
+//   - fails with types.ErrCacheOnly, without fetching, for indexes it hasn't
+//     cached under a context made with types.WithCacheOnly
+//   - returns the context error when the context is cancelled
+//   - answers the full IndexingService.Query walk
+//
+// Implementations run the suite from their tests:
+//
+//	blobindexlookuptest.RunConformance(t, func() service.BlobIndexLookup {
+//		return blobindexlookup.WithCache(blobindexlookup.NewBlobIndexLookup(http.DefaultClient), store, queue)
+//	})
+package blobindexlookuptest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/internal/conformance"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns a new blob index lookup, with an empty cache
+type Factory func() service.BlobIndexLookup
+
+// serveIndex serves a new index from the origin, returning it, the context ID
+// to look it up by and its URL
+func serveIndex(t *testing.T, origin *conformance.Origin) (blobindex.ShardedDagIndexView, types.EncodedContextID, url.URL) {
+	_, index := testutil.RandomShardedDagIndexView(8)
+	contextID := testutil.RandomMultihash()
+	return index, types.EncodedContextID(contextID), origin.Serve(t, "/"+contextID.B58String(), archive(t, index))
+}
+
+func archive(t *testing.T, index blobindex.ShardedDagIndexView) []byte {
+	return testutil.Must(io.ReadAll(testutil.Must(blobindex.Archive(index))(t)))(t)
+}
+
+// RunConformance runs the conformance suite against the blob index lookups
+// returned by newLookup
+func RunConformance(t *testing.T, newLookup Factory) {
+	ctx := context.Background()
+	provider := testutil.RandomProviderResult()
+	find := func(t *testing.T, bl service.BlobIndexLookup, contextID types.EncodedContextID, fetchURL url.URL) blobindex.ShardedDagIndexView {
+		return testutil.Must(bl.Find(ctx, contextID, provider, fetchURL, nil))(t)
+	}
+
+	t.Run("reads the cache before the origin", func(t *testing.T) {
+		origin := conformance.NewOrigin(t)
+		bl := newLookup()
+		index, contextID, fetchURL := serveIndex(t, origin)
+		for range 2 {
+			testutil.RequireEqualIndex(t, index, find(t, bl, contextID, fetchURL))
+		}
+		require.Equal(t, 1, origin.Requests())
+
+		t.Run("while the origin is down", func(t *testing.T) {
+			origin.Fail(http.StatusServiceUnavailable)
+			testutil.RequireEqualIndex(t, index, find(t, bl, contextID, fetchURL))
+		})
+	})
+
+	t.Run("fetches the range asked for", func(t *testing.T) {
+		origin := conformance.NewOrigin(t)
+		bl := newLookup()
+		_, index := testutil.RandomShardedDagIndexView(8)
+		data := archive(t, index)
+		prefix := testutil.RandomBytes(100)
+		blob := append(append(prefix, data...), testutil.RandomBytes(100)...)
+		length := uint64(len(data))
+		fetchURL := origin.Serve(t, "/blob", blob)
+		found := testutil.Must(bl.Find(ctx, types.EncodedContextID(testutil.RandomMultihash()), provider, fetchURL, &metadata.Range{Offset: uint64(len(prefix)), Length: &length}))(t)
+		testutil.RequireEqualIndex(t, index, found)
+	})
+
+	t.Run("classifies missing indexes", func(t *testing.T) {
+		origin := conformance.NewOrigin(t)
+		bl := newLookup()
+		_, index := testutil.RandomShardedDagIndexView(8)
+		contextID := types.EncodedContextID(testutil.RandomMultihash())
+		fetchURL := origin.URL(t, "/missing")
+		_, err := bl.Find(ctx, contextID, provider, fetchURL, nil)
+		require.ErrorIs(t, err, types.ErrOriginNotFound)
+		require.NotErrorIs(t, err, types.ErrOriginUnavailable)
+		// that the index wasn't found isn't cached
+		origin.Serve(t, fetchURL.Path, archive(t, index))
+		testutil.RequireEqualIndex(t, index, find(t, bl, contextID, fetchURL))
+	})
+
+	t.Run("classifies origin failures", func(t *testing.T) {
+		origin := conformance.NewOrigin(t)
+		bl := newLookup()
+		index, contextID, fetchURL := serveIndex(t, origin)
+		origin.Fail(http.StatusInternalServerError)
+		_, err := bl.Find(ctx, contextID, provider, fetchURL, nil)
+		require.ErrorIs(t, err, types.ErrOriginUnavailable)
+		require.NotErrorIs(t, err, types.ErrOriginNotFound)
+		_, err = bl.Find(ctx, types.EncodedContextID(testutil.RandomMultihash()), provider, conformance.UnreachableURL(t), nil)
+		require.ErrorIs(t, err, types.ErrOriginUnavailable)
+		// failures aren't cached
+		origin.Fail(0)
+		testutil.RequireEqualIndex(t, index, find(t, bl, contextID, fetchURL))
+	})
+
+	t.Run("only reads the cache when lookups are cache only", func(t *testing.T) {
+		origin := conformance.NewOrigin(t)
+		bl := newLookup()
+		cached, cachedID, cachedURL := serveIndex(t, origin)
+		find(t, bl, cachedID, cachedURL)
+		_, uncachedID, uncachedURL := serveIndex(t, origin)
+		cacheOnly := types.WithCacheOnly(ctx)
+		_, err := bl.Find(cacheOnly, uncachedID, provider, uncachedURL, nil)
+		require.ErrorIs(t, err, types.ErrCacheOnly)
+		testutil.RequireEqualIndex(t, cached, testutil.Must(bl.Find(cacheOnly, cachedID, provider, cachedURL, nil))(t))
+		require.Equal(t, 1, origin.Requests())
+	})
+
+	t.Run("stops when the context is cancelled", func(t *testing.T) {
+		origin := conformance.NewOrigin(t)
+		bl := newLookup()
+		_, contextID, fetchURL := serveIndex(t, origin)
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := bl.Find(cctx, contextID, provider, fetchURL, nil)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("answers the query walk", func(t *testing.T) {
+		s := conformance.NewScenario(t)
+		is := testutil.Must(service.NewIndexingService(newLookup(), claimlookup.NewClaimLookup(http.DefaultClient), conformance.NewProviderIndex(s.Finder())))(t)
+		s.Query(t, is)
+	})
+}
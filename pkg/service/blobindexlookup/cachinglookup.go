@@ -1,41 +1,150 @@
 package blobindexlookup
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
+	"time"
 
+	lru "github.com/hashicorp/golang-lru/v2"
+	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipni/go-libipni/find/model"
+	mh "github.com/multiformats/go-multihash"
 	"github.com/storacha/indexing-service/pkg/blobindex"
 	"github.com/storacha/indexing-service/pkg/metadata"
 	"github.com/storacha/indexing-service/pkg/types"
 )
 
-// CachingQueue can queue a provider record to be cached for all CIDs in an index
+var log = logging.Logger("blobindexlookup")
+
+const (
+	// DefaultUnsupportedVersionTTL is how long an index of a version that can't
+	// be read is remembered, when not otherwise configured
+	DefaultUnsupportedVersionTTL = time.Minute
+	// unsupportedIndexes is the most indexes of versions that can't be read that
+	// are remembered
+	unsupportedIndexes = 10_000
+)
+
+// unsupportedIndex is an index found to be of a version that can't be read,
+// which fails again without being fetched until it expires
+type unsupportedIndex struct {
+	err     blobindex.ErrUnsupportedIndexVersion
+	expires time.Time
+}
+
+// CachingQueue can queue a provider record to be cached for all CIDs in an
+// index, which is cached under the given context ID
 type CachingQueue interface {
-	QueueProviderCaching(ctx context.Context, provider model.ProviderResult, index blobindex.ShardedDagIndexView) error
+	QueueProviderCaching(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, index blobindex.ShardedDagIndexView) error
 }
 
 type cachingLookup struct {
 	blobIndexLookup    BlobIndexLookup
 	shardDagIndexCache types.ShardedDagIndexStore
 	cachingQueue       CachingQueue
+	shardFilterCache   types.ShardFilterStore
+	falsePositiveRate  float64
+	blobCache          types.IndexBlobStore
+	digestCache        types.IndexDigestStore
+	metrics            types.CacheMetrics
+	unsupportedTTL     time.Duration
+	unsupported        *lru.Cache[string, unsupportedIndex]
+	now                func() time.Time
+}
+
+// Option configures a caching lookup
+type Option func(*cachingLookup)
+
+// WithShardFilters caches the shard filters of each fetched index with at least
+// blobindex.ShardFilterMinSlices slices alongside it, built at the given false
+// positive rate. A rate of zero uses blobindex.DefaultShardFilterFalsePositiveRate
+func WithShardFilters(cache types.ShardFilterStore, falsePositiveRate float64) Option {
+	return func(b *cachingLookup) {
+		b.shardFilterCache = cache
+		b.falsePositiveRate = falsePositiveRate
+	}
+}
+
+// WithSharedBlobs caches each fetched index once by the digest of its blob, with
+// the digest cached for each context ID it is fetched for, so an index
+// referenced from several context IDs, such as from several spaces, is stored
+// once. When the digest of the blob is known before fetching, from
+// WithIndexDigest, and the blob is cached, it isn't fetched again. Indexes
+// already cached by context ID are still read, but fetched indexes are no longer
+// cached that way
+func WithSharedBlobs(blobs types.IndexBlobStore, digests types.IndexDigestStore) Option {
+	return func(b *cachingLookup) {
+		b.blobCache = blobs
+		b.digestCache = digests
+	}
+}
+
+// WithMetrics reports whether each read of the index cache found the index
+func WithMetrics(m types.CacheMetrics) Option {
+	return func(b *cachingLookup) {
+		b.metrics = m
+	}
+}
+
+// WithUnsupportedVersionTTL sets how long an index found to be of a version that
+// can't be read is remembered, failing again with
+// blobindex.ErrUnsupportedIndexVersion without being fetched. Zero uses
+// DefaultUnsupportedVersionTTL, and a negative TTL remembers none
+func WithUnsupportedVersionTTL(ttl time.Duration) Option {
+	return func(b *cachingLookup) {
+		b.unsupportedTTL = ttl
+	}
+}
+
+// WithClock sets the function the lookup reads the time from, for expiring the
+// indexes of versions that can't be read. If not set, time.Now is used
+func WithClock(now func() time.Time) Option {
+	return func(b *cachingLookup) {
+		b.now = now
+	}
 }
 
 // WithCache returns a blobIndexLookup that attempts to read blobs from the cache, and also caches providers asociated with index cids
-func WithCache(blobIndexLookup BlobIndexLookup, shardedDagIndexCache types.ShardedDagIndexStore, cachingQueue CachingQueue) BlobIndexLookup {
-	return &cachingLookup{
+func WithCache(blobIndexLookup BlobIndexLookup, shardedDagIndexCache types.ShardedDagIndexStore, cachingQueue CachingQueue, opts ...Option) BlobIndexLookup {
+	b := &cachingLookup{
 		blobIndexLookup:    blobIndexLookup,
 		shardDagIndexCache: shardedDagIndexCache,
 		cachingQueue:       cachingQueue,
+		metrics:            types.NoopCacheMetrics{},
+		now:                time.Now,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.falsePositiveRate == 0 {
+		b.falsePositiveRate = blobindex.DefaultShardFilterFalsePositiveRate
+	}
+	if b.unsupportedTTL == 0 {
+		b.unsupportedTTL = DefaultUnsupportedVersionTTL
+	}
+	if b.unsupportedTTL > 0 {
+		unsupported, err := lru.New[string, unsupportedIndex](unsupportedIndexes)
+		if err != nil {
+			panic(err)
+		}
+		b.unsupported = unsupported
 	}
+	return b
 }
 
 func (b *cachingLookup) Find(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, fetchURL url.URL, rng *metadata.Range) (blobindex.ShardedDagIndexView, error) {
+	if b.blobCache != nil {
+		return b.findShared(ctx, contextID, provider, fetchURL, rng)
+	}
 	// attempt to read index from cache and return it if succesful
 	index, err := b.shardDagIndexCache.Get(ctx, contextID)
 	if err == nil {
+		types.CacheRead(ctx, b.metrics, types.IndexesCache, true)
 		return index, nil
 	}
 
@@ -43,10 +152,15 @@ func (b *cachingLookup) Find(ctx context.Context, contextID types.EncodedContext
 	if !errors.Is(err, types.ErrKeyNotFound) {
 		return nil, fmt.Errorf("reading from index cache: %w", err)
 	}
+	types.CacheRead(ctx, b.metrics, types.IndexesCache, false)
+	if err := b.knownUnsupported(contextID); err != nil {
+		return nil, fmt.Errorf("fetching underlying index: %w", err)
+	}
 
 	// attempt to fetch the index from the underlying blob index lookup
 	index, err = b.blobIndexLookup.Find(ctx, contextID, provider, fetchURL, rng)
 	if err != nil {
+		b.rememberUnsupported(contextID, fetchURL, err)
 		return nil, fmt.Errorf("fetching underlying index: %w", err)
 	}
 
@@ -54,11 +168,166 @@ func (b *cachingLookup) Find(ctx context.Context, contextID types.EncodedContext
 	if err := b.shardDagIndexCache.Set(ctx, contextID, index, true); err != nil {
 		return nil, fmt.Errorf("caching fetched index: %w", err)
 	}
+	b.cacheShardFilters(ctx, contextID, index)
 
 	// queue a background cache of an provider record for all cids in the index without one
-	if err := b.cachingQueue.QueueProviderCaching(ctx, provider, index); err != nil {
+	if err := b.cachingQueue.QueueProviderCaching(ctx, contextID, provider, index); err != nil {
 		return nil, fmt.Errorf("queueing provider caching for index failed: %w", err)
 	}
 
 	return index, nil
 }
+
+// findShared finds an index with shared blobs: through the digest cached for
+// the context ID, then the index cached by context ID from before blobs were
+// shared, then the digest the index is known by before fetching. Only if none
+// of them have it is the index fetched
+func (b *cachingLookup) findShared(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, fetchURL url.URL, rng *metadata.Range) (blobindex.ShardedDagIndexView, error) {
+	digest, err := b.digestCache.Get(ctx, contextID)
+	if err == nil {
+		index, err := b.blobCache.Get(ctx, digest)
+		if err == nil {
+			types.CacheRead(ctx, b.metrics, types.IndexesCache, true)
+			return index, nil
+		}
+		// a blob evicted since leaves the digest dangling until it is fetched again
+		if !errors.Is(err, types.ErrKeyNotFound) {
+			return nil, fmt.Errorf("reading from index blob cache: %w", err)
+		}
+	} else if !errors.Is(err, types.ErrKeyNotFound) {
+		return nil, fmt.Errorf("reading from index digest cache: %w", err)
+	}
+	index, err := b.shardDagIndexCache.Get(ctx, contextID)
+	if err == nil {
+		types.CacheRead(ctx, b.metrics, types.IndexesCache, true)
+		return index, nil
+	}
+	if !errors.Is(err, types.ErrKeyNotFound) {
+		return nil, fmt.Errorf("reading from index cache: %w", err)
+	}
+
+	known := IndexDigest(ctx)
+	if known != nil {
+		index, err := b.blobCache.Get(ctx, known)
+		if err == nil {
+			// the index is cached for another context ID, and only needs to be
+			// for this one too
+			types.CacheRead(ctx, b.metrics, types.IndexesCache, true)
+			if err := b.digestCache.Set(ctx, contextID, known, true); err != nil {
+				return nil, fmt.Errorf("caching index digest: %w", err)
+			}
+			if err := b.cached(ctx, contextID, provider, index); err != nil {
+				return nil, err
+			}
+			return index, nil
+		}
+		if !errors.Is(err, types.ErrKeyNotFound) {
+			return nil, fmt.Errorf("reading from index blob cache: %w", err)
+		}
+	}
+	types.CacheRead(ctx, b.metrics, types.IndexesCache, false)
+	if err := b.knownUnsupported(contextID); err != nil {
+		return nil, fmt.Errorf("fetching underlying index: %w", err)
+	}
+
+	index, digest, err = b.fetchDigest(ctx, contextID, provider, fetchURL, rng)
+	if err != nil {
+		b.rememberUnsupported(contextID, fetchURL, err)
+		return nil, fmt.Errorf("fetching underlying index: %w", err)
+	}
+	if known != nil && !bytes.Equal(known, digest) {
+		log.Warnw("index blob digest differs from the one it is known by", "known", known, "fetched", digest)
+	}
+	if err := b.blobCache.Set(ctx, digest, index, true); err != nil {
+		return nil, fmt.Errorf("caching fetched index: %w", err)
+	}
+	if err := b.digestCache.Set(ctx, contextID, digest, true); err != nil {
+		return nil, fmt.Errorf("caching index digest: %w", err)
+	}
+	if err := b.cached(ctx, contextID, provider, index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// fetchDigest fetches the index with the underlying lookup, along with the
+// digest of its blob. Lookups that can't say what the blob was have the index
+// archived again to find it
+func (b *cachingLookup) fetchDigest(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, fetchURL url.URL, rng *metadata.Range) (blobindex.ShardedDagIndexView, mh.Multihash, error) {
+	if dl, ok := b.blobIndexLookup.(DigestLookup); ok {
+		return dl.FindDigest(ctx, contextID, provider, fetchURL, rng)
+	}
+	index, err := b.blobIndexLookup.Find(ctx, contextID, provider, fetchURL, rng)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := index.Archive()
+	if err != nil {
+		return nil, nil, fmt.Errorf("archiving index: %w", err)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, nil, fmt.Errorf("archiving index: %w", err)
+	}
+	digest, err := mh.Encode(h.Sum(nil), mh.SHA2_256)
+	if err != nil {
+		return nil, nil, err
+	}
+	return index, digest, nil
+}
+
+// knownUnsupported returns the error the index for the context ID last failed
+// with for being of a version that can't be read, until it expires
+func (b *cachingLookup) knownUnsupported(contextID types.EncodedContextID) error {
+	if b.unsupported == nil {
+		return nil
+	}
+	known, ok := b.unsupported.Get(string(contextID))
+	if !ok {
+		return nil
+	}
+	if !b.now().Before(known.expires) {
+		b.unsupported.Remove(string(contextID))
+		return nil
+	}
+	return known.err
+}
+
+// rememberUnsupported remembers the index for the context ID if the fetch
+// failed for it being of a version that can't be read, so that it isn't
+// fetched again for a while. Operators are told, as reading it takes an upgrade
+func (b *cachingLookup) rememberUnsupported(contextID types.EncodedContextID, fetchURL url.URL, err error) {
+	var unsupported blobindex.ErrUnsupportedIndexVersion
+	if b.unsupported == nil || !errors.As(err, &unsupported) {
+		return
+	}
+	log.Warnw("index version unsupported, upgrade the indexing service to read it", "url", fetchURL.Redacted(), "version", unsupported.Found, "supported", unsupported.Supported)
+	b.unsupported.Add(string(contextID), unsupportedIndex{err: unsupported, expires: b.now().Add(b.unsupportedTTL)})
+}
+
+// cached does what follows caching an index for a context ID: caching its shard
+// filters, and queueing the caching of provider records for its CIDs
+func (b *cachingLookup) cached(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, index blobindex.ShardedDagIndexView) error {
+	b.cacheShardFilters(ctx, contextID, index)
+	if err := b.cachingQueue.QueueProviderCaching(ctx, contextID, provider, index); err != nil {
+		return fmt.Errorf("queueing provider caching for index failed: %w", err)
+	}
+	return nil
+}
+
+// cacheShardFilters caches the shard filters of a large index that was just
+// fetched, replacing any built for an earlier fetch. Failures are logged and
+// otherwise ignored, as the index can be searched without them
+func (b *cachingLookup) cacheShardFilters(ctx context.Context, contextID types.EncodedContextID, index blobindex.ShardedDagIndexView) {
+	if b.shardFilterCache == nil || blobindex.SliceCount(index) < blobindex.ShardFilterMinSlices {
+		return
+	}
+	filters, err := blobindex.NewShardFilters(index, b.falsePositiveRate)
+	if err != nil {
+		log.Warnw("building shard filters", "error", err)
+		return
+	}
+	if err := b.shardFilterCache.Set(ctx, contextID, filters, true); err != nil {
+		log.Warnw("caching shard filters", "error", err)
+	}
+}
@@ -4,10 +4,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
 	"github.com/storacha/indexing-service/pkg/blobindex"
 	"github.com/storacha/indexing-service/pkg/internal/testutil"
 	"github.com/storacha/indexing-service/pkg/metadata"
@@ -189,6 +197,239 @@ type mockCachingQueue struct {
 }
 
 // QueueProviderCaching implements blobindexlookup.ProviderCacher.
-func (m *mockCachingQueue) QueueProviderCaching(ctx context.Context, provider model.ProviderResult, index blobindex.ShardedDagIndexView) error {
+func (m *mockCachingQueue) QueueProviderCaching(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, index blobindex.ShardedDagIndexView) error {
 	return m.err
 }
+
+func TestWithCache__ShardFilters(t *testing.T) {
+	_, small := testutil.RandomShardedDagIndexView(32)
+	large := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 10)
+	for range 10 {
+		shard := testutil.RandomMultihash()
+		for range blobindex.ShardFilterMinSlices / 10 {
+			large.SetSlice(shard, testutil.RandomMultihash(), blobindex.Position{Offset: 0, Length: 10})
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		index    blobindex.ShardedDagIndexView
+		expected bool
+	}{
+		{name: "large index", index: large, expected: true},
+		{name: "small index", index: small, expected: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			contextID := testutil.RandomBytes(16)
+			filterStore := &mockShardFilterStore{filters: map[string]*blobindex.ShardFilters{}}
+			cl := blobindexlookup.WithCache(
+				&mockBlobIndexLookup{tc.index, nil},
+				&MockShardedDagIndexStore{indexes: map[string]blobindex.ShardedDagIndexView{}},
+				&mockCachingQueue{nil},
+				blobindexlookup.WithShardFilters(filterStore, 0.01),
+			)
+
+			_, err := cl.Find(context.Background(), contextID, testutil.RandomProviderResult(), *testutil.TestURL, nil)
+			require.NoError(t, err)
+			filters, ok := filterStore.filters[string(contextID)]
+			require.Equal(t, tc.expected, ok)
+			if ok {
+				require.NoError(t, filters.Check(tc.index))
+			}
+		})
+	}
+}
+
+type mockShardFilterStore struct {
+	filters map[string]*blobindex.ShardFilters
+}
+
+func (m *mockShardFilterStore) Get(ctx context.Context, contextID types.EncodedContextID) (*blobindex.ShardFilters, error) {
+	filters, ok := m.filters[string(contextID)]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return filters, nil
+}
+
+func (m *mockShardFilterStore) Set(ctx context.Context, contextID types.EncodedContextID, filters *blobindex.ShardFilters, expires bool) error {
+	m.filters[string(contextID)] = filters
+	return nil
+}
+
+func (m *mockShardFilterStore) SetExpirable(ctx context.Context, contextID types.EncodedContextID, expires bool) error {
+	return nil
+}
+
+func TestWithCache__SharedBlobs(t *testing.T) {
+	_, index := testutil.RandomShardedDagIndexView(32)
+	blob := testutil.Must(io.ReadAll(testutil.Must(index.Archive())(t)))(t)
+	digest := testutil.Must(multihash.Sum(blob, multihash.SHA2_256, -1))(t)
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write(blob)
+	}))
+	defer server.Close()
+	fetchURL := *testutil.Must(url.Parse(server.URL))(t)
+	provider := testutil.RandomProviderResult()
+
+	type sharedLookup struct {
+		blobindexlookup.BlobIndexLookup
+		blobs   *mapCache[multihash.Multihash, blobindex.ShardedDagIndexView]
+		digests *mapCache[types.EncodedContextID, multihash.Multihash]
+		queued  *recordingCachingQueue
+	}
+	newLookup := func() sharedLookup {
+		fetches.Store(0)
+		l := sharedLookup{
+			blobs:   &mapCache[multihash.Multihash, blobindex.ShardedDagIndexView]{values: map[string]blobindex.ShardedDagIndexView{}},
+			digests: &mapCache[types.EncodedContextID, multihash.Multihash]{values: map[string]multihash.Multihash{}},
+			queued:  &recordingCachingQueue{},
+		}
+		l.BlobIndexLookup = blobindexlookup.WithCache(
+			blobindexlookup.NewBlobIndexLookup(server.Client()),
+			&MockShardedDagIndexStore{indexes: map[string]blobindex.ShardedDagIndexView{}},
+			l.queued,
+			blobindexlookup.WithSharedBlobs(l.blobs, l.digests),
+		)
+		return l
+	}
+	find := func(t *testing.T, ctx context.Context, l sharedLookup, contextID types.EncodedContextID) {
+		found := testutil.Must(l.Find(ctx, contextID, provider, fetchURL, nil))(t)
+		testutil.RequireEqualIndex(t, index, found)
+	}
+	contextA, contextB := types.EncodedContextID(testutil.RandomBytes(16)), types.EncodedContextID(testutil.RandomBytes(16))
+
+	t.Run("context IDs with the same digest share the blob", func(t *testing.T) {
+		l := newLookup()
+		ctx := blobindexlookup.WithIndexDigest(context.Background(), digest)
+		find(t, ctx, l, contextA)
+		find(t, ctx, l, contextB)
+		find(t, ctx, l, contextB)
+		require.Equal(t, int32(1), fetches.Load())
+		require.Len(t, l.blobs.values, 1)
+		require.Contains(t, l.blobs.values, string(digest))
+		require.Equal(t, map[string]multihash.Multihash{string(contextA): digest, string(contextB): digest}, l.digests.values)
+		// provider records are cached for each context ID
+		require.Equal(t, []types.EncodedContextID{contextA, contextB}, l.queued.contextIDs)
+	})
+
+	t.Run("digests are of the fetched bytes", func(t *testing.T) {
+		l := newLookup()
+		find(t, context.Background(), l, contextA)
+		find(t, context.Background(), l, contextB)
+		// without knowing the digest first each context ID is fetched, but the
+		// blob is cached once
+		require.Equal(t, int32(2), fetches.Load())
+		require.Len(t, l.blobs.values, 1)
+		require.Equal(t, digest, l.digests.values[string(contextB)])
+
+		// a digest known wrongly is corrected by the one fetched
+		l = newLookup()
+		find(t, blobindexlookup.WithIndexDigest(context.Background(), testutil.RandomMultihash()), l, contextA)
+		require.Equal(t, map[string]multihash.Multihash{string(contextA): digest}, l.digests.values)
+		require.Contains(t, l.blobs.values, string(digest))
+	})
+
+	t.Run("evicted blobs are fetched again", func(t *testing.T) {
+		l := newLookup()
+		ctx := blobindexlookup.WithIndexDigest(context.Background(), digest)
+		find(t, ctx, l, contextA)
+		find(t, ctx, l, contextB)
+		delete(l.blobs.values, string(digest))
+
+		find(t, ctx, l, contextB)
+		require.Equal(t, int32(2), fetches.Load())
+		require.Contains(t, l.blobs.values, string(digest))
+		// the other context ID reads the blob fetched again
+		find(t, ctx, l, contextA)
+		require.Equal(t, int32(2), fetches.Load())
+	})
+}
+
+type mapCache[K ~[]byte, V any] struct {
+	values map[string]V
+}
+
+func (m *mapCache[K, V]) Get(ctx context.Context, key K) (V, error) {
+	v, ok := m.values[string(key)]
+	if !ok {
+		return v, types.ErrKeyNotFound
+	}
+	return v, nil
+}
+
+func (m *mapCache[K, V]) Set(ctx context.Context, key K, value V, expires bool) error {
+	m.values[string(key)] = value
+	return nil
+}
+
+func (m *mapCache[K, V]) SetExpirable(ctx context.Context, key K, expires bool) error {
+	return nil
+}
+
+type recordingCachingQueue struct {
+	contextIDs []types.EncodedContextID
+}
+
+func (m *recordingCachingQueue) QueueProviderCaching(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, index blobindex.ShardedDagIndexView) error {
+	m.contextIDs = append(m.contextIDs, contextID)
+	return nil
+}
+
+func TestWithCache__UnsupportedVersion(t *testing.T) {
+	blob := testutil.Must(os.ReadFile(filepath.Join("..", "..", "blobindex", "testdata", "index-v0.2.car")))(t)
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write(blob)
+	}))
+	defer server.Close()
+	fetchURL := *testutil.Must(url.Parse(server.URL))(t)
+	provider := testutil.RandomProviderResult()
+	contextID := types.EncodedContextID(testutil.RandomBytes(16))
+	find := func(t *testing.T, l blobindexlookup.BlobIndexLookup) {
+		_, err := l.Find(context.Background(), contextID, provider, fetchURL, nil)
+		var unsupported blobindex.ErrUnsupportedIndexVersion
+		require.ErrorAs(t, err, &unsupported)
+		require.Equal(t, "0.2", unsupported.Found)
+	}
+
+	t.Run("indexes of unsupported versions aren't fetched again until they expire", func(t *testing.T) {
+		fetches.Store(0)
+		now := time.Now()
+		l := blobindexlookup.WithCache(
+			blobindexlookup.NewBlobIndexLookup(server.Client()),
+			&MockShardedDagIndexStore{indexes: map[string]blobindex.ShardedDagIndexView{}},
+			&recordingCachingQueue{},
+			blobindexlookup.WithUnsupportedVersionTTL(time.Minute),
+			blobindexlookup.WithClock(func() time.Time { return now }),
+		)
+		find(t, l)
+		find(t, l)
+		require.Equal(t, int32(1), fetches.Load())
+
+		now = now.Add(time.Minute)
+		find(t, l)
+		require.Equal(t, int32(2), fetches.Load())
+	})
+
+	t.Run("a negative TTL remembers none", func(t *testing.T) {
+		fetches.Store(0)
+		l := blobindexlookup.WithCache(
+			blobindexlookup.NewBlobIndexLookup(server.Client()),
+			&MockShardedDagIndexStore{indexes: map[string]blobindex.ShardedDagIndexView{}},
+			&recordingCachingQueue{},
+			blobindexlookup.WithSharedBlobs(
+				&mapCache[multihash.Multihash, blobindex.ShardedDagIndexView]{values: map[string]blobindex.ShardedDagIndexView{}},
+				&mapCache[types.EncodedContextID, multihash.Multihash]{values: map[string]multihash.Multihash{}},
+			),
+			blobindexlookup.WithUnsupportedVersionTTL(-1),
+		)
+		find(t, l)
+		find(t, l)
+		require.Equal(t, int32(2), fetches.Load())
+	})
+}
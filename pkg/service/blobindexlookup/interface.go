@@ -5,6 +5,7 @@ import (
 	"net/url"
 
 	"github.com/ipni/go-libipni/find/model"
+	mh "github.com/multiformats/go-multihash"
 	"github.com/storacha/indexing-service/pkg/blobindex"
 	"github.com/storacha/indexing-service/pkg/metadata"
 	"github.com/storacha/indexing-service/pkg/types"
@@ -13,3 +14,26 @@ import (
 type BlobIndexLookup interface {
 	Find(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, fetchURL url.URL, rng *metadata.Range) (blobindex.ShardedDagIndexView, error)
 }
+
+// DigestLookup is implemented by lookups that can also return the sha2-256
+// digest of the bytes the index was decoded from
+type DigestLookup interface {
+	FindDigest(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, fetchURL url.URL, rng *metadata.Range) (blobindex.ShardedDagIndexView, mh.Multihash, error)
+}
+
+type indexDigestKey struct{}
+
+// WithIndexDigest returns a context telling lookups the digest of the index blob
+// about to be looked up, when it is known before fetching, such as from the
+// location commitment for the blob. A caching lookup holding the blob for
+// another context ID needn't fetch it again
+func WithIndexDigest(ctx context.Context, digest mh.Multihash) context.Context {
+	return context.WithValue(ctx, indexDigestKey{}, digest)
+}
+
+// IndexDigest returns the digest of the index blob set with WithIndexDigest, or
+// nil if there isn't one
+func IndexDigest(ctx context.Context) mh.Multihash {
+	digest, _ := ctx.Value(indexDigestKey{}).(mh.Multihash)
+	return digest
+}
@@ -2,6 +2,7 @@ package blobindexlookup
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 	"strconv"
 
 	"github.com/ipni/go-libipni/find/model"
+	mh "github.com/multiformats/go-multihash"
 	"github.com/storacha/indexing-service/pkg/blobindex"
 	"github.com/storacha/indexing-service/pkg/metadata"
 	"github.com/storacha/indexing-service/pkg/types"
@@ -23,7 +25,18 @@ func NewBlobIndexLookup(httpClient *http.Client) BlobIndexLookup {
 }
 
 // Find fetches the blob index from the given fetchURL
-func (s *simpleLookup) Find(ctx context.Context, _ types.EncodedContextID, _ model.ProviderResult, fetchURL url.URL, rng *metadata.Range) (blobindex.ShardedDagIndexView, error) {
+func (s *simpleLookup) Find(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, fetchURL url.URL, rng *metadata.Range) (blobindex.ShardedDagIndexView, error) {
+	index, _, err := s.FindDigest(ctx, contextID, provider, fetchURL, rng)
+	return index, err
+}
+
+// FindDigest fetches the blob index from the given fetchURL, hashing the bytes
+// of the index as they are read
+func (s *simpleLookup) FindDigest(ctx context.Context, _ types.EncodedContextID, _ model.ProviderResult, fetchURL url.URL, rng *metadata.Range) (blobindex.ShardedDagIndexView, mh.Multihash, error) {
+	if types.IsCacheOnly(ctx) {
+		return nil, nil, types.ErrCacheOnly
+	}
+	types.WalkCountersFrom(ctx).Fetched(types.FetchIndex)
 	// attempt to fetch the index from provided url
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fetchURL.String(), nil)
 	if rng != nil {
@@ -35,12 +48,26 @@ func (s *simpleLookup) Find(ctx context.Context, _ types.EncodedContextID, _ mod
 	}
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch index: %w", err)
+		return nil, nil, types.OriginFetchError(ctx, fmt.Errorf("failed to fetch index: %w", err))
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		body, _ := io.ReadAll(resp.Body)
 
-		return nil, fmt.Errorf("failure response fetching index. status: %s, message: %s", resp.Status, string(body))
+		return nil, nil, types.OriginStatusError(resp.StatusCode, fmt.Errorf("failure response fetching index. status: %s, message: %s", resp.Status, string(body)))
+	}
+	h := sha256.New()
+	index, err := blobindex.Extract(io.TeeReader(resp.Body, h))
+	if err != nil {
+		return nil, nil, err
+	}
+	// the digest is of every byte of the blob, not just those decoded
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return nil, nil, fmt.Errorf("reading index: %w", err)
+	}
+	digest, err := mh.Encode(h.Sum(nil), mh.SHA2_256)
+	if err != nil {
+		return nil, nil, err
 	}
-	return blobindex.Extract(resp.Body)
+	return index, digest, nil
 }
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultCanaryInterval is how often the canary runs a self check, when not
+// otherwise set
+const DefaultCanaryInterval = 10 * time.Minute
+
+// Canary runs a self check on a schedule, as a synthetic canary of the publish,
+// cache, query and removal paths, keeping the report of the last run for the
+// health of the service
+type Canary struct {
+	service  *IndexingService
+	opts     SelfCheckOptions
+	interval time.Duration
+
+	lk      sync.Mutex
+	last    SelfCheckReport
+	checked bool
+
+	closing chan struct{}
+	closed  sync.WaitGroup
+}
+
+// WithCanary runs a self check with the given options every interval, or every
+// DefaultCanaryInterval if it is zero, once the canary is started
+func WithCanary(interval time.Duration, opts SelfCheckOptions) Option {
+	return func(is *IndexingService) {
+		if interval <= 0 {
+			interval = DefaultCanaryInterval
+		}
+		is.canary = &Canary{service: is, opts: opts, interval: interval, closing: make(chan struct{})}
+	}
+}
+
+// Canary returns the canary running self checks on a schedule, or nil if there
+// is none
+func (is *IndexingService) Canary() *Canary {
+	return is.canary
+}
+
+// Check runs a self check now, keeping its report as the last
+func (c *Canary) Check(ctx context.Context) (SelfCheckReport, error) {
+	report, err := c.service.SelfCheck(ctx, c.opts)
+	if err != nil && report.Stages == nil {
+		// the self check couldn't start, which is as much a failure of the canary
+		report = SelfCheckReport{Started: time.Now(), Stages: []SelfCheckResult{{Stage: SelfCheckPublish, Status: SelfCheckFailed, Err: err}}}
+	}
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.last, c.checked = report, true
+	return report, err
+}
+
+// Last returns the report of the last self check, and whether one has run
+func (c *Canary) Last() (SelfCheckReport, bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.last, c.checked
+}
+
+// Failing returns true if the last self check failed
+func (c *Canary) Failing() bool {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.checked && !c.last.Passed()
+}
+
+// Startup runs a self check in the background every interval, starting
+// straight away (returns immediately)
+func (c *Canary) Startup() {
+	c.closed.Add(1)
+	go func() {
+		defer c.closed.Done()
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), c.interval)
+			if _, err := c.Check(ctx); err != nil {
+				log.Errorw("canary self check failed", "error", err)
+			}
+			cancel()
+			select {
+			case <-c.closing:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Shutdown stops the canary, returning when the self check in progress
+// finishes or the passed context cancels
+func (c *Canary) Shutdown(ctx context.Context) error {
+	close(c.closing)
+	closed := make(chan struct{})
+	go func() {
+		c.closed.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,150 @@
+// Package claimevents delivers notifications about claims that were
+// successfully published or cached by the indexing service, either to
+// in-process subscribers or to remote webhook receivers
+package claimevents
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/core/ipld"
+	"github.com/storacha/go-ucanto/did"
+)
+
+// DefaultSubscriberBuffer is the number of events buffered per subscriber before
+// further events for that subscriber are dropped
+const DefaultSubscriberBuffer = 64
+
+// ClaimEvent describes a claim that was successfully published or cached
+type ClaimEvent struct {
+	// Claim is the CID of the claim's root block
+	Claim cid.Cid
+	// Type is the ability of the claim's first capability, i.e. "assert/location"
+	Type string
+	// Space is the space the claim is bound to, if any
+	Space *did.DID
+	// Provider is the peer the claim was published for, if known
+	Provider *peer.ID
+	// HashCount is the number of multihashes the claim was published on
+	HashCount int
+	// Advert is the link to the advertisement the claim was published in, if
+	// known. It is nil for claims that were only cached, and for claims published
+	// through a provider index that doesn't report the advertisements it writes
+	Advert ipld.Link
+}
+
+// NewClaimEvent returns an event populated from the fields in the delegation itself
+func NewClaimEvent(claim delegation.Delegation) ClaimEvent {
+	evt := ClaimEvent{
+		Claim: asCid(claim.Link()),
+	}
+	caps := claim.Capabilities()
+	if len(caps) > 0 {
+		evt.Type = caps[0].Can()
+		if space, err := did.Parse(caps[0].With()); err == nil {
+			evt.Space = &space
+		}
+	}
+	return evt
+}
+
+func asCid(l ipld.Link) cid.Cid {
+	if cl, ok := l.(cidlink.Link); ok {
+		return cl.Cid
+	}
+	c, err := cid.Parse(l.String())
+	if err != nil {
+		return cid.Undef
+	}
+	return c
+}
+
+type subscriber struct {
+	events chan ClaimEvent
+	once   sync.Once
+}
+
+// Bus fans claim events out to in-process subscribers. Publishing never blocks:
+// when a subscriber's buffer is full, the event is dropped for that subscriber
+// and counted
+type Bus struct {
+	lk      sync.RWMutex
+	subs    map[*subscriber]struct{}
+	buffer  int
+	dropped atomic.Uint64
+}
+
+// BusOption configures a Bus
+type BusOption func(*Bus)
+
+// WithSubscriberBuffer sets the number of events buffered for each subscriber
+func WithSubscriberBuffer(buffer int) BusOption {
+	return func(b *Bus) {
+		b.buffer = buffer
+	}
+}
+
+// NewBus returns a new event bus with no subscribers
+func NewBus(opts ...BusOption) *Bus {
+	b := &Bus{
+		subs:   make(map[*subscriber]struct{}),
+		buffer: DefaultSubscriberBuffer,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Subscribe returns a channel of future events and a function to end the
+// subscription. The subscription also ends when the passed context cancels.
+// The channel is closed when the subscription ends
+func (b *Bus) Subscribe(ctx context.Context) (<-chan ClaimEvent, func()) {
+	sub := &subscriber{events: make(chan ClaimEvent, b.buffer)}
+	b.lk.Lock()
+	b.subs[sub] = struct{}{}
+	b.lk.Unlock()
+
+	done := make(chan struct{})
+	cancel := func() {
+		sub.once.Do(func() {
+			b.lk.Lock()
+			delete(b.subs, sub)
+			close(sub.events)
+			b.lk.Unlock()
+			close(done)
+		})
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-done:
+		}
+	}()
+	return sub.events, cancel
+}
+
+// Publish delivers the event to all current subscribers without blocking
+func (b *Bus) Publish(evt ClaimEvent) {
+	b.lk.RLock()
+	defer b.lk.RUnlock()
+	for sub := range b.subs {
+		select {
+		case sub.events <- evt:
+		default:
+			b.dropped.Add(1)
+		}
+	}
+}
+
+// Dropped returns the total number of events dropped because a subscriber was
+// not keeping up
+func (b *Bus) Dropped() uint64 {
+	return b.dropped.Load()
+}
@@ -0,0 +1,77 @@
+package claimevents_test
+
+import (
+	"context"
+	"testing"
+
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/claimevents"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBus__Subscribe(t *testing.T) {
+	ctx := context.Background()
+	events := make([]claimevents.ClaimEvent, 0, 10)
+	for range 10 {
+		events = append(events, claimevents.NewClaimEvent(testutil.RandomIndexDelegation()))
+	}
+
+	t.Run("delivers events in order to all subscribers", func(t *testing.T) {
+		bus := claimevents.NewBus()
+		sub1, cancel1 := bus.Subscribe(ctx)
+		defer cancel1()
+		sub2, cancel2 := bus.Subscribe(ctx)
+		defer cancel2()
+		for _, evt := range events {
+			bus.Publish(evt)
+		}
+		for _, sub := range []<-chan claimevents.ClaimEvent{sub1, sub2} {
+			for _, expected := range events {
+				require.Equal(t, expected, <-sub)
+			}
+		}
+		require.Zero(t, bus.Dropped())
+	})
+
+	t.Run("slow subscribers drop events without blocking", func(t *testing.T) {
+		bus := claimevents.NewBus(claimevents.WithSubscriberBuffer(2))
+		sub, cancel := bus.Subscribe(ctx)
+		defer cancel()
+		for _, evt := range events {
+			bus.Publish(evt)
+		}
+		require.Equal(t, events[0], <-sub)
+		require.Equal(t, events[1], <-sub)
+		require.Equal(t, uint64(8), bus.Dropped())
+	})
+
+	t.Run("cancel closes the channel", func(t *testing.T) {
+		bus := claimevents.NewBus()
+		sub, cancel := bus.Subscribe(ctx)
+		cancel()
+		_, ok := <-sub
+		require.False(t, ok)
+		// publishing after cancel is a no-op
+		bus.Publish(events[0])
+		cancel()
+	})
+
+	t.Run("context cancellation ends the subscription", func(t *testing.T) {
+		bus := claimevents.NewBus()
+		subCtx, cancel := context.WithCancel(ctx)
+		sub, _ := bus.Subscribe(subCtx)
+		cancel()
+		_, ok := <-sub
+		require.False(t, ok)
+	})
+}
+
+func TestNewClaimEvent(t *testing.T) {
+	claim := testutil.RandomIndexDelegation()
+	evt := claimevents.NewClaimEvent(claim)
+	require.Equal(t, claim.Link().(cidlink.Link).Cid, evt.Claim)
+	require.Equal(t, claim.Capabilities()[0].Can(), evt.Type)
+	require.NotNil(t, evt.Space)
+	require.Equal(t, testutil.Service.DID(), *evt.Space)
+}
@@ -0,0 +1,345 @@
+package claimevents
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("claimevents")
+
+// SignatureHeader is the HTTP header carrying the HMAC-SHA256 signature of the
+// webhook request body
+const SignatureHeader = "X-Signature-256"
+
+var outboxPrefix = datastore.NewKey("claimevents/outbox")
+
+type (
+	// WebhookOption configures a Webhook
+	WebhookOption func(*webhookConfig)
+
+	webhookConfig struct {
+		secret       []byte
+		httpClient   *http.Client
+		minBackoff   time.Duration
+		maxBackoff   time.Duration
+		pollInterval time.Duration
+	}
+
+	// Webhook POSTs claim events as JSON to a set of target URLs. Events are
+	// written to a persistent outbox before delivery is attempted, so that
+	// undelivered events survive restarts and are retried with exponential backoff
+	Webhook struct {
+		*webhookConfig
+		targets []string
+		outbox  datastore.Batching
+		seq     atomic.Uint64
+		wake    chan struct{}
+		closing chan struct{}
+		closed  chan struct{}
+		// closeOnce guards closing, so that Shutdown can be called more than once
+		closeOnce sync.Once
+	}
+
+	outboxEntry struct {
+		Target      string          `json:"target"`
+		Event       json.RawMessage `json:"event"`
+		Attempts    int             `json:"attempts"`
+		NextAttempt time.Time       `json:"nextAttempt"`
+	}
+
+	eventJSON struct {
+		Claim     string `json:"claim"`
+		Type      string `json:"type"`
+		Space     string `json:"space,omitempty"`
+		Provider  string `json:"provider,omitempty"`
+		HashCount int    `json:"hashCount"`
+		Advert    string `json:"advert,omitempty"`
+	}
+)
+
+// WithSecret signs every request body with HMAC-SHA256 using the given secret
+func WithSecret(secret []byte) WebhookOption {
+	return func(c *webhookConfig) {
+		c.secret = secret
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to deliver events
+func WithHTTPClient(client *http.Client) WebhookOption {
+	return func(c *webhookConfig) {
+		c.httpClient = client
+	}
+}
+
+// WithRetryBackoff sets the minimum and maximum delay between delivery attempts
+// for a single event
+func WithRetryBackoff(min, max time.Duration) WebhookOption {
+	return func(c *webhookConfig) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// WithPollInterval sets how often the outbox is checked for events due for
+// redelivery
+func WithPollInterval(interval time.Duration) WebhookOption {
+	return func(c *webhookConfig) {
+		c.pollInterval = interval
+	}
+}
+
+// NewWebhook returns a webhook dispatcher delivering to the given targets, using
+// the given datastore for its outbox
+func NewWebhook(targets []string, ds datastore.Batching, opts ...WebhookOption) (*Webhook, error) {
+	c := &webhookConfig{
+		httpClient:   http.DefaultClient,
+		minBackoff:   time.Second,
+		maxBackoff:   5 * time.Minute,
+		pollInterval: 30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	outbox := namespace.Wrap(ds, outboxPrefix)
+	seq, err := lastSequence(outbox)
+	if err != nil {
+		return nil, fmt.Errorf("reading outbox: %w", err)
+	}
+	w := &Webhook{
+		webhookConfig: c,
+		targets:       targets,
+		outbox:        outbox,
+		wake:          make(chan struct{}, 1),
+		closing:       make(chan struct{}),
+		closed:        make(chan struct{}),
+	}
+	w.seq.Store(seq)
+	return w, nil
+}
+
+// Enqueue durably records the event for delivery to every target
+func (w *Webhook) Enqueue(ctx context.Context, evt ClaimEvent) error {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	seq := w.seq.Add(1)
+	batch, err := w.outbox.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	for i, target := range w.targets {
+		entry, err := json.Marshal(outboxEntry{Target: target, Event: data})
+		if err != nil {
+			return err
+		}
+		if err := batch.Put(ctx, entryKey(seq, i), entry); err != nil {
+			return err
+		}
+	}
+	if err := batch.Commit(ctx); err != nil {
+		return fmt.Errorf("writing outbox: %w", err)
+	}
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Startup starts delivering events in the background (returns immediately)
+func (w *Webhook) Startup() {
+	go w.run()
+}
+
+// Shutdown stops delivery, returning when the dispatcher stops or the passed
+// context cancels. Undelivered events remain in the outbox. It is safe to call
+// more than once
+func (w *Webhook) Shutdown(ctx context.Context) error {
+	w.closeOnce.Do(func() { close(w.closing) })
+	select {
+	case <-w.closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *Webhook) run() {
+	defer close(w.closed)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-w.closing
+		cancel()
+	}()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-w.closing:
+			return
+		case <-timer.C:
+		case <-w.wake:
+		}
+		if err := w.deliverDue(ctx); err != nil && ctx.Err() == nil {
+			log.Errorw("delivering claim events", "error", err)
+		}
+		timer.Reset(w.pollInterval)
+	}
+}
+
+// deliverDue attempts delivery of every entry that is due, in order. Once an entry
+// for a target is not delivered, later entries for the same target are held back
+// so that each target receives events in the order they were published
+func (w *Webhook) deliverDue(ctx context.Context) error {
+	results, err := w.outbox.Query(ctx, query.Query{Orders: []query.Order{query.OrderByKey{}}})
+	if err != nil {
+		return err
+	}
+	// read all entries up front so the outbox isn't modified while iterating
+	entries, err := results.Rest()
+	if err != nil {
+		return err
+	}
+	blocked := map[string]struct{}{}
+	now := time.Now()
+	for _, result := range entries {
+		var entry outboxEntry
+		if err := json.Unmarshal(result.Value, &entry); err != nil {
+			return fmt.Errorf("decoding outbox entry %s: %w", result.Key, err)
+		}
+		if _, ok := blocked[entry.Target]; ok {
+			continue
+		}
+		if entry.NextAttempt.After(now) {
+			blocked[entry.Target] = struct{}{}
+			continue
+		}
+		key := datastore.NewKey(result.Key)
+		if err := w.deliver(ctx, entry); err != nil {
+			log.Warnw("claim event delivery failed", "target", entry.Target, "attempts", entry.Attempts+1, "error", err)
+			blocked[entry.Target] = struct{}{}
+			entry.Attempts++
+			entry.NextAttempt = now.Add(w.backoff(entry.Attempts))
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := w.outbox.Put(ctx, key, data); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.outbox.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Webhook) deliver(ctx context.Context, entry outboxEntry) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, entry.Target, bytes.NewReader(entry.Event))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(w.secret, entry.Event))
+	}
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failure response delivering event. status: %s, message: %s", resp.Status, string(body))
+	}
+	return nil
+}
+
+func (w *Webhook) backoff(attempts int) time.Duration {
+	backoff := w.minBackoff
+	for i := 1; i < attempts && backoff < w.maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, w.maxBackoff)
+}
+
+// Sign returns the signature header value for the given body
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature header value against the given body
+func Verify(secret []byte, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// MarshalJSON encodes the event in the form POSTed to webhook targets
+func (e ClaimEvent) MarshalJSON() ([]byte, error) {
+	ej := eventJSON{
+		Claim:     e.Claim.String(),
+		Type:      e.Type,
+		HashCount: e.HashCount,
+	}
+	if e.Space != nil {
+		ej.Space = e.Space.String()
+	}
+	if e.Provider != nil {
+		ej.Provider = e.Provider.String()
+	}
+	if e.Advert != nil {
+		ej.Advert = e.Advert.String()
+	}
+	return json.Marshal(ej)
+}
+
+func entryKey(seq uint64, target int) datastore.Key {
+	return datastore.NewKey(fmt.Sprintf("%020d-%04d", seq, target))
+}
+
+func lastSequence(outbox datastore.Batching) (uint64, error) {
+	results, err := outbox.Query(context.Background(), query.Query{
+		KeysOnly: true,
+		Orders:   []query.Order{query.OrderByKeyDescending{}},
+		Limit:    1,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer results.Close()
+	result, ok := results.NextSync()
+	if !ok {
+		return 0, nil
+	}
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	seqString, _, found := strings.Cut(strings.TrimPrefix(result.Key, "/"), "-")
+	if !found {
+		return 0, errors.New("malformed outbox key")
+	}
+	return strconv.ParseUint(seqString, 10, 64)
+}
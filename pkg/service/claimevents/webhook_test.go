@@ -0,0 +1,151 @@
+package claimevents_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/claimevents"
+	"github.com/stretchr/testify/require"
+)
+
+type receiver struct {
+	lk       sync.Mutex
+	failures int
+	attempts int
+	received []map[string]any
+	secret   []byte
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.attempts++
+	if r.failures > 0 {
+		r.failures--
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+	if !claimevents.Verify(r.secret, body, req.Header.Get(claimevents.SignatureHeader)) {
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+	var evt map[string]any
+	if err := json.Unmarshal(body, &evt); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.received = append(r.received, evt)
+}
+
+func (r *receiver) receivedClaims() []string {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	claims := make([]string, 0, len(r.received))
+	for _, evt := range r.received {
+		claims = append(claims, evt["claim"].(string))
+	}
+	return claims
+}
+
+func (r *receiver) setFailures(failures int) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.failures = failures
+}
+
+func TestWebhook(t *testing.T) {
+	ctx := context.Background()
+	secret := []byte("secret")
+	opts := []claimevents.WebhookOption{
+		claimevents.WithSecret(secret),
+		claimevents.WithRetryBackoff(time.Millisecond, 10*time.Millisecond),
+		claimevents.WithPollInterval(5 * time.Millisecond),
+	}
+	events := make([]claimevents.ClaimEvent, 0, 3)
+	expectedClaims := make([]string, 0, 3)
+	for range 3 {
+		evt := claimevents.NewClaimEvent(testutil.RandomLocationDelegation())
+		events = append(events, evt)
+		expectedClaims = append(expectedClaims, evt.Claim.String())
+	}
+
+	t.Run("retries failed deliveries in order", func(t *testing.T) {
+		rcv := &receiver{failures: 2, secret: secret}
+		server := httptest.NewServer(rcv)
+		defer server.Close()
+
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		webhook := testutil.Must(claimevents.NewWebhook([]string{server.URL}, ds, opts...))(t)
+		webhook.Startup()
+		defer webhook.Shutdown(ctx)
+
+		for _, evt := range events {
+			require.NoError(t, webhook.Enqueue(ctx, evt))
+		}
+		require.Eventually(t, func() bool {
+			return len(rcv.receivedClaims()) == len(events)
+		}, time.Second, 5*time.Millisecond)
+		require.Equal(t, expectedClaims, rcv.receivedClaims())
+		require.Eventually(t, func() bool {
+			entries := testutil.Must(testutil.Must(ds.Query(ctx, query.Query{}))(t).Rest())(t)
+			return len(entries) == 0
+		}, time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("shuts down more than once", func(t *testing.T) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		webhook := testutil.Must(claimevents.NewWebhook([]string{"http://127.0.0.1:0"}, ds, opts...))(t)
+		webhook.Startup()
+		require.NoError(t, webhook.Shutdown(ctx))
+		require.NoError(t, webhook.Shutdown(ctx))
+	})
+
+	t.Run("undelivered events survive restart", func(t *testing.T) {
+		rcv := &receiver{secret: secret}
+		server := httptest.NewServer(rcv)
+		defer server.Close()
+		rcv.setFailures(1000)
+
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		webhook := testutil.Must(claimevents.NewWebhook([]string{server.URL}, ds, opts...))(t)
+		webhook.Startup()
+		for _, evt := range events {
+			require.NoError(t, webhook.Enqueue(ctx, evt))
+		}
+		require.Eventually(t, func() bool {
+			rcv.lk.Lock()
+			defer rcv.lk.Unlock()
+			return rcv.attempts > 1
+		}, time.Second, 5*time.Millisecond)
+		require.NoError(t, webhook.Shutdown(ctx))
+		require.Empty(t, rcv.receivedClaims())
+
+		rcv.setFailures(0)
+		restarted := testutil.Must(claimevents.NewWebhook([]string{server.URL}, ds, opts...))(t)
+		restarted.Startup()
+		defer restarted.Shutdown(ctx)
+		require.Eventually(t, func() bool {
+			return len(rcv.receivedClaims()) == len(events)
+		}, time.Second, 5*time.Millisecond)
+		require.Equal(t, expectedClaims, rcv.receivedClaims())
+
+		// new events are sequenced after the ones recovered from the outbox
+		extra := claimevents.NewClaimEvent(testutil.RandomIndexDelegation())
+		require.NoError(t, restarted.Enqueue(ctx, extra))
+		require.Eventually(t, func() bool {
+			return len(rcv.receivedClaims()) == len(events)+1
+		}, time.Second, 5*time.Millisecond)
+		require.Equal(t, append(expectedClaims, extra.Claim.String()), rcv.receivedClaims())
+	})
+}
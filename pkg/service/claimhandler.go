@@ -0,0 +1,393 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/go-libipni/find/model"
+	ipnimd "github.com/ipni/go-libipni/metadata"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/jobwalker"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service/blobindexlookup"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// ClaimHandler handles a claim protocol found in provider records while a query
+// is walked. Handlers are registered per multicodec code with WithClaimHandler
+type ClaimHandler interface {
+	// NewMetadata returns an empty value of the protocol's metadata, which
+	// provider record metadata is decoded into. It must implement
+	// metadata.HasClaim, naming the claim to fetch
+	NewMetadata() ipnimd.Protocol
+	// Handle is called with each provider record carrying the protocol, once the
+	// claim it names has been fetched and added to the query result, or
+	// confirmed if the query already knows it. It spawns
+	// any follow up lookups and adds anything else to the result
+	Handle(ctx context.Context, c *ClaimContext) error
+}
+
+// ClaimContext is a claim found while walking a query, along with the parts of
+// the walk a ClaimHandler can act on
+type ClaimContext struct {
+	j        job
+	record   claimRecord
+	claim    delegation.Delegation
+	spawn    func(job) error
+	state    jobwalker.WrappedState[queryState]
+	metadata ipnimd.Protocol
+}
+
+// Hash is the multihash being looked up
+func (c *ClaimContext) Hash() multihash.Multihash {
+	return c.j.mh
+}
+
+// IndexFor is the multihash an index is being resolved for, when the lookup is
+// for the location of an index. Otherwise it is nil
+func (c *ClaimContext) IndexFor() multihash.Multihash {
+	if c.j.indexForMh == nil {
+		return nil
+	}
+	return *c.j.indexForMh
+}
+
+// Result is the provider record the claim was found in
+func (c *ClaimContext) Result() model.ProviderResult {
+	return c.record.result
+}
+
+// Metadata is the decoded metadata of the claim protocol, of the type returned
+// by the handler's NewMetadata
+func (c *ClaimContext) Metadata() ipnimd.Protocol {
+	return c.metadata
+}
+
+// Claim is the fetched claim, or nil if the query already knows it and it was
+// not fetched
+func (c *ClaimContext) Claim() delegation.Delegation {
+	return c.claim
+}
+
+// Query is the query being walked
+func (c *ClaimContext) Query() Query {
+	return *c.state.Access().q
+}
+
+// FollowLocation looks up location commitments for a multihash
+func (c *ClaimContext) FollowLocation(hash multihash.Multihash) error {
+	return c.spawn(job{mh: hash, jobType: locationJobType, origin: c.j.origin, depth: c.j.depth})
+}
+
+// FollowShard looks up index claims and location commitments for a multihash.
+// When an index is being resolved, the shard is looked up as a shard of the
+// index, so that the indexes nested in it are resolved for the same hash
+func (c *ClaimContext) FollowShard(hash multihash.Multihash) error {
+	j := job{mh: hash, jobType: equalsOrLocationJobType, origin: c.j.origin, depth: c.j.depth}
+	if c.j.indexForMh != nil {
+		j.shardFor = c.j.indexForMh
+		j.depth++
+	}
+	return c.spawn(j)
+}
+
+// FollowIndex looks up the location of an index for the multihash being looked
+// up, so that the index is fetched and added to the result. An index of a shard
+// of another index is nested in it, and is resolved for the hash found in the
+// shard instead, unless it is nested deeper than the service follows
+func (c *ClaimContext) FollowIndex(index multihash.Multihash) error {
+	mh := c.j.mh
+	if c.j.shardFor != nil {
+		if c.j.depth > c.state.Access().maxIndexDepth {
+			c.indexTooDeep()
+			return nil
+		}
+		mh = *c.j.shardFor
+	}
+	result := c.record.result
+	return c.spawn(job{
+		mh:                  index,
+		indexForMh:          &mh,
+		indexProviderRecord: &result,
+		jobType:             equalsOrLocationJobType,
+		origin:              c.j.origin,
+		depth:               c.j.depth,
+	})
+}
+
+// AddIndex adds an index to the query result, if it doesn't have one for the
+// context ID already
+func (c *ClaimContext) AddIndex(contextID types.EncodedContextID, index blobindex.ShardedDagIndexView) {
+	c.state.CmpSwap(
+		func(qs queryState) bool {
+			return !qs.qr.Indexes.Has(contextID)
+		},
+		func(qs queryState) queryState {
+			qs.qr.Indexes.Set(contextID, index)
+			return qs
+		})
+	attribute(c.state, c.j, func(a *attribution) { a.indexes[string(contextID)] = struct{}{} })
+}
+
+// AddIndexRef records the index an index claim is for in the query result, if
+// it doesn't have a reference for the context ID already. The reference is kept
+// whether or not the index can be fetched
+func (c *ClaimContext) AddIndexRef(contextID types.EncodedContextID, ref queryresult.IndexRef) {
+	c.state.CmpSwap(
+		func(qs queryState) bool {
+			return !qs.qr.IndexRefs.Has(contextID)
+		},
+		func(qs queryState) queryState {
+			qs.qr.IndexRefs.Set(contextID, ref)
+			return qs
+		})
+	attribute(c.state, c.j, func(a *attribution) { a.indexRefs[string(contextID)] = struct{}{} })
+}
+
+// indexFetched clears any failure recorded on the reference to the index being
+// resolved, now that it was fetched from a location, and counts it as expanded
+func (c *ClaimContext) indexFetched() {
+	contextID := c.j.indexProviderRecord.ContextID
+	c.state.Access().counters.IndexExpanded()
+	c.state.Modify(func(qs queryState) queryState {
+		qs.qr.fetchedRefs[string(contextID)] = struct{}{}
+		if qs.qr.IndexRefs.Has(contextID) {
+			ref := qs.qr.IndexRefs.Get(contextID)
+			ref.Error = ""
+			qs.qr.IndexRefs.Set(contextID, ref)
+		}
+		return qs
+	})
+}
+
+// indexFetchFailed records why the index being resolved couldn't be fetched on
+// its reference, unless it was fetched from another location. Indexes of
+// versions that can't be read are traced for diagnosis. The failure only fails
+// the query if the query itself was cancelled
+func (c *ClaimContext) indexFetchFailed(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	contextID := c.j.indexProviderRecord.ContextID
+	log.Warnw("fetching index failed", "hash", c.Hash(), "provider", c.Result().Provider.ID, "error", err)
+	var unsupported blobindex.ErrUnsupportedIndexVersion
+	if errors.As(err, &unsupported) {
+		c.state.Access().trace.unsupportedIndex(c.j, c.Result().Provider.ID, unsupported)
+	}
+	c.state.Modify(func(qs queryState) queryState {
+		if _, ok := qs.qr.fetchedRefs[string(contextID)]; ok || !qs.qr.IndexRefs.Has(contextID) {
+			return qs
+		}
+		ref := qs.qr.IndexRefs.Get(contextID)
+		ref.Error = err.Error()
+		qs.qr.IndexRefs.Set(contextID, ref)
+		return qs
+	})
+	return nil
+}
+
+// indexTooDeep records on the reference to the index of the claim that it was
+// not fetched for being nested too deep, unless it was fetched elsewhere
+func (c *ClaimContext) indexTooDeep() {
+	contextID := c.record.result.ContextID
+	log.Debugw("not following nested index", "hash", c.Hash(), "depth", c.j.depth)
+	c.state.Access().limited(c.j, maxIndexDepthLimit)
+	c.state.Modify(func(qs queryState) queryState {
+		if _, ok := qs.qr.fetchedRefs[string(contextID)]; ok || !qs.qr.IndexRefs.Has(contextID) {
+			return qs
+		}
+		ref := qs.qr.IndexRefs.Get(contextID)
+		ref.Error = indexDepthExceeded
+		qs.qr.IndexRefs.Set(contextID, ref)
+		return qs
+	})
+}
+
+// indexPending records on the reference to the index being resolved that it is
+// still being expanded, unless it was fetched elsewhere, and marks the result
+// partial
+func (c *ClaimContext) indexPending() {
+	contextID := c.j.indexProviderRecord.ContextID
+	log.Debugw("not waiting for index expansion", "hash", c.Hash(), "provider", c.Result().Provider.ID)
+	c.state.Access().counters.Truncated(indexExpansionWaitLimit)
+	c.state.Modify(func(qs queryState) queryState {
+		qs.qr.pending = true
+		if _, ok := qs.qr.fetchedRefs[string(contextID)]; ok || !qs.qr.IndexRefs.Has(contextID) {
+			return qs
+		}
+		ref := qs.qr.IndexRefs.Get(contextID)
+		ref.Error = IndexExpansionPending
+		qs.qr.IndexRefs.Set(contextID, ref)
+		return qs
+	})
+}
+
+func (c *ClaimContext) seenAt() time.Time {
+	return c.record.seenAt
+}
+
+func (c *ClaimContext) config() *runtimeConfig {
+	return c.state.Access().cfg
+}
+
+// defaultClaimHandlers are the handlers for the claim protocols the service
+// supports out of the box
+func defaultClaimHandlers(is *IndexingService) map[multicodec.Code]ClaimHandler {
+	return map[multicodec.Code]ClaimHandler{
+		metadata.EqualsClaimID:        equalsClaimHandler{},
+		metadata.IndexClaimID:         indexClaimHandler{is},
+		metadata.LocationCommitmentID: locationClaimHandler{is},
+	}
+}
+
+type equalsClaimHandler struct{}
+
+func (equalsClaimHandler) NewMetadata() ipnimd.Protocol { return &metadata.EqualsClaimMetadata{} }
+
+// Handle follows an equals claim, which is published on both the content and
+// equals multihashes, with a query for location claims on the OTHER side of it
+func (equalsClaimHandler) Handle(ctx context.Context, c *ClaimContext) error {
+	equals := c.Metadata().(*metadata.EqualsClaimMetadata)
+	if string(equals.Equals.Hash()) != string(c.Hash()) {
+		// lookup was the content hash, queue the equals hash
+		return c.FollowLocation(equals.Equals.Hash())
+	}
+	// lookup was the equals hash, queue the content hash
+	return c.FollowLocation(multihash.Multihash(c.Result().ContextID))
+}
+
+type indexClaimHandler struct {
+	is *IndexingService
+}
+
+func (indexClaimHandler) NewMetadata() ipnimd.Protocol { return &metadata.IndexClaimMetadata{} }
+
+// Handle follows an index claim by looking for a location claim for the index,
+// and fetching the index. A reference to the index is added to the result
+// either way. A fetched claim superseding another is recorded, so that the
+// claim it supersedes is left out of later results that don't find it
+func (h indexClaimHandler) Handle(ctx context.Context, c *ClaimContext) error {
+	if claim := c.Claim(); claim != nil {
+		h.is.recordSupersession(ctx, claim)
+	}
+	index := c.Metadata().(*metadata.IndexClaimMetadata).Index
+	result := c.Result()
+	c.AddIndexRef(result.ContextID, queryresult.IndexRef{Index: index, Provider: result.Provider.ID})
+	return c.FollowIndex(index.Hash())
+}
+
+type locationClaimHandler struct {
+	is *IndexingService
+}
+
+func (locationClaimHandler) NewMetadata() ipnimd.Protocol {
+	return &metadata.LocationCommitmentMetadata{}
+}
+
+// Handle keeps a location claim, unless it is for an index CID, in which case
+// the full index is fetched and the shards containing the looked up multihash
+// followed
+func (h locationClaimHandler) Handle(ctx context.Context, c *ClaimContext) error {
+	location := c.Metadata().(*metadata.LocationCommitmentMetadata)
+	result := c.Result()
+	if c.config().LocationCacheWarming {
+		h.is.warmLocationCache(ctx, c.Hash(), result, location)
+	}
+	indexFor := c.IndexFor()
+	if indexFor == nil {
+		return nil
+	}
+
+	// an index the client already has is not fetched again if we remember which
+	// of its shards to follow
+	known := c.state.Access().known.index(result.ContextID)
+	if known {
+		if containing, ok := h.is.shardSummaries.get(result.ContextID, indexFor); ok {
+			for _, shard := range containing {
+				if err := c.FollowShard(shard); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	index, err := h.fetchIndex(ctx, c, location)
+	if errors.Is(err, errExpansionPending) {
+		c.indexPending()
+		return nil
+	}
+	if err != nil {
+		if ctx.Err() == nil && !types.IsCacheOnly(ctx) {
+			h.is.reconstructOnFailure(c.Hash(), result.ContextID)
+		}
+		return c.indexFetchFailed(ctx, err)
+	}
+	c.indexFetched()
+	h.is.markSeen(ctx, c.Hash(), result, c.seenAt())
+	if !known {
+		c.AddIndex(result.ContextID, index)
+	}
+
+	// add location queries for all shards containing the original CID we're seeing an index for
+	containing := h.is.containingShards(ctx, result.ContextID, index, indexFor)
+	for _, shard := range containing {
+		if err := c.FollowShard(shard); err != nil {
+			return err
+		}
+	}
+	h.is.shardSummaries.put(result.ContextID, indexFor, containing)
+	// a query can only prefetch fewer shards than the service is set to
+	prefetch := h.is.prefetch
+	if q := c.Query(); q.Prefetch != 0 {
+		prefetch = min(prefetch, q.Prefetch)
+	}
+	// prefetches fetch from the origin, which cache only walks don't
+	if prefetch > 0 && !types.IsCacheOnly(ctx) {
+		h.is.prefetchShards(nextShards(index, containing, prefetch))
+	}
+	return nil
+}
+
+// fetchIndex fetches (from URL or cache) the full index at the location, failing
+// over between the URLs it can be fetched from. An index reached more than once
+// by the query is only fetched once
+func (h locationClaimHandler) fetchIndex(ctx context.Context, c *ClaimContext, location *metadata.LocationCommitmentMetadata) (blobindex.ShardedDagIndexView, error) {
+	result := c.Result()
+	memo := c.state.Access().indexes
+	if index, ok := memo.get(result.ContextID); ok {
+		return index, nil
+	}
+	shard := location.Shard
+	if shard == nil {
+		sc := cid.NewCidV1(cid.Raw, c.Hash())
+		shard = &sc
+	}
+	urls, err := h.is.indexURLs(ctx, *result.Provider, *shard, location, c.Claim())
+	if err != nil {
+		return nil, err
+	}
+	// an index that is the whole of its blob is known by the digest of the blob,
+	// so a cached copy fetched for another context ID can be used
+	if location.Range == nil {
+		ctx = blobindexlookup.WithIndexDigest(ctx, shard.Hash())
+	}
+	var index blobindex.ShardedDagIndexView
+	// cache only walks don't expand indexes, as they don't fetch them
+	if h.is.expansion != nil && !types.IsCacheOnly(ctx) {
+		index, err = h.is.expandIndex(ctx, c, *shard, urls, location)
+	} else {
+		index, err = h.is.fetchIndexFrom(ctx, c, urls, location)
+	}
+	if err != nil {
+		return nil, err
+	}
+	memo.put(result.ContextID, index)
+	return index, nil
+}
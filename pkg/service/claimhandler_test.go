@@ -0,0 +1,640 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/maurl"
+	ipnimd "github.com/ipni/go-libipni/metadata"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+	"github.com/storacha/go-ucanto/core/car"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/core/ipld"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/blobindexlookup"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// claimFixture serves random claims and builds provider results pointing at them
+type claimFixture struct {
+	claims   map[string][]byte
+	server   *httptest.Server
+	provider *peer.AddrInfo
+	// failBlobs makes the fixture fail every blob request with a server error
+	failBlobs bool
+}
+
+func newClaimFixture(t *testing.T) *claimFixture {
+	f := &claimFixture{claims: map[string][]byte{}}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.failBlobs && strings.HasPrefix(r.URL.Path, "/blobs/") {
+			http.Error(w, "blob unavailable", http.StatusInternalServerError)
+			return
+		}
+		claim, ok := f.claims[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		testutil.Must(w.Write(claim))(t)
+	}))
+	t.Cleanup(f.server.Close)
+	claimsURL := testutil.Must(url.Parse(f.server.URL + "/claims/{claim}"))(t)
+	blobsURL := testutil.Must(url.Parse(f.server.URL + "/blobs/{shard}"))(t)
+	f.provider = &peer.AddrInfo{
+		ID: testutil.RandomPeer(),
+		Addrs: []multiaddr.Multiaddr{
+			testutil.Must(maurl.FromURL(claimsURL))(t),
+			testutil.Must(maurl.FromURL(blobsURL))(t),
+		},
+	}
+	return f
+}
+
+func (f *claimFixture) newClaim(t *testing.T) cid.Cid {
+	return f.addClaim(t, testutil.RandomLocationDelegation())
+}
+
+func (f *claimFixture) addClaim(t *testing.T, claim delegation.Delegation) cid.Cid {
+	claimCid := claim.Link().(cidlink.Link).Cid
+	f.claims["/claims/"+claimCid.String()] = testutil.Must(io.ReadAll(claim.Archive()))(t)
+	return claimCid
+}
+
+func (f *claimFixture) result(t *testing.T, contextID []byte, md interface{ MarshalBinary() ([]byte, error) }) model.ProviderResult {
+	return model.ProviderResult{
+		ContextID: contextID,
+		Metadata:  testutil.Must(md.MarshalBinary())(t),
+		Provider:  f.provider,
+	}
+}
+
+func queriedClaims(t *testing.T, is *service.IndexingService, hash multihash.Multihash) ([]cid.Cid, int) {
+	qr, err := is.Query(context.Background(), service.Query{Hashes: []multihash.Multihash{hash}})
+	require.NoError(t, err)
+	claims := make([]cid.Cid, 0, len(qr.Claims()))
+	for _, link := range qr.Claims() {
+		claims = append(claims, link.(cidlink.Link).Cid)
+	}
+	return claims, len(qr.Indexes())
+}
+
+func TestIndexingService__ClaimHandlers(t *testing.T) {
+	f := newClaimFixture(t)
+
+	// the content hash has an equals claim and an index claim. The equals hash
+	// has a location, as does the index, which has the content in a shard with
+	// a location too
+	contentHash := testutil.RandomMultihash()
+	equalsCid, indexCid, shardHash := testutil.RandomCID().(cidlink.Link).Cid, testutil.RandomCID().(cidlink.Link).Cid, testutil.RandomMultihash()
+	index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 1)
+	index.SetSlice(shardHash, contentHash, blobindex.Position{Offset: 0, Length: 10})
+	equalsClaim, indexClaim := f.newClaim(t), f.newClaim(t)
+	equalsLocation, indexLocation, shardLocation := f.newClaim(t), f.newClaim(t), f.newClaim(t)
+	results := map[string][]model.ProviderResult{
+		string(contentHash): {
+			f.result(t, contentHash, &metadata.EqualsClaimMetadata{Equals: equalsCid, Claim: equalsClaim}),
+			f.result(t, testutil.RandomBytes(10), &metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaim}),
+		},
+		string(equalsCid.Hash()): {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: equalsLocation})},
+		string(indexCid.Hash()):  {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: indexLocation})},
+		string(shardHash):        {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: shardLocation})},
+	}
+
+	t.Run("equals, index and location claims are followed", func(t *testing.T) {
+		providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: results, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{index: index}, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex, service.WithConcurrency(1)))(t)
+
+		claims, indexes := queriedClaims(t, is, contentHash)
+		require.ElementsMatch(t, []cid.Cid{equalsClaim, indexClaim, equalsLocation, indexLocation, shardLocation}, claims)
+		require.Equal(t, 1, indexes)
+	})
+
+	t.Run("registered custom claim protocol takes part in the walk", func(t *testing.T) {
+		inclusionHash, includedHash := testutil.RandomMultihash(), testutil.RandomMultihash()
+		inclusionClaim, includedLocation := f.newClaim(t), f.newClaim(t)
+		custom := map[string][]model.ProviderResult{
+			string(inclusionHash): {f.result(t, includedHash, &inclusionMetadata{Claim: inclusionClaim})},
+			string(includedHash):  {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: includedLocation})},
+		}
+		handler := &inclusionHandler{}
+		newService := func(opts ...service.Option) *service.IndexingService {
+			providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: custom, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+			return testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex, opts...))(t)
+		}
+
+		// without a handler for it, the protocol is not looked up
+		claims, _ := queriedClaims(t, newService(), inclusionHash)
+		require.Empty(t, claims)
+
+		claims, _ = queriedClaims(t, newService(service.WithClaimHandler(inclusionID, handler)), inclusionHash)
+		require.ElementsMatch(t, []cid.Cid{inclusionClaim, includedLocation}, claims)
+		require.Equal(t, []cid.Cid{inclusionClaim}, handler.handled)
+	})
+}
+
+func TestIndexingService__ShardFilters(t *testing.T) {
+	f := newClaimFixture(t)
+	contentHash, indexCid, shardHash := testutil.RandomMultihash(), testutil.RandomCID().(cidlink.Link).Cid, testutil.RandomMultihash()
+	contextID := testutil.RandomBytes(10)
+	newIndex := func() blobindex.ShardedDagIndexView {
+		index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 21)
+		for range 20 {
+			shard := testutil.RandomMultihash()
+			for range blobindex.ShardFilterMinSlices / 20 {
+				index.SetSlice(shard, testutil.RandomMultihash(), blobindex.Position{Offset: 0, Length: 10})
+			}
+		}
+		return index
+	}
+	index := newIndex()
+	index.SetSlice(shardHash, contentHash, blobindex.Position{Offset: 0, Length: 10})
+	// filters of another version of the index, without the content
+	stale := testutil.Must(blobindex.NewShardFilters(newIndex(), 0.01))(t)
+
+	indexClaim, indexLocation, shardLocation := f.newClaim(t), f.newClaim(t), f.newClaim(t)
+	results := map[string][]model.ProviderResult{
+		string(contentHash):     {f.result(t, contextID, &metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaim})},
+		string(indexCid.Hash()): {f.result(t, contextID, &metadata.LocationCommitmentMetadata{Claim: indexLocation})},
+		string(shardHash):       {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: shardLocation})},
+	}
+
+	testCases := []struct {
+		name    string
+		filters map[string]*blobindex.ShardFilters
+	}{
+		{name: "no filters"},
+		{name: "current filters", filters: map[string]*blobindex.ShardFilters{string(contextID): testutil.Must(blobindex.NewShardFilters(index, 0.01))(t)}},
+		{name: "stale filters are ignored", filters: map[string]*blobindex.ShardFilters{string(contextID): stale}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &mockShardFilterStore{filters: tc.filters}
+			providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: results, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+			is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{index: index}, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex, service.WithShardFilters(store)))(t)
+
+			claims, _ := queriedClaims(t, is, contentHash)
+			require.ElementsMatch(t, []cid.Cid{indexClaim, indexLocation, shardLocation}, claims)
+			require.Equal(t, 1, store.reads)
+		})
+	}
+}
+
+type mockShardFilterStore struct {
+	filters map[string]*blobindex.ShardFilters
+	reads   int
+}
+
+func (m *mockShardFilterStore) Get(ctx context.Context, contextID types.EncodedContextID) (*blobindex.ShardFilters, error) {
+	m.reads++
+	filters, ok := m.filters[string(contextID)]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return filters, nil
+}
+
+func (m *mockShardFilterStore) Set(ctx context.Context, contextID types.EncodedContextID, filters *blobindex.ShardFilters, expires bool) error {
+	m.filters[string(contextID)] = filters
+	return nil
+}
+
+func (m *mockShardFilterStore) SetExpirable(ctx context.Context, contextID types.EncodedContextID, expires bool) error {
+	return nil
+}
+
+const inclusionID = multicodec.Code(0x3E0100)
+
+// inclusionMetadata is a claim protocol unknown to the service, encoded as the
+// code, a length and the claim CID
+type inclusionMetadata struct {
+	Claim cid.Cid
+}
+
+var _ metadata.HasClaim = (*inclusionMetadata)(nil)
+
+func (m *inclusionMetadata) ID() multicodec.Code { return inclusionID }
+
+func (m *inclusionMetadata) GetClaim() cid.Cid { return m.Claim }
+
+func (m *inclusionMetadata) MarshalBinary() ([]byte, error) {
+	claim := m.Claim.Bytes()
+	return bytes.Join([][]byte{varint.ToUvarint(uint64(inclusionID)), varint.ToUvarint(uint64(len(claim))), claim}, nil), nil
+}
+
+func (m *inclusionMetadata) UnmarshalBinary(data []byte) error {
+	_, err := m.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+func (m *inclusionMetadata) ReadFrom(r io.Reader) (int64, error) {
+	br := r.(io.ByteReader)
+	code, err := varint.ReadUvarint(br)
+	if err != nil {
+		return 0, err
+	}
+	size, err := varint.ReadUvarint(br)
+	if err != nil {
+		return 0, err
+	}
+	claim := make([]byte, size)
+	if _, err := io.ReadFull(r, claim); err != nil {
+		return 0, err
+	}
+	m.Claim, err = cid.Cast(claim)
+	return int64(varint.UvarintSize(code) + varint.UvarintSize(size) + len(claim)), err
+}
+
+// inclusionHandler follows an inclusion claim by looking up the location of the
+// included content, named by the context ID
+type inclusionHandler struct {
+	lk      sync.Mutex
+	handled []cid.Cid
+}
+
+func (h *inclusionHandler) NewMetadata() ipnimd.Protocol { return &inclusionMetadata{} }
+
+func (h *inclusionHandler) Handle(ctx context.Context, c *service.ClaimContext) error {
+	h.lk.Lock()
+	h.handled = append(h.handled, c.Metadata().(*inclusionMetadata).Claim)
+	h.lk.Unlock()
+	return c.FollowLocation(multihash.Multihash(c.Result().ContextID))
+}
+
+func TestIndexingService__FirstLocationWins(t *testing.T) {
+	f := newClaimFixture(t)
+
+	// one hash has locations from five providers, the other a location and an
+	// index whose own location would otherwise be followed
+	coveredHash, indexedHash := testutil.RandomMultihash(), testutil.RandomMultihash()
+	indexCid, shardHash := testutil.RandomCID().(cidlink.Link).Cid, testutil.RandomMultihash()
+	index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 1)
+	index.SetSlice(shardHash, indexedHash, blobindex.Position{Offset: 0, Length: 10})
+	var coveredLocations []cid.Cid
+	results := map[string][]model.ProviderResult{}
+	for range 5 {
+		location := f.newClaim(t)
+		coveredLocations = append(coveredLocations, location)
+		results[string(coveredHash)] = append(results[string(coveredHash)], f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: location}))
+	}
+	indexedLocation, indexClaim, indexLocation, shardLocation := f.newClaim(t), f.newClaim(t), f.newClaim(t), f.newClaim(t)
+	results[string(indexedHash)] = []model.ProviderResult{
+		f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: indexedLocation}),
+		f.result(t, testutil.RandomBytes(10), &metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaim}),
+	}
+	results[string(indexCid.Hash())] = []model.ProviderResult{f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: indexLocation})}
+	results[string(shardHash)] = []model.ProviderResult{f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: shardLocation})}
+
+	query := func(t *testing.T, firstLocationWins bool) ([]cid.Cid, int) {
+		providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: results, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{index: index}, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex, service.WithConcurrency(1)))(t)
+		qr, err := is.Query(context.Background(), service.Query{Hashes: []multihash.Multihash{coveredHash, indexedHash}, FirstLocationWins: firstLocationWins})
+		require.NoError(t, err)
+		claims := make([]cid.Cid, 0, len(qr.Claims()))
+		for _, link := range qr.Claims() {
+			claims = append(claims, link.(cidlink.Link).Cid)
+		}
+		return claims, len(qr.Indexes())
+	}
+
+	t.Run("every location is fetched by default", func(t *testing.T) {
+		claims, indexes := query(t, false)
+		require.ElementsMatch(t, append([]cid.Cid{indexedLocation, indexClaim, indexLocation, shardLocation}, coveredLocations...), claims)
+		require.Equal(t, 1, indexes)
+	})
+
+	t.Run("only the first location of each hash is fetched", func(t *testing.T) {
+		claims, indexes := query(t, true)
+		require.Len(t, claims, 3)
+		require.Contains(t, claims, indexedLocation)
+		require.Contains(t, claims, indexClaim)
+		var covered int
+		for _, location := range coveredLocations {
+			if slices.Contains(claims, location) {
+				covered++
+			}
+		}
+		require.Equal(t, 1, covered)
+		require.Zero(t, indexes)
+	})
+}
+
+func TestIndexingService__MaxResultsPerHash(t *testing.T) {
+	f := newClaimFixture(t)
+	// the same addresses under another peer ID, so that each is a distinct
+	// provider of its record
+	fromProvider := func(result model.ProviderResult) model.ProviderResult {
+		result.Provider = &peer.AddrInfo{ID: testutil.RandomPeer(), Addrs: f.provider.Addrs}
+		return result
+	}
+	locations := func(n int) ([]model.ProviderResult, map[cid.Cid]struct{}) {
+		results := make([]model.ProviderResult, 0, n)
+		claims := map[cid.Cid]struct{}{}
+		for range n {
+			location := f.newClaim(t)
+			claims[location] = struct{}{}
+			results = append(results, fromProvider(f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: location})))
+		}
+		return results, claims
+	}
+	newService := func(results map[string][]model.ProviderResult, index blobindex.ShardedDagIndexView) (*service.IndexingService, *countingClaimLookup) {
+		providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: results, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		lookup := &countingClaimLookup{ClaimLookup: claimlookup.NewClaimLookup(http.DefaultClient)}
+		return testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{index: index}, lookup, providerIndex, service.WithConcurrency(1)))(t), lookup
+	}
+	fetchedOf := func(lookup *countingClaimLookup, claims map[cid.Cid]struct{}) int {
+		fetched := 0
+		for _, c := range lookup.lookups {
+			if _, ok := claims[c]; ok {
+				fetched++
+			}
+		}
+		return fetched
+	}
+
+	hash := testutil.RandomMultihash()
+	served, servedClaims := locations(10)
+
+	t.Run("every provider's location is fetched without a limit", func(t *testing.T) {
+		is, lookup := newService(map[string][]model.ProviderResult{string(hash): served}, nil)
+		qr, err := is.Query(context.Background(), service.Query{Hashes: []multihash.Multihash{hash}})
+		require.NoError(t, err)
+		require.Len(t, qr.Claims(), 10)
+		require.Equal(t, 10, fetchedOf(lookup, servedClaims))
+	})
+
+	t.Run("locations are fetched up to the limit", func(t *testing.T) {
+		is, lookup := newService(map[string][]model.ProviderResult{string(hash): served}, nil)
+		qr, err := is.Query(context.Background(), service.Query{Hashes: []multihash.Multihash{hash}, MaxResultsPerHash: 3})
+		require.NoError(t, err)
+		require.Len(t, qr.Claims(), 3)
+		require.Equal(t, 3, fetchedOf(lookup, servedClaims))
+	})
+
+	t.Run("locations from the same provider count once", func(t *testing.T) {
+		again := f.newClaim(t)
+		repeated := f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: again})
+		repeated.Provider = served[0].Provider
+		results := append([]model.ProviderResult{served[0], repeated}, served[1:]...)
+		is, lookup := newService(map[string][]model.ProviderResult{string(hash): results}, nil)
+		qr, err := is.Query(context.Background(), service.Query{Hashes: []multihash.Multihash{hash}, MaxResultsPerHash: 2})
+		require.NoError(t, err)
+		require.Len(t, qr.Claims(), 3)
+		require.Len(t, lookup.lookups, 3)
+	})
+
+	t.Run("hashes sharing a shard are counted separately", func(t *testing.T) {
+		// both hashes are found through the same index, in the same shard, whose
+		// locations are served by ten providers
+		first, second := testutil.RandomMultihash(), testutil.RandomMultihash()
+		indexCid, shardHash := testutil.RandomCID().(cidlink.Link).Cid, testutil.RandomMultihash()
+		index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 1)
+		index.SetSlice(shardHash, first, blobindex.Position{Offset: 0, Length: 10})
+		index.SetSlice(shardHash, second, blobindex.Position{Offset: 10, Length: 10})
+		indexClaim, indexLocation := f.newClaim(t), f.newClaim(t)
+		indexRecord := f.result(t, testutil.RandomBytes(10), &metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaim})
+		shardLocations, shardClaims := locations(10)
+		results := map[string][]model.ProviderResult{
+			string(first):           {indexRecord},
+			string(second):          {indexRecord},
+			string(indexCid.Hash()): {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: indexLocation})},
+			string(shardHash):       shardLocations,
+		}
+
+		is, lookup := newService(results, index)
+		qr, err := is.Query(context.Background(), service.Query{Hashes: []multihash.Multihash{first, second}})
+		require.NoError(t, err)
+		require.Len(t, qr.Indexes(), 1)
+		require.Equal(t, 20, fetchedOf(lookup, shardClaims))
+
+		// the location of the index is the first of each hash, and the index is
+		// still followed to reach the rest
+		is, lookup = newService(results, index)
+		qr, err = is.Query(context.Background(), service.Query{Hashes: []multihash.Multihash{first, second}, MaxResultsPerHash: 3})
+		require.NoError(t, err)
+		require.Len(t, qr.Indexes(), 1)
+		require.Equal(t, 4, fetchedOf(lookup, shardClaims))
+		require.Contains(t, qr.Claims(), cidlink.Link{Cid: indexClaim})
+	})
+}
+
+func TestIndexingService__BlobURLTemplate(t *testing.T) {
+	f := newClaimFixture(t)
+	contentHash, indexCid := testutil.RandomMultihash(), testutil.RandomCID().(cidlink.Link).Cid
+	index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 1)
+	index.SetSlice(testutil.RandomMultihash(), contentHash, blobindex.Position{Offset: 0, Length: 10})
+	indexClaim, indexLocation := f.newClaim(t), f.newClaim(t)
+	shard := cid.NewCidV1(cid.Raw, indexCid.Hash())
+	encodedHash := testutil.Must(multibase.Encode(multibase.Base58BTC, indexCid.Hash()))(t)
+
+	testCases := []struct {
+		name        string
+		template    *string
+		expectedURL string
+	}{
+		{
+			name:        "no template uses the provider address",
+			expectedURL: f.server.URL + "/blobs/" + shard.String(),
+		},
+		{
+			name:        "blob CID template",
+			template:    ptr("https://sp.example/{blobCID}/blob"),
+			expectedURL: "https://sp.example/" + shard.String() + "/blob",
+		},
+		{
+			name:        "multihash template",
+			template:    ptr("https://sp.example/blobs/{multihash}"),
+			expectedURL: "https://sp.example/blobs/" + encodedHash,
+		},
+		{
+			name:        "unknown placeholder falls back to the provider address",
+			template:    ptr("https://sp.example/{piece}/blob"),
+			expectedURL: f.server.URL + "/blobs/" + shard.String(),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			results := map[string][]model.ProviderResult{
+				string(contentHash):     {f.result(t, testutil.RandomBytes(10), &metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaim})},
+				string(indexCid.Hash()): {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: indexLocation, Template: tc.template})},
+			}
+			providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: results, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+			blobIndexLookup := &mockBlobIndexLookup{index: index}
+			is := testutil.Must(service.NewIndexingService(blobIndexLookup, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex, service.WithConcurrency(1)))(t)
+
+			_, indexes := queriedClaims(t, is, contentHash)
+			require.Equal(t, 1, indexes)
+			require.Equal(t, []string{tc.expectedURL}, blobIndexLookup.urls)
+		})
+	}
+}
+
+func TestIndexingService__IndexRefs(t *testing.T) {
+	f := newClaimFixture(t)
+	f.failBlobs = true
+	contentHash, otherHash, indexCid := testutil.RandomMultihash(), testutil.RandomMultihash(), testutil.RandomCID().(cidlink.Link).Cid
+	indexClaim, indexLocation, otherLocation := f.newClaim(t), f.newClaim(t), f.newClaim(t)
+	indexContextID := testutil.RandomBytes(10)
+	results := map[string][]model.ProviderResult{
+		string(contentHash):     {f.result(t, indexContextID, &metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaim})},
+		string(indexCid.Hash()): {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: indexLocation})},
+		string(otherHash):       {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: otherLocation})},
+	}
+	newService := func(blobIndexLookup blobindexlookup.BlobIndexLookup) *service.IndexingService {
+		providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: results, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		return testutil.Must(service.NewIndexingService(blobIndexLookup, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex))(t)
+	}
+
+	t.Run("index that fails to fetch", func(t *testing.T) {
+		is := newService(blobindexlookup.NewBlobIndexLookup(http.DefaultClient))
+		qr, err := is.Query(context.Background(), service.Query{Hashes: []multihash.Multihash{contentHash, otherHash}})
+		require.NoError(t, err)
+		claims := make([]cid.Cid, 0, len(qr.Claims()))
+		for _, link := range qr.Claims() {
+			claims = append(claims, link.(cidlink.Link).Cid)
+		}
+		require.ElementsMatch(t, []cid.Cid{indexClaim, indexLocation, otherLocation}, claims)
+		require.Empty(t, qr.Indexes())
+
+		require.Equal(t, 1, qr.IndexRefs().Size())
+		ref := qr.IndexRefs().Get(indexContextID)
+		require.Equal(t, indexCid, ref.Index)
+		require.Equal(t, f.provider.ID, ref.Provider)
+		require.Contains(t, ref.Error, "500")
+
+		// the reference is part of the encoded result
+		archived := car.Encode([]ipld.Link{qr.Root().Link()}, qr.Blocks())
+		extracted := testutil.Must(queryresult.Extract(archived))(t)
+		require.Equal(t, ref, extracted.IndexRefs().Get(indexContextID))
+	})
+
+	t.Run("index that is fetched", func(t *testing.T) {
+		index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 0)
+		is := newService(&mockBlobIndexLookup{index: index})
+		qr := testutil.Must(is.Query(context.Background(), service.Query{Hashes: []multihash.Multihash{contentHash}}))(t)
+		require.Len(t, qr.Indexes(), 1)
+		require.Equal(t, queryresult.IndexRef{Index: indexCid, Provider: f.provider.ID}, qr.IndexRefs().Get(indexContextID))
+	})
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestIndexingService__QuerySnapshot(t *testing.T) {
+	f := newClaimFixture(t)
+
+	// the content is its own shard, so its records are read a second time once
+	// its index is fetched. The index fetch replaces its location in between
+	contentHash, indexCid := testutil.RandomMultihash(), testutil.RandomCID().(cidlink.Link).Cid
+	index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 1)
+	index.SetSlice(contentHash, contentHash, blobindex.Position{Offset: 0, Length: 10})
+	indexClaim, indexLocation, oldLocation, newLocation := f.newClaim(t), f.newClaim(t), f.newClaim(t), f.newClaim(t)
+	indexResult := f.result(t, testutil.RandomBytes(10), &metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaim})
+	store := &mockProviderStore{results: map[string][]model.ProviderResult{
+		string(contentHash): {
+			indexResult,
+			f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: oldLocation}),
+		},
+		string(indexCid.Hash()): {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: indexLocation})},
+	}}
+	replaced := false
+	blobIndexLookup := &mockBlobIndexLookup{index: index, cache: func() {
+		if replaced {
+			return
+		}
+		replaced = true
+		testutil.Must(0, store.Set(context.Background(), contentHash, []model.ProviderResult{
+			indexResult,
+			f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: newLocation}),
+		}, false))(t)
+	}}
+	providerIndex := providerindex.NewProviderIndex(store, &countingFinder{results: map[string][]model.ProviderResult{}, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+	is := testutil.Must(service.NewIndexingService(blobIndexLookup, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex, service.WithConcurrency(2)))(t)
+
+	// the query sees the records as they were when it started
+	claims, indexes := queriedClaims(t, is, contentHash)
+	require.True(t, replaced)
+	require.ElementsMatch(t, []cid.Cid{indexClaim, indexLocation, oldLocation}, claims)
+	require.Equal(t, 1, indexes)
+
+	// the next query sees the new location
+	claims, _ = queriedClaims(t, is, contentHash)
+	require.ElementsMatch(t, []cid.Cid{indexClaim, indexLocation, newLocation}, claims)
+}
+
+func TestIndexingService__UnsupportedIndexVersion(t *testing.T) {
+	f := newClaimFixture(t)
+	// the index served is the golden fixture of a version newer than this
+	// service reads
+	archive := testutil.Must(os.ReadFile(filepath.Join("..", "blobindex", "testdata", "index-v0.2.car")))(t)
+	server := newCountingServer(t, 0, func(*http.Request) []byte { return archive })
+	contentHash, indexCid := testutil.RandomMultihash(), testutil.RandomCID().(cidlink.Link).Cid
+	indexClaim := f.newClaim(t)
+	indexLocation := f.addClaim(t, locationsDelegation(t, indexCid.Hash(), server.url(t, "/index")))
+	indexContextID := testutil.RandomBytes(10)
+	// the provider serves claims, but not blobs
+	provider := &peer.AddrInfo{ID: f.provider.ID, Addrs: f.provider.Addrs[:1]}
+	results := map[string][]model.ProviderResult{
+		string(contentHash):     {f.result(t, indexContextID, &metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaim})},
+		string(indexCid.Hash()): {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: indexLocation})},
+	}
+	for hash, records := range results {
+		for i := range records {
+			records[i].Provider = provider
+		}
+		results[hash] = records
+	}
+	providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: results, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+	blobIndexLookup := blobindexlookup.WithCache(blobindexlookup.NewBlobIndexLookup(http.DefaultClient), redis.NewShardedDagIndexStore(&memRedis{data: map[string]string{}}), noopCachingQueue{})
+	is := testutil.Must(service.NewIndexingService(blobIndexLookup, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex))(t)
+	encode := func(hash multihash.Multihash) string {
+		return testutil.Must(multibase.Encode(multibase.Base58BTC, hash))(t)
+	}
+
+	for range 2 {
+		qr := testutil.Must(is.Query(context.Background(), service.Query{Hashes: []multihash.Multihash{contentHash}, Diagnose: true}))(t)
+		require.Empty(t, qr.Indexes())
+		// the reference to the index says why it wasn't read
+		ref := qr.IndexRefs().Get(indexContextID)
+		require.Equal(t, indexCid, ref.Index)
+		require.Contains(t, ref.Error, "unsupported index version 0.2")
+
+		diagnosis := qr.Diagnostics()[encode(contentHash)]
+		require.Equal(t, queryresult.OutcomeUnsupportedIndex, diagnosis.Outcome)
+		require.Equal(t, []queryresult.UnsupportedIndex{{
+			Hash:      encode(indexCid.Hash()),
+			Provider:  provider.ID.String(),
+			Version:   "0.2",
+			Supported: blobindex.SupportedVersions(),
+		}}, diagnosis.UnsupportedIndexes)
+	}
+	// the index is remembered as unsupported, and not fetched again
+	require.Equal(t, int32(1), server.requests.Load())
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/storacha/indexing-service/pkg/service/claimimport"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+)
+
+type (
+	// ImportOptions configures an import of claims
+	ImportOptions = claimimport.Options
+	// ImportReport totals the outcomes of an import of claims
+	ImportReport = claimimport.Report
+)
+
+// WithClaimLimits sets the limits imported claims are checked against, for
+// imports that don't set their own. If not set, the default limits are used
+func WithClaimLimits(limits claimlookup.Limits) Option {
+	return func(is *IndexingService) {
+		is.claimLimits = limits
+	}
+}
+
+// WithClockSkewTolerance allows the clocks of claim issuers to be off from ours
+// by up to the tolerance, either side of the validity period of imported
+// claims, for imports that don't set their own. Claims written to the claim
+// cache are cached for the tolerance past their expiration
+func WithClockSkewTolerance(tolerance time.Duration) Option {
+	return func(is *IndexingService) {
+		is.clockSkew = max(tolerance, 0)
+	}
+}
+
+// WithSkewMetrics reports imported claims valid only because of the clock skew
+// tolerance to the given metrics
+func WithSkewMetrics(m claimlookup.SkewMetrics) Option {
+	return func(is *IndexingService) {
+		is.skewMetrics = m
+	}
+}
+
+// ImportClaims caches or publishes every valid claim in a CAR file of
+// delegations, as selected by the options. Claims that are invalid or fail to
+// import are reported without stopping the import
+func (is *IndexingService) ImportClaims(ctx context.Context, r io.Reader, opts ImportOptions) (ImportReport, error) {
+	if opts.Identities == nil && is.identities != nil {
+		opts.Identities = is.identities
+	}
+	if opts.Limits == (claimlookup.Limits{}) {
+		opts.Limits = is.claimLimits
+	}
+	if opts.ClockSkewTolerance == 0 {
+		opts.ClockSkewTolerance = is.clockSkew
+	}
+	if opts.SkewMetrics == nil {
+		opts.SkewMetrics = is.skewMetrics
+	}
+	return claimimport.Import(ctx, is, r, opts)
+}
@@ -0,0 +1,375 @@
+// Package claimimport loads content claims in bulk from a CAR file of
+// delegations, such as one written for a migration or a backup
+package claimimport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/go-ucanto/core/car"
+	"github.com/storacha/go-ucanto/core/dag/blockstore"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/core/ipld"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/go-ucanto/principal/ed25519/verifier"
+	"github.com/storacha/go-ucanto/validator"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+)
+
+var log = logging.Logger("claimimport")
+
+const (
+	// DefaultBatchSize is the number of claims submitted together when not
+	// otherwise configured
+	DefaultBatchSize = 64
+	// DefaultDedupeWindow is the number of most recently imported claims
+	// remembered for detecting duplicates when not otherwise configured
+	DefaultDedupeWindow = 1 << 20
+	// maxPendingBytes bounds the blocks held while waiting for the root of the
+	// delegation they belong to
+	maxPendingBytes = 4 << 20
+)
+
+// Mode is how imported claims are written
+type Mode int
+
+const (
+	// ModeCache caches claims without publishing them
+	ModeCache Mode = iota
+	// ModePublish caches claims and publishes them to IPNI
+	ModePublish
+)
+
+// Status is the outcome of importing a single claim
+type Status string
+
+const (
+	StatusImported  Status = "imported"
+	StatusDuplicate Status = "duplicate"
+	StatusInvalid   Status = "invalid"
+	StatusFailed    Status = "failed"
+)
+
+// Outcome is the result of importing a single claim
+type Outcome struct {
+	Claim  cid.Cid
+	Type   string
+	Status Status
+	// Reason explains why a claim was invalid or failed
+	Reason string
+	// ClockSkew describes the comparison of the claim's validity period with
+	// the local clock when the clock skew tolerance changed the outcome
+	ClockSkew string
+}
+
+// Report totals the outcomes of an import
+type Report struct {
+	Imported   int
+	Duplicates int
+	Invalid    int
+	Failed     int
+}
+
+func (r *Report) add(o Outcome) {
+	switch o.Status {
+	case StatusImported:
+		r.Imported++
+	case StatusDuplicate:
+		r.Duplicates++
+	case StatusInvalid:
+		r.Invalid++
+	case StatusFailed:
+		r.Failed++
+	}
+}
+
+// Options configures an import
+type Options struct {
+	Mode Mode
+	// TrustedIssuers are the issuers whose claims are imported. If empty, claims
+	// from any issuer with a valid signature are imported
+	TrustedIssuers []did.DID
+	// Identities resolves issuers to peer IDs, so that the claims of an issuer
+	// resolving to the same peer as a trusted issuer are trusted too
+	Identities PeerResolver
+	// BatchSize is the number of claims written concurrently. If zero,
+	// DefaultBatchSize is used
+	BatchSize int
+	// DedupeWindow is the number of most recently seen claims that duplicates are
+	// detected against. If zero, DefaultDedupeWindow is used
+	DedupeWindow int
+	// Limits bound the claims imported, and a claim that exceeds them is
+	// invalid. Zero limits use their defaults
+	Limits claimlookup.Limits
+	// ClockSkewTolerance is how far the clocks of issuers may be off from ours,
+	// allowed either side of the validity period of each claim
+	ClockSkewTolerance time.Duration
+	// SkewMetrics is told about claims valid only because of the tolerance
+	SkewMetrics claimlookup.SkewMetrics
+	// OnOutcome is called with the outcome of every claim, in the order the
+	// claims appear in the CAR
+	OnOutcome func(Outcome)
+}
+
+// PeerResolver resolves the peer ID of a DID
+type PeerResolver interface {
+	ResolvePeer(d did.DID) (peer.ID, bool)
+}
+
+// Sink is where imported claims are written
+type Sink interface {
+	CacheClaim(ctx context.Context, claim delegation.Delegation) error
+	PublishClaim(ctx context.Context, claim delegation.Delegation) error
+}
+
+// supportedClaims are the claim types that can be imported, with a check of
+// their caveats
+var supportedClaims = map[string]func(validator.Source) error{
+	assert.LocationAbility: func(s validator.Source) error { _, fail := assert.Location.Match(s); return asError(fail) },
+	assert.IndexAbility:    func(s validator.Source) error { _, fail := assert.Index.Match(s); return asError(fail) },
+	assert.EqualsAbility:   func(s validator.Source) error { _, fail := assert.Equals.Match(s); return asError(fail) },
+}
+
+// timeReasons are the reasons given for claims outside their validity period
+var timeReasons = map[error]string{
+	claimlookup.ErrClaimExpired:     "expired",
+	claimlookup.ErrClaimNotYetValid: "not yet valid",
+}
+
+func asError(fail validator.InvalidCapability) error {
+	if fail == nil {
+		return nil
+	}
+	return fail
+}
+
+// Import reads the delegations that are roots of the CAR and writes each valid
+// claim to the sink. The CAR is read as a stream, and only the blocks of the
+// delegation being read are held, so a delegation's blocks must come before
+// its root. A claim that is invalid or fails to write is reported and doesn't
+// stop the import, which only returns an error if the CAR can't be read
+func Import(ctx context.Context, sink Sink, r io.Reader, opts Options) (Report, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.DedupeWindow <= 0 {
+		opts.DedupeWindow = DefaultDedupeWindow
+	}
+	roots, blocks, err := car.Decode(r)
+	if err != nil {
+		return Report{}, fmt.Errorf("decoding CAR: %w", err)
+	}
+	isRoot := make(map[cid.Cid]struct{}, len(roots))
+	for _, root := range roots {
+		isRoot[asCid(root)] = struct{}{}
+	}
+	seen, err := simplelru.NewLRU[cid.Cid, struct{}](opts.DedupeWindow, nil)
+	if err != nil {
+		return Report{}, err
+	}
+
+	im := &importer{sink: sink, opts: opts}
+	var pending []ipld.Block
+	var pendingBytes int
+	for blk, err := range blocks {
+		if err != nil {
+			im.flush(ctx)
+			return im.report, fmt.Errorf("reading CAR: %w", err)
+		}
+		if ctx.Err() != nil {
+			im.flush(ctx)
+			return im.report, ctx.Err()
+		}
+		c := asCid(blk.Link())
+		if _, ok := isRoot[c]; !ok {
+			pending = append(pending, blk)
+			pendingBytes += len(blk.Bytes())
+			for pendingBytes > maxPendingBytes && len(pending) > 1 {
+				pendingBytes -= len(pending[0].Bytes())
+				pending = pending[1:]
+			}
+			continue
+		}
+		if seen.Contains(c) {
+			im.add(ctx, Outcome{Claim: c, Status: StatusDuplicate})
+		} else {
+			seen.Add(c, struct{}{})
+			im.read(ctx, blk, pending)
+		}
+		pending, pendingBytes = nil, 0
+	}
+	im.flush(ctx)
+	return im.report, nil
+}
+
+// importer validates claims and writes them to the sink in batches, reporting
+// outcomes in the order the claims were read
+type importer struct {
+	sink   Sink
+	opts   Options
+	report Report
+	// queue holds the outcomes of the claims in the current batch, for those
+	// waiting to be written along with the claim
+	queue  []Outcome
+	claims []delegation.Delegation
+}
+
+func (im *importer) read(ctx context.Context, root ipld.Block, blocks []ipld.Block) {
+	c := asCid(root.Link())
+	bs, err := blockstore.NewBlockReader(blockstore.WithBlocks(append(slices.Clip(blocks), root)))
+	if err != nil {
+		im.add(ctx, Outcome{Claim: c, Status: StatusInvalid, Reason: err.Error()})
+		return
+	}
+	claim := delegation.NewDelegation(root, bs)
+	outcome, ok := im.validate(ctx, c, claim)
+	if !ok {
+		im.add(ctx, outcome)
+		return
+	}
+	im.queue = append(im.queue, outcome)
+	im.claims = append(im.claims, claim)
+	if len(im.claims) >= im.opts.BatchSize {
+		im.flush(ctx)
+	}
+}
+
+// trusted returns true if there are no trusted issuers, or the issuer is one of
+// them or resolves to the same peer as one of them
+func (im *importer) trusted(issuer did.DID) bool {
+	if len(im.opts.TrustedIssuers) == 0 || slices.Contains(im.opts.TrustedIssuers, issuer) {
+		return true
+	}
+	if im.opts.Identities == nil {
+		return false
+	}
+	id, ok := im.opts.Identities.ResolvePeer(issuer)
+	if !ok {
+		return false
+	}
+	return slices.ContainsFunc(im.opts.TrustedIssuers, func(trusted did.DID) bool {
+		trustedID, ok := im.opts.Identities.ResolvePeer(trusted)
+		return ok && trustedID == id
+	})
+}
+
+// validate checks the claim is within the limits, of a supported type,
+// unexpired, and signed by a trusted issuer. Decoding a malformed delegation
+// panics, which is reported as the claim being invalid
+func (im *importer) validate(ctx context.Context, c cid.Cid, claim delegation.Delegation) (outcome Outcome, ok bool) {
+	outcome = Outcome{Claim: c, Status: StatusInvalid}
+	defer func() {
+		if r := recover(); r != nil {
+			outcome, ok = Outcome{Claim: c, Status: StatusInvalid, Reason: fmt.Sprintf("malformed delegation: %v", r)}, false
+		}
+	}()
+	if err := claimlookup.CheckLimits(ctx, claim, im.opts.Limits); err != nil {
+		outcome.Reason = err.Error()
+		return outcome, false
+	}
+	caps := claim.Capabilities()
+	if len(caps) == 0 {
+		outcome.Reason = "no capabilities"
+		return outcome, false
+	}
+	outcome.Type = caps[0].Can()
+	check, ok := supportedClaims[outcome.Type]
+	if !ok {
+		outcome.Reason = "unsupported claim type"
+		return outcome, false
+	}
+	if err := check(validator.NewSource(caps[0], claim)); err != nil {
+		outcome.Reason = fmt.Sprintf("malformed claim: %s", err)
+		return outcome, false
+	}
+	issuer := claim.Issuer().DID()
+	times := claimlookup.CheckTimes(claim, time.Now(), im.opts.ClockSkewTolerance)
+	if times.Timestamp != "" && im.opts.ClockSkewTolerance > 0 {
+		outcome.ClockSkew = times.String()
+	}
+	if times.Err != nil {
+		outcome.Reason = timeReasons[times.Err]
+		return outcome, false
+	}
+	if !im.trusted(issuer) {
+		outcome.Reason = fmt.Sprintf("untrusted issuer: %s", issuer)
+		return outcome, false
+	}
+	vfr, err := verifier.Parse(issuer.String())
+	if err != nil {
+		outcome.Reason = fmt.Sprintf("unverifiable signature: %s", err)
+		return outcome, false
+	}
+	if _, fail := validator.VerifySignature(claim, vfr); fail != nil {
+		outcome.Reason = fail.Error()
+		return outcome, false
+	}
+	if times.Salvaged() {
+		log.Warnw("claim valid only within the clock skew tolerance", "claim", c, "issuer", issuer, "check", outcome.ClockSkew)
+		if im.opts.SkewMetrics != nil {
+			im.opts.SkewMetrics.ClaimSkewSalvaged(times.Timestamp)
+		}
+	}
+	outcome.Status = StatusImported
+	return outcome, true
+}
+
+// add reports an outcome that doesn't need writing, once the claims read before
+// it have been written
+func (im *importer) add(ctx context.Context, outcome Outcome) {
+	if len(im.claims) > 0 {
+		im.flush(ctx)
+	}
+	im.report.add(outcome)
+	if im.opts.OnOutcome != nil {
+		im.opts.OnOutcome(outcome)
+	}
+}
+
+// flush writes the claims in the current batch concurrently and reports their
+// outcomes
+func (im *importer) flush(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i, claim := range im.claims {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if im.opts.Mode == ModePublish {
+				err = im.sink.PublishClaim(ctx, claim)
+			} else {
+				err = im.sink.CacheClaim(ctx, claim)
+			}
+			if err != nil {
+				log.Warnw("importing claim", "claim", im.queue[i].Claim, "error", err)
+				im.queue[i].Status = StatusFailed
+				im.queue[i].Reason = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, outcome := range im.queue {
+		im.report.add(outcome)
+		if im.opts.OnOutcome != nil {
+			im.opts.OnOutcome(outcome)
+		}
+	}
+	im.queue, im.claims = im.queue[:0], im.claims[:0]
+}
+
+func asCid(l ipld.Link) cid.Cid {
+	c, err := cid.Parse(l.String())
+	if err != nil {
+		return cid.Undef
+	}
+	return c
+}
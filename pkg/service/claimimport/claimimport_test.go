@@ -0,0 +1,237 @@
+package claimimport_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"iter"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/go-ucanto/core/car"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/core/ipld"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/claimimport"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/stretchr/testify/require"
+)
+
+type mockSink struct {
+	lk        sync.Mutex
+	cached    []cid.Cid
+	published []cid.Cid
+	failing   map[cid.Cid]struct{}
+}
+
+func (m *mockSink) write(claim delegation.Delegation, to *[]cid.Cid) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	c := claim.Link().(cidlink.Link).Cid
+	if _, ok := m.failing[c]; ok {
+		return errors.New("cache unavailable")
+	}
+	*to = append(*to, c)
+	return nil
+}
+
+func (m *mockSink) CacheClaim(ctx context.Context, claim delegation.Delegation) error {
+	return m.write(claim, &m.cached)
+}
+
+func (m *mockSink) PublishClaim(ctx context.Context, claim delegation.Delegation) error {
+	return m.write(claim, &m.published)
+}
+
+// archive writes the delegations to a CAR with each one as a root, and its
+// blocks ahead of its root block
+func archive(t *testing.T, claims ...delegation.Delegation) io.Reader {
+	roots := make([]ipld.Link, 0, len(claims))
+	for _, claim := range claims {
+		roots = append(roots, claim.Link())
+	}
+	var blocks iter.Seq2[ipld.Block, error] = func(yield func(ipld.Block, error) bool) {
+		for _, claim := range claims {
+			for blk, err := range claim.Blocks() {
+				if blk.Link().String() == claim.Link().String() {
+					continue
+				}
+				if !yield(blk, err) {
+					return
+				}
+			}
+			if !yield(claim.Root(), nil) {
+				return
+			}
+		}
+	}
+	return bytes.NewReader(testutil.Must(io.ReadAll(car.Encode(roots, blocks)))(t))
+}
+
+type countingSkewMetrics map[string]int
+
+func (m countingSkewMetrics) ClaimSkewSalvaged(timestamp string) { m[timestamp]++ }
+
+type mockResolver map[did.DID]peer.ID
+
+func (m mockResolver) ResolvePeer(d did.DID) (peer.ID, bool) {
+	id, ok := m[d]
+	return id, ok
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	claimCid := func(claim delegation.Delegation) cid.Cid { return claim.Link().(cidlink.Link).Cid }
+
+	location := testutil.RandomLocationDelegation()
+	index := testutil.RandomIndexDelegation()
+	expired := testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.IndexCaveats]{testutil.RandomIndexClaim()},
+		delegation.WithExpiration(int(time.Now().Add(-time.Hour).Unix()))))(t)
+	untrusted := testutil.Must(delegation.Delegate(testutil.Alice, testutil.Service, []ucan.Capability[assert.IndexCaveats]{testutil.RandomIndexClaim()}))(t)
+	// a claim proven by another delegation, whose blocks are written with it
+	proof := testutil.Must(delegation.Delegate(testutil.Alice, testutil.Service, []ucan.Capability[assert.IndexCaveats]{testutil.RandomIndexClaim()}))(t)
+	proven := testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.IndexCaveats]{testutil.RandomIndexClaim()},
+		delegation.WithProof(delegation.FromDelegation(proof))))(t)
+	failing := testutil.RandomIndexDelegation()
+	fixture := func(t *testing.T) io.Reader {
+		return archive(t, location, index, location, expired, untrusted, proven, failing)
+	}
+	trusted := []did.DID{testutil.Service.DID()}
+
+	t.Run("imports valid claims and reports the rest", func(t *testing.T) {
+		sink := &mockSink{failing: map[cid.Cid]struct{}{claimCid(failing): {}}}
+		var outcomes []claimimport.Outcome
+		report, err := claimimport.Import(ctx, sink, fixture(t), claimimport.Options{
+			TrustedIssuers: trusted,
+			BatchSize:      2,
+			OnOutcome:      func(o claimimport.Outcome) { outcomes = append(outcomes, o) },
+		})
+		require.NoError(t, err)
+		require.Equal(t, claimimport.Report{Imported: 3, Duplicates: 1, Invalid: 2, Failed: 1}, report)
+		require.ElementsMatch(t, []cid.Cid{claimCid(location), claimCid(index), claimCid(proven)}, sink.cached)
+		require.Empty(t, sink.published)
+
+		statuses := make([]claimimport.Status, 0, len(outcomes))
+		for _, o := range outcomes {
+			statuses = append(statuses, o.Status)
+		}
+		require.Equal(t, []claimimport.Status{
+			claimimport.StatusImported,
+			claimimport.StatusImported,
+			claimimport.StatusDuplicate,
+			claimimport.StatusInvalid,
+			claimimport.StatusInvalid,
+			claimimport.StatusImported,
+			claimimport.StatusFailed,
+		}, statuses)
+		require.Equal(t, assert.LocationAbility, outcomes[0].Type)
+		require.Equal(t, "expired", outcomes[3].Reason)
+		require.Contains(t, outcomes[4].Reason, "untrusted issuer")
+		require.Equal(t, "cache unavailable", outcomes[6].Reason)
+	})
+
+	t.Run("publish mode publishes claims", func(t *testing.T) {
+		sink := &mockSink{}
+		report, err := claimimport.Import(ctx, sink, archive(t, location, index), claimimport.Options{Mode: claimimport.ModePublish})
+		require.NoError(t, err)
+		require.Equal(t, 2, report.Imported)
+		require.ElementsMatch(t, []cid.Cid{claimCid(location), claimCid(index)}, sink.published)
+		require.Empty(t, sink.cached)
+	})
+
+	t.Run("claims from any issuer are imported without trusted issuers", func(t *testing.T) {
+		sink := &mockSink{}
+		report, err := claimimport.Import(ctx, sink, archive(t, untrusted), claimimport.Options{})
+		require.NoError(t, err)
+		require.Equal(t, 1, report.Imported)
+	})
+
+	t.Run("issuers resolving to the peer of a trusted issuer are trusted", func(t *testing.T) {
+		alicePeer := testutil.RandomPeer()
+		resolver := mockResolver{testutil.Alice.DID(): alicePeer, testutil.Bob.DID(): testutil.RandomPeer()}
+		trustedWeb := testutil.Must(did.Parse("did:web:alice.example.com"))(t)
+		sink := &mockSink{}
+		opts := claimimport.Options{TrustedIssuers: []did.DID{trustedWeb}, Identities: resolver}
+		report, err := claimimport.Import(ctx, sink, archive(t, untrusted), opts)
+		require.NoError(t, err)
+		require.Equal(t, 1, report.Invalid)
+
+		resolver[trustedWeb] = alicePeer
+		report, err = claimimport.Import(ctx, sink, archive(t, untrusted), opts)
+		require.NoError(t, err)
+		require.Equal(t, 1, report.Imported)
+	})
+
+	t.Run("claims over the limits are invalid", func(t *testing.T) {
+		var outcomes []claimimport.Outcome
+		opts := claimimport.Options{
+			Limits:    claimlookup.Limits{MaxProofDepth: 1},
+			OnOutcome: func(o claimimport.Outcome) { outcomes = append(outcomes, o) },
+		}
+		deep := testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.IndexCaveats]{testutil.RandomIndexClaim()},
+			delegation.WithProof(delegation.FromDelegation(proven))))(t)
+		report, err := claimimport.Import(ctx, &mockSink{}, archive(t, proven), opts)
+		require.NoError(t, err)
+		require.Equal(t, 1, report.Imported)
+
+		report, err = claimimport.Import(ctx, &mockSink{}, archive(t, deep), opts)
+		require.NoError(t, err)
+		require.Equal(t, 1, report.Invalid)
+		require.Equal(t, claimlookup.ErrClaimTooComplex{Reason: claimlookup.ReasonProofDepth}.Error(), outcomes[1].Reason)
+	})
+
+	t.Run("claims within the clock skew tolerance are imported and counted", func(t *testing.T) {
+		at := func(d time.Duration) int { return int(time.Now().Add(d).Unix()) }
+		claim := func(opts ...delegation.Option) delegation.Delegation {
+			return testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.IndexCaveats]{testutil.RandomIndexClaim()}, opts...))(t)
+		}
+		justExpired := claim(delegation.WithExpiration(at(-time.Minute)))
+		longExpired := claim(delegation.WithExpiration(at(-time.Hour)))
+		notYetValid := claim(delegation.WithNotBefore(at(time.Hour)))
+		fixture := func(t *testing.T) io.Reader { return archive(t, justExpired, longExpired, notYetValid) }
+
+		var outcomes []claimimport.Outcome
+		report, err := claimimport.Import(ctx, &mockSink{}, fixture(t), claimimport.Options{
+			OnOutcome: func(o claimimport.Outcome) { outcomes = append(outcomes, o) },
+		})
+		require.NoError(t, err)
+		require.Equal(t, 3, report.Invalid)
+		require.Equal(t, "expired", outcomes[0].Reason)
+		require.Empty(t, outcomes[0].ClockSkew)
+
+		outcomes = nil
+		metrics := countingSkewMetrics{}
+		sink := &mockSink{}
+		report, err = claimimport.Import(ctx, sink, fixture(t), claimimport.Options{
+			ClockSkewTolerance: 5 * time.Minute,
+			SkewMetrics:        metrics,
+			OnOutcome:          func(o claimimport.Outcome) { outcomes = append(outcomes, o) },
+		})
+		require.NoError(t, err)
+		require.Equal(t, claimimport.Report{Imported: 1, Invalid: 2}, report)
+		require.Equal(t, []cid.Cid{claimCid(justExpired)}, sink.cached)
+		require.Equal(t, countingSkewMetrics{claimlookup.TimestampExpiration: 1}, metrics)
+		// the comparison the tolerance decided is recorded with the outcome
+		require.Contains(t, outcomes[0].ClockSkew, "accepted exp")
+		require.Equal(t, "expired", outcomes[1].Reason)
+		require.Contains(t, outcomes[1].ClockSkew, "rejected exp")
+		require.Equal(t, "not yet valid", outcomes[2].Reason)
+		require.Contains(t, outcomes[2].ClockSkew, "rejected nbf")
+	})
+
+	t.Run("a truncated CAR stops the import", func(t *testing.T) {
+		data := testutil.Must(io.ReadAll(fixture(t)))(t)
+		sink := &mockSink{}
+		report, err := claimimport.Import(ctx, sink, bytes.NewReader(data[:len(data)-10]), claimimport.Options{TrustedIssuers: trusted})
+		require.Error(t, err)
+		require.Equal(t, 3, report.Imported)
+	})
+}
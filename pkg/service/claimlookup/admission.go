@@ -0,0 +1,240 @@
+package claimlookup
+
+import (
+	"context"
+	"hash/maphash"
+	"math/bits"
+	"sync"
+
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// DefaultAdmissionThreshold is the fewest estimated requests for a claim it
+	// takes to be cached once the cache has no headroom
+	DefaultAdmissionThreshold = 3
+	// DefaultAdmissionCounters is the number of counters in each row of the
+	// frequency sketch when not otherwise configured
+	DefaultAdmissionCounters = 1 << 16
+	// DefaultAdmissionEntries is the number of cached claims whose size is
+	// remembered when not otherwise configured
+	DefaultAdmissionEntries = 100_000
+)
+
+// AdmissionPolicy decides which fetched claims are written to the claim cache
+type AdmissionPolicy interface {
+	// Requested records a request for the claim, whether or not it was cached
+	Requested(claim cid.Cid)
+	// Admit returns true if the fetched claim, of the size in bytes, should be
+	// written to the cache
+	Admit(claim cid.Cid, size int) bool
+	// Written records a claim of the size in bytes written to the cache without
+	// being admitted, such as one published by the service. It is admitted if
+	// it is fetched again
+	Written(claim cid.Cid, size int)
+}
+
+// AdmissionMetrics is told whether each fetched claim was written to the cache
+type AdmissionMetrics interface {
+	ClaimAdmitted(admitted bool)
+}
+
+type noopAdmissionMetrics struct{}
+
+func (noopAdmissionMetrics) ClaimAdmitted(bool) {}
+
+// TinyLFUOption configures a TinyLFU policy
+type TinyLFUOption func(*TinyLFU)
+
+// WithAdmissionThreshold sets the fewest estimated requests for a claim it
+// takes to be cached once the cache has no headroom. If not set,
+// DefaultAdmissionThreshold is used
+func WithAdmissionThreshold(n int) TinyLFUOption {
+	return func(p *TinyLFU) {
+		if n > 0 {
+			p.threshold = min(n, maxCount)
+		}
+	}
+}
+
+// WithAdmissionCounters sets the number of counters in each row of the
+// frequency sketch, rounded up to a power of two. If not set,
+// DefaultAdmissionCounters is used
+func WithAdmissionCounters(n int) TinyLFUOption {
+	return func(p *TinyLFU) {
+		if n > 0 {
+			p.width = 1 << bits.Len(uint(n-1))
+		}
+	}
+}
+
+// WithAdmissionEntries sets the number of cached claims whose size is
+// remembered. If not set, DefaultAdmissionEntries is used
+func WithAdmissionEntries(n int) TinyLFUOption {
+	return func(p *TinyLFU) {
+		if n > 0 {
+			p.entries = n
+		}
+	}
+}
+
+const (
+	sketchDepth = 4
+	// maxCount is where the counters of the sketch saturate
+	maxCount = 15
+)
+
+type cachedClaim struct {
+	size      int
+	published bool
+}
+
+// TinyLFU admits fetched claims to a cache of a byte budget while it has
+// headroom, and after that only those requested often enough, and more often
+// than the least recently used claim they would evict. Request counts
+// are estimated by a count-min sketch, halved every few requests per counter so
+// that claims that were once hot age out.
+//
+// Headroom is the budget less the sizes of the claims it has seen written to
+// the cache, forgotten oldest first once they exceed it as the cache would
+// evict them. The cache may expire or evict claims sooner, so headroom is an
+// underestimate
+type TinyLFU struct {
+	lk        sync.Mutex
+	seed      maphash.Seed
+	width     int
+	threshold int
+	entries   int
+	sketch    [sketchDepth][]uint8
+	requests  int
+	budget    int64
+	used      int64
+	cached    *simplelru.LRU[cid.Cid, cachedClaim]
+}
+
+var _ AdmissionPolicy = (*TinyLFU)(nil)
+
+// NewTinyLFU returns a policy for a claim cache of the budget in bytes
+func NewTinyLFU(budget int64, opts ...TinyLFUOption) *TinyLFU {
+	p := &TinyLFU{
+		seed:      maphash.MakeSeed(),
+		width:     DefaultAdmissionCounters,
+		threshold: DefaultAdmissionThreshold,
+		entries:   DefaultAdmissionEntries,
+		budget:    budget,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	for i := range p.sketch {
+		p.sketch[i] = make([]uint8, p.width)
+	}
+	cached, err := simplelru.NewLRU(p.entries, func(_ cid.Cid, c cachedClaim) {
+		p.used -= int64(c.size)
+	})
+	if err != nil {
+		panic(err)
+	}
+	p.cached = cached
+	return p
+}
+
+// Requested counts a request for the claim
+func (p *TinyLFU) Requested(claim cid.Cid) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	// a hit keeps the claim as recently used as it is in the cache
+	p.cached.Get(claim)
+	for i, slot := range p.slots(claim) {
+		if p.sketch[i][slot] < maxCount {
+			p.sketch[i][slot]++
+		}
+	}
+	p.requests++
+	// aged every ten requests a counter, as TinyLFU does
+	if p.requests >= 10*p.width {
+		p.requests = 0
+		for i := range p.sketch {
+			for j := range p.sketch[i] {
+				p.sketch[i][j] >>= 1
+			}
+		}
+	}
+}
+
+// Admit admits claims published by the service, any claim while the cache has
+// headroom for it, and after that claims requested at least the threshold
+// number of times and more often than the claim the cache would evict first
+func (p *TinyLFU) Admit(claim cid.Cid, size int) bool {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	if c, ok := p.cached.Peek(claim); ok && c.published {
+		p.cache(claim, size, true)
+		return true
+	}
+	if p.used+int64(size) > p.budget {
+		n := p.estimate(claim)
+		if n < p.threshold {
+			return false
+		}
+		if victim, _, ok := p.cached.GetOldest(); ok && n <= p.estimate(victim) {
+			return false
+		}
+	}
+	p.cache(claim, size, false)
+	return true
+}
+
+// Written counts the claim towards the budget, and remembers it was published
+func (p *TinyLFU) Written(claim cid.Cid, size int) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.cache(claim, size, true)
+}
+
+func (p *TinyLFU) cache(claim cid.Cid, size int, published bool) {
+	if c, ok := p.cached.Peek(claim); ok {
+		p.used -= int64(c.size)
+		published = published || c.published
+	}
+	p.cached.Add(claim, cachedClaim{size: size, published: published})
+	p.used += int64(size)
+	for p.used > p.budget && p.cached.Len() > 1 {
+		p.cached.RemoveOldest()
+	}
+}
+
+// estimate returns the least of the claim's counters
+func (p *TinyLFU) estimate(claim cid.Cid) int {
+	n := maxCount
+	for i, slot := range p.slots(claim) {
+		n = min(n, int(p.sketch[i][slot]))
+	}
+	return n
+}
+
+// slots returns the counter of the claim in each row of the sketch
+func (p *TinyLFU) slots(claim cid.Cid) [sketchDepth]int {
+	h := maphash.Bytes(p.seed, claim.Hash())
+	lo, hi := uint32(h), uint32(h>>32)
+	var slots [sketchDepth]int
+	for i := range slots {
+		slots[i] = int((lo + uint32(i)*hi) & uint32(p.width-1))
+	}
+	return slots
+}
+
+type notCachedKey struct{}
+
+// WithNotCachedNotice returns a context in which claims fetched through a
+// caching lookup but not admitted to the cache are passed to notice
+func WithNotCachedNotice(ctx context.Context, notice func(claim cid.Cid)) context.Context {
+	return context.WithValue(ctx, notCachedKey{}, notice)
+}
+
+func notCached(ctx context.Context, claim cid.Cid) {
+	if notice, ok := ctx.Value(notCachedKey{}).(func(cid.Cid)); ok {
+		notice(claim)
+	}
+}
@@ -0,0 +1,175 @@
+package claimlookup_test
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/url"
+	"testing"
+
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithAdmission(t *testing.T) {
+	newClaims := func(n int) ([]cid.Cid, map[cid.Cid]delegation.Delegation) {
+		cids := make([]cid.Cid, 0, n)
+		claims := make(map[cid.Cid]delegation.Delegation, n)
+		for range n {
+			claim := testutil.RandomLocationDelegation()
+			c := claim.Link().(cidlink.Link).Cid
+			cids = append(cids, c)
+			claims[c] = claim
+		}
+		return cids, claims
+	}
+	hot, claims := newClaims(200)
+	oneHit, oneHitClaims := newClaims(2000)
+	for c, claim := range oneHitClaims {
+		claims[c] = claim
+	}
+	size := len(testutil.Must(io.ReadAll(claims[hot[0]].Archive()))(t))
+	// room for a tenth of the hot claims
+	budget := int64(size * 20)
+	lookup := &mapClaimLookup{claims: claims}
+
+	t.Run("hot claims are cached and one hit wonders aren't", func(t *testing.T) {
+		store := newBudgetedClaimStore(t, budget)
+		metrics := &admissionMetrics{}
+		cl := claimlookup.WithCache(lookup, store, claimlookup.WithAdmission(claimlookup.NewTinyLFU(budget)), claimlookup.WithAdmissionMetrics(metrics))
+
+		zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.2, 1, uint64(len(hot)-1))
+		for i, c := range oneHit {
+			// a one hit wonder after every four requests of the zipfian stream
+			for range 4 {
+				testutil.Must(cl.LookupClaim(context.Background(), hot[zipf.Uint64()], *testutil.TestURL))(t)
+			}
+			testutil.Must(cl.LookupClaim(context.Background(), c, *testutil.TestURL))(t)
+			if i == len(oneHit)/2 {
+				require.NotZero(t, metrics.rejected, "the budget fills in the first half of the stream")
+			}
+		}
+		for _, c := range hot[:10] {
+			require.True(t, store.Contains(c), "hot claims are cached")
+		}
+		for _, c := range oneHit[len(oneHit)/2:] {
+			require.False(t, store.Contains(c), "one hit wonders aren't cached once the budget is full")
+		}
+		require.NotZero(t, metrics.admitted)
+	})
+
+	t.Run("published claims bypass admission", func(t *testing.T) {
+		store := newBudgetedClaimStore(t, budget)
+		policy := claimlookup.NewTinyLFU(budget)
+		cl := claimlookup.WithCache(lookup, store, claimlookup.WithAdmission(policy))
+		// the budget is filled by claims requested once
+		for _, c := range oneHit[:40] {
+			testutil.Must(cl.LookupClaim(context.Background(), c, *testutil.TestURL))(t)
+		}
+
+		published, cold := hot[0], hot[1]
+		require.NoError(t, claimlookup.CacheClaim(context.Background(), store, claims[published], true, claimlookup.CountedBy(policy)))
+		require.True(t, store.Contains(published))
+
+		// fetched again once evicted, it is admitted though requested once
+		store.Remove(published)
+		var notCached []cid.Cid
+		ctx := claimlookup.WithNotCachedNotice(context.Background(), func(c cid.Cid) { notCached = append(notCached, c) })
+		testutil.Must(cl.LookupClaim(ctx, published, *testutil.TestURL))(t)
+		require.True(t, store.Contains(published))
+
+		testutil.Must(cl.LookupClaim(ctx, cold, *testutil.TestURL))(t)
+		require.False(t, store.Contains(cold))
+		require.Equal(t, []cid.Cid{cold}, notCached)
+	})
+
+	t.Run("claims are cached while there is headroom", func(t *testing.T) {
+		store := newBudgetedClaimStore(t, budget)
+		cl := claimlookup.WithCache(lookup, store, claimlookup.WithAdmission(claimlookup.NewTinyLFU(budget)))
+		for _, c := range oneHit[:20] {
+			testutil.Must(cl.LookupClaim(context.Background(), c, *testutil.TestURL))(t)
+		}
+		for _, c := range oneHit[:20] {
+			require.True(t, store.Contains(c))
+		}
+	})
+}
+
+type admissionMetrics struct {
+	admitted, rejected int
+}
+
+func (m *admissionMetrics) ClaimAdmitted(admitted bool) {
+	if admitted {
+		m.admitted++
+	} else {
+		m.rejected++
+	}
+}
+
+type mapClaimLookup struct {
+	claims map[cid.Cid]delegation.Delegation
+}
+
+func (m *mapClaimLookup) LookupClaim(ctx context.Context, claimCid cid.Cid, fetchURL url.URL) (delegation.Delegation, error) {
+	return m.claims[claimCid], nil
+}
+
+// budgetedClaimStore evicts the least recently used claims once they exceed
+// the budget in bytes, as redis does with a memory limit
+type budgetedClaimStore struct {
+	t      *testing.T
+	budget int64
+	used   int64
+	claims *simplelru.LRU[cid.Cid, delegation.Delegation]
+}
+
+var _ types.ContentClaimsStore = (*budgetedClaimStore)(nil)
+
+func newBudgetedClaimStore(t *testing.T, budget int64) *budgetedClaimStore {
+	s := &budgetedClaimStore{t: t, budget: budget}
+	s.claims = testutil.Must(simplelru.NewLRU(1<<20, func(_ cid.Cid, claim delegation.Delegation) {
+		s.used -= s.size(claim)
+	}))(t)
+	return s
+}
+
+func (s *budgetedClaimStore) size(claim delegation.Delegation) int64 {
+	return int64(len(testutil.Must(io.ReadAll(claim.Archive()))(s.t)))
+}
+
+func (s *budgetedClaimStore) Set(ctx context.Context, claimCid cid.Cid, claim delegation.Delegation, expires bool) error {
+	s.Remove(claimCid)
+	s.claims.Add(claimCid, claim)
+	s.used += s.size(claim)
+	for s.used > s.budget {
+		s.claims.RemoveOldest()
+	}
+	return nil
+}
+
+func (s *budgetedClaimStore) SetExpirable(ctx context.Context, claimCid cid.Cid, expires bool) error {
+	return nil
+}
+
+func (s *budgetedClaimStore) Get(ctx context.Context, claimCid cid.Cid) (delegation.Delegation, error) {
+	claim, ok := s.claims.Get(claimCid)
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return claim, nil
+}
+
+func (s *budgetedClaimStore) Contains(claimCid cid.Cid) bool {
+	return s.claims.Contains(claimCid)
+}
+
+func (s *budgetedClaimStore) Remove(claimCid cid.Cid) {
+	s.claims.Remove(claimCid)
+}
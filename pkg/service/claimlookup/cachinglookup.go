@@ -5,43 +5,109 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/delegationutil"
 	"github.com/storacha/indexing-service/pkg/types"
 )
 
 type cachingLookup struct {
 	claimLookup ClaimLookup
 	claimStore  types.ContentClaimsStore
+	metrics     types.CacheMetrics
+	admission   AdmissionPolicy
+	admitted    AdmissionMetrics
+}
+
+// CacheOption configures a caching lookup
+type CacheOption func(*cachingLookup)
+
+// WithCacheMetrics reports whether each read of the claim store found the claim
+func WithCacheMetrics(m types.CacheMetrics) CacheOption {
+	return func(cl *cachingLookup) {
+		cl.metrics = m
+	}
+}
+
+// WithAdmission only caches the fetched claims the policy admits. Without it,
+// every fetched claim is cached
+func WithAdmission(policy AdmissionPolicy) CacheOption {
+	return func(cl *cachingLookup) {
+		cl.admission = policy
+	}
+}
+
+// WithAdmissionMetrics reports whether each fetched claim was admitted to the
+// cache
+func WithAdmissionMetrics(m AdmissionMetrics) CacheOption {
+	return func(cl *cachingLookup) {
+		cl.admitted = m
+	}
 }
 
 // WithCache augments a ClaimLookup with cached claims from a claim store
-func WithCache(claimLookup ClaimLookup, claimStore types.ContentClaimsStore) ClaimLookup {
-	return &cachingLookup{
+func WithCache(claimLookup ClaimLookup, claimStore types.ContentClaimsStore, opts ...CacheOption) ClaimLookup {
+	cl := &cachingLookup{
 		claimLookup: claimLookup,
 		claimStore:  claimStore,
+		metrics:     types.NoopCacheMetrics{},
+		admitted:    noopAdmissionMetrics{},
+	}
+	for _, opt := range opts {
+		opt(cl)
 	}
+	return cl
 }
 
 // LookupClaim attempts to fetch a claim from either the local cache or via the provided URL (caching the result if its fetched)
 func (cl *cachingLookup) LookupClaim(ctx context.Context, claimCid cid.Cid, fetchURL url.URL) (delegation.Delegation, error) {
+	if cl.admission != nil {
+		cl.admission.Requested(claimCid)
+	}
 	// attempt to read claim from cache and return it if succesful
 	claim, err := cl.claimStore.Get(ctx, claimCid)
 	if err == nil {
+		types.CacheRead(ctx, cl.metrics, types.ClaimsCache, true)
 		return claim, nil
 	}
 
-	// if an error occurred other than the claim not being in the cache, return it
-	if !errors.Is(err, types.ErrKeyNotFound) {
+	// if an error occurred other than the claim not being in the cache, return
+	// it. A corrupt claim is fetched again, replacing it
+	if errors.Is(err, types.ErrCorruptEntry) {
+		log.Warnw("refetching corrupt cached claim", "claim", claimCid, "error", err)
+	} else if !errors.Is(err, types.ErrKeyNotFound) {
 		return nil, fmt.Errorf("reading from claim cache: %w", err)
 	}
+	types.CacheRead(ctx, cl.metrics, types.ClaimsCache, false)
 
 	// attempt to fetch the claim from the underlying claim lookup
 	claim, err = cl.claimLookup.LookupClaim(ctx, claimCid, fetchURL)
 	if err != nil {
 		return nil, fmt.Errorf("fetching underlying claim: %w", err)
 	}
+	// the claim is served as it is cached, however it was archived by its origin
+	claim, err = delegationutil.Canonical(claim)
+	if err != nil {
+		return nil, fmt.Errorf("canonicalizing fetched claim: %w", err)
+	}
+
+	if cl.admission != nil {
+		size, err := claimSize(claim)
+		if err != nil {
+			return nil, fmt.Errorf("sizing fetched claim: %w", err)
+		}
+		admitted := cl.admission.Admit(claimCid, size)
+		cl.admitted.ClaimAdmitted(admitted)
+		if !admitted {
+			notCached(ctx, claimCid)
+			if sr, ok := cl.claimStore.(skipRecordingClaimStore); ok {
+				sr.WriteSkipped(claimCid, size)
+			}
+			return claim, nil
+		}
+	}
 
 	// cache the claim for the future
 	if err := cl.claimStore.Set(ctx, claimCid, claim, true); err != nil {
@@ -49,3 +115,91 @@ func (cl *cachingLookup) LookupClaim(ctx context.Context, claimCid cid.Cid, fetc
 	}
 	return claim, nil
 }
+
+// skipRecordingClaimStore is implemented by claim stores that record the
+// claims not written to them because they weren't admitted
+type skipRecordingClaimStore interface {
+	WriteSkipped(claimCid cid.Cid, size int)
+}
+
+// ttlClaimStore is implemented by claim stores that can set an explicit
+// expiration on a write
+type ttlClaimStore interface {
+	SetWithTTL(ctx context.Context, claimCid cid.Cid, claim delegation.Delegation, ttl time.Duration) error
+}
+
+// CacheClaimOption configures caching a claim with CacheClaim
+type CacheClaimOption func(*cacheClaimConfig)
+
+type cacheClaimConfig struct {
+	tolerance time.Duration
+	admission AdmissionPolicy
+}
+
+// WithSkewTolerance caches an expiring claim for the tolerance past its
+// expiration, as long as a claim that is checked with the same tolerance is
+// still accepted
+func WithSkewTolerance(tolerance time.Duration) CacheClaimOption {
+	return func(c *cacheClaimConfig) {
+		c.tolerance = max(tolerance, 0)
+	}
+}
+
+// CountedBy counts the cached claim towards the budget of the admission
+// policy, without asking it to admit the claim
+func CountedBy(policy AdmissionPolicy) CacheClaimOption {
+	return func(c *cacheClaimConfig) {
+		c.admission = policy
+	}
+}
+
+// CacheClaim writes a claim already held in full to the claim store, the same
+// way a fetched claim is cached, so that it is served from the cache rather
+// than fetched. An expiring claim is cached until its expiration where the store
+// supports it, and one that has already expired is not cached. If expires is
+// false the claim is cached without expiring, until it is made expirable
+func CacheClaim(ctx context.Context, claimStore types.ContentClaimsStore, claim delegation.Delegation, expires bool, opts ...CacheClaimOption) error {
+	var cfg cacheClaimConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	claimCid, err := cid.Parse(claim.Link().String())
+	if err != nil {
+		return fmt.Errorf("parsing claim CID: %w", err)
+	}
+	written, err := cacheClaim(ctx, claimStore, claimCid, claim, expires, cfg.tolerance)
+	if err != nil || !written || cfg.admission == nil {
+		return err
+	}
+	size, err := claimSize(claim)
+	if err != nil {
+		return fmt.Errorf("sizing claim: %w", err)
+	}
+	cfg.admission.Written(claimCid, size)
+	return nil
+}
+
+// cacheClaim writes the claim to the claim store, returning false if it had
+// already expired
+func cacheClaim(ctx context.Context, claimStore types.ContentClaimsStore, claimCid cid.Cid, claim delegation.Delegation, expires bool, tolerance time.Duration) (bool, error) {
+	if !expires {
+		return true, claimStore.Set(ctx, claimCid, claim, false)
+	}
+	if claim.Expiration() != nil {
+		ttl, ok := ClaimTTL(claim, time.Now(), tolerance)
+		if !ok {
+			return false, nil
+		}
+		if ts, ok := claimStore.(ttlClaimStore); ok {
+			return true, ts.SetWithTTL(ctx, claimCid, claim, ttl)
+		}
+	}
+	return true, claimStore.Set(ctx, claimCid, claim, true)
+}
+
+// claimSize returns the size in bytes of the claim as it is cached, which is
+// the size of its canonical archive
+func claimSize(claim delegation.Delegation) (int, error) {
+	archive, err := delegationutil.Canonicalize(claim)
+	return len(archive), err
+}
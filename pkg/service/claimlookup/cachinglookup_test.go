@@ -4,12 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/delegationutil"
 	"github.com/storacha/indexing-service/pkg/internal/testutil"
 	"github.com/storacha/indexing-service/pkg/service/claimlookup"
 	"github.com/storacha/indexing-service/pkg/types"
@@ -65,6 +70,15 @@ func TestWithCache__LookupClaim(t *testing.T) {
 				cachedCid.String(): cachedClaim,
 			},
 		},
+		{
+			name:          "Corrupt cached claim, refetched",
+			claimCid:      cachedCid,
+			expectedClaim: notCachedClaim,
+			getErr:        fmt.Errorf("%w: claim checksum mismatch", types.ErrCorruptEntry),
+			finalState: map[string]delegation.Delegation{
+				cachedCid.String(): notCachedClaim,
+			},
+		},
 		{
 			name:          "Save cache error",
 			claimCid:      notCachedCid,
@@ -125,6 +139,95 @@ func TestWithCache__LookupClaim(t *testing.T) {
 	}
 }
 
+func TestCacheClaim(t *testing.T) {
+	anError := errors.New("fetching disabled")
+	delegate := func(expiration time.Time) delegation.Delegation {
+		location := assert.Location.New(testutil.Service.DID().String(), assert.LocationCaveats{
+			Content:  assert.FromHash(testutil.RandomMultihash()),
+			Location: []url.URL{*testutil.TestURL},
+		})
+		var opts []delegation.Option
+		if !expiration.IsZero() {
+			opts = append(opts, delegation.WithExpiration(int(expiration.Unix())))
+		}
+		return testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.LocationCaveats]{location}, opts...))(t)
+	}
+	newStore := func() *ttlClaimsStore {
+		return &ttlClaimsStore{
+			MockContentClaimsStore: MockContentClaimsStore{claims: map[string]delegation.Delegation{}},
+			expires:                map[string]bool{},
+			ttls:                   map[string]time.Duration{},
+		}
+	}
+	asCid := func(claim delegation.Delegation) cid.Cid {
+		return claim.Link().(cidlink.Link).Cid
+	}
+
+	t.Run("cached claims are looked up without fetching", func(t *testing.T) {
+		store := newStore()
+		claim := delegate(time.Time{})
+		require.NoError(t, claimlookup.CacheClaim(context.Background(), store, claim, true))
+
+		cl := claimlookup.WithCache(&mockClaimLookup{nil, anError}, store)
+		found := testutil.Must(cl.LookupClaim(context.Background(), asCid(claim), *testutil.TestURL))(t)
+		testutil.RequireEqualDelegation(t, claim, found)
+	})
+
+	t.Run("expiring claims are cached until they expire", func(t *testing.T) {
+		store := newStore()
+		claim := delegate(time.Now().Add(time.Hour))
+		require.NoError(t, claimlookup.CacheClaim(context.Background(), store, claim, true))
+		ttl := store.ttls[asCid(claim).String()]
+		require.Greater(t, ttl, 59*time.Minute)
+		require.LessOrEqual(t, ttl, time.Hour)
+	})
+
+	t.Run("claims that don't expire yet are cached without a TTL", func(t *testing.T) {
+		store := newStore()
+		claim := delegate(time.Now().Add(time.Hour))
+		require.NoError(t, claimlookup.CacheClaim(context.Background(), store, claim, false))
+		require.Contains(t, store.claims, asCid(claim).String())
+		require.False(t, store.expires[asCid(claim).String()])
+		require.Empty(t, store.ttls)
+	})
+
+	t.Run("expired claims are not cached", func(t *testing.T) {
+		store := newStore()
+		require.NoError(t, claimlookup.CacheClaim(context.Background(), store, delegate(time.Now().Add(-time.Hour)), true))
+		require.Empty(t, store.claims)
+	})
+
+	t.Run("claims expired within the skew tolerance are cached for the rest of it", func(t *testing.T) {
+		store := newStore()
+		claim := delegate(time.Now().Add(-time.Minute))
+		require.NoError(t, claimlookup.CacheClaim(context.Background(), store, claim, true, claimlookup.WithSkewTolerance(5*time.Minute)))
+		ttl := store.ttls[asCid(claim).String()]
+		require.Greater(t, ttl, 3*time.Minute)
+		require.LessOrEqual(t, ttl, 4*time.Minute)
+
+		store = newStore()
+		require.NoError(t, claimlookup.CacheClaim(context.Background(), store, delegate(time.Now().Add(-10*time.Minute)), true, claimlookup.WithSkewTolerance(5*time.Minute)))
+		require.Empty(t, store.claims)
+	})
+}
+
+// ttlClaimsStore records how claims were cached
+type ttlClaimsStore struct {
+	MockContentClaimsStore
+	expires map[string]bool
+	ttls    map[string]time.Duration
+}
+
+func (m *ttlClaimsStore) Set(ctx context.Context, claimCid cid.Cid, claim delegation.Delegation, expires bool) error {
+	m.expires[claimCid.String()] = expires
+	return m.MockContentClaimsStore.Set(ctx, claimCid, claim, expires)
+}
+
+func (m *ttlClaimsStore) SetWithTTL(ctx context.Context, claimCid cid.Cid, claim delegation.Delegation, ttl time.Duration) error {
+	m.ttls[claimCid.String()] = ttl
+	return m.MockContentClaimsStore.Set(ctx, claimCid, claim, true)
+}
+
 // MockContentClaimsStore is a mock implementation of the ContentClaimsStore interface
 type MockContentClaimsStore struct {
 	setErr, getErr error
@@ -165,3 +268,39 @@ type mockClaimLookup struct {
 func (m *mockClaimLookup) LookupClaim(ctx context.Context, claimCid cid.Cid, fetchURL url.URL) (delegation.Delegation, error) {
 	return m.claim, m.err
 }
+
+// sizingPolicy admits every claim, recording the size it was asked to admit
+type sizingPolicy struct {
+	sizes []int
+}
+
+func (p *sizingPolicy) Requested(claim cid.Cid) {}
+
+func (p *sizingPolicy) Admit(claim cid.Cid, size int) bool {
+	p.sizes = append(p.sizes, size)
+	return true
+}
+
+func (p *sizingPolicy) Written(claim cid.Cid, size int) {}
+
+func TestWithCache__CanonicalClaims(t *testing.T) {
+	claim := testutil.RandomLocationDelegation()
+	claimCid := claim.Link().(cidlink.Link).Cid
+	policy := &sizingPolicy{}
+	// the same claim fetched from two origins that archive it differently
+	var fetched []delegation.Delegation
+	var cached []delegation.Delegation
+	for _, archive := range [][]byte{testutil.Must(io.ReadAll(claim.Archive()))(t), testutil.ReorderedArchive(t, claim)} {
+		store := &MockContentClaimsStore{claims: map[string]delegation.Delegation{}}
+		lookup := claimlookup.WithCache(&mockClaimLookup{claim: testutil.Must(delegation.Extract(archive))(t)}, store, claimlookup.WithAdmission(policy))
+		fetched = append(fetched, testutil.Must(lookup.LookupClaim(context.Background(), claimCid, *testutil.TestURL))(t))
+		cached = append(cached, store.claims[claimCid.String()])
+	}
+	canonical := testutil.Must(delegationutil.Canonicalize(claim))(t)
+	for i := range fetched {
+		// the claim is served and cached as its canonical archive
+		require.Equal(t, canonical, testutil.Must(io.ReadAll(fetched[i].Archive()))(t))
+		require.Equal(t, canonical, testutil.Must(io.ReadAll(cached[i].Archive()))(t))
+	}
+	require.Equal(t, []int{len(canonical), len(canonical)}, policy.sizes)
+}
@@ -0,0 +1,133 @@
+// Package claimlookuptest is a conformance suite for service.ClaimLookup
+// implementations.
+//
+// An implementation passes the suite when it:
+//   - reads claims from its cache before fetching them from the URL, and
+//     caches the claims it fetches
+//   - keeps answering with cached claims while the origin is down
+//   - fails with types.ErrOriginNotFound when the origin doesn't have the
+//     claim, and fetches it again once it does
+//   - fails with types.ErrOriginUnavailable when the origin fails or can't be
+//     reached
+//   - fails with types.ErrCacheOnly, without fetching, for claims it hasn't
+//     cached under a context made with types.WithCacheOnly
+//   - returns the context error when the context is cancelled
+//   - answers the full IndexingService.Query walk
+//
+// Implementations run the suite from their tests:
+//
+//	claimlookuptest.RunConformance(t, func() service.ClaimLookup {
+//		return claimlookup.WithCache(claimlookup.NewClaimLookup(http.DefaultClient), store)
+//	})
+package claimlookuptest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/blobindexlookup"
+	"github.com/storacha/indexing-service/pkg/service/internal/conformance"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns a new claim lookup, with an empty cache
+type Factory func() service.ClaimLookup
+
+// serveClaim serves a new claim from the origin, returning it and its CID
+func serveClaim(t *testing.T, origin *conformance.Origin) (delegation.Delegation, cid.Cid) {
+	claim := testutil.RandomLocationDelegation()
+	claimCid := claim.Link().(cidlink.Link).Cid
+	origin.Serve(t, "/claims/"+claimCid.String(), testutil.Must(io.ReadAll(claim.Archive()))(t))
+	return claim, claimCid
+}
+
+// RunConformance runs the conformance suite against the claim lookups returned
+// by newLookup
+func RunConformance(t *testing.T, newLookup Factory) {
+	ctx := context.Background()
+
+	t.Run("reads the cache before the origin", func(t *testing.T) {
+		origin := conformance.NewOrigin(t)
+		cl := newLookup()
+		claim, claimCid := serveClaim(t, origin)
+		for range 2 {
+			found := testutil.Must(cl.LookupClaim(ctx, claimCid, origin.URL(t, "/claims/"+claimCid.String())))(t)
+			testutil.RequireEqualDelegation(t, claim, found)
+		}
+		require.Equal(t, 1, origin.Requests())
+
+		t.Run("while the origin is down", func(t *testing.T) {
+			origin.Fail(http.StatusServiceUnavailable)
+			found := testutil.Must(cl.LookupClaim(ctx, claimCid, origin.URL(t, "/claims/"+claimCid.String())))(t)
+			testutil.RequireEqualDelegation(t, claim, found)
+		})
+	})
+
+	t.Run("classifies missing claims", func(t *testing.T) {
+		origin := conformance.NewOrigin(t)
+		cl := newLookup()
+		claim := testutil.RandomLocationDelegation()
+		claimCid := claim.Link().(cidlink.Link).Cid
+		fetchURL := origin.URL(t, "/claims/"+claimCid.String())
+		_, err := cl.LookupClaim(ctx, claimCid, fetchURL)
+		require.ErrorIs(t, err, types.ErrOriginNotFound)
+		require.NotErrorIs(t, err, types.ErrOriginUnavailable)
+		// that the claim wasn't found isn't cached
+		origin.Serve(t, fetchURL.Path, testutil.Must(io.ReadAll(claim.Archive()))(t))
+		testutil.RequireEqualDelegation(t, claim, testutil.Must(cl.LookupClaim(ctx, claimCid, fetchURL))(t))
+	})
+
+	t.Run("classifies origin failures", func(t *testing.T) {
+		origin := conformance.NewOrigin(t)
+		cl := newLookup()
+		claim, claimCid := serveClaim(t, origin)
+		fetchURL := origin.URL(t, "/claims/"+claimCid.String())
+		origin.Fail(http.StatusInternalServerError)
+		_, err := cl.LookupClaim(ctx, claimCid, fetchURL)
+		require.ErrorIs(t, err, types.ErrOriginUnavailable)
+		require.NotErrorIs(t, err, types.ErrOriginNotFound)
+		_, err = cl.LookupClaim(ctx, testutil.RandomCID().(cidlink.Link).Cid, conformance.UnreachableURL(t))
+		require.ErrorIs(t, err, types.ErrOriginUnavailable)
+		// failures aren't cached
+		origin.Fail(0)
+		testutil.RequireEqualDelegation(t, claim, testutil.Must(cl.LookupClaim(ctx, claimCid, fetchURL))(t))
+	})
+
+	t.Run("only reads the cache when lookups are cache only", func(t *testing.T) {
+		origin := conformance.NewOrigin(t)
+		cl := newLookup()
+		cached, cachedCid := serveClaim(t, origin)
+		testutil.Must(cl.LookupClaim(ctx, cachedCid, origin.URL(t, "/claims/"+cachedCid.String())))(t)
+		_, uncachedCid := serveClaim(t, origin)
+		cacheOnly := types.WithCacheOnly(ctx)
+		_, err := cl.LookupClaim(cacheOnly, uncachedCid, origin.URL(t, "/claims/"+uncachedCid.String()))
+		require.ErrorIs(t, err, types.ErrCacheOnly)
+		found := testutil.Must(cl.LookupClaim(cacheOnly, cachedCid, origin.URL(t, "/claims/"+cachedCid.String())))(t)
+		testutil.RequireEqualDelegation(t, cached, found)
+		require.Equal(t, 1, origin.Requests())
+	})
+
+	t.Run("stops when the context is cancelled", func(t *testing.T) {
+		origin := conformance.NewOrigin(t)
+		cl := newLookup()
+		_, claimCid := serveClaim(t, origin)
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := cl.LookupClaim(cctx, claimCid, origin.URL(t, "/claims/"+claimCid.String()))
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("answers the query walk", func(t *testing.T) {
+		s := conformance.NewScenario(t)
+		is := testutil.Must(service.NewIndexingService(blobindexlookup.NewBlobIndexLookup(http.DefaultClient), newLookup(), conformance.NewProviderIndex(s.Finder())))(t)
+		s.Query(t, is)
+	})
+}
@@ -0,0 +1,53 @@
+package claimlookup_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup/claimlookuptest"
+)
+
+// memRedis is a redis client holding keys in memory
+type memRedis struct {
+	lk   sync.Mutex
+	data map[string]string
+}
+
+func (m *memRedis) Get(ctx context.Context, key string) *goredis.StringCmd {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	val, ok := m.data[key]
+	if !ok {
+		return goredis.NewStringResult("", goredis.Nil)
+	}
+	return goredis.NewStringResult(val, nil)
+}
+
+func (m *memRedis) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *goredis.StatusCmd {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.data[key] = value.(string)
+	return goredis.NewStatusResult("OK", nil)
+}
+
+func (m *memRedis) Expire(ctx context.Context, key string, expiration time.Duration) *goredis.BoolCmd {
+	return goredis.NewBoolResult(true, nil)
+}
+
+func (m *memRedis) Persist(ctx context.Context, key string) *goredis.BoolCmd {
+	return goredis.NewBoolResult(true, nil)
+}
+
+func TestWithCache__Conformance(t *testing.T) {
+	claimlookuptest.RunConformance(t, func() service.ClaimLookup {
+		store := redis.NewContentClaimsStore(&memRedis{data: map[string]string{}})
+		return claimlookup.WithCache(claimlookup.NewClaimLookup(http.DefaultClient), store)
+	})
+}
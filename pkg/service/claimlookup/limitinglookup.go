@@ -0,0 +1,105 @@
+package claimlookup
+
+import (
+	"context"
+	"errors"
+	"net/url"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/storacha/go-ucanto/core/delegation"
+)
+
+var log = logging.Logger("claimlookup")
+
+// DefaultRejectedClaims is the number of claims found too complex that are
+// remembered when not otherwise configured
+const DefaultRejectedClaims = 10_000
+
+// LimitMetrics is told about claims that exceed the limits
+type LimitMetrics interface {
+	// ClaimTooComplex is called with the reason a fetched claim was found to
+	// exceed the limits. Claims rejected again from memory aren't counted
+	ClaimTooComplex(reason string)
+}
+
+type noopLimitMetrics struct{}
+
+func (noopLimitMetrics) ClaimTooComplex(string) {}
+
+type limitingLookup struct {
+	claimLookup ClaimLookup
+	limits      Limits
+	size        int
+	rejected    *lru.Cache[cid.Cid, ErrClaimTooComplex]
+	metrics     LimitMetrics
+}
+
+// LimitOption configures a limiting lookup
+type LimitOption func(*limitingLookup)
+
+// WithLimitMetrics reports the claims found too complex to the given metrics
+func WithLimitMetrics(m LimitMetrics) LimitOption {
+	return func(ll *limitingLookup) {
+		ll.metrics = m
+	}
+}
+
+// WithRejectedClaims sets the number of claims found too complex that are
+// remembered. If not set, DefaultRejectedClaims is used
+func WithRejectedClaims(size int) LimitOption {
+	return func(ll *limitingLookup) {
+		if size > 0 {
+			ll.size = size
+		}
+	}
+}
+
+// WithLimits augments a ClaimLookup with a check of each claim fetched against
+// the limits. A claim that exceeds them fails with ErrClaimTooComplex, and is
+// remembered so that it fails again without being fetched. Claims that time out
+// aren't remembered, as the deadline may have been missed because of a slow
+// fetch or a loaded host rather than the claim itself
+func WithLimits(claimLookup ClaimLookup, limits Limits, opts ...LimitOption) ClaimLookup {
+	ll := &limitingLookup{
+		claimLookup: claimLookup,
+		limits:      limits.WithDefaults(),
+		size:        DefaultRejectedClaims,
+		metrics:     noopLimitMetrics{},
+	}
+	for _, opt := range opts {
+		opt(ll)
+	}
+	rejected, err := lru.New[cid.Cid, ErrClaimTooComplex](ll.size)
+	if err != nil {
+		panic(err)
+	}
+	ll.rejected = rejected
+	return ll
+}
+
+// LookupClaim fetches the claim from the underlying lookup, unless it is known
+// to be too complex, and checks it against the limits
+func (ll *limitingLookup) LookupClaim(ctx context.Context, claimCid cid.Cid, fetchURL url.URL) (delegation.Delegation, error) {
+	if tooComplex, ok := ll.rejected.Get(claimCid); ok {
+		return nil, tooComplex
+	}
+	claim, err := ll.claimLookup.LookupClaim(ctx, claimCid, fetchURL)
+	if err == nil {
+		err = CheckLimits(ctx, claim, ll.limits)
+	}
+	var tooComplex ErrClaimTooComplex
+	if errors.As(err, &tooComplex) {
+		log.Warnw("rejecting claim", "claim", claimCid, "url", fetchURL.String(), "reason", tooComplex.Reason)
+		if tooComplex.Reason != ReasonTimeout {
+			ll.rejected.Add(claimCid, tooComplex)
+		}
+		ll.metrics.ClaimTooComplex(tooComplex.Reason)
+		return nil, tooComplex
+	}
+	if err != nil {
+		return nil, err
+	}
+	return claim, nil
+}
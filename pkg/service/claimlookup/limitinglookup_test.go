@@ -0,0 +1,106 @@
+package claimlookup_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/stretchr/testify/require"
+)
+
+type countingClaimLookup struct {
+	claim   delegation.Delegation
+	err     error
+	lookups int
+}
+
+func (m *countingClaimLookup) LookupClaim(ctx context.Context, claimCid cid.Cid, fetchURL url.URL) (delegation.Delegation, error) {
+	m.lookups++
+	return m.claim, m.err
+}
+
+type countingLimitMetrics map[string]int
+
+func (m countingLimitMetrics) ClaimTooComplex(reason string) { m[reason]++ }
+
+func TestWithLimits__LookupClaim(t *testing.T) {
+	ctx := context.Background()
+	claimCid := testutil.RandomCID().(cidlink.Link).Cid
+	limits := claimlookup.Limits{MaxProofDepth: 2}
+
+	t.Run("claims within the limits are returned", func(t *testing.T) {
+		claim := provenClaim(t, 2, 0, 1)
+		base := &countingClaimLookup{claim: claim}
+		metrics := countingLimitMetrics{}
+		cl := claimlookup.WithLimits(base, limits, claimlookup.WithLimitMetrics(metrics))
+		got, err := cl.LookupClaim(ctx, claimCid, *testutil.TestURL)
+		require.NoError(t, err)
+		testutil.RequireEqualDelegation(t, claim, got)
+		require.Empty(t, metrics)
+	})
+
+	t.Run("claims too complex are rejected and remembered", func(t *testing.T) {
+		base := &countingClaimLookup{claim: provenClaim(t, 3, 0, 1)}
+		metrics := countingLimitMetrics{}
+		cl := claimlookup.WithLimits(base, limits, claimlookup.WithLimitMetrics(metrics))
+		for range 3 {
+			_, err := cl.LookupClaim(ctx, claimCid, *testutil.TestURL)
+			require.ErrorIs(t, err, claimlookup.ErrClaimTooComplex{Reason: claimlookup.ReasonProofDepth})
+		}
+		require.Equal(t, 1, base.lookups)
+		require.Equal(t, countingLimitMetrics{claimlookup.ReasonProofDepth: 1}, metrics)
+	})
+
+	t.Run("claims too large to fetch are remembered", func(t *testing.T) {
+		base := &countingClaimLookup{err: claimlookup.ErrClaimTooComplex{Reason: claimlookup.ReasonSize}}
+		metrics := countingLimitMetrics{}
+		cl := claimlookup.WithLimits(base, limits, claimlookup.WithLimitMetrics(metrics))
+		for range 2 {
+			_, err := cl.LookupClaim(ctx, claimCid, *testutil.TestURL)
+			require.ErrorIs(t, err, claimlookup.ErrClaimTooComplex{Reason: claimlookup.ReasonSize})
+		}
+		require.Equal(t, 1, base.lookups)
+		require.Equal(t, countingLimitMetrics{claimlookup.ReasonSize: 1}, metrics)
+	})
+
+	t.Run("claims that time out are not remembered", func(t *testing.T) {
+		base := &countingClaimLookup{claim: provenClaim(t, 2, 0, 1)}
+		metrics := countingLimitMetrics{}
+		cl := claimlookup.WithLimits(base, claimlookup.Limits{Timeout: time.Nanosecond}, claimlookup.WithLimitMetrics(metrics))
+		for range 2 {
+			_, err := cl.LookupClaim(ctx, claimCid, *testutil.TestURL)
+			require.ErrorIs(t, err, claimlookup.ErrClaimTooComplex{Reason: claimlookup.ReasonTimeout})
+		}
+		require.Equal(t, 2, base.lookups)
+		require.Equal(t, countingLimitMetrics{claimlookup.ReasonTimeout: 2}, metrics)
+	})
+
+	t.Run("other failures are not remembered", func(t *testing.T) {
+		anError := errors.New("something went wrong")
+		base := &countingClaimLookup{err: anError}
+		cl := claimlookup.WithLimits(base, limits)
+		for range 2 {
+			_, err := cl.LookupClaim(ctx, claimCid, *testutil.TestURL)
+			require.ErrorIs(t, err, anError)
+		}
+		require.Equal(t, 2, base.lookups)
+	})
+
+	t.Run("rejected claims are forgotten beyond the configured number", func(t *testing.T) {
+		base := &countingClaimLookup{claim: provenClaim(t, 3, 0, 1)}
+		cl := claimlookup.WithLimits(base, limits, claimlookup.WithRejectedClaims(1))
+		other := testutil.RandomCID().(cidlink.Link).Cid
+		for _, c := range []cid.Cid{claimCid, other, claimCid} {
+			_, err := cl.LookupClaim(ctx, c, *testutil.TestURL)
+			require.Error(t, err)
+		}
+		require.Equal(t, 3, base.lookups)
+	})
+}
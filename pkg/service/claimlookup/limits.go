@@ -0,0 +1,152 @@
+package claimlookup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/storacha/go-ucanto/core/dag/blockstore"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/core/ipld"
+)
+
+const (
+	// DefaultMaxProofDepth is the deepest chain of proofs a claim may have when
+	// not otherwise configured
+	DefaultMaxProofDepth = 16
+	// DefaultMaxClaimSize is the largest archive of a claim and its proofs, in
+	// bytes, when not otherwise configured
+	DefaultMaxClaimSize = 1 << 20
+	// DefaultMaxCapabilities is the most capabilities any delegation of a claim
+	// may have when not otherwise configured
+	DefaultMaxCapabilities = 64
+	// DefaultValidationTimeout bounds checking a claim when not otherwise
+	// configured
+	DefaultValidationTimeout = time.Second
+)
+
+// The reasons a claim is too complex
+const (
+	ReasonProofDepth   = "proof-depth"
+	ReasonSize         = "size"
+	ReasonCapabilities = "capabilities"
+	ReasonTimeout      = "timeout"
+)
+
+// ErrClaimTooComplex is returned for a claim that exceeds the limits, so that
+// validating a crafted claim can't exhaust CPU or memory
+type ErrClaimTooComplex struct {
+	// Reason is which limit was exceeded, one of the Reason constants
+	Reason string
+}
+
+func (e ErrClaimTooComplex) Error() string {
+	return fmt.Sprintf("claim too complex: exceeds %s limit", e.Reason)
+}
+
+// Limits bound the claims that are validated. A zero field uses its default
+type Limits struct {
+	// MaxProofDepth is the deepest chain of proofs included with a claim
+	MaxProofDepth int
+	// MaxSize is the most bytes of the blocks of a claim and its proofs, which
+	// is also the most read when fetching a claim
+	MaxSize int
+	// MaxCapabilities is the most capabilities of a claim or any of its proofs
+	MaxCapabilities int
+	// Timeout bounds checking a claim
+	Timeout time.Duration
+}
+
+// WithDefaults returns the limits with each zero field set to its default
+func (l Limits) WithDefaults() Limits {
+	if l.MaxProofDepth <= 0 {
+		l.MaxProofDepth = DefaultMaxProofDepth
+	}
+	if l.MaxSize <= 0 {
+		l.MaxSize = DefaultMaxClaimSize
+	}
+	if l.MaxCapabilities <= 0 {
+		l.MaxCapabilities = DefaultMaxCapabilities
+	}
+	if l.Timeout <= 0 {
+		l.Timeout = DefaultValidationTimeout
+	}
+	return l
+}
+
+// CheckLimits returns ErrClaimTooComplex if the claim exceeds the limits. The
+// proofs included with the claim are walked breadth first, each at most once,
+// stopping at the first limit exceeded. A malformed delegation is reported as
+// an error of its own
+func CheckLimits(ctx context.Context, claim delegation.Delegation, limits Limits) (err error) {
+	limits = limits.WithDefaults()
+	deadline := time.Now().Add(limits.Timeout)
+	expired := func() error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !time.Now().Before(deadline) {
+			return ErrClaimTooComplex{Reason: ReasonTimeout}
+		}
+		return nil
+	}
+	// decoding a malformed delegation panics
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed delegation: %v", r)
+		}
+	}()
+
+	var blocks []ipld.Block
+	size := 0
+	for blk, err := range claim.Blocks() {
+		if err != nil {
+			return fmt.Errorf("reading claim blocks: %w", err)
+		}
+		size += len(blk.Bytes())
+		if size > limits.MaxSize {
+			return ErrClaimTooComplex{Reason: ReasonSize}
+		}
+		blocks = append(blocks, blk)
+	}
+	bs, err := blockstore.NewBlockReader(blockstore.WithBlocks(blocks))
+	if err != nil {
+		return fmt.Errorf("reading claim blocks: %w", err)
+	}
+
+	type pending struct {
+		dlg   delegation.Delegation
+		depth int
+	}
+	seen := map[string]struct{}{claim.Link().String(): {}}
+	queue := []pending{{claim, 0}}
+	for len(queue) > 0 {
+		if err := expired(); err != nil {
+			return err
+		}
+		next := queue[0]
+		queue = queue[1:]
+		if len(next.dlg.Capabilities()) > limits.MaxCapabilities {
+			return ErrClaimTooComplex{Reason: ReasonCapabilities}
+		}
+		for _, link := range next.dlg.Proofs() {
+			if _, ok := seen[link.String()]; ok {
+				continue
+			}
+			seen[link.String()] = struct{}{}
+			blk, ok, err := bs.Get(link)
+			if err != nil {
+				return fmt.Errorf("reading proof %s: %w", link, err)
+			}
+			// proofs are not required to be included with the claim
+			if !ok {
+				continue
+			}
+			if next.depth+1 > limits.MaxProofDepth {
+				return ErrClaimTooComplex{Reason: ReasonProofDepth}
+			}
+			queue = append(queue, pending{delegation.NewDelegation(blk, bs), next.depth + 1})
+		}
+	}
+	return expired()
+}
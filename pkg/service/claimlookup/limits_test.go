@@ -0,0 +1,163 @@
+package claimlookup_test
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/stretchr/testify/require"
+)
+
+// provenClaim returns an index claim with the given number of capabilities,
+// proven by a chain of depth delegations, the first of which is also proven
+// by width delegations of its own
+func provenClaim(t *testing.T, depth, width, caps int) delegation.Delegation {
+	capabilities := func(n int) []ucan.Capability[assert.IndexCaveats] {
+		c := make([]ucan.Capability[assert.IndexCaveats], 0, n)
+		for range n {
+			c = append(c, testutil.RandomIndexClaim())
+		}
+		return c
+	}
+	var proofs []delegation.Proof
+	for range width {
+		proof := testutil.Must(delegation.Delegate(testutil.Alice, testutil.Service, capabilities(1)))(t)
+		proofs = append(proofs, delegation.FromDelegation(proof))
+	}
+	for range depth {
+		proof := testutil.Must(delegation.Delegate(testutil.Alice, testutil.Service, capabilities(1), delegation.WithProof(proofs...)))(t)
+		proofs = []delegation.Proof{delegation.FromDelegation(proof)}
+	}
+	return testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, capabilities(caps), delegation.WithProof(proofs...)))(t)
+}
+
+func blocksSize(t *testing.T, claim delegation.Delegation) int {
+	size := 0
+	for blk, err := range claim.Blocks() {
+		require.NoError(t, err)
+		size += len(blk.Bytes())
+	}
+	return size
+}
+
+func TestCheckLimits(t *testing.T) {
+	ctx := context.Background()
+	limits := claimlookup.Limits{MaxProofDepth: 4, MaxCapabilities: 3}
+
+	t.Run("claims within the default limits", func(t *testing.T) {
+		require.NoError(t, claimlookup.CheckLimits(ctx, testutil.RandomLocationDelegation(), claimlookup.Limits{}))
+		require.NoError(t, claimlookup.CheckLimits(ctx, provenClaim(t, 3, 3, 1), claimlookup.Limits{}))
+	})
+
+	testCases := []struct {
+		name   string
+		claim  delegation.Delegation
+		limits func(claim delegation.Delegation) claimlookup.Limits
+		reason string
+	}{
+		{
+			name:   "proof chain at the depth limit",
+			claim:  provenClaim(t, 4, 0, 1),
+			limits: func(delegation.Delegation) claimlookup.Limits { return limits },
+		},
+		{
+			name:   "proof chain over the depth limit",
+			claim:  provenClaim(t, 5, 0, 1),
+			limits: func(delegation.Delegation) claimlookup.Limits { return limits },
+			reason: claimlookup.ReasonProofDepth,
+		},
+		{
+			// proofs of the first delegation of the chain are one deeper
+			name:   "wide proofs over the depth limit",
+			claim:  provenClaim(t, 4, 2, 1),
+			limits: func(delegation.Delegation) claimlookup.Limits { return limits },
+			reason: claimlookup.ReasonProofDepth,
+		},
+		{
+			name:   "capabilities at the limit",
+			claim:  provenClaim(t, 1, 0, 3),
+			limits: func(delegation.Delegation) claimlookup.Limits { return limits },
+		},
+		{
+			name:   "capabilities over the limit",
+			claim:  provenClaim(t, 1, 0, 4),
+			limits: func(delegation.Delegation) claimlookup.Limits { return limits },
+			reason: claimlookup.ReasonCapabilities,
+		},
+		{
+			name:  "size at the limit",
+			claim: provenClaim(t, 2, 2, 1),
+			limits: func(claim delegation.Delegation) claimlookup.Limits {
+				return claimlookup.Limits{MaxSize: blocksSize(t, claim)}
+			},
+		},
+		{
+			name:  "size over the limit",
+			claim: provenClaim(t, 2, 2, 1),
+			limits: func(claim delegation.Delegation) claimlookup.Limits {
+				return claimlookup.Limits{MaxSize: blocksSize(t, claim) - 1}
+			},
+			reason: claimlookup.ReasonSize,
+		},
+		{
+			name:  "validation over the time limit",
+			claim: provenClaim(t, 1, 0, 1),
+			limits: func(delegation.Delegation) claimlookup.Limits {
+				return claimlookup.Limits{Timeout: time.Nanosecond}
+			},
+			reason: claimlookup.ReasonTimeout,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := claimlookup.CheckLimits(ctx, tc.claim, tc.limits(tc.claim))
+			if tc.reason == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, claimlookup.ErrClaimTooComplex{Reason: tc.reason})
+		})
+	}
+
+	t.Run("a canceled context isn't a claim over the time limit", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		require.ErrorIs(t, claimlookup.CheckLimits(canceled, provenClaim(t, 1, 0, 1), limits), context.Canceled)
+	})
+}
+
+func FuzzCheckLimits(f *testing.F) {
+	f.Add(uint8(0), uint8(0), uint8(1))
+	f.Add(uint8(16), uint8(0), uint8(1))
+	f.Add(uint8(17), uint8(0), uint8(1))
+	f.Add(uint8(2), uint8(64), uint8(2))
+	f.Add(uint8(1), uint8(1), uint8(65))
+	f.Add(uint8(48), uint8(48), uint8(8))
+	f.Fuzz(func(t *testing.T, depth, width, caps uint8) {
+		claim := provenClaim(t, int(depth%64), int(width%64), int(caps%128))
+		size := blocksSize(t, claim)
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		err := claimlookup.CheckLimits(context.Background(), claim, claimlookup.Limits{})
+		elapsed := time.Since(start)
+		runtime.ReadMemStats(&after)
+
+		require.Less(t, elapsed, claimlookup.DefaultValidationTimeout+100*time.Millisecond)
+		// allocations grow with the blocks read, which stop at the size limit
+		require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(64*min(size, claimlookup.DefaultMaxClaimSize)+1<<20))
+		if err != nil {
+			require.IsType(t, claimlookup.ErrClaimTooComplex{}, err)
+		}
+		if int(depth%64) > claimlookup.DefaultMaxProofDepth || int(caps%128) > claimlookup.DefaultMaxCapabilities {
+			require.Error(t, err)
+		}
+	})
+}
@@ -9,33 +9,68 @@ import (
 
 	"github.com/ipfs/go-cid"
 	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/types"
 )
 
 // simpleLookup is a read through cache for fetching content claims
 type simpleLookup struct {
 	httpClient *http.Client
+	maxSize    int
+}
+
+// Option configures a claim lookup
+type Option func(*simpleLookup)
+
+// WithMaxClaimSize sets the most bytes read when fetching a claim. A claim
+// that is larger fails with ErrClaimTooComplex. If not set, DefaultMaxClaimSize
+// is used
+func WithMaxClaimSize(size int) Option {
+	return func(sl *simpleLookup) {
+		if size > 0 {
+			sl.maxSize = size
+		}
+	}
 }
 
 // NewClaimLookup creates a new ClaimLookup with the provided claimstore and HTTP client
-func NewClaimLookup(httpClient *http.Client) ClaimLookup {
-	return &simpleLookup{
+func NewClaimLookup(httpClient *http.Client, opts ...Option) ClaimLookup {
+	sl := &simpleLookup{
 		httpClient: httpClient,
+		maxSize:    DefaultMaxClaimSize,
+	}
+	for _, opt := range opts {
+		opt(sl)
 	}
+	return sl
 }
 
 // LookupClaim attempts to fetch a claim from either the local cache or via the provided URL (caching the result if its fetched)
 func (sl *simpleLookup) LookupClaim(ctx context.Context, claimCid cid.Cid, fetchURL url.URL) (delegation.Delegation, error) {
+	if types.IsCacheOnly(ctx) {
+		return nil, types.ErrCacheOnly
+	}
+	types.WalkCountersFrom(ctx).Fetched(types.FetchClaim)
 	// attempt to fetch the claim from provided url
-	resp, err := sl.httpClient.Get(fetchURL.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fetchURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("constructing claim request: %w", err)
+	}
+	resp, err := sl.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch claim: %w", err)
+		return nil, types.OriginFetchError(ctx, fmt.Errorf("failed to fetch claim: %w", err))
 	}
-	body, err := io.ReadAll(resp.Body)
+	defer resp.Body.Close()
+	// one byte more than the limit is read, to tell a claim at the limit from
+	// one over it
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(sl.maxSize)+1))
 	if err != nil {
 		return nil, fmt.Errorf("reading fetched claim body: %w", err)
 	}
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return nil, fmt.Errorf("failure response fetching claim. status: %s, message: %s", resp.Status, string(body))
+		return nil, types.OriginStatusError(resp.StatusCode, fmt.Errorf("failure response fetching claim. status: %s, message: %s", resp.Status, string(body)))
+	}
+	if len(body) > sl.maxSize {
+		return nil, ErrClaimTooComplex{Reason: ReasonSize}
 	}
 	return delegation.Extract(body)
 }
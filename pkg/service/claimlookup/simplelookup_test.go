@@ -57,3 +57,23 @@ func TestClaimLookup__LookupClaim(t *testing.T) {
 		})
 	}
 }
+
+func TestClaimLookup__MaxClaimSize(t *testing.T) {
+	cid := testutil.RandomCID().(cidlink.Link).Cid
+	claim := testutil.RandomIndexDelegation()
+	claimBytes := testutil.Must(io.ReadAll(claim.Archive()))(t)
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.Must(w.Write(claimBytes))(t)
+	}))
+	defer testServer.Close()
+	fetchURL := *testutil.Must(url.Parse(testServer.URL))(t)
+
+	cl := claimlookup.NewClaimLookup(testServer.Client(), claimlookup.WithMaxClaimSize(len(claimBytes)))
+	got, err := cl.LookupClaim(context.Background(), cid, fetchURL)
+	require.NoError(t, err)
+	testutil.RequireEqualDelegation(t, claim, got)
+
+	cl = claimlookup.NewClaimLookup(testServer.Client(), claimlookup.WithMaxClaimSize(len(claimBytes)-1))
+	_, err = cl.LookupClaim(context.Background(), cid, fetchURL)
+	require.ErrorIs(t, err, claimlookup.ErrClaimTooComplex{Reason: claimlookup.ReasonSize})
+}
@@ -0,0 +1,119 @@
+package claimlookup
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/storacha/go-ucanto/core/delegation"
+)
+
+// The timestamps of a claim checked against the local clock. UCANs carry no
+// issued-at time, so the validity period is all there is to check
+const (
+	TimestampExpiration = "exp"
+	TimestampNotBefore  = "nbf"
+)
+
+var (
+	// ErrClaimExpired is the error of a claim past its expiration
+	ErrClaimExpired = errors.New("claim expired")
+	// ErrClaimNotYetValid is the error of a claim before its not before time
+	ErrClaimNotYetValid = errors.New("claim not yet valid")
+)
+
+// SkewMetrics is told about claims accepted only because of the clock skew
+// tolerance, so that issuers with badly drifting clocks can be noticed
+type SkewMetrics interface {
+	// ClaimSkewSalvaged is called with the timestamp, one of the Timestamp
+	// constants, that a claim was outside of by less than the tolerance
+	ClaimSkewSalvaged(timestamp string)
+}
+
+// TimeCheck is the result of comparing the validity period of a claim with the
+// local clock, allowing for the clocks of issuers being off from ours
+type TimeCheck struct {
+	// Now is the local time the claim was checked at
+	Now time.Time
+	// Tolerance is how far the clock of the issuer was allowed to be off
+	Tolerance time.Duration
+	// Err is ErrClaimExpired or ErrClaimNotYetValid if the claim is outside its
+	// validity period even with the tolerance
+	Err error
+	// Timestamp is the timestamp the claim was outside of, with or without the
+	// tolerance, or empty if it was within its validity period either way
+	Timestamp string
+	// At is the value of the timestamp, and Effective the value compared with
+	// Now once the tolerance is applied
+	At, Effective time.Time
+}
+
+// Salvaged returns true if the claim is valid only because of the tolerance
+func (tc TimeCheck) Salvaged() bool {
+	return tc.Err == nil && tc.Timestamp != ""
+}
+
+// String describes the comparison that decided the check, for diagnostics
+func (tc TimeCheck) String() string {
+	if tc.Timestamp == "" {
+		return "within validity period"
+	}
+	outcome := "accepted"
+	if tc.Err != nil {
+		outcome = "rejected"
+	}
+	return fmt.Sprintf("%s %s at %s, compared as %s with %s tolerance against now %s",
+		outcome, tc.Timestamp, tc.At.UTC().Format(time.RFC3339), tc.Effective.UTC().Format(time.RFC3339), tc.Tolerance, tc.Now.UTC().Format(time.RFC3339))
+}
+
+// CheckTimes checks the claim is within its validity period at now, allowing
+// the tolerance either side of it. A claim is expired from its expiration plus
+// the tolerance, and valid from its not before time minus the tolerance.
+//
+// Claim imports reject claims by it, and report the comparison in their
+// outcomes. Queries don't call it, so their diagnostics have no comparison to
+// record: a query returns the claims its records lead to for the caller to
+// validate, without comparing their times with our clock. Records and claims
+// drop out of queries as they expire from the provider index and the caches,
+// and the expirations derived from those of claims already allow for the
+// tolerance
+func CheckTimes(claim delegation.Delegation, now time.Time, tolerance time.Duration) TimeCheck {
+	tc := TimeCheck{Now: now, Tolerance: tolerance}
+	if exp := claim.Expiration(); exp != nil {
+		at := time.Unix(int64(*exp), 0)
+		if !now.Before(at) {
+			tc.Timestamp, tc.At, tc.Effective = TimestampExpiration, at, at.Add(tolerance)
+			if !now.Before(tc.Effective) {
+				tc.Err = ErrClaimExpired
+			}
+			return tc
+		}
+	}
+	if nbf := claim.NotBefore(); nbf != 0 {
+		at := time.Unix(int64(nbf), 0)
+		if now.Before(at) {
+			tc.Timestamp, tc.At, tc.Effective = TimestampNotBefore, at, at.Add(-tolerance)
+			if now.Before(tc.Effective) {
+				tc.Err = ErrClaimNotYetValid
+			}
+		}
+	}
+	return tc
+}
+
+// ClaimTTL returns how long the claim may be cached from now, which is until
+// its expiration plus the tolerance, so that a claim accepted because of the
+// tolerance is cached for as long as it would still be accepted. It returns
+// false if the claim is expired even with the tolerance, and a zero TTL if the
+// claim doesn't expire. The TTL returned is never negative
+func ClaimTTL(claim delegation.Delegation, now time.Time, tolerance time.Duration) (time.Duration, bool) {
+	exp := claim.Expiration()
+	if exp == nil {
+		return 0, true
+	}
+	ttl := time.Unix(int64(*exp), 0).Add(tolerance).Sub(now)
+	if ttl <= 0 {
+		return 0, false
+	}
+	return ttl, true
+}
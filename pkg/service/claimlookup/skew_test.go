@@ -0,0 +1,97 @@
+package claimlookup_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckTimes(t *testing.T) {
+	now := time.Unix(1_800_000_000, 0)
+	tolerance := 2 * time.Minute
+	claim := func(opts ...delegation.Option) delegation.Delegation {
+		opts = append([]delegation.Option{delegation.WithNoExpiration()}, opts...)
+		return testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.IndexCaveats]{testutil.RandomIndexClaim()}, opts...))(t)
+	}
+	exp := func(at time.Time) delegation.Option { return delegation.WithExpiration(int(at.Unix())) }
+	nbf := func(at time.Time) delegation.Option { return delegation.WithNotBefore(int(at.Unix())) }
+
+	testCases := []struct {
+		name      string
+		claim     delegation.Delegation
+		tolerance time.Duration
+		err       error
+		timestamp string
+	}{
+		{name: "no validity period", claim: claim()},
+		{name: "exp in the future", claim: claim(exp(now.Add(time.Second)))},
+		{name: "exp exactly now", claim: claim(exp(now)), err: claimlookup.ErrClaimExpired, timestamp: claimlookup.TimestampExpiration},
+		{name: "exp exactly now with tolerance", claim: claim(exp(now)), tolerance: tolerance, timestamp: claimlookup.TimestampExpiration},
+		{name: "exp within the tolerance", claim: claim(exp(now.Add(-tolerance + time.Second))), tolerance: tolerance, timestamp: claimlookup.TimestampExpiration},
+		{name: "exp now minus tolerance", claim: claim(exp(now.Add(-tolerance))), tolerance: tolerance, err: claimlookup.ErrClaimExpired, timestamp: claimlookup.TimestampExpiration},
+		{name: "nbf now", claim: claim(nbf(now))},
+		{name: "nbf slightly in the future", claim: claim(nbf(now.Add(time.Second))), err: claimlookup.ErrClaimNotYetValid, timestamp: claimlookup.TimestampNotBefore},
+		{name: "nbf slightly in the future with tolerance", claim: claim(nbf(now.Add(time.Second))), tolerance: tolerance, timestamp: claimlookup.TimestampNotBefore},
+		{name: "nbf now plus tolerance", claim: claim(nbf(now.Add(tolerance))), tolerance: tolerance, timestamp: claimlookup.TimestampNotBefore},
+		{name: "nbf beyond the tolerance", claim: claim(nbf(now.Add(tolerance + time.Second))), tolerance: tolerance, err: claimlookup.ErrClaimNotYetValid, timestamp: claimlookup.TimestampNotBefore},
+		{name: "expired with nbf in the future", claim: claim(nbf(now.Add(time.Hour)), exp(now.Add(-time.Hour))), tolerance: tolerance, err: claimlookup.ErrClaimExpired, timestamp: claimlookup.TimestampExpiration},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			check := claimlookup.CheckTimes(tc.claim, now, tc.tolerance)
+			require.Equal(t, tc.err, check.Err)
+			require.Equal(t, tc.timestamp, check.Timestamp)
+			require.Equal(t, tc.err == nil && tc.timestamp != "", check.Salvaged())
+			if tc.timestamp != "" {
+				// the effective comparison values are recorded for diagnostics
+				require.Contains(t, check.String(), tc.timestamp)
+				require.Contains(t, check.String(), check.Effective.UTC().Format(time.RFC3339))
+				require.Contains(t, check.String(), now.UTC().Format(time.RFC3339))
+			}
+		})
+	}
+}
+
+func TestClaimTTL(t *testing.T) {
+	now := time.Unix(1_800_000_000, 0)
+	tolerance := 2 * time.Minute
+	claim := func(at time.Time) delegation.Delegation {
+		return testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.IndexCaveats]{testutil.RandomIndexClaim()}, delegation.WithExpiration(int(at.Unix()))))(t)
+	}
+
+	testCases := []struct {
+		name      string
+		exp       time.Time
+		tolerance time.Duration
+		ttl       time.Duration
+		ok        bool
+	}{
+		{name: "unexpired", exp: now.Add(time.Hour), ttl: time.Hour, ok: true},
+		{name: "unexpired with tolerance", exp: now.Add(time.Hour), tolerance: tolerance, ttl: time.Hour + tolerance, ok: true},
+		{name: "exp exactly now", exp: now},
+		{name: "exp exactly now with tolerance", exp: now, tolerance: tolerance, ttl: tolerance, ok: true},
+		{name: "exp within the tolerance", exp: now.Add(-time.Minute), tolerance: tolerance, ttl: time.Minute, ok: true},
+		{name: "exp now minus tolerance", exp: now.Add(-tolerance), tolerance: tolerance},
+		{name: "exp beyond the tolerance", exp: now.Add(-time.Hour), tolerance: tolerance},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ttl, ok := claimlookup.ClaimTTL(claim(tc.exp), now, tc.tolerance)
+			require.Equal(t, tc.ok, ok)
+			require.Equal(t, tc.ttl, ttl)
+			require.GreaterOrEqual(t, ttl, time.Duration(0))
+		})
+	}
+
+	t.Run("claims that don't expire", func(t *testing.T) {
+		ttl, ok := claimlookup.ClaimTTL(testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.IndexCaveats]{testutil.RandomIndexClaim()}, delegation.WithNoExpiration()))(t), now, tolerance)
+		require.True(t, ok)
+		require.Zero(t, ttl)
+	})
+}
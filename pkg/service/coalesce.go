@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/storacha/go-ucanto/core/delegation"
+)
+
+// DefaultPublishWait bounds how long a publish waits on one of the same claim
+// already in progress
+const DefaultPublishWait = 30 * time.Second
+
+// ErrPublishInProgress is returned by a publish of a claim that is already
+// being published when the publish in progress doesn't finish in time
+var ErrPublishInProgress = errors.New("publish of claim already in progress")
+
+// PublishMetrics is told about publishes coalesced with one in progress
+type PublishMetrics interface {
+	// PublishCoalesced is called when a publish waits on one of the same claim
+	// already in progress rather than publishing it again
+	PublishCoalesced()
+	// PublishWaitTimedOut is called when a coalesced publish gives up waiting
+	PublishWaitTimedOut()
+}
+
+type noopPublishMetrics struct{}
+
+func (noopPublishMetrics) PublishCoalesced()    {}
+func (noopPublishMetrics) PublishWaitTimedOut() {}
+
+// WithPublishWait sets how long a publish of a claim already being published
+// waits for the publish in progress, before returning ErrPublishInProgress. If
+// not set, DefaultPublishWait is used
+func WithPublishWait(wait time.Duration) Option {
+	return func(is *IndexingService) {
+		is.publishWait = wait
+	}
+}
+
+// WithPublishMetrics reports coalesced publishes to the given metrics
+func WithPublishMetrics(m PublishMetrics) Option {
+	return func(is *IndexingService) {
+		is.publishMetrics = m
+	}
+}
+
+// publishCall is a publish in progress, and its outcome once done is closed
+type publishCall struct {
+	done chan struct{}
+	err  error
+}
+
+// publishes coalesces concurrent publishes of the same claim, so that a claim
+// submitted again while it is being published isn't run through the pipeline
+// twice
+type publishes struct {
+	lk       sync.Mutex
+	inFlight map[string]*publishCall
+	running  sync.WaitGroup
+}
+
+func newPublishes() *publishes {
+	return &publishes{inFlight: map[string]*publishCall{}}
+}
+
+// join returns the publish of the claim in progress, and whether the caller is
+// to run it. The caller running it must call finish
+func (p *publishes) join(key string) (*publishCall, bool) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	if call, ok := p.inFlight[key]; ok {
+		return call, false
+	}
+	call := &publishCall{done: make(chan struct{})}
+	p.inFlight[key] = call
+	p.running.Add(1)
+	return call, true
+}
+
+func (p *publishes) finish(key string, call *publishCall, err error) {
+	p.lk.Lock()
+	delete(p.inFlight, key)
+	p.lk.Unlock()
+	call.err = err
+	close(call.done)
+	p.running.Done()
+}
+
+// coalescePublish runs the publish of the claim, unless the claim is already
+// being published, in which case it waits for that publish and returns its
+// outcome
+func (is *IndexingService) coalescePublish(ctx context.Context, claim delegation.Delegation, publish func() error) (err error) {
+	// claims are keyed by their root CID
+	key := claim.Link().String()
+	call, leader := is.publishes.join(key)
+	if leader {
+		defer func() {
+			is.publishes.finish(key, call, err)
+		}()
+		return publish()
+	}
+	is.publishMetrics.PublishCoalesced()
+	log.Debugw("waiting on publish of claim in progress", "claim", key)
+	timer := time.NewTimer(is.publishWait)
+	defer timer.Stop()
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		is.publishMetrics.PublishWaitTimedOut()
+		return ErrPublishInProgress
+	}
+}
+
+// DrainPublishes waits for the publishes in progress to finish. If the context
+// is done first, the error of the context is returned
+func (is *IndexingService) DrainPublishes(ctx context.Context) error {
+	drained := make(chan struct{})
+	go func() {
+		is.publishes.running.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
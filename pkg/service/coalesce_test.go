@@ -0,0 +1,132 @@
+package service_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingAuditSink counts the publishes audited, holding each until released
+type blockingAuditSink struct {
+	release chan struct{}
+	audited atomic.Int32
+}
+
+func (m *blockingAuditSink) Record(ctx context.Context, entry types.AuditEntry) error {
+	m.audited.Add(1)
+	<-m.release
+	return nil
+}
+
+// publishCountingIndex counts the records published
+type publishCountingIndex struct {
+	mockProviderIndex
+	published atomic.Int32
+}
+
+func (m *publishCountingIndex) Publish(ctx context.Context, digests []multihash.Multihash, result model.ProviderResult, opts ...providerindex.PublishOption) error {
+	m.published.Add(1)
+	return nil
+}
+
+type countingPublishMetrics struct {
+	coalesced atomic.Int32
+	timedOut  atomic.Int32
+}
+
+func (m *countingPublishMetrics) PublishCoalesced()    { m.coalesced.Add(1) }
+func (m *countingPublishMetrics) PublishWaitTimedOut() { m.timedOut.Add(1) }
+
+func TestIndexingService__CoalescedPublishes(t *testing.T) {
+	ctx := context.Background()
+	provider := peer.AddrInfo{ID: testutil.RandomPeer()}
+	newService := func(wait time.Duration) (*service.IndexingService, *publishCountingIndex, *blockingAuditSink, *countingPublishMetrics) {
+		providerIndex := &publishCountingIndex{}
+		sink := &blockingAuditSink{release: make(chan struct{})}
+		metrics := &countingPublishMetrics{}
+		is := testutil.Must(service.NewIndexingService(nil, nil, providerIndex, service.WithClaimProvider(provider),
+			service.WithAuditSinks(sink), service.WithPublishMetrics(metrics), service.WithPublishWait(wait)))(t)
+		return is, providerIndex, sink, metrics
+	}
+
+	t.Run("concurrent publishes of a claim share one outcome", func(t *testing.T) {
+		is, providerIndex, sink, metrics := newService(time.Minute)
+		claim := testutil.RandomLocationDelegation()
+		errs := make([]error, 20)
+		var wg sync.WaitGroup
+		for i := range errs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = is.PublishClaim(ctx, claim)
+			}()
+		}
+		require.Eventually(t, func() bool {
+			return sink.audited.Load() == 1 && metrics.coalesced.Load() == 19
+		}, time.Second, time.Millisecond)
+		close(sink.release)
+		wg.Wait()
+
+		require.Equal(t, int32(1), sink.audited.Load())
+		require.Equal(t, int32(1), providerIndex.published.Load())
+		for _, err := range errs {
+			require.NoError(t, err)
+		}
+		require.Zero(t, metrics.timedOut.Load())
+		require.NoError(t, is.DrainPublishes(ctx))
+
+		// once done the claim is published again
+		require.NoError(t, is.PublishClaim(ctx, claim))
+		require.Equal(t, int32(2), sink.audited.Load())
+		require.Equal(t, int32(2), providerIndex.published.Load())
+	})
+
+	t.Run("other claims aren't coalesced", func(t *testing.T) {
+		is, providerIndex, sink, metrics := newService(time.Minute)
+		close(sink.release)
+		var wg sync.WaitGroup
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				require.NoError(t, is.PublishClaim(ctx, testutil.RandomLocationDelegation()))
+			}()
+		}
+		wg.Wait()
+		require.Equal(t, int32(5), sink.audited.Load())
+		require.Equal(t, int32(5), providerIndex.published.Load())
+		require.Zero(t, metrics.coalesced.Load())
+	})
+
+	t.Run("waits time out without publishing again", func(t *testing.T) {
+		is, providerIndex, sink, metrics := newService(10 * time.Millisecond)
+		claim := testutil.RandomLocationDelegation()
+		first := make(chan error)
+		go func() { first <- is.PublishClaim(ctx, claim) }()
+		require.Eventually(t, func() bool { return sink.audited.Load() == 1 }, time.Second, time.Millisecond)
+
+		require.ErrorIs(t, is.PublishClaim(ctx, claim), service.ErrPublishInProgress)
+		require.Equal(t, int32(1), metrics.timedOut.Load())
+
+		drainCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, is.DrainPublishes(drainCtx), context.DeadlineExceeded)
+
+		close(sink.release)
+		require.NoError(t, <-first)
+		require.NoError(t, is.DrainPublishes(ctx))
+		require.Equal(t, int32(1), sink.audited.Load())
+		require.Equal(t, int32(1), providerIndex.published.Load())
+	})
+}
@@ -2,32 +2,432 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	dssync "github.com/ipfs/go-datastore/sync"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipld/go-ipld-prime/linking"
+	"github.com/ipni/go-libipni/announce/httpsender"
 	ipnifind "github.com/ipni/go-libipni/find/client"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
 	goredis "github.com/redis/go-redis/v9"
 	"github.com/storacha/indexing-service/pkg/internal/jobqueue"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/storacha/indexing-service/pkg/publisher/remotestore"
 	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/service/addrpolicy"
+	"github.com/storacha/indexing-service/pkg/service/admission"
+	"github.com/storacha/indexing-service/pkg/service/audit"
 	"github.com/storacha/indexing-service/pkg/service/blobindexlookup"
+	"github.com/storacha/indexing-service/pkg/service/claimevents"
 	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/deadletter"
+	"github.com/storacha/indexing-service/pkg/service/dnsresolver"
+	"github.com/storacha/indexing-service/pkg/service/expansion"
+	"github.com/storacha/indexing-service/pkg/service/faults"
+	"github.com/storacha/indexing-service/pkg/service/findclient"
+	"github.com/storacha/indexing-service/pkg/service/httppool"
+	"github.com/storacha/indexing-service/pkg/service/identity"
+	"github.com/storacha/indexing-service/pkg/service/liveness"
+	"github.com/storacha/indexing-service/pkg/service/prommetrics"
 	"github.com/storacha/indexing-service/pkg/service/providercacher"
 	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/service/replication"
+	"github.com/storacha/indexing-service/pkg/service/shadow"
+	cachesync "github.com/storacha/indexing-service/pkg/sync"
+	"github.com/storacha/indexing-service/pkg/types"
 )
 
 var log = logging.Logger("service")
 
+// DefaultCacheTTLJitter is the fraction cache expirations are randomized by when
+// not otherwise configured
+const DefaultCacheTTLJitter = 0.1
+
+// shadowOrigin is the origin of writes copied to a secondary by a service with
+// no region set
+const shadowOrigin = "primary"
+
 type ServiceConfig struct {
 	RedisURL    string
 	RedisPasswd string
-	ProvidersDB int
-	ClaimsDB    int
-	IndexesDB   int
-	IndexerURL  string
+	// RedisReplicaURL is the address of a redis replica to send cache reads to.
+	// If not set, reads and writes both go to RedisURL
+	RedisReplicaURL string
+	ProvidersDB     int
+	ClaimsDB        int
+	IndexesDB       int
+	SpacesDB        int
+	IndexerURL      string
+	// CacheTTLJitter randomizes cache expirations within ±fraction of the expire
+	// time. If zero, DefaultCacheTTLJitter is used. A negative value disables jitter
+	CacheTTLJitter float64
+	// CacheEventSink receives the events of the provider, claim and index
+	// caches, such as reads, writes and expiries, for analyzing the caches
+	// offline. Events are dropped while the sink falls behind
+	CacheEventSink redis.CacheEventSink
+	// CacheEventsFile is a file the events of the caches are appended to as
+	// JSON lines, if set and CacheEventSink isn't
+	CacheEventsFile string
+	// CacheEventBuffer is the number of cache events that may wait for the
+	// sink. If zero, redis.DefaultEventBuffer is used
+	CacheEventBuffer int
+	// Datastore holds durable service state. If not set, an in-memory datastore
+	// is used and state is lost on restart
+	Datastore datastore.Batching
+	// DisableLocationCacheWarming stops location commitments discovered while
+	// handling queries from being written to the providers cache
+	DisableLocationCacheWarming bool
+	// PrefetchShards is the number of shards following a resolved shard of an
+	// index whose locations are prefetched in the background. Zero disables
+	PrefetchShards int
+	// MaxIndexDepth is the number of levels of nested indexes followed below an
+	// index found for a queried hash. If zero, DefaultMaxIndexDepth is used, and
+	// if negative no nested indexes are followed
+	MaxIndexDepth int
+	// DeadLetterMaxAge is how long failed background cache writes are retried
+	// for. If zero, deadletter.DefaultMaxAge is used
+	DeadLetterMaxAge time.Duration
+	// AuditLog keeps an audit trail of publishes, caches and provider removals
+	// in the datastore, readable through the admin API
+	AuditLog bool
+	// AuditLogFile is a file audit entries are appended to as JSON lines, if set
+	AuditLogFile string
+	// SelfCheckURL is the provider URL the synthetic claims of the canary are
+	// advertised to be fetched from, with "{claim}" in place of their CID. The
+	// canary only runs self checks if it is set
+	SelfCheckURL string
+	// SelfCheckInterval is how often the canary runs a self check. If not set,
+	// DefaultCanaryInterval is used
+	SelfCheckInterval time.Duration
+	// SelfCheckIPNIWait is how long the canary's self checks wait for IPNI to
+	// ingest their claims. If not set, the IPNI stage is skipped
+	SelfCheckIPNIWait time.Duration
+	// MaxInFlightQueries is the number of queries in flight beyond which
+	// expensive queries are shed. Zero is unlimited
+	MaxInFlightQueries int
+	// MaxQueryP95 is the p95 of recent query durations beyond which expensive
+	// queries are shed. Zero is unlimited
+	MaxQueryP95 time.Duration
+	// ShardFilterFalsePositiveRate is the false positive rate of the shard
+	// filters cached alongside large indexes, for finding the shards containing
+	// a multihash quickly. Zero doesn't use shard filters
+	ShardFilterFalsePositiveRate float64
+	// ContextIDCodec is the scheme context IDs are derived and matched with. If not
+	// set, types.DefaultContextIDCodec is used
+	ContextIDCodec types.ContextIDCodec
+	// BindSpaceCommitments binds spaces to location commitments already
+	// published under another space, instead of advertising and caching the
+	// same commitment again for each space
+	BindSpaceCommitments bool
+	// SpaceBindingWindow is how far apart the expirations of commitments may be
+	// for them to be bound. If zero, providerindex.DefaultBindingExpiryWindow is
+	// used
+	SpaceBindingWindow time.Duration
+	// RecentResults is how many of the results of the last IPNI lookups are kept
+	// in memory, and answered from before reading the providers cache. If zero,
+	// none are kept
+	RecentResults int
+	// RecentResultsTTL is how long the results of IPNI lookups are kept in
+	// memory. If zero, providerindex.DefaultRecentResultsTTL is used
+	RecentResultsTTL time.Duration
+	// MaxFindRecords is the most provider records kept of an IPNI find response
+	// for a hash, which is then read as it arrives rather than all at once. If
+	// zero, every record is kept
+	MaxFindRecords int
+	// ResultCache is how many of the results of the last queries that are the
+	// same for every caller are kept in memory, and answered from before walking
+	// the query. If zero, none are kept
+	ResultCache int
+	// ResultCacheTTL is how long the results of queries are kept in memory. If
+	// zero, DefaultResultCacheTTL is used
+	ResultCacheTTL time.Duration
+	// PublisherKey signs the advertisements published for claims. If not set,
+	// no advertisements are written
+	PublisherKey crypto.PrivKey
+	// SignResults signs the results of queries asking to attest them with
+	// PublisherKey, which must then be an Ed25519 key. If not set, such queries
+	// fail
+	SignResults bool
+	// ReconstructIndexes allows lost indexes to be reconstructed from the shards
+	// they index. Reconstructed indexes can be republished if PublisherKey is an
+	// Ed25519 key
+	ReconstructIndexes bool
+	// MaxReconstructShardSize is the size in bytes of the largest shard scanned
+	// to reconstruct an index. If zero, DefaultMaxShardSize is used
+	MaxReconstructShardSize uint64
+	// ReconstructOnFetchFailure are the shards of indexes, by the CID of the
+	// index, reconstructed in the background when the index can't be fetched
+	ReconstructOnFetchFailure map[cid.Cid][]cid.Cid
+	// PublisherAddrs are the addresses advertisements can be fetched from, sent
+	// with every announcement
+	PublisherAddrs []multiaddr.Multiaddr
+	// ClaimAddrs are the addresses, with a "{claim}" path, that claims published
+	// or cached through the service are fetched from. They are recorded as the
+	// addresses of the service's provider, identified by the peer of
+	// PublisherKey. Claims can only be published or cached with a PublisherKey
+	ClaimAddrs []multiaddr.Multiaddr
+	// PublisherS3 and PublisherDynamo, if both set, keep the advertisement chain
+	// in S3 and DynamoDB instead of the service datastore, so that publishers
+	// without a local disk can share it
+	PublisherS3     remotestore.S3Client
+	PublisherDynamo remotestore.DynamoClient
+	// PublisherS3Prefix is the prefix of the keys of blocks kept in S3
+	PublisherS3Prefix string
+	// AnnounceURLs are the HTTP announce endpoints of the indexers published
+	// advertisements are announced to
+	AnnounceURLs []string
+	// RequiredAnnounceURLs are announce endpoints that must confirm an
+	// advertisement for it to count as announced under AnnounceAllRequired. They
+	// are announced to along with AnnounceURLs
+	RequiredAnnounceURLs []string
+	// AnnouncePolicy decides when an advertisement counts as announced
+	AnnouncePolicy publisher.AnnouncePolicy
+	// AnnounceRoutes are the initial announce URLs advertisements are announced
+	// to by the kinds of claims they carry, see DynamicConfig.AnnounceRoutes
+	AnnounceRoutes publisher.AnnounceRoutes
+	// LagCheckURLs are the base URLs of the indexers checked for how far behind
+	// the head of the advertisement chain they are in ingesting it for the peer
+	// of the publisher key. If not set, lag is not monitored
+	LagCheckURLs []string
+	// MaxAdvertisementLag is the number of advertisements an indexer may be
+	// behind the head before it is lagging. If not set, publisher.DefaultMaxLag
+	// is used
+	MaxAdvertisementLag int
+	// LagCheckInterval is how often indexers are checked for lag. If not set,
+	// publisher.DefaultLagCheckInterval is used
+	LagCheckInterval time.Duration
+	// OnAdvertisementLag is called when an indexer starts lagging
+	OnAdvertisementLag func(publisher.IndexerLag)
+	// ProbeBudget is how long the liveness probes of the location URLs of a
+	// query asking for them may take altogether. If not set,
+	// liveness.DefaultBudget is used
+	ProbeBudget time.Duration
+	// ProbeObserver receives the outcome of every liveness probe made
+	ProbeObserver liveness.Observer
+	// Region names the region this service runs in. Replication is only set up
+	// when it is set
+	Region string
+	// ReplicationPeers are the base URLs of the indexing services of other
+	// regions, which publish-origin cache writes are replicated to
+	ReplicationPeers []string
+	// ReplicationToken authorizes replicated batches sent to and received from
+	// peers
+	ReplicationToken string
+	// AllowPrivateAddresses lets claims and indexes be fetched from providers at
+	// loopback, link-local and private addresses, for development and testing
+	AllowPrivateAddresses bool
+	// AllowedAddressRanges are address ranges claims and indexes may be fetched
+	// from even though they are not publicly routable
+	AllowedAddressRanges []netip.Prefix
+	// DoHEndpoint is a DNS-over-HTTPS endpoint provider host names and dnsaddr
+	// records are resolved with, and checked against the address policy with.
+	// If not set, the system resolver is used
+	DoHEndpoint string
+	// ResolverMetrics is told the latency and failures of lookups sent to the
+	// DoH endpoint
+	ResolverMetrics dnsresolver.Metrics
+	// WebhookURLs are notified of every successfully published or cached claim
+	WebhookURLs []string
+	// WebhookSecret signs webhook request bodies
+	WebhookSecret string
+	// RecordContainingIndexes records the indexes the blocks of fetched indexes
+	// are in, for looking up which DAGs a block is part of
+	RecordContainingIndexes bool
+	// MaxContainingIndexes is the number of indexes recorded for each block,
+	// keeping the most recent. If zero, redis.DefaultMaxContainingIndexes is used
+	MaxContainingIndexes int
+	// IndexCachingConcurrency is the number of fetched indexes whose provider
+	// records are cached at once. If zero, providercacher.DefaultConcurrency is
+	// used
+	IndexCachingConcurrency int
+	// IndexCachingBuffer is the number of fetched indexes that may wait for
+	// their provider records to be cached. Indexes fetched with the buffer full
+	// are not cached until fetched again. If zero, providercacher.DefaultBuffer
+	// is used
+	IndexCachingBuffer int
+	// IndexExpansionWorkers is the number of workers indexes that aren't cached
+	// are expanded by, with their jobs kept in the datastore. Zero has queries
+	// fetch indexes themselves
+	IndexExpansionWorkers int
+	// IndexExpansionWait is how long a query waits for the expansion of an index
+	// before going on without it
+	IndexExpansionWait time.Duration
+	// ShadowURL is the base URL of a secondary indexing service, such as a
+	// deployment being migrated to, that publish-origin cache writes are copied
+	// to and a sample of queries is compared with. To accept copied writes, the
+	// secondary must have a region set other than this service's
+	ShadowURL string
+	// ShadowToken authorizes writes copied to the secondary
+	ShadowToken string
+	// ShadowReadRate is the share of queries, from 0 to 1, compared with the
+	// secondary. Zero compares none
+	ShadowReadRate float64
+	// ShadowMetrics is told about writes copied to and queries compared with the
+	// secondary
+	ShadowMetrics shadow.Metrics
+	// SyncRateLimit is the number of hashes per second whose records are
+	// fetched when syncing the provider cache from another deployment. Zero
+	// fetches them as fast as the other deployment sends them
+	SyncRateLimit float64
+	// MaxConnsPerHost is the number of connections that may be open to a
+	// provider or indexer at once. If zero, httppool.DefaultMaxConnsPerHost is
+	// used, and if negative it is unlimited
+	MaxConnsPerHost int
+	// MaxIdleConnsPerHost is the number of idle connections kept open to a
+	// provider or indexer. If zero, httppool.DefaultMaxIdleConnsPerHost is used
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long idle connections are kept open. If zero,
+	// httppool.DefaultIdleConnTimeout is used
+	IdleConnTimeout time.Duration
+	// DisableHTTP2 stops HTTP/2 being negotiated with providers and indexers
+	DisableHTTP2 bool
+	// DisableHostCooldowns keeps sending requests to providers and indexers
+	// that throttle with 429 or 503 responses, or fail repeatedly, rather than
+	// leaving them alone for a while
+	DisableHostCooldowns bool
+	// MaxHostCooldown is the longest a provider or indexer is left alone for,
+	// however long it asks for. If zero, httppool.DefaultMaxCooldown is used
+	MaxHostCooldown time.Duration
+	// ProviderHostLimits are the requests that may be in flight at once to hosts
+	// of providers known to throttle, by host
+	ProviderHostLimits map[string]int
+	// HTTPMetrics is told about the outbound connections and requests of the
+	// service
+	HTTPMetrics httppool.Metrics
+	// HTTPProxy is the proxy outbound requests to providers, indexers and the
+	// DoH endpoint are sent through. If nil, and no proxy rule matches, they are
+	// sent directly
+	HTTPProxy *url.URL
+	// ProxyRules override HTTPProxy for the hosts they match, sending requests
+	// to them through another proxy or directly. The first rule matching a host
+	// wins
+	ProxyRules []httppool.ProxyRule
+	// HedgeFetches hedges fetches of claims and indexes that can be fetched
+	// from more than one URL, fetching from the next URL as well when one is slow
+	HedgeFetches bool
+	// HedgeDelay is how long a fetch is given before it is hedged. If zero,
+	// fetches are hedged after the p95 of recent fetches from their host
+	HedgeDelay time.Duration
+	// MaxHedgesPerQuery is the number of hedged fetches a query may launch. If
+	// zero, DefaultMaxHedges is used
+	MaxHedgesPerQuery int
+	// ClaimLimits bound the claims fetched and imported, so that a crafted claim
+	// can't exhaust the resources of the service. Zero limits use their defaults
+	ClaimLimits claimlookup.Limits
+	// ClaimLimitMetrics is told about claims that exceed the limits
+	ClaimLimitMetrics claimlookup.LimitMetrics
+	// ClaimCacheBudget is the size in bytes of the claim cache. Once the claims
+	// written to it fill the budget, a fetched claim is only cached once it has
+	// been requested ClaimAdmissionThreshold times, and more often than the
+	// claim it would evict. Published claims are always cached. If zero, every
+	// fetched claim is cached
+	ClaimCacheBudget int64
+	// ClaimAdmissionThreshold is the fewest estimated requests for a claim it
+	// takes to be cached with the budget full. If zero,
+	// claimlookup.DefaultAdmissionThreshold is used
+	ClaimAdmissionThreshold int
+	// ClockSkewTolerance is how far the clocks of claim issuers may be off from
+	// ours, allowed either side of the validity period of imported claims and
+	// of how long claims and location commitments are cached
+	ClockSkewTolerance time.Duration
+	// SkewMetrics is told about claims valid only because of the tolerance
+	SkewMetrics claimlookup.SkewMetrics
+	// StrictMetadata leaves out location commitments whose provider record has
+	// a range or shard that disagrees with the claim, rather than following the
+	// claim
+	StrictMetadata bool
+	// AdvertisedFilter keeps a filter of every multihash advertised by the
+	// publisher, checked before asking IPNI about a hash. Requires a publisher
+	// key
+	AdvertisedFilter bool
+	// AdvertisedFilterMode is what a miss of the advertised filter does to a
+	// query. Only an authoritative filter skips asking IPNI and the legacy
+	// systems, and only deployments that advertise every hash that can be found
+	// should use one
+	AdvertisedFilterMode providerindex.FilterMode
+	// AdvertisedFilterCapacity is the number of multihashes the first stage of
+	// the filter holds. If zero, publisher.DefaultAdvertisedFilterCapacity is
+	// used
+	AdvertisedFilterCapacity int
+	// AdvertisedFilterFalsePositiveRate is the rate the filter stays under of
+	// reporting a hash that was never advertised. If zero,
+	// publisher.DefaultAdvertisedFilterFalsePositiveRate is used
+	AdvertisedFilterFalsePositiveRate float64
+	// FilterMetrics is told the outcome of each check of the advertised filter
+	FilterMetrics providerindex.FilterMetrics
+	// PrometheusMetrics records the metrics of every component of the service,
+	// served for scraping at /metrics. Metrics given for a component above are
+	// told about it instead
+	PrometheusMetrics *prommetrics.Exporter
 }
 
-func Construct(sc ServiceConfig) (*IndexingService, func(context.Context), error) {
+type constructConfig struct {
+	faults   *faults.Schedule
+	httpPool *httppool.Pool
+}
+
+// ConstructOption configures how a service is constructed, beyond its config
+type ConstructOption func(*constructConfig)
+
+// WithFaults injects faults into the redis clients, provider index, claim and
+// index lookups and fetches of the service by the schedule, for testing and
+// staging. Faults are never injected unless this option is given
+func WithFaults(s *faults.Schedule) ConstructOption {
+	return func(cc *constructConfig) {
+		cc.faults = s
+	}
+}
+
+// WithHTTPPool sends every outbound fetch and request to indexers with the
+// given pool, such as one over the transport of an httptest server, instead of
+// pools built from the config. The address policy doesn't apply to its fetches
+func WithHTTPPool(p *httppool.Pool) ConstructOption {
+	return func(cc *constructConfig) {
+		cc.httpPool = p
+	}
+}
+
+func Construct(sc ServiceConfig, constructOpts ...ConstructOption) (*IndexingService, func(context.Context), error) {
+	var cc constructConfig
+	for _, opt := range constructOpts {
+		opt(&cc)
+	}
+	redisClient := func(c *goredis.Client) redis.Client {
+		if cc.faults == nil {
+			return c
+		}
+		return faults.WrapRedisClient(c, cc.faults)
+	}
+	pm := sc.PrometheusMetrics
+	if pm != nil {
+		if sc.ProbeObserver == nil {
+			sc.ProbeObserver = pm
+		}
+		if sc.ResolverMetrics == nil {
+			sc.ResolverMetrics = pm
+		}
+		if sc.ShadowMetrics == nil {
+			sc.ShadowMetrics = pm
+		}
+		if sc.HTTPMetrics == nil {
+			sc.HTTPMetrics = pm
+		}
+	}
 
 	// connect to redis
 	providersClient := goredis.NewClient(&goredis.Options{
@@ -45,46 +445,673 @@ func Construct(sc ServiceConfig) (*IndexingService, func(context.Context), error
 		Password: sc.RedisPasswd,
 		DB:       sc.IndexesDB,
 	})
+	spacesClient := goredis.NewClient(&goredis.Options{
+		Addr:     sc.RedisURL,
+		Password: sc.RedisPasswd,
+		DB:       sc.SpacesDB,
+	})
 
 	// build caches
-	providersCache := redis.NewProviderStore(providersClient)
-	claimsCache := redis.NewContentClaimsStore(claimsClient)
-	shardDagIndexesCache := redis.NewShardedDagIndexStore(indexesClient)
+	ttlJitter := sc.CacheTTLJitter
+	if ttlJitter == 0 {
+		ttlJitter = DefaultCacheTTLJitter
+	}
+	storeOpts := func(db int) []redis.Option {
+		opts := []redis.Option{redis.WithTTLJitter(ttlJitter)}
+		if sc.RedisReplicaURL != "" {
+			opts = append(opts, redis.WithReadClient(redisClient(goredis.NewClient(&goredis.Options{
+				Addr:     sc.RedisReplicaURL,
+				Password: sc.RedisPasswd,
+				DB:       db,
+			}))))
+		}
+		return opts
+	}
+	// the events of the caches analyzed offline
+	eventSink := sc.CacheEventSink
+	var eventsFile *os.File
+	if eventSink == nil && sc.CacheEventsFile != "" {
+		f, err := os.OpenFile(sc.CacheEventsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening cache events file: %w", err)
+		}
+		eventsFile = f
+		eventSink = redis.NewNDJSONSink(eventsFile)
+	}
+	var cacheEvents *redis.CacheEvents
+	if eventSink != nil {
+		eventOpts := []redis.CacheEventsOption{}
+		if sc.CacheEventBuffer > 0 {
+			eventOpts = append(eventOpts, redis.WithEventBuffer(sc.CacheEventBuffer))
+		}
+		if pm != nil {
+			eventOpts = append(eventOpts, redis.WithEventMetrics(pm))
+		}
+		cacheEvents = redis.NewCacheEvents(eventSink, eventOpts...)
+	}
+	cacheOpts := func(db int, store string) []redis.Option {
+		opts := storeOpts(db)
+		if cacheEvents != nil {
+			opts = append(opts, redis.WithCacheEvents(cacheEvents, store))
+		}
+		return opts
+	}
+	providersCache := redis.NewProviderStore(redisClient(providersClient), cacheOpts(sc.ProvidersDB, types.ProvidersCache)...)
+	claimsCache := redis.NewContentClaimsStore(redisClient(claimsClient), cacheOpts(sc.ClaimsDB, types.ClaimsCache)...)
+	shardDagIndexesCache := redis.NewShardedDagIndexStore(redisClient(indexesClient), cacheOpts(sc.IndexesDB, types.IndexesCache)...)
+
+	ds := sc.Datastore
+	if ds == nil {
+		log.Warn("No datastore configured, using an in-memory datastore")
+		ds = dssync.MutexWrap(datastore.NewMapDatastore())
+	}
+
+	// shed expensive queries under overload
+	var controller *admission.Controller
+	if sc.MaxInFlightQueries > 0 || sc.MaxQueryP95 > 0 {
+		admissionOpts := []admission.Option{admission.WithMaxInFlight(sc.MaxInFlightQueries), admission.WithMaxP95(sc.MaxQueryP95)}
+		if pm != nil {
+			admissionOpts = append(admissionOpts, admission.WithMetrics(pm))
+		}
+		controller = admission.New(admissionOpts...)
+	}
+
+	// keep failed background provider writes for replay once redis is healthy,
+	// and pause replays while queries are being shed
+	deadLetterOpts := []deadletter.Option{deadletter.WithHealthCheck(func(ctx context.Context) error {
+		if controller != nil && controller.Shedding() {
+			return admission.ErrOverloaded
+		}
+		return providersClient.Ping(ctx).Err()
+	})}
+	if sc.DeadLetterMaxAge != 0 {
+		deadLetterOpts = append(deadLetterOpts, deadletter.WithMaxAge(sc.DeadLetterMaxAge))
+	}
+	deadLetters, err := deadletter.NewQueue(providersCache, ds, deadLetterOpts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pm != nil {
+		if err := pm.TrackDeadLetters(deadLetters); err != nil {
+			return nil, nil, err
+		}
+	}
 
 	// setup and start the provider caching queue for indexes
-	cachingJobHandler := providercacher.NewJobHandler(providercacher.NewSimpleProviderCacher(providersCache))
+	// record the indexes blocks are in as they are cached
+	var containingIndexes *redis.ContainingIndexStore
+	var jobHandlerOpts []providercacher.JobHandlerOption
+	if sc.RecordContainingIndexes {
+		containingIndexes = redis.NewContainingIndexStore(indexesClient, sc.MaxContainingIndexes)
+		jobHandlerOpts = append(jobHandlerOpts, providercacher.WithContainingIndexes(containingIndexes))
+	}
+	// the indexes populated are marked for as long as the records are cached,
+	// so they aren't expanded again after a restart
+	jobHandlerOpts = append(jobHandlerOpts, providercacher.WithPopulationMarkers(redis.NewPopulationMarkerStore(redisClient(providersClient), storeOpts(sc.ProvidersDB)...)))
+	cachingJobHandler := providercacher.NewJobHandler(providercacher.NewSimpleProviderCacher(providersCache, providercacher.WithDeadLetters(deadLetters)), jobHandlerOpts...)
+	cachingConcurrency, cachingBuffer := providercacher.DefaultConcurrency, providercacher.DefaultBuffer
+	if sc.IndexCachingConcurrency > 0 {
+		cachingConcurrency = sc.IndexCachingConcurrency
+	}
+	if sc.IndexCachingBuffer > 0 {
+		cachingBuffer = sc.IndexCachingBuffer
+	}
 	jobQueue := jobqueue.NewJobQueue(cachingJobHandler.Handle,
-		jobqueue.WithBuffer(5),
-		jobqueue.WithConcurrency(5),
+		jobqueue.WithBuffer(cachingBuffer),
+		jobqueue.WithConcurrency(cachingConcurrency),
 		jobqueue.WithErrorHandler(func(err error) {
 			log.Errorw("caching provider index", "error", err)
 		}))
-	cachingQueue := providercacher.NewCachingQueue(jobQueue)
+	cachingQueueOpts := []providercacher.CachingQueueOption{providercacher.WithMaxPending(cachingConcurrency + cachingBuffer)}
+	if pm != nil {
+		cachingQueueOpts = append(cachingQueueOpts, providercacher.WithPopulationMetrics(pm))
+	}
+	cachingQueue := providercacher.NewCachingQueue(jobQueue, cachingQueueOpts...)
+
+	// requests to indexers share a pool of connections, and fetches from
+	// providers share another that applies the address policy. Both back off
+	// from hosts in the same cooldown table
+	var cooldownOpts []httppool.Option
+	if !sc.DisableHostCooldowns {
+		var opts []httppool.CooldownOption
+		if sc.MaxHostCooldown > 0 {
+			opts = append(opts, httppool.WithMaxCooldown(sc.MaxHostCooldown))
+		}
+		cooldownOpts = append(cooldownOpts, httppool.WithCooldowns(httppool.NewCooldowns(opts...)))
+	}
+	newPool := func(opts ...httppool.Option) *httppool.Pool {
+		if cc.httpPool != nil {
+			return cc.httpPool
+		}
+		return httppool.New(slices.Concat(httpPoolOpts(sc), cooldownOpts, opts)...)
+	}
+	endpointPool := newPool()
 
 	// setup IPNI
 	// TODO: switch to double hashed client for reader privacy?
-	findClient, err := ipnifind.New(sc.IndexerURL)
+	var findClient ipnifind.Finder
+	if sc.MaxFindRecords > 0 {
+		findClient, err = findclient.New(sc.IndexerURL, findclient.WithClient(endpointPool.Client()))
+	} else {
+		findClient, err = ipnifind.New(sc.IndexerURL, ipnifind.WithClient(endpointPool.Client()))
+	}
 	if err != nil {
 		return nil, nil, err
 	}
 
+	// setup replication of publishes to other regions
+	var replicator *replication.Replicator
+	var providerIndexOpts []providerindex.Option
+	if sc.ContextIDCodec != nil {
+		providerIndexOpts = append(providerIndexOpts, providerindex.WithContextIDCodec(sc.ContextIDCodec))
+	}
+	// tombstones of removed providers are kept with the provider records
+	tombstones := redis.NewTombstoneStore(redisClient(providersClient))
+	providerIndexOpts = append(providerIndexOpts,
+		providerindex.WithTombstones(tombstones),
+		providerindex.WithClaimCache(claimsCache))
+	if pm != nil {
+		providerIndexOpts = append(providerIndexOpts, providerindex.WithMetrics(pm))
+	}
+	providerIndexOpts = append(providerIndexOpts,
+		providerindex.WithClockSkewTolerance(sc.ClockSkewTolerance),
+		providerindex.WithRecentResults(sc.RecentResults, sc.RecentResultsTTL),
+		providerindex.WithMaxFindRecords(sc.MaxFindRecords))
+	// space bindings are kept with the provider records they bind to
+	if sc.BindSpaceCommitments {
+		providerIndexOpts = append(providerIndexOpts, providerindex.WithSpaceBindings(
+			redis.NewSpaceBindingStore(redisClient(providersClient), storeOpts(sc.ProvidersDB)...),
+			sc.SpaceBindingWindow,
+		))
+	}
+	var adverts *publisher.Publisher
+	var publisherDs datastore.Batching = namespace.Wrap(ds, datastore.NewKey("publisher"))
+	if sc.PublisherS3 != nil && sc.PublisherDynamo != nil {
+		publisherDs = remotestore.NewServerlessDatastore(sc.PublisherS3, sc.PublisherS3Prefix, sc.PublisherDynamo)
+	}
+	if sc.PublisherKey != nil {
+		var publisherOpts []publisher.Option
+		if sc.AdvertisedFilter {
+			capacity, rate := sc.AdvertisedFilterCapacity, sc.AdvertisedFilterFalsePositiveRate
+			if capacity == 0 {
+				capacity = publisher.DefaultAdvertisedFilterCapacity
+			}
+			if rate == 0 {
+				rate = publisher.DefaultAdvertisedFilterFalsePositiveRate
+			}
+			if capacity < 0 || rate < 0 || rate >= 1 {
+				return nil, nil, fmt.Errorf("invalid advertised filter capacity %d or false positive rate %v", capacity, rate)
+			}
+			publisherOpts = append(publisherOpts, publisher.WithAdvertisedFilter(capacity, rate))
+		}
+		adverts = publisher.New(publisherDs, sc.PublisherKey, publisherOpts...)
+		providerIndexOpts = append(providerIndexOpts, providerindex.WithAdvertisementPublisher(adverts))
+		if sc.AdvertisedFilter {
+			providerIndexOpts = append(providerIndexOpts, providerindex.WithAdvertisedFilter(adverts, sc.AdvertisedFilterMode))
+			if sc.FilterMetrics != nil {
+				providerIndexOpts = append(providerIndexOpts, providerindex.WithFilterMetrics(sc.FilterMetrics))
+			} else if pm != nil {
+				providerIndexOpts = append(providerIndexOpts, providerindex.WithFilterMetrics(pm))
+			}
+		}
+	}
+	var announcer *publisher.Announcer
+	if adverts != nil && len(sc.AnnounceURLs)+len(sc.RequiredAnnounceURLs) > 0 {
+		announcer, err = newAnnouncer(sc, publisherDs, endpointPool.Client())
+		if err != nil {
+			return nil, nil, err
+		}
+		providerIndexOpts = append(providerIndexOpts, providerindex.WithAdvertisementAnnouncer(announcer))
+	}
+	var lagMonitor *publisher.LagMonitor
+	if adverts != nil && len(sc.LagCheckURLs) > 0 {
+		lagMonitor, err = newLagMonitor(sc, adverts, endpointPool.Client())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if sc.Region != "" {
+		sinks := make([]replication.Sink, 0, len(sc.ReplicationPeers))
+		for _, peer := range sc.ReplicationPeers {
+			sinks = append(sinks, replication.NewHTTPSink(strings.TrimSuffix(peer, "/")+"/replicate", sc.ReplicationToken, http.DefaultClient))
+		}
+		replicator, err = replication.NewReplicator(sc.Region, providersCache, claimsCache, sinks, ds)
+		if err != nil {
+			return nil, nil, err
+		}
+		providerIndexOpts = append(providerIndexOpts, providerindex.WithReplicator(replicator))
+	}
+
+	// setup shadowing of a secondary service
+	var shadowWriter *shadow.Writer
+	var shadowReader *shadow.Reader
+	if sc.ShadowURL != "" {
+		var shadowOpts []shadow.Option
+		if sc.ShadowMetrics != nil {
+			shadowOpts = append(shadowOpts, shadow.WithMetrics(sc.ShadowMetrics))
+		}
+		origin := sc.Region
+		if origin == "" {
+			origin = shadowOrigin
+		}
+		base := strings.TrimSuffix(sc.ShadowURL, "/")
+		shadowWriter = shadow.NewWriter(origin, replication.NewHTTPSink(base+"/replicate", sc.ShadowToken, http.DefaultClient), shadowOpts...)
+		shadowReader = shadow.NewReader(shadow.NewHTTPQuerier(base+"/claims", http.DefaultClient), shadowOpts...)
+		providerIndexOpts = append(providerIndexOpts, providerindex.WithReplicator(shadowWriter))
+	}
+
+	// resolve provider addresses with the same resolver they are checked with
+	var resolver dnsresolver.Resolver = net.DefaultResolver
+	if sc.DoHEndpoint != "" {
+		// the DoH endpoint is queried like the indexers, without the address
+		// policy
+		dohOpts := []dnsresolver.DoHOption{dnsresolver.WithHTTPClient(endpointPool.Client())}
+		if sc.ResolverMetrics != nil {
+			dohOpts = append(dohOpts, dnsresolver.WithMetrics(sc.ResolverMetrics))
+		}
+		resolver, err = dnsresolver.NewDoH(sc.DoHEndpoint, dohOpts...)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// only fetch from providers at addresses we are allowed to connect to
+	addressPolicy := addrpolicy.New(
+		addrpolicy.WithAllowPrivate(sc.AllowPrivateAddresses),
+		addrpolicy.WithAllowedPrefixes(sc.AllowedAddressRanges...),
+		addrpolicy.WithResolver(resolver),
+	)
+	// a proxy connects to providers on our behalf, so the providers reached
+	// through one are checked against the policy before requests are sent
+	fetchPoolOpts := []httppool.Option{httppool.WithDialContext(addressPolicy.DialContext), httppool.WithDestinationCheck(addressPolicy.CheckHost)}
+	for host, n := range sc.ProviderHostLimits {
+		fetchPoolOpts = append(fetchPoolOpts, httppool.WithHostLimit(host, n))
+	}
+	fetchClient := newPool(fetchPoolOpts...).Client()
+	if cc.faults != nil {
+		fetchClient = faults.WrapHTTPClient(fetchClient, cc.faults)
+	}
+
 	// build read through fetchers
 	// TODO: add sender / publisher / linksystem / legacy systems
-	providerIndex := providerindex.NewProviderIndex(providersCache, findClient, nil, nil, linking.LinkSystem{}, nil)
-	claimLookup := claimlookup.WithCache(claimlookup.NewClaimLookup(http.DefaultClient), claimsCache)
+	var providerIndex ProviderIndex = providerindex.NewProviderIndex(providersCache, findClient, nil, nil, linking.LinkSystem{}, nil, providerIndexOpts...)
+	var claimFetcher claimlookup.ClaimLookup = claimlookup.NewClaimLookup(fetchClient, claimlookup.WithMaxClaimSize(sc.ClaimLimits.MaxSize))
+	var indexFetcher blobindexlookup.BlobIndexLookup = blobindexlookup.NewBlobIndexLookup(fetchClient)
+	if cc.faults != nil {
+		// the caches stay outside the faulted lookups, so how they handle
+		// failed lookups is exercised too
+		providerIndex = faults.WrapProviderIndex(providerIndex, cc.faults)
+		claimFetcher = faults.WrapClaimLookup(claimFetcher, cc.faults)
+		indexFetcher = faults.WrapBlobIndexLookup(indexFetcher, cc.faults)
+	}
+	var claimCacheOpts []claimlookup.CacheOption
+	var claimLimitOpts []claimlookup.LimitOption
+	var lookupOpts []blobindexlookup.Option
+	if pm != nil {
+		claimCacheOpts = append(claimCacheOpts, claimlookup.WithCacheMetrics(pm))
+		claimLimitOpts = append(claimLimitOpts, claimlookup.WithLimitMetrics(pm))
+		lookupOpts = append(lookupOpts, blobindexlookup.WithMetrics(pm))
+	}
+	if sc.ClaimLimitMetrics != nil {
+		claimLimitOpts = append(claimLimitOpts, claimlookup.WithLimitMetrics(sc.ClaimLimitMetrics))
+	}
+	// claims that exceed the limits are rejected before they are cached
+	claimFetcher = claimlookup.WithLimits(claimFetcher, sc.ClaimLimits, claimLimitOpts...)
+	var claimAdmission claimlookup.AdmissionPolicy
+	if sc.ClaimCacheBudget > 0 {
+		claimAdmission = claimlookup.NewTinyLFU(sc.ClaimCacheBudget, claimlookup.WithAdmissionThreshold(sc.ClaimAdmissionThreshold))
+		claimCacheOpts = append(claimCacheOpts, claimlookup.WithAdmission(claimAdmission))
+		if pm != nil {
+			claimCacheOpts = append(claimCacheOpts, claimlookup.WithAdmissionMetrics(pm))
+		}
+	}
+	claimLookup := claimlookup.WithCache(claimFetcher, claimsCache, claimCacheOpts...)
+	var shardFilters *redis.ShardFilterStore
+	if sc.ShardFilterFalsePositiveRate >= 1 {
+		return nil, nil, fmt.Errorf("shard filter false positive rate must be below 1: %v", sc.ShardFilterFalsePositiveRate)
+	}
+	if sc.ShardFilterFalsePositiveRate > 0 {
+		shardFilters = redis.NewShardFilterStore(redisClient(indexesClient), storeOpts(sc.IndexesDB)...)
+		lookupOpts = append(lookupOpts, blobindexlookup.WithShardFilters(shardFilters, sc.ShardFilterFalsePositiveRate))
+	}
+	// indexes are cached once by the digest of their blob, however many context
+	// IDs they are fetched for
+	lookupOpts = append(lookupOpts, blobindexlookup.WithSharedBlobs(
+		redis.NewIndexBlobStore(redisClient(indexesClient), cacheOpts(sc.IndexesDB, types.IndexesCache)...),
+		redis.NewIndexDigestStore(redisClient(indexesClient), storeOpts(sc.IndexesDB)...),
+	))
 	blobIndexLookup := blobindexlookup.WithCache(
-		blobindexlookup.NewBlobIndexLookup(http.DefaultClient),
+		indexFetcher,
 		shardDagIndexesCache,
 		cachingQueue,
+		lookupOpts...,
 	)
 
 	// setup walker
-	service := NewIndexingService(blobIndexLookup, claimLookup, providerIndex, WithConcurrency(5))
+	opts := []Option{WithConcurrency(5), WithDeadLetters(deadLetters), WithAddressPolicy(addressPolicy), WithResolver(resolver), WithLocationCacheWarming(!sc.DisableLocationCacheWarming), WithPrefetch(sc.PrefetchShards), WithClaimCache(claimsCache)}
+	if claimAdmission != nil {
+		opts = append(opts, WithClaimAdmission(claimAdmission))
+	}
+	if shardFilters != nil {
+		opts = append(opts, WithShardFilters(shardFilters))
+	}
+	// the space index is kept in the namespace it was last rebuilt into, which
+	// the publisher records
+	var spaceNamespace string
+	if adverts != nil {
+		spaceNamespace, err = adverts.ActiveNamespace(context.Background(), string(RebuildSpaceIndex))
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, WithSpaceIndexRebuilds(func(namespace string) types.SpaceIndexStore {
+			return redis.NewSpaceIndexStore(spacesClient, redis.WithSpaceNamespace(namespace))
+		}))
+	}
+	opts = append(opts, WithSpaceIndex(redis.NewSpaceIndexStore(spacesClient, redis.WithSpaceNamespace(spaceNamespace))))
+	if sc.MaxIndexDepth != 0 {
+		opts = append(opts, WithMaxIndexDepth(sc.MaxIndexDepth))
+	}
+	opts = append(opts, WithResultCache(sc.ResultCache, sc.ResultCacheTTL))
+	// supersessions are kept with the claims they are between
+	opts = append(opts, WithSupersessions(redis.NewSupersessionStore(redisClient(claimsClient), storeOpts(sc.ClaimsDB)...)))
+	if containingIndexes != nil {
+		opts = append(opts, WithContainingIndexes(containingIndexes))
+	}
+	var expansions *expansion.Pool
+	if sc.IndexExpansionWorkers > 0 {
+		expansions, err = expansion.NewPool(ds, expansion.FetchWith(blobIndexLookup), expansion.WithWorkers(sc.IndexExpansionWorkers))
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, WithIndexExpansion(expansions, sc.IndexExpansionWait))
+	}
+	// probes go through the address policy like any other fetch
+	proberOpts := []liveness.Option{}
+	if sc.ProbeBudget > 0 {
+		proberOpts = append(proberOpts, liveness.WithBudget(sc.ProbeBudget))
+	}
+	if sc.ProbeObserver != nil {
+		proberOpts = append(proberOpts, liveness.WithObserver(sc.ProbeObserver))
+	}
+	opts = append(opts, WithLocationProber(liveness.New(fetchClient, proberOpts...)))
+
+	// setup claim webhooks
+	var webhook *claimevents.Webhook
+	if len(sc.WebhookURLs) > 0 {
+		webhook, err = claimevents.NewWebhook(sc.WebhookURLs, ds, claimevents.WithSecret([]byte(sc.WebhookSecret)))
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, WithClaimWebhook(webhook))
+	}
+	if replicator != nil {
+		opts = append(opts, WithReplicator(replicator))
+	}
+	// setup syncing of the provider cache with other deployments
+	syncOpts := []cachesync.Option{cachesync.WithTombstones(tombstones)}
+	if sc.SyncRateLimit > 0 {
+		syncOpts = append(syncOpts, cachesync.WithRateLimit(sc.SyncRateLimit, int(sc.SyncRateLimit)))
+	}
+	opts = append(opts, WithSync(cachesync.NewSource(providersCache), cachesync.NewSyncer(providersCache, syncOpts...)))
+	if shadowWriter != nil {
+		opts = append(opts, WithShadowWriter(shadowWriter), WithShadowReader(shadowReader), WithShadowReadRate(sc.ShadowReadRate))
+	}
+	if controller != nil {
+		opts = append(opts, WithAdmission(controller))
+	}
+	if adverts != nil {
+		opts = append(opts, WithPublisher(adverts))
+	}
+	if announcer != nil {
+		opts = append(opts, WithAnnouncer(announcer), WithAnnounceRoutes(sc.AnnounceRoutes))
+	}
+	if lagMonitor != nil {
+		opts = append(opts, WithLagMonitor(lagMonitor))
+	}
+	if sc.HedgeFetches {
+		opts = append(opts, WithHedging(sc.HedgeDelay, sc.MaxHedgesPerQuery))
+	}
+	opts = append(opts, WithClaimLimits(sc.ClaimLimits), WithClockSkewTolerance(sc.ClockSkewTolerance))
+	opts = append(opts, WithStrictMetadata(sc.StrictMetadata))
+	if sc.SignResults {
+		if sc.PublisherKey == nil {
+			return nil, nil, errors.New("signing query results requires a publisher key")
+		}
+		resultSigner, err := newResultSigner(sc.PublisherKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("creating query result signer: %w", err)
+		}
+		log.Infow("signing query results", "did", resultSigner.DID())
+		opts = append(opts, WithResultSigner(resultSigner))
+	}
+	if sc.ReconstructIndexes {
+		reconstruction := IndexReconstruction{
+			Cache:          shardDagIndexesCache,
+			Client:         fetchClient,
+			MaxShardSize:   sc.MaxReconstructShardSize,
+			OnFetchFailure: sc.ReconstructOnFetchFailure,
+		}
+		if sc.PublisherKey != nil {
+			signer, err := newResultSigner(sc.PublisherKey)
+			if err != nil {
+				log.Warnw("reconstructed indexes can't be republished", "error", err)
+			} else {
+				reconstruction.Signer = signer
+			}
+		}
+		opts = append(opts, WithIndexReconstruction(reconstruction))
+	}
+	if pm != nil {
+		opts = append(opts, WithMetrics(pm), WithMetricsHandler(pm.Handler()), WithHedgeMetrics(pm), WithSelfCheckMetrics(pm), WithPublishMetrics(pm), WithSkewMetrics(pm), WithMismatchMetrics(pm))
+	}
+	if sc.SkewMetrics != nil {
+		opts = append(opts, WithSkewMetrics(sc.SkewMetrics))
+	}
+	// self checks wait for ingestion by asking IPNI directly
+	opts = append(opts, WithIPNIFinder(findClient))
+	if sc.SelfCheckURL != "" {
+		u, err := url.Parse(sc.SelfCheckURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing self check URL: %w", err)
+		}
+		opts = append(opts, WithCanary(sc.SelfCheckInterval, SelfCheckOptions{ProviderURL: *u, IPNIWait: sc.SelfCheckIPNIWait}))
+	}
+	var identityOpts []identity.Option
+	if sc.PublisherKey != nil {
+		// the service advertises the claims published to it, whoever issued them
+		publisherID, err := peer.IDFromPrivateKey(sc.PublisherKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("deriving publisher peer ID: %w", err)
+		}
+		identityOpts = append(identityOpts, identity.WithRelays(publisherID))
+		// claims published or cached through the service are provided by it
+		opts = append(opts, WithClaimProvider(peer.AddrInfo{ID: publisherID, Addrs: sc.ClaimAddrs}))
+	}
+	if sc.ContextIDCodec != nil {
+		opts = append(opts, WithContextIDCodec(sc.ContextIDCodec))
+	}
+	identities, err := identity.NewMapping(context.Background(), ds, identityOpts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts = append(opts, WithIdentities(identities))
+	if sc.AuditLog {
+		auditLog, err := audit.NewLog(ds)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, WithAuditSinks(auditLog))
+	}
+	var auditFile *os.File
+	if sc.AuditLogFile != "" {
+		auditFile, err = os.OpenFile(sc.AuditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening audit log file: %w", err)
+		}
+		opts = append(opts, WithAuditSinks(audit.NewJSONLines(auditFile)))
+	}
+
+	service, err := NewIndexingService(blobIndexLookup, claimLookup, providerIndex, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// start the job queue
 	jobQueue.Startup()
+	deadLetters.Startup()
+	if expansions != nil {
+		expansions.Startup()
+	}
+	if cacheEvents != nil {
+		cacheEvents.Startup()
+	}
+	if webhook != nil {
+		webhook.Startup()
+	}
+	if replicator != nil {
+		replicator.Startup()
+	}
+	if shadowWriter != nil {
+		shadowWriter.Startup()
+	}
+	if announcer != nil {
+		announcer.Startup()
+	}
+	if lagMonitor != nil {
+		lagMonitor.Startup()
+	}
+	if canary := service.Canary(); canary != nil {
+		canary.Startup()
+	}
 
 	return service, func(ctx context.Context) {
+		service.DrainRefinements(ctx)
+		service.DrainPublishes(ctx)
 		jobQueue.Shutdown(ctx)
+		deadLetters.Shutdown(ctx)
+		if expansions != nil {
+			expansions.Shutdown(ctx)
+		}
+		if webhook != nil {
+			webhook.Shutdown(ctx)
+		}
+		if replicator != nil {
+			replicator.Shutdown(ctx)
+		}
+		if shadowWriter != nil {
+			shadowWriter.Shutdown(ctx)
+			shadowReader.Shutdown(ctx)
+		}
+		if announcer != nil {
+			announcer.Shutdown(ctx)
+		}
+		if lagMonitor != nil {
+			lagMonitor.Shutdown(ctx)
+		}
+		if canary := service.Canary(); canary != nil {
+			canary.Shutdown(ctx)
+		}
+		if auditFile != nil {
+			auditFile.Close()
+		}
+		if cacheEvents != nil {
+			cacheEvents.Shutdown(ctx)
+		}
+		if eventsFile != nil {
+			eventsFile.Close()
+		}
 	}, nil
 }
+
+// httpPoolOpts are the options of the connection pools of the service from its
+// config
+func httpPoolOpts(sc ServiceConfig) []httppool.Option {
+	var opts []httppool.Option
+	switch {
+	case sc.MaxConnsPerHost > 0:
+		opts = append(opts, httppool.WithMaxConnsPerHost(sc.MaxConnsPerHost))
+	case sc.MaxConnsPerHost < 0:
+		opts = append(opts, httppool.WithMaxConnsPerHost(0))
+	}
+	if sc.MaxIdleConnsPerHost > 0 {
+		opts = append(opts, httppool.WithMaxIdleConnsPerHost(sc.MaxIdleConnsPerHost))
+	}
+	if sc.IdleConnTimeout > 0 {
+		opts = append(opts, httppool.WithIdleConnTimeout(sc.IdleConnTimeout))
+	}
+	if sc.DisableHTTP2 {
+		opts = append(opts, httppool.WithHTTP2(false))
+	}
+	if sc.HTTPMetrics != nil {
+		opts = append(opts, httppool.WithMetrics(sc.HTTPMetrics))
+	}
+	if sc.HTTPProxy != nil || len(sc.ProxyRules) > 0 {
+		opts = append(opts, httppool.WithProxy(httppool.ProxyConfig{Proxy: sc.HTTPProxy, Rules: sc.ProxyRules}))
+	}
+	return opts
+}
+
+// newLagMonitor returns a monitor checking each lag check URL for how far
+// behind the chain of the publisher it is, for the peer of the publisher key
+func newLagMonitor(sc ServiceConfig, adverts *publisher.Publisher, client *http.Client) (*publisher.LagMonitor, error) {
+	peerID, err := peer.IDFromPrivateKey(sc.PublisherKey)
+	if err != nil {
+		return nil, fmt.Errorf("deriving publisher peer ID: %w", err)
+	}
+	endpoints := make([]publisher.LagEndpoint, 0, len(sc.LagCheckURLs))
+	for _, u := range sc.LagCheckURLs {
+		finder, err := ipnifind.New(u, ipnifind.WithClient(client))
+		if err != nil {
+			return nil, fmt.Errorf("creating lag check client: %w", err)
+		}
+		endpoints = append(endpoints, publisher.LagEndpoint{Name: u, Finder: finder})
+	}
+	opts := []publisher.LagOption{publisher.WithLagAlert(sc.OnAdvertisementLag)}
+	if sc.MaxAdvertisementLag > 0 {
+		opts = append(opts, publisher.WithMaxLag(sc.MaxAdvertisementLag))
+	}
+	if sc.LagCheckInterval > 0 {
+		opts = append(opts, publisher.WithLagCheckInterval(sc.LagCheckInterval))
+	}
+	return publisher.NewLagMonitor(adverts, peerID, endpoints, opts...), nil
+}
+
+// newAnnouncer returns an announcer with an HTTP sender for each announce URL,
+// sending as the peer of the publisher key
+func newAnnouncer(sc ServiceConfig, ds datastore.Batching, client *http.Client) (*publisher.Announcer, error) {
+	peerID, err := peer.IDFromPrivateKey(sc.PublisherKey)
+	if err != nil {
+		return nil, fmt.Errorf("deriving publisher peer ID: %w", err)
+	}
+	var endpoints []publisher.AnnounceEndpoint
+	addEndpoint := func(rawURL string, required bool) error {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return fmt.Errorf("parsing announce URL: %w", err)
+		}
+		sender, err := httpsender.New([]*url.URL{u}, peerID, httpsender.WithClient(client))
+		if err != nil {
+			return fmt.Errorf("creating announce sender: %w", err)
+		}
+		endpoints = append(endpoints, publisher.AnnounceEndpoint{Name: rawURL, Sender: sender, Required: required})
+		return nil
+	}
+	for _, u := range sc.AnnounceURLs {
+		if err := addEndpoint(u, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, u := range sc.RequiredAnnounceURLs {
+		if err := addEndpoint(u, true); err != nil {
+			return nil, err
+		}
+	}
+	opts := []publisher.AnnouncerOption{
+		publisher.WithAnnouncePolicy(sc.AnnouncePolicy),
+		publisher.WithAnnounceAddrs(sc.PublisherAddrs...),
+	}
+	if sc.PrometheusMetrics != nil {
+		opts = append(opts, publisher.WithAnnounceMetrics(sc.PrometheusMetrics))
+	}
+	return publisher.NewAnnouncer(ds, endpoints, opts...)
+}
@@ -0,0 +1,31 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// ErrContainingIndexesDisabled is returned from ContainingIndexes when the
+// indexes blocks are in are not recorded
+var ErrContainingIndexesDisabled = errors.New("containing indexes are not recorded")
+
+// WithContainingIndexes reads the indexes blocks were found in from the store,
+// which is written to as the blocks of fetched indexes are cached
+func WithContainingIndexes(store types.ContainingIndexStore) Option {
+	return func(is *IndexingService) {
+		is.containingIndexes = store
+	}
+}
+
+// ContainingIndexes returns the cached indexes the block was found in by
+// queries, most recently found first. Only indexes fetched while their blocks
+// were cached are known, and those of them still cached
+func (is *IndexingService) ContainingIndexes(ctx context.Context, hash multihash.Multihash) ([]types.IndexRef, error) {
+	if is.containingIndexes == nil {
+		return nil, ErrContainingIndexesDisabled
+	}
+	return is.containingIndexes.Get(ctx, hash)
+}
@@ -0,0 +1,101 @@
+package service_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/blobindexlookup"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providercacher"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// syncJobQueue handles provider caching jobs as they are queued
+type syncJobQueue struct {
+	handler *providercacher.JobHandler
+}
+
+func (q *syncJobQueue) Queue(ctx context.Context, j providercacher.ProviderCachingJob) error {
+	return q.handler.Handle(ctx, j)
+}
+
+type mockContainingIndexStore struct {
+	lk   sync.Mutex
+	refs map[string][]types.IndexRef
+}
+
+func (m *mockContainingIndexStore) Add(ctx context.Context, ref types.IndexRef, hashes []multihash.Multihash) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	for _, hash := range hashes {
+		m.refs[string(hash)] = append([]types.IndexRef{ref}, m.refs[string(hash)]...)
+	}
+	return nil
+}
+
+func (m *mockContainingIndexStore) Get(ctx context.Context, hash multihash.Multihash) ([]types.IndexRef, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.refs[string(hash)], nil
+}
+
+func TestIndexingService__ContainingIndexes(t *testing.T) {
+	ctx := context.Background()
+	f := newClaimFixture(t)
+
+	contentHash, interiorHash := testutil.RandomMultihash(), testutil.RandomMultihash()
+	indexCid := testutil.RandomCID().(cidlink.Link).Cid
+	content := testutil.RandomCID()
+	index := blobindex.NewShardedDagIndexView(content, 2)
+	index.SetSlice(contentHash, contentHash, blobindex.Position{Offset: 0, Length: 10})
+	index.SetSlice(contentHash, interiorHash, blobindex.Position{Offset: 10, Length: 10})
+	// the index is known by the context ID of its location
+	locationContextID := testutil.RandomBytes(10)
+	indexClaim, indexLocation := f.newClaim(t), f.newClaim(t)
+	store := &mockProviderStore{results: map[string][]model.ProviderResult{
+		string(contentHash):     {f.result(t, testutil.RandomBytes(10), &metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaim})},
+		string(indexCid.Hash()): {f.result(t, locationContextID, &metadata.LocationCommitmentMetadata{Claim: indexLocation})},
+	}}
+
+	containing := &mockContainingIndexStore{refs: map[string][]types.IndexRef{}}
+	cachingQueue := providercacher.NewCachingQueue(&syncJobQueue{
+		handler: providercacher.NewJobHandler(providercacher.NewSimpleProviderCacher(store), providercacher.WithContainingIndexes(containing)),
+	})
+	blobIndexLookup := blobindexlookup.WithCache(
+		&mockBlobIndexLookup{index: index},
+		redis.NewShardedDagIndexStore(&memRedis{data: map[string]string{}}),
+		cachingQueue,
+	)
+	providerIndex := providerindex.NewProviderIndex(store, &countingFinder{results: map[string][]model.ProviderResult{}, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+	is := testutil.Must(service.NewIndexingService(blobIndexLookup, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex, service.WithContainingIndexes(containing)))(t)
+
+	// nothing is known of the block until a query fetches its index
+	refs := testutil.Must(is.ContainingIndexes(ctx, interiorHash))(t)
+	require.Empty(t, refs)
+
+	claims, indexes := queriedClaims(t, is, contentHash)
+	require.ElementsMatch(t, []cid.Cid{indexClaim, indexLocation}, claims)
+	require.Equal(t, 1, indexes)
+
+	refs = testutil.Must(is.ContainingIndexes(ctx, interiorHash))(t)
+	require.Equal(t, []types.IndexRef{{ContextID: locationContextID, Content: content.(cidlink.Link).Cid.Hash()}}, refs)
+
+	t.Run("disabled", func(t *testing.T) {
+		is := testutil.Must(service.NewIndexingService(blobIndexLookup, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex))(t)
+		_, err := is.ContainingIndexes(ctx, interiorHash)
+		require.ErrorIs(t, err, service.ErrContainingIndexesDisabled)
+	})
+}
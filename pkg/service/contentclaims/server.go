@@ -5,11 +5,11 @@ import (
 	"github.com/storacha/go-ucanto/server"
 )
 
-func NewServer(id principal.Signer) (server.ServerView, error) {
-	service := NewService()
-	var opts []server.Option
+func NewServer(id principal.Signer, opts ...Option) (server.ServerView, error) {
+	service := NewService(opts...)
+	var srvOpts []server.Option
 	for ability, method := range service {
-		opts = append(opts, server.WithServiceMethod(ability, method))
+		srvOpts = append(srvOpts, server.WithServiceMethod(ability, method))
 	}
-	return server.NewServer(id, opts...)
+	return server.NewServer(id, srvOpts...)
 }
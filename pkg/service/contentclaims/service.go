@@ -1,38 +1,113 @@
 package contentclaims
 
 import (
+	"context"
+	"time"
+
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/storacha/go-ucanto/core/delegation"
 	"github.com/storacha/go-ucanto/core/invocation"
+	"github.com/storacha/go-ucanto/core/ipld"
 	"github.com/storacha/go-ucanto/core/receipt"
+	"github.com/storacha/go-ucanto/core/result"
 	"github.com/storacha/go-ucanto/server"
+	"github.com/storacha/go-ucanto/server/transaction"
 	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/go-ucanto/validator"
 	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/service/claimevents"
+	"github.com/storacha/indexing-service/pkg/types"
 )
 
 var log = logging.Logger("contentclaims")
 
-func NewService() map[ucan.Ability]server.ServiceMethod[assert.Unit] {
+// ClaimService publishes the claims invoked on the server
+type ClaimService interface {
+	PublishClaim(ctx context.Context, claim delegation.Delegation) error
+}
+
+// Auditor records operations that are rejected before reaching the claim
+// service
+type Auditor interface {
+	Audit(ctx context.Context, entry types.AuditEntry) error
+}
+
+// Option configures the content claims service
+type Option func(*config)
+
+type config struct {
+	claims  ClaimService
+	auditor Auditor
+}
+
+// WithClaimService publishes invoked claims with the given service, as made by
+// the issuers of the invocations
+func WithClaimService(claims ClaimService) Option {
+	return func(c *config) {
+		c.claims = claims
+	}
+}
+
+// WithAuditor audits invocations that aren't authorized as rejected
+func WithAuditor(auditor Auditor) Option {
+	return func(c *config) {
+		c.auditor = auditor
+	}
+}
+
+func NewService(opts ...Option) map[ucan.Ability]server.ServiceMethod[assert.Unit] {
+	c := &config{}
+	for _, opt := range opts {
+		opt(c)
+	}
 	return map[ucan.Ability]server.ServiceMethod[assert.Unit]{
-		assert.Equals.Can(): server.Provide(
-			assert.Equals,
-			func(cap ucan.Capability[assert.EqualsCaveats], inv invocation.Invocation, ctx server.InvocationContext) (assert.Unit, receipt.Effects, error) {
-				log.Errorf("TODO: implement me")
-				return assert.Unit{}, nil, nil
-			},
-		),
-		assert.Index.Can(): server.Provide(
-			assert.Index,
-			func(cap ucan.Capability[assert.IndexCaveats], inv invocation.Invocation, ctx server.InvocationContext) (assert.Unit, receipt.Effects, error) {
-				log.Errorf("TODO: implement me")
-				return assert.Unit{}, nil, nil
-			},
-		),
-		assert.Location.Can(): server.Provide(
-			assert.Location,
-			func(cap ucan.Capability[assert.LocationCaveats], inv invocation.Invocation, ctx server.InvocationContext) (assert.Unit, receipt.Effects, error) {
+		assert.Equals.Can():   provide(c, assert.Equals),
+		assert.Index.Can():    provide(c, assert.Index),
+		assert.Location.Can(): provide(c, assert.Location),
+	}
+}
+
+// provide publishes invocations of the capability that are authorized, and
+// audits the others as rejected
+func provide[C any](c *config, capability validator.CapabilityParser[C]) server.ServiceMethod[assert.Unit] {
+	return func(inv invocation.Invocation, ictx server.InvocationContext) (transaction.Transaction[assert.Unit, ipld.Builder], error) {
+		// the handler is only called for invocations that are authorized
+		authorized := false
+		method := server.Provide(capability, func(cap ucan.Capability[C], inv invocation.Invocation, ictx server.InvocationContext) (assert.Unit, receipt.Effects, error) {
+			authorized = true
+			if c.claims == nil {
 				log.Errorf("TODO: implement me")
 				return assert.Unit{}, nil, nil
-			},
-		),
+			}
+			ctx := types.WithAuditActor(context.Background(), inv.Issuer().DID().String())
+			return assert.Unit{}, nil, c.claims.PublishClaim(ctx, inv)
+		})
+		tx, err := method(inv, ictx)
+		if err == nil && !authorized && c.auditor != nil {
+			auditRejected(c.auditor, inv, tx)
+		}
+		return tx, err
+	}
+}
+
+// auditRejected records an invocation that wasn't authorized. Nothing was
+// changed, so failing to record it is only logged
+func auditRejected(auditor Auditor, inv invocation.Invocation, tx transaction.Transaction[assert.Unit, ipld.Builder]) {
+	evt := claimevents.NewClaimEvent(inv)
+	entry := types.AuditEntry{
+		Operation: types.AuditPublish,
+		Actor:     inv.Issuer().DID().String(),
+		Claim:     evt.Claim,
+		Space:     evt.Space,
+		Outcome:   types.AuditRejected,
+		Time:      time.Now(),
+	}
+	result.MatchResultR0(tx.Out(), func(assert.Unit) {}, func(x ipld.Builder) {
+		if err, ok := x.(error); ok {
+			entry.Error = err.Error()
+		}
+	})
+	if err := auditor.Audit(context.Background(), entry); err != nil {
+		log.Errorw("recording rejected invocation", "invocation", inv.Link(), "error", err)
 	}
 }
@@ -0,0 +1,408 @@
+// Package deadletter keeps provider cache writes that failed in the background,
+// so they can be replayed once the cache is healthy rather than lost
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/providerresults"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+var log = logging.Logger("deadletter")
+
+// DefaultMaxAge is how long a failed write is retried for when not otherwise
+// configured
+const DefaultMaxAge = 24 * time.Hour
+
+var queuePrefix = datastore.NewKey("deadletter")
+
+type (
+	// Option configures a Queue
+	Option func(*queueConfig)
+
+	queueConfig struct {
+		minBackoff   time.Duration
+		maxBackoff   time.Duration
+		pollInterval time.Duration
+		maxAge       time.Duration
+		healthy      func(context.Context) error
+	}
+
+	// Queue durably stores provider cache writes that failed, and replays them
+	// into the provider store with exponential backoff
+	Queue struct {
+		*queueConfig
+		store   types.ProviderStore
+		entries datastore.Batching
+		seq     atomic.Uint64
+		dropped atomic.Uint64
+		closing chan struct{}
+		closed  chan struct{}
+		// closeOnce guards closing, so that Shutdown can be called more than once
+		closeOnce sync.Once
+	}
+
+	// Entry is a failed write of provider results for a multihash
+	Entry struct {
+		Key         string
+		Hash        multihash.Multihash
+		Results     []model.ProviderResult
+		Expires     bool
+		Attempts    int
+		Added       time.Time
+		NextAttempt time.Time
+	}
+
+	// Stats describes the state of the queue
+	Stats struct {
+		// Depth is the number of writes waiting to be replayed
+		Depth int
+		// Dropped is the number of writes dropped since startup for exceeding the
+		// maximum age
+		Dropped uint64
+	}
+
+	storedEntry struct {
+		Hash        []byte    `json:"hash"`
+		Results     []byte    `json:"results"`
+		Expires     bool      `json:"expires"`
+		Attempts    int       `json:"attempts"`
+		Added       time.Time `json:"added"`
+		NextAttempt time.Time `json:"nextAttempt"`
+	}
+)
+
+// WithRetryBackoff sets the minimum and maximum delay between replays of a
+// single write
+func WithRetryBackoff(min, max time.Duration) Option {
+	return func(c *queueConfig) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// WithPollInterval sets how often the queue is checked for writes due for replay
+func WithPollInterval(interval time.Duration) Option {
+	return func(c *queueConfig) {
+		c.pollInterval = interval
+	}
+}
+
+// WithMaxAge sets how long a write is retried for before it is dropped
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(c *queueConfig) {
+		c.maxAge = maxAge
+	}
+}
+
+// WithHealthCheck sets a check run before replaying writes. While it errors,
+// writes are not replayed and keep their place in the queue
+func WithHealthCheck(healthy func(context.Context) error) Option {
+	return func(c *queueConfig) {
+		c.healthy = healthy
+	}
+}
+
+// NewQueue returns a dead letter queue replaying into the given provider store,
+// using the given datastore to hold failed writes
+func NewQueue(store types.ProviderStore, ds datastore.Batching, opts ...Option) (*Queue, error) {
+	c := &queueConfig{
+		minBackoff:   time.Second,
+		maxBackoff:   5 * time.Minute,
+		pollInterval: 30 * time.Second,
+		maxAge:       DefaultMaxAge,
+		healthy:      func(context.Context) error { return nil },
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	entries := namespace.Wrap(ds, queuePrefix)
+	seq, err := lastSequence(entries)
+	if err != nil {
+		return nil, fmt.Errorf("reading dead letter queue: %w", err)
+	}
+	q := &Queue{
+		queueConfig: c,
+		store:       store,
+		entries:     entries,
+		closing:     make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+	q.seq.Store(seq)
+	return q, nil
+}
+
+// Add durably records a failed write of results for a multihash. The write is
+// first replayed after the minimum backoff
+func (q *Queue) Add(ctx context.Context, hash multihash.Multihash, results []model.ProviderResult, expires bool) error {
+	now := time.Now()
+	entry, err := encodeEntry(Entry{
+		Hash:        hash,
+		Results:     results,
+		Expires:     expires,
+		Added:       now,
+		NextAttempt: now.Add(q.minBackoff),
+	})
+	if err != nil {
+		return fmt.Errorf("encoding dead letter entry: %w", err)
+	}
+	if err := q.entries.Put(ctx, entryKey(q.seq.Add(1)), entry); err != nil {
+		return fmt.Errorf("writing dead letter queue: %w", err)
+	}
+	return nil
+}
+
+// Entries returns the writes waiting to be replayed, oldest first
+func (q *Queue) Entries(ctx context.Context) ([]Entry, error) {
+	results, err := q.entries.Query(ctx, query.Query{Orders: []query.Order{query.OrderByKey{}}})
+	if err != nil {
+		return nil, err
+	}
+	stored, err := results.Rest()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(stored))
+	for _, result := range stored {
+		entry, err := decodeEntry(result)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Purge removes every write from the queue, returning the number removed
+func (q *Queue) Purge(ctx context.Context) (int, error) {
+	keys, err := q.keys(ctx)
+	if err != nil {
+		return 0, err
+	}
+	batch, err := q.entries.Batch(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		if err := batch.Delete(ctx, datastore.NewKey(key)); err != nil {
+			return 0, err
+		}
+	}
+	if err := batch.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("purging dead letter queue: %w", err)
+	}
+	return len(keys), nil
+}
+
+// Stats returns the current depth of the queue and the number of writes dropped
+func (q *Queue) Stats(ctx context.Context) (Stats, error) {
+	keys, err := q.keys(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+	return Stats{Depth: len(keys), Dropped: q.dropped.Load()}, nil
+}
+
+// Startup starts replaying writes in the background (returns immediately)
+func (q *Queue) Startup() {
+	go q.run()
+}
+
+// Shutdown stops replaying, returning when the replayer stops or the passed
+// context cancels. Writes not yet replayed remain in the queue. It is safe to
+// call more than once
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.closeOnce.Do(func() { close(q.closing) })
+	select {
+	case <-q.closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *Queue) run() {
+	defer close(q.closed)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-q.closing
+		cancel()
+	}()
+	timer := time.NewTimer(q.pollInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-q.closing:
+			return
+		case <-timer.C:
+		}
+		if err := q.replayDue(ctx); err != nil && ctx.Err() == nil {
+			log.Errorw("replaying failed cache writes", "error", err)
+		}
+		timer.Reset(q.pollInterval)
+	}
+}
+
+// replayDue drops writes older than the maximum age, then replays every write
+// that is due if the cache is healthy
+func (q *Queue) replayDue(ctx context.Context) error {
+	entries, err := q.Entries(ctx)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	healthErr := q.healthy(ctx)
+	if healthErr != nil {
+		log.Debugw("cache unhealthy, holding failed writes", "error", healthErr)
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		key := datastore.NewKey(entry.Key)
+		if now.Sub(entry.Added) > q.maxAge {
+			log.Warnw("dropping failed cache write", "hash", entry.Hash, "added", entry.Added, "attempts", entry.Attempts)
+			if err := q.entries.Delete(ctx, key); err != nil {
+				return err
+			}
+			q.dropped.Add(1)
+			continue
+		}
+		if healthErr != nil || entry.NextAttempt.After(now) {
+			continue
+		}
+		if err := q.replay(ctx, entry); err != nil {
+			log.Warnw("replaying failed cache write", "hash", entry.Hash, "attempts", entry.Attempts+1, "error", err)
+			entry.Attempts++
+			entry.NextAttempt = now.Add(q.backoff(entry.Attempts))
+			data, err := encodeEntry(entry)
+			if err != nil {
+				return err
+			}
+			if err := q.entries.Put(ctx, key, data); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := q.entries.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replay writes the results of an entry, merged with any results stored for the
+// multihash since the write failed
+func (q *Queue) replay(ctx context.Context, entry Entry) error {
+	existing, err := types.GetForWrite(ctx, q.store, entry.Hash)
+	if err != nil && !errors.Is(err, types.ErrKeyNotFound) {
+		return err
+	}
+	merged := existing
+	for _, result := range entry.Results {
+		if !slices.ContainsFunc(merged, func(r model.ProviderResult) bool { return providerresults.Equals(r, result) }) {
+			merged = append(merged, result)
+		}
+	}
+	return q.store.Set(ctx, entry.Hash, merged, entry.Expires)
+}
+
+func (q *Queue) backoff(attempts int) time.Duration {
+	backoff := q.minBackoff
+	for i := 1; i < attempts && backoff < q.maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, q.maxBackoff)
+}
+
+func (q *Queue) keys(ctx context.Context) ([]string, error) {
+	results, err := q.entries.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	stored, err := results.Rest()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(stored))
+	for _, result := range stored {
+		keys = append(keys, result.Key)
+	}
+	return keys, nil
+}
+
+func decodeEntry(result query.Entry) (Entry, error) {
+	var stored storedEntry
+	if err := json.Unmarshal(result.Value, &stored); err != nil {
+		return Entry{}, fmt.Errorf("decoding dead letter entry %s: %w", result.Key, err)
+	}
+	results, err := providerresults.UnmarshalCBOR(stored.Results)
+	if err != nil {
+		return Entry{}, fmt.Errorf("decoding dead letter entry %s: %w", result.Key, err)
+	}
+	return Entry{
+		Key:         result.Key,
+		Hash:        stored.Hash,
+		Results:     results,
+		Expires:     stored.Expires,
+		Attempts:    stored.Attempts,
+		Added:       stored.Added,
+		NextAttempt: stored.NextAttempt,
+	}, nil
+}
+
+func encodeEntry(entry Entry) ([]byte, error) {
+	data, err := providerresults.MarshalCBOR(entry.Results)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(storedEntry{
+		Hash:        entry.Hash,
+		Results:     data,
+		Expires:     entry.Expires,
+		Attempts:    entry.Attempts,
+		Added:       entry.Added,
+		NextAttempt: entry.NextAttempt,
+	})
+}
+
+func entryKey(seq uint64) datastore.Key {
+	return datastore.NewKey(fmt.Sprintf("%020d", seq))
+}
+
+func lastSequence(entries datastore.Batching) (uint64, error) {
+	results, err := entries.Query(context.Background(), query.Query{
+		KeysOnly: true,
+		Orders:   []query.Order{query.OrderByKeyDescending{}},
+		Limit:    1,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer results.Close()
+	result, ok := results.NextSync()
+	if !ok {
+		return 0, nil
+	}
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return strconv.ParseUint(strings.TrimPrefix(result.Key, "/"), 10, 64)
+}
@@ -0,0 +1,187 @@
+package deadletter_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/deadletter"
+	"github.com/storacha/indexing-service/pkg/service/providercacher"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+var errUnavailable = errors.New("cache unavailable")
+
+type failingProviderStore struct {
+	lk      sync.Mutex
+	failing bool
+	sets    int
+	data    map[string][]model.ProviderResult
+}
+
+func newFailingProviderStore() *failingProviderStore {
+	return &failingProviderStore{failing: true, data: map[string][]model.ProviderResult{}}
+}
+
+func (m *failingProviderStore) heal() {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.failing = false
+}
+
+func (m *failingProviderStore) healthy(ctx context.Context) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if m.failing {
+		return errUnavailable
+	}
+	return nil
+}
+
+func (m *failingProviderStore) setCount() int {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.sets
+}
+
+func (m *failingProviderStore) Get(ctx context.Context, hash multihash.Multihash) ([]model.ProviderResult, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	results, ok := m.data[string(hash)]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return results, nil
+}
+
+func (m *failingProviderStore) Set(ctx context.Context, hash multihash.Multihash, results []model.ProviderResult, expires bool) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.sets++
+	if m.failing {
+		return errUnavailable
+	}
+	m.data[string(hash)] = results
+	return nil
+}
+
+func (m *failingProviderStore) SetExpirable(ctx context.Context, hash multihash.Multihash, expires bool) error {
+	return nil
+}
+
+var _ types.ProviderStore = (*failingProviderStore)(nil)
+
+func depth(t *testing.T, q *deadletter.Queue) int {
+	return testutil.Must(q.Stats(context.Background()))(t).Depth
+}
+
+func TestQueue(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("replays failed provider caching once the cache heals", func(t *testing.T) {
+		store := newFailingProviderStore()
+		q := testutil.Must(deadletter.NewQueue(store, dssync.MutexWrap(datastore.NewMapDatastore()),
+			deadletter.WithRetryBackoff(time.Millisecond, 10*time.Millisecond),
+			deadletter.WithPollInterval(5*time.Millisecond),
+			deadletter.WithHealthCheck(store.healthy),
+		))(t)
+		cacher := providercacher.NewSimpleProviderCacher(store, providercacher.WithDeadLetters(q))
+
+		provider := testutil.RandomProviderResult()
+		index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), -1)
+		shard := testutil.RandomMultihash()
+		slices := testutil.RandomMultihashes(3)
+		for _, slice := range slices {
+			index.SetSlice(shard, slice, blobindex.Position{})
+		}
+
+		written := testutil.Must(cacher.CacheProviderForIndexRecords(ctx, provider, index))(t)
+		require.Zero(t, written)
+		entries := testutil.Must(q.Entries(ctx))(t)
+		require.Len(t, entries, 3)
+		for _, entry := range entries {
+			require.Contains(t, slices, entry.Hash)
+			require.Equal(t, []model.ProviderResult{provider}, entry.Results)
+			require.True(t, entry.Expires)
+		}
+
+		q.Startup()
+		defer q.Shutdown(ctx)
+
+		// nothing is replayed while the cache is unhealthy
+		sets := store.setCount()
+		time.Sleep(50 * time.Millisecond)
+		require.Equal(t, sets, store.setCount())
+		require.Equal(t, 3, depth(t, q))
+
+		store.heal()
+		require.Eventually(t, func() bool { return depth(t, q) == 0 }, time.Second, 5*time.Millisecond)
+		for _, slice := range slices {
+			require.Equal(t, []model.ProviderResult{provider}, testutil.Must(store.Get(ctx, slice))(t))
+		}
+	})
+
+	t.Run("merges replayed results with results written since", func(t *testing.T) {
+		store := newFailingProviderStore()
+		q := testutil.Must(deadletter.NewQueue(store, dssync.MutexWrap(datastore.NewMapDatastore()),
+			deadletter.WithRetryBackoff(time.Millisecond, time.Millisecond),
+			deadletter.WithPollInterval(5*time.Millisecond),
+		))(t)
+		hash := testutil.RandomMultihash()
+		failed, written := testutil.RandomProviderResult(), testutil.RandomProviderResult()
+		require.NoError(t, q.Add(ctx, hash, []model.ProviderResult{failed}, true))
+		store.heal()
+		require.NoError(t, store.Set(ctx, hash, []model.ProviderResult{written}, true))
+
+		q.Startup()
+		defer q.Shutdown(ctx)
+		require.Eventually(t, func() bool { return depth(t, q) == 0 }, time.Second, 5*time.Millisecond)
+		require.Equal(t, []model.ProviderResult{written, failed}, testutil.Must(store.Get(ctx, hash))(t))
+	})
+
+	t.Run("drops writes older than the maximum age", func(t *testing.T) {
+		store := newFailingProviderStore()
+		q := testutil.Must(deadletter.NewQueue(store, dssync.MutexWrap(datastore.NewMapDatastore()),
+			deadletter.WithMaxAge(time.Millisecond),
+			deadletter.WithPollInterval(5*time.Millisecond),
+		))(t)
+		require.NoError(t, q.Add(ctx, testutil.RandomMultihash(), []model.ProviderResult{testutil.RandomProviderResult()}, false))
+
+		q.Startup()
+		defer q.Shutdown(ctx)
+		require.Eventually(t, func() bool {
+			stats := testutil.Must(q.Stats(ctx))(t)
+			return stats.Depth == 0 && stats.Dropped == 1
+		}, time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("shuts down more than once", func(t *testing.T) {
+		q := testutil.Must(deadletter.NewQueue(newFailingProviderStore(), dssync.MutexWrap(datastore.NewMapDatastore())))(t)
+		q.Startup()
+		require.NoError(t, q.Shutdown(ctx))
+		require.NoError(t, q.Shutdown(ctx))
+	})
+
+	t.Run("keeps writes across restarts and purges them", func(t *testing.T) {
+		store := newFailingProviderStore()
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		q := testutil.Must(deadletter.NewQueue(store, ds))(t)
+		require.NoError(t, q.Add(ctx, testutil.RandomMultihash(), []model.ProviderResult{testutil.RandomProviderResult()}, false))
+
+		restarted := testutil.Must(deadletter.NewQueue(store, ds))(t)
+		require.NoError(t, restarted.Add(ctx, testutil.RandomMultihash(), []model.ProviderResult{testutil.RandomProviderResult()}, false))
+		require.Equal(t, 2, depth(t, restarted))
+
+		require.Equal(t, 2, testutil.Must(restarted.Purge(ctx))(t))
+		require.Zero(t, depth(t, restarted))
+	})
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// shardSummaryCacheSize is the number of index and multihash pairs whose
+// containing shards are remembered
+const shardSummaryCacheSize = 4096
+
+// known are the claims and indexes a query already holds
+type known struct {
+	claims  map[cid.Cid]struct{}
+	indexes map[string]struct{}
+}
+
+func newKnown(q *Query) *known {
+	k := &known{
+		claims:  make(map[cid.Cid]struct{}, len(q.KnownClaims)),
+		indexes: make(map[string]struct{}, len(q.KnownIndexes)),
+	}
+	for _, c := range q.KnownClaims {
+		k.claims[c] = struct{}{}
+	}
+	for _, contextID := range q.KnownIndexes {
+		k.indexes[string(contextID)] = struct{}{}
+	}
+	return k
+}
+
+func (k *known) claim(c cid.Cid) bool {
+	_, ok := k.claims[c]
+	return ok
+}
+
+func (k *known) index(contextID types.EncodedContextID) bool {
+	_, ok := k.indexes[string(contextID)]
+	return ok
+}
+
+// shardSummaries remembers which shards of an index contain a multihash, so
+// that shards can be followed for a known index without fetching it again
+type shardSummaries struct {
+	cache *lru.Cache[string, []multihash.Multihash]
+}
+
+func newShardSummaries(size int) *shardSummaries {
+	cache, err := lru.New[string, []multihash.Multihash](size)
+	if err != nil {
+		panic(err)
+	}
+	return &shardSummaries{cache: cache}
+}
+
+func shardSummaryKey(contextID types.EncodedContextID, hash multihash.Multihash) string {
+	return string(contextID) + string(hash)
+}
+
+func (s *shardSummaries) get(contextID types.EncodedContextID, hash multihash.Multihash) ([]multihash.Multihash, bool) {
+	return s.cache.Get(shardSummaryKey(contextID, hash))
+}
+
+func (s *shardSummaries) put(contextID types.EncodedContextID, hash multihash.Multihash, shards []multihash.Multihash) {
+	s.cache.Add(shardSummaryKey(contextID, hash), shards)
+}
@@ -0,0 +1,109 @@
+package service_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+type countingClaimLookup struct {
+	service.ClaimLookup
+	lk      sync.Mutex
+	lookups []cid.Cid
+}
+
+func (c *countingClaimLookup) LookupClaim(ctx context.Context, claimCid cid.Cid, fetchURL url.URL) (delegation.Delegation, error) {
+	c.lk.Lock()
+	c.lookups = append(c.lookups, claimCid)
+	c.lk.Unlock()
+	return c.ClaimLookup.LookupClaim(ctx, claimCid, fetchURL)
+}
+
+func TestIndexingService__KnownClaims(t *testing.T) {
+	f := newClaimFixture(t)
+
+	// two hashes are in different shards of the same index, which has an index
+	// claim published for both of them
+	contentHash, otherHash := testutil.RandomMultihash(), testutil.RandomMultihash()
+	shardHash, otherShardHash := testutil.RandomMultihash(), testutil.RandomMultihash()
+	indexCid := testutil.RandomCID().(cidlink.Link).Cid
+	index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 2)
+	index.SetSlice(shardHash, contentHash, blobindex.Position{Offset: 0, Length: 10})
+	index.SetSlice(otherShardHash, otherHash, blobindex.Position{Offset: 0, Length: 10})
+	indexClaim, indexLocation := f.newClaim(t), f.newClaim(t)
+	shardLocation, otherShardLocation := f.newClaim(t), f.newClaim(t)
+	indexResult := f.result(t, testutil.RandomBytes(10), &metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaim})
+	results := map[string][]model.ProviderResult{
+		string(contentHash):     {indexResult},
+		string(otherHash):       {indexResult},
+		string(indexCid.Hash()): {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: indexLocation})},
+		string(shardHash):       {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: shardLocation})},
+		string(otherShardHash):  {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: otherShardLocation})},
+	}
+
+	indexFetches := 0
+	claimLookup := &countingClaimLookup{ClaimLookup: claimlookup.NewClaimLookup(http.DefaultClient)}
+	providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: results, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+	is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{index: index, cache: func() { indexFetches++ }}, claimLookup, providerIndex))(t)
+
+	query := func(q service.Query) (claims []cid.Cid, confirmed []cid.Cid, contextIDs []types.EncodedContextID) {
+		qr := testutil.Must(is.Query(context.Background(), q))(t)
+		parts, indexes := testutil.Must2(queryresult.Parts(qr))(t)
+		for claimCid := range parts {
+			claims = append(claims, claimCid)
+		}
+		for _, link := range qr.Confirmed() {
+			confirmed = append(confirmed, link.(cidlink.Link).Cid)
+		}
+		for contextID := range indexes.Iterator() {
+			contextIDs = append(contextIDs, contextID)
+		}
+		return claims, confirmed, contextIDs
+	}
+
+	claims, confirmed, contextIDs := query(service.Query{Hashes: []multihash.Multihash{contentHash}})
+	require.ElementsMatch(t, []cid.Cid{indexClaim, indexLocation, shardLocation}, claims)
+	require.Empty(t, confirmed)
+	require.Len(t, contextIDs, 1)
+	require.Equal(t, 1, indexFetches)
+
+	// querying again with what the first query returned, along with a new hash,
+	// returns only the newly discovered location. The known index is fetched for
+	// the new hash, but not returned
+	claimLookup.lookups = nil
+	known := service.Query{
+		Hashes:       []multihash.Multihash{contentHash, otherHash},
+		KnownClaims:  claims,
+		KnownIndexes: contextIDs,
+	}
+	claims, confirmed, contextIDs = query(known)
+	require.Equal(t, []cid.Cid{otherShardLocation}, claims)
+	require.ElementsMatch(t, []cid.Cid{indexClaim, indexLocation, shardLocation}, confirmed)
+	require.Empty(t, contextIDs)
+	require.Equal(t, []cid.Cid{otherShardLocation}, claimLookup.lookups)
+	require.Equal(t, 2, indexFetches)
+
+	// once both are known, the shards are followed without fetching the index
+	known.KnownClaims = append(known.KnownClaims, otherShardLocation)
+	claims, confirmed, _ = query(known)
+	require.Empty(t, claims)
+	require.ElementsMatch(t, []cid.Cid{indexClaim, indexLocation, shardLocation, otherShardLocation}, confirmed)
+	require.Equal(t, 2, indexFetches)
+}
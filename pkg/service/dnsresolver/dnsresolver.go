@@ -0,0 +1,96 @@
+// Package dnsresolver resolves the host names and dnsaddr records of provider
+// addresses, either with the system resolver or over DNS-over-HTTPS
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Resolver looks up the IP addresses of hosts and the TXT records of names.
+// *net.Resolver implements it, and is the system resolver
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+var _ Resolver = net.DefaultResolver
+
+// maxDNSAddrDepth bounds how many dnsaddr records are followed from a single
+// address, so records that refer to each other can't recurse forever
+const maxDNSAddrDepth = 4
+
+const dnsaddrPrefix = "dnsaddr="
+
+// ErrDNSAddrDepth is returned for dnsaddr records nested too deeply to follow
+var ErrDNSAddrDepth = errors.New("dnsaddr records nested too deeply")
+
+// ResolveAddrs replaces each /dnsaddr address with the addresses listed in the
+// TXT records of its name, following dnsaddr records that list further
+// dnsaddr addresses. Other addresses, including /dns4 and /dns6 ones whose
+// names are resolved when connecting, are returned as they are. Addresses
+// that fail to resolve are left out, and their errors returned alongside the
+// addresses that did resolve
+func ResolveAddrs(ctx context.Context, r Resolver, addrs []multiaddr.Multiaddr) ([]multiaddr.Multiaddr, error) {
+	var resolved []multiaddr.Multiaddr
+	var errs []error
+	for _, addr := range addrs {
+		expanded, err := resolveAddr(ctx, r, addr, 0)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("resolving %s: %w", addr, err))
+		}
+		resolved = append(resolved, expanded...)
+	}
+	return resolved, errors.Join(errs...)
+}
+
+func resolveAddr(ctx context.Context, r Resolver, addr multiaddr.Multiaddr, depth int) ([]multiaddr.Multiaddr, error) {
+	first, rest := multiaddr.SplitFirst(addr)
+	if first == nil || first.Protocol().Code != multiaddr.P_DNSADDR {
+		return []multiaddr.Multiaddr{addr}, nil
+	}
+	if depth >= maxDNSAddrDepth {
+		return nil, ErrDNSAddrDepth
+	}
+	records, err := r.LookupTXT(ctx, "_dnsaddr."+first.Value())
+	if err != nil {
+		return nil, err
+	}
+	var resolved []multiaddr.Multiaddr
+	var errs []error
+	for _, record := range records {
+		if !strings.HasPrefix(record, dnsaddrPrefix) {
+			continue
+		}
+		listed, err := multiaddr.NewMultiaddr(strings.TrimPrefix(record, dnsaddrPrefix))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// an address with components after the name, such as a peer ID, only
+		// matches records ending with the same components
+		if rest != nil && !hasSuffix(listed, rest) {
+			continue
+		}
+		expanded, err := resolveAddr(ctx, r, listed, depth+1)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		resolved = append(resolved, expanded...)
+	}
+	if len(resolved) == 0 && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return resolved, nil
+}
+
+func hasSuffix(addr, suffix multiaddr.Multiaddr) bool {
+	a, s := addr.Bytes(), suffix.Bytes()
+	return len(a) >= len(s) && string(a[len(a)-len(s):]) == string(s)
+}
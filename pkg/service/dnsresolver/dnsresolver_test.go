@@ -0,0 +1,222 @@
+package dnsresolver_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-multiaddr"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/dnsresolver"
+	"github.com/stretchr/testify/require"
+)
+
+type record struct {
+	Name string `json:"name"`
+	Type int    `json:"type"`
+	TTL  int    `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type response struct {
+	Status    int      `json:"Status"`
+	Answer    []record `json:"Answer,omitempty"`
+	Authority []record `json:"Authority,omitempty"`
+}
+
+// fakeDoH answers questions from a script of responses keyed by name and type,
+// counting the questions asked
+type fakeDoH struct {
+	lk        sync.Mutex
+	responses map[string]response
+	asked     map[string]int
+}
+
+func newFakeDoH(t *testing.T, responses map[string]response) (*fakeDoH, string) {
+	f := &fakeDoH{responses: responses, asked: map[string]int{}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/dns-json", r.Header.Get("Accept"))
+		key := r.URL.Query().Get("name") + "/" + r.URL.Query().Get("type")
+		f.lk.Lock()
+		f.asked[key]++
+		resp, ok := f.responses[key]
+		f.lk.Unlock()
+		if !ok {
+			resp = response{Status: 3}
+		}
+		w.Header().Set("Content-Type", "application/dns-json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+	return f, server.URL + "/dns-query"
+}
+
+func (f *fakeDoH) count(name string, rtype int) int {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	return f.asked[name+"/"+strconv.Itoa(rtype)]
+}
+
+type mockMetrics struct {
+	lk       sync.Mutex
+	lookups  int
+	failures int
+}
+
+func (m *mockMetrics) Resolved(recordType string, duration time.Duration, err error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.lookups++
+	if err != nil {
+		m.failures++
+	}
+}
+
+const (
+	typeA     = 1
+	typeCNAME = 5
+	typeSOA   = 6
+	typeTXT   = 16
+	typeAAAA  = 28
+)
+
+func TestDoH(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	clock := func() time.Time { return now }
+	soa := record{Name: "example.com", Type: typeSOA, TTL: 300, Data: "ns.example.com. admin.example.com. 1 7200 3600 1209600 60"}
+	fake, endpoint := newFakeDoH(t, map[string]response{
+		"host.example.com/1":  {Answer: []record{{Name: "host.example.com.", Type: typeA, TTL: 60, Data: "203.0.113.1"}}},
+		"host.example.com/28": {Status: 0, Authority: []record{soa}},
+		// an alias whose answer includes the target's records
+		"www.example.com/1": {Answer: []record{
+			{Name: "www.example.com.", Type: typeCNAME, TTL: 30, Data: "edge.example.net."},
+			{Name: "edge.example.net.", Type: typeA, TTL: 120, Data: "203.0.113.2"},
+		}},
+		// an alias chain whose answer stops at the first alias
+		"cdn.example.com/1":    {Answer: []record{{Name: "cdn.example.com.", Type: typeCNAME, TTL: 30, Data: "a.example.net."}}},
+		"a.example.net/1":      {Answer: []record{{Name: "a.example.net.", Type: typeCNAME, TTL: 30, Data: "b.example.net."}}},
+		"b.example.net/1":      {Answer: []record{{Name: "b.example.net.", Type: typeA, TTL: 30, Data: "203.0.113.3"}}},
+		"loop.example.com/1":   {Answer: []record{{Name: "loop.example.com.", Type: typeCNAME, TTL: 30, Data: "loop.example.com."}}},
+		"gone.example.com/1":   {Status: 3, Authority: []record{soa}},
+		"gone.example.com/28":  {Status: 3, Authority: []record{soa}},
+		"broken.example.com/1": {Status: 2},
+		"_dnsaddr.example.com/16": {Answer: []record{
+			{Name: "_dnsaddr.example.com.", Type: typeTXT, TTL: 60, Data: `"dnsaddr=/dns4/host.example.com/tcp/443/https"`},
+		}},
+	})
+	metrics := &mockMetrics{}
+	resolver := testutil.Must(dnsresolver.NewDoH(endpoint, dnsresolver.WithClock(clock), dnsresolver.WithMetrics(metrics)))(t)
+
+	t.Run("addresses are cached for their TTL", func(t *testing.T) {
+		ips := testutil.Must(resolver.LookupNetIP(ctx, "ip", "host.example.com"))(t)
+		require.Equal(t, []netip.Addr{netip.MustParseAddr("203.0.113.1")}, ips)
+		testutil.Must(resolver.LookupNetIP(ctx, "ip4", "HOST.example.com."))(t)
+		require.Equal(t, 1, fake.count("host.example.com", typeA))
+
+		now = now.Add(61 * time.Second)
+		testutil.Must(resolver.LookupNetIP(ctx, "ip4", "host.example.com"))(t)
+		require.Equal(t, 2, fake.count("host.example.com", typeA))
+	})
+
+	t.Run("aliases", func(t *testing.T) {
+		ips := testutil.Must(resolver.LookupNetIP(ctx, "ip4", "www.example.com"))(t)
+		require.Equal(t, []netip.Addr{netip.MustParseAddr("203.0.113.2")}, ips)
+		ips = testutil.Must(resolver.LookupNetIP(ctx, "ip4", "cdn.example.com"))(t)
+		require.Equal(t, []netip.Addr{netip.MustParseAddr("203.0.113.3")}, ips)
+		testutil.Must(resolver.LookupNetIP(ctx, "ip4", "cdn.example.com"))(t)
+		require.Equal(t, 1, fake.count("b.example.net", typeA))
+
+		_, err := resolver.LookupNetIP(ctx, "ip4", "loop.example.com")
+		require.Error(t, err)
+	})
+
+	t.Run("names that don't exist are cached for the SOA minimum", func(t *testing.T) {
+		_, err := resolver.LookupNetIP(ctx, "ip", "gone.example.com")
+		var dnsErr *net.DNSError
+		require.ErrorAs(t, err, &dnsErr)
+		require.True(t, dnsErr.IsNotFound)
+		_, err = resolver.LookupNetIP(ctx, "ip", "gone.example.com")
+		require.Error(t, err)
+		require.Equal(t, 1, fake.count("gone.example.com", typeA))
+
+		now = now.Add(61 * time.Second)
+		_, err = resolver.LookupNetIP(ctx, "ip", "gone.example.com")
+		require.Error(t, err)
+		require.Equal(t, 2, fake.count("gone.example.com", typeA))
+	})
+
+	t.Run("server failures are not cached", func(t *testing.T) {
+		failures := metrics.failures
+		for range 2 {
+			_, err := resolver.LookupNetIP(ctx, "ip4", "broken.example.com")
+			require.Error(t, err)
+		}
+		require.Equal(t, 2, fake.count("broken.example.com", typeA))
+		require.Equal(t, failures+2, metrics.failures)
+	})
+
+	t.Run("TXT records are unquoted", func(t *testing.T) {
+		records := testutil.Must(resolver.LookupTXT(ctx, "_dnsaddr.example.com"))(t)
+		require.Equal(t, []string{"dnsaddr=/dns4/host.example.com/tcp/443/https"}, records)
+	})
+}
+
+func TestResolveAddrs(t *testing.T) {
+	ctx := context.Background()
+	peerA, peerB := testutil.RandomPeer(), testutil.RandomPeer()
+	txt := func(name string, values ...string) response {
+		var answer []record
+		for _, v := range values {
+			answer = append(answer, record{Name: name + ".", Type: typeTXT, TTL: 60, Data: strconv.Quote(v)})
+		}
+		return response{Answer: answer}
+	}
+	_, endpoint := newFakeDoH(t, map[string]response{
+		"_dnsaddr.example.com/16": txt("_dnsaddr.example.com",
+			"dnsaddr=/dnsaddr/a.example.com",
+			"dnsaddr=/dns4/b.example.com/tcp/443/https/p2p/"+peerB.String(),
+			"not a dnsaddr record",
+		),
+		"_dnsaddr.a.example.com/16": txt("_dnsaddr.a.example.com",
+			"dnsaddr=/dns4/a.example.com/tcp/443/https/p2p/"+peerA.String(),
+		),
+		"_dnsaddr.loop.example.com/16": txt("_dnsaddr.loop.example.com", "dnsaddr=/dnsaddr/loop.example.com"),
+	})
+	resolver := testutil.Must(dnsresolver.NewDoH(endpoint))(t)
+	ma := func(s string) multiaddr.Multiaddr {
+		return testutil.Must(multiaddr.NewMultiaddr(s))(t)
+	}
+
+	t.Run("recursive records", func(t *testing.T) {
+		addrs, err := dnsresolver.ResolveAddrs(ctx, resolver, []multiaddr.Multiaddr{ma("/dnsaddr/example.com"), ma("/ip4/203.0.113.1/tcp/80/http")})
+		require.NoError(t, err)
+		require.Equal(t, []multiaddr.Multiaddr{
+			ma("/dns4/a.example.com/tcp/443/https/p2p/" + peerA.String()),
+			ma("/dns4/b.example.com/tcp/443/https/p2p/" + peerB.String()),
+			ma("/ip4/203.0.113.1/tcp/80/http"),
+		}, addrs)
+	})
+
+	t.Run("records matching a peer", func(t *testing.T) {
+		addrs, err := dnsresolver.ResolveAddrs(ctx, resolver, []multiaddr.Multiaddr{ma("/dnsaddr/example.com/p2p/" + peerB.String())})
+		require.NoError(t, err)
+		require.Equal(t, []multiaddr.Multiaddr{ma("/dns4/b.example.com/tcp/443/https/p2p/" + peerB.String())}, addrs)
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		addrs, err := dnsresolver.ResolveAddrs(ctx, resolver, []multiaddr.Multiaddr{ma("/dnsaddr/loop.example.com"), ma("/dnsaddr/unknown.example.com"), ma("/dns4/host.example.com/tcp/80/http")})
+		require.ErrorIs(t, err, dnsresolver.ErrDNSAddrDepth)
+		var dnsErr *net.DNSError
+		require.ErrorAs(t, err, &dnsErr)
+		require.True(t, dnsErr.IsNotFound)
+		require.Equal(t, []multiaddr.Multiaddr{ma("/dns4/host.example.com/tcp/80/http")}, addrs)
+	})
+}
@@ -0,0 +1,391 @@
+package dnsresolver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+const (
+	// DefaultNegativeTTL is how long a name that doesn't exist, or has no
+	// records of a type, is remembered when the answer doesn't say
+	DefaultNegativeTTL = 30 * time.Second
+	// DefaultCacheSize is the number of answers remembered by a DoH resolver
+	DefaultCacheSize = 4096
+	// maxCNAMEDepth bounds how many CNAME records are followed for a name
+	maxCNAMEDepth = 8
+)
+
+// DNS record types and response codes, as numbered in answers
+const (
+	typeA     = 1
+	typeCNAME = 5
+	typeSOA   = 6
+	typeTXT   = 16
+	typeAAAA  = 28
+
+	rcodeSuccess  = 0
+	rcodeNXDomain = 3
+)
+
+// Metrics is told about every lookup a DoH resolver sends
+type Metrics interface {
+	// Resolved is called after a lookup of a name is answered, or fails, with
+	// how long it took. Answers read from the cache are not lookups
+	Resolved(recordType string, duration time.Duration, err error)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) Resolved(string, time.Duration, error) {}
+
+type (
+	// DoHOption configures a DoH resolver
+	DoHOption func(*DoH)
+
+	// DoH resolves names over DNS-over-HTTPS, with the JSON API served by most
+	// public resolvers. Answers, including names that don't exist, are cached
+	// for as long as their TTLs allow
+	DoH struct {
+		endpoint    string
+		client      *http.Client
+		metrics     Metrics
+		negativeTTL time.Duration
+		cacheSize   int
+		now         func() time.Time
+		cache       *lru.Cache[question, answer]
+	}
+
+	question struct {
+		name  string
+		rtype uint16
+	}
+
+	// answer is the data of the records for a question, the name it aliases if
+	// the answer stops at a CNAME record, or the error looking it up, and when
+	// it expires
+	answer struct {
+		data    []string
+		target  string
+		err     error
+		expires time.Time
+	}
+)
+
+// WithHTTPClient sets the HTTP client the resolver queries with. It should not
+// be the address policy's client, as the resolver endpoint is usually private.
+// If not set, http.DefaultClient is used
+func WithHTTPClient(client *http.Client) DoHOption {
+	return func(d *DoH) {
+		d.client = client
+	}
+}
+
+// WithMetrics reports the latency and failures of lookups to the given metrics
+func WithMetrics(m Metrics) DoHOption {
+	return func(d *DoH) {
+		d.metrics = m
+	}
+}
+
+// WithNegativeTTL sets how long a name that doesn't exist is remembered when
+// the answer doesn't include a SOA record saying for how long. If not set,
+// DefaultNegativeTTL is used
+func WithNegativeTTL(ttl time.Duration) DoHOption {
+	return func(d *DoH) {
+		d.negativeTTL = ttl
+	}
+}
+
+// WithCacheSize sets the number of answers remembered. If not set,
+// DefaultCacheSize is used
+func WithCacheSize(size int) DoHOption {
+	return func(d *DoH) {
+		d.cacheSize = size
+	}
+}
+
+// WithClock sets the function the resolver reads the time from, for expiring
+// cached answers. If not set, time.Now is used
+func WithClock(now func() time.Time) DoHOption {
+	return func(d *DoH) {
+		d.now = now
+	}
+}
+
+// NewDoH returns a resolver that queries the given DNS-over-HTTPS endpoint,
+// such as https://cloudflare-dns.com/dns-query
+func NewDoH(endpoint string, opts ...DoHOption) (*DoH, error) {
+	if _, err := url.ParseRequestURI(endpoint); err != nil {
+		return nil, fmt.Errorf("parsing DoH endpoint: %w", err)
+	}
+	d := &DoH{
+		endpoint:    endpoint,
+		client:      http.DefaultClient,
+		metrics:     noopMetrics{},
+		negativeTTL: DefaultNegativeTTL,
+		cacheSize:   DefaultCacheSize,
+		now:         time.Now,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	cache, err := lru.New[question, answer](d.cacheSize)
+	if err != nil {
+		return nil, fmt.Errorf("creating DoH cache: %w", err)
+	}
+	d.cache = cache
+	return d, nil
+}
+
+// LookupNetIP looks up the IPv4 addresses of the host for network "ip4", the
+// IPv6 addresses for "ip6", or both for "ip"
+func (d *DoH) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	var rtypes []uint16
+	switch network {
+	case "ip":
+		rtypes = []uint16{typeA, typeAAAA}
+	case "ip4":
+		rtypes = []uint16{typeA}
+	case "ip6":
+		rtypes = []uint16{typeAAAA}
+	default:
+		return nil, fmt.Errorf("unsupported network: %s", network)
+	}
+	var ips []netip.Addr
+	var lastErr error
+	for _, rtype := range rtypes {
+		data, err := d.lookup(ctx, host, rtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, s := range data {
+			ip, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, &net.DNSError{Err: fmt.Sprintf("invalid address in answer: %s", s), Name: host}
+			}
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+// LookupTXT looks up the TXT records of the name
+func (d *DoH) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	data, err := d.lookup(ctx, name, typeTXT)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]string, 0, len(data))
+	for _, s := range data {
+		records = append(records, unquoteTXT(s))
+	}
+	return records, nil
+}
+
+// lookup returns the data of the records of the type for the name, following
+// CNAME records to the name they alias
+func (d *DoH) lookup(ctx context.Context, name string, rtype uint16) ([]string, error) {
+	for range maxCNAMEDepth {
+		data, target, err := d.cachedLookup(ctx, name, rtype)
+		if err != nil || target == "" {
+			return data, err
+		}
+		name = target
+	}
+	return nil, &net.DNSError{Err: "too many CNAME records", Name: name}
+}
+
+// cachedLookup answers a question from the cache, or by querying the endpoint.
+// If the name is an alias whose answer doesn't include the records of the
+// alias target, the target is returned to be looked up instead
+func (d *DoH) cachedLookup(ctx context.Context, name string, rtype uint16) ([]string, string, error) {
+	q := question{name: strings.ToLower(strings.TrimSuffix(name, ".")), rtype: rtype}
+	if a, ok := d.cache.Get(q); ok && d.now().Before(a.expires) {
+		return a.data, a.target, a.err
+	}
+	start := d.now()
+	a, err := d.query(ctx, q)
+	d.metrics.Resolved(typeName(rtype), d.now().Sub(start), firstErr(err, a.err))
+	if err != nil {
+		// failures to reach the endpoint are not answers, so are not cached
+		return nil, "", err
+	}
+	d.cache.Add(q, a)
+	return a.data, a.target, a.err
+}
+
+type dohResponse struct {
+	Status    int         `json:"Status"`
+	Answer    []dohRecord `json:"Answer"`
+	Authority []dohRecord `json:"Authority"`
+}
+
+type dohRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// query asks the endpoint the question. Names that don't exist, or have no
+// records of the type, are answered with an error that is cached as well
+func (d *DoH) query(ctx context.Context, q question) (answer, error) {
+	u, _ := url.Parse(d.endpoint)
+	params := u.Query()
+	params.Set("name", q.name)
+	params.Set("type", strconv.Itoa(int(q.rtype)))
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return answer{}, err
+	}
+	req.Header.Set("Accept", "application/dns-json")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return answer{}, &net.DNSError{Err: err.Error(), Name: q.name, IsTemporary: true}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return answer{}, &net.DNSError{Err: fmt.Sprintf("DoH endpoint returned %s", resp.Status), Name: q.name, IsTemporary: true}
+	}
+	var r dohResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return answer{}, &net.DNSError{Err: fmt.Sprintf("decoding DoH answer: %s", err), Name: q.name}
+	}
+
+	now := d.now()
+	switch r.Status {
+	case rcodeSuccess:
+	case rcodeNXDomain:
+		return answer{
+			err:     &net.DNSError{Err: "no such host", Name: q.name, IsNotFound: true},
+			expires: now.Add(d.negativeTTLOf(r)),
+		}, nil
+	default:
+		// server failures and refusals are not cached
+		return answer{}, &net.DNSError{Err: fmt.Sprintf("DNS response code %d", r.Status), Name: q.name, IsTemporary: true}
+	}
+
+	// follow the aliases included in the answer to the records of the type
+	name, ttl := q.name, uint32(0)
+	var data []string
+	var aliased bool
+	for range maxCNAMEDepth {
+		var next string
+		for _, rec := range r.Answer {
+			if !strings.EqualFold(strings.TrimSuffix(rec.Name, "."), name) {
+				continue
+			}
+			switch rec.Type {
+			case q.rtype:
+				data = append(data, rec.Data)
+				ttl = minTTL(ttl, rec.TTL)
+			case typeCNAME:
+				next = strings.ToLower(strings.TrimSuffix(rec.Data, "."))
+				ttl = minTTL(ttl, rec.TTL)
+			}
+		}
+		if len(data) > 0 || next == "" {
+			break
+		}
+		name, aliased = next, true
+	}
+	if len(data) == 0 {
+		if aliased {
+			// the answer stops at an alias, whose target is looked up next
+			return answer{target: name, expires: now.Add(time.Duration(ttl) * time.Second)}, nil
+		}
+		return answer{
+			err:     &net.DNSError{Err: "no such host", Name: q.name, IsNotFound: true},
+			expires: now.Add(d.negativeTTLOf(r)),
+		}, nil
+	}
+	return answer{data: data, expires: now.Add(time.Duration(ttl) * time.Second)}, nil
+}
+
+// negativeTTLOf returns how long a negative answer may be cached: the lower of
+// the TTL of the SOA record in the answer and its minimum field, per RFC 2308
+func (d *DoH) negativeTTLOf(r dohResponse) time.Duration {
+	for _, rec := range r.Authority {
+		if rec.Type != typeSOA {
+			continue
+		}
+		fields := strings.Fields(rec.Data)
+		if len(fields) != 7 {
+			continue
+		}
+		minimum, err := strconv.ParseUint(fields[6], 10, 32)
+		if err != nil {
+			continue
+		}
+		return time.Duration(min(uint64(rec.TTL), minimum)) * time.Second
+	}
+	return d.negativeTTL
+}
+
+// minTTL returns the lower of two TTLs, where zero is no TTL yet
+func minTTL(current, ttl uint32) uint32 {
+	if current == 0 || ttl < current {
+		return ttl
+	}
+	return current
+}
+
+// unquoteTXT joins the quoted strings of a TXT record, which resolvers return
+// either quoted or bare
+func unquoteTXT(s string) string {
+	if !strings.HasPrefix(s, `"`) {
+		return s
+	}
+	var b strings.Builder
+	for rest := s; rest != ""; {
+		rest = strings.TrimLeft(rest, " ")
+		prefix, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return s
+		}
+		unquoted, _ := strconv.Unquote(prefix)
+		b.WriteString(unquoted)
+		rest = rest[len(prefix):]
+	}
+	return b.String()
+}
+
+func typeName(rtype uint16) string {
+	switch rtype {
+	case typeA:
+		return "A"
+	case typeAAAA:
+		return "AAAA"
+	case typeTXT:
+		return "TXT"
+	default:
+		return strconv.Itoa(int(rtype))
+	}
+}
+
+func firstErr(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
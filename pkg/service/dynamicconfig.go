@@ -0,0 +1,219 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/storacha/indexing-service/pkg/service/identity"
+	"golang.org/x/time/rate"
+)
+
+// ErrQueryRateLimited is returned from Query when the configured query rate
+// limit has been exceeded
+var ErrQueryRateLimited = errors.New("query rate limit exceeded")
+
+// DynamicConfig holds the service settings that can be changed at runtime with
+// Reconfigure, without reconnecting storage or dropping in-flight queries. Cache
+// TTLs and trust roots aren't among them
+type DynamicConfig struct {
+	// QueryRateLimit is the maximum sustained number of queries per second. Zero
+	// means unlimited
+	QueryRateLimit float64 `json:"queryRateLimit"`
+	// QueryBurst is the number of queries allowed above the rate limit in a burst.
+	// Defaults to 1 when a rate limit is set
+	QueryBurst int `json:"queryBurst"`
+	// DeniedProviders are peer IDs or DIDs of providers whose records, and
+	// claims they issued, are ignored when handling queries. Each form also
+	// denies the other, where one resolves to the other
+	DeniedProviders []string `json:"deniedProviders"`
+	// LocationCacheWarming caches location commitments discovered while handling
+	// queries under the multihash of the shard they are for
+	LocationCacheWarming bool `json:"locationCacheWarming"`
+	// DisableShadowWrites stops copying publish-origin cache writes to the
+	// secondary of a shadow writer, if one is set
+	DisableShadowWrites bool `json:"disableShadowWrites"`
+	// ShadowReadRate is the share of queries, from 0 to 1, also run against the
+	// secondary of a shadow reader to compare results. Zero disables shadow reads
+	ShadowReadRate float64 `json:"shadowReadRate"`
+	// AnnounceRoutes decide the announce endpoints advertisements are announced
+	// to by the kinds of claims they carry. Endpoints are named by their URL.
+	// The zero value announces every advertisement to every endpoint
+	AnnounceRoutes publisher.AnnounceRoutes `json:"announceRoutes"`
+}
+
+// DefaultDynamicConfig returns the settings used when none are configured
+func DefaultDynamicConfig() DynamicConfig {
+	return DynamicConfig{
+		DeniedProviders: []string{},
+	}
+}
+
+// runtimeConfig is a validated DynamicConfig in the form read by the service
+// while handling queries
+type runtimeConfig struct {
+	DynamicConfig
+	denied     map[peer.ID]struct{}
+	deniedDIDs map[did.DID]struct{}
+	limiter    *rate.Limiter
+}
+
+func newRuntimeConfig(cfg DynamicConfig) (*runtimeConfig, error) {
+	if cfg.QueryRateLimit < 0 {
+		return nil, fmt.Errorf("invalid query rate limit: %v", cfg.QueryRateLimit)
+	}
+	if cfg.QueryBurst < 0 {
+		return nil, fmt.Errorf("invalid query burst: %d", cfg.QueryBurst)
+	}
+	if cfg.ShadowReadRate < 0 || cfg.ShadowReadRate > 1 {
+		return nil, fmt.Errorf("invalid shadow read rate: %v", cfg.ShadowReadRate)
+	}
+	if err := cfg.AnnounceRoutes.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.AnnounceRoutes = cfg.AnnounceRoutes.Clone()
+	if cfg.QueryRateLimit > 0 && cfg.QueryBurst == 0 {
+		cfg.QueryBurst = 1
+	}
+	if cfg.DeniedProviders == nil {
+		cfg.DeniedProviders = []string{}
+	}
+	cfg.DeniedProviders = slices.Clone(cfg.DeniedProviders)
+	denied := make(map[peer.ID]struct{}, len(cfg.DeniedProviders))
+	deniedDIDs := map[did.DID]struct{}{}
+	for _, p := range cfg.DeniedProviders {
+		if strings.HasPrefix(p, "did:") {
+			d, err := did.Parse(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid denied provider %q: %w", p, err)
+			}
+			deniedDIDs[d] = struct{}{}
+			if id, ok := identity.PeerFromDID(d); ok {
+				denied[id] = struct{}{}
+			}
+			continue
+		}
+		id, err := peer.Decode(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid denied provider %q: %w", p, err)
+		}
+		denied[id] = struct{}{}
+		if d, ok := identity.DIDFromPeer(id); ok {
+			deniedDIDs[d] = struct{}{}
+		}
+	}
+	rc := &runtimeConfig{DynamicConfig: cfg, denied: denied, deniedDIDs: deniedDIDs}
+	if cfg.QueryRateLimit > 0 {
+		rc.limiter = rate.NewLimiter(rate.Limit(cfg.QueryRateLimit), cfg.QueryBurst)
+	}
+	return rc, nil
+}
+
+func (rc *runtimeConfig) allowQuery() bool {
+	return rc.limiter == nil || rc.limiter.Allow()
+}
+
+// isDenied returns true if the provider is denied by its peer ID, or by the DID
+// it was observed issuing claims under
+func (rc *runtimeConfig) isDenied(provider *peer.AddrInfo, ids *identity.Mapping) bool {
+	if provider == nil {
+		return false
+	}
+	if _, ok := rc.denied[provider.ID]; ok {
+		return true
+	}
+	if len(rc.deniedDIDs) == 0 {
+		return false
+	}
+	d, ok := ids.ResolveDID(provider.ID)
+	if !ok {
+		return false
+	}
+	_, ok = rc.deniedDIDs[d]
+	return ok
+}
+
+// isIssuerDenied returns true if the issuer of a claim is denied by its DID, or
+// by the peer ID it resolves to
+func (rc *runtimeConfig) isIssuerDenied(issuer did.DID, ids *identity.Mapping) bool {
+	if _, ok := rc.deniedDIDs[issuer]; ok {
+		return true
+	}
+	if len(rc.denied) == 0 {
+		return false
+	}
+	id, ok := ids.ResolvePeer(issuer)
+	if !ok {
+		return false
+	}
+	_, ok = rc.denied[id]
+	return ok
+}
+
+// resultConfigFields are the fields, by JSON name, that change the results of
+// queries. Cached results are flushed when any of them change
+var resultConfigFields = []string{"deniedProviders"}
+
+type configChange struct {
+	field    string
+	old, new any
+}
+
+// changes lists the fields that differ between two configs, by JSON name
+func changes(prev, next DynamicConfig) []configChange {
+	var changed []configChange
+	pv, nv := reflect.ValueOf(prev), reflect.ValueOf(next)
+	for i := range pv.NumField() {
+		old, new := pv.Field(i).Interface(), nv.Field(i).Interface()
+		if !reflect.DeepEqual(old, new) {
+			changed = append(changed, configChange{pv.Type().Field(i).Tag.Get("json"), old, new})
+		}
+	}
+	return changed
+}
+
+// applyAnnounceConfig routes announcements of the advertisement chain, if the
+// service announces it
+func (is *IndexingService) applyAnnounceConfig(cfg *runtimeConfig) error {
+	if is.announcer == nil {
+		return nil
+	}
+	return is.announcer.SetRoutes(cfg.AnnounceRoutes)
+}
+
+// Config returns the effective dynamic configuration, including defaults
+func (is *IndexingService) Config() DynamicConfig {
+	cfg := is.config.Load().DynamicConfig
+	cfg.DeniedProviders = slices.Clone(cfg.DeniedProviders)
+	cfg.AnnounceRoutes = cfg.AnnounceRoutes.Clone()
+	return cfg
+}
+
+// Reconfigure validates and atomically applies new dynamic settings. Queries
+// already in progress complete with the settings they started with
+func (is *IndexingService) Reconfigure(cfg DynamicConfig) error {
+	next, err := newRuntimeConfig(cfg)
+	if err != nil {
+		return err
+	}
+	// routes naming endpoints the announcer doesn't have are only caught here
+	if err := is.applyAnnounceConfig(next); err != nil {
+		return err
+	}
+	prev := is.config.Swap(next)
+	is.applyShadowConfig(next)
+	flush := false
+	for _, change := range changes(prev.DynamicConfig, next.DynamicConfig) {
+		log.Infow("applied config change", "field", change.field, "old", change.old, "new", change.new)
+		flush = flush || slices.Contains(resultConfigFields, change.field)
+	}
+	if flush {
+		is.flushResults()
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service/expansion"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// DefaultIndexExpansionWait is how long queries wait for the expansion of an
+// index, if configured from the command line
+const DefaultIndexExpansionWait = 2 * time.Second
+
+// IndexExpansionPending is the error recorded on the reference to an index the
+// query didn't wait for the expansion of. The index is expanded in the
+// background, and found by later queries
+const IndexExpansionPending = "index expansion pending"
+
+// errExpansionPending is returned from fetching an index that is still being
+// expanded once the query stops waiting for it
+var errExpansionPending = errors.New(IndexExpansionPending)
+
+// WithIndexExpansion has indexes that aren't cached expanded by the workers of
+// the pool, rather than fetched by the query walking to them. A query waits up
+// to the wait for the expansion. If it isn't finished by then, the query goes on
+// without the index, and its reference is marked with IndexExpansionPending.
+// Zero waits for no expansion. Results left without an index are never cached
+func WithIndexExpansion(pool *expansion.Pool, wait time.Duration) Option {
+	return func(is *IndexingService) {
+		is.expansion = pool
+		is.expansionWait = wait
+	}
+}
+
+// Expansions returns the pool expanding indexes, or nil if queries fetch
+// indexes themselves
+func (is *IndexingService) Expansions() *expansion.Pool {
+	return is.expansion
+}
+
+// expandIndex returns the index at the location from the cache, or has it
+// expanded by the pool, waiting for it up to the expansion wait
+func (is *IndexingService) expandIndex(ctx context.Context, c *ClaimContext, shard cid.Cid, urls []url.URL, location *metadata.LocationCommitmentMetadata) (blobindex.ShardedDagIndexView, error) {
+	result := c.Result()
+	provider := *c.j.indexProviderRecord
+	index, err := is.blobIndexLookup.Find(types.WithCacheOnly(ctx), result.ContextID, provider, urls[0], location.Range)
+	if err == nil {
+		return index, nil
+	}
+	task := expansion.Task{
+		ContextID: result.ContextID,
+		Index:     shard,
+		Provider:  provider,
+		URLs:      urls,
+		Range:     location.Range,
+		Reason:    expansion.ReasonQuery,
+	}
+	if location.Range == nil {
+		task.Digest = shard.Hash()
+	}
+	wctx, cancel := context.WithTimeout(ctx, is.expansionWait)
+	defer cancel()
+	index, err = is.expansion.Expand(wctx, task)
+	if err != nil && ctx.Err() == nil && wctx.Err() != nil {
+		return nil, errExpansionPending
+	}
+	return index, err
+}
+
+// expandClaimedIndex returns the index of a claim being published from the
+// cache, or has it expanded by the pool. Publishing always waits for the
+// expansion
+func (is *IndexingService) expandClaimedIndex(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, shard cid.Cid, urls []url.URL, location *metadata.LocationCommitmentMetadata) (blobindex.ShardedDagIndexView, error) {
+	index, err := is.blobIndexLookup.Find(types.WithCacheOnly(ctx), contextID, provider, urls[0], location.Range)
+	if err == nil {
+		return index, nil
+	}
+	task := expansion.Task{
+		ContextID: contextID,
+		Index:     shard,
+		Provider:  provider,
+		URLs:      urls,
+		Range:     location.Range,
+		Reason:    expansion.ReasonPublish,
+	}
+	if location.Range == nil {
+		task.Digest = shard.Hash()
+	}
+	return is.expansion.Expand(ctx, task)
+}
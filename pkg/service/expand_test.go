@@ -0,0 +1,164 @@
+package service_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/blobindexlookup"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/expansion"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexingService__IndexExpansion(t *testing.T) {
+	f := newClaimFixture(t)
+	contentHash, indexCid, shardHash := testutil.RandomMultihash(), testutil.RandomCID().(cidlink.Link).Cid, testutil.RandomMultihash()
+	index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 1)
+	index.SetSlice(shardHash, contentHash, blobindex.Position{Offset: 0, Length: 10})
+	archive := testutil.Must(io.ReadAll(testutil.Must(blobindex.Archive(index))(t)))(t)
+	indexContextID := testutil.RandomBytes(10)
+	indexClaim, shardLocation := f.newClaim(t), f.newClaim(t)
+	// the provider serves claims, but not blobs
+	provider := &peer.AddrInfo{ID: f.provider.ID, Addrs: f.provider.Addrs[:1]}
+
+	newService := func(t *testing.T, delay, wait time.Duration) (*service.IndexingService, *countingServer) {
+		server := newCountingServer(t, delay, func(*http.Request) []byte { return archive })
+		indexLocation := f.addClaim(t, locationsDelegation(t, indexCid.Hash(), server.url(t, "/index")))
+		results := map[string][]model.ProviderResult{
+			string(contentHash):     {f.result(t, indexContextID, &metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaim})},
+			string(indexCid.Hash()): {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: indexLocation})},
+			string(shardHash):       {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: shardLocation})},
+		}
+		for hash, records := range results {
+			for i := range records {
+				records[i].Provider = provider
+			}
+			results[hash] = records
+		}
+		providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: results, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		blobIndexLookup := blobindexlookup.WithCache(blobindexlookup.NewBlobIndexLookup(http.DefaultClient), redis.NewShardedDagIndexStore(&memRedis{data: map[string]string{}}), noopCachingQueue{})
+		pool := testutil.Must(expansion.NewPool(dssync.MutexWrap(datastore.NewMapDatastore()), expansion.FetchWith(blobIndexLookup), expansion.WithPollInterval(5*time.Millisecond)))(t)
+		pool.Startup()
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			require.NoError(t, pool.Shutdown(ctx))
+		})
+		is := testutil.Must(service.NewIndexingService(blobIndexLookup, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex, service.WithIndexExpansion(pool, wait)))(t)
+		return is, server
+	}
+	query := func(t *testing.T, is *service.IndexingService) ([]cid.Cid, int, string) {
+		qr := testutil.Must(is.Query(context.Background(), service.Query{Hashes: []multihash.Multihash{contentHash}}))(t)
+		var claims []cid.Cid
+		for _, link := range qr.Claims() {
+			claims = append(claims, link.(cidlink.Link).Cid)
+		}
+		return claims, len(qr.Indexes()), qr.IndexRefs().Get(indexContextID).Error
+	}
+
+	t.Run("queries wait for expansions that finish in time", func(t *testing.T) {
+		is, server := newService(t, 0, 5*time.Second)
+		claims, indexes, refErr := query(t, is)
+		require.Equal(t, 1, indexes)
+		require.Empty(t, refErr)
+		// the shards of the index are followed
+		require.Contains(t, claims, shardLocation)
+		require.Equal(t, int32(1), server.requests.Load())
+		require.Empty(t, testutil.Must(is.Expansions().Jobs(context.Background()))(t))
+	})
+
+	t.Run("queries go on without expansions that don't", func(t *testing.T) {
+		is, server := newService(t, 200*time.Millisecond, 0)
+		claims, indexes, refErr := query(t, is)
+		require.Zero(t, indexes)
+		require.Equal(t, service.IndexExpansionPending, refErr)
+		require.NotContains(t, claims, shardLocation)
+
+		// the index is expanded in the background, and read from the cache once
+		// it is
+		require.Eventually(t, func() bool {
+			return len(testutil.Must(is.Expansions().Jobs(context.Background()))(t)) == 0
+		}, 5*time.Second, 5*time.Millisecond)
+		claims, indexes, refErr = query(t, is)
+		require.Equal(t, 1, indexes)
+		require.Empty(t, refErr)
+		require.Contains(t, claims, shardLocation)
+		require.Equal(t, int32(1), server.requests.Load())
+	})
+}
+
+// uncachedLookup finds no index in the cache, so every index is expanded
+type uncachedLookup struct {
+	*mockBlobIndexLookup
+}
+
+func (l uncachedLookup) Find(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, fetchURL url.URL, rng *metadata.Range) (blobindex.ShardedDagIndexView, error) {
+	if types.IsCacheOnly(ctx) {
+		return nil, types.ErrKeyNotFound
+	}
+	return l.mockBlobIndexLookup.Find(ctx, contextID, provider, fetchURL, rng)
+}
+
+func TestIndexingService__PublishIndexExpansion(t *testing.T) {
+	ctx := context.Background()
+	f := newPublishFixture(t)
+	content := testutil.RandomCID().(cidlink.Link).Cid
+	indexCid := testutil.RandomCID().(cidlink.Link).Cid
+	shard, slice := testutil.RandomMultihash(), testutil.RandomMultihash()
+	index := blobindex.NewShardedDagIndexView(cidlink.Link{Cid: content}, 1)
+	index.SetSlice(shard, slice, blobindex.Position{Offset: 0, Length: 10})
+	f.indexes.index = index
+	lookup := uncachedLookup{f.indexes}
+
+	reasons := make(chan expansion.Reason, 1)
+	fetch := expansion.FetchWith(lookup)
+	expand := func(ctx context.Context, task expansion.Task) (blobindex.ShardedDagIndexView, error) {
+		reasons <- task.Reason
+		return fetch(ctx, task)
+	}
+	pool := testutil.Must(expansion.NewPool(dssync.MutexWrap(datastore.NewMapDatastore()), expand, expansion.WithPollInterval(5*time.Millisecond)))(t)
+	pool.Startup()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		require.NoError(t, pool.Shutdown(ctx))
+	})
+	providerIndex := providerindex.NewProviderIndex(f.store, &countingFinder{results: map[string][]model.ProviderResult{}, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+	claimLookup := claimlookup.WithCache(claimlookup.NewClaimLookup(&http.Client{Transport: failingTransport{}}), f.claims)
+	// queries wait for no expansion, but publishes always wait
+	is := testutil.Must(service.NewIndexingService(lookup, claimLookup, providerIndex, service.WithClaimProvider(f.provider), service.WithClaimCache(f.claims), service.WithIndexExpansion(pool, 0)))(t)
+
+	location := locationsDelegation(t, indexCid.Hash(), testutil.Must(url.Parse("https://blobs.example/index"))(t))
+	require.NoError(t, is.CacheClaim(ctx, location))
+	require.NoError(t, is.PublishClaim(ctx, indexDelegation(t, content, indexCid)))
+	select {
+	case reason := <-reasons:
+		require.Equal(t, expansion.ReasonPublish, reason)
+	default:
+		require.Fail(t, "the index wasn't expanded by the pool")
+	}
+	require.Equal(t, []string{"https://blobs.example/index"}, f.indexes.urls)
+	for _, hash := range []multihash.Multihash{shard, slice} {
+		results, _ := f.records(t, hash)
+		require.Len(t, results, 1)
+	}
+	require.Empty(t, testutil.Must(pool.Jobs(ctx))(t))
+}
@@ -0,0 +1,623 @@
+// Package expansion expands indexes in a pool of workers consuming a durable
+// queue, so that fetching large indexes and populating the caches from them is
+// decoupled from the requests that need them
+package expansion
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service/blobindexlookup"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+var log = logging.Logger("expansion")
+
+const (
+	// DefaultWorkers is the number of workers expanding indexes when not
+	// otherwise configured
+	DefaultWorkers = 4
+	// DefaultLease is how long a worker has to expand an index before another
+	// worker may take it over, when not otherwise configured
+	DefaultLease = time.Minute
+	// DefaultMaxAttempts is the number of times an index is expanded before it
+	// is failed, when not otherwise configured
+	DefaultMaxAttempts = 5
+)
+
+var queuePrefix = datastore.NewKey("expansion")
+
+// Reason is why an index is expanded
+type Reason string
+
+const (
+	// ReasonQuery is for indexes a query walked to
+	ReasonQuery Reason = "query"
+	// ReasonPublish is for indexes of claims being published, whose publishing
+	// waits for them
+	ReasonPublish Reason = "publish"
+	// ReasonPrefetch is for indexes expanded ahead of queries for them
+	ReasonPrefetch Reason = "prefetch"
+)
+
+// State is where a job is in the queue
+type State string
+
+const (
+	// StateQueued is for jobs waiting for a worker, including those retried
+	// after failing
+	StateQueued State = "queued"
+	// StateLeased is for jobs a worker is expanding. Once the lease expires the
+	// job is taken over by another worker
+	StateLeased State = "leased"
+	// StateFailed is for jobs that failed every attempt. They are kept for
+	// inspection until the index is expanded again
+	StateFailed State = "failed"
+)
+
+// Task is an index to expand: where to fetch it from, and the provider record
+// of the claim it was found through
+type Task struct {
+	ContextID types.EncodedContextID
+	// Index is the CID of the blob the index is in
+	Index    cid.Cid
+	Provider model.ProviderResult
+	// URLs are the URLs the index can be fetched from, tried in order
+	URLs  []url.URL
+	Range *metadata.Range
+	// Digest is the digest of the blob of the index, if it is known before it is
+	// fetched
+	Digest multihash.Multihash
+	Reason Reason
+}
+
+// Job is the state of the expansion of a task in the queue
+type Job struct {
+	Task
+	Key   string
+	State State
+	// Owner is the worker holding the lease of a leased job
+	Owner        string
+	LeaseExpires time.Time
+	Attempts     int
+	Added        time.Time
+	NextAttempt  time.Time
+	// Error is why the last attempt failed, if it did
+	Error string
+}
+
+// Stats describes the state of the queue
+type Stats struct {
+	// Depth is the number of jobs waiting for a worker
+	Depth int
+	// InFlight is the number of jobs workers hold leases for
+	InFlight int
+	// Failed is the number of jobs that failed every attempt
+	Failed int
+}
+
+// ExpandFunc expands the index of a task, returning it
+type ExpandFunc func(ctx context.Context, task Task) (blobindex.ShardedDagIndexView, error)
+
+// Option configures a Pool
+type Option func(*Pool)
+
+// WithWorkers sets the number of workers expanding indexes. If not set,
+// DefaultWorkers is used
+func WithWorkers(workers int) Option {
+	return func(p *Pool) {
+		if workers > 0 {
+			p.workers = workers
+		}
+	}
+}
+
+// WithLease sets how long a worker has to expand an index. The expansion is
+// cancelled once it expires, and another worker may take the job over. If not
+// set, DefaultLease is used
+func WithLease(lease time.Duration) Option {
+	return func(p *Pool) {
+		if lease > 0 {
+			p.lease = lease
+		}
+	}
+}
+
+// WithRetryBackoff sets the minimum and maximum delay between attempts to
+// expand an index
+func WithRetryBackoff(min, max time.Duration) Option {
+	return func(p *Pool) {
+		p.minBackoff = min
+		p.maxBackoff = max
+	}
+}
+
+// WithMaxAttempts sets the number of times an index is expanded before its job
+// is failed. If not set, DefaultMaxAttempts is used
+func WithMaxAttempts(attempts int) Option {
+	return func(p *Pool) {
+		if attempts > 0 {
+			p.maxAttempts = attempts
+		}
+	}
+}
+
+// WithPollInterval sets how often idle workers check the queue for jobs due,
+// besides when tasks are added
+func WithPollInterval(interval time.Duration) Option {
+	return func(p *Pool) {
+		p.pollInterval = interval
+	}
+}
+
+// outcome is how the expansion of a job ended, for the tasks waiting for it
+type outcome struct {
+	index blobindex.ShardedDagIndexView
+	err   error
+}
+
+// Pool expands indexes with a pool of workers, consuming a queue of tasks kept
+// in a datastore, so that queued and unfinished tasks are expanded after a
+// restart. Each worker leases the job it expands, and a job whose lease expires
+// is taken over by another worker. Failed attempts are retried with exponential
+// backoff, up to the most attempts
+type Pool struct {
+	jobs         datastore.Batching
+	expand       ExpandFunc
+	workers      int
+	lease        time.Duration
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	maxAttempts  int
+	pollInterval time.Duration
+	// instance tells the workers of this pool from those of earlier runs
+	instance string
+
+	// lk serializes the claiming and finishing of jobs
+	lk      sync.Mutex
+	waiters map[string][]chan outcome
+	wake    chan struct{}
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewPool returns a pool expanding indexes with the given function, keeping its
+// queue in the given datastore
+func NewPool(ds datastore.Batching, expand ExpandFunc, opts ...Option) (*Pool, error) {
+	instance := make([]byte, 4)
+	if _, err := rand.Read(instance); err != nil {
+		return nil, fmt.Errorf("generating pool instance: %w", err)
+	}
+	p := &Pool{
+		jobs:         namespace.Wrap(ds, queuePrefix),
+		expand:       expand,
+		workers:      DefaultWorkers,
+		lease:        DefaultLease,
+		minBackoff:   time.Second,
+		maxBackoff:   5 * time.Minute,
+		maxAttempts:  DefaultMaxAttempts,
+		pollInterval: 10 * time.Second,
+		instance:     hex.EncodeToString(instance),
+		waiters:      map[string][]chan outcome{},
+		closing:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.wake = make(chan struct{}, p.workers)
+	return p, nil
+}
+
+// FetchWith returns an ExpandFunc fetching indexes with the lookup, from each of
+// the URLs of a task in turn until one succeeds. A lookup caching the indexes it
+// fetches populates the caches from them
+func FetchWith(lookup blobindexlookup.BlobIndexLookup) ExpandFunc {
+	return func(ctx context.Context, task Task) (blobindex.ShardedDagIndexView, error) {
+		if task.Digest != nil {
+			ctx = blobindexlookup.WithIndexDigest(ctx, task.Digest)
+		}
+		var errs []error
+		for _, u := range task.URLs {
+			index, err := lookup.Find(ctx, task.ContextID, task.Provider, u, task.Range)
+			if err == nil {
+				return index, nil
+			}
+			errs = append(errs, fmt.Errorf("fetching index from %s: %w", u.Redacted(), err))
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		if len(errs) == 0 {
+			return nil, errors.New("no URL to fetch the index from")
+		}
+		return nil, errors.Join(errs...)
+	}
+}
+
+// Enqueue durably adds a task to the queue. A task already queued or being
+// expanded for the context ID isn't added again, and a failed one is queued
+// afresh
+func (p *Pool) Enqueue(ctx context.Context, task Task) error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	key := jobKey(task.ContextID)
+	existing, err := p.get(ctx, key)
+	if err == nil && existing.State != StateFailed {
+		return nil
+	}
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return fmt.Errorf("reading expansion queue: %w", err)
+	}
+	now := time.Now()
+	if err := p.put(ctx, Job{Task: task, Key: key.String(), State: StateQueued, Added: now, NextAttempt: now}); err != nil {
+		return err
+	}
+	p.notify()
+	return nil
+}
+
+// Expand adds a task to the queue and waits for its index to be expanded,
+// returning it, or the error of its last attempt once every attempt failed. If
+// the context is done first its error is returned, and the task stays queued
+func (p *Pool) Expand(ctx context.Context, task Task) (blobindex.ShardedDagIndexView, error) {
+	key := jobKey(task.ContextID).String()
+	done := make(chan outcome, 1)
+	p.lk.Lock()
+	p.waiters[key] = append(p.waiters[key], done)
+	p.lk.Unlock()
+	defer p.unwait(key, done)
+	if err := p.Enqueue(ctx, task); err != nil {
+		return nil, err
+	}
+	select {
+	case o := <-done:
+		return o.index, o.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *Pool) unwait(key string, done chan outcome) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.waiters[key] = slices.DeleteFunc(p.waiters[key], func(c chan outcome) bool { return c == done })
+	if len(p.waiters[key]) == 0 {
+		delete(p.waiters, key)
+	}
+}
+
+// Jobs returns the jobs in the queue, oldest first
+func (p *Pool) Jobs(ctx context.Context) ([]Job, error) {
+	results, err := p.jobs.Query(ctx, query.Query{})
+	if err != nil {
+		return nil, err
+	}
+	stored, err := results.Rest()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, 0, len(stored))
+	for _, result := range stored {
+		job, err := decodeJob(result.Key, result.Value)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	slices.SortStableFunc(jobs, func(a, b Job) int { return a.Added.Compare(b.Added) })
+	return jobs, nil
+}
+
+// Stats returns the number of jobs waiting, being expanded and failed
+func (p *Pool) Stats(ctx context.Context) (Stats, error) {
+	jobs, err := p.Jobs(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+	now := time.Now()
+	var stats Stats
+	for _, job := range jobs {
+		switch {
+		case job.State == StateFailed:
+			stats.Failed++
+		case job.State == StateLeased && job.LeaseExpires.After(now):
+			stats.InFlight++
+		default:
+			stats.Depth++
+		}
+	}
+	return stats, nil
+}
+
+// Startup starts the workers in the background (returns immediately)
+func (p *Pool) Startup() {
+	for i := range p.workers {
+		p.wg.Add(1)
+		go p.work(fmt.Sprintf("%s/%d", p.instance, i))
+	}
+}
+
+// Shutdown stops the workers, cancelling the expansions they are running,
+// returning when they stop or the passed context cancels. Jobs not finished
+// remain in the queue, and are taken over once their leases expire
+func (p *Pool) Shutdown(ctx context.Context) error {
+	close(p.closing)
+	stopped := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) work(owner string) {
+	defer p.wg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-p.closing
+		cancel()
+	}()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.closing:
+			return
+		case <-timer.C:
+		case <-p.wake:
+		}
+		for {
+			job, ok, err := p.claim(ctx, owner)
+			if err != nil && ctx.Err() == nil {
+				log.Errorw("claiming expansion job", "error", err)
+			}
+			if !ok {
+				break
+			}
+			p.run(ctx, owner, job)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(p.pollInterval)
+	}
+}
+
+// run expands the index of a job within its lease
+func (p *Pool) run(ctx context.Context, owner string, job Job) {
+	ctx, cancel := context.WithDeadline(ctx, job.LeaseExpires)
+	defer cancel()
+	index, err := p.expand(ctx, job.Task)
+	if err := p.finish(context.Background(), owner, job, index, err); err != nil {
+		log.Errorw("finishing expansion job", "context", job.ContextID, "error", err)
+	}
+}
+
+// claim leases the oldest job that is due: queued for its next attempt, or
+// leased by a worker whose lease expired
+func (p *Pool) claim(ctx context.Context, owner string) (Job, bool, error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	jobs, err := p.Jobs(ctx)
+	if err != nil {
+		return Job{}, false, err
+	}
+	now := time.Now()
+	for _, job := range jobs {
+		due := job.State == StateQueued && !job.NextAttempt.After(now)
+		expired := job.State == StateLeased && !job.LeaseExpires.After(now)
+		if !due && !expired {
+			continue
+		}
+		if expired {
+			log.Warnw("taking over expansion job with expired lease", "context", job.ContextID, "owner", job.Owner, "attempts", job.Attempts)
+		}
+		job.State, job.Owner, job.LeaseExpires = StateLeased, owner, now.Add(p.lease)
+		job.Attempts++
+		if err := p.put(ctx, job); err != nil {
+			return Job{}, false, err
+		}
+		return job, true, nil
+	}
+	return Job{}, false, nil
+}
+
+// finish records the outcome of an attempt, unless the worker lost the lease
+// of the job to another worker meanwhile. A successful expansion removes the
+// job, and a failed one is retried after a backoff, or failed once it has had
+// every attempt. Tasks waiting for the job are told once it succeeds or fails
+func (p *Pool) finish(ctx context.Context, owner string, job Job, index blobindex.ShardedDagIndexView, expandErr error) error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	key := datastore.NewKey(job.Key)
+	current, err := p.get(ctx, key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if current.State != StateLeased || current.Owner != owner {
+		log.Debugw("expansion job lease lost", "context", job.ContextID, "owner", owner)
+		return nil
+	}
+	if expandErr == nil {
+		if err := p.jobs.Delete(ctx, key); err != nil {
+			return err
+		}
+		p.done(job.Key, outcome{index: index})
+		return nil
+	}
+	current.Owner, current.LeaseExpires, current.Error = "", time.Time{}, expandErr.Error()
+	if current.Attempts >= p.maxAttempts {
+		log.Warnw("expansion job failed", "context", job.ContextID, "attempts", current.Attempts, "error", expandErr)
+		current.State = StateFailed
+		if err := p.put(ctx, current); err != nil {
+			return err
+		}
+		p.done(job.Key, outcome{err: expandErr})
+		return nil
+	}
+	log.Debugw("expansion attempt failed", "context", job.ContextID, "attempts", current.Attempts, "error", expandErr)
+	current.State = StateQueued
+	current.NextAttempt = time.Now().Add(p.backoff(current.Attempts))
+	return p.put(ctx, current)
+}
+
+// done tells the tasks waiting for a job how it ended
+func (p *Pool) done(key string, o outcome) {
+	for _, waiter := range p.waiters[key] {
+		waiter <- o
+	}
+	delete(p.waiters, key)
+}
+
+func (p *Pool) notify() {
+	for range p.workers {
+		select {
+		case p.wake <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+func (p *Pool) backoff(attempts int) time.Duration {
+	backoff := p.minBackoff
+	for i := 1; i < attempts && backoff < p.maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, p.maxBackoff)
+}
+
+func (p *Pool) get(ctx context.Context, key datastore.Key) (Job, error) {
+	data, err := p.jobs.Get(ctx, key)
+	if err != nil {
+		return Job{}, err
+	}
+	return decodeJob(key.String(), data)
+}
+
+func (p *Pool) put(ctx context.Context, job Job) error {
+	data, err := encodeJob(job)
+	if err != nil {
+		return fmt.Errorf("encoding expansion job: %w", err)
+	}
+	if err := p.jobs.Put(ctx, datastore.NewKey(job.Key), data); err != nil {
+		return fmt.Errorf("writing expansion queue: %w", err)
+	}
+	return nil
+}
+
+type storedJob struct {
+	ContextID    []byte               `json:"contextId"`
+	Index        string               `json:"index"`
+	Provider     model.ProviderResult `json:"provider"`
+	URLs         []string             `json:"urls"`
+	Range        *metadata.Range      `json:"range,omitempty"`
+	Digest       []byte               `json:"digest,omitempty"`
+	Reason       Reason               `json:"reason"`
+	State        State                `json:"state"`
+	Owner        string               `json:"owner,omitempty"`
+	LeaseExpires time.Time            `json:"leaseExpires"`
+	Attempts     int                  `json:"attempts"`
+	Added        time.Time            `json:"added"`
+	NextAttempt  time.Time            `json:"nextAttempt"`
+	Error        string               `json:"error,omitempty"`
+}
+
+func encodeJob(job Job) ([]byte, error) {
+	urls := make([]string, 0, len(job.URLs))
+	for _, u := range job.URLs {
+		urls = append(urls, u.String())
+	}
+	var index string
+	if job.Index.Defined() {
+		index = job.Index.String()
+	}
+	return json.Marshal(storedJob{
+		ContextID:    job.ContextID,
+		Index:        index,
+		Provider:     job.Provider,
+		URLs:         urls,
+		Range:        job.Range,
+		Digest:       job.Digest,
+		Reason:       job.Reason,
+		State:        job.State,
+		Owner:        job.Owner,
+		LeaseExpires: job.LeaseExpires,
+		Attempts:     job.Attempts,
+		Added:        job.Added,
+		NextAttempt:  job.NextAttempt,
+		Error:        job.Error,
+	})
+}
+
+func decodeJob(key string, data []byte) (Job, error) {
+	var stored storedJob
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return Job{}, fmt.Errorf("decoding expansion job %s: %w", key, err)
+	}
+	task := Task{
+		ContextID: stored.ContextID,
+		Provider:  stored.Provider,
+		Range:     stored.Range,
+		Digest:    stored.Digest,
+		Reason:    stored.Reason,
+	}
+	if stored.Index != "" {
+		index, err := cid.Decode(stored.Index)
+		if err != nil {
+			return Job{}, fmt.Errorf("decoding expansion job %s: %w", key, err)
+		}
+		task.Index = index
+	}
+	for _, s := range stored.URLs {
+		u, err := url.Parse(s)
+		if err != nil {
+			return Job{}, fmt.Errorf("decoding expansion job %s: %w", key, err)
+		}
+		task.URLs = append(task.URLs, *u)
+	}
+	return Job{
+		Task:         task,
+		Key:          key,
+		State:        stored.State,
+		Owner:        stored.Owner,
+		LeaseExpires: stored.LeaseExpires,
+		Attempts:     stored.Attempts,
+		Added:        stored.Added,
+		NextAttempt:  stored.NextAttempt,
+		Error:        stored.Error,
+	}, nil
+}
+
+func jobKey(contextID types.EncodedContextID) datastore.Key {
+	return datastore.NewKey(hex.EncodeToString(contextID))
+}
@@ -0,0 +1,156 @@
+package expansion_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/expansion"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// mockExpander counts its calls, blocking the calls made while block is set
+// until release is closed, regardless of their context
+type mockExpander struct {
+	lk      sync.Mutex
+	calls   map[string]int
+	block   bool
+	release chan struct{}
+	err     error
+	index   blobindex.ShardedDagIndexView
+}
+
+func newMockExpander(index blobindex.ShardedDagIndexView) *mockExpander {
+	return &mockExpander{calls: map[string]int{}, release: make(chan struct{}), index: index}
+}
+
+func (m *mockExpander) expand(ctx context.Context, task expansion.Task) (blobindex.ShardedDagIndexView, error) {
+	m.lk.Lock()
+	m.calls[string(task.ContextID)]++
+	block, err := m.block, m.err
+	m.block = false
+	m.lk.Unlock()
+	if block {
+		<-m.release
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m.index, nil
+}
+
+func (m *mockExpander) count(contextID types.EncodedContextID) int {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.calls[string(contextID)]
+}
+
+func newTask(t *testing.T) expansion.Task {
+	return expansion.Task{
+		ContextID: testutil.RandomBytes(16),
+		Provider:  testutil.RandomProviderResult(),
+		URLs:      []url.URL{*testutil.Must(url.Parse("https://storage.example/blob"))(t)},
+		Reason:    expansion.ReasonQuery,
+	}
+}
+
+func TestPool(t *testing.T) {
+	ctx := context.Background()
+	_, index := testutil.RandomShardedDagIndexView(32)
+	opts := []expansion.Option{expansion.WithPollInterval(5 * time.Millisecond), expansion.WithRetryBackoff(time.Millisecond, time.Millisecond)}
+	newPool := func(t *testing.T, ds datastore.Batching, expand expansion.ExpandFunc, more ...expansion.Option) *expansion.Pool {
+		return testutil.Must(expansion.NewPool(ds, expand, append(opts, more...)...))(t)
+	}
+	shutdown := func(t *testing.T, p *expansion.Pool) {
+		ctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		require.NoError(t, p.Shutdown(ctx))
+	}
+
+	t.Run("jobs whose lease expired are taken over by another worker", func(t *testing.T) {
+		expander := newMockExpander(index)
+		expander.block = true
+		p := newPool(t, dssync.MutexWrap(datastore.NewMapDatastore()), expander.expand, expansion.WithWorkers(2), expansion.WithLease(50*time.Millisecond))
+		p.Startup()
+		defer shutdown(t, p)
+		defer close(expander.release)
+
+		task := newTask(t)
+		wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		expanded := testutil.Must(p.Expand(wctx, task))(t)
+		require.Equal(t, index, expanded)
+		// the first worker is still stuck on the job it lost the lease of
+		require.Equal(t, 2, expander.count(task.ContextID))
+		require.Empty(t, testutil.Must(p.Jobs(ctx))(t))
+	})
+
+	t.Run("jobs are retried until they fail every attempt", func(t *testing.T) {
+		expander := newMockExpander(index)
+		expander.err = errors.New("index unavailable")
+		p := newPool(t, dssync.MutexWrap(datastore.NewMapDatastore()), expander.expand, expansion.WithMaxAttempts(3))
+		p.Startup()
+		defer shutdown(t, p)
+
+		task := newTask(t)
+		_, err := p.Expand(ctx, task)
+		require.ErrorIs(t, err, expander.err)
+		require.Equal(t, 3, expander.count(task.ContextID))
+		jobs := testutil.Must(p.Jobs(ctx))(t)
+		require.Len(t, jobs, 1)
+		require.Equal(t, expansion.StateFailed, jobs[0].State)
+		require.Equal(t, "index unavailable", jobs[0].Error)
+		require.Equal(t, 3, jobs[0].Attempts)
+		require.Equal(t, expansion.Stats{Failed: 1}, testutil.Must(p.Stats(ctx))(t))
+
+		// asking for the index again queues it afresh
+		expander.lk.Lock()
+		expander.err = nil
+		expander.lk.Unlock()
+		testutil.Must(p.Expand(ctx, task))(t)
+		require.Equal(t, 4, expander.count(task.ContextID))
+		require.Equal(t, expansion.Stats{}, testutil.Must(p.Stats(ctx))(t))
+	})
+
+	t.Run("queued and unfinished jobs are expanded after a restart", func(t *testing.T) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		// the first run leases one job, and stops before it finishes it
+		stuck := newMockExpander(index)
+		stuck.block = true
+		defer close(stuck.release)
+		first := newPool(t, ds, stuck.expand, expansion.WithWorkers(1), expansion.WithLease(500*time.Millisecond))
+		leased := newTask(t)
+		require.NoError(t, first.Enqueue(ctx, leased))
+		first.Startup()
+		require.Eventually(t, func() bool { return stuck.count(leased.ContextID) == 1 }, time.Second, time.Millisecond)
+		queued := []expansion.Task{newTask(t), newTask(t)}
+		for _, task := range queued {
+			require.NoError(t, first.Enqueue(ctx, task))
+		}
+		sctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, first.Shutdown(sctx), context.DeadlineExceeded)
+		stats := testutil.Must(first.Stats(ctx))(t)
+		require.Equal(t, 1, stats.InFlight)
+		require.Equal(t, 2, stats.Depth)
+
+		expander := newMockExpander(index)
+		second := newPool(t, ds, expander.expand)
+		second.Startup()
+		defer shutdown(t, second)
+		require.Eventually(t, func() bool {
+			return len(testutil.Must(second.Jobs(ctx))(t)) == 0
+		}, 5*time.Second, 5*time.Millisecond)
+		for _, task := range append(queued, leased) {
+			require.Equal(t, 1, expander.count(task.ContextID))
+		}
+	})
+}
@@ -0,0 +1,28 @@
+package service
+
+import (
+	"context"
+	"io"
+
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// providerExporter is implemented by provider indexes that can export their
+// cached records in bulk
+type providerExporter interface {
+	ExportProviderRecords(ctx context.Context, w io.Writer, format types.ExportFormat, cursor string, limit int) (string, error)
+}
+
+// ExportProviderRecords writes a page of the cached provider records to w, of
+// up to about limit hashes starting at the cursor, and returns the cursor of
+// the next page, which is empty after the last. It returns
+// providerindex.ErrExportUnsupported if the provider index can't be exported.
+// See providerindex.ProviderIndex.ExportProviderRecords
+func (is *IndexingService) ExportProviderRecords(ctx context.Context, w io.Writer, format types.ExportFormat, cursor string, limit int) (string, error) {
+	pe, ok := is.providerIndex.(providerExporter)
+	if !ok {
+		return "", providerindex.ErrExportUnsupported
+	}
+	return pe.ExportProviderRecords(ctx, w, format, cursor, limit)
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/validator"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+)
+
+// DefaultURLTimeout is how long a fetch from one of several URLs is given
+// before the next URL is tried
+const DefaultURLTimeout = 10 * time.Second
+
+// WithURLTimeout sets how long a fetch of an index or claim from one of several
+// URLs is given before the next URL is tried. The last URL is given as long as
+// the query allows. Zero gives every URL as long as the query allows. If not
+// set, DefaultURLTimeout is used
+func WithURLTimeout(timeout time.Duration) Option {
+	return func(is *IndexingService) {
+		is.urlTimeout = timeout
+	}
+}
+
+// attemptContext returns the context for a fetch from one of several URLs tried
+// in turn. Every attempt but the last is cut short by the URL timeout, so that a
+// URL that doesn't respond fails over to the next
+func (is *IndexingService) attemptContext(ctx context.Context, last bool) (context.Context, context.CancelFunc) {
+	if last || is.urlTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, is.urlTimeout)
+}
+
+// fetchIndexFrom fetches the index at the location from each of the URLs in
+// turn, until one succeeds, hedging the fetches if hedging is enabled
+func (is *IndexingService) fetchIndexFrom(ctx context.Context, c *ClaimContext, urls []url.URL, location *metadata.LocationCommitmentMetadata) (blobindex.ShardedDagIndexView, error) {
+	result := c.Result()
+	hosts := make([]string, 0, len(urls))
+	for _, u := range urls {
+		hosts = append(hosts, u.Host)
+	}
+	index, i, err := fetchFirst(ctx, is, HedgedIndexFetch, hosts, func(ctx context.Context, i int) (blobindex.ShardedDagIndexView, error) {
+		index, err := is.blobIndexLookup.Find(ctx, result.ContextID, *c.j.indexProviderRecord, urls[i], location.Range)
+		if err != nil {
+			return nil, fmt.Errorf("fetching index from %s: %w", urls[i].Redacted(), err)
+		}
+		return index, nil
+	}, func(int, time.Duration, error) {})
+	if err != nil {
+		return nil, err
+	}
+	if i > 0 {
+		log.Debugw("fetched index from fallback URL", "url", urls[i].Redacted(), "attempt", i+1)
+	}
+	return index, nil
+}
+
+// indexURLs returns the URLs the index at the location can be fetched from, in
+// the order to try them: the URL the provider serves the shard at, followed by
+// the URLs of the location commitment in their priority order. URLs of the
+// commitment that can't be fetched from over HTTP, or whose hosts the address
+// policy doesn't allow, are left out
+func (is *IndexingService) indexURLs(ctx context.Context, provider peer.AddrInfo, shard cid.Cid, location *metadata.LocationCommitmentMetadata, claim delegation.Delegation) ([]url.URL, error) {
+	var urls []url.URL
+	providerURL, err := is.fetchRetrievalURL(ctx, provider, shard, location.Template)
+	if err == nil {
+		urls = append(urls, *providerURL)
+	}
+	for _, u := range is.commitmentURLs(ctx, claim) {
+		if !slices.ContainsFunc(urls, func(v url.URL) bool { return v.String() == u.String() }) {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 {
+		return nil, err
+	}
+	return urls, nil
+}
+
+// commitmentURLs returns the URLs of a location commitment that can be fetched
+// from, in the order they are listed. A nil claim, which is one the client
+// already has, has none
+func (is *IndexingService) commitmentURLs(ctx context.Context, claim delegation.Delegation) []url.URL {
+	if claim == nil {
+		return nil
+	}
+	var urls []url.URL
+	for _, capability := range claim.Capabilities() {
+		if capability.Can() != assert.LocationAbility {
+			continue
+		}
+		match, fail := assert.Location.Match(validator.NewSource(capability, claim))
+		if fail != nil {
+			continue
+		}
+		for _, u := range queryresult.FetchableURLs(match.Value().Nb().Location) {
+			if is.addressPolicy != nil {
+				if err := is.addressPolicy.CheckHost(ctx, u.Hostname()); err != nil {
+					log.Debugw("skipping location URL", "url", u.Redacted(), "error", err)
+					continue
+				}
+			}
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
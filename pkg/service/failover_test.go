@@ -0,0 +1,151 @@
+package service_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/maurl"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/blobindexlookup"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/stretchr/testify/require"
+)
+
+// countingServer serves the body to every request, after the delay, and counts
+// the requests made to it. A request given up on before the delay is answered
+// with nothing
+type countingServer struct {
+	*httptest.Server
+	requests atomic.Int32
+}
+
+func newCountingServer(t *testing.T, delay time.Duration, body func(r *http.Request) []byte) *countingServer {
+	s := &countingServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		data := body(r)
+		if data == nil {
+			http.NotFound(w, r)
+			return
+		}
+		testutil.Must(w.Write(data))(t)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *countingServer) url(t *testing.T, path string) *url.URL {
+	return testutil.Must(url.Parse(s.URL + path))(t)
+}
+
+func TestIndexingService__URLFailover(t *testing.T) {
+	f := newClaimFixture(t)
+	contentHash, indexCid, shardHash := testutil.RandomMultihash(), testutil.RandomCID().(cidlink.Link).Cid, testutil.RandomMultihash()
+	index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 1)
+	index.SetSlice(shardHash, contentHash, blobindex.Position{Offset: 0, Length: 10})
+	archive := testutil.Must(io.ReadAll(testutil.Must(blobindex.Archive(index))(t)))(t)
+	serveIndex := func(*http.Request) []byte { return archive }
+
+	// the index commitment lists three URLs: the first doesn't respond in time,
+	// the second serves the index, and the third is never needed
+	stalled := newCountingServer(t, time.Minute, serveIndex)
+	serving := newCountingServer(t, 0, serveIndex)
+	spare := newCountingServer(t, 0, serveIndex)
+	indexURLs := []*url.URL{stalled.url(t, "/index"), serving.url(t, "/index"), spare.url(t, "/index")}
+	shardURLs := []*url.URL{stalled.url(t, "/shard"), serving.url(t, "/shard"), spare.url(t, "/shard")}
+	indexClaim := f.newClaim(t)
+	indexLocation := f.addClaim(t, locationsDelegation(t, indexCid.Hash(), indexURLs...))
+	shardLocation := f.addClaim(t, locationsDelegation(t, shardHash, shardURLs...))
+
+	results := map[string][]model.ProviderResult{
+		string(contentHash):     {f.result(t, testutil.RandomBytes(10), &metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaim})},
+		string(indexCid.Hash()): {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: indexLocation})},
+		string(shardHash):       {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: shardLocation})},
+	}
+	// the provider serves claims, but not blobs, so the index can only be
+	// fetched from the URLs of the commitment
+	provider := &peer.AddrInfo{ID: f.provider.ID, Addrs: f.provider.Addrs[:1]}
+	newService := func(provider *peer.AddrInfo, results map[string][]model.ProviderResult) *service.IndexingService {
+		withProvider := map[string][]model.ProviderResult{}
+		for hash, records := range results {
+			for _, r := range records {
+				r.Provider = provider
+				withProvider[hash] = append(withProvider[hash], r)
+			}
+		}
+		providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: withProvider, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		return testutil.Must(service.NewIndexingService(blobindexlookup.NewBlobIndexLookup(http.DefaultClient), claimlookup.NewClaimLookup(http.DefaultClient), providerIndex, service.WithURLTimeout(100*time.Millisecond)))(t)
+	}
+	queryClaims := func(t *testing.T, is *service.IndexingService) (found []cid.Cid, indexes int) {
+		qr := testutil.Must(is.Query(context.Background(), service.Query{Hashes: []multihash.Multihash{contentHash}}))(t)
+		for _, link := range qr.Claims() {
+			found = append(found, link.(cidlink.Link).Cid)
+		}
+		return found, len(qr.Indexes())
+	}
+
+	t.Run("index is fetched from the first URL that responds", func(t *testing.T) {
+		qr := testutil.Must(newService(provider, results).Query(context.Background(), service.Query{Hashes: []multihash.Multihash{contentHash}}))(t)
+		require.Len(t, qr.Indexes(), 1)
+		require.Equal(t, int32(1), stalled.requests.Load())
+		require.Equal(t, int32(1), serving.requests.Load())
+		require.Zero(t, spare.requests.Load())
+
+		// the full list of URLs is kept in priority order for retrievers
+		summary := qr.Summaries()[indexLocation]
+		require.Equal(t, []url.URL{*indexURLs[0], *indexURLs[1], *indexURLs[2]}, summary.Location)
+		require.False(t, summary.Unfetchable)
+		plan := testutil.Must(service.PlanRetrieval(qr, []multihash.Multihash{contentHash}))(t)
+		require.Equal(t, []service.Fetch{{
+			URL:       *shardURLs[0],
+			Fallbacks: []url.URL{*shardURLs[1], *shardURLs[2]},
+			Shard:     shardHash,
+			Claim:     shardLocation,
+			Offset:    0,
+			Length:    10,
+			Slices:    []service.Slice{{Hash: contentHash, Offset: 0, Length: 10}},
+		}}, plan.Fetches)
+	})
+
+	t.Run("claims are fetched from the next address of the provider", func(t *testing.T) {
+		stalledClaims := newCountingServer(t, time.Minute, func(*http.Request) []byte { return nil })
+		claimsAddr := testutil.Must(maurl.FromURL(stalledClaims.url(t, "/claims/{claim}")))(t)
+		failover := &peer.AddrInfo{ID: provider.ID, Addrs: []multiaddr.Multiaddr{claimsAddr, provider.Addrs[0]}}
+
+		claims, indexes := queryClaims(t, newService(failover, results))
+		require.ElementsMatch(t, []cid.Cid{indexClaim, indexLocation, shardLocation}, claims)
+		require.Equal(t, 1, indexes)
+		require.Equal(t, int32(3), stalledClaims.requests.Load())
+	})
+
+	t.Run("commitments with no URL that can be fetched are still returned", func(t *testing.T) {
+		unfetchable := f.addClaim(t, locationsDelegation(t, indexCid.Hash(), testutil.Must(url.Parse("ftp://files.example/index"))(t)))
+		claims, indexes := queryClaims(t, newService(provider, map[string][]model.ProviderResult{
+			string(contentHash):     results[string(contentHash)],
+			string(indexCid.Hash()): {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: unfetchable})},
+		}))
+		require.ElementsMatch(t, []cid.Cid{indexClaim, unfetchable}, claims)
+		require.Zero(t, indexes)
+	})
+}
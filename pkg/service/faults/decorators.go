@@ -0,0 +1,101 @@
+package faults
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service/blobindexlookup"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// ProviderIndex is the provider index of the indexing service
+type ProviderIndex interface {
+	FindDetailed(context.Context, providerindex.QueryKey) (providerindex.FindResult, error)
+	CacheProviderResult(ctx context.Context, hash multihash.Multihash, result model.ProviderResult, expiration time.Time) error
+	MarkSeen(ctx context.Context, hash multihash.Multihash, result model.ProviderResult, at time.Time) error
+	Publish(context.Context, []multihash.Multihash, model.ProviderResult, ...providerindex.PublishOption) error
+}
+
+type providerIndex struct {
+	providerIndex ProviderIndex
+	schedule      *Schedule
+}
+
+// WrapProviderIndex injects faults into the calls to a provider index, keyed by
+// hash. Queries read the wrapped index directly, rather than a snapshot of it
+func WrapProviderIndex(pi ProviderIndex, s *Schedule) ProviderIndex {
+	return &providerIndex{pi, s}
+}
+
+func (p *providerIndex) FindDetailed(ctx context.Context, qk providerindex.QueryKey) (providerindex.FindResult, error) {
+	if err := p.schedule.Next(OpFindProviders, string(qk.Hash)).Inject(ctx); err != nil {
+		return providerindex.FindResult{}, err
+	}
+	return p.providerIndex.FindDetailed(ctx, qk)
+}
+
+func (p *providerIndex) CacheProviderResult(ctx context.Context, hash multihash.Multihash, result model.ProviderResult, expiration time.Time) error {
+	if err := p.schedule.Next(OpCacheProvider, string(hash)).Inject(ctx); err != nil {
+		return err
+	}
+	return p.providerIndex.CacheProviderResult(ctx, hash, result, expiration)
+}
+
+func (p *providerIndex) MarkSeen(ctx context.Context, hash multihash.Multihash, result model.ProviderResult, at time.Time) error {
+	if err := p.schedule.Next(OpMarkSeen, string(hash)).Inject(ctx); err != nil {
+		return err
+	}
+	return p.providerIndex.MarkSeen(ctx, hash, result, at)
+}
+
+func (p *providerIndex) Publish(ctx context.Context, hashes []multihash.Multihash, result model.ProviderResult, opts ...providerindex.PublishOption) error {
+	if err := p.schedule.Next(OpPublish, string(result.ContextID)).Inject(ctx); err != nil {
+		return err
+	}
+	return p.providerIndex.Publish(ctx, hashes, result, opts...)
+}
+
+type claimLookup struct {
+	claimLookup claimlookup.ClaimLookup
+	schedule    *Schedule
+}
+
+// WrapClaimLookup injects faults into the claim lookups of a claim lookup,
+// keyed by claim CID
+func WrapClaimLookup(cl claimlookup.ClaimLookup, s *Schedule) claimlookup.ClaimLookup {
+	return &claimLookup{cl, s}
+}
+
+func (c *claimLookup) LookupClaim(ctx context.Context, claimCid cid.Cid, fetchURL url.URL) (delegation.Delegation, error) {
+	if err := c.schedule.Next(OpLookupClaim, claimCid.String()).Inject(ctx); err != nil {
+		return nil, err
+	}
+	return c.claimLookup.LookupClaim(ctx, claimCid, fetchURL)
+}
+
+type blobIndexLookup struct {
+	blobIndexLookup blobindexlookup.BlobIndexLookup
+	schedule        *Schedule
+}
+
+// WrapBlobIndexLookup injects faults into the index lookups of a blob index
+// lookup, keyed by context ID
+func WrapBlobIndexLookup(bil blobindexlookup.BlobIndexLookup, s *Schedule) blobindexlookup.BlobIndexLookup {
+	return &blobIndexLookup{bil, s}
+}
+
+func (b *blobIndexLookup) Find(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, fetchURL url.URL, rng *metadata.Range) (blobindex.ShardedDagIndexView, error) {
+	if err := b.schedule.Next(OpFindIndex, string(contextID)).Inject(ctx); err != nil {
+		return nil, err
+	}
+	return b.blobIndexLookup.Find(ctx, contextID, provider, fetchURL, rng)
+}
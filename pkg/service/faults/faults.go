@@ -0,0 +1,235 @@
+// Package faults injects failures into the dependencies of the indexing
+// service, for testing how queries degrade when they fail. Faults follow a
+// seeded schedule, so the same calls fail the same way on every run
+package faults
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("faults")
+
+// ErrInjected is wrapped by the errors of injected Error faults
+var ErrInjected = errors.New("injected fault")
+
+// Kind is a kind of fault
+type Kind int
+
+const (
+	// None makes the call as normal
+	None Kind = iota
+	// Latency delays the call by the rule's delay, then makes it
+	Latency
+	// Error fails the call with an error wrapping ErrInjected
+	Error
+	// Hang blocks the call until its context is done
+	Hang
+	// Corrupt flips bytes of the payload the call returns
+	Corrupt
+	// Truncate cuts the payload the call returns in half
+	Truncate
+)
+
+func (k Kind) String() string {
+	switch k {
+	case None:
+		return "none"
+	case Latency:
+		return "latency"
+	case Error:
+		return "error"
+	case Hang:
+		return "hang"
+	case Corrupt:
+		return "corrupt"
+	case Truncate:
+		return "truncate"
+	default:
+		return fmt.Sprintf("kind(%d)", int(k))
+	}
+}
+
+// Operations faults can be injected into
+const (
+	OpFindProviders = "providerindex.FindDetailed"
+	OpCacheProvider = "providerindex.CacheProviderResult"
+	OpMarkSeen      = "providerindex.MarkSeen"
+	OpPublish       = "providerindex.Publish"
+	OpLookupClaim   = "claimlookup.LookupClaim"
+	OpFindIndex     = "blobindexlookup.Find"
+	OpRedisGet      = "redis.Get"
+	OpRedisSet      = "redis.Set"
+	OpRedisExpire   = "redis.Expire"
+	OpRedisPersist  = "redis.Persist"
+	OpHTTPRoundTrip = "http.RoundTrip"
+)
+
+// Rule injects a kind of fault into a share of the calls to an operation.
+// Corrupt and Truncate faults only affect operations returning a payload: redis
+// reads and HTTP responses. Elsewhere the call is made as normal
+type Rule struct {
+	// Op is the operation faults are injected into. An operation ending in "*"
+	// matches every operation starting with what comes before it, such as
+	// "redis.*"
+	Op string
+	// Kind is the kind of fault injected
+	Kind Kind
+	// Rate is the share of calls, from 0 to 1, the fault is injected into
+	Rate float64
+	// Delay is how long Latency faults delay calls
+	Delay time.Duration
+}
+
+func (r Rule) matches(op string) bool {
+	if prefix, ok := strings.CutSuffix(r.Op, "*"); ok {
+		return strings.HasPrefix(op, prefix)
+	}
+	return r.Op == op
+}
+
+// Schedule decides which calls faults are injected into. Calls to an operation
+// for a key, such as a hash or claim CID, are numbered, and whether a call is
+// faulted depends only on the seed, operation, key and number. Calls made by
+// concurrent jobs for other keys can't change the outcome, so a failure seen
+// once is seen again on every run with the same seed
+type Schedule struct {
+	seed     uint64
+	rules    []Rule
+	lk       sync.Mutex
+	calls    map[call]uint64
+	injected map[string]int
+}
+
+type call struct {
+	op  string
+	key string
+}
+
+// NewSchedule returns a schedule injecting faults by the rules, which are
+// tried in order until one applies to a call
+func NewSchedule(seed int64, rules ...Rule) *Schedule {
+	return &Schedule{
+		seed:     uint64(seed),
+		rules:    rules,
+		calls:    map[call]uint64{},
+		injected: map[string]int{},
+	}
+}
+
+// Fault is the fault injected into a single call
+type Fault struct {
+	Kind  Kind
+	Delay time.Duration
+	op    string
+}
+
+// Next returns the fault to inject into the next call to the operation for the
+// key
+func (s *Schedule) Next(op, key string) Fault {
+	if s == nil {
+		return Fault{op: op}
+	}
+	s.lk.Lock()
+	c := call{op, key}
+	n := s.calls[c]
+	s.calls[c] = n + 1
+	s.lk.Unlock()
+
+	for i, rule := range s.rules {
+		if !rule.matches(op) || s.draw(c, n, i) >= rule.Rate {
+			continue
+		}
+		s.lk.Lock()
+		s.injected[op]++
+		s.lk.Unlock()
+		log.Debugw("injecting fault", "op", op, "key", key, "call", n, "kind", rule.Kind)
+		return Fault{Kind: rule.Kind, Delay: rule.Delay, op: op}
+	}
+	return Fault{op: op}
+}
+
+// Injected returns the number of faults injected into calls to the operation
+func (s *Schedule) Injected(op string) int {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.injected[op]
+}
+
+// draw returns a number in [0, 1) derived from the call and rule alone
+func (s *Schedule) draw(c call, n uint64, rule int) float64 {
+	h := fnv.New64a()
+	h.Write(binary.BigEndian.AppendUint64(nil, s.seed))
+	h.Write([]byte(c.op))
+	h.Write([]byte{0})
+	h.Write([]byte(c.key))
+	h.Write([]byte{0})
+	h.Write(binary.BigEndian.AppendUint64(nil, n))
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(rule)))
+	// fnv mixes the last bytes written poorly, so the sum is finalized as in
+	// splitmix64 before being scaled
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x>>11) / (1 << 53)
+}
+
+// Inject delays, fails or blocks the call as the fault requires. Faults that
+// change payloads return nil, and are applied with Mangle once the call is made
+func (f Fault) Inject(ctx context.Context) error {
+	switch f.Kind {
+	case Latency:
+		timer := time.NewTimer(f.Delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	case Hang:
+		<-ctx.Done()
+		return ctx.Err()
+	case Error:
+		return fmt.Errorf("%s: %w", f.op, ErrInjected)
+	default:
+		return nil
+	}
+}
+
+// Mangles returns true if the fault changes the payload the call returns
+func (f Fault) Mangles() bool {
+	return f.Kind == Corrupt || f.Kind == Truncate
+}
+
+// Mangle returns a copy of the payload corrupted or truncated as the fault
+// requires
+func (f Fault) Mangle(data []byte) []byte {
+	switch f.Kind {
+	case Truncate:
+		return append([]byte(nil), data[:len(data)/2]...)
+	case Corrupt:
+		mangled := append([]byte(nil), data...)
+		// the leading byte is flipped so that framing and type tags are broken,
+		// and the middle one so that content checks fail as well
+		for _, i := range []int{0, len(mangled) / 2} {
+			if i < len(mangled) {
+				mangled[i] ^= 0xff
+			}
+		}
+		return mangled
+	default:
+		return data
+	}
+}
@@ -0,0 +1,51 @@
+package faults_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/storacha/indexing-service/pkg/service/faults"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedule(t *testing.T) {
+	rules := []faults.Rule{
+		{Op: faults.OpLookupClaim, Kind: faults.Error, Rate: 0.25},
+		{Op: "redis.*", Kind: faults.Corrupt, Rate: 1},
+	}
+	outcomes := func(s *faults.Schedule) []faults.Kind {
+		var kinds []faults.Kind
+		for i := range 1000 {
+			kinds = append(kinds, s.Next(faults.OpLookupClaim, fmt.Sprint(i%100)).Kind)
+		}
+		return kinds
+	}
+
+	t.Run("same seed, same faults", func(t *testing.T) {
+		require.Equal(t, outcomes(faults.NewSchedule(7, rules...)), outcomes(faults.NewSchedule(7, rules...)))
+		require.NotEqual(t, outcomes(faults.NewSchedule(7, rules...)), outcomes(faults.NewSchedule(8, rules...)))
+	})
+
+	t.Run("rates", func(t *testing.T) {
+		s := faults.NewSchedule(7, rules...)
+		outcomes(s)
+		require.InDelta(t, 250, s.Injected(faults.OpLookupClaim), 50)
+		require.Equal(t, faults.Corrupt, s.Next(faults.OpRedisGet, "key").Kind)
+		require.Equal(t, faults.None, s.Next(faults.OpFindIndex, "key").Kind)
+	})
+
+	t.Run("injection", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, faults.Fault{Kind: faults.Error}.Inject(ctx), faults.ErrInjected)
+		require.NoError(t, faults.Fault{Kind: faults.Latency, Delay: time.Millisecond}.Inject(ctx))
+		require.ErrorIs(t, faults.Fault{Kind: faults.Hang}.Inject(ctx), context.DeadlineExceeded)
+
+		data := []byte("payload")
+		require.Equal(t, []byte("pay"), faults.Fault{Kind: faults.Truncate}.Mangle(data))
+		require.NotEqual(t, data, faults.Fault{Kind: faults.Corrupt}.Mangle(data))
+		require.Equal(t, []byte("payload"), data)
+	})
+}
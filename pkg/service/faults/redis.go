@@ -0,0 +1,58 @@
+package faults
+
+import (
+	"context"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/storacha/indexing-service/pkg/redis"
+)
+
+type redisClient struct {
+	client   redis.Client
+	schedule *Schedule
+}
+
+// WrapRedisClient injects faults into the commands sent to a redis client,
+// keyed by redis key. Corrupt and Truncate faults change the values read, not
+// the values written
+func WrapRedisClient(c redis.Client, s *Schedule) redis.Client {
+	return &redisClient{c, s}
+}
+
+func (r *redisClient) Get(ctx context.Context, key string) *goredis.StringCmd {
+	f := r.schedule.Next(OpRedisGet, key)
+	if err := f.Inject(ctx); err != nil {
+		return goredis.NewStringResult("", err)
+	}
+	cmd := r.client.Get(ctx, key)
+	if !f.Mangles() {
+		return cmd
+	}
+	val, err := cmd.Result()
+	if err != nil {
+		return cmd
+	}
+	return goredis.NewStringResult(string(f.Mangle([]byte(val))), nil)
+}
+
+func (r *redisClient) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *goredis.StatusCmd {
+	if err := r.schedule.Next(OpRedisSet, key).Inject(ctx); err != nil {
+		return goredis.NewStatusResult("", err)
+	}
+	return r.client.Set(ctx, key, value, expiration)
+}
+
+func (r *redisClient) Expire(ctx context.Context, key string, expiration time.Duration) *goredis.BoolCmd {
+	if err := r.schedule.Next(OpRedisExpire, key).Inject(ctx); err != nil {
+		return goredis.NewBoolResult(false, err)
+	}
+	return r.client.Expire(ctx, key, expiration)
+}
+
+func (r *redisClient) Persist(ctx context.Context, key string) *goredis.BoolCmd {
+	if err := r.schedule.Next(OpRedisPersist, key).Inject(ctx); err != nil {
+		return goredis.NewBoolResult(false, err)
+	}
+	return r.client.Persist(ctx, key)
+}
@@ -0,0 +1,52 @@
+package faults
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+type transport struct {
+	transport http.RoundTripper
+	schedule  *Schedule
+}
+
+// WrapTransport injects faults into the requests sent with an HTTP transport,
+// keyed by the path and query of the URL, so that schedules don't depend on
+// which host serves a resource. Corrupt and Truncate faults change the bodies
+// of responses
+func WrapTransport(rt http.RoundTripper, s *Schedule) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &transport{rt, s}
+}
+
+// WrapHTTPClient returns a copy of the client sending requests with faults
+// injected into them
+func WrapHTTPClient(c *http.Client, s *Schedule) *http.Client {
+	wrapped := *c
+	wrapped.Transport = WrapTransport(c.Transport, s)
+	return &wrapped
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f := t.schedule.Next(OpHTTPRoundTrip, req.URL.RequestURI())
+	if err := f.Inject(req.Context()); err != nil {
+		return nil, err
+	}
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil || !f.Mangles() {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	body = f.Mangle(body)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
@@ -0,0 +1,262 @@
+package service_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/maurl"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/faults"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+// memRedis is an in-memory redis client, safe for concurrent use
+type memRedis struct {
+	lk   sync.Mutex
+	data map[string]string
+}
+
+func (m *memRedis) Get(ctx context.Context, key string) *goredis.StringCmd {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	val, ok := m.data[key]
+	if !ok {
+		return goredis.NewStringResult("", goredis.Nil)
+	}
+	return goredis.NewStringResult(val, nil)
+}
+
+func (m *memRedis) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *goredis.StatusCmd {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.data[key] = value.(string)
+	return goredis.NewStatusResult("OK", nil)
+}
+
+func (m *memRedis) Expire(ctx context.Context, key string, expiration time.Duration) *goredis.BoolCmd {
+	return goredis.NewBoolResult(true, nil)
+}
+
+func (m *memRedis) Persist(ctx context.Context, key string) *goredis.BoolCmd {
+	return goredis.NewBoolResult(true, nil)
+}
+
+// fixedCID returns a CID that is the same on every run, so that faults keyed
+// by it are scheduled the same way on every run
+func fixedCID(name string) cid.Cid {
+	digest := sha256.Sum256([]byte(name))
+	hash, _ := multihash.Encode(digest[:], multihash.SHA2_256)
+	return cid.NewCidV1(cid.Raw, hash)
+}
+
+func TestIndexingService__Faults(t *testing.T) {
+	const numClaims = 16
+	contentHash := fixedCID("content").Hash()
+	claims := map[string]delegation.Delegation{}
+	bodies := map[string][]byte{}
+	for i := range numClaims {
+		claim := testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.IndexCaveats]{
+			assert.Index.New(testutil.Service.DID().String(), assert.IndexCaveats{
+				Content: cidlink.Link{Cid: fixedCID(fmt.Sprintf("content %d", i))},
+				Index:   cidlink.Link{Cid: fixedCID(fmt.Sprintf("index %d", i))},
+			}),
+		}, delegation.WithNoExpiration()))(t)
+		claims[claim.Link().String()] = claim
+		bodies[claim.Link().String()] = testutil.Must(io.ReadAll(claim.Archive()))(t)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := bodies[strings.TrimPrefix(r.URL.Path, "/claims/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(body)
+	}))
+	defer server.Close()
+	serverURL := testutil.Must(url.Parse(server.URL))(t)
+	serverURL.Path = "/claims/{claim}"
+	provider := &peer.AddrInfo{
+		ID:    testutil.RandomPeer(),
+		Addrs: []multiaddr.Multiaddr{testutil.Must(maurl.FromURL(serverURL))(t)},
+	}
+	var results []model.ProviderResult
+	for _, claim := range claims {
+		md := &metadata.IndexClaimMetadata{
+			Index: fixedCID("index " + claim.Link().String()),
+			Claim: claim.Link().(cidlink.Link).Cid,
+		}
+		results = append(results, model.ProviderResult{
+			ContextID: testutil.RandomBytes(10),
+			Metadata:  testutil.Must(md.MarshalBinary())(t),
+			Provider:  provider,
+		})
+	}
+
+	// run queries the hash for the claims, with faults injected into the
+	// provider index, claim lookups, claim cache and claim fetches by the
+	// schedule. If warm is true, the claim cache is filled by a query without
+	// faults first
+	type run struct {
+		claims   []string
+		err      error
+		injected int
+		cache    *memRedis
+	}
+	runQuery := func(t *testing.T, schedule *faults.Schedule, op string, warm bool, timeout time.Duration) run {
+		cache := &memRedis{data: map[string]string{}}
+		transport := &http.Transport{}
+		defer transport.CloseIdleConnections()
+		newService := func(schedule *faults.Schedule) *service.IndexingService {
+			providerIndex := faults.WrapProviderIndex(providerindex.NewProviderIndex(
+				&mockProviderStore{results: map[string][]model.ProviderResult{string(contentHash): results}},
+				&countingFinder{results: map[string][]model.ProviderResult{}, calls: map[string]int{}},
+				nil, nil, cidlink.DefaultLinkSystem(), nil,
+			), schedule)
+			fetchClient := faults.WrapHTTPClient(&http.Client{Transport: transport}, schedule)
+			claimLookup := claimlookup.WithCache(
+				faults.WrapClaimLookup(claimlookup.NewClaimLookup(fetchClient), schedule),
+				redis.NewContentClaimsStore(faults.WrapRedisClient(cache, schedule)),
+			)
+			return testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimLookup, providerIndex, service.WithConcurrency(4)))(t)
+		}
+		if warm {
+			testutil.Must(newService(nil).Query(context.Background(), service.Query{Hashes: []multihash.Multihash{contentHash}}))(t)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		qr, err := newService(schedule).Query(ctx, service.Query{Hashes: []multihash.Multihash{contentHash}})
+		r := run{err: err, injected: schedule.Injected(op), cache: cache}
+		if err == nil {
+			for _, link := range qr.Claims() {
+				r.claims = append(r.claims, link.String())
+			}
+		}
+		return r
+	}
+
+	testCases := []struct {
+		name    string
+		rules   []faults.Rule
+		warm    bool
+		timeout time.Duration
+		// err is the error the query fails with, if it fails
+		err error
+		// partial is true if some claims are expected to be left out, one for
+		// each fault injected into the faulted operation
+		partial bool
+	}{
+		{
+			name: "no faults",
+		},
+		{
+			name:  "latency",
+			rules: []faults.Rule{{Op: "*", Kind: faults.Latency, Rate: 1, Delay: time.Millisecond}},
+		},
+		{
+			name:    "failed claim lookups",
+			rules:   []faults.Rule{{Op: faults.OpLookupClaim, Kind: faults.Error, Rate: 0.5}},
+			partial: true,
+		},
+		{
+			name:    "corrupt claim responses",
+			rules:   []faults.Rule{{Op: faults.OpHTTPRoundTrip, Kind: faults.Corrupt, Rate: 0.5}},
+			partial: true,
+		},
+		{
+			name:    "truncated claim responses",
+			rules:   []faults.Rule{{Op: faults.OpHTTPRoundTrip, Kind: faults.Truncate, Rate: 0.5}},
+			partial: true,
+		},
+		{
+			name:    "corrupt cache reads",
+			rules:   []faults.Rule{{Op: faults.OpRedisGet, Kind: faults.Corrupt, Rate: 0.5}},
+			warm:    true,
+			partial: true,
+		},
+		{
+			name:  "failed provider lookups",
+			rules: []faults.Rule{{Op: faults.OpFindProviders, Kind: faults.Error, Rate: 1}},
+			err:   faults.ErrInjected,
+		},
+		{
+			name:    "hung provider lookups",
+			rules:   []faults.Rule{{Op: faults.OpFindProviders, Kind: faults.Hang, Rate: 1}},
+			timeout: 50 * time.Millisecond,
+			err:     context.DeadlineExceeded,
+		},
+		{
+			name:    "hung claim fetches",
+			rules:   []faults.Rule{{Op: faults.OpHTTPRoundTrip, Kind: faults.Hang, Rate: 1}},
+			timeout: 50 * time.Millisecond,
+			err:     context.DeadlineExceeded,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+			timeout := tc.timeout
+			if timeout == 0 {
+				timeout = 10 * time.Second
+			}
+			op := ""
+			if len(tc.rules) > 0 {
+				op = tc.rules[0].Op
+			}
+
+			first := runQuery(t, faults.NewSchedule(1, tc.rules...), op, tc.warm, timeout)
+			if tc.err != nil {
+				require.ErrorIs(t, first.err, tc.err)
+			} else {
+				require.NoError(t, first.err)
+				if tc.partial {
+					require.NotZero(t, first.injected)
+					require.Less(t, first.injected, numClaims)
+				}
+				require.Len(t, first.claims, numClaims-first.injected)
+			}
+
+			// the same seed fails the same calls
+			second := runQuery(t, faults.NewSchedule(1, tc.rules...), op, tc.warm, timeout)
+			require.ElementsMatch(t, first.claims, second.claims)
+			require.Equal(t, first.injected, second.injected)
+
+			// only intact claims are cached
+			store := redis.NewContentClaimsStore(first.cache)
+			for key, claim := range claims {
+				cached, err := store.Get(context.Background(), claim.Link().(cidlink.Link).Cid)
+				if err != nil {
+					require.ErrorIs(t, err, types.ErrKeyNotFound, key)
+					continue
+				}
+				require.Equal(t, claim.Link(), cached.Link())
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+)
+
+// FindProviders returns the provider records of the claims for a hash, as an
+// IPNI indexer would: records of every claim protocol, whatever space they are
+// bound to. Records the provider index read from the legacy systems are only
+// returned if includeLegacy is set
+func (is *IndexingService) FindProviders(ctx context.Context, hash multihash.Multihash, includeLegacy bool) ([]model.ProviderResult, error) {
+	cfg := is.config.Load()
+	if !cfg.allowQuery() {
+		return nil, ErrQueryRateLimited
+	}
+	found, err := is.providerIndex.FindDetailed(ctx, providerindex.QueryKey{
+		Hash:         hash,
+		TargetClaims: metadata.ClaimCodes(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("finding providers of %s: %w", hash.B58String(), err)
+	}
+	if found.Source == providerindex.SourceLegacy && !includeLegacy {
+		return nil, nil
+	}
+	return found.Results, nil
+}
@@ -0,0 +1,43 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexingService__FindProviders(t *testing.T) {
+	claimed, legacy := testutil.RandomMultihash(), testutil.RandomMultihash()
+	providerIndex := &mockProviderIndex{
+		results: map[string][]model.ProviderResult{
+			string(claimed): {testutil.RandomProviderResult()},
+			string(legacy):  {testutil.RandomProviderResult()},
+		},
+		sources: map[string]providerindex.RecordSource{
+			string(claimed): providerindex.SourceIPNI,
+			string(legacy):  providerindex.SourceLegacy,
+		},
+	}
+	is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, nil, providerIndex))(t)
+
+	for _, tc := range []struct {
+		name          string
+		hash          []byte
+		includeLegacy bool
+		expected      []model.ProviderResult
+	}{
+		{name: "claim records are found", hash: claimed, expected: providerIndex.results[string(claimed)]},
+		{name: "legacy records are left out", hash: legacy},
+		{name: "legacy records are included", hash: legacy, includeLegacy: true, expected: providerIndex.results[string(legacy)]},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			results := testutil.Must(is.FindProviders(context.Background(), tc.hash, tc.includeLegacy))(t)
+			require.Equal(t, tc.expected, results)
+		})
+	}
+}
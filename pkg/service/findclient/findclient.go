@@ -0,0 +1,218 @@
+// Package findclient is a client of the IPNI find API that reads the provider
+// records of find responses as they arrive, so that responses too large to hold
+// in memory can be cut short once enough records have been read
+package findclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+
+	ipnifind "github.com/ipni/go-libipni/find/client"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	findPath = "multihash"
+	// ndjsonType is the media type of find responses streamed as one provider
+	// record per line
+	ndjsonType = "application/x-ndjson"
+)
+
+// Client finds the provider records of multihashes on an IPNI indexer
+type Client struct {
+	client  *http.Client
+	findURL *url.URL
+}
+
+var _ ipnifind.Finder = (*Client)(nil)
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithClient sends finds with the given HTTP client
+func WithClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.client = client
+	}
+}
+
+// New returns a client of the indexer at the given URL
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing indexer URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("indexer URL must have http or https scheme: %s", baseURL)
+	}
+	u.Path = ""
+	c := &Client{client: http.DefaultClient, findURL: u.JoinPath(findPath)}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Find returns every provider record for the hash. If there are none, an empty
+// response is returned
+func (c *Client) Find(ctx context.Context, hash multihash.Multihash) (*model.FindResponse, error) {
+	var results []model.ProviderResult
+	err := c.FindStream(ctx, hash, func(result model.ProviderResult) bool {
+		results = append(results, result)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return &model.FindResponse{}, nil
+	}
+	return &model.FindResponse{MultihashResults: []model.MultihashResult{{Multihash: hash, ProviderResults: results}}}, nil
+}
+
+// FindStream calls yield with each provider record for the hash as it is read
+// from the response, until yield returns false, at which point the rest of the
+// response is not read. Responses are asked for as NDJSON, one record per line,
+// and JSON find responses are read a record at a time too
+func (c *Client) FindStream(ctx context.Context, hash multihash.Multihash, yield func(model.ProviderResult) bool) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.findURL.JoinPath(hash.B58String()).String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", ndjsonType+", application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return fmt.Errorf("find query failed: %v", http.StatusText(resp.StatusCode))
+	}
+	dec := json.NewDecoder(resp.Body)
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == ndjsonType {
+		return readNDJSON(dec, yield)
+	}
+	return readFindResponse(dec, yield)
+}
+
+// errStop ends the reading of a response once yield returns false
+var errStop = errors.New("stop reading")
+
+func readNDJSON(dec *json.Decoder, yield func(model.ProviderResult) bool) error {
+	for {
+		var result model.ProviderResult
+		if err := dec.Decode(&result); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("decoding provider record: %w", err)
+		}
+		if !yield(result) {
+			return nil
+		}
+	}
+}
+
+// readFindResponse reads the provider records of a JSON find response one at a
+// time, skipping every other field
+func readFindResponse(dec *json.Decoder, yield func(model.ProviderResult) bool) error {
+	err := readObject(dec, func(key string) error {
+		if key != "MultihashResults" {
+			return skip(dec)
+		}
+		return readArray(dec, func() error {
+			return readObject(dec, func(key string) error {
+				if key != "ProviderResults" {
+					return skip(dec)
+				}
+				return readArray(dec, func() error {
+					var result model.ProviderResult
+					if err := dec.Decode(&result); err != nil {
+						return fmt.Errorf("decoding provider record: %w", err)
+					}
+					if !yield(result) {
+						return errStop
+					}
+					return nil
+				})
+			})
+		})
+	})
+	if errors.Is(err, errStop) {
+		return nil
+	}
+	return err
+}
+
+// readObject reads a JSON object, calling field with each key, which must
+// read the value of the key
+func readObject(dec *json.Decoder, field func(key string) error) error {
+	if err := expect(dec, json.Delim('{')); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("decoding find response: %w", err)
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("decoding find response: unexpected %v", tok)
+		}
+		if err := field(key); err != nil {
+			return err
+		}
+	}
+	return expect(dec, json.Delim('}'))
+}
+
+// readArray reads a JSON array, calling elem to read each of its elements.
+// A null array has no elements
+func readArray(dec *json.Decoder, elem func() error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("decoding find response: %w", err)
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('[') {
+		return fmt.Errorf("decoding find response: expected [, got %v", tok)
+	}
+	for dec.More() {
+		if err := elem(); err != nil {
+			return err
+		}
+	}
+	return expect(dec, json.Delim(']'))
+}
+
+func expect(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("decoding find response: %w", err)
+	}
+	if tok != delim {
+		return fmt.Errorf("decoding find response: expected %v, got %v", delim, tok)
+	}
+	return nil
+}
+
+func skip(dec *json.Decoder) error {
+	var value json.RawMessage
+	if err := dec.Decode(&value); err != nil {
+		return fmt.Errorf("decoding find response: %w", err)
+	}
+	return nil
+}
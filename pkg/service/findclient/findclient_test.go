@@ -0,0 +1,88 @@
+package findclient_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ipnifind "github.com/ipni/go-libipni/find/client"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/findclient"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/stretchr/testify/require"
+)
+
+var _ providerindex.StreamFinder = (*findclient.Client)(nil)
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	hash := testutil.RandomMultihash()
+	results := []model.ProviderResult{testutil.RandomProviderResult(), testutil.RandomProviderResult(), testutil.RandomProviderResult()}
+	// ndjson is whether the server streams records as NDJSON, as when asked to,
+	// or answers with a JSON find response regardless
+	ndjson := true
+	var accepted string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepted = r.Header.Get("Accept")
+		if r.URL.Path != "/multihash/"+hash.B58String() {
+			http.NotFound(w, r)
+			return
+		}
+		if !ndjson {
+			w.Header().Set("Content-Type", "application/json")
+			testutil.Must(w.Write(testutil.Must(model.MarshalFindResponse(&model.FindResponse{
+				MultihashResults: []model.MultihashResult{{Multihash: hash, ProviderResults: results}},
+			}))(t)))(t)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		enc := json.NewEncoder(w)
+		for _, result := range results {
+			require.NoError(t, enc.Encode(result))
+		}
+	}))
+	t.Cleanup(server.Close)
+	client := testutil.Must(findclient.New(server.URL, findclient.WithClient(server.Client())))(t)
+	stream := func(t *testing.T, hash multihash.Multihash, limit int) []model.ProviderResult {
+		var read []model.ProviderResult
+		require.NoError(t, client.FindStream(ctx, hash, func(result model.ProviderResult) bool {
+			read = append(read, result)
+			return len(read) < limit
+		}))
+		return read
+	}
+
+	for _, format := range []bool{true, false} {
+		ndjson = format
+		require.Equal(t, results, stream(t, hash, len(results)+1), "ndjson: %v", format)
+		require.Equal(t, results[:2], stream(t, hash, 2), "reading stops once yield returns false")
+		require.Contains(t, accepted, "application/x-ndjson")
+
+		fr := testutil.Must(client.Find(ctx, hash))(t)
+		require.Equal(t, results, fr.MultihashResults[0].ProviderResults)
+	}
+
+	// unknown hashes have no records
+	require.Empty(t, stream(t, testutil.RandomMultihash(), 1))
+	fr := testutil.Must(client.Find(ctx, testutil.RandomMultihash()))(t)
+	require.Empty(t, fr.MultihashResults)
+
+	// results are the same as those of the IPNI find client
+	ndjson = false
+	ipni := testutil.Must(ipnifind.New(server.URL, ipnifind.WithClient(server.Client())))(t)
+	require.Equal(t, testutil.Must(ipni.Find(ctx, hash))(t).MultihashResults[0].ProviderResults, testutil.Must(client.Find(ctx, hash))(t).MultihashResults[0].ProviderResults)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(failing.Close)
+	client = testutil.Must(findclient.New(failing.URL))(t)
+	require.Error(t, client.FindStream(ctx, hash, func(model.ProviderResult) bool { return true }))
+
+	_, err := findclient.New("ftp://indexer.example")
+	require.Error(t, err)
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultHedgeDelay is how long a fetch is given before it is hedged, while
+	// too few fetches from its host are known to hedge after their p95
+	DefaultHedgeDelay = 500 * time.Millisecond
+	// DefaultMaxHedges is the number of hedged fetches a single query may
+	// launch, when not otherwise configured
+	DefaultMaxHedges = 8
+	// minHedgeSamples is the number of fetches from a host needed before fetches
+	// from it are hedged after their p95
+	minHedgeSamples = 20
+	// maxHedgeSamples bounds the fetch durations kept per host
+	maxHedgeSamples = 128
+	// maxHedgeHosts bounds the hosts fetch durations are kept for
+	maxHedgeHosts = 1024
+)
+
+// Fetches that can be hedged, as reported to HedgeMetrics
+const (
+	HedgedClaimFetch = "claim"
+	HedgedIndexFetch = "index"
+)
+
+// HedgeMetrics is told about hedged fetches
+type HedgeMetrics interface {
+	// HedgeLaunched is called when a fetch is hedged by fetching from the next
+	// URL as well
+	HedgeLaunched(fetch string)
+	// HedgeWon is called when a hedged fetch completes before the fetch it
+	// hedged
+	HedgeWon(fetch string)
+}
+
+type noopHedgeMetrics struct{}
+
+func (noopHedgeMetrics) HedgeLaunched(string) {}
+func (noopHedgeMetrics) HedgeWon(string)      {}
+
+// WithHedging hedges fetches of claims and indexes that can be fetched from more
+// than one URL. When a fetch hasn't completed within the delay, the next URL is
+// fetched from as well, and whichever completes first is used, cancelling the
+// rest. A zero delay hedges after the p95 of recent fetches from the host, or
+// after DefaultHedgeDelay while too few are known. A query launches at most
+// maxPerQuery hedged fetches, or DefaultMaxHedges if it is zero. Hedged fetches
+// go through the same lookups as any other, so they count against the same
+// limits on requests to a host
+func WithHedging(delay time.Duration, maxPerQuery int) Option {
+	return func(is *IndexingService) {
+		if maxPerQuery <= 0 {
+			maxPerQuery = DefaultMaxHedges
+		}
+		is.hedging = &hedging{delay: delay, maxPerQuery: int32(maxPerQuery), hosts: map[string][]time.Duration{}}
+	}
+}
+
+// WithHedgeMetrics reports hedged fetches to the given metrics
+func WithHedgeMetrics(m HedgeMetrics) Option {
+	return func(is *IndexingService) {
+		is.hedgeMetrics = m
+	}
+}
+
+// hedging holds the recent fetch durations of each host, to hedge fetches after
+type hedging struct {
+	delay       time.Duration
+	maxPerQuery int32
+	lk          sync.Mutex
+	hosts       map[string][]time.Duration
+}
+
+// after returns how long a fetch from the host is given before it is hedged
+func (h *hedging) after(host string) time.Duration {
+	if h.delay > 0 {
+		return h.delay
+	}
+	h.lk.Lock()
+	durations := slices.Clone(h.hosts[host])
+	h.lk.Unlock()
+	if len(durations) < minHedgeSamples {
+		return DefaultHedgeDelay
+	}
+	slices.Sort(durations)
+	return durations[(len(durations)*95-1)/100]
+}
+
+// observe records how long a successful fetch from the host took
+func (h *hedging) observe(host string, d time.Duration) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	durations, ok := h.hosts[host]
+	if !ok && len(h.hosts) >= maxHedgeHosts {
+		// forget some host, rather than growing without bound
+		for other := range h.hosts {
+			delete(h.hosts, other)
+			break
+		}
+	}
+	durations = append(durations, d)
+	if len(durations) > maxHedgeSamples {
+		durations = slices.Delete(durations, 0, len(durations)-maxHedgeSamples)
+	}
+	h.hosts[host] = durations
+}
+
+type hedgeBudgetKey struct{}
+
+// withHedgeBudget returns a context for a query, under which at most the
+// configured number of hedged fetches are launched
+func (h *hedging) withHedgeBudget(ctx context.Context) context.Context {
+	budget := &atomic.Int32{}
+	budget.Store(h.maxPerQuery)
+	return context.WithValue(ctx, hedgeBudgetKey{}, budget)
+}
+
+// takeHedge claims a hedged fetch from the budget of the query, returning false
+// if there is none left
+func takeHedge(ctx context.Context) bool {
+	budget, ok := ctx.Value(hedgeBudgetKey{}).(*atomic.Int32)
+	if !ok {
+		return false
+	}
+	return budget.Add(-1) >= 0
+}
+
+// fetchAttempt is the outcome of a fetch from one of several sources
+type fetchAttempt[T any] struct {
+	source   int
+	value    T
+	err      error
+	duration time.Duration
+}
+
+// fetchFirst fetches from each of the sources, given by the hosts they are
+// fetched from, until a fetch succeeds, returning the value and the source it
+// was fetched from. A failed fetch fails over to the next source. With hedging,
+// a fetch that hasn't completed within the hedge delay is joined by a fetch
+// from the next source, and the fetches that lose are cancelled. Every fetch
+// but the last is cut short by the URL timeout. Each fetch that completes before
+// the value is returned is observed, and the errors of failed fetches are
+// joined if none succeeds
+func fetchFirst[T any](ctx context.Context, is *IndexingService, kind string, hosts []string, fetch func(ctx context.Context, source int) (T, error), observe func(source int, duration time.Duration, err error)) (T, int, error) {
+	var zero T
+	if len(hosts) == 0 {
+		return zero, 0, errors.New("nothing to fetch from")
+	}
+	results := make(chan fetchAttempt[T], len(hosts))
+	var cancels []context.CancelFunc
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+	hedged := map[int]bool{}
+	next, running := 0, 0
+	var lastStart time.Time
+	start := func() {
+		attemptCtx, cancel := is.attemptContext(ctx, next == len(hosts)-1)
+		cancels = append(cancels, cancel)
+		source := next
+		lastStart = time.Now()
+		go func() {
+			begin := time.Now()
+			value, err := fetch(attemptCtx, source)
+			results <- fetchAttempt[T]{source, value, err, time.Since(begin)}
+		}()
+		next++
+		running++
+	}
+	start()
+	// fetches are only hedged while the query has budget for them
+	hedging := is.hedging != nil
+	var errs []error
+	for running > 0 {
+		var hedgeTimer <-chan time.Time
+		stop := func() bool { return false }
+		if hedging && next < len(hosts) {
+			timer := time.NewTimer(is.hedging.after(hosts[next-1]) - time.Since(lastStart))
+			hedgeTimer, stop = timer.C, timer.Stop
+		}
+		select {
+		case attempt := <-results:
+			stop()
+			running--
+			observe(attempt.source, attempt.duration, attempt.err)
+			if attempt.err == nil {
+				if is.hedging != nil {
+					is.hedging.observe(hosts[attempt.source], attempt.duration)
+				}
+				if hedged[attempt.source] {
+					is.hedgeMetrics.HedgeWon(kind)
+				}
+				return attempt.value, attempt.source, nil
+			}
+			if ctx.Err() != nil {
+				return zero, 0, ctx.Err()
+			}
+			errs = append(errs, attempt.err)
+			if next < len(hosts) && running == 0 {
+				start()
+			}
+		case <-hedgeTimer:
+			if !takeHedge(ctx) {
+				hedging = false
+				continue
+			}
+			is.hedgeMetrics.HedgeLaunched(kind)
+			hedged[next] = true
+			start()
+		case <-ctx.Done():
+			stop()
+			return zero, 0, ctx.Err()
+		}
+	}
+	return zero, 0, errors.Join(errs...)
+}
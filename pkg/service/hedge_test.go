@@ -0,0 +1,133 @@
+package service_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/blobindexlookup"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/stretchr/testify/require"
+)
+
+// stalledServer never answers, counting the requests made to it and those
+// given up on
+type stalledServer struct {
+	*httptest.Server
+	requests  atomic.Int32
+	cancelled atomic.Int32
+}
+
+func newStalledServer(t *testing.T) *stalledServer {
+	s := &stalledServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		<-r.Context().Done()
+		s.cancelled.Add(1)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *stalledServer) url(t *testing.T) *url.URL {
+	return testutil.Must(url.Parse(s.URL + "/index"))(t)
+}
+
+type mockHedgeMetrics struct {
+	lk       sync.Mutex
+	launched map[string]int
+	won      map[string]int
+}
+
+func (m *mockHedgeMetrics) HedgeLaunched(fetch string) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.launched[fetch]++
+}
+
+func (m *mockHedgeMetrics) HedgeWon(fetch string) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.won[fetch]++
+}
+
+func TestIndexingService__Hedging(t *testing.T) {
+	f := newClaimFixture(t)
+	contentHash, indexCid := testutil.RandomMultihash(), testutil.RandomCID().(cidlink.Link).Cid
+	index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 1)
+	index.SetSlice(testutil.RandomMultihash(), contentHash, blobindex.Position{Offset: 0, Length: 10})
+	archive := testutil.Must(io.ReadAll(testutil.Must(blobindex.Archive(index))(t)))(t)
+	indexClaim := f.newClaim(t)
+	// the provider serves claims, but not blobs, so the index can only be
+	// fetched from the URLs of the commitment
+	provider := &peer.AddrInfo{ID: f.provider.ID, Addrs: f.provider.Addrs[:1]}
+
+	query := func(t *testing.T, indexURLs []*url.URL, opts ...service.Option) (indexes int, metrics *mockHedgeMetrics) {
+		indexLocation := f.addClaim(t, locationsDelegation(t, indexCid.Hash(), indexURLs...))
+		results := map[string][]model.ProviderResult{
+			string(contentHash):     {f.result(t, testutil.RandomBytes(10), &metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaim})},
+			string(indexCid.Hash()): {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: indexLocation})},
+		}
+		for hash, records := range results {
+			for i := range records {
+				records[i].Provider = provider
+			}
+			results[hash] = records
+		}
+		metrics = &mockHedgeMetrics{launched: map[string]int{}, won: map[string]int{}}
+		providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: results, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		is := testutil.Must(service.NewIndexingService(blobindexlookup.NewBlobIndexLookup(http.DefaultClient), claimlookup.NewClaimLookup(http.DefaultClient), providerIndex, append(opts, service.WithHedgeMetrics(metrics))...))(t)
+		qr := testutil.Must(is.Query(context.Background(), service.Query{Hashes: []multihash.Multihash{contentHash}}))(t)
+		return len(qr.Indexes()), metrics
+	}
+
+	t.Run("a slow fetch is hedged by the next URL", func(t *testing.T) {
+		stalled := newStalledServer(t)
+		serving := newCountingServer(t, 0, func(*http.Request) []byte { return archive })
+		start := time.Now()
+		indexes, metrics := query(t, []*url.URL{stalled.url(t), serving.url(t, "/index")}, service.WithURLTimeout(time.Minute), service.WithHedging(20*time.Millisecond, 0))
+		require.Less(t, time.Since(start), 10*time.Second)
+		require.Equal(t, 1, indexes)
+		require.Equal(t, int32(1), serving.requests.Load())
+		require.Equal(t, map[string]int{service.HedgedIndexFetch: 1}, metrics.launched)
+		require.Equal(t, map[string]int{service.HedgedIndexFetch: 1}, metrics.won)
+		// the fetch that lost is cancelled
+		require.Eventually(t, func() bool { return stalled.cancelled.Load() == 1 }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("a query launches at most the hedges allowed", func(t *testing.T) {
+		first, second := newStalledServer(t), newStalledServer(t)
+		serving := newCountingServer(t, 0, func(*http.Request) []byte { return archive })
+		indexes, metrics := query(t, []*url.URL{first.url(t), second.url(t), serving.url(t, "/index")}, service.WithURLTimeout(200*time.Millisecond), service.WithHedging(20*time.Millisecond, 1))
+		require.Equal(t, 1, indexes)
+		require.Equal(t, int32(1), first.requests.Load())
+		require.Equal(t, int32(1), second.requests.Load())
+		// the last URL is only fetched from once the others time out
+		require.Equal(t, map[string]int{service.HedgedIndexFetch: 1}, metrics.launched)
+		require.Empty(t, metrics.won)
+	})
+
+	t.Run("fetches are not hedged without hedging", func(t *testing.T) {
+		stalled := newStalledServer(t)
+		serving := newCountingServer(t, 0, func(*http.Request) []byte { return archive })
+		indexes, metrics := query(t, []*url.URL{stalled.url(t), serving.url(t, "/index")}, service.WithURLTimeout(100*time.Millisecond))
+		require.Equal(t, 1, indexes)
+		require.Eventually(t, func() bool { return stalled.cancelled.Load() == 1 }, time.Second, 10*time.Millisecond)
+		require.Empty(t, metrics.launched)
+	})
+}
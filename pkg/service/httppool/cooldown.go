@@ -0,0 +1,234 @@
+package httppool
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxCooldown is the longest a host is left alone for when not
+	// otherwise configured, however long it asks for
+	DefaultMaxCooldown = 5 * time.Minute
+	// DefaultBaseBackoff is how long a host is left alone for after it first
+	// throttles without saying for how long, or fails too many times in a row,
+	// when not otherwise configured. It doubles each time it happens again
+	DefaultBaseBackoff = time.Second
+	// DefaultFailureThreshold is the number of server errors in a row from a
+	// host before it is backed off from, when not otherwise configured
+	DefaultFailureThreshold = 3
+	// maxTrackedHosts bounds the hosts whose failures are remembered, beyond
+	// which hosts that aren't cooling down are forgotten
+	maxTrackedHosts = 4096
+)
+
+// ErrProviderCoolingDown is returned for requests to a host that is cooling
+// down, because it asked for fewer requests with a 429 or 503 response, or
+// failed too many times in a row. The request is not sent
+type ErrProviderCoolingDown struct {
+	Host  string
+	Until time.Time
+}
+
+func (e ErrProviderCoolingDown) Error() string {
+	return fmt.Sprintf("%s is cooling down until %s", e.Host, e.Until.Format(time.RFC3339))
+}
+
+type (
+	// CooldownOption configures Cooldowns
+	CooldownOption func(*Cooldowns)
+
+	// Cooldowns is a table of the hosts requests shouldn't be sent to until a
+	// time, from their Retry-After headers, or backoff when they fail
+	// repeatedly. It is safe for concurrent use, and meant to be shared by every
+	// pool of the process, so that all requests to a host back off together
+	Cooldowns struct {
+		max       time.Duration
+		base      time.Duration
+		threshold int
+		now       func() time.Time
+
+		lk    sync.Mutex
+		hosts map[string]*hostCooldown
+	}
+
+	hostCooldown struct {
+		until time.Time
+		// failures are the responses in a row the host failed or throttled
+		failures int
+	}
+)
+
+// WithMaxCooldown sets the longest a host is left alone for, however long it
+// asks for
+func WithMaxCooldown(d time.Duration) CooldownOption {
+	return func(c *Cooldowns) {
+		c.max = d
+	}
+}
+
+// WithBaseBackoff sets how long a host is left alone for after it first
+// throttles without saying for how long, or fails too many times in a row
+func WithBaseBackoff(d time.Duration) CooldownOption {
+	return func(c *Cooldowns) {
+		c.base = d
+	}
+}
+
+// WithFailureThreshold sets the number of server errors in a row from a host
+// before it is backed off from
+func WithFailureThreshold(n int) CooldownOption {
+	return func(c *Cooldowns) {
+		c.threshold = n
+	}
+}
+
+// WithClock sets the source of the current time
+func WithClock(now func() time.Time) CooldownOption {
+	return func(c *Cooldowns) {
+		c.now = now
+	}
+}
+
+// NewCooldowns returns an empty cooldown table
+func NewCooldowns(opts ...CooldownOption) *Cooldowns {
+	c := &Cooldowns{
+		max:       DefaultMaxCooldown,
+		base:      DefaultBaseBackoff,
+		threshold: DefaultFailureThreshold,
+		now:       time.Now,
+		hosts:     map[string]*hostCooldown{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Until returns when the host stops cooling down, and whether it is cooling
+// down now
+func (c *Cooldowns) Until(host string) (time.Time, bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	h, ok := c.hosts[host]
+	if !ok || !c.now().Before(h.until) {
+		return time.Time{}, false
+	}
+	return h.until, true
+}
+
+// Hosts returns the hosts cooling down now, and when each stops
+func (c *Cooldowns) Hosts() map[string]time.Time {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	now := c.now()
+	hosts := map[string]time.Time{}
+	for host, h := range c.hosts {
+		if now.Before(h.until) {
+			hosts[host] = h.until
+		}
+	}
+	return hosts
+}
+
+// Observe records the response of a host, returning how long it is to cool
+// down for if the response starts or extends a cooldown
+func (c *Cooldowns) Observe(host string, resp *http.Response) (time.Duration, bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	now := c.now()
+	h, ok := c.hosts[host]
+	switch code := resp.StatusCode; {
+	case throttled(resp):
+		h = c.track(host, h)
+		h.failures++
+		d, ok := retryAfter(resp.Header.Get("Retry-After"), now)
+		if !ok {
+			d = c.backoff(h.failures - 1)
+		}
+		return c.coolDown(h, now, d)
+	case code >= 500:
+		h = c.track(host, h)
+		h.failures++
+		if h.failures < c.threshold {
+			return 0, false
+		}
+		return c.coolDown(h, now, c.backoff(h.failures-c.threshold))
+	default:
+		if ok && !now.Before(h.until) {
+			delete(c.hosts, host)
+		} else if ok {
+			h.failures = 0
+		}
+		return 0, false
+	}
+}
+
+// throttled returns true for responses asking for fewer requests
+func throttled(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// track returns the entry of the host, adding one if it has none
+func (c *Cooldowns) track(host string, h *hostCooldown) *hostCooldown {
+	if h != nil {
+		return h
+	}
+	if len(c.hosts) >= maxTrackedHosts {
+		now := c.now()
+		for other, o := range c.hosts {
+			if !now.Before(o.until) {
+				delete(c.hosts, other)
+			}
+		}
+	}
+	h = &hostCooldown{}
+	c.hosts[host] = h
+	return h
+}
+
+// coolDown leaves the host alone for d from now, capped at the maximum, unless
+// it is already cooling down for longer
+func (c *Cooldowns) coolDown(h *hostCooldown, now time.Time, d time.Duration) (time.Duration, bool) {
+	d = min(d, c.max)
+	until := now.Add(d)
+	if d <= 0 || !until.After(h.until) {
+		return 0, false
+	}
+	h.until = until
+	return d, true
+}
+
+// backoff returns the base backoff doubled n times, capped at the maximum
+func (c *Cooldowns) backoff(n int) time.Duration {
+	d := c.base
+	for range n {
+		if d >= c.max {
+			break
+		}
+		d *= 2
+	}
+	return min(d, c.max)
+}
+
+// retryAfter parses a Retry-After header, in seconds or as an HTTP date
+func retryAfter(header string, now time.Time) (time.Duration, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(header, 10, 64); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(min(secs, int64(time.Duration(1<<62)/time.Second))) * time.Second, true
+	}
+	at, err := http.ParseTime(header)
+	if err != nil {
+		return 0, false
+	}
+	return at.Sub(now), true
+}
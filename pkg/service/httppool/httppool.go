@@ -0,0 +1,384 @@
+// Package httppool shares outbound HTTP connections between the components of
+// the service, so that bursts of fetches from the same provider reuse a bounded
+// number of connections rather than each opening their own
+package httppool
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxConnsPerHost is the number of connections that may be open to a
+	// host at once when not otherwise configured. Requests beyond it wait for a
+	// connection to be free
+	DefaultMaxConnsPerHost = 32
+	// DefaultMaxIdleConnsPerHost is the number of idle connections kept open to
+	// a host for reuse when not otherwise configured
+	DefaultMaxIdleConnsPerHost = 16
+	// DefaultIdleConnTimeout is how long an idle connection is kept open when
+	// not otherwise configured
+	DefaultIdleConnTimeout = 90 * time.Second
+)
+
+// Metrics is told about the connections and requests of a pool
+type Metrics interface {
+	// Conns is called with the number of connections open to a host and port
+	// whenever it changes
+	Conns(host string, open int)
+	// Waited is called with how long a request waited for a slot under the
+	// limit of its host, for hosts with a limit
+	Waited(host string, wait time.Duration)
+	// CooledDown is called when a host starts cooling down for a duration, for
+	// pools with cooldowns
+	CooledDown(host string, d time.Duration)
+	// Refused is called for a request that isn't sent because its host is
+	// cooling down
+	Refused(host string)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) Conns(string, int) {}
+
+func (noopMetrics) Waited(string, time.Duration) {}
+
+func (noopMetrics) CooledDown(string, time.Duration) {}
+
+func (noopMetrics) Refused(string) {}
+
+// DialFunc connects to an address
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+type (
+	// Option configures a Pool
+	Option func(*Pool)
+
+	// Pool owns an HTTP client whose transport bounds the connections open to
+	// each host, and limits the requests in flight to hosts known to throttle
+	Pool struct {
+		maxConnsPerHost     int
+		maxIdleConnsPerHost int
+		idleConnTimeout     time.Duration
+		http2               bool
+		dial                DialFunc
+		proxy               *ProxyConfig
+		checkDestination    func(ctx context.Context, host string) error
+		tlsConfig           *tls.Config
+		transport           http.RoundTripper
+		hostLimits          map[string]int
+		cooldowns           *Cooldowns
+		metrics             Metrics
+		client              *http.Client
+
+		lk    sync.Mutex
+		conns map[string]int
+		slots map[string]chan struct{}
+	}
+
+	// Stats are the connections and requests of a pool at a point in time
+	Stats struct {
+		// Conns are the connections open, by the host and port dialed. They are
+		// only counted for pools that dial their own connections
+		Conns map[string]int
+		// Requests are the requests holding a slot under the limit of their host,
+		// by host
+		Requests map[string]int
+		// Cooldowns are when the hosts cooling down stop, by host, for pools with
+		// cooldowns
+		Cooldowns map[string]time.Time
+	}
+)
+
+// WithMaxConnsPerHost sets the number of connections that may be open to a host
+// at once. Zero is unlimited
+func WithMaxConnsPerHost(n int) Option {
+	return func(p *Pool) {
+		p.maxConnsPerHost = n
+	}
+}
+
+// WithMaxIdleConnsPerHost sets the number of idle connections kept open to a
+// host for reuse
+func WithMaxIdleConnsPerHost(n int) Option {
+	return func(p *Pool) {
+		p.maxIdleConnsPerHost = n
+	}
+}
+
+// WithIdleConnTimeout sets how long an idle connection is kept open
+func WithIdleConnTimeout(d time.Duration) Option {
+	return func(p *Pool) {
+		p.idleConnTimeout = d
+	}
+}
+
+// WithHTTP2 sets whether HTTP/2 is negotiated with hosts that support it, which
+// multiplexes requests to a host over fewer connections. It is by default
+func WithHTTP2(enabled bool) Option {
+	return func(p *Pool) {
+		p.http2 = enabled
+	}
+}
+
+// WithDialContext sets how connections are made, such as to only connect to
+// addresses an address policy allows. Requests are only sent through a proxy
+// when it is set if one is given with WithProxy, as a proxy from the
+// environment would connect on our behalf without it
+func WithDialContext(dial DialFunc) Option {
+	return func(p *Pool) {
+		p.dial = dial
+	}
+}
+
+// WithTLSConfig sets the TLS config connections to hosts and proxies are made
+// with, such as the roots of a proxy that intercepts TLS
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(p *Pool) {
+		p.tlsConfig = cfg
+	}
+}
+
+// WithTransport sends requests with the given transport instead of one the
+// pool configures, such as the transport of an httptest server's client. The
+// transport settings of the pool don't apply to it, but host limits still do
+func WithTransport(rt http.RoundTripper) Option {
+	return func(p *Pool) {
+		p.transport = rt
+	}
+}
+
+// WithHostLimit limits the requests in flight to a host at once, for providers
+// known to throttle. A request holds its slot until its response body is
+// closed. The host is matched against the host of request URLs, including any
+// port
+func WithHostLimit(host string, n int) Option {
+	return func(p *Pool) {
+		p.hostLimits[host] = n
+	}
+}
+
+// WithCooldowns backs off from hosts that throttle or fail repeatedly, using
+// the given table, which pools may share. While a host is cooling down, requests
+// to it fail with ErrProviderCoolingDown without being sent. A 429 or 503
+// response that starts a cooldown fails the same way
+func WithCooldowns(c *Cooldowns) Option {
+	return func(p *Pool) {
+		p.cooldowns = c
+	}
+}
+
+// WithMetrics reports the connections and requests of the pool to the given
+// metrics
+func WithMetrics(m Metrics) Option {
+	return func(p *Pool) {
+		p.metrics = m
+	}
+}
+
+// New returns a new pool
+func New(opts ...Option) *Pool {
+	p := &Pool{
+		maxConnsPerHost:     DefaultMaxConnsPerHost,
+		maxIdleConnsPerHost: DefaultMaxIdleConnsPerHost,
+		idleConnTimeout:     DefaultIdleConnTimeout,
+		http2:               true,
+		hostLimits:          map[string]int{},
+		metrics:             noopMetrics{},
+		conns:               map[string]int{},
+		slots:               map[string]chan struct{}{},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	for host, n := range p.hostLimits {
+		if n > 0 {
+			p.slots[host] = make(chan struct{}, n)
+		}
+	}
+	rt := p.transport
+	if rt == nil {
+		rt = p.newTransport()
+		if p.proxy != nil {
+			rt = &proxiedTransport{proxy: p.proxy, transport: rt}
+		}
+	}
+	p.client = &http.Client{Transport: &limitedTransport{pool: p, transport: rt}}
+	return p
+}
+
+func (p *Pool) newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = p.maxConnsPerHost
+	transport.MaxIdleConnsPerHost = p.maxIdleConnsPerHost
+	if transport.MaxIdleConns < p.maxIdleConnsPerHost {
+		transport.MaxIdleConns = p.maxIdleConnsPerHost
+	}
+	transport.IdleConnTimeout = p.idleConnTimeout
+	transport.ForceAttemptHTTP2 = p.http2
+	if !p.http2 {
+		// a non-nil empty map stops HTTP/2 being negotiated
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if p.tlsConfig != nil {
+		transport.TLSClientConfig = p.tlsConfig.Clone()
+	}
+	direct := (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	dial := p.dial
+	if dial != nil {
+		transport.Proxy = nil
+	} else {
+		dial = direct
+	}
+	var proxies map[string]string
+	if p.proxy != nil {
+		transport.Proxy = p.proxyFor
+		transport.OnProxyConnectResponse = proxyConnectResponse
+		proxies = p.proxy.proxies()
+	}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dial := dial
+		proxy, isProxy := proxies[address]
+		if isProxy {
+			dial = direct
+		}
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			if isProxy {
+				return nil, ErrProviderUnreachable{Proxy: proxy, Err: err}
+			}
+			return nil, err
+		}
+		p.opened(address)
+		return &countedConn{Conn: conn, closed: func() { p.closed(address) }}, nil
+	}
+	return transport
+}
+
+// Client returns the client requests of the pool are sent with
+func (p *Pool) Client() *http.Client {
+	return p.client
+}
+
+// Stats returns the connections and requests of the pool now
+func (p *Pool) Stats() Stats {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	stats := Stats{Conns: make(map[string]int, len(p.conns)), Requests: make(map[string]int, len(p.slots))}
+	for host, n := range p.conns {
+		stats.Conns[host] = n
+	}
+	for host, slots := range p.slots {
+		stats.Requests[host] = len(slots)
+	}
+	if p.cooldowns != nil {
+		stats.Cooldowns = p.cooldowns.Hosts()
+	}
+	return stats
+}
+
+func (p *Pool) opened(address string) {
+	p.lk.Lock()
+	p.conns[address]++
+	open := p.conns[address]
+	p.lk.Unlock()
+	p.metrics.Conns(address, open)
+}
+
+func (p *Pool) closed(address string) {
+	p.lk.Lock()
+	p.conns[address]--
+	open := p.conns[address]
+	if open == 0 {
+		delete(p.conns, address)
+	}
+	p.lk.Unlock()
+	p.metrics.Conns(address, open)
+}
+
+// countedConn is a connection counted as open until it is first closed
+type countedConn struct {
+	net.Conn
+	once   sync.Once
+	closed func()
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(c.closed)
+	return c.Conn.Close()
+}
+
+// limitedTransport holds a slot under the limit of the host of each request,
+// for hosts with a limit, until its response body is closed. With cooldowns,
+// requests to hosts cooling down are refused, and responses are recorded
+type limitedTransport struct {
+	pool      *Pool
+	transport http.RoundTripper
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cooldowns := t.pool.cooldowns
+	if cooldowns == nil {
+		return t.roundTrip(req)
+	}
+	host := req.URL.Host
+	if until, ok := cooldowns.Until(host); ok {
+		t.pool.metrics.Refused(host)
+		return nil, ErrProviderCoolingDown{Host: host, Until: until}
+	}
+	resp, err := t.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := cooldowns.Observe(host, resp)
+	if !ok {
+		return resp, nil
+	}
+	t.pool.metrics.CooledDown(host, d)
+	// a host throttling the request has asked for it not to be sent, so it
+	// fails like the requests that follow it
+	if throttled(resp) {
+		resp.Body.Close()
+		until, _ := cooldowns.Until(host)
+		return nil, ErrProviderCoolingDown{Host: host, Until: until}
+	}
+	return resp, nil
+}
+
+func (t *limitedTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	slots, ok := t.pool.slots[req.URL.Host]
+	if !ok {
+		return t.transport.RoundTrip(req)
+	}
+	start := time.Now()
+	select {
+	case slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	t.pool.metrics.Waited(req.URL.Host, time.Since(start))
+	var once sync.Once
+	release := func() { once.Do(func() { <-slots }) }
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
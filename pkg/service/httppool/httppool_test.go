@@ -0,0 +1,304 @@
+package httppool_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/httppool"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProvider is a server counting the most connections and requests it has
+// had open at once
+type fakeProvider struct {
+	*httptest.Server
+	lk                     sync.Mutex
+	conns, peakConns       int
+	requests, peakRequests atomic.Int32
+}
+
+func newFakeProvider(t testing.TB, delay time.Duration) *fakeProvider {
+	p := &fakeProvider{}
+	p.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := p.requests.Add(1)
+		defer p.requests.Add(-1)
+		for {
+			peak := p.peakRequests.Load()
+			if n <= peak || p.peakRequests.CompareAndSwap(peak, n) {
+				break
+			}
+		}
+		time.Sleep(delay)
+		w.Write([]byte("claim"))
+	}))
+	p.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		p.lk.Lock()
+		defer p.lk.Unlock()
+		switch state {
+		case http.StateNew:
+			p.conns++
+			p.peakConns = max(p.peakConns, p.conns)
+		case http.StateClosed, http.StateHijacked:
+			p.conns--
+		}
+	}
+	p.Start()
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *fakeProvider) peak() int {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return p.peakConns
+}
+
+// fetchAll fetches from the URL n times at once, returning the first error
+func fetchAll(client *http.Client, u string, n int) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(u)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+			if _, err := io.ReadAll(resp.Body); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+type recordingMetrics struct {
+	lk       sync.Mutex
+	conns    map[string]int
+	waits    int
+	cooled   int
+	refusals int
+}
+
+func (m *recordingMetrics) Conns(host string, open int) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.conns[host] = max(m.conns[host], open)
+}
+
+func (m *recordingMetrics) Waited(string, time.Duration) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.waits++
+}
+
+func (m *recordingMetrics) CooledDown(string, time.Duration) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.cooled++
+}
+
+func (m *recordingMetrics) Refused(string) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.refusals++
+}
+
+func TestPool(t *testing.T) {
+	provider := newFakeProvider(t, 5*time.Millisecond)
+	metrics := &recordingMetrics{conns: map[string]int{}}
+	pool := httppool.New(httppool.WithMaxConnsPerHost(8), httppool.WithMetrics(metrics))
+	require.NoError(t, fetchAll(pool.Client(), provider.URL, 500))
+	require.LessOrEqual(t, provider.peak(), 8)
+	host := provider.Listener.Addr().String()
+	require.Positive(t, metrics.conns[host])
+	require.LessOrEqual(t, metrics.conns[host], 8)
+	// connections are kept for reuse
+	require.Positive(t, pool.Stats().Conns[host])
+	require.Zero(t, metrics.waits)
+
+	t.Run("host limits", func(t *testing.T) {
+		provider := newFakeProvider(t, 5*time.Millisecond)
+		host := testURLHost(t, provider.URL)
+		metrics := &recordingMetrics{conns: map[string]int{}}
+		// a transport of the test's own, such as one an httptest server provides
+		pool := httppool.New(httppool.WithTransport(provider.Client().Transport), httppool.WithHostLimit(host, 2), httppool.WithMetrics(metrics))
+		require.NoError(t, fetchAll(pool.Client(), provider.URL, 50))
+		require.LessOrEqual(t, provider.peakRequests.Load(), int32(2))
+		require.Equal(t, 50, metrics.waits)
+		require.Zero(t, pool.Stats().Requests[host])
+	})
+
+	t.Run("waiting for a slot is cancelled with the request", func(t *testing.T) {
+		provider := newFakeProvider(t, 200*time.Millisecond)
+		host := testURLHost(t, provider.URL)
+		pool := httppool.New(httppool.WithHostLimit(host, 1))
+		go fetchAll(pool.Client(), provider.URL, 1)
+		require.Eventually(t, func() bool { return pool.Stats().Requests[host] == 1 }, time.Second, time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, provider.URL, nil)
+		require.NoError(t, err)
+		_, err = pool.Client().Do(req)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestPool__Cooldowns(t *testing.T) {
+	// scriptedHost responds with each of the statuses in turn, then with 200
+	type scriptedHost struct {
+		*httptest.Server
+		requests atomic.Int32
+	}
+	newScriptedHost := func(t *testing.T, retryAfter string, statuses ...int) *scriptedHost {
+		h := &scriptedHost{}
+		h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := int(h.requests.Add(1))
+			if n <= len(statuses) {
+				if retryAfter != "" {
+					w.Header().Set("Retry-After", retryAfter)
+				}
+				w.WriteHeader(statuses[n-1])
+				return
+			}
+			w.Write([]byte("claim"))
+		}))
+		t.Cleanup(h.Close)
+		return h
+	}
+	get := func(client *http.Client, u string) (int, error) {
+		resp, err := client.Get(u)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	var lk sync.Mutex
+	now := time.Now()
+	clock := func() time.Time {
+		lk.Lock()
+		defer lk.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		lk.Lock()
+		defer lk.Unlock()
+		now = now.Add(d)
+	}
+
+	t.Run("requests wait out Retry-After without being sent", func(t *testing.T) {
+		host := newScriptedHost(t, "30", http.StatusTooManyRequests)
+		metrics := &recordingMetrics{conns: map[string]int{}}
+		pool := httppool.New(httppool.WithCooldowns(httppool.NewCooldowns(httppool.WithClock(clock))), httppool.WithMetrics(metrics))
+
+		_, err := get(pool.Client(), host.URL)
+		var cooling httppool.ErrProviderCoolingDown
+		require.ErrorAs(t, err, &cooling)
+		require.Equal(t, clock().Add(30*time.Second), cooling.Until)
+		for range 5 {
+			_, err := get(pool.Client(), host.URL)
+			require.ErrorAs(t, err, &cooling)
+		}
+		require.Equal(t, int32(1), host.requests.Load())
+		require.Equal(t, 1, metrics.cooled)
+		require.Equal(t, 5, metrics.refusals)
+		require.Equal(t, map[string]time.Time{testURLHost(t, host.URL): cooling.Until}, pool.Stats().Cooldowns)
+
+		advance(30 * time.Second)
+		code := testutil.Must(get(pool.Client(), host.URL))(t)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, int32(2), host.requests.Load())
+		require.Empty(t, pool.Stats().Cooldowns)
+	})
+
+	t.Run("cooldowns are shared between pools", func(t *testing.T) {
+		host := newScriptedHost(t, "30", http.StatusServiceUnavailable)
+		cooldowns := httppool.NewCooldowns(httppool.WithClock(clock))
+		indexers := httppool.New(httppool.WithCooldowns(cooldowns))
+		providers := httppool.New(httppool.WithCooldowns(cooldowns))
+		_, err := get(indexers.Client(), host.URL)
+		require.ErrorAs(t, err, &httppool.ErrProviderCoolingDown{})
+		_, err = get(providers.Client(), host.URL)
+		require.ErrorAs(t, err, &httppool.ErrProviderCoolingDown{})
+		require.Equal(t, int32(1), host.requests.Load())
+		advance(30 * time.Second)
+	})
+
+	t.Run("cooldowns are capped", func(t *testing.T) {
+		host := newScriptedHost(t, "3600", http.StatusTooManyRequests)
+		pool := httppool.New(httppool.WithCooldowns(httppool.NewCooldowns(httppool.WithClock(clock), httppool.WithMaxCooldown(time.Minute))))
+		_, err := get(pool.Client(), host.URL)
+		var cooling httppool.ErrProviderCoolingDown
+		require.ErrorAs(t, err, &cooling)
+		require.Equal(t, clock().Add(time.Minute), cooling.Until)
+		advance(time.Minute)
+		require.Equal(t, http.StatusOK, testutil.Must(get(pool.Client(), host.URL))(t))
+	})
+
+	t.Run("repeated server errors back off", func(t *testing.T) {
+		host := newScriptedHost(t, "", http.StatusInternalServerError, http.StatusBadGateway, http.StatusInternalServerError, http.StatusInternalServerError)
+		pool := httppool.New(httppool.WithCooldowns(httppool.NewCooldowns(httppool.WithClock(clock), httppool.WithFailureThreshold(3), httppool.WithBaseBackoff(time.Second))))
+		// the responses are those of the host, up to the one starting a cooldown
+		for range 3 {
+			code := testutil.Must(get(pool.Client(), host.URL))(t)
+			require.GreaterOrEqual(t, code, 500)
+		}
+		_, err := get(pool.Client(), host.URL)
+		var cooling httppool.ErrProviderCoolingDown
+		require.ErrorAs(t, err, &cooling)
+		require.Equal(t, clock().Add(time.Second), cooling.Until)
+
+		// failing again doubles the backoff
+		advance(time.Second)
+		require.Equal(t, http.StatusInternalServerError, testutil.Must(get(pool.Client(), host.URL))(t))
+		_, err = get(pool.Client(), host.URL)
+		require.ErrorAs(t, err, &cooling)
+		require.Equal(t, clock().Add(2*time.Second), cooling.Until)
+		require.Equal(t, int32(4), host.requests.Load())
+
+		// and succeeding starts over
+		advance(2 * time.Second)
+		require.Equal(t, http.StatusOK, testutil.Must(get(pool.Client(), host.URL))(t))
+		require.Empty(t, pool.Stats().Cooldowns)
+	})
+}
+
+func testURLHost(t testing.TB, u string) string {
+	parsed, err := url.Parse(u)
+	require.NoError(t, err)
+	return parsed.Host
+}
+
+// BenchmarkPool__ConcurrentFetches fetches from one provider 500 times at once
+// per iteration, reporting the most connections the provider had open at once
+func BenchmarkPool__ConcurrentFetches(b *testing.B) {
+	const maxConns = 16
+	provider := newFakeProvider(b, time.Millisecond)
+	pool := httppool.New(httppool.WithMaxConnsPerHost(maxConns))
+	b.ResetTimer()
+	for range b.N {
+		if err := fetchAll(pool.Client(), provider.URL, 500); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(provider.peak()), "peak-conns")
+	if provider.peak() > maxConns {
+		b.Fatalf("provider had %d connections open at once, beyond the limit of %d", provider.peak(), maxConns)
+	}
+}
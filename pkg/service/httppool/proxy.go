@@ -0,0 +1,203 @@
+package httppool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrProviderUnreachable is returned for requests sent through a proxy that
+// couldn't be connected to, or that refused to connect to the host, such as
+// for missing or wrong credentials
+type ErrProviderUnreachable struct {
+	Host string
+	// Proxy is the URL of the proxy, without its password
+	Proxy string
+	Err   error
+}
+
+func (e ErrProviderUnreachable) Error() string {
+	return fmt.Sprintf("%s is unreachable through proxy %s: %s", e.Host, e.Proxy, e.Err)
+}
+
+func (e ErrProviderUnreachable) Unwrap() error {
+	return e.Err
+}
+
+// DirectRule is the proxy of a rule for hosts that are connected to directly
+const DirectRule = "direct"
+
+type (
+	// ProxyRule overrides the proxy requests to hosts matching a pattern are
+	// sent through
+	ProxyRule struct {
+		// Pattern is a host name, "*.example.com" for every subdomain of
+		// example.com, or "*" for every host. Ports are not matched
+		Pattern string
+		// Proxy is the proxy requests are sent through, or nil to connect to the
+		// hosts directly
+		Proxy *url.URL
+	}
+
+	// ProxyConfig decides the proxy each request is sent through
+	ProxyConfig struct {
+		// Proxy is the proxy of requests to hosts no rule matches, or nil to
+		// connect to them directly
+		Proxy *url.URL
+		// Rules override the proxy for the hosts they match. The first rule that
+		// matches a host wins
+		Rules []ProxyRule
+	}
+)
+
+// ParseProxyURL parses the URL of an HTTP or HTTPS proxy, which may carry the
+// credentials requests through it are authenticated with
+func ParseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing proxy URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("proxy URL must be an http or https URL with a host: %s", u.Redacted())
+	}
+	return u, nil
+}
+
+// ParseProxyRule parses a rule of the form pattern=proxy, where proxy is the
+// URL of a proxy or DirectRule
+func ParseProxyRule(raw string) (ProxyRule, error) {
+	pattern, proxy, ok := strings.Cut(raw, "=")
+	if !ok || pattern == "" || proxy == "" {
+		return ProxyRule{}, fmt.Errorf("parsing proxy rule: %q is not pattern=proxy", raw)
+	}
+	rule := ProxyRule{Pattern: strings.ToLower(pattern)}
+	if proxy == DirectRule {
+		return rule, nil
+	}
+	u, err := ParseProxyURL(proxy)
+	if err != nil {
+		return ProxyRule{}, err
+	}
+	rule.Proxy = u
+	return rule, nil
+}
+
+func (r ProxyRule) matches(host string) bool {
+	switch {
+	case r.Pattern == "*":
+		return true
+	case strings.HasPrefix(r.Pattern, "*."):
+		return strings.HasSuffix(host, r.Pattern[1:])
+	default:
+		return host == r.Pattern
+	}
+}
+
+// ProxyFor returns the proxy requests to the host are sent through, or nil if
+// the host is connected to directly
+func (c ProxyConfig) ProxyFor(host string) *url.URL {
+	host = strings.ToLower(host)
+	for _, r := range c.Rules {
+		if r.matches(host) {
+			return r.Proxy
+		}
+	}
+	return c.Proxy
+}
+
+// proxies returns the redacted URLs of the proxies of the config, by the
+// address they are dialed at
+func (c ProxyConfig) proxies() map[string]string {
+	proxies := map[string]string{}
+	add := func(u *url.URL) {
+		if u == nil {
+			return
+		}
+		port := u.Port()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+		}
+		proxies[net.JoinHostPort(u.Hostname(), port)] = u.Redacted()
+	}
+	add(c.Proxy)
+	for _, r := range c.Rules {
+		add(r.Proxy)
+	}
+	return proxies
+}
+
+// WithProxy sends requests through the proxies the config decides on. Proxies
+// are connected to without the dialer set by WithDialContext, as they are
+// trusted, and often on private networks, so hosts reached through a proxy are
+// checked by the check set by WithDestinationCheck instead. Proxies are
+// authenticated with the credentials in their URLs, for both CONNECT tunnels
+// and plain HTTP requests
+func WithProxy(cfg ProxyConfig) Option {
+	return func(p *Pool) {
+		p.proxy = &cfg
+	}
+}
+
+// WithDestinationCheck checks the host of each request sent through a proxy
+// before it is sent, such as with an address policy. The proxy connects to the
+// host on our behalf, so the dialer never sees it
+func WithDestinationCheck(check func(ctx context.Context, host string) error) Option {
+	return func(p *Pool) {
+		p.checkDestination = check
+	}
+}
+
+// proxyFor returns the proxy of a request, once its host passes the
+// destination check
+func (p *Pool) proxyFor(req *http.Request) (*url.URL, error) {
+	proxy := p.proxy.ProxyFor(req.URL.Hostname())
+	if proxy == nil || p.checkDestination == nil {
+		return proxy, nil
+	}
+	if err := p.checkDestination(req.Context(), req.URL.Hostname()); err != nil {
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// proxyConnectResponse fails CONNECT tunnels the proxy refused
+func proxyConnectResponse(ctx context.Context, proxy *url.URL, req *http.Request, resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	return ErrProviderUnreachable{Host: req.Host, Proxy: proxy.Redacted(), Err: fmt.Errorf("proxy responded %s", resp.Status)}
+}
+
+// proxiedTransport names the host in failures to connect to its proxy, which
+// are only known by the proxy's address when dialed, and fails plain HTTP
+// requests a proxy refused for missing or wrong credentials
+type proxiedTransport struct {
+	proxy     *ProxyConfig
+	transport http.RoundTripper
+}
+
+func (t *proxiedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		var unreachable ErrProviderUnreachable
+		if errors.As(err, &unreachable) && unreachable.Host == "" {
+			unreachable.Host = req.URL.Host
+			return nil, unreachable
+		}
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		if proxy := t.proxy.ProxyFor(req.URL.Hostname()); proxy != nil {
+			resp.Body.Close()
+			return nil, ErrProviderUnreachable{Host: req.URL.Host, Proxy: proxy.Redacted(), Err: fmt.Errorf("proxy responded %s", resp.Status)}
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,234 @@
+package httppool_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/httppool"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("claim"))
+	}))
+	t.Cleanup(backend.Close)
+	tlsBackend := httptest.NewTLSServer(backend.Config.Handler)
+	t.Cleanup(tlsBackend.Close)
+	// the certificate of the TLS backend is for example.com
+	tlsConfig := &tls.Config{RootCAs: tlsBackend.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+	newProxy := func(t *testing.T, user, pass string) *testProxy {
+		p := &testProxy{backend: backend.Listener.Addr().String(), tlsBackend: tlsBackend.Listener.Addr().String(), user: user, pass: pass}
+		p.Server = httptest.NewServer(p)
+		t.Cleanup(p.Close)
+		return p
+	}
+	get := func(client *http.Client, u string) error {
+		resp, err := client.Get(u)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if string(body) != "claim" {
+			return errors.New("unexpected response: " + string(body))
+		}
+		return nil
+	}
+
+	t.Run("rules override the proxy of the hosts they match", func(t *testing.T) {
+		global := testutil.Must(url.Parse("http://global.proxy:3128"))(t)
+		partner := testutil.Must(url.Parse("http://partner.proxy:3128"))(t)
+		cfg := httppool.ProxyConfig{
+			Proxy: global,
+			Rules: []httppool.ProxyRule{
+				testutil.Must(httppool.ParseProxyRule("direct.partner.example=direct"))(t),
+				{Pattern: "*.partner.example", Proxy: partner},
+				{Pattern: "sp.example"},
+			},
+		}
+		for host, expected := range map[string]*url.URL{
+			"provider.example":        global,
+			"sp.partner.example":      partner,
+			"a.b.partner.example":     partner,
+			"SP.Partner.Example":      partner,
+			"partner.example":         global,
+			"direct.partner.example":  nil,
+			"sp.example":              nil,
+			"sp.example.elsewhere":    global,
+			"not-partner.example.com": global,
+		} {
+			require.Equal(t, expected, cfg.ProxyFor(host), host)
+		}
+	})
+
+	t.Run("requests are routed by the rules", func(t *testing.T) {
+		global, partner := newProxy(t, "", ""), newProxy(t, "", "")
+		pool := httppool.New(httppool.WithTLSConfig(tlsConfig), httppool.WithProxy(httppool.ProxyConfig{
+			Proxy: testutil.Must(httppool.ParseProxyURL(global.URL))(t),
+			Rules: []httppool.ProxyRule{
+				{Pattern: "*.partner.example", Proxy: testutil.Must(httppool.ParseProxyURL(partner.URL))(t)},
+				testutil.Must(httppool.ParseProxyRule("127.0.0.1=direct"))(t),
+			},
+		}))
+		require.NoError(t, get(pool.Client(), "http://provider.example/claims/1"))
+		require.NoError(t, get(pool.Client(), "https://example.com/claims/2"))
+		require.NoError(t, get(pool.Client(), "http://sp.partner.example/claims/3"))
+		require.NoError(t, get(pool.Client(), backend.URL+"/claims/4"))
+
+		require.Equal(t, []string{"GET provider.example", "CONNECT example.com:443"}, global.recorded())
+		require.Equal(t, []string{"GET sp.partner.example"}, partner.recorded())
+	})
+
+	t.Run("the destination is checked rather than the proxy", func(t *testing.T) {
+		proxy := newProxy(t, "", "")
+		errDisallowed := errors.New("disallowed")
+		var checked []string
+		pool := httppool.New(
+			// the dialer refuses every address, including the proxy's
+			httppool.WithDialContext(func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, errDisallowed
+			}),
+			httppool.WithDestinationCheck(func(ctx context.Context, host string) error {
+				checked = append(checked, host)
+				if host == "internal.example" {
+					return errDisallowed
+				}
+				return nil
+			}),
+			httppool.WithProxy(httppool.ProxyConfig{Proxy: testutil.Must(httppool.ParseProxyURL(proxy.URL))(t)}),
+		)
+		require.NoError(t, get(pool.Client(), "http://provider.example/claims/1"))
+		require.ErrorIs(t, get(pool.Client(), "http://internal.example/claims/1"), errDisallowed)
+		require.Equal(t, []string{"provider.example", "internal.example"}, checked)
+		require.Equal(t, []string{"GET provider.example"}, proxy.recorded())
+	})
+
+	t.Run("a proxy requiring credentials is authenticated with those in its URL", func(t *testing.T) {
+		proxy := newProxy(t, "indexer", "secret")
+		proxyURL := testutil.Must(url.Parse(proxy.URL))(t)
+		newClient := func(user *url.Userinfo) *http.Client {
+			u := *proxyURL
+			u.User = user
+			return httppool.New(httppool.WithTLSConfig(tlsConfig), httppool.WithProxy(httppool.ProxyConfig{Proxy: &u})).Client()
+		}
+
+		authenticated := newClient(url.UserPassword("indexer", "secret"))
+		require.NoError(t, get(authenticated, "http://provider.example/claims/1"))
+		require.NoError(t, get(authenticated, "https://example.com/claims/2"))
+
+		for _, client := range []*http.Client{newClient(nil), newClient(url.UserPassword("indexer", "wrong"))} {
+			for _, u := range []string{"http://provider.example/claims/1", "https://example.com/claims/2"} {
+				var unreachable httppool.ErrProviderUnreachable
+				require.ErrorAs(t, get(client, u), &unreachable)
+				// tunnels are to the host and port
+				require.Equal(t, testutil.Must(url.Parse(u))(t).Hostname(), strings.TrimSuffix(unreachable.Host, ":443"))
+				require.Contains(t, unreachable.Proxy, proxyURL.Host)
+				require.NotContains(t, unreachable.Error(), "wrong")
+			}
+		}
+		require.Equal(t, []string{"GET provider.example", "CONNECT example.com:443"}, proxy.recorded())
+	})
+
+	t.Run("a proxy that can't be connected to makes the provider unreachable", func(t *testing.T) {
+		listener := testutil.Must(net.Listen("tcp", "127.0.0.1:0"))(t)
+		proxyURL := "http://" + listener.Addr().String()
+		listener.Close()
+		pool := httppool.New(httppool.WithProxy(httppool.ProxyConfig{Proxy: testutil.Must(httppool.ParseProxyURL(proxyURL))(t)}))
+		var unreachable httppool.ErrProviderUnreachable
+		require.ErrorAs(t, get(pool.Client(), "http://provider.example/claims/1"), &unreachable)
+		require.Equal(t, "provider.example", unreachable.Host)
+		require.Equal(t, proxyURL, unreachable.Proxy)
+	})
+
+	t.Run("malformed rules are rejected", func(t *testing.T) {
+		for _, rule := range []string{"", "*.example", "=direct", "*.example=ftp://proxy", "*.example=http://"} {
+			_, err := httppool.ParseProxyRule(rule)
+			require.Error(t, err, rule)
+		}
+	})
+}
+
+// testProxy is a forward proxy recording the requests sent through it. Plain
+// HTTP requests are forwarded to backend and CONNECT tunnels opened to
+// tlsBackend, whatever host they are for. If user is set, requests must carry
+// its credentials
+type testProxy struct {
+	*httptest.Server
+	backend, tlsBackend string
+	user, pass          string
+
+	lk       sync.Mutex
+	requests []string
+}
+
+func (p *testProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.user != "" {
+		// the proxy credentials are read as if they were the request's
+		user, pass, ok := (&http.Request{Header: http.Header{"Authorization": r.Header.Values("Proxy-Authorization")}}).BasicAuth()
+		if !ok || user != p.user || pass != p.pass {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+	}
+	if r.Method == http.MethodConnect {
+		p.record(r.Method + " " + r.Host)
+		upstream, err := net.Dial("tcp", p.tlsBackend)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+		return
+	}
+	p.record(r.Method + " " + r.URL.Host)
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.URL.Host = p.backend
+	out.Header.Del("Proxy-Authorization")
+	resp, err := http.DefaultTransport.RoundTrip(out)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (p *testProxy) record(request string) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.requests = append(p.requests, request)
+}
+
+func (p *testProxy) recorded() []string {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return p.requests
+}
@@ -0,0 +1,35 @@
+package service
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/service/identity"
+)
+
+// WithIdentities records the peers that advertise the claims of each issuer in
+// the mapping, so that providers denied by DID or by peer ID are denied by both.
+// Without it, only peer IDs derived from did:key DIDs are resolved
+func WithIdentities(ids *identity.Mapping) Option {
+	return func(is *IndexingService) {
+		is.identities = ids
+	}
+}
+
+// Identities returns the mapping of claim issuers to the peers advertising
+// their claims, or nil if there is none
+func (is *IndexingService) Identities() *identity.Mapping {
+	return is.identities
+}
+
+// observeIssuer records that the provider advertised a claim of its issuer.
+// Failures are logged and otherwise ignored
+func (is *IndexingService) observeIssuer(ctx context.Context, claim delegation.Delegation, provider peer.ID) {
+	if is.identities == nil {
+		return
+	}
+	if err := is.identities.Observe(ctx, claim.Issuer().DID(), provider); err != nil {
+		log.Warnw("recording claim issuer identity", "issuer", claim.Issuer().DID(), "provider", provider, "error", err)
+	}
+}
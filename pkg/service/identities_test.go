@@ -0,0 +1,104 @@
+package service_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/maurl"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/go-ucanto/principal/signer"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/identity"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexingService__Identities(t *testing.T) {
+	ctx := context.Background()
+	webDID := testutil.Must(did.Parse("did:web:provider.example.com"))(t)
+	webIssuer := testutil.Must(signer.Wrap(testutil.Bob, webDID))(t)
+	webClaim := testutil.Must(delegation.Delegate(webIssuer, webIssuer, []ucan.Capability[assert.IndexCaveats]{testutil.RandomIndexClaim()}))(t)
+	aliceClaim := testutil.Must(delegation.Delegate(testutil.Alice, testutil.Alice, []ucan.Capability[assert.IndexCaveats]{testutil.RandomIndexClaim()}))(t)
+	claims := map[string][]byte{}
+	for _, claim := range []delegation.Delegation{webClaim, aliceClaim} {
+		claims[claim.Link().String()] = testutil.Must(io.ReadAll(claim.Archive()))(t)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.Must(w.Write(claims[strings.TrimPrefix(r.URL.Path, "/claims/")]))(t)
+	}))
+	defer server.Close()
+	claimsURL := testutil.Must(url.Parse(server.URL + "/claims/{claim}"))(t)
+
+	providerID := testutil.RandomPeer()
+	contentHash := testutil.RandomMultihash()
+	resultFor := func(claim delegation.Delegation) model.ProviderResult {
+		return model.ProviderResult{
+			ContextID: testutil.RandomBytes(10),
+			Metadata: testutil.Must((&metadata.IndexClaimMetadata{
+				Index: testutil.RandomCID().(cidlink.Link).Cid,
+				Claim: claim.Link().(cidlink.Link).Cid,
+			}).MarshalBinary())(t),
+			Provider: &peer.AddrInfo{
+				ID:    providerID,
+				Addrs: []multiaddr.Multiaddr{testutil.Must(maurl.FromURL(claimsURL))(t)},
+			},
+		}
+	}
+	providerIndex := &mockProviderIndex{results: map[string][]model.ProviderResult{
+		string(contentHash): {resultFor(webClaim), resultFor(aliceClaim)},
+	}}
+	ids := testutil.Must(identity.NewMapping(ctx, dssync.MutexWrap(datastore.NewMapDatastore())))(t)
+	is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex,
+		service.WithConcurrency(1), service.WithIdentities(ids)))(t)
+	query := service.Query{Hashes: []multihash.Multihash{contentHash}}
+	deny := func(providers ...string) int {
+		require.NoError(t, is.Reconfigure(service.DynamicConfig{DeniedProviders: providers}))
+		return len(testutil.Must(is.Query(ctx, query))(t).Claims())
+	}
+
+	require.Equal(t, 2, deny())
+	resolved, ok := ids.ResolvePeer(webDID)
+	require.True(t, ok)
+	require.Equal(t, providerID, resolved)
+	// the provider advertises a claim of a did:key issuer other than itself
+	conflicts := ids.Conflicts()
+	require.Len(t, conflicts, 1)
+	require.Equal(t, testutil.Alice.DID(), conflicts[0].DID)
+	require.Equal(t, providerID, conflicts[0].Peer)
+
+	t.Run("issuers are denied by DID", func(t *testing.T) {
+		require.Equal(t, 1, deny(testutil.Alice.DID().String()))
+	})
+
+	t.Run("issuers are denied by the peer their key derives", func(t *testing.T) {
+		alicePeer, ok := identity.PeerFromDID(testutil.Alice.DID())
+		require.True(t, ok)
+		require.Equal(t, 1, deny(alicePeer.String()))
+	})
+
+	t.Run("providers are denied by the DID they were observed with", func(t *testing.T) {
+		// which denies the claims of other issuers they advertise too
+		require.Equal(t, 0, deny(webDID.String()))
+	})
+
+	t.Run("invalid DIDs are rejected", func(t *testing.T) {
+		require.Error(t, is.Reconfigure(service.DynamicConfig{DeniedProviders: []string{"did:key:not-a-key"}}))
+	})
+}
@@ -0,0 +1,363 @@
+// Package identity connects the DIDs claims are issued by with the peer IDs
+// provider records are keyed by, so that checks applied to one form of
+// identifier apply to the other too. Peer IDs are derived from did:key DIDs
+// where the key type allows it, and other pairs are learned by observing the
+// peers that advertise the claims of an issuer
+package identity
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-varint"
+	"github.com/storacha/go-ucanto/did"
+)
+
+var log = logging.Logger("identity")
+
+var (
+	mappingPrefix  = datastore.NewKey("identity")
+	pairsPrefix    = datastore.NewKey("pairs")
+	conflictPrefix = datastore.NewKey("conflicts")
+)
+
+// PeerFromDID derives the peer ID of the key of a did:key DID. It returns false
+// for other DIDs, and keys libp2p has no peer IDs for
+func PeerFromDID(d did.DID) (peer.ID, bool) {
+	if !strings.HasPrefix(d.String(), did.KeyPrefix) {
+		return "", false
+	}
+	code, n, err := varint.FromUvarint(d.Bytes())
+	if err != nil {
+		return "", false
+	}
+	raw := d.Bytes()[n:]
+	var pub crypto.PubKey
+	switch code {
+	case did.Ed25519:
+		pub, err = crypto.UnmarshalEd25519PublicKey(raw)
+	case did.RSA:
+		// did:key encodes RSA keys in PKCS #1, and libp2p in PKIX
+		rsaPub, perr := x509.ParsePKCS1PublicKey(raw)
+		if perr != nil {
+			return "", false
+		}
+		pkix, perr := x509.MarshalPKIXPublicKey(rsaPub)
+		if perr != nil {
+			return "", false
+		}
+		pub, err = crypto.UnmarshalRsaPublicKey(pkix)
+	default:
+		return "", false
+	}
+	if err != nil {
+		return "", false
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		return "", false
+	}
+	return id, true
+}
+
+// DIDFromPeer derives the did:key DID of the key a peer ID embeds. It returns
+// false for peer IDs that are hashes of their key, as those of RSA keys are,
+// and keys did:key DIDs aren't supported for
+func DIDFromPeer(id peer.ID) (did.DID, bool) {
+	pub, err := id.ExtractPublicKey()
+	if err != nil || pub.Type() != crypto.Ed25519 {
+		return did.Undef, false
+	}
+	raw, err := pub.Raw()
+	if err != nil {
+		return did.Undef, false
+	}
+	d, err := did.Decode(append(varint.ToUvarint(did.Ed25519), raw...))
+	if err != nil {
+		return did.Undef, false
+	}
+	return d, true
+}
+
+// Conflict is an observation of a DID and a peer ID that disagrees with what
+// one of them is already mapped to. The mapping is left as it was
+type Conflict struct {
+	DID  did.DID
+	Peer peer.ID
+	// MappedPeer is the peer the DID was already mapped to, if not Peer
+	MappedPeer peer.ID
+	// MappedDID is the DID the peer was already mapped to, if not DID
+	MappedDID did.DID
+	// First is when the conflict was first observed, and Last the last time
+	// since startup
+	First time.Time
+	Last  time.Time
+	// Count is the number of times it was observed since startup, which is
+	// zero for conflicts only observed before
+	Count int
+}
+
+type storedPair struct {
+	DID  string `json:"did"`
+	Peer string `json:"peer"`
+}
+
+type storedConflict struct {
+	DID        string    `json:"did"`
+	Peer       string    `json:"peer"`
+	MappedPeer string    `json:"mappedPeer,omitempty"`
+	MappedDID  string    `json:"mappedDid,omitempty"`
+	First      time.Time `json:"first"`
+}
+
+// Mapping is a persisted bidirectional mapping of DIDs and peer IDs, learned
+// from observed pairs and held in memory for resolving without I/O. It is safe
+// for concurrent use
+type Mapping struct {
+	ds     datastore.Batching
+	relays map[peer.ID]struct{}
+
+	lk        sync.RWMutex
+	peers     map[did.DID]peer.ID
+	dids      map[peer.ID]did.DID
+	conflicts map[storedPair]*Conflict
+}
+
+// Option configures a Mapping
+type Option func(*Mapping)
+
+// WithRelays ignores observations of the peers, which advertise the claims of
+// issuers other than themselves. The service's own publisher is one
+func WithRelays(ids ...peer.ID) Option {
+	return func(m *Mapping) {
+		for _, id := range ids {
+			m.relays[id] = struct{}{}
+		}
+	}
+}
+
+// NewMapping returns a mapping kept in the datastore, loading the pairs and
+// conflicts already observed
+func NewMapping(ctx context.Context, ds datastore.Batching, opts ...Option) (*Mapping, error) {
+	m := &Mapping{
+		ds:        namespace.Wrap(ds, mappingPrefix),
+		relays:    map[peer.ID]struct{}{},
+		peers:     map[did.DID]peer.ID{},
+		dids:      map[peer.ID]did.DID{},
+		conflicts: map[storedPair]*Conflict{},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	err := m.load(ctx, pairsPrefix, func(data []byte) error {
+		var p storedPair
+		if err := json.Unmarshal(data, &p); err != nil {
+			return err
+		}
+		d, id, err := parsePair(p.DID, p.Peer)
+		if err != nil {
+			return err
+		}
+		m.peers[d], m.dids[id] = id, d
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("loading identity pairs: %w", err)
+	}
+	err = m.load(ctx, conflictPrefix, func(data []byte) error {
+		var c storedConflict
+		if err := json.Unmarshal(data, &c); err != nil {
+			return err
+		}
+		d, id, err := parsePair(c.DID, c.Peer)
+		if err != nil {
+			return err
+		}
+		conflict := &Conflict{DID: d, Peer: id, First: c.First, Last: c.First}
+		if c.MappedPeer != "" {
+			if conflict.MappedPeer, err = peer.Decode(c.MappedPeer); err != nil {
+				return err
+			}
+		}
+		if c.MappedDID != "" {
+			if conflict.MappedDID, err = did.Parse(c.MappedDID); err != nil {
+				return err
+			}
+		}
+		m.conflicts[storedPair{c.DID, c.Peer}] = conflict
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("loading identity conflicts: %w", err)
+	}
+	return m, nil
+}
+
+func (m *Mapping) load(ctx context.Context, prefix datastore.Key, decode func([]byte) error) error {
+	results, err := m.ds.Query(ctx, query.Query{Prefix: prefix.String()})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+	for result := range results.Next() {
+		if result.Error != nil {
+			return result.Error
+		}
+		if err := decode(result.Value); err != nil {
+			return fmt.Errorf("decoding %s: %w", result.Key, err)
+		}
+	}
+	return nil
+}
+
+func parsePair(d, id string) (did.DID, peer.ID, error) {
+	parsed, err := did.Parse(d)
+	if err != nil {
+		return did.Undef, "", fmt.Errorf("parsing DID: %w", err)
+	}
+	pid, err := peer.Decode(id)
+	if err != nil {
+		return did.Undef, "", fmt.Errorf("parsing peer ID: %w", err)
+	}
+	return parsed, pid, nil
+}
+
+// ResolvePeer returns the peer ID of a DID, derived from its key if it is a
+// did:key DID libp2p supports the key type of, or else as observed. A nil
+// mapping only derives
+func (m *Mapping) ResolvePeer(d did.DID) (peer.ID, bool) {
+	if id, ok := PeerFromDID(d); ok {
+		return id, true
+	}
+	if m == nil {
+		return "", false
+	}
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+	id, ok := m.peers[d]
+	return id, ok
+}
+
+// ResolveDID returns the DID of a peer ID, as observed, or else derived from
+// the key it embeds. Observed DIDs come first, since a provider issuing claims
+// under a DID other than that of its peer key is more use to know about. A nil
+// mapping only derives
+func (m *Mapping) ResolveDID(id peer.ID) (did.DID, bool) {
+	if m == nil {
+		return DIDFromPeer(id)
+	}
+	m.lk.RLock()
+	d, ok := m.dids[id]
+	m.lk.RUnlock()
+	if ok {
+		return d, true
+	}
+	return DIDFromPeer(id)
+}
+
+// Observe records that the peer advertised a claim issued by the DID. Pairs
+// already known are ignored, and new pairs are persisted. A pair that disagrees
+// with the peer the DID resolves to, or the DID the peer was observed with, is
+// recorded as a conflict, leaving the mapping as it was. The DID derived from
+// the key of a peer doesn't conflict, as providers may issue claims under a DID
+// other than that of their peer key
+func (m *Mapping) Observe(ctx context.Context, d did.DID, id peer.ID) error {
+	if _, ok := m.relays[id]; ok {
+		return nil
+	}
+	mappedPeer, peerOK := m.ResolvePeer(d)
+	m.lk.RLock()
+	mappedDID, didOK := m.dids[id]
+	m.lk.RUnlock()
+	if (peerOK && mappedPeer != id) || (didOK && mappedDID != d) {
+		conflict := Conflict{DID: d, Peer: id}
+		if peerOK && mappedPeer != id {
+			conflict.MappedPeer = mappedPeer
+		}
+		if didOK && mappedDID != d {
+			conflict.MappedDID = mappedDID
+		}
+		return m.addConflict(ctx, conflict)
+	}
+	if didOK {
+		return nil
+	}
+	return m.addPair(ctx, d, id)
+}
+
+func (m *Mapping) addPair(ctx context.Context, d did.DID, id peer.ID) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if _, ok := m.dids[id]; ok {
+		return nil
+	}
+	p := storedPair{DID: d.String(), Peer: id.String()}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if err := m.ds.Put(ctx, pairsPrefix.ChildString(p.DID), data); err != nil {
+		return fmt.Errorf("writing identity pair: %w", err)
+	}
+	m.peers[d], m.dids[id] = id, d
+	return nil
+}
+
+func (m *Mapping) addConflict(ctx context.Context, conflict Conflict) error {
+	key := storedPair{DID: conflict.DID.String(), Peer: conflict.Peer.String()}
+	now := time.Now().UTC()
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if existing, ok := m.conflicts[key]; ok {
+		existing.Last = now
+		existing.Count++
+		return nil
+	}
+	stored := storedConflict{DID: key.DID, Peer: key.Peer, First: now}
+	if conflict.MappedPeer != "" {
+		stored.MappedPeer = conflict.MappedPeer.String()
+	}
+	if conflict.MappedDID.Defined() {
+		stored.MappedDID = conflict.MappedDID.String()
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	if err := m.ds.Put(ctx, conflictPrefix.ChildString(key.DID).ChildString(key.Peer), data); err != nil {
+		return fmt.Errorf("writing identity conflict: %w", err)
+	}
+	log.Warnw("conflicting identity observed", "did", conflict.DID, "peer", conflict.Peer, "mappedPeer", conflict.MappedPeer, "mappedDid", conflict.MappedDID)
+	conflict.First, conflict.Last, conflict.Count = now, now, 1
+	m.conflicts[key] = &conflict
+	return nil
+}
+
+// Conflicts returns the conflicting observations recorded, oldest first
+func (m *Mapping) Conflicts() []Conflict {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+	conflicts := make([]Conflict, 0, len(m.conflicts))
+	for _, c := range m.conflicts {
+		conflicts = append(conflicts, *c)
+	}
+	slices.SortFunc(conflicts, func(a, b Conflict) int {
+		if c := a.First.Compare(b.First); c != 0 {
+			return c
+		}
+		return strings.Compare(a.DID.String()+a.Peer.String(), b.DID.String()+b.Peer.String())
+	})
+	return conflicts
+}
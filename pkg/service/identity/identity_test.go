@@ -0,0 +1,177 @@
+package identity_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-varint"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/identity"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDerivation(t *testing.T) {
+	alicePeer := testutil.Must(peer.Decode("12D3KooWFVFiLve8MC6jwVgGBePaGhyCAifzJBnEFv1DzFVkvtHG"))(t)
+
+	rsaKey := testutil.Must(rsa.GenerateKey(rand.Reader, 2048))(t)
+	rsaDID := testutil.Must(did.Decode(append(varint.ToUvarint(did.RSA), x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)...)))(t)
+	rsaPub := testutil.Must(crypto.UnmarshalRsaPublicKey(testutil.Must(x509.MarshalPKIXPublicKey(&rsaKey.PublicKey))(t)))(t)
+	rsaPeer := testutil.Must(peer.IDFromPublicKey(rsaPub))(t)
+
+	webDID := testutil.Must(did.Parse("did:web:indexer.storacha.network"))(t)
+
+	t.Run("peer from DID", func(t *testing.T) {
+		testCases := []struct {
+			name string
+			did  did.DID
+			peer peer.ID
+			ok   bool
+		}{
+			{name: "ed25519", did: testutil.Alice.DID(), peer: alicePeer, ok: true},
+			{name: "rsa", did: rsaDID, peer: rsaPeer, ok: true},
+			{name: "not a key", did: webDID},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				id, ok := identity.PeerFromDID(tc.did)
+				require.Equal(t, tc.ok, ok)
+				require.Equal(t, tc.peer, id)
+			})
+		}
+	})
+
+	t.Run("DID from peer", func(t *testing.T) {
+		testCases := []struct {
+			name string
+			peer peer.ID
+			did  did.DID
+			ok   bool
+		}{
+			{name: "ed25519", peer: alicePeer, did: testutil.Alice.DID(), ok: true},
+			{name: "rsa keys are hashed", peer: rsaPeer, did: did.Undef},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				d, ok := identity.DIDFromPeer(tc.peer)
+				require.Equal(t, tc.ok, ok)
+				require.Equal(t, tc.did, d)
+			})
+		}
+	})
+
+	t.Run("round trips generated keys", func(t *testing.T) {
+		for range 10 {
+			id := testutil.RandomPeer()
+			d, ok := identity.DIDFromPeer(id)
+			require.True(t, ok)
+			back, ok := identity.PeerFromDID(d)
+			require.True(t, ok)
+			require.Equal(t, id, back)
+		}
+	})
+}
+
+func TestMapping(t *testing.T) {
+	ctx := context.Background()
+	webDID := testutil.Must(did.Parse("did:web:indexer.storacha.network"))(t)
+	otherDID := testutil.Must(did.Parse("did:web:other.storacha.network"))(t)
+	alicePeer := testutil.Must(peer.Decode("12D3KooWFVFiLve8MC6jwVgGBePaGhyCAifzJBnEFv1DzFVkvtHG"))(t)
+	find := func(conflicts []identity.Conflict, d did.DID, id peer.ID) identity.Conflict {
+		for _, c := range conflicts {
+			if c.DID == d && c.Peer == id {
+				return c
+			}
+		}
+		require.Failf(t, "no conflict", "%s and %s", d, id)
+		return identity.Conflict{}
+	}
+
+	t.Run("resolves observed pairs both ways", func(t *testing.T) {
+		m := testutil.Must(identity.NewMapping(ctx, dssync.MutexWrap(datastore.NewMapDatastore())))(t)
+		id := testutil.RandomPeer()
+		_, ok := m.ResolvePeer(webDID)
+		require.False(t, ok)
+
+		require.NoError(t, m.Observe(ctx, webDID, id))
+		resolved, ok := m.ResolvePeer(webDID)
+		require.True(t, ok)
+		require.Equal(t, id, resolved)
+		d, ok := m.ResolveDID(id)
+		require.True(t, ok)
+		require.Equal(t, webDID, d)
+
+		// observing it again changes nothing
+		require.NoError(t, m.Observe(ctx, webDID, id))
+		require.Empty(t, m.Conflicts())
+	})
+
+	t.Run("derived pairs don't need observing", func(t *testing.T) {
+		m := testutil.Must(identity.NewMapping(ctx, dssync.MutexWrap(datastore.NewMapDatastore())))(t)
+		id, ok := m.ResolvePeer(testutil.Alice.DID())
+		require.True(t, ok)
+		require.Equal(t, alicePeer, id)
+		require.NoError(t, m.Observe(ctx, testutil.Alice.DID(), id))
+		require.Empty(t, m.Conflicts())
+	})
+
+	t.Run("relays aren't observed", func(t *testing.T) {
+		relay := testutil.RandomPeer()
+		m := testutil.Must(identity.NewMapping(ctx, dssync.MutexWrap(datastore.NewMapDatastore()), identity.WithRelays(relay)))(t)
+		require.NoError(t, m.Observe(ctx, webDID, relay))
+		require.NoError(t, m.Observe(ctx, testutil.Alice.DID(), relay))
+		_, ok := m.ResolvePeer(webDID)
+		require.False(t, ok)
+		require.Empty(t, m.Conflicts())
+	})
+
+	t.Run("conflicts are recorded without overwriting, and persisted", func(t *testing.T) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		m := testutil.Must(identity.NewMapping(ctx, ds))(t)
+		first, second := testutil.RandomPeer(), testutil.RandomPeer()
+		require.NoError(t, m.Observe(ctx, webDID, first))
+
+		// the DID is advertised by another peer
+		require.NoError(t, m.Observe(ctx, webDID, second))
+		require.NoError(t, m.Observe(ctx, webDID, second))
+		// the peer advertises the claims of another DID
+		require.NoError(t, m.Observe(ctx, otherDID, first))
+		// a did:key DID is advertised by a peer other than its own
+		require.NoError(t, m.Observe(ctx, testutil.Alice.DID(), second))
+
+		resolved, _ := m.ResolvePeer(webDID)
+		require.Equal(t, first, resolved)
+		d, _ := m.ResolveDID(first)
+		require.Equal(t, webDID, d)
+		_, ok := m.ResolvePeer(otherDID)
+		require.False(t, ok)
+
+		conflicts := m.Conflicts()
+		require.Len(t, conflicts, 3)
+		advertised := find(conflicts, webDID, second)
+		require.Equal(t, first, advertised.MappedPeer)
+		require.Equal(t, did.Undef, advertised.MappedDID)
+		require.Equal(t, 2, advertised.Count)
+		require.Equal(t, webDID, find(conflicts, otherDID, first).MappedDID)
+		require.Equal(t, alicePeer, find(conflicts, testutil.Alice.DID(), second).MappedPeer)
+
+		reloaded := testutil.Must(identity.NewMapping(ctx, ds))(t)
+		resolved, _ = reloaded.ResolvePeer(webDID)
+		require.Equal(t, first, resolved)
+		reloadedConflicts := reloaded.Conflicts()
+		require.Len(t, reloadedConflicts, 3)
+		for _, c := range conflicts {
+			loaded := find(reloadedConflicts, c.DID, c.Peer)
+			require.Equal(t, c.MappedPeer, loaded.MappedPeer)
+			require.Equal(t, c.MappedDID, loaded.MappedDID)
+			require.True(t, c.First.Equal(loaded.First))
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package conformance
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+)
+
+// Origin is a server the suites fill and break, counting the requests made to
+// it. Ranges of what it serves can be requested
+type Origin struct {
+	server   *httptest.Server
+	lk       sync.Mutex
+	files    map[string][]byte
+	status   int
+	requests int
+}
+
+// NewOrigin returns a new origin, serving for the duration of the test
+func NewOrigin(t *testing.T) *Origin {
+	o := &Origin{files: map[string][]byte{}}
+	o.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o.lk.Lock()
+		o.requests++
+		data, ok := o.files[r.URL.Path]
+		status := o.status
+		o.lk.Unlock()
+		if status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(o.server.Close)
+	return o
+}
+
+// Serve serves the data at the path, returning its URL
+func (o *Origin) Serve(t *testing.T, path string, data []byte) url.URL {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	o.files[path] = data
+	return o.URL(t, path)
+}
+
+// URL returns the URL of the path
+func (o *Origin) URL(t *testing.T, path string) url.URL {
+	return *testutil.Must(url.Parse(o.server.URL + path))(t)
+}
+
+// Fail fails every request with the status, until it is zero
+func (o *Origin) Fail(status int) {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	o.status = status
+}
+
+// Requests returns how many requests were made to the origin
+func (o *Origin) Requests() int {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	return o.requests
+}
+
+// UnreachableURL returns a URL nothing answers at
+func UnreachableURL(t *testing.T) url.URL {
+	server := httptest.NewServer(http.NotFoundHandler())
+	u := *testutil.Must(url.Parse(server.URL + "/unreachable"))(t)
+	server.Close()
+	return u
+}
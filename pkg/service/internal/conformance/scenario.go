@@ -0,0 +1,155 @@
+// Package conformance holds what the conformance suites of the lookups the
+// service is built from share: the origin they fetch from, and the query they
+// run through the full IndexingService.Query walk
+package conformance
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	ipnifind "github.com/ipni/go-libipni/find/client"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/maurl"
+	ipnimd "github.com/ipni/go-libipni/metadata"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// Scenario is content with an index claim, where the index has a location
+// commitment. A provider of its own serves the claims and the index
+type Scenario struct {
+	// Content is the hash queried for
+	Content mh.Multihash
+	// Results are the provider results the walk finds, by hash
+	Results map[string][]model.ProviderResult
+	claims  []cid.Cid
+}
+
+// NewScenario returns a new scenario, with a provider serving it for the
+// duration of the test
+func NewScenario(t *testing.T) *Scenario {
+	content, indexCid, shard := testutil.RandomMultihash(), testutil.RandomCID().(cidlink.Link).Cid, testutil.RandomMultihash()
+	index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 1)
+	index.SetSlice(shard, content, blobindex.Position{Offset: 0, Length: 10})
+	origin := NewOrigin(t)
+	indexURL := origin.Serve(t, "/index", testutil.Must(io.ReadAll(testutil.Must(blobindex.Archive(index))(t)))(t))
+	claimsURL := origin.URL(t, "/claims/{claim}")
+	provider := &peer.AddrInfo{
+		ID:    testutil.RandomPeer(),
+		Addrs: []multiaddr.Multiaddr{testutil.Must(maurl.FromURL(&claimsURL))(t)},
+	}
+	serve := func(claim delegation.Delegation) cid.Cid {
+		claimCid := claim.Link().(cidlink.Link).Cid
+		origin.Serve(t, "/claims/"+claimCid.String(), testutil.Must(io.ReadAll(claim.Archive()))(t))
+		return claimCid
+	}
+	location := assert.Location.New(testutil.Service.DID().String(), assert.LocationCaveats{
+		Content:  assert.FromHash(indexCid.Hash()),
+		Location: []url.URL{indexURL},
+	})
+	indexClaim := serve(testutil.RandomIndexDelegation())
+	locationClaim := serve(testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.LocationCaveats]{location}))(t))
+	result := func(contextID []byte, protocol ipnimd.Protocol) model.ProviderResult {
+		md := metadata.MetadataContext.New(protocol)
+		return model.ProviderResult{
+			ContextID: contextID,
+			Metadata:  testutil.Must(md.MarshalBinary())(t),
+			Provider:  provider,
+		}
+	}
+	return &Scenario{
+		Content: content,
+		Results: map[string][]model.ProviderResult{
+			string(content):         {result(content, &metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaim})},
+			string(indexCid.Hash()): {result(indexCid.Hash(), &metadata.LocationCommitmentMetadata{Claim: locationClaim})},
+		},
+		claims: []cid.Cid{indexClaim, locationClaim},
+	}
+}
+
+// Finder returns an IPNI finder with the provider results of the scenario
+func (s *Scenario) Finder() ipnifind.Finder {
+	return finder{s.Results}
+}
+
+// Publish publishes the provider results of the scenario to the provider index
+func (s *Scenario) Publish(t *testing.T, pi service.ProviderIndex) {
+	for hash, results := range s.Results {
+		for _, result := range results {
+			require.NoError(t, pi.Publish(context.Background(), []mh.Multihash{mh.Multihash(hash)}, result))
+		}
+	}
+}
+
+// Query queries the service for the content, requiring that it finds both
+// claims and the index
+func (s *Scenario) Query(t *testing.T, is *service.IndexingService) {
+	qr, err := is.Query(context.Background(), service.Query{Hashes: []mh.Multihash{s.Content}})
+	require.NoError(t, err)
+	claims := make([]cid.Cid, 0, len(qr.Claims()))
+	for _, link := range qr.Claims() {
+		claims = append(claims, link.(cidlink.Link).Cid)
+	}
+	require.ElementsMatch(t, s.claims, claims)
+	require.Len(t, qr.Indexes(), 1)
+}
+
+// NewProviderIndex returns a provider index caching in memory what it finds
+// with the finder
+func NewProviderIndex(finder ipnifind.Finder) service.ProviderIndex {
+	return providerindex.NewProviderIndex(&providerStore{results: map[string][]model.ProviderResult{}}, finder, nil, nil, cidlink.DefaultLinkSystem(), nil)
+}
+
+type finder struct {
+	results map[string][]model.ProviderResult
+}
+
+func (f finder) Find(ctx context.Context, hash mh.Multihash) (*model.FindResponse, error) {
+	results, ok := f.results[string(hash)]
+	if !ok {
+		return &model.FindResponse{}, nil
+	}
+	return &model.FindResponse{MultihashResults: []model.MultihashResult{{Multihash: hash, ProviderResults: results}}}, nil
+}
+
+type providerStore struct {
+	lk      sync.Mutex
+	results map[string][]model.ProviderResult
+}
+
+func (ps *providerStore) Get(ctx context.Context, hash mh.Multihash) ([]model.ProviderResult, error) {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	results, ok := ps.results[string(hash)]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return results, nil
+}
+
+func (ps *providerStore) Set(ctx context.Context, hash mh.Multihash, results []model.ProviderResult, expires bool) error {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	ps.results[string(hash)] = results
+	return nil
+}
+
+func (ps *providerStore) SetExpirable(ctx context.Context, hash mh.Multihash, expires bool) error {
+	return nil
+}
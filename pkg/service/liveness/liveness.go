@@ -0,0 +1,267 @@
+// Package liveness checks that location URLs respond before they are handed to
+// callers, within a strict budget so that probing can't hold up a query
+package liveness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/storacha/indexing-service/pkg/service/httppool"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+var log = logging.Logger("liveness")
+
+const (
+	// DefaultConcurrency is the number of URLs probed at once for a query when
+	// not otherwise configured
+	DefaultConcurrency = 8
+	// DefaultBudget is how long the probes of a query may take altogether when
+	// not otherwise configured
+	DefaultBudget = 2 * time.Second
+	// DefaultCacheTTL is how long the outcome of a probe is reused for the same
+	// URL when not otherwise configured
+	DefaultCacheTTL = 30 * time.Second
+	// maxCached bounds the number of probe outcomes kept
+	maxCached = 4096
+)
+
+// Observer receives the outcome of every probe made, such as to track the
+// reputation of the providers serving the URLs
+type Observer interface {
+	ObserveProbe(u url.URL, probe queryresult.LocationProbe)
+}
+
+type noopObserver struct{}
+
+func (noopObserver) ObserveProbe(url.URL, queryresult.LocationProbe) {}
+
+type (
+	// Option configures a Prober
+	Option func(*Prober)
+
+	// Prober probes location URLs with HEAD requests, falling back to one byte
+	// range requests for servers that reject HEAD. Outcomes are cached briefly
+	// by URL
+	Prober struct {
+		client      *http.Client
+		concurrency int
+		budget      time.Duration
+		ttl         time.Duration
+		now         func() time.Time
+		observer    Observer
+
+		lk     sync.Mutex
+		cached map[string]cachedProbe
+	}
+
+	cachedProbe struct {
+		probe   queryresult.LocationProbe
+		expires time.Time
+	}
+)
+
+// WithConcurrency sets the number of URLs probed at once for a query
+func WithConcurrency(n int) Option {
+	return func(p *Prober) {
+		p.concurrency = n
+	}
+}
+
+// WithBudget sets how long the probes of a query may take altogether. URLs
+// that haven't responded by then time out, and those not yet probed are
+// skipped
+func WithBudget(budget time.Duration) Option {
+	return func(p *Prober) {
+		p.budget = budget
+	}
+}
+
+// WithCacheTTL sets how long the outcome of a probe is reused for the same URL.
+// Zero disables caching
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(p *Prober) {
+		p.ttl = ttl
+	}
+}
+
+// WithClock sets the source of the current time
+func WithClock(now func() time.Time) Option {
+	return func(p *Prober) {
+		p.now = now
+	}
+}
+
+// WithObserver reports the outcome of every probe made to the given observer
+func WithObserver(o Observer) Option {
+	return func(p *Prober) {
+		p.observer = o
+	}
+}
+
+// New returns a new prober making requests with the given client
+func New(client *http.Client, opts ...Option) *Prober {
+	p := &Prober{
+		client:      client,
+		concurrency: DefaultConcurrency,
+		budget:      DefaultBudget,
+		ttl:         DefaultCacheTTL,
+		now:         time.Now,
+		observer:    noopObserver{},
+		cached:      map[string]cachedProbe{},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.client == nil {
+		p.client = http.DefaultClient
+	}
+	if p.concurrency <= 0 {
+		p.concurrency = 1
+	}
+	return p
+}
+
+// Probe checks that each of the distinct URLs responds, returning the outcome
+// for each keyed by URL. It returns once every URL has been probed or the
+// budget runs out, whichever is first. Under a cache only context only cached
+// outcomes are used, and other URLs are skipped
+func (p *Prober) Probe(ctx context.Context, urls []url.URL) map[string]queryresult.LocationProbe {
+	probes := make(map[string]queryresult.LocationProbe, len(urls))
+	var pending []url.URL
+	for _, u := range urls {
+		key := u.String()
+		if _, ok := probes[key]; ok {
+			continue
+		}
+		if probe, ok := p.cachedProbe(key); ok {
+			probes[key] = probe
+			continue
+		}
+		probes[key] = queryresult.LocationProbe{Status: queryresult.ProbeSkipped}
+		pending = append(pending, u)
+	}
+	if len(pending) == 0 || types.IsCacheOnly(ctx) {
+		return probes
+	}
+
+	budgetCtx, cancel := context.WithTimeout(ctx, p.budget)
+	defer cancel()
+	var lk sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, p.concurrency)
+	for _, u := range pending {
+		select {
+		case sem <- struct{}{}:
+		case <-budgetCtx.Done():
+		}
+		// URLs left when the budget runs out stay skipped
+		if budgetCtx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			probe := p.probe(budgetCtx, u)
+			if ctx.Err() != nil {
+				// the query went away, which says nothing about the URL
+				return
+			}
+			p.cache(u.String(), probe)
+			p.observer.ObserveProbe(u, probe)
+			lk.Lock()
+			probes[u.String()] = probe
+			lk.Unlock()
+		}()
+	}
+	wg.Wait()
+	return probes
+}
+
+// probe checks the URL responds with a HEAD request, or a request for its
+// first byte if HEAD isn't supported
+func (p *Prober) probe(ctx context.Context, u url.URL) queryresult.LocationProbe {
+	start := p.now()
+	code, err := p.request(ctx, http.MethodHead, u)
+	if err == nil && (code == http.StatusMethodNotAllowed || code == http.StatusNotImplemented) {
+		code, err = p.request(ctx, http.MethodGet, u)
+	}
+	probe := queryresult.LocationProbe{Code: code, Latency: p.now().Sub(start)}
+	var cooling httppool.ErrProviderCoolingDown
+	switch {
+	case errors.As(err, &cooling):
+		probe.Status = queryresult.ProbeCoolingDown
+		probe.Error = cooling.Error()
+	case errors.Is(err, context.DeadlineExceeded):
+		probe.Status = queryresult.ProbeTimeout
+		probe.Error = err.Error()
+	case err != nil:
+		probe.Status = queryresult.ProbeFailed
+		probe.Error = err.Error()
+	case code >= 200 && code < 300:
+		probe.Status = queryresult.ProbeLive
+	default:
+		probe.Status = queryresult.ProbeFailed
+		probe.Error = fmt.Sprintf("unexpected status %d", code)
+	}
+	log.Debugw("probed location", "url", u.Redacted(), "status", probe.Status, "code", code, "latency", probe.Latency)
+	return probe
+}
+
+func (p *Prober) request(ctx context.Context, method string, u url.URL) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return 0, fmt.Errorf("constructing probe request: %w", err)
+	}
+	if method == http.MethodGet {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("probing %s: %w", u.Redacted(), err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func (p *Prober) cachedProbe(key string) (queryresult.LocationProbe, bool) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	c, ok := p.cached[key]
+	if !ok || !p.now().Before(c.expires) {
+		return queryresult.LocationProbe{}, false
+	}
+	probe := c.probe
+	probe.Cached = true
+	return probe, true
+}
+
+func (p *Prober) cache(key string, probe queryresult.LocationProbe) {
+	if p.ttl <= 0 {
+		return
+	}
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	now := p.now()
+	if len(p.cached) >= maxCached {
+		for k, c := range p.cached {
+			if !now.Before(c.expires) {
+				delete(p.cached, k)
+			}
+		}
+	}
+	if len(p.cached) >= maxCached {
+		return
+	}
+	p.cached[key] = cachedProbe{probe: probe, expires: now.Add(p.ttl)}
+}
@@ -0,0 +1,152 @@
+package liveness_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/httppool"
+	"github.com/storacha/indexing-service/pkg/service/liveness"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingObserver struct {
+	lk     sync.Mutex
+	probes map[string]queryresult.LocationProbe
+}
+
+func (o *recordingObserver) ObserveProbe(u url.URL, probe queryresult.LocationProbe) {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	o.probes[u.String()] = probe
+}
+
+func TestProber(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/healthy":
+			w.WriteHeader(http.StatusOK)
+		case "/no-head":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			if r.Header.Get("Range") != "bytes=0-0" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte{0})
+		case "/hang":
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	at := func(path string) url.URL {
+		return *testutil.Must(url.Parse(srv.URL + path))(t)
+	}
+
+	observer := &recordingObserver{probes: map[string]queryresult.LocationProbe{}}
+	prober := liveness.New(srv.Client(), liveness.WithBudget(200*time.Millisecond), liveness.WithObserver(observer))
+	healthy, noHead, missing, hang := at("/healthy"), at("/no-head"), at("/missing"), at("/hang")
+	start := time.Now()
+	probes := prober.Probe(context.Background(), []url.URL{healthy, noHead, missing, hang, healthy})
+	// the URL that hangs doesn't hold up the query beyond the budget
+	require.Less(t, time.Since(start), 2*time.Second)
+
+	require.Len(t, probes, 4)
+	require.Equal(t, queryresult.ProbeLive, probes[healthy.String()].Status)
+	require.Equal(t, http.StatusOK, probes[healthy.String()].Code)
+	require.Positive(t, probes[healthy.String()].Latency)
+	require.Equal(t, queryresult.ProbeLive, probes[noHead.String()].Status)
+	require.Equal(t, http.StatusPartialContent, probes[noHead.String()].Code)
+	require.Equal(t, queryresult.ProbeFailed, probes[missing.String()].Status)
+	require.Equal(t, http.StatusNotFound, probes[missing.String()].Code)
+	require.Equal(t, queryresult.ProbeTimeout, probes[hang.String()].Status)
+	require.Zero(t, probes[hang.String()].Code)
+	for _, probe := range probes {
+		require.False(t, probe.Cached)
+	}
+	observer.lk.Lock()
+	require.Len(t, observer.probes, 4)
+	observer.lk.Unlock()
+
+	t.Run("recent outcomes are reused", func(t *testing.T) {
+		before := requests.Load()
+		probes := prober.Probe(context.Background(), []url.URL{healthy, missing, hang})
+		require.Equal(t, before, requests.Load())
+		require.True(t, probes[healthy.String()].Cached)
+		require.Equal(t, queryresult.ProbeLive, probes[healthy.String()].Status)
+		require.True(t, probes[missing.String()].Cached)
+		require.Equal(t, queryresult.ProbeFailed, probes[missing.String()].Status)
+		require.Equal(t, queryresult.ProbeTimeout, probes[hang.String()].Status)
+	})
+
+	t.Run("outcomes expire", func(t *testing.T) {
+		now := time.Now()
+		prober := liveness.New(srv.Client(), liveness.WithCacheTTL(time.Minute), liveness.WithClock(func() time.Time { return now }))
+		prober.Probe(context.Background(), []url.URL{healthy})
+		require.True(t, prober.Probe(context.Background(), []url.URL{healthy})[healthy.String()].Cached)
+		now = now.Add(2 * time.Minute)
+		require.False(t, prober.Probe(context.Background(), []url.URL{healthy})[healthy.String()].Cached)
+	})
+
+	t.Run("URLs left when the budget runs out are skipped", func(t *testing.T) {
+		prober := liveness.New(srv.Client(), liveness.WithConcurrency(1), liveness.WithBudget(100*time.Millisecond))
+		probes := prober.Probe(context.Background(), []url.URL{hang, healthy})
+		require.Equal(t, queryresult.ProbeTimeout, probes[hang.String()].Status)
+		require.Equal(t, queryresult.ProbeSkipped, probes[healthy.String()].Status)
+		// skipped URLs aren't cached, so are probed next time
+		probes = prober.Probe(context.Background(), []url.URL{healthy})
+		require.Equal(t, queryresult.ProbeLive, probes[healthy.String()].Status)
+	})
+
+	t.Run("cache only queries make no requests", func(t *testing.T) {
+		prober := liveness.New(srv.Client())
+		prober.Probe(context.Background(), []url.URL{healthy})
+		before := requests.Load()
+		probes := prober.Probe(types.WithCacheOnly(context.Background()), []url.URL{healthy, missing})
+		require.Equal(t, before, requests.Load())
+		require.True(t, probes[healthy.String()].Cached)
+		require.Equal(t, queryresult.ProbeSkipped, probes[missing.String()].Status)
+	})
+
+	t.Run("hosts cooling down aren't probed", func(t *testing.T) {
+		var throttled atomic.Int32
+		throttling := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			throttled.Add(1)
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		t.Cleanup(throttling.Close)
+		pool := httppool.New(httppool.WithCooldowns(httppool.NewCooldowns()))
+		observer := &recordingObserver{probes: map[string]queryresult.LocationProbe{}}
+		prober := liveness.New(pool.Client(), liveness.WithConcurrency(1), liveness.WithObserver(observer))
+		first := *testutil.Must(url.Parse(throttling.URL + "/a"))(t)
+		second := *testutil.Must(url.Parse(throttling.URL + "/b"))(t)
+		probes := prober.Probe(context.Background(), []url.URL{first, second})
+		require.Equal(t, queryresult.ProbeCoolingDown, probes[first.String()].Status)
+		require.Equal(t, queryresult.ProbeCoolingDown, probes[second.String()].Status)
+		require.Equal(t, int32(1), throttled.Load())
+		observer.lk.Lock()
+		defer observer.lk.Unlock()
+		require.Equal(t, queryresult.ProbeCoolingDown, observer.probes[second.String()].Status)
+	})
+}
@@ -0,0 +1,47 @@
+package service
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/indexing-service/pkg/metadata"
+)
+
+// Metrics is told about the walks of queries and the claims fetched for them
+type Metrics interface {
+	// QueryWalked is called after the walk of a query completes, or fails, with
+	// how long it took and the number of jobs it ran
+	QueryWalked(duration time.Duration, jobs int, err error)
+	// ClaimFetched is called after each attempt to fetch a claim of the given
+	// kind from a provider, with how long it took
+	ClaimFetched(kind metadata.Kind, provider peer.ID, duration time.Duration, err error)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) QueryWalked(time.Duration, int, error) {}
+
+func (noopMetrics) ClaimFetched(metadata.Kind, peer.ID, time.Duration, error) {}
+
+// WithMetrics reports the walks of queries and the claims fetched for them to
+// the given metrics
+func WithMetrics(m Metrics) Option {
+	return func(is *IndexingService) {
+		is.metrics = m
+	}
+}
+
+// WithMetricsHandler makes a handler serving the metrics of the service for
+// scraping available through MetricsHandler
+func WithMetricsHandler(h http.Handler) Option {
+	return func(is *IndexingService) {
+		is.metricsHandler = h
+	}
+}
+
+// MetricsHandler returns the handler serving the metrics of the service for
+// scraping, or nil if they aren't served
+func (is *IndexingService) MetricsHandler() http.Handler {
+	return is.metricsHandler
+}
@@ -0,0 +1,111 @@
+package service_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/blobindexlookup"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/prommetrics"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/stretchr/testify/require"
+)
+
+// scrape returns the value of each series served by the handler, by its name
+// and labels as written in the text format
+func scrape(t *testing.T, h http.Handler) map[string]string {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	series := map[string]string{}
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		series[line[:i]] = line[i+1:]
+	}
+	return series
+}
+
+func TestIndexingService__Metrics(t *testing.T) {
+	ctx := context.Background()
+	f := newClaimFixture(t)
+	contentHash, indexCid, shardHash := testutil.RandomMultihash(), testutil.RandomCID().(cidlink.Link).Cid, testutil.RandomMultihash()
+	index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 1)
+	index.SetSlice(shardHash, contentHash, blobindex.Position{Offset: 0, Length: 10})
+	archive := testutil.Must(io.ReadAll(testutil.Must(blobindex.Archive(index))(t)))(t)
+	blobs := newCountingServer(t, 0, func(*http.Request) []byte { return archive })
+	indexClaim := f.newClaim(t)
+	indexLocation := f.addClaim(t, locationsDelegation(t, indexCid.Hash(), blobs.url(t, "/index")))
+	finder := &countingFinder{results: map[string][]model.ProviderResult{
+		string(contentHash):     {f.result(t, contentHash, &metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaim})},
+		string(indexCid.Hash()): {f.result(t, indexCid.Hash(), &metadata.LocationCommitmentMetadata{Claim: indexLocation})},
+	}, calls: map[string]int{}}
+
+	exporter := prommetrics.New()
+	providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, finder, nil, nil, cidlink.DefaultLinkSystem(), nil, providerindex.WithMetrics(exporter))
+	claimLookup := claimlookup.WithCache(claimlookup.NewClaimLookup(http.DefaultClient), redis.NewContentClaimsStore(&memRedis{data: map[string]string{}}), claimlookup.WithCacheMetrics(exporter))
+	blobIndexLookup := blobindexlookup.WithCache(blobindexlookup.NewBlobIndexLookup(http.DefaultClient), redis.NewShardedDagIndexStore(&memRedis{data: map[string]string{}}), noopCachingQueue{}, blobindexlookup.WithMetrics(exporter))
+	is := testutil.Must(service.NewIndexingService(blobIndexLookup, claimLookup, providerIndex, service.WithMetrics(exporter), service.WithMetricsHandler(exporter.Handler())))(t)
+	query := func() {
+		qr := testutil.Must(is.Query(ctx, service.Query{Hashes: []multihash.Multihash{contentHash}}))(t)
+		require.Len(t, qr.Indexes(), 1)
+	}
+
+	// the first query misses every cache, looking up the content, the index
+	// and the shard of the index, and the second finds everything the first
+	// cached
+	query()
+	series := scrape(t, is.MetricsHandler())
+	require.Equal(t, "3", series[`indexing_cache_reads_total{outcome="miss",store="providers"}`])
+	require.Equal(t, "2", series[`indexing_cache_reads_total{outcome="miss",store="claims"}`])
+	require.Contains(t, series, `indexing_cache_reads_total{outcome="miss",store="indexes"}`)
+	require.NotContains(t, series, `indexing_cache_reads_total{outcome="hit",store="providers"}`)
+	require.Equal(t, "3", series[`indexing_ipni_find_duration_seconds_count{outcome="success"}`])
+	require.Equal(t, "1", series[`indexing_claim_fetches_total{claim_type="index",outcome="success"}`])
+	require.Equal(t, "1", series[`indexing_claim_fetches_total{claim_type="location",outcome="success"}`])
+	require.Equal(t, "1", series[`indexing_query_walk_duration_seconds_count{outcome="success"}`])
+	require.Equal(t, "1", series[`indexing_query_walk_jobs_count`])
+	require.Equal(t, "3", series[`indexing_query_walk_jobs_sum`])
+
+	query()
+	series = scrape(t, is.MetricsHandler())
+	require.Equal(t, "3", series[`indexing_cache_reads_total{outcome="hit",store="providers"}`])
+	require.Equal(t, "3", series[`indexing_cache_reads_total{outcome="miss",store="providers"}`])
+	require.Equal(t, "2", series[`indexing_cache_reads_total{outcome="hit",store="claims"}`])
+	require.Equal(t, "1", series[`indexing_cache_reads_total{outcome="hit",store="indexes"}`])
+	require.Equal(t, "3", series[`indexing_ipni_find_duration_seconds_count{outcome="success"}`])
+	require.Equal(t, "2", series[`indexing_claim_fetches_total{claim_type="index",outcome="success"}`])
+	require.Equal(t, "2", series[`indexing_query_walk_jobs_count`])
+	require.Equal(t, "6", series[`indexing_query_walk_jobs_sum`])
+	// providers aren't labelled by default
+	for name := range series {
+		require.NotContains(t, name, "provider_bucket")
+	}
+
+	t.Run("providers are hashed into buckets", func(t *testing.T) {
+		exporter := prommetrics.New(prommetrics.WithProviderBuckets(4))
+		exporter.ClaimFetched(metadata.LocationKind, testutil.RandomPeer(), 0, nil)
+		var buckets []string
+		for name := range scrape(t, exporter.Handler()) {
+			if strings.HasPrefix(name, "indexing_claim_fetches_total{") {
+				buckets = append(buckets, name)
+			}
+		}
+		require.Len(t, buckets, 1)
+		require.Regexp(t, `provider_bucket="[0-3]"`, buckets[0])
+	})
+}
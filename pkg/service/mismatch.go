@@ -0,0 +1,149 @@
+package service
+
+import (
+	"bytes"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/validator"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	adm "github.com/storacha/indexing-service/pkg/capability/assert/datamodel"
+	"github.com/storacha/indexing-service/pkg/metadata"
+)
+
+// fields of location commitment metadata checked against the claim they are
+// for
+const (
+	MismatchRange = "range"
+	MismatchShard = "shard"
+)
+
+// MismatchMetrics is told about provider records whose location commitment
+// metadata disagrees with the claim fetched for them
+type MismatchMetrics interface {
+	// MetadataMismatch is called for each field of a record's metadata that
+	// disagrees with its claim, with the provider of the record
+	MetadataMismatch(field string, provider peer.ID)
+}
+
+type noopMismatchMetrics struct{}
+
+func (noopMismatchMetrics) MetadataMismatch(string, peer.ID) {}
+
+// MismatchObserver receives every provider record found with location
+// commitment metadata that disagrees with its claim, such as to track the
+// reputation of the providers advertising them
+type MismatchObserver interface {
+	ObserveMismatch(provider peer.ID, claim cid.Cid, fields []string)
+}
+
+// WithMismatchMetrics reports records whose metadata disagrees with their
+// claim to the given metrics
+func WithMismatchMetrics(m MismatchMetrics) Option {
+	return func(is *IndexingService) {
+		is.mismatchMetrics = m
+	}
+}
+
+// WithMismatchObserver reports records whose metadata disagrees with their
+// claim to the given observer
+func WithMismatchObserver(o MismatchObserver) Option {
+	return func(is *IndexingService) {
+		is.mismatchObserver = o
+	}
+}
+
+// WithStrictMetadata leaves out location commitments found through a provider
+// record whose range or shard disagrees with the claim. By default the claim is
+// kept, and followed with the range and shard the claim states, as it is
+// signed and the record isn't
+func WithStrictMetadata(strict bool) Option {
+	return func(is *IndexingService) {
+		is.strictMetadata = strict
+	}
+}
+
+// locationMismatch compares the range and shard of location commitment
+// metadata with the caveats of the claim it is for, returning the fields that
+// disagree along with a copy of the metadata corrected to what the claim
+// states. Metadata with neither a range nor a shard isn't compared, and a
+// missing range is the same as one from the start to the end of the shard. A
+// shard is the same as the content of the claim if it has the same multihash,
+// whatever its version or codec
+func locationMismatch(md *metadata.LocationCommitmentMetadata, claim delegation.Delegation) ([]string, *metadata.LocationCommitmentMetadata) {
+	if md.Range == nil && md.Shard == nil {
+		return nil, md
+	}
+	nb, ok := parseLocationCaveats(claim)
+	if !ok {
+		return nil, md
+	}
+	var fields []string
+	corrected := *md
+	if !sameRange(md.Range, nb.Range) {
+		fields = append(fields, MismatchRange)
+		corrected.Range = nil
+		if nb.Range != nil {
+			corrected.Range = &metadata.Range{Offset: nb.Range.Offset, Length: nb.Range.Length}
+		}
+	}
+	if md.Shard != nil && !bytes.Equal(md.Shard.Hash(), nb.Content.Hash()) {
+		fields = append(fields, MismatchShard)
+		shard := cid.NewCidV1(md.Shard.Prefix().Codec, nb.Content.Hash())
+		corrected.Shard = &shard
+	}
+	if len(fields) == 0 {
+		return nil, md
+	}
+	return fields, &corrected
+}
+
+// parseLocationCaveats reads the caveats of the location capability of a
+// claim. It returns false if the claim is not a location commitment
+func parseLocationCaveats(claim delegation.Delegation) (assert.LocationCaveats, bool) {
+	for _, capability := range claim.Capabilities() {
+		if capability.Can() != assert.LocationAbility {
+			continue
+		}
+		match, fail := assert.Location.Match(validator.NewSource(capability, claim))
+		if fail != nil {
+			continue
+		}
+		return match.Value().Nb(), true
+	}
+	return assert.LocationCaveats{}, false
+}
+
+// sameRange returns true if the metadata range is the range of the claim,
+// with missing ranges covering the whole shard
+func sameRange(md *metadata.Range, rng *adm.Range) bool {
+	var mdOffset, offset uint64
+	var mdLength, length *uint64
+	if md != nil {
+		mdOffset, mdLength = md.Offset, md.Length
+	}
+	if rng != nil {
+		offset, length = rng.Offset, rng.Length
+	}
+	if mdOffset != offset || (mdLength == nil) != (length == nil) {
+		return false
+	}
+	return mdLength == nil || *mdLength == *length
+}
+
+// metadataMismatch reports a record whose metadata disagrees with its claim
+func (is *IndexingService) metadataMismatch(j job, trace *queryTrace, record claimRecord, fields []string) {
+	var provider peer.ID
+	if record.result.Provider != nil {
+		provider = record.result.Provider.ID
+	}
+	log.Warnw("location commitment metadata disagrees with claim", "claim", record.claimCid, "provider", provider, "fields", fields)
+	trace.mismatch(j, provider, record.claimCid, fields)
+	for _, field := range fields {
+		is.mismatchMetrics.MetadataMismatch(field, provider)
+	}
+	if is.mismatchObserver != nil {
+		is.mismatchObserver.ObserveMismatch(provider, record.claimCid, fields)
+	}
+}
@@ -0,0 +1,185 @@
+package service_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	ipnimd "github.com/ipni/go-libipni/metadata"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	adm "github.com/storacha/indexing-service/pkg/capability/assert/datamodel"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexingService__MetadataMismatch(t *testing.T) {
+	ctx := context.Background()
+	f := newClaimFixture(t)
+	shardHash := testutil.RandomMultihash()
+	length := uint64(20)
+	newLocationClaim := func(t *testing.T, rng *adm.Range) cid.Cid {
+		claim := testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.LocationCaveats]{
+			assert.Location.New(testutil.Service.DID().String(), assert.LocationCaveats{
+				Content:  assert.FromHash(shardHash),
+				Location: []url.URL{*testutil.TestURL},
+				Range:    rng,
+			}),
+		}))(t)
+		return f.addClaim(t, claim)
+	}
+	ranged := newLocationClaim(t, &adm.Range{Offset: 10, Length: &length})
+	unranged := newLocationClaim(t, nil)
+	// the shard is advertised as a CAR, while the claim is for its multihash
+	shard := cid.NewCidV1(uint64(multicodec.Car), shardHash)
+	other := testutil.RandomCID().(cidlink.Link).Cid
+	diagnosed := func(t *testing.T, qr queryresult.QueryResult) queryresult.HashDiagnosis {
+		diagnostics := qr.Diagnostics()
+		require.Len(t, diagnostics, 1)
+		for _, d := range diagnostics {
+			return d
+		}
+		return queryresult.HashDiagnosis{}
+	}
+
+	testCases := []struct {
+		name   string
+		md     *metadata.LocationCommitmentMetadata
+		strict bool
+		// expected are the fields that disagree, and handled the metadata the
+		// claim is followed with, if it isn't left out
+		expected []string
+		handled  *metadata.LocationCommitmentMetadata
+	}{
+		{
+			name:    "agreeing metadata is followed as is",
+			md:      &metadata.LocationCommitmentMetadata{Claim: ranged, Shard: &shard, Range: &metadata.Range{Offset: 10, Length: &length}},
+			handled: &metadata.LocationCommitmentMetadata{Claim: ranged, Shard: &shard, Range: &metadata.Range{Offset: 10, Length: &length}},
+		},
+		{
+			name:    "a zero range agrees with a claim without one",
+			md:      &metadata.LocationCommitmentMetadata{Claim: unranged, Shard: &shard, Range: &metadata.Range{}},
+			handled: &metadata.LocationCommitmentMetadata{Claim: unranged, Shard: &shard, Range: &metadata.Range{}},
+		},
+		{
+			name:    "metadata without a range or shard isn't compared",
+			md:      &metadata.LocationCommitmentMetadata{Claim: ranged},
+			handled: &metadata.LocationCommitmentMetadata{Claim: ranged},
+		},
+		{
+			name:     "a mismatched range is replaced by the claim's",
+			md:       &metadata.LocationCommitmentMetadata{Claim: ranged, Range: &metadata.Range{Offset: 10}},
+			expected: []string{service.MismatchRange},
+			handled:  &metadata.LocationCommitmentMetadata{Claim: ranged, Range: &metadata.Range{Offset: 10, Length: &length}},
+		},
+		{
+			name:     "a mismatched shard is replaced by the claim's content",
+			md:       &metadata.LocationCommitmentMetadata{Claim: unranged, Shard: &other},
+			expected: []string{service.MismatchShard},
+			handled:  &metadata.LocationCommitmentMetadata{Claim: unranged, Shard: ptr(cid.NewCidV1(other.Prefix().Codec, shardHash))},
+		},
+		{
+			name:     "strict checks leave out mismatched records",
+			md:       &metadata.LocationCommitmentMetadata{Claim: ranged, Shard: &other, Range: &metadata.Range{Offset: 10, Length: &length}},
+			strict:   true,
+			expected: []string{service.MismatchShard},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := &locationRecorder{}
+			metrics := &mockMismatchMetrics{}
+			observer := &mockMismatchObserver{}
+			providerIndex := &mockProviderIndex{results: map[string][]model.ProviderResult{string(shardHash): {f.result(t, testutil.RandomBytes(10), tc.md)}}}
+			is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex,
+				service.WithClaimHandler(metadata.LocationCommitmentID, handler),
+				service.WithMismatchMetrics(metrics),
+				service.WithMismatchObserver(observer),
+				service.WithStrictMetadata(tc.strict),
+			))(t)
+
+			qr := testutil.Must(is.Query(ctx, service.Query{Hashes: []multihash.Multihash{shardHash}, Diagnose: true}))(t)
+			var expectedMetrics []string
+			for _, field := range tc.expected {
+				expectedMetrics = append(expectedMetrics, field+" "+f.provider.ID.String())
+			}
+			require.Equal(t, expectedMetrics, metrics.mismatches)
+			if len(tc.expected) > 0 {
+				require.Equal(t, []observedMismatch{{f.provider.ID, tc.md.Claim, tc.expected}}, observer.observed)
+			} else {
+				require.Empty(t, observer.observed)
+			}
+			if tc.handled == nil {
+				require.Empty(t, qr.Claims())
+				require.Empty(t, handler.handled)
+				d := diagnosed(t, qr)
+				require.Equal(t, queryresult.OutcomeProvidersSkipped, d.Outcome)
+				require.Equal(t, "metadata mismatch", d.Skipped[0].Reason)
+				require.Equal(t, tc.expected, d.Mismatches[0].Fields)
+				require.Equal(t, tc.md.Claim.String(), d.Mismatches[0].Claim)
+				return
+			}
+			require.Len(t, qr.Claims(), 1)
+			require.Equal(t, []*metadata.LocationCommitmentMetadata{tc.handled}, handler.handled)
+		})
+	}
+}
+
+// locationRecorder records the metadata of the location commitments it is
+// handed, without following them
+type locationRecorder struct {
+	lk      sync.Mutex
+	handled []*metadata.LocationCommitmentMetadata
+}
+
+func (h *locationRecorder) NewMetadata() ipnimd.Protocol {
+	return &metadata.LocationCommitmentMetadata{}
+}
+
+func (h *locationRecorder) Handle(ctx context.Context, c *service.ClaimContext) error {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	h.handled = append(h.handled, c.Metadata().(*metadata.LocationCommitmentMetadata))
+	return nil
+}
+
+type mockMismatchMetrics struct {
+	lk         sync.Mutex
+	mismatches []string
+}
+
+func (m *mockMismatchMetrics) MetadataMismatch(field string, provider peer.ID) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.mismatches = append(m.mismatches, field+" "+provider.String())
+}
+
+type observedMismatch struct {
+	provider peer.ID
+	claim    cid.Cid
+	fields   []string
+}
+
+type mockMismatchObserver struct {
+	lk       sync.Mutex
+	observed []observedMismatch
+}
+
+func (m *mockMismatchObserver) ObserveMismatch(provider peer.ID, claim cid.Cid, fields []string) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.observed = append(m.observed, observedMismatch{provider, claim, fields})
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// DefaultMaxIndexDepth is the number of levels of nested indexes followed below
+// an index found for a queried hash
+const DefaultMaxIndexDepth = 3
+
+// indexDepthExceeded is the error recorded on the reference to a nested index
+// that was not fetched because it is nested too deep
+const indexDepthExceeded = "index nesting depth exceeded"
+
+// WithMaxIndexDepth sets the number of levels of nested indexes followed below
+// an index found for a queried hash. A nested index is found through an index
+// claim on a shard of another index, and is resolved for the hash the shard
+// was found to contain. Zero follows no nested indexes. If not set,
+// DefaultMaxIndexDepth is used
+func WithMaxIndexDepth(depth int) Option {
+	return func(is *IndexingService) {
+		is.maxIndexDepth = depth
+	}
+}
+
+// indexMemo holds the indexes fetched by a query, by context ID, so that an
+// index reached from several shards or queried hashes is only fetched once
+type indexMemo struct {
+	lk      sync.Mutex
+	indexes map[string]blobindex.ShardedDagIndexView
+}
+
+func newIndexMemo() *indexMemo {
+	return &indexMemo{indexes: map[string]blobindex.ShardedDagIndexView{}}
+}
+
+func (m *indexMemo) get(contextID types.EncodedContextID) (blobindex.ShardedDagIndexView, bool) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	index, ok := m.indexes[string(contextID)]
+	return index, ok
+}
+
+func (m *indexMemo) put(contextID types.EncodedContextID, index blobindex.ShardedDagIndexView) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.indexes[string(contextID)] = index
+}
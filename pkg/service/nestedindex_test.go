@@ -0,0 +1,137 @@
+package service_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// mockIndexes serves indexes by the context ID they are fetched with, counting
+// the fetches of each
+type mockIndexes struct {
+	lk      sync.Mutex
+	indexes map[string]blobindex.ShardedDagIndexView
+	fetches map[string]int
+}
+
+func (m *mockIndexes) Find(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, fetchURL url.URL, rng *metadata.Range) (blobindex.ShardedDagIndexView, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.fetches[string(contextID)]++
+	index, ok := m.indexes[string(contextID)]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return index, nil
+}
+
+// nestedIndexFixture is a two level nested index. The queried hashes are in a
+// shard of the top level index, which has an index claim for the nested index.
+// The nested index has the hashes in a leaf shard with a location
+type nestedIndexFixture struct {
+	hashes []multihash.Multihash
+	// topContextID and nestedContextID are the context IDs the indexes are
+	// fetched with, and nestedClaimContextID that of the nested index claim
+	topContextID, nestedContextID, nestedClaimContextID []byte
+	// claims are those found above the leaf shard, and leafLocation the location
+	// of the leaf shard
+	claims       []cid.Cid
+	leafLocation cid.Cid
+	store        *mockProviderStore
+	indexes      *mockIndexes
+}
+
+func newNestedIndexFixture(t *testing.T, f *claimFixture, hashes int) *nestedIndexFixture {
+	n := &nestedIndexFixture{
+		hashes:               testutil.RandomMultihashes(hashes),
+		topContextID:         testutil.RandomBytes(10),
+		nestedContextID:      testutil.RandomBytes(10),
+		nestedClaimContextID: testutil.RandomBytes(10),
+	}
+	topCid, nestedCid := testutil.RandomCID().(cidlink.Link).Cid, testutil.RandomCID().(cidlink.Link).Cid
+	shardHash, leafHash := testutil.RandomMultihash(), testutil.RandomMultihash()
+	topIndex := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 1)
+	nestedIndex := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 1)
+	for i, hash := range n.hashes {
+		topIndex.SetSlice(shardHash, hash, blobindex.Position{Offset: uint64(i * 10), Length: 10})
+		nestedIndex.SetSlice(leafHash, hash, blobindex.Position{Offset: uint64(i * 10), Length: 10})
+	}
+	topClaim, topLocation, nestedClaim, nestedLocation := f.newClaim(t), f.newClaim(t), f.newClaim(t), f.newClaim(t)
+	n.claims = []cid.Cid{topClaim, topLocation, nestedClaim, nestedLocation}
+	n.leafLocation = f.newClaim(t)
+	n.store = &mockProviderStore{results: map[string][]model.ProviderResult{
+		string(topCid.Hash()):    {f.result(t, n.topContextID, &metadata.LocationCommitmentMetadata{Claim: topLocation})},
+		string(shardHash):        {f.result(t, n.nestedClaimContextID, &metadata.IndexClaimMetadata{Index: nestedCid, Claim: nestedClaim})},
+		string(nestedCid.Hash()): {f.result(t, n.nestedContextID, &metadata.LocationCommitmentMetadata{Claim: nestedLocation})},
+		string(leafHash):         {f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: n.leafLocation})},
+	}}
+	for _, hash := range n.hashes {
+		n.store.results[string(hash)] = []model.ProviderResult{
+			f.result(t, testutil.RandomBytes(10), &metadata.IndexClaimMetadata{Index: topCid, Claim: topClaim}),
+		}
+	}
+	n.indexes = &mockIndexes{
+		indexes: map[string]blobindex.ShardedDagIndexView{
+			string(n.topContextID):    topIndex,
+			string(n.nestedContextID): nestedIndex,
+		},
+		fetches: map[string]int{},
+	}
+	return n
+}
+
+func (n *nestedIndexFixture) service(t *testing.T, opts ...service.Option) *service.IndexingService {
+	providerIndex := providerindex.NewProviderIndex(n.store, &countingFinder{results: map[string][]model.ProviderResult{}, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+	return testutil.Must(service.NewIndexingService(n.indexes, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex, opts...))(t)
+}
+
+func TestIndexingService__NestedIndexes(t *testing.T) {
+	f := newClaimFixture(t)
+
+	t.Run("leaf locations are found", func(t *testing.T) {
+		n := newNestedIndexFixture(t, f, 1)
+		for _, depth := range []int{1, service.DefaultMaxIndexDepth} {
+			claims, indexes := queriedClaims(t, n.service(t, service.WithMaxIndexDepth(depth)), n.hashes[0])
+			require.ElementsMatch(t, append(n.claims, n.leafLocation), claims)
+			require.Equal(t, 2, indexes)
+		}
+	})
+
+	t.Run("nesting depth is limited", func(t *testing.T) {
+		n := newNestedIndexFixture(t, f, 1)
+		qr := testutil.Must(n.service(t, service.WithMaxIndexDepth(0)).Query(context.Background(), service.Query{Hashes: n.hashes}))(t)
+		claims := make([]cid.Cid, 0, len(qr.Claims()))
+		for _, link := range qr.Claims() {
+			claims = append(claims, link.(cidlink.Link).Cid)
+		}
+		// the nested index claim is found, but the index isn't fetched
+		require.ElementsMatch(t, n.claims[:3], claims)
+		require.Len(t, qr.Indexes(), 1)
+		require.Zero(t, n.indexes.fetches[string(n.nestedContextID)])
+		require.Contains(t, qr.IndexRefs().Get(n.nestedClaimContextID).Error, "depth exceeded")
+		require.Empty(t, qr.IndexRefs().Get(types.EncodedContextID(n.topContextID)).Error)
+	})
+
+	t.Run("shared indexes are fetched once", func(t *testing.T) {
+		n := newNestedIndexFixture(t, f, 3)
+		is := n.service(t)
+		qr := testutil.Must(is.Query(context.Background(), service.Query{Hashes: n.hashes}))(t)
+		require.Len(t, qr.Claims(), len(n.claims)+1)
+		require.Equal(t, map[string]int{string(n.topContextID): 1, string(n.nestedContextID): 1}, n.indexes.fetches)
+	})
+}
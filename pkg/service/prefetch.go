@@ -0,0 +1,181 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+)
+
+const (
+	// prefetchBudget is the maximum number of shards prefetched at once. Shards
+	// beyond the budget are not prefetched
+	prefetchBudget = 4
+	// prefetchTimeout bounds how long a prefetch may run once a query asks for
+	// its shard
+	prefetchTimeout = 30 * time.Second
+	// prefetchRecent is how long a prefetched shard is skipped for, so that a
+	// sequential reader doesn't prefetch the same shards on every query. A
+	// prefetch whose shard no query asks for in that time is cancelled
+	prefetchRecent = time.Minute
+)
+
+// prefetcher resolves and caches the locations of shards in the background
+type prefetcher struct {
+	budget chan struct{}
+	// window and timeout are prefetchRecent and prefetchTimeout
+	window  time.Duration
+	timeout time.Duration
+	lk      sync.Mutex
+	recent  map[string]*prefetch
+}
+
+// prefetch is a shard prefetched recently
+type prefetch struct {
+	at        time.Time
+	requested bool
+	// deadline cancels the prefetch, at the end of the recency window until a
+	// query asks for the shard, and prefetchTimeout after one does
+	deadline *time.Timer
+}
+
+func newPrefetcher() *prefetcher {
+	return &prefetcher{
+		budget:  make(chan struct{}, prefetchBudget),
+		window:  prefetchRecent,
+		timeout: prefetchTimeout,
+		recent:  map[string]*prefetch{},
+	}
+}
+
+// claim marks a shard as being prefetched, returning the context to prefetch it
+// with, or false if it was prefetched recently or there is no budget left
+func (p *prefetcher) claim(shard multihash.Multihash) (context.Context, context.CancelFunc, bool) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	now := time.Now()
+	for s, pf := range p.recent {
+		if now.Sub(pf.at) > p.window {
+			delete(p.recent, s)
+		}
+	}
+	if _, ok := p.recent[string(shard)]; ok {
+		return nil, nil, false
+	}
+	select {
+	case p.budget <- struct{}{}:
+	default:
+		return nil, nil, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	pf := &prefetch{at: now, deadline: time.AfterFunc(p.window, cancel)}
+	p.recent[string(shard)] = pf
+	return ctx, func() {
+		p.lk.Lock()
+		pf.deadline.Stop()
+		p.lk.Unlock()
+		cancel()
+	}, true
+}
+
+// requested records that a query asked for the location of a shard, so that a
+// prefetch of it runs on for up to prefetchTimeout rather than being cancelled
+// at the end of the recency window
+func (p *prefetcher) requested(shard multihash.Multihash) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	pf, ok := p.recent[string(shard)]
+	if !ok || pf.requested {
+		return
+	}
+	pf.requested = true
+	pf.deadline.Reset(p.timeout)
+}
+
+func (p *prefetcher) release() {
+	<-p.budget
+}
+
+// nextShards returns up to n shards of the index that follow the given shards,
+// in the order shards are encoded in the index, wrapping around
+func nextShards(index blobindex.ShardedDagIndexView, after []multihash.Multihash, n int) []multihash.Multihash {
+	shards := blobindex.ShardOrder(index)
+	var next []multihash.Multihash
+	for _, shard := range after {
+		i := slices.IndexFunc(shards, func(s multihash.Multihash) bool { return bytes.Equal(s, shard) })
+		if i < 0 {
+			continue
+		}
+		for j := 1; j < len(shards) && len(next) < n; j++ {
+			candidate := shards[(i+j)%len(shards)]
+			if slices.ContainsFunc(after, func(s multihash.Multihash) bool { return bytes.Equal(s, candidate) }) ||
+				slices.ContainsFunc(next, func(s multihash.Multihash) bool { return bytes.Equal(s, candidate) }) {
+				continue
+			}
+			next = append(next, candidate)
+		}
+	}
+	return next
+}
+
+// prefetchShards resolves the location commitments for the shards in the
+// background, which caches the provider records and claims for later queries.
+// Nothing is prefetched while queries are being shed
+func (is *IndexingService) prefetchShards(shards []multihash.Multihash) {
+	if is.admission != nil && is.admission.Shedding() {
+		return
+	}
+	for _, shard := range shards {
+		ctx, cancel, ok := is.prefetcher.claim(shard)
+		if !ok {
+			continue
+		}
+		go func() {
+			defer is.prefetcher.release()
+			defer cancel()
+			if err := is.prefetchShard(ctx, shard); err != nil {
+				log.Debugw("prefetching shard location", "shard", shard, "error", err)
+			}
+		}()
+	}
+}
+
+func (is *IndexingService) prefetchShard(ctx context.Context, shard multihash.Multihash) error {
+	fr, err := is.providerIndex.FindDetailed(ctx, providerindex.QueryKey{
+		Hash:         shard,
+		TargetClaims: targetClaims[locationJobType],
+	})
+	if err != nil {
+		return err
+	}
+	cfg := is.config.Load()
+	for _, result := range fr.Results {
+		if cfg.isDenied(result.Provider, is.identities) || !is.allowedProvider(ctx, result.Provider) {
+			continue
+		}
+		md := metadata.MetadataContext.New()
+		if err := md.UnmarshalBinary(result.Metadata); err != nil {
+			return err
+		}
+		for _, code := range md.Protocols() {
+			location, ok := md.Get(code).(*metadata.LocationCommitmentMetadata)
+			if !ok {
+				continue
+			}
+			url, err := is.fetchClaimURL(ctx, *result.Provider, location.Claim)
+			if err != nil {
+				continue
+			}
+			if _, err := is.claimLookup.LookupClaim(ctx, location.Claim, *url); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetcher__Cancel(t *testing.T) {
+	newPrefetcher := func() *prefetcher {
+		p := newPrefetcher()
+		p.window, p.timeout = 20*time.Millisecond, time.Hour
+		return p
+	}
+
+	t.Run("prefetches of shards not asked for are cancelled after the window", func(t *testing.T) {
+		p := newPrefetcher()
+		ctx, cancel, ok := p.claim(testutil.RandomMultihash())
+		require.True(t, ok)
+		defer cancel()
+		select {
+		case <-ctx.Done():
+			require.ErrorIs(t, ctx.Err(), context.Canceled)
+		case <-time.After(time.Second):
+			t.Fatal("prefetch not cancelled")
+		}
+	})
+
+	t.Run("prefetches of shards asked for run on", func(t *testing.T) {
+		p := newPrefetcher()
+		shard := testutil.RandomMultihash()
+		ctx, cancel, ok := p.claim(shard)
+		require.True(t, ok)
+		p.requested(shard)
+		select {
+		case <-ctx.Done():
+			t.Fatal("prefetch cancelled")
+		case <-time.After(50 * time.Millisecond):
+		}
+		cancel()
+		require.Error(t, ctx.Err())
+	})
+
+	t.Run("recently prefetched shards are skipped", func(t *testing.T) {
+		p := newPrefetcher()
+		shard := testutil.RandomMultihash()
+		_, cancel, ok := p.claim(shard)
+		require.True(t, ok)
+		cancel()
+		p.release()
+		_, _, ok = p.claim(shard)
+		require.False(t, ok)
+	})
+}
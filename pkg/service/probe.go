@@ -0,0 +1,36 @@
+package service
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/ipfs/go-cid"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/service/liveness"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+)
+
+// WithLocationProber checks the location URLs of the results of queries asking
+// for it with the given prober. Without one, queries asking for probes get none
+func WithLocationProber(p *liveness.Prober) Option {
+	return func(is *IndexingService) {
+		is.prober = p
+	}
+}
+
+// probeLocations probes the distinct URLs of the location commitments among the
+// claims, leaving out those the address policy doesn't allow fetching from
+func (is *IndexingService) probeLocations(ctx context.Context, claims map[cid.Cid]delegation.Delegation) map[string]queryresult.LocationProbe {
+	if is.prober == nil {
+		log.Debugw("query asked for location probes, but no prober is configured")
+		return nil
+	}
+	var urls []url.URL
+	for _, claim := range claims {
+		urls = append(urls, is.commitmentURLs(ctx, claim)...)
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	return is.prober.Probe(ctx, urls)
+}
@@ -0,0 +1,73 @@
+package service_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/blobindexlookup"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/liveness"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexingService__ProbeLocations(t *testing.T) {
+	f := newClaimFixture(t)
+	shardHash := testutil.RandomMultihash()
+	serving := newCountingServer(t, 0, func(*http.Request) []byte { return []byte("blob") })
+	stalled := newCountingServer(t, time.Minute, func(*http.Request) []byte { return nil })
+	// the blob paths of the claim fixture's server are not found
+	missing := testutil.Must(url.Parse(f.server.URL + "/missing"))(t)
+	live, hung := serving.url(t, "/shard"), stalled.url(t, "/shard")
+	location := f.addClaim(t, locationsDelegation(t, shardHash, hung, missing, live))
+
+	// the provider serves claims, but not blobs
+	provider := &peer.AddrInfo{ID: f.provider.ID, Addrs: f.provider.Addrs[:1]}
+	record := f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: location})
+	record.Provider = provider
+	results := map[string][]model.ProviderResult{string(shardHash): {record}}
+	providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: results, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+	prober := liveness.New(http.DefaultClient, liveness.WithBudget(200*time.Millisecond))
+	is := testutil.Must(service.NewIndexingService(blobindexlookup.NewBlobIndexLookup(http.DefaultClient), claimlookup.NewClaimLookup(http.DefaultClient), providerIndex, service.WithLocationProber(prober)))(t)
+	q := service.Query{Hashes: []multihash.Multihash{shardHash}, ProbeLocations: true}
+
+	start := time.Now()
+	qr := testutil.Must(is.Query(context.Background(), q))(t)
+	require.Less(t, time.Since(start), 5*time.Second)
+	// claims whose URLs fail their probes are still returned
+	require.Len(t, qr.Claims(), 1)
+	require.Equal(t, location, qr.Claims()[0].(cidlink.Link).Cid)
+	probes := qr.Probes()
+	require.Len(t, probes, 3)
+	require.Equal(t, queryresult.ProbeLive, probes[live.String()].Status)
+	require.Equal(t, http.StatusOK, probes[live.String()].Code)
+	require.Equal(t, queryresult.ProbeFailed, probes[missing.String()].Status)
+	require.Equal(t, http.StatusNotFound, probes[missing.String()].Code)
+	require.Equal(t, queryresult.ProbeTimeout, probes[hung.String()].Status)
+
+	t.Run("recent probes are reused", func(t *testing.T) {
+		requests := serving.requests.Load()
+		qr := testutil.Must(is.Query(context.Background(), q))(t)
+		require.True(t, qr.Probes()[live.String()].Cached)
+		require.Equal(t, requests, serving.requests.Load())
+	})
+
+	t.Run("queries not asking for probes get none", func(t *testing.T) {
+		requests := serving.requests.Load()
+		qr := testutil.Must(is.Query(context.Background(), service.Query{Hashes: []multihash.Multihash{shardHash}}))(t)
+		require.Len(t, qr.Claims(), 1)
+		require.Nil(t, qr.Probes())
+		require.Equal(t, requests, serving.requests.Load())
+	})
+}
@@ -0,0 +1,541 @@
+// Package prommetrics exports the metrics of the service for scraping in the
+// Prometheus text format, without needing a metrics pipeline of its own. An
+// Exporter implements the metrics interfaces of the components of the service,
+// so that one exporter can be given to each of them
+package prommetrics
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service/deadletter"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/service/shadow"
+)
+
+var log = logging.Logger("prommetrics")
+
+const namespace = "indexing"
+
+// outcomes of the operations counted
+const (
+	outcomeHit     = "hit"
+	outcomeMiss    = "miss"
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+	outcomeAdmit   = "admitted"
+	outcomeReject  = "rejected"
+)
+
+// deadLetterStatsTimeout bounds how long a scrape waits for the depth of the
+// dead letter queue
+const deadLetterStatsTimeout = 5 * time.Second
+
+type (
+	// Option configures an Exporter
+	Option func(*Exporter)
+
+	// Exporter records the metrics of the service in a registry of its own and
+	// serves them for scraping
+	Exporter struct {
+		registry        *prometheus.Registry
+		providerBuckets int
+
+		cacheReads     *prometheus.CounterVec
+		ipniFinds      *prometheus.HistogramVec
+		walkDurations  *prometheus.HistogramVec
+		walkJobs       prometheus.Histogram
+		claimFetches   *prometheus.CounterVec
+		claimDurations *prometheus.HistogramVec
+		hedges         *prometheus.CounterVec
+		hedgesWon      *prometheus.CounterVec
+		announcements  *prometheus.CounterVec
+		shedding       prometheus.Gauge
+		shed           prometheus.Counter
+		shedCost       prometheus.Counter
+		dnsLookups     *prometheus.HistogramVec
+		shadowWrites   *prometheus.CounterVec
+		shadowReads    *prometheus.CounterVec
+		probes         *prometheus.CounterVec
+		httpConns      prometheus.Gauge
+		httpWaits      prometheus.Histogram
+		cooldowns      prometheus.Counter
+		refused        prometheus.Counter
+		selfChecks     *prometheus.CounterVec
+		selfCheckTimes *prometheus.HistogramVec
+		coalesced      prometheus.Counter
+		publishWaits   prometheus.Counter
+		tooComplex     *prometheus.CounterVec
+		admissions     *prometheus.CounterVec
+		skewSalvaged   *prometheus.CounterVec
+		filterChecks   *prometheus.CounterVec
+		populations    *prometheus.CounterVec
+		eventsDropped  prometheus.Counter
+		mismatches     *prometheus.CounterVec
+
+		lk    sync.Mutex
+		conns map[string]int
+	}
+)
+
+// WithProviderBuckets labels claim fetches with the bucket of their provider,
+// one of n buckets its peer ID is hashed into, so that slow or failing
+// providers show up without a series per provider. By default fetches aren't
+// labelled by provider at all
+func WithProviderBuckets(n int) Option {
+	return func(e *Exporter) {
+		e.providerBuckets = n
+	}
+}
+
+// New returns a new exporter with its metrics registered
+func New(opts ...Option) *Exporter {
+	e := &Exporter{registry: prometheus.NewRegistry(), conns: map[string]int{}}
+	for _, opt := range opts {
+		opt(e)
+	}
+	claimLabels := []string{"claim_type", "outcome"}
+	if e.providerBuckets > 0 {
+		claimLabels = append(claimLabels, "provider_bucket")
+	}
+	e.cacheReads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_reads_total",
+		Help:      "Reads of the caches of the service, by store and whether they hit",
+	}, []string{"store", "outcome"})
+	e.ipniFinds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ipni_find_duration_seconds",
+		Help:      "Latency of finds sent to IPNI on cache misses",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"outcome"})
+	e.walkDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "query_walk_duration_seconds",
+		Help:      "Duration of the walks of queries",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"outcome"})
+	e.walkJobs = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "query_walk_jobs",
+		Help:      "Jobs run by the walk of each query, which is how far it fanned out",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 11),
+	})
+	e.claimFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "claim_fetches_total",
+		Help:      "Attempts to fetch claims from providers, by claim type and outcome",
+	}, claimLabels)
+	e.claimDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "claim_fetch_duration_seconds",
+		Help:      "Latency of attempts to fetch claims from providers, by claim type",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"claim_type"})
+	e.hedges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hedged_fetches_total",
+		Help:      "Fetches of claims and indexes hedged by fetching from another URL as well, by what was fetched",
+	}, []string{"fetch"})
+	e.hedgesWon = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hedged_fetches_won_total",
+		Help:      "Hedged fetches that completed before the fetch they hedged, by what was fetched",
+	}, []string{"fetch"})
+	e.announcements = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "announcements_total",
+		Help:      "Announcements of advertisements sent, by announce endpoint and outcome",
+	}, []string{"endpoint", "outcome"})
+	e.shedding = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "shedding",
+		Help:      "Whether expensive queries are being shed, 1 if so",
+	})
+	e.shed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queries_shed_total",
+		Help:      "Queries rejected while shedding",
+	})
+	e.shedCost = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queries_shed_cost_total",
+		Help:      "Estimated cost of the queries rejected while shedding",
+	})
+	e.dnsLookups = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "dns_lookup_duration_seconds",
+		Help:      "Latency of DNS lookups sent over HTTPS, by record type and outcome",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"record_type", "outcome"})
+	e.shadowWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "shadow_writes_lost_total",
+		Help:      "Writes not copied to the shadow secondary, by whether they were dropped or failed",
+	}, []string{"outcome"})
+	e.shadowReads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "shadow_reads_total",
+		Help:      "Queries compared with the shadow secondary, by whether they matched",
+	}, []string{"outcome"})
+	e.probes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "location_probes_total",
+		Help:      "Liveness probes of location URLs, by status",
+	}, []string{"status"})
+	e.httpConns = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "http_open_connections",
+		Help:      "Outbound connections open to providers and indexers",
+	})
+	e.httpWaits = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_host_limit_wait_seconds",
+		Help:      "Time requests to hosts with a limit waited for a slot",
+		Buckets:   prometheus.DefBuckets,
+	})
+	e.cooldowns = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_host_cooldowns_total",
+		Help:      "Times providers and indexers were left alone after throttling or failing",
+	})
+	e.refused = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_cooldown_refused_total",
+		Help:      "Requests not sent because their host was cooling down",
+	})
+	e.selfChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "self_check_stages_total",
+		Help:      "Stages of self checks run, by stage and whether they passed, failed or were skipped",
+	}, []string{"stage", "status"})
+	e.selfCheckTimes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "self_check_stage_duration_seconds",
+		Help:      "Duration of the stages of self checks that ran, by stage",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"stage"})
+	e.coalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "publishes_coalesced_total",
+		Help:      "Publishes that waited on a publish of the same claim already in progress",
+	})
+	e.publishWaits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "publish_waits_timed_out_total",
+		Help:      "Coalesced publishes that gave up waiting on the publish in progress",
+	})
+	e.tooComplex = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "claims_too_complex_total",
+		Help:      "Fetched claims rejected for exceeding the limits, by the limit exceeded",
+	}, []string{"reason"})
+	e.admissions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "claim_cache_admissions_total",
+		Help:      "Fetched claims admitted to or rejected from the claim cache, by outcome",
+	}, []string{"outcome"})
+	e.skewSalvaged = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "claims_skew_salvaged_total",
+		Help:      "Imported claims valid only within the clock skew tolerance, by the timestamp they were outside of",
+	}, []string{"timestamp"})
+	e.filterChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "advertised_filter_checks_total",
+		Help:      "Checks of the advertised filter before asking IPNI about a hash, by outcome",
+	}, []string{"outcome"})
+	e.populations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "index_populations_total",
+		Help:      "Requests to cache the provider records of fetched indexes, by whether they were queued, already in flight or dropped",
+	}, []string{"outcome"})
+	e.eventsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_events_dropped_total",
+		Help:      "Cache events dropped because the sink they are sent to fell behind",
+	})
+	mismatchLabels := []string{"field"}
+	if e.providerBuckets > 0 {
+		mismatchLabels = append(mismatchLabels, "provider_bucket")
+	}
+	e.mismatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "location_metadata_mismatches_total",
+		Help:      "Provider records whose location commitment metadata disagreed with the claim fetched for them, by the field that disagreed",
+	}, mismatchLabels)
+	e.registry.MustRegister(
+		e.cacheReads, e.ipniFinds, e.walkDurations, e.walkJobs, e.claimFetches,
+		e.claimDurations, e.hedges, e.hedgesWon, e.announcements, e.shedding, e.shed, e.shedCost,
+		e.dnsLookups, e.shadowWrites, e.shadowReads, e.probes, e.httpConns, e.httpWaits,
+		e.cooldowns, e.refused, e.selfChecks, e.selfCheckTimes, e.coalesced, e.publishWaits,
+		e.tooComplex, e.admissions, e.skewSalvaged, e.filterChecks, e.populations,
+		e.eventsDropped, e.mismatches,
+	)
+	return e
+}
+
+// Registry returns the registry the metrics are recorded in, to register
+// further collectors with
+func (e *Exporter) Registry() *prometheus.Registry {
+	return e.registry
+}
+
+// Handler returns a handler serving the metrics for scraping
+func (e *Exporter) Handler() http.Handler {
+	return promhttp.HandlerFor(e.registry, promhttp.HandlerOpts{})
+}
+
+// TrackDeadLetters reports the depth of the dead letter queue, and the writes it
+// dropped, read from the queue at each scrape. Only one queue may be tracked
+func (e *Exporter) TrackDeadLetters(q *deadletter.Queue) error {
+	if err := e.registry.Register(newDeadLetterCollector(q)); err != nil {
+		return fmt.Errorf("registering dead letter queue metrics: %w", err)
+	}
+	return nil
+}
+
+// CacheRead implements types.CacheMetrics
+func (e *Exporter) CacheRead(store string, hit bool) {
+	outcome := outcomeMiss
+	if hit {
+		outcome = outcomeHit
+	}
+	e.cacheReads.WithLabelValues(store, outcome).Inc()
+}
+
+// IPNIFind implements providerindex.Metrics
+func (e *Exporter) IPNIFind(duration time.Duration, err error) {
+	e.ipniFinds.WithLabelValues(outcome(err)).Observe(duration.Seconds())
+}
+
+// QueryWalked implements service.Metrics
+func (e *Exporter) QueryWalked(duration time.Duration, jobs int, err error) {
+	e.walkDurations.WithLabelValues(outcome(err)).Observe(duration.Seconds())
+	e.walkJobs.Observe(float64(jobs))
+}
+
+// ClaimFetched implements service.Metrics
+func (e *Exporter) ClaimFetched(kind metadata.Kind, provider peer.ID, duration time.Duration, err error) {
+	labels := []string{kind.String(), outcome(err)}
+	if e.providerBuckets > 0 {
+		labels = append(labels, e.providerBucket(provider))
+	}
+	e.claimFetches.WithLabelValues(labels...).Inc()
+	e.claimDurations.WithLabelValues(kind.String()).Observe(duration.Seconds())
+}
+
+// HedgeLaunched implements service.HedgeMetrics
+func (e *Exporter) HedgeLaunched(fetch string) {
+	e.hedges.WithLabelValues(fetch).Inc()
+}
+
+// HedgeWon implements service.HedgeMetrics
+func (e *Exporter) HedgeWon(fetch string) {
+	e.hedgesWon.WithLabelValues(fetch).Inc()
+}
+
+// PublishCoalesced implements service.PublishMetrics
+func (e *Exporter) PublishCoalesced() {
+	e.coalesced.Inc()
+}
+
+// PublishWaitTimedOut implements service.PublishMetrics
+func (e *Exporter) PublishWaitTimedOut() {
+	e.publishWaits.Inc()
+}
+
+// ClaimTooComplex implements claimlookup.LimitMetrics
+func (e *Exporter) ClaimTooComplex(reason string) {
+	e.tooComplex.WithLabelValues(reason).Inc()
+}
+
+// ClaimAdmitted implements claimlookup.AdmissionMetrics
+func (e *Exporter) ClaimAdmitted(admitted bool) {
+	outcome := outcomeReject
+	if admitted {
+		outcome = outcomeAdmit
+	}
+	e.admissions.WithLabelValues(outcome).Inc()
+}
+
+// IndexPopulation implements providercacher.PopulationMetrics
+func (e *Exporter) IndexPopulation(outcome string) {
+	e.populations.WithLabelValues(outcome).Inc()
+}
+
+// CacheEventDropped implements redis.CacheEventMetrics
+func (e *Exporter) CacheEventDropped() {
+	e.eventsDropped.Inc()
+}
+
+// ClaimSkewSalvaged implements claimlookup.SkewMetrics
+func (e *Exporter) ClaimSkewSalvaged(timestamp string) {
+	e.skewSalvaged.WithLabelValues(timestamp).Inc()
+}
+
+// MetadataMismatch implements service.MismatchMetrics
+func (e *Exporter) MetadataMismatch(field string, provider peer.ID) {
+	labels := []string{field}
+	if e.providerBuckets > 0 {
+		labels = append(labels, e.providerBucket(provider))
+	}
+	e.mismatches.WithLabelValues(labels...).Inc()
+}
+
+// AdvertisedFilterChecked implements providerindex.FilterMetrics
+func (e *Exporter) AdvertisedFilterChecked(outcome string) {
+	e.filterChecks.WithLabelValues(outcome).Inc()
+}
+
+// providerBucket hashes the peer ID into one of the provider buckets
+func (e *Exporter) providerBucket(provider peer.ID) string {
+	h := fnv.New32a()
+	h.Write([]byte(provider))
+	return fmt.Sprint(h.Sum32() % uint32(e.providerBuckets))
+}
+
+// AnnounceSent implements publisher.AnnounceMetrics. Endpoints are those of
+// the config, so are few
+func (e *Exporter) AnnounceSent(endpoint string, err error) {
+	e.announcements.WithLabelValues(endpoint, outcome(err)).Inc()
+}
+
+// SheddingChanged implements admission.Metrics
+func (e *Exporter) SheddingChanged(shedding bool) {
+	if shedding {
+		e.shedding.Set(1)
+	} else {
+		e.shedding.Set(0)
+	}
+}
+
+// Rejected implements admission.Metrics
+func (e *Exporter) Rejected(cost int) {
+	e.shed.Inc()
+	e.shedCost.Add(float64(cost))
+}
+
+// Resolved implements dnsresolver.Metrics
+func (e *Exporter) Resolved(recordType string, duration time.Duration, err error) {
+	e.dnsLookups.WithLabelValues(recordType, outcome(err)).Observe(duration.Seconds())
+}
+
+// WriteDropped implements shadow.Metrics
+func (e *Exporter) WriteDropped() {
+	e.shadowWrites.WithLabelValues("dropped").Inc()
+}
+
+// WriteFailed implements shadow.Metrics
+func (e *Exporter) WriteFailed(error) {
+	e.shadowWrites.WithLabelValues(outcomeFailure).Inc()
+}
+
+// ReadCompared implements shadow.Metrics
+func (e *Exporter) ReadCompared(d shadow.Diff) {
+	if d.Equal() {
+		e.shadowReads.WithLabelValues("match").Inc()
+	} else {
+		e.shadowReads.WithLabelValues("diff").Inc()
+	}
+}
+
+// ReadFailed implements shadow.Metrics
+func (e *Exporter) ReadFailed(error) {
+	e.shadowReads.WithLabelValues(outcomeFailure).Inc()
+}
+
+// ObserveProbe implements liveness.Observer. Probes aren't labelled by URL, of
+// which there are as many as there are blobs
+func (e *Exporter) ObserveProbe(_ url.URL, probe queryresult.LocationProbe) {
+	e.probes.WithLabelValues(string(probe.Status)).Inc()
+}
+
+// Conns implements httppool.Metrics. Connections are summed across hosts, of
+// which there are as many as there are providers
+func (e *Exporter) Conns(host string, open int) {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	if open == 0 {
+		delete(e.conns, host)
+	} else {
+		e.conns[host] = open
+	}
+	total := 0
+	for _, n := range e.conns {
+		total += n
+	}
+	e.httpConns.Set(float64(total))
+}
+
+// Waited implements httppool.Metrics
+func (e *Exporter) Waited(_ string, wait time.Duration) {
+	e.httpWaits.Observe(wait.Seconds())
+}
+
+// CooledDown implements httppool.Metrics
+func (e *Exporter) CooledDown(string, time.Duration) {
+	e.cooldowns.Inc()
+}
+
+// Refused implements httppool.Metrics
+func (e *Exporter) Refused(string) {
+	e.refused.Inc()
+}
+
+// SelfChecked implements service.SelfCheckMetrics
+func (e *Exporter) SelfChecked(stage, status string, duration time.Duration) {
+	e.selfChecks.WithLabelValues(stage, status).Inc()
+	if status != "skipped" {
+		e.selfCheckTimes.WithLabelValues(stage).Observe(duration.Seconds())
+	}
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return outcomeFailure
+	}
+	return outcomeSuccess
+}
+
+// deadLetterCollector reads the stats of a dead letter queue when scraped
+type deadLetterCollector struct {
+	queue   *deadletter.Queue
+	depth   *prometheus.Desc
+	dropped *prometheus.Desc
+}
+
+func newDeadLetterCollector(q *deadletter.Queue) *deadLetterCollector {
+	return &deadLetterCollector{
+		queue:   q,
+		depth:   prometheus.NewDesc(namespace+"_dead_letters", "Failed provider writes waiting to be replayed", nil, nil),
+		dropped: prometheus.NewDesc(namespace+"_dead_letters_dropped_total", "Failed provider writes dropped for exceeding the maximum age", nil, nil),
+	}
+}
+
+func (c *deadLetterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.depth
+	ch <- c.dropped
+}
+
+func (c *deadLetterCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), deadLetterStatsTimeout)
+	defer cancel()
+	stats, err := c.queue.Stats(ctx)
+	if err != nil {
+		log.Warnw("reading dead letter queue stats", "error", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.depth, prometheus.GaugeValue, float64(stats.Depth))
+	ch <- prometheus.MustNewConstMetric(c.dropped, prometheus.CounterValue, float64(stats.Dropped))
+}
@@ -1,16 +1,50 @@
 package providercacher
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
 
+	logging "github.com/ipfs/go-log/v2"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
 	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+var log = logging.Logger("providercacher")
+
+const (
+	// DefaultConcurrency is the number of indexes whose provider records are
+	// cached at once when not otherwise configured
+	DefaultConcurrency = 5
+	// DefaultBuffer is the number of indexes waiting for their provider records
+	// to be cached when not otherwise configured
+	DefaultBuffer = 5
+)
+
+// outcomes of queueing the caching of provider records for an index
+const (
+	// PopulationQueued is for jobs queued to cache the records
+	PopulationQueued = "queued"
+	// PopulationInFlight is for indexes already queued or being cached
+	PopulationInFlight = "in_flight"
+	// PopulationDropped is for jobs dropped because the queue was full
+	PopulationDropped = "dropped"
 )
 
 type (
 	ProviderCachingJob struct {
-		provider model.ProviderResult
-		index    blobindex.ShardedDagIndexView
+		contextID types.EncodedContextID
+		provider  model.ProviderResult
+		index     blobindex.ShardedDagIndexView
+		// done is called once the job is handled
+		done func()
 	}
 
 	JobQueue interface {
@@ -19,30 +53,200 @@ type (
 
 	JobHandler struct {
 		providerCacher ProviderCacher
+		containing     types.ContainingIndexStore
+		markers        types.PopulationMarkerStore
 	}
 
+	// JobHandlerOption configures a JobHandler
+	JobHandlerOption func(*JobHandler)
+
+	// PopulationMetrics is told the outcome of each request to cache the
+	// provider records of an index
+	PopulationMetrics interface {
+		IndexPopulation(outcome string)
+	}
+
+	// CachingQueueOption configures a CachingQueue
+	CachingQueueOption func(*CachingQueue)
+
+	// CachingQueue queues a job for each index whose provider records are to be
+	// cached, unless one is already queued or running for its context ID
 	CachingQueue struct {
-		jobQueue JobQueue
+		jobQueue   JobQueue
+		maxPending int
+		metrics    PopulationMetrics
+
+		lk       sync.Mutex
+		inFlight map[string]struct{}
 	}
 )
 
-func NewJobHandler(providerCacher ProviderCacher) *JobHandler {
-	return &JobHandler{
+type noopPopulationMetrics struct{}
+
+func (noopPopulationMetrics) IndexPopulation(string) {}
+
+// WithContainingIndexes also records the index each block is in, once provider
+// records for the blocks of the index are cached
+func WithContainingIndexes(store types.ContainingIndexStore) JobHandlerOption {
+	return func(j *JobHandler) {
+		j.containing = store
+	}
+}
+
+// WithPopulationMarkers records the digest of each index whose provider records
+// were cached, so that an index isn't expanded again until its marker expires,
+// even after a restart
+func WithPopulationMarkers(store types.PopulationMarkerStore) JobHandlerOption {
+	return func(j *JobHandler) {
+		j.markers = store
+	}
+}
+
+func NewJobHandler(providerCacher ProviderCacher, opts ...JobHandlerOption) *JobHandler {
+	j := &JobHandler{
 		providerCacher: providerCacher,
 	}
+	for _, opt := range opts {
+		opt(j)
+	}
+	return j
 }
 
 func (j *JobHandler) Handle(ctx context.Context, job ProviderCachingJob) error {
-	_, err := j.providerCacher.CacheProviderForIndexRecords(ctx, job.provider, job.index)
-	return err
+	if job.done != nil {
+		defer job.done()
+	}
+	var digest multihash.Multihash
+	if j.markers != nil {
+		var err error
+		digest, err = indexDigest(job.index)
+		if err != nil {
+			return err
+		}
+		populated, err := j.markers.Get(ctx, job.contextID)
+		if err == nil && bytes.Equal(populated, digest) {
+			log.Debugw("index already populated", "contextID", job.contextID)
+			return nil
+		}
+		if err != nil && !errors.Is(err, types.ErrKeyNotFound) {
+			return fmt.Errorf("reading population marker: %w", err)
+		}
+	}
+	if _, err := j.providerCacher.CacheProviderForIndexRecords(ctx, job.provider, job.index); err != nil {
+		return err
+	}
+	if err := j.recordContaining(ctx, job); err != nil {
+		return err
+	}
+	if j.markers != nil {
+		if err := j.markers.Set(ctx, job.contextID, digest, true); err != nil {
+			return fmt.Errorf("recording population marker: %w", err)
+		}
+	}
+	return nil
 }
 
-func NewCachingQueue(jobQueue JobQueue) *CachingQueue {
-	return &CachingQueue{
+func (j *JobHandler) recordContaining(ctx context.Context, job ProviderCachingJob) error {
+	if j.containing == nil {
+		return nil
+	}
+	var hashes []multihash.Multihash
+	for _, shardIndex := range job.index.Shards().Iterator() {
+		for hash := range shardIndex.Iterator() {
+			hashes = append(hashes, hash)
+		}
+	}
+	ref := types.IndexRef{ContextID: job.contextID}
+	if content, ok := job.index.Content().(cidlink.Link); ok {
+		ref.Content = content.Cid.Hash()
+	}
+	if err := j.containing.Add(ctx, ref, hashes); err != nil {
+		return fmt.Errorf("recording containing index: %w", err)
+	}
+	return nil
+}
+
+// indexDigest returns the sha256 digest of the archived index
+func indexDigest(index blobindex.ShardedDagIndexView) (multihash.Multihash, error) {
+	r, err := index.Archive()
+	if err != nil {
+		return nil, fmt.Errorf("archiving index: %w", err)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, fmt.Errorf("archiving index: %w", err)
+	}
+	return multihash.Encode(h.Sum(nil), multihash.SHA2_256)
+}
+
+// WithMaxPending bounds the number of jobs queued or running. Once that many
+// are, further jobs are dropped rather than waited on. The bound should be no
+// more than the concurrency and buffer of the job queue together, so that
+// queueing doesn't block
+func WithMaxPending(n int) CachingQueueOption {
+	return func(q *CachingQueue) {
+		q.maxPending = n
+	}
+}
+
+// WithPopulationMetrics reports the outcome of each request to cache the
+// provider records of an index
+func WithPopulationMetrics(m PopulationMetrics) CachingQueueOption {
+	return func(q *CachingQueue) {
+		q.metrics = m
+	}
+}
+
+func NewCachingQueue(jobQueue JobQueue, opts ...CachingQueueOption) *CachingQueue {
+	q := &CachingQueue{
 		jobQueue: jobQueue,
+		metrics:  noopPopulationMetrics{},
+		inFlight: map[string]struct{}{},
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
+}
+
+// QueueProviderCaching queues a job caching the provider records of the index,
+// unless one is already queued or running for the context ID, or the queue is
+// full. Neither is an error, as the records are cached by another job or when
+// the index is next fetched
+func (q *CachingQueue) QueueProviderCaching(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, index blobindex.ShardedDagIndexView) error {
+	q.lk.Lock()
+	if _, ok := q.inFlight[string(contextID)]; ok {
+		q.lk.Unlock()
+		q.metrics.IndexPopulation(PopulationInFlight)
+		return nil
+	}
+	if q.maxPending > 0 && len(q.inFlight) >= q.maxPending {
+		q.lk.Unlock()
+		q.metrics.IndexPopulation(PopulationDropped)
+		log.Warnw("provider caching queue is full, dropping index", "contextID", contextID)
+		return nil
+	}
+	q.inFlight[string(contextID)] = struct{}{}
+	q.lk.Unlock()
+
+	done := func() { q.release(contextID) }
+	if err := q.jobQueue.Queue(ctx, ProviderCachingJob{contextID: contextID, provider: provider, index: index, done: done}); err != nil {
+		done()
+		return err
 	}
+	q.metrics.IndexPopulation(PopulationQueued)
+	return nil
+}
+
+// Pending returns the number of jobs queued or running
+func (q *CachingQueue) Pending() int {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	return len(q.inFlight)
 }
 
-func (q *CachingQueue) QueueProviderCaching(ctx context.Context, provider model.ProviderResult, index blobindex.ShardedDagIndexView) error {
-	return q.jobQueue.Queue(ctx, ProviderCachingJob{provider: provider, index: index})
+func (q *CachingQueue) release(contextID types.EncodedContextID) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	delete(q.inFlight, string(contextID))
 }
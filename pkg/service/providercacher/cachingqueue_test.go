@@ -0,0 +1,228 @@
+package providercacher_test
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/jobqueue"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service/blobindexlookup"
+	"github.com/storacha/indexing-service/pkg/service/providercacher"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachingQueue(t *testing.T) {
+	ctx := context.Background()
+	provider := testutil.RandomProviderResult()
+	contextID := types.EncodedContextID(testutil.RandomBytes(10))
+	_, index := testutil.RandomShardedDagIndexView(8)
+	hashes := 0
+	for _, shard := range index.Shards().Iterator() {
+		hashes += shard.Size()
+	}
+
+	// start starts a queue, as the service does on startup, and returns it
+	// shut down when the test ends
+	start := func(t *testing.T, store types.ProviderStore, markers types.PopulationMarkerStore, metrics providercacher.PopulationMetrics) *providercacher.CachingQueue {
+		handler := providercacher.NewJobHandler(providercacher.NewSimpleProviderCacher(store), providercacher.WithPopulationMarkers(markers))
+		jobQueue := jobqueue.NewJobQueue(handler.Handle, jobqueue.WithBuffer(2), jobqueue.WithConcurrency(2))
+		jobQueue.Startup()
+		t.Cleanup(func() { jobQueue.Shutdown(ctx) })
+		return providercacher.NewCachingQueue(jobQueue, providercacher.WithMaxPending(4), providercacher.WithPopulationMetrics(metrics))
+	}
+	drained := func(t *testing.T, q *providercacher.CachingQueue) {
+		require.Eventually(t, func() bool { return q.Pending() == 0 }, time.Second, time.Millisecond)
+	}
+
+	t.Run("concurrent fetches of an index populate it once", func(t *testing.T) {
+		store := newCountingProviderStore()
+		// the first population is held until every fetch is done
+		store.gate = make(chan struct{})
+		metrics := &populationMetrics{outcomes: map[string]int{}}
+		q := start(t, store, &memCache[types.EncodedContextID, multihash.Multihash]{}, metrics)
+
+		// every fetch misses the cache before any of them lands
+		fetches := &barrierLookup{index: index, barrier: make(chan struct{})}
+		lookup := blobindexlookup.WithCache(fetches, &memCache[types.EncodedContextID, blobindex.ShardedDagIndexView]{}, q)
+		var wg sync.WaitGroup
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				testutil.Must(lookup.Find(ctx, contextID, provider, *testutil.TestURL, nil))(t)
+			}()
+		}
+		require.Eventually(t, func() bool { return fetches.count() == 5 }, time.Second, time.Millisecond)
+		close(fetches.barrier)
+		wg.Wait()
+		close(store.gate)
+		drained(t, q)
+
+		require.Equal(t, hashes, store.sets(), "each hash is written once")
+		require.Equal(t, map[string]int{providercacher.PopulationQueued: 1, providercacher.PopulationInFlight: 4}, metrics.outcomes)
+
+		// once done, the index can be queued again
+		require.NoError(t, q.QueueProviderCaching(ctx, contextID, provider, index))
+		require.Equal(t, 2, metrics.outcomes[providercacher.PopulationQueued])
+		drained(t, q)
+	})
+
+	t.Run("a populated index isn't expanded again after a restart", func(t *testing.T) {
+		markers := &memCache[types.EncodedContextID, multihash.Multihash]{}
+		store := newCountingProviderStore()
+		q := start(t, store, markers, &populationMetrics{outcomes: map[string]int{}})
+		require.NoError(t, q.QueueProviderCaching(ctx, contextID, provider, index))
+		drained(t, q)
+		require.Equal(t, hashes, store.sets())
+
+		// a restarted service has a new queue and an empty provider store, as if
+		// it were another replica, but the same markers
+		restarted := newCountingProviderStore()
+		q = start(t, restarted, markers, &populationMetrics{outcomes: map[string]int{}})
+		require.NoError(t, q.QueueProviderCaching(ctx, contextID, provider, index))
+		drained(t, q)
+		require.Zero(t, restarted.gets(), "the index isn't expanded")
+
+		// an index that has changed since it was populated is expanded
+		_, changed := testutil.RandomShardedDagIndexView(4)
+		require.NoError(t, q.QueueProviderCaching(ctx, contextID, provider, changed))
+		drained(t, q)
+		require.NotZero(t, restarted.sets())
+	})
+
+	t.Run("jobs are dropped once the queue is full", func(t *testing.T) {
+		store := newCountingProviderStore()
+		store.gate = make(chan struct{})
+		metrics := &populationMetrics{outcomes: map[string]int{}}
+		q := start(t, store, &memCache[types.EncodedContextID, multihash.Multihash]{}, metrics)
+		for range 6 {
+			require.NoError(t, q.QueueProviderCaching(ctx, testutil.RandomBytes(10), provider, index))
+		}
+		require.Equal(t, 4, q.Pending())
+		require.Equal(t, map[string]int{providercacher.PopulationQueued: 4, providercacher.PopulationDropped: 2}, metrics.outcomes)
+		close(store.gate)
+		drained(t, q)
+	})
+}
+
+type populationMetrics struct {
+	lk       sync.Mutex
+	outcomes map[string]int
+}
+
+func (m *populationMetrics) IndexPopulation(outcome string) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.outcomes[outcome]++
+}
+
+// barrierLookup holds every fetch of the index until the barrier is closed
+type barrierLookup struct {
+	index   blobindex.ShardedDagIndexView
+	barrier chan struct{}
+	lk      sync.Mutex
+	fetches int
+}
+
+func (b *barrierLookup) Find(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, fetchURL url.URL, rng *metadata.Range) (blobindex.ShardedDagIndexView, error) {
+	b.lk.Lock()
+	b.fetches++
+	b.lk.Unlock()
+	<-b.barrier
+	return b.index, nil
+}
+
+func (b *barrierLookup) count() int {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return b.fetches
+}
+
+// countingProviderStore counts the reads and writes of records. If gate is set,
+// writes wait for it to be closed
+type countingProviderStore struct {
+	gate           chan struct{}
+	lk             sync.Mutex
+	results        map[string][]model.ProviderResult
+	getCnt, setCnt int
+}
+
+func newCountingProviderStore() *countingProviderStore {
+	return &countingProviderStore{results: map[string][]model.ProviderResult{}}
+}
+
+func (s *countingProviderStore) Get(ctx context.Context, hash multihash.Multihash) ([]model.ProviderResult, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.getCnt++
+	results, ok := s.results[string(hash)]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return results, nil
+}
+
+func (s *countingProviderStore) Set(ctx context.Context, hash multihash.Multihash, results []model.ProviderResult, expires bool) error {
+	if s.gate != nil {
+		<-s.gate
+	}
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.setCnt++
+	s.results[string(hash)] = results
+	return nil
+}
+
+func (s *countingProviderStore) SetExpirable(ctx context.Context, hash multihash.Multihash, expires bool) error {
+	return nil
+}
+
+func (s *countingProviderStore) gets() int {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.getCnt
+}
+
+func (s *countingProviderStore) sets() int {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.setCnt
+}
+
+// memCache is a cache of values in memory, by the bytes of their keys
+type memCache[Key ~[]byte, Value any] struct {
+	lk     sync.Mutex
+	values map[string]Value
+}
+
+func (m *memCache[Key, Value]) Get(ctx context.Context, key Key) (Value, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	v, ok := m.values[string(key)]
+	if !ok {
+		return v, types.ErrKeyNotFound
+	}
+	return v, nil
+}
+
+func (m *memCache[Key, Value]) Set(ctx context.Context, key Key, value Value, expires bool) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if m.values == nil {
+		m.values = map[string]Value{}
+	}
+	m.values[string(key)] = value
+	return nil
+}
+
+func (m *memCache[Key, Value]) SetExpirable(ctx context.Context, key Key, expires bool) error {
+	return nil
+}
@@ -7,24 +7,47 @@ import (
 	"slices"
 
 	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
 	"github.com/storacha/indexing-service/pkg/blobindex"
 	"github.com/storacha/indexing-service/pkg/providerresults"
 	"github.com/storacha/indexing-service/pkg/types"
 )
 
+// DeadLetters records provider cache writes that failed, to be replayed later
+type DeadLetters interface {
+	Add(ctx context.Context, hash multihash.Multihash, results []model.ProviderResult, expires bool) error
+}
+
+// Option configures a provider cacher
+type Option func(*simpleProviderCacher)
+
+// WithDeadLetters records failed writes in the given queue instead of failing.
+// Caching carries on with the remaining multihashes of the index, unless the
+// write can't be recorded either
+func WithDeadLetters(deadLetters DeadLetters) Option {
+	return func(s *simpleProviderCacher) {
+		s.deadLetters = deadLetters
+	}
+}
+
 type simpleProviderCacher struct {
 	providerStore types.ProviderStore
+	deadLetters   DeadLetters
 }
 
-func NewSimpleProviderCacher(providerStore types.ProviderStore) ProviderCacher {
-	return &simpleProviderCacher{providerStore: providerStore}
+func NewSimpleProviderCacher(providerStore types.ProviderStore, opts ...Option) ProviderCacher {
+	s := &simpleProviderCacher{providerStore: providerStore}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 func (s *simpleProviderCacher) CacheProviderForIndexRecords(ctx context.Context, provider model.ProviderResult, index blobindex.ShardedDagIndexView) (uint64, error) {
 	written := uint64(0)
 	for _, shardIndex := range index.Shards().Iterator() {
 		for hash := range shardIndex.Iterator() {
-			existing, err := s.providerStore.Get(ctx, hash)
+			existing, err := types.GetForWrite(ctx, s.providerStore, hash)
 			if err != nil && !errors.Is(err, types.ErrKeyNotFound) {
 				return written, err
 			}
@@ -37,7 +60,13 @@ func (s *simpleProviderCacher) CacheProviderForIndexRecords(ctx context.Context,
 				newResults := append(existing, provider)
 				err = s.providerStore.Set(ctx, hash, newResults, true)
 				if err != nil {
-					return written, err
+					if s.deadLetters == nil {
+						return written, err
+					}
+					if dlErr := s.deadLetters.Add(ctx, hash, newResults, true); dlErr != nil {
+						return written, errors.Join(err, fmt.Errorf("recording failed write: %w", dlErr))
+					}
+					continue
 				}
 				written++
 			}
@@ -0,0 +1,98 @@
+package providerindex
+
+import (
+	"context"
+
+	mh "github.com/multiformats/go-multihash"
+)
+
+// FilterMode decides what a definite miss of the advertised filter does to a
+// query
+type FilterMode int
+
+const (
+	// FilterAdvisory only records whether IPNI and the legacy systems agreed
+	// with a miss of the filter, leaving query results unchanged. For
+	// deployments where hashes are also advertised to IPNI by others, such as
+	// storage providers publishing their own claims
+	FilterAdvisory FilterMode = iota
+	// FilterAuthoritative answers hashes the filter misses with no records,
+	// without asking IPNI or the legacy systems. For deployments where every
+	// hash that can be found was advertised by this service
+	FilterAuthoritative
+)
+
+// The outcomes of checking the advertised filter before asking IPNI about a
+// hash
+const (
+	// FilterHit is when the hash may have been advertised
+	FilterHit = "hit"
+	// FilterSkipped is when the hash was never advertised, and IPNI and the
+	// legacy systems weren't asked about it
+	FilterSkipped = "skipped"
+	// FilterMissAgreed is when the hash was never advertised, and IPNI and the
+	// legacy systems had no records of it either
+	FilterMissAgreed = "miss_agreed"
+	// FilterMissDisagreed is when the hash was never advertised, but IPNI or
+	// the legacy systems had records of it, which an authoritative filter would
+	// have missed
+	FilterMissDisagreed = "miss_disagreed"
+	// FilterError is when the filter couldn't be checked, and the hash was
+	// treated as possibly advertised
+	FilterError = "error"
+)
+
+// AdvertisedFilter tells hashes that were never advertised by this service
+// apart from those that may have been
+type AdvertisedFilter interface {
+	MayHaveAdvertised(ctx context.Context, hash mh.Multihash) (bool, error)
+}
+
+// FilterMetrics is told the outcome of each check of the advertised filter
+type FilterMetrics interface {
+	// AdvertisedFilterChecked is called with one of the Filter outcomes
+	AdvertisedFilterChecked(outcome string)
+}
+
+// WithAdvertisedFilter checks the filter before asking IPNI about a hash that
+// isn't cached, and with FilterAuthoritative doesn't ask IPNI or the legacy
+// systems about hashes it misses
+func WithAdvertisedFilter(f AdvertisedFilter, mode FilterMode) Option {
+	return func(pi *ProviderIndex) {
+		pi.advertised = f
+		pi.filterMode = mode
+	}
+}
+
+// WithFilterMetrics reports the outcome of each check of the advertised filter
+// to the given metrics
+func WithFilterMetrics(m FilterMetrics) Option {
+	return func(pi *ProviderIndex) {
+		pi.filterMetrics = m
+	}
+}
+
+// checkAdvertised returns false if the advertised filter is set and the hash
+// was never advertised. Errors are logged, and the hash treated as possibly
+// advertised
+func (pi *ProviderIndex) checkAdvertised(ctx context.Context, hash mh.Multihash) bool {
+	if pi.advertised == nil {
+		return true
+	}
+	may, err := pi.advertised.MayHaveAdvertised(ctx, hash)
+	if err != nil {
+		log.Warnw("checking advertised filter", "hash", hash, "error", err)
+		pi.filterChecked(FilterError)
+		return true
+	}
+	if may {
+		pi.filterChecked(FilterHit)
+	}
+	return may
+}
+
+func (pi *ProviderIndex) filterChecked(outcome string) {
+	if pi.filterMetrics != nil {
+		pi.filterMetrics.AdvertisedFilterChecked(outcome)
+	}
+}
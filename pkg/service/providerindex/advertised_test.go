@@ -0,0 +1,130 @@
+package providerindex_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/stretchr/testify/require"
+)
+
+type mockAdvertisedFilter struct {
+	advertised map[string]bool
+	err        error
+}
+
+func (m *mockAdvertisedFilter) MayHaveAdvertised(ctx context.Context, hash multihash.Multihash) (bool, error) {
+	return m.advertised[string(hash)], m.err
+}
+
+type countingFilterMetrics map[string]int
+
+func (m countingFilterMetrics) AdvertisedFilterChecked(outcome string) { m[outcome]++ }
+
+func TestProviderIndex__AdvertisedFilter(t *testing.T) {
+	ctx := context.Background()
+	advertised, unadvertised := testutil.RandomMultihash(), testutil.RandomMultihash()
+	filter := &mockAdvertisedFilter{advertised: map[string]bool{string(advertised): true}}
+	ipniResult, legacyResult := testutil.RandomProviderResult(), testutil.RandomProviderResult()
+
+	t.Run("advisory filters never change query results", func(t *testing.T) {
+		for _, results := range [][]model.ProviderResult{nil, {ipniResult}} {
+			withoutFilter := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &mockFinder{results: results}, nil, nil, cidlink.DefaultLinkSystem(), &mockLegacySystems{results: []model.ProviderResult{legacyResult}})
+			finder, legacy := &mockFinder{results: results}, &mockLegacySystems{results: []model.ProviderResult{legacyResult}}
+			metrics := countingFilterMetrics{}
+			withFilter := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, finder, nil, nil, cidlink.DefaultLinkSystem(), legacy,
+				providerindex.WithAdvertisedFilter(filter, providerindex.FilterAdvisory),
+				providerindex.WithFilterMetrics(metrics))
+			for _, hash := range []multihash.Multihash{advertised, unadvertised, advertised, unadvertised} {
+				expected := testutil.Must(withoutFilter.FindDetailed(ctx, providerindex.QueryKey{Hash: hash}))(t)
+				actual := testutil.Must(withFilter.FindDetailed(ctx, providerindex.QueryKey{Hash: hash}))(t)
+				// records from IPNI are seen when they are found
+				require.Len(t, actual.SeenAt, len(expected.SeenAt))
+				expected.SeenAt, actual.SeenAt = nil, nil
+				require.Equal(t, expected, actual)
+			}
+			// the second queries were answered from the cache
+			require.Equal(t, 2, finder.calls)
+			if results == nil {
+				require.Equal(t, 2, legacy.calls)
+			} else {
+				require.Zero(t, legacy.calls)
+			}
+			// a miss while IPNI or the legacy systems have records is one
+			// an authoritative filter would have gotten wrong
+			require.Equal(t, countingFilterMetrics{providerindex.FilterHit: 1, providerindex.FilterMissDisagreed: 1}, metrics)
+		}
+	})
+
+	t.Run("advisory misses agreed with by IPNI and the legacy systems", func(t *testing.T) {
+		metrics := countingFilterMetrics{}
+		pi := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil,
+			providerindex.WithAdvertisedFilter(filter, providerindex.FilterAdvisory),
+			providerindex.WithFilterMetrics(metrics))
+		fr := testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: unadvertised}))(t)
+		require.Empty(t, fr.Results)
+		require.Equal(t, providerindex.SourceIPNI, fr.Source)
+		require.Equal(t, countingFilterMetrics{providerindex.FilterMissAgreed: 1}, metrics)
+	})
+
+	t.Run("authoritative misses skip IPNI and the legacy systems", func(t *testing.T) {
+		store := &mockProviderStore{results: map[string][]model.ProviderResult{}}
+		finder, legacy := &mockFinder{results: []model.ProviderResult{ipniResult}}, &mockLegacySystems{results: []model.ProviderResult{legacyResult}}
+		metrics := countingFilterMetrics{}
+		pi := providerindex.NewProviderIndex(store, finder, nil, nil, cidlink.DefaultLinkSystem(), legacy,
+			providerindex.WithAdvertisedFilter(filter, providerindex.FilterAuthoritative),
+			providerindex.WithFilterMetrics(metrics))
+
+		fr := testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: unadvertised}))(t)
+		require.Empty(t, fr.Results)
+		require.False(t, fr.Known())
+		require.Equal(t, providerindex.SourceFilter, fr.Source)
+		require.Zero(t, finder.calls)
+		require.Zero(t, legacy.calls)
+		// nothing is cached, so the hash is found once it is advertised
+		require.NotContains(t, store.results, string(unadvertised))
+
+		fr = testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: advertised}))(t)
+		require.Equal(t, []model.ProviderResult{ipniResult}, fr.Results)
+		require.Equal(t, 1, finder.calls)
+		require.Equal(t, countingFilterMetrics{providerindex.FilterSkipped: 1, providerindex.FilterHit: 1}, metrics)
+	})
+
+	t.Run("hashes are treated as advertised when the filter fails", func(t *testing.T) {
+		finder := &mockFinder{results: []model.ProviderResult{ipniResult}}
+		metrics := countingFilterMetrics{}
+		pi := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, finder, nil, nil, cidlink.DefaultLinkSystem(), nil,
+			providerindex.WithAdvertisedFilter(&mockAdvertisedFilter{err: errors.New("something went wrong")}, providerindex.FilterAuthoritative),
+			providerindex.WithFilterMetrics(metrics))
+		fr := testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: unadvertised}))(t)
+		require.Equal(t, []model.ProviderResult{ipniResult}, fr.Results)
+		require.Equal(t, countingFilterMetrics{providerindex.FilterError: 1}, metrics)
+	})
+
+	t.Run("hashes published through the provider index are advertised", func(t *testing.T) {
+		key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+		adverts := publisher.New(dssync.MutexWrap(datastore.NewMapDatastore()), key, publisher.WithAdvertisedFilter(100, 0.01))
+		require.NoError(t, adverts.LoadAdvertisedFilter(ctx))
+		finder := &mockFinder{}
+		pi := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, finder, nil, nil, cidlink.DefaultLinkSystem(), nil,
+			providerindex.WithAdvertisementPublisher(adverts),
+			providerindex.WithAdvertisedFilter(adverts, providerindex.FilterAuthoritative))
+		hashes := testutil.RandomMultihashes(3)
+		require.NoError(t, pi.Publish(ctx, hashes, testutil.RandomProviderResult()))
+		for _, hash := range hashes {
+			require.True(t, testutil.Must(adverts.MayHaveAdvertised(ctx, hash))(t))
+		}
+		fr := testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: testutil.RandomMultihash()}))(t)
+		require.Equal(t, providerindex.SourceFilter, fr.Source)
+		require.Zero(t, finder.calls)
+	})
+}
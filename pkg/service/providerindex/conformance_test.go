@@ -0,0 +1,82 @@
+package providerindex_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	ipnifind "github.com/ipni/go-libipni/find/client"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/service/providerindex/providerindextest"
+)
+
+// memRedis is a redis client holding keys in memory, along with the expire
+// times of those written with one
+type memRedis struct {
+	lk   sync.Mutex
+	data map[string]string
+	ttls map[string]time.Duration
+}
+
+func (m *memRedis) Get(ctx context.Context, key string) *goredis.StringCmd {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	val, ok := m.data[key]
+	if !ok {
+		return goredis.NewStringResult("", goredis.Nil)
+	}
+	return goredis.NewStringResult(val, nil)
+}
+
+func (m *memRedis) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *goredis.StatusCmd {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.data[key] = value.(string)
+	if expiration != goredis.KeepTTL {
+		m.setTTL(key, expiration)
+	}
+	return goredis.NewStatusResult("OK", nil)
+}
+
+func (m *memRedis) Expire(ctx context.Context, key string, expiration time.Duration) *goredis.BoolCmd {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	_, ok := m.data[key]
+	if ok {
+		m.setTTL(key, expiration)
+	}
+	return goredis.NewBoolResult(ok, nil)
+}
+
+func (m *memRedis) Persist(ctx context.Context, key string) *goredis.BoolCmd {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.setTTL(key, 0)
+	return goredis.NewBoolResult(true, nil)
+}
+
+// ttl returns the expire time of a key, zero if it doesn't expire
+func (m *memRedis) ttl(key string) time.Duration {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.ttls[key]
+}
+
+func (m *memRedis) setTTL(key string, ttl time.Duration) {
+	if m.ttls == nil {
+		m.ttls = map[string]time.Duration{}
+	}
+	m.ttls[key] = ttl
+}
+
+func TestProviderIndex__Conformance(t *testing.T) {
+	providerindextest.RunConformance(t, func(origin ipnifind.Finder) service.ProviderIndex {
+		store := redis.NewProviderStore(&memRedis{data: map[string]string{}})
+		return providerindex.NewProviderIndex(store, origin, nil, nil, cidlink.DefaultLinkSystem(), nil)
+	})
+}
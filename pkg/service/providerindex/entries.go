@@ -0,0 +1,108 @@
+package providerindex
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/bytemap"
+)
+
+// MaxMismatchSample is the most multihashes of each kind an
+// EntriesMismatchError lists
+const MaxMismatchSample = 10
+
+// ErrEntriesGiven is returned when hashes are passed to a publish that derives
+// them from an index
+var ErrEntriesGiven = errors.New("hashes given for entries derived from index")
+
+// EntriesMismatchError is returned when the hashes published for an index claim
+// differ from the multihashes of the index by more than the tolerance
+type EntriesMismatchError struct {
+	// Extra are a sample of the hashes published that aren't in the index
+	Extra []mh.Multihash
+	// Missing are a sample of the multihashes of the index that aren't published
+	Missing []mh.Multihash
+	// ExtraCount and MissingCount are the number of each there are in total
+	ExtraCount   int
+	MissingCount int
+}
+
+func (e EntriesMismatchError) Error() string {
+	return fmt.Sprintf("entries differ from index: %d not in index %v, %d missing %v", e.ExtraCount, e.Extra, e.MissingCount, e.Missing)
+}
+
+// ValidateEntries checks the hashes published are the multihashes of the index
+// the claim is for, the digests of its shards and slices, failing the publish
+// with an EntriesMismatchError if more than tolerance of them differ
+func ValidateEntries(index blobindex.ShardedDagIndex, tolerance int) PublishOption {
+	return func(c *publishConfig) {
+		c.index = index
+		c.tolerance = tolerance
+		c.derive = false
+	}
+}
+
+// DeriveEntriesFromIndex publishes the multihashes of the index the claim is
+// for, the digests of its shards and slices, instead of hashes given by the
+// caller, which must pass none. Entries derived from the index can't go stale
+// with it, so this is preferred to ValidateEntries
+func DeriveEntriesFromIndex(index blobindex.ShardedDagIndex) PublishOption {
+	return func(c *publishConfig) {
+		c.index = index
+		c.derive = true
+	}
+}
+
+// indexEntries returns the hashes to publish, derived from the index of the
+// config or checked against it, if it has one
+func indexEntries(hashes []mh.Multihash, cfg publishConfig) ([]mh.Multihash, error) {
+	if cfg.index == nil {
+		return hashes, nil
+	}
+	if cfg.derive {
+		if len(hashes) > 0 {
+			return nil, ErrEntriesGiven
+		}
+		return slices.Collect(blobindex.Multihashes(cfg.index)), nil
+	}
+	return hashes, checkEntries(hashes, cfg.index, cfg.tolerance)
+}
+
+// checkEntries compares the hashes with the multihashes of the index, reading
+// those as it goes rather than collecting them first
+func checkEntries(hashes []mh.Multihash, index blobindex.ShardedDagIndex, tolerance int) error {
+	// whether each hash was found in the index
+	found := bytemap.NewByteMap[mh.Multihash, bool](len(hashes))
+	for _, hash := range hashes {
+		found.Set(hash, false)
+	}
+	var mismatch EntriesMismatchError
+	for hash := range blobindex.Multihashes(index) {
+		if !found.Has(hash) {
+			mismatch.MissingCount++
+			if len(mismatch.Missing) < MaxMismatchSample {
+				mismatch.Missing = append(mismatch.Missing, hash)
+			}
+			continue
+		}
+		found.Set(hash, true)
+	}
+	for _, hash := range hashes {
+		if found.Get(hash) {
+			continue
+		}
+		// count duplicates of a hash only once
+		found.Set(hash, true)
+		mismatch.ExtraCount++
+		if len(mismatch.Extra) < MaxMismatchSample {
+			mismatch.Extra = append(mismatch.Extra, hash)
+		}
+	}
+	if mismatch.ExtraCount+mismatch.MissingCount > tolerance {
+		return mismatch
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package providerindex
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// ErrExportUnsupported is returned from ExportProviderRecords when the provider
+// store can't be exported
+var ErrExportUnsupported = errors.New("provider record export is not supported")
+
+// exportingProviderStore is implemented by provider stores whose records can
+// be exported in bulk
+type exportingProviderStore interface {
+	ExportProviderRecords(ctx context.Context, w io.Writer, format types.ExportFormat, cursor string, limit int) (string, error)
+}
+
+// ExportProviderRecords writes the cached provider records of up to about limit
+// hashes to w, starting at the cursor, and returns the cursor to continue from,
+// which is empty once the export is done. See
+// redis.ProviderStore.ExportProviderRecords
+func (pi *ProviderIndex) ExportProviderRecords(ctx context.Context, w io.Writer, format types.ExportFormat, cursor string, limit int) (string, error) {
+	store, ok := pi.providerStore.(exportingProviderStore)
+	if !ok {
+		return "", ErrExportUnsupported
+	}
+	return store.ExportProviderRecords(ctx, w, format, cursor, limit)
+}
@@ -0,0 +1,122 @@
+package providerindex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/providerresults"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// ErrInvalidationUnsupported is returned from Invalidate when the provider
+// store can't delete the entries of hashes
+var ErrInvalidationUnsupported = errors.New("provider store can't delete entries")
+
+// deletingProviderStore is implemented by provider stores that can delete the
+// entry of a hash
+type deletingProviderStore interface {
+	Delete(ctx context.Context, hash mh.Multihash) error
+}
+
+// Invalidation is what was dropped from the caches of the provider index for a
+// hash
+type Invalidation struct {
+	// Cached is set if the provider store had an entry for the hash
+	Cached bool
+	// Records is the number of records of the entry deleted from the provider
+	// store
+	Records int
+	// Negative is set if the entry deleted had no records, caching that the
+	// hash was unknown
+	Negative bool
+	// Recent is set if the results of a recent IPNI lookup of the hash were
+	// dropped
+	Recent bool
+	// Claims are the claims the records dropped refer to
+	Claims []cid.Cid
+	// Tombstoned are the providers of the records dropped that were removed,
+	// whose records aren't cached again
+	Tombstoned []peer.ID
+}
+
+// Invalidate drops the records cached for the hash from the provider store and
+// the recent results of IPNI lookups, including an entry caching that IPNI had
+// no records of it, so that the next lookup of the hash reads it from IPNI.
+// Tombstones are kept, so the records of removed providers stay dropped. The
+// recent results are dropped even if the provider store can't be read or
+// written, in which case the error is returned along with what was dropped
+func (pi *ProviderIndex) Invalidate(ctx context.Context, hash mh.Multihash) (Invalidation, error) {
+	var inv Invalidation
+	entry, cached, err := pi.deleteStoredEntry(ctx, hash)
+	records := entry.Records
+	inv.Cached, inv.Records, inv.Negative = cached, len(records), cached && len(records) == 0
+	// recent results are dropped once the entry is gone, so that a lookup in
+	// between doesn't keep the records deleted
+	if pi.recent != nil {
+		if entry, ok := pi.recent.remove(string(hash)); ok {
+			inv.Recent = true
+			records = append(records, entry.Records...)
+		}
+	}
+	seen := map[cid.Cid]bool{}
+	for _, record := range records {
+		for _, claim := range recordClaims(record) {
+			if !seen[claim] {
+				seen[claim] = true
+				inv.Claims = append(inv.Claims, claim)
+			}
+		}
+	}
+	tombstoned, terr := pi.tombstonedProviders(ctx, records)
+	inv.Tombstoned = tombstoned
+	return inv, errors.Join(err, terr)
+}
+
+// deleteStoredEntry deletes the entry for the hash from the provider store,
+// returning it and whether there was one
+func (pi *ProviderIndex) deleteStoredEntry(ctx context.Context, hash mh.Multihash) (providerresults.Entry, bool, error) {
+	ds, ok := pi.providerStore.(deletingProviderStore)
+	if !ok {
+		return providerresults.Entry{}, false, ErrInvalidationUnsupported
+	}
+	entry, err := pi.getStoredEntryForWrite(ctx, hash)
+	if errors.Is(err, types.ErrKeyNotFound) {
+		return providerresults.Entry{}, false, nil
+	}
+	if err != nil {
+		return providerresults.Entry{}, false, fmt.Errorf("reading records: %w", err)
+	}
+	if err := ds.Delete(ctx, hash); err != nil {
+		return providerresults.Entry{}, false, fmt.Errorf("deleting records: %w", err)
+	}
+	return entry, true, nil
+}
+
+// tombstonedProviders returns the providers of the records that have
+// tombstones
+func (pi *ProviderIndex) tombstonedProviders(ctx context.Context, records []providerresults.Record) ([]peer.ID, error) {
+	if pi.tombstones == nil {
+		return nil, nil
+	}
+	checked := map[peer.ID]bool{}
+	var tombstoned []peer.ID
+	for _, record := range records {
+		if record.Provider == nil || checked[record.Provider.ID] {
+			continue
+		}
+		checked[record.Provider.ID] = true
+		_, err := pi.tombstones.Get(ctx, record.Provider.ID)
+		if errors.Is(err, types.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return tombstoned, fmt.Errorf("reading tombstone: %w", err)
+		}
+		tombstoned = append(tombstoned, record.Provider.ID)
+	}
+	return tombstoned, nil
+}
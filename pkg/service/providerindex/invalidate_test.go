@@ -0,0 +1,103 @@
+package providerindex_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/providerresults"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// deletingEntryStore is an entry store whose entries can be deleted
+type deletingEntryStore struct {
+	mockEntryStore
+}
+
+func (m *deletingEntryStore) Delete(ctx context.Context, hash multihash.Multihash) error {
+	delete(m.entries, string(hash))
+	return nil
+}
+
+func TestProviderIndex__Invalidate(t *testing.T) {
+	ctx := context.Background()
+	record := func(t *testing.T, provider peer.ID, claim cid.Cid) providerresults.Record {
+		md := &metadata.LocationCommitmentMetadata{Claim: claim}
+		return providerresults.Record{ProviderResult: model.ProviderResult{
+			ContextID: testutil.RandomBytes(10),
+			Metadata:  testutil.Must(md.MarshalBinary())(t),
+			Provider:  &peer.AddrInfo{ID: provider},
+		}}
+	}
+
+	t.Run("records, recent results and the claims they refer to are dropped", func(t *testing.T) {
+		hash := testutil.RandomMultihash()
+		removed, kept := testutil.RandomPeer(), testutil.RandomPeer()
+		claims := []cid.Cid{testutil.RandomCID().(cidlink.Link).Cid, testutil.RandomCID().(cidlink.Link).Cid}
+		finder := &mockFinder{results: []model.ProviderResult{record(t, kept, claims[0]).ProviderResult}}
+		store := &deletingEntryStore{mockEntryStore{entries: map[string]providerresults.Entry{}}}
+		tombstones := &mockTombstones{tombstones: map[peer.ID]types.ProviderTombstone{removed: {Provider: removed, Started: time.Now()}}}
+		pi := providerindex.NewProviderIndex(store, finder, nil, nil, cidlink.DefaultLinkSystem(), nil,
+			providerindex.WithRecentResults(8, time.Minute), providerindex.WithTombstones(tombstones))
+
+		// the recent results have the record read from IPNI, and the store also
+		// has a record of a provider removed since
+		testutil.Must(pi.Find(ctx, providerindex.QueryKey{Hash: hash}))(t)
+		entry := store.entries[string(hash)]
+		entry.Records = append(entry.Records, record(t, removed, claims[1]))
+		store.entries[string(hash)] = entry
+
+		inv := testutil.Must(pi.Invalidate(ctx, hash))(t)
+		require.True(t, inv.Cached)
+		require.Equal(t, 2, inv.Records)
+		require.False(t, inv.Negative)
+		require.True(t, inv.Recent)
+		require.ElementsMatch(t, claims, inv.Claims)
+		require.Equal(t, []peer.ID{removed}, inv.Tombstoned)
+		require.NotContains(t, store.entries, string(hash))
+
+		// the next lookup reads IPNI
+		testutil.Must(pi.Find(ctx, providerindex.QueryKey{Hash: hash}))(t)
+		require.Equal(t, 2, finder.calls)
+
+		// nothing is left to drop
+		inv = testutil.Must(pi.Invalidate(ctx, testutil.RandomMultihash()))(t)
+		require.Equal(t, providerindex.Invalidation{}, inv)
+	})
+
+	t.Run("entries caching that a hash is unknown are negative", func(t *testing.T) {
+		hash := testutil.RandomMultihash()
+		store := &deletingEntryStore{mockEntryStore{entries: map[string]providerresults.Entry{}}}
+		pi := providerindex.NewProviderIndex(store, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		testutil.Must(pi.Find(ctx, providerindex.QueryKey{Hash: hash}))(t)
+
+		inv := testutil.Must(pi.Invalidate(ctx, hash))(t)
+		require.True(t, inv.Cached)
+		require.True(t, inv.Negative)
+		require.Zero(t, inv.Records)
+	})
+
+	t.Run("recent results are dropped from stores that can't delete entries", func(t *testing.T) {
+		hash := testutil.RandomMultihash()
+		finder := &mockFinder{results: []model.ProviderResult{record(t, testutil.RandomPeer(), testutil.RandomCID().(cidlink.Link).Cid).ProviderResult}}
+		store := &mockEntryStore{entries: map[string]providerresults.Entry{}}
+		pi := providerindex.NewProviderIndex(store, finder, nil, nil, cidlink.DefaultLinkSystem(), nil, providerindex.WithRecentResults(8, time.Minute))
+		testutil.Must(pi.Find(ctx, providerindex.QueryKey{Hash: hash}))(t)
+
+		inv, err := pi.Invalidate(ctx, hash)
+		require.ErrorIs(t, err, providerindex.ErrInvalidationUnsupported)
+		require.True(t, inv.Recent)
+		require.False(t, inv.Cached)
+		require.Len(t, inv.Claims, 1)
+		require.Contains(t, store.entries, string(hash))
+	})
+}
@@ -3,17 +3,25 @@ package providerindex
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"slices"
+	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipni/go-libipni/announce"
 	"github.com/ipni/go-libipni/dagsync"
 	ipnifind "github.com/ipni/go-libipni/find/client"
 	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multicodec"
 	mh "github.com/multiformats/go-multihash"
 	"github.com/storacha/go-ucanto/did"
 	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/providerresults"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/storacha/indexing-service/pkg/service/httppool"
 	"github.com/storacha/indexing-service/pkg/types"
 )
 
@@ -21,23 +29,189 @@ type QueryKey struct {
 	Spaces       []did.DID
 	Hash         mh.Multihash
 	TargetClaims []multicodec.Code
+	// UnscopedLocations also admits location commitments whose context ID isn't
+	// scoped to a space when filtering by Spaces, such as those storage
+	// providers publish for the blobs they hold, along with the records matching
+	// the spaces
+	UnscopedLocations bool
+	// Keep, if set, is the policy providers must pass for their records to be
+	// kept when a find response is read as it arrives, such as a deny list. The
+	// records of providers it rejects neither count towards the most records
+	// kept nor are cached. Records are not otherwise filtered by it
+	Keep func(*peer.AddrInfo) bool
+}
+
+// RecordSource is where the provider records for a hash were read from
+type RecordSource string
+
+const (
+	// SourceCache is for records read from the provider store
+	SourceCache RecordSource = "cache"
+	// SourceIPNI is for records found on IPNI after a cache miss
+	SourceIPNI RecordSource = "ipni"
+	// SourceLegacy is for records asked of the legacy systems, because IPNI had
+	// none
+	SourceLegacy RecordSource = "legacy"
+	// SourceFilter is for hashes an authoritative advertised filter says were
+	// never advertised, which IPNI and the legacy systems weren't asked about
+	SourceFilter RecordSource = "filter"
+)
+
+// FindResult is the result of a query to the provider index, including
+// information about records that were filtered out
+type FindResult struct {
+	// Results are the provider records matching the query
+	Results []model.ProviderResult
+	// Source is where the records were read from
+	Source RecordSource
+	// Unfiltered is the number of records known for the hash before filtering by
+	// claim type or space
+	Unfiltered int
+	// ClaimMatches is the number of records left after filtering by claim type,
+	// before filtering by space
+	ClaimMatches int
+	// SeenClaims are the claim codes present in any of the unfiltered records
+	SeenClaims []multicodec.Code
+	// SeenAt is when each of the results was last seen, in the same order as
+	// Results. A zero time means it is not known
+	SeenAt []time.Time
+	// Unscoped is the number of results admitted only because they are location
+	// commitments not scoped to a space, under UnscopedLocations
+	Unscoped int
+	// Truncated is set when IPNI had more records for the hash than were kept
+	Truncated bool
+}
+
+// Known returns true if there are any records for the hash at all, even if none
+// of them matched the query
+func (fr FindResult) Known() bool {
+	return fr.Unfiltered > 0
 }
 
 // ProviderIndex is a read/write interface to a local cache of providers that falls back to IPNI
 type ProviderIndex struct {
 	providerStore types.ProviderStore
 	findClient    ipnifind.Finder
+	legacySystems LegacySystems
+	replicators   []Replicator
+	adverts       AdvertisementPublisher
+	announcer     AdvertisementAnnouncer
+	contextIDs    types.ContextIDCodec
+	snapshot      *snapshot
+	tombstones    types.TombstoneStore
+	claims        ClaimCache
+	metrics       Metrics
+	bindings      types.SpaceBindingStore
+	bindingWindow time.Duration
+	now           func() time.Time
+	clockSkew     time.Duration
+	advertised    AdvertisedFilter
+	filterMode    FilterMode
+	filterMetrics FilterMetrics
+	recent        *recentResults
+	// maxFindRecords is the most records kept of a find response, if streamed
+	maxFindRecords int
+}
+
+// Metrics is told about the reads of the provider store and the finds sent to
+// IPNI
+type Metrics interface {
+	types.CacheMetrics
+	// IPNIFind is called after a find sent to IPNI is answered, or fails, with
+	// how long it took
+	IPNIFind(duration time.Duration, err error)
+}
+
+type noopMetrics struct {
+	types.NoopCacheMetrics
+}
+
+func (noopMetrics) IPNIFind(time.Duration, error) {}
+
+// Replicator is sent provider results written by publishes, to be copied to
+// other regions
+type Replicator interface {
+	ReplicateProviders(hash mh.Multihash, results []model.ProviderResult)
+}
+
+// AdvertisementPublisher writes IPNI advertisements for published provider
+// results
+type AdvertisementPublisher interface {
+	Publish(ctx context.Context, provider peer.AddrInfo, contextID []byte, metadata []byte, hashes []mh.Multihash, opts ...publisher.PublishOption) (ipld.Link, error)
+}
+
+// AdvertisementAnnouncer announces published advertisements to indexers
+type AdvertisementAnnouncer interface {
+	Announce(ctx context.Context, link ipld.Link, opts ...publisher.AnnounceOption) error
+}
+
+// Option configures a ProviderIndex
+type Option func(*ProviderIndex)
+
+// WithReplicator sends the provider results of every publish to the replicator,
+// in addition to any replicators already set. Records cached on read are not
+// replicated
+func WithReplicator(r Replicator) Option {
+	return func(pi *ProviderIndex) {
+		pi.replicators = append(pi.replicators, r)
+	}
+}
+
+// WithAdvertisementPublisher writes an advertisement for the hashes of every
+// publish
+func WithAdvertisementPublisher(p AdvertisementPublisher) Option {
+	return func(pi *ProviderIndex) {
+		pi.adverts = p
+	}
 }
 
-// TBD access to legacy systems
-type LegacySystems interface{}
+// WithAdvertisementAnnouncer announces every advertisement written by the
+// advertisement publisher
+func WithAdvertisementAnnouncer(a AdvertisementAnnouncer) Option {
+	return func(pi *ProviderIndex) {
+		pi.announcer = a
+	}
+}
+
+// WithContextIDCodec sets the scheme context IDs are matched with when filtering
+// by space. If not set, types.DefaultContextIDCodec is used
+func WithContextIDCodec(codec types.ContextIDCodec) Option {
+	return func(pi *ProviderIndex) {
+		pi.contextIDs = codec
+	}
+}
+
+// WithMetrics reports the reads of the provider store and the finds sent to
+// IPNI to the given metrics
+func WithMetrics(m Metrics) Option {
+	return func(pi *ProviderIndex) {
+		pi.metrics = m
+	}
+}
+
+// LegacySystems is consulted for provider records for hashes that neither the
+// cache nor IPNI know anything about
+type LegacySystems interface {
+	Find(ctx context.Context, hash mh.Multihash) ([]model.ProviderResult, error)
+}
 
 // TODO: This assumes using low level primitives for publishing from IPNI but maybe we want to go ahead and use index-provider?
-func NewProviderIndex(providerStore types.ProviderStore, findClient ipnifind.Finder, sender announce.Sender, publisher dagsync.Publisher, advertisementsLsys ipld.LinkSystem, legacySystems LegacySystems) *ProviderIndex {
-	return &ProviderIndex{
+func NewProviderIndex(providerStore types.ProviderStore, findClient ipnifind.Finder, sender announce.Sender, publisher dagsync.Publisher, advertisementsLsys ipld.LinkSystem, legacySystems LegacySystems, opts ...Option) *ProviderIndex {
+	pi := &ProviderIndex{
 		providerStore: providerStore,
 		findClient:    findClient,
+		legacySystems: legacySystems,
+		contextIDs:    types.DefaultContextIDCodec,
+		metrics:       noopMetrics{},
+		now:           time.Now,
 	}
+	for _, opt := range opts {
+		opt(pi)
+	}
+	if pi.recent != nil {
+		pi.recent.now = pi.now
+	}
+	return pi
 }
 
 // Find should do the following
@@ -48,101 +222,605 @@ func NewProviderIndex(providerStore types.ProviderStore, findClient ipnifind.Fin
 //  2. With returned provider results, filter additionally for claim type. If space dids are set, calculate an encodedcontextid's by hashing space DID and Hash, and filter for a matching context id
 //     Future TODO: kick off a conversion task to update the recrds
 func (pi *ProviderIndex) Find(ctx context.Context, qk QueryKey) ([]model.ProviderResult, error) {
-	results, err := pi.getProviderResults(ctx, qk.Hash)
+	fr, err := pi.FindDetailed(ctx, qk)
 	if err != nil {
 		return nil, err
 	}
-	results, err = pi.filteredCodecs(results, qk.TargetClaims)
+	return fr.Results, nil
+}
+
+// FindDetailed is the same as Find, but also reports how many records were known
+// for the hash before filtering and which claim types they contained, so that
+// callers can tell an unknown hash apart from one with no matching claims
+func (pi *ProviderIndex) FindDetailed(ctx context.Context, qk QueryKey) (FindResult, error) {
+	entry, source, err := pi.getProviderRecords(ctx, qk.Hash, qk.TargetClaims, qk.Keep)
 	if err != nil {
-		return nil, err
+		return FindResult{}, err
+	}
+	records := entry.Records
+	filtered, seen, err := pi.filteredCodecs(records, qk.TargetClaims)
+	if err != nil {
+		return FindResult{}, err
+	}
+	claimMatches := len(filtered)
+	filtered, unscoped, err := pi.filterBySpace(ctx, filtered, qk.Hash, qk.Spaces, qk.UnscopedLocations)
+	if err != nil {
+		return FindResult{}, err
 	}
-	return pi.filterBySpace(results, qk.Hash, qk.Spaces)
+	seenAt := make([]time.Time, 0, len(filtered))
+	for _, record := range filtered {
+		seenAt = append(seenAt, record.SeenAt)
+	}
+	return FindResult{
+		Results:      providerresults.Results(filtered),
+		Source:       source,
+		Unfiltered:   len(records),
+		ClaimMatches: claimMatches,
+		SeenClaims:   seen,
+		SeenAt:       seenAt,
+		Unscoped:     unscoped,
+		Truncated:    entry.Truncated,
+	}, nil
+}
+
+// recordProviderStore is implemented by provider stores that keep when each
+// record was last seen
+type recordProviderStore interface {
+	GetRecords(ctx context.Context, hash mh.Multihash) ([]providerresults.Record, error)
+	SetRecords(ctx context.Context, hash mh.Multihash, records []providerresults.Record, expires bool) error
 }
 
-func (pi *ProviderIndex) getProviderResults(ctx context.Context, mh mh.Multihash) ([]model.ProviderResult, error) {
-	res, err := pi.providerStore.Get(ctx, mh)
-	if err == nil {
-		return res, nil
+// entryProviderStore is implemented by provider stores that keep whether the
+// records cached for a hash are every record IPNI had for it. Stores that don't
+// are assumed to only hold complete entries
+type entryProviderStore interface {
+	GetEntry(ctx context.Context, hash mh.Multihash) (providerresults.Entry, error)
+	SetEntry(ctx context.Context, hash mh.Multihash, entry providerresults.Entry, expires bool) error
+}
+
+// primaryEntryProviderStore is implemented by provider stores that may read
+// entries from a replica, which can also read them from the primary
+type primaryEntryProviderStore interface {
+	GetEntryPrimary(ctx context.Context, hash mh.Multihash) (providerresults.Entry, error)
+}
+
+func (pi *ProviderIndex) getStoredEntry(ctx context.Context, mh mh.Multihash) (providerresults.Entry, error) {
+	if es, ok := pi.providerStore.(entryProviderStore); ok {
+		return es.GetEntry(ctx, mh)
 	}
-	if err != types.ErrKeyNotFound {
-		return nil, err
+	if rs, ok := pi.providerStore.(recordProviderStore); ok {
+		records, err := rs.GetRecords(ctx, mh)
+		return providerresults.Entry{Records: records, Complete: true}, err
+	}
+	results, err := pi.providerStore.Get(ctx, mh)
+	if err != nil {
+		return providerresults.Entry{}, err
+	}
+	return providerresults.Entry{Records: unseenRecords(results), Complete: true}, nil
+}
+
+// getStoredEntryForWrite reads the entry for a hash to write back a change to
+// it, from the primary where the store reads from a replica, so that records
+// written by other instances the replica hasn't caught up with aren't dropped
+func (pi *ProviderIndex) getStoredEntryForWrite(ctx context.Context, mh mh.Multihash) (providerresults.Entry, error) {
+	if ps, ok := pi.providerStore.(primaryEntryProviderStore); ok {
+		return ps.GetEntryPrimary(ctx, mh)
+	}
+	_, entries := pi.providerStore.(entryProviderStore)
+	_, records := pi.providerStore.(recordProviderStore)
+	if entries || records {
+		return pi.getStoredEntry(ctx, mh)
+	}
+	results, err := types.GetForWrite(ctx, pi.providerStore, mh)
+	if err != nil {
+		return providerresults.Entry{}, err
+	}
+	return providerresults.Entry{Records: unseenRecords(results), Complete: true}, nil
+}
+
+func (pi *ProviderIndex) setStoredEntry(ctx context.Context, mh mh.Multihash, entry providerresults.Entry, expires bool) error {
+	if es, ok := pi.providerStore.(entryProviderStore); ok {
+		return es.SetEntry(ctx, mh, entry, expires)
+	}
+	if rs, ok := pi.providerStore.(recordProviderStore); ok {
+		return rs.SetRecords(ctx, mh, entry.Records, expires)
+	}
+	return pi.providerStore.Set(ctx, mh, providerresults.Results(entry.Records), expires)
+}
+
+// covers reports whether a cached entry holds every record for the given claim
+// types. Entries filtered to claim types when read from IPNI cover only those,
+// and other entries that are not complete only cover the claim types of the
+// records they hold, so a query for all claim types always needs a complete
+// entry, or one truncated without filtering
+func covers(entry providerresults.Entry, codecs []multicodec.Code) bool {
+	if entry.Complete {
+		return true
+	}
+	if len(entry.Claims) > 0 {
+		return len(codecs) > 0 && !slices.ContainsFunc(codecs, func(code multicodec.Code) bool {
+			return !slices.Contains(entry.Claims, code)
+		})
+	}
+	if entry.Truncated {
+		return true
+	}
+	if len(codecs) == 0 {
+		return false
+	}
+	held := map[multicodec.Code]bool{}
+	for _, record := range entry.Records {
+		md := metadata.MetadataContext.New()
+		if err := md.UnmarshalBinary(record.Metadata); err != nil {
+			continue
+		}
+		for _, code := range md.Protocols() {
+			held[code] = true
+		}
+	}
+	for _, code := range codecs {
+		if !held[code] {
+			return false
+		}
+	}
+	return true
+}
+
+func (pi *ProviderIndex) getProviderRecords(ctx context.Context, mh mh.Multihash, codecs []multicodec.Code, keep func(*peer.AddrInfo) bool) (providerresults.Entry, RecordSource, error) {
+	if pi.snapshot != nil {
+		return pi.getSnapshotRecords(ctx, mh, codecs, keep)
+	}
+	return pi.readProviderRecords(ctx, mh, codecs, keep)
+}
+
+// readProviderRecords reads the records for a hash from the recent results of
+// IPNI lookups, if kept, and otherwise as readStoredRecords
+func (pi *ProviderIndex) readProviderRecords(ctx context.Context, mh mh.Multihash, codecs []multicodec.Code, keep func(*peer.AddrInfo) bool) (providerresults.Entry, RecordSource, error) {
+	if pi.recent == nil || types.IsFresh(ctx) {
+		return pi.readStoredRecords(ctx, mh, codecs, keep)
+	}
+	return pi.readRecentRecords(ctx, mh, codecs, func() (providerresults.Entry, RecordSource, error) {
+		return pi.readStoredRecords(ctx, mh, codecs, keep)
+	})
+}
+
+// readStoredRecords reads the cached records for a hash, if they cover the
+// claim types. Otherwise the records are read from IPNI, merged with those
+// cached and cached as a complete entry, unless records were left out as the
+// response was read
+func (pi *ProviderIndex) readStoredRecords(ctx context.Context, mh mh.Multihash, codecs []multicodec.Code, keep func(*peer.AddrInfo) bool) (providerresults.Entry, RecordSource, error) {
+	cached, err := pi.getStoredEntry(ctx, mh)
+	if err == nil && covers(cached, codecs) {
+		types.CacheRead(ctx, pi.metrics, types.ProvidersCache, true)
+		return cached, SourceCache, nil
+	}
+	if err != nil && err != types.ErrKeyNotFound {
+		return providerresults.Entry{}, "", err
+	}
+	types.CacheRead(ctx, pi.metrics, types.ProvidersCache, false)
+	// IPNI isn't asked under a cache only context, so what's cached is all
+	// there is
+	if types.IsCacheOnly(ctx) {
+		return providerresults.Entry{Records: cached.Records}, SourceCache, nil
+	}
+	advertised := pi.checkAdvertised(ctx, mh)
+	if !advertised && pi.filterMode == FilterAuthoritative {
+		pi.filterChecked(FilterSkipped)
+		return providerresults.Entry{Records: cached.Records}, SourceFilter, nil
+	}
+
+	types.WalkCountersFrom(ctx).Fetched(types.FetchIPNI)
+	start := time.Now()
+	streamed, err := pi.findRecords(ctx, mh, codecs, keep)
+	pi.metrics.IPNIFind(time.Since(start), err)
+	var cooling httppool.ErrProviderCoolingDown
+	if errors.As(err, &cooling) {
+		return pi.readWithoutIPNI(ctx, mh, cached, err)
+	}
+	if err != nil {
+		return providerresults.Entry{}, "", types.OriginFetchError(ctx, err)
+	}
+	source := SourceIPNI
+	records := streamed.records
+	entry := providerresults.Entry{Complete: true}
+	if streamed.truncated || streamed.filtered > 0 {
+		entry = providerresults.Entry{Claims: slices.Clone(codecs), Truncated: streamed.truncated}
+	}
+	// only fall back to legacy systems when nothing at all is known about the hash
+	if streamed.read == 0 && pi.legacySystems != nil {
+		results, err := pi.legacySystems.Find(ctx, mh)
+		if err != nil {
+			return providerresults.Entry{}, "", err
+		}
+		records = unseenRecords(results)
+		source = SourceLegacy
+	}
+	if !advertised {
+		if len(records) == 0 {
+			pi.filterChecked(FilterMissAgreed)
+		} else {
+			pi.filterChecked(FilterMissDisagreed)
+		}
+	}
+	// removed providers stay removed, even while IPNI still has their records
+	records, err = pi.withoutTombstoned(ctx, records)
+	if err != nil {
+		return providerresults.Entry{}, "", err
 	}
+	// records cached piecemeal, such as from publishes, may not be on IPNI yet
+	for _, record := range cached.Records {
+		i := slices.IndexFunc(records, func(r providerresults.Record) bool {
+			return providerresults.Equals(r.ProviderResult, record.ProviderResult)
+		})
+		if i < 0 {
+			records = append(records, record)
+		} else if records[i].SeenAt.IsZero() {
+			records[i].SeenAt = record.SeenAt
+		}
+	}
+	if records == nil {
+		records = []providerresults.Record{}
+	}
+	// an empty result is cached too, so unknown hashes aren't repeatedly queried
+	entry.Records = records
+	err = pi.setStoredEntry(ctx, mh, entry, true)
+	if err != nil {
+		return providerresults.Entry{}, "", err
+	}
+	return entry, source, nil
+}
 
+// findRecords reads the records for a hash from IPNI, as the response arrives
+// if the most records kept is set and the find client can stream responses
+func (pi *ProviderIndex) findRecords(ctx context.Context, mh mh.Multihash, codecs []multicodec.Code, keep func(*peer.AddrInfo) bool) (streamedRecords, error) {
+	if finder, ok := pi.findClient.(StreamFinder); ok && pi.maxFindRecords > 0 {
+		return pi.streamFind(ctx, finder, mh, codecs, keep)
+	}
 	findRes, err := pi.findClient.Find(ctx, mh)
 	if err != nil {
-		return nil, err
+		return streamedRecords{}, err
 	}
-	var results []model.ProviderResult
+	// records returned by IPNI have just been seen
+	now := time.Now()
+	var s streamedRecords
 	for _, mhres := range findRes.MultihashResults {
-		results = append(results, mhres.ProviderResults...)
+		for _, result := range mhres.ProviderResults {
+			s.records = append(s.records, providerresults.Record{ProviderResult: result, SeenAt: now})
+		}
 	}
-	err = pi.providerStore.Set(ctx, mh, results, true)
+	s.read = len(s.records)
+	return s, nil
+}
+
+// readWithoutIPNI reads the records for a hash while IPNI is cooling down from
+// those cached, or the legacy systems if none are. The records aren't cached, as
+// IPNI may know of others, and if there are none the IPNI error is returned
+func (pi *ProviderIndex) readWithoutIPNI(ctx context.Context, mh mh.Multihash, cached providerresults.Entry, ipniErr error) (providerresults.Entry, RecordSource, error) {
+	if len(cached.Records) > 0 {
+		return providerresults.Entry{Records: cached.Records}, SourceCache, nil
+	}
+	if pi.legacySystems == nil {
+		return providerresults.Entry{}, "", types.OriginFetchError(ctx, ipniErr)
+	}
+	results, err := pi.legacySystems.Find(ctx, mh)
 	if err != nil {
-		return nil, err
+		return providerresults.Entry{}, "", err
+	}
+	records, err := pi.withoutTombstoned(ctx, unseenRecords(results))
+	if err != nil {
+		return providerresults.Entry{}, "", err
 	}
-	return results, nil
+	log.Debugw("read records without IPNI while it cools down", "hash", mh, "records", len(records), "error", ipniErr)
+	return providerresults.Entry{Records: records}, SourceLegacy, nil
 }
 
-func (pi *ProviderIndex) filteredCodecs(results []model.ProviderResult, codecs []multicodec.Code) ([]model.ProviderResult, error) {
-	if len(codecs) == 0 {
-		return results, nil
+func unseenRecords(results []model.ProviderResult) []providerresults.Record {
+	records := make([]providerresults.Record, 0, len(results))
+	for _, result := range results {
+		records = append(records, providerresults.Record{ProviderResult: result})
+	}
+	return records
+}
+
+// MarkSeen records that a provider was seen to have a record for a hash at the
+// given time, if the store keeps when records were last seen and the record is
+// cached. Times earlier than the one already recorded are ignored
+func (pi *ProviderIndex) MarkSeen(ctx context.Context, hash mh.Multihash, result model.ProviderResult, at time.Time) error {
+	_, ok := pi.providerStore.(recordProviderStore)
+	if !ok {
+		return nil
+	}
+	entry, err := pi.getStoredEntryForWrite(ctx, hash)
+	if err != nil {
+		if err == types.ErrKeyNotFound {
+			return nil
+		}
+		return err
+	}
+	i := slices.IndexFunc(entry.Records, func(r providerresults.Record) bool {
+		return providerresults.Equals(r.ProviderResult, result)
+	})
+	if i < 0 || !at.After(entry.Records[i].SeenAt) {
+		return nil
 	}
-	return filter(results, func(result model.ProviderResult) (bool, error) {
+	entry.Records[i].SeenAt = at
+	pi.invalidateRecent(hash)
+	return pi.setStoredEntry(ctx, hash, entry, true)
+}
+
+// filteredCodecs filters records to those with metadata for any of the given
+// codecs, also returning every codec seen in the records
+func (pi *ProviderIndex) filteredCodecs(results []providerresults.Record, codecs []multicodec.Code) ([]providerresults.Record, []multicodec.Code, error) {
+	var seen []multicodec.Code
+	filtered, err := filter(results, func(result model.ProviderResult) (bool, error) {
 		md := metadata.MetadataContext.New()
 		err := md.UnmarshalBinary(result.Metadata)
 		if err != nil {
+			// unreadable metadata only matters when filtering by codec
+			if len(codecs) == 0 {
+				return true, nil
+			}
 			return false, err
 		}
+		for _, mdCode := range md.Protocols() {
+			if !slices.Contains(seen, mdCode) {
+				seen = append(seen, mdCode)
+			}
+		}
+		if len(codecs) == 0 {
+			return true, nil
+		}
 		return slices.ContainsFunc(codecs, func(code multicodec.Code) bool {
 			return slices.ContainsFunc(md.Protocols(), func(mdCode multicodec.Code) bool {
 				return mdCode == code
 			})
 		}), nil
 	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return filtered, seen, nil
 }
 
-func (pi *ProviderIndex) filterBySpace(results []model.ProviderResult, mh mh.Multihash, spaces []did.DID) ([]model.ProviderResult, error) {
+// filterBySpace filters records to those with context IDs of any of the spaces
+// or location commitments any of the spaces is bound to, and, if
+// unscopedLocations is set, location commitments with context IDs not scoped
+// to a space, returning how many were admitted only as the latter. If none
+// match any of the spaces, every record is returned
+func (pi *ProviderIndex) filterBySpace(ctx context.Context, results []providerresults.Record, mh mh.Multihash, spaces []did.DID, unscopedLocations bool) ([]providerresults.Record, int, error) {
 	if len(spaces) == 0 {
-		return results, nil
-	}
-	encryptedIds := make([]types.EncodedContextID, 0, len(spaces))
-	for _, space := range spaces {
-		encryptedId, err := types.ContextID{
-			Space: &space,
-			Hash:  mh,
-		}.ToEncoded()
+		return results, 0, nil
+	}
+	var bindings []types.SpaceBinding
+	if pi.bindings != nil {
+		var err error
+		if bindings, err = pi.spaceBindings(ctx, mh); err != nil {
+			return nil, 0, err
+		}
+	}
+	var matched, unscoped int
+	filtered, err := filter(results, func(result model.ProviderResult) (bool, error) {
+		for _, space := range spaces {
+			ok, err := pi.contextIDs.Match(types.ContextID{Space: &space, Hash: mh}, result.ContextID)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				matched++
+				return true, nil
+			}
+		}
+		bound, err := pi.boundToSpace(bindings, result, mh, spaces)
 		if err != nil {
-			return nil, err
+			return false, err
+		}
+		if bound {
+			matched++
+			return true, nil
 		}
-		encryptedIds = append(encryptedIds, encryptedId)
+		if !unscopedLocations {
+			return false, nil
+		}
+		ok, err := pi.contextIDs.Match(types.ContextID{Hash: mh}, result.ContextID)
+		if err != nil || !ok || !isLocation(result) {
+			return false, err
+		}
+		unscoped++
+		return true, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if matched > 0 {
+		return filtered, unscoped, nil
 	}
+	return results, 0, nil
+}
 
-	filtered, err := filter(results, func(result model.ProviderResult) (bool, error) {
-		return slices.ContainsFunc(encryptedIds, func(encyptedID types.EncodedContextID) bool {
-			return bytes.Equal(result.ContextID, encyptedID)
-		}), nil
+// isLocation returns true if the record has location commitment metadata
+func isLocation(result model.ProviderResult) bool {
+	md := metadata.MetadataContext.New()
+	if err := md.UnmarshalBinary(result.Metadata); err != nil {
+		return false
+	}
+	return slices.ContainsFunc(md.Protocols(), func(code multicodec.Code) bool {
+		return metadata.ClaimKind(code) == metadata.LocationKind
 	})
+}
+
+// ttlProviderStore is implemented by provider stores that can set an explicit
+// expiration on a write
+type ttlProviderStore interface {
+	SetWithTTL(ctx context.Context, hash mh.Multihash, results []model.ProviderResult, ttl time.Duration) error
+}
+
+// mergingProviderStore is implemented by provider stores that can write an
+// entry with a record added to it without extending how long its other records
+// are kept. A zero ttl is the store's default expiration
+type mergingProviderStore interface {
+	MergeEntry(ctx context.Context, hash mh.Multihash, entry providerresults.Entry, ttl time.Duration) error
+}
+
+// CacheProviderResult merges a single provider record into the cached records for
+// the given hash, leaving any other cached records in place, as seen now. If
+// expiration is set, the cache entry expires at that time where the store
+// supports it, or sooner if the cached entry already expires sooner, so that
+// caching a record never keeps the other records for longer. Records that have
+// already expired are not cached
+func (pi *ProviderIndex) CacheProviderResult(ctx context.Context, hash mh.Multihash, result model.ProviderResult, expiration time.Time) error {
+	var ttl time.Duration
+	if !expiration.IsZero() {
+		var ok bool
+		if ttl, ok = pi.ttl(expiration); !ok {
+			return nil
+		}
+	}
+	entry, err := pi.getStoredEntryForWrite(ctx, hash)
+	if err != nil && err != types.ErrKeyNotFound {
+		return err
+	}
+	if slices.ContainsFunc(entry.Records, func(r providerresults.Record) bool { return sameProviderResult(r.ProviderResult, result) }) {
+		return nil
+	}
+	entry.Records = append(slices.Clone(entry.Records), providerresults.Record{ProviderResult: result, SeenAt: pi.now()})
+	pi.invalidateRecent(hash)
+	if ms, ok := pi.providerStore.(mergingProviderStore); ok {
+		return ms.MergeEntry(ctx, hash, entry, ttl)
+	}
+	if ts, ok := pi.providerStore.(ttlProviderStore); ok && ttl > 0 {
+		return ts.SetWithTTL(ctx, hash, providerresults.Results(entry.Records), ttl)
+	}
+	return pi.setStoredEntry(ctx, hash, entry, true)
+}
+
+// ExpireClaim shortens how long the cached records for the given hash are kept
+// to ttl if any of them are for the claim, such as for an index claim that was
+// superseded, so that they are looked up again soon rather than served until
+// they expire. Records are only expired early where the store supports it
+func (pi *ProviderIndex) ExpireClaim(ctx context.Context, hash mh.Multihash, claim cid.Cid, ttl time.Duration) error {
+	ts, ok := pi.providerStore.(ttlProviderStore)
+	if !ok || ttl <= 0 {
+		return nil
+	}
+	existing, err := types.GetForWrite(ctx, pi.providerStore, hash)
 	if err != nil {
-		return nil, err
+		if errors.Is(err, types.ErrKeyNotFound) {
+			return nil
+		}
+		return err
 	}
-	if len(filtered) > 0 {
-		return filtered, nil
+	if !slices.ContainsFunc(existing, func(r model.ProviderResult) bool {
+		return slices.Contains(recordClaims(providerresults.Record{ProviderResult: r}), claim)
+	}) {
+		return nil
 	}
-	return results, nil
+	pi.invalidateRecent(hash)
+	return ts.SetWithTTL(ctx, hash, existing, ttl)
 }
 
-// Publish should do the following:
-// 1. Write the entries to the cache with no expiration until publishing is complete
-// 2. Generate an advertisement for the advertised hashes and publish/announce it
-func (pi *ProviderIndex) Publish(context.Context, []mh.Multihash, model.ProviderResult) {
+func sameProviderResult(a, b model.ProviderResult) bool {
+	if !bytes.Equal(a.ContextID, b.ContextID) || !bytes.Equal(a.Metadata, b.Metadata) {
+		return false
+	}
+	if a.Provider == nil || b.Provider == nil {
+		return a.Provider == b.Provider
+	}
+	return a.Provider.ID == b.Provider.ID
+}
 
+// Publish caches the provider result for the hashes, then publishes an
+// advertisement of it if an advertisement publisher is set, announcing it if an
+// announcer is set. The cache entries of hashes that had none don't expire
+// until the advertisement is published and announced, and entries already
+// cached keep their expire time until then. Once publishing is done, every
+// entry of the hashes expires as any other cached entry does
+//
+// The provider result is validated and normalized with NormalizeProviderResult
+// before anything is written, and it is the normalized result that is cached,
+// as seen now, and replicated if replicators are set. With space bindings, a
+// location commitment already published under another space is bound to
+// instead, unless DistinctClaims is given. For index claims, the hashes can be checked against
+// the index with ValidateEntries, or derived from it with DeriveEntriesFromIndex
+func (pi *ProviderIndex) Publish(ctx context.Context, hashes []mh.Multihash, result model.ProviderResult, opts ...PublishOption) error {
+	var cfg publishConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	hashes, err := indexEntries(hashes, cfg)
+	if err != nil {
+		return err
+	}
+	normalized, err := NormalizeProviderResult(result)
+	if err != nil {
+		return err
+	}
+	if !cfg.distinct {
+		bound, err := pi.bindSpace(ctx, hashes, normalized)
+		if err != nil {
+			return fmt.Errorf("binding space: %w", err)
+		}
+		if bound {
+			return nil
+		}
+	}
+	for _, hash := range hashes {
+		entry, err := pi.getStoredEntryForWrite(ctx, hash)
+		if err != nil && err != types.ErrKeyNotFound {
+			return err
+		}
+		if slices.ContainsFunc(entry.Records, func(r providerresults.Record) bool { return providerresults.Equals(r.ProviderResult, normalized) }) {
+			continue
+		}
+		entry.Records = append(slices.Clone(entry.Records), providerresults.Record{ProviderResult: normalized, SeenAt: pi.now()})
+		pi.invalidateRecent(hash)
+		if err := pi.setPublishedEntry(ctx, hash, entry); err != nil {
+			return err
+		}
+		for _, r := range pi.replicators {
+			r.ReplicateProviders(hash, []model.ProviderResult{normalized})
+		}
+	}
+	if pi.adverts != nil {
+		link, err := pi.adverts.Publish(ctx, *normalized.Provider, normalized.ContextID, normalized.Metadata, hashes)
+		if err != nil {
+			return fmt.Errorf("publishing advertisement: %w", err)
+		}
+		if pi.announcer != nil {
+			kinds := metadata.ClaimKinds(normalized.Metadata)
+			if err := pi.announcer.Announce(ctx, link, publisher.WithClaimKinds(kinds...), publisher.ForContextID(normalized.Provider.ID, normalized.ContextID)); err != nil {
+				return fmt.Errorf("announcing advertisement: %w", err)
+			}
+		}
+	}
+	for _, hash := range hashes {
+		if err := pi.providerStore.SetExpirable(ctx, hash, true); err != nil {
+			return fmt.Errorf("expiring published records: %w", err)
+		}
+	}
+	return nil
+}
+
+// replacingProviderStore is implemented by provider stores that can rewrite an
+// entry without changing when it expires
+type replacingProviderStore interface {
+	ReplaceEntry(ctx context.Context, hash mh.Multihash, entry providerresults.Entry) error
+}
+
+// setPublishedEntry writes an entry with a record being published added to it,
+// keeping the expire time of the entry it replaces where the store supports it,
+// so an entry only doesn't expire while publishing if it wasn't cached before
+func (pi *ProviderIndex) setPublishedEntry(ctx context.Context, hash mh.Multihash, entry providerresults.Entry) error {
+	if rs, ok := pi.providerStore.(replacingProviderStore); ok {
+		return rs.ReplaceEntry(ctx, hash, entry)
+	}
+	return pi.setStoredEntry(ctx, hash, entry, false)
 }
 
-func filter(results []model.ProviderResult, filterFunc func(model.ProviderResult) (bool, error)) ([]model.ProviderResult, error) {
+func filter(results []providerresults.Record, filterFunc func(model.ProviderResult) (bool, error)) ([]providerresults.Record, error) {
 
-	filtered := make([]model.ProviderResult, 0, len(results))
+	filtered := make([]providerresults.Record, 0, len(results))
 	for _, result := range results {
-		include, err := filterFunc(result)
+		include, err := filterFunc(result.ProviderResult)
 		if err != nil {
 			return nil, err
 		}
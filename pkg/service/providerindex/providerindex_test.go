@@ -0,0 +1,899 @@
+package providerindex_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	ipnifind "github.com/ipni/go-libipni/find/client"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/ingest/schema"
+	ipnimd "github.com/ipni/go-libipni/metadata"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/go-ucanto/principal/ed25519/signer"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/providerresults"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/service/httppool"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderIndex__FindDetailed(t *testing.T) {
+	ctx := context.Background()
+	hash := testutil.RandomMultihash()
+	equalsResult := testutil.RandomProviderResult()
+	equalsResult.Metadata = testutil.Must((&metadata.EqualsClaimMetadata{
+		Equals: testutil.RandomCID().(cidlink.Link).Cid,
+		Claim:  testutil.RandomCID().(cidlink.Link).Cid,
+	}).MarshalBinary())(t)
+	indexResult := testutil.RandomProviderResult()
+	indexResult.Metadata = testutil.Must((&metadata.IndexClaimMetadata{
+		Index: testutil.RandomCID().(cidlink.Link).Cid,
+		Claim: testutil.RandomCID().(cidlink.Link).Cid,
+	}).MarshalBinary())(t)
+
+	testCases := []struct {
+		name               string
+		cached             []model.ProviderResult
+		ipniResults        []model.ProviderResult
+		legacyResults      []model.ProviderResult
+		targetClaims       []multicodec.Code
+		expectedResults    []model.ProviderResult
+		expectedUnfiltered int
+		expectedSeen       []multicodec.Code
+		expectIPNI         bool
+		expectLegacy       bool
+		expectedCached     []model.ProviderResult
+	}{
+		{
+			name:           "unknown everywhere falls back to legacy and caches empty result",
+			targetClaims:   []multicodec.Code{metadata.LocationCommitmentID},
+			expectIPNI:     true,
+			expectLegacy:   true,
+			expectedCached: []model.ProviderResult{},
+		},
+		{
+			name:               "unknown in IPNI uses legacy results",
+			legacyResults:      []model.ProviderResult{indexResult},
+			targetClaims:       []multicodec.Code{metadata.IndexClaimID},
+			expectedResults:    []model.ProviderResult{indexResult},
+			expectedUnfiltered: 1,
+			expectedSeen:       []multicodec.Code{metadata.IndexClaimID},
+			expectIPNI:         true,
+			expectLegacy:       true,
+			expectedCached:     []model.ProviderResult{indexResult},
+		},
+		{
+			name:               "known but filtered does not fall back to legacy",
+			ipniResults:        []model.ProviderResult{equalsResult},
+			targetClaims:       []multicodec.Code{metadata.LocationCommitmentID},
+			expectedUnfiltered: 1,
+			expectedSeen:       []multicodec.Code{metadata.EqualsClaimID},
+			expectIPNI:         true,
+			expectedCached:     []model.ProviderResult{equalsResult},
+		},
+		{
+			name:               "matching records",
+			ipniResults:        []model.ProviderResult{equalsResult, indexResult},
+			targetClaims:       []multicodec.Code{metadata.IndexClaimID},
+			expectedResults:    []model.ProviderResult{indexResult},
+			expectedUnfiltered: 2,
+			expectedSeen:       []multicodec.Code{metadata.EqualsClaimID, metadata.IndexClaimID},
+			expectIPNI:         true,
+			expectedCached:     []model.ProviderResult{equalsResult, indexResult},
+		},
+		{
+			name:           "cached empty result is not queried again",
+			cached:         []model.ProviderResult{},
+			targetClaims:   []multicodec.Code{metadata.LocationCommitmentID},
+			expectedCached: []model.ProviderResult{},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &mockProviderStore{results: map[string][]model.ProviderResult{}}
+			if tc.cached != nil {
+				store.results[string(hash)] = tc.cached
+			}
+			finder := &mockFinder{results: tc.ipniResults}
+			legacy := &mockLegacySystems{results: tc.legacyResults}
+			pi := providerindex.NewProviderIndex(store, finder, nil, nil, cidlink.DefaultLinkSystem(), legacy)
+
+			fr, err := pi.FindDetailed(ctx, providerindex.QueryKey{Hash: hash, TargetClaims: tc.targetClaims})
+			require.NoError(t, err)
+			require.ElementsMatch(t, tc.expectedResults, fr.Results)
+			require.Equal(t, tc.expectedUnfiltered, fr.Unfiltered)
+			require.Equal(t, tc.expectedUnfiltered > 0, fr.Known())
+			require.ElementsMatch(t, tc.expectedSeen, fr.SeenClaims)
+			require.Equal(t, tc.expectIPNI, finder.calls > 0)
+			require.Equal(t, tc.expectLegacy, legacy.calls > 0)
+			cached, ok := store.results[string(hash)]
+			require.True(t, ok)
+			require.ElementsMatch(t, tc.expectedCached, cached)
+		})
+	}
+}
+
+func TestProviderIndex__CachedClaimTypes(t *testing.T) {
+	ctx := context.Background()
+	resultWith := func(protocol ipnimd.Protocol) model.ProviderResult {
+		result := testutil.RandomProviderResult()
+		md := metadata.MetadataContext.New(protocol)
+		result.Metadata = testutil.Must(md.MarshalBinary())(t)
+		return result
+	}
+	locationResult := resultWith(&metadata.LocationCommitmentMetadata{Claim: testutil.RandomCID().(cidlink.Link).Cid})
+	indexResult := resultWith(&metadata.IndexClaimMetadata{Index: testutil.RandomCID().(cidlink.Link).Cid, Claim: testutil.RandomCID().(cidlink.Link).Cid})
+	locationOnly := []multicodec.Code{metadata.LocationCommitmentID}
+	standard := []multicodec.Code{metadata.IndexClaimID, metadata.LocationCommitmentID}
+
+	find := func(t *testing.T, pi *providerindex.ProviderIndex, hash multihash.Multihash, codecs []multicodec.Code) []model.ProviderResult {
+		return testutil.Must(pi.Find(ctx, providerindex.QueryKey{Hash: hash, TargetClaims: codecs}))(t)
+	}
+
+	t.Run("location query does not narrow later queries", func(t *testing.T) {
+		hash := testutil.RandomMultihash()
+		store := &mockEntryStore{entries: map[string]providerresults.Entry{}}
+		finder := &mockFinder{results: []model.ProviderResult{locationResult, indexResult}}
+		pi := providerindex.NewProviderIndex(store, finder, nil, nil, cidlink.DefaultLinkSystem(), nil)
+
+		require.Equal(t, []model.ProviderResult{locationResult}, find(t, pi, hash, locationOnly))
+		require.ElementsMatch(t, []model.ProviderResult{locationResult, indexResult}, find(t, pi, hash, standard))
+		require.Equal(t, 1, finder.calls)
+	})
+
+	t.Run("records cached piecemeal are refreshed for other claim types", func(t *testing.T) {
+		hash := testutil.RandomMultihash()
+		store := &mockEntryStore{entries: map[string]providerresults.Entry{}}
+		finder := &mockFinder{results: []model.ProviderResult{indexResult}}
+		pi := providerindex.NewProviderIndex(store, finder, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		require.NoError(t, pi.CacheProviderResult(ctx, hash, locationResult, time.Time{}))
+
+		require.Equal(t, []model.ProviderResult{locationResult}, find(t, pi, hash, locationOnly))
+		require.Equal(t, 0, finder.calls)
+		require.ElementsMatch(t, []model.ProviderResult{locationResult, indexResult}, find(t, pi, hash, standard))
+		require.Equal(t, 1, finder.calls)
+		require.True(t, store.entries[string(hash)].Complete)
+		// once complete, the entry covers every claim type
+		require.Len(t, find(t, pi, hash, nil), 2)
+		require.Equal(t, 1, finder.calls)
+	})
+
+	t.Run("snapshot reads again for claim types not covered", func(t *testing.T) {
+		hash := testutil.RandomMultihash()
+		store := &mockEntryStore{entries: map[string]providerresults.Entry{
+			string(hash): {Records: []providerresults.Record{{ProviderResult: locationResult}}},
+		}}
+		finder := &mockFinder{results: []model.ProviderResult{indexResult}}
+		pi := providerindex.NewProviderIndex(store, finder, nil, nil, cidlink.DefaultLinkSystem(), nil).Snapshot(10)
+
+		require.Equal(t, []model.ProviderResult{locationResult}, find(t, pi, hash, locationOnly))
+		require.ElementsMatch(t, []model.ProviderResult{locationResult, indexResult}, find(t, pi, hash, standard))
+		require.ElementsMatch(t, []model.ProviderResult{locationResult, indexResult}, find(t, pi, hash, standard))
+		require.Equal(t, 1, finder.calls)
+	})
+}
+
+func TestProviderIndex__SeenAt(t *testing.T) {
+	ctx := context.Background()
+	hash := testutil.RandomMultihash()
+	ipniResult := testutil.RandomProviderResult()
+	legacyResult := testutil.RandomProviderResult()
+
+	store := &mockRecordStore{mockProviderStore{results: map[string][]model.ProviderResult{}}, map[string][]providerresults.Record{}}
+	pi := providerindex.NewProviderIndex(store, &mockFinder{results: []model.ProviderResult{ipniResult}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+	before := time.Now()
+	fr := testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: hash}))(t)
+	require.Equal(t, []model.ProviderResult{ipniResult}, fr.Results)
+	require.Len(t, fr.SeenAt, 1)
+	require.False(t, fr.SeenAt[0].Before(before.Truncate(time.Second)))
+	// seen at times are stored along with the records
+	require.Equal(t, fr.SeenAt[0], store.records[string(hash)][0].SeenAt)
+
+	// records from legacy systems have not been seen
+	legacyHash := testutil.RandomMultihash()
+	pi = providerindex.NewProviderIndex(store, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), &mockLegacySystems{results: []model.ProviderResult{legacyResult}})
+	fr = testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: legacyHash}))(t)
+	require.Equal(t, []model.ProviderResult{legacyResult}, fr.Results)
+	require.True(t, fr.SeenAt[0].IsZero())
+
+	// marking a record seen updates it, unless it was seen later already
+	at := time.Now().Add(time.Minute)
+	require.NoError(t, pi.MarkSeen(ctx, legacyHash, legacyResult, at))
+	require.Equal(t, at, store.records[string(legacyHash)][0].SeenAt)
+	require.NoError(t, pi.MarkSeen(ctx, legacyHash, legacyResult, at.Add(-time.Hour)))
+	require.Equal(t, at, store.records[string(legacyHash)][0].SeenAt)
+	// unknown records are ignored
+	require.NoError(t, pi.MarkSeen(ctx, legacyHash, ipniResult, at))
+	require.Len(t, store.records[string(legacyHash)], 1)
+}
+
+func TestProviderIndex__IPNICoolingDown(t *testing.T) {
+	ctx := context.Background()
+	var requests atomic.Int32
+	ipni := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ipni.Close()
+	pool := httppool.New(httppool.WithCooldowns(httppool.NewCooldowns()))
+	finder := testutil.Must(ipnifind.New(ipni.URL, ipnifind.WithClient(pool.Client())))(t)
+
+	legacyResult := testutil.RandomProviderResult()
+	cachedResult := testutil.RandomProviderResult()
+	cachedHash := testutil.RandomMultihash()
+	store := &mockEntryStore{entries: map[string]providerresults.Entry{
+		string(cachedHash): {Records: []providerresults.Record{{ProviderResult: cachedResult}}},
+	}}
+	legacy := &mockLegacySystems{results: []model.ProviderResult{legacyResult}}
+	pi := providerindex.NewProviderIndex(store, finder, nil, nil, cidlink.DefaultLinkSystem(), legacy)
+
+	for range 3 {
+		hash := testutil.RandomMultihash()
+		fr := testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: hash}))(t)
+		require.Equal(t, []model.ProviderResult{legacyResult}, fr.Results)
+		// what the legacy systems know isn't cached in place of what IPNI does
+		require.NotContains(t, store.entries, string(hash))
+	}
+	fr := testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: cachedHash}))(t)
+	require.Equal(t, []model.ProviderResult{cachedResult}, fr.Results)
+	require.False(t, store.entries[string(cachedHash)].Complete)
+	require.Equal(t, 3, legacy.calls)
+	// only the first query reached IPNI, the rest failed fast
+	require.Equal(t, int32(1), requests.Load())
+
+	t.Run("fails when nothing else is known", func(t *testing.T) {
+		pi := providerindex.NewProviderIndex(store, finder, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		_, err := pi.FindDetailed(ctx, providerindex.QueryKey{Hash: testutil.RandomMultihash()})
+		require.ErrorAs(t, err, &httppool.ErrProviderCoolingDown{})
+		require.Equal(t, int32(1), requests.Load())
+	})
+}
+
+func TestProviderIndex__Snapshot(t *testing.T) {
+	ctx := context.Background()
+	hash, otherHash := testutil.RandomMultihash(), testutil.RandomMultihash()
+	before, after := testutil.RandomProviderResult(), testutil.RandomProviderResult()
+	store := &mockProviderStore{results: map[string][]model.ProviderResult{
+		string(hash):      {before},
+		string(otherHash): {before},
+	}}
+	pi := providerindex.NewProviderIndex(store, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+	find := func(t *testing.T, pi *providerindex.ProviderIndex, hash multihash.Multihash) []model.ProviderResult {
+		return testutil.Must(pi.Find(ctx, providerindex.QueryKey{Hash: hash}))(t)
+	}
+
+	snapshot := pi.Snapshot(1)
+	require.Equal(t, []model.ProviderResult{before}, find(t, snapshot, hash))
+	require.Equal(t, []model.ProviderResult{before}, find(t, snapshot, otherHash))
+	store.results[string(hash)] = []model.ProviderResult{after}
+	store.results[string(otherHash)] = []model.ProviderResult{after}
+
+	// the first hash read keeps its records, while a full snapshot reads the
+	// store every time
+	require.Equal(t, []model.ProviderResult{before}, find(t, snapshot, hash))
+	require.Equal(t, []model.ProviderResult{after}, find(t, snapshot, otherHash))
+	require.Equal(t, []model.ProviderResult{after}, find(t, pi, hash))
+	require.Equal(t, []model.ProviderResult{after}, find(t, pi.Snapshot(1), hash))
+}
+
+func TestProviderIndex__ExpireClaim(t *testing.T) {
+	ctx := context.Background()
+	hash := testutil.RandomMultihash()
+	claim := testutil.RandomCID().(cidlink.Link).Cid
+	md := metadata.IndexClaimMetadata{Index: testutil.RandomCID().(cidlink.Link).Cid, Claim: claim}
+	result := model.ProviderResult{ContextID: testutil.RandomBytes(10), Metadata: testutil.Must(md.MarshalBinary())(t), Provider: &peer.AddrInfo{ID: testutil.RandomPeer()}}
+	store := &ttlProviderStore{mockProviderStore: mockProviderStore{results: map[string][]model.ProviderResult{
+		string(hash): {result, testutil.RandomProviderResult()},
+	}}, ttls: map[string]time.Duration{}}
+	pi := providerindex.NewProviderIndex(store, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+
+	// records for other claims are left alone
+	require.NoError(t, pi.ExpireClaim(ctx, hash, testutil.RandomCID().(cidlink.Link).Cid, time.Minute))
+	require.Empty(t, store.ttls)
+	require.NoError(t, pi.ExpireClaim(ctx, testutil.RandomMultihash(), claim, time.Minute))
+	require.Empty(t, store.ttls)
+
+	require.NoError(t, pi.ExpireClaim(ctx, hash, claim, time.Minute))
+	require.Equal(t, time.Minute, store.ttls[string(hash)])
+	require.Len(t, store.results[string(hash)], 2)
+}
+
+// laggingProviderStore reads from a replica that hasn't caught up with the
+// writes to the primary
+type laggingProviderStore struct {
+	mockProviderStore
+	replica map[string][]model.ProviderResult
+}
+
+func (m *laggingProviderStore) Get(ctx context.Context, hash multihash.Multihash) ([]model.ProviderResult, error) {
+	results, ok := m.replica[string(hash)]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return results, nil
+}
+
+func (m *laggingProviderStore) GetPrimary(ctx context.Context, hash multihash.Multihash) ([]model.ProviderResult, error) {
+	return m.mockProviderStore.Get(ctx, hash)
+}
+
+func TestProviderIndex__WritesReadPrimary(t *testing.T) {
+	ctx := context.Background()
+	hash := testutil.RandomMultihash()
+	claim := testutil.RandomCID().(cidlink.Link).Cid
+	md := metadata.IndexClaimMetadata{Index: testutil.RandomCID().(cidlink.Link).Cid, Claim: claim}
+	provider := &peer.AddrInfo{ID: testutil.RandomPeer(), Addrs: []multiaddr.Multiaddr{testutil.RandomMultiaddr()}}
+	newStore := func() (*laggingProviderStore, model.ProviderResult) {
+		// another instance wrote a record the replica hasn't seen yet
+		written := testutil.RandomProviderResult()
+		return &laggingProviderStore{
+			mockProviderStore: mockProviderStore{results: map[string][]model.ProviderResult{string(hash): {written}}},
+			replica:           map[string][]model.ProviderResult{},
+		}, written
+	}
+	result := model.ProviderResult{ContextID: testutil.RandomBytes(10), Metadata: testutil.Must(md.MarshalBinary())(t), Provider: provider}
+
+	t.Run("caching a record", func(t *testing.T) {
+		store, written := newStore()
+		pi := providerindex.NewProviderIndex(store, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		require.NoError(t, pi.CacheProviderResult(ctx, hash, result, time.Time{}))
+		require.Equal(t, []model.ProviderResult{written, result}, store.results[string(hash)])
+	})
+
+	t.Run("publishing a record", func(t *testing.T) {
+		store, written := newStore()
+		pi := providerindex.NewProviderIndex(store, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		require.NoError(t, pi.Publish(ctx, []multihash.Multihash{hash}, result))
+		require.Len(t, store.results[string(hash)], 2)
+		require.Equal(t, written, store.results[string(hash)][0])
+	})
+}
+
+// expiringProviderStore is a provider store that keeps whether each entry
+// expires
+type expiringProviderStore struct {
+	mockProviderStore
+	expires map[string]bool
+}
+
+func (m *expiringProviderStore) Set(ctx context.Context, hash multihash.Multihash, results []model.ProviderResult, expires bool) error {
+	m.expires[string(hash)] = expires
+	return m.mockProviderStore.Set(ctx, hash, results, expires)
+}
+
+func (m *expiringProviderStore) SetExpirable(ctx context.Context, hash multihash.Multihash, expires bool) error {
+	if _, ok := m.results[string(hash)]; ok {
+		m.expires[string(hash)] = expires
+	}
+	return nil
+}
+
+func (m *expiringProviderStore) ReplaceEntry(ctx context.Context, hash multihash.Multihash, entry providerresults.Entry) error {
+	m.results[string(hash)] = providerresults.Results(entry.Records)
+	return nil
+}
+
+// expiryAnnouncer records whether the entries of the hashes expire when an
+// advertisement is announced
+type expiryAnnouncer struct {
+	store   *expiringProviderStore
+	hashes  []multihash.Multihash
+	expires []bool
+}
+
+func (m *expiryAnnouncer) Announce(ctx context.Context, link ipld.Link, opts ...publisher.AnnounceOption) error {
+	for _, hash := range m.hashes {
+		m.expires = append(m.expires, m.store.expires[string(hash)])
+	}
+	return nil
+}
+
+func TestProviderIndex__PublishExpiry(t *testing.T) {
+	ctx := context.Background()
+	md := metadata.IndexClaimMetadata{Index: testutil.RandomCID().(cidlink.Link).Cid, Claim: testutil.RandomCID().(cidlink.Link).Cid}
+	result := model.ProviderResult{
+		ContextID: testutil.RandomBytes(10),
+		Metadata:  testutil.Must(md.MarshalBinary())(t),
+		Provider:  &peer.AddrInfo{ID: testutil.RandomPeer(), Addrs: []multiaddr.Multiaddr{testutil.RandomMultiaddr()}},
+	}
+	cached, uncached := testutil.RandomMultihash(), testutil.RandomMultihash()
+	store := &expiringProviderStore{
+		mockProviderStore: mockProviderStore{results: map[string][]model.ProviderResult{string(cached): {testutil.RandomProviderResult()}}},
+		expires:           map[string]bool{string(cached): true},
+	}
+	announcer := &expiryAnnouncer{store: store, hashes: []multihash.Multihash{cached, uncached}}
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	pi := providerindex.NewProviderIndex(store, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil,
+		providerindex.WithAdvertisementPublisher(publisher.New(dssync.MutexWrap(datastore.NewMapDatastore()), key)),
+		providerindex.WithAdvertisementAnnouncer(announcer))
+
+	require.NoError(t, pi.Publish(ctx, []multihash.Multihash{cached, uncached}, result))
+	// until the advertisement is announced, the entry already cached keeps
+	// expiring but the new entry doesn't, and once it is, both expire
+	require.Equal(t, []bool{true, false}, announcer.expires)
+	require.True(t, store.expires[string(cached)])
+	require.True(t, store.expires[string(uncached)])
+	require.Len(t, store.results[string(cached)], 2)
+	require.Len(t, store.results[string(uncached)], 1)
+}
+
+func TestProviderIndex__Publish(t *testing.T) {
+	ctx := context.Background()
+	claim := &metadata.IndexClaimMetadata{
+		Index:      testutil.RandomCID().(cidlink.Link).Cid,
+		Expiration: 1000,
+		Claim:      testutil.RandomCID().(cidlink.Link).Cid,
+	}
+	claimMd := metadata.MetadataContext.New(claim)
+	canonical := testutil.Must(claimMd.MarshalBinary())(t)
+	// the same claim, with the keys of its CBOR map out of order
+	reordered := varint.ToUvarint(uint64(metadata.IndexClaimID))
+	nd := testutil.Must(qp.BuildMap(basicnode.Prototype.Any, 3, func(ma ipld.MapAssembler) {
+		qp.MapEntry(ma, "i", qp.Link(cidlink.Link{Cid: claim.Index}))
+		qp.MapEntry(ma, "e", qp.Int(claim.Expiration))
+		qp.MapEntry(ma, "c", qp.Link(cidlink.Link{Cid: claim.Claim}))
+	}))(t)
+	var buf bytes.Buffer
+	require.NoError(t, dagcbor.EncodeOptions{AllowLinks: true, MapSortMode: codec.MapSortMode_None}.Encode(nd, &buf))
+	reordered = append(reordered, buf.Bytes()...)
+	require.NotEqual(t, canonical, reordered)
+	// the same claim, alongside a non-claim protocol
+	withBitswapMd := metadata.MetadataContext.New(claim, &ipnimd.Bitswap{})
+	withBitswap := testutil.Must(withBitswapMd.MarshalBinary())(t)
+	// an unknown protocol is a code followed by a length prefixed payload
+	unknownOnly := append(append(varint.ToUvarint(0x3E00FF), varint.ToUvarint(10)...), testutil.RandomBytes(10)...)
+
+	addr := testutil.RandomMultiaddr()
+	provider := &peer.AddrInfo{ID: testutil.RandomPeer(), Addrs: []multiaddr.Multiaddr{addr}}
+	contextID := testutil.RandomBytes(10)
+	expected := model.ProviderResult{ContextID: contextID, Metadata: canonical, Provider: provider}
+
+	testCases := []struct {
+		name        string
+		metadata    []byte
+		provider    *peer.AddrInfo
+		expectedErr error
+	}{
+		{name: "canonical", metadata: canonical, provider: provider},
+		{name: "map keys out of order", metadata: reordered, provider: provider},
+		{name: "non-claim protocols", metadata: withBitswap, provider: provider},
+		{name: "duplicate addresses", metadata: canonical, provider: &peer.AddrInfo{ID: provider.ID, Addrs: []multiaddr.Multiaddr{addr, addr}}},
+		{name: "junk metadata", metadata: []byte("not metadata"), provider: provider, expectedErr: providerindex.ErrInvalidMetadata},
+		{name: "unknown protocols only", metadata: unknownOnly, provider: provider, expectedErr: providerindex.ErrNoClaimProtocol},
+		{name: "oversized metadata", metadata: append(slices.Clone(canonical), make([]byte, providerindex.MaxMetadataSize)...), provider: provider, expectedErr: providerindex.ErrMetadataTooLarge},
+		{name: "no provider", metadata: canonical, expectedErr: providerindex.ErrInvalidProvider},
+		{name: "no provider addresses", metadata: canonical, provider: &peer.AddrInfo{ID: provider.ID}, expectedErr: providerindex.ErrInvalidProvider},
+		{name: "invalid peer ID", metadata: canonical, provider: &peer.AddrInfo{Addrs: provider.Addrs}, expectedErr: providerindex.ErrInvalidProvider},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &mockProviderStore{results: map[string][]model.ProviderResult{}}
+			pi := providerindex.NewProviderIndex(store, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+			hashes := testutil.RandomMultihashes(2)
+			result := model.ProviderResult{ContextID: contextID, Metadata: tc.metadata, Provider: tc.provider}
+
+			err := pi.Publish(ctx, hashes, result)
+			if tc.expectedErr != nil {
+				require.ErrorIs(t, err, tc.expectedErr)
+				require.Empty(t, store.results)
+				return
+			}
+			require.NoError(t, err)
+			for _, hash := range hashes {
+				cached := store.results[string(hash)]
+				require.Len(t, cached, 1)
+				require.Equal(t, canonical, cached[0].Metadata)
+				require.True(t, providerresults.Equals(expected, cached[0]))
+			}
+			// publishing again doesn't duplicate the record
+			require.NoError(t, pi.Publish(ctx, hashes, result))
+			require.Len(t, store.results[string(hashes[0])], 1)
+		})
+	}
+}
+
+func TestProviderIndex__ContextIDCodec(t *testing.T) {
+	ctx := context.Background()
+	hash := testutil.RandomMultihash()
+	space, otherSpace := testutil.Must(signer.Generate())(t).DID(), testutil.Must(signer.Generate())(t).DID()
+	oldScheme, newScheme := types.DefaultContextIDCodec, types.NewMultihashContextIDCodec(multihash.SHA2_512)
+
+	// records cached before the switch carry context IDs of the old scheme
+	withContextID := func(scheme types.ContextIDCodec, space did.DID) model.ProviderResult {
+		result := testutil.RandomProviderResult()
+		result.ContextID = testutil.Must(scheme.Encode(types.ContextID{Space: &space, Hash: hash}))(t)
+		return result
+	}
+	oldResult, newResult, otherResult := withContextID(oldScheme, space), withContextID(newScheme, space), withContextID(oldScheme, otherSpace)
+	cached := []model.ProviderResult{oldResult, newResult, otherResult}
+
+	testCases := []struct {
+		name     string
+		codec    types.ContextIDCodec
+		expected []model.ProviderResult
+	}{
+		{
+			name:     "default scheme matches old records only",
+			codec:    oldScheme,
+			expected: []model.ProviderResult{oldResult},
+		},
+		{
+			name:     "new scheme alone matches new records only",
+			codec:    newScheme,
+			expected: []model.ProviderResult{newResult},
+		},
+		{
+			name:     "secondary scheme matches records of mixed eras",
+			codec:    types.NewMultiContextIDCodec(newScheme, oldScheme),
+			expected: []model.ProviderResult{oldResult, newResult},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &mockProviderStore{results: map[string][]model.ProviderResult{string(hash): cached}}
+			pi := providerindex.NewProviderIndex(store, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil, providerindex.WithContextIDCodec(tc.codec))
+			results := testutil.Must(pi.Find(ctx, providerindex.QueryKey{Hash: hash, Spaces: []did.DID{space}}))(t)
+			require.Equal(t, tc.expected, results)
+		})
+	}
+
+	// the primary scheme is used for encoding
+	encoded := testutil.Must(types.NewMultiContextIDCodec(newScheme, oldScheme).Encode(types.ContextID{Space: &space, Hash: hash}))(t)
+	require.Equal(t, newResult.ContextID, []byte(encoded))
+}
+
+func TestProviderIndex__KeyedContextID(t *testing.T) {
+	ctx := context.Background()
+	hash := testutil.RandomMultihash()
+	space, otherSpace := testutil.Must(signer.Generate())(t).DID(), testutil.Must(signer.Generate())(t).DID()
+	key, nextKey, wrongKey := testutil.RandomBytes(32), testutil.RandomBytes(32), testutil.RandomBytes(32)
+	keyed := testutil.Must(types.NewKeyedContextIDCodec(key))(t)
+	codec := types.NewMultiContextIDCodec(keyed, types.DefaultContextIDCodec)
+
+	// the context ID is published through the advertisement chain
+	pk, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	adverts := publisher.New(ds, pk)
+	store := &mockProviderStore{results: map[string][]model.ProviderResult{}}
+	pi := providerindex.NewProviderIndex(store, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil,
+		providerindex.WithAdvertisementPublisher(adverts),
+		providerindex.WithContextIDCodec(codec))
+	contextID := types.ContextID{Space: &space, Hash: hash}
+	keyedResult := testutil.RandomProviderResult()
+	keyedResult.ContextID = testutil.Must(codec.Encode(contextID))(t)
+	require.NoError(t, pi.Publish(ctx, []multihash.Multihash{hash}, keyedResult))
+
+	head := testutil.Must(adverts.Head(ctx))(t)
+	data := testutil.Must(ds.Get(ctx, datastore.NewKey(head.String())))(t)
+	adv := testutil.Must(schema.BytesToAdvertisement(head.(cidlink.Link).Cid, data))(t)
+	require.Equal(t, []byte(keyedResult.ContextID), adv.ContextID)
+
+	t.Run("observers of the advertisement can't recompute the space binding", func(t *testing.T) {
+		require.False(t, bytes.Contains(data, space.Bytes()))
+		for _, code := range []uint64{multihash.SHA2_256, multihash.SHA2_512, multihash.SHA3_256, multihash.BLAKE2B_MIN + 31} {
+			plain := testutil.Must(types.NewMultihashContextIDCodec(code).Encode(contextID))(t)
+			require.False(t, bytes.Contains(data, plain))
+		}
+		guessed := testutil.Must(types.NewKeyedContextIDCodec(wrongKey))(t)
+		require.False(t, testutil.Must(guessed.Match(contextID, adv.ContextID))(t))
+	})
+
+	t.Run("space filtered queries match keyed and plainly derived records", func(t *testing.T) {
+		plainResult, otherResult := testutil.RandomProviderResult(), testutil.RandomProviderResult()
+		plainResult.ContextID = testutil.Must(types.DefaultContextIDCodec.Encode(contextID))(t)
+		otherResult.ContextID = testutil.Must(codec.Encode(types.ContextID{Space: &otherSpace, Hash: hash}))(t)
+		store.results[string(hash)] = append(store.results[string(hash)], plainResult, otherResult)
+		results := testutil.Must(pi.Find(ctx, providerindex.QueryKey{Hash: hash, Spaces: []did.DID{space}}))(t)
+		require.Len(t, results, 2)
+		require.True(t, providerresults.Equals(keyedResult, results[0]))
+		require.Equal(t, plainResult, results[1])
+	})
+
+	t.Run("records keyed before a rotation match until the previous key is dropped", func(t *testing.T) {
+		rotated := testutil.Must(types.NewKeyedContextIDCodec(nextKey, key))(t)
+		require.True(t, testutil.Must(rotated.Match(contextID, keyedResult.ContextID))(t))
+		reencoded := testutil.Must(rotated.Encode(contextID))(t)
+		require.NotEqual(t, keyedResult.ContextID, reencoded)
+		require.True(t, testutil.Must(rotated.Match(contextID, reencoded))(t))
+
+		dropped := testutil.Must(types.NewKeyedContextIDCodec(nextKey))(t)
+		require.False(t, testutil.Must(dropped.Match(contextID, keyedResult.ContextID))(t))
+	})
+
+	_, err := types.NewKeyedContextIDCodec(testutil.RandomBytes(16))
+	require.Error(t, err)
+}
+
+func TestProviderIndex__UnscopedLocations(t *testing.T) {
+	ctx := context.Background()
+	hash := testutil.RandomMultihash()
+	space, otherSpace := testutil.Must(signer.Generate())(t).DID(), testutil.Must(signer.Generate())(t).DID()
+	withContext := func(space *did.DID, md interface{ MarshalBinary() ([]byte, error) }) model.ProviderResult {
+		result := testutil.RandomProviderResult()
+		result.ContextID = testutil.Must(types.DefaultContextIDCodec.Encode(types.ContextID{Space: space, Hash: hash}))(t)
+		result.Metadata = testutil.Must(md.MarshalBinary())(t)
+		return result
+	}
+	location := &metadata.LocationCommitmentMetadata{Claim: testutil.RandomCID().(cidlink.Link).Cid}
+	index := &metadata.IndexClaimMetadata{Index: testutil.RandomCID().(cidlink.Link).Cid, Claim: testutil.RandomCID().(cidlink.Link).Cid}
+	scopedLocation, unscopedLocation, unscopedIndex, otherLocation := withContext(&space, location), withContext(nil, location), withContext(nil, index), withContext(&otherSpace, location)
+	store := &mockProviderStore{results: map[string][]model.ProviderResult{string(hash): {scopedLocation, unscopedLocation, unscopedIndex, otherLocation}}}
+	pi := providerindex.NewProviderIndex(store, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+
+	fr := testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: hash, Spaces: []did.DID{space}}))(t)
+	require.Equal(t, []model.ProviderResult{scopedLocation}, fr.Results)
+	require.Zero(t, fr.Unscoped)
+
+	// only locations are admitted unscoped, and never those of other spaces
+	fr = testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: hash, Spaces: []did.DID{space}, UnscopedLocations: true}))(t)
+	require.Equal(t, []model.ProviderResult{scopedLocation, unscopedLocation}, fr.Results)
+	require.Equal(t, 1, fr.Unscoped)
+
+	// with no match for the space every record is returned, as before
+	store.results[string(hash)] = []model.ProviderResult{unscopedLocation, otherLocation}
+	fr = testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: hash, Spaces: []did.DID{space}, UnscopedLocations: true}))(t)
+	require.Equal(t, []model.ProviderResult{unscopedLocation, otherLocation}, fr.Results)
+	require.Zero(t, fr.Unscoped)
+}
+
+type mockRecordStore struct {
+	mockProviderStore
+	records map[string][]providerresults.Record
+}
+
+func (m *mockRecordStore) GetRecords(ctx context.Context, hash multihash.Multihash) ([]providerresults.Record, error) {
+	records, ok := m.records[string(hash)]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return records, nil
+}
+
+func (m *mockRecordStore) SetRecords(ctx context.Context, hash multihash.Multihash, records []providerresults.Record, expires bool) error {
+	m.records[string(hash)] = records
+	return nil
+}
+
+// mockEntryStore keeps whether entries are complete, like the redis store
+type mockEntryStore struct {
+	entries map[string]providerresults.Entry
+}
+
+func (m *mockEntryStore) Get(ctx context.Context, hash multihash.Multihash) ([]model.ProviderResult, error) {
+	entry, err := m.GetEntry(ctx, hash)
+	return providerresults.Results(entry.Records), err
+}
+
+func (m *mockEntryStore) Set(ctx context.Context, hash multihash.Multihash, results []model.ProviderResult, expires bool) error {
+	entry := m.entries[string(hash)]
+	entry.Records = nil
+	for _, result := range results {
+		entry.Records = append(entry.Records, providerresults.Record{ProviderResult: result})
+	}
+	m.entries[string(hash)] = entry
+	return nil
+}
+
+func (m *mockEntryStore) SetExpirable(ctx context.Context, hash multihash.Multihash, expires bool) error {
+	return nil
+}
+
+func (m *mockEntryStore) GetEntry(ctx context.Context, hash multihash.Multihash) (providerresults.Entry, error) {
+	entry, ok := m.entries[string(hash)]
+	if !ok {
+		return providerresults.Entry{}, types.ErrKeyNotFound
+	}
+	return entry, nil
+}
+
+func (m *mockEntryStore) SetEntry(ctx context.Context, hash multihash.Multihash, entry providerresults.Entry, expires bool) error {
+	m.entries[string(hash)] = entry
+	return nil
+}
+
+type mockProviderStore struct {
+	results map[string][]model.ProviderResult
+}
+
+func (m *mockProviderStore) Get(ctx context.Context, hash multihash.Multihash) ([]model.ProviderResult, error) {
+	results, ok := m.results[string(hash)]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return results, nil
+}
+
+func (m *mockProviderStore) Set(ctx context.Context, hash multihash.Multihash, results []model.ProviderResult, expires bool) error {
+	if results == nil {
+		results = []model.ProviderResult{}
+	}
+	m.results[string(hash)] = results
+	return nil
+}
+
+func (m *mockProviderStore) SetExpirable(ctx context.Context, hash multihash.Multihash, expires bool) error {
+	return nil
+}
+
+type mockFinder struct {
+	results []model.ProviderResult
+	calls   int
+}
+
+func (m *mockFinder) Find(ctx context.Context, hash multihash.Multihash) (*model.FindResponse, error) {
+	m.calls++
+	if len(m.results) == 0 {
+		return &model.FindResponse{}, nil
+	}
+	return &model.FindResponse{
+		MultihashResults: []model.MultihashResult{{Multihash: hash, ProviderResults: m.results}},
+	}, nil
+}
+
+type mockLegacySystems struct {
+	results []model.ProviderResult
+	calls   int
+}
+
+func (m *mockLegacySystems) Find(ctx context.Context, hash multihash.Multihash) ([]model.ProviderResult, error) {
+	m.calls++
+	return m.results, nil
+}
+
+type mockAnnouncer struct {
+	announced []ipld.Link
+}
+
+func (m *mockAnnouncer) Announce(ctx context.Context, link ipld.Link, opts ...publisher.AnnounceOption) error {
+	m.announced = append(m.announced, link)
+	return nil
+}
+
+func TestProviderIndex__PublishAdvertisement(t *testing.T) {
+	ctx := context.Background()
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	adverts := publisher.New(ds, key)
+	announcer := &mockAnnouncer{}
+	client := &memRedis{data: map[string]string{}}
+	pi := providerindex.NewProviderIndex(redis.NewProviderStore(client), &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil,
+		providerindex.WithAdvertisementPublisher(adverts),
+		providerindex.WithAdvertisementAnnouncer(announcer))
+
+	claimMd := metadata.MetadataContext.New(&metadata.LocationCommitmentMetadata{Claim: testutil.RandomCID().(cidlink.Link).Cid})
+	md := testutil.Must(claimMd.MarshalBinary())(t)
+	provider := &peer.AddrInfo{ID: testutil.RandomPeer(), Addrs: []multiaddr.Multiaddr{testutil.RandomMultiaddr()}}
+	contextID := testutil.RandomBytes(10)
+	hashes := testutil.RandomMultihashes(3)
+	require.NoError(t, pi.Publish(ctx, hashes, model.ProviderResult{ContextID: contextID, Metadata: md, Provider: provider}))
+
+	summary := testutil.Must(adverts.ChainSummary(ctx))(t)
+	require.Equal(t, uint64(1), summary.Adverts)
+	require.Equal(t, int64(3), summary.Entries)
+	require.Equal(t, []ipld.Link{summary.Head}, announcer.announced)
+	// the cached records expire once the advertisement is announced
+	for _, hash := range hashes {
+		require.Positive(t, client.ttl(string(hash)))
+	}
+
+	data := testutil.Must(ds.Get(ctx, datastore.NewKey(summary.Head.String())))(t)
+	adv := testutil.Must(schema.BytesToAdvertisement(summary.Head.(cidlink.Link).Cid, data))(t)
+	require.Equal(t, provider.ID.String(), adv.Provider)
+	require.Equal(t, []string{provider.Addrs[0].String()}, adv.Addresses)
+	require.Equal(t, contextID, adv.ContextID)
+	require.Equal(t, md, adv.Metadata)
+	var advertised []multihash.Multihash
+	for hash, err := range publisher.Entries(ctx, ds, adv.Entries) {
+		require.NoError(t, err)
+		advertised = append(advertised, hash)
+	}
+	require.Equal(t, hashes, advertised)
+}
+
+func TestProviderIndex__IndexEntries(t *testing.T) {
+	ctx := context.Background()
+	shards := testutil.RandomMultihashes(2)
+	sliceHashes := testutil.RandomMultihashes(5)
+	index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 2)
+	for i, slice := range sliceHashes[:3] {
+		index.SetSlice(shards[0], slice, blobindex.Position{Offset: uint64(i * 10), Length: 10})
+	}
+	for i, slice := range sliceHashes[2:] {
+		// the first of these is in both shards
+		index.SetSlice(shards[1], slice, blobindex.Position{Offset: uint64(i * 10), Length: 10})
+	}
+	entries := slices.Concat(sliceHashes, shards)
+
+	claimMd := metadata.MetadataContext.New(&metadata.IndexClaimMetadata{Index: testutil.RandomCID().(cidlink.Link).Cid, Claim: testutil.RandomCID().(cidlink.Link).Cid})
+	md := testutil.Must(claimMd.MarshalBinary())(t)
+	result := model.ProviderResult{
+		ContextID: testutil.RandomBytes(10),
+		Metadata:  md,
+		Provider:  &peer.AddrInfo{ID: testutil.RandomPeer(), Addrs: []multiaddr.Multiaddr{testutil.RandomMultiaddr()}},
+	}
+	newProviderIndex := func(t *testing.T) (*providerindex.ProviderIndex, *publisher.Publisher, datastore.Batching) {
+		key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		adverts := publisher.New(ds, key, publisher.WithEntriesChunkSize(2))
+		pi := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil,
+			providerindex.WithAdvertisementPublisher(adverts))
+		return pi, adverts, ds
+	}
+
+	t.Run("publishes entries matching the index", func(t *testing.T) {
+		pi, adverts, _ := newProviderIndex(t)
+		require.NoError(t, pi.Publish(ctx, entries, result, providerindex.ValidateEntries(index, 0)))
+		require.Equal(t, int64(7), testutil.Must(adverts.ChainSummary(ctx))(t).Entries)
+	})
+
+	t.Run("refuses entries not in the index", func(t *testing.T) {
+		pi, adverts, _ := newProviderIndex(t)
+		extra := testutil.RandomMultihash()
+		err := pi.Publish(ctx, append(slices.Clone(entries), extra), result, providerindex.ValidateEntries(index, 0))
+		var mismatch providerindex.EntriesMismatchError
+		require.ErrorAs(t, err, &mismatch)
+		require.Equal(t, []multihash.Multihash{extra}, mismatch.Extra)
+		require.Equal(t, 1, mismatch.ExtraCount)
+		require.Zero(t, mismatch.MissingCount)
+		require.Nil(t, testutil.Must(adverts.Head(ctx))(t))
+	})
+
+	t.Run("refuses entries missing from the index", func(t *testing.T) {
+		pi, _, _ := newProviderIndex(t)
+		err := pi.Publish(ctx, entries[1:], result, providerindex.ValidateEntries(index, 0))
+		var mismatch providerindex.EntriesMismatchError
+		require.ErrorAs(t, err, &mismatch)
+		require.Equal(t, []multihash.Multihash{entries[0]}, mismatch.Missing)
+		require.Equal(t, 1, mismatch.MissingCount)
+		require.Zero(t, mismatch.ExtraCount)
+	})
+
+	t.Run("publishes mismatched entries within the tolerance", func(t *testing.T) {
+		pi, adverts, _ := newProviderIndex(t)
+		require.NoError(t, pi.Publish(ctx, append(slices.Clone(entries[1:]), testutil.RandomMultihash()), result, providerindex.ValidateEntries(index, 2)))
+		require.Equal(t, int64(7), testutil.Must(adverts.ChainSummary(ctx))(t).Entries)
+	})
+
+	t.Run("derives the entries from the index", func(t *testing.T) {
+		pi, adverts, ds := newProviderIndex(t)
+		require.NoError(t, pi.Publish(ctx, nil, result, providerindex.DeriveEntriesFromIndex(index)))
+
+		head := testutil.Must(adverts.Head(ctx))(t)
+		data := testutil.Must(ds.Get(ctx, datastore.NewKey(head.String())))(t)
+		adv := testutil.Must(schema.BytesToAdvertisement(head.(cidlink.Link).Cid, data))(t)
+		var advertised []multihash.Multihash
+		for hash, err := range publisher.Entries(ctx, ds, adv.Entries) {
+			require.NoError(t, err)
+			advertised = append(advertised, hash)
+		}
+		require.ElementsMatch(t, entries, advertised)
+
+		require.ErrorIs(t, pi.Publish(ctx, entries, result, providerindex.DeriveEntriesFromIndex(index)), providerindex.ErrEntriesGiven)
+	})
+}
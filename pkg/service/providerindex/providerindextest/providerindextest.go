@@ -0,0 +1,306 @@
+// Package providerindextest is a conformance suite for service.ProviderIndex
+// implementations.
+//
+// An implementation passes the suite when it:
+//   - reads records from its cache before the origin, and caches what the
+//     origin finds, including that it finds nothing for a hash
+//   - returns the records with metadata for any of the claim types asked for,
+//     or every record when no claim types are given
+//   - returns only the records of the spaces asked for, when any match
+//   - returns no records and no error for a hash nobody has records for,
+//     reporting that no records were known before filtering
+//   - finds records as soon as they are published, without the origin, and
+//     finds a record published twice once
+//   - rejects records with metadata that can't be read back
+//   - fails with types.ErrOriginUnavailable when the origin fails, and asks
+//     the origin again once it recovers
+//   - returns the context error when the context is cancelled
+//   - answers the full IndexingService.Query walk, both from the origin and
+//     from what was published to it
+//
+// Implementations run the suite from their tests, with the origin the suite
+// gives them standing in for IPNI:
+//
+//	providerindextest.RunConformance(t, func(origin ipnifind.Finder) service.ProviderIndex {
+//		return providerindex.NewProviderIndex(store, origin, nil, nil, cidlink.DefaultLinkSystem(), nil)
+//	})
+package providerindextest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	ipnifind "github.com/ipni/go-libipni/find/client"
+	"github.com/ipni/go-libipni/find/model"
+	ipnimd "github.com/ipni/go-libipni/metadata"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/providerresults"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/blobindexlookup"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/internal/conformance"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns a new provider index, with an empty cache, that finds what
+// isn't cached with the origin
+type Factory func(origin ipnifind.Finder) service.ProviderIndex
+
+var errOrigin = errors.New("origin failed")
+
+// origin is an IPNI finder the suite fills and breaks, counting the finds
+// asked of it
+type origin struct {
+	lk      sync.Mutex
+	results map[string][]model.ProviderResult
+	err     error
+	finds   int
+}
+
+func newOrigin() *origin {
+	return &origin{results: map[string][]model.ProviderResult{}}
+}
+
+func (o *origin) Find(ctx context.Context, hash mh.Multihash) (*model.FindResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	o.finds++
+	if o.err != nil {
+		return nil, o.err
+	}
+	results, ok := o.results[string(hash)]
+	if !ok {
+		return &model.FindResponse{}, nil
+	}
+	return &model.FindResponse{MultihashResults: []model.MultihashResult{{Multihash: hash, ProviderResults: results}}}, nil
+}
+
+func (o *origin) add(hash mh.Multihash, results ...model.ProviderResult) {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	o.results[string(hash)] = append(o.results[string(hash)], results...)
+}
+
+func (o *origin) fail(err error) {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	o.err = err
+}
+
+func (o *origin) findCount() int {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	return o.finds
+}
+
+func newResult(t *testing.T, contextID []byte, protocol ipnimd.Protocol) model.ProviderResult {
+	md := metadata.MetadataContext.New(protocol)
+	return model.ProviderResult{
+		ContextID: contextID,
+		Metadata:  testutil.Must(md.MarshalBinary())(t),
+		Provider:  &peer.AddrInfo{ID: testutil.RandomPeer(), Addrs: []multiaddr.Multiaddr{testutil.RandomMultiaddr()}},
+	}
+}
+
+func locationResult(t *testing.T, contextID []byte) model.ProviderResult {
+	return newResult(t, contextID, &metadata.LocationCommitmentMetadata{Claim: testutil.RandomCID().(cidlink.Link).Cid})
+}
+
+func indexResult(t *testing.T, contextID []byte) model.ProviderResult {
+	return newResult(t, contextID, &metadata.IndexClaimMetadata{Index: testutil.RandomCID().(cidlink.Link).Cid, Claim: testutil.RandomCID().(cidlink.Link).Cid})
+}
+
+func spaceContextID(t *testing.T, space did.DID, hash mh.Multihash) types.EncodedContextID {
+	return testutil.Must(types.DefaultContextIDCodec.Encode(types.ContextID{Space: &space, Hash: hash}))(t)
+}
+
+// requireResults requires the results to be the expected ones, in any order
+func requireResults(t *testing.T, expected, actual []model.ProviderResult) {
+	require.Len(t, actual, len(expected))
+	for _, e := range expected {
+		require.True(t, slices.ContainsFunc(actual, func(a model.ProviderResult) bool { return providerresults.Equals(a, e) }), "missing result with context ID %x", e.ContextID)
+	}
+}
+
+// RunConformance runs the conformance suite against the provider indexes
+// returned by newIndex
+func RunConformance(t *testing.T, newIndex Factory) {
+	ctx := context.Background()
+	find := func(t *testing.T, pi service.ProviderIndex, qk providerindex.QueryKey) providerindex.FindResult {
+		return testutil.Must(pi.FindDetailed(ctx, qk))(t)
+	}
+
+	t.Run("reads the cache before the origin", func(t *testing.T) {
+		o := newOrigin()
+		pi := newIndex(o)
+		hash := testutil.RandomMultihash()
+		record := locationResult(t, hash)
+		o.add(hash, record)
+		for range 2 {
+			requireResults(t, []model.ProviderResult{record}, find(t, pi, providerindex.QueryKey{Hash: hash}).Results)
+		}
+		require.Equal(t, 1, o.findCount())
+	})
+
+	t.Run("filters by claim type", func(t *testing.T) {
+		o := newOrigin()
+		pi := newIndex(o)
+		hash := testutil.RandomMultihash()
+		location, index := locationResult(t, hash), indexResult(t, hash)
+		o.add(hash, location, index)
+		testCases := []struct {
+			name     string
+			claims   []multicodec.Code
+			expected []model.ProviderResult
+		}{
+			{"every claim type", nil, []model.ProviderResult{location, index}},
+			{"location commitments", []multicodec.Code{metadata.LocationCommitmentID}, []model.ProviderResult{location}},
+			{"index claims", []multicodec.Code{metadata.IndexClaimID}, []model.ProviderResult{index}},
+			{"either", []multicodec.Code{metadata.LocationCommitmentID, metadata.IndexClaimID}, []model.ProviderResult{location, index}},
+			{"neither", []multicodec.Code{metadata.EqualsClaimID}, nil},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				fr := find(t, pi, providerindex.QueryKey{Hash: hash, TargetClaims: tc.claims})
+				requireResults(t, tc.expected, fr.Results)
+				require.Equal(t, 2, fr.Unfiltered)
+			})
+		}
+	})
+
+	t.Run("filters by space", func(t *testing.T) {
+		o := newOrigin()
+		pi := newIndex(o)
+		hash := testutil.RandomMultihash()
+		first, second := testutil.Alice.DID(), testutil.Bob.DID()
+		firstRecord, secondRecord := locationResult(t, spaceContextID(t, first, hash)), locationResult(t, spaceContextID(t, second, hash))
+		o.add(hash, firstRecord, secondRecord)
+		testCases := []struct {
+			name     string
+			spaces   []did.DID
+			expected []model.ProviderResult
+		}{
+			{"one space", []did.DID{first}, []model.ProviderResult{firstRecord}},
+			{"the other space", []did.DID{second}, []model.ProviderResult{secondRecord}},
+			{"both spaces", []did.DID{first, second}, []model.ProviderResult{firstRecord, secondRecord}},
+			{"no spaces", nil, []model.ProviderResult{firstRecord, secondRecord}},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				qk := providerindex.QueryKey{Hash: hash, Spaces: tc.spaces, TargetClaims: []multicodec.Code{metadata.LocationCommitmentID}}
+				requireResults(t, tc.expected, find(t, pi, qk).Results)
+			})
+		}
+	})
+
+	t.Run("finds nothing for unknown hashes", func(t *testing.T) {
+		o := newOrigin()
+		pi := newIndex(o)
+		hash := testutil.RandomMultihash()
+		for range 2 {
+			fr := find(t, pi, providerindex.QueryKey{Hash: hash})
+			require.Empty(t, fr.Results)
+			require.Zero(t, fr.Unfiltered)
+		}
+		// that nothing was found is cached too
+		require.Equal(t, 1, o.findCount())
+	})
+
+	t.Run("finds published records", func(t *testing.T) {
+		o := newOrigin()
+		pi := newIndex(o)
+		hashes := testutil.RandomMultihashes(2)
+		record := locationResult(t, hashes[0])
+		require.NoError(t, pi.Publish(ctx, hashes, record))
+		for _, hash := range hashes {
+			requireResults(t, []model.ProviderResult{record}, find(t, pi, providerindex.QueryKey{Hash: hash}).Results)
+		}
+
+		t.Run("along with those of the origin", func(t *testing.T) {
+			hash := testutil.RandomMultihash()
+			found, published := indexResult(t, hash), locationResult(t, hash)
+			o.add(hash, found)
+			require.NoError(t, pi.Publish(ctx, []mh.Multihash{hash}, published))
+			requireResults(t, []model.ProviderResult{found, published}, find(t, pi, providerindex.QueryKey{Hash: hash}).Results)
+		})
+	})
+
+	t.Run("publishing is idempotent", func(t *testing.T) {
+		pi := newIndex(newOrigin())
+		hash := testutil.RandomMultihash()
+		record := locationResult(t, hash)
+		for range 2 {
+			require.NoError(t, pi.Publish(ctx, []mh.Multihash{hash}, record))
+		}
+		requireResults(t, []model.ProviderResult{record}, find(t, pi, providerindex.QueryKey{Hash: hash}).Results)
+	})
+
+	t.Run("rejects unreadable metadata", func(t *testing.T) {
+		pi := newIndex(newOrigin())
+		hash := testutil.RandomMultihash()
+		record := locationResult(t, hash)
+		record.Metadata = []byte("not metadata")
+		require.Error(t, pi.Publish(ctx, []mh.Multihash{hash}, record))
+		require.Empty(t, find(t, pi, providerindex.QueryKey{Hash: hash}).Results)
+	})
+
+	t.Run("classifies origin failures", func(t *testing.T) {
+		o := newOrigin()
+		pi := newIndex(o)
+		hash := testutil.RandomMultihash()
+		record := locationResult(t, hash)
+		o.add(hash, record)
+		o.fail(errOrigin)
+		_, err := pi.FindDetailed(ctx, providerindex.QueryKey{Hash: hash})
+		require.ErrorIs(t, err, types.ErrOriginUnavailable)
+		require.NotErrorIs(t, err, types.ErrOriginNotFound)
+		// failures aren't cached
+		o.fail(nil)
+		requireResults(t, []model.ProviderResult{record}, find(t, pi, providerindex.QueryKey{Hash: hash}).Results)
+	})
+
+	t.Run("stops when the context is cancelled", func(t *testing.T) {
+		o := newOrigin()
+		pi := newIndex(o)
+		hash := testutil.RandomMultihash()
+		o.add(hash, locationResult(t, hash))
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := pi.FindDetailed(cctx, providerindex.QueryKey{Hash: hash})
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("answers the query walk", func(t *testing.T) {
+		newService := func(pi service.ProviderIndex) *service.IndexingService {
+			return testutil.Must(service.NewIndexingService(blobindexlookup.NewBlobIndexLookup(http.DefaultClient), claimlookup.NewClaimLookup(http.DefaultClient), pi))(t)
+		}
+
+		t.Run("from the origin", func(t *testing.T) {
+			s := conformance.NewScenario(t)
+			s.Query(t, newService(newIndex(s.Finder())))
+		})
+
+		t.Run("from published records", func(t *testing.T) {
+			s := conformance.NewScenario(t)
+			pi := newIndex(newOrigin())
+			s.Publish(t, pi)
+			s.Query(t, newService(pi))
+		})
+	})
+}
@@ -0,0 +1,222 @@
+package providerindex
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/multiformats/go-multicodec"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/providerresults"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+const (
+	// DefaultRecentResultsTTL is how long the results of an IPNI lookup are
+	// kept in memory when WithRecentResults is given no TTL
+	DefaultRecentResultsTTL = 10 * time.Second
+	// MaxRecentResultsTTL is the longest the results of an IPNI lookup are kept
+	// in memory. Longer TTLs are clamped to it
+	MaxRecentResultsTTL = 30 * time.Second
+)
+
+// SourceRecent is for records read from the results of a recent IPNI lookup by
+// this process, or one in progress when they were asked for
+const SourceRecent RecordSource = "recent"
+
+// WithRecentResults keeps the results of the last size IPNI lookups in memory
+// for the TTL, and answers lookups of the same hash from them before reading
+// the provider store. Lookups of a hash already being looked up on IPNI wait
+// for its results rather than looking it up again. Only results this process
+// just wrote to the provider store are kept, and they are dropped when records
+// of the hash are written through the provider index. Lookups under a context
+// made with types.WithFresh skip them
+func WithRecentResults(size int, ttl time.Duration) Option {
+	return func(pi *ProviderIndex) {
+		if size <= 0 {
+			pi.recent = nil
+			return
+		}
+		if ttl <= 0 {
+			ttl = DefaultRecentResultsTTL
+		}
+		pi.recent = newRecentResults(size, min(ttl, MaxRecentResultsTTL))
+	}
+}
+
+type recentResult struct {
+	key     string
+	entry   providerresults.Entry
+	expires time.Time
+}
+
+// recentLookup is a read of the records of a hash in progress, whose outcome is
+// set once done is closed
+type recentLookup struct {
+	done   chan struct{}
+	entry  providerresults.Entry
+	source RecordSource
+	err    error
+}
+
+// recentResults holds the results of recent IPNI lookups, evicting the oldest
+// beyond its size, along with the reads in progress
+type recentResults struct {
+	size int
+	ttl  time.Duration
+	// now is the clock of the provider index
+	now func() time.Time
+
+	lk       sync.Mutex
+	results  map[string]*list.Element
+	order    *list.List
+	inFlight map[string]*recentLookup
+	// generation is bumped by every invalidation, so that lookups that started
+	// before one don't keep their results
+	generation uint64
+}
+
+func newRecentResults(size int, ttl time.Duration) *recentResults {
+	return &recentResults{
+		size:     size,
+		ttl:      ttl,
+		results:  map[string]*list.Element{},
+		order:    list.New(),
+		inFlight: map[string]*recentLookup{},
+	}
+}
+
+// get returns the recent results for the key, if they haven't expired
+func (r *recentResults) get(key string) (providerresults.Entry, bool) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	el, ok := r.results[key]
+	if !ok {
+		return providerresults.Entry{}, false
+	}
+	result := el.Value.(*recentResult)
+	if !r.now().Before(result.expires) {
+		r.order.Remove(el)
+		delete(r.results, key)
+		return providerresults.Entry{}, false
+	}
+	// callers are free to change the records they are given
+	return result.entry.Clone(), true
+}
+
+// join returns the read of the key in progress, and whether the caller is to
+// run it, along with the generation it started in. The caller running it must
+// call finish
+func (r *recentResults) join(key string) (*recentLookup, bool, uint64) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if lookup, ok := r.inFlight[key]; ok {
+		return lookup, false, r.generation
+	}
+	lookup := &recentLookup{done: make(chan struct{})}
+	r.inFlight[key] = lookup
+	return lookup, true, r.generation
+}
+
+// finish sets the outcome of the read, and keeps its results if they were just
+// written to the provider store and nothing was invalidated since it started
+func (r *recentResults) finish(key string, lookup *recentLookup, generation uint64) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	delete(r.inFlight, key)
+	close(lookup.done)
+	if lookup.err != nil || !origin(lookup.source) || (!lookup.entry.Complete && !lookup.entry.Truncated) || generation != r.generation {
+		return
+	}
+	if el, ok := r.results[key]; ok {
+		r.order.Remove(el)
+	}
+	r.results[key] = r.order.PushBack(&recentResult{key: key, entry: lookup.entry, expires: r.now().Add(r.ttl)})
+	for r.order.Len() > r.size {
+		oldest := r.order.Front()
+		r.order.Remove(oldest)
+		delete(r.results, oldest.Value.(*recentResult).key)
+	}
+}
+
+// invalidate drops the recent results for the key, or all of them if key is
+// empty
+func (r *recentResults) invalidate(key string) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.generation++
+	if key == "" {
+		r.results = map[string]*list.Element{}
+		r.order.Init()
+		return
+	}
+	if el, ok := r.results[key]; ok {
+		r.order.Remove(el)
+		delete(r.results, key)
+	}
+}
+
+// remove drops the recent results for the key, returning them if they hadn't
+// expired
+func (r *recentResults) remove(key string) (providerresults.Entry, bool) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.generation++
+	el, ok := r.results[key]
+	if !ok {
+		return providerresults.Entry{}, false
+	}
+	r.order.Remove(el)
+	delete(r.results, key)
+	result := el.Value.(*recentResult)
+	return result.entry, r.now().Before(result.expires)
+}
+
+// origin returns true for records read from IPNI or the legacy systems, rather
+// than a cache
+func origin(source RecordSource) bool {
+	return source == SourceIPNI || source == SourceLegacy
+}
+
+// readRecentRecords reads the records for a hash from the recent results, or
+// waits on a read of it in progress, before reading them with read
+func (pi *ProviderIndex) readRecentRecords(ctx context.Context, hash mh.Multihash, codecs []multicodec.Code, read func() (providerresults.Entry, RecordSource, error)) (providerresults.Entry, RecordSource, error) {
+	key := string(hash)
+	if entry, ok := pi.recent.get(key); ok && covers(entry, codecs) {
+		types.CacheRead(ctx, pi.metrics, types.RecentProvidersCache, true)
+		return entry, SourceRecent, nil
+	}
+	types.CacheRead(ctx, pi.metrics, types.RecentProvidersCache, false)
+	// lookups under a cache only context don't wait on IPNI
+	if types.IsCacheOnly(ctx) {
+		return read()
+	}
+	lookup, leader, generation := pi.recent.join(key)
+	if leader {
+		entry, source, err := read()
+		// waiters are given their own copies of the records
+		lookup.entry, lookup.source, lookup.err = entry.Clone(), source, err
+		pi.recent.finish(key, lookup, generation)
+		return entry, source, err
+	}
+	select {
+	case <-lookup.done:
+	case <-ctx.Done():
+		return providerresults.Entry{}, "", ctx.Err()
+	}
+	// the read in progress may have failed under its own context, or read less
+	// than this lookup needs, in which case the records are read again
+	if lookup.err != nil || !covers(lookup.entry, codecs) {
+		return read()
+	}
+	return lookup.entry.Clone(), SourceRecent, nil
+}
+
+// invalidateRecent drops the recent results for the hash, after records of it
+// were written, or all of them if hash is nil
+func (pi *ProviderIndex) invalidateRecent(hash mh.Multihash) {
+	if pi.recent != nil {
+		pi.recent.invalidate(string(hash))
+	}
+}
@@ -0,0 +1,221 @@
+package providerindex_test
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// syncProviderStore is a provider store safe for concurrent use, counting its
+// reads, whose entries expire after the TTL if set
+type syncProviderStore struct {
+	lk      sync.Mutex
+	results map[string][]model.ProviderResult
+	written map[string]time.Time
+	ttl     time.Duration
+	reads   atomic.Int64
+}
+
+func newSyncProviderStore(ttl time.Duration) *syncProviderStore {
+	return &syncProviderStore{results: map[string][]model.ProviderResult{}, written: map[string]time.Time{}, ttl: ttl}
+}
+
+func (s *syncProviderStore) Get(ctx context.Context, hash multihash.Multihash) ([]model.ProviderResult, error) {
+	s.reads.Add(1)
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	results, ok := s.results[string(hash)]
+	if !ok || (s.ttl > 0 && time.Since(s.written[string(hash)]) > s.ttl) {
+		return nil, types.ErrKeyNotFound
+	}
+	return results, nil
+}
+
+func (s *syncProviderStore) Set(ctx context.Context, hash multihash.Multihash, results []model.ProviderResult, expires bool) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if results == nil {
+		results = []model.ProviderResult{}
+	}
+	s.results[string(hash)] = results
+	s.written[string(hash)] = time.Now()
+	return nil
+}
+
+func (s *syncProviderStore) SetExpirable(ctx context.Context, hash multihash.Multihash, expires bool) error {
+	return nil
+}
+
+// gatedFinder is a finder safe for concurrent use, counting its finds, which
+// wait for the gate to be closed if set
+type gatedFinder struct {
+	results []model.ProviderResult
+	gate    chan struct{}
+	delay   time.Duration
+	calls   atomic.Int64
+}
+
+func (f *gatedFinder) Find(ctx context.Context, hash multihash.Multihash) (*model.FindResponse, error) {
+	f.calls.Add(1)
+	if f.gate != nil {
+		<-f.gate
+	}
+	time.Sleep(f.delay)
+	return &model.FindResponse{MultihashResults: []model.MultihashResult{{Multihash: hash, ProviderResults: f.results}}}, nil
+}
+
+func TestProviderIndex__RecentResults(t *testing.T) {
+	ctx := context.Background()
+	result := testutil.RandomProviderResult()
+	const ttl = 5 * time.Second
+	newIndex := func(store *syncProviderStore, finder *gatedFinder, now *time.Time, opts ...providerindex.Option) *providerindex.ProviderIndex {
+		opts = append(opts, providerindex.WithClock(func() time.Time { return *now }), providerindex.WithRecentResults(2, ttl))
+		return providerindex.NewProviderIndex(store, finder, nil, nil, cidlink.DefaultLinkSystem(), nil, opts...)
+	}
+	find := func(t *testing.T, ctx context.Context, pi *providerindex.ProviderIndex, hash multihash.Multihash) providerindex.FindResult {
+		return testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: hash}))(t)
+	}
+
+	t.Run("IPNI lookups are answered from memory until they expire", func(t *testing.T) {
+		now := time.Now()
+		store, finder := newSyncProviderStore(0), &gatedFinder{results: []model.ProviderResult{result}}
+		pi := newIndex(store, finder, &now)
+		hash := testutil.RandomMultihash()
+		require.Equal(t, providerindex.SourceIPNI, find(t, ctx, pi, hash).Source)
+
+		reads := store.reads.Load()
+		fr := find(t, ctx, pi, hash)
+		require.Equal(t, providerindex.SourceRecent, fr.Source)
+		require.Equal(t, []model.ProviderResult{result}, fr.Results)
+		require.Equal(t, reads, store.reads.Load())
+
+		now = now.Add(ttl)
+		require.Equal(t, providerindex.SourceCache, find(t, ctx, pi, hash).Source)
+		require.Equal(t, reads+1, store.reads.Load())
+		require.EqualValues(t, 1, finder.calls.Load())
+	})
+
+	t.Run("fresh lookups skip them", func(t *testing.T) {
+		now := time.Now()
+		store := newSyncProviderStore(0)
+		pi := newIndex(store, &gatedFinder{results: []model.ProviderResult{result}}, &now)
+		hash := testutil.RandomMultihash()
+		find(t, ctx, pi, hash)
+		reads := store.reads.Load()
+		require.Equal(t, providerindex.SourceCache, find(t, types.WithFresh(ctx), pi, hash).Source)
+		require.Equal(t, reads+1, store.reads.Load())
+	})
+
+	t.Run("writes of the hash drop them", func(t *testing.T) {
+		now := time.Now()
+		pi := newIndex(newSyncProviderStore(0), &gatedFinder{results: []model.ProviderResult{result}}, &now)
+		hash := testutil.RandomMultihash()
+		find(t, ctx, pi, hash)
+		published := testutil.RandomProviderResult()
+		require.NoError(t, pi.Publish(ctx, []multihash.Multihash{hash}, published))
+		fr := find(t, ctx, pi, hash)
+		require.Equal(t, providerindex.SourceCache, fr.Source)
+		require.Len(t, fr.Results, 2)
+	})
+
+	t.Run("the oldest are evicted beyond the size", func(t *testing.T) {
+		now := time.Now()
+		pi := newIndex(newSyncProviderStore(0), &gatedFinder{results: []model.ProviderResult{result}}, &now)
+		hashes := testutil.RandomMultihashes(3)
+		for _, hash := range hashes {
+			find(t, ctx, pi, hash)
+		}
+		require.Equal(t, providerindex.SourceCache, find(t, ctx, pi, hashes[0]).Source)
+		require.Equal(t, providerindex.SourceRecent, find(t, ctx, pi, hashes[2]).Source)
+	})
+
+	t.Run("concurrent lookups of a hash wait on the one in progress", func(t *testing.T) {
+		now := time.Now()
+		finder := &gatedFinder{results: []model.ProviderResult{result}, gate: make(chan struct{})}
+		pi := newIndex(newSyncProviderStore(0), finder, &now)
+		hash := testutil.RandomMultihash()
+		const lookups = 10
+		sources := make(chan providerindex.RecordSource, lookups)
+		var wg sync.WaitGroup
+		for range lookups {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fr, err := pi.FindDetailed(ctx, providerindex.QueryKey{Hash: hash})
+				if err == nil && len(fr.Results) == 1 {
+					sources <- fr.Source
+				}
+			}()
+		}
+		require.Eventually(t, func() bool { return finder.calls.Load() > 0 }, time.Second, time.Millisecond)
+		// give the other lookups time to join the one in progress
+		time.Sleep(50 * time.Millisecond)
+		close(finder.gate)
+		wg.Wait()
+		close(sources)
+		counts := map[providerindex.RecordSource]int{}
+		for source := range sources {
+			counts[source]++
+		}
+		require.EqualValues(t, 1, finder.calls.Load())
+		require.Equal(t, map[providerindex.RecordSource]int{providerindex.SourceIPNI: 1, providerindex.SourceRecent: lookups - 1}, counts)
+	})
+
+	t.Run("TTLs are clamped", func(t *testing.T) {
+		now := time.Now()
+		store := newSyncProviderStore(0)
+		pi := providerindex.NewProviderIndex(store, &gatedFinder{results: []model.ProviderResult{result}}, nil, nil, cidlink.DefaultLinkSystem(), nil,
+			providerindex.WithClock(func() time.Time { return now }),
+			providerindex.WithRecentResults(10, time.Hour))
+		hash := testutil.RandomMultihash()
+		find(t, ctx, pi, hash)
+		now = now.Add(providerindex.MaxRecentResultsTTL)
+		require.Equal(t, providerindex.SourceCache, find(t, ctx, pi, hash).Source)
+	})
+}
+
+// BenchmarkProviderIndex__RecentResults looks up hashes drawn from a zipfian
+// distribution from several goroutines at once, as when a popular DAG is
+// queried by many clients, against a providers cache whose entries expire
+// quickly, reporting the reads of the cache and finds sent to IPNI per lookup
+func BenchmarkProviderIndex__RecentResults(b *testing.B) {
+	hashes := testutil.RandomMultihashes(1000)
+	result := testutil.RandomProviderResult()
+	for _, bench := range []struct {
+		name string
+		opts []providerindex.Option
+	}{
+		{name: "without recent results"},
+		{name: "with recent results", opts: []providerindex.Option{providerindex.WithRecentResults(100, 50*time.Millisecond)}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			store := newSyncProviderStore(100 * time.Millisecond)
+			finder := &gatedFinder{results: []model.ProviderResult{result}, delay: 2 * time.Millisecond}
+			pi := providerindex.NewProviderIndex(store, finder, nil, nil, cidlink.DefaultLinkSystem(), nil, bench.opts...)
+			var seed atomic.Int64
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				zipf := rand.NewZipf(rand.New(rand.NewSource(seed.Add(1))), 1.2, 1, uint64(len(hashes)-1))
+				for pb.Next() {
+					if _, err := pi.FindDetailed(context.Background(), providerindex.QueryKey{Hash: hashes[zipf.Uint64()]}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.ReportMetric(float64(store.reads.Load())/float64(b.N), "store-reads/op")
+			b.ReportMetric(float64(finder.calls.Load())/float64(b.N), "ipni-finds/op")
+		})
+	}
+}
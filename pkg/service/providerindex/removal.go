@@ -0,0 +1,314 @@
+package providerindex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/providerresults"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// DefaultSweepBatchSize is the number of cached hashes checked at a time when
+// removing a provider, between saves of its progress
+const DefaultSweepBatchSize = 1000
+
+// ErrRemovalUnsupported is returned from RemoveProvider when the provider index
+// has no tombstone store, or a provider store that can't be swept
+var ErrRemovalUnsupported = errors.New("provider removal is not supported")
+
+// ClaimCache is the cache of fetched claims, which claims only found through
+// the records of a removed provider are evicted from
+type ClaimCache interface {
+	Delete(ctx context.Context, claim cid.Cid) error
+}
+
+// WithTombstones keeps the tombstones of removed providers in the store, which
+// is required for removing providers. Records of removed providers read from
+// IPNI are dropped rather than cached
+func WithTombstones(store types.TombstoneStore) Option {
+	return func(pi *ProviderIndex) {
+		pi.tombstones = store
+	}
+}
+
+// WithClaimCache evicts the claims only found through the records of a removed
+// provider from the cache
+func WithClaimCache(cache ClaimCache) Option {
+	return func(pi *ProviderIndex) {
+		pi.claims = cache
+	}
+}
+
+// sweepingProviderStore is implemented by provider stores whose hashes can be
+// iterated, and whose entries can be rewritten without changing when they
+// expire
+type sweepingProviderStore interface {
+	entryProviderStore
+	replacingProviderStore
+	Scan(ctx context.Context, cursor uint64, count int) ([]mh.Multihash, uint64, error)
+}
+
+// advertisementRemover is implemented by advertisement publishers that can
+// remove what they published
+type advertisementRemover interface {
+	AdvertisedContextIDs(ctx context.Context, provider peer.ID) ([][]byte, error)
+	Remove(ctx context.Context, provider peer.AddrInfo, contextID []byte) (ipld.Link, error)
+}
+
+// removalAnnouncer is implemented by advertisement announcers that announce
+// removals to the indexers the removed advertisements were announced to
+type removalAnnouncer interface {
+	AnnounceRemovals(ctx context.Context, provider peer.ID, removals []publisher.RemovalAnnouncement) error
+}
+
+type removeConfig struct {
+	batchSize  int
+	onProgress func(types.ProviderTombstone)
+}
+
+// RemoveOption configures the removal of a provider
+type RemoveOption func(*removeConfig)
+
+// WithRemovalProgress is sent the tombstone of the provider each time progress
+// is saved, and once the removal is done
+func WithRemovalProgress(onProgress func(types.ProviderTombstone)) RemoveOption {
+	return func(c *removeConfig) {
+		c.onProgress = onProgress
+	}
+}
+
+// WithSweepBatchSize sets the number of cached hashes checked at a time. If not
+// set, DefaultSweepBatchSize is used
+func WithSweepBatchSize(size int) RemoveOption {
+	return func(c *removeConfig) {
+		c.batchSize = size
+	}
+}
+
+// RemoveProvider removes every record naming the provider:
+//  1. A tombstone is written, so that records of the provider read from IPNI
+//     are dropped from then on
+//  2. A removal advertisement is published for every context ID advertised for
+//     the provider, if the advertisement publisher can remove advertisements
+//  3. The cached records of the provider are deleted from every hash, and the
+//     cached claims that were only found through them are evicted
+//
+// Progress is saved in the tombstone after every batch of hashes swept, and a
+// removal that was interrupted resumes from where it got to when the provider
+// is removed again. Removing a provider whose removal finished starts over,
+// for records cached since
+func (pi *ProviderIndex) RemoveProvider(ctx context.Context, provider peer.ID, opts ...RemoveOption) error {
+	c := &removeConfig{batchSize: DefaultSweepBatchSize}
+	for _, opt := range opts {
+		opt(c)
+	}
+	store, ok := pi.providerStore.(sweepingProviderStore)
+	if !ok || pi.tombstones == nil {
+		return ErrRemovalUnsupported
+	}
+
+	tombstone, err := pi.tombstones.Get(ctx, provider)
+	if err != nil && !errors.Is(err, types.ErrKeyNotFound) {
+		return fmt.Errorf("reading tombstone: %w", err)
+	}
+	if err != nil || tombstone.Done() {
+		tombstone = types.ProviderTombstone{Provider: provider, Started: time.Now().UTC()}
+	}
+	save := func() error {
+		if err := pi.tombstones.Set(ctx, provider, tombstone, false); err != nil {
+			return fmt.Errorf("writing tombstone: %w", err)
+		}
+		if c.onProgress != nil {
+			c.onProgress(tombstone)
+		}
+		return nil
+	}
+	if err := save(); err != nil {
+		return err
+	}
+	// the recent results of IPNI lookups may hold records of the provider
+	pi.invalidateRecent(nil)
+
+	adverts, err := pi.removeAdvertisements(ctx, provider)
+	tombstone.Adverts += adverts
+	if err != nil {
+		return err
+	}
+	if adverts > 0 {
+		if err := save(); err != nil {
+			return err
+		}
+	}
+
+	for {
+		hashes, next, err := store.Scan(ctx, tombstone.Cursor, c.batchSize)
+		if err != nil {
+			return fmt.Errorf("sweeping provider records: %w", err)
+		}
+		for _, hash := range hashes {
+			records, claims, err := pi.removeRecords(ctx, store, hash, provider)
+			if err != nil {
+				return fmt.Errorf("removing provider records of %s: %w", hash.B58String(), err)
+			}
+			tombstone.Swept++
+			if records > 0 {
+				tombstone.Hashes++
+				tombstone.Records += records
+				tombstone.Claims += claims
+			}
+		}
+		tombstone.Cursor = next
+		if next == 0 {
+			break
+		}
+		if err := save(); err != nil {
+			return err
+		}
+	}
+	tombstone.Finished = time.Now().UTC()
+	return save()
+}
+
+// removeAdvertisements publishes a removal advertisement for every context ID
+// advertised for the provider that hasn't been removed, returning the number
+// published. The last one is announced, or if the announcer routes
+// announcements, the last one announced to each set of indexers
+func (pi *ProviderIndex) removeAdvertisements(ctx context.Context, provider peer.ID) (int, error) {
+	remover, ok := pi.adverts.(advertisementRemover)
+	if !ok {
+		return 0, nil
+	}
+	contextIDs, err := remover.AdvertisedContextIDs(ctx, provider)
+	if err != nil {
+		return 0, fmt.Errorf("listing advertised context IDs: %w", err)
+	}
+	removals := make([]publisher.RemovalAnnouncement, 0, len(contextIDs))
+	for i, contextID := range contextIDs {
+		link, err := remover.Remove(ctx, peer.AddrInfo{ID: provider}, contextID)
+		if err != nil {
+			return i, fmt.Errorf("publishing removal advertisement: %w", err)
+		}
+		removals = append(removals, publisher.RemovalAnnouncement{ContextID: contextID, Link: link})
+	}
+	if len(removals) == 0 || pi.announcer == nil {
+		return len(contextIDs), nil
+	}
+	if ra, ok := pi.announcer.(removalAnnouncer); ok {
+		err = ra.AnnounceRemovals(ctx, provider, removals)
+	} else {
+		err = pi.announcer.Announce(ctx, removals[len(removals)-1].Link)
+	}
+	if err != nil {
+		return len(contextIDs), fmt.Errorf("announcing removal advertisement: %w", err)
+	}
+	return len(contextIDs), nil
+}
+
+// removeRecords deletes the cached records of the provider for a hash, and
+// evicts the claims none of the remaining records refer to. It returns the
+// number of records removed and claims evicted
+func (pi *ProviderIndex) removeRecords(ctx context.Context, store sweepingProviderStore, hash mh.Multihash, provider peer.ID) (int, int, error) {
+	var entry providerresults.Entry
+	var err error
+	if ps, ok := store.(primaryEntryProviderStore); ok {
+		entry, err = ps.GetEntryPrimary(ctx, hash)
+	} else {
+		entry, err = store.GetEntry(ctx, hash)
+	}
+	if err != nil {
+		// expired since it was swept
+		if errors.Is(err, types.ErrKeyNotFound) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	kept := make([]providerresults.Record, 0, len(entry.Records))
+	var removed []providerresults.Record
+	for _, record := range entry.Records {
+		if record.Provider != nil && record.Provider.ID == provider {
+			removed = append(removed, record)
+		} else {
+			kept = append(kept, record)
+		}
+	}
+	if len(removed) == 0 {
+		return 0, 0, nil
+	}
+	entry.Records = kept
+	if err := store.ReplaceEntry(ctx, hash, entry); err != nil {
+		return 0, 0, err
+	}
+	if pi.claims == nil {
+		return len(removed), 0, nil
+	}
+	keptClaims := map[cid.Cid]bool{}
+	for _, record := range kept {
+		for _, claim := range recordClaims(record) {
+			keptClaims[claim] = true
+		}
+	}
+	evicted := map[cid.Cid]bool{}
+	for _, record := range removed {
+		for _, claim := range recordClaims(record) {
+			if keptClaims[claim] || evicted[claim] {
+				continue
+			}
+			if err := pi.claims.Delete(ctx, claim); err != nil {
+				return len(removed), len(evicted), fmt.Errorf("evicting claim %s: %w", claim, err)
+			}
+			evicted[claim] = true
+		}
+	}
+	return len(removed), len(evicted), nil
+}
+
+// recordClaims returns the claims the metadata of a record refers to
+func recordClaims(record providerresults.Record) []cid.Cid {
+	md := metadata.MetadataContext.New()
+	if err := md.UnmarshalBinary(record.Metadata); err != nil {
+		return nil
+	}
+	var claims []cid.Cid
+	for _, protocol := range metadata.FilterClaimProtocols(md) {
+		if hc, ok := protocol.(metadata.HasClaim); ok {
+			claims = append(claims, hc.GetClaim())
+		}
+	}
+	return claims
+}
+
+// withoutTombstoned drops the records of providers with tombstones
+func (pi *ProviderIndex) withoutTombstoned(ctx context.Context, records []providerresults.Record) ([]providerresults.Record, error) {
+	if pi.tombstones == nil || len(records) == 0 {
+		return records, nil
+	}
+	tombstoned := map[peer.ID]bool{}
+	kept := records[:0]
+	for _, record := range records {
+		if record.Provider == nil {
+			kept = append(kept, record)
+			continue
+		}
+		removed, ok := tombstoned[record.Provider.ID]
+		if !ok {
+			_, err := pi.tombstones.Get(ctx, record.Provider.ID)
+			if err != nil && !errors.Is(err, types.ErrKeyNotFound) {
+				return nil, fmt.Errorf("reading tombstone: %w", err)
+			}
+			removed = err == nil
+			tombstoned[record.Provider.ID] = removed
+		}
+		if !removed {
+			kept = append(kept, record)
+		}
+	}
+	return kept, nil
+}
@@ -0,0 +1,315 @@
+package providerindex_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/announce/message"
+	"github.com/ipni/go-libipni/find/model"
+	ipnimd "github.com/ipni/go-libipni/metadata"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/providerresults"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// mockSweepStore is an entry store whose hashes can be scanned in the order
+// they were added, with the cursor being the position of the next hash
+type mockSweepStore struct {
+	mockEntryStore
+	hashes []multihash.Multihash
+	// failAt fails the scan starting at the cursor once
+	failAt *uint64
+}
+
+func (m *mockSweepStore) add(hash multihash.Multihash, records ...providerresults.Record) {
+	m.hashes = append(m.hashes, hash)
+	m.entries[string(hash)] = providerresults.Entry{Records: records, Complete: true}
+}
+
+func (m *mockSweepStore) Scan(ctx context.Context, cursor uint64, count int) ([]multihash.Multihash, uint64, error) {
+	if m.failAt != nil && *m.failAt == cursor {
+		m.failAt = nil
+		return nil, 0, errors.New("connection reset")
+	}
+	end := min(int(cursor)+count, len(m.hashes))
+	next := uint64(end)
+	if end == len(m.hashes) {
+		next = 0
+	}
+	return m.hashes[cursor:end], next, nil
+}
+
+func (m *mockSweepStore) ReplaceEntry(ctx context.Context, hash multihash.Multihash, entry providerresults.Entry) error {
+	m.entries[string(hash)] = entry
+	return nil
+}
+
+type mockTombstones struct {
+	tombstones map[peer.ID]types.ProviderTombstone
+}
+
+func (m *mockTombstones) Get(ctx context.Context, id peer.ID) (types.ProviderTombstone, error) {
+	t, ok := m.tombstones[id]
+	if !ok {
+		return types.ProviderTombstone{}, types.ErrKeyNotFound
+	}
+	return t, nil
+}
+
+func (m *mockTombstones) Set(ctx context.Context, id peer.ID, t types.ProviderTombstone, expires bool) error {
+	m.tombstones[id] = t
+	return nil
+}
+
+func (m *mockTombstones) SetExpirable(ctx context.Context, id peer.ID, expires bool) error {
+	return nil
+}
+
+type mockClaimCache struct {
+	deleted []cid.Cid
+}
+
+func (m *mockClaimCache) Delete(ctx context.Context, claim cid.Cid) error {
+	m.deleted = append(m.deleted, claim)
+	return nil
+}
+
+// removalFixture has records of two providers cached, and advertised
+type removalFixture struct {
+	target, other *peer.AddrInfo
+	store         *mockSweepStore
+	tombstones    *mockTombstones
+	claims        *mockClaimCache
+	adverts       *publisher.Publisher
+	announcer     *mockAnnouncer
+	// targetOnly are the claims only found through records of the target
+	targetOnly []cid.Cid
+	// shared is in records of both providers
+	shared multihash.Multihash
+}
+
+func newRemovalFixture(t *testing.T) *removalFixture {
+	ctx := context.Background()
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	f := &removalFixture{
+		target:     &peer.AddrInfo{ID: testutil.RandomPeer(), Addrs: []multiaddr.Multiaddr{testutil.RandomMultiaddr()}},
+		other:      &peer.AddrInfo{ID: testutil.RandomPeer(), Addrs: []multiaddr.Multiaddr{testutil.RandomMultiaddr()}},
+		store:      &mockSweepStore{mockEntryStore: mockEntryStore{entries: map[string]providerresults.Entry{}}},
+		tombstones: &mockTombstones{tombstones: map[peer.ID]types.ProviderTombstone{}},
+		claims:     &mockClaimCache{},
+		adverts:    publisher.New(dssync.MutexWrap(datastore.NewMapDatastore()), key),
+		announcer:  &mockAnnouncer{},
+		shared:     testutil.RandomMultihash(),
+	}
+	record := func(provider *peer.AddrInfo, claim cid.Cid) providerresults.Record {
+		md := metadata.MetadataContext.New(&metadata.LocationCommitmentMetadata{Claim: claim})
+		data := testutil.Must(md.MarshalBinary())(t)
+		return providerresults.Record{ProviderResult: model.ProviderResult{ContextID: testutil.RandomBytes(10), Metadata: data, Provider: provider}}
+	}
+	for range 3 {
+		claim := testutil.RandomCID().(cidlink.Link).Cid
+		f.targetOnly = append(f.targetOnly, claim)
+		f.store.add(testutil.RandomMultihash(), record(f.target, claim))
+		f.store.add(testutil.RandomMultihash(), record(f.other, testutil.RandomCID().(cidlink.Link).Cid))
+	}
+	// the same claim found through both providers isn't evicted
+	sharedClaim := testutil.RandomCID().(cidlink.Link).Cid
+	f.store.add(f.shared, record(f.target, sharedClaim), record(f.other, sharedClaim), record(f.other, testutil.RandomCID().(cidlink.Link).Cid))
+
+	for _, provider := range []*peer.AddrInfo{f.target, f.target, f.other} {
+		testutil.Must(f.adverts.Publish(ctx, *provider, testutil.RandomBytes(10), testutil.RandomBytes(10), testutil.RandomMultihashes(2)))(t)
+	}
+	return f
+}
+
+func (f *removalFixture) providerIndex(finder *mockFinder) *providerindex.ProviderIndex {
+	return providerindex.NewProviderIndex(f.store, finder, nil, nil, cidlink.DefaultLinkSystem(), nil,
+		providerindex.WithTombstones(f.tombstones),
+		providerindex.WithClaimCache(f.claims),
+		providerindex.WithAdvertisementPublisher(f.adverts),
+		providerindex.WithAdvertisementAnnouncer(f.announcer))
+}
+
+// requirePurged checks no records of the target are left, and that those of the
+// other provider all are
+func (f *removalFixture) requirePurged(t *testing.T) {
+	var others int
+	for _, entry := range f.store.entries {
+		for _, record := range entry.Records {
+			require.NotEqual(t, f.target.ID, record.Provider.ID)
+			others++
+		}
+	}
+	require.Equal(t, 5, others)
+	require.True(t, f.store.entries[string(f.shared)].Complete)
+}
+
+func TestProviderIndex__RemoveProvider(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("only the provider is purged", func(t *testing.T) {
+		f := newRemovalFixture(t)
+		pi := f.providerIndex(&mockFinder{})
+		var progress []types.ProviderTombstone
+		require.NoError(t, pi.RemoveProvider(ctx, f.target.ID, providerindex.WithSweepBatchSize(2), providerindex.WithRemovalProgress(func(t types.ProviderTombstone) {
+			progress = append(progress, t)
+		})))
+
+		f.requirePurged(t)
+		require.ElementsMatch(t, f.targetOnly, f.claims.deleted)
+		require.Empty(t, testutil.Must(f.adverts.AdvertisedContextIDs(ctx, f.target.ID))(t))
+		require.Len(t, testutil.Must(f.adverts.AdvertisedContextIDs(ctx, f.other.ID))(t), 1)
+		require.Equal(t, []ipld.Link{testutil.Must(f.adverts.Head(ctx))(t)}, f.announcer.announced)
+
+		tombstone := f.tombstones.tombstones[f.target.ID]
+		require.True(t, tombstone.Done())
+		require.Equal(t, types.ProviderTombstone{
+			Provider: f.target.ID,
+			Started:  tombstone.Started,
+			Finished: tombstone.Finished,
+			Adverts:  2,
+			Swept:    7,
+			Hashes:   4,
+			Records:  4,
+			Claims:   3,
+		}, tombstone)
+		require.NotContains(t, f.tombstones.tombstones, f.other.ID)
+		// started, advertisements removed, three of four batches saved and done
+		require.Len(t, progress, 6)
+		require.Equal(t, tombstone, progress[len(progress)-1])
+		require.True(t, slices.IsSortedFunc(progress, func(a, b types.ProviderTombstone) int { return a.Swept - b.Swept }))
+	})
+
+	t.Run("records of the provider on IPNI are not cached again", func(t *testing.T) {
+		f := newRemovalFixture(t)
+		target, other := testutil.RandomProviderResult(), testutil.RandomProviderResult()
+		target.Provider, other.Provider = f.target, f.other
+		pi := f.providerIndex(&mockFinder{results: []model.ProviderResult{target, other}})
+		require.NoError(t, pi.RemoveProvider(ctx, f.target.ID))
+
+		hash := testutil.RandomMultihash()
+		results := testutil.Must(pi.Find(ctx, providerindex.QueryKey{Hash: hash}))(t)
+		require.Equal(t, []model.ProviderResult{other}, results)
+		require.Equal(t, []model.ProviderResult{other}, providerresults.Results(f.store.entries[string(hash)].Records))
+	})
+
+	t.Run("an interrupted removal resumes", func(t *testing.T) {
+		f := newRemovalFixture(t)
+		pi := f.providerIndex(&mockFinder{})
+		failAt := uint64(4)
+		f.store.failAt = &failAt
+		require.Error(t, pi.RemoveProvider(ctx, f.target.ID, providerindex.WithSweepBatchSize(2)))
+		interrupted := f.tombstones.tombstones[f.target.ID]
+		require.False(t, interrupted.Done())
+		require.Equal(t, uint64(4), interrupted.Cursor)
+		require.Equal(t, 4, interrupted.Swept)
+
+		require.NoError(t, pi.RemoveProvider(ctx, f.target.ID, providerindex.WithSweepBatchSize(2)))
+		f.requirePurged(t)
+		tombstone := f.tombstones.tombstones[f.target.ID]
+		require.True(t, tombstone.Done())
+		require.Equal(t, interrupted.Started, tombstone.Started)
+		require.Equal(t, 7, tombstone.Swept)
+		require.Equal(t, 4, tombstone.Records)
+		require.Equal(t, 2, tombstone.Adverts)
+
+		// a finished removal starts over
+		require.NoError(t, pi.RemoveProvider(ctx, f.target.ID))
+		again := f.tombstones.tombstones[f.target.ID]
+		require.Equal(t, 7, again.Swept)
+		require.Zero(t, again.Records)
+		require.Zero(t, again.Adverts)
+	})
+
+	t.Run("unsupported without tombstones or a sweepable store", func(t *testing.T) {
+		f := newRemovalFixture(t)
+		pi := providerindex.NewProviderIndex(f.store, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		require.ErrorIs(t, pi.RemoveProvider(ctx, f.target.ID), providerindex.ErrRemovalUnsupported)
+		pi = providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil, providerindex.WithTombstones(f.tombstones))
+		require.ErrorIs(t, pi.RemoveProvider(ctx, f.target.ID), providerindex.ErrRemovalUnsupported)
+	})
+}
+
+// recordingSender records the advertisements announced to it
+type recordingSender struct {
+	lk   sync.Mutex
+	sent []ipld.Link
+}
+
+func (s *recordingSender) Close() error { return nil }
+
+func (s *recordingSender) Send(ctx context.Context, msg message.Message) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.sent = append(s.sent, cidlink.Link{Cid: msg.Cid})
+	return nil
+}
+
+func (s *recordingSender) received(links ...ipld.Link) func() bool {
+	return func() bool {
+		s.lk.Lock()
+		defer s.lk.Unlock()
+		return slices.Equal(s.sent, links)
+	}
+}
+
+func TestProviderIndex__AnnounceRoutes(t *testing.T) {
+	ctx := context.Background()
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	adverts := publisher.New(ds, key)
+	public, private := &recordingSender{}, &recordingSender{}
+	announcer := testutil.Must(publisher.NewAnnouncer(ds, []publisher.AnnounceEndpoint{
+		{Name: "public", Sender: public},
+		{Name: "private", Sender: private},
+	}, publisher.WithAnnounceRoutes(publisher.AnnounceRoutes{
+		Kinds: map[string][]string{"index": {"public"}, "location": {"private"}},
+	})))(t)
+	announcer.Startup()
+	t.Cleanup(func() { announcer.Shutdown(ctx) })
+	store := &mockSweepStore{mockEntryStore: mockEntryStore{entries: map[string]providerresults.Entry{}}}
+	pi := providerindex.NewProviderIndex(store, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil,
+		providerindex.WithTombstones(&mockTombstones{tombstones: map[peer.ID]types.ProviderTombstone{}}),
+		providerindex.WithAdvertisementPublisher(adverts),
+		providerindex.WithAdvertisementAnnouncer(announcer))
+
+	provider := &peer.AddrInfo{ID: testutil.RandomPeer(), Addrs: []multiaddr.Multiaddr{testutil.RandomMultiaddr()}}
+	publish := func(protocol ipnimd.Protocol) ([]byte, ipld.Link) {
+		md := metadata.MetadataContext.New(protocol)
+		data := testutil.Must(md.MarshalBinary())(t)
+		contextID := testutil.RandomBytes(10)
+		require.NoError(t, pi.Publish(ctx, testutil.RandomMultihashes(2), model.ProviderResult{ContextID: contextID, Metadata: data, Provider: provider}))
+		return contextID, testutil.Must(adverts.Head(ctx))(t)
+	}
+	location, locationAd := publish(&metadata.LocationCommitmentMetadata{Claim: testutil.RandomCID().(cidlink.Link).Cid})
+	require.Eventually(t, private.received(locationAd), time.Second, 5*time.Millisecond)
+	index, indexAd := publish(&metadata.IndexClaimMetadata{Index: testutil.RandomCID().(cidlink.Link).Cid, Claim: testutil.RandomCID().(cidlink.Link).Cid})
+	require.Eventually(t, public.received(indexAd), time.Second, 5*time.Millisecond)
+
+	require.NoError(t, pi.RemoveProvider(ctx, provider.ID))
+	// removing again returns the removal advertisements already published
+	locationRm := testutil.Must(adverts.Remove(ctx, *provider, location))(t)
+	indexRm := testutil.Must(adverts.Remove(ctx, *provider, index))(t)
+	require.Eventually(t, private.received(locationAd, locationRm), time.Second, 5*time.Millisecond)
+	require.Eventually(t, public.received(indexAd, indexRm), time.Second, 5*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return len(testutil.Must(announcer.Announcements(ctx))(t)) == 0
+	}, time.Second, 5*time.Millisecond)
+}
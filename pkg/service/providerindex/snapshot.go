@@ -0,0 +1,74 @@
+package providerindex
+
+import (
+	"context"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multicodec"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/providerresults"
+)
+
+// snapshot holds the provider records read for each hash, so that every later
+// read of the hash returns the same records
+type snapshot struct {
+	lk      sync.Mutex
+	size    int
+	records map[string]snapshotRecords
+}
+
+// snapshotRecords are the records read for a hash, and where they were read from
+type snapshotRecords struct {
+	entry  providerresults.Entry
+	source RecordSource
+}
+
+// get returns the records remembered for a hash, if they cover the claim types
+func (s *snapshot) get(hash mh.Multihash, codecs []multicodec.Code) (snapshotRecords, bool) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	records, ok := s.records[string(hash)]
+	return records, ok && covers(records.entry, codecs)
+}
+
+// put remembers the records read for a hash, unless records covering the claim
+// types were remembered by a concurrent read first, in which case those are
+// returned. Once the snapshot is full, records are no longer remembered
+func (s *snapshot) put(hash mh.Multihash, codecs []multicodec.Code, records snapshotRecords) snapshotRecords {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	existing, ok := s.records[string(hash)]
+	if ok && covers(existing.entry, codecs) {
+		return existing
+	}
+	if ok || len(s.records) < s.size {
+		s.records[string(hash)] = records
+	}
+	return records
+}
+
+// Snapshot returns a view of the provider index in which the records for a hash
+// are read at most once, and every later find for the hash sees the records of
+// the first read, regardless of writes made since. The records of up to size
+// hashes are held, after which reads of further hashes go to the store every
+// time. Writes go to the store as usual, but are not seen by the snapshot. The
+// exception is records read for claim types not covered by the first read,
+// which replace the records of the first read
+func (pi *ProviderIndex) Snapshot(size int) *ProviderIndex {
+	view := *pi
+	view.snapshot = &snapshot{size: size, records: map[string]snapshotRecords{}}
+	return &view
+}
+
+func (pi *ProviderIndex) getSnapshotRecords(ctx context.Context, hash mh.Multihash, codecs []multicodec.Code, keep func(*peer.AddrInfo) bool) (providerresults.Entry, RecordSource, error) {
+	if sr, ok := pi.snapshot.get(hash, codecs); ok {
+		return sr.entry, sr.source, nil
+	}
+	entry, source, err := pi.readProviderRecords(ctx, hash, codecs, keep)
+	if err != nil {
+		return providerresults.Entry{}, "", err
+	}
+	sr := pi.snapshot.put(hash, codecs, snapshotRecords{entry, source})
+	return sr.entry, sr.source, nil
+}
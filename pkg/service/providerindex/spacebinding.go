@@ -0,0 +1,302 @@
+package providerindex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multiaddr"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+var log = logging.Logger("providerindex")
+
+// DefaultBindingExpiryWindow is how far apart the expirations of location
+// commitments may be for them to be treated as the same commitment, when not
+// otherwise configured
+const DefaultBindingExpiryWindow = time.Hour
+
+type (
+	// PublishOption configures a single publish
+	PublishOption func(*publishConfig)
+
+	publishConfig struct {
+		distinct bool
+		// index is the index the published hashes are checked against, or
+		// derived from if derive is set
+		index     blobindex.ShardedDagIndex
+		tolerance int
+		derive    bool
+	}
+)
+
+// DistinctClaims publishes the provider result even if the same commitment is
+// already published under another space, for providers that insist on a claim
+// of their own per space
+func DistinctClaims() PublishOption {
+	return func(c *publishConfig) {
+		c.distinct = true
+	}
+}
+
+// WithSpaceBindings deduplicates location commitments published to several
+// spaces. When a commitment is published for a space, and a commitment from the
+// same provider for the same hash, at the same addresses and expiring within
+// the window of it, is already published under another space, the space is
+// bound to the existing commitment in the store instead of being advertised
+// and cached again. Queries filtered by the space find the existing commitment
+// through the binding. If the window is zero, DefaultBindingExpiryWindow is
+// used
+func WithSpaceBindings(store types.SpaceBindingStore, window time.Duration) Option {
+	return func(pi *ProviderIndex) {
+		pi.bindings = store
+		pi.bindingWindow = window
+		if pi.bindingWindow <= 0 {
+			pi.bindingWindow = DefaultBindingExpiryWindow
+		}
+	}
+}
+
+// WithClock sets the clock the expirations of commitments and space bindings
+// are checked against
+func WithClock(now func() time.Time) Option {
+	return func(pi *ProviderIndex) {
+		pi.now = now
+	}
+}
+
+// WithClockSkewTolerance allows the clocks of commitment issuers to be off from
+// ours by up to the tolerance, so that commitments and space bindings are only
+// expired, and cached, until the tolerance past their expiration
+func WithClockSkewTolerance(tolerance time.Duration) Option {
+	return func(pi *ProviderIndex) {
+		pi.clockSkew = max(tolerance, 0)
+	}
+}
+
+// expired returns true if the expiration is past, allowing for the clock skew
+// tolerance. A zero expiration never expires
+func (pi *ProviderIndex) expired(expiration time.Time) bool {
+	return !expiration.IsZero() && !pi.now().Before(expiration.Add(pi.clockSkew))
+}
+
+// ttl returns how long until the expiration is past, allowing for the clock
+// skew tolerance, or false if it already is. The TTL is never negative
+func (pi *ProviderIndex) ttl(expiration time.Time) (time.Duration, bool) {
+	ttl := expiration.Add(pi.clockSkew).Sub(pi.now())
+	if ttl <= 0 {
+		return 0, false
+	}
+	return ttl, true
+}
+
+// ttlBindingStore is implemented by space binding stores that can set an
+// explicit expiration on a write
+type ttlBindingStore interface {
+	SetWithTTL(ctx context.Context, hash mh.Multihash, bindings []types.SpaceBinding, ttl time.Duration) error
+}
+
+// bindSpace binds the space of the result to a commitment already published
+// under another space for every hash, returning false if any hash has no such
+// commitment, in which case nothing is bound
+func (pi *ProviderIndex) bindSpace(ctx context.Context, hashes []mh.Multihash, result model.ProviderResult) (bool, error) {
+	if pi.bindings == nil || len(hashes) == 0 {
+		return false, nil
+	}
+	location, ok := locationMetadata(result)
+	if !ok {
+		return false, nil
+	}
+	var shared *metadata.LocationCommitmentMetadata
+	for _, hash := range hashes {
+		// a commitment not scoped to a space has no space to bind
+		unscoped, err := pi.contextIDs.Match(types.ContextID{Hash: hash}, result.ContextID)
+		if err != nil || unscoped {
+			return false, err
+		}
+		existing, err := types.GetForWrite(ctx, pi.providerStore, hash)
+		if errors.Is(err, types.ErrKeyNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		match, ok := pi.sharedCommitment(existing, result, location)
+		if !ok || (shared != nil && !shared.Claim.Equals(match.Claim)) {
+			return false, nil
+		}
+		shared = match
+	}
+	binding := types.SpaceBinding{ContextID: result.ContextID, Claim: shared.Claim}
+	if shared.Expiration != 0 {
+		binding.Expiration = time.Unix(shared.Expiration, 0)
+	}
+	for _, hash := range hashes {
+		if err := pi.addBinding(ctx, hash, binding); err != nil {
+			return false, err
+		}
+	}
+	log.Debugw("bound space to existing location commitment", "claim", shared.Claim, "hashes", len(hashes))
+	return true, nil
+}
+
+// sharedCommitment returns the metadata of the unexpired commitment among the
+// records that is the same as the location commitment of the result, but
+// published under another context ID
+func (pi *ProviderIndex) sharedCommitment(records []model.ProviderResult, result model.ProviderResult, location *metadata.LocationCommitmentMetadata) (*metadata.LocationCommitmentMetadata, bool) {
+	for _, r := range records {
+		if bytes.Equal(r.ContextID, result.ContextID) || !sameProvider(r, result) {
+			continue
+		}
+		existing, ok := locationMetadata(r)
+		if !ok || !sameLocation(existing, location) || existing.Claim.Equals(location.Claim) {
+			continue
+		}
+		if existing.Expiration != 0 && pi.expired(time.Unix(existing.Expiration, 0)) {
+			continue
+		}
+		gap := time.Duration(existing.Expiration-location.Expiration) * time.Second
+		if (existing.Expiration == 0) != (location.Expiration == 0) || gap.Abs() > pi.bindingWindow {
+			continue
+		}
+		return existing, true
+	}
+	return nil, false
+}
+
+// addBinding adds the binding to those of the hash, replacing any for the same
+// context ID and dropping any that have expired. The bindings expire with the
+// last commitment they bind to
+func (pi *ProviderIndex) addBinding(ctx context.Context, hash mh.Multihash, binding types.SpaceBinding) error {
+	bindings, _, err := pi.liveBindings(ctx, hash, true)
+	if err != nil {
+		return err
+	}
+	bindings = slices.DeleteFunc(bindings, func(b types.SpaceBinding) bool { return bytes.Equal(b.ContextID, binding.ContextID) })
+	bindings = append(bindings, binding)
+	var last time.Time
+	for _, b := range bindings {
+		if b.Expiration.IsZero() {
+			return pi.bindings.Set(ctx, hash, bindings, false)
+		}
+		if b.Expiration.After(last) {
+			last = b.Expiration
+		}
+	}
+	if ts, ok := pi.bindings.(ttlBindingStore); ok {
+		if ttl, ok := pi.ttl(last); ok {
+			return ts.SetWithTTL(ctx, hash, bindings, ttl)
+		}
+	}
+	return pi.bindings.Set(ctx, hash, bindings, true)
+}
+
+// spaceBindings returns the unexpired bindings of the hash, removing any that
+// have expired from the store
+func (pi *ProviderIndex) spaceBindings(ctx context.Context, hash mh.Multihash) ([]types.SpaceBinding, error) {
+	live, expired, err := pi.liveBindings(ctx, hash, false)
+	if err != nil || !expired {
+		return live, err
+	}
+	// the bindings written back are read again from the primary, so that none
+	// added since the replica was read are dropped
+	current, expired, err := pi.liveBindings(ctx, hash, true)
+	if err == nil && expired {
+		err = pi.bindings.Set(ctx, hash, current, true)
+	}
+	if err != nil {
+		log.Warnw("removing expired space bindings", "error", err)
+	}
+	return live, nil
+}
+
+// liveBindings reads the unexpired bindings of the hash, from the primary if
+// set, along with whether any expired bindings were left out
+func (pi *ProviderIndex) liveBindings(ctx context.Context, hash mh.Multihash, primary bool) ([]types.SpaceBinding, bool, error) {
+	var bindings []types.SpaceBinding
+	var err error
+	if primary {
+		bindings, err = types.GetForWrite(ctx, pi.bindings, hash)
+	} else {
+		bindings, err = pi.bindings.Get(ctx, hash)
+	}
+	if errors.Is(err, types.ErrKeyNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("reading space bindings: %w", err)
+	}
+	live := slices.DeleteFunc(slices.Clone(bindings), func(b types.SpaceBinding) bool { return pi.expired(b.Expiration) })
+	return live, len(live) < len(bindings), nil
+}
+
+// boundToSpace returns true if the result is a location commitment one of the
+// spaces is bound to
+func (pi *ProviderIndex) boundToSpace(bindings []types.SpaceBinding, result model.ProviderResult, hash mh.Multihash, spaces []did.DID) (bool, error) {
+	if len(bindings) == 0 {
+		return false, nil
+	}
+	location, ok := locationMetadata(result)
+	if !ok {
+		return false, nil
+	}
+	for _, b := range bindings {
+		if !b.Claim.Equals(location.Claim) {
+			continue
+		}
+		for _, space := range spaces {
+			ok, err := pi.contextIDs.Match(types.ContextID{Space: &space, Hash: hash}, b.ContextID)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// locationMetadata returns the location commitment metadata of the result, if
+// it has any
+func locationMetadata(result model.ProviderResult) (*metadata.LocationCommitmentMetadata, bool) {
+	md := metadata.MetadataContext.New()
+	if err := md.UnmarshalBinary(result.Metadata); err != nil {
+		return nil, false
+	}
+	location, ok := md.Get(metadata.LocationCommitmentID).(*metadata.LocationCommitmentMetadata)
+	return location, ok
+}
+
+// sameProvider returns true if both results are from the same provider at the
+// same addresses
+func sameProvider(a, b model.ProviderResult) bool {
+	if a.Provider == nil || b.Provider == nil {
+		return false
+	}
+	return a.Provider.ID == b.Provider.ID && slices.EqualFunc(a.Provider.Addrs, b.Provider.Addrs, multiaddr.Multiaddr.Equal)
+}
+
+// sameLocation returns true if both commitments are for the same part of the
+// same shard, retrieved the same way
+func sameLocation(a, b *metadata.LocationCommitmentMetadata) bool {
+	return equalPtr(a.Shard, b.Shard, cid.Cid.Equals) &&
+		equalPtr(a.Range, b.Range, func(x, y metadata.Range) bool {
+			return x.Offset == y.Offset && equalPtr(x.Length, y.Length, func(m, n uint64) bool { return m == n })
+		}) &&
+		equalPtr(a.Template, b.Template, func(x, y string) bool { return x == y })
+}
+
+func equalPtr[T any](a, b *T, eq func(T, T) bool) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return eq(*a, *b)
+}
@@ -0,0 +1,193 @@
+package providerindex_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/go-ucanto/principal/ed25519/signer"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+type mockBindingStore struct {
+	bindings map[string][]types.SpaceBinding
+}
+
+func (m *mockBindingStore) Get(ctx context.Context, hash multihash.Multihash) ([]types.SpaceBinding, error) {
+	bindings, ok := m.bindings[string(hash)]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return bindings, nil
+}
+
+func (m *mockBindingStore) Set(ctx context.Context, hash multihash.Multihash, bindings []types.SpaceBinding, expires bool) error {
+	m.bindings[string(hash)] = bindings
+	return nil
+}
+
+func (m *mockBindingStore) SetExpirable(ctx context.Context, hash multihash.Multihash, expires bool) error {
+	return nil
+}
+
+func TestProviderIndex__SpaceBindings(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(time.Now().Unix(), 0)
+	expiration := now.Add(24 * time.Hour)
+	hash := testutil.RandomMultihash()
+	provider := &peer.AddrInfo{ID: testutil.RandomPeer(), Addrs: []multiaddr.Multiaddr{testutil.RandomMultiaddr()}}
+	newSpace := func() did.DID { return testutil.Must(signer.Generate())(t).DID() }
+	first, second, distinct, unrelated := newSpace(), newSpace(), newSpace(), newSpace()
+	// the same commitment as issued for each space has a claim of its own
+	commitment := func(space did.DID, expiration time.Time) model.ProviderResult {
+		md := metadata.MetadataContext.New(&metadata.LocationCommitmentMetadata{Claim: testutil.RandomCID().(cidlink.Link).Cid, Expiration: expiration.Unix()})
+		return model.ProviderResult{
+			ContextID: testutil.Must(types.DefaultContextIDCodec.Encode(types.ContextID{Space: &space, Hash: hash}))(t),
+			Metadata:  testutil.Must(md.MarshalBinary())(t),
+			Provider:  provider,
+		}
+	}
+
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	adverts := publisher.New(dssync.MutexWrap(datastore.NewMapDatastore()), key)
+	advertCount := func(t *testing.T) uint64 {
+		return testutil.Must(adverts.ChainSummary(ctx))(t).Adverts
+	}
+	// records of another provider, so that records admitted by a binding can be
+	// told apart from every record being returned when no space matches
+	other := commitment(unrelated, expiration)
+	other.Provider = &peer.AddrInfo{ID: testutil.RandomPeer(), Addrs: []multiaddr.Multiaddr{testutil.RandomMultiaddr()}}
+	store := &mockProviderStore{results: map[string][]model.ProviderResult{string(hash): {other}}}
+	bindings := &mockBindingStore{bindings: map[string][]types.SpaceBinding{}}
+	pi := providerindex.NewProviderIndex(store, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil,
+		providerindex.WithAdvertisementPublisher(adverts),
+		providerindex.WithSpaceBindings(bindings, time.Hour),
+		providerindex.WithClock(func() time.Time { return now }))
+	find := func(t *testing.T, space did.DID) []model.ProviderResult {
+		return testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: hash, Spaces: []did.DID{space}, TargetClaims: []multicodec.Code{metadata.LocationCommitmentID}}))(t).Results
+	}
+
+	published := commitment(first, expiration)
+	require.NoError(t, pi.Publish(ctx, []multihash.Multihash{hash}, published))
+	// the same commitment for another space, expiring within the window
+	require.NoError(t, pi.Publish(ctx, []multihash.Multihash{hash}, commitment(second, expiration.Add(10*time.Minute))))
+	require.Equal(t, uint64(1), advertCount(t))
+	require.Len(t, store.results[string(hash)], 2)
+	require.Len(t, bindings.bindings[string(hash)], 1)
+	require.Equal(t, expiration, bindings.bindings[string(hash)][0].Expiration)
+
+	require.Equal(t, []model.ProviderResult{published}, find(t, first))
+	require.Equal(t, []model.ProviderResult{published}, find(t, second))
+
+	t.Run("providers insisting on distinct claims publish them", func(t *testing.T) {
+		require.NoError(t, pi.Publish(ctx, []multihash.Multihash{hash}, commitment(distinct, expiration), providerindex.DistinctClaims()))
+		require.Equal(t, uint64(2), advertCount(t))
+		require.Len(t, bindings.bindings[string(hash)], 1)
+		require.Len(t, find(t, distinct), 1)
+	})
+
+	t.Run("commitments expiring outside the window are published", func(t *testing.T) {
+		require.NoError(t, pi.Publish(ctx, []multihash.Multihash{hash}, commitment(newSpace(), expiration.Add(2*time.Hour))))
+		require.Equal(t, uint64(3), advertCount(t))
+		require.Len(t, bindings.bindings[string(hash)], 1)
+	})
+
+	t.Run("bindings expire with the commitment", func(t *testing.T) {
+		now = expiration
+		// with no binding left, nothing matches the space and every record is
+		// returned
+		require.Len(t, find(t, second), len(store.results[string(hash)]))
+		require.Empty(t, bindings.bindings[string(hash)])
+		// the shared commitment has expired, so a new one is published
+		before := advertCount(t)
+		require.NoError(t, pi.Publish(ctx, []multihash.Multihash{hash}, commitment(second, expiration.Add(24*time.Hour))))
+		require.Equal(t, before+1, advertCount(t))
+		require.Empty(t, bindings.bindings[string(hash)])
+	})
+}
+
+// ttlProviderStore records the TTLs records are cached with
+type ttlProviderStore struct {
+	mockProviderStore
+	ttls map[string]time.Duration
+}
+
+func (m *ttlProviderStore) SetWithTTL(ctx context.Context, hash multihash.Multihash, results []model.ProviderResult, ttl time.Duration) error {
+	m.ttls[string(hash)] = ttl
+	return m.Set(ctx, hash, results, true)
+}
+
+func TestProviderIndex__ClockSkewTolerance(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(time.Now().Unix(), 0)
+	tolerance := 2 * time.Minute
+
+	t.Run("cached records expire the tolerance past their expiration", func(t *testing.T) {
+		testCases := []struct {
+			name       string
+			expiration time.Time
+			tolerance  time.Duration
+			ttl        time.Duration
+			cached     bool
+		}{
+			{name: "unexpired", expiration: now.Add(time.Hour), tolerance: tolerance, ttl: time.Hour + tolerance, cached: true},
+			{name: "expiration exactly now", expiration: now},
+			{name: "expiration exactly now with tolerance", expiration: now, tolerance: tolerance, ttl: tolerance, cached: true},
+			{name: "expiration within the tolerance", expiration: now.Add(-time.Minute), tolerance: tolerance, ttl: time.Minute, cached: true},
+			{name: "expiration now minus tolerance", expiration: now.Add(-tolerance), tolerance: tolerance},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				hash := testutil.RandomMultihash()
+				store := &ttlProviderStore{mockProviderStore: mockProviderStore{results: map[string][]model.ProviderResult{}}, ttls: map[string]time.Duration{}}
+				pi := providerindex.NewProviderIndex(store, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil,
+					providerindex.WithClock(func() time.Time { return now }),
+					providerindex.WithClockSkewTolerance(tc.tolerance))
+				require.NoError(t, pi.CacheProviderResult(ctx, hash, testutil.RandomProviderResult(), tc.expiration))
+				ttl, cached := store.ttls[string(hash)]
+				require.Equal(t, tc.cached, cached)
+				require.Equal(t, tc.ttl, ttl)
+			})
+		}
+	})
+
+	t.Run("space bindings expire the tolerance past their commitment", func(t *testing.T) {
+		hash := testutil.RandomMultihash()
+		expiration := now.Add(time.Hour)
+		clock := now
+		binding := types.SpaceBinding{ContextID: testutil.RandomBytes(10), Claim: testutil.RandomCID().(cidlink.Link).Cid, Expiration: expiration}
+		bindings := &mockBindingStore{bindings: map[string][]types.SpaceBinding{}}
+		pi := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &mockFinder{}, nil, nil, cidlink.DefaultLinkSystem(), nil,
+			providerindex.WithSpaceBindings(bindings, time.Hour),
+			providerindex.WithClock(func() time.Time { return clock }),
+			providerindex.WithClockSkewTolerance(tolerance))
+		find := func() {
+			_, err := pi.FindDetailed(ctx, providerindex.QueryKey{Hash: hash, Spaces: []did.DID{testutil.Must(signer.Generate())(t).DID()}})
+			require.NoError(t, err)
+		}
+
+		bindings.bindings[string(hash)] = []types.SpaceBinding{binding}
+		clock = expiration.Add(tolerance - time.Second)
+		find()
+		require.Len(t, bindings.bindings[string(hash)], 1)
+
+		clock = expiration.Add(tolerance)
+		find()
+		require.Empty(t, bindings.bindings[string(hash)])
+	})
+}
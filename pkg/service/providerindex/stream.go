@@ -0,0 +1,151 @@
+package providerindex
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multicodec"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/providerresults"
+)
+
+// findScanFactor is how many times the most records kept are read from a find
+// response, once that many have been kept, looking for providers that haven't
+// been kept a record of
+const findScanFactor = 4
+
+// StreamFinder is implemented by find clients that read the provider records of
+// a find response as it arrives, rather than all at once
+type StreamFinder interface {
+	// FindStream calls yield with each provider record for the hash, in the
+	// order IPNI returned them, until yield returns false
+	FindStream(ctx context.Context, hash mh.Multihash, yield func(model.ProviderResult) bool) error
+}
+
+// WithMaxFindRecords keeps at most n of the records of an IPNI find response
+// for a hash, when the find client is a StreamFinder. Records are filtered by
+// the claim types and the provider policy of the query as they are read, and
+// records of providers with no record kept yet are preferred over more records
+// of those that have, so that very large responses are never held in memory.
+// Entries cut short are cached as truncated, and only cover the claim types
+// they were filtered to. By default, every record is kept
+func WithMaxFindRecords(n int) Option {
+	return func(pi *ProviderIndex) {
+		pi.maxFindRecords = n
+	}
+}
+
+// streamedRecords are the records kept from a find response read as it
+// arrived
+type streamedRecords struct {
+	records []providerresults.Record
+	// read is the number of records read from the response, kept or not
+	read int
+	// filtered is the number of records left out for their claim types
+	filtered int
+	// truncated is set if records for the claim types were left out once the
+	// most records were kept
+	truncated bool
+}
+
+// streamFind reads the records for a hash from a find response as it arrives,
+// keeping up to the most records for the claim types whose providers the keep
+// policy allows
+func (pi *ProviderIndex) streamFind(ctx context.Context, finder StreamFinder, hash mh.Multihash, codecs []multicodec.Code, keep func(*peer.AddrInfo) bool) (streamedRecords, error) {
+	var s streamedRecords
+	r := retainer{max: pi.maxFindRecords, counts: map[peer.ID]int{}}
+	// records returned by IPNI have just been seen
+	now := time.Now()
+	err := finder.FindStream(ctx, hash, func(result model.ProviderResult) bool {
+		s.read++
+		if len(codecs) > 0 && !hasClaim(result, codecs) {
+			s.filtered++
+			return true
+		}
+		if keep != nil && !keep(result.Provider) {
+			return true
+		}
+		return r.add(providerresults.Record{ProviderResult: result, SeenAt: now})
+	})
+	if err != nil {
+		return streamedRecords{}, err
+	}
+	s.records, s.truncated = r.records, r.truncated
+	if s.truncated {
+		log.Debugw("find response truncated", "hash", hash, "read", s.read, "kept", len(s.records))
+	}
+	return s, nil
+}
+
+// hasClaim returns true if the record has metadata for any of the claim types
+func hasClaim(result model.ProviderResult, codecs []multicodec.Code) bool {
+	md := metadata.MetadataContext.New()
+	if err := md.UnmarshalBinary(result.Metadata); err != nil {
+		return false
+	}
+	return slices.ContainsFunc(md.Protocols(), func(code multicodec.Code) bool {
+		return slices.Contains(codecs, code)
+	})
+}
+
+// retainer picks the records of a find response to keep, up to max, favouring
+// records of providers it has no record of over more records of those it has
+type retainer struct {
+	max       int
+	records   []providerresults.Record
+	counts    map[peer.ID]int
+	read      int
+	truncated bool
+}
+
+// add keeps the record if there is room, or otherwise in place of the last
+// record kept of the provider with the most records, if the record's provider
+// has none kept. It returns false once reading more records can't change what
+// is kept, as every record kept is of a different provider, or enough records
+// have been read
+func (r *retainer) add(record providerresults.Record) bool {
+	r.read++
+	id := providerID(record.ProviderResult)
+	if len(r.records) < r.max {
+		r.records = append(r.records, record)
+		r.counts[id]++
+		return true
+	}
+	r.truncated = true
+	if r.counts[id] == 0 {
+		if i := r.mostKept(); i >= 0 {
+			replaced := providerID(r.records[i].ProviderResult)
+			r.counts[replaced]--
+			if r.counts[replaced] == 0 {
+				delete(r.counts, replaced)
+			}
+			r.records[i] = record
+			r.counts[id]++
+		}
+	}
+	return len(r.counts) < r.max && r.read < findScanFactor*r.max
+}
+
+// mostKept returns the index of the last record kept of the provider with the
+// most records kept, or -1 if no provider has more than one
+func (r *retainer) mostKept() int {
+	most, index := 1, -1
+	for i := len(r.records) - 1; i >= 0; i-- {
+		id := providerID(r.records[i].ProviderResult)
+		if count := r.counts[id]; count > most {
+			most, index = count, i
+		}
+	}
+	return index
+}
+
+func providerID(result model.ProviderResult) peer.ID {
+	if result.Provider == nil {
+		return ""
+	}
+	return result.Provider.ID
+}
@@ -0,0 +1,222 @@
+package providerindex_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/providerresults"
+	"github.com/storacha/indexing-service/pkg/service/findclient"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderIndex__MaxFindRecords(t *testing.T) {
+	ctx := context.Background()
+	hash := testutil.RandomMultihash()
+	location := []multicodec.Code{metadata.LocationCommitmentID}
+	index := []multicodec.Code{metadata.IndexClaimID}
+	newRecord := func(t *testing.T, provider peer.ID, md interface{ MarshalBinary() ([]byte, error) }) model.ProviderResult {
+		return model.ProviderResult{
+			ContextID: testutil.RandomBytes(10),
+			Metadata:  testutil.Must(md.MarshalBinary())(t),
+			Provider:  &peer.AddrInfo{ID: provider},
+		}
+	}
+	newLocation := func(t *testing.T, provider peer.ID) model.ProviderResult {
+		return newRecord(t, provider, &metadata.LocationCommitmentMetadata{Claim: testutil.RandomCID().(cidlink.Link).Cid})
+	}
+	newIndex := func(t *testing.T, provider peer.ID) model.ProviderResult {
+		return newRecord(t, provider, &metadata.IndexClaimMetadata{Index: testutil.RandomCID().(cidlink.Link).Cid, Claim: testutil.RandomCID().(cidlink.Link).Cid})
+	}
+	providers := func(results []model.ProviderResult) []peer.ID {
+		var ids []peer.ID
+		for _, result := range results {
+			ids = append(ids, result.Provider.ID)
+		}
+		return ids
+	}
+	newIndexWith := func(finder *streamFinder, store *mockEntryStore, max int) *providerindex.ProviderIndex {
+		return providerindex.NewProviderIndex(store, finder, nil, nil, cidlink.DefaultLinkSystem(), nil, providerindex.WithMaxFindRecords(max))
+	}
+
+	t.Run("records of providers without a record kept are preferred", func(t *testing.T) {
+		busy, a, b, c := testutil.RandomPeer(), testutil.RandomPeer(), testutil.RandomPeer(), testutil.RandomPeer()
+		var results []model.ProviderResult
+		for range 6 {
+			results = append(results, newLocation(t, busy))
+		}
+		// records of other claim types don't count towards the most kept
+		results = append(results, newIndex(t, a), newLocation(t, a), newLocation(t, a), newLocation(t, b), newLocation(t, c))
+		finder := &streamFinder{mockFinder: mockFinder{results: results}}
+		pi := newIndexWith(finder, &mockEntryStore{entries: map[string]providerresults.Entry{}}, 4)
+
+		fr := testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: hash, TargetClaims: location}))(t)
+		require.True(t, fr.Truncated)
+		require.ElementsMatch(t, []peer.ID{busy, a, b, c}, providers(fr.Results))
+		// every record kept is of a different provider, so no more are read
+		require.Equal(t, len(results), finder.read)
+	})
+
+	t.Run("reading stops once enough records have been read", func(t *testing.T) {
+		busy := testutil.RandomPeer()
+		var results []model.ProviderResult
+		for range 100 {
+			results = append(results, newLocation(t, busy))
+		}
+		finder := &streamFinder{mockFinder: mockFinder{results: results}}
+		pi := newIndexWith(finder, &mockEntryStore{entries: map[string]providerresults.Entry{}}, 5)
+
+		fr := testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: hash, TargetClaims: location}))(t)
+		require.True(t, fr.Truncated)
+		require.Equal(t, results[:5], fr.Results)
+		require.Equal(t, 20, finder.read)
+	})
+
+	t.Run("records of providers the policy rejects aren't kept", func(t *testing.T) {
+		denied, allowed := testutil.RandomPeer(), testutil.RandomPeer()
+		results := []model.ProviderResult{newLocation(t, denied), newLocation(t, denied), newLocation(t, allowed)}
+		finder := &streamFinder{mockFinder: mockFinder{results: results}}
+		store := &mockEntryStore{entries: map[string]providerresults.Entry{}}
+		pi := newIndexWith(finder, store, 1)
+
+		fr := testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{
+			Hash:         hash,
+			TargetClaims: location,
+			Keep:         func(provider *peer.AddrInfo) bool { return provider.ID != denied },
+		}))(t)
+		require.False(t, fr.Truncated)
+		require.Equal(t, []peer.ID{allowed}, providers(fr.Results))
+		// records left out by the policy alone leave the entry complete
+		require.True(t, store.entries[string(hash)].Complete)
+	})
+
+	t.Run("truncated entries are refreshed for claim types filtered out", func(t *testing.T) {
+		results := []model.ProviderResult{newLocation(t, testutil.RandomPeer()), newLocation(t, testutil.RandomPeer()), newLocation(t, testutil.RandomPeer())}
+		indexRecord := newIndex(t, testutil.RandomPeer())
+		results = append(results, indexRecord)
+		finder := &streamFinder{mockFinder: mockFinder{results: results}}
+		store := &mockEntryStore{entries: map[string]providerresults.Entry{}}
+		pi := newIndexWith(finder, store, 2)
+
+		fr := testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: hash, TargetClaims: location}))(t)
+		require.True(t, fr.Truncated)
+		require.Len(t, fr.Results, 2)
+		entry := store.entries[string(hash)]
+		require.True(t, entry.Truncated)
+		require.False(t, entry.Complete)
+		require.Equal(t, location, entry.Claims)
+
+		// the claim types kept are answered from the cache
+		fr = testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: hash, TargetClaims: location}))(t)
+		require.Equal(t, providerindex.SourceCache, fr.Source)
+		require.True(t, fr.Truncated)
+		require.Equal(t, 1, finder.calls)
+
+		// those filtered out before the cap was hit are read from IPNI again
+		fr = testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: hash, TargetClaims: index}))(t)
+		require.Equal(t, providerindex.SourceIPNI, fr.Source)
+		require.Equal(t, []model.ProviderResult{indexRecord}, fr.Results)
+		require.Equal(t, 2, finder.calls)
+		// as are all claim types
+		testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: hash}))(t)
+		require.Equal(t, 3, finder.calls)
+	})
+
+	t.Run("responses within the most records kept are complete", func(t *testing.T) {
+		results := []model.ProviderResult{newLocation(t, testutil.RandomPeer()), newIndex(t, testutil.RandomPeer())}
+		finder := &streamFinder{mockFinder: mockFinder{results: results}}
+		store := &mockEntryStore{entries: map[string]providerresults.Entry{}}
+		pi := newIndexWith(finder, store, 10)
+
+		fr := testutil.Must(pi.FindDetailed(ctx, providerindex.QueryKey{Hash: hash}))(t)
+		require.False(t, fr.Truncated)
+		require.Equal(t, results, fr.Results)
+		require.True(t, store.entries[string(hash)].Complete)
+	})
+}
+
+// streamFinder is a find client streaming its results, counting the finds and
+// the records read
+type streamFinder struct {
+	mockFinder
+	read int
+}
+
+func (f *streamFinder) FindStream(ctx context.Context, hash multihash.Multihash, yield func(model.ProviderResult) bool) error {
+	f.calls++
+	for _, result := range f.results {
+		f.read++
+		if !yield(result) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// BenchmarkProviderIndex__MaxFindRecords looks up a hash IPNI has 50k location
+// commitments for, from a few hundred providers, streamed as NDJSON, keeping at
+// most 100 of them, reporting the records kept per lookup. The memory allocated
+// per lookup stays the same however many records the response has
+func BenchmarkProviderIndex__MaxFindRecords(b *testing.B) {
+	const records = 50_000
+	hash := testutil.RandomMultihash()
+	peers := make([]peer.ID, 300)
+	for i := range peers {
+		peers[i] = testutil.RandomPeer()
+	}
+	lines := make([][]byte, 0, records)
+	for i := range records {
+		md, err := (&metadata.LocationCommitmentMetadata{Claim: cid.NewCidV1(cid.Raw, testutil.RandomMultihash())}).MarshalBinary()
+		if err != nil {
+			b.Fatal(err)
+		}
+		// providers have runs of records, as popular providers do
+		line, err := json.Marshal(model.ProviderResult{
+			ContextID: testutil.RandomBytes(10),
+			Metadata:  md,
+			Provider:  &peer.AddrInfo{ID: peers[(i/200)%len(peers)]},
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for _, line := range lines {
+			if _, err := w.Write(append(line, '\n')); err != nil {
+				return
+			}
+		}
+	}))
+	b.Cleanup(server.Close)
+	finder, err := findclient.New(server.URL, findclient.WithClient(server.Client()))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var kept int
+	for range b.N {
+		// every lookup misses the cache
+		pi := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, finder, nil, nil, cidlink.DefaultLinkSystem(), nil, providerindex.WithMaxFindRecords(100))
+		fr, err := pi.FindDetailed(context.Background(), providerindex.QueryKey{Hash: hash, TargetClaims: []multicodec.Code{metadata.LocationCommitmentID}})
+		if err != nil {
+			b.Fatal(err)
+		}
+		kept += len(fr.Results)
+	}
+	b.ReportMetric(float64(kept)/float64(b.N), "kept/op")
+}
@@ -0,0 +1,78 @@
+package providerindex
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/storacha/indexing-service/pkg/metadata"
+)
+
+// MaxMetadataSize is the maximum size in bytes of the metadata of a provider
+// result accepted for publishing
+const MaxMetadataSize = 1024
+
+var (
+	// ErrInvalidMetadata is returned when provider result metadata can't be decoded
+	ErrInvalidMetadata = errors.New("invalid metadata")
+	// ErrNoClaimProtocol is returned when provider result metadata contains no
+	// content claim protocol
+	ErrNoClaimProtocol = errors.New("metadata contains no claim protocol")
+	// ErrMetadataTooLarge is returned when provider result metadata exceeds
+	// MaxMetadataSize
+	ErrMetadataTooLarge = errors.New("metadata too large")
+	// ErrInvalidProvider is returned when a provider result has no valid peer ID
+	// or no addresses
+	ErrInvalidProvider = errors.New("invalid provider")
+)
+
+// NormalizeProviderResult checks that a provider result is one that can be read
+// back when handling queries, and returns it in canonical form: metadata is
+// re-encoded with only the claim protocols, and duplicate provider addresses are
+// removed. Equivalent results normalize to identical bytes
+func NormalizeProviderResult(result model.ProviderResult) (model.ProviderResult, error) {
+	if len(result.Metadata) > MaxMetadataSize {
+		return model.ProviderResult{}, fmt.Errorf("%w: %d bytes, maximum is %d", ErrMetadataTooLarge, len(result.Metadata), MaxMetadataSize)
+	}
+	if result.Provider == nil {
+		return model.ProviderResult{}, fmt.Errorf("%w: missing provider", ErrInvalidProvider)
+	}
+	if err := result.Provider.ID.Validate(); err != nil {
+		return model.ProviderResult{}, fmt.Errorf("%w: %w", ErrInvalidProvider, err)
+	}
+	addrs := make([]multiaddr.Multiaddr, 0, len(result.Provider.Addrs))
+	for _, addr := range result.Provider.Addrs {
+		if addr == nil {
+			continue
+		}
+		if !slices.ContainsFunc(addrs, addr.Equal) {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return model.ProviderResult{}, fmt.Errorf("%w: provider %s has no addresses", ErrInvalidProvider, result.Provider.ID)
+	}
+
+	md := metadata.MetadataContext.New()
+	if err := md.UnmarshalBinary(result.Metadata); err != nil {
+		return model.ProviderResult{}, fmt.Errorf("%w: %w", ErrInvalidMetadata, err)
+	}
+	claims := metadata.FilterClaimProtocols(md)
+	if len(claims) == 0 {
+		return model.ProviderResult{}, fmt.Errorf("%w: found protocols %v", ErrNoClaimProtocol, md.Protocols())
+	}
+	canonical := metadata.MetadataContext.New(claims...)
+	mdBytes, err := canonical.MarshalBinary()
+	if err != nil {
+		return model.ProviderResult{}, fmt.Errorf("%w: %w", ErrInvalidMetadata, err)
+	}
+
+	return model.ProviderResult{
+		ContextID: slices.Clone(result.ContextID),
+		Metadata:  mdBytes,
+		Provider:  &peer.AddrInfo{ID: result.Provider.ID, Addrs: addrs},
+	}, nil
+}
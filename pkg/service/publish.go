@@ -0,0 +1,274 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	ipnimd "github.com/ipni/go-libipni/metadata"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/core/ipld"
+	"github.com/storacha/go-ucanto/validator"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service/claimevents"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// ErrNoClaimProvider is returned when a claim is published or cached by a
+// service that has no provider to record it as provided by
+var ErrNoClaimProvider = errors.New("no provider to record claims as provided by")
+
+// ErrUnrecognizedClaim is returned when a claim published or cached is not one
+// of the claims the service records
+var ErrUnrecognizedClaim = errors.New("unrecognized claim")
+
+// ErrIndexNotLocated is returned when an index claim is published or cached for
+// an index that no location commitment the service knows of can be fetched
+// from. The index is needed to record the claim on the multihashes it indexes
+var ErrIndexNotLocated = errors.New("index not located")
+
+// WithClaimProvider sets the provider that claims published or cached through
+// the service are recorded as provided by, and the addresses their claims are
+// fetched from with a "{claim}" path. Claims can't be published or cached
+// without one
+func WithClaimProvider(provider peer.AddrInfo) Option {
+	return func(is *IndexingService) {
+		is.claimProvider = &provider
+	}
+}
+
+// WithContextIDCodec sets the scheme context IDs of the records of claims
+// published or cached are derived with, which must be that of the provider
+// index. If not set, types.DefaultContextIDCodec is used
+func WithContextIDCodec(codec types.ContextIDCodec) Option {
+	return func(is *IndexingService) {
+		is.contextIDs = codec
+	}
+}
+
+// claimEntries is the provider record a claim is recorded as, and the
+// multihashes it is recorded on
+type claimEntries struct {
+	hashes []multihash.Multihash
+	result model.ProviderResult
+	// index is the index an index claim is for, whose multihashes it is recorded
+	// on rather than hashes
+	index blobindex.ShardedDagIndexView
+}
+
+// count is the number of multihashes the claim is recorded on
+func (ce claimEntries) count() int {
+	if ce.index != nil {
+		n := 0
+		for range blobindex.Multihashes(ce.index) {
+			n++
+		}
+		return n
+	}
+	return len(ce.hashes)
+}
+
+func (is *IndexingService) cacheClaim(ctx context.Context, claim delegation.Delegation) (claimevents.ClaimEvent, error) {
+	evt := claimevents.NewClaimEvent(claim)
+	entries, err := is.claimEntries(ctx, claim, evt)
+	if err != nil {
+		return evt, err
+	}
+	var expiration time.Time
+	if exp := claim.Expiration(); exp != nil {
+		expiration = time.Unix(int64(*exp), 0)
+	}
+	hashes := entries.hashes
+	if entries.index != nil {
+		hashes = slices.Collect(blobindex.Multihashes(entries.index))
+	}
+	for _, hash := range hashes {
+		if err := is.providerIndex.CacheProviderResult(ctx, hash, entries.result, expiration); err != nil {
+			return evt, fmt.Errorf("caching provider record: %w", err)
+		}
+	}
+	evt.Provider = &entries.result.Provider.ID
+	evt.HashCount = len(hashes)
+	return evt, nil
+}
+
+func (is *IndexingService) publishClaim(ctx context.Context, claim delegation.Delegation) (claimevents.ClaimEvent, error) {
+	evt := claimevents.NewClaimEvent(claim)
+	entries, err := is.claimEntries(ctx, claim, evt)
+	if err != nil {
+		return evt, err
+	}
+	var opts []providerindex.PublishOption
+	if entries.index != nil {
+		opts = append(opts, providerindex.DeriveEntriesFromIndex(entries.index))
+	}
+	if err := is.providerIndex.Publish(ctx, entries.hashes, entries.result, opts...); err != nil {
+		return evt, fmt.Errorf("publishing provider record: %w", err)
+	}
+	evt.Provider = &entries.result.Provider.ID
+	evt.HashCount = entries.count()
+	return evt, nil
+}
+
+// claimEntries reads the provider record of the claim provider for the claim,
+// from its first capability. Location commitments are recorded on their
+// content under a context ID scoped to the space of the claim. Equals claims
+// are recorded on both sides, under the content multihash, which their
+// handler follows back from the equals side. Index claims are recorded on the
+// multihashes of the index under its multihash, so the index must be located
+// to be fetched first
+func (is *IndexingService) claimEntries(ctx context.Context, claim delegation.Delegation, evt claimevents.ClaimEvent) (claimEntries, error) {
+	if is.claimProvider == nil {
+		return claimEntries{}, ErrNoClaimProvider
+	}
+	caps := claim.Capabilities()
+	if len(caps) == 0 {
+		return claimEntries{}, fmt.Errorf("%w: no capabilities", ErrUnrecognizedClaim)
+	}
+	var expiration int64
+	if exp := claim.Expiration(); exp != nil {
+		expiration = int64(*exp)
+	}
+	claimCid := claim.Link().(cidlink.Link).Cid
+	source := validator.NewSource(caps[0], claim)
+	var entries claimEntries
+	var contextID types.ContextID
+	var md ipnimd.Protocol
+	switch caps[0].Can() {
+	case assert.LocationAbility:
+		match, fail := assert.Location.Match(source)
+		if fail != nil {
+			return claimEntries{}, fmt.Errorf("%w: %s", ErrUnrecognizedClaim, fail.Error())
+		}
+		nb := match.Value().Nb()
+		location := &metadata.LocationCommitmentMetadata{Expiration: expiration, Claim: claimCid}
+		if nb.Range != nil {
+			location.Range = &metadata.Range{Offset: nb.Range.Offset, Length: nb.Range.Length}
+		}
+		md = location
+		entries.hashes = []multihash.Multihash{nb.Content.Hash()}
+		contextID = types.ContextID{Space: evt.Space, Hash: nb.Content.Hash()}
+	case assert.EqualsAbility:
+		match, fail := assert.Equals.Match(source)
+		if fail != nil {
+			return claimEntries{}, fmt.Errorf("%w: %s", ErrUnrecognizedClaim, fail.Error())
+		}
+		nb := match.Value().Nb()
+		equals, err := linkCid(nb.Equals)
+		if err != nil {
+			return claimEntries{}, fmt.Errorf("%w: %w", ErrUnrecognizedClaim, err)
+		}
+		md = &metadata.EqualsClaimMetadata{Equals: equals, Expiration: expiration, Claim: claimCid}
+		entries.hashes = []multihash.Multihash{nb.Content.Hash(), equals.Hash()}
+		contextID = types.ContextID{Hash: nb.Content.Hash()}
+	case assert.IndexAbility:
+		match, fail := assert.Index.Match(source)
+		if fail != nil {
+			return claimEntries{}, fmt.Errorf("%w: %s", ErrUnrecognizedClaim, fail.Error())
+		}
+		index, err := linkCid(match.Value().Nb().Index)
+		if err != nil {
+			return claimEntries{}, fmt.Errorf("%w: %w", ErrUnrecognizedClaim, err)
+		}
+		md = &metadata.IndexClaimMetadata{Index: index, Expiration: expiration, Claim: claimCid}
+		contextID = types.ContextID{Hash: index.Hash()}
+		if entries.index, err = is.claimedIndex(ctx, index, types.EncodedContextID(index.Hash())); err != nil {
+			return claimEntries{}, err
+		}
+	default:
+		return claimEntries{}, fmt.Errorf("%w: %s", ErrUnrecognizedClaim, caps[0].Can())
+	}
+	encoded, err := is.contextIDs.Encode(contextID)
+	if err != nil {
+		return claimEntries{}, fmt.Errorf("encoding context ID: %w", err)
+	}
+	encodedMd := metadata.MetadataContext.New(md)
+	mdBytes, err := encodedMd.MarshalBinary()
+	if err != nil {
+		return claimEntries{}, fmt.Errorf("encoding metadata: %w", err)
+	}
+	entries.result = model.ProviderResult{ContextID: encoded, Metadata: mdBytes, Provider: is.claimProvider}
+	return entries, nil
+}
+
+// claimedIndex fetches the index an index claim is for, from the first
+// location commitment for it that the index can be fetched from. The index is
+// kept by the blob index lookup under the context ID of the claim's record, so
+// that queries following the claim find it
+func (is *IndexingService) claimedIndex(ctx context.Context, index cid.Cid, contextID types.EncodedContextID) (blobindex.ShardedDagIndexView, error) {
+	fr, err := is.providerIndex.FindDetailed(ctx, providerindex.QueryKey{
+		Hash:         index.Hash(),
+		TargetClaims: targetClaims[locationJobType],
+	})
+	if err != nil {
+		return nil, fmt.Errorf("finding location of index %s: %w", index, err)
+	}
+	cfg := is.config.Load()
+	for _, result := range fr.Results {
+		if cfg.isDenied(result.Provider, is.identities) || !is.allowedProvider(ctx, result.Provider) {
+			continue
+		}
+		md := metadata.MetadataContext.New()
+		if err := md.UnmarshalBinary(result.Metadata); err != nil {
+			continue
+		}
+		for _, code := range md.Protocols() {
+			location, ok := md.Get(code).(*metadata.LocationCommitmentMetadata)
+			if !ok {
+				continue
+			}
+			claimURL, err := is.fetchClaimURL(ctx, *result.Provider, location.Claim)
+			if err != nil {
+				continue
+			}
+			claim, err := is.claimLookup.LookupClaim(ctx, location.Claim, *claimURL)
+			if err != nil {
+				log.Debugw("fetching index location", "index", index, "error", err)
+				continue
+			}
+			shard := index
+			if location.Shard != nil {
+				shard = *location.Shard
+			}
+			urls, err := is.indexURLs(ctx, *result.Provider, shard, location, claim)
+			if err != nil {
+				continue
+			}
+			if is.expansion != nil {
+				view, err := is.expandClaimedIndex(ctx, contextID, result, shard, urls, location)
+				if err != nil {
+					log.Debugw("expanding claimed index", "index", index, "error", err)
+					continue
+				}
+				return view, nil
+			}
+			for _, u := range urls {
+				view, err := is.blobIndexLookup.Find(ctx, contextID, result, u, location.Range)
+				if err != nil {
+					log.Debugw("fetching claimed index", "index", index, "url", u.Redacted(), "error", err)
+					continue
+				}
+				return view, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrIndexNotLocated, index)
+}
+
+// linkCid returns the CID of a link of a claim's caveats
+func linkCid(l ipld.Link) (cid.Cid, error) {
+	if cl, ok := l.(cidlink.Link); ok {
+		return cl.Cid, nil
+	}
+	return cid.Parse(l.String())
+}
@@ -0,0 +1,383 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/maurl"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/go-ucanto/validator"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	adm "github.com/storacha/indexing-service/pkg/capability/assert/datamodel"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/providerresults"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimevents"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// failingTransport fails every request, so that nothing is fetched over HTTP
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return nil, errors.New("fetching disabled")
+}
+
+// publishFixture is a service recording the claims published or cached through
+// it as its own provider, in a provider index over an in-memory store. Claims
+// are never fetched, only read from the claim cache
+type publishFixture struct {
+	provider peer.AddrInfo
+	store    *mockProviderStore
+	claims   *mockClaimStore
+	indexes  *mockBlobIndexLookup
+	// providers is the store of the provider index, f.store if not set
+	providers types.ProviderStore
+}
+
+func newPublishFixture(t *testing.T) *publishFixture {
+	claimsURL := testutil.Must(url.Parse("https://claims.example/claims/{claim}"))(t)
+	return &publishFixture{
+		provider: peer.AddrInfo{ID: testutil.RandomPeer(), Addrs: []multiaddr.Multiaddr{testutil.Must(maurl.FromURL(claimsURL))(t)}},
+		store:    &mockProviderStore{results: map[string][]model.ProviderResult{}},
+		claims:   newMockClaimStore(),
+		indexes:  &mockBlobIndexLookup{},
+	}
+}
+
+func (f *publishFixture) service(t *testing.T, opts ...service.Option) *service.IndexingService {
+	var providers types.ProviderStore = f.store
+	if f.providers != nil {
+		providers = f.providers
+	}
+	providerIndex := providerindex.NewProviderIndex(providers, &countingFinder{results: map[string][]model.ProviderResult{}, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+	claimLookup := claimlookup.WithCache(claimlookup.NewClaimLookup(&http.Client{Transport: failingTransport{}}), f.claims)
+	opts = append([]service.Option{service.WithClaimProvider(f.provider), service.WithClaimCache(f.claims)}, opts...)
+	return testutil.Must(service.NewIndexingService(f.indexes, claimLookup, providerIndex, opts...))(t)
+}
+
+// records returns the records stored for the hash, with their metadata decoded
+func (f *publishFixture) records(t *testing.T, hash multihash.Multihash) ([]model.ProviderResult, []any) {
+	results, err := f.store.Get(context.Background(), hash)
+	if errors.Is(err, types.ErrKeyNotFound) {
+		return nil, nil
+	}
+	require.NoError(t, err)
+	var protocols []any
+	for _, result := range results {
+		md := metadata.MetadataContext.New()
+		require.NoError(t, md.UnmarshalBinary(result.Metadata))
+		for _, code := range md.Protocols() {
+			protocols = append(protocols, md.Get(code))
+		}
+	}
+	return results, protocols
+}
+
+func equalsDelegation(t *testing.T, content multihash.Multihash, equals cid.Cid) delegation.Delegation {
+	claim := assert.Equals.New(testutil.Service.DID().String(), assert.EqualsCaveats{
+		Content: assert.FromHash(content),
+		Equals:  cidlink.Link{Cid: equals},
+	})
+	return testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.EqualsCaveats]{claim}))(t)
+}
+
+func indexDelegation(t *testing.T, content cid.Cid, index cid.Cid) delegation.Delegation {
+	claim := assert.Index.New(testutil.Service.DID().String(), assert.IndexCaveats{
+		Content: cidlink.Link{Cid: content},
+		Index:   cidlink.Link{Cid: index},
+	})
+	return testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.IndexCaveats]{claim}))(t)
+}
+
+func TestIndexingService__PublishClaim(t *testing.T) {
+	ctx := context.Background()
+	space := testutil.Service.DID()
+
+	t.Run("location commitments are recorded on their content for their space", func(t *testing.T) {
+		f := newPublishFixture(t)
+		content := testutil.RandomMultihash()
+		length := uint64(100)
+		claim := testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.LocationCaveats]{
+			assert.Location.New(space.String(), assert.LocationCaveats{
+				Content:  assert.FromHash(content),
+				Location: []url.URL{*testutil.TestURL},
+				Range:    &adm.Range{Offset: 10, Length: &length},
+			}),
+		}, delegation.WithExpiration(1900000000)))(t)
+		require.NoError(t, f.service(t).PublishClaim(ctx, claim))
+
+		results, protocols := f.records(t, content)
+		require.Len(t, results, 1)
+		require.Equal(t, f.provider.ID, results[0].Provider.ID)
+		require.Equal(t, testutil.Must(types.DefaultContextIDCodec.Encode(types.ContextID{Space: &space, Hash: content}))(t), types.EncodedContextID(results[0].ContextID))
+		require.Equal(t, []any{&metadata.LocationCommitmentMetadata{
+			Range:      &metadata.Range{Offset: 10, Length: &length},
+			Expiration: 1900000000,
+			Claim:      asCid(claim),
+		}}, protocols)
+	})
+
+	t.Run("equals claims are recorded on both sides under the content", func(t *testing.T) {
+		f := newPublishFixture(t)
+		content, equals := testutil.RandomMultihash(), testutil.RandomCID().(cidlink.Link).Cid
+		claim := equalsDelegation(t, content, equals)
+		require.NoError(t, f.service(t).PublishClaim(ctx, claim))
+
+		for _, hash := range []multihash.Multihash{content, equals.Hash()} {
+			results, protocols := f.records(t, hash)
+			require.Len(t, results, 1)
+			require.Equal(t, []byte(content), results[0].ContextID)
+			require.Equal(t, []any{&metadata.EqualsClaimMetadata{Equals: equals, Expiration: int64(*claim.Expiration()), Claim: asCid(claim)}}, protocols)
+		}
+	})
+
+	t.Run("index claims are recorded on the multihashes of the located index", func(t *testing.T) {
+		f := newPublishFixture(t)
+		content := testutil.RandomCID().(cidlink.Link).Cid
+		indexCid := testutil.RandomCID().(cidlink.Link).Cid
+		shard, slice := testutil.RandomMultihash(), testutil.RandomMultihash()
+		index := blobindex.NewShardedDagIndexView(cidlink.Link{Cid: content}, 1)
+		index.SetSlice(shard, slice, blobindex.Position{Offset: 0, Length: 10})
+		f.indexes.index = index
+		is := f.service(t)
+
+		claim := indexDelegation(t, content, indexCid)
+		require.ErrorIs(t, is.PublishClaim(ctx, claim), service.ErrIndexNotLocated)
+
+		// once the index has a location, the claim can be published
+		location := locationsDelegation(t, indexCid.Hash(), testutil.Must(url.Parse("https://blobs.example/index"))(t))
+		require.NoError(t, is.CacheClaim(ctx, location))
+		require.NoError(t, is.PublishClaim(ctx, claim))
+		require.Equal(t, []string{"https://blobs.example/index"}, f.indexes.urls)
+		for _, hash := range []multihash.Multihash{shard, slice} {
+			results, protocols := f.records(t, hash)
+			require.Len(t, results, 1)
+			require.Equal(t, []byte(indexCid.Hash()), results[0].ContextID)
+			require.Equal(t, []any{&metadata.IndexClaimMetadata{Index: indexCid, Expiration: int64(*claim.Expiration()), Claim: asCid(claim)}}, protocols)
+		}
+	})
+
+	t.Run("cached claims are cached but not published", func(t *testing.T) {
+		f := newPublishFixture(t)
+		claim := testutil.RandomLocationDelegation()
+		require.NoError(t, f.service(t).CacheClaim(ctx, claim))
+		content := parseLocation(t, claim)
+		results, _ := f.records(t, content)
+		require.Len(t, results, 1)
+		require.Equal(t, f.provider.ID, results[0].Provider.ID)
+	})
+
+	t.Run("claims can't be recorded without a provider", func(t *testing.T) {
+		is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), &mockProviderIndex{}))(t)
+		require.ErrorIs(t, is.PublishClaim(ctx, testutil.RandomLocationDelegation()), service.ErrNoClaimProvider)
+		require.ErrorIs(t, is.CacheClaim(ctx, testutil.RandomLocationDelegation()), service.ErrNoClaimProvider)
+	})
+
+	t.Run("other claims are rejected", func(t *testing.T) {
+		f := newPublishFixture(t)
+		claim := testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[ucan.NoCaveats]{
+			ucan.NewCapability("assert/partition", space.String(), ucan.NoCaveats{}),
+		}))(t)
+		require.ErrorIs(t, f.service(t).PublishClaim(ctx, claim), service.ErrUnrecognizedClaim)
+	})
+}
+
+func TestIndexingService__RepublishClaim(t *testing.T) {
+	// a retried publish of a claim through the service adds nothing to the
+	// advertisement chain
+	ctx := context.Background()
+	f := newPublishFixture(t)
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	adverts := publisher.New(dssync.MutexWrap(datastore.NewMapDatastore()), key)
+	providerIndex := providerindex.NewProviderIndex(f.store, &countingFinder{results: map[string][]model.ProviderResult{}, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil,
+		providerindex.WithAdvertisementPublisher(adverts))
+	is := testutil.Must(service.NewIndexingService(f.indexes, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex, service.WithClaimProvider(f.provider)))(t)
+
+	claim := testutil.RandomLocationDelegation()
+	require.NoError(t, is.PublishClaim(ctx, claim))
+	head := testutil.Must(adverts.Head(ctx))(t)
+	require.NoError(t, is.PublishClaim(ctx, claim))
+	require.Equal(t, head, testutil.Must(adverts.Head(ctx))(t))
+	summary := testutil.Must(adverts.ChainSummary(ctx))(t)
+	require.Equal(t, uint64(1), summary.Adverts)
+}
+
+func TestIndexingService__PublishThenQuery(t *testing.T) {
+	ctx := context.Background()
+	f := newPublishFixture(t)
+	content := testutil.RandomCID().(cidlink.Link).Cid
+	indexCid := testutil.RandomCID().(cidlink.Link).Cid
+	shard, slice := testutil.RandomMultihash(), testutil.RandomMultihash()
+	index := blobindex.NewShardedDagIndexView(cidlink.Link{Cid: content}, 1)
+	index.SetSlice(shard, slice, blobindex.Position{Offset: 0, Length: 10})
+	f.indexes.index = index
+	is := f.service(t)
+
+	indexLocation := locationsDelegation(t, indexCid.Hash(), testutil.Must(url.Parse("https://blobs.example/index"))(t))
+	shardLocation := locationsDelegation(t, shard, testutil.Must(url.Parse("https://blobs.example/shard"))(t))
+	indexClaim := indexDelegation(t, content, indexCid)
+	require.NoError(t, is.PublishClaim(ctx, indexLocation))
+	require.NoError(t, is.PublishClaim(ctx, shardLocation))
+	require.NoError(t, is.PublishClaim(ctx, indexClaim))
+
+	// claims are never fetched, so every claim found was written through to the
+	// claim cache when it was published
+	qr := testutil.Must(is.Query(ctx, service.Query{Hashes: []multihash.Multihash{slice}}))(t)
+	claims := make([]cid.Cid, 0, len(qr.Claims()))
+	for _, link := range qr.Claims() {
+		claims = append(claims, link.(cidlink.Link).Cid)
+	}
+	require.ElementsMatch(t, []cid.Cid{asCid(indexClaim), asCid(indexLocation), asCid(shardLocation)}, claims)
+	require.Len(t, qr.Indexes(), 1)
+}
+
+// seenProviderStore is a provider store that keeps when each record was last
+// seen
+type seenProviderStore struct {
+	*mockProviderStore
+	records map[string][]providerresults.Record
+}
+
+func (m *seenProviderStore) GetRecords(ctx context.Context, hash multihash.Multihash) ([]providerresults.Record, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	records, ok := m.records[string(hash)]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return records, nil
+}
+
+func (m *seenProviderStore) SetRecords(ctx context.Context, hash multihash.Multihash, records []providerresults.Record, expires bool) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.records[string(hash)] = records
+	m.results[string(hash)] = providerresults.Results(records)
+	return nil
+}
+
+func TestIndexingService__PublishThenQueryMaxProviderAge(t *testing.T) {
+	ctx := context.Background()
+	for _, publish := range []string{"published", "cached"} {
+		t.Run(publish+" claims have been seen", func(t *testing.T) {
+			f := newPublishFixture(t)
+			f.providers = &seenProviderStore{mockProviderStore: f.store, records: map[string][]providerresults.Record{}}
+			is := f.service(t)
+			claim := testutil.RandomLocationDelegation()
+			if publish == "published" {
+				require.NoError(t, is.PublishClaim(ctx, claim))
+			} else {
+				require.NoError(t, is.CacheClaim(ctx, claim))
+			}
+
+			qr := testutil.Must(is.Query(ctx, service.Query{Hashes: []multihash.Multihash{parseLocation(t, claim)}, MaxProviderAge: time.Hour}))(t)
+			require.Len(t, qr.Claims(), 1)
+			require.Equal(t, asCid(claim), qr.Claims()[0].(cidlink.Link).Cid)
+		})
+	}
+}
+
+type eventReceiver struct {
+	lk     sync.Mutex
+	claims []string
+}
+
+func (r *eventReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var evt map[string]any
+	if err := json.NewDecoder(req.Body).Decode(&evt); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.claims = append(r.claims, evt["claim"].(string))
+}
+
+func (r *eventReceiver) received() []string {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return append([]string(nil), r.claims...)
+}
+
+func TestIndexingService__ClaimEvents(t *testing.T) {
+	ctx := context.Background()
+	f := newPublishFixture(t)
+	rcv := &eventReceiver{}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+	webhook := testutil.Must(claimevents.NewWebhook([]string{server.URL}, dssync.MutexWrap(datastore.NewMapDatastore()),
+		claimevents.WithPollInterval(5*time.Millisecond)))(t)
+	webhook.Startup()
+	defer webhook.Shutdown(ctx)
+	is := f.service(t, service.WithClaimWebhook(webhook))
+	events, unsubscribe := is.SubscribeClaims(ctx)
+	defer unsubscribe()
+
+	published := testutil.RandomLocationDelegation()
+	cached := testutil.RandomLocationDelegation()
+	equals := equalsDelegation(t, testutil.RandomMultihash(), testutil.RandomCID().(cidlink.Link).Cid)
+	require.NoError(t, is.PublishClaim(ctx, published))
+	require.NoError(t, is.CacheClaim(ctx, cached))
+	require.NoError(t, is.PublishClaim(ctx, equals))
+	// a failed publish has no event
+	require.Error(t, is.PublishClaim(ctx, indexDelegation(t, testutil.RandomCID().(cidlink.Link).Cid, testutil.RandomCID().(cidlink.Link).Cid)))
+
+	expected := []struct {
+		claim     delegation.Delegation
+		hashCount int
+	}{{published, 1}, {cached, 1}, {equals, 2}}
+	var claims []string
+	for _, e := range expected {
+		select {
+		case evt := <-events:
+			require.Equal(t, asCid(e.claim), evt.Claim)
+			require.Equal(t, e.claim.Capabilities()[0].Can(), evt.Type)
+			require.Equal(t, &f.provider.ID, evt.Provider)
+			require.Equal(t, e.hashCount, evt.HashCount)
+			require.Equal(t, testutil.Must(did.Parse(e.claim.Capabilities()[0].With()))(t), *evt.Space)
+		case <-time.After(time.Second):
+			t.Fatal("claim event not delivered")
+		}
+		claims = append(claims, asCid(e.claim).String())
+	}
+	select {
+	case evt := <-events:
+		t.Fatalf("unexpected event for %s", evt.Claim)
+	default:
+	}
+
+	require.Eventually(t, func() bool { return len(rcv.received()) == len(claims) }, time.Second, 5*time.Millisecond)
+	require.Equal(t, claims, rcv.received())
+}
+
+// parseLocation returns the content of a location commitment
+func parseLocation(t *testing.T, claim delegation.Delegation) multihash.Multihash {
+	match, fail := assert.Location.Match(validator.NewSource(claim.Capabilities()[0], claim))
+	require.Nil(t, fail)
+	return match.Value().Nb().Content.Hash()
+}
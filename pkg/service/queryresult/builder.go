@@ -0,0 +1,109 @@
+package queryresult
+
+import (
+	"iter"
+	"maps"
+
+	"github.com/ipfs/go-cid"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/bytemap"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// Map is a read-only map in a query result, safe to read from several
+// goroutines at once
+type Map[K comparable, V any] struct {
+	m map[K]V
+}
+
+// Get returns the value for the key, and whether there is one
+func (m Map[K, V]) Get(k K) (V, bool) {
+	v, ok := m.m[k]
+	return v, ok
+}
+
+// Len returns the number of keys in the map
+func (m Map[K, V]) Len() int {
+	return len(m.m)
+}
+
+// All iterates the keys and values of the map, in no particular order
+func (m Map[K, V]) All() iter.Seq2[K, V] {
+	return maps.All(m.m)
+}
+
+// Clone returns a copy of the map that can be changed, or nil if the map is
+// empty and was never set
+func (m Map[K, V]) Clone() map[K]V {
+	return maps.Clone(m.m)
+}
+
+// Builder collects the parts of a query result while a query walks, to build
+// an immutable QueryResult from once the walk is complete. A builder is not safe
+// for concurrent use, but the results it builds share none of its state
+type Builder struct {
+	Claims    map[cid.Cid]delegation.Delegation
+	Indexes   bytemap.ByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView]
+	IndexRefs bytemap.ByteMap[types.EncodedContextID, IndexRef]
+	// Confirmed are the claims the query already knew, which were found again
+	Confirmed   map[cid.Cid]struct{}
+	Diagnostics map[string]HashDiagnosis
+	Probes      map[string]LocationProbe
+	HashResults map[string]HashResult
+	// SupersededBy are the newest live claims replacing the superseded index
+	// claims kept in the result, keyed by the CID of the superseded claim
+	SupersededBy map[cid.Cid]cid.Cid
+	Stats        Stats
+}
+
+// NewBuilder returns an empty builder
+func NewBuilder() *Builder {
+	return &Builder{
+		Claims:    map[cid.Cid]delegation.Delegation{},
+		Indexes:   bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1),
+		IndexRefs: bytemap.NewByteMap[types.EncodedContextID, IndexRef](-1),
+		Confirmed: map[cid.Cid]struct{}{},
+	}
+}
+
+// ConfirmedClaims lists the confirmed claims
+func (b *Builder) ConfirmedClaims() []cid.Cid {
+	confirmed := make([]cid.Cid, 0, len(b.Confirmed))
+	for c := range b.Confirmed {
+		confirmed = append(confirmed, c)
+	}
+	return confirmed
+}
+
+// Build generates a new encodable QueryResult from the parts collected so far
+func (b *Builder) Build() (QueryResult, error) {
+	return Build(b.Claims, b.Indexes, WithConfirmed(b.ConfirmedClaims()...), WithIndexRefs(b.IndexRefs), WithDiagnostics(b.Diagnostics), WithProbes(b.Probes), WithHashResults(b.HashResults), WithSupersededBy(b.SupersededBy), WithStats(b.Stats))
+}
+
+// Clone returns a builder holding copies of the parts of the result, for
+// callers that need to change them. Claims and indexes are decoded from the
+// blocks of the result
+func (q *queryResult) Clone() (*Builder, error) {
+	claims, indexes, err := Parts(q)
+	if err != nil {
+		return nil, err
+	}
+	b := &Builder{
+		Claims:       claims,
+		Indexes:      indexes,
+		IndexRefs:    bytemap.Clone(q.IndexReferences()),
+		Confirmed:    make(map[cid.Cid]struct{}, len(q.data.Confirmed)),
+		Diagnostics:  maps.Clone(q.diagnostics),
+		Probes:       maps.Clone(q.probes),
+		HashResults:  maps.Clone(q.hashResults),
+		SupersededBy: maps.Clone(q.supersededBy),
+		Stats:        q.stats.clone(),
+	}
+	for _, link := range q.data.Confirmed {
+		if c, err := cid.Parse(link.String()); err == nil {
+			b.Confirmed[c] = struct{}{}
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,155 @@
+package queryresult_test
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func newBuilder(t *testing.T) *queryresult.Builder {
+	b := queryresult.NewBuilder()
+	for range 4 {
+		claim := testutil.RandomLocationDelegation()
+		b.Claims[claim.Link().(cidlink.Link).Cid] = claim
+	}
+	_, index := testutil.RandomShardedDagIndexView(4)
+	contextID := types.EncodedContextID(testutil.RandomMultihash())
+	b.Indexes.Set(contextID, index)
+	b.IndexRefs.Set(contextID, queryresult.IndexRef{Index: testutil.RandomCID().(cidlink.Link).Cid, Provider: peer.ID("provider")})
+	b.Confirmed[testutil.RandomCID().(cidlink.Link).Cid] = struct{}{}
+	b.Diagnostics = map[string]queryresult.HashDiagnosis{"hash": {Outcome: queryresult.OutcomeUnknown}}
+	b.Probes = map[string]queryresult.LocationProbe{"https://example.com/blob": {Status: queryresult.ProbeLive}}
+	b.Stats = queryresult.Stats{Jobs: 3, CacheHits: map[string]int{types.ClaimsCache: 2}, WallTime: time.Second}
+	return b
+}
+
+func TestBuilder(t *testing.T) {
+	b := newBuilder(t)
+	qr := testutil.Must(b.Build())(t)
+
+	t.Run("results share none of the builder's state", func(t *testing.T) {
+		claim := testutil.RandomLocationDelegation()
+		b.Claims[claim.Link().(cidlink.Link).Cid] = claim
+		b.IndexRefs.Set(types.EncodedContextID("other"), queryresult.IndexRef{})
+		b.Diagnostics["other"] = queryresult.HashDiagnosis{Outcome: queryresult.OutcomeFiltered}
+		b.Probes["https://other.example/blob"] = queryresult.LocationProbe{Status: queryresult.ProbeFailed}
+		b.Stats.CacheHits[types.IndexesCache] = 1
+
+		require.Len(t, qr.Claims(), 4)
+		require.Equal(t, 4, qr.ClaimSummaries().Len())
+		require.Equal(t, 1, qr.IndexReferences().Size())
+		require.Equal(t, 1, qr.HashDiagnoses().Len())
+		require.Equal(t, 1, qr.LocationProbes().Len())
+		require.Len(t, qr.Stats().CacheHits, 1)
+	})
+
+	t.Run("deprecated accessors return copies", func(t *testing.T) {
+		delete(qr.Summaries(), qr.Claims()[0].(cidlink.Link).Cid)
+		qr.IndexRefs().Set(types.EncodedContextID("other"), queryresult.IndexRef{})
+		qr.Diagnostics()["other"] = queryresult.HashDiagnosis{}
+		qr.Probes()["https://other.example/blob"] = queryresult.LocationProbe{}
+		qr.Claims()[0] = nil
+
+		require.NotNil(t, qr.Claims()[0])
+		require.Equal(t, 4, qr.ClaimSummaries().Len())
+		require.Equal(t, 1, qr.IndexReferences().Size())
+		require.Equal(t, 1, qr.HashDiagnoses().Len())
+		require.Equal(t, 1, qr.LocationProbes().Len())
+	})
+
+	t.Run("clone", func(t *testing.T) {
+		clone := testutil.Must(qr.Clone())(t)
+		require.Len(t, clone.Claims, 4)
+		require.Equal(t, 1, clone.Indexes.Size())
+		require.Equal(t, 1, clone.IndexRefs.Size())
+		require.Len(t, clone.Confirmed, 1)
+		require.Equal(t, qr.HashDiagnoses().Clone(), clone.Diagnostics)
+		require.Equal(t, qr.LocationProbes().Clone(), clone.Probes)
+		require.Equal(t, qr.Stats(), clone.Stats)
+
+		clone.Probes["https://other.example/blob"] = queryresult.LocationProbe{Status: queryresult.ProbeFailed}
+		rebuilt := testutil.Must(clone.Build())(t)
+		require.ElementsMatch(t, qr.Claims(), rebuilt.Claims())
+		require.ElementsMatch(t, qr.Indexes(), rebuilt.Indexes())
+		require.Equal(t, 2, rebuilt.LocationProbes().Len())
+		require.Equal(t, 1, qr.LocationProbes().Len())
+	})
+}
+
+// TestQueryResult__ConcurrentReaders is meant to be run with the race detector
+func TestQueryResult__ConcurrentReaders(t *testing.T) {
+	qr := testutil.Must(newBuilder(t).Build())(t)
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			claims := map[cid.Cid]struct{}{}
+			for _, link := range qr.Claims() {
+				claims[link.(cidlink.Link).Cid] = struct{}{}
+			}
+			for c, summary := range qr.ClaimSummaries().All() {
+				require.Contains(t, claims, c)
+				require.Equal(t, "assert/location", summary.Type)
+			}
+			for contextID := range qr.IndexReferences().Iterator() {
+				require.True(t, qr.IndexReferences().Has(contextID))
+			}
+			d, ok := qr.HashDiagnoses().Get("hash")
+			require.True(t, ok)
+			require.Equal(t, queryresult.OutcomeUnknown, d.Outcome)
+			require.Len(t, qr.Indexes(), 1)
+			for range qr.Blocks() {
+			}
+
+			// copies are the reader's own to change
+			summaries := qr.Summaries()
+			for c := range summaries {
+				delete(summaries, c)
+			}
+			refs := qr.IndexRefs()
+			refs.Set(types.EncodedContextID("other"), queryresult.IndexRef{})
+			probes := qr.Probes()
+			probes["https://other.example/blob"] = queryresult.LocationProbe{}
+			clone := testutil.Must(qr.Clone())(t)
+			clone.Diagnostics["other"] = queryresult.HashDiagnosis{}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 4, qr.ClaimSummaries().Len())
+	require.Equal(t, 1, qr.IndexReferences().Size())
+	require.Equal(t, 1, qr.LocationProbes().Len())
+}
+
+func TestStats(t *testing.T) {
+	stats := queryresult.Stats{
+		Jobs:            3,
+		CacheHits:       map[string]int{types.ProvidersCache: 1, types.ClaimsCache: 1},
+		CacheMisses:     map[string]int{types.ProvidersCache: 2},
+		Fetches:         map[string]int{types.FetchIPNI: 2, types.FetchIndex: 1},
+		IndexesExpanded: 1,
+		WallTime:        1500 * time.Microsecond,
+		Truncated:       []string{"maxFindRecords"},
+	}
+	require.Equal(t, "jobs=3; hits=2; misses=2; fetches=3; expanded=1; wall=2ms; truncated=maxFindRecords", stats.String())
+	require.JSONEq(t, `{
+		"jobs": 3,
+		"cacheHits": {"providers": 1, "claims": 1},
+		"cacheMisses": {"providers": 2},
+		"fetches": {"ipni": 2, "index": 1},
+		"indexesExpanded": 1,
+		"wallTime": "1.5ms",
+		"truncated": ["maxFindRecords"]
+	}`, string(testutil.Must(json.Marshal(stats))(t)))
+
+	require.Equal(t, "jobs=0; hits=0; misses=0; fetches=0; expanded=0; wall=0s", queryresult.Stats{}.String())
+}
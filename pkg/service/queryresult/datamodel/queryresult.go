@@ -37,6 +37,12 @@ type QueryResultModel struct {
 type QueryResultModel0_1 struct {
 	Claims  []ipld.Link
 	Indexes *IndexesModel
+	// Confirmed are claims the query already knew, which were found again but
+	// not included in the result
+	Confirmed []ipld.Link
+	// IndexRefs point to the indexes of the index claims found, whether or not
+	// the indexes could be fetched
+	IndexRefs *IndexRefsModel
 }
 
 // IndexesModel maps encoded context IDs to index links
@@ -44,3 +50,16 @@ type IndexesModel struct {
 	Keys   []string
 	Values map[string]ipld.Link
 }
+
+// IndexRefsModel maps encoded context IDs to references to indexes
+type IndexRefsModel struct {
+	Keys   []string
+	Values map[string]IndexRefModel
+}
+
+// IndexRefModel points to the index an index claim is for
+type IndexRefModel struct {
+	Index    ipld.Link
+	Provider string
+	Error    *string
+}
@@ -0,0 +1,18 @@
+package datamodel_test
+
+import (
+	"testing"
+
+	"github.com/ipld/go-ipld-prime/schema"
+	"github.com/storacha/indexing-service/pkg/service/queryresult/datamodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryResultType(t *testing.T) {
+	// a union without a representation doesn't parse, and the package panics as
+	// it loads the schema
+	union, ok := datamodel.QueryResultType().(*schema.TypeUnion)
+	require.True(t, ok)
+	_, keyed := union.RepresentationStrategy().(schema.UnionRepresentation_Keyed)
+	require.True(t, keyed)
+}
@@ -0,0 +1,123 @@
+package queryresult
+
+// Outcome sums up why a queried hash found no claims
+type Outcome string
+
+const (
+	// OutcomeUnknown is for hashes no provider records were found for at all
+	OutcomeUnknown Outcome = "unknown"
+	// OutcomeFiltered is for hashes with provider records, none of which were
+	// for the claim types or spaces queried
+	OutcomeFiltered Outcome = "filtered"
+	// OutcomeProvidersSkipped is for hashes whose matching provider records were
+	// all skipped, by the deny list, address policy or query limits
+	OutcomeProvidersSkipped Outcome = "providers-skipped"
+	// OutcomeFetchFailed is for hashes whose claims could not be fetched from
+	// any provider
+	OutcomeFetchFailed Outcome = "fetch-failed"
+	// OutcomeNoClaims is for hashes whose provider records didn't lead to any
+	// claims, such as records for unregistered claim protocols
+	OutcomeNoClaims Outcome = "no-claims"
+	// OutcomeUnsupportedIndex is for hashes with indexes of versions the service
+	// can't read, whether or not other claims were found for them. Reading them
+	// takes upgrading the service
+	OutcomeUnsupportedIndex Outcome = "unsupported-index"
+)
+
+// HashDiagnosis describes how a query walked a hash it found no claims for, or
+// whose indexes were of versions that can't be read. Hashes are base58btc
+// multibase strings
+type HashDiagnosis struct {
+	Outcome Outcome `json:"outcome"`
+	// Lookups are the provider record lookups made for the hash, and for the
+	// hashes followed on its behalf, in the order they were made
+	Lookups []LookupDiagnosis `json:"lookups,omitempty"`
+	// Skipped are the providers whose records were not used
+	Skipped []SkippedProvider `json:"skipped,omitempty"`
+	// Fetches are the claims fetches attempted for the hash
+	Fetches []ClaimFetch `json:"fetches,omitempty"`
+	// Limits are the query limits that left out records or claims
+	Limits []string `json:"limits,omitempty"`
+	// Mismatches are the provider records whose metadata disagreed with the
+	// claim they are for
+	Mismatches []MetadataMismatch `json:"mismatches,omitempty"`
+	// UnsupportedIndexes are the indexes of versions that can't be read
+	UnsupportedIndexes []UnsupportedIndex `json:"unsupportedIndexes,omitempty"`
+}
+
+// LookupDiagnosis is a lookup of the provider records for a hash
+type LookupDiagnosis struct {
+	Hash    string `json:"hash"`
+	JobType string `json:"jobType"`
+	// Source is where the records were read from: the cache, IPNI, or the legacy
+	// systems when IPNI had none
+	Source string `json:"source"`
+	// Records is the number of records before filtering by claim type
+	Records int `json:"records"`
+	// ClaimMatches is the number of records for the claim types looked up
+	ClaimMatches int `json:"claimMatches"`
+	// Matches is the number of records left after filtering by space
+	Matches int `json:"matches"`
+	// Unscoped is the number of the matches admitted only because they are
+	// location commitments not scoped to a space
+	Unscoped int `json:"unscoped,omitempty"`
+	// Truncated is set when IPNI had more records for the hash than were kept
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// SkippedProvider is a provider whose record for a hash was not used
+type SkippedProvider struct {
+	Hash     string `json:"hash"`
+	Provider string `json:"provider"`
+	Reason   string `json:"reason"`
+}
+
+// ClaimFetch is an attempt to fetch a claim, which failed if Error is set.
+// NotCached is set for a claim that was fetched but not admitted to the claim
+// cache
+type ClaimFetch struct {
+	Hash      string `json:"hash"`
+	Claim     string `json:"claim"`
+	Error     string `json:"error,omitempty"`
+	NotCached bool   `json:"notCached,omitempty"`
+}
+
+// MetadataMismatch is a provider record for a hash whose location commitment
+// metadata disagreed with its claim, in the fields named
+type MetadataMismatch struct {
+	Hash     string   `json:"hash"`
+	Provider string   `json:"provider"`
+	Claim    string   `json:"claim"`
+	Fields   []string `json:"fields"`
+}
+
+// UnsupportedIndex is an index of a hash, with the provider it was fetched
+// for, whose version can't be read
+type UnsupportedIndex struct {
+	Hash     string `json:"hash"`
+	Provider string `json:"provider"`
+	// Version is the version of the index
+	Version string `json:"version"`
+	// Supported are the versions that can be read
+	Supported []string `json:"supported"`
+}
+
+// WithDiagnostics includes diagnoses of queried hashes that found no claims in
+// the result, keyed by the base58btc multibase string of the hash
+func WithDiagnostics(diagnostics map[string]HashDiagnosis) Option {
+	return func(c *config) {
+		c.diagnostics = diagnostics
+	}
+}
+
+// HashDiagnoses returns the diagnoses of queried hashes that found no claims,
+// if the query asked for them
+func (q *queryResult) HashDiagnoses() Map[string, HashDiagnosis] {
+	return Map[string, HashDiagnosis]{q.diagnostics}
+}
+
+// Diagnostics returns a copy of the diagnoses of queried hashes that found no
+// claims, if the query asked for them
+func (q *queryResult) Diagnostics() map[string]HashDiagnosis {
+	return q.HashDiagnoses().Clone()
+}
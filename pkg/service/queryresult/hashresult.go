@@ -0,0 +1,37 @@
+package queryresult
+
+import (
+	"github.com/ipfs/go-cid"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// HashResult is what a query found for an alias cluster: a queried hash along
+// with the hashes equivalent to it through equals claims, attributed to the
+// canonical hash of the cluster. Hashes are base58btc multibase strings
+type HashResult struct {
+	// Aliases are the other hashes of the cluster, in order
+	Aliases []string
+	// Claims are the claims found for any hash of the cluster
+	Claims []cid.Cid
+	// Indexes are the context IDs of the indexes found for any hash of the
+	// cluster
+	Indexes []types.EncodedContextID
+	// IndexRefs are the context IDs of the index claims found for any hash of
+	// the cluster, whether or not their indexes could be fetched
+	IndexRefs []types.EncodedContextID
+}
+
+// WithHashResults includes what was found for each alias cluster of the queried
+// hashes in the result, keyed by the base58btc multibase string of the
+// canonical hash of the cluster
+func WithHashResults(results map[string]HashResult) Option {
+	return func(c *config) {
+		c.hashResults = results
+	}
+}
+
+// HashResults returns what was found for each alias cluster of the queried
+// hashes, if the query asked to canonicalize aliases
+func (q *queryResult) HashResults() Map[string, HashResult] {
+	return Map[string, HashResult]{q.hashResults}
+}
@@ -0,0 +1,97 @@
+package queryresult
+
+import (
+	"slices"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/indexing-service/pkg/internal/bytemap"
+	qdm "github.com/storacha/indexing-service/pkg/service/queryresult/datamodel"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// IndexRef points to the index an index claim is for. It is included in a
+// result whether or not the index could be fetched, so that callers can fetch
+// it themselves if the query couldn't
+type IndexRef struct {
+	// Index is the CID of the index
+	Index cid.Cid
+	// Provider is the provider of the index claim
+	Provider peer.ID
+	// Error is why fetching the index failed, if it was attempted and failed, or
+	// why it was not attempted
+	Error string
+}
+
+// WithIndexRefs includes references to the indexes of the index claims found
+// in the result, keyed by the context ID of the index claim
+func WithIndexRefs(refs bytemap.ReadOnlyByteMap[types.EncodedContextID, IndexRef]) Option {
+	return func(c *config) {
+		c.indexRefs = refs
+	}
+}
+
+// indexRefsModel encodes the references in order of context ID, so the same
+// references always encode the same way, or returns nil if there are none so
+// that the field is left out
+func indexRefsModel(refs bytemap.ReadOnlyByteMap[types.EncodedContextID, IndexRef]) *qdm.IndexRefsModel {
+	if refs == nil || refs.Size() == 0 {
+		return nil
+	}
+	m := &qdm.IndexRefsModel{
+		Keys:   make([]string, 0, refs.Size()),
+		Values: make(map[string]qdm.IndexRefModel, refs.Size()),
+	}
+	for contextID, ref := range refs.Iterator() {
+		model := qdm.IndexRefModel{Index: cidlink.Link{Cid: ref.Index}, Provider: ref.Provider.String()}
+		if ref.Error != "" {
+			model.Error = &ref.Error
+		}
+		m.Keys = append(m.Keys, string(contextID))
+		m.Values[string(contextID)] = model
+	}
+	slices.Sort(m.Keys)
+	return m
+}
+
+// IndexReferences returns the references to the indexes of the index claims
+// found, keyed by the context ID of the index claim. They are decoded on first
+// use and kept
+func (q *queryResult) IndexReferences() bytemap.ReadOnlyByteMap[types.EncodedContextID, IndexRef] {
+	q.indexRefsOnce.Do(func() {
+		q.indexRefs = bytemap.Freeze[types.EncodedContextID, IndexRef](q.decodeIndexRefs())
+	})
+	return q.indexRefs
+}
+
+// IndexRefs returns a copy of the references to the indexes of the index claims
+// found
+func (q *queryResult) IndexRefs() bytemap.ByteMap[types.EncodedContextID, IndexRef] {
+	return bytemap.Clone(q.IndexReferences())
+}
+
+func (q *queryResult) decodeIndexRefs() bytemap.ByteMap[types.EncodedContextID, IndexRef] {
+	refs := bytemap.NewByteMap[types.EncodedContextID, IndexRef](-1)
+	if q.data.IndexRefs == nil {
+		return refs
+	}
+	for _, contextID := range q.data.IndexRefs.Keys {
+		model, ok := q.data.IndexRefs.Values[contextID]
+		if !ok {
+			continue
+		}
+		var ref IndexRef
+		if l, ok := model.Index.(cidlink.Link); ok {
+			ref.Index = l.Cid
+		}
+		if id, err := peer.Decode(model.Provider); err == nil {
+			ref.Provider = id
+		}
+		if model.Error != nil {
+			ref.Error = *model.Error
+		}
+		refs.Set(types.EncodedContextID(contextID), ref)
+	}
+	return refs
+}
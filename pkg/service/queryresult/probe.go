@@ -0,0 +1,78 @@
+package queryresult
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ProbeStatus sums up whether a location URL responded to a liveness probe
+type ProbeStatus string
+
+const (
+	// ProbeLive is for URLs that responded with a success status
+	ProbeLive ProbeStatus = "live"
+	// ProbeFailed is for URLs that responded with an error status, or whose
+	// request failed outright
+	ProbeFailed ProbeStatus = "failed"
+	// ProbeTimeout is for URLs that didn't respond within the probe budget
+	ProbeTimeout ProbeStatus = "timeout"
+	// ProbeSkipped is for URLs that weren't probed, because the probe budget
+	// ran out first or the query was answered from cache alone
+	ProbeSkipped ProbeStatus = "skipped"
+	// ProbeCoolingDown is for URLs that weren't probed, because their host
+	// asked to be sent fewer requests and is being left alone for a while
+	ProbeCoolingDown ProbeStatus = "cooling-down"
+)
+
+// LocationProbe is the outcome of checking that a location URL responds. It
+// only annotates the locations of a result: claims whose URLs fail their
+// probes are not left out
+type LocationProbe struct {
+	Status ProbeStatus
+	// Code is the HTTP status code of the response, if there was one
+	Code int
+	// Latency is how long the URL took to respond
+	Latency time.Duration
+	// Error is why the request failed, if it did
+	Error string
+	// Cached is true if the outcome is that of a recent probe of the same URL
+	Cached bool
+}
+
+type locationProbeJSON struct {
+	Status  ProbeStatus `json:"status"`
+	Code    int         `json:"code,omitempty"`
+	Latency string      `json:"latency,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Cached  bool        `json:"cached,omitempty"`
+}
+
+// MarshalJSON encodes the probe with its latency as a duration string, and
+// leaves out fields that don't apply to its status
+func (p LocationProbe) MarshalJSON() ([]byte, error) {
+	body := locationProbeJSON{Status: p.Status, Code: p.Code, Error: p.Error, Cached: p.Cached}
+	if p.Latency > 0 {
+		body.Latency = p.Latency.String()
+	}
+	return json.Marshal(body)
+}
+
+// WithProbes includes the outcomes of liveness probes of the location URLs in
+// the result, keyed by URL
+func WithProbes(probes map[string]LocationProbe) Option {
+	return func(c *config) {
+		c.probes = probes
+	}
+}
+
+// LocationProbes returns the outcomes of liveness probes of the location URLs
+// in the result, keyed by URL, if the query asked for them
+func (q *queryResult) LocationProbes() Map[string, LocationProbe] {
+	return Map[string, LocationProbe]{q.probes}
+}
+
+// Probes returns a copy of the outcomes of liveness probes of the location URLs
+// in the result, if the query asked for them
+func (q *queryResult) Probes() map[string]LocationProbe {
+	return q.LocationProbes().Clone()
+}
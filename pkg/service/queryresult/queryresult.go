@@ -1,13 +1,21 @@
 package queryresult
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"iter"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime/datamodel"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	multihash "github.com/multiformats/go-multihash/core"
+	"github.com/storacha/go-ucanto/core/car"
 	"github.com/storacha/go-ucanto/core/dag/blockstore"
 	"github.com/storacha/go-ucanto/core/delegation"
 	"github.com/storacha/go-ucanto/core/ipld"
@@ -20,7 +28,10 @@ import (
 	"github.com/storacha/indexing-service/pkg/types"
 )
 
-// QueryResult is an encodable result of a query
+// QueryResult is an encodable result of a query. A result can't be changed
+// once built, so it is safe to read from several goroutines at once: the slices
+// and maps it returns are its own copies or read-only views. Callers that need
+// to change a result Clone it into a Builder and build a new one
 type QueryResult interface {
 	ipld.View
 	// Claims is a list of links to the root bock of claims that can be found in this message
@@ -28,12 +39,77 @@ type QueryResult interface {
 	// Indexes is a list of links to the CID hash of archived sharded dag indexes that can be found in this
 	// message
 	Indexes() []ipld.Link
+	// Confirmed is a list of links to claims the query already knew, which were
+	// found again but are not included in this message
+	Confirmed() []ipld.Link
+	// ClaimSummaries describes what each claim in this message asserts, keyed
+	// by the CID of the claim, so that callers don't need to decode the
+	// delegations
+	ClaimSummaries() Map[cid.Cid, ClaimSummary]
+	// IndexReferences points to the index of each index claim found, keyed by
+	// the context ID of the index claim, including indexes that could not be
+	// fetched
+	IndexReferences() bytemap.ReadOnlyByteMap[types.EncodedContextID, IndexRef]
+	// HashDiagnoses describes why queried hashes found no claims, keyed by the
+	// base58btc multibase string of the hash. It is only set if the query asked
+	// for diagnoses, and is not part of the encoded message
+	HashDiagnoses() Map[string, HashDiagnosis]
+	// HashResults attributes the claims and indexes found to the canonical hash
+	// of the alias cluster of each queried hash, keyed by the base58btc multibase
+	// string of the canonical hash. It is only set if the query asked to
+	// canonicalize aliases, and is not part of the encoded message
+	HashResults() Map[string, HashResult]
+	// LocationProbes are the outcomes of liveness probes of the location URLs
+	// in this message, keyed by URL. They are only set if the query asked for
+	// probes, and are not part of the encoded message
+	LocationProbes() Map[string, LocationProbe]
+	// Receipt is the service's signed attestation of the result, if the query
+	// asked for one. It is not part of the encoded message
+	Receipt() (Receipt, bool)
+	// Stats counts the work done to answer the query. They are set for every
+	// query, and are not part of the encoded message
+	Stats() Stats
+	// Clone returns a builder holding copies of the parts of the result, for
+	// callers that need to change them
+	Clone() (*Builder, error)
+
+	// Summaries returns a copy of ClaimSummaries.
+	//
+	// Deprecated: use ClaimSummaries. Summaries will be removed in the next
+	// release
+	Summaries() map[cid.Cid]ClaimSummary
+	// IndexRefs returns a copy of IndexReferences.
+	//
+	// Deprecated: use IndexReferences. IndexRefs will be removed in the next
+	// release
+	IndexRefs() bytemap.ByteMap[types.EncodedContextID, IndexRef]
+	// Diagnostics returns a copy of HashDiagnoses.
+	//
+	// Deprecated: use HashDiagnoses. Diagnostics will be removed in the next
+	// release
+	Diagnostics() map[string]HashDiagnosis
+	// Probes returns a copy of LocationProbes.
+	//
+	// Deprecated: use LocationProbes. Probes will be removed in the next
+	// release
+	Probes() map[string]LocationProbe
 }
 
 type queryResult struct {
 	root ipld.Block
 	data *qdm.QueryResultModel0_1
 	blks blockstore.BlockReader
+
+	summariesOnce sync.Once
+	summaries     map[cid.Cid]ClaimSummary
+	indexRefsOnce sync.Once
+	indexRefs     bytemap.ReadOnlyByteMap[types.EncodedContextID, IndexRef]
+
+	diagnostics  map[string]HashDiagnosis
+	probes       map[string]LocationProbe
+	hashResults  map[string]HashResult
+	supersededBy map[cid.Cid]cid.Cid
+	stats        Stats
 }
 
 var _ QueryResult = (*queryResult)(nil)
@@ -43,11 +119,14 @@ func (q *queryResult) Blocks() iter.Seq2[block.Block, error] {
 }
 
 func (q *queryResult) Claims() []datamodel.Link {
-	return q.data.Claims
+	return slices.Clone(q.data.Claims)
 }
 
 func (q *queryResult) Indexes() []datamodel.Link {
 	var indexes []ipld.Link
+	if q.data.Indexes == nil {
+		return indexes
+	}
 	for _, k := range q.data.Indexes.Keys {
 		l, ok := q.data.Indexes.Values[k]
 		if ok {
@@ -57,19 +136,68 @@ func (q *queryResult) Indexes() []datamodel.Link {
 	return indexes
 }
 
+func (q *queryResult) Confirmed() []datamodel.Link {
+	return slices.Clone(q.data.Confirmed)
+}
+
 func (q *queryResult) Root() block.Block {
 	return q.root
 }
 
+func (q *queryResult) Receipt() (Receipt, bool) {
+	return Receipt{}, false
+}
+
+type config struct {
+	confirmed    []cid.Cid
+	indexRefs    bytemap.ReadOnlyByteMap[types.EncodedContextID, IndexRef]
+	diagnostics  map[string]HashDiagnosis
+	probes       map[string]LocationProbe
+	hashResults  map[string]HashResult
+	supersededBy map[cid.Cid]cid.Cid
+	stats        Stats
+}
+
+// Option configures a built query result
+type Option func(*config)
+
+// WithConfirmed lists claims the query already knew in the result, without
+// including them
+func WithConfirmed(claims ...cid.Cid) Option {
+	return func(c *config) {
+		c.confirmed = append(c.confirmed, claims...)
+	}
+}
+
+// confirmedLinks are the links to the confirmed claims, or nil if there are
+// none so that the field is left out
+func confirmedLinks(confirmed []cid.Cid) []ipld.Link {
+	if len(confirmed) == 0 {
+		return nil
+	}
+	links := make([]ipld.Link, 0, len(confirmed))
+	for _, c := range confirmed {
+		links = append(links, cidlink.Link{Cid: c})
+	}
+	return links
+}
+
 // Build generates a new encodable QueryResult
-func Build(claims map[cid.Cid]delegation.Delegation, indexes bytemap.ByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView]) (QueryResult, error) {
+func Build(claims map[cid.Cid]delegation.Delegation, indexes bytemap.ByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView], opts ...Option) (QueryResult, error) {
+	var cfg config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 	bs, err := blockstore.NewBlockStore()
 	if err != nil {
 		return nil, err
 	}
 
+	// claims are written in the order of their CIDs, so that the blocks of the
+	// result are always in the same order
 	cls := []ipld.Link{}
-	for _, claim := range claims {
+	for _, c := range slices.SortedFunc(maps.Keys(claims), func(a, b cid.Cid) int { return strings.Compare(a.KeyString(), b.KeyString()) }) {
+		claim := claims[c]
 		cls = append(cls, claim.Link())
 
 		err := blockstore.WriteInto(claim, bs)
@@ -111,12 +239,18 @@ func Build(claims map[cid.Cid]delegation.Delegation, indexes bytemap.ByteMap[typ
 			indexesModel.Keys = append(indexesModel.Keys, string(contextID))
 			indexesModel.Values[string(contextID)] = lnk
 		}
+		slices.Sort(indexesModel.Keys)
 	}
+	// claims and indexes are ordered so that the same parts always build a
+	// result with the same root, which receipts attest to
+	slices.SortFunc(cls, func(a, b ipld.Link) int { return strings.Compare(a.Binary(), b.Binary()) })
 
 	queryResultModel := qdm.QueryResultModel{
 		Result0_1: &qdm.QueryResultModel0_1{
-			Claims:  cls,
-			Indexes: indexesModel,
+			Claims:    cls,
+			Indexes:   indexesModel,
+			Confirmed: confirmedLinks(cfg.confirmed),
+			IndexRefs: indexRefsModel(cfg.indexRefs),
 		},
 	}
 
@@ -135,5 +269,119 @@ func Build(claims map[cid.Cid]delegation.Delegation, indexes bytemap.ByteMap[typ
 		return nil, err
 	}
 
+	// the result keeps its own copies, so the caller can go on changing theirs
+	return &queryResult{root: rt, data: queryResultModel.Result0_1, blks: bs, diagnostics: maps.Clone(cfg.diagnostics), probes: maps.Clone(cfg.probes), hashResults: maps.Clone(cfg.hashResults), supersededBy: maps.Clone(cfg.supersededBy), stats: cfg.stats.clone()}, nil
+}
+
+// Extract decodes a QueryResult from a CAR file, as produced by encoding the
+// result's root and blocks
+func Extract(r io.Reader) (QueryResult, error) {
+	roots, blocks, err := car.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("decoding CAR: %w", err)
+	}
+	if len(roots) != 1 {
+		return nil, fmt.Errorf("unexpected number of roots: %d", len(roots))
+	}
+	bs, err := blockstore.NewBlockReader(blockstore.WithBlocksIterator(blocks))
+	if err != nil {
+		return nil, err
+	}
+	return view(roots[0], bs)
+}
+
+func view(root ipld.Link, bs blockstore.BlockReader) (*queryResult, error) {
+	rt, ok, err := bs.Get(root)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("missing root block: %s", root)
+	}
+	queryResultModel := qdm.QueryResultModel{}
+	err = block.Decode(rt, &queryResultModel, qdm.QueryResultType(), cbor.Codec, sha256.Hasher)
+	if err != nil {
+		return nil, fmt.Errorf("decoding query result: %w", err)
+	}
+	if queryResultModel.Result0_1 == nil {
+		return nil, errors.New("unknown query result version")
+	}
 	return &queryResult{root: rt, data: queryResultModel.Result0_1, blks: bs}, nil
 }
+
+// Parts returns the claims and indexes contained in a query result, in the form
+// they are passed to Build
+func Parts(qr QueryResult) (map[cid.Cid]delegation.Delegation, bytemap.ByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView], error) {
+	bs, err := blockstore.NewBlockReader(blockstore.WithBlocksIterator(qr.Blocks()))
+	if err != nil {
+		return nil, nil, err
+	}
+	q, err := view(qr.Root().Link(), bs)
+	if err != nil {
+		return nil, nil, err
+	}
+	claims := make(map[cid.Cid]delegation.Delegation, len(q.data.Claims))
+	for _, link := range q.data.Claims {
+		claim, err := claimView(link, bs)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading claim %s: %w", link, err)
+		}
+		claims[link.(cidlink.Link).Cid] = claim
+	}
+	indexes := bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1)
+	if q.data.Indexes != nil {
+		for _, contextID := range q.data.Indexes.Keys {
+			link := q.data.Indexes.Values[contextID]
+			blk, ok, err := bs.Get(link)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !ok {
+				return nil, nil, fmt.Errorf("missing index block: %s", link)
+			}
+			index, err := blobindex.Extract(bytes.NewReader(blk.Bytes()))
+			if err != nil {
+				return nil, nil, fmt.Errorf("reading index %s: %w", link, err)
+			}
+			indexes.Set(types.EncodedContextID(contextID), index)
+		}
+	}
+	return claims, indexes, nil
+}
+
+// claimView returns a delegation backed by only the blocks of the claim and its
+// proofs, rather than every block in the result
+func claimView(root ipld.Link, bs blockstore.BlockReader) (delegation.Delegation, error) {
+	claimBs, err := blockstore.NewBlockStore()
+	if err != nil {
+		return nil, err
+	}
+	pending := []ipld.Link{root}
+	for len(pending) > 0 {
+		link := pending[0]
+		pending = pending[1:]
+		if _, ok, _ := claimBs.Get(link); ok {
+			continue
+		}
+		blk, ok, err := bs.Get(link)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// proofs are not required to be included in the result
+			if link == root {
+				return nil, fmt.Errorf("missing claim block: %s", link)
+			}
+			continue
+		}
+		if err := claimBs.Put(blk); err != nil {
+			return nil, err
+		}
+		dlg, err := delegation.NewDelegationView(link, bs)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, dlg.Proofs()...)
+	}
+	return delegation.NewDelegationView(root, claimBs)
+}
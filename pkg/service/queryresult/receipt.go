@@ -0,0 +1,208 @@
+package queryresult
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/storacha/go-ucanto/core/ipld"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/go-ucanto/principal"
+	"github.com/storacha/go-ucanto/principal/ed25519/verifier"
+	"github.com/storacha/go-ucanto/ucan/crypto/signature"
+)
+
+// receiptVersion is the version of the encoding of receipts
+const receiptVersion = 1
+
+var (
+	// ErrReceiptIssuer is returned when verifying a receipt issued by another
+	// service than the one expected
+	ErrReceiptIssuer = errors.New("receipt was not issued by the service")
+	// ErrReceiptResult is returned when verifying a receipt for another result
+	// than the one expected
+	ErrReceiptResult = errors.New("receipt is for another result")
+	// ErrReceiptSignature is returned when the signature of a receipt doesn't
+	// verify
+	ErrReceiptSignature = errors.New("invalid receipt signature")
+)
+
+// Receipt is the attestation of a service that it answered a query with a
+// result at a time, so that the result can be passed on and later proven to
+// have come from the service without querying it again
+type Receipt struct {
+	// Issuer is the did:key of the key of the service that signed the receipt
+	Issuer did.DID
+	// Result is the root of the result
+	Result ipld.Link
+	// Query is the canonical digest of the query answered
+	Query []byte
+	// Issued is when the result was answered, to the millisecond
+	Issued time.Time
+	// Signature is the signature of the issuer over the rest of the receipt
+	Signature []byte
+}
+
+// SignReceipt returns a receipt for the result root, answering the query with
+// the given digest at the given time, signed by the signer
+func SignReceipt(signer principal.Signer, result ipld.Link, query []byte, issued time.Time) (Receipt, error) {
+	r := Receipt{Issuer: signer.DID(), Result: result, Query: bytes.Clone(query), Issued: time.UnixMilli(issued.UnixMilli()).UTC()}
+	payload, err := r.payload()
+	if err != nil {
+		return Receipt{}, err
+	}
+	r.Signature = signature.Encode(signer.Sign(payload))
+	return r, nil
+}
+
+// VerifyReceipt checks the receipt is for the result root and was signed by the
+// service with the given did:key DID
+func VerifyReceipt(receipt Receipt, resultRoot ipld.Link, serviceDID did.DID) error {
+	if receipt.Issuer != serviceDID {
+		return fmt.Errorf("%w: issued by %s", ErrReceiptIssuer, receipt.Issuer)
+	}
+	if receipt.Result == nil || resultRoot == nil || receipt.Result.Binary() != resultRoot.Binary() {
+		return fmt.Errorf("%w: issued for %s", ErrReceiptResult, receipt.Result)
+	}
+	v, err := verifier.Parse(serviceDID.String())
+	if err != nil {
+		return fmt.Errorf("parsing service DID: %w", err)
+	}
+	payload, err := receipt.payload()
+	if err != nil {
+		return err
+	}
+	if !v.Verify(payload, signature.Decode(receipt.Signature)) {
+		return ErrReceiptSignature
+	}
+	return nil
+}
+
+// payload is the dag-cbor encoding of the receipt without its signature, which
+// is what is signed
+func (r Receipt) payload() ([]byte, error) {
+	return r.encode(false)
+}
+
+func (r Receipt) encode(signed bool) ([]byte, error) {
+	if r.Result == nil {
+		return nil, errors.New("encoding receipt: no result")
+	}
+	fields := int64(5)
+	if signed {
+		fields++
+	}
+	nd, err := qp.BuildMap(basicnode.Prototype.Any, fields, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "v", qp.Int(receiptVersion))
+		qp.MapEntry(ma, "iss", qp.String(r.Issuer.String()))
+		qp.MapEntry(ma, "res", qp.Link(r.Result))
+		qp.MapEntry(ma, "qry", qp.Bytes(r.Query))
+		qp.MapEntry(ma, "iat", qp.Int(r.Issued.UnixMilli()))
+		if signed {
+			qp.MapEntry(ma, "sig", qp.Bytes(r.Signature))
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encoding receipt: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := dagcbor.Encode(nd, &buf); err != nil {
+		return nil, fmt.Errorf("encoding receipt: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// MarshalBinary encodes the receipt as dag-cbor
+func (r Receipt) MarshalBinary() ([]byte, error) {
+	return r.encode(true)
+}
+
+// UnmarshalBinary decodes a receipt encoded with MarshalBinary
+func (r *Receipt) UnmarshalBinary(data []byte) error {
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := dagcbor.Decode(nb, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("decoding receipt: %w", err)
+	}
+	nd := nb.Build()
+	field := func(name string) (datamodel.Node, error) {
+		v, err := nd.LookupByString(name)
+		if err != nil {
+			return nil, fmt.Errorf("decoding receipt %s: %w", name, err)
+		}
+		return v, nil
+	}
+
+	v, err := field("v")
+	if err != nil {
+		return err
+	}
+	version, err := v.AsInt()
+	if err != nil {
+		return fmt.Errorf("decoding receipt version: %w", err)
+	}
+	if version != receiptVersion {
+		return fmt.Errorf("unknown receipt version: %d", version)
+	}
+
+	var decoded Receipt
+	if v, err = field("iss"); err != nil {
+		return err
+	}
+	issuer, err := v.AsString()
+	if err != nil {
+		return fmt.Errorf("decoding receipt issuer: %w", err)
+	}
+	if decoded.Issuer, err = did.Parse(issuer); err != nil {
+		return fmt.Errorf("decoding receipt issuer: %w", err)
+	}
+	if v, err = field("res"); err != nil {
+		return err
+	}
+	if decoded.Result, err = v.AsLink(); err != nil {
+		return fmt.Errorf("decoding receipt result: %w", err)
+	}
+	if v, err = field("qry"); err != nil {
+		return err
+	}
+	if decoded.Query, err = v.AsBytes(); err != nil {
+		return fmt.Errorf("decoding receipt query: %w", err)
+	}
+	if v, err = field("iat"); err != nil {
+		return err
+	}
+	issued, err := v.AsInt()
+	if err != nil {
+		return fmt.Errorf("decoding receipt issued time: %w", err)
+	}
+	decoded.Issued = time.UnixMilli(issued).UTC()
+	if v, err = field("sig"); err != nil {
+		return err
+	}
+	if decoded.Signature, err = v.AsBytes(); err != nil {
+		return fmt.Errorf("decoding receipt signature: %w", err)
+	}
+	*r = decoded
+	return nil
+}
+
+type attestedResult struct {
+	QueryResult
+	receipt Receipt
+}
+
+func (a *attestedResult) Receipt() (Receipt, bool) {
+	return a.receipt, true
+}
+
+// WithReceipt returns the query result with the receipt attached
+func WithReceipt(qr QueryResult, r Receipt) QueryResult {
+	if a, ok := qr.(*attestedResult); ok {
+		qr = a.QueryResult
+	}
+	return &attestedResult{QueryResult: qr, receipt: r}
+}
@@ -0,0 +1,75 @@
+package queryresult_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/storacha/go-ucanto/principal/ed25519/signer"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReceipt(t *testing.T) {
+	service := testutil.Must(signer.Generate())(t)
+	qr := testutil.Must(newBuilder(t).Build())(t)
+	root := qr.Root().Link()
+	query := testutil.RandomBytes(32)
+	issued := time.Now()
+	receipt := testutil.Must(queryresult.SignReceipt(service, root, query, issued))(t)
+
+	t.Run("round trips through its binary encoding", func(t *testing.T) {
+		var decoded queryresult.Receipt
+		require.NoError(t, decoded.UnmarshalBinary(testutil.Must(receipt.MarshalBinary())(t)))
+		require.Equal(t, receipt, decoded)
+		require.Equal(t, issued.UnixMilli(), decoded.Issued.UnixMilli())
+		require.NoError(t, queryresult.VerifyReceipt(decoded, root, service.DID()))
+	})
+
+	t.Run("verifies for the result and service it was signed for", func(t *testing.T) {
+		require.Equal(t, service.DID(), receipt.Issuer)
+		require.Equal(t, query, receipt.Query)
+		require.NoError(t, queryresult.VerifyReceipt(receipt, root, service.DID()))
+	})
+
+	t.Run("rejects tampered receipts", func(t *testing.T) {
+		require.ErrorIs(t, queryresult.VerifyReceipt(receipt, testutil.RandomCID(), service.DID()), queryresult.ErrReceiptResult)
+
+		tampered := receipt
+		tampered.Result = testutil.RandomCID()
+		require.ErrorIs(t, queryresult.VerifyReceipt(tampered, tampered.Result, service.DID()), queryresult.ErrReceiptSignature)
+
+		tampered = receipt
+		tampered.Query = testutil.RandomBytes(32)
+		require.ErrorIs(t, queryresult.VerifyReceipt(tampered, root, service.DID()), queryresult.ErrReceiptSignature)
+
+		tampered = receipt
+		tampered.Issued = receipt.Issued.Add(time.Hour)
+		require.ErrorIs(t, queryresult.VerifyReceipt(tampered, root, service.DID()), queryresult.ErrReceiptSignature)
+	})
+
+	t.Run("rejects receipts signed with another key", func(t *testing.T) {
+		other := testutil.Must(signer.Generate())(t)
+		forged := testutil.Must(queryresult.SignReceipt(other, root, query, issued))(t)
+		require.ErrorIs(t, queryresult.VerifyReceipt(forged, root, service.DID()), queryresult.ErrReceiptIssuer)
+
+		// claiming to be issued by the service doesn't help
+		forged.Issuer = service.DID()
+		require.ErrorIs(t, queryresult.VerifyReceipt(forged, root, service.DID()), queryresult.ErrReceiptSignature)
+	})
+
+	t.Run("attached to results", func(t *testing.T) {
+		_, ok := qr.Receipt()
+		require.False(t, ok)
+		attested := queryresult.WithReceipt(qr, receipt)
+		attached, ok := attested.Receipt()
+		require.True(t, ok)
+		require.Equal(t, receipt, attached)
+		require.Equal(t, root, attested.Root().Link())
+	})
+
+	t.Run("results of the same parts have the same root", func(t *testing.T) {
+		b := newBuilder(t)
+		require.Equal(t, testutil.Must(b.Build())(t).Root().Link(), testutil.Must(b.Build())(t).Root().Link())
+	})
+}
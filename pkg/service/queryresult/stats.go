@@ -0,0 +1,96 @@
+package queryresult
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Stats counts the work done to answer a query, for clients that adapt how
+// they query to it. Unlike diagnoses, stats are kept for every query, and are
+// not part of the encoded message. A result answered from the result cache has
+// no jobs, reads or fetches
+type Stats struct {
+	// Jobs is the number of jobs the walk executed
+	Jobs int
+	// CacheHits and CacheMisses are the reads of each cache, keyed by the store
+	// names of types.CacheMetrics, that did and didn't find what they were
+	// looking for
+	CacheHits   map[string]int
+	CacheMisses map[string]int
+	// Fetches are the fetches from origins, keyed by the kinds of fetch in the
+	// types package
+	Fetches map[string]int
+	// IndexesExpanded is the number of indexes read to follow their shards
+	IndexesExpanded int
+	// WallTime is how long the query took to answer
+	WallTime time.Duration
+	// Truncated names the limits that left something out of the result, in
+	// order
+	Truncated []string
+}
+
+type statsJSON struct {
+	Jobs            int            `json:"jobs"`
+	CacheHits       map[string]int `json:"cacheHits,omitempty"`
+	CacheMisses     map[string]int `json:"cacheMisses,omitempty"`
+	Fetches         map[string]int `json:"fetches,omitempty"`
+	IndexesExpanded int            `json:"indexesExpanded"`
+	WallTime        string         `json:"wallTime"`
+	Truncated       []string       `json:"truncated,omitempty"`
+}
+
+// MarshalJSON encodes the stats with the wall time as a duration string
+func (s Stats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(statsJSON{
+		Jobs:            s.Jobs,
+		CacheHits:       s.CacheHits,
+		CacheMisses:     s.CacheMisses,
+		Fetches:         s.Fetches,
+		IndexesExpanded: s.IndexesExpanded,
+		WallTime:        s.WallTime.String(),
+		Truncated:       s.Truncated,
+	})
+}
+
+// String sums the stats up on one line, with the reads and fetches totalled,
+// for a header: jobs=12; hits=7; misses=3; fetches=4; expanded=1; wall=35ms,
+// followed by truncated=maxFindRecords,maxIndexDepth if any limit applied
+func (s Stats) String() string {
+	summary := fmt.Sprintf("jobs=%d; hits=%d; misses=%d; fetches=%d; expanded=%d; wall=%s", s.Jobs, total(s.CacheHits), total(s.CacheMisses), total(s.Fetches), s.IndexesExpanded, s.WallTime.Round(time.Millisecond))
+	if len(s.Truncated) > 0 {
+		summary += "; truncated=" + strings.Join(s.Truncated, ",")
+	}
+	return summary
+}
+
+func (s Stats) clone() Stats {
+	s.CacheHits = maps.Clone(s.CacheHits)
+	s.CacheMisses = maps.Clone(s.CacheMisses)
+	s.Fetches = maps.Clone(s.Fetches)
+	s.Truncated = slices.Clone(s.Truncated)
+	return s
+}
+
+func total(counts map[string]int) int {
+	n := 0
+	for _, c := range counts {
+		n += c
+	}
+	return n
+}
+
+// WithStats includes the stats of the query in the result
+func WithStats(stats Stats) Option {
+	return func(c *config) {
+		c.stats = stats
+	}
+}
+
+// Stats returns a copy of the stats of the query
+func (q *queryResult) Stats() Stats {
+	return q.stats.clone()
+}
@@ -0,0 +1,258 @@
+package queryresult
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"iter"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	gomultihash "github.com/multiformats/go-multihash"
+	multihash "github.com/multiformats/go-multihash/core"
+	"github.com/multiformats/go-varint"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/core/ipld"
+	"github.com/storacha/go-ucanto/core/ipld/block"
+	"github.com/storacha/go-ucanto/core/ipld/codec/cbor"
+	ucansha256 "github.com/storacha/go-ucanto/core/ipld/hash/sha256"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/bytemap"
+	qdm "github.com/storacha/indexing-service/pkg/service/queryresult/datamodel"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// streamBufferSize is the size of the buffer index archives are copied through
+const streamBufferSize = 32 << 10
+
+// ErrIndexMismatch means an index source produced different bytes than its
+// link and size describe
+var ErrIndexMismatch = errors.New("index archive does not match its link")
+
+// IndexSource is an archived sharded dag index that is read when it is
+// streamed
+type IndexSource struct {
+	ContextID types.EncodedContextID
+	// Link is the raw SHA2-256 CID of the archive
+	Link ipld.Link
+	// Size is the length in bytes of the archive
+	Size uint64
+	// Open returns a reader of the archive
+	Open func() (io.ReadCloser, error)
+}
+
+// IndexSourceFromView returns a source of the archive of the index. The index is
+// archived once, and the archive kept to be read when it is streamed
+func IndexSourceFromView(contextID types.EncodedContextID, index blobindex.ShardedDagIndexView) (IndexSource, error) {
+	r, err := index.Archive()
+	if err != nil {
+		return IndexSource{}, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return IndexSource{}, err
+	}
+	digest := sha256.Sum256(data)
+	return IndexSource{
+		ContextID: contextID,
+		Link:      rawLink(digest[:]),
+		Size:      uint64(len(data)),
+		Open: func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		},
+	}, nil
+}
+
+// IndexSources returns a sequence of the given sources, for Sources.Indexes
+func IndexSources(sources ...IndexSource) iter.Seq2[IndexSource, error] {
+	return func(yield func(IndexSource, error) bool) {
+		for _, source := range sources {
+			if !yield(source, nil) {
+				return
+			}
+		}
+	}
+}
+
+// rawLink is the raw CID of the SHA2-256 digest
+func rawLink(digest []byte) ipld.Link {
+	mh, err := gomultihash.Encode(digest, multihash.SHA2_256)
+	if err != nil {
+		panic(err)
+	}
+	return cidlink.Link{Cid: cid.NewCidV1(cid.Raw, mh)}
+}
+
+// Sources are the parts of a query result to stream
+type Sources struct {
+	Claims []delegation.Delegation
+	// Indexes are produced when the result is written, so that an index isn't
+	// archived until it is needed. It may be nil if there are none
+	Indexes iter.Seq2[IndexSource, error]
+	// Confirmed are claims the query already knew, which are listed in the
+	// result without being included
+	Confirmed []cid.Cid
+	// IndexRefs point to the indexes of the index claims found, keyed by the
+	// context ID of the index claim
+	IndexRefs bytemap.ReadOnlyByteMap[types.EncodedContextID, IndexRef]
+	// Stats count the work done to answer the query. They aren't written
+	Stats Stats
+}
+
+// Write streams a query result made of the given sources to w as a CAR with the
+// root block first, without holding index archives in memory. The CAR decodes
+// to the same result as building it from the claims and indexes would. It
+// returns the SHA2-256 digest of everything written.
+//
+// If a source fails once writing has started, the CAR written so far is
+// incomplete, and the caller must make sure the reader can tell
+func Write(w io.Writer, src Sources) ([]byte, error) {
+	hw := &hashingWriter{w: w, h: sha256.New()}
+
+	claims := make([]ipld.Link, 0, len(src.Claims))
+	for _, claim := range src.Claims {
+		claims = append(claims, claim.Link())
+	}
+	var indexes []IndexSource
+	if src.Indexes != nil {
+		for index, err := range src.Indexes {
+			if err != nil {
+				return nil, fmt.Errorf("reading index source: %w", err)
+			}
+			indexes = append(indexes, index)
+		}
+	}
+	var indexesModel *qdm.IndexesModel
+	if len(indexes) > 0 {
+		indexesModel = &qdm.IndexesModel{
+			Keys:   make([]string, 0, len(indexes)),
+			Values: make(map[string]ipld.Link, len(indexes)),
+		}
+		for _, index := range indexes {
+			indexesModel.Keys = append(indexesModel.Keys, string(index.ContextID))
+			indexesModel.Values[string(index.ContextID)] = index.Link
+		}
+	}
+	root, err := block.Encode(
+		&qdm.QueryResultModel{Result0_1: &qdm.QueryResultModel0_1{Claims: claims, Indexes: indexesModel, Confirmed: confirmedLinks(src.Confirmed), IndexRefs: indexRefsModel(src.IndexRefs)}},
+		qdm.QueryResultType(),
+		cbor.Codec,
+		ucansha256.Hasher,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("encoding root block: %w", err)
+	}
+
+	if err := writeHeader(hw, root.Link()); err != nil {
+		return nil, fmt.Errorf("writing CAR header: %w", err)
+	}
+	if err := writeBlock(hw, root.Link(), root.Bytes()); err != nil {
+		return nil, fmt.Errorf("writing root block: %w", err)
+	}
+
+	written := map[string]struct{}{}
+	for _, claim := range src.Claims {
+		for blk, err := range claim.Blocks() {
+			if err != nil {
+				return nil, fmt.Errorf("reading claim %s: %w", claim.Link(), err)
+			}
+			if _, ok := written[blk.Link().Binary()]; ok {
+				continue
+			}
+			written[blk.Link().Binary()] = struct{}{}
+			if err := writeBlock(hw, blk.Link(), blk.Bytes()); err != nil {
+				return nil, fmt.Errorf("writing claim %s: %w", claim.Link(), err)
+			}
+		}
+	}
+
+	buf := make([]byte, streamBufferSize)
+	for i, index := range indexes {
+		if err := writeIndex(hw, index, buf); err != nil {
+			return nil, fmt.Errorf("writing index %s: %w", index.Link, err)
+		}
+		// let the archive go once it is written
+		indexes[i] = IndexSource{}
+	}
+	return hw.h.Sum(nil), nil
+}
+
+func writeHeader(w io.Writer, root ipld.Link) error {
+	header, err := qp.BuildMap(basicnode.Prototype.Any, 2, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "roots", qp.List(1, func(la datamodel.ListAssembler) {
+			qp.ListEntry(la, qp.Link(root))
+		}))
+		qp.MapEntry(ma, "version", qp.Int(1))
+	})
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := dagcbor.Encode(header, &buf); err != nil {
+		return err
+	}
+	if _, err := w.Write(varint.ToUvarint(uint64(buf.Len()))); err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func writeBlock(w io.Writer, link ipld.Link, data []byte) error {
+	cidBytes := []byte(link.Binary())
+	if _, err := w.Write(varint.ToUvarint(uint64(len(cidBytes) + len(data)))); err != nil {
+		return err
+	}
+	if _, err := w.Write(cidBytes); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// writeIndex copies an index archive into the CAR, checking it matches the
+// link and size the block was announced with
+func writeIndex(w io.Writer, index IndexSource, buf []byte) error {
+	r, err := index.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cidBytes := []byte(index.Link.Binary())
+	if _, err := w.Write(varint.ToUvarint(uint64(len(cidBytes)) + index.Size)); err != nil {
+		return err
+	}
+	if _, err := w.Write(cidBytes); err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.CopyBuffer(io.MultiWriter(w, h), io.LimitReader(r, int64(index.Size)), buf)
+	if err != nil {
+		return err
+	}
+	if uint64(n) != index.Size {
+		return fmt.Errorf("%w: read %d of %d bytes", ErrIndexMismatch, n, index.Size)
+	}
+	if rawLink(h.Sum(nil)).Binary() != index.Link.Binary() {
+		return ErrIndexMismatch
+	}
+	return nil
+}
+
+type hashingWriter struct {
+	w io.Writer
+	h hash.Hash
+}
+
+func (hw *hashingWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	return n, err
+}
@@ -0,0 +1,190 @@
+package queryresult_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"runtime"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/car"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/core/ipld"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/bytemap"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	claim := testutil.RandomLocationDelegation()
+	contextID := types.EncodedContextID(testutil.RandomBytes(10))
+	_, index := testutil.RandomShardedDagIndexView(32)
+	source := testutil.Must(queryresult.IndexSourceFromView(contextID, index))(t)
+
+	t.Run("writes the same result as building it", func(t *testing.T) {
+		indexes := bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1)
+		indexes.Set(contextID, index)
+		refs := bytemap.NewByteMap[types.EncodedContextID, queryresult.IndexRef](-1)
+		refs.Set(types.EncodedContextID(testutil.RandomBytes(10)), queryresult.IndexRef{Index: testutil.RandomCID().(cidlink.Link).Cid, Provider: testutil.RandomPeer()})
+		refs.Set(types.EncodedContextID(testutil.RandomBytes(10)), queryresult.IndexRef{Index: testutil.RandomCID().(cidlink.Link).Cid, Provider: testutil.RandomPeer(), Error: "fetching index: 500"})
+		qr := testutil.Must(queryresult.Build(map[cid.Cid]delegation.Delegation{claim.Link().(cidlink.Link).Cid: claim}, indexes, queryresult.WithIndexRefs(refs)))(t)
+
+		var buf bytes.Buffer
+		digest := testutil.Must(queryresult.Write(&buf, queryresult.Sources{
+			Claims:    []delegation.Delegation{claim},
+			Indexes:   queryresult.IndexSources(source),
+			IndexRefs: refs,
+		}))(t)
+		sum := sha256.Sum256(buf.Bytes())
+		require.Equal(t, sum[:], digest)
+
+		// the root comes first, so it can be read before the rest of the result
+		roots, blocks := testutil.Must2(car.Decode(bytes.NewReader(buf.Bytes())))(t)
+		require.Equal(t, []ipld.Link{qr.Root().Link()}, roots)
+		for blk, err := range blocks {
+			require.NoError(t, err)
+			require.Equal(t, qr.Root().Link(), blk.Link())
+			break
+		}
+
+		written := testutil.Must(queryresult.Extract(&buf))(t)
+		require.Equal(t, qr.Claims(), written.Claims())
+		require.Equal(t, qr.Indexes(), written.Indexes())
+		require.Equal(t, refs, written.IndexRefs())
+		claims, writtenIndexes := testutil.Must2(queryresult.Parts(written))(t)
+		require.Equal(t, claim.Link(), claims[claim.Link().(cidlink.Link).Cid].Link())
+		testutil.RequireEqualIndex(t, index, writtenIndexes.Get(contextID))
+	})
+
+	t.Run("indexes are archived once", func(t *testing.T) {
+		counting := &countingView{ShardedDagIndexView: index}
+		source := testutil.Must(queryresult.IndexSourceFromView(contextID, counting))(t)
+		var buf bytes.Buffer
+		testutil.Must(queryresult.Write(&buf, queryresult.Sources{Indexes: queryresult.IndexSources(source)}))(t)
+		require.Equal(t, 1, counting.archives)
+		written := testutil.Must(queryresult.Extract(&buf))(t)
+		require.Equal(t, []ipld.Link{source.Link}, written.Indexes())
+	})
+
+	t.Run("fails when a source can't be produced", func(t *testing.T) {
+		errArchive := errors.New("archive failed")
+		indexes := func(yield func(queryresult.IndexSource, error) bool) {
+			yield(queryresult.IndexSource{}, errArchive)
+		}
+		_, err := queryresult.Write(io.Discard, queryresult.Sources{Indexes: indexes})
+		require.ErrorIs(t, err, errArchive)
+	})
+
+	t.Run("fails when a source does not match its link", func(t *testing.T) {
+		truncated := source
+		truncated.Open = func() (io.ReadCloser, error) {
+			r, err := source.Open()
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(io.LimitReader(r, int64(source.Size)/2)), nil
+		}
+		corrupted := source
+		corrupted.Link = testutil.RandomCID()
+
+		for _, src := range []queryresult.IndexSource{truncated, corrupted} {
+			_, err := queryresult.Write(io.Discard, queryresult.Sources{Indexes: queryresult.IndexSources(src)})
+			require.ErrorIs(t, err, queryresult.ErrIndexMismatch)
+		}
+	})
+
+	t.Run("fails when a source can't be read", func(t *testing.T) {
+		errUnavailable := errors.New("unavailable")
+		failing := source
+		failing.Open = func() (io.ReadCloser, error) { return nil, errUnavailable }
+		_, err := queryresult.Write(io.Discard, queryresult.Sources{Indexes: queryresult.IndexSources(failing)})
+		require.ErrorIs(t, err, errUnavailable)
+	})
+}
+
+// countingView counts the times the index is archived
+type countingView struct {
+	blobindex.ShardedDagIndexView
+	archives int
+}
+
+func (v *countingView) Archive() (io.Reader, error) {
+	v.archives++
+	return v.ShardedDagIndexView.Archive()
+}
+
+// syntheticIndex is a source of pseudo random bytes standing in for an archived
+// index, which is never held in memory
+func syntheticIndex(b *testing.B, size uint64) queryresult.IndexSource {
+	open := func() (io.ReadCloser, error) {
+		return io.NopCloser(io.LimitReader(rand.NewChaCha8([32]byte{}), int64(size))), nil
+	}
+	r, _ := open()
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	require.NoError(b, err)
+	digest, err := multihash.Encode(h.Sum(nil), multihash.SHA2_256)
+	require.NoError(b, err)
+	return queryresult.IndexSource{
+		ContextID: testutil.RandomBytes(10),
+		Link:      cidlink.Link{Cid: cid.NewCidV1(cid.Raw, digest)},
+		Size:      size,
+		Open:      open,
+	}
+}
+
+// BenchmarkWrite shows memory use of streaming a result is independent of the
+// size of the indexes in it. Compare the B/op and peak-heap-B metrics across
+// sizes
+func BenchmarkWrite(b *testing.B) {
+	claim := testutil.RandomLocationDelegation()
+	for _, size := range []uint64{1 << 20, 10 << 20, 100 << 20, 500 << 20} {
+		b.Run(fmt.Sprintf("%dMB", size>>20), func(b *testing.B) {
+			src := queryresult.Sources{
+				Claims:  []delegation.Delegation{claim},
+				Indexes: queryresult.IndexSources(syntheticIndex(b, size)),
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			var peak uint64
+			var stats runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&stats)
+			base := stats.HeapAlloc
+			b.ResetTimer()
+			for range b.N {
+				w := &sampledDiscard{sample: func() {
+					runtime.ReadMemStats(&stats)
+					peak = max(peak, stats.HeapAlloc-min(base, stats.HeapAlloc))
+				}}
+				_, err := queryresult.Write(w, src)
+				require.NoError(b, err)
+			}
+			b.ReportMetric(float64(peak), "peak-heap-B")
+		})
+	}
+}
+
+// sampledDiscard discards writes, sampling memory use every so often
+type sampledDiscard struct {
+	written uint64
+	sample  func()
+}
+
+func (s *sampledDiscard) Write(p []byte) (int, error) {
+	before := s.written
+	s.written += uint64(len(p))
+	if before>>24 != s.written>>24 {
+		s.sample()
+	}
+	return len(p), nil
+}
@@ -0,0 +1,252 @@
+package queryresult
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/go-ucanto/validator"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+)
+
+// UnknownClaimType is the type of claims with no capability of a known shape
+const UnknownClaimType = "unknown"
+
+// Range is a byte range within a shard
+type Range struct {
+	Offset uint64
+	// Length is nil for a range extending to the end of the shard
+	Length *uint64
+}
+
+// ClaimSummary is what a claim asserts, read from the capabilities of its
+// delegation. A delegation with several capabilities is summarized as a whole:
+// its type is that of the first capability of a known shape, and the hashes and
+// locations of all its capabilities are collected
+type ClaimSummary struct {
+	// Type is the ability of the claim, or UnknownClaimType
+	Type string
+	// Space is the DID the claim is bound to, if its resource is a DID
+	Space *did.DID
+	// Content are the hashes of the content the claim is about. For location
+	// commitments, these are the shards the locations are for
+	Content []multihash.Multihash
+	// Index is the CID of the index, for index claims
+	Index cid.Cid
+	// Equals is the CID of the equivalent content, for equals claims
+	Equals cid.Cid
+	// Supersedes is the CID of the index claim this one replaces, for index
+	// claims that replace one
+	Supersedes cid.Cid
+	// SupersededBy is the CID of the newest live index claim that replaces
+	// this one, for superseded index claims returned by queries that include
+	// them. It is not read from the claim, and is not part of the encoded
+	// message
+	SupersededBy cid.Cid
+	// Location are the URLs the content can be retrieved from, for location
+	// commitments, in the order they are listed in the commitment, which is the
+	// order to try them in
+	Location []url.URL
+	// Unfetchable is true for location commitments with no URL that can be
+	// fetched from over HTTP
+	Unfetchable bool
+	// Range is the byte range of the content in the shard, for location
+	// commitments of part of a shard. Only those bytes can be retrieved from the
+	// locations of the commitment. It is nil when the whole shard can be
+	Range *Range
+	// Expiration is when the claim expires, or nil if it doesn't
+	Expiration *time.Time
+}
+
+type rangeJSON struct {
+	Offset uint64  `json:"offset"`
+	Length *uint64 `json:"length,omitempty"`
+}
+
+type claimSummaryJSON struct {
+	Type         string     `json:"type"`
+	Space        string     `json:"space,omitempty"`
+	Content      []string   `json:"content,omitempty"`
+	Index        string     `json:"index,omitempty"`
+	Equals       string     `json:"equals,omitempty"`
+	Supersedes   string     `json:"supersedes,omitempty"`
+	SupersededBy string     `json:"supersededBy,omitempty"`
+	Location     []string   `json:"location,omitempty"`
+	Unfetchable  bool       `json:"unfetchable,omitempty"`
+	Range        *rangeJSON `json:"range,omitempty"`
+	Expiration   *time.Time `json:"expiration,omitempty"`
+}
+
+// MarshalJSON encodes the summary with hashes as base58btc multibase strings,
+// and leaves out fields that don't apply to the claim
+func (s ClaimSummary) MarshalJSON() ([]byte, error) {
+	body := claimSummaryJSON{Type: s.Type, Unfetchable: s.Unfetchable, Expiration: s.Expiration}
+	if s.Space != nil {
+		body.Space = s.Space.String()
+	}
+	for _, hash := range s.Content {
+		encoded, err := multibase.Encode(multibase.Base58BTC, hash)
+		if err != nil {
+			return nil, fmt.Errorf("encoding content hash: %w", err)
+		}
+		body.Content = append(body.Content, encoded)
+	}
+	if s.Index.Defined() {
+		body.Index = s.Index.String()
+	}
+	if s.Equals.Defined() {
+		body.Equals = s.Equals.String()
+	}
+	if s.Supersedes.Defined() {
+		body.Supersedes = s.Supersedes.String()
+	}
+	if s.SupersededBy.Defined() {
+		body.SupersededBy = s.SupersededBy.String()
+	}
+	for _, u := range s.Location {
+		body.Location = append(body.Location, u.String())
+	}
+	if s.Range != nil {
+		body.Range = &rangeJSON{Offset: s.Range.Offset, Length: s.Range.Length}
+	}
+	return json.Marshal(body)
+}
+
+// Summarize reads what a claim asserts from its delegation. Capabilities of an
+// unknown shape are skipped, and a claim with none of a known shape has the
+// type UnknownClaimType
+func Summarize(claim delegation.Delegation) (summary ClaimSummary) {
+	summary.Type = UnknownClaimType
+	// decoding a malformed delegation panics
+	defer func() {
+		if r := recover(); r != nil {
+			summary = ClaimSummary{Type: UnknownClaimType}
+		}
+	}()
+	if exp := claim.Expiration(); exp != nil {
+		expiration := time.Unix(int64(*exp), 0)
+		summary.Expiration = &expiration
+	}
+	caps := claim.Capabilities()
+	if len(caps) > 0 {
+		if space, err := did.Parse(caps[0].With()); err == nil {
+			summary.Space = &space
+		}
+	}
+	for _, capability := range caps {
+		if summarizeCapability(&summary, capability, claim) && summary.Type == UnknownClaimType {
+			summary.Type = capability.Can()
+		}
+	}
+	summary.Unfetchable = summary.Type == assert.LocationAbility && len(FetchableURLs(summary.Location)) == 0
+	return summary
+}
+
+// FetchableURLs returns the URLs that can be fetched from over HTTP, keeping
+// their order
+func FetchableURLs(urls []url.URL) []url.URL {
+	var fetchable []url.URL
+	for _, u := range urls {
+		if (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+			fetchable = append(fetchable, u)
+		}
+	}
+	return fetchable
+}
+
+// summarizeCapability adds what the capability asserts to the summary,
+// returning false if it isn't of a known shape
+func summarizeCapability(summary *ClaimSummary, capability ucan.Capability[any], claim delegation.Delegation) bool {
+	source := validator.NewSource(capability, claim)
+	switch capability.Can() {
+	case assert.LocationAbility:
+		match, fail := assert.Location.Match(source)
+		if fail != nil {
+			return false
+		}
+		nb := match.Value().Nb()
+		summary.Content = append(summary.Content, nb.Content.Hash())
+		summary.Location = append(summary.Location, nb.Location...)
+		if nb.Range != nil && summary.Range == nil {
+			summary.Range = &Range{Offset: nb.Range.Offset, Length: nb.Range.Length}
+		}
+	case assert.IndexAbility:
+		match, fail := assert.Index.Match(source)
+		if fail != nil {
+			return false
+		}
+		nb := match.Value().Nb()
+		content, err := cid.Parse(nb.Content.String())
+		if err != nil {
+			return false
+		}
+		summary.Content = append(summary.Content, content.Hash())
+		if index, err := cid.Parse(nb.Index.String()); err == nil && !summary.Index.Defined() {
+			summary.Index = index
+		}
+		if nb.Supersedes != nil && !summary.Supersedes.Defined() {
+			if supersedes, err := cid.Parse((*nb.Supersedes).String()); err == nil {
+				summary.Supersedes = supersedes
+			}
+		}
+	case assert.EqualsAbility:
+		match, fail := assert.Equals.Match(source)
+		if fail != nil {
+			return false
+		}
+		nb := match.Value().Nb()
+		summary.Content = append(summary.Content, nb.Content.Hash())
+		if equals, err := cid.Parse(nb.Equals.String()); err == nil && !summary.Equals.Defined() {
+			summary.Equals = equals
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// WithSupersededBy marks the superseded index claims in the result with the
+// newest live claim that replaces each, keyed by the CID of the superseded
+// claim
+func WithSupersededBy(supersededBy map[cid.Cid]cid.Cid) Option {
+	return func(c *config) {
+		c.supersededBy = supersededBy
+	}
+}
+
+// ClaimSummaries returns a summary of every claim in the result, keyed by the
+// CID of the claim. They are worked out on first use and kept
+func (q *queryResult) ClaimSummaries() Map[cid.Cid, ClaimSummary] {
+	q.summariesOnce.Do(func() {
+		q.summaries = make(map[cid.Cid]ClaimSummary, len(q.data.Claims))
+		for _, link := range q.data.Claims {
+			c, err := cid.Parse(link.String())
+			if err != nil {
+				continue
+			}
+			claim, err := delegation.NewDelegationView(link, q.blks)
+			if err != nil {
+				q.summaries[c] = ClaimSummary{Type: UnknownClaimType}
+				continue
+			}
+			summary := Summarize(claim)
+			summary.SupersededBy = q.supersededBy[c]
+			q.summaries[c] = summary
+		}
+	})
+	return Map[cid.Cid, ClaimSummary]{q.summaries}
+}
+
+// Summaries returns a copy of the summary of every claim in the result. The
+// summaries themselves are shared with the result, so their fields must not be
+// changed
+func (q *queryResult) Summaries() map[cid.Cid]ClaimSummary {
+	return q.ClaimSummaries().Clone()
+}
@@ -0,0 +1,223 @@
+package queryresult_test
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	adm "github.com/storacha/indexing-service/pkg/capability/assert/datamodel"
+	"github.com/storacha/indexing-service/pkg/internal/bytemap"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummaries(t *testing.T) {
+	space := testutil.Alice.DID()
+	provider := testutil.Service.DID()
+	shard, otherShard, content := testutil.RandomMultihash(), testutil.RandomMultihash(), testutil.RandomCID()
+	index, equals, superseded := testutil.RandomCID(), testutil.RandomCID(), testutil.RandomCID()
+	length := uint64(20)
+	expiration := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+	otherURL := testutil.Must(url.Parse("https://other.example/blob"))(t)
+	delegate := func(caps ...ucan.Capability[ucan.CaveatBuilder]) delegation.Delegation {
+		return testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, caps, delegation.WithExpiration(int(expiration.Unix()))))(t)
+	}
+	location := func(hash multihash.Multihash, u url.URL, rng *adm.Range) ucan.Capability[ucan.CaveatBuilder] {
+		return ucan.NewCapability[ucan.CaveatBuilder](assert.LocationAbility, provider.String(), assert.LocationCaveats{
+			Content:  assert.FromHash(hash),
+			Location: []url.URL{u},
+			Range:    rng,
+		})
+	}
+	locations := func(hash multihash.Multihash, urls ...url.URL) ucan.Capability[ucan.CaveatBuilder] {
+		return ucan.NewCapability[ucan.CaveatBuilder](assert.LocationAbility, provider.String(), assert.LocationCaveats{
+			Content:  assert.FromHash(hash),
+			Location: urls,
+		})
+	}
+	ftpURL := testutil.Must(url.Parse("ftp://files.example/blob"))(t)
+	urnURL := testutil.Must(url.Parse("urn:blob:1"))(t)
+	unknown := ucan.NewCapability[ucan.CaveatBuilder]("space/blob/add", space.String(), ucan.NoCaveats{})
+
+	testCases := []struct {
+		name     string
+		claim    delegation.Delegation
+		expected queryresult.ClaimSummary
+	}{
+		{
+			name:  "location",
+			claim: delegate(location(shard, *testutil.TestURL, &adm.Range{Offset: 10, Length: &length})),
+			expected: queryresult.ClaimSummary{
+				Type:       assert.LocationAbility,
+				Space:      &provider,
+				Content:    []multihash.Multihash{shard},
+				Location:   []url.URL{*testutil.TestURL},
+				Range:      &queryresult.Range{Offset: 10, Length: &length},
+				Expiration: &expiration,
+			},
+		},
+		{
+			name: "index",
+			claim: delegate(ucan.NewCapability[ucan.CaveatBuilder](assert.IndexAbility, space.String(), assert.IndexCaveats{
+				Content: content,
+				Index:   index,
+			})),
+			expected: queryresult.ClaimSummary{
+				Type:       assert.IndexAbility,
+				Space:      &space,
+				Content:    []multihash.Multihash{content.(cidlink.Link).Cid.Hash()},
+				Index:      index.(cidlink.Link).Cid,
+				Expiration: &expiration,
+			},
+		},
+		{
+			name: "index superseding another",
+			claim: delegate(ucan.NewCapability[ucan.CaveatBuilder](assert.IndexAbility, space.String(), assert.IndexCaveats{
+				Content:    content,
+				Index:      index,
+				Supersedes: &superseded,
+			})),
+			expected: queryresult.ClaimSummary{
+				Type:       assert.IndexAbility,
+				Space:      &space,
+				Content:    []multihash.Multihash{content.(cidlink.Link).Cid.Hash()},
+				Index:      index.(cidlink.Link).Cid,
+				Supersedes: superseded.(cidlink.Link).Cid,
+				Expiration: &expiration,
+			},
+		},
+		{
+			name: "equals",
+			claim: delegate(ucan.NewCapability[ucan.CaveatBuilder](assert.EqualsAbility, space.String(), assert.EqualsCaveats{
+				Content: assert.FromHash(shard),
+				Equals:  equals,
+			})),
+			expected: queryresult.ClaimSummary{
+				Type:       assert.EqualsAbility,
+				Space:      &space,
+				Content:    []multihash.Multihash{shard},
+				Equals:     equals.(cidlink.Link).Cid,
+				Expiration: &expiration,
+			},
+		},
+		{
+			name:  "multiple capabilities",
+			claim: delegate(location(shard, *testutil.TestURL, nil), location(otherShard, *otherURL, nil)),
+			expected: queryresult.ClaimSummary{
+				Type:       assert.LocationAbility,
+				Space:      &provider,
+				Content:    []multihash.Multihash{shard, otherShard},
+				Location:   []url.URL{*testutil.TestURL, *otherURL},
+				Expiration: &expiration,
+			},
+		},
+		{
+			name:  "several URLs in priority order",
+			claim: delegate(locations(shard, *otherURL, *ftpURL, *testutil.TestURL)),
+			expected: queryresult.ClaimSummary{
+				Type:       assert.LocationAbility,
+				Space:      &provider,
+				Content:    []multihash.Multihash{shard},
+				Location:   []url.URL{*otherURL, *ftpURL, *testutil.TestURL},
+				Expiration: &expiration,
+			},
+		},
+		{
+			name:  "no URL that can be fetched",
+			claim: delegate(locations(shard, *ftpURL, *urnURL)),
+			expected: queryresult.ClaimSummary{
+				Type:        assert.LocationAbility,
+				Space:       &provider,
+				Content:     []multihash.Multihash{shard},
+				Location:    []url.URL{*ftpURL, *urnURL},
+				Unfetchable: true,
+				Expiration:  &expiration,
+			},
+		},
+		{
+			name:  "unknown capability followed by a known one",
+			claim: delegate(unknown, location(shard, *testutil.TestURL, nil)),
+			expected: queryresult.ClaimSummary{
+				Type:       assert.LocationAbility,
+				Space:      &space,
+				Content:    []multihash.Multihash{shard},
+				Location:   []url.URL{*testutil.TestURL},
+				Expiration: &expiration,
+			},
+		},
+		{
+			name:  "unknown capability",
+			claim: delegate(unknown),
+			expected: queryresult.ClaimSummary{
+				Type:       queryresult.UnknownClaimType,
+				Space:      &space,
+				Expiration: &expiration,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			claimCid := tc.claim.Link().(cidlink.Link).Cid
+			qr := testutil.Must(queryresult.Build(map[cid.Cid]delegation.Delegation{claimCid: tc.claim}, bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1)))(t)
+			summaries := qr.Summaries()
+			require.Equal(t, map[cid.Cid]queryresult.ClaimSummary{claimCid: tc.expected}, summaries)
+			require.Equal(t, queryresult.Summarize(tc.claim), summaries[claimCid])
+		})
+	}
+}
+
+func TestClaimSummary__MarshalJSON(t *testing.T) {
+	space := testutil.Must(did.Parse(testutil.Alice.DID().String()))(t)
+	shard, equals := testutil.RandomMultihash(), testutil.RandomCID().(cidlink.Link).Cid
+	length := uint64(20)
+	expiration := time.Unix(1700000000, 0).UTC()
+	summary := queryresult.ClaimSummary{
+		Type:       assert.LocationAbility,
+		Space:      &space,
+		Content:    []multihash.Multihash{shard},
+		Equals:     equals,
+		Location:   []url.URL{*testutil.TestURL},
+		Range:      &queryresult.Range{Offset: 10, Length: &length},
+		Expiration: &expiration,
+	}
+	encodedShard := testutil.Must(multibase.Encode(multibase.Base58BTC, shard))(t)
+	require.JSONEq(t, `{
+		"type": "`+assert.LocationAbility+`",
+		"space": "`+space.String()+`",
+		"content": ["`+encodedShard+`"],
+		"equals": "`+equals.String()+`",
+		"location": ["`+testutil.TestURL.String()+`"],
+		"range": {"offset": 10, "length": 20},
+		"expiration": "2023-11-14T22:13:20Z"
+	}`, string(testutil.Must(json.Marshal(summary))(t)))
+
+	unfetchable := queryresult.ClaimSummary{Type: assert.LocationAbility, Location: []url.URL{{Scheme: "ftp", Host: "files.example"}}, Unfetchable: true}
+	require.JSONEq(t, `{
+		"type": "`+assert.LocationAbility+`",
+		"location": ["ftp://files.example"],
+		"unfetchable": true
+	}`, string(testutil.Must(json.Marshal(unfetchable))(t)))
+
+	index, supersedes, supersededBy := testutil.RandomCID().(cidlink.Link).Cid, testutil.RandomCID().(cidlink.Link).Cid, testutil.RandomCID().(cidlink.Link).Cid
+	superseded := queryresult.ClaimSummary{Type: assert.IndexAbility, Index: index, Supersedes: supersedes, SupersededBy: supersededBy}
+	require.JSONEq(t, `{
+		"type": "`+assert.IndexAbility+`",
+		"index": "`+index.String()+`",
+		"supersedes": "`+supersedes.String()+`",
+		"supersededBy": "`+supersededBy.String()+`"
+	}`, string(testutil.Must(json.Marshal(superseded))(t)))
+
+	require.JSONEq(t, `{"type": "unknown"}`, string(testutil.Must(json.Marshal(queryresult.ClaimSummary{Type: queryresult.UnknownClaimType}))(t)))
+}
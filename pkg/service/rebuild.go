@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/indexing-service/pkg/delegationutil"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// RebuildTarget is a store derived from the operation log and advertisement
+// chain that can be rebuilt from them
+type RebuildTarget string
+
+// RebuildSpaceIndex rebuilds the space index
+const RebuildSpaceIndex RebuildTarget = "space-index"
+
+// ErrRebuildUnsupported is returned from Rebuild for targets the service can't
+// rebuild
+var ErrRebuildUnsupported = errors.New("rebuild not supported")
+
+// ErrRebuildInProgress is returned from Rebuild when a target is already being
+// rebuilt
+var ErrRebuildInProgress = errors.New("rebuild already in progress")
+
+// WithSpaceIndexRebuilds allows the space index to be rebuilt, into the space
+// indexes the function returns for fresh namespaces. The space index passed to
+// WithSpaceIndex should be the one of the namespace last rebuilt into, as
+// recorded by the publisher
+func WithSpaceIndexRebuilds(fresh func(namespace string) types.SpaceIndexStore) Option {
+	return func(is *IndexingService) {
+		is.spaceIndexes = fresh
+	}
+}
+
+// Rebuild regenerates each of the targets from scratch, by replaying the
+// operation log and the advertisement chain into a fresh namespace, which is
+// then swapped in for the one in use. The rebuilt store receives the writes
+// made while it is being rebuilt as well, so none are lost by the swap. If a
+// rebuild fails, the store in use is kept. Other instances of the service keep
+// using the namespace they started with until they restart.
+//
+// Claims in the operation log are replayed from their archives, and claims in
+// the chain are fetched from the providers that published them. A claim that
+// can't be fetched fails the rebuild, rather than swapping in a store missing it
+func (is *IndexingService) Rebuild(ctx context.Context, targets ...RebuildTarget) error {
+	if is.publisher == nil {
+		return errors.New("no operation log to rebuild from")
+	}
+	for _, target := range targets {
+		switch target {
+		case RebuildSpaceIndex:
+			if is.spaceIndex == nil {
+				return ErrSpaceIndexDisabled
+			}
+			if is.spaceIndexes == nil {
+				return fmt.Errorf("%w: %s has no fresh namespaces", ErrRebuildUnsupported, target)
+			}
+		default:
+			return fmt.Errorf("%w: %s", ErrRebuildUnsupported, target)
+		}
+	}
+	rebuilt := map[RebuildTarget]struct{}{}
+	for _, target := range targets {
+		if _, ok := rebuilt[target]; ok {
+			continue
+		}
+		rebuilt[target] = struct{}{}
+		start := time.Now()
+		var err error
+		switch target {
+		case RebuildSpaceIndex:
+			err = is.rebuildSpaceIndex(ctx)
+		}
+		if err != nil {
+			return fmt.Errorf("rebuilding %s: %w", target, err)
+		}
+		log.Infow("rebuilt derived store", "target", target, "duration", time.Since(start))
+	}
+	return nil
+}
+
+func (is *IndexingService) rebuildSpaceIndex(ctx context.Context) error {
+	if !is.spaceIndex.rebuilding.TryLock() {
+		return ErrRebuildInProgress
+	}
+	defer is.spaceIndex.rebuilding.Unlock()
+	namespace, err := is.publisher.NextNamespace(ctx, string(RebuildSpaceIndex))
+	if err != nil {
+		return err
+	}
+	fresh := is.spaceIndexes(namespace)
+	is.spaceIndex.startBuilding(fresh)
+	swapped := false
+	defer func() {
+		if !swapped {
+			is.spaceIndex.abandonBuilding()
+		}
+	}()
+
+	index := func(claim delegation.Delegation) error {
+		space, sc, ok := parseSpaceClaim(claim)
+		if !ok {
+			return nil
+		}
+		return fresh.Add(ctx, space, sc)
+	}
+	for op, err := range is.publisher.Operations(ctx) {
+		if err != nil {
+			return fmt.Errorf("reading operation log: %w", err)
+		}
+		// publishes are replayed from the chain, which also holds those made
+		// before the operation log was kept
+		if op.Kind != publisher.OpCache {
+			continue
+		}
+		claim, err := delegation.Extract(op.Archive)
+		if err != nil {
+			return fmt.Errorf("extracting claim %s of operation %d: %w", op.Claim, op.Seq, err)
+		}
+		if err := index(claim); err != nil {
+			return err
+		}
+	}
+	err = is.chainClaims(ctx, func(claim delegation.Delegation, err error) error {
+		if err != nil {
+			return err
+		}
+		return index(claim)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := is.publisher.SetActiveNamespace(ctx, string(RebuildSpaceIndex), namespace); err != nil {
+		return err
+	}
+	is.spaceIndex.swap()
+	swapped = true
+	return nil
+}
+
+// recordClaimOperation appends an operation on the claim to the operation log,
+// with the claim archived so that it can be replayed. There is nothing to
+// record to without a publisher
+func (is *IndexingService) recordClaimOperation(ctx context.Context, kind publisher.OpKind, claim delegation.Delegation) error {
+	if is.publisher == nil {
+		return nil
+	}
+	archive, err := delegationutil.Canonicalize(claim)
+	if err != nil {
+		return fmt.Errorf("archiving claim: %w", err)
+	}
+	op := publisher.Operation{Kind: kind, Claim: claim.Link().(cidlink.Link).Cid, Archive: archive}
+	if err := is.publisher.RecordOperation(ctx, op); err != nil {
+		return fmt.Errorf("recording %s of claim: %w", kind, err)
+	}
+	return nil
+}
+
+// swappableSpaceIndex is a space index that can be swapped for one rebuilt from
+// scratch. While one is being rebuilt, it is sent every claim added as well
+type swappableSpaceIndex struct {
+	// rebuilding is held while the space index is being rebuilt
+	rebuilding sync.Mutex
+	lk         sync.RWMutex
+	active     types.SpaceIndexStore
+	building   types.SpaceIndexStore
+}
+
+var _ types.SpaceIndexStore = (*swappableSpaceIndex)(nil)
+
+func newSwappableSpaceIndex(store types.SpaceIndexStore) *swappableSpaceIndex {
+	return &swappableSpaceIndex{active: store}
+}
+
+func (s *swappableSpaceIndex) Add(ctx context.Context, space did.DID, claim types.SpaceClaim) error {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+	if err := s.active.Add(ctx, space, claim); err != nil {
+		return err
+	}
+	if s.building != nil {
+		return s.building.Add(ctx, space, claim)
+	}
+	return nil
+}
+
+func (s *swappableSpaceIndex) List(ctx context.Context, space did.DID, cursor string, limit int) ([]types.SpaceClaim, string, error) {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+	return s.active.List(ctx, space, cursor, limit)
+}
+
+func (s *swappableSpaceIndex) Prune(ctx context.Context, space did.DID, now time.Time) (int, error) {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+	return s.active.Prune(ctx, space, now)
+}
+
+func (s *swappableSpaceIndex) startBuilding(store types.SpaceIndexStore) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.building = store
+}
+
+func (s *swappableSpaceIndex) abandonBuilding() {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.building = nil
+}
+
+func (s *swappableSpaceIndex) swap() {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.active, s.building = s.building, nil
+}
@@ -0,0 +1,134 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexingService__Rebuild(t *testing.T) {
+	ctx := context.Background()
+	f := newClaimFixture(t)
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	adverts := publisher.New(dssync.MutexWrap(datastore.NewMapDatastore()), key)
+	space := testutil.Alice.DID()
+	expiration := int(time.Now().Add(time.Hour).Unix())
+	indexClaim := func(t *testing.T) delegation.Delegation {
+		return testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.IndexCaveats]{
+			assert.Index.New(space.String(), assert.IndexCaveats{Content: testutil.RandomCID(), Index: testutil.RandomCID()}),
+		}, delegation.WithExpiration(expiration)))(t)
+	}
+
+	// a published index claim, a published location claim, and a cached claim
+	// that is only in the operation log
+	published := f.addClaim(t, indexClaim(t))
+	data := testutil.Must((&metadata.IndexClaimMetadata{Index: testutil.RandomCID().(cidlink.Link).Cid, Claim: published}).MarshalBinary())(t)
+	testutil.Must(adverts.Publish(ctx, *f.provider, testutil.RandomBytes(10), data, testutil.RandomMultihashes(2)))(t)
+	data = testutil.Must((&metadata.LocationCommitmentMetadata{Claim: f.newClaim(t)}).MarshalBinary())(t)
+	testutil.Must(adverts.Publish(ctx, *f.provider, testutil.RandomBytes(10), data, testutil.RandomMultihashes(2)))(t)
+	cached := indexClaim(t)
+	archive := new(bytes.Buffer)
+	testutil.Must(archive.ReadFrom(cached.Archive()))(t)
+	require.NoError(t, adverts.RecordOperation(ctx, publisher.Operation{Kind: publisher.OpCache, Claim: cached.Link().(cidlink.Link).Cid, Archive: archive.Bytes()}))
+
+	namespaces := map[string]*mockSpaceIndex{}
+	fresh := func(namespace string) types.SpaceIndexStore {
+		namespaces[namespace] = &mockSpaceIndex{claims: map[did.DID][]types.SpaceClaim{}}
+		return namespaces[namespace]
+	}
+	is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), nil,
+		service.WithPublisher(adverts),
+		service.WithSpaceIndex(&mockSpaceIndex{claims: map[did.DID][]types.SpaceClaim{}}),
+		service.WithSpaceIndexRebuilds(fresh)))(t)
+	require.NoError(t, is.Rebuild(ctx, service.RebuildSpaceIndex, service.RebuildSpaceIndex))
+	require.Len(t, namespaces, 1)
+	require.Equal(t, "1", testutil.Must(adverts.ActiveNamespace(ctx, string(service.RebuildSpaceIndex)))(t))
+
+	// the rebuilt store is the one queries are served from
+	claims, _ := testutil.Must2(is.ListClaims(ctx, space, "", 10))(t)
+	require.ElementsMatch(t, []cidlink.Link{{Cid: published}, {Cid: cached.Link().(cidlink.Link).Cid}}, []cidlink.Link{{Cid: claims[0].Claim}, {Cid: claims[1].Claim}})
+	claims, _ = testutil.Must2(is.ListClaims(ctx, testutil.Service.DID(), "", 10))(t)
+	require.Len(t, claims, 1)
+
+	// rebuilding again from the same log gives the same store
+	require.NoError(t, is.Rebuild(ctx, service.RebuildSpaceIndex))
+	require.Equal(t, "2", testutil.Must(adverts.ActiveNamespace(ctx, string(service.RebuildSpaceIndex)))(t))
+	require.Equal(t, namespaces["1"].claims, namespaces["2"].claims)
+
+	t.Run("unsupported", func(t *testing.T) {
+		require.ErrorIs(t, is.Rebuild(ctx, "provider-cache"), service.ErrRebuildUnsupported)
+		noRebuilds := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), nil,
+			service.WithPublisher(adverts),
+			service.WithSpaceIndex(&mockSpaceIndex{claims: map[did.DID][]types.SpaceClaim{}})))(t)
+		require.ErrorIs(t, noRebuilds.Rebuild(ctx, service.RebuildSpaceIndex), service.ErrRebuildUnsupported)
+		disabled := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), nil,
+			service.WithPublisher(adverts)))(t)
+		require.ErrorIs(t, disabled.Rebuild(ctx, service.RebuildSpaceIndex), service.ErrSpaceIndexDisabled)
+		noLog := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), nil,
+			service.WithSpaceIndex(&mockSpaceIndex{claims: map[did.DID][]types.SpaceClaim{}}),
+			service.WithSpaceIndexRebuilds(fresh)))(t)
+		require.Error(t, noLog.Rebuild(ctx, service.RebuildSpaceIndex))
+	})
+}
+
+func TestIndexingService__RebuildPublishedClaims(t *testing.T) {
+	ctx := context.Background()
+	f := newPublishFixture(t)
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	adverts := publisher.New(dssync.MutexWrap(datastore.NewMapDatastore()), key)
+	providerIndex := providerindex.NewProviderIndex(f.store, &countingFinder{results: map[string][]model.ProviderResult{}, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil,
+		providerindex.WithAdvertisementPublisher(adverts))
+	namespaces := map[string]*mockSpaceIndex{}
+	fresh := func(namespace string) types.SpaceIndexStore {
+		namespaces[namespace] = &mockSpaceIndex{claims: map[did.DID][]types.SpaceClaim{}}
+		return namespaces[namespace]
+	}
+	is := testutil.Must(service.NewIndexingService(f.indexes, claimlookup.WithCache(claimlookup.NewClaimLookup(&http.Client{Transport: failingTransport{}}), f.claims), providerIndex,
+		service.WithClaimProvider(f.provider),
+		service.WithClaimCache(f.claims),
+		service.WithPublisher(adverts),
+		service.WithSpaceIndex(&mockSpaceIndex{claims: map[did.DID][]types.SpaceClaim{}}),
+		service.WithSpaceIndexRebuilds(fresh)))(t)
+
+	// the published claim is replayed from the advertisement it was published in,
+	// and the cached claim from the operation log
+	published := testutil.RandomLocationDelegation()
+	cached := testutil.RandomLocationDelegation()
+	require.NoError(t, is.PublishClaim(ctx, published))
+	require.NoError(t, is.CacheClaim(ctx, cached))
+	var ops []publisher.OpKind
+	for op, err := range adverts.Operations(ctx) {
+		require.NoError(t, err)
+		ops = append(ops, op.Kind)
+	}
+	require.Equal(t, []publisher.OpKind{publisher.OpPublish, publisher.OpCache}, ops)
+
+	require.NoError(t, is.Rebuild(ctx, service.RebuildSpaceIndex))
+	require.Len(t, namespaces, 1)
+	claims, _ := testutil.Must2(is.ListClaims(ctx, testutil.Service.DID(), "", 10))(t)
+	rebuilt := make([]cidlink.Link, 0, len(claims))
+	for _, claim := range claims {
+		rebuilt = append(rebuilt, cidlink.Link{Cid: claim.Claim})
+	}
+	require.ElementsMatch(t, []cidlink.Link{{Cid: asCid(published)}, {Cid: asCid(cached)}}, rebuilt)
+}
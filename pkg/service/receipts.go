@@ -0,0 +1,124 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/storacha/go-ucanto/principal"
+	"github.com/storacha/go-ucanto/principal/ed25519/signer"
+	"github.com/storacha/go-ucanto/principal/ed25519/verifier"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+)
+
+// ErrNoResultSigner is returned from Query when the query asks for a receipt,
+// but the service has no key to sign results with
+var ErrNoResultSigner = errors.New("service does not sign query results")
+
+// WithResultSigner signs the results of queries asking for receipts with the
+// given signer. Without one, such queries fail with ErrNoResultSigner
+func WithResultSigner(signer principal.Signer) Option {
+	return func(is *IndexingService) {
+		is.resultSigner = signer
+	}
+}
+
+// errUnsupportedResultKey is returned when the publisher key can't sign results
+var errUnsupportedResultKey = errors.New("only Ed25519 keys can sign query results")
+
+// newResultSigner returns a signer for query results with the publisher key, so
+// that results are attested by the same identity as the service's
+// advertisements
+func newResultSigner(key crypto.PrivKey) (principal.Signer, error) {
+	if key.Type() != crypto.Ed25519 {
+		return nil, errUnsupportedResultKey
+	}
+	raw, err := key.Raw()
+	if err != nil {
+		return nil, fmt.Errorf("reading publisher key: %w", err)
+	}
+	// the raw key is the seed followed by the public key, which is what the
+	// signer encoding holds, each prefixed with its multicodec
+	seed, pub := raw[:32], raw[32:]
+	b := binary.AppendUvarint(nil, signer.Code)
+	b = append(b, seed...)
+	b = binary.AppendUvarint(b, verifier.Code)
+	b = append(b, pub...)
+	return signer.Decode(b)
+}
+
+// attest attaches a receipt for the query to the result, signed now
+func (is *IndexingService) attest(q Query, qr queryresult.QueryResult) (queryresult.QueryResult, error) {
+	receipt, err := queryresult.SignReceipt(is.resultSigner, qr.Root().Link(), QueryDigest(q), time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("signing query result: %w", err)
+	}
+	return queryresult.WithReceipt(qr, receipt), nil
+}
+
+// QueryDigest is a canonical digest of the parts of a query that decide its
+// result, independent of the order of its hashes and spaces. Options that only
+// change how the result is found or attested, such as Prefetch, Walker,
+// Concurrency, Fresh and Attest, are left out. Options are only written when
+// set, each after a tag of its own, so digests of queries that set none of
+// the later options are unchanged
+func QueryDigest(q Query) []byte {
+	hashes := make([]string, 0, len(q.Hashes))
+	for _, h := range q.Hashes {
+		hashes = append(hashes, string(h))
+	}
+	slices.Sort(hashes)
+	spaces := make([]string, 0, len(q.Match.Subject))
+	for _, s := range q.Match.Subject {
+		spaces = append(spaces, s.String())
+	}
+	slices.Sort(spaces)
+	knownClaims := make([]string, 0, len(q.KnownClaims))
+	for _, c := range q.KnownClaims {
+		knownClaims = append(knownClaims, c.KeyString())
+	}
+	slices.Sort(knownClaims)
+	knownIndexes := make([]string, 0, len(q.KnownIndexes))
+	for _, contextID := range q.KnownIndexes {
+		knownIndexes = append(knownIndexes, string(contextID))
+	}
+	slices.Sort(knownIndexes)
+	h := sha256.New()
+	for _, part := range [][]string{hashes, spaces, knownClaims, knownIndexes} {
+		part = slices.Compact(part)
+		h.Write(binary.AppendUvarint(nil, uint64(len(part))))
+		for _, s := range part {
+			h.Write(binary.AppendUvarint(nil, uint64(len(s))))
+			h.Write([]byte(s))
+		}
+	}
+	h.Write(binary.AppendVarint(nil, int64(q.MaxProviderAge)))
+	if q.IncludeSuperseded {
+		h.Write([]byte{1})
+	}
+	if q.CanonicalizeAliases {
+		h.Write([]byte{2})
+	}
+	if q.StrictSpaces {
+		h.Write([]byte{3})
+	}
+	if q.FirstLocationWins {
+		h.Write([]byte{4})
+	}
+	if q.Diagnose {
+		h.Write([]byte{5})
+	}
+	if q.ProbeLocations {
+		h.Write([]byte{6})
+	}
+	// the limit is written last, so that its value can't be read as a tag
+	if q.MaxResultsPerHash > 0 {
+		h.Write([]byte{7})
+		h.Write(binary.AppendUvarint(nil, uint64(q.MaxResultsPerHash)))
+	}
+	return h.Sum(nil)
+}
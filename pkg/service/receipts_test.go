@@ -0,0 +1,96 @@
+package service_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/go-ucanto/principal/ed25519/signer"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/blobindexlookup"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexingService__Attest(t *testing.T) {
+	ctx := context.Background()
+	id := testutil.Must(signer.Generate())(t)
+	newService := func(opts ...service.Option) *service.IndexingService {
+		providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: map[string][]model.ProviderResult{}, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		return testutil.Must(service.NewIndexingService(blobindexlookup.NewBlobIndexLookup(http.DefaultClient), claimlookup.NewClaimLookup(http.DefaultClient), providerIndex, opts...))(t)
+	}
+	hashes := testutil.RandomMultihashes(2)
+
+	t.Run("results of queries asking to attest them carry a receipt", func(t *testing.T) {
+		q := service.Query{Hashes: hashes, Attest: true}
+		qr := testutil.Must(newService(service.WithResultSigner(id)).Query(ctx, q))(t)
+		receipt, ok := qr.Receipt()
+		require.True(t, ok)
+		require.NoError(t, queryresult.VerifyReceipt(receipt, qr.Root().Link(), id.DID()))
+		require.Equal(t, service.QueryDigest(q), receipt.Query)
+	})
+
+	t.Run("results of other queries don't", func(t *testing.T) {
+		qr := testutil.Must(newService(service.WithResultSigner(id)).Query(ctx, service.Query{Hashes: hashes}))(t)
+		_, ok := qr.Receipt()
+		require.False(t, ok)
+	})
+
+	t.Run("services without a signer fail queries asking for receipts", func(t *testing.T) {
+		_, err := newService().Query(ctx, service.Query{Hashes: hashes, Attest: true})
+		require.ErrorIs(t, err, service.ErrNoResultSigner)
+	})
+
+	t.Run("query digests don't depend on the order of hashes", func(t *testing.T) {
+		reversed := []multihash.Multihash{hashes[1], hashes[0]}
+		require.Equal(t, service.QueryDigest(service.Query{Hashes: hashes}), service.QueryDigest(service.Query{Hashes: reversed}))
+		require.NotEqual(t, service.QueryDigest(service.Query{Hashes: hashes}), service.QueryDigest(service.Query{Hashes: hashes[:1]}))
+	})
+
+	t.Run("query digests differ for every option that changes the result", func(t *testing.T) {
+		queries := []service.Query{
+			{Hashes: hashes},
+			{Hashes: hashes, Match: service.Match{Subject: []did.DID{testutil.Alice.DID()}}},
+			{Hashes: hashes, StrictSpaces: true},
+			{Hashes: hashes, MaxProviderAge: time.Hour},
+			{Hashes: hashes, IncludeSuperseded: true},
+			{Hashes: hashes, CanonicalizeAliases: true},
+			{Hashes: hashes, FirstLocationWins: true},
+			{Hashes: hashes, MaxResultsPerHash: 1},
+			{Hashes: hashes, MaxResultsPerHash: 2},
+			{Hashes: hashes, KnownClaims: []cid.Cid{testutil.RandomCID().(cidlink.Link).Cid}},
+			{Hashes: hashes, KnownIndexes: []types.EncodedContextID{testutil.RandomBytes(10)}},
+			{Hashes: hashes, Diagnose: true},
+			{Hashes: hashes, ProbeLocations: true},
+			{Hashes: hashes, StrictSpaces: true, FirstLocationWins: true},
+		}
+		digests := map[string]int{}
+		for i, q := range queries {
+			digest := string(service.QueryDigest(q))
+			prev, ok := digests[digest]
+			require.False(t, ok, "query %d has the digest of query %d", i, prev)
+			digests[digest] = i
+		}
+
+		// options that don't change the result don't change the digest
+		for _, q := range []service.Query{
+			{Hashes: hashes, Prefetch: 3},
+			{Hashes: hashes, Concurrency: 2},
+			{Hashes: hashes, Fresh: true},
+			{Hashes: hashes, Attest: true},
+		} {
+			require.Equal(t, service.QueryDigest(service.Query{Hashes: hashes}), service.QueryDigest(q))
+		}
+	})
+}
@@ -0,0 +1,421 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/core/ipld"
+	"github.com/storacha/go-ucanto/principal"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/go-ucanto/validator"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	adm "github.com/storacha/indexing-service/pkg/capability/assert/datamodel"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+const (
+	// DefaultMaxShardSize is the size in bytes of the largest shard scanned to
+	// reconstruct an index
+	DefaultMaxShardSize = 4 << 30
+	// reconstructTimeout bounds how long the background reconstruction of an
+	// index may run
+	reconstructTimeout = 10 * time.Minute
+)
+
+// ErrReconstructionDisabled is returned from ReconstructIndex when the service
+// wasn't configured to reconstruct indexes
+var ErrReconstructionDisabled = errors.New("index reconstruction not enabled")
+
+// ErrShardTooLarge is returned from ReconstructIndex for shards larger than the
+// maximum size scanned
+var ErrShardTooLarge = errors.New("shard too large to reconstruct an index of")
+
+// IndexReconstruction configures the reconstruction of indexes whose blobs are
+// lost from the shards they index, which are still retrievable from their
+// location commitments
+type IndexReconstruction struct {
+	// Cache is where reconstructed indexes are kept, which should be the cache
+	// of the service's blob index lookup, so that they are found in place of the
+	// lost blobs
+	Cache types.ShardedDagIndexStore
+	// Client fetches the shards. If nil, http.DefaultClient is used
+	Client *http.Client
+	// Signer issues the index claims republished for reconstructed indexes. If
+	// nil, they can't be republished
+	Signer principal.Signer
+	// MaxShardSize is the size in bytes of the largest shard scanned. If zero,
+	// DefaultMaxShardSize is used
+	MaxShardSize uint64
+	// OnFetchFailure are the shards of the indexes, by the CID of the index,
+	// that are reconstructed in the background when the index can't be fetched
+	// while a query is walked
+	OnFetchFailure map[cid.Cid][]cid.Cid
+}
+
+// reconstructor is the state of index reconstruction
+type reconstructor struct {
+	IndexReconstruction
+	// shards are those of OnFetchFailure, by the multihash of the index
+	shards  map[string][]cid.Cid
+	lk      sync.Mutex
+	running map[string]struct{}
+}
+
+// WithIndexReconstruction allows the indexes of shards to be reconstructed with
+// ReconstructIndex, and in the background for indexes that can't be fetched
+// and have shards to reconstruct them from
+func WithIndexReconstruction(cfg IndexReconstruction) Option {
+	return func(is *IndexingService) {
+		if cfg.Client == nil {
+			cfg.Client = http.DefaultClient
+		}
+		if cfg.MaxShardSize == 0 {
+			cfg.MaxShardSize = DefaultMaxShardSize
+		}
+		r := &reconstructor{IndexReconstruction: cfg, shards: map[string][]cid.Cid{}, running: map[string]struct{}{}}
+		for index, shards := range cfg.OnFetchFailure {
+			r.shards[string(index.Hash())] = shards
+		}
+		is.reconstruction = r
+	}
+}
+
+type (
+	// ReconstructOption configures the reconstruction of an index
+	ReconstructOption func(*reconstructConfig)
+
+	reconstructConfig struct {
+		contextID types.EncodedContextID
+		content   ipld.Link
+		republish bool
+	}
+)
+
+// ReconstructedFor caches the reconstructed index under the context ID of the
+// location commitment of the lost index blob, so that queries find it in place
+// of the blob. Without it, the index is cached under the digest of its archive
+func ReconstructedFor(contextID types.EncodedContextID) ReconstructOption {
+	return func(c *reconstructConfig) {
+		c.contextID = contextID
+	}
+}
+
+// ReconstructedContent sets the content the reconstructed index is for. Without
+// it, the index is for the first root of the shard
+func ReconstructedContent(content ipld.Link) ReconstructOption {
+	return func(c *reconstructConfig) {
+		c.content = content
+	}
+}
+
+// RepublishReconstructed publishes an index claim for the reconstructed index,
+// issued by the service and flagged as reconstructed
+func RepublishReconstructed() ReconstructOption {
+	return func(c *reconstructConfig) {
+		c.republish = true
+	}
+}
+
+// ReconstructIndex reconstructs the index of a shard by streaming the shard
+// from the URLs of its location commitment and scanning the headers of its
+// blocks, so that neither the shard nor its blocks are held in memory. If
+// location is nil, the commitment is looked up. The index is cached, and
+// republished if asked to
+func (is *IndexingService) ReconstructIndex(ctx context.Context, shard cid.Cid, location delegation.Delegation, opts ...ReconstructOption) (blobindex.ShardedDagIndexView, error) {
+	if is.reconstruction == nil {
+		return nil, ErrReconstructionDisabled
+	}
+	cfg := reconstructConfig{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.republish && is.reconstruction.Signer == nil {
+		return nil, errors.New("no signer to republish reconstructed indexes with")
+	}
+	index, err := is.scanShard(ctx, shard, location, cfg.content)
+	if err != nil {
+		return nil, err
+	}
+	return index, is.keepReconstructed(ctx, index, cfg)
+}
+
+// scanShard reconstructs the index of the shard from each URL of its location
+// commitment in turn, until one succeeds
+func (is *IndexingService) scanShard(ctx context.Context, shard cid.Cid, location delegation.Delegation, content ipld.Link) (blobindex.ShardedDagIndexView, error) {
+	var err error
+	if location == nil {
+		location, err = is.shardLocation(ctx, shard.Hash())
+		if err != nil {
+			return nil, err
+		}
+	}
+	nb, err := shardCaveats(location, shard.Hash())
+	if err != nil {
+		return nil, err
+	}
+	maxSize := is.reconstruction.MaxShardSize
+	if nb.Range != nil && nb.Range.Length != nil && *nb.Range.Length > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrShardTooLarge, *nb.Range.Length)
+	}
+	urls := is.commitmentURLs(ctx, location)
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("location commitment for shard %s has no fetchable URLs", shard)
+	}
+	// a whole shard can take longer than the URL timeout to stream, so each URL
+	// is given as long as the context allows
+	var errs []error
+	for _, u := range urls {
+		index, err := is.scanShardAt(ctx, u, shard.Hash(), nb.Range, content)
+		if err == nil {
+			return index, nil
+		}
+		if errors.Is(err, ErrShardTooLarge) || ctx.Err() != nil {
+			return nil, err
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// scanShardAt reconstructs the index of the shard at the range of the URL
+func (is *IndexingService) scanShardAt(ctx context.Context, u url.URL, shard multihash.Multihash, rng *adm.Range, content ipld.Link) (blobindex.ShardedDagIndexView, error) {
+	maxSize := is.reconstruction.MaxShardSize
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if rng != nil {
+		rangeHeader := fmt.Sprintf("bytes=%d-", rng.Offset)
+		if rng.Length != nil {
+			rangeHeader += strconv.FormatUint(rng.Offset+*rng.Length-1, 10)
+		}
+		req.Header.Set("Range", rangeHeader)
+	}
+	resp, err := is.reconstruction.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching shard from %s: %w", u.Redacted(), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, types.OriginStatusError(resp.StatusCode, fmt.Errorf("fetching shard from %s: status: %s", u.Redacted(), resp.Status))
+	}
+	var body io.Reader = resp.Body
+	if rng != nil && resp.StatusCode != http.StatusPartialContent {
+		// the whole blob was sent, of which the shard is the range
+		if _, err := io.CopyN(io.Discard, body, int64(rng.Offset)); err != nil {
+			return nil, fmt.Errorf("fetching shard from %s: %w", u.Redacted(), err)
+		}
+		if rng.Length != nil {
+			body = io.LimitReader(body, int64(*rng.Length))
+		}
+	} else if resp.ContentLength > 0 && uint64(resp.ContentLength) > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrShardTooLarge, resp.ContentLength)
+	}
+	limited := &io.LimitedReader{R: body, N: int64(maxSize) + 1}
+	index, err := blobindex.FromShard(limited, shard, content)
+	if err != nil {
+		if limited.N == 0 {
+			return nil, fmt.Errorf("%w: more than %d bytes", ErrShardTooLarge, maxSize)
+		}
+		return nil, fmt.Errorf("scanning shard from %s: %w", u.Redacted(), err)
+	}
+	return index, nil
+}
+
+// shardCaveats returns the caveats of the location commitment of the shard
+func shardCaveats(location delegation.Delegation, shard multihash.Multihash) (assert.LocationCaveats, error) {
+	for _, capability := range location.Capabilities() {
+		if capability.Can() != assert.LocationAbility {
+			continue
+		}
+		match, fail := assert.Location.Match(validator.NewSource(capability, location))
+		if fail != nil {
+			continue
+		}
+		if nb := match.Value().Nb(); bytes.Equal(nb.Content.Hash(), shard) {
+			return nb, nil
+		}
+	}
+	return assert.LocationCaveats{}, fmt.Errorf("claim %s is not a location commitment for shard %s", location.Link(), shard.B58String())
+}
+
+// shardLocation looks up a location commitment for the shard, from the first
+// provider of one the service allows
+func (is *IndexingService) shardLocation(ctx context.Context, shard multihash.Multihash) (delegation.Delegation, error) {
+	fr, err := is.providerIndex.FindDetailed(ctx, providerindex.QueryKey{
+		Hash:         shard,
+		TargetClaims: targetClaims[locationJobType],
+	})
+	if err != nil {
+		return nil, err
+	}
+	cfg := is.config.Load()
+	for _, result := range fr.Results {
+		if cfg.isDenied(result.Provider, is.identities) || !is.allowedProvider(ctx, result.Provider) {
+			continue
+		}
+		md := metadata.MetadataContext.New()
+		if err := md.UnmarshalBinary(result.Metadata); err != nil {
+			continue
+		}
+		for _, code := range md.Protocols() {
+			location, ok := md.Get(code).(*metadata.LocationCommitmentMetadata)
+			if !ok {
+				continue
+			}
+			url, err := is.fetchClaimURL(ctx, *result.Provider, location.Claim)
+			if err != nil {
+				continue
+			}
+			claim, err := is.claimLookup.LookupClaim(ctx, location.Claim, *url)
+			if err != nil {
+				log.Debugw("fetching shard location", "shard", shard, "error", err)
+				continue
+			}
+			return claim, nil
+		}
+	}
+	return nil, fmt.Errorf("no location commitment found for shard %s", shard.B58String())
+}
+
+// keepReconstructed caches the reconstructed index, and republishes an index
+// claim for it if the config asks to
+func (is *IndexingService) keepReconstructed(ctx context.Context, index blobindex.ShardedDagIndexView, cfg reconstructConfig) error {
+	var link ipld.Link
+	contextID := cfg.contextID
+	if contextID == nil || cfg.republish {
+		var err error
+		link, err = indexLink(index)
+		if err != nil {
+			return err
+		}
+		if contextID == nil {
+			contextID = types.EncodedContextID(link.(cidlink.Link).Hash())
+		}
+	}
+	if err := is.reconstruction.Cache.Set(ctx, contextID, index, true); err != nil {
+		return fmt.Errorf("caching reconstructed index: %w", err)
+	}
+	if !cfg.republish {
+		return nil
+	}
+	claim, err := reconstructedClaim(is.reconstruction.Signer, index.Content(), link)
+	if err != nil {
+		return err
+	}
+	if err := is.PublishClaim(ctx, claim); err != nil {
+		return fmt.Errorf("republishing reconstructed index: %w", err)
+	}
+	return nil
+}
+
+// indexLink returns the CID of the archive of the index
+func indexLink(index blobindex.ShardedDagIndexView) (ipld.Link, error) {
+	r, err := index.Archive()
+	if err != nil {
+		return nil, fmt.Errorf("archiving reconstructed index: %w", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("archiving reconstructed index: %w", err)
+	}
+	digest, err := multihash.Sum(data, multihash.SHA2_256, -1)
+	if err != nil {
+		return nil, err
+	}
+	return cidlink.Link{Cid: cid.NewCidV1(uint64(multicodec.Car), digest)}, nil
+}
+
+// reconstructedFact flags a claim as one for a reconstructed index
+type reconstructedFact struct{}
+
+func (reconstructedFact) ToIPLD() (map[string]datamodel.Node, error) {
+	return map[string]datamodel.Node{"reconstructed": basicnode.NewBool(true)}, nil
+}
+
+// reconstructedClaim returns an index claim for the reconstructed index, issued
+// by the signer to itself
+func reconstructedClaim(signer principal.Signer, content ipld.Link, index ipld.Link) (delegation.Delegation, error) {
+	capability := assert.Index.New(signer.DID().String(), assert.IndexCaveats{Content: content, Index: index})
+	claim, err := delegation.Delegate(signer, signer, []ucan.Capability[assert.IndexCaveats]{capability},
+		delegation.WithFacts([]ucan.FactBuilder{reconstructedFact{}}))
+	if err != nil {
+		return nil, fmt.Errorf("issuing reconstructed index claim: %w", err)
+	}
+	return claim, nil
+}
+
+// reconstructOnFailure reconstructs the index in the background from its
+// shards, if it has shards to reconstruct it from, caching it under the
+// context ID of its location commitment so that later queries find it. An
+// index already being reconstructed isn't reconstructed again
+func (is *IndexingService) reconstructOnFailure(index multihash.Multihash, contextID types.EncodedContextID) {
+	r := is.reconstruction
+	if r == nil {
+		return
+	}
+	shards, ok := r.shards[string(index)]
+	if !ok || len(shards) == 0 {
+		return
+	}
+	r.lk.Lock()
+	if _, ok := r.running[string(contextID)]; ok {
+		r.lk.Unlock()
+		return
+	}
+	r.running[string(contextID)] = struct{}{}
+	r.lk.Unlock()
+	go func() {
+		defer func() {
+			r.lk.Lock()
+			delete(r.running, string(contextID))
+			r.lk.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), reconstructTimeout)
+		defer cancel()
+		if err := is.reconstructShards(ctx, shards, contextID); err != nil {
+			log.Warnw("reconstructing index", "index", index, "error", err)
+			return
+		}
+		log.Infow("reconstructed index", "index", index, "shards", len(shards))
+	}()
+}
+
+// reconstructShards reconstructs the index of each of the shards, caching them
+// together as the index of the context ID
+func (is *IndexingService) reconstructShards(ctx context.Context, shards []cid.Cid, contextID types.EncodedContextID) error {
+	var merged blobindex.ShardedDagIndexView
+	for _, shard := range shards {
+		index, err := is.scanShard(ctx, shard, nil, nil)
+		if err != nil {
+			return fmt.Errorf("reconstructing shard %s: %w", shard, err)
+		}
+		if merged == nil {
+			merged = blobindex.NewShardedDagIndexView(index.Content(), len(shards))
+		}
+		for hash, slices := range index.Shards().Iterator() {
+			for slice, position := range slices.Iterator() {
+				merged.SetSlice(hash, slice, position)
+			}
+		}
+	}
+	return is.keepReconstructed(ctx, merged, reconstructConfig{contextID: contextID})
+}
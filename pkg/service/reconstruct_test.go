@@ -0,0 +1,266 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/maurl"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/car"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/core/ipld/block"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	adm "github.com/storacha/indexing-service/pkg/capability/assert/datamodel"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// memIndexStore is a sharded dag index store safe for concurrent use
+type memIndexStore struct {
+	lk      sync.Mutex
+	indexes map[string]blobindex.ShardedDagIndexView
+}
+
+func newMemIndexStore() *memIndexStore {
+	return &memIndexStore{indexes: map[string]blobindex.ShardedDagIndexView{}}
+}
+
+func (m *memIndexStore) Get(ctx context.Context, contextID types.EncodedContextID) (blobindex.ShardedDagIndexView, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	index, ok := m.indexes[string(contextID)]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return index, nil
+}
+
+func (m *memIndexStore) Set(ctx context.Context, contextID types.EncodedContextID, index blobindex.ShardedDagIndexView, expires bool) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.indexes[string(contextID)] = index
+	return nil
+}
+
+func (m *memIndexStore) SetExpirable(ctx context.Context, contextID types.EncodedContextID, expires bool) error {
+	return nil
+}
+
+func (m *memIndexStore) size() int {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return len(m.indexes)
+}
+
+// cachedIndexLookup finds indexes in the cache only, as the index blobs are lost
+type cachedIndexLookup struct {
+	cache *memIndexStore
+}
+
+func (l cachedIndexLookup) Find(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, fetchURL url.URL, rng *metadata.Range) (blobindex.ShardedDagIndexView, error) {
+	return l.cache.Get(ctx, contextID)
+}
+
+// shardCAR returns a CAR of blocks of the given sizes, rooted at the first, and
+// the digest of the CAR
+func shardCAR(t *testing.T, sizes ...int) ([]byte, multihash.Multihash) {
+	var blocks []block.Block
+	for _, size := range sizes {
+		data := testutil.RandomBytes(size)
+		c := testutil.Must(cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum(data))(t)
+		blocks = append(blocks, block.NewBlock(cidlink.Link{Cid: c}, data))
+	}
+	r := car.Encode([]datamodel.Link{blocks[0].Link()}, func(yield func(block.Block, error) bool) {
+		for _, b := range blocks {
+			if !yield(b, nil) {
+				return
+			}
+		}
+	})
+	data := testutil.Must(io.ReadAll(r))(t)
+	return data, testutil.Must(multihash.Sum(data, multihash.SHA2_256, -1))(t)
+}
+
+func locationCommitment(t *testing.T, shard multihash.Multihash, rng *adm.Range, urls ...string) delegation.Delegation {
+	var locations []url.URL
+	for _, u := range urls {
+		locations = append(locations, *testutil.Must(url.Parse(u))(t))
+	}
+	return testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.LocationCaveats]{
+		assert.Location.New(testutil.Service.DID().String(), assert.LocationCaveats{Content: assert.FromHash(shard), Location: locations, Range: rng}),
+	}))(t)
+}
+
+func TestIndexingService__ReconstructIndex(t *testing.T) {
+	ctx := context.Background()
+	var blobsLk sync.Mutex
+	blobs := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blobsLk.Lock()
+		blob, ok := blobs[r.URL.Path]
+		blobsLk.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer server.Close()
+	serve := func(path string, data []byte) string {
+		blobsLk.Lock()
+		defer blobsLk.Unlock()
+		blobs[path] = data
+		return server.URL + path
+	}
+
+	shard, digest := shardCAR(t, 10, 300, 1, 70000, 128)
+	roots, _ := testutil.Must2(car.Decode(bytes.NewReader(shard)))(t)
+	want := testutil.Must(blobindex.FromShardArchives(roots[0], [][]byte{shard}))(t)
+	shardCid := cid.NewCidV1(cid.Raw, digest)
+	newService := func(cache *memIndexStore, cfg service.IndexReconstruction) *service.IndexingService {
+		cfg.Cache = cache
+		return testutil.Must(service.NewIndexingService(cachedIndexLookup{cache}, claimlookup.NewClaimLookup(http.DefaultClient), nil, service.WithIndexReconstruction(cfg)))(t)
+	}
+
+	t.Run("matches the index of the shard", func(t *testing.T) {
+		cache := newMemIndexStore()
+		is := newService(cache, service.IndexReconstruction{})
+		// the first URL has lost the shard too
+		location := locationCommitment(t, digest, nil, server.URL+"/lost", serve("/shard", shard))
+		index := testutil.Must(is.ReconstructIndex(ctx, shardCid, location))(t)
+		testutil.RequireEqualIndex(t, want, index)
+		require.Equal(t, 1, cache.size())
+
+		contextID := testutil.RandomBytes(10)
+		content := testutil.RandomCID()
+		index = testutil.Must(is.ReconstructIndex(ctx, shardCid, location, service.ReconstructedFor(contextID), service.ReconstructedContent(content)))(t)
+		require.Equal(t, content, index.Content())
+		require.Equal(t, index, testutil.Must(cache.Get(ctx, contextID))(t))
+	})
+
+	t.Run("shards in a range of a blob", func(t *testing.T) {
+		cache := newMemIndexStore()
+		is := newService(cache, service.IndexReconstruction{})
+		prefix := testutil.RandomBytes(1000)
+		blob := append(append(prefix, shard...), testutil.RandomBytes(500)...)
+		length := uint64(len(shard))
+		location := locationCommitment(t, digest, &adm.Range{Offset: uint64(len(prefix)), Length: &length}, serve("/blob", blob))
+		index := testutil.Must(is.ReconstructIndex(ctx, shardCid, location))(t)
+		testutil.RequireEqualIndex(t, want, index)
+	})
+
+	t.Run("truncated shards fail", func(t *testing.T) {
+		cache := newMemIndexStore()
+		is := newService(cache, service.IndexReconstruction{})
+		location := locationCommitment(t, digest, nil, serve("/truncated", shard[:len(shard)-100]))
+		_, err := is.ReconstructIndex(ctx, shardCid, location)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		require.Zero(t, cache.size())
+	})
+
+	t.Run("shards larger than the maximum fail", func(t *testing.T) {
+		is := newService(newMemIndexStore(), service.IndexReconstruction{MaxShardSize: 1000})
+		location := locationCommitment(t, digest, nil, serve("/shard", shard))
+		_, err := is.ReconstructIndex(ctx, shardCid, location)
+		require.ErrorIs(t, err, service.ErrShardTooLarge)
+	})
+
+	t.Run("commitments for other shards fail", func(t *testing.T) {
+		is := newService(newMemIndexStore(), service.IndexReconstruction{})
+		location := locationCommitment(t, testutil.RandomMultihash(), nil, serve("/shard", shard))
+		_, err := is.ReconstructIndex(ctx, shardCid, location)
+		require.Error(t, err)
+	})
+
+	t.Run("republishing needs a signer", func(t *testing.T) {
+		is := newService(newMemIndexStore(), service.IndexReconstruction{})
+		location := locationCommitment(t, digest, nil, serve("/shard", shard))
+		_, err := is.ReconstructIndex(ctx, shardCid, location, service.RepublishReconstructed())
+		require.Error(t, err)
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), nil))(t)
+		_, err := is.ReconstructIndex(ctx, shardCid, locationCommitment(t, digest, nil, serve("/shard", shard)))
+		require.ErrorIs(t, err, service.ErrReconstructionDisabled)
+	})
+
+	t.Run("lost indexes of allowlisted shards are reconstructed in the background", func(t *testing.T) {
+		other, otherDigest := shardCAR(t, 20, 40)
+		otherCid := cid.NewCidV1(cid.Raw, otherDigest)
+		provider := &peer.AddrInfo{
+			ID:    testutil.RandomPeer(),
+			Addrs: []multiaddr.Multiaddr{testutil.Must(maurl.FromURL(testutil.Must(url.Parse(server.URL + "/claims/{claim}"))(t)))(t)},
+		}
+		publishClaim := func(t *testing.T, claim delegation.Delegation) model.ProviderResult {
+			claimCid := claim.Link().(cidlink.Link).Cid
+			serve("/claims/"+claimCid.String(), testutil.Must(io.ReadAll(claim.Archive()))(t))
+			return model.ProviderResult{
+				ContextID: testutil.RandomBytes(10),
+				Metadata:  testutil.Must((&metadata.LocationCommitmentMetadata{Claim: claimCid}).MarshalBinary())(t),
+				Provider:  provider,
+			}
+		}
+		indexCid := testutil.RandomCID().(cidlink.Link).Cid
+		indexClaim := testutil.RandomIndexDelegation()
+		indexClaimCid := indexClaim.Link().(cidlink.Link).Cid
+		serve("/claims/"+indexClaimCid.String(), testutil.Must(io.ReadAll(indexClaim.Archive()))(t))
+		indexResult := model.ProviderResult{
+			ContextID: testutil.RandomBytes(10),
+			Metadata:  testutil.Must((&metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaimCid}).MarshalBinary())(t),
+			Provider:  provider,
+		}
+		// the index blob is committed to, but is lost
+		indexLocation := publishClaim(t, locationCommitment(t, indexCid.Hash(), nil, server.URL+"/lost"))
+		block := want.Shards().Get(digest)
+		var blockHash multihash.Multihash
+		for hash := range block.Iterator() {
+			blockHash = hash
+			break
+		}
+		finder := &countingFinder{calls: map[string]int{}, results: map[string][]model.ProviderResult{
+			string(blockHash):       {indexResult},
+			string(indexCid.Hash()): {indexLocation},
+			string(digest):          {publishClaim(t, locationCommitment(t, digest, nil, serve("/shard", shard)))},
+			string(otherDigest):     {publishClaim(t, locationCommitment(t, otherDigest, nil, serve("/other", other)))},
+		}}
+		providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, finder, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		cache := newMemIndexStore()
+		is := testutil.Must(service.NewIndexingService(cachedIndexLookup{cache}, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex,
+			service.WithIndexReconstruction(service.IndexReconstruction{
+				Cache:          cache,
+				OnFetchFailure: map[cid.Cid][]cid.Cid{indexCid: {shardCid, otherCid}},
+			})))(t)
+
+		qr := testutil.Must(is.Query(ctx, service.Query{Hashes: []multihash.Multihash{blockHash}}))(t)
+		require.Empty(t, qr.Indexes())
+		require.Eventually(t, func() bool { return cache.size() == 1 }, 5*time.Second, 10*time.Millisecond)
+		index := testutil.Must(cache.Get(ctx, indexLocation.ContextID))(t)
+		require.Equal(t, 2, index.Shards().Size())
+		require.Equal(t, want.Shards().Get(digest), index.Shards().Get(digest))
+
+		// the next query finds the reconstructed index
+		qr = testutil.Must(is.Query(ctx, service.Query{Hashes: []multihash.Multihash{blockHash}}))(t)
+		require.Len(t, qr.Indexes(), 1)
+	})
+}
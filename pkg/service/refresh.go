@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// The stores a refresh drops the cached state of a hash from, in the order they
+// are refreshed
+const (
+	// RefreshProviders is the provider store, including entries caching that
+	// IPNI had no records of the hash
+	RefreshProviders = types.ProvidersCache
+	// RefreshRecent is the in-memory results of recent IPNI lookups
+	RefreshRecent = types.RecentProvidersCache
+	// RefreshClaims is the claim cache, which the claims the cached records of
+	// the hash refer to are evicted from
+	RefreshClaims = types.ClaimsCache
+	// RefreshResults is the in-memory cache of query results
+	RefreshResults = "results"
+)
+
+// hashInvalidator is implemented by provider indexes that can drop the records
+// cached for a hash
+type hashInvalidator interface {
+	Invalidate(ctx context.Context, hash multihash.Multihash) (providerindex.Invalidation, error)
+}
+
+// RefreshOptions configures the refresh of a hash
+type RefreshOptions struct {
+	// Resolve queries for the hash once its cached state is dropped, so that
+	// the caches are populated again from IPNI
+	Resolve bool
+}
+
+// RefreshStoreResult is what a refresh dropped from a store
+type RefreshStoreResult struct {
+	Store string
+	// Deleted is the number of records deleted from the provider store, and of
+	// entries deleted from the other stores
+	Deleted int
+	// Skipped is why the store wasn't refreshed, if it wasn't
+	Skipped string
+	// Err is why the store couldn't be refreshed, if it couldn't
+	Err error
+}
+
+// RefreshResolution is what the query run once the cached state of a hash was
+// dropped found
+type RefreshResolution struct {
+	Claims   []cid.Cid
+	Indexes  []cid.Cid
+	Duration time.Duration
+	// Err is why the query failed, if it did
+	Err error
+}
+
+// RefreshReport is what a refresh dropped from each store, and what the hash
+// resolved to afterwards
+type RefreshReport struct {
+	Hash multihash.Multihash
+	// Negative is set if the provider store had cached that IPNI had no records
+	// of the hash
+	Negative bool
+	// Tombstoned are the removed providers of the records deleted, whose
+	// records aren't cached again
+	Tombstoned []peer.ID
+	Stores     []RefreshStoreResult
+	// Resolution is set if the hash was resolved once refreshed
+	Resolution *RefreshResolution
+}
+
+// Err returns the errors of refreshing the stores and resolving the hash, or
+// nil if there were none
+func (r RefreshReport) Err() error {
+	var errs []error
+	for _, s := range r.Stores {
+		if s.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.Store, s.Err))
+		}
+	}
+	if r.Resolution != nil && r.Resolution.Err != nil {
+		errs = append(errs, fmt.Errorf("resolving: %w", r.Resolution.Err))
+	}
+	return errors.Join(errs...)
+}
+
+// Refresh drops everything cached for a hash: its provider records, including
+// an entry caching that IPNI had none, the recent results of IPNI lookups of
+// it, the claims its records refer to from the claim cache, and the cached
+// results of queries that looked it up. Tombstones are kept, so removed
+// providers stay removed. A store that can't be refreshed doesn't stop the
+// others from being refreshed, and is reported with its error. If asked to,
+// the hash is then queried for afresh to populate the caches again. The
+// returned error is that of the report
+func (is *IndexingService) Refresh(ctx context.Context, hash multihash.Multihash, opts RefreshOptions) (RefreshReport, error) {
+	report := RefreshReport{Hash: hash}
+	var claims []cid.Cid
+	if pi, ok := is.providerIndex.(hashInvalidator); ok {
+		inv, err := pi.Invalidate(ctx, hash)
+		report.Negative, report.Tombstoned, claims = inv.Negative, inv.Tombstoned, inv.Claims
+		recent := 0
+		if inv.Recent {
+			recent = 1
+		}
+		report.Stores = append(report.Stores,
+			RefreshStoreResult{Store: RefreshProviders, Deleted: inv.Records, Err: err},
+			RefreshStoreResult{Store: RefreshRecent, Deleted: recent},
+		)
+	} else {
+		report.Stores = append(report.Stores,
+			RefreshStoreResult{Store: RefreshProviders, Skipped: "provider index can't drop records"},
+			RefreshStoreResult{Store: RefreshRecent, Skipped: "provider index can't drop records"},
+		)
+	}
+	report.Stores = append(report.Stores, is.evictClaims(ctx, claims))
+	results := RefreshStoreResult{Store: RefreshResults, Skipped: "no result cache"}
+	if is.resultCache != nil {
+		results = RefreshStoreResult{Store: RefreshResults, Deleted: is.resultCache.invalidate([]multihash.Multihash{hash})}
+	}
+	report.Stores = append(report.Stores, results)
+
+	if opts.Resolve {
+		report.Resolution = is.resolve(ctx, hash)
+	}
+	return report, report.Err()
+}
+
+// evictClaims deletes the claims from the claim cache, counting those that were
+// cached
+func (is *IndexingService) evictClaims(ctx context.Context, claims []cid.Cid) RefreshStoreResult {
+	result := RefreshStoreResult{Store: RefreshClaims}
+	if is.claimCache == nil {
+		result.Skipped = "no claim cache"
+		return result
+	}
+	cache, ok := is.claimCache.(providerindex.ClaimCache)
+	if !ok {
+		result.Skipped = "claim cache can't delete claims"
+		return result
+	}
+	var errs []error
+	for _, claim := range claims {
+		if _, err := is.claimCache.Get(ctx, claim); err != nil {
+			if !errors.Is(err, types.ErrKeyNotFound) {
+				errs = append(errs, fmt.Errorf("reading claim %s: %w", claim, err))
+			}
+			continue
+		}
+		if err := cache.Delete(ctx, claim); err != nil {
+			errs = append(errs, fmt.Errorf("evicting claim %s: %w", claim, err))
+			continue
+		}
+		result.Deleted++
+	}
+	result.Err = errors.Join(errs...)
+	return result
+}
+
+// resolve queries for the hash, skipping the results of recent lookups
+func (is *IndexingService) resolve(ctx context.Context, hash multihash.Multihash) *RefreshResolution {
+	start := time.Now()
+	qr, err := is.Query(ctx, Query{Hashes: []multihash.Multihash{hash}, Fresh: true})
+	resolution := &RefreshResolution{Duration: time.Since(start), Err: err}
+	if err != nil {
+		return resolution
+	}
+	for _, link := range qr.Claims() {
+		resolution.Claims = append(resolution.Claims, link.(cidlink.Link).Cid)
+	}
+	for _, link := range qr.Indexes() {
+		resolution.Indexes = append(resolution.Indexes, link.(cidlink.Link).Cid)
+	}
+	return resolution
+}
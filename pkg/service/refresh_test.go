@@ -0,0 +1,186 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/maurl"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/stretchr/testify/require"
+)
+
+// deletingProviderStore is a provider store whose entries can be deleted,
+// failing to once err is set
+type deletingProviderStore struct {
+	*mockProviderStore
+	err error
+}
+
+func (m *deletingProviderStore) Delete(ctx context.Context, hash multihash.Multihash) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	delete(m.results, string(hash))
+	return nil
+}
+
+func (m *deletingProviderStore) cached(hash multihash.Multihash) bool {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	_, ok := m.results[string(hash)]
+	return ok
+}
+
+// deletingClaimStore is a claim store claims can be evicted from
+type deletingClaimStore struct {
+	*mockClaimStore
+}
+
+func (m *deletingClaimStore) Delete(ctx context.Context, claim cid.Cid) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	delete(m.claims, claim)
+	return nil
+}
+
+func (m *deletingClaimStore) cached(claim cid.Cid) bool {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	_, ok := m.claims[claim]
+	return ok
+}
+
+func TestIndexingService__Refresh(t *testing.T) {
+	ctx := context.Background()
+	capability := testutil.RandomIndexClaim()
+	claim := testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.IndexCaveats]{capability}))(t)
+	claimCid := claim.Link().(cidlink.Link).Cid
+	contentHash := capability.Nb().Content.(cidlink.Link).Hash()
+	claimBytes := testutil.Must(io.ReadAll(claim.Archive()))(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.Must(w.Write(claimBytes))(t)
+	}))
+	defer server.Close()
+	serverURL := testutil.Must(url.Parse(server.URL))(t)
+	serverURL.Path = "/claims/{claim}"
+	md := &metadata.IndexClaimMetadata{Index: testutil.RandomCID().(cidlink.Link).Cid, Claim: claimCid}
+	result := model.ProviderResult{
+		ContextID: testutil.RandomBytes(10),
+		Metadata:  testutil.Must(md.MarshalBinary())(t),
+		Provider: &peer.AddrInfo{
+			ID:    testutil.RandomPeer(),
+			Addrs: []multiaddr.Multiaddr{testutil.Must(maurl.FromURL(serverURL))(t)},
+		},
+	}
+
+	type fixture struct {
+		is     *service.IndexingService
+		store  *deletingProviderStore
+		claims *deletingClaimStore
+		finder *countingFinder
+	}
+	newFixture := func() fixture {
+		f := fixture{
+			store:  &deletingProviderStore{mockProviderStore: &mockProviderStore{results: map[string][]model.ProviderResult{}}},
+			claims: &deletingClaimStore{mockClaimStore: newMockClaimStore()},
+			finder: &countingFinder{results: map[string][]model.ProviderResult{string(contentHash): {result}}, calls: map[string]int{}},
+		}
+		providerIndex := providerindex.NewProviderIndex(f.store, f.finder, nil, nil, cidlink.DefaultLinkSystem(), nil, providerindex.WithRecentResults(8, time.Minute))
+		claimLookup := claimlookup.WithCache(claimlookup.NewClaimLookup(http.DefaultClient), f.claims)
+		f.is = testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimLookup, providerIndex, service.WithClaimCache(f.claims), service.WithResultCache(8, time.Minute)))(t)
+		return f
+	}
+	query := func(t *testing.T, is *service.IndexingService) {
+		qr := testutil.Must(is.Query(ctx, service.Query{Hashes: []multihash.Multihash{contentHash}}))(t)
+		require.Len(t, qr.Claims(), 1)
+	}
+	deleted := func(report service.RefreshReport) map[string]int {
+		counts := map[string]int{}
+		for _, s := range report.Stores {
+			counts[s.Store] = s.Deleted
+		}
+		return counts
+	}
+
+	t.Run("every store is cleared, and resolved again once", func(t *testing.T) {
+		f := newFixture()
+		query(t, f.is)
+		require.Equal(t, 1, f.finder.count(contentHash))
+		require.True(t, f.store.cached(contentHash))
+		require.True(t, f.claims.cached(claimCid))
+
+		report := testutil.Must(f.is.Refresh(ctx, contentHash, service.RefreshOptions{}))(t)
+		require.Equal(t, map[string]int{
+			service.RefreshProviders: 1,
+			service.RefreshRecent:    1,
+			service.RefreshClaims:    1,
+			service.RefreshResults:   1,
+		}, deleted(report))
+		require.False(t, report.Negative)
+		require.Nil(t, report.Resolution)
+		require.False(t, f.store.cached(contentHash))
+		require.False(t, f.claims.cached(claimCid))
+		require.Equal(t, 1, f.finder.count(contentHash))
+		// neither the recent results nor the result cache answer the query
+		query(t, f.is)
+		require.Equal(t, 2, f.finder.count(contentHash))
+
+		report = testutil.Must(f.is.Refresh(ctx, contentHash, service.RefreshOptions{Resolve: true}))(t)
+		require.Equal(t, 1, deleted(report)[service.RefreshProviders])
+		require.Equal(t, []cid.Cid{claimCid}, report.Resolution.Claims)
+		require.NoError(t, report.Resolution.Err)
+		require.Equal(t, 3, f.finder.count(contentHash))
+		require.True(t, f.store.cached(contentHash))
+		require.True(t, f.claims.cached(claimCid))
+	})
+
+	t.Run("hashes cached as unknown are reported as negative", func(t *testing.T) {
+		f := newFixture()
+		unknown := testutil.RandomMultihash()
+		testutil.Must(f.is.Query(ctx, service.Query{Hashes: []multihash.Multihash{unknown}}))(t)
+		require.True(t, f.store.cached(unknown))
+
+		report := testutil.Must(f.is.Refresh(ctx, unknown, service.RefreshOptions{Resolve: true}))(t)
+		require.True(t, report.Negative)
+		require.Zero(t, deleted(report)[service.RefreshProviders])
+		require.Empty(t, report.Resolution.Claims)
+		require.Equal(t, 2, f.finder.count(unknown))
+	})
+
+	t.Run("stores that can't be refreshed don't stop the others", func(t *testing.T) {
+		f := newFixture()
+		query(t, f.is)
+		f.store.err = errors.New("connection refused")
+
+		report, err := f.is.Refresh(ctx, contentHash, service.RefreshOptions{Resolve: true})
+		require.ErrorIs(t, err, f.store.err)
+		require.Equal(t, service.RefreshProviders, report.Stores[0].Store)
+		require.ErrorIs(t, report.Stores[0].Err, f.store.err)
+		require.Equal(t, 1, deleted(report)[service.RefreshRecent])
+		require.Equal(t, 1, deleted(report)[service.RefreshResults])
+		// the claims of the records are still known from the recent results
+		require.Equal(t, 1, deleted(report)[service.RefreshClaims])
+		require.NotNil(t, report.Resolution)
+	})
+}
@@ -0,0 +1,36 @@
+package service
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// providerRemover is implemented by provider indexes that can remove every
+// record of a provider
+type providerRemover interface {
+	RemoveProvider(ctx context.Context, provider peer.ID, opts ...providerindex.RemoveOption) error
+}
+
+// RemoveProvider removes every record naming the provider from the provider
+// index, advertises their removal, and evicts the claims only found through
+// them. Progress is sent to onProgress, if set, each time it is saved. It
+// returns providerindex.ErrRemovalUnsupported if the provider index can't remove
+// providers. Attempted removals are audited as made by the actor of the
+// context. See providerindex.ProviderIndex.RemoveProvider
+func (is *IndexingService) RemoveProvider(ctx context.Context, provider peer.ID, onProgress func(types.ProviderTombstone)) error {
+	pr, ok := is.providerIndex.(providerRemover)
+	if !ok {
+		return providerindex.ErrRemovalUnsupported
+	}
+	var opts []providerindex.RemoveOption
+	if onProgress != nil {
+		opts = append(opts, providerindex.WithRemovalProgress(onProgress))
+	}
+	err := pr.RemoveProvider(ctx, provider, opts...)
+	// the claims of the provider may be in any cached result
+	is.flushResults()
+	return is.auditRemoval(ctx, provider, err)
+}
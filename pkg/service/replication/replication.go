@@ -0,0 +1,228 @@
+// Package replication copies cache writes that originate from publishes to the
+// indexing services of other regions, so that their caches are warm before the
+// first query arrives there
+package replication
+
+import (
+	"bytes"
+	"context"
+	// for importing schema
+	_ "embed"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/schema"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/delegationutil"
+	"github.com/storacha/indexing-service/pkg/providerresults"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// ContentType is the media type of an encoded batch
+const ContentType = "application/cbor"
+
+var (
+	//go:embed replication.ipldsch
+	replicationBytes []byte
+	batchType        schema.Type
+)
+
+func init() {
+	typeSystem, err := ipld.LoadSchemaBytes(replicationBytes)
+	if err != nil {
+		panic(fmt.Errorf("failed to load schema: %w", err))
+	}
+	batchType = typeSystem.TypeByName("Batch")
+}
+
+// ProviderWrite is a set of provider results published for a multihash
+type ProviderWrite struct {
+	Hash    multihash.Multihash
+	Results []model.ProviderResult
+}
+
+// Batch is a set of cache writes made in one region, to be applied in others
+type Batch struct {
+	// Origin is the region the writes were made in. Regions never apply batches
+	// of their own origin, so writes cannot loop between them
+	Origin    string
+	Providers []ProviderWrite
+	Claims    []delegation.Delegation
+}
+
+// Empty returns true if the batch has no writes
+func (b Batch) Empty() bool {
+	return len(b.Providers) == 0 && len(b.Claims) == 0
+}
+
+// Size is the number of writes in the batch
+func (b Batch) Size() int {
+	return len(b.Providers) + len(b.Claims)
+}
+
+type batchModel struct {
+	Origin    string
+	Providers []providerWriteModel
+	Claims    [][]byte
+}
+
+type providerWriteModel struct {
+	Hash    []byte
+	Results []byte
+}
+
+// MarshalBatch encodes a batch in CBOR
+func MarshalBatch(b Batch) ([]byte, error) {
+	bm := batchModel{
+		Origin:    b.Origin,
+		Providers: make([]providerWriteModel, 0, len(b.Providers)),
+		Claims:    make([][]byte, 0, len(b.Claims)),
+	}
+	for _, pw := range b.Providers {
+		results, err := providerresults.MarshalCBOR(pw.Results)
+		if err != nil {
+			return nil, fmt.Errorf("encoding provider results: %w", err)
+		}
+		bm.Providers = append(bm.Providers, providerWriteModel{Hash: pw.Hash, Results: results})
+	}
+	for _, claim := range b.Claims {
+		archive, err := delegationutil.Canonicalize(claim)
+		if err != nil {
+			return nil, fmt.Errorf("archiving claim: %w", err)
+		}
+		bm.Claims = append(bm.Claims, archive)
+	}
+	return ipld.Marshal(dagcbor.Encode, &bm, batchType)
+}
+
+// UnmarshalBatch decodes a batch from CBOR-encoded bytes
+func UnmarshalBatch(data []byte) (Batch, error) {
+	var bm batchModel
+	if _, err := ipld.Unmarshal(data, dagcbor.Decode, &bm, batchType); err != nil {
+		return Batch{}, err
+	}
+	b := Batch{
+		Origin:    bm.Origin,
+		Providers: make([]ProviderWrite, 0, len(bm.Providers)),
+		Claims:    make([]delegation.Delegation, 0, len(bm.Claims)),
+	}
+	for _, pw := range bm.Providers {
+		hash, err := multihash.Cast(pw.Hash)
+		if err != nil {
+			return Batch{}, fmt.Errorf("decoding multihash: %w", err)
+		}
+		results, err := providerresults.UnmarshalCBOR(pw.Results)
+		if err != nil {
+			return Batch{}, fmt.Errorf("decoding provider results: %w", err)
+		}
+		b.Providers = append(b.Providers, ProviderWrite{Hash: hash, Results: results})
+	}
+	for _, archive := range bm.Claims {
+		claim, err := delegation.Extract(archive)
+		if err != nil {
+			return Batch{}, fmt.Errorf("extracting claim: %w", err)
+		}
+		b.Claims = append(b.Claims, claim)
+	}
+	return b, nil
+}
+
+// Sink receives batches of writes replicated from this region
+type Sink interface {
+	// ID identifies the sink, so that undelivered batches are retried against the
+	// same sink after a restart
+	ID() string
+	Replicate(ctx context.Context, batch Batch) error
+}
+
+// HTTPSink POSTs batches to the replication endpoint of a remote indexing
+// service
+type HTTPSink struct {
+	endpoint   string
+	token      string
+	httpClient *http.Client
+}
+
+var _ Sink = (*HTTPSink)(nil)
+
+// NewHTTPSink returns a sink POSTing to the given endpoint URL, authorized with
+// the given bearer token
+func NewHTTPSink(endpoint string, token string, httpClient *http.Client) *HTTPSink {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &HTTPSink{endpoint: endpoint, token: token, httpClient: httpClient}
+}
+
+// ID is the endpoint URL
+func (s *HTTPSink) ID() string {
+	return s.endpoint
+}
+
+// Replicate sends the batch to the remote service
+func (s *HTTPSink) Replicate(ctx context.Context, batch Batch) error {
+	data, err := MarshalBatch(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ContentType)
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failure response replicating batch. status: %s, message: %s", resp.Status, string(body))
+	}
+	return nil
+}
+
+// StoreSink writes batches straight to another set of stores, such as the
+// caches of a deployment being migrated to
+type StoreSink struct {
+	id            string
+	providerStore types.ProviderStore
+	claimStore    types.ContentClaimsStore
+}
+
+var _ Sink = (*StoreSink)(nil)
+
+// NewStoreSink returns a sink identified by id writing to the given stores.
+// Provider results are merged into those already stored for a hash
+func NewStoreSink(id string, providerStore types.ProviderStore, claimStore types.ContentClaimsStore) *StoreSink {
+	return &StoreSink{id: id, providerStore: providerStore, claimStore: claimStore}
+}
+
+// ID is the id the sink was created with
+func (s *StoreSink) ID() string {
+	return s.id
+}
+
+// Replicate writes the batch to the stores
+func (s *StoreSink) Replicate(ctx context.Context, batch Batch) error {
+	for _, pw := range batch.Providers {
+		if err := applyProviders(ctx, s.providerStore, pw); err != nil {
+			return fmt.Errorf("writing provider results: %w", err)
+		}
+	}
+	for _, claim := range batch.Claims {
+		if err := s.claimStore.Set(ctx, claim.Link().(cidlink.Link).Cid, claim, true); err != nil {
+			return fmt.Errorf("writing claim: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,440 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	logging "github.com/ipfs/go-log/v2"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/providerresults"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+var log = logging.Logger("replication")
+
+var outboxPrefix = datastore.NewKey("replication/outbox")
+
+// ErrOwnOrigin is returned when asked to apply a batch that originated in this
+// region
+var ErrOwnOrigin = errors.New("batch originated in this region")
+
+const (
+	// DefaultMaxBatchSize is the number of writes a batch is sent at, if the flush
+	// interval has not passed first
+	DefaultMaxBatchSize = 100
+	// DefaultFlushInterval is how often pending writes are batched for sending
+	DefaultFlushInterval = time.Second
+)
+
+type (
+	// Option configures a Replicator
+	Option func(*config)
+
+	config struct {
+		maxBatchSize  int
+		flushInterval time.Duration
+		minBackoff    time.Duration
+		maxBackoff    time.Duration
+		pollInterval  time.Duration
+	}
+
+	// Replicator batches publish-origin cache writes and sends them to sinks in
+	// other regions, and applies batches received from them. Batches are written
+	// to a persistent outbox before they are sent, so that undelivered batches
+	// survive restarts and are retried with exponential backoff
+	Replicator struct {
+		*config
+		origin        string
+		providerStore types.ProviderStore
+		claimStore    types.ContentClaimsStore
+		sinks         map[string]Sink
+		outbox        datastore.Batching
+		seq           atomic.Uint64
+		lk            sync.Mutex
+		pending       Batch
+		flush         chan struct{}
+		wake          chan struct{}
+		closing       chan struct{}
+		closed        chan struct{}
+	}
+
+	outboxEntry struct {
+		Sink        string    `json:"sink"`
+		Batch       []byte    `json:"batch"`
+		Attempts    int       `json:"attempts"`
+		NextAttempt time.Time `json:"nextAttempt"`
+	}
+)
+
+// WithMaxBatchSize sets the number of writes at which a batch is sent without
+// waiting for the flush interval
+func WithMaxBatchSize(size int) Option {
+	return func(c *config) {
+		c.maxBatchSize = size
+	}
+}
+
+// WithFlushInterval sets how often pending writes are batched for sending
+func WithFlushInterval(interval time.Duration) Option {
+	return func(c *config) {
+		c.flushInterval = interval
+	}
+}
+
+// WithRetryBackoff sets the minimum and maximum delay between attempts to send a
+// single batch
+func WithRetryBackoff(min, max time.Duration) Option {
+	return func(c *config) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// WithPollInterval sets how often the outbox is checked for batches due for
+// resending
+func WithPollInterval(interval time.Duration) Option {
+	return func(c *config) {
+		c.pollInterval = interval
+	}
+}
+
+// NewReplicator returns a replicator for the region named origin. Batches
+// received from other regions are written to the given stores, and batches of
+// local writes are sent to the given sinks, using the datastore for the outbox
+func NewReplicator(origin string, providerStore types.ProviderStore, claimStore types.ContentClaimsStore, sinks []Sink, ds datastore.Batching, opts ...Option) (*Replicator, error) {
+	c := &config{
+		maxBatchSize:  DefaultMaxBatchSize,
+		flushInterval: DefaultFlushInterval,
+		minBackoff:    time.Second,
+		maxBackoff:    5 * time.Minute,
+		pollInterval:  30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if origin == "" {
+		return nil, errors.New("replication origin region is required")
+	}
+	sinksByID := make(map[string]Sink, len(sinks))
+	for _, sink := range sinks {
+		sinksByID[sink.ID()] = sink
+	}
+	outbox := namespace.Wrap(ds, outboxPrefix)
+	seq, err := lastSequence(outbox)
+	if err != nil {
+		return nil, fmt.Errorf("reading outbox: %w", err)
+	}
+	r := &Replicator{
+		config:        c,
+		origin:        origin,
+		providerStore: providerStore,
+		claimStore:    claimStore,
+		sinks:         sinksByID,
+		outbox:        outbox,
+		pending:       Batch{Origin: origin},
+		flush:         make(chan struct{}, 1),
+		wake:          make(chan struct{}, 1),
+		closing:       make(chan struct{}),
+		closed:        make(chan struct{}),
+	}
+	r.seq.Store(seq)
+	return r, nil
+}
+
+// Origin is the region this replicator's writes originate in
+func (r *Replicator) Origin() string {
+	return r.origin
+}
+
+// ReplicateProviders queues provider results published for a hash to be sent
+// to every sink
+func (r *Replicator) ReplicateProviders(hash multihash.Multihash, results []model.ProviderResult) {
+	r.add(func(b *Batch) {
+		b.Providers = append(b.Providers, ProviderWrite{Hash: hash, Results: results})
+	})
+}
+
+// ReplicateClaim queues a published claim to be sent to every sink
+func (r *Replicator) ReplicateClaim(claim delegation.Delegation) {
+	r.add(func(b *Batch) {
+		b.Claims = append(b.Claims, claim)
+	})
+}
+
+func (r *Replicator) add(write func(*Batch)) {
+	if len(r.sinks) == 0 {
+		return
+	}
+	r.lk.Lock()
+	write(&r.pending)
+	full := r.pending.Size() >= r.maxBatchSize
+	r.lk.Unlock()
+	if full {
+		signal(r.flush)
+	}
+}
+
+// ApplyReplicated writes a batch received from another region to the local
+// stores. The writes are not replicated any further
+func (r *Replicator) ApplyReplicated(ctx context.Context, batch Batch) error {
+	if batch.Origin == r.origin {
+		return ErrOwnOrigin
+	}
+	for _, pw := range batch.Providers {
+		if err := applyProviders(ctx, r.providerStore, pw); err != nil {
+			return fmt.Errorf("applying provider results: %w", err)
+		}
+	}
+	for _, claim := range batch.Claims {
+		if err := r.claimStore.Set(ctx, claim.Link().(cidlink.Link).Cid, claim, true); err != nil {
+			return fmt.Errorf("applying claim: %w", err)
+		}
+	}
+	return nil
+}
+
+// applyProviders merges replicated results into those already cached for the
+// hash
+func applyProviders(ctx context.Context, store types.ProviderStore, pw ProviderWrite) error {
+	existing, err := types.GetForWrite(ctx, store, pw.Hash)
+	if err != nil && !errors.Is(err, types.ErrKeyNotFound) {
+		return err
+	}
+	merged := slices.Clone(existing)
+	for _, result := range pw.Results {
+		if !slices.ContainsFunc(merged, func(r model.ProviderResult) bool { return providerresults.Equals(r, result) }) {
+			merged = append(merged, result)
+		}
+	}
+	if len(merged) == len(existing) {
+		return nil
+	}
+	return store.Set(ctx, pw.Hash, merged, true)
+}
+
+// Flush durably records pending writes as a batch for every sink
+func (r *Replicator) Flush(ctx context.Context) error {
+	r.lk.Lock()
+	batch := r.pending
+	r.pending = Batch{Origin: r.origin}
+	r.lk.Unlock()
+	if batch.Empty() {
+		return nil
+	}
+	data, err := MarshalBatch(batch)
+	if err != nil {
+		return err
+	}
+	seq := r.seq.Add(1)
+	dsBatch, err := r.outbox.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	for id := range r.sinks {
+		entry, err := json.Marshal(outboxEntry{Sink: id, Batch: data})
+		if err != nil {
+			return err
+		}
+		if err := dsBatch.Put(ctx, entryKey(seq, id), entry); err != nil {
+			return err
+		}
+	}
+	if err := dsBatch.Commit(ctx); err != nil {
+		return fmt.Errorf("writing outbox: %w", err)
+	}
+	signal(r.wake)
+	return nil
+}
+
+// Startup starts sending batches in the background (returns immediately)
+func (r *Replicator) Startup() {
+	go r.run()
+}
+
+// Shutdown stops sending, returning when the replicator stops or the passed
+// context cancels. Pending writes are flushed to the outbox, and unsent batches
+// remain there
+func (r *Replicator) Shutdown(ctx context.Context) error {
+	close(r.closing)
+	select {
+	case <-r.closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Replicator) run() {
+	defer close(r.closed)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-r.closing
+		cancel()
+	}()
+	flushTicker := time.NewTicker(r.flushInterval)
+	defer flushTicker.Stop()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-r.closing:
+			if err := r.Flush(context.Background()); err != nil {
+				log.Errorw("flushing replicated writes", "error", err)
+			}
+			return
+		case <-flushTicker.C:
+			r.flushAndLog(ctx)
+			continue
+		case <-r.flush:
+			r.flushAndLog(ctx)
+			continue
+		case <-timer.C:
+		case <-r.wake:
+		}
+		if err := r.sendDue(ctx); err != nil && ctx.Err() == nil {
+			log.Errorw("sending replicated writes", "error", err)
+		}
+		timer.Reset(r.pollInterval)
+	}
+}
+
+func (r *Replicator) flushAndLog(ctx context.Context) {
+	if err := r.Flush(ctx); err != nil && ctx.Err() == nil {
+		log.Errorw("flushing replicated writes", "error", err)
+	}
+}
+
+// sendDue attempts to send every batch that is due, in order. Once a batch for a
+// sink is not sent, later batches for the same sink are held back
+func (r *Replicator) sendDue(ctx context.Context) error {
+	results, err := r.outbox.Query(ctx, query.Query{Orders: []query.Order{query.OrderByKey{}}})
+	if err != nil {
+		return err
+	}
+	// read all entries up front so the outbox isn't modified while iterating
+	entries, err := results.Rest()
+	if err != nil {
+		return err
+	}
+	blocked := map[string]struct{}{}
+	now := time.Now()
+	for _, result := range entries {
+		var entry outboxEntry
+		if err := json.Unmarshal(result.Value, &entry); err != nil {
+			return fmt.Errorf("decoding outbox entry %s: %w", result.Key, err)
+		}
+		key := datastore.NewKey(result.Key)
+		sink, ok := r.sinks[entry.Sink]
+		if !ok {
+			log.Warnw("dropping replicated batch for unconfigured sink", "sink", entry.Sink)
+			if err := r.outbox.Delete(ctx, key); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, ok := blocked[entry.Sink]; ok {
+			continue
+		}
+		if entry.NextAttempt.After(now) {
+			blocked[entry.Sink] = struct{}{}
+			continue
+		}
+		if err := r.send(ctx, sink, entry); err != nil {
+			log.Warnw("replicated batch send failed", "sink", entry.Sink, "attempts", entry.Attempts+1, "error", err)
+			blocked[entry.Sink] = struct{}{}
+			entry.Attempts++
+			entry.NextAttempt = now.Add(r.backoff(entry.Attempts))
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := r.outbox.Put(ctx, key, data); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := r.outbox.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Replicator) send(ctx context.Context, sink Sink, entry outboxEntry) error {
+	batch, err := UnmarshalBatch(entry.Batch)
+	if err != nil {
+		return fmt.Errorf("decoding batch: %w", err)
+	}
+	return sink.Replicate(ctx, batch)
+}
+
+func (r *Replicator) backoff(attempts int) time.Duration {
+	backoff := r.minBackoff
+	for i := 1; i < attempts && backoff < r.maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, r.maxBackoff)
+}
+
+// Pending is the number of batches waiting in the outbox to be sent
+func (r *Replicator) Pending(ctx context.Context) (int, error) {
+	results, err := r.outbox.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func entryKey(seq uint64, sink string) datastore.Key {
+	return datastore.NewKey(fmt.Sprintf("%020d-%x", seq, sink))
+}
+
+func lastSequence(outbox datastore.Batching) (uint64, error) {
+	results, err := outbox.Query(context.Background(), query.Query{
+		KeysOnly: true,
+		Orders:   []query.Order{query.OrderByKeyDescending{}},
+		Limit:    1,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer results.Close()
+	result, ok := results.NextSync()
+	if !ok {
+		return 0, nil
+	}
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	seqString, _, found := strings.Cut(strings.TrimPrefix(result.Key, "/"), "-")
+	if !found {
+		return 0, errors.New("malformed outbox key")
+	}
+	return strconv.ParseUint(seqString, 10, 64)
+}
@@ -0,0 +1,186 @@
+package replication_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/replication"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+type mockSink struct {
+	lk      sync.Mutex
+	failing bool
+	batches []replication.Batch
+}
+
+func (m *mockSink) ID() string { return "mock" }
+
+func (m *mockSink) Replicate(ctx context.Context, batch replication.Batch) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if m.failing {
+		return errors.New("peer unavailable")
+	}
+	m.batches = append(m.batches, batch)
+	return nil
+}
+
+func (m *mockSink) setFailing(failing bool) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.failing = failing
+}
+
+func (m *mockSink) received() []replication.Batch {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.batches
+}
+
+type mockProviderStore struct {
+	lk      sync.Mutex
+	results map[string][]model.ProviderResult
+}
+
+func (m *mockProviderStore) Get(ctx context.Context, hash multihash.Multihash) ([]model.ProviderResult, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	results, ok := m.results[string(hash)]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return results, nil
+}
+
+func (m *mockProviderStore) Set(ctx context.Context, hash multihash.Multihash, results []model.ProviderResult, expires bool) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.results[string(hash)] = results
+	return nil
+}
+
+func (m *mockProviderStore) SetExpirable(ctx context.Context, hash multihash.Multihash, expires bool) error {
+	return nil
+}
+
+type mockClaimStore struct {
+	lk     sync.Mutex
+	claims map[cid.Cid]delegation.Delegation
+}
+
+func (m *mockClaimStore) Get(ctx context.Context, claimCid cid.Cid) (delegation.Delegation, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	claim, ok := m.claims[claimCid]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return claim, nil
+}
+
+func (m *mockClaimStore) Set(ctx context.Context, claimCid cid.Cid, claim delegation.Delegation, expires bool) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.claims[claimCid] = claim
+	return nil
+}
+
+func (m *mockClaimStore) SetExpirable(ctx context.Context, claimCid cid.Cid, expires bool) error {
+	return nil
+}
+
+func newStores() (*mockProviderStore, *mockClaimStore) {
+	return &mockProviderStore{results: map[string][]model.ProviderResult{}}, &mockClaimStore{claims: map[cid.Cid]delegation.Delegation{}}
+}
+
+func TestBatch(t *testing.T) {
+	claim := testutil.RandomLocationDelegation()
+	batch := replication.Batch{
+		Origin: "us-east",
+		Providers: []replication.ProviderWrite{
+			{Hash: testutil.RandomMultihash(), Results: []model.ProviderResult{testutil.RandomProviderResult(), testutil.RandomProviderResult()}},
+		},
+		Claims: []delegation.Delegation{claim},
+	}
+	decoded := testutil.Must(replication.UnmarshalBatch(testutil.Must(replication.MarshalBatch(batch))(t)))(t)
+	require.Equal(t, batch.Origin, decoded.Origin)
+	require.Equal(t, batch.Providers, decoded.Providers)
+	require.Len(t, decoded.Claims, 1)
+	require.Equal(t, claim.Link(), decoded.Claims[0].Link())
+}
+
+func TestReplicator(t *testing.T) {
+	ctx := context.Background()
+	newReplicator := func(t *testing.T, sink replication.Sink, ds datastore.Batching) *replication.Replicator {
+		providers, claims := newStores()
+		return testutil.Must(replication.NewReplicator("a", providers, claims, []replication.Sink{sink}, ds,
+			replication.WithFlushInterval(5*time.Millisecond),
+			replication.WithPollInterval(5*time.Millisecond),
+			replication.WithRetryBackoff(time.Millisecond, 5*time.Millisecond),
+		))(t)
+	}
+
+	t.Run("batches writes and retries failed sends", func(t *testing.T) {
+		sink := &mockSink{failing: true}
+		r := newReplicator(t, sink, dssync.MutexWrap(datastore.NewMapDatastore()))
+		hashes := testutil.RandomMultihashes(3)
+		for _, hash := range hashes {
+			r.ReplicateProviders(hash, []model.ProviderResult{testutil.RandomProviderResult()})
+		}
+		r.Startup()
+		defer r.Shutdown(ctx)
+
+		require.Eventually(t, func() bool { return testutil.Must(r.Pending(ctx))(t) == 1 }, time.Second, 5*time.Millisecond)
+		sink.setFailing(false)
+		require.Eventually(t, func() bool { return testutil.Must(r.Pending(ctx))(t) == 0 }, time.Second, 5*time.Millisecond)
+		received := sink.received()
+		require.Len(t, received, 1)
+		require.Equal(t, "a", received[0].Origin)
+		require.Len(t, received[0].Providers, 3)
+	})
+
+	t.Run("keeps unsent batches across restarts", func(t *testing.T) {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		r := newReplicator(t, &mockSink{failing: true}, ds)
+		r.ReplicateClaim(testutil.RandomLocationDelegation())
+		require.NoError(t, r.Flush(ctx))
+
+		sink := &mockSink{}
+		restarted := newReplicator(t, sink, ds)
+		require.Equal(t, 1, testutil.Must(restarted.Pending(ctx))(t))
+		restarted.Startup()
+		defer restarted.Shutdown(ctx)
+		require.Eventually(t, func() bool { return len(sink.received()) == 1 }, time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("applies batches from other regions only", func(t *testing.T) {
+		providers, claims := newStores()
+		r := testutil.Must(replication.NewReplicator("a", providers, claims, nil, dssync.MutexWrap(datastore.NewMapDatastore())))(t)
+		hash, existing, replicated := testutil.RandomMultihash(), testutil.RandomProviderResult(), testutil.RandomProviderResult()
+		require.NoError(t, providers.Set(ctx, hash, []model.ProviderResult{existing}, true))
+		claim := testutil.RandomLocationDelegation()
+		batch := replication.Batch{
+			Origin:    "b",
+			Providers: []replication.ProviderWrite{{Hash: hash, Results: []model.ProviderResult{replicated, existing}}},
+			Claims:    []delegation.Delegation{claim},
+		}
+
+		require.ErrorIs(t, r.ApplyReplicated(ctx, replication.Batch{Origin: "a", Claims: batch.Claims}), replication.ErrOwnOrigin)
+		require.NoError(t, r.ApplyReplicated(ctx, batch))
+		require.Equal(t, []model.ProviderResult{existing, replicated}, testutil.Must(providers.Get(ctx, hash))(t))
+		require.Equal(t, claim.Link(), testutil.Must(claims.Get(ctx, claim.Link().(cidlink.Link).Cid))(t).Link())
+	})
+}
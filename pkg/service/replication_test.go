@@ -0,0 +1,107 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/server"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/service/replication"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexingService__Replication(t *testing.T) {
+	ctx := context.Background()
+	f := newClaimFixture(t)
+	const token = "replication-secret"
+
+	// region b only receives
+	providersB, claimsB := &mockProviderStore{results: map[string][]model.ProviderResult{}}, newMockClaimStore()
+	finderB := &countingFinder{results: map[string][]model.ProviderResult{}, calls: map[string]int{}}
+	replicatorB := testutil.Must(replication.NewReplicator("b", providersB, claimsB, nil, dssync.MutexWrap(datastore.NewMapDatastore())))(t)
+	isB := testutil.Must(service.NewIndexingService(
+		&mockBlobIndexLookup{},
+		claimlookup.WithCache(claimlookup.NewClaimLookup(http.DefaultClient), claimsB),
+		providerindex.NewProviderIndex(providersB, finderB, nil, nil, cidlink.DefaultLinkSystem(), nil),
+		service.WithReplicator(replicatorB),
+	))(t)
+	serverB := httptest.NewServer(server.NewServer(server.WithService(isB), server.WithReplicationToken(token)))
+	defer serverB.Close()
+
+	// region a replicates its publishes to b
+	providersA, claimsA := &mockProviderStore{results: map[string][]model.ProviderResult{}}, newMockClaimStore()
+	replicatorA := testutil.Must(replication.NewReplicator("a", providersA, claimsA,
+		[]replication.Sink{replication.NewHTTPSink(serverB.URL+"/replicate", token, nil)},
+		dssync.MutexWrap(datastore.NewMapDatastore()),
+		replication.WithFlushInterval(5*time.Millisecond),
+		replication.WithPollInterval(5*time.Millisecond),
+		replication.WithRetryBackoff(time.Millisecond, 10*time.Millisecond),
+	))(t)
+	replicatorA.Startup()
+	defer replicatorA.Shutdown(ctx)
+	providerIndexA := providerindex.NewProviderIndex(providersA, &countingFinder{results: map[string][]model.ProviderResult{}, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil, providerindex.WithReplicator(replicatorA))
+
+	// the claim is not served by the fixture, so b can only resolve it from cache
+	hash := testutil.RandomMultihash()
+	claim := testutil.RandomLocationDelegation()
+	claimCid := claim.Link().(cidlink.Link).Cid
+	result := f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: claimCid})
+	require.NoError(t, providerIndexA.Publish(ctx, []multihash.Multihash{hash}, result))
+	replicatorA.ReplicateClaim(claim)
+
+	require.Eventually(t, func() bool {
+		_, providersErr := providersB.Get(ctx, hash)
+		_, claimErr := claimsB.Get(ctx, claimCid)
+		return providersErr == nil && claimErr == nil
+	}, time.Second, 5*time.Millisecond)
+
+	claims, _ := queriedClaims(t, isB, hash)
+	require.Equal(t, []cid.Cid{claimCid}, claims)
+	require.Zero(t, finderB.count(hash))
+
+	t.Run("claims published or cached through a service reach the other regions", func(t *testing.T) {
+		fa := newPublishFixture(t)
+		isA := fa.service(t, service.WithReplicator(replicatorA))
+		published, cached := testutil.RandomLocationDelegation(), testutil.RandomLocationDelegation()
+		require.NoError(t, isA.PublishClaim(ctx, published))
+		require.NoError(t, isA.CacheClaim(ctx, cached))
+
+		for _, claim := range []delegation.Delegation{published, cached} {
+			require.Eventually(t, func() bool {
+				_, err := claimsB.Get(ctx, claim.Link().(cidlink.Link).Cid)
+				return err == nil
+			}, time.Second, 5*time.Millisecond)
+		}
+	})
+
+	t.Run("batches are not applied in their origin region", func(t *testing.T) {
+		data := testutil.Must(replication.MarshalBatch(replication.Batch{Origin: "b"}))(t)
+		req := testutil.Must(http.NewRequest(http.MethodPost, serverB.URL+"/replicate", bytes.NewReader(data)))(t)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := testutil.Must(http.DefaultClient.Do(req))(t)
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("batches require the replication token", func(t *testing.T) {
+		data := testutil.Must(replication.MarshalBatch(replication.Batch{Origin: "a"}))(t)
+		resp := testutil.Must(http.Post(serverB.URL+"/replicate", replication.ContentType, bytes.NewReader(data)))(t)
+		resp.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
@@ -0,0 +1,314 @@
+package service
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/car"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/validator"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+)
+
+const (
+	// DefaultResultCacheTTL is how long the results of queries are kept in
+	// memory when WithResultCache is given no TTL
+	DefaultResultCacheTTL = 5 * time.Second
+	// MaxResultCacheTTL is the longest the results of queries are kept in
+	// memory. Longer TTLs are clamped to it
+	MaxResultCacheTTL = time.Minute
+	// resultCacheFanout is the most cached results kept for each hash looked up
+	// to find them. Caching another drops the oldest
+	resultCacheFanout = 64
+	// maxResultCacheHashes is the most hashes a query may look up for its
+	// result to be cached
+	maxResultCacheHashes = 1024
+)
+
+// WithResultCache keeps the encoded results of the last size queries that are
+// the same for every caller in memory for the TTL, and answers the same query
+// from them before walking it. Only queries with no spaces, known claims or
+// indexes, and no options that limit, trace or annotate the result are cached,
+// and queries asking for fresh records skip them. Cached results are dropped
+// when claims for any hash looked up to find them are published or cached,
+// when a provider is removed or denied, and when a claim in them expires.
+// Claims can't be revoked through the service, so nothing drops the results
+// holding a claim revoked elsewhere: they are served until they expire, for at
+// most MaxResultCacheTTL
+func WithResultCache(size int, ttl time.Duration) Option {
+	return func(is *IndexingService) {
+		if size <= 0 {
+			is.resultCache = nil
+			return
+		}
+		if ttl <= 0 {
+			ttl = DefaultResultCacheTTL
+		}
+		is.resultCache = newResultCache(size, min(ttl, MaxResultCacheTTL))
+	}
+}
+
+type cachedResult struct {
+	key     string
+	data    []byte
+	hashes  []string
+	expires time.Time
+}
+
+// resultCache holds the encoded results of recent queries, evicting the oldest
+// beyond its size, along with the queries cached for each hash so that they can
+// be dropped when its claims change
+type resultCache struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	lk      sync.Mutex
+	results map[string]*list.Element
+	order   *list.List
+	byHash  map[string][]string
+	// generation is bumped by every invalidation, so that queries that started
+	// before one don't keep their results
+	generation uint64
+}
+
+func newResultCache(size int, ttl time.Duration) *resultCache {
+	return &resultCache{
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		results: map[string]*list.Element{},
+		order:   list.New(),
+		byHash:  map[string][]string{},
+	}
+}
+
+// get returns the encoded result for the key, if it hasn't expired
+func (r *resultCache) get(key string) ([]byte, bool) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	el, ok := r.results[key]
+	if !ok {
+		return nil, false
+	}
+	result := el.Value.(*cachedResult)
+	if !r.now().Before(result.expires) {
+		r.remove(el)
+		return nil, false
+	}
+	return result.data, true
+}
+
+// begin returns the generation a query starts in, to pass to put once done
+func (r *resultCache) begin() uint64 {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return r.generation
+}
+
+// put keeps the encoded result of a query that looked up the hashes until
+// expires, if nothing was invalidated since it started
+func (r *resultCache) put(key string, data []byte, hashes []string, expires time.Time, generation uint64) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if generation != r.generation {
+		return
+	}
+	if el, ok := r.results[key]; ok {
+		r.remove(el)
+	}
+	for _, h := range hashes {
+		if keys := r.byHash[h]; len(keys) >= resultCacheFanout {
+			r.remove(r.results[keys[0]])
+		}
+		r.byHash[h] = append(r.byHash[h], key)
+	}
+	r.results[key] = r.order.PushBack(&cachedResult{key: key, data: data, hashes: hashes, expires: expires})
+	for r.order.Len() > r.size {
+		r.remove(r.order.Front())
+	}
+}
+
+// remove drops a cached result. The caller must hold the lock
+func (r *resultCache) remove(el *list.Element) {
+	result := el.Value.(*cachedResult)
+	r.order.Remove(el)
+	delete(r.results, result.key)
+	for _, h := range result.hashes {
+		keys := r.byHash[h]
+		for i, key := range keys {
+			if key == result.key {
+				keys = append(keys[:i], keys[i+1:]...)
+				break
+			}
+		}
+		if len(keys) == 0 {
+			delete(r.byHash, h)
+		} else {
+			r.byHash[h] = keys
+		}
+	}
+}
+
+// invalidate drops the cached results that looked up any of the hashes,
+// returning how many were dropped
+func (r *resultCache) invalidate(hashes []multihash.Multihash) int {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.generation++
+	dropped := 0
+	for _, h := range hashes {
+		for _, key := range append([]string(nil), r.byHash[string(h)]...) {
+			r.remove(r.results[key])
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// flush drops every cached result
+func (r *resultCache) flush() {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.generation++
+	r.results = map[string]*list.Element{}
+	r.order.Init()
+	r.byHash = map[string][]string{}
+}
+
+// cacheableResult returns true for queries whose result is the same for every
+// caller asking them, and that don't ask for fresh records
+func cacheableResult(q *Query) bool {
+	return len(q.Match.Subject) == 0 &&
+		len(q.KnownClaims) == 0 &&
+		len(q.KnownIndexes) == 0 &&
+		q.MaxProviderAge == 0 &&
+		!q.CanonicalizeAliases &&
+		!q.FirstLocationWins &&
+		q.MaxResultsPerHash == 0 &&
+		!q.IncludeSuperseded &&
+		!q.Diagnose &&
+		!q.ProbeLocations &&
+		!q.Fresh
+}
+
+// cachedResult returns the result of the query under the key from the result
+// cache, decoded into a result that can be changed and built again
+func (is *IndexingService) cachedResult(key string) (*queryResult, bool) {
+	data, ok := is.resultCache.get(key)
+	if !ok {
+		return nil, false
+	}
+	cached, err := queryresult.Extract(bytes.NewReader(data))
+	if err == nil {
+		var b *queryresult.Builder
+		if b, err = cached.Clone(); err == nil {
+			return &queryResult{Builder: b, fetchedRefs: map[string]struct{}{}}, true
+		}
+	}
+	log.Warnw("decoding cached query result", "error", err)
+	return nil, false
+}
+
+// cacheResult encodes the result of a walk and keeps it in the result cache
+// under the key, unless it looked up too many hashes to invalidate. It expires
+// when the first of its claims do
+func (is *IndexingService) cacheResult(key string, generation uint64, qs queryState) {
+	if len(qs.hashes) > maxResultCacheHashes {
+		return
+	}
+	built, err := qs.qr.Build()
+	if err != nil {
+		log.Warnw("building query result to cache", "error", err)
+		return
+	}
+	data, err := io.ReadAll(car.Encode([]ipld.Link{built.Root().Link()}, built.Blocks()))
+	if err != nil {
+		log.Warnw("encoding query result to cache", "error", err)
+		return
+	}
+	hashes := make([]string, 0, len(qs.hashes))
+	for h := range qs.hashes {
+		hashes = append(hashes, h)
+	}
+	expires := is.resultCache.now().Add(is.resultCache.ttl)
+	for _, claim := range qs.qr.Claims {
+		if exp := claim.Expiration(); exp != nil {
+			if t := time.Unix(int64(*exp), 0); t.Before(expires) {
+				expires = t
+			}
+		}
+	}
+	is.resultCache.put(key, data, hashes, expires, generation)
+}
+
+// invalidateResults drops the cached results that looked up a hash the claim
+// is about. Results are dropped whether or not the claim was published or
+// cached, as a failure may have happened after records were written. Claims
+// that can't be read drop every cached result
+func (is *IndexingService) invalidateResults(claim delegation.Delegation) {
+	if is.resultCache == nil {
+		return
+	}
+	hashes, ok := claimHashes(claim)
+	if !ok {
+		is.resultCache.flush()
+		return
+	}
+	is.resultCache.invalidate(hashes)
+}
+
+// flushResults drops every cached result, for changes that can't be traced to
+// the hashes they affect, such as the removal of a provider
+func (is *IndexingService) flushResults() {
+	if is.resultCache != nil {
+		is.resultCache.flush()
+	}
+}
+
+// claimHashes returns the hashes a claim is about, read from its first
+// capability: its content, and the hash it is equivalent to for an equals claim
+func claimHashes(claim delegation.Delegation) ([]multihash.Multihash, bool) {
+	if len(claim.Capabilities()) == 0 {
+		return nil, false
+	}
+	capability := claim.Capabilities()[0]
+	source := validator.NewSource(capability, claim)
+	switch capability.Can() {
+	case assert.LocationAbility:
+		match, fail := assert.Location.Match(source)
+		if fail != nil {
+			return nil, false
+		}
+		return []multihash.Multihash{match.Value().Nb().Content.Hash()}, true
+	case assert.IndexAbility:
+		match, fail := assert.Index.Match(source)
+		if fail != nil {
+			return nil, false
+		}
+		content, err := cid.Parse(match.Value().Nb().Content.String())
+		if err != nil {
+			return nil, false
+		}
+		return []multihash.Multihash{content.Hash()}, true
+	case assert.EqualsAbility:
+		match, fail := assert.Equals.Match(source)
+		if fail != nil {
+			return nil, false
+		}
+		hashes := []multihash.Multihash{match.Value().Nb().Content.Hash()}
+		if equals, err := cid.Parse(match.Value().Nb().Equals.String()); err == nil {
+			hashes = append(hashes, equals.Hash())
+		}
+		return hashes, true
+	default:
+		return nil, false
+	}
+}
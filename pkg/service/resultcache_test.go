@@ -0,0 +1,164 @@
+package service_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/maurl"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexingService__ResultCache(t *testing.T) {
+	ctx := context.Background()
+	capability := testutil.RandomIndexClaim()
+	claim := testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.IndexCaveats]{capability}))(t)
+	claimCid := claim.Link().(cidlink.Link).Cid
+	contentHash := capability.Nb().Content.(cidlink.Link).Hash()
+	claimBytes := testutil.Must(io.ReadAll(claim.Archive()))(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.Must(w.Write(claimBytes))(t)
+	}))
+	defer server.Close()
+	serverURL := testutil.Must(url.Parse(server.URL))(t)
+	serverURL.Path = "/claims/{claim}"
+	md := &metadata.IndexClaimMetadata{Index: testutil.RandomCID().(cidlink.Link).Cid, Claim: claimCid}
+	result := model.ProviderResult{
+		ContextID: testutil.RandomBytes(10),
+		Metadata:  testutil.Must(md.MarshalBinary())(t),
+		Provider: &peer.AddrInfo{
+			ID:    testutil.RandomPeer(),
+			Addrs: []multiaddr.Multiaddr{testutil.Must(maurl.FromURL(serverURL))(t)},
+		},
+	}
+
+	newService := func(ttl time.Duration) (*service.IndexingService, *countingProviderIndex) {
+		providerIndex := &countingProviderIndex{mockProviderIndex: mockProviderIndex{results: map[string][]model.ProviderResult{string(contentHash): {result}}}}
+		claimLookup := claimlookup.WithCache(claimlookup.NewClaimLookup(http.DefaultClient), newMockClaimStore())
+		return testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimLookup, providerIndex, service.WithResultCache(8, ttl)))(t), providerIndex
+	}
+	query := func(t *testing.T, is *service.IndexingService, q service.Query) {
+		qr := testutil.Must(is.Query(ctx, q))(t)
+		claims := make([]cid.Cid, 0, len(qr.Claims()))
+		for _, link := range qr.Claims() {
+			claims = append(claims, link.(cidlink.Link).Cid)
+		}
+		require.Equal(t, []cid.Cid{claimCid}, claims)
+	}
+	q := service.Query{Hashes: []multihash.Multihash{contentHash}}
+
+	t.Run("a repeated query is answered from the cache", func(t *testing.T) {
+		is, providerIndex := newService(time.Minute)
+		query(t, is, q)
+		walked := providerIndex.count()
+		require.NotZero(t, walked)
+		query(t, is, q)
+		require.Equal(t, walked, providerIndex.count())
+	})
+
+	t.Run("queries with personalized results are walked", func(t *testing.T) {
+		is, providerIndex := newService(time.Minute)
+		query(t, is, q)
+		for _, personalized := range []service.Query{
+			{Hashes: q.Hashes, Match: service.Match{Subject: []did.DID{testutil.Alice.DID()}}},
+			{Hashes: q.Hashes, KnownClaims: []cid.Cid{testutil.RandomCID().(cidlink.Link).Cid}},
+			{Hashes: q.Hashes, Fresh: true},
+			{Hashes: q.Hashes, Diagnose: true},
+			{Hashes: q.Hashes, MaxProviderAge: time.Hour},
+		} {
+			walked := providerIndex.count()
+			testutil.Must(is.Query(ctx, personalized))(t)
+			require.Greater(t, providerIndex.count(), walked)
+		}
+		// none of them were cached in place of the query
+		walked := providerIndex.count()
+		query(t, is, q)
+		require.Equal(t, walked, providerIndex.count())
+	})
+
+	t.Run("a publish for a queried hash drops its results", func(t *testing.T) {
+		is, providerIndex := newService(time.Minute)
+		query(t, is, q)
+		// results are dropped even when the publish fails, as it may have written
+		// records before failing
+		require.Error(t, is.PublishClaim(ctx, claim))
+		walked := providerIndex.count()
+		query(t, is, q)
+		require.Greater(t, providerIndex.count(), walked)
+
+		// a publish for a hash the query never looked up leaves them cached
+		require.Error(t, is.PublishClaim(ctx, testutil.RandomIndexDelegation()))
+		walked = providerIndex.count()
+		query(t, is, q)
+		require.Equal(t, walked, providerIndex.count())
+	})
+
+	t.Run("denying a provider drops every result", func(t *testing.T) {
+		is, providerIndex := newService(time.Minute)
+		query(t, is, q)
+		// settings that don't change results leave them cached
+		cfg := is.Config()
+		cfg.LocationCacheWarming = true
+		require.NoError(t, is.Reconfigure(cfg))
+		walked := providerIndex.count()
+		query(t, is, q)
+		require.Equal(t, walked, providerIndex.count())
+
+		cfg.DeniedProviders = []string{result.Provider.ID.String()}
+		require.NoError(t, is.Reconfigure(cfg))
+		qr := testutil.Must(is.Query(ctx, q))(t)
+		require.Greater(t, providerIndex.count(), walked)
+		require.Empty(t, qr.Claims())
+	})
+
+	t.Run("results expire after the TTL", func(t *testing.T) {
+		is, providerIndex := newService(20 * time.Millisecond)
+		query(t, is, q)
+		walked := providerIndex.count()
+		query(t, is, q)
+		require.Equal(t, walked, providerIndex.count())
+		time.Sleep(30 * time.Millisecond)
+		query(t, is, q)
+		require.Greater(t, providerIndex.count(), walked)
+	})
+}
+
+// countingProviderIndex counts the provider records looked up
+type countingProviderIndex struct {
+	mockProviderIndex
+	lk    sync.Mutex
+	finds int
+}
+
+func (c *countingProviderIndex) FindDetailed(ctx context.Context, qk providerindex.QueryKey) (providerindex.FindResult, error) {
+	c.lk.Lock()
+	c.finds++
+	c.lk.Unlock()
+	return c.mockProviderIndex.FindDetailed(ctx, qk)
+}
+
+func (c *countingProviderIndex) count() int {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.finds
+}
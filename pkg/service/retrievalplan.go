@@ -0,0 +1,277 @@
+package service
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"net/url"
+	"slices"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/validator"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/internal/bytemap"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+)
+
+// Slice is the position of a wanted hash within a fetch
+type Slice struct {
+	Hash multihash.Multihash
+	// Offset is relative to the start of the fetched bytes
+	Offset uint64
+	Length uint64
+}
+
+// Fetch is a single byte range request that retrieves one or more wanted hashes
+type Fetch struct {
+	// URL is the location to fetch from, the first URL of the location claim
+	// that can be fetched from over HTTP
+	URL url.URL
+	// Fallbacks are the other URLs of the location claim that can be fetched
+	// from, in the order to try them when fetching from URL fails
+	Fallbacks []url.URL
+	// Shard is the multihash of the shard the bytes are read from
+	Shard multihash.Multihash
+	// Claim is the CID of the location claim authorizing the fetch
+	Claim cid.Cid
+	// Offset and Length are the byte range to request from URL
+	Offset uint64
+	Length uint64
+	// Slices are the wanted hashes served by the fetch, ordered by offset
+	Slices []Slice
+	// Probes are the outcomes of the liveness probes of the URLs of the fetch,
+	// keyed by URL, if the query result has any. They don't change the order the
+	// URLs are tried in
+	Probes map[string]queryresult.LocationProbe
+}
+
+// RetrievalPlan is the set of fetches needed to retrieve the wanted hashes
+type RetrievalPlan struct {
+	Fetches []Fetch
+	// Missing are the wanted hashes that can't be located from the query result
+	Missing []multihash.Multihash
+}
+
+// URLs returns every URL the fetch can be made from, in the order to try them
+func (f Fetch) URLs() []url.URL {
+	return append([]url.URL{f.URL}, f.Fallbacks...)
+}
+
+type planLocation struct {
+	// urls are the URLs of the claim that can be fetched from, in priority order
+	urls  []url.URL
+	claim cid.Cid
+	// ranged is true when the claim only covers the bytes of the shard from
+	// offset, for length bytes or to the end of the shard if length is nil.
+	// Positions in the shard are the same at the URL either way
+	ranged bool
+	offset uint64
+	length *uint64
+}
+
+type planSlice struct {
+	shard multihash.Multihash
+	Slice
+}
+
+// PlanRetrieval works out how to fetch the wanted hashes using the location
+// claims and indexes in a query result.
+//
+// When a hash is in several shards, the shard serving the most wanted hashes is
+// used. Each slice of a shard is read from a location claim covering its bytes:
+// claims for a range of the shard are preferred to claims for the whole shard,
+// and among those the one with the lowest first URL, so the plan is the same for
+// the same inputs. Slices no claim covers are missing. The URLs of a location
+// claim are in priority order, the order they are listed in the claim, and those
+// that can't be fetched from over HTTP are left out. Claims with none are not
+// used. Slices read from the same claim that are adjacent or overlap are
+// coalesced into a single fetch. Fetches are annotated with the liveness probes
+// of their URLs in the result.
+func PlanRetrieval(qr queryresult.QueryResult, wanted []multihash.Multihash) (RetrievalPlan, error) {
+	claims, indexes, err := queryresult.Parts(qr)
+	if err != nil {
+		return RetrievalPlan{}, fmt.Errorf("reading query result: %w", err)
+	}
+
+	locations := bytemap.NewByteMap[multihash.Multihash, []planLocation](-1)
+	for claimCid, claim := range claims {
+		for _, capability := range claim.Capabilities() {
+			if capability.Can() != assert.LocationAbility {
+				continue
+			}
+			match, fail := assert.Location.Match(validator.NewSource(capability, claim))
+			if fail != nil {
+				continue
+			}
+			nb := match.Value().Nb()
+			urls := queryresult.FetchableURLs(nb.Location)
+			if len(urls) == 0 {
+				continue
+			}
+			shard := nb.Content.Hash()
+			location := planLocation{urls: urls, claim: claimCid}
+			if nb.Range != nil {
+				location.ranged = true
+				location.offset = nb.Range.Offset
+				location.length = nb.Range.Length
+			}
+			locations.Set(shard, append(locations.Get(shard), location))
+		}
+	}
+	for _, candidates := range locations.Iterator() {
+		slices.SortFunc(candidates, func(a, b planLocation) int {
+			return cmp.Or(
+				compareBool(b.ranged, a.ranged),
+				cmp.Compare(a.urls[0].String(), b.urls[0].String()),
+				cmp.Compare(a.claim.String(), b.claim.String()),
+			)
+		})
+	}
+
+	// find every located shard each wanted hash can be read from
+	var unique []multihash.Multihash
+	candidates := bytemap.NewByteMap[multihash.Multihash, []planSlice](-1)
+	for _, hash := range wanted {
+		if candidates.Has(hash) {
+			continue
+		}
+		unique = append(unique, hash)
+		var found []planSlice
+		for _, index := range indexes.Iterator() {
+			for shard, positions := range index.Shards().Iterator() {
+				if !positions.Has(hash) || !locations.Has(shard) {
+					continue
+				}
+				pos := positions.Get(hash)
+				if slices.ContainsFunc(found, func(s planSlice) bool { return bytes.Equal(s.shard, shard) }) {
+					continue
+				}
+				found = append(found, planSlice{shard, Slice{hash, pos.Offset, pos.Length}})
+			}
+		}
+		candidates.Set(hash, found)
+	}
+
+	served := bytemap.NewByteMap[multihash.Multihash, int](-1)
+	for _, found := range candidates.Iterator() {
+		for _, s := range found {
+			served.Set(s.shard, served.Get(s.shard)+1)
+		}
+	}
+
+	var plan RetrievalPlan
+	chosen := bytemap.NewByteMap[multihash.Multihash, []Slice](-1)
+	var shards []multihash.Multihash
+	for _, hash := range unique {
+		found := candidates.Get(hash)
+		if len(found) == 0 {
+			plan.Missing = append(plan.Missing, hash)
+			continue
+		}
+		best := slices.MinFunc(found, func(a, b planSlice) int {
+			return cmp.Or(cmp.Compare(served.Get(b.shard), served.Get(a.shard)), bytes.Compare(a.shard, b.shard))
+		})
+		if !chosen.Has(best.shard) {
+			shards = append(shards, best.shard)
+		}
+		chosen.Set(best.shard, append(chosen.Get(best.shard), best.Slice))
+	}
+
+	slices.SortFunc(shards, func(a, b multihash.Multihash) int { return bytes.Compare(a, b) })
+	for _, shard := range shards {
+		fetches, missing := planShard(shard, chosen.Get(shard), locations.Get(shard))
+		plan.Fetches = append(plan.Fetches, fetches...)
+		plan.Missing = append(plan.Missing, missing...)
+	}
+	if probes := qr.LocationProbes(); probes.Len() > 0 {
+		for i := range plan.Fetches {
+			plan.Fetches[i].Probes = fetchProbes(plan.Fetches[i], probes)
+		}
+	}
+	return plan, nil
+}
+
+// fetchProbes returns the probes of the URLs of the fetch, or nil if none of
+// them were probed
+func fetchProbes(f Fetch, probes queryresult.Map[string, queryresult.LocationProbe]) map[string]queryresult.LocationProbe {
+	var found map[string]queryresult.LocationProbe
+	for _, u := range f.URLs() {
+		probe, ok := probes.Get(u.String())
+		if !ok {
+			continue
+		}
+		if found == nil {
+			found = map[string]queryresult.LocationProbe{}
+		}
+		found[u.String()] = probe
+	}
+	return found
+}
+
+// planShard reads each slice of a shard from the first location that covers it,
+// coalescing the slices read from each location into fetches. Slices that no
+// location covers are returned as missing
+func planShard(shard multihash.Multihash, wanted []Slice, locations []planLocation) ([]Fetch, []multihash.Multihash) {
+	slices.SortFunc(wanted, func(a, b Slice) int {
+		return cmp.Or(cmp.Compare(a.Offset, b.Offset), cmp.Compare(a.Length, b.Length))
+	})
+
+	var fetches []Fetch
+	var missing []multihash.Multihash
+	// the last fetch from each location, which the next slice may be coalesced into
+	last := make([]int, len(locations))
+	for i := range last {
+		last[i] = -1
+	}
+	for _, s := range wanted {
+		i := slices.IndexFunc(locations, func(l planLocation) bool { return l.covers(s) })
+		if i < 0 {
+			missing = append(missing, s.Hash)
+			continue
+		}
+		if n := last[i]; n >= 0 && s.Offset <= fetches[n].Offset+fetches[n].Length {
+			f := &fetches[n]
+			f.Length = max(f.Length, s.Offset+s.Length-f.Offset)
+			f.Slices = append(f.Slices, Slice{s.Hash, s.Offset - f.Offset, s.Length})
+			continue
+		}
+		location := locations[i]
+		var fallbacks []url.URL
+		if len(location.urls) > 1 {
+			fallbacks = location.urls[1:]
+		}
+		last[i] = len(fetches)
+		fetches = append(fetches, Fetch{
+			URL:       location.urls[0],
+			Fallbacks: fallbacks,
+			Shard:     shard,
+			Claim:     location.claim,
+			Offset:    s.Offset,
+			Length:    s.Length,
+			Slices:    []Slice{{s.Hash, 0, s.Length}},
+		})
+	}
+	return fetches, missing
+}
+
+// covers returns true if the slice is within the bytes of the shard the location
+// claim is for
+func (l planLocation) covers(s Slice) bool {
+	if !l.ranged {
+		return true
+	}
+	return s.Offset >= l.offset && (l.length == nil || s.Offset+s.Length <= l.offset+*l.length)
+}
+
+// compareBool orders false before true
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
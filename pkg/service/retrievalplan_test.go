@@ -0,0 +1,244 @@
+package service_test
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	adm "github.com/storacha/indexing-service/pkg/capability/assert/datamodel"
+	"github.com/storacha/indexing-service/pkg/internal/bytemap"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanRetrieval(t *testing.T) {
+	shardA, shardB := testutil.RandomMultihash(), testutil.RandomMultihash()
+	hashes := testutil.RandomMultihashes(4)
+	unindexed := testutil.RandomMultihash()
+	urlA := testutil.Must(url.Parse("https://a.example.com/blob"))(t)
+	urlB := testutil.Must(url.Parse("https://b.example.com/blob"))(t)
+
+	locationA := locationDelegation(t, shardA, *urlA, nil)
+	locationB := locationDelegation(t, shardB, *urlB, nil)
+	locationBElsewhere := locationDelegation(t, shardB, *urlA, nil)
+	length := uint64(100)
+	rangedA := locationDelegation(t, shardA, *urlB, &adm.Range{Offset: 1000, Length: &length})
+	coveringA := locationDelegation(t, shardA, *urlB, &adm.Range{Offset: 25, Length: &length})
+	urlC := testutil.Must(url.Parse("https://c.example.com/blob"))(t)
+	half := uint64(20)
+	firstHalfA := locationDelegation(t, shardA, *urlB, &adm.Range{Offset: 0, Length: &half})
+	secondHalfA := locationDelegation(t, shardA, *urlC, &adm.Range{Offset: 20, Length: &half})
+	short := uint64(12)
+	gappedA := locationDelegation(t, shardA, *urlB, &adm.Range{Offset: 0, Length: &short})
+	ftpURL := testutil.Must(url.Parse("ftp://files.example.com/blob"))(t)
+	failoverA := locationsDelegation(t, shardA, urlC, ftpURL, urlA, urlB)
+	unfetchableA := locationsDelegation(t, shardA, ftpURL)
+
+	index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), -1)
+	index.SetSlice(shardA, hashes[0], blobindex.Position{Offset: 0, Length: 10})
+	index.SetSlice(shardA, hashes[1], blobindex.Position{Offset: 10, Length: 5})
+	index.SetSlice(shardA, hashes[2], blobindex.Position{Offset: 30, Length: 5})
+	index.SetSlice(shardB, hashes[2], blobindex.Position{Offset: 50, Length: 5})
+	index.SetSlice(shardB, hashes[3], blobindex.Position{Offset: 0, Length: 20})
+
+	testCases := []struct {
+		name            string
+		claims          []delegation.Delegation
+		probes          map[string]queryresult.LocationProbe
+		wanted          []multihash.Multihash
+		expectedFetches []service.Fetch
+		expectedMissing []multihash.Multihash
+	}{
+		{
+			name:   "coalesces adjacent ranges",
+			claims: []delegation.Delegation{locationA},
+			wanted: []multihash.Multihash{hashes[1], hashes[0], hashes[2]},
+			expectedFetches: []service.Fetch{
+				{URL: *urlA, Shard: shardA, Claim: asCid(locationA), Offset: 0, Length: 15, Slices: []service.Slice{
+					{Hash: hashes[0], Offset: 0, Length: 10},
+					{Hash: hashes[1], Offset: 10, Length: 5},
+				}},
+				{URL: *urlA, Shard: shardA, Claim: asCid(locationA), Offset: 30, Length: 5, Slices: []service.Slice{
+					{Hash: hashes[2], Offset: 0, Length: 5},
+				}},
+			},
+		},
+		{
+			name:   "chooses the shard serving the most wanted hashes",
+			claims: []delegation.Delegation{locationA, locationB},
+			wanted: []multihash.Multihash{hashes[2], hashes[3]},
+			expectedFetches: []service.Fetch{
+				{URL: *urlB, Shard: shardB, Claim: asCid(locationB), Offset: 0, Length: 20, Slices: []service.Slice{
+					{Hash: hashes[3], Offset: 0, Length: 20},
+				}},
+				{URL: *urlB, Shard: shardB, Claim: asCid(locationB), Offset: 50, Length: 5, Slices: []service.Slice{
+					{Hash: hashes[2], Offset: 0, Length: 5},
+				}},
+			},
+		},
+		{
+			name:   "chooses the lowest location of a shard",
+			claims: []delegation.Delegation{locationB, locationBElsewhere},
+			wanted: []multihash.Multihash{hashes[3]},
+			expectedFetches: []service.Fetch{
+				{URL: *urlA, Shard: shardB, Claim: asCid(locationBElsewhere), Offset: 0, Length: 20, Slices: []service.Slice{
+					{Hash: hashes[3], Offset: 0, Length: 20},
+				}},
+			},
+		},
+		{
+			name:   "reads each slice from the location covering its range",
+			claims: []delegation.Delegation{firstHalfA, secondHalfA},
+			wanted: []multihash.Multihash{hashes[2], hashes[0], hashes[1]},
+			expectedFetches: []service.Fetch{
+				{URL: *urlB, Shard: shardA, Claim: asCid(firstHalfA), Offset: 0, Length: 15, Slices: []service.Slice{
+					{Hash: hashes[0], Offset: 0, Length: 10},
+					{Hash: hashes[1], Offset: 10, Length: 5},
+				}},
+				{URL: *urlC, Shard: shardA, Claim: asCid(secondHalfA), Offset: 30, Length: 5, Slices: []service.Slice{
+					{Hash: hashes[2], Offset: 0, Length: 5},
+				}},
+			},
+		},
+		{
+			name:   "prefers ranged locations to the whole shard",
+			claims: []delegation.Delegation{locationA, firstHalfA},
+			wanted: []multihash.Multihash{hashes[0], hashes[2]},
+			expectedFetches: []service.Fetch{
+				{URL: *urlB, Shard: shardA, Claim: asCid(firstHalfA), Offset: 0, Length: 10, Slices: []service.Slice{
+					{Hash: hashes[0], Offset: 0, Length: 10},
+				}},
+				{URL: *urlA, Shard: shardA, Claim: asCid(locationA), Offset: 30, Length: 5, Slices: []service.Slice{
+					{Hash: hashes[2], Offset: 0, Length: 5},
+				}},
+			},
+		},
+		{
+			name:   "lists slices in a gap between ranged locations as missing",
+			claims: []delegation.Delegation{gappedA, secondHalfA},
+			wanted: []multihash.Multihash{hashes[0], hashes[1], hashes[2]},
+			expectedFetches: []service.Fetch{
+				{URL: *urlB, Shard: shardA, Claim: asCid(gappedA), Offset: 0, Length: 10, Slices: []service.Slice{
+					{Hash: hashes[0], Offset: 0, Length: 10},
+				}},
+				{URL: *urlC, Shard: shardA, Claim: asCid(secondHalfA), Offset: 30, Length: 5, Slices: []service.Slice{
+					{Hash: hashes[2], Offset: 0, Length: 5},
+				}},
+			},
+			expectedMissing: []multihash.Multihash{hashes[1]},
+		},
+		{
+			// the range of a location is the bytes of the shard it covers, not where
+			// the shard starts at its URL, so slices are read at their own offsets
+			name:   "doesn't offset slices by the range of the location",
+			claims: []delegation.Delegation{coveringA},
+			wanted: []multihash.Multihash{hashes[2]},
+			expectedFetches: []service.Fetch{
+				{URL: *urlB, Shard: shardA, Claim: asCid(coveringA), Offset: 30, Length: 5, Slices: []service.Slice{
+					{Hash: hashes[2], Offset: 0, Length: 5},
+				}},
+			},
+		},
+		{
+			// a slice at 30 was once planned at 1030 from a location ranged from
+			// 1000, which read the range as where the shard starts at the URL
+			name:            "lists slices outside the range of every location as missing",
+			claims:          []delegation.Delegation{rangedA},
+			wanted:          []multihash.Multihash{hashes[2]},
+			expectedMissing: []multihash.Multihash{hashes[2]},
+		},
+		{
+			name:   "lists the URLs of a location in priority order",
+			claims: []delegation.Delegation{failoverA},
+			wanted: []multihash.Multihash{hashes[0]},
+			expectedFetches: []service.Fetch{
+				{URL: *urlC, Fallbacks: []url.URL{*urlA, *urlB}, Shard: shardA, Claim: asCid(failoverA), Offset: 0, Length: 10, Slices: []service.Slice{
+					{Hash: hashes[0], Offset: 0, Length: 10},
+				}},
+			},
+		},
+		{
+			name:   "annotates fetches with the probes of their URLs",
+			claims: []delegation.Delegation{failoverA},
+			probes: map[string]queryresult.LocationProbe{
+				urlC.String():                     {Status: queryresult.ProbeFailed, Code: 404},
+				urlB.String():                     {Status: queryresult.ProbeLive, Code: 200},
+				"https://unrelated.example.com/x": {Status: queryresult.ProbeLive, Code: 200},
+			},
+			wanted: []multihash.Multihash{hashes[0]},
+			expectedFetches: []service.Fetch{
+				// failed probes don't change the order the URLs are tried in
+				{URL: *urlC, Fallbacks: []url.URL{*urlA, *urlB}, Shard: shardA, Claim: asCid(failoverA), Offset: 0, Length: 10, Slices: []service.Slice{
+					{Hash: hashes[0], Offset: 0, Length: 10},
+				}, Probes: map[string]queryresult.LocationProbe{
+					urlC.String(): {Status: queryresult.ProbeFailed, Code: 404},
+					urlB.String(): {Status: queryresult.ProbeLive, Code: 200},
+				}},
+			},
+		},
+		{
+			name:            "skips locations with no URL that can be fetched",
+			claims:          []delegation.Delegation{unfetchableA},
+			wanted:          []multihash.Multihash{hashes[0]},
+			expectedMissing: []multihash.Multihash{hashes[0]},
+		},
+		{
+			name:            "lists hashes without an index or location as missing",
+			claims:          []delegation.Delegation{locationA},
+			wanted:          []multihash.Multihash{hashes[3], unindexed},
+			expectedMissing: []multihash.Multihash{hashes[3], unindexed},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := map[cid.Cid]delegation.Delegation{}
+			for _, claim := range tc.claims {
+				claims[asCid(claim)] = claim
+			}
+			indexes := bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1)
+			indexes.Set(types.EncodedContextID("index"), index)
+			qr := testutil.Must(queryresult.Build(claims, indexes, queryresult.WithProbes(tc.probes)))(t)
+
+			plan := testutil.Must(service.PlanRetrieval(qr, tc.wanted))(t)
+			require.Equal(t, tc.expectedFetches, plan.Fetches)
+			require.Equal(t, tc.expectedMissing, plan.Missing)
+		})
+	}
+}
+
+func locationDelegation(t *testing.T, shard multihash.Multihash, location url.URL, rng *adm.Range) delegation.Delegation {
+	claim := assert.Location.New(testutil.Service.DID().String(), assert.LocationCaveats{
+		Content:  assert.FromHash(shard),
+		Location: []url.URL{location},
+		Range:    rng,
+	})
+	return testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.LocationCaveats]{claim}))(t)
+}
+
+// locationsDelegation is a location commitment listing several URLs, highest
+// priority first
+func locationsDelegation(t *testing.T, shard multihash.Multihash, locations ...*url.URL) delegation.Delegation {
+	urls := make([]url.URL, 0, len(locations))
+	for _, u := range locations {
+		urls = append(urls, *u)
+	}
+	claim := assert.Location.New(testutil.Service.DID().String(), assert.LocationCaveats{
+		Content:  assert.FromHash(shard),
+		Location: urls,
+	})
+	return testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.LocationCaveats]{claim}))(t)
+}
+
+func asCid(claim delegation.Delegation) cid.Cid {
+	return claim.Link().(cidlink.Link).Cid
+}
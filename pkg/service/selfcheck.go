@@ -0,0 +1,396 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	ipnifind "github.com/ipni/go-libipni/find/client"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/maurl"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	ed25519 "github.com/storacha/go-ucanto/principal/ed25519/signer"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+const (
+	// DefaultSelfCheckCacheWait is how long a self check waits for the published
+	// record to be cached, when not otherwise set
+	DefaultSelfCheckCacheWait = 10 * time.Second
+	// selfCheckPollInterval is how often a self check looks for the record it is
+	// waiting for
+	selfCheckPollInterval = 100 * time.Millisecond
+	// selfCheckRemoveTimeout bounds the removal of the synthetic provider, which
+	// is attempted even once the context of the self check is done
+	selfCheckRemoveTimeout = 30 * time.Second
+	// selfCheckClaimTTL is how long the synthetic claim is valid for, should its
+	// removal fail
+	selfCheckClaimTTL = time.Hour
+)
+
+// SelfCheckStage is a stage of a self check
+type SelfCheckStage string
+
+const (
+	// SelfCheckPublish publishes the synthetic claim, advertising it if the
+	// service publishes advertisements
+	SelfCheckPublish SelfCheckStage = "publish"
+	// SelfCheckCache waits for the record of the claim to be cached
+	SelfCheckCache SelfCheckStage = "cache"
+	// SelfCheckIPNI waits for IPNI to ingest the advertisement of the claim
+	SelfCheckIPNI SelfCheckStage = "ipni"
+	// SelfCheckQuery queries for the content of the claim through the full walk
+	SelfCheckQuery SelfCheckStage = "query"
+	// SelfCheckRemove removes the synthetic provider, and checks that its
+	// records are gone
+	SelfCheckRemove SelfCheckStage = "remove"
+)
+
+// SelfCheckStatus is how a stage of a self check ended
+type SelfCheckStatus string
+
+const (
+	SelfCheckPassed  SelfCheckStatus = "passed"
+	SelfCheckFailed  SelfCheckStatus = "failed"
+	SelfCheckSkipped SelfCheckStatus = "skipped"
+)
+
+// SelfCheckOptions configures a self check
+type SelfCheckOptions struct {
+	// ProviderURL is the URL the synthetic claim is advertised to be fetched
+	// from, with "{claim}" in place of its CID. The claim is served from the
+	// claim cache if the service has one, but the URL must still be one the
+	// address policy allows fetching from
+	ProviderURL url.URL
+	// CacheWait is how long the published record has to be cached in. If not
+	// set, DefaultSelfCheckCacheWait is used
+	CacheWait time.Duration
+	// IPNIWait is how long IPNI has to ingest the advertisement of the claim in.
+	// The stage is skipped if it is not set
+	IPNIWait time.Duration
+}
+
+// SelfCheckResult is the outcome of a stage of a self check
+type SelfCheckResult struct {
+	Stage    SelfCheckStage
+	Status   SelfCheckStatus
+	Duration time.Duration
+	// Reason is why the stage was skipped, if it was
+	Reason string
+	// Err is why the stage failed, if it did
+	Err error
+}
+
+// SelfCheckReport is the outcome of every stage of a self check, in the order
+// they ran
+type SelfCheckReport struct {
+	// Hash is the synthetic multihash the claim was published for
+	Hash multihash.Multihash
+	// Provider is the ephemeral peer the claim was published as provided by
+	Provider peer.ID
+	// Claim is the CID of the synthetic claim
+	Claim   cid.Cid
+	Started time.Time
+	Stages  []SelfCheckResult
+}
+
+// Passed returns true if no stage failed
+func (r SelfCheckReport) Passed() bool {
+	return r.Err() == nil
+}
+
+// Err returns the error of the first stage that failed, or nil if none did
+func (r SelfCheckReport) Err() error {
+	for _, s := range r.Stages {
+		if s.Status == SelfCheckFailed {
+			return fmt.Errorf("self check failed at %s: %w", s.Stage, s.Err)
+		}
+	}
+	return nil
+}
+
+// SelfCheckMetrics is told about the stages of self checks
+type SelfCheckMetrics interface {
+	// SelfChecked is called after each stage of a self check, with its
+	// SelfCheckStage, its SelfCheckStatus and how long it took
+	SelfChecked(stage, status string, duration time.Duration)
+}
+
+type noopSelfCheckMetrics struct{}
+
+func (noopSelfCheckMetrics) SelfChecked(string, string, time.Duration) {}
+
+// WithSelfCheckMetrics reports the stages of self checks to the given metrics
+func WithSelfCheckMetrics(m SelfCheckMetrics) Option {
+	return func(is *IndexingService) {
+		is.selfCheckMetrics = m
+	}
+}
+
+// WithIPNIFinder sets the client self checks ask IPNI for the synthetic claim
+// with directly, bypassing the cache, to wait for its ingestion
+func WithIPNIFinder(finder ipnifind.Finder) Option {
+	return func(is *IndexingService) {
+		is.ipniFinder = finder
+	}
+}
+
+// selfCheck is a self check in progress
+type selfCheck struct {
+	report  SelfCheckReport
+	result  model.ProviderResult
+	claim   delegation.Delegation
+	failed  bool
+	metrics SelfCheckMetrics
+}
+
+// run runs a stage, recording its outcome. Stages after one that failed are
+// skipped
+func (sc *selfCheck) run(stage SelfCheckStage, fn func() error) {
+	if sc.failed {
+		sc.skip(stage, "an earlier stage failed")
+		return
+	}
+	sc.always(stage, fn)
+}
+
+// always runs a stage whether or not an earlier stage failed
+func (sc *selfCheck) always(stage SelfCheckStage, fn func() error) {
+	start := time.Now()
+	err := fn()
+	result := SelfCheckResult{Stage: stage, Status: SelfCheckPassed, Duration: time.Since(start)}
+	if err != nil {
+		result.Status = SelfCheckFailed
+		result.Err = err
+		sc.failed = true
+	}
+	sc.record(result)
+}
+
+func (sc *selfCheck) skip(stage SelfCheckStage, reason string) {
+	sc.record(SelfCheckResult{Stage: stage, Status: SelfCheckSkipped, Reason: reason})
+}
+
+func (sc *selfCheck) record(result SelfCheckResult) {
+	sc.report.Stages = append(sc.report.Stages, result)
+	sc.metrics.SelfChecked(string(result.Stage), string(result.Status), result.Duration)
+}
+
+// SelfCheck publishes a synthetic location commitment for a random multihash,
+// as provided by an ephemeral peer, waits for it to be cached and, if
+// opts.IPNIWait is set, ingested by IPNI, queries it back through the full
+// walk, then removes the ephemeral provider. Nothing real is touched. The
+// removal is attempted whichever stage fails, and only passes once the records
+// of the provider are gone. The report lists every stage, including those
+// skipped, and the error returned is that of the first stage that failed
+func (is *IndexingService) SelfCheck(ctx context.Context, opts SelfCheckOptions) (SelfCheckReport, error) {
+	if opts.CacheWait <= 0 {
+		opts.CacheWait = DefaultSelfCheckCacheWait
+	}
+	sc, err := is.newSelfCheck(opts)
+	if err != nil {
+		return SelfCheckReport{}, err
+	}
+	hash := sc.report.Hash
+
+	sc.run(SelfCheckPublish, func() error {
+		if err := is.providerIndex.Publish(ctx, []multihash.Multihash{hash}, sc.result); err != nil {
+			return err
+		}
+		if is.claimCache != nil {
+			if err := claimlookup.CacheClaim(ctx, is.claimCache, sc.claim, true); err != nil {
+				return fmt.Errorf("caching claim: %w", err)
+			}
+		}
+		return nil
+	})
+	sc.run(SelfCheckCache, func() error {
+		return pollSelfCheck(ctx, opts.CacheWait, func() (bool, error) {
+			found, err := is.selfCheckCached(ctx, hash, sc.report.Provider)
+			if errors.Is(err, types.ErrCacheOnly) {
+				return false, nil
+			}
+			return found, err
+		})
+	})
+	switch {
+	case opts.IPNIWait <= 0:
+		sc.skip(SelfCheckIPNI, "IPNI wait disabled")
+	case is.ipniFinder == nil:
+		sc.skip(SelfCheckIPNI, "no IPNI finder configured")
+	default:
+		sc.run(SelfCheckIPNI, func() error {
+			return pollSelfCheck(ctx, opts.IPNIWait, func() (bool, error) {
+				res, err := is.ipniFinder.Find(ctx, hash)
+				if err != nil {
+					return false, err
+				}
+				return providedBy(res, sc.report.Provider), nil
+			})
+		})
+	}
+	sc.run(SelfCheckQuery, func() error {
+		qr, err := is.Query(ctx, Query{Hashes: []multihash.Multihash{hash}})
+		if err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(qr.Claims(), func(l ipld.Link) bool { return l.String() == sc.report.Claim.String() }) {
+			return fmt.Errorf("claim %s missing from query result", sc.report.Claim)
+		}
+		return nil
+	})
+	// the provider is removed whatever failed, since the publish may have been
+	// partly written
+	sc.always(SelfCheckRemove, func() error {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), selfCheckRemoveTimeout)
+		defer cancel()
+		if err := is.RemoveProvider(ctx, sc.report.Provider, nil); err != nil {
+			return err
+		}
+		found, err := is.selfCheckCached(ctx, hash, sc.report.Provider)
+		if err != nil && !errors.Is(err, types.ErrCacheOnly) {
+			return fmt.Errorf("verifying removal: %w", err)
+		}
+		if found {
+			return errors.New("records of the provider remain after removal")
+		}
+		return nil
+	})
+	return sc.report, sc.report.Err()
+}
+
+// newSelfCheck generates the ephemeral provider, content and claim of a self
+// check
+func (is *IndexingService) newSelfCheck(opts SelfCheckOptions) (*selfCheck, error) {
+	if !strings.Contains(opts.ProviderURL.Path, "{claim}") {
+		return nil, fmt.Errorf("provider URL %q has no {claim} in its path", opts.ProviderURL.String())
+	}
+	addr, err := maurl.FromURL(&opts.ProviderURL)
+	if err != nil {
+		return nil, fmt.Errorf("converting provider URL: %w", err)
+	}
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating provider key: %w", err)
+	}
+	provider, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("deriving provider peer ID: %w", err)
+	}
+	issuer, err := ed25519.Generate()
+	if err != nil {
+		return nil, fmt.Errorf("generating issuer: %w", err)
+	}
+	content := make([]byte, 32)
+	if _, err := rand.Read(content); err != nil {
+		return nil, fmt.Errorf("generating content: %w", err)
+	}
+	hash, err := multihash.Sum(content, multihash.SHA2_256, -1)
+	if err != nil {
+		return nil, fmt.Errorf("hashing content: %w", err)
+	}
+	location := url.URL{Scheme: "https", Host: "selfcheck.invalid", Path: "/blob/" + hash.B58String()}
+	expiration := time.Now().Add(selfCheckClaimTTL)
+	claim, err := delegation.Delegate(issuer, issuer, []ucan.Capability[assert.LocationCaveats]{
+		assert.Location.New(issuer.DID().String(), assert.LocationCaveats{
+			Content:  assert.FromHash(hash),
+			Location: []url.URL{location},
+		}),
+	}, delegation.WithExpiration(int(expiration.Unix())))
+	if err != nil {
+		return nil, fmt.Errorf("delegating claim: %w", err)
+	}
+	claimCid := claim.Link().(cidlink.Link).Cid
+	md := metadata.MetadataContext.New(&metadata.LocationCommitmentMetadata{
+		Claim:      claimCid,
+		Expiration: expiration.Unix(),
+	})
+	mdBytes, err := md.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("encoding metadata: %w", err)
+	}
+	metrics := is.selfCheckMetrics
+	if metrics == nil {
+		metrics = noopSelfCheckMetrics{}
+	}
+	return &selfCheck{
+		report: SelfCheckReport{Hash: hash, Provider: provider, Claim: claimCid, Started: time.Now()},
+		result: model.ProviderResult{
+			ContextID: hash,
+			Metadata:  mdBytes,
+			Provider:  &peer.AddrInfo{ID: provider, Addrs: []multiaddr.Multiaddr{addr}},
+		},
+		claim:   claim,
+		metrics: metrics,
+	}, nil
+}
+
+// selfCheckCached returns true if the cache has a location commitment record
+// of the provider for the hash
+func (is *IndexingService) selfCheckCached(ctx context.Context, hash multihash.Multihash, provider peer.ID) (bool, error) {
+	res, err := is.providerIndex.FindDetailed(types.WithCacheOnly(ctx), providerindex.QueryKey{
+		Hash:         hash,
+		TargetClaims: []multicodec.Code{metadata.LocationCommitmentID},
+	})
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(res.Results, func(r model.ProviderResult) bool {
+		return r.Provider != nil && r.Provider.ID == provider
+	}), nil
+}
+
+// providedBy returns true if any result of the response is of the provider
+func providedBy(res *model.FindResponse, provider peer.ID) bool {
+	if res == nil {
+		return false
+	}
+	for _, mhr := range res.MultihashResults {
+		for _, r := range mhr.ProviderResults {
+			if r.Provider != nil && r.Provider.ID == provider {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pollSelfCheck calls check until it returns true, errors, or the wait is over
+func pollSelfCheck(ctx context.Context, wait time.Duration, check func() (bool, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	ticker := time.NewTicker(selfCheckPollInterval)
+	defer ticker.Stop()
+	for {
+		ok, err := check()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("not found within %s: %w", wait, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
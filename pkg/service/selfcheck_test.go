@@ -0,0 +1,217 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/faults"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/stretchr/testify/require"
+)
+
+// removingProviderIndex removes the records of a provider from the store of
+// the provider index it wraps. If keep is set, removals succeed without
+// removing anything
+type removingProviderIndex struct {
+	service.ProviderIndex
+	store *mockProviderStore
+	keep  bool
+	err   error
+}
+
+func (m *removingProviderIndex) RemoveProvider(ctx context.Context, provider peer.ID, opts ...providerindex.RemoveOption) error {
+	if m.err != nil || m.keep {
+		return m.err
+	}
+	m.store.lk.Lock()
+	defer m.store.lk.Unlock()
+	for hash, results := range m.store.results {
+		m.store.results[hash] = slices.DeleteFunc(results, func(r model.ProviderResult) bool { return r.Provider.ID == provider })
+	}
+	return nil
+}
+
+// ingestingFinder is an IPNI that has ingested whatever is in the store, once
+// ingested is set
+type ingestingFinder struct {
+	store    *mockProviderStore
+	ingested bool
+}
+
+func (f *ingestingFinder) Find(ctx context.Context, hash multihash.Multihash) (*model.FindResponse, error) {
+	if !f.ingested {
+		return &model.FindResponse{}, nil
+	}
+	results, err := f.store.Get(ctx, hash)
+	if err != nil {
+		return &model.FindResponse{}, nil
+	}
+	return &model.FindResponse{MultihashResults: []model.MultihashResult{{Multihash: hash, ProviderResults: results}}}, nil
+}
+
+type recordingSelfCheckMetrics struct {
+	lk     sync.Mutex
+	stages map[string]string
+}
+
+func (m *recordingSelfCheckMetrics) SelfChecked(stage, status string, _ time.Duration) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.stages[stage] = status
+}
+
+func TestIndexingService__SelfCheck(t *testing.T) {
+	providerURL := *testutil.Must(url.Parse("http://claims.example.com/claims/{claim}"))(t)
+	newService := func(wrap func(service.ProviderIndex) service.ProviderIndex, opts ...service.Option) (*service.IndexingService, *removingProviderIndex) {
+		store := &mockProviderStore{results: map[string][]model.ProviderResult{}}
+		var providerIndex service.ProviderIndex = providerindex.NewProviderIndex(store,
+			&countingFinder{results: map[string][]model.ProviderResult{}, calls: map[string]int{}},
+			nil, nil, cidlink.DefaultLinkSystem(), nil)
+		if wrap != nil {
+			providerIndex = wrap(providerIndex)
+		}
+		removing := &removingProviderIndex{ProviderIndex: providerIndex, store: store}
+		claims := newMockClaimStore()
+		claimLookup := claimlookup.WithCache(claimlookup.NewClaimLookup(http.DefaultClient), claims)
+		opts = append([]service.Option{service.WithClaimCache(claims)}, opts...)
+		return testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimLookup, removing, opts...))(t), removing
+	}
+	statuses := func(report service.SelfCheckReport) map[service.SelfCheckStage]service.SelfCheckStatus {
+		s := map[service.SelfCheckStage]service.SelfCheckStatus{}
+		for _, stage := range report.Stages {
+			s[stage.Stage] = stage.Status
+		}
+		return s
+	}
+	remaining := func(is *removingProviderIndex, report service.SelfCheckReport) []model.ProviderResult {
+		is.store.lk.Lock()
+		defer is.store.lk.Unlock()
+		return is.store.results[string(report.Hash)]
+	}
+
+	t.Run("passes against the in-memory stack", func(t *testing.T) {
+		metrics := &recordingSelfCheckMetrics{stages: map[string]string{}}
+		is, removing := newService(nil, service.WithSelfCheckMetrics(metrics))
+		report, err := is.SelfCheck(context.Background(), service.SelfCheckOptions{ProviderURL: providerURL})
+		require.NoError(t, err)
+		require.True(t, report.Passed())
+		require.Equal(t, []service.SelfCheckStage{service.SelfCheckPublish, service.SelfCheckCache, service.SelfCheckIPNI, service.SelfCheckQuery, service.SelfCheckRemove}, []service.SelfCheckStage{
+			report.Stages[0].Stage, report.Stages[1].Stage, report.Stages[2].Stage, report.Stages[3].Stage, report.Stages[4].Stage,
+		})
+		require.Equal(t, service.SelfCheckSkipped, report.Stages[2].Status)
+		require.Equal(t, "IPNI wait disabled", report.Stages[2].Reason)
+		for _, stage := range slices.Delete(slices.Clone(report.Stages), 2, 3) {
+			require.Equal(t, service.SelfCheckPassed, stage.Status, stage.Stage)
+		}
+		require.Empty(t, remaining(removing, report))
+		require.Equal(t, map[string]string{"publish": "passed", "cache": "passed", "ipni": "skipped", "query": "passed", "remove": "passed"}, metrics.stages)
+
+		// every self check is of content and a provider of its own
+		again := testutil.Must(is.SelfCheck(context.Background(), service.SelfCheckOptions{ProviderURL: providerURL}))(t)
+		require.NotEqual(t, report.Hash, again.Hash)
+		require.NotEqual(t, report.Provider, again.Provider)
+	})
+
+	t.Run("waits for IPNI", func(t *testing.T) {
+		finder := &ingestingFinder{}
+		is, removing := newService(nil, service.WithIPNIFinder(finder))
+		finder.store = removing.store
+		finder.ingested = true
+		report, err := is.SelfCheck(context.Background(), service.SelfCheckOptions{ProviderURL: providerURL, IPNIWait: time.Second})
+		require.NoError(t, err)
+		require.Equal(t, service.SelfCheckPassed, statuses(report)[service.SelfCheckIPNI])
+
+		finder.ingested = false
+		report, err = is.SelfCheck(context.Background(), service.SelfCheckOptions{ProviderURL: providerURL, IPNIWait: 300 * time.Millisecond})
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Equal(t, map[service.SelfCheckStage]service.SelfCheckStatus{
+			service.SelfCheckPublish: service.SelfCheckPassed,
+			service.SelfCheckCache:   service.SelfCheckPassed,
+			service.SelfCheckIPNI:    service.SelfCheckFailed,
+			service.SelfCheckQuery:   service.SelfCheckSkipped,
+			service.SelfCheckRemove:  service.SelfCheckPassed,
+		}, statuses(report))
+		require.Empty(t, remaining(removing, report))
+	})
+
+	t.Run("failing publishes are reported, and removed anyway", func(t *testing.T) {
+		schedule := faults.NewSchedule(1, faults.Rule{Op: faults.OpPublish, Kind: faults.Error, Rate: 1})
+		is, _ := newService(func(pi service.ProviderIndex) service.ProviderIndex { return faults.WrapProviderIndex(pi, schedule) })
+		report, err := is.SelfCheck(context.Background(), service.SelfCheckOptions{ProviderURL: providerURL})
+		require.ErrorIs(t, err, faults.ErrInjected)
+		require.ErrorContains(t, err, "publish")
+		require.False(t, report.Passed())
+		require.Equal(t, map[service.SelfCheckStage]service.SelfCheckStatus{
+			service.SelfCheckPublish: service.SelfCheckFailed,
+			service.SelfCheckCache:   service.SelfCheckSkipped,
+			service.SelfCheckIPNI:    service.SelfCheckSkipped,
+			service.SelfCheckQuery:   service.SelfCheckSkipped,
+			service.SelfCheckRemove:  service.SelfCheckPassed,
+		}, statuses(report))
+	})
+
+	t.Run("failing finds are reported", func(t *testing.T) {
+		schedule := faults.NewSchedule(1, faults.Rule{Op: faults.OpFindProviders, Kind: faults.Error, Rate: 1})
+		is, removing := newService(func(pi service.ProviderIndex) service.ProviderIndex { return faults.WrapProviderIndex(pi, schedule) })
+		report, err := is.SelfCheck(context.Background(), service.SelfCheckOptions{ProviderURL: providerURL})
+		require.ErrorIs(t, err, faults.ErrInjected)
+		require.Equal(t, service.SelfCheckFailed, statuses(report)[service.SelfCheckCache])
+		require.Equal(t, service.SelfCheckSkipped, statuses(report)[service.SelfCheckQuery])
+		// the removal went through, but couldn't be verified
+		require.Equal(t, service.SelfCheckFailed, statuses(report)[service.SelfCheckRemove])
+		require.Empty(t, remaining(removing, report))
+	})
+
+	t.Run("removals are verified", func(t *testing.T) {
+		is, removing := newService(nil)
+		removing.keep = true
+		report, err := is.SelfCheck(context.Background(), service.SelfCheckOptions{ProviderURL: providerURL})
+		require.ErrorContains(t, err, "remain after removal")
+		require.Equal(t, service.SelfCheckPassed, statuses(report)[service.SelfCheckQuery])
+		require.Equal(t, service.SelfCheckFailed, statuses(report)[service.SelfCheckRemove])
+
+		removing.keep = false
+		removing.err = providerindex.ErrRemovalUnsupported
+		_, err = is.SelfCheck(context.Background(), service.SelfCheckOptions{ProviderURL: providerURL})
+		require.ErrorIs(t, err, providerindex.ErrRemovalUnsupported)
+	})
+
+	t.Run("provider URLs must have a claim placeholder", func(t *testing.T) {
+		is, _ := newService(nil)
+		report, err := is.SelfCheck(context.Background(), service.SelfCheckOptions{ProviderURL: *testutil.Must(url.Parse("http://claims.example.com/claims"))(t)})
+		require.Error(t, err)
+		require.Empty(t, report.Stages)
+	})
+
+	t.Run("the canary keeps the last report", func(t *testing.T) {
+		is, removing := newService(nil, service.WithCanary(time.Hour, service.SelfCheckOptions{ProviderURL: providerURL}))
+		canary := is.Canary()
+		_, checked := canary.Last()
+		require.False(t, checked)
+		require.False(t, canary.Failing())
+
+		testutil.Must(canary.Check(context.Background()))(t)
+		require.False(t, canary.Failing())
+
+		removing.err = errors.New("removal failed")
+		_, err := canary.Check(context.Background())
+		require.Error(t, err)
+		require.True(t, canary.Failing())
+		last, checked := canary.Last()
+		require.True(t, checked)
+		require.Equal(t, service.SelfCheckFailed, statuses(last)[service.SelfCheckRemove])
+	})
+}
@@ -3,30 +3,50 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net"
+	"net/http"
 	"net/url"
+	"slices"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/ipfs/go-cid"
+	ipnifind "github.com/ipni/go-libipni/find/client"
 	"github.com/ipni/go-libipni/find/model"
 	"github.com/ipni/go-libipni/maurl"
+	ipnimd "github.com/ipni/go-libipni/metadata"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
 	"github.com/multiformats/go-multicodec"
 	"github.com/multiformats/go-multihash"
 	"github.com/storacha/go-ucanto/core/delegation"
 	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/go-ucanto/principal"
 	"github.com/storacha/indexing-service/pkg/blobindex"
-	"github.com/storacha/indexing-service/pkg/internal/bytemap"
-	"github.com/storacha/indexing-service/pkg/internal/jobwalker"
-	"github.com/storacha/indexing-service/pkg/internal/jobwalker/parallelwalk"
-	"github.com/storacha/indexing-service/pkg/internal/jobwalker/singlewalk"
+	"github.com/storacha/indexing-service/pkg/jobwalker"
+	"github.com/storacha/indexing-service/pkg/jobwalker/parallelwalk"
+	"github.com/storacha/indexing-service/pkg/jobwalker/singlewalk"
 	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/storacha/indexing-service/pkg/service/addrpolicy"
+	"github.com/storacha/indexing-service/pkg/service/admission"
+	"github.com/storacha/indexing-service/pkg/service/claimevents"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/deadletter"
+	"github.com/storacha/indexing-service/pkg/service/dnsresolver"
+	"github.com/storacha/indexing-service/pkg/service/expansion"
+	"github.com/storacha/indexing-service/pkg/service/identity"
+	"github.com/storacha/indexing-service/pkg/service/liveness"
 	"github.com/storacha/indexing-service/pkg/service/providerindex"
 	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/service/replication"
+	"github.com/storacha/indexing-service/pkg/service/shadow"
+	cachesync "github.com/storacha/indexing-service/pkg/sync"
 	"github.com/storacha/indexing-service/pkg/types"
 )
 
-const defaultConcurrency = 5
-
 // Match narrows parameters for locating providers/claims for a set of multihashes
 type Match struct {
 	Subject []did.DID
@@ -36,9 +56,83 @@ type Match struct {
 type Query struct {
 	Hashes []multihash.Multihash
 	Match  Match
+	// StrictSpaces filters the location lookups spawned by following indexes and
+	// equals claims by the spaces of Match as strictly as the lookups of the
+	// queried hashes, for deployments where every record is published per space.
+	// By default they also accept location commitments not scoped to a space,
+	// such as those storage providers publish for the blobs they hold
+	StrictSpaces bool
+	// MaxProviderAge excludes provider records that have not been seen within
+	// the given duration, including records never seen. Zero means no limit
+	MaxProviderAge time.Duration
+	// Prefetch lowers the number of shards following a resolved shard whose
+	// locations are prefetched for this query, which can't be more than the
+	// service setting. Zero uses the service setting, negative disables
+	// prefetching for this query
+	Prefetch int
+	// IncludeSuperseded returns every generation of a location commitment found,
+	// and index claims replaced by a newer index claim, marked with the claim
+	// replacing them in their summaries. By default only the location commitment
+	// with the latest expiration is returned for each provider and shard, and
+	// superseded index claims are left out along with their indexes
+	IncludeSuperseded bool
+	// CanonicalizeAliases looks up every hash equivalent to a queried hash
+	// through equals claims along with it, and attributes what is found for any
+	// of them to a canonical hash of the cluster: the lowest of the queried hashes
+	// in it. Limits on the locations of a queried hash apply to the cluster, and
+	// the result lists the members of each cluster
+	CanonicalizeAliases bool
+	// FirstLocationWins stops looking for locations of a queried hash once one
+	// location commitment has been found for it. Pending location lookups spawned
+	// on its behalf are skipped, and no more location commitments are fetched for
+	// it, for callers that only need one retrievable location per hash
+	FirstLocationWins bool
+	// MaxResultsPerHash stops looking for locations of a queried hash once
+	// location commitments from that many distinct providers have been found for
+	// it, in the same way as FirstLocationWins, for callers that race a few
+	// locations. Indexes are still followed to reach them. Zero means no limit
+	MaxResultsPerHash int
+	// KnownClaims are claims the client already holds. They are not fetched, and
+	// are listed as confirmed in the result instead of being included when they
+	// are found again
+	KnownClaims []cid.Cid
+	// KnownIndexes are the context IDs of indexes the client already holds. They
+	// are left out of the result, and are only fetched again to find the shards
+	// to follow when the service doesn't remember them
+	KnownIndexes []types.EncodedContextID
+	// Diagnose traces the walk of the query, to describe in the result why each
+	// queried hash that found no claims found none
+	Diagnose bool
+	// ProbeLocations checks that the location URLs in the result respond, once
+	// the walk completes, to annotate the result with whether they do. Claims
+	// whose URLs fail their probes are still returned
+	ProbeLocations bool
+	// Walker overrides how the jobs of the query are walked. The default is the
+	// walker the service was constructed with
+	Walker Walker
+	// Concurrency overrides the most jobs of the query handled at once by the
+	// parallel walker, which it is walked with unless Walker says otherwise. Zero
+	// uses the service setting, and concurrency above the service's ceiling is
+	// clamped to it
+	Concurrency int
+	// Fresh skips the in-memory results of recent IPNI lookups, reading provider
+	// records from the cache or IPNI
+	Fresh bool
+	// Attest asks for the result to carry a receipt signed by the service,
+	// attesting that it answered the query with the result
+	Attest bool
 }
 
-// ProviderIndex is a read/write interface to a local cache of providers that falls back to IPNI
+// seenAtResolution is how stale a record's last seen time gets before a
+// successful fetch updates it
+const seenAtResolution = time.Minute
+
+// querySnapshotSize is the number of hashes whose provider records a single
+// query holds on to, so that all its jobs see the same records
+const querySnapshotSize = 4096
+
+// ProviderIndex is a read/write interface to a local cache of providers that falls back to IPNI.
+// Implementations must pass the conformance suite in providerindextest
 type ProviderIndex interface {
 	// Find should do the following
 	//  1. Read from the IPNI Storage cache to get a list of providers
@@ -47,14 +141,24 @@ type ProviderIndex interface {
 	//     b. the are no records in the cache or IPNI, it can attempt to read from legacy systems -- Dynamo tables & content claims storage, synthetically constructing provider results
 	//  2. With returned provider results, filter additionally for claim type. If space dids are set, calculate an encodedcontextid's by hashing space DID and Hash, and filter for a matching context id
 	//     Future TODO: kick off a conversion task to update the recrds
-	Find(context.Context, providerindex.QueryKey) ([]model.ProviderResult, error)
+	//  3. Report how many records were known before filtering, so an unknown hash can be told apart from one with no matching claims
+	FindDetailed(context.Context, providerindex.QueryKey) (providerindex.FindResult, error)
+	// CacheProviderResult merges a single provider record into the cache for a hash, expiring it no later than
+	// the given expiration if set
+	CacheProviderResult(ctx context.Context, hash multihash.Multihash, result model.ProviderResult, expiration time.Time) error
+	// MarkSeen records that a provider was seen to have a cached record for a hash at the given time
+	MarkSeen(ctx context.Context, hash multihash.Multihash, result model.ProviderResult, at time.Time) error
 	// Publish should do the following:
 	// 1. Write the entries to the cache with no expiration until publishing is complete
 	// 2. Generate an advertisement for the advertised hashes and publish/announce it
-	Publish(context.Context, []multihash.Multihash, model.ProviderResult)
+	// 3. Reject provider results with metadata that can't be read back, before writing anything
+	// 4. Bind location commitments already published under another space to the existing commitment, unless
+	//    providerindex.DistinctClaims is given
+	Publish(context.Context, []multihash.Multihash, model.ProviderResult, ...providerindex.PublishOption) error
 }
 
-// ClaimLookup is used to get full claims from a claim cid
+// ClaimLookup is used to get full claims from a claim cid. Implementations must
+// pass the conformance suite in claimlookuptest
 type ClaimLookup interface {
 	// LookupClaim should:
 	// 1. attempt to read the claim from the cache from the encoded contextID
@@ -63,7 +167,8 @@ type ClaimLookup interface {
 	LookupClaim(ctx context.Context, claimCid cid.Cid, fetchURL url.URL) (delegation.Delegation, error)
 }
 
-// BlobIndexLookup is a read through cache for fetching blob indexes
+// BlobIndexLookup is a read through cache for fetching blob indexes.
+// Implementations must pass the conformance suite in blobindexlookuptest
 type BlobIndexLookup interface {
 	// Find should:
 	// 1. attempt to read the sharded dag index from the cache from the encoded contextID
@@ -76,10 +181,75 @@ type BlobIndexLookup interface {
 
 // IndexingService implements read/write logic for indexing data with IPNI, content claims, sharded dag indexes, and a cache layer
 type IndexingService struct {
-	blobIndexLookup BlobIndexLookup
-	claimLookup     ClaimLookup
-	providerIndex   ProviderIndex
-	jobWalker       jobwalker.JobWalker[job, queryState]
+	blobIndexLookup   BlobIndexLookup
+	claimLookup       ClaimLookup
+	providerIndex     ProviderIndex
+	jobWalker         jobwalker.JobWalker[job, queryState]
+	claimEvents       *claimevents.Bus
+	claimWebhook      *claimevents.Webhook
+	deadLetters       *deadletter.Queue
+	replicator        *replication.Replicator
+	syncSource        *cachesync.Source
+	syncer            *cachesync.Syncer
+	shadowWriter      *shadow.Writer
+	shadowReader      *shadow.Reader
+	publisher         *publisher.Publisher
+	claimCache        types.ContentClaimsStore
+	claimAdmission    claimlookup.AdmissionPolicy
+	announcer         *publisher.Announcer
+	lagMonitor        *publisher.LagMonitor
+	prober            *liveness.Prober
+	refiner           *refiner
+	maxRefinements    int
+	refinementTimeout time.Duration
+	addressPolicy     *addrpolicy.Policy
+	resolver          dnsresolver.Resolver
+	initialConfig     DynamicConfig
+	config            atomic.Pointer[runtimeConfig]
+	prefetch          int
+	urlTimeout        time.Duration
+	prefetcher        *prefetcher
+	shardSummaries    *shardSummaries
+	shardFilters      types.ShardFilterStore
+	urlTemplates      *urlTemplates
+	maxAliasDepth     int
+	maxIndexDepth     int
+	spaceIndex        *swappableSpaceIndex
+	spaceIndexes      func(namespace string) types.SpaceIndexStore
+	containingIndexes types.ContainingIndexStore
+	admission         *admission.Controller
+	claimHandlers     map[multicodec.Code]ClaimHandler
+	metadataContext   ipnimd.MetadataContext
+	claimProvider     *peer.AddrInfo
+	contextIDs        types.ContextIDCodec
+	metrics           Metrics
+	hedging           *hedging
+	hedgeMetrics      HedgeMetrics
+	metricsHandler    http.Handler
+	auditSinks        []types.AuditSink
+	selfCheckMetrics  SelfCheckMetrics
+	ipniFinder        ipnifind.Finder
+	canary            *Canary
+	identities        *identity.Mapping
+	publishes         *publishes
+	publishWait       time.Duration
+	publishMetrics    PublishMetrics
+	claimLimits       claimlookup.Limits
+	clockSkew         time.Duration
+	skewMetrics       claimlookup.SkewMetrics
+	// concurrency is that of the service's walker, for queries that only
+	// override the walker
+	concurrency         int
+	maxQueryConcurrency int
+	resultSigner        principal.Signer
+	reconstruction      *reconstructor
+	resultCache         *resultCache
+	supersessions       types.SupersessionStore
+	strictMetadata      bool
+	mismatchMetrics     MismatchMetrics
+	mismatchObserver    MismatchObserver
+	expansion           *expansion.Pool
+	expansionWait       time.Duration
 }
 
 type job struct {
@@ -87,6 +257,13 @@ type job struct {
 	indexForMh          *multihash.Multihash
 	indexProviderRecord *model.ProviderResult
 	jobType             jobType
+	// origin is the queried hash the job was spawned on behalf of
+	origin multihash.Multihash
+	// shardFor is the hash an index was found to have in the shard being looked
+	// up, when the job is for a shard of an index
+	shardFor *multihash.Multihash
+	// depth is the number of indexes followed to reach the job
+	depth int
 }
 
 type jobKey string
@@ -96,6 +273,11 @@ func (j job) key() jobKey {
 	if j.indexForMh != nil {
 		k += jobKey(*j.indexForMh)
 	}
+	// shards are looked up for each hash found in them, so that the nested
+	// indexes of a shard are resolved for every hash
+	if j.shardFor != nil {
+		k += "shard" + jobKey(*j.shardFor)
+	}
 	return k
 }
 
@@ -105,48 +287,200 @@ const standardJobType jobType = "standard"
 const locationJobType jobType = "location"
 const equalsOrLocationJobType jobType = "equals_or_location"
 
+// targetClaims are the claims each type of follow up lookup is for. Standard
+// lookups are for every registered claim protocol
 var targetClaims = map[jobType][]multicodec.Code{
-	standardJobType:         {metadata.EqualsClaimID, metadata.IndexClaimID, metadata.LocationCommitmentID},
-	locationJobType:         {metadata.LocationCommitmentID},
-	equalsOrLocationJobType: {metadata.IndexClaimID, metadata.LocationCommitmentID},
+	locationJobType:         metadata.ClaimCodes(metadata.LocationKind),
+	equalsOrLocationJobType: metadata.ClaimCodes(metadata.IndexKind, metadata.LocationKind),
 }
 
+// targetClaims returns the claims a lookup of the given type is for
+func (is *IndexingService) targetClaims(jt jobType) []multicodec.Code {
+	if jt != standardJobType {
+		return targetClaims[jt]
+	}
+	codes := make([]multicodec.Code, 0, len(is.claimHandlers))
+	for code := range is.claimHandlers {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	return codes
+}
+
+// queryResult is the result of a query as it walks, built into an immutable
+// queryresult.QueryResult once the walk is complete
 type queryResult struct {
-	Claims  map[cid.Cid]delegation.Delegation
-	Indexes bytemap.ByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView]
+	*queryresult.Builder
+	// fetchedRefs are the context IDs of the index refs whose index was fetched
+	// from at least one location, so a failure at another can't mark them failed
+	fetchedRefs map[string]struct{}
+	// attributed is what was found on behalf of each origin hash, when the query
+	// canonicalizes aliases. Otherwise it is nil
+	attributed map[string]*attribution
+	// pending is set when the query went on without an index still being
+	// expanded, leaving the result partial
+	pending bool
+}
+
+// claimRecord is a claim protocol found in a provider result
+type claimRecord struct {
+	result   model.ProviderResult
+	seenAt   time.Time
+	protocol ipnimd.Protocol
+	claimCid cid.Cid
+}
+
+// claimCandidate is a URL of a provider a claim may be fetched from
+type claimCandidate struct {
+	provider peer.AddrInfo
+	url      *url.URL
+	result   model.ProviderResult
+	seenAt   time.Time
 }
 
 type queryState struct {
+	cfg    *runtimeConfig
 	q      *Query
+	known  *known
 	qr     *queryResult
 	visits map[jobKey]struct{}
+	// hashes are the hashes looked up by the walk, when its result is to be
+	// cached. Otherwise it is nil
+	hashes map[string]struct{}
+	// located are the providers location commitments have been found from for
+	// each queried hash, when the query limits the locations it wants
+	located map[string]map[peer.ID]struct{}
+	// providers is the provider index the query reads records from, which is a
+	// snapshot if the provider index supports them
+	providers ProviderIndex
+	// trace records the steps of the walk, if the query asks for diagnoses
+	trace *queryTrace
+	// indexes are the indexes the query has fetched
+	indexes *indexMemo
+	// maxIndexDepth is the number of levels of nested indexes followed
+	maxIndexDepth int
+	// counters count the work of the query for its stats
+	counters *types.WalkCounters
+}
+
+// wantedLocations returns the number of distinct providers of location
+// commitments the query wants for each queried hash, or zero for every location
+func (q *Query) wantedLocations() int {
+	if q.FirstLocationWins {
+		return 1
+	}
+	return max(q.MaxResultsPerHash, 0)
+}
+
+// locationLimit names the limit on locations in traces
+func (q *Query) locationLimit() string {
+	if q.FirstLocationWins {
+		return firstLocationWinsLimit
+	}
+	return maxResultsPerHashLimit
+}
+
+// limited records that the limit left something out for the job, in the trace
+// and the stats of the query
+func (qs queryState) limited(j job, limit string) {
+	qs.trace.limited(j, limit)
+	qs.counters.Truncated(limit)
+}
+
+// isSatisfied returns true if the query limits the locations it wants for the
+// job's origin hash, and they have all been found
+func (qs queryState) isSatisfied(j job) bool {
+	wanted := qs.q.wantedLocations()
+	return wanted > 0 && len(qs.located[string(j.origin)]) >= wanted
 }
 
 func (is *IndexingService) jobHandler(mhCtx context.Context, j job, spawn func(job) error, state jobwalker.WrappedState[queryState]) error {
 
+	// location lookups for a hash that already has its location are not needed.
+	// The job isn't marked visited, as it may be needed for another hash
+	trace := state.Access().trace
+	if j.jobType != standardJobType && state.Access().isSatisfied(j) {
+		log.Debugw("skipping job for satisfied hash", "hash", j.mh, "jobType", j.jobType, "origin", j.origin)
+		state.Access().limited(j, state.Access().q.locationLimit())
+		return nil
+	}
+
 	// check if node has already been visited and ignore if that is the case
 	if !state.CmpSwap(func(qs queryState) bool {
 		_, ok := qs.visits[j.key()]
 		return !ok
 	}, func(qs queryState) queryState {
 		qs.visits[j.key()] = struct{}{}
+		if qs.hashes != nil {
+			qs.hashes[string(j.mh)] = struct{}{}
+		}
 		return qs
 	}) {
 		return nil
 	}
+	state.Access().counters.Job()
+	if j.jobType == locationJobType {
+		is.prefetcher.requested(j.mh)
+	}
 
 	// find provider records related to this multihash
-	results, err := is.providerIndex.Find(mhCtx, providerindex.QueryKey{
+	cfg := state.Access().cfg
+	q := state.Access().q
+	fr, err := state.Access().providers.FindDetailed(mhCtx, providerindex.QueryKey{
 		Hash:         j.mh,
-		Spaces:       state.Access().q.Match.Subject,
-		TargetClaims: targetClaims[j.jobType],
+		Spaces:       q.Match.Subject,
+		TargetClaims: is.targetClaims(j.jobType),
+		// spawned lookups are for records that may have been published by
+		// someone other than the publisher of the records that led to them
+		UnscopedLocations: j.jobType != standardJobType && !q.StrictSpaces,
+		// records of denied providers aren't kept of find responses cut short,
+		// making room for those of other providers
+		Keep: func(provider *peer.AddrInfo) bool { return !cfg.isDenied(provider, is.identities) },
 	})
 	if err != nil {
 		return err
 	}
-	for _, result := range results {
+	trace.lookup(j, fr)
+	if fr.Truncated {
+		state.Access().counters.Truncated(maxFindRecordsLimit)
+	}
+	if fr.Unscoped > 0 {
+		log.Debugw("admitted location commitments not scoped to a space", "hash", j.mh, "jobType", j.jobType, "unscoped", fr.Unscoped)
+	}
+	if len(fr.Results) == 0 && fr.Known() {
+		log.Debugw("records found but none with requested claims", "hash", j.mh, "jobType", j.jobType, "seen", fr.SeenClaims)
+	}
+	maxAge := state.Access().q.MaxProviderAge
+	results := make([]model.ProviderResult, 0, len(fr.Results))
+	seenAts := make([]time.Time, 0, len(fr.Results))
+	for i, result := range fr.Results {
+		if cfg.isDenied(result.Provider, is.identities) {
+			trace.skip(j, result.Provider.ID, deniedReason)
+			continue
+		}
+		if !is.allowedProvider(mhCtx, result.Provider) {
+			log.Debugw("skipping provider with no allowed addresses", "hash", j.mh, "provider", result.Provider.ID)
+			trace.skip(j, result.Provider.ID, addrPolicyReason)
+			continue
+		}
+		var seenAt time.Time
+		if i < len(fr.SeenAt) {
+			seenAt = fr.SeenAt[i]
+		}
+		if maxAge > 0 && (seenAt.IsZero() || time.Since(seenAt) > maxAge) {
+			state.Access().limited(j, maxProviderAgeLimit)
+			continue
+		}
+		results = append(results, result)
+		seenAts = append(seenAts, seenAt)
+	}
+	// gather the claim protocols in every provider record, along with all the
+	// providers a claim can be fetched from, before fetching any of them
+	var records []claimRecord
+	candidates := map[cid.Cid][]claimCandidate{}
+	for i, result := range results {
 		// unmarshall metadata for this provider
-		md := metadata.MetadataContext.New()
+		md := is.metadataContext.New()
 		err = md.UnmarshalBinary(result.Metadata)
 		if err != nil {
 			return err
@@ -154,98 +488,178 @@ func (is *IndexingService) jobHandler(mhCtx context.Context, j job, spawn func(j
 		// the provider may list one or more protocols for this CID
 		// in our case, the protocols are just differnt types of content claims
 		for _, code := range md.Protocols() {
+			if _, ok := is.claimHandlers[code]; !ok {
+				log.Debugw("skipping unregistered claim protocol", "hash", j.mh, "code", code)
+				continue
+			}
 			protocol := md.Get(code)
 			// make sure this is some kind of claim protocol, ignore if not
 			hasClaimCid, ok := protocol.(metadata.HasClaim)
 			if !ok {
 				continue
 			}
-			// fetch (from cache or url) the actual content claim
 			claimCid := hasClaimCid.GetClaim()
-			url, err := is.fetchClaimURL(*result.Provider, claimCid)
+			records = append(records, claimRecord{result, seenAts[i], protocol, claimCid})
+			urls, err := is.fetchClaimURLs(mhCtx, *result.Provider, claimCid)
 			if err != nil {
-				return err
+				log.Warnw("provider has no claim endpoint", "claim", claimCid, "provider", result.Provider.ID, "error", err)
+				trace.skip(j, result.Provider.ID, noEndpointReason)
+				continue
 			}
-			claim, err := is.claimLookup.LookupClaim(mhCtx, claimCid, *url)
-			if err != nil {
-				return err
+			for _, url := range urls {
+				candidates[claimCid] = append(candidates[claimCid], claimCandidate{*result.Provider, &url, result, seenAts[i]})
 			}
-			// add the fetched claim to the results, if we don't already have it
+		}
+	}
+
+	claims := map[cid.Cid]delegation.Delegation{}
+	failed := map[cid.Cid]struct{}{}
+	for _, record := range records {
+		claimCid := record.claimCid
+		if _, ok := failed[claimCid]; ok {
+			continue
+		}
+		isLocation := metadata.ClaimKind(record.protocol.ID()) == metadata.LocationKind
+		if isLocation && state.Access().isSatisfied(j) {
+			log.Debugw("skipping location for satisfied hash", "claim", claimCid, "origin", j.origin)
+			state.Access().limited(j, q.locationLimit())
+			continue
+		}
+		var claim delegation.Delegation
+		if state.Access().known.claim(claimCid) {
+			// a claim the client already has is confirmed rather than fetched, and
+			// its handler still follows it
 			state.CmpSwap(
 				func(qs queryState) bool {
-					_, ok := qs.qr.Claims[claimCid]
+					_, ok := qs.qr.Confirmed[claimCid]
 					return !ok
 				},
 				func(qs queryState) queryState {
-					qs.qr.Claims[claimCid] = claim
+					qs.qr.Confirmed[claimCid] = struct{}{}
 					return qs
 				})
-
-			// handle each type of protocol
-			switch typedProtocol := protocol.(type) {
-			case *metadata.EqualsClaimMetadata:
-				// for an equals claim, it's published on both the content and equals multihashes
-				// we follow with a query for location claim on the OTHER side of the multihash
-				if string(typedProtocol.Equals.Hash()) != string(j.mh) {
-					// lookup was the content hash, queue the equals hash
-					if err := spawn(job{typedProtocol.Equals.Hash(), nil, nil, locationJobType}); err != nil {
-						return err
-					}
-				} else {
-					// lookup was the equals hash, queue the content hash
-					if err := spawn(job{multihash.Multihash(result.ContextID), nil, nil, locationJobType}); err != nil {
-						return err
+			trace.claim(j, claimCid)
+			attribute(state, j, func(a *attribution) { a.claims[claimCid] = struct{}{} })
+		} else {
+			var fetched bool
+			claim, fetched = claims[claimCid]
+			if !fetched {
+				// fetch (from cache or url) the actual content claim, falling back across
+				// all providers that advertised it
+				var from claimCandidate
+				// traced fetches note claims the claim cache didn't admit
+				var notCached atomic.Bool
+				fetchCtx := mhCtx
+				if trace != nil {
+					fetchCtx = claimlookup.WithNotCachedNotice(mhCtx, func(cid.Cid) { notCached.Store(true) })
+				}
+				claim, from, err = is.fetchClaim(fetchCtx, claimCid, metadata.ClaimKind(record.protocol.ID()), candidates[claimCid])
+				trace.fetch(j, claimCid, err, notCached.Load())
+				if err != nil {
+					if mhCtx.Err() != nil {
+						return mhCtx.Err()
 					}
+					// a claim no provider could serve fails only that claim, not the query
+					log.Warnw("fetching claim failed from all providers", "claim", claimCid, "error", err)
+					failed[claimCid] = struct{}{}
+					continue
 				}
-			case *metadata.IndexClaimMetadata:
-				// for an index claim, we follow by looking for a location claim for the index, and fetching the index
-				mh := j.mh
-				if err := spawn(job{typedProtocol.Index.Hash(), &mh, &result, equalsOrLocationJobType}); err != nil {
-					return err
+				is.observeIssuer(mhCtx, claim, from.provider.ID)
+				if cfg.isIssuerDenied(claim.Issuer().DID(), is.identities) {
+					trace.skip(j, from.provider.ID, deniedReason)
+					failed[claimCid] = struct{}{}
+					continue
 				}
-			case *metadata.LocationCommitmentMetadata:
-				// for a location claim, we just store it, unless its for an index CID, in which case get the full idnex
-				if j.indexForMh != nil {
-					// fetch (from URL or cache) the full index
-					shard := typedProtocol.Shard
-					if shard == nil {
-						c := cid.NewCidV1(cid.Raw, j.mh)
-						shard = &c
-					}
-					url, err := is.fetchRetrievalURL(*result.Provider, *shard)
-					if err != nil {
-						return err
-					}
-					index, err := is.blobIndexLookup.Find(mhCtx, result.ContextID, *j.indexProviderRecord, *url, typedProtocol.Range)
-					if err != nil {
-						return err
-					}
-					// Add the index to the query results, if we don't already have it
-					state.CmpSwap(
-						func(qs queryState) bool {
-							return !qs.qr.Indexes.Has(result.ContextID)
-						},
-						func(qs queryState) queryState {
-							qs.qr.Indexes.Set(result.ContextID, index)
-							return qs
-						})
-
-					// add location queries for all shards containing the original CID we're seeing an index for
-					shards := index.Shards().Iterator()
-					for shard, index := range shards {
-						if index.Has(*j.indexForMh) {
-							if err := spawn(job{shard, nil, nil, equalsOrLocationJobType}); err != nil {
-								return err
-							}
+				claims[claimCid] = claim
+				is.markSeen(mhCtx, j.mh, from.result, from.seenAt)
+			}
+
+			// the record's range and shard are checked against the signed claim,
+			// which wins if they disagree
+			if md, ok := record.protocol.(*metadata.LocationCommitmentMetadata); ok {
+				if fields, corrected := locationMismatch(md, claim); len(fields) > 0 {
+					is.metadataMismatch(j, trace, record, fields)
+					if is.strictMetadata {
+						if record.result.Provider != nil {
+							trace.skip(j, record.result.Provider.ID, metadataMismatchReason)
 						}
+						continue
 					}
+					record.protocol = corrected
 				}
 			}
+
+			// add the fetched claim to the results, if we don't already have it
+			state.CmpSwap(
+				func(qs queryState) bool {
+					_, ok := qs.qr.Claims[claimCid]
+					return !ok
+				},
+				func(qs queryState) queryState {
+					qs.qr.Claims[claimCid] = claim
+					return qs
+				})
+			trace.claim(j, claimCid)
+			attribute(state, j, func(a *attribution) { a.claims[claimCid] = struct{}{} })
+		}
+
+		// hand the claim to the handler for its protocol
+		err := is.claimHandlers[record.protocol.ID()].Handle(mhCtx, &ClaimContext{
+			j:        j,
+			record:   record,
+			claim:    claim,
+			spawn:    spawn,
+			state:    state,
+			metadata: record.protocol,
+		})
+		if err != nil {
+			return err
+		}
+		if isLocation && q.wantedLocations() > 0 && record.result.Provider != nil {
+			state.Modify(func(qs queryState) queryState {
+				providers, ok := qs.located[string(j.origin)]
+				if !ok {
+					providers = map[peer.ID]struct{}{}
+					qs.located[string(j.origin)] = providers
+				}
+				providers[record.result.Provider.ID] = struct{}{}
+				return qs
+			})
 		}
 	}
 	return nil
 }
 
+// markSeen records a provider record as seen after something was successfully
+// fetched using it, unless it was seen recently anyway. Failures are logged and
+// otherwise ignored
+func (is *IndexingService) markSeen(ctx context.Context, mh multihash.Multihash, result model.ProviderResult, seenAt time.Time) {
+	now := time.Now()
+	if now.Sub(seenAt) < seenAtResolution {
+		return
+	}
+	if err := is.providerIndex.MarkSeen(ctx, mh, result, now); err != nil {
+		log.Warnw("recording provider record as seen", "hash", mh, "provider", result.Provider.ID, "error", err)
+	}
+}
+
+// warmLocationCache caches a location commitment under the multihash of the
+// shard it is for, so that later queries reaching the shard don't need to go to
+// IPNI. Failures are logged and otherwise ignored
+func (is *IndexingService) warmLocationCache(ctx context.Context, mh multihash.Multihash, result model.ProviderResult, location *metadata.LocationCommitmentMetadata) {
+	shard := mh
+	if location.Shard != nil {
+		shard = location.Shard.Hash()
+	}
+	var expiration time.Time
+	if location.Expiration != 0 {
+		expiration = time.Unix(location.Expiration, 0)
+	}
+	if err := is.providerIndex.CacheProviderResult(ctx, shard, result, expiration); err != nil {
+		log.Warnw("caching observed location commitment", "shard", shard, "error", err)
+	}
+}
+
 // Query returns back relevant content claims for the given query using the following steps
 // 1. Query the IPNIIndex for all matching records
 // 2. For any index records, query the IPNIIndex for any location claims for that index cid
@@ -253,28 +667,240 @@ func (is *IndexingService) jobHandler(mhCtx context.Context, j job, spawn func(j
 // 4. Query the BlobIndexLookup to get the full ShardedDagIndex for any index claims
 // 5. Query IPNIIndex for any location claims for any shards that contain the multihash based on the ShardedDagIndex
 // 6. Read the requisite claims from the ClaimLookup
-// 7. Return all discovered claims and sharded dag indexes
+// 7. Return all discovered claims and sharded dag indexes, with a signed
+// receipt if the query asked to attest the result
 func (is *IndexingService) Query(ctx context.Context, q Query) (queryresult.QueryResult, error) {
+	if q.Attest && is.resultSigner == nil {
+		return nil, ErrNoResultSigner
+	}
+	qr, err := is.query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	built, err := qr.Build()
+	if err != nil || !q.Attest {
+		return built, err
+	}
+	return is.attest(q, built)
+}
+
+// QuerySources runs a query the same way as Query, but returns the parts of the
+// result for streaming with queryresult.Write instead of building it. Indexes are
+// archived as they are written
+func (is *IndexingService) QuerySources(ctx context.Context, q Query) (queryresult.Sources, error) {
+	qr, err := is.query(ctx, q)
+	if err != nil {
+		return queryresult.Sources{}, err
+	}
+	src := queryresult.Sources{
+		Claims: make([]delegation.Delegation, 0, len(qr.Claims)),
+		Indexes: func(yield func(queryresult.IndexSource, error) bool) {
+			for contextID, index := range qr.Indexes.Iterator() {
+				source, err := queryresult.IndexSourceFromView(contextID, index)
+				if err != nil {
+					err = fmt.Errorf("archiving index: %w", err)
+				}
+				if !yield(source, err) || err != nil {
+					return
+				}
+			}
+		},
+		Confirmed: qr.ConfirmedClaims(),
+		IndexRefs: qr.IndexRefs,
+		Stats:     qr.Stats,
+	}
+	for _, claim := range qr.Claims {
+		src.Claims = append(src.Claims, claim)
+	}
+	return src, nil
+}
+
+func (is *IndexingService) query(ctx context.Context, q Query) (*queryResult, error) {
+	received := time.Now()
+	if q.Fresh {
+		ctx = types.WithFresh(ctx)
+	}
+	cfg := is.config.Load()
+	if !cfg.allowQuery() {
+		return nil, ErrQueryRateLimited
+	}
+	// results that are the same for every caller are answered from the result
+	// cache without being walked or admitted
+	var resultKey string
+	var generation uint64
+	var hashes map[string]struct{}
+	if is.resultCache != nil && cacheableResult(&q) {
+		resultKey = string(QueryDigest(q))
+		if qr, ok := is.cachedResult(resultKey); ok {
+			qr.Stats = queryresult.Stats{WallTime: time.Since(received)}
+			return qr, nil
+		}
+		generation = is.resultCache.begin()
+		hashes = map[string]struct{}{}
+		// the result is walked with the settings current once its generation
+		// began, so that a reconfiguration flushing results after it drops it
+		cfg = is.config.Load()
+	}
+	if is.admission != nil {
+		// there is no estimate of the work a query will do, so queries for more
+		// hashes are taken to be more expensive
+		done, err := is.admission.Admit(len(q.Hashes))
+		if err != nil {
+			return nil, err
+		}
+		defer done()
+	}
+	if is.hedging != nil {
+		ctx = is.hedging.withHedgeBudget(ctx)
+	}
+	counters := &types.WalkCounters{}
+	ctx = types.WithWalkCounters(ctx, counters)
 	initialJobs := make([]job, 0, len(q.Hashes))
-	for _, mh := range q.Hashes {
-		initialJobs = append(initialJobs, job{mh, nil, nil, standardJobType})
+	origins := q.Hashes
+	var clusters []aliasCluster
+	var attributed map[string]*attribution
+	if q.CanonicalizeAliases {
+		var err error
+		clusters, err = is.aliasClusters(ctx, cfg, q)
+		if err != nil {
+			return nil, err
+		}
+		origins = make([]multihash.Multihash, 0, len(clusters))
+		for _, c := range clusters {
+			origins = append(origins, c.canonical)
+			for _, mh := range c.members {
+				initialJobs = append(initialJobs, job{mh: mh, jobType: standardJobType, origin: c.canonical})
+			}
+		}
+		attributed = map[string]*attribution{}
+	} else {
+		for _, mh := range q.Hashes {
+			initialJobs = append(initialJobs, job{mh: mh, jobType: standardJobType, origin: mh})
+		}
 	}
-	qs, err := is.jobWalker(ctx, initialJobs, queryState{
-		q: &q,
+	start := time.Now()
+	qs, err := is.walkerFor(&q)(ctx, initialJobs, queryState{
+		cfg:   cfg,
+		q:     &q,
+		known: newKnown(&q),
 		qr: &queryResult{
-			Claims:  make(map[cid.Cid]delegation.Delegation),
-			Indexes: bytemap.NewByteMap[types.EncodedContextID, blobindex.ShardedDagIndexView](-1),
+			Builder:     queryresult.NewBuilder(),
+			fetchedRefs: map[string]struct{}{},
+			attributed:  attributed,
 		},
-		visits: map[jobKey]struct{}{},
+		visits:        map[jobKey]struct{}{},
+		hashes:        hashes,
+		located:       map[string]map[peer.ID]struct{}{},
+		providers:     is.queryProviders(),
+		trace:         newQueryTrace(&q),
+		indexes:       newIndexMemo(),
+		maxIndexDepth: is.maxIndexDepth,
+		counters:      counters,
 	}, is.jobHandler)
 	if err != nil {
+		is.metrics.QueryWalked(time.Since(start), 0, err)
 		return nil, err
 	}
-	return queryresult.Build(qs.qr.Claims, qs.qr.Indexes)
+	is.metrics.QueryWalked(time.Since(start), len(qs.visits), nil)
+	supersededIndexes := is.supersededIndexes(ctx, qs.qr.Claims)
+	if q.IncludeSuperseded {
+		qs.qr.SupersededBy = supersededIndexes
+	} else {
+		if superseded := supersededLocations(qs.qr.Claims); len(superseded) > 0 {
+			log.Debugw("omitting superseded location claims", "claims", superseded)
+			for _, claimCid := range superseded {
+				delete(qs.qr.Claims, claimCid)
+			}
+		}
+		if len(supersededIndexes) > 0 {
+			log.Debugw("omitting superseded index claims", "claims", supersededIndexes)
+			omitSupersededIndexes(qs.qr, supersededIndexes)
+		}
+	}
+	qs.qr.Diagnostics = qs.trace.diagnose(origins)
+	if q.CanonicalizeAliases {
+		qs.qr.HashResults = hashResults(clusters, qs.qr)
+	}
+	if q.ProbeLocations {
+		qs.qr.Probes = is.probeLocations(ctx, qs.qr.Claims)
+	}
+	qs.qr.Stats = queryresult.Stats{
+		Jobs:            counters.Jobs(),
+		CacheHits:       counters.CacheHits(),
+		CacheMisses:     counters.CacheMisses(),
+		Fetches:         counters.Fetches(),
+		IndexesExpanded: counters.IndexesExpanded(),
+		WallTime:        time.Since(received),
+		Truncated:       counters.TruncatedBy(),
+	}
+	// results found under a cache only context, or without indexes still being
+	// expanded, are partial, so they are never cached
+	if hashes != nil && !types.IsCacheOnly(ctx) && !qs.qr.pending {
+		is.cacheResult(resultKey, generation, qs)
+	}
+	is.shadowRead(ctx, cfg, q, qs.qr)
+	return qs.qr, nil
+}
+
+// snapshotProviderIndex is implemented by provider indexes that can give a
+// query a consistent view of the provider records, unaffected by writes made
+// while the query runs
+type snapshotProviderIndex interface {
+	Snapshot(size int) *providerindex.ProviderIndex
 }
 
-func (is *IndexingService) urlForResource(provider peer.AddrInfo, resourceType string, resourceID string) (*url.URL, error) {
-	for _, addr := range provider.Addrs {
+// queryProviders returns the provider index for a single query to read from.
+// Every job of the query sees the same records for a hash, so a publish or
+// removal landing part way through a query can't leave it half applied
+func (is *IndexingService) queryProviders() ProviderIndex {
+	if s, ok := is.providerIndex.(snapshotProviderIndex); ok {
+		return s.Snapshot(querySnapshotSize)
+	}
+	return is.providerIndex
+}
+
+// allowedProvider returns true if the provider has an address the address
+// policy allows connecting to. Records of other providers are skipped
+// altogether, so nothing is fetched or cached from them
+func (is *IndexingService) allowedProvider(ctx context.Context, provider *peer.AddrInfo) bool {
+	if is.addressPolicy == nil || provider == nil {
+		return true
+	}
+	for _, addr := range is.providerAddrs(ctx, *provider) {
+		url, err := maurl.ToURL(addr)
+		if err != nil {
+			continue
+		}
+		if is.addressPolicy.CheckHost(ctx, url.Hostname()) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// providerAddrs returns the addresses of the provider, with dnsaddr addresses
+// replaced by the addresses they resolve to
+func (is *IndexingService) providerAddrs(ctx context.Context, provider peer.AddrInfo) []multiaddr.Multiaddr {
+	addrs, err := dnsresolver.ResolveAddrs(ctx, is.resolver, provider.Addrs)
+	if err != nil {
+		log.Debugw("resolving provider addresses", "provider", provider.ID, "error", err)
+	}
+	return addrs
+}
+
+func (is *IndexingService) urlForResource(ctx context.Context, provider peer.AddrInfo, resourceType string, resourceID string) (*url.URL, error) {
+	urls, err := is.urlsForResource(ctx, provider, resourceType, resourceID)
+	if err != nil {
+		return nil, err
+	}
+	return &urls[0], nil
+}
+
+// urlsForResource returns a URL for the resource for every address of the
+// provider that can serve it, in the order the addresses are listed
+func (is *IndexingService) urlsForResource(ctx context.Context, provider peer.AddrInfo, resourceType string, resourceID string) ([]url.URL, error) {
+	var urls []url.URL
+	for _, addr := range is.providerAddrs(ctx, provider) {
 		// first, attempt to convert the addr to a url scheme
 		url, err := maurl.ToURL(addr)
 		// if it can't be converted, skip
@@ -289,19 +915,74 @@ func (is *IndexingService) urlForResource(provider peer.AddrInfo, resourceType s
 		if !strings.Contains(url.Path, resourceType) {
 			continue
 		}
-		// ok we have a matching URL, return with all resource type components replaced with the id
+		// and the host must resolve to an address we are allowed to connect to
+		if is.addressPolicy != nil {
+			if err := is.addressPolicy.CheckHost(ctx, url.Hostname()); err != nil {
+				log.Debugw("skipping provider address", "provider", provider.ID, "addr", addr, "error", err)
+				continue
+			}
+		}
+		// ok we have a matching URL, with all resource type components replaced with the id
 		url.Path = strings.ReplaceAll(url.Path, resourceType, resourceID)
-		return url, nil
+		urls = append(urls, *url)
+	}
+	if len(urls) == 0 {
+		return nil, errors.New("no claim endpoint found")
 	}
-	return nil, errors.New("no claim endpoint found")
+	return urls, nil
 }
 
-func (is *IndexingService) fetchClaimURL(provider peer.AddrInfo, claimCid cid.Cid) (*url.URL, error) {
-	return is.urlForResource(provider, "{claim}", claimCid.String())
+func (is *IndexingService) fetchClaimURL(ctx context.Context, provider peer.AddrInfo, claimCid cid.Cid) (*url.URL, error) {
+	return is.urlForResource(ctx, provider, "{claim}", claimCid.String())
 }
 
-func (is *IndexingService) fetchRetrievalURL(provider peer.AddrInfo, shard cid.Cid) (*url.URL, error) {
-	return is.urlForResource(provider, "{shard}", shard.String())
+// fetchClaimURLs returns every URL the provider serves the claim at, in the
+// order its addresses are listed
+func (is *IndexingService) fetchClaimURLs(ctx context.Context, provider peer.AddrInfo, claimCid cid.Cid) ([]url.URL, error) {
+	return is.urlsForResource(ctx, provider, "{claim}", claimCid.String())
+}
+
+// fetchClaim reads a claim from the claim lookup, trying each URL of each
+// provider that advertised it in order until one succeeds, and returns the
+// provider it was fetched from. Every attempt but the last is cut short by the
+// URL timeout, and attempts are hedged if hedging is enabled
+func (is *IndexingService) fetchClaim(ctx context.Context, claimCid cid.Cid, kind metadata.Kind, candidates []claimCandidate) (delegation.Delegation, claimCandidate, error) {
+	if len(candidates) == 0 {
+		return nil, claimCandidate{}, errors.New("no provider with a claim endpoint")
+	}
+	hosts := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		hosts = append(hosts, candidate.url.Host)
+	}
+	claim, i, err := fetchFirst(ctx, is, HedgedClaimFetch, hosts, func(ctx context.Context, i int) (delegation.Delegation, error) {
+		claim, err := is.claimLookup.LookupClaim(ctx, claimCid, *candidates[i].url)
+		if err != nil {
+			return nil, fmt.Errorf("fetching claim from provider %s at %s: %w", candidates[i].provider.ID, candidates[i].url.Redacted(), err)
+		}
+		return claim, nil
+	}, func(i int, duration time.Duration, err error) {
+		is.metrics.ClaimFetched(kind, candidates[i].provider.ID, duration, err)
+	})
+	if err != nil {
+		return nil, claimCandidate{}, err
+	}
+	log.Debugw("fetched claim", "claim", claimCid, "provider", candidates[i].provider.ID)
+	return claim, candidates[i], nil
+}
+
+// fetchRetrievalURL returns the URL the shard is retrieved from, following the
+// blob URL template advertised by the provider if there is one, or else the
+// provider's address with a "{shard}" path. A template that can't be used falls
+// back to the provider's addresses
+func (is *IndexingService) fetchRetrievalURL(ctx context.Context, provider peer.AddrInfo, shard cid.Cid, template *string) (*url.URL, error) {
+	if template != nil {
+		url, err := is.templateRetrievalURL(ctx, provider, *template, shard)
+		if err == nil {
+			return url, nil
+		}
+		log.Debugw("falling back from blob URL template", "provider", provider.ID, "template", *template, "error", err)
+	}
+	return is.urlForResource(ctx, provider, "{shard}", shard.String())
 }
 
 // CacheClaim is used to cache a claim without publishing it to IPNI
@@ -310,7 +991,27 @@ func (is *IndexingService) fetchRetrievalURL(provider peer.AddrInfo, shard cid.C
 // ideally however, IPNI would enable UCAN chains for publishing so that we could publish it directly from the storage service
 // it doesn't for now, so we let SPs publish themselves them direct cache with us
 func (is *IndexingService) CacheClaim(ctx context.Context, claim delegation.Delegation) error {
-	return errors.New("not implemented")
+	if err := is.checkSupersession(ctx, claim); err != nil {
+		return is.auditClaim(ctx, types.AuditCache, claim, claimevents.ClaimEvent{}, err)
+	}
+	evt, err := is.cacheClaim(ctx, claim)
+	is.invalidateResults(claim)
+	if err == nil {
+		// cached claims aren't advertised, so the operation log is the only record
+		// of them to rebuild from. Failing to record it fails the cache, so that it
+		// is retried rather than missed
+		err = is.recordClaimOperation(ctx, publisher.OpCache, claim)
+	}
+	if err := is.auditClaim(ctx, types.AuditCache, claim, evt, err); err != nil {
+		return err
+	}
+	is.warmClaimCache(ctx, claim)
+	is.replicateClaim(claim)
+	is.shadowClaim(claim)
+	is.indexSpaceClaim(ctx, claim)
+	is.recordSupersession(ctx, claim)
+	is.notifyClaim(ctx, evt)
+	return nil
 }
 
 // PublishClaim caches and publishes a content claim
@@ -320,7 +1021,120 @@ func (is *IndexingService) CacheClaim(ctx context.Context, claim delegation.Dele
 // The service should lookup the index cid location claim, and fetch the ShardedDagIndexView, then use the hashes inside
 // to assemble all the multihashes in the index advertisement
 func (is *IndexingService) PublishClaim(ctx context.Context, claim delegation.Delegation) error {
-	return errors.New("not implemented")
+	return is.coalescePublish(ctx, claim, func() error {
+		return is.runPublish(ctx, claim)
+	})
+}
+
+func (is *IndexingService) runPublish(ctx context.Context, claim delegation.Delegation) error {
+	if err := is.checkSupersession(ctx, claim); err != nil {
+		return is.auditClaim(ctx, types.AuditPublish, claim, claimevents.ClaimEvent{}, err)
+	}
+	evt, err := is.publishClaim(ctx, claim)
+	is.invalidateResults(claim)
+	if err := is.auditClaim(ctx, types.AuditPublish, claim, evt, err); err != nil {
+		return err
+	}
+	is.warmClaimCache(ctx, claim)
+	is.replicateClaim(claim)
+	is.shadowClaim(claim)
+	is.indexSpaceClaim(ctx, claim)
+	is.recordSupersession(ctx, claim)
+	if evt.Provider != nil {
+		is.observeIssuer(ctx, claim, *evt.Provider)
+	}
+	is.notifyClaim(ctx, evt)
+	return nil
+}
+
+// replicateClaim queues a claim written through the service to be sent to the
+// other regions
+func (is *IndexingService) replicateClaim(claim delegation.Delegation) {
+	if is.replicator != nil {
+		is.replicator.ReplicateClaim(claim)
+	}
+}
+
+// SubscribeClaims returns a channel receiving an event for every claim that is
+// successfully published or cached, and a function to end the subscription.
+// Subscribers that fall behind miss events rather than slowing down publishing
+func (is *IndexingService) SubscribeClaims(ctx context.Context) (<-chan claimevents.ClaimEvent, func()) {
+	return is.claimEvents.Subscribe(ctx)
+}
+
+// DeadLetters returns the queue of failed background cache writes, or nil if
+// failed writes are not kept
+func (is *IndexingService) DeadLetters() *deadletter.Queue {
+	return is.deadLetters
+}
+
+// Admission returns the controller shedding queries under overload, or nil if
+// queries are never shed
+func (is *IndexingService) Admission() *admission.Controller {
+	return is.admission
+}
+
+// Replicator returns the replicator exchanging publish-origin cache writes with
+// other regions, or nil if replication is not configured
+func (is *IndexingService) Replicator() *replication.Replicator {
+	return is.replicator
+}
+
+// SyncSource returns the source describing the provider cache to other
+// deployments syncing from it, or nil if syncing is not configured
+func (is *IndexingService) SyncSource() *cachesync.Source {
+	return is.syncSource
+}
+
+// Syncer returns the syncer of the provider cache from other deployments, or
+// nil if syncing is not configured
+func (is *IndexingService) Syncer() *cachesync.Syncer {
+	return is.syncer
+}
+
+// Announcer returns the announcer of the service's advertisement chain, or nil
+// if advertisements are not announced
+func (is *IndexingService) Announcer() *publisher.Announcer {
+	return is.announcer
+}
+
+// LagMonitor returns the monitor of how far behind the head of the
+// advertisement chain indexers are, or nil if it isn't monitored
+func (is *IndexingService) LagMonitor() *publisher.LagMonitor {
+	return is.lagMonitor
+}
+
+// Publisher returns the publisher writing the service's advertisement chain, or
+// nil if advertisements are not published
+func (is *IndexingService) Publisher() *publisher.Publisher {
+	return is.publisher
+}
+
+// warmClaimCache writes a claim that was published or cached to the claim
+// cache. It is written once publishing is done, advertisement announced and
+// all, so it is expirable from the start. A failed write only costs a fetch of
+// the claim later, so it is logged rather than failing the publish. Claims
+// published or cached here bypass the admission policy of the claim cache
+func (is *IndexingService) warmClaimCache(ctx context.Context, claim delegation.Delegation) {
+	if is.claimCache == nil {
+		return
+	}
+	opts := []claimlookup.CacheClaimOption{claimlookup.WithSkewTolerance(is.clockSkew)}
+	if is.claimAdmission != nil {
+		opts = append(opts, claimlookup.CountedBy(is.claimAdmission))
+	}
+	if err := claimlookup.CacheClaim(ctx, is.claimCache, claim, true, opts...); err != nil {
+		log.Warnw("warming claim cache", "claim", claim.Link(), "error", err)
+	}
+}
+
+func (is *IndexingService) notifyClaim(ctx context.Context, evt claimevents.ClaimEvent) {
+	is.claimEvents.Publish(evt)
+	if is.claimWebhook != nil {
+		if err := is.claimWebhook.Enqueue(ctx, evt); err != nil {
+			log.Errorw("queueing claim event for webhook delivery", "claim", evt.Claim, "error", err)
+		}
+	}
 }
 
 // Option configures an IndexingService
@@ -329,20 +1143,205 @@ type Option func(is *IndexingService)
 // WithConcurrency causes the indexing service to process find queries parallel, with the given concurrency
 func WithConcurrency(concurrency int) Option {
 	return func(is *IndexingService) {
-		is.jobWalker = parallelwalk.NewParallelWalk[job, queryState](concurrency)
+		is.jobWalker = parallelwalk.NewParallelWalk[job, queryState](jobwalker.WithConcurrency(concurrency))
+		is.concurrency = concurrency
 	}
 }
 
-// NewIndexingService returns a new indexing service
-func NewIndexingService(blobIndexLookup BlobIndexLookup, claimLookup ClaimLookup, providerIndex ProviderIndex, options ...Option) *IndexingService {
+// WithClaimWebhook delivers events for published and cached claims to the given
+// webhook dispatcher
+func WithClaimWebhook(webhook *claimevents.Webhook) Option {
+	return func(is *IndexingService) {
+		is.claimWebhook = webhook
+	}
+}
+
+// WithDeadLetters makes the queue of failed background cache writes available
+// for inspection through the service
+func WithDeadLetters(deadLetters *deadletter.Queue) Option {
+	return func(is *IndexingService) {
+		is.deadLetters = deadLetters
+	}
+}
+
+// WithAdmission sheds expensive queries while the controller reports the
+// service is overloaded, and pauses background prefetching while it does
+func WithAdmission(controller *admission.Controller) Option {
+	return func(is *IndexingService) {
+		is.admission = controller
+	}
+}
+
+// WithAnnouncer makes the announcer of the advertisement chain available
+// through Announcer
+func WithAnnouncer(a *publisher.Announcer) Option {
+	return func(is *IndexingService) {
+		is.announcer = a
+	}
+}
+
+// WithAnnounceRoutes sets the initial routes of announcements of the
+// advertisement chain, see DynamicConfig.AnnounceRoutes
+func WithAnnounceRoutes(routes publisher.AnnounceRoutes) Option {
+	return func(is *IndexingService) {
+		is.initialConfig.AnnounceRoutes = routes
+	}
+}
+
+// WithLagMonitor makes the monitor of how far behind the head of the
+// advertisement chain indexers are available through LagMonitor
+func WithLagMonitor(m *publisher.LagMonitor) Option {
+	return func(is *IndexingService) {
+		is.lagMonitor = m
+	}
+}
+
+// WithClaimCache writes claims that are published or cached to the claim
+// cache, so that the first query for them doesn't fetch them back from the
+// provider. It should be the store the claim lookup reads through
+func WithClaimCache(store types.ContentClaimsStore) Option {
+	return func(is *IndexingService) {
+		is.claimCache = store
+	}
+}
+
+// WithClaimAdmission counts the claims written to the claim cache towards the
+// budget of the admission policy the claim lookup caches through, so that they
+// are admitted if they have to be fetched again
+func WithClaimAdmission(policy claimlookup.AdmissionPolicy) Option {
+	return func(is *IndexingService) {
+		is.claimAdmission = policy
+	}
+}
+
+// WithPublisher makes the publisher of the advertisement chain available through
+// the service, for inspecting the chain
+func WithPublisher(p *publisher.Publisher) Option {
+	return func(is *IndexingService) {
+		is.publisher = p
+	}
+}
+
+// WithReplicator sends the claims published or cached through the service to
+// the other regions of the replicator, and makes it available through the
+// service, so that batches replicated from other regions can be applied
+func WithReplicator(replicator *replication.Replicator) Option {
+	return func(is *IndexingService) {
+		is.replicator = replicator
+	}
+}
+
+// WithSync makes the provider cache available to sync to and from other
+// deployments through the service
+func WithSync(source *cachesync.Source, syncer *cachesync.Syncer) Option {
+	return func(is *IndexingService) {
+		is.syncSource = source
+		is.syncer = syncer
+	}
+}
+
+// WithAddressPolicy only fetches claims and indexes from provider addresses the
+// policy allows, so that provider records can't point fetches at loopback or
+// private networks
+func WithAddressPolicy(policy *addrpolicy.Policy) Option {
+	return func(is *IndexingService) {
+		is.addressPolicy = policy
+	}
+}
+
+// WithResolver sets the resolver the dnsaddr addresses of providers are
+// resolved with. It should be the resolver of the address policy, so that
+// addresses are checked against the same answers they are resolved with. If
+// not set, net.DefaultResolver is used
+func WithResolver(r dnsresolver.Resolver) Option {
+	return func(is *IndexingService) {
+		is.resolver = r
+	}
+}
+
+// WithLocationCacheWarming caches location commitments discovered while handling
+// queries under the multihash of the shard they are for
+func WithLocationCacheWarming(enabled bool) Option {
+	return func(is *IndexingService) {
+		is.initialConfig.LocationCacheWarming = enabled
+	}
+}
+
+// WithPrefetch resolves and caches the locations of the given number of shards
+// following each shard resolved through an index, in the background, so that
+// queries for the following blocks of a sequential reader are served from cache
+func WithPrefetch(shards int) Option {
+	return func(is *IndexingService) {
+		is.prefetch = shards
+	}
+}
+
+// WithClaimHandler registers a handler for the claim protocol with the given
+// multicodec code, replacing any handler already registered for it. Provider
+// records are then looked up for the protocol and its claims followed by the
+// handler when walking queries
+func WithClaimHandler(code multicodec.Code, handler ClaimHandler) Option {
+	return func(is *IndexingService) {
+		is.claimHandlers[code] = handler
+	}
+}
+
+// WithDynamicConfig sets the initial runtime configurable settings, which can
+// later be changed with Reconfigure. The service isn't created if they are
+// invalid
+func WithDynamicConfig(cfg DynamicConfig) Option {
+	return func(is *IndexingService) {
+		is.initialConfig = cfg
+	}
+}
+
+// NewIndexingService returns a new indexing service, or an error if the initial
+// dynamic config is invalid
+func NewIndexingService(blobIndexLookup BlobIndexLookup, claimLookup ClaimLookup, providerIndex ProviderIndex, options ...Option) (*IndexingService, error) {
 	is := &IndexingService{
-		blobIndexLookup: blobIndexLookup,
-		claimLookup:     claimLookup,
-		providerIndex:   providerIndex,
-		jobWalker:       singlewalk.SingleWalker[job, queryState],
+		blobIndexLookup:     blobIndexLookup,
+		claimLookup:         claimLookup,
+		providerIndex:       providerIndex,
+		jobWalker:           singlewalk.SingleWalker[job, queryState],
+		concurrency:         1,
+		maxQueryConcurrency: DefaultMaxQueryConcurrency,
+		claimEvents:         claimevents.NewBus(),
+		initialConfig:       DefaultDynamicConfig(),
+		prefetcher:          newPrefetcher(),
+		shardSummaries:      newShardSummaries(shardSummaryCacheSize),
+		urlTemplates:        newURLTemplates(urlTemplateCacheSize),
+		maxAliasDepth:       DefaultMaxAliasDepth,
+		maxIndexDepth:       DefaultMaxIndexDepth,
+		urlTimeout:          DefaultURLTimeout,
+		maxRefinements:      DefaultMaxRefinements,
+		refinementTimeout:   DefaultRefinementTimeout,
+		resolver:            net.DefaultResolver,
+		metrics:             noopMetrics{},
+		hedgeMetrics:        noopHedgeMetrics{},
+		publishes:           newPublishes(),
+		publishWait:         DefaultPublishWait,
+		publishMetrics:      noopPublishMetrics{},
+		mismatchMetrics:     noopMismatchMetrics{},
+		contextIDs:          types.DefaultContextIDCodec,
 	}
+	is.claimHandlers = defaultClaimHandlers(is)
 	for _, option := range options {
 		option(is)
 	}
-	return is
+	is.metadataContext = metadata.MetadataContext
+	for code, handler := range is.claimHandlers {
+		is.metadataContext = is.metadataContext.WithProtocol(code, handler.NewMetadata)
+	}
+	cfg, err := newRuntimeConfig(is.initialConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dynamic config: %w", err)
+	}
+	if err := is.applyAnnounceConfig(cfg); err != nil {
+		log.Errorw("invalid announce routes, announcing to every endpoint", "error", err)
+		cfg.AnnounceRoutes = publisher.AnnounceRoutes{}
+	}
+	is.config.Store(cfg)
+	is.applyShadowConfig(cfg)
+	is.refiner = newRefiner(is.maxRefinements, is.refinementTimeout)
+	return is, nil
 }
@@ -0,0 +1,802 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/maurl"
+	ipnimd "github.com/ipni/go-libipni/metadata"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/admission"
+	"github.com/storacha/indexing-service/pkg/service/blobindexlookup"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexingService__Query(t *testing.T) {
+	ctx := context.Background()
+	claim := testutil.RandomIndexDelegation()
+	claimCid := claim.Link().(cidlink.Link).Cid
+	claimBytes := testutil.Must(io.ReadAll(claim.Archive()))(t)
+	md := &metadata.IndexClaimMetadata{
+		Index: testutil.RandomCID().(cidlink.Link).Cid,
+		Claim: claimCid,
+	}
+	mdBytes := testutil.Must(md.MarshalBinary())(t)
+	contentHash := testutil.RandomMultihash()
+
+	unavailable := httptest.NewServer(http.NotFoundHandler())
+	defer unavailable.Close()
+	available := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.Must(w.Write(claimBytes))(t)
+	}))
+	defer available.Close()
+
+	resultFor := func(t *testing.T, server *httptest.Server) model.ProviderResult {
+		serverURL := testutil.Must(url.Parse(server.URL))(t)
+		serverURL.Path = "/claims/{claim}"
+		return model.ProviderResult{
+			ContextID: testutil.RandomBytes(10),
+			Metadata:  mdBytes,
+			Provider: &peer.AddrInfo{
+				ID:    testutil.RandomPeer(),
+				Addrs: []multiaddr.Multiaddr{testutil.Must(maurl.FromURL(serverURL))(t)},
+			},
+		}
+	}
+
+	testCases := []struct {
+		name           string
+		servers        []*httptest.Server
+		expectedClaims []cid.Cid
+	}{
+		{
+			name:           "falls back to next provider when the first fails",
+			servers:        []*httptest.Server{unavailable, available},
+			expectedClaims: []cid.Cid{claimCid},
+		},
+		{
+			name:    "claim unavailable from every provider is skipped",
+			servers: []*httptest.Server{unavailable, unavailable},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			results := make([]model.ProviderResult, 0, len(tc.servers))
+			for _, server := range tc.servers {
+				results = append(results, resultFor(t, server))
+			}
+			providerIndex := &mockProviderIndex{results: map[string][]model.ProviderResult{string(contentHash): results}}
+			claimStore := newMockClaimStore()
+			claimLookup := claimlookup.WithCache(claimlookup.NewClaimLookup(http.DefaultClient), claimStore)
+			is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimLookup, providerIndex, service.WithConcurrency(1)))(t)
+
+			qr, err := is.Query(ctx, service.Query{Hashes: []multihash.Multihash{contentHash}})
+			require.NoError(t, err)
+			claims := make([]cid.Cid, 0, len(qr.Claims()))
+			for _, link := range qr.Claims() {
+				claims = append(claims, link.(cidlink.Link).Cid)
+			}
+			require.ElementsMatch(t, tc.expectedClaims, claims)
+			require.Equal(t, len(tc.expectedClaims), claimStore.sets)
+		})
+	}
+}
+
+func TestIndexingService__LocationCacheWarming(t *testing.T) {
+	ctx := context.Background()
+	claims := map[string][]byte{}
+	addClaim := func(t *testing.T, claim delegation.Delegation) cid.Cid {
+		claimCid := claim.Link().(cidlink.Link).Cid
+		claims["/claims/"+claimCid.String()] = testutil.Must(io.ReadAll(claim.Archive()))(t)
+		return claimCid
+	}
+	newClaim := func(t *testing.T) cid.Cid {
+		return addClaim(t, testutil.RandomLocationDelegation())
+	}
+	// newShardClaim is a location commitment for the shard, as the shard its
+	// record names is checked against the claim
+	newShardClaim := func(t *testing.T, shard multihash.Multihash) cid.Cid {
+		return addClaim(t, testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.LocationCaveats]{
+			assert.Location.New(testutil.Service.DID().String(), assert.LocationCaveats{Content: assert.FromHash(shard), Location: []url.URL{*testutil.TestURL}}),
+		}))(t))
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claim, ok := claims[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		testutil.Must(w.Write(claim))(t)
+	}))
+	defer server.Close()
+	claimsURL := testutil.Must(url.Parse(server.URL + "/claims/{claim}"))(t)
+	blobsURL := testutil.Must(url.Parse(server.URL + "/blobs/{shard}"))(t)
+	provider := &peer.AddrInfo{
+		ID: testutil.RandomPeer(),
+		Addrs: []multiaddr.Multiaddr{
+			testutil.Must(maurl.FromURL(claimsURL))(t),
+			testutil.Must(maurl.FromURL(blobsURL))(t),
+		},
+	}
+	resultFor := func(t *testing.T, md interface{ MarshalBinary() ([]byte, error) }) model.ProviderResult {
+		return model.ProviderResult{
+			ContextID: testutil.RandomBytes(10),
+			Metadata:  testutil.Must(md.MarshalBinary())(t),
+			Provider:  provider,
+		}
+	}
+	expiration := time.Now().Add(time.Hour).Unix()
+
+	// hash A has a location commitment for shard X, which also contains hash B,
+	// found through an index claim for B
+	hashA, hashB, shardHash := testutil.RandomMultihash(), testutil.RandomMultihash(), testutil.RandomMultihash()
+	shardCid := cid.NewCidV1(cid.Raw, shardHash)
+	indexCid := testutil.RandomCID().(cidlink.Link).Cid
+	index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 1)
+	index.SetSlice(shardHash, hashB, blobindex.Position{Offset: 0, Length: 10})
+	ipniResults := map[string][]model.ProviderResult{
+		string(hashA):           {resultFor(t, &metadata.LocationCommitmentMetadata{Shard: &shardCid, Expiration: expiration, Claim: newShardClaim(t, shardHash)})},
+		string(hashB):           {resultFor(t, &metadata.IndexClaimMetadata{Index: indexCid, Expiration: expiration, Claim: newClaim(t)})},
+		string(indexCid.Hash()): {resultFor(t, &metadata.LocationCommitmentMetadata{Expiration: expiration, Claim: newClaim(t)})},
+		string(shardHash):       {resultFor(t, &metadata.LocationCommitmentMetadata{Expiration: expiration, Claim: newClaim(t)})},
+	}
+
+	testCases := []struct {
+		name               string
+		warm               bool
+		expectedShardFinds int
+	}{
+		{
+			name:               "shard location is served from cache",
+			warm:               true,
+			expectedShardFinds: 0,
+		},
+		{
+			name:               "shard location is looked up when warming is disabled",
+			warm:               false,
+			expectedShardFinds: 1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			finder := &countingFinder{results: ipniResults, calls: map[string]int{}}
+			providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, finder, nil, nil, cidlink.DefaultLinkSystem(), nil)
+			claimLookup := claimlookup.NewClaimLookup(http.DefaultClient)
+			is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{index: index}, claimLookup, providerIndex,
+				service.WithConcurrency(1), service.WithLocationCacheWarming(tc.warm)))(t)
+
+			_, err := is.Query(ctx, service.Query{Hashes: []multihash.Multihash{hashA}})
+			require.NoError(t, err)
+			qr, err := is.Query(ctx, service.Query{Hashes: []multihash.Multihash{hashB}})
+			require.NoError(t, err)
+			require.Len(t, qr.Indexes(), 1)
+			require.Equal(t, tc.expectedShardFinds, finder.calls[string(shardHash)])
+		})
+	}
+}
+
+func TestIndexingService__Reconfigure(t *testing.T) {
+	ctx := context.Background()
+	claim := testutil.RandomIndexDelegation()
+	claimCid := claim.Link().(cidlink.Link).Cid
+	claimBytes := testutil.Must(io.ReadAll(claim.Archive()))(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.Must(w.Write(claimBytes))(t)
+	}))
+	defer server.Close()
+	claimsURL := testutil.Must(url.Parse(server.URL + "/claims/{claim}"))(t)
+	providerID := testutil.RandomPeer()
+	contentHash := testutil.RandomMultihash()
+	providerIndex := &mockProviderIndex{results: map[string][]model.ProviderResult{
+		string(contentHash): {{
+			ContextID: testutil.RandomBytes(10),
+			Metadata: testutil.Must((&metadata.IndexClaimMetadata{
+				Index: testutil.RandomCID().(cidlink.Link).Cid,
+				Claim: claimCid,
+			}).MarshalBinary())(t),
+			Provider: &peer.AddrInfo{
+				ID:    providerID,
+				Addrs: []multiaddr.Multiaddr{testutil.Must(maurl.FromURL(claimsURL))(t)},
+			},
+		}},
+	}}
+	is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex, service.WithConcurrency(1)))(t)
+	query := service.Query{Hashes: []multihash.Multihash{contentHash}}
+
+	require.Equal(t, service.DefaultDynamicConfig(), is.Config())
+	qr, err := is.Query(ctx, query)
+	require.NoError(t, err)
+	require.Len(t, qr.Claims(), 1)
+
+	// rate limit queries
+	require.NoError(t, is.Reconfigure(service.DynamicConfig{QueryRateLimit: 0.001}))
+	require.Equal(t, 1, is.Config().QueryBurst)
+	_, err = is.Query(ctx, query)
+	require.NoError(t, err)
+	_, err = is.Query(ctx, query)
+	require.ErrorIs(t, err, service.ErrQueryRateLimited)
+
+	// lift the rate limit and deny the only provider
+	require.NoError(t, is.Reconfigure(service.DynamicConfig{DeniedProviders: []string{providerID.String()}}))
+	require.Equal(t, []string{providerID.String()}, is.Config().DeniedProviders)
+	qr, err = is.Query(ctx, query)
+	require.NoError(t, err)
+	require.Empty(t, qr.Claims())
+
+	// invalid config is rejected and leaves the current config in place
+	err = is.Reconfigure(service.DynamicConfig{DeniedProviders: []string{"not a peer"}})
+	require.Error(t, err)
+	err = is.Reconfigure(service.DynamicConfig{QueryRateLimit: -1})
+	require.Error(t, err)
+	require.Equal(t, []string{providerID.String()}, is.Config().DeniedProviders)
+}
+
+func TestIndexingService__InvalidDynamicConfig(t *testing.T) {
+	// the service isn't created with invalid initial settings, rather than
+	// running with the defaults in their place
+	for _, cfg := range []service.DynamicConfig{
+		{DeniedProviders: []string{"not a peer"}},
+		{QueryRateLimit: -1},
+		{ShadowReadRate: 2},
+	} {
+		_, err := service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), &mockProviderIndex{},
+			service.WithDynamicConfig(cfg))
+		require.Error(t, err)
+	}
+}
+
+func TestIndexingService__AnnounceRoutes(t *testing.T) {
+	announcer := testutil.Must(publisher.NewAnnouncer(dssync.MutexWrap(datastore.NewMapDatastore()), []publisher.AnnounceEndpoint{
+		{Name: "https://public.example"},
+		{Name: "https://private.example"},
+	}))(t)
+	routes := publisher.AnnounceRoutes{Kinds: map[string][]string{"location": {"https://private.example"}}}
+	is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), &mockProviderIndex{},
+		service.WithAnnouncer(announcer), service.WithAnnounceRoutes(routes)))(t)
+	require.Equal(t, routes, is.Config().AnnounceRoutes)
+	require.Equal(t, routes, announcer.Routes())
+
+	routes = publisher.AnnounceRoutes{Kinds: map[string][]string{"index": {"https://public.example"}}, Default: []string{"https://private.example"}}
+	require.NoError(t, is.Reconfigure(service.DynamicConfig{AnnounceRoutes: routes}))
+	require.Equal(t, routes, is.Config().AnnounceRoutes)
+	require.Equal(t, routes, announcer.Routes())
+
+	// invalid routes are rejected and leave the current routes in place
+	require.Error(t, is.Reconfigure(service.DynamicConfig{AnnounceRoutes: publisher.AnnounceRoutes{Kinds: map[string][]string{"inclusion": {}}}}))
+	require.Error(t, is.Reconfigure(service.DynamicConfig{AnnounceRoutes: publisher.AnnounceRoutes{Default: []string{"https://unknown.example"}}}))
+	require.Equal(t, routes, is.Config().AnnounceRoutes)
+	require.Equal(t, routes, announcer.Routes())
+
+	// initial routes naming unknown endpoints are dropped
+	is = testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), &mockProviderIndex{},
+		service.WithAnnouncer(announcer), service.WithAnnounceRoutes(publisher.AnnounceRoutes{Default: []string{"https://unknown.example"}})))(t)
+	require.Zero(t, is.Config().AnnounceRoutes)
+}
+
+func TestIndexingService__Admission(t *testing.T) {
+	ctx := context.Background()
+	// every query appears to take a second, well over the allowed p95
+	now := time.Unix(1000, 0)
+	clock := func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	controller := admission.New(admission.WithMaxP95(time.Millisecond), admission.WithClock(clock))
+	is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), &mockProviderIndex{}, service.WithAdmission(controller)))(t)
+	require.Same(t, controller, is.Admission())
+
+	expensive := service.Query{Hashes: testutil.RandomMultihashes(2)}
+	_, err := is.Query(ctx, expensive)
+	require.NoError(t, err)
+	require.True(t, controller.Shedding())
+
+	_, err = is.Query(ctx, expensive)
+	require.ErrorIs(t, err, admission.ErrOverloaded)
+	_, err = is.Query(ctx, service.Query{Hashes: testutil.RandomMultihashes(1)})
+	require.NoError(t, err)
+}
+
+func TestIndexingService__MaxProviderAge(t *testing.T) {
+	ctx := context.Background()
+	claims := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claim, ok := claims[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		testutil.Must(w.Write(claim))(t)
+	}))
+	defer server.Close()
+	claimsURL := testutil.Must(url.Parse(server.URL + "/claims/{claim}"))(t)
+	contentHash := testutil.RandomMultihash()
+
+	newResult := func(t *testing.T) (model.ProviderResult, cid.Cid) {
+		claim := testutil.RandomIndexDelegation()
+		claimCid := claim.Link().(cidlink.Link).Cid
+		claims["/claims/"+claimCid.String()] = testutil.Must(io.ReadAll(claim.Archive()))(t)
+		md := &metadata.IndexClaimMetadata{Index: testutil.RandomCID().(cidlink.Link).Cid, Claim: claimCid}
+		return model.ProviderResult{
+			ContextID: testutil.RandomBytes(10),
+			Metadata:  testutil.Must(md.MarshalBinary())(t),
+			Provider: &peer.AddrInfo{
+				ID:    testutil.RandomPeer(),
+				Addrs: []multiaddr.Multiaddr{testutil.Must(maurl.FromURL(claimsURL))(t)},
+			},
+		}, claimCid
+	}
+	fresh, freshClaim := newResult(t)
+	stale, staleClaim := newResult(t)
+	unseen, unseenClaim := newResult(t)
+	now := time.Now()
+
+	testCases := []struct {
+		name           string
+		maxAge         time.Duration
+		expectedClaims []cid.Cid
+		expectedMarked []model.ProviderResult
+	}{
+		{
+			name:           "no limit returns every record",
+			expectedClaims: []cid.Cid{freshClaim, staleClaim, unseenClaim},
+			expectedMarked: []model.ProviderResult{stale, unseen},
+		},
+		{
+			name:           "records not seen recently are excluded",
+			maxAge:         time.Hour,
+			expectedClaims: []cid.Cid{freshClaim},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			providerIndex := &mockProviderIndex{
+				results: map[string][]model.ProviderResult{string(contentHash): {fresh, stale, unseen}},
+				seenAt:  map[string][]time.Time{string(contentHash): {now.Add(-10 * time.Second), now.Add(-48 * time.Hour), {}}},
+			}
+			claimLookup := claimlookup.WithCache(claimlookup.NewClaimLookup(http.DefaultClient), newMockClaimStore())
+			is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimLookup, providerIndex, service.WithConcurrency(1)))(t)
+
+			qr, err := is.Query(ctx, service.Query{Hashes: []multihash.Multihash{contentHash}, MaxProviderAge: tc.maxAge})
+			require.NoError(t, err)
+			claims := make([]cid.Cid, 0, len(qr.Claims()))
+			for _, link := range qr.Claims() {
+				claims = append(claims, link.(cidlink.Link).Cid)
+			}
+			require.ElementsMatch(t, tc.expectedClaims, claims)
+			// records seen within the last minute aren't marked again
+			require.ElementsMatch(t, tc.expectedMarked, providerIndex.marked)
+		})
+	}
+}
+
+func TestIndexingService__Prefetch(t *testing.T) {
+	ctx := context.Background()
+	var claimsLk sync.Mutex
+	claims := map[string][]byte{}
+	claimFetches := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claimsLk.Lock()
+		defer claimsLk.Unlock()
+		claim, ok := claims[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		claimFetches[r.URL.Path]++
+		testutil.Must(w.Write(claim))(t)
+	}))
+	defer server.Close()
+	newClaim := func(t *testing.T) cid.Cid {
+		claim := testutil.RandomLocationDelegation()
+		claimCid := claim.Link().(cidlink.Link).Cid
+		claims["/claims/"+claimCid.String()] = testutil.Must(io.ReadAll(claim.Archive()))(t)
+		return claimCid
+	}
+	fetchesOf := func(claimCid cid.Cid) int {
+		claimsLk.Lock()
+		defer claimsLk.Unlock()
+		return claimFetches["/claims/"+claimCid.String()]
+	}
+	provider := &peer.AddrInfo{
+		ID: testutil.RandomPeer(),
+		Addrs: []multiaddr.Multiaddr{
+			testutil.Must(maurl.FromURL(testutil.Must(url.Parse(server.URL + "/claims/{claim}"))(t)))(t),
+			testutil.Must(maurl.FromURL(testutil.Must(url.Parse(server.URL + "/blobs/{shard}"))(t)))(t),
+		},
+	}
+	resultFor := func(t *testing.T, md interface{ MarshalBinary() ([]byte, error) }) model.ProviderResult {
+		return model.ProviderResult{
+			ContextID: testutil.RandomBytes(10),
+			Metadata:  testutil.Must(md.MarshalBinary())(t),
+			Provider:  provider,
+		}
+	}
+
+	// a DAG of 4 blocks, one in each shard, read in shard order
+	shards := testutil.RandomMultihashes(4)
+	slices.SortFunc(shards, func(a, b multihash.Multihash) int { return bytes.Compare(a, b) })
+	blocks := testutil.RandomMultihashes(4)
+	index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), len(shards))
+	for i, shard := range shards {
+		index.SetSlice(shard, blocks[i], blobindex.Position{Offset: 0, Length: 10})
+	}
+	indexCid := testutil.RandomCID().(cidlink.Link).Cid
+	indexResult := resultFor(t, &metadata.IndexClaimMetadata{Index: indexCid, Claim: newClaim(t)})
+	ipniResults := map[string][]model.ProviderResult{
+		string(indexCid.Hash()): {resultFor(t, &metadata.LocationCommitmentMetadata{Claim: newClaim(t)})},
+	}
+	shardClaims := make([]cid.Cid, 0, len(shards))
+	for i, shard := range shards {
+		ipniResults[string(blocks[i])] = []model.ProviderResult{indexResult}
+		shardClaims = append(shardClaims, newClaim(t))
+		ipniResults[string(shard)] = []model.ProviderResult{resultFor(t, &metadata.LocationCommitmentMetadata{Claim: shardClaims[i]})}
+	}
+
+	testCases := []struct {
+		name            string
+		opts            []service.Option
+		queryPrefetch   int
+		followUpFetches int
+	}{
+		{
+			name:            "follow up queries are served from cache",
+			opts:            []service.Option{service.WithPrefetch(2)},
+			followUpFetches: 0,
+		},
+		{
+			name:            "disabled by default",
+			followUpFetches: 2,
+		},
+		{
+			name:            "disabled for a query",
+			opts:            []service.Option{service.WithPrefetch(2)},
+			queryPrefetch:   -1,
+			followUpFetches: 2,
+		},
+		{
+			name:            "lowered for a query",
+			opts:            []service.Option{service.WithPrefetch(2)},
+			queryPrefetch:   1,
+			followUpFetches: 0,
+		},
+		{
+			name:            "not enabled by a query",
+			queryPrefetch:   1,
+			followUpFetches: 2,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			claimsLk.Lock()
+			clear(claimFetches)
+			claimsLk.Unlock()
+			finder := &countingFinder{results: ipniResults, calls: map[string]int{}}
+			providerStore := &mockProviderStore{results: map[string][]model.ProviderResult{}}
+			providerIndex := providerindex.NewProviderIndex(providerStore, finder, nil, nil, cidlink.DefaultLinkSystem(), nil)
+			claimStore := newMockClaimStore()
+			claimLookup := claimlookup.WithCache(claimlookup.NewClaimLookup(http.DefaultClient), claimStore)
+			// caching the index caches the index claim for every block in it, as the
+			// blob index lookup does
+			blobIndexLookup := &mockBlobIndexLookup{index: index, cache: func() {
+				for _, block := range blocks {
+					require.NoError(t, providerStore.Set(ctx, block, []model.ProviderResult{indexResult}, true))
+				}
+			}}
+			is := testutil.Must(service.NewIndexingService(blobIndexLookup, claimLookup, providerIndex, append([]service.Option{service.WithConcurrency(1)}, tc.opts...)...))(t)
+			prefetched := func(i int) bool {
+				_, err := claimStore.Get(ctx, shardClaims[i])
+				return err == nil
+			}
+
+			for i := range 3 {
+				before := finder.count(shards[i]) + fetchesOf(shardClaims[i])
+				qr, err := is.Query(ctx, service.Query{Hashes: []multihash.Multihash{blocks[i]}, Prefetch: tc.queryPrefetch})
+				require.NoError(t, err)
+				require.Len(t, qr.Indexes(), 1)
+				require.Contains(t, qr.Claims(), cidlink.Link{Cid: shardClaims[i]})
+				if i > 0 {
+					require.Equal(t, tc.followUpFetches, finder.count(shards[i])+fetchesOf(shardClaims[i])-before)
+				}
+				// let prefetching for the next block finish before reading it
+				if tc.followUpFetches == 0 {
+					require.Eventually(t, func() bool { return prefetched(i + 1) }, time.Second, time.Millisecond)
+				}
+			}
+			// every shard location is resolved from the origin at most once
+			for i := range shards {
+				require.LessOrEqual(t, finder.count(shards[i]), 1)
+				require.LessOrEqual(t, fetchesOf(shardClaims[i]), 1)
+			}
+		})
+	}
+}
+
+func TestIndexingService__Diagnose(t *testing.T) {
+	ctx := context.Background()
+	claims := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claim, ok := claims[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		testutil.Must(w.Write(claim))(t)
+	}))
+	defer server.Close()
+	claimsURL := testutil.Must(url.Parse(server.URL + "/claims/{claim}"))(t)
+	provider := &peer.AddrInfo{
+		ID:    testutil.RandomPeer(),
+		Addrs: []multiaddr.Multiaddr{testutil.Must(maurl.FromURL(claimsURL))(t)},
+	}
+	indexResult := func(t *testing.T, served bool) model.ProviderResult {
+		claim := testutil.RandomIndexDelegation()
+		claimCid := claim.Link().(cidlink.Link).Cid
+		if served {
+			claims["/claims/"+claimCid.String()] = testutil.Must(io.ReadAll(claim.Archive()))(t)
+		}
+		md := &metadata.IndexClaimMetadata{Index: testutil.RandomCID().(cidlink.Link).Cid, Claim: claimCid}
+		return model.ProviderResult{ContextID: testutil.RandomBytes(10), Metadata: testutil.Must(md.MarshalBinary())(t), Provider: provider}
+	}
+
+	found, bitswap, unreachable, unknown := testutil.RandomMultihash(), testutil.RandomMultihash(), testutil.RandomMultihash(), testutil.RandomMultihash()
+	bitswapMd := ipnimd.Default.New(ipnimd.Bitswap{})
+	results := map[string][]model.ProviderResult{
+		string(found):       {indexResult(t, true)},
+		string(bitswap):     {{ContextID: testutil.RandomBytes(10), Metadata: testutil.Must(bitswapMd.MarshalBinary())(t), Provider: provider}},
+		string(unreachable): {indexResult(t, false)},
+	}
+	newService := func() *service.IndexingService {
+		providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: results, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		claimLookup := claimlookup.WithCache(claimlookup.NewClaimLookup(http.DefaultClient), newMockClaimStore())
+		return testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimLookup, providerIndex))(t)
+	}
+	encode := func(hash multihash.Multihash) string {
+		return testutil.Must(multibase.Encode(multibase.Base58BTC, hash))(t)
+	}
+	hashes := []multihash.Multihash{found, bitswap, unreachable, unknown}
+
+	qr := testutil.Must(newService().Query(ctx, service.Query{Hashes: hashes, Diagnose: true}))(t)
+	require.Len(t, qr.Claims(), 1)
+	diagnostics := qr.Diagnostics()
+	require.Len(t, diagnostics, 3)
+	require.NotContains(t, diagnostics, encode(found))
+
+	filtered := diagnostics[encode(bitswap)]
+	require.Equal(t, queryresult.OutcomeFiltered, filtered.Outcome)
+	require.Equal(t, []queryresult.LookupDiagnosis{{
+		Hash:    encode(bitswap),
+		JobType: "standard",
+		Source:  string(providerindex.SourceIPNI),
+		Records: 1,
+	}}, filtered.Lookups)
+	require.Empty(t, filtered.Fetches)
+
+	failed := diagnostics[encode(unreachable)]
+	require.Equal(t, queryresult.OutcomeFetchFailed, failed.Outcome)
+	require.Len(t, failed.Lookups, 1)
+	require.Equal(t, 1, failed.Lookups[0].Matches)
+	require.Len(t, failed.Fetches, 1)
+	require.NotEmpty(t, failed.Fetches[0].Error)
+
+	require.Equal(t, queryresult.HashDiagnosis{
+		Outcome: queryresult.OutcomeUnknown,
+		Lookups: []queryresult.LookupDiagnosis{{Hash: encode(unknown), JobType: "standard", Source: string(providerindex.SourceIPNI)}},
+	}, diagnostics[encode(unknown)])
+
+	// a second query reads the records from the cache
+	is := newService()
+	testutil.Must(is.Query(ctx, service.Query{Hashes: []multihash.Multihash{unknown}}))(t)
+	qr = testutil.Must(is.Query(ctx, service.Query{Hashes: []multihash.Multihash{unknown}, Diagnose: true}))(t)
+	require.Equal(t, string(providerindex.SourceCache), qr.Diagnostics()[encode(unknown)].Lookups[0].Source)
+
+	qr = testutil.Must(newService().Query(ctx, service.Query{Hashes: hashes}))(t)
+	require.Nil(t, qr.Diagnostics(), "diagnoses are opt in")
+}
+
+type mockProviderIndex struct {
+	results map[string][]model.ProviderResult
+	seenAt  map[string][]time.Time
+	sources map[string]providerindex.RecordSource
+	marked  []model.ProviderResult
+}
+
+func (m *mockProviderIndex) FindDetailed(ctx context.Context, qk providerindex.QueryKey) (providerindex.FindResult, error) {
+	results := m.results[string(qk.Hash)]
+	return providerindex.FindResult{Results: results, Unfiltered: len(results), SeenAt: m.seenAt[string(qk.Hash)], Source: m.sources[string(qk.Hash)]}, nil
+}
+
+func (m *mockProviderIndex) MarkSeen(ctx context.Context, hash multihash.Multihash, result model.ProviderResult, at time.Time) error {
+	m.marked = append(m.marked, result)
+	return nil
+}
+
+func (m *mockProviderIndex) CacheProviderResult(ctx context.Context, hash multihash.Multihash, result model.ProviderResult, expiration time.Time) error {
+	return nil
+}
+
+func (m *mockProviderIndex) Publish(ctx context.Context, digests []multihash.Multihash, result model.ProviderResult, opts ...providerindex.PublishOption) error {
+	return nil
+}
+
+type mockBlobIndexLookup struct {
+	index blobindex.ShardedDagIndexView
+	cache func()
+	lk    sync.Mutex
+	urls  []string
+}
+
+func (m *mockBlobIndexLookup) Find(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, fetchURL url.URL, rng *metadata.Range) (blobindex.ShardedDagIndexView, error) {
+	m.lk.Lock()
+	m.urls = append(m.urls, fetchURL.String())
+	m.lk.Unlock()
+	if m.index == nil {
+		return nil, types.ErrKeyNotFound
+	}
+	if m.cache != nil {
+		m.cache()
+	}
+	return m.index, nil
+}
+
+type mockProviderStore struct {
+	lk      sync.Mutex
+	results map[string][]model.ProviderResult
+}
+
+func (m *mockProviderStore) Get(ctx context.Context, hash multihash.Multihash) ([]model.ProviderResult, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	results, ok := m.results[string(hash)]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return results, nil
+}
+
+func (m *mockProviderStore) Set(ctx context.Context, hash multihash.Multihash, results []model.ProviderResult, expires bool) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.results[string(hash)] = results
+	return nil
+}
+
+func (m *mockProviderStore) SetExpirable(ctx context.Context, hash multihash.Multihash, expires bool) error {
+	return nil
+}
+
+type countingFinder struct {
+	lk      sync.Mutex
+	results map[string][]model.ProviderResult
+	calls   map[string]int
+}
+
+func (m *countingFinder) count(hash multihash.Multihash) int {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.calls[string(hash)]
+}
+
+func (m *countingFinder) Find(ctx context.Context, hash multihash.Multihash) (*model.FindResponse, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.calls[string(hash)]++
+	results, ok := m.results[string(hash)]
+	if !ok {
+		return &model.FindResponse{}, nil
+	}
+	return &model.FindResponse{
+		MultihashResults: []model.MultihashResult{{Multihash: hash, ProviderResults: results}},
+	}, nil
+}
+
+type mockClaimStore struct {
+	lk     sync.Mutex
+	claims map[cid.Cid]delegation.Delegation
+	sets   int
+}
+
+func newMockClaimStore() *mockClaimStore {
+	return &mockClaimStore{claims: map[cid.Cid]delegation.Delegation{}}
+}
+
+func (m *mockClaimStore) Get(ctx context.Context, claimCid cid.Cid) (delegation.Delegation, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	claim, ok := m.claims[claimCid]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return claim, nil
+}
+
+func (m *mockClaimStore) Set(ctx context.Context, claimCid cid.Cid, claim delegation.Delegation, overwrite bool) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.claims[claimCid] = claim
+	m.sets++
+	return nil
+}
+
+func (m *mockClaimStore) SetExpirable(ctx context.Context, claimCid cid.Cid, expires bool) error {
+	return nil
+}
+
+func TestIndexingService__SpaceFilteredShardLocations(t *testing.T) {
+	ctx := context.Background()
+	f := newClaimFixture(t)
+	space := testutil.Alice.DID()
+	contentHash, indexCid, shardHash := testutil.RandomMultihash(), testutil.RandomCID().(cidlink.Link).Cid, testutil.RandomMultihash()
+	index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 1)
+	index.SetSlice(shardHash, contentHash, blobindex.Position{Offset: 0, Length: 10})
+	archive := testutil.Must(io.ReadAll(testutil.Must(blobindex.Archive(index))(t)))(t)
+	blobs := newCountingServer(t, 0, func(*http.Request) []byte { return archive })
+	scoped := func(hash multihash.Multihash) []byte {
+		return testutil.Must(types.DefaultContextIDCodec.Encode(types.ContextID{Space: &space, Hash: hash}))(t)
+	}
+
+	// the index and its location are published for the space, but the storage
+	// provider publishes the shard location unscoped, and the only location
+	// published for the space is one its provider no longer serves
+	indexClaim := f.newClaim(t)
+	indexLocation := f.addClaim(t, locationsDelegation(t, indexCid.Hash(), blobs.url(t, "/index")))
+	shardLocation := f.addClaim(t, locationsDelegation(t, shardHash, blobs.url(t, "/shard")))
+	retired := testutil.RandomCID().(cidlink.Link).Cid
+	results := map[string][]model.ProviderResult{
+		string(contentHash):     {f.result(t, scoped(contentHash), &metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaim})},
+		string(indexCid.Hash()): {f.result(t, scoped(indexCid.Hash()), &metadata.LocationCommitmentMetadata{Claim: indexLocation})},
+		string(shardHash): {
+			f.result(t, scoped(shardHash), &metadata.LocationCommitmentMetadata{Claim: retired}),
+			f.result(t, shardHash, &metadata.LocationCommitmentMetadata{Claim: shardLocation}),
+		},
+	}
+	query := func(t *testing.T, strict bool) []cid.Cid {
+		providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: results, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		blobIndexLookup := blobindexlookup.WithCache(blobindexlookup.NewBlobIndexLookup(http.DefaultClient), redis.NewShardedDagIndexStore(&memRedis{data: map[string]string{}}), noopCachingQueue{})
+		is := testutil.Must(service.NewIndexingService(blobIndexLookup, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex))(t)
+		qr := testutil.Must(is.Query(ctx, service.Query{
+			Hashes:       []multihash.Multihash{contentHash},
+			Match:        service.Match{Subject: []did.DID{space}},
+			StrictSpaces: strict,
+		}))(t)
+		require.Len(t, qr.Indexes(), 1)
+		var claims []cid.Cid
+		for _, link := range qr.Claims() {
+			claims = append(claims, link.(cidlink.Link).Cid)
+		}
+		return claims
+	}
+
+	require.ElementsMatch(t, []cid.Cid{indexClaim, indexLocation, shardLocation}, query(t, false))
+	// strict deployments only follow records published for the space
+	require.ElementsMatch(t, []cid.Cid{indexClaim, indexLocation}, query(t, true))
+}
@@ -0,0 +1,112 @@
+package shadow
+
+import (
+	"bytes"
+	"slices"
+
+	"github.com/ipfs/go-cid"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// Result is the part of a query result compared between the primary and the
+// secondary
+type Result struct {
+	// Claims are the CIDs of the claims found
+	Claims []cid.Cid
+	// Indexes are the context IDs of the indexes found
+	Indexes []types.EncodedContextID
+}
+
+// ResultOf returns the claims and indexes of a query result
+func ResultOf(qr queryresult.QueryResult) (Result, error) {
+	claims, indexes, err := queryresult.Parts(qr)
+	if err != nil {
+		return Result{}, err
+	}
+	r := Result{
+		Claims:  make([]cid.Cid, 0, len(claims)),
+		Indexes: make([]types.EncodedContextID, 0, indexes.Size()),
+	}
+	for c := range claims {
+		r.Claims = append(r.Claims, c)
+	}
+	for contextID := range indexes.Iterator() {
+		r.Indexes = append(r.Indexes, contextID)
+	}
+	return r, nil
+}
+
+// Diff is how the secondary's result for a query differs from the primary's
+type Diff struct {
+	// MissingClaims are claims found by the primary but not the secondary
+	MissingClaims []cid.Cid
+	// ExtraClaims are claims found by the secondary but not the primary
+	ExtraClaims []cid.Cid
+	// MissingIndexes are context IDs of indexes found by the primary but not the
+	// secondary
+	MissingIndexes []types.EncodedContextID
+	// ExtraIndexes are context IDs of indexes found by the secondary but not the
+	// primary
+	ExtraIndexes []types.EncodedContextID
+}
+
+// Equal returns true if both results found the same claims and indexes
+func (d Diff) Equal() bool {
+	return len(d.MissingClaims) == 0 && len(d.ExtraClaims) == 0 && len(d.MissingIndexes) == 0 && len(d.ExtraIndexes) == 0
+}
+
+// Compare returns how the secondary's result differs from the primary's. Order
+// and duplicates within either result don't matter, and the differences are
+// sorted
+func Compare(primary, secondary Result) Diff {
+	missingClaims, extraClaims := difference(primary.Claims, secondary.Claims, func(c cid.Cid) string { return c.KeyString() })
+	missingIndexes, extraIndexes := difference(primary.Indexes, secondary.Indexes, func(id types.EncodedContextID) string { return string(id) })
+	slices.SortFunc(missingClaims, compareCids)
+	slices.SortFunc(extraClaims, compareCids)
+	slices.SortFunc(missingIndexes, compareContextIDs)
+	slices.SortFunc(extraIndexes, compareContextIDs)
+	return Diff{
+		MissingClaims:  missingClaims,
+		ExtraClaims:    extraClaims,
+		MissingIndexes: missingIndexes,
+		ExtraIndexes:   extraIndexes,
+	}
+}
+
+// difference returns the elements only in a, and those only in b
+func difference[T any](a, b []T, key func(T) string) (onlyA, onlyB []T) {
+	inA := make(map[string]struct{}, len(a))
+	for _, v := range a {
+		inA[key(v)] = struct{}{}
+	}
+	inB := make(map[string]struct{}, len(b))
+	for _, v := range b {
+		k := key(v)
+		if _, ok := inB[k]; ok {
+			continue
+		}
+		inB[k] = struct{}{}
+		if _, ok := inA[k]; !ok {
+			onlyB = append(onlyB, v)
+		}
+	}
+	for _, v := range a {
+		k := key(v)
+		if _, ok := inB[k]; ok {
+			continue
+		}
+		// mark it seen so duplicates are only listed once
+		inB[k] = struct{}{}
+		onlyA = append(onlyA, v)
+	}
+	return onlyA, onlyB
+}
+
+func compareCids(a, b cid.Cid) int {
+	return bytes.Compare(a.Bytes(), b.Bytes())
+}
+
+func compareContextIDs(a, b types.EncodedContextID) int {
+	return bytes.Compare(a, b)
+}
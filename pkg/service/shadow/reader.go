@@ -0,0 +1,167 @@
+package shadow
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+)
+
+// Querier runs shadow reads against the secondary
+type Querier interface {
+	ShadowQuery(ctx context.Context, hashes []multihash.Multihash, spaces []did.DID) (Result, error)
+}
+
+// Reader runs queries against the secondary in the background and compares
+// their results with the primary's. Reads are bounded by the read budget and
+// the number allowed in flight, so whatever the secondary does, the primary only
+// pays for starting them
+type Reader struct {
+	*config
+	secondary Querier
+	inFlight  chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewReader returns a reader comparing results with those of the secondary
+func NewReader(secondary Querier, opts ...Option) *Reader {
+	c := newConfig(opts)
+	return &Reader{
+		config:    c,
+		secondary: secondary,
+		inFlight:  make(chan struct{}, c.maxInFlight),
+	}
+}
+
+// Compare runs the query against the secondary in the background, and compares
+// its result with the primary's (returns immediately). The read is skipped if
+// too many are already in flight
+func (r *Reader) Compare(ctx context.Context, hashes []multihash.Multihash, spaces []did.DID, primary Result) {
+	select {
+	case r.inFlight <- struct{}{}:
+	default:
+		log.Debugw("skipping shadow read, too many in flight")
+		return
+	}
+	// the read outlives the query it shadows, so it is only bound by its budget
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), r.readBudget)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer func() { <-r.inFlight }()
+		defer cancel()
+		secondary, err := r.secondary.ShadowQuery(ctx, hashes, spaces)
+		if err != nil {
+			log.Warnw("shadow read failed", "hashes", len(hashes), "error", err)
+			r.metrics.ReadFailed(err)
+			return
+		}
+		d := Compare(primary, secondary)
+		if !d.Equal() {
+			log.Warnw("shadow read mismatch",
+				"hashes", hashes,
+				"missingClaims", d.MissingClaims,
+				"extraClaims", d.ExtraClaims,
+				"missingIndexes", len(d.MissingIndexes),
+				"extraIndexes", len(d.ExtraIndexes),
+			)
+		}
+		r.metrics.ReadCompared(d)
+	}()
+}
+
+// Shutdown waits for shadow reads in progress to finish, returning early if the
+// passed context cancels
+func (r *Reader) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// continuationHeader is the response header the indexing service returns the
+// token for the rest of a paged result in
+const continuationHeader = "X-Continuation-Token"
+
+// HTTPQuerier runs shadow reads against the claims endpoint of a remote
+// indexing service
+type HTTPQuerier struct {
+	endpoint   string
+	httpClient *http.Client
+}
+
+var _ Querier = (*HTTPQuerier)(nil)
+
+// NewHTTPQuerier returns a querier GETting claims from the given endpoint URL
+func NewHTTPQuerier(endpoint string, httpClient *http.Client) *HTTPQuerier {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &HTTPQuerier{endpoint: endpoint, httpClient: httpClient}
+}
+
+// ShadowQuery queries the remote service, following continuation tokens until
+// the whole result has been read
+func (q *HTTPQuerier) ShadowQuery(ctx context.Context, hashes []multihash.Multihash, spaces []did.DID) (Result, error) {
+	params := url.Values{}
+	for _, hash := range hashes {
+		encoded, err := multibase.Encode(multibase.Base58BTC, hash)
+		if err != nil {
+			return Result{}, err
+		}
+		params.Add("multihash", encoded)
+	}
+	for _, space := range spaces {
+		params.Add("spaces", space.String())
+	}
+	var result Result
+	for {
+		page, token, err := q.get(ctx, params)
+		if err != nil {
+			return Result{}, err
+		}
+		result.Claims = append(result.Claims, page.Claims...)
+		result.Indexes = append(result.Indexes, page.Indexes...)
+		if token == "" {
+			return result, nil
+		}
+		params = url.Values{"continuation": {token}}
+	}
+}
+
+func (q *HTTPQuerier) get(ctx context.Context, params url.Values) (Result, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, q.endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return Result{}, "", err
+	}
+	resp, err := q.httpClient.Do(req)
+	if err != nil {
+		return Result{}, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Result{}, "", fmt.Errorf("failure response querying secondary. status: %s", resp.Status)
+	}
+	qr, err := queryresult.Extract(resp.Body)
+	if err != nil {
+		return Result{}, "", fmt.Errorf("extracting query result: %w", err)
+	}
+	page, err := ResultOf(qr)
+	if err != nil {
+		return Result{}, "", fmt.Errorf("reading query result: %w", err)
+	}
+	return page, resp.Header.Get(continuationHeader), nil
+}
@@ -0,0 +1,115 @@
+// Package shadow runs a secondary indexing service alongside the primary, for
+// validating a migration before cutover. Publish-origin cache writes are copied
+// to the secondary in the background, and a sample of queries is run against it
+// too, with results compared to the primary's. Neither ever fails or holds up
+// the primary: copies that can't be made are dropped, and shadow reads that
+// don't finish within their budget are abandoned
+package shadow
+
+import (
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("shadow")
+
+const (
+	// DefaultQueueSize is the number of writes waiting to be copied beyond which
+	// further writes are dropped
+	DefaultQueueSize = 1024
+	// DefaultWriteTimeout is how long copying a batch of writes may take
+	DefaultWriteTimeout = 5 * time.Second
+	// DefaultReadBudget is how long a shadow read may take
+	DefaultReadBudget = 2 * time.Second
+	// DefaultMaxInFlightReads is the number of shadow reads in progress beyond
+	// which sampled queries are not shadowed
+	DefaultMaxInFlightReads = 16
+
+	// maxBatchSize is the number of queued writes copied together
+	maxBatchSize = 100
+)
+
+// Metrics is told what happens to shadow writes and reads
+type Metrics interface {
+	// WriteDropped is called when a write is not copied because too many are
+	// waiting
+	WriteDropped()
+	// WriteFailed is called when copying a batch of writes fails
+	WriteFailed(err error)
+	// ReadCompared is called with the differences found by a shadow read
+	ReadCompared(d Diff)
+	// ReadFailed is called when a shadow read fails or runs out of budget
+	ReadFailed(err error)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) WriteDropped()     {}
+func (noopMetrics) WriteFailed(error) {}
+func (noopMetrics) ReadCompared(Diff) {}
+func (noopMetrics) ReadFailed(error)  {}
+
+type (
+	// Option configures a Writer or Reader
+	Option func(*config)
+
+	config struct {
+		queueSize    int
+		writeTimeout time.Duration
+		readBudget   time.Duration
+		maxInFlight  int
+		metrics      Metrics
+	}
+)
+
+func newConfig(opts []Option) *config {
+	c := &config{
+		queueSize:    DefaultQueueSize,
+		writeTimeout: DefaultWriteTimeout,
+		readBudget:   DefaultReadBudget,
+		maxInFlight:  DefaultMaxInFlightReads,
+		metrics:      noopMetrics{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithQueueSize sets the number of writes waiting to be copied beyond which
+// further writes are dropped
+func WithQueueSize(size int) Option {
+	return func(c *config) {
+		c.queueSize = size
+	}
+}
+
+// WithWriteTimeout sets how long copying a batch of writes may take
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.writeTimeout = timeout
+	}
+}
+
+// WithReadBudget sets how long a shadow read may take before it is abandoned
+func WithReadBudget(budget time.Duration) Option {
+	return func(c *config) {
+		c.readBudget = budget
+	}
+}
+
+// WithMaxInFlightReads sets the number of shadow reads in progress beyond which
+// sampled queries are not shadowed
+func WithMaxInFlightReads(n int) Option {
+	return func(c *config) {
+		c.maxInFlight = n
+	}
+}
+
+// WithMetrics sets the metrics told about shadow writes and reads
+func WithMetrics(m Metrics) Option {
+	return func(c *config) {
+		c.metrics = m
+	}
+}
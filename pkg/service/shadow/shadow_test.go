@@ -0,0 +1,275 @@
+package shadow_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service/replication"
+	"github.com/storacha/indexing-service/pkg/service/shadow"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+type mockSink struct {
+	lk      sync.Mutex
+	hang    bool
+	failing bool
+	// hanging is the number of calls hanging until they are cancelled
+	hanging int
+	batches []replication.Batch
+}
+
+func (m *mockSink) ID() string { return "mock" }
+
+func (m *mockSink) Replicate(ctx context.Context, batch replication.Batch) error {
+	m.lk.Lock()
+	hang, failing := m.hang, m.failing
+	if hang {
+		m.hanging++
+	}
+	m.lk.Unlock()
+	if hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if failing {
+		return errors.New("secondary unavailable")
+	}
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.batches = append(m.batches, batch)
+	return nil
+}
+
+func (m *mockSink) writes() int {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	n := 0
+	for _, b := range m.batches {
+		n += b.Size()
+	}
+	return n
+}
+
+type mockMetrics struct {
+	lk       sync.Mutex
+	dropped  int
+	failed   int
+	compared []shadow.Diff
+	readErrs []error
+}
+
+func (m *mockMetrics) WriteDropped() {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.dropped++
+}
+
+func (m *mockMetrics) WriteFailed(err error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.failed++
+}
+
+func (m *mockMetrics) ReadCompared(d shadow.Diff) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.compared = append(m.compared, d)
+}
+
+func (m *mockMetrics) ReadFailed(err error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.readErrs = append(m.readErrs, err)
+}
+
+func (m *mockMetrics) counts() (dropped, failed int) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.dropped, m.failed
+}
+
+func TestWriter(t *testing.T) {
+	write := func(w *shadow.Writer) {
+		w.ReplicateProviders(testutil.RandomMultihash(), []model.ProviderResult{testutil.RandomProviderResult()})
+		w.ReplicateClaim(testutil.RandomLocationDelegation())
+	}
+
+	t.Run("copies writes", func(t *testing.T) {
+		defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+		sink := &mockSink{}
+		w := shadow.NewWriter("primary", sink)
+		w.Startup()
+		for range 5 {
+			write(w)
+		}
+		require.Eventually(t, func() bool { return sink.writes() == 10 }, time.Second, time.Millisecond)
+		require.NoError(t, w.Shutdown(context.Background()))
+		for _, b := range sink.batches {
+			require.Equal(t, "primary", b.Origin)
+		}
+	})
+
+	t.Run("fire and forget when the secondary fails", func(t *testing.T) {
+		defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+		sink := &mockSink{failing: true}
+		metrics := &mockMetrics{}
+		w := shadow.NewWriter("primary", sink, shadow.WithMetrics(metrics))
+		w.Startup()
+		write(w)
+		require.Eventually(t, func() bool { _, failed := metrics.counts(); return failed > 0 }, time.Second, time.Millisecond)
+		require.NoError(t, w.Shutdown(context.Background()))
+		require.Zero(t, sink.writes())
+	})
+
+	t.Run("fire and forget when the secondary hangs", func(t *testing.T) {
+		defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+		sink := &mockSink{hang: true}
+		metrics := &mockMetrics{}
+		w := shadow.NewWriter("primary", sink, shadow.WithQueueSize(2), shadow.WithWriteTimeout(time.Hour), shadow.WithMetrics(metrics))
+		w.Startup()
+		write(w)
+		require.Eventually(t, func() bool { sink.lk.Lock(); defer sink.lk.Unlock(); return sink.hanging == 1 }, time.Second, time.Millisecond)
+		dropped, _ := metrics.counts()
+		start := time.Now()
+		for range 10 {
+			write(w)
+		}
+		// writes are dropped rather than waiting for the queue to drain
+		require.Less(t, time.Since(start), 100*time.Millisecond)
+		newlyDropped, _ := metrics.counts()
+		require.GreaterOrEqual(t, newlyDropped-dropped, 20-2)
+		// shutting down doesn't wait for the secondary either
+		require.NoError(t, w.Shutdown(context.Background()))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+		sink := &mockSink{}
+		metrics := &mockMetrics{}
+		w := shadow.NewWriter("primary", sink, shadow.WithQueueSize(1), shadow.WithMetrics(metrics))
+		w.SetEnabled(false)
+		require.False(t, w.Enabled())
+		for range 5 {
+			write(w)
+		}
+		dropped, _ := metrics.counts()
+		require.Zero(t, dropped)
+		w.Startup()
+		require.NoError(t, w.Shutdown(context.Background()))
+		require.Zero(t, sink.writes())
+	})
+}
+
+func TestCompare(t *testing.T) {
+	claims := []cid.Cid{randomCid(), randomCid(), randomCid()}
+	indexes := []types.EncodedContextID{testutil.RandomBytes(10), testutil.RandomBytes(10), testutil.RandomBytes(10)}
+	testCases := []struct {
+		name      string
+		primary   shadow.Result
+		secondary shadow.Result
+		expected  shadow.Diff
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:      "equal",
+			primary:   shadow.Result{Claims: claims, Indexes: indexes},
+			secondary: shadow.Result{Claims: []cid.Cid{claims[2], claims[0], claims[1], claims[0]}, Indexes: []types.EncodedContextID{indexes[1], indexes[2], indexes[0]}},
+		},
+		{
+			name:      "missing",
+			primary:   shadow.Result{Claims: claims, Indexes: indexes},
+			secondary: shadow.Result{Claims: claims[:1], Indexes: indexes[1:]},
+			expected:  shadow.Diff{MissingClaims: sorted(claims[1:]...), MissingIndexes: indexes[:1]},
+		},
+		{
+			name:      "extra",
+			primary:   shadow.Result{Claims: claims[:1], Indexes: indexes[:2]},
+			secondary: shadow.Result{Claims: append(claims, claims[2]), Indexes: indexes},
+			expected:  shadow.Diff{ExtraClaims: sorted(claims[1:]...), ExtraIndexes: indexes[2:]},
+		},
+		{
+			name:      "missing and extra",
+			primary:   shadow.Result{Claims: claims[:2], Indexes: indexes[:1]},
+			secondary: shadow.Result{Claims: claims[1:], Indexes: indexes[1:2]},
+			expected:  shadow.Diff{MissingClaims: claims[:1], ExtraClaims: claims[2:], MissingIndexes: indexes[:1], ExtraIndexes: indexes[1:2]},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := shadow.Compare(tc.primary, tc.secondary)
+			require.Equal(t, tc.expected, d)
+			require.Equal(t, tc.expected.Equal(), d.Equal())
+		})
+	}
+	require.True(t, shadow.Compare(shadow.Result{Claims: claims}, shadow.Result{Claims: claims}).Equal())
+	require.False(t, shadow.Compare(shadow.Result{Claims: claims}, shadow.Result{}).Equal())
+}
+
+type querierFunc func(ctx context.Context, hashes []multihash.Multihash, spaces []did.DID) (shadow.Result, error)
+
+func (f querierFunc) ShadowQuery(ctx context.Context, hashes []multihash.Multihash, spaces []did.DID) (shadow.Result, error) {
+	return f(ctx, hashes, spaces)
+}
+
+func TestReader(t *testing.T) {
+	claims := []cid.Cid{randomCid(), randomCid()}
+	hashes := testutil.RandomMultihashes(1)
+
+	t.Run("compares results", func(t *testing.T) {
+		defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+		metrics := &mockMetrics{}
+		r := shadow.NewReader(querierFunc(func(ctx context.Context, hs []multihash.Multihash, spaces []did.DID) (shadow.Result, error) {
+			require.Equal(t, hashes, hs)
+			return shadow.Result{Claims: claims[:1]}, nil
+		}), shadow.WithMetrics(metrics))
+		r.Compare(context.Background(), hashes, nil, shadow.Result{Claims: claims})
+		require.NoError(t, r.Shutdown(context.Background()))
+		require.Equal(t, []shadow.Diff{{MissingClaims: claims[1:]}}, metrics.compared)
+	})
+
+	t.Run("abandons reads over budget", func(t *testing.T) {
+		defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+		metrics := &mockMetrics{}
+		r := shadow.NewReader(querierFunc(func(ctx context.Context, hs []multihash.Multihash, spaces []did.DID) (shadow.Result, error) {
+			<-ctx.Done()
+			return shadow.Result{}, ctx.Err()
+		}), shadow.WithReadBudget(100*time.Millisecond), shadow.WithMaxInFlightReads(1), shadow.WithMetrics(metrics))
+		// the read isn't cancelled along with the query it shadows
+		ctx, cancel := context.WithCancel(context.Background())
+		start := time.Now()
+		r.Compare(ctx, hashes, nil, shadow.Result{Claims: claims})
+		cancel()
+		// reads beyond the in flight limit are skipped
+		r.Compare(context.Background(), hashes, nil, shadow.Result{Claims: claims})
+		require.Less(t, time.Since(start), 50*time.Millisecond)
+		require.NoError(t, r.Shutdown(context.Background()))
+		require.Len(t, metrics.readErrs, 1)
+		require.ErrorIs(t, metrics.readErrs[0], context.DeadlineExceeded)
+		require.Empty(t, metrics.compared)
+	})
+}
+
+func randomCid() cid.Cid {
+	return testutil.RandomCID().(cidlink.Link).Cid
+}
+
+func sorted(cids ...cid.Cid) []cid.Cid {
+	cids = slices.Clone(cids)
+	slices.SortFunc(cids, func(a, b cid.Cid) int { return bytes.Compare(a.Bytes(), b.Bytes()) })
+	return cids
+}
@@ -0,0 +1,128 @@
+package shadow
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/indexing-service/pkg/service/replication"
+)
+
+// Writer copies publish-origin cache writes to a secondary, in the background.
+// Writes are queued in memory and dropped if the queue is full or copying them
+// fails, so the secondary can never slow down or fail a publish
+type Writer struct {
+	*config
+	origin  string
+	sink    replication.Sink
+	enabled atomic.Bool
+	queue   chan func(*replication.Batch)
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+// NewWriter returns a writer copying writes made in the region named origin to
+// the sink, which may be the replication endpoint of a remote service or the
+// stores of a secondary deployment. Writes are copied once the writer is
+// started, and until it is disabled
+func NewWriter(origin string, sink replication.Sink, opts ...Option) *Writer {
+	c := newConfig(opts)
+	w := &Writer{
+		config:  c,
+		origin:  origin,
+		sink:    sink,
+		queue:   make(chan func(*replication.Batch), c.queueSize),
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	w.enabled.Store(true)
+	return w
+}
+
+// SetEnabled starts or stops copying writes. Writes made while disabled are
+// never copied
+func (w *Writer) SetEnabled(enabled bool) {
+	w.enabled.Store(enabled)
+}
+
+// Enabled returns true if writes are being copied
+func (w *Writer) Enabled() bool {
+	return w.enabled.Load()
+}
+
+// ReplicateProviders queues provider results published for a hash to be copied
+func (w *Writer) ReplicateProviders(hash multihash.Multihash, results []model.ProviderResult) {
+	w.add(func(b *replication.Batch) {
+		b.Providers = append(b.Providers, replication.ProviderWrite{Hash: hash, Results: results})
+	})
+}
+
+// ReplicateClaim queues a published or cached claim to be copied
+func (w *Writer) ReplicateClaim(claim delegation.Delegation) {
+	w.add(func(b *replication.Batch) {
+		b.Claims = append(b.Claims, claim)
+	})
+}
+
+func (w *Writer) add(write func(*replication.Batch)) {
+	if !w.enabled.Load() {
+		return
+	}
+	select {
+	case w.queue <- write:
+	default:
+		w.metrics.WriteDropped()
+	}
+}
+
+// Startup starts copying writes in the background (returns immediately)
+func (w *Writer) Startup() {
+	go w.run()
+}
+
+// Shutdown stops copying, returning when the writer stops or the passed context
+// cancels. Writes still queued are dropped
+func (w *Writer) Shutdown(ctx context.Context) error {
+	close(w.closing)
+	select {
+	case <-w.closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *Writer) run() {
+	defer close(w.closed)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-w.closing
+		cancel()
+	}()
+	for {
+		select {
+		case <-w.closing:
+			return
+		case write := <-w.queue:
+			batch := replication.Batch{Origin: w.origin}
+			write(&batch)
+			// writes queued meanwhile are copied along with the first
+			for batch.Size() < maxBatchSize && len(w.queue) > 0 {
+				(<-w.queue)(&batch)
+			}
+			w.send(ctx, batch)
+		}
+	}
+}
+
+func (w *Writer) send(ctx context.Context, batch replication.Batch) {
+	ctx, cancel := context.WithTimeout(ctx, w.writeTimeout)
+	defer cancel()
+	if err := w.sink.Replicate(ctx, batch); err != nil {
+		log.Warnw("copying writes to secondary", "sink", w.sink.ID(), "writes", batch.Size(), "error", err)
+		w.metrics.WriteFailed(err)
+	}
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"math/rand"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/indexing-service/pkg/service/shadow"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// WithShadowWriter copies the claims published or cached through the service to
+// the secondary of the writer, which is stopped and started with the
+// DisableShadowWrites setting. Provider results are copied by a provider index
+// the writer is set as a replicator of
+func WithShadowWriter(w *shadow.Writer) Option {
+	return func(is *IndexingService) {
+		is.shadowWriter = w
+	}
+}
+
+// WithShadowReader compares the results of a sample of queries with those the
+// secondary of the reader returns. The share of queries sampled is set by the
+// ShadowReadRate setting
+func WithShadowReader(r *shadow.Reader) Option {
+	return func(is *IndexingService) {
+		is.shadowReader = r
+	}
+}
+
+// WithShadowReadRate sets the share of queries, from 0 to 1, compared with the
+// secondary of the shadow reader
+func WithShadowReadRate(rate float64) Option {
+	return func(is *IndexingService) {
+		is.initialConfig.ShadowReadRate = rate
+	}
+}
+
+// ShadowWriter returns the writer copying writes to a secondary, or nil if
+// writes are not copied
+func (is *IndexingService) ShadowWriter() *shadow.Writer {
+	return is.shadowWriter
+}
+
+// ShadowReader returns the reader comparing query results with a secondary, or
+// nil if queries are not shadowed
+func (is *IndexingService) ShadowReader() *shadow.Reader {
+	return is.shadowReader
+}
+
+// ShadowQuery runs a query for the hashes matching the spaces, so that a service
+// in the same process can be the secondary of a shadow reader
+func (is *IndexingService) ShadowQuery(ctx context.Context, hashes []multihash.Multihash, spaces []did.DID) (shadow.Result, error) {
+	qr, err := is.query(ctx, Query{Hashes: hashes, Match: Match{Subject: spaces}})
+	if err != nil {
+		return shadow.Result{}, err
+	}
+	return shadowResult(qr), nil
+}
+
+func (is *IndexingService) applyShadowConfig(cfg *runtimeConfig) {
+	if is.shadowWriter != nil {
+		is.shadowWriter.SetEnabled(!cfg.DisableShadowWrites)
+	}
+}
+
+// shadowClaim copies a claim written through the service to the secondary
+func (is *IndexingService) shadowClaim(claim delegation.Delegation) {
+	if is.shadowWriter != nil {
+		is.shadowWriter.ReplicateClaim(claim)
+	}
+}
+
+// shadowRead starts a shadow read of a sample of the queries the secondary can
+// be asked the same question of. Queries with options the secondary isn't sent,
+// and cache only queries, would never find the same results, so they aren't
+// sampled
+func (is *IndexingService) shadowRead(ctx context.Context, cfg *runtimeConfig, q Query, qr *queryResult) {
+	if is.shadowReader == nil || cfg.ShadowReadRate <= 0 || rand.Float64() >= cfg.ShadowReadRate {
+		return
+	}
+	if len(q.KnownClaims) > 0 || len(q.KnownIndexes) > 0 || q.MaxProviderAge != 0 || q.IncludeSuperseded || q.CanonicalizeAliases || q.FirstLocationWins || q.MaxResultsPerHash > 0 || types.IsCacheOnly(ctx) {
+		return
+	}
+	is.shadowReader.Compare(ctx, q.Hashes, q.Match.Subject, shadowResult(qr))
+}
+
+func shadowResult(qr *queryResult) shadow.Result {
+	r := shadow.Result{
+		Claims:  make([]cid.Cid, 0, len(qr.Claims)),
+		Indexes: make([]types.EncodedContextID, 0, qr.Indexes.Size()),
+	}
+	for c := range qr.Claims {
+		r.Claims = append(r.Claims, c)
+	}
+	for contextID := range qr.Indexes.Iterator() {
+		r.Indexes = append(r.Indexes, contextID)
+	}
+	return r
+}
@@ -0,0 +1,144 @@
+package service_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/service/replication"
+	"github.com/storacha/indexing-service/pkg/service/shadow"
+	"github.com/stretchr/testify/require"
+)
+
+type shadowMetrics struct {
+	lk       sync.Mutex
+	compared []shadow.Diff
+}
+
+func (m *shadowMetrics) WriteDropped()     {}
+func (m *shadowMetrics) WriteFailed(error) {}
+func (m *shadowMetrics) ReadFailed(error)  {}
+func (m *shadowMetrics) ReadCompared(d shadow.Diff) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.compared = append(m.compared, d)
+}
+
+func (m *shadowMetrics) diffs() []shadow.Diff {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.compared
+}
+
+func TestIndexingService__Shadow(t *testing.T) {
+	ctx := context.Background()
+	f := newClaimFixture(t)
+
+	// the secondary is a service with stores of its own
+	providersB, claimsB := &mockProviderStore{results: map[string][]model.ProviderResult{}}, newMockClaimStore()
+	isB := testutil.Must(service.NewIndexingService(
+		&mockBlobIndexLookup{},
+		claimlookup.WithCache(claimlookup.NewClaimLookup(http.DefaultClient), claimsB),
+		providerindex.NewProviderIndex(providersB, &countingFinder{results: map[string][]model.ProviderResult{}, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil),
+	))(t)
+
+	// the primary copies its publishes to the secondary's stores, and compares
+	// every query with it
+	metrics := &shadowMetrics{}
+	writer := shadow.NewWriter("primary", replication.NewStoreSink("secondary", providersB, claimsB))
+	writer.Startup()
+	defer writer.Shutdown(ctx)
+	reader := shadow.NewReader(isB, shadow.WithMetrics(metrics))
+	providerIndexA := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: map[string][]model.ProviderResult{}, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil, providerindex.WithReplicator(writer))
+	isA := testutil.Must(service.NewIndexingService(
+		&mockBlobIndexLookup{},
+		claimlookup.WithCache(claimlookup.NewClaimLookup(http.DefaultClient), newMockClaimStore()),
+		providerIndexA,
+		service.WithShadowWriter(writer),
+		service.WithShadowReader(reader),
+		service.WithShadowReadRate(1),
+	))(t)
+
+	publish := func(t *testing.T) (multihash.Multihash, cid.Cid) {
+		hash := testutil.RandomMultihash()
+		claimCid := f.newClaim(t)
+		result := f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: claimCid})
+		require.NoError(t, providerIndexA.Publish(ctx, []multihash.Multihash{hash}, result))
+		return hash, claimCid
+	}
+	copied := func(hash multihash.Multihash) bool {
+		_, err := providersB.Get(ctx, hash)
+		return err == nil
+	}
+
+	copiedHash, copiedClaim := publish(t)
+	require.Eventually(t, func() bool { return copied(copiedHash) }, time.Second, time.Millisecond)
+
+	// writes made while shadow writes are disabled are never copied
+	cfg := isA.Config()
+	cfg.DisableShadowWrites = true
+	require.NoError(t, isA.Reconfigure(cfg))
+	uncopiedHash, uncopiedClaim := publish(t)
+	cfg.DisableShadowWrites = false
+	require.NoError(t, isA.Reconfigure(cfg))
+	laterHash, _ := publish(t)
+	require.Eventually(t, func() bool { return copied(laterHash) }, time.Second, time.Millisecond)
+	require.False(t, copied(uncopiedHash))
+
+	claims, _ := queriedClaims(t, isA, copiedHash)
+	require.Equal(t, []cid.Cid{copiedClaim}, claims)
+	claims, _ = queriedClaims(t, isA, uncopiedHash)
+	require.Equal(t, []cid.Cid{uncopiedClaim}, claims)
+	require.NoError(t, reader.Shutdown(ctx))
+	require.ElementsMatch(t, []shadow.Diff{{}, {MissingClaims: []cid.Cid{uncopiedClaim}}}, metrics.diffs())
+
+	// no queries are compared while shadow reads are disabled
+	cfg.ShadowReadRate = 0
+	require.NoError(t, isA.Reconfigure(cfg))
+	queriedClaims(t, isA, copiedHash)
+	require.NoError(t, reader.Shutdown(ctx))
+	require.Len(t, metrics.diffs(), 2)
+
+	cfg.ShadowReadRate = 1.5
+	require.Error(t, isA.Reconfigure(cfg))
+}
+
+func TestIndexingService__ShadowPublishedClaims(t *testing.T) {
+	ctx := context.Background()
+	f := newPublishFixture(t)
+	providersB, claimsB := &mockProviderStore{results: map[string][]model.ProviderResult{}}, newMockClaimStore()
+	writer := shadow.NewWriter("primary", replication.NewStoreSink("secondary", providersB, claimsB))
+	writer.Startup()
+	defer writer.Shutdown(ctx)
+	providerIndex := providerindex.NewProviderIndex(f.store, &countingFinder{results: map[string][]model.ProviderResult{}, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil, providerindex.WithReplicator(writer))
+	is := testutil.Must(service.NewIndexingService(f.indexes, claimlookup.WithCache(claimlookup.NewClaimLookup(&http.Client{Transport: failingTransport{}}), f.claims), providerIndex,
+		service.WithClaimProvider(f.provider),
+		service.WithShadowWriter(writer),
+	))(t)
+
+	// the records and the claim published are both copied to the secondary
+	claim := testutil.RandomLocationDelegation()
+	require.NoError(t, is.PublishClaim(ctx, claim))
+	require.Eventually(t, func() bool {
+		_, err := providersB.Get(ctx, parseLocation(t, claim))
+		if err != nil {
+			return false
+		}
+		_, err = claimsB.Get(ctx, asCid(claim))
+		return err == nil
+	}, time.Second, time.Millisecond)
+	results := testutil.Must(providersB.Get(ctx, parseLocation(t, claim)))(t)
+	require.Len(t, results, 1)
+	require.Equal(t, f.provider.ID, results[0].Provider.ID)
+}
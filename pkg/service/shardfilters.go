@@ -0,0 +1,60 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// WithShardFilters finds the shards of large indexes containing a multihash
+// using the shard filters cached alongside them, rather than searching every
+// shard. Indexes without current filters are searched in full
+func WithShardFilters(store types.ShardFilterStore) Option {
+	return func(is *IndexingService) {
+		is.shardFilters = store
+	}
+}
+
+// containingShards returns the shards of the index that contain the multihash
+func (is *IndexingService) containingShards(ctx context.Context, contextID types.EncodedContextID, index blobindex.ShardedDagIndexView, hash multihash.Multihash) []multihash.Multihash {
+	var containing []multihash.Multihash
+	if filters := is.indexShardFilters(ctx, contextID, index); filters != nil {
+		// filters may report shards that don't contain the hash, but never miss one
+		for _, shard := range filters.MayContain(hash) {
+			if slices := index.Shards().Get(shard); slices != nil && slices.Has(hash) {
+				containing = append(containing, shard)
+			}
+		}
+		return containing
+	}
+	for shard, slices := range index.Shards().Iterator() {
+		if slices.Has(hash) {
+			containing = append(containing, shard)
+		}
+	}
+	return containing
+}
+
+// indexShardFilters returns the shard filters cached for the index, or nil if
+// the index is too small to have them or they were built for another version
+// of it
+func (is *IndexingService) indexShardFilters(ctx context.Context, contextID types.EncodedContextID, index blobindex.ShardedDagIndexView) *blobindex.ShardFilters {
+	if is.shardFilters == nil || blobindex.SliceCount(index) < blobindex.ShardFilterMinSlices {
+		return nil
+	}
+	filters, err := is.shardFilters.Get(ctx, contextID)
+	if err != nil {
+		if !errors.Is(err, types.ErrKeyNotFound) {
+			log.Warnw("reading shard filters", "error", err)
+		}
+		return nil
+	}
+	if err := filters.Check(index); err != nil {
+		log.Debugw("ignoring shard filters", "error", err)
+		return nil
+	}
+	return filters
+}
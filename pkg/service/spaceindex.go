@@ -0,0 +1,195 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/go-ucanto/validator"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service/claimevents"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// ErrSpaceIndexDisabled is returned from ListClaims and BackfillSpaceIndex when
+// the service has no space index
+var ErrSpaceIndexDisabled = errors.New("space index is not enabled")
+
+// WithSpaceIndex records the claims bound to each space as they are published or
+// cached, so that every claim for a space can be listed
+func WithSpaceIndex(store types.SpaceIndexStore) Option {
+	return func(is *IndexingService) {
+		if store == nil {
+			is.spaceIndex = nil
+			return
+		}
+		is.spaceIndex = newSwappableSpaceIndex(store)
+	}
+}
+
+// ListClaims returns up to limit of the unexpired claims bound to the space,
+// following the cursor returned with the previous page. An empty cursor starts
+// from the first page, and an empty next cursor means there are no more claims
+func (is *IndexingService) ListClaims(ctx context.Context, space did.DID, cursor string, limit int) ([]types.SpaceClaim, string, error) {
+	if is.spaceIndex == nil {
+		return nil, "", ErrSpaceIndexDisabled
+	}
+	return is.spaceIndex.List(ctx, space, cursor, limit)
+}
+
+// BackfillSpaceIndex indexes the claims in every advertisement of the service's
+// advertisement chain, fetching each claim from the provider that published it.
+// Claims that can't be fetched are logged and skipped. It returns the number of
+// claims that were indexed
+func (is *IndexingService) BackfillSpaceIndex(ctx context.Context) (int, error) {
+	if is.spaceIndex == nil {
+		return 0, ErrSpaceIndexDisabled
+	}
+	if is.publisher == nil {
+		return 0, errors.New("no advertisement chain to backfill from")
+	}
+	var indexed int
+	err := is.chainClaims(ctx, func(claim delegation.Delegation, err error) error {
+		if err != nil {
+			log.Warnw("fetching claim to backfill", "error", err)
+			return nil
+		}
+		if is.indexSpaceClaim(ctx, claim) {
+			indexed++
+		}
+		return nil
+	})
+	return indexed, err
+}
+
+// chainClaims calls fn with each claim in the advertisements of the service's
+// advertisement chain, newest first, fetching each claim from the provider that
+// published it, or with the error fetching it failed with. Walking the chain
+// stops at the first error fn returns
+func (is *IndexingService) chainClaims(ctx context.Context, fn func(delegation.Delegation, error) error) error {
+	for adv, err := range is.publisher.Advertisements(ctx) {
+		if err != nil {
+			return fmt.Errorf("walking advertisement chain: %w", err)
+		}
+		if adv.IsRm {
+			continue
+		}
+		provider, err := advertProvider(adv.Provider, adv.Addresses)
+		if err != nil {
+			log.Warnw("skipping advertisement with invalid provider", "provider", adv.Provider, "error", err)
+			continue
+		}
+		md := is.metadataContext.New()
+		if err := md.UnmarshalBinary(adv.Metadata); err != nil {
+			log.Warnw("skipping advertisement with invalid metadata", "provider", adv.Provider, "error", err)
+			continue
+		}
+		for _, code := range md.Protocols() {
+			hasClaim, ok := md.Get(code).(metadata.HasClaim)
+			if !ok {
+				continue
+			}
+			claimCid := hasClaim.GetClaim()
+			url, err := is.fetchClaimURL(ctx, provider, claimCid)
+			if err != nil {
+				if err := fn(nil, fmt.Errorf("provider %s has no claim endpoint for %s: %w", provider.ID, claimCid, err)); err != nil {
+					return err
+				}
+				continue
+			}
+			claim, err := is.claimLookup.LookupClaim(ctx, claimCid, *url)
+			if err != nil {
+				err = fmt.Errorf("fetching claim %s: %w", claimCid, err)
+			}
+			if err := fn(claim, err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func advertProvider(id string, addrs []string) (peer.AddrInfo, error) {
+	pid, err := peer.Decode(id)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	provider := peer.AddrInfo{ID: pid}
+	for _, a := range addrs {
+		addr, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			return peer.AddrInfo{}, err
+		}
+		provider.Addrs = append(provider.Addrs, addr)
+	}
+	return provider, nil
+}
+
+// indexSpaceClaim records the claim under the space it is bound to, if there is
+// a space index and the claim names a space. Failures are logged rather than
+// returned, since the claim has already been published. It returns true if the
+// claim was recorded
+func (is *IndexingService) indexSpaceClaim(ctx context.Context, claim delegation.Delegation) bool {
+	if is.spaceIndex == nil {
+		return false
+	}
+	space, sc, ok := parseSpaceClaim(claim)
+	if !ok {
+		return false
+	}
+	if err := is.spaceIndex.Add(ctx, space, sc); err != nil {
+		log.Errorw("recording claim in space index", "claim", sc.Claim, "space", space, "error", err)
+		return false
+	}
+	return true
+}
+
+// parseSpaceClaim reads the space a claim is bound to and the hash of the
+// content it is about from its first capability. It returns false for claims
+// that don't name a space or aren't about content
+func parseSpaceClaim(claim delegation.Delegation) (did.DID, types.SpaceClaim, bool) {
+	evt := claimevents.NewClaimEvent(claim)
+	if evt.Space == nil {
+		return did.DID{}, types.SpaceClaim{}, false
+	}
+	sc := types.SpaceClaim{Claim: evt.Claim, Type: evt.Type}
+	capability := claim.Capabilities()[0]
+	source := validator.NewSource(capability, claim)
+	switch capability.Can() {
+	case assert.LocationAbility:
+		match, fail := assert.Location.Match(source)
+		if fail != nil {
+			return did.DID{}, types.SpaceClaim{}, false
+		}
+		sc.Hash = match.Value().Nb().Content.Hash()
+	case assert.IndexAbility:
+		match, fail := assert.Index.Match(source)
+		if fail != nil {
+			return did.DID{}, types.SpaceClaim{}, false
+		}
+		content, err := cid.Parse(match.Value().Nb().Content.String())
+		if err != nil {
+			return did.DID{}, types.SpaceClaim{}, false
+		}
+		sc.Hash = content.Hash()
+	case assert.EqualsAbility:
+		match, fail := assert.Equals.Match(source)
+		if fail != nil {
+			return did.DID{}, types.SpaceClaim{}, false
+		}
+		sc.Hash = match.Value().Nb().Content.Hash()
+	default:
+		return did.DID{}, types.SpaceClaim{}, false
+	}
+	if exp := claim.Expiration(); exp != nil {
+		sc.Expiration = time.Unix(int64(*exp), 0)
+	}
+	return *evt.Space, sc, true
+}
@@ -0,0 +1,120 @@
+package service_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/did"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/publisher"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+type mockSpaceIndex struct {
+	lk     sync.Mutex
+	claims map[did.DID][]types.SpaceClaim
+}
+
+func (m *mockSpaceIndex) Add(ctx context.Context, space did.DID, claim types.SpaceClaim) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.claims[space] = append(m.claims[space], claim)
+	return nil
+}
+
+func (m *mockSpaceIndex) List(ctx context.Context, space did.DID, cursor string, limit int) ([]types.SpaceClaim, string, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.claims[space], "", nil
+}
+
+func (m *mockSpaceIndex) Prune(ctx context.Context, space did.DID, now time.Time) (int, error) {
+	return 0, nil
+}
+
+func TestIndexingService__BackfillSpaceIndex(t *testing.T) {
+	ctx := context.Background()
+	f := newClaimFixture(t)
+	key, _ := testutil.Must2(crypto.GenerateEd25519Key(nil))(t)
+	adverts := publisher.New(dssync.MutexWrap(datastore.NewMapDatastore()), key)
+	publish := func(t *testing.T, md interface{ MarshalBinary() ([]byte, error) }) {
+		data := testutil.Must(md.MarshalBinary())(t)
+		testutil.Must(adverts.Publish(ctx, *f.provider, testutil.RandomBytes(10), data, testutil.RandomMultihashes(2)))(t)
+	}
+
+	// an index claim for a space, a location claim for the provider, and a claim
+	// the provider can't serve
+	space := testutil.Alice.DID()
+	content := testutil.RandomCID()
+	expiration := int(time.Now().Add(time.Hour).Unix())
+	indexClaim := testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.IndexCaveats]{
+		assert.Index.New(space.String(), assert.IndexCaveats{Content: content, Index: testutil.RandomCID()}),
+	}, delegation.WithExpiration(expiration)))(t)
+	indexCid := f.addClaim(t, indexClaim)
+	publish(t, &metadata.IndexClaimMetadata{Index: testutil.RandomCID().(cidlink.Link).Cid, Claim: indexCid})
+	locationCid := f.newClaim(t)
+	publish(t, &metadata.LocationCommitmentMetadata{Claim: locationCid})
+	publish(t, &metadata.LocationCommitmentMetadata{Claim: testutil.RandomCID().(cidlink.Link).Cid})
+
+	index := &mockSpaceIndex{claims: map[did.DID][]types.SpaceClaim{}}
+	is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), nil,
+		service.WithPublisher(adverts),
+		service.WithSpaceIndex(index)))(t)
+	indexed, err := is.BackfillSpaceIndex(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, indexed)
+
+	claims, _ := testutil.Must2(is.ListClaims(ctx, space, "", 10))(t)
+	require.Equal(t, []types.SpaceClaim{{
+		Claim:      indexCid,
+		Type:       assert.IndexAbility,
+		Hash:       content.(cidlink.Link).Cid.Hash(),
+		Expiration: time.Unix(int64(expiration), 0),
+	}}, claims)
+	claims, _ = testutil.Must2(is.ListClaims(ctx, testutil.Service.DID(), "", 10))(t)
+	require.Equal(t, []cid.Cid{locationCid}, []cid.Cid{claims[0].Claim})
+	require.Equal(t, assert.LocationAbility, claims[0].Type)
+
+	disabled := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), nil))(t)
+	_, _, err = disabled.ListClaims(ctx, space, "", 10)
+	require.ErrorIs(t, err, service.ErrSpaceIndexDisabled)
+	_, err = disabled.BackfillSpaceIndex(ctx)
+	require.ErrorIs(t, err, service.ErrSpaceIndexDisabled)
+}
+
+func TestIndexingService__IndexSpaceClaims(t *testing.T) {
+	ctx := context.Background()
+	f := newPublishFixture(t)
+	index := &mockSpaceIndex{claims: map[did.DID][]types.SpaceClaim{}}
+	is := f.service(t, service.WithSpaceIndex(index))
+
+	published := testutil.RandomLocationDelegation()
+	cached := testutil.RandomLocationDelegation()
+	require.NoError(t, is.PublishClaim(ctx, published))
+	require.NoError(t, is.CacheClaim(ctx, cached))
+	// claims that fail to publish aren't listed
+	require.Error(t, is.PublishClaim(ctx, indexDelegation(t, testutil.RandomCID().(cidlink.Link).Cid, testutil.RandomCID().(cidlink.Link).Cid)))
+
+	claims, _ := testutil.Must2(is.ListClaims(ctx, testutil.Service.DID(), "", 10))(t)
+	require.Len(t, claims, 2)
+	for i, claim := range []delegation.Delegation{published, cached} {
+		require.Equal(t, asCid(claim), claims[i].Claim)
+		require.Equal(t, assert.LocationAbility, claims[i].Type)
+		require.Equal(t, parseLocation(t, claim), claims[i].Hash)
+	}
+}
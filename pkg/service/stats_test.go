@@ -0,0 +1,102 @@
+package service_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/blobindexlookup"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexingService__Stats(t *testing.T) {
+	ctx := context.Background()
+	f := newClaimFixture(t)
+	contentHash, indexCid, shardHash := testutil.RandomMultihash(), testutil.RandomCID().(cidlink.Link).Cid, testutil.RandomMultihash()
+	index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 1)
+	index.SetSlice(shardHash, contentHash, blobindex.Position{Offset: 0, Length: 10})
+	archive := testutil.Must(io.ReadAll(testutil.Must(blobindex.Archive(index))(t)))(t)
+	blobs := newCountingServer(t, 0, func(*http.Request) []byte { return archive })
+	indexDelegation := testutil.RandomLocationDelegation()
+	indexClaim := f.addClaim(t, indexDelegation)
+	indexLocation := f.addClaim(t, locationsDelegation(t, indexCid.Hash(), blobs.url(t, "/index")))
+	// the provider serves claims, but not blobs, so the index is only fetched
+	// from its location
+	result := func(contextID []byte, md interface{ MarshalBinary() ([]byte, error) }) model.ProviderResult {
+		r := f.result(t, contextID, md)
+		r.Provider = &peer.AddrInfo{ID: f.provider.ID, Addrs: f.provider.Addrs[:1]}
+		return r
+	}
+	contentResults := []model.ProviderResult{result(contentHash, &metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaim})}
+
+	// the records of the content and its index claim are cached, while those of
+	// the index and the shard, the index location and the index itself aren't
+	newService := func(t *testing.T) *service.IndexingService {
+		finder := &countingFinder{results: map[string][]model.ProviderResult{
+			string(contentHash):     contentResults,
+			string(indexCid.Hash()): {result(indexCid.Hash(), &metadata.LocationCommitmentMetadata{Claim: indexLocation})},
+		}, calls: map[string]int{}}
+		providerStore := &mockProviderStore{results: map[string][]model.ProviderResult{string(contentHash): contentResults}}
+		claimStore := redis.NewContentClaimsStore(&memRedis{data: map[string]string{}})
+		require.NoError(t, claimStore.Set(ctx, indexClaim, indexDelegation, true))
+		providerIndex := providerindex.NewProviderIndex(providerStore, finder, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		claimLookup := claimlookup.WithCache(claimlookup.NewClaimLookup(http.DefaultClient), claimStore)
+		blobIndexLookup := blobindexlookup.WithCache(blobindexlookup.NewBlobIndexLookup(http.DefaultClient), redis.NewShardedDagIndexStore(&memRedis{data: map[string]string{}}), noopCachingQueue{})
+		return testutil.Must(service.NewIndexingService(blobIndexLookup, claimLookup, providerIndex))(t)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		walker service.Walker
+	}{
+		{"single walker", service.WalkerSingle},
+		{"parallel walker", service.WalkerParallel},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			is := newService(t)
+			q := service.Query{Hashes: []multihash.Multihash{contentHash}, Walker: tc.walker, Concurrency: 4}
+
+			// the walk looks up the content, the index and the shard
+			stats := testutil.Must(is.Query(ctx, q))(t).Stats()
+			require.Equal(t, 3, stats.Jobs)
+			require.Equal(t, map[string]int{types.ProvidersCache: 1, types.ClaimsCache: 1}, stats.CacheHits)
+			require.Equal(t, map[string]int{types.ProvidersCache: 2, types.ClaimsCache: 1, types.IndexesCache: 1}, stats.CacheMisses)
+			require.Equal(t, map[string]int{types.FetchIPNI: 2, types.FetchClaim: 1, types.FetchIndex: 1}, stats.Fetches)
+			require.Equal(t, 1, stats.IndexesExpanded)
+			require.Positive(t, stats.WallTime)
+			require.Empty(t, stats.Truncated)
+
+			// the next query finds everything the first cached
+			stats = testutil.Must(is.Query(ctx, q))(t).Stats()
+			require.Equal(t, 3, stats.Jobs)
+			require.Equal(t, map[string]int{types.ProvidersCache: 3, types.ClaimsCache: 2, types.IndexesCache: 1}, stats.CacheHits)
+			require.Empty(t, stats.CacheMisses)
+			require.Empty(t, stats.Fetches)
+			require.Equal(t, 1, stats.IndexesExpanded)
+		})
+	}
+
+	t.Run("limits that leave things out are named", func(t *testing.T) {
+		// the cached records of the content were never seen by IPNI, so they
+		// are too old for any age
+		is := newService(t)
+		stats := testutil.Must(is.Query(ctx, service.Query{Hashes: []multihash.Multihash{contentHash}, MaxProviderAge: time.Hour}))(t).Stats()
+		require.Equal(t, 1, stats.Jobs)
+		require.Empty(t, stats.Fetches)
+		require.Equal(t, []string{"maxProviderAge"}, stats.Truncated)
+	})
+}
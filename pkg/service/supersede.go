@@ -0,0 +1,75 @@
+package service
+
+import (
+	"cmp"
+	"math"
+
+	"github.com/ipfs/go-cid"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/validator"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+)
+
+// locationIdentity is what location commitments that are generations of the
+// same commitment have in common. The location caveats don't name a space, so
+// commitments for a shard by a provider are generations of each other whatever
+// space they were made for
+type locationIdentity struct {
+	provider string
+	shard    string
+}
+
+// parseLocationIdentity reads the identity of a location commitment from the
+// caveats of its location capability. It returns false if the claim is not a
+// location commitment
+func parseLocationIdentity(claim delegation.Delegation) (locationIdentity, bool) {
+	for _, capability := range claim.Capabilities() {
+		if capability.Can() != assert.LocationAbility {
+			continue
+		}
+		match, fail := assert.Location.Match(validator.NewSource(capability, claim))
+		if fail != nil {
+			continue
+		}
+		return locationIdentity{
+			provider: claim.Issuer().DID().String(),
+			shard:    string(match.Value().Nb().Content.Hash()),
+		}, true
+	}
+	return locationIdentity{}, false
+}
+
+// expiresAt is when a claim expires, with claims that don't expire last
+func expiresAt(claim delegation.Delegation) int {
+	if exp := claim.Expiration(); exp != nil {
+		return *exp
+	}
+	return math.MaxInt
+}
+
+// supersededLocations returns the location commitments in claims for which a
+// later generation of the same commitment, expiring after it, is also present.
+// Of generations expiring at the same time, the one with the greatest CID is
+// kept
+func supersededLocations(claims map[cid.Cid]delegation.Delegation) []cid.Cid {
+	latest := map[locationIdentity]cid.Cid{}
+	var superseded []cid.Cid
+	for claimCid, claim := range claims {
+		id, ok := parseLocationIdentity(claim)
+		if !ok {
+			continue
+		}
+		current, ok := latest[id]
+		if !ok {
+			latest[id] = claimCid
+			continue
+		}
+		if cmp.Or(cmp.Compare(expiresAt(claim), expiresAt(claims[current])), cmp.Compare(claimCid.KeyString(), current.KeyString())) > 0 {
+			latest[id] = claimCid
+			superseded = append(superseded, current)
+		} else {
+			superseded = append(superseded, claimCid)
+		}
+	}
+	return superseded
+}
@@ -0,0 +1,67 @@
+package service_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/principal"
+	"github.com/storacha/go-ucanto/principal/ed25519/signer"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/stretchr/testify/require"
+)
+
+func expiringLocation(t *testing.T, issuer principal.Signer, shard multihash.Multihash, location string, expiration time.Time) delegation.Delegation {
+	claim := assert.Location.New(issuer.DID().String(), assert.LocationCaveats{
+		Content:  assert.FromHash(shard),
+		Location: []url.URL{*testutil.Must(url.Parse(location))(t)},
+	})
+	return testutil.Must(delegation.Delegate(issuer, issuer, []ucan.Capability[assert.LocationCaveats]{claim}, delegation.WithExpiration(int(expiration.Unix()))))(t)
+}
+
+func TestIndexingService__SupersededLocations(t *testing.T) {
+	f := newClaimFixture(t)
+	provider, other := testutil.Must(signer.Generate())(t), testutil.Must(signer.Generate())(t)
+	shard := testutil.RandomMultihash()
+	now := time.Now()
+
+	// the provider re-issued its commitment for the shard with a new URL and a
+	// later expiry, while another provider has its own commitment
+	older := f.addClaim(t, expiringLocation(t, provider, shard, "https://old.example.com/blob", now.Add(time.Hour)))
+	newer := f.addClaim(t, expiringLocation(t, provider, shard, "https://new.example.com/blob", now.Add(2*time.Hour)))
+	others := f.addClaim(t, expiringLocation(t, other, shard, "https://other.example.com/blob", now.Add(time.Hour)))
+	results := map[string][]model.ProviderResult{
+		string(shard): {
+			f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: newer}),
+			f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: older}),
+			f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: others}),
+		},
+	}
+	providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, &countingFinder{results: results, calls: map[string]int{}}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+	is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex))(t)
+
+	query := func(includeSuperseded bool) []cid.Cid {
+		qr := testutil.Must(is.Query(context.Background(), service.Query{Hashes: []multihash.Multihash{shard}, IncludeSuperseded: includeSuperseded}))(t)
+		claims := make([]cid.Cid, 0, len(qr.Claims()))
+		for _, link := range qr.Claims() {
+			claims = append(claims, link.(cidlink.Link).Cid)
+		}
+		return claims
+	}
+
+	require.ElementsMatch(t, []cid.Cid{newer, others}, query(false))
+	require.ElementsMatch(t, []cid.Cid{older, newer, others}, query(true))
+}
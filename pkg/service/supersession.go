@@ -0,0 +1,289 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/validator"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+const (
+	// maxSupersessionDepth is the most supersessions followed from an index
+	// claim to the newest claim replacing it
+	maxSupersessionDepth = 16
+	// supersededRecordTTL is how long the cached provider records of an index
+	// claim are kept once it is superseded
+	supersededRecordTTL = 5 * time.Minute
+)
+
+// ErrSupersessionCycle is returned when publishing or caching an index claim
+// that supersedes a claim already superseded, directly or through a chain of
+// claims, by the claim itself
+var ErrSupersessionCycle = errors.New("supersession cycle")
+
+// WithSupersessions records the index claims replaced by a newer index claim
+// for the same content in the store, as claims superseding them are published,
+// cached or found by queries, so that queries leave out the claims replaced
+// even when the claims replacing them aren't found too. Without a store, only
+// claims replaced by another claim in the same result are left out
+func WithSupersessions(store types.SupersessionStore) Option {
+	return func(is *IndexingService) {
+		is.supersessions = store
+	}
+}
+
+// claimExpirer is implemented by provider indexes that can expire the cached
+// records of a claim early
+type claimExpirer interface {
+	ExpireClaim(ctx context.Context, hash multihash.Multihash, claim cid.Cid, ttl time.Duration) error
+}
+
+// parseIndexClaim reads the caveats of the index capability of a claim. It
+// returns false if the claim is not an index claim
+func parseIndexClaim(claim delegation.Delegation) (assert.IndexCaveats, bool) {
+	for _, capability := range claim.Capabilities() {
+		if capability.Can() != assert.IndexAbility {
+			continue
+		}
+		match, fail := assert.Index.Match(validator.NewSource(capability, claim))
+		if fail != nil {
+			continue
+		}
+		return match.Value().Nb(), true
+	}
+	return assert.IndexCaveats{}, false
+}
+
+// parseSupersedes reads the index claim an index claim supersedes from its
+// caveats, along with the supersession to record for it. It returns false if
+// the claim doesn't supersede one
+func parseSupersedes(claim delegation.Delegation) (cid.Cid, types.Supersession, bool) {
+	nb, ok := parseIndexClaim(claim)
+	if !ok || nb.Supersedes == nil {
+		return cid.Undef, types.Supersession{}, false
+	}
+	superseded, err := cid.Parse((*nb.Supersedes).String())
+	if err != nil {
+		return cid.Undef, types.Supersession{}, false
+	}
+	content, err := cid.Parse(nb.Content.String())
+	if err != nil {
+		return cid.Undef, types.Supersession{}, false
+	}
+	supersession := types.Supersession{
+		By:      claim.Link().(cidlink.Link).Cid,
+		Issuer:  claim.Issuer().DID().String(),
+		Content: content.Hash(),
+	}
+	if exp := claim.Expiration(); exp != nil {
+		supersession.Expiration = time.Unix(int64(*exp), 0)
+	}
+	return superseded, supersession, true
+}
+
+// supersessionExpiry is when the claim replacing a superseded claim expires,
+// with claims that don't expire last
+func supersessionExpiry(s types.Supersession) int64 {
+	if s.Expiration.IsZero() {
+		return math.MaxInt64
+	}
+	return s.Expiration.Unix()
+}
+
+// newerSupersession returns true if a claim replaced by a is better replaced by
+// b, as b expires later. Of supersessions expiring at the same time, the one by
+// the greatest CID wins
+func newerSupersession(a, b types.Supersession) bool {
+	return cmp.Or(cmp.Compare(supersessionExpiry(b), supersessionExpiry(a)), cmp.Compare(b.By.KeyString(), a.By.KeyString())) > 0
+}
+
+// supersedesItself returns true if the claim would end up superseding itself
+// by superseding the given claim, because the claim is already superseded by
+// it, directly or through a chain of claims
+func (is *IndexingService) supersedesItself(ctx context.Context, claim, superseded cid.Cid) (bool, error) {
+	if claim == superseded {
+		return true, nil
+	}
+	if is.supersessions == nil {
+		return false, nil
+	}
+	current := claim
+	for range maxSupersessionDepth {
+		s, err := is.supersessions.Get(ctx, current)
+		if err != nil {
+			if errors.Is(err, types.ErrKeyNotFound) {
+				return false, nil
+			}
+			return false, fmt.Errorf("reading supersession of %s: %w", current, err)
+		}
+		if s.By == superseded {
+			return true, nil
+		}
+		current = s.By
+	}
+	return false, nil
+}
+
+// checkSupersession fails index claims superseding a claim that already
+// supersedes them
+func (is *IndexingService) checkSupersession(ctx context.Context, claim delegation.Delegation) error {
+	superseded, s, ok := parseSupersedes(claim)
+	if !ok {
+		return nil
+	}
+	cycle, err := is.supersedesItself(ctx, s.By, superseded)
+	if err != nil {
+		return err
+	}
+	if cycle {
+		return fmt.Errorf("%w: index claim %s supersedes %s, which already supersedes it", ErrSupersessionCycle, s.By, superseded)
+	}
+	return nil
+}
+
+// recordSupersession records the claim an index claim supersedes, unless it is
+// already superseded by a newer claim, and expires the cached provider records
+// of the superseded claim early. Cached results for the content are dropped, as
+// they may hold the superseded claim. Failures are logged, as the claim itself
+// was published or cached regardless
+func (is *IndexingService) recordSupersession(ctx context.Context, claim delegation.Delegation) {
+	if is.supersessions == nil {
+		return
+	}
+	superseded, s, ok := parseSupersedes(claim)
+	if !ok {
+		return
+	}
+	existing, err := types.GetForWrite(ctx, is.supersessions, superseded)
+	if err == nil && (existing.By == s.By || !newerSupersession(existing, s)) {
+		return
+	}
+	if err != nil && !errors.Is(err, types.ErrKeyNotFound) {
+		log.Warnw("reading supersession", "claim", superseded, "error", err)
+		return
+	}
+	if cycle, err := is.supersedesItself(ctx, s.By, superseded); err != nil || cycle {
+		log.Warnw("not recording supersession", "claim", superseded, "by", s.By, "cycle", cycle, "error", err)
+		return
+	}
+	if err := is.supersessions.Set(ctx, superseded, s, false); err != nil {
+		log.Warnw("recording supersession", "claim", superseded, "by", s.By, "error", err)
+		return
+	}
+	if is.resultCache != nil {
+		is.resultCache.invalidate([]multihash.Multihash{s.Content})
+	}
+	if e, ok := is.providerIndex.(claimExpirer); ok {
+		if err := e.ExpireClaim(ctx, s.Content, superseded, supersededRecordTTL); err != nil {
+			log.Warnw("expiring records of superseded claim", "claim", superseded, "error", err)
+		}
+	}
+}
+
+// supersededIndexes returns the index claims among claims that are replaced by
+// a live index claim from the same issuer, along with the newest live claim
+// replacing each. Supersessions are read from the caveats of the claims, then
+// from the supersession store, so that a claim is left out even if the claims
+// replacing it weren't found
+func (is *IndexingService) supersededIndexes(ctx context.Context, claims map[cid.Cid]delegation.Delegation) map[cid.Cid]cid.Cid {
+	now := time.Now()
+	found := map[cid.Cid]types.Supersession{}
+	for _, claim := range claims {
+		superseded, s, ok := parseSupersedes(claim)
+		if !ok {
+			continue
+		}
+		if existing, ok := found[superseded]; !ok || newerSupersession(existing, s) {
+			found[superseded] = s
+		}
+	}
+	if len(found) == 0 && is.supersessions == nil {
+		return nil
+	}
+	lookup := func(claim cid.Cid) (types.Supersession, bool) {
+		if s, ok := found[claim]; ok {
+			return s, true
+		}
+		if is.supersessions == nil {
+			return types.Supersession{}, false
+		}
+		s, err := is.supersessions.Get(ctx, claim)
+		if err != nil {
+			if !errors.Is(err, types.ErrKeyNotFound) {
+				log.Warnw("reading supersession", "claim", claim, "error", err)
+			}
+			return types.Supersession{}, false
+		}
+		return s, true
+	}
+	superseded := map[cid.Cid]cid.Cid{}
+	for c, claim := range claims {
+		if _, ok := parseIndexClaim(claim); !ok {
+			continue
+		}
+		issuer := claim.Issuer().DID().String()
+		var newest cid.Cid
+		seen := map[cid.Cid]struct{}{c: {}}
+		current := c
+		for range maxSupersessionDepth {
+			s, ok := lookup(current)
+			if !ok || s.Issuer != issuer {
+				break
+			}
+			if _, ok := seen[s.By]; ok {
+				break
+			}
+			seen[s.By] = struct{}{}
+			if s.Live(now) {
+				newest = s.By
+			}
+			current = s.By
+		}
+		if newest.Defined() {
+			superseded[c] = newest
+		}
+	}
+	return superseded
+}
+
+// omitSupersededIndexes drops the superseded index claims from the result,
+// along with the references to their indexes and the indexes themselves,
+// unless a claim that is kept is for the same index
+func omitSupersededIndexes(qr *queryResult, superseded map[cid.Cid]cid.Cid) {
+	dropped := map[cid.Cid]struct{}{}
+	for c := range superseded {
+		if nb, ok := parseIndexClaim(qr.Claims[c]); ok {
+			if index, err := cid.Parse(nb.Index.String()); err == nil {
+				dropped[index] = struct{}{}
+			}
+		}
+		delete(qr.Claims, c)
+	}
+	for _, claim := range qr.Claims {
+		if nb, ok := parseIndexClaim(claim); ok {
+			if index, err := cid.Parse(nb.Index.String()); err == nil {
+				delete(dropped, index)
+			}
+		}
+	}
+	var contextIDs []types.EncodedContextID
+	for contextID, ref := range qr.IndexRefs.Iterator() {
+		if _, ok := dropped[ref.Index]; ok {
+			contextIDs = append(contextIDs, contextID)
+		}
+	}
+	for _, contextID := range contextIDs {
+		qr.IndexRefs.Delete(contextID)
+		qr.Indexes.Delete(contextID)
+	}
+}
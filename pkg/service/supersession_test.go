@@ -0,0 +1,214 @@
+package service_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/go-ucanto/core/delegation"
+	"github.com/storacha/go-ucanto/ucan"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/capability/assert"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexingService__Supersession(t *testing.T) {
+	ctx := context.Background()
+	f := newClaimFixture(t)
+	content := testutil.RandomCID()
+	contentHash := content.(cidlink.Link).Cid.Hash()
+	// newIndexClaim publishes an index claim for the content, superseding the
+	// given claim if it is defined
+	newIndexClaim := func(t *testing.T, supersedes cid.Cid) (cid.Cid, cid.Cid, model.ProviderResult) {
+		index := testutil.RandomCID()
+		nb := assert.IndexCaveats{Content: content, Index: index}
+		if supersedes.Defined() {
+			link := ipld.Link(cidlink.Link{Cid: supersedes})
+			nb.Supersedes = &link
+		}
+		claim := testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.IndexCaveats]{
+			assert.Index.New(testutil.Service.DID().String(), nb),
+		}))(t)
+		claimCid := f.addClaim(t, claim)
+		indexCid := index.(cidlink.Link).Cid
+		return claimCid, indexCid, f.result(t, testutil.RandomBytes(10), &metadata.IndexClaimMetadata{Index: indexCid, Claim: claimCid})
+	}
+	// the oldest claim is superseded by the middle one, which is superseded
+	// by the newest
+	oldest, oldestIndex, oldestResult := newIndexClaim(t, cid.Undef)
+	middle, middleIndex, middleResult := newIndexClaim(t, oldest)
+	newest, newestIndex, newestResult := newIndexClaim(t, middle)
+	newService := func(store types.SupersessionStore, results ...model.ProviderResult) *service.IndexingService {
+		providerIndex := &mockProviderIndex{results: map[string][]model.ProviderResult{string(contentHash): results}}
+		opts := []service.Option{}
+		if store != nil {
+			opts = append(opts, service.WithSupersessions(store))
+		}
+		return testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, claimlookup.NewClaimLookup(http.DefaultClient), providerIndex, opts...))(t)
+	}
+	query := func(t *testing.T, is *service.IndexingService, includeSuperseded bool) ([]cid.Cid, []cid.Cid, map[cid.Cid]supersessionSummary) {
+		qr := testutil.Must(is.Query(ctx, service.Query{Hashes: []multihash.Multihash{contentHash}, IncludeSuperseded: includeSuperseded}))(t)
+		var claims, indexes []cid.Cid
+		for _, link := range qr.Claims() {
+			claims = append(claims, link.(cidlink.Link).Cid)
+		}
+		for _, ref := range qr.IndexReferences().Iterator() {
+			indexes = append(indexes, ref.Index)
+		}
+		summaries := map[cid.Cid]supersessionSummary{}
+		for c, s := range qr.ClaimSummaries().All() {
+			summaries[c] = supersessionSummary{s.Supersedes, s.SupersededBy}
+		}
+		return claims, indexes, summaries
+	}
+
+	t.Run("superseded index claims are left out for the newest", func(t *testing.T) {
+		is := newService(nil, oldestResult, middleResult, newestResult)
+		claims, indexes, _ := query(t, is, false)
+		require.Equal(t, []cid.Cid{newest}, claims)
+		require.Equal(t, []cid.Cid{newestIndex}, indexes)
+	})
+
+	t.Run("superseded index claims are included with the claim replacing them", func(t *testing.T) {
+		is := newService(nil, oldestResult, middleResult, newestResult)
+		claims, indexes, summaries := query(t, is, true)
+		require.ElementsMatch(t, []cid.Cid{oldest, middle, newest}, claims)
+		require.ElementsMatch(t, []cid.Cid{oldestIndex, middleIndex, newestIndex}, indexes)
+		require.Equal(t, map[cid.Cid]supersessionSummary{
+			oldest: {SupersededBy: newest},
+			middle: {Supersedes: oldest, SupersededBy: newest},
+			newest: {Supersedes: middle},
+		}, summaries)
+	})
+
+	t.Run("recorded supersessions leave out claims whose successors aren't found", func(t *testing.T) {
+		store := newMockSupersessionStore()
+		_, _, _ = query(t, newService(store, oldestResult, middleResult, newestResult), false)
+		require.Equal(t, middle, store.supersessions[oldest].By)
+		require.Equal(t, newest, store.supersessions[middle].By)
+
+		claims, _, _ := query(t, newService(store, oldestResult), false)
+		require.Empty(t, claims)
+		claims, _, summaries := query(t, newService(store, oldestResult), true)
+		require.Equal(t, []cid.Cid{oldest}, claims)
+		require.Equal(t, newest, summaries[oldest].SupersededBy)
+	})
+
+	t.Run("claims superseding a claim that supersedes them are rejected", func(t *testing.T) {
+		store := newMockSupersessionStore()
+		is := newService(store)
+		// the claim is published after a claim superseding it was, which it
+		// then claims to supersede, directly or through a chain
+		claim := testutil.RandomIndexDelegation()
+		claimCid := claim.Link().(cidlink.Link).Cid
+		successor := testutil.RandomCID().(cidlink.Link).Cid
+		supersedes := func(successor cid.Cid) delegation.Delegation {
+			link := ipld.Link(cidlink.Link{Cid: successor})
+			return testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.IndexCaveats]{
+				assert.Index.New(testutil.Service.DID().String(), assert.IndexCaveats{Content: content, Index: testutil.RandomCID(), Supersedes: &link}),
+			}))(t)
+		}
+		cyclic := supersedes(successor)
+		store.supersessions[cyclic.Link().(cidlink.Link).Cid] = types.Supersession{By: successor}
+		require.ErrorIs(t, is.PublishClaim(ctx, cyclic), service.ErrSupersessionCycle)
+		require.ErrorIs(t, is.CacheClaim(ctx, cyclic), service.ErrSupersessionCycle)
+
+		chained := supersedes(successor)
+		intermediate := testutil.RandomCID().(cidlink.Link).Cid
+		store.supersessions[chained.Link().(cidlink.Link).Cid] = types.Supersession{By: intermediate}
+		store.supersessions[intermediate] = types.Supersession{By: successor}
+		require.ErrorIs(t, is.PublishClaim(ctx, chained), service.ErrSupersessionCycle)
+
+		// claims superseding nothing, or a claim that doesn't supersede them,
+		// get past the check
+		for _, claim := range []delegation.Delegation{claim, supersedes(claimCid)} {
+			err := is.PublishClaim(ctx, claim)
+			require.Error(t, err)
+			require.NotErrorIs(t, err, service.ErrSupersessionCycle)
+		}
+	})
+}
+
+func TestIndexingService__RecordSupersession(t *testing.T) {
+	ctx := context.Background()
+	f := newPublishFixture(t)
+	content := testutil.RandomCID()
+	index := testutil.RandomCID()
+	view := blobindex.NewShardedDagIndexView(content, 1)
+	view.SetSlice(testutil.RandomMultihash(), testutil.RandomMultihash(), blobindex.Position{Offset: 0, Length: 10})
+	f.indexes.index = view
+	store := newMockSupersessionStore()
+	is := f.service(t, service.WithSupersessions(store))
+	require.NoError(t, is.CacheClaim(ctx, locationsDelegation(t, index.(cidlink.Link).Cid.Hash(), testutil.Must(url.Parse("https://blobs.example/index"))(t))))
+
+	supersedesWith := func(index ipld.Link, superseded cid.Cid) delegation.Delegation {
+		link := ipld.Link(cidlink.Link{Cid: superseded})
+		return testutil.Must(delegation.Delegate(testutil.Service, testutil.Service, []ucan.Capability[assert.IndexCaveats]{
+			assert.Index.New(testutil.Service.DID().String(), assert.IndexCaveats{Content: content, Index: index, Supersedes: &link}),
+		}))(t)
+	}
+	supersedes := func(superseded cid.Cid) delegation.Delegation { return supersedesWith(index, superseded) }
+	oldest := testutil.RandomCID().(cidlink.Link).Cid
+	published := supersedes(oldest)
+	require.NoError(t, is.PublishClaim(ctx, published))
+	require.Equal(t, asCid(published), store.supersessions[oldest].By)
+	require.Equal(t, content.(cidlink.Link).Cid.Hash(), store.supersessions[oldest].Content)
+
+	cached := supersedes(asCid(published))
+	require.NoError(t, is.CacheClaim(ctx, cached))
+	require.Equal(t, asCid(cached), store.supersessions[asCid(published)].By)
+
+	// claims that fail to publish record nothing
+	failed := testutil.RandomCID().(cidlink.Link).Cid
+	require.ErrorIs(t, is.PublishClaim(ctx, supersedesWith(testutil.RandomCID(), failed)), service.ErrIndexNotLocated)
+	require.NotContains(t, store.supersessions, failed)
+}
+
+// supersessionSummary is the part of a claim summary about supersession
+type supersessionSummary struct {
+	Supersedes   cid.Cid
+	SupersededBy cid.Cid
+}
+
+// mockSupersessionStore keeps supersessions in memory
+type mockSupersessionStore struct {
+	lk            sync.Mutex
+	supersessions map[cid.Cid]types.Supersession
+}
+
+func newMockSupersessionStore() *mockSupersessionStore {
+	return &mockSupersessionStore{supersessions: map[cid.Cid]types.Supersession{}}
+}
+
+func (m *mockSupersessionStore) Get(ctx context.Context, claim cid.Cid) (types.Supersession, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	s, ok := m.supersessions[claim]
+	if !ok {
+		return types.Supersession{}, types.ErrKeyNotFound
+	}
+	return s, nil
+}
+
+func (m *mockSupersessionStore) Set(ctx context.Context, claim cid.Cid, s types.Supersession, expires bool) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.supersessions[claim] = s
+	return nil
+}
+
+func (m *mockSupersessionStore) SetExpirable(ctx context.Context, claim cid.Cid, expires bool) error {
+	return nil
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+const (
+	// DefaultMaxRefinements is the number of tiered queries refined in the
+	// background at once
+	DefaultMaxRefinements = 16
+	// DefaultRefinementTimeout bounds how long the refinement of a tiered query
+	// may run
+	DefaultRefinementTimeout = time.Minute
+)
+
+// refiner runs the full walks of tiered queries in the background, within a
+// budget, until it is drained
+type refiner struct {
+	budget  chan struct{}
+	timeout time.Duration
+	lk      sync.Mutex
+	running sync.WaitGroup
+	closed  bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func newRefiner(max int, timeout time.Duration) *refiner {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &refiner{budget: make(chan struct{}, max), timeout: timeout, ctx: ctx, cancel: cancel}
+}
+
+// start claims budget for a refinement, returning false if there is none left
+// or the refiner has been drained
+func (r *refiner) start() bool {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if r.closed {
+		return false
+	}
+	select {
+	case r.budget <- struct{}{}:
+	default:
+		return false
+	}
+	r.running.Add(1)
+	return true
+}
+
+func (r *refiner) done() {
+	<-r.budget
+	r.running.Done()
+}
+
+// WithMaxRefinements sets the number of tiered queries refined in the
+// background at once. Tiered queries beyond it are answered in full straight
+// away. If not set, DefaultMaxRefinements is used
+func WithMaxRefinements(max int) Option {
+	return func(is *IndexingService) {
+		is.maxRefinements = max
+	}
+}
+
+// WithRefinementTimeout sets how long the refinement of a tiered query may run.
+// If not set, DefaultRefinementTimeout is used
+func WithRefinementTimeout(timeout time.Duration) Option {
+	return func(is *IndexingService) {
+		is.refinementTimeout = timeout
+	}
+}
+
+// QueryTiered answers a query in two phases. The result returned is built
+// from cache hits alone: nothing is fetched from IPNI or over HTTP, and what
+// isn't cached is left out. The full walk of the query then continues in the
+// background, and refine is called with its complete result, or the error it
+// failed with, once it finishes. Unless the first phase fails, refine is
+// called exactly once.
+//
+// The refinement is detached from the passed context, and bounded by the
+// refinement timeout instead. When the maximum number of refinements are
+// already running or the service is draining, the full result is returned
+// straight away, and refine is called with it before returning
+func (is *IndexingService) QueryTiered(ctx context.Context, q Query, refine func(queryresult.QueryResult, error)) (queryresult.QueryResult, error) {
+	fast, err := is.Query(types.WithCacheOnly(ctx), q)
+	if err != nil {
+		return nil, err
+	}
+	if !is.refiner.start() {
+		log.Debugw("no budget to refine tiered query, answering in full", "hashes", len(q.Hashes))
+		qr, err := is.Query(ctx, q)
+		refine(qr, err)
+		return qr, err
+	}
+	go func() {
+		defer is.refiner.done()
+		refineCtx, cancel := context.WithTimeout(is.refiner.ctx, is.refiner.timeout)
+		defer cancel()
+		refine(is.Query(refineCtx, q))
+	}()
+	return fast, nil
+}
+
+// DrainRefinements stops refining tiered queries in the background, and waits
+// for the refinements running to finish. If the context is done first, they
+// are cancelled, and the error of the context is returned
+func (is *IndexingService) DrainRefinements(ctx context.Context) error {
+	is.refiner.lk.Lock()
+	is.refiner.closed = true
+	is.refiner.lk.Unlock()
+	drained := make(chan struct{})
+	go func() {
+		is.refiner.running.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		is.refiner.cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,158 @@
+package service_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/metadata"
+	"github.com/storacha/indexing-service/pkg/redis"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/blobindexlookup"
+	"github.com/storacha/indexing-service/pkg/service/claimlookup"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// originCounter counts the fetches made from IPNI and over HTTP, and those of
+// them made under a cache only context
+type originCounter struct {
+	fetches, cacheOnly atomic.Int32
+}
+
+func (o *originCounter) count(ctx context.Context) {
+	o.fetches.Add(1)
+	if types.IsCacheOnly(ctx) {
+		o.cacheOnly.Add(1)
+	}
+}
+
+func (o *originCounter) RoundTrip(r *http.Request) (*http.Response, error) {
+	o.count(r.Context())
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+type countedFinder struct {
+	*countingFinder
+	origin *originCounter
+}
+
+func (f countedFinder) Find(ctx context.Context, hash multihash.Multihash) (*model.FindResponse, error) {
+	f.origin.count(ctx)
+	return f.countingFinder.Find(ctx, hash)
+}
+
+type noopCachingQueue struct{}
+
+func (noopCachingQueue) QueueProviderCaching(ctx context.Context, contextID types.EncodedContextID, provider model.ProviderResult, index blobindex.ShardedDagIndexView) error {
+	return nil
+}
+
+func TestIndexingService__QueryTiered(t *testing.T) {
+	ctx := context.Background()
+	f := newClaimFixture(t)
+	contentHash, indexCid, shardHash := testutil.RandomMultihash(), testutil.RandomCID().(cidlink.Link).Cid, testutil.RandomMultihash()
+	index := blobindex.NewShardedDagIndexView(testutil.RandomCID(), 1)
+	index.SetSlice(shardHash, contentHash, blobindex.Position{Offset: 0, Length: 10})
+	archive := testutil.Must(io.ReadAll(testutil.Must(blobindex.Archive(index))(t)))(t)
+	blobs := newCountingServer(t, 0, func(*http.Request) []byte { return archive })
+
+	indexClaim := f.newClaim(t)
+	indexLocation := f.addClaim(t, locationsDelegation(t, indexCid.Hash(), blobs.url(t, "/index")))
+	shardLocation := f.addClaim(t, locationsDelegation(t, shardHash, blobs.url(t, "/shard")))
+	// the provider serves claims, but not blobs
+	provider := &peer.AddrInfo{ID: f.provider.ID, Addrs: f.provider.Addrs[:1]}
+	withProvider := func(r model.ProviderResult) model.ProviderResult {
+		r.Provider = provider
+		return r
+	}
+	results := map[string][]model.ProviderResult{
+		string(contentHash):     {withProvider(f.result(t, testutil.RandomBytes(10), &metadata.IndexClaimMetadata{Index: indexCid, Claim: indexClaim}))},
+		string(indexCid.Hash()): {withProvider(f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: indexLocation}))},
+		string(shardHash):       {withProvider(f.result(t, testutil.RandomBytes(10), &metadata.LocationCommitmentMetadata{Claim: shardLocation}))},
+	}
+
+	newService := func(opts ...service.Option) (*service.IndexingService, *originCounter) {
+		origin := &originCounter{}
+		client := &http.Client{Transport: origin}
+		providerIndex := providerindex.NewProviderIndex(&mockProviderStore{results: map[string][]model.ProviderResult{}}, countedFinder{&countingFinder{results: results, calls: map[string]int{}}, origin}, nil, nil, cidlink.DefaultLinkSystem(), nil)
+		blobIndexLookup := blobindexlookup.WithCache(blobindexlookup.NewBlobIndexLookup(client), redis.NewShardedDagIndexStore(&memRedis{data: map[string]string{}}), noopCachingQueue{})
+		claimLookup := claimlookup.WithCache(claimlookup.NewClaimLookup(client), newMockClaimStore())
+		return testutil.Must(service.NewIndexingService(blobIndexLookup, claimLookup, providerIndex, opts...))(t), origin
+	}
+	q := service.Query{Hashes: []multihash.Multihash{contentHash}}
+	claimsOf := func(qr queryresult.QueryResult) []cid.Cid {
+		var claims []cid.Cid
+		for _, link := range qr.Claims() {
+			claims = append(claims, link.(cidlink.Link).Cid)
+		}
+		return claims
+	}
+	type refinement struct {
+		qr  queryresult.QueryResult
+		err error
+	}
+	queryTiered := func(t *testing.T, is *service.IndexingService) (queryresult.QueryResult, refinement) {
+		refined := make(chan refinement, 1)
+		fast := testutil.Must(is.QueryTiered(ctx, q, func(qr queryresult.QueryResult, err error) {
+			refined <- refinement{qr, err}
+		}))(t)
+		select {
+		case r := <-refined:
+			require.NoError(t, r.err)
+			return fast, r
+		case <-time.After(10 * time.Second):
+			t.Fatal("query was never refined")
+			return nil, refinement{}
+		}
+	}
+
+	is, origin := newService()
+	fast, refined := queryTiered(t, is)
+	// nothing is cached yet, so the answer from cache is empty, and nothing was
+	// fetched from the origin to give it
+	require.Empty(t, fast.Claims())
+	require.Empty(t, fast.Indexes())
+	require.Zero(t, origin.cacheOnly.Load())
+	require.NotZero(t, origin.fetches.Load())
+
+	// the refinement is the result of the full walk
+	plain := testutil.Must(is.Query(ctx, q))(t)
+	require.ElementsMatch(t, []cid.Cid{indexClaim, indexLocation, shardLocation}, claimsOf(refined.qr))
+	require.ElementsMatch(t, claimsOf(plain), claimsOf(refined.qr))
+	require.Len(t, refined.qr.Indexes(), 1)
+	require.Equal(t, plain.Indexes(), refined.qr.Indexes())
+
+	t.Run("answers from a warm cache are complete", func(t *testing.T) {
+		fetches := origin.fetches.Load()
+		fast, refined := queryTiered(t, is)
+		require.ElementsMatch(t, claimsOf(refined.qr), claimsOf(fast))
+		require.Equal(t, refined.qr.Indexes(), fast.Indexes())
+		require.Equal(t, fetches, origin.fetches.Load())
+	})
+
+	t.Run("drained services answer in full", func(t *testing.T) {
+		is, origin := newService()
+		require.NoError(t, is.DrainRefinements(ctx))
+		refined := false
+		full := testutil.Must(is.QueryTiered(ctx, q, func(qr queryresult.QueryResult, err error) {
+			require.NoError(t, err)
+			refined = true
+		}))(t)
+		require.True(t, refined)
+		require.ElementsMatch(t, []cid.Cid{indexClaim, indexLocation, shardLocation}, claimsOf(full))
+		require.Zero(t, origin.cacheOnly.Load())
+	})
+}
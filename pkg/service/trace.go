@@ -0,0 +1,245 @@
+package service
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/blobindex"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/storacha/indexing-service/pkg/service/queryresult"
+)
+
+// limits named in traces when they leave out records or claims
+const (
+	maxProviderAgeLimit    = "maxProviderAge"
+	firstLocationWinsLimit = "firstLocationWins"
+	maxResultsPerHashLimit = "maxResultsPerHash"
+	maxIndexDepthLimit     = "maxIndexDepth"
+)
+
+// limits only named in the stats of a query, as traces describe them otherwise
+const (
+	// maxFindRecordsLimit is for IPNI finds with more records than were kept
+	maxFindRecordsLimit = "maxFindRecords"
+	// indexExpansionWaitLimit is for indexes the query stopped waiting for the
+	// expansion of
+	indexExpansionWaitLimit = "indexExpansionWait"
+)
+
+// reasons a provider's record is skipped
+const (
+	deniedReason     = "denied"
+	addrPolicyReason = "address policy"
+	noEndpointReason = "no claim endpoint"
+	// metadataMismatchReason is for location commitments left out by strict
+	// metadata checks
+	metadataMismatchReason = "metadata mismatch"
+)
+
+type traceKind int
+
+const (
+	// traceLookup is a lookup of the provider records for a hash
+	traceLookup traceKind = iota
+	// traceSkip is a provider record that was not used
+	traceSkip
+	// traceLimit is a query limit that left something out
+	traceLimit
+	// traceFetch is an attempt to fetch a claim
+	traceFetch
+	// traceClaim is a claim found for the origin, fetched or already known
+	traceClaim
+	// traceMismatch is a provider record whose metadata disagrees with its
+	// claim
+	traceMismatch
+	// traceUnsupported is an index of a version that can't be read
+	traceUnsupported
+)
+
+// traceEvent is a step of a query walk, made on behalf of a queried hash
+type traceEvent struct {
+	kind    traceKind
+	origin  multihash.Multihash
+	hash    multihash.Multihash
+	jobType jobType
+	find    providerindex.FindResult
+	// provider and reason are set for skipped records
+	provider peer.ID
+	reason   string
+	// limit is set for limits
+	limit string
+	// claim and err are set for fetches, and notCached if the fetched claim
+	// wasn't admitted to the claim cache
+	claim     cid.Cid
+	err       error
+	notCached bool
+	// fields are set for mismatches, along with the provider and claim
+	fields []string
+	// unsupported is set for indexes of versions that can't be read, along with
+	// the provider
+	unsupported blobindex.ErrUnsupportedIndexVersion
+}
+
+// queryTrace records the steps of a query walk. A nil trace records nothing,
+// so that queries that aren't traced pay nothing for it
+type queryTrace struct {
+	lk     sync.Mutex
+	events []traceEvent
+}
+
+// newQueryTrace returns a trace if the query asks for diagnoses, or nil
+func newQueryTrace(q *Query) *queryTrace {
+	if !q.Diagnose {
+		return nil
+	}
+	return &queryTrace{}
+}
+
+func (t *queryTrace) record(e traceEvent) {
+	if t == nil {
+		return
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.events = append(t.events, e)
+}
+
+func (t *queryTrace) lookup(j job, find providerindex.FindResult) {
+	t.record(traceEvent{kind: traceLookup, origin: j.origin, hash: j.mh, jobType: j.jobType, find: find})
+}
+
+func (t *queryTrace) skip(j job, provider peer.ID, reason string) {
+	t.record(traceEvent{kind: traceSkip, origin: j.origin, hash: j.mh, provider: provider, reason: reason})
+}
+
+func (t *queryTrace) limited(j job, limit string) {
+	t.record(traceEvent{kind: traceLimit, origin: j.origin, hash: j.mh, limit: limit})
+}
+
+func (t *queryTrace) fetch(j job, claim cid.Cid, err error, notCached bool) {
+	t.record(traceEvent{kind: traceFetch, origin: j.origin, hash: j.mh, claim: claim, err: err, notCached: notCached})
+}
+
+func (t *queryTrace) claim(j job, claim cid.Cid) {
+	t.record(traceEvent{kind: traceClaim, origin: j.origin, hash: j.mh, claim: claim})
+}
+
+func (t *queryTrace) mismatch(j job, provider peer.ID, claim cid.Cid, fields []string) {
+	t.record(traceEvent{kind: traceMismatch, origin: j.origin, hash: j.mh, provider: provider, claim: claim, fields: fields})
+}
+
+func (t *queryTrace) unsupportedIndex(j job, provider peer.ID, err blobindex.ErrUnsupportedIndexVersion) {
+	t.record(traceEvent{kind: traceUnsupported, origin: j.origin, hash: j.mh, provider: provider, unsupported: err})
+}
+
+// diagnose assembles a diagnosis for each of the hashes that found no claims, or
+// whose indexes were of versions that can't be read, keyed by the base58btc
+// multibase string of the hash
+func (t *queryTrace) diagnose(hashes []multihash.Multihash) map[string]queryresult.HashDiagnosis {
+	if t == nil {
+		return nil
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	byOrigin := map[string][]traceEvent{}
+	for _, e := range t.events {
+		byOrigin[string(e.origin)] = append(byOrigin[string(e.origin)], e)
+	}
+	diagnostics := map[string]queryresult.HashDiagnosis{}
+	for _, hash := range hashes {
+		key := encodeHash(hash)
+		if _, ok := diagnostics[key]; ok {
+			continue
+		}
+		if d, ok := diagnoseEvents(byOrigin[string(hash)]); ok {
+			diagnostics[key] = d
+		}
+	}
+	return diagnostics
+}
+
+// diagnoseEvents assembles the diagnosis of a queried hash from the steps made
+// on its behalf, returning false if it found claims and none of its indexes
+// were of versions that can't be read
+func diagnoseEvents(events []traceEvent) (queryresult.HashDiagnosis, bool) {
+	var d queryresult.HashDiagnosis
+	var records, matches int
+	var failed, found bool
+	for _, e := range events {
+		switch e.kind {
+		case traceClaim:
+			found = true
+		case traceLookup:
+			records += e.find.Unfiltered
+			matches += len(e.find.Results)
+			d.Lookups = append(d.Lookups, queryresult.LookupDiagnosis{
+				Hash:         encodeHash(e.hash),
+				JobType:      string(e.jobType),
+				Source:       string(e.find.Source),
+				Records:      e.find.Unfiltered,
+				ClaimMatches: e.find.ClaimMatches,
+				Matches:      len(e.find.Results),
+				Unscoped:     e.find.Unscoped,
+				Truncated:    e.find.Truncated,
+			})
+		case traceSkip:
+			d.Skipped = append(d.Skipped, queryresult.SkippedProvider{
+				Hash:     encodeHash(e.hash),
+				Provider: e.provider.String(),
+				Reason:   e.reason,
+			})
+		case traceLimit:
+			if !slices.Contains(d.Limits, e.limit) {
+				d.Limits = append(d.Limits, e.limit)
+			}
+		case traceFetch:
+			fetch := queryresult.ClaimFetch{Hash: encodeHash(e.hash), Claim: e.claim.String(), NotCached: e.notCached}
+			if e.err != nil {
+				fetch.Error = e.err.Error()
+				failed = true
+			}
+			d.Fetches = append(d.Fetches, fetch)
+		case traceMismatch:
+			d.Mismatches = append(d.Mismatches, queryresult.MetadataMismatch{
+				Hash:     encodeHash(e.hash),
+				Provider: e.provider.String(),
+				Claim:    e.claim.String(),
+				Fields:   e.fields,
+			})
+		case traceUnsupported:
+			d.UnsupportedIndexes = append(d.UnsupportedIndexes, queryresult.UnsupportedIndex{
+				Hash:      encodeHash(e.hash),
+				Provider:  e.provider.String(),
+				Version:   e.unsupported.Found,
+				Supported: e.unsupported.Supported,
+			})
+		}
+	}
+	if found && len(d.UnsupportedIndexes) == 0 {
+		return queryresult.HashDiagnosis{}, false
+	}
+	switch {
+	case len(d.UnsupportedIndexes) > 0:
+		d.Outcome = queryresult.OutcomeUnsupportedIndex
+	case records == 0:
+		d.Outcome = queryresult.OutcomeUnknown
+	case matches == 0:
+		d.Outcome = queryresult.OutcomeFiltered
+	case failed:
+		d.Outcome = queryresult.OutcomeFetchFailed
+	case len(d.Skipped) > 0 || len(d.Limits) > 0:
+		d.Outcome = queryresult.OutcomeProvidersSkipped
+	default:
+		d.Outcome = queryresult.OutcomeNoClaims
+	}
+	return d, true
+}
+
+func encodeHash(hash multihash.Multihash) string {
+	encoded, _ := multibase.Encode(multibase.Base58BTC, hash)
+	return encoded
+}
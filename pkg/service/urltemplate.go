@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multibase"
+)
+
+// urlTemplateCacheSize is the number of providers whose parsed blob URL
+// templates are remembered
+const urlTemplateCacheSize = 1024
+
+// urlTemplatePlaceholder matches a placeholder in a blob URL template
+var urlTemplatePlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// urlTemplatePlaceholders are the placeholders a blob URL template may contain,
+// with how each is filled in for a shard
+var urlTemplatePlaceholders = map[string]func(shard cid.Cid) (string, error){
+	"{blobCID}": func(shard cid.Cid) (string, error) { return shard.String(), nil },
+	"{shard}":   func(shard cid.Cid) (string, error) { return shard.String(), nil },
+	"{multihash}": func(shard cid.Cid) (string, error) {
+		return multibase.Encode(multibase.Base58BTC, shard.Hash())
+	},
+}
+
+// urlTemplate is a provider's pattern for the URLs blobs are retrieved from
+type urlTemplate struct {
+	raw          string
+	placeholders []string
+}
+
+// parseURLTemplate checks that a blob URL template is an HTTP URL containing
+// at least one placeholder, and only placeholders that are understood
+func parseURLTemplate(raw string) (*urlTemplate, error) {
+	placeholders := urlTemplatePlaceholder.FindAllString(raw, -1)
+	if len(placeholders) == 0 {
+		return nil, errors.New("no placeholder for the blob")
+	}
+	for _, p := range placeholders {
+		if _, ok := urlTemplatePlaceholders[p]; !ok {
+			return nil, fmt.Errorf("unknown placeholder: %s", p)
+		}
+	}
+	u, err := url.Parse(urlTemplatePlaceholder.ReplaceAllString(raw, "x"))
+	if err != nil {
+		return nil, err
+	}
+	if !(u.Scheme == "http" || u.Scheme == "https") || u.Host == "" {
+		return nil, errors.New("not an http url")
+	}
+	return &urlTemplate{raw: raw, placeholders: placeholders}, nil
+}
+
+// expand returns the URL the shard is retrieved from
+func (t *urlTemplate) expand(shard cid.Cid) (*url.URL, error) {
+	expanded := t.raw
+	for _, p := range t.placeholders {
+		value, err := urlTemplatePlaceholders[p](shard)
+		if err != nil {
+			return nil, err
+		}
+		expanded = strings.ReplaceAll(expanded, p, value)
+	}
+	return url.Parse(expanded)
+}
+
+type urlTemplateEntry struct {
+	raw      string
+	template *urlTemplate
+	err      error
+}
+
+// urlTemplates remembers the parsed blob URL template of each provider, so that
+// a template is only parsed again if the provider advertises a different one
+type urlTemplates struct {
+	cache *lru.Cache[peer.ID, urlTemplateEntry]
+}
+
+func newURLTemplates(size int) *urlTemplates {
+	cache, err := lru.New[peer.ID, urlTemplateEntry](size)
+	if err != nil {
+		panic(err)
+	}
+	return &urlTemplates{cache: cache}
+}
+
+// get returns the provider's parsed template. A malformed template is logged
+// the first time it is seen
+func (u *urlTemplates) get(provider peer.ID, raw string) (*urlTemplate, error) {
+	if entry, ok := u.cache.Get(provider); ok && entry.raw == raw {
+		return entry.template, entry.err
+	}
+	template, err := parseURLTemplate(raw)
+	if err != nil {
+		log.Warnw("ignoring malformed blob URL template", "provider", provider, "template", raw, "error", err)
+	}
+	u.cache.Add(provider, urlTemplateEntry{raw: raw, template: template, err: err})
+	return template, err
+}
+
+// templateRetrievalURL returns the URL the shard is retrieved from according to
+// the provider's blob URL template, if its host is one we are allowed to
+// connect to
+func (is *IndexingService) templateRetrievalURL(ctx context.Context, provider peer.AddrInfo, raw string, shard cid.Cid) (*url.URL, error) {
+	template, err := is.urlTemplates.get(provider.ID, raw)
+	if err != nil {
+		return nil, err
+	}
+	u, err := template.expand(shard)
+	if err != nil {
+		return nil, err
+	}
+	if is.addressPolicy != nil {
+		if err := is.addressPolicy.CheckHost(ctx, u.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
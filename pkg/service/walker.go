@@ -0,0 +1,71 @@
+package service
+
+import (
+	"github.com/storacha/indexing-service/pkg/jobwalker"
+	"github.com/storacha/indexing-service/pkg/jobwalker/parallelwalk"
+	"github.com/storacha/indexing-service/pkg/jobwalker/singlewalk"
+)
+
+const (
+	// DefaultMaxQueryConcurrency is the most jobs a single query may ask to have
+	// handled at once when not otherwise configured
+	DefaultMaxQueryConcurrency = 64
+	// defaultConcurrency is that of queries asking for the parallel walker
+	// without saying how concurrent, of a service that walks jobs one at a time
+	defaultConcurrency = 5
+)
+
+// Walker chooses how the jobs of a query are walked
+type Walker string
+
+const (
+	// WalkerDefault walks with the walker the service was constructed with
+	WalkerDefault Walker = ""
+	// WalkerSingle handles jobs one at a time, which costs the least for
+	// queries with little to do
+	WalkerSingle Walker = "single"
+	// WalkerParallel handles jobs concurrently
+	WalkerParallel Walker = "parallel"
+	// WalkerAuto walks queries for a single hash one job at a time, and others
+	// concurrently
+	WalkerAuto Walker = "auto"
+)
+
+// WithMaxQueryConcurrency sets the most jobs a single query may ask to have
+// handled at once. Queries asking for more are clamped to it
+func WithMaxQueryConcurrency(concurrency int) Option {
+	return func(is *IndexingService) {
+		is.maxQueryConcurrency = concurrency
+	}
+}
+
+// walkerFor returns the walker for the jobs of the query. Walkers are closures
+// over their options, so one is cheap to make for each query that overrides the
+// service's walker, and the service's own is used as is for the others
+func (is *IndexingService) walkerFor(q *Query) jobwalker.JobWalker[job, queryState] {
+	concurrency := is.concurrency
+	if concurrency <= 1 {
+		concurrency = defaultConcurrency
+	}
+	if q.Concurrency > 0 {
+		concurrency = min(q.Concurrency, max(is.maxQueryConcurrency, 1))
+	}
+	parallel := func() jobwalker.JobWalker[job, queryState] {
+		return parallelwalk.NewParallelWalk[job, queryState](jobwalker.WithConcurrency(concurrency))
+	}
+	switch q.Walker {
+	case WalkerSingle:
+		return singlewalk.SingleWalker[job, queryState]
+	case WalkerParallel:
+		return parallel()
+	case WalkerAuto:
+		if len(q.Hashes) == 1 {
+			return singlewalk.SingleWalker[job, queryState]
+		}
+		return parallel()
+	}
+	if q.Concurrency > 0 {
+		return parallel()
+	}
+	return is.jobWalker
+}
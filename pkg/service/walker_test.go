@@ -0,0 +1,102 @@
+package service_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/service"
+	"github.com/storacha/indexing-service/pkg/service/providerindex"
+	"github.com/stretchr/testify/require"
+)
+
+// peakProviderIndex counts the most lookups it has had in flight at once
+type peakProviderIndex struct {
+	mockProviderIndex
+	delay          time.Duration
+	lk             sync.Mutex
+	inFlight, peak int
+}
+
+func (m *peakProviderIndex) FindDetailed(ctx context.Context, qk providerindex.QueryKey) (providerindex.FindResult, error) {
+	m.lk.Lock()
+	m.inFlight++
+	m.peak = max(m.peak, m.inFlight)
+	m.lk.Unlock()
+	time.Sleep(m.delay)
+	m.lk.Lock()
+	m.inFlight--
+	m.lk.Unlock()
+	return providerindex.FindResult{}, nil
+}
+
+// query runs the query, returning the most lookups it had in flight at once
+func (m *peakProviderIndex) query(t *testing.T, is *service.IndexingService, q service.Query) int {
+	m.lk.Lock()
+	m.peak = 0
+	m.lk.Unlock()
+	testutil.Must(is.Query(context.Background(), q))(t)
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.peak
+}
+
+func TestIndexingService__QueryWalker(t *testing.T) {
+	hashes := testutil.RandomMultihashes(16)
+	single := []multihash.Multihash{hashes[0]}
+	providerIndex := &peakProviderIndex{delay: 10 * time.Millisecond}
+	is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, nil, providerIndex, service.WithConcurrency(2), service.WithMaxQueryConcurrency(4)))(t)
+
+	t.Run("concurrency above the ceiling is clamped", func(t *testing.T) {
+		require.Equal(t, 4, providerIndex.query(t, is, service.Query{Hashes: hashes, Concurrency: 100}))
+		require.Equal(t, 3, providerIndex.query(t, is, service.Query{Hashes: hashes, Concurrency: 3}))
+	})
+
+	t.Run("overrides don't leak into later queries", func(t *testing.T) {
+		require.Equal(t, 4, providerIndex.query(t, is, service.Query{Hashes: hashes, Concurrency: 4}))
+		require.Equal(t, 2, providerIndex.query(t, is, service.Query{Hashes: hashes}))
+		require.Equal(t, 1, providerIndex.query(t, is, service.Query{Hashes: hashes, Walker: service.WalkerSingle}))
+		require.Equal(t, 2, providerIndex.query(t, is, service.Query{Hashes: hashes}))
+	})
+
+	t.Run("auto walks single hashes one job at a time", func(t *testing.T) {
+		require.Equal(t, 1, providerIndex.query(t, is, service.Query{Hashes: single, Walker: service.WalkerAuto}))
+		require.Equal(t, 2, providerIndex.query(t, is, service.Query{Hashes: hashes, Walker: service.WalkerAuto}))
+	})
+
+	t.Run("services walking one job at a time walk in parallel on request", func(t *testing.T) {
+		is := testutil.Must(service.NewIndexingService(&mockBlobIndexLookup{}, nil, providerIndex))(t)
+		require.Equal(t, 1, providerIndex.query(t, is, service.Query{Hashes: hashes}))
+		require.Greater(t, providerIndex.query(t, is, service.Query{Hashes: hashes, Walker: service.WalkerParallel}), 1)
+		require.Equal(t, 3, providerIndex.query(t, is, service.Query{Hashes: hashes, Concurrency: 3}))
+		require.Equal(t, 1, providerIndex.query(t, is, service.Query{Hashes: hashes}))
+	})
+}
+
+// BenchmarkIndexingService__SingleHashWalker compares the latency of queries
+// for a single hash walked in parallel with those walked as auto selects
+func BenchmarkIndexingService__SingleHashWalker(b *testing.B) {
+	providerIndex := &peakProviderIndex{}
+	is, err := service.NewIndexingService(&mockBlobIndexLookup{}, nil, providerIndex, service.WithConcurrency(16))
+	require.NoError(b, err)
+	hashes := []multihash.Multihash{testutil.RandomMultihash()}
+	for _, bc := range []struct {
+		name   string
+		walker service.Walker
+	}{
+		{"forced parallel", service.WalkerParallel},
+		{"auto", service.WalkerAuto},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			q := service.Query{Hashes: hashes, Walker: bc.walker}
+			for range b.N {
+				if _, err := is.Query(context.Background(), q); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
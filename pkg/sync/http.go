@@ -0,0 +1,108 @@
+package sync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxRecordsRowSize limits the size in bytes of a line of records sent by a
+// remote
+const maxRecordsRowSize = 16 << 20
+
+// HTTPRemote is the source of a sync served by the sync endpoints of another
+// indexing service deployment
+type HTTPRemote struct {
+	url        string
+	token      string
+	httpClient *http.Client
+}
+
+var _ Remote = (*HTTPRemote)(nil)
+
+// NewHTTPRemote returns a remote for the deployment at the given base URL,
+// authorized with the given admin bearer token
+func NewHTTPRemote(baseURL string, token string, httpClient *http.Client) *HTTPRemote {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &HTTPRemote{url: strings.TrimSuffix(baseURL, "/"), token: token, httpClient: httpClient}
+}
+
+// Manifest fetches a page of the manifest of the remote
+func (r *HTTPRemote) Manifest(ctx context.Context, cursor string, limit int) (ManifestPage, error) {
+	params := url.Values{"limit": {strconv.Itoa(limit)}}
+	if cursor != "" {
+		params.Set("cursor", cursor)
+	}
+	resp, err := r.get(ctx, "/sync/manifest", params)
+	if err != nil {
+		return ManifestPage{}, err
+	}
+	defer resp.Body.Close()
+	var page ManifestPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return ManifestPage{}, fmt.Errorf("decoding manifest: %w", err)
+	}
+	return page, nil
+}
+
+// Records fetches the records of a page of hashes in the ranges from the
+// remote
+func (r *HTTPRemote) Records(ctx context.Context, ranges []int, cursor string, limit int, yield func(RecordsRow) error) (string, error) {
+	rs := make([]string, 0, len(ranges))
+	for _, rng := range ranges {
+		rs = append(rs, strconv.Itoa(rng))
+	}
+	params := url.Values{"ranges": {strings.Join(rs, ",")}, "limit": {strconv.Itoa(limit)}}
+	if cursor != "" {
+		params.Set("cursor", cursor)
+	}
+	resp, err := r.get(ctx, "/sync/records", params)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, maxRecordsRowSize)
+	for scanner.Scan() {
+		var row RecordsRow
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return "", fmt.Errorf("decoding records: %w", err)
+		}
+		if err := yield(row); err != nil {
+			return "", err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("reading records: %w", err)
+	}
+	// the trailer is only read once the body has been
+	return resp.Trailer.Get("Next-Cursor"), nil
+}
+
+func (r *HTTPRemote) get(ctx context.Context, path string, params url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("failure response from %s. status: %s, message: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
@@ -0,0 +1,107 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/ipni/go-libipni/find/model"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+// SourceOption configures a Source
+type SourceOption func(*Source)
+
+// WithRangeBits sets the number of leading bits of the digest of a hash naming
+// its range, up to MaxRangeBits. More ranges make the records fetched for each
+// range that doesn't match fewer, and the manifest longer. If not set,
+// DefaultRangeBits is used
+func WithRangeBits(bits int) SourceOption {
+	return func(s *Source) {
+		s.bits = min(max(bits, 1), MaxRangeBits)
+	}
+}
+
+// Source describes the provider cache of a deployment to destinations syncing
+// from it, and sends them the records of the ranges they ask for
+type Source struct {
+	store Store
+	bits  int
+}
+
+var _ Remote = (*Source)(nil)
+
+// NewSource returns a source describing the given store
+func NewSource(store Store, opts ...SourceOption) *Source {
+	s := &Source{store: store, bits: DefaultRangeBits}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Manifest returns the page of up to limit ranges starting at the cursor. An
+// empty cursor starts at the first range, and a limit of zero or less returns
+// every range in one page. Each page is a scan of every hash in the store, of
+// which the records of those in the page's ranges are read
+func (s *Source) Manifest(ctx context.Context, cursor string, limit int) (ManifestPage, error) {
+	ranges := 1 << s.bits
+	start := 0
+	if cursor != "" {
+		var err error
+		start, err = strconv.Atoi(cursor)
+		if err != nil || start <= 0 || start >= ranges {
+			return ManifestPage{}, types.ErrInvalidCursor
+		}
+	}
+	end := ranges
+	if limit > 0 {
+		end = min(start+limit, ranges)
+	}
+	digests, err := summarize(ctx, s.store, s.bits, start, end)
+	if err != nil {
+		return ManifestPage{}, err
+	}
+	page := ManifestPage{Bits: s.bits, Start: start, End: end, Ranges: digests}
+	if end < ranges {
+		page.Next = strconv.Itoa(end)
+	}
+	return page, nil
+}
+
+// Records yields the records of up to about limit hashes in the ranges,
+// starting at the cursor, and returns the cursor to continue from. An empty
+// cursor starts at the first hash, and an empty next cursor is returned once
+// every hash in the ranges was yielded. A limit of zero or less yields every
+// hash in one call. Hashes may be yielded again by later calls
+func (s *Source) Records(ctx context.Context, ranges []int, cursor string, limit int, yield func(RecordsRow) error) (string, error) {
+	if len(ranges) == 0 || len(ranges) > MaxRecordsRanges || slices.ContainsFunc(ranges, func(r int) bool { return r < 0 || r >= 1<<s.bits }) {
+		return "", fmt.Errorf("%w: expected from 1 to %d ranges below %d", ErrInvalidRanges, MaxRecordsRanges, 1<<s.bits)
+	}
+	var scan uint64
+	if cursor != "" {
+		var err error
+		scan, err = strconv.ParseUint(cursor, 10, 64)
+		// the scan cursor of records that aren't done is never zero
+		if err != nil || scan == 0 {
+			return "", types.ErrInvalidCursor
+		}
+	}
+	in := make(map[int]bool, len(ranges))
+	for _, r := range ranges {
+		in[r] = true
+	}
+	next, err := scanRanges(ctx, s.store, s.bits, func(r int) bool { return in[r] }, scan, limit, func(hash mh.Multihash, results []model.ProviderResult) error {
+		row, err := newRecordsRow(hash, results)
+		if err != nil {
+			return err
+		}
+		return yield(row)
+	})
+	if err != nil || next == 0 {
+		return "", err
+	}
+	return strconv.FormatUint(next, 10), nil
+}
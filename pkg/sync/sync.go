@@ -0,0 +1,267 @@
+// Package sync copies what is missing from the provider cache of one indexing
+// service deployment to another, such as the deployment taking over from it in
+// a blue/green cutover, or that of a new region being bootstrapped.
+//
+// The hashes of a cache are split into ranges by the leading bits of their
+// SHA-256 digest. The source describes its cache with a manifest of the ranges
+// holding records, each with a digest of the normalized provider records of its
+// hashes. The destination compares the manifest with the digests of its own
+// ranges, fetches the records of the ranges that don't match from the source,
+// and merges them into its cache, skipping records of providers it removed.
+//
+// A pass over the manifest is made a page of ranges at a time, and can be
+// resumed from the cursor of the page it got to. Nothing is held still while a
+// pass is made, so records written to either cache during it may or may not be
+// synced by it. Repeated passes converge instead: once a pass writes nothing,
+// every record the source had throughout it is in the destination. Ranges in
+// which the destination has records the source doesn't, including those it
+// drops as their provider was removed, never match, so they are fetched again
+// by every pass although nothing more of them is written
+package sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multibase"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/types"
+)
+
+var log = logging.Logger("sync")
+
+const (
+	// DefaultRangeBits is the number of leading bits of the digest of a hash
+	// naming its range, splitting a cache into 4096 ranges
+	DefaultRangeBits = 12
+	// MaxRangeBits is the most leading bits ranges are named by
+	MaxRangeBits = 16
+	// MaxRecordsRanges is the most ranges the records of which are asked for at
+	// once
+	MaxRecordsRanges = 256
+)
+
+// scanCount is the number of hashes asked for by each scan of a store
+const scanCount = 1000
+
+// ErrInvalidRanges is returned when asked for the records of ranges beyond the
+// ranges of the source, or too many of them
+var ErrInvalidRanges = errors.New("invalid ranges")
+
+// Store is a provider cache whose hashes can be iterated, such as
+// redis.ProviderStore
+type Store interface {
+	types.ProviderStore
+	// Scan returns a batch of about count of the hashes stored, starting at the
+	// cursor, along with the cursor of the next batch, which is 0 after the
+	// last. Hashes stored throughout the iteration are returned at least once
+	Scan(ctx context.Context, cursor uint64, count int) ([]mh.Multihash, uint64, error)
+}
+
+// ManifestPage describes a page of the ranges of a cache
+type ManifestPage struct {
+	// Bits is the number of leading bits of the SHA-256 digest of a hash naming
+	// its range
+	Bits int `json:"bits"`
+	// Start and End are the first range of the page and the range after the
+	// last
+	Start int `json:"start"`
+	End   int `json:"end"`
+	// Ranges are the ranges of the page holding records, in order
+	Ranges []RangeDigest `json:"ranges"`
+	// Next is the cursor of the next page, empty after the last
+	Next string `json:"next"`
+}
+
+// RangeDigest describes the records of a range
+type RangeDigest struct {
+	Range int `json:"range"`
+	// Hashes is the number of hashes in the range with records
+	Hashes int `json:"hashes"`
+	// Digest is the SHA-256 digest of the digests of the normalized records of
+	// each hash in the range, in order
+	Digest []byte `json:"digest"`
+}
+
+// RecordsRow is the records of a hash, as sent from the source
+type RecordsRow struct {
+	// Multihash is the base58btc multibase multihash
+	Multihash string           `json:"multihash"`
+	Records   []ProviderRecord `json:"records"`
+}
+
+// ProviderRecord is a provider record, as sent from the source
+type ProviderRecord struct {
+	// Provider is the peer ID of the provider, empty for records without one
+	Provider  string   `json:"provider,omitempty"`
+	Addrs     []string `json:"addrs,omitempty"`
+	ContextID []byte   `json:"contextID"`
+	Metadata  []byte   `json:"metadata"`
+}
+
+func newRecordsRow(hash mh.Multihash, results []model.ProviderResult) (RecordsRow, error) {
+	encoded, err := multibase.Encode(multibase.Base58BTC, hash)
+	if err != nil {
+		return RecordsRow{}, fmt.Errorf("encoding multihash: %w", err)
+	}
+	row := RecordsRow{Multihash: encoded, Records: make([]ProviderRecord, 0, len(results))}
+	for _, result := range results {
+		record := ProviderRecord{ContextID: result.ContextID, Metadata: result.Metadata}
+		if result.Provider != nil {
+			record.Provider = result.Provider.ID.String()
+			for _, addr := range result.Provider.Addrs {
+				record.Addrs = append(record.Addrs, addr.String())
+			}
+		}
+		row.Records = append(row.Records, record)
+	}
+	return row, nil
+}
+
+// Decode returns the hash and provider records of the row
+func (r RecordsRow) Decode() (mh.Multihash, []model.ProviderResult, error) {
+	_, data, err := multibase.Decode(r.Multihash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding multihash: %w", err)
+	}
+	hash, err := mh.Cast(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding multihash: %w", err)
+	}
+	results := make([]model.ProviderResult, 0, len(r.Records))
+	for _, record := range r.Records {
+		result := model.ProviderResult{ContextID: record.ContextID, Metadata: record.Metadata}
+		if record.Provider != "" {
+			id, err := peer.Decode(record.Provider)
+			if err != nil {
+				return nil, nil, fmt.Errorf("decoding provider of %s: %w", r.Multihash, err)
+			}
+			result.Provider = &peer.AddrInfo{ID: id}
+			for _, a := range record.Addrs {
+				addr, err := multiaddr.NewMultiaddr(a)
+				if err != nil {
+					return nil, nil, fmt.Errorf("decoding provider address of %s: %w", r.Multihash, err)
+				}
+				result.Provider.Addrs = append(result.Provider.Addrs, addr)
+			}
+		}
+		results = append(results, result)
+	}
+	return hash, results, nil
+}
+
+// RangeOf returns the range a hash is in, of ranges named by the given number
+// of leading bits of the SHA-256 digest of the hash
+func RangeOf(bits int, hash mh.Multihash) int {
+	sum := sha256.Sum256(hash)
+	return int(binary.BigEndian.Uint32(sum[:4]) >> (32 - bits))
+}
+
+// digestRecords digests the hash along with its records, normalized so that
+// records providerresults.Equals holds for digest the same, in any order
+func digestRecords(hash mh.Multihash, results []model.ProviderResult) [sha256.Size]byte {
+	encoded := make([][]byte, 0, len(results))
+	for _, result := range results {
+		var provider []byte
+		if result.Provider != nil {
+			provider = append([]byte{1}, result.Provider.String()...)
+		}
+		var b []byte
+		for _, field := range [][]byte{result.ContextID, result.Metadata, provider} {
+			b = binary.AppendUvarint(b, uint64(len(field)))
+			b = append(b, field...)
+		}
+		encoded = append(encoded, b)
+	}
+	slices.SortFunc(encoded, bytes.Compare)
+	encoded = slices.CompactFunc(encoded, bytes.Equal)
+	h := sha256.New()
+	h.Write(binary.AppendUvarint(nil, uint64(len(hash))))
+	h.Write(hash)
+	for _, b := range encoded {
+		h.Write(b)
+	}
+	return [sha256.Size]byte(h.Sum(nil))
+}
+
+// summarize digests the ranges of the store from start to end
+func summarize(ctx context.Context, store Store, bits int, start, end int) ([]RangeDigest, error) {
+	digests := map[int][][sha256.Size]byte{}
+	in := func(r int) bool { return r >= start && r < end }
+	_, err := scanRanges(ctx, store, bits, in, 0, 0, func(hash mh.Multihash, results []model.ProviderResult) error {
+		r := RangeOf(bits, hash)
+		digests[r] = append(digests[r], digestRecords(hash, results))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ranges := make([]RangeDigest, 0, len(digests))
+	for r, hashes := range digests {
+		slices.SortFunc(hashes, func(a, b [sha256.Size]byte) int { return bytes.Compare(a[:], b[:]) })
+		h := sha256.New()
+		for _, d := range hashes {
+			h.Write(d[:])
+		}
+		ranges = append(ranges, RangeDigest{Range: r, Hashes: len(hashes), Digest: h.Sum(nil)})
+	}
+	slices.SortFunc(ranges, func(a, b RangeDigest) int { return a.Range - b.Range })
+	return ranges, nil
+}
+
+// scanRanges calls each with the records of the hashes of the store in the
+// ranges in selects, from the scan cursor until the end of the store, or the
+// end of the scan batch in which limit hashes with records were seen if limit
+// is more than zero. It returns the cursor to continue from, which is 0 at the
+// end. A hash the scan returns more than once is only seen once, and hashes
+// without records are skipped
+func scanRanges(ctx context.Context, store Store, bits int, in func(int) bool, cursor uint64, limit int, each func(mh.Multihash, []model.ProviderResult) error) (uint64, error) {
+	seen := map[string]struct{}{}
+	n := 0
+	for {
+		hashes, next, err := store.Scan(ctx, cursor, scanCount)
+		if err != nil {
+			return 0, fmt.Errorf("scanning provider records: %w", err)
+		}
+		for _, hash := range hashes {
+			if !in(RangeOf(bits, hash)) {
+				continue
+			}
+			if _, ok := seen[string(hash)]; ok {
+				continue
+			}
+			seen[string(hash)] = struct{}{}
+			results, err := store.Get(ctx, hash)
+			if err != nil {
+				// the hash expired since it was scanned
+				if errors.Is(err, types.ErrKeyNotFound) {
+					continue
+				}
+				return 0, fmt.Errorf("reading provider records of %s: %w", hash.B58String(), err)
+			}
+			if len(results) == 0 {
+				continue
+			}
+			if err := each(hash, results); err != nil {
+				return 0, err
+			}
+			n++
+		}
+		if next == 0 || (limit > 0 && n >= limit) {
+			return next, nil
+		}
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		cursor = next
+	}
+}
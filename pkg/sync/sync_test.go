@@ -0,0 +1,331 @@
+package sync_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/internal/testutil"
+	"github.com/storacha/indexing-service/pkg/providerresults"
+	cachesync "github.com/storacha/indexing-service/pkg/sync"
+	"github.com/storacha/indexing-service/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// memStore is a provider store safe for concurrent use, scanned in key order
+type memStore struct {
+	lk      gosync.Mutex
+	results map[string][]model.ProviderResult
+}
+
+func newMemStore() *memStore {
+	return &memStore{results: map[string][]model.ProviderResult{}}
+}
+
+func (s *memStore) Get(ctx context.Context, hash mh.Multihash) ([]model.ProviderResult, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	results, ok := s.results[string(hash)]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	return slices.Clone(results), nil
+}
+
+func (s *memStore) Set(ctx context.Context, hash mh.Multihash, results []model.ProviderResult, expires bool) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.results[string(hash)] = slices.Clone(results)
+	return nil
+}
+
+func (s *memStore) SetExpirable(ctx context.Context, hash mh.Multihash, expires bool) error {
+	return nil
+}
+
+// Scan returns the hashes in key order, the cursor being the position of the
+// next
+func (s *memStore) Scan(ctx context.Context, cursor uint64, count int) ([]mh.Multihash, uint64, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	keys := make([]string, 0, len(s.results))
+	for key := range s.results {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	start := min(int(cursor), len(keys))
+	end := min(start+count, len(keys))
+	hashes := make([]mh.Multihash, 0, end-start)
+	for _, key := range keys[start:end] {
+		hashes = append(hashes, mh.Multihash(key))
+	}
+	if end == len(keys) {
+		return hashes, 0, nil
+	}
+	return hashes, uint64(end), nil
+}
+
+// contains returns true if the store has every record of the other store,
+// except those of the removed provider
+func (s *memStore) contains(other *memStore, removed peer.ID) bool {
+	other.lk.Lock()
+	defer other.lk.Unlock()
+	for key, results := range other.results {
+		have, _ := s.Get(context.Background(), mh.Multihash(key))
+		for _, result := range results {
+			if result.Provider != nil && result.Provider.ID == removed {
+				continue
+			}
+			if !slices.ContainsFunc(have, func(r model.ProviderResult) bool { return providerresults.Equals(r, result) }) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+type tombstones map[peer.ID]types.ProviderTombstone
+
+func (t tombstones) Get(ctx context.Context, id peer.ID) (types.ProviderTombstone, error) {
+	tombstone, ok := t[id]
+	if !ok {
+		return types.ProviderTombstone{}, types.ErrKeyNotFound
+	}
+	return tombstone, nil
+}
+
+func (t tombstones) Set(ctx context.Context, id peer.ID, tombstone types.ProviderTombstone, expires bool) error {
+	t[id] = tombstone
+	return nil
+}
+
+func (t tombstones) SetExpirable(ctx context.Context, id peer.ID, expires bool) error {
+	return nil
+}
+
+// hookedRemote calls the hook before each page of the manifest is read, which
+// fails the read if it returns an error
+type hookedRemote struct {
+	cachesync.Remote
+	pages int
+	hook  func(page int) error
+}
+
+func (r *hookedRemote) Manifest(ctx context.Context, cursor string, limit int) (cachesync.ManifestPage, error) {
+	r.pages++
+	if r.hook != nil {
+		if err := r.hook(r.pages); err != nil {
+			return cachesync.ManifestPage{}, err
+		}
+	}
+	return r.Remote.Manifest(ctx, cursor, limit)
+}
+
+func seed(t *testing.T, n int, stores ...*memStore) []mh.Multihash {
+	hashes := testutil.RandomMultihashes(n)
+	for _, hash := range hashes {
+		result := testutil.RandomProviderResult()
+		for _, s := range stores {
+			require.NoError(t, s.Set(context.Background(), hash, []model.ProviderResult{result}, true))
+		}
+	}
+	return hashes
+}
+
+func TestSyncer(t *testing.T) {
+	ctx := context.Background()
+	const bits = 8
+
+	t.Run("divergent caches converge within two passes", func(t *testing.T) {
+		const bits = 10
+		src, dst := newMemStore(), newMemStore()
+		common := seed(t, 1000, src, dst)
+		// the hashes whose records differ
+		diff := seed(t, 100, src)
+		diff = append(diff, seed(t, 10, dst)...)
+		for _, hash := range common[:10] {
+			results := testutil.Must(src.Get(ctx, hash))(t)
+			require.NoError(t, src.Set(ctx, hash, append(results, testutil.RandomProviderResult()), true))
+			diff = append(diff, hash)
+		}
+		for _, hash := range common[10:15] {
+			results := testutil.Must(dst.Get(ctx, hash))(t)
+			require.NoError(t, dst.Set(ctx, hash, append(results, testutil.RandomProviderResult()), true))
+			diff = append(diff, hash)
+		}
+		// records of a removed provider are never written
+		removed := testutil.RandomProviderResult()
+		for _, hash := range testutil.RandomMultihashes(5) {
+			require.NoError(t, src.Set(ctx, hash, []model.ProviderResult{removed}, true))
+			diff = append(diff, hash)
+		}
+		require.NoError(t, src.Set(ctx, common[20], append(testutil.Must(src.Get(ctx, common[20]))(t), removed), true))
+		diff = append(diff, common[20])
+
+		// the ranges of the source that don't match are those holding the hashes
+		// that differ, and of the source hashes only those in them are fetched
+		differ := map[int]bool{}
+		for _, hash := range diff {
+			differ[cachesync.RangeOf(bits, hash)] = true
+		}
+		mismatched := map[int]bool{}
+		expected := 0
+		for key := range src.results {
+			if r := cachesync.RangeOf(bits, mh.Multihash(key)); differ[r] {
+				mismatched[r] = true
+				expected++
+			}
+		}
+
+		source := cachesync.NewSource(src, cachesync.WithRangeBits(bits))
+		syncer := cachesync.NewSyncer(dst, cachesync.WithManifestPageSize(64), cachesync.WithRecordsPageSize(3), cachesync.WithTombstones(tombstones{removed.Provider.ID: {}}))
+		var pages []cachesync.Progress
+		first := testutil.Must(syncer.Sync(ctx, source, "", func(p cachesync.Progress) { pages = append(pages, p) }))(t)
+		require.Len(t, pages, 16)
+		require.Equal(t, first, pages[15])
+		require.True(t, first.Done())
+		require.Equal(t, 1<<bits, first.Ranges)
+		require.Equal(t, len(mismatched), first.Mismatched)
+		require.True(t, dst.contains(src, removed.Provider.ID))
+		require.Equal(t, 110, first.Written)
+		require.Equal(t, expected, first.Fetched)
+		require.Less(t, first.Fetched, len(src.results)/4)
+
+		// ranges with records only the destination has are fetched again, but
+		// nothing more is written
+		second := testutil.Must(syncer.Sync(ctx, source, "", nil))(t)
+		require.Zero(t, second.Written)
+		require.Less(t, second.Fetched, first.Fetched)
+		for _, hash := range diff[len(diff)-6 : len(diff)-1] {
+			_, err := dst.Get(ctx, hash)
+			require.ErrorIs(t, err, types.ErrKeyNotFound)
+		}
+	})
+
+	t.Run("interrupted passes resume from their cursor", func(t *testing.T) {
+		src, dst := newMemStore(), newMemStore()
+		seed(t, 100, src)
+		remote := &hookedRemote{Remote: cachesync.NewSource(src, cachesync.WithRangeBits(bits)), hook: func(page int) error {
+			if page == 3 {
+				return errors.New("connection reset")
+			}
+			return nil
+		}}
+		syncer := cachesync.NewSyncer(dst, cachesync.WithManifestPageSize(64))
+		progress, err := syncer.Sync(ctx, remote, "", nil)
+		require.ErrorContains(t, err, "connection reset")
+		require.Equal(t, "128", progress.Cursor)
+		require.False(t, dst.contains(src, ""))
+
+		progress = testutil.Must(syncer.Sync(ctx, remote, progress.Cursor, nil))(t)
+		require.True(t, progress.Done())
+		require.Equal(t, 128, progress.Ranges)
+		require.True(t, dst.contains(src, ""))
+	})
+
+	t.Run("records written during a pass are synced by the next", func(t *testing.T) {
+		src, dst := newMemStore(), newMemStore()
+		seed(t, 100, src)
+		var added []mh.Multihash
+		remote := &hookedRemote{Remote: cachesync.NewSource(src, cachesync.WithRangeBits(bits)), hook: func(page int) error {
+			// write to ranges the pass has and hasn't got to yet
+			if page == 2 {
+				added = seed(t, 100, src)
+			}
+			return nil
+		}}
+		syncer := cachesync.NewSyncer(dst, cachesync.WithManifestPageSize(64))
+		first := testutil.Must(syncer.Sync(ctx, remote, "", nil))(t)
+		require.Greater(t, first.Written, 100)
+		require.Less(t, first.Written, 200)
+		require.False(t, dst.contains(src, ""))
+
+		second := testutil.Must(syncer.Sync(ctx, remote, "", nil))(t)
+		require.Equal(t, 200-first.Written, second.Written)
+		require.True(t, dst.contains(src, ""))
+		require.Len(t, added, 100)
+		third := testutil.Must(syncer.Sync(ctx, remote, "", nil))(t)
+		require.Zero(t, third.Written)
+		require.Zero(t, third.Fetched)
+	})
+
+	t.Run("fetches are rate limited", func(t *testing.T) {
+		src, dst := newMemStore(), newMemStore()
+		seed(t, 10, src)
+		syncer := cachesync.NewSyncer(dst, cachesync.WithRateLimit(100, 1))
+		start := time.Now()
+		progress := testutil.Must(syncer.Sync(ctx, cachesync.NewSource(src), "", nil))(t)
+		require.Equal(t, 10, progress.Fetched)
+		require.GreaterOrEqual(t, time.Since(start), 80*time.Millisecond)
+	})
+}
+
+func TestSource(t *testing.T) {
+	ctx := context.Background()
+	src := newMemStore()
+	hashes := seed(t, 100, src)
+	source := cachesync.NewSource(src, cachesync.WithRangeBits(4))
+
+	t.Run("manifest pages cover every range", func(t *testing.T) {
+		var ranges []cachesync.RangeDigest
+		cursor := ""
+		for {
+			page := testutil.Must(source.Manifest(ctx, cursor, 5))(t)
+			require.Equal(t, 4, page.Bits)
+			ranges = append(ranges, page.Ranges...)
+			if page.Next == "" {
+				require.Equal(t, 16, page.End)
+				break
+			}
+			cursor = page.Next
+		}
+		total := 0
+		for _, r := range ranges {
+			total += r.Hashes
+		}
+		require.Equal(t, len(hashes), total)
+		require.Equal(t, ranges, testutil.Must(source.Manifest(ctx, "", 0))(t).Ranges)
+	})
+
+	t.Run("records of the ranges are paged", func(t *testing.T) {
+		want := 0
+		for _, hash := range hashes {
+			if r := cachesync.RangeOf(4, hash); r == 3 || r == 7 {
+				want++
+			}
+		}
+		got := map[string]bool{}
+		cursor := ""
+		for {
+			next := testutil.Must(source.Records(ctx, []int{3, 7}, cursor, 1, func(row cachesync.RecordsRow) error {
+				hash, results, err := row.Decode()
+				require.NoError(t, err)
+				require.Equal(t, testutil.Must(src.Get(ctx, hash))(t), results)
+				got[string(hash)] = true
+				return nil
+			}))(t)
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		require.Len(t, got, want)
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		_, err := source.Manifest(ctx, "16", 0)
+		require.ErrorIs(t, err, types.ErrInvalidCursor)
+		_, err = source.Records(ctx, []int{16}, "", 0, nil)
+		require.ErrorIs(t, err, cachesync.ErrInvalidRanges)
+		_, err = source.Records(ctx, nil, "", 0, nil)
+		require.ErrorIs(t, err, cachesync.ErrInvalidRanges)
+		_, err = source.Records(ctx, []int{1}, "0", 0, nil)
+		require.ErrorIs(t, err, types.ErrInvalidCursor)
+	})
+}
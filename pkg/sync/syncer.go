@@ -0,0 +1,250 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/storacha/indexing-service/pkg/providerresults"
+	"github.com/storacha/indexing-service/pkg/types"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultManifestPageSize is the number of ranges compared at a time
+	DefaultManifestPageSize = 1024
+	// DefaultRecordsPageSize is the number of hashes whose records are fetched
+	// with each request for them
+	DefaultRecordsPageSize = 1000
+)
+
+// Remote is the source of a sync, such as a Source, or one served by another
+// deployment through an HTTPRemote
+type Remote interface {
+	// Manifest returns the page of up to limit ranges starting at the cursor,
+	// see Source.Manifest
+	Manifest(ctx context.Context, cursor string, limit int) (ManifestPage, error)
+	// Records yields the records of up to about limit hashes in the ranges
+	// starting at the cursor, and returns the cursor to continue from, see
+	// Source.Records
+	Records(ctx context.Context, ranges []int, cursor string, limit int, yield func(RecordsRow) error) (string, error)
+}
+
+// Option configures a Syncer
+type Option func(*Syncer)
+
+// WithTombstones skips records of providers with a tombstone in the store,
+// which were removed from this deployment
+func WithTombstones(store types.TombstoneStore) Option {
+	return func(s *Syncer) {
+		s.tombstones = store
+	}
+}
+
+// WithRateLimit limits the hashes whose records are fetched to the given
+// number per second, with bursts of up to burst hashes. If not set, hashes are
+// fetched as fast as the source sends them
+func WithRateLimit(hashesPerSecond float64, burst int) Option {
+	return func(s *Syncer) {
+		s.limiter = rate.NewLimiter(rate.Limit(hashesPerSecond), max(burst, 1))
+	}
+}
+
+// WithManifestPageSize sets the number of ranges compared at a time. If not
+// set, DefaultManifestPageSize is used
+func WithManifestPageSize(ranges int) Option {
+	return func(s *Syncer) {
+		s.manifestPageSize = ranges
+	}
+}
+
+// WithRecordsPageSize sets the number of hashes whose records are fetched with
+// each request for them. If not set, DefaultRecordsPageSize is used
+func WithRecordsPageSize(hashes int) Option {
+	return func(s *Syncer) {
+		s.recordsPageSize = hashes
+	}
+}
+
+// Syncer syncs the provider cache of this deployment from the cache of another
+type Syncer struct {
+	store            Store
+	tombstones       types.TombstoneStore
+	limiter          *rate.Limiter
+	manifestPageSize int
+	recordsPageSize  int
+}
+
+// NewSyncer returns a syncer writing to the given store
+func NewSyncer(store Store, opts ...Option) *Syncer {
+	s := &Syncer{
+		store:            store,
+		limiter:          rate.NewLimiter(rate.Inf, 0),
+		manifestPageSize: DefaultManifestPageSize,
+		recordsPageSize:  DefaultRecordsPageSize,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Progress describes how far a pass got
+type Progress struct {
+	// Cursor is where the pass resumes from, empty once it is done
+	Cursor string
+	// Ranges is the number of ranges compared, and Mismatched the number of them
+	// that didn't match
+	Ranges     int
+	Mismatched int
+	// Fetched is the number of hashes whose records were fetched, and Written
+	// the number of them with records this deployment didn't have
+	Fetched int
+	Written int
+	// Records is the number of records written
+	Records int
+}
+
+// Done returns true once the pass has compared every range, if it didn't stop
+// with an error
+func (p Progress) Done() bool {
+	return p.Cursor == ""
+}
+
+// Sync makes a pass over the manifest of the remote starting at the cursor, or
+// the first range if it is empty, merging the records of the ranges that don't
+// match into those already cached here, and calling onProgress after each page
+// of ranges if it isn't nil. A pass that stops with an error is resumed from
+// the cursor of the progress it returns
+func (s *Syncer) Sync(ctx context.Context, remote Remote, cursor string, onProgress func(Progress)) (Progress, error) {
+	progress := Progress{Cursor: cursor}
+	tombstoned := map[peer.ID]bool{}
+	for {
+		page, err := remote.Manifest(ctx, progress.Cursor, s.manifestPageSize)
+		if err != nil {
+			return progress, fmt.Errorf("reading manifest: %w", err)
+		}
+		if page.Bits < 1 || page.Bits > MaxRangeBits || page.Start < 0 || page.End < page.Start || page.End > 1<<page.Bits {
+			return progress, fmt.Errorf("reading manifest: invalid page of ranges %d to %d of %d bits", page.Start, page.End, page.Bits)
+		}
+		local, err := summarize(ctx, s.store, page.Bits, page.Start, page.End)
+		if err != nil {
+			return progress, err
+		}
+		mismatched := mismatchedRanges(page.Ranges, local)
+		log.Debugw("compared ranges", "start", page.Start, "end", page.End, "mismatched", len(mismatched))
+		for batch := range slices.Chunk(mismatched, MaxRecordsRanges) {
+			if err := s.fetch(ctx, remote, batch, tombstoned, &progress); err != nil {
+				return progress, err
+			}
+		}
+		progress.Ranges += page.End - page.Start
+		progress.Mismatched += len(mismatched)
+		progress.Cursor = page.Next
+		if onProgress != nil {
+			onProgress(progress)
+		}
+		if page.Next == "" {
+			return progress, nil
+		}
+	}
+}
+
+// mismatchedRanges returns the ranges of the source holding records whose
+// digests don't match those of the destination
+func mismatchedRanges(source, destination []RangeDigest) []int {
+	digests := make(map[int][]byte, len(destination))
+	for _, d := range destination {
+		digests[d.Range] = d.Digest
+	}
+	var mismatched []int
+	for _, d := range source {
+		if local, ok := digests[d.Range]; !ok || string(local) != string(d.Digest) {
+			mismatched = append(mismatched, d.Range)
+		}
+	}
+	return mismatched
+}
+
+// fetch merges the records of the ranges from the remote
+func (s *Syncer) fetch(ctx context.Context, remote Remote, ranges []int, tombstoned map[peer.ID]bool, progress *Progress) error {
+	cursor := ""
+	for {
+		next, err := remote.Records(ctx, ranges, cursor, s.recordsPageSize, func(row RecordsRow) error {
+			if err := s.limiter.Wait(ctx); err != nil {
+				return err
+			}
+			hash, results, err := row.Decode()
+			if err != nil {
+				return err
+			}
+			progress.Fetched++
+			written, err := s.merge(ctx, hash, results, tombstoned)
+			if err != nil {
+				return fmt.Errorf("merging provider records of %s: %w", hash.B58String(), err)
+			}
+			if written > 0 {
+				progress.Written++
+				progress.Records += written
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("fetching records: %w", err)
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// merge writes the records of the hash that aren't already cached and whose
+// providers weren't removed, along with those that are, returning the number
+// written
+func (s *Syncer) merge(ctx context.Context, hash mh.Multihash, results []model.ProviderResult, tombstoned map[peer.ID]bool) (int, error) {
+	existing, err := s.store.Get(ctx, hash)
+	if err != nil && !errors.Is(err, types.ErrKeyNotFound) {
+		return 0, err
+	}
+	merged := slices.Clone(existing)
+	for _, result := range results {
+		if slices.ContainsFunc(merged, func(r model.ProviderResult) bool { return providerresults.Equals(r, result) }) {
+			continue
+		}
+		removed, err := s.removed(ctx, result, tombstoned)
+		if err != nil {
+			return 0, err
+		}
+		if !removed {
+			merged = append(merged, result)
+		}
+	}
+	written := len(merged) - len(existing)
+	if written == 0 {
+		return 0, nil
+	}
+	return written, s.store.Set(ctx, hash, merged, true)
+}
+
+// removed returns true if the provider of the record has a tombstone,
+// remembering the answer for the rest of the pass
+func (s *Syncer) removed(ctx context.Context, result model.ProviderResult, tombstoned map[peer.ID]bool) (bool, error) {
+	if s.tombstones == nil || result.Provider == nil {
+		return false, nil
+	}
+	removed, ok := tombstoned[result.Provider.ID]
+	if !ok {
+		_, err := s.tombstones.Get(ctx, result.Provider.ID)
+		if err != nil && !errors.Is(err, types.ErrKeyNotFound) {
+			return false, fmt.Errorf("reading tombstone: %w", err)
+		}
+		removed = err == nil
+		tombstoned[result.Provider.ID] = removed
+	}
+	return removed, nil
+}
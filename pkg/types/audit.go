@@ -0,0 +1,105 @@
+package types
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/storacha/go-ucanto/did"
+)
+
+// AuditOperation is the kind of change an audit entry records. Claims can't be
+// revoked through the service, so there is no operation for revocations: they
+// are out of scope until a revoke operation exists to audit
+type AuditOperation string
+
+const (
+	// AuditPublish is for claims published to IPNI
+	AuditPublish AuditOperation = "publish"
+	// AuditCache is for claims cached without being published
+	AuditCache AuditOperation = "cache"
+	// AuditRemoveProvider is for removals of every record of a provider
+	AuditRemoveProvider AuditOperation = "remove-provider"
+)
+
+// AuditOutcome is how an audited operation ended
+type AuditOutcome string
+
+const (
+	AuditSucceeded AuditOutcome = "succeeded"
+	AuditFailed    AuditOutcome = "failed"
+	// AuditRejected is for operations that weren't authorized, and so weren't
+	// attempted
+	AuditRejected AuditOutcome = "rejected"
+)
+
+// AuditAdminActor is the actor of operations authorized with the admin token
+// rather than a UCAN
+const AuditAdminActor = "admin"
+
+// AuditEntry records who changed what, when, and how it ended. Entries name
+// claims by CID, and never hold their bytes
+type AuditEntry struct {
+	Operation AuditOperation
+	// Actor is the DID of the issuer of the UCAN authorizing the operation, or
+	// AuditAdminActor. It is empty if the operation wasn't made on anyone's behalf
+	Actor string
+	// Claim is the claim published or cached, cid.Undef for other operations
+	Claim cid.Cid
+	// Space is the space the claim is bound to, if any
+	Space *did.DID
+	// Provider is the provider the claim was published for or the records of
+	// were removed, if known
+	Provider *peer.ID
+	// HashCount is the number of multihashes the operation was on
+	HashCount int
+	Outcome   AuditOutcome
+	// Error is why the operation failed or was rejected, if it was
+	Error string
+	Time  time.Time
+}
+
+// AuditSink records audit entries. Record only returns once the entry is
+// durable, so that operations aren't acknowledged before they are audited
+type AuditSink interface {
+	Record(ctx context.Context, entry AuditEntry) error
+}
+
+// AuditFilter selects audit entries. Entries match if they match every field
+// that is set
+type AuditFilter struct {
+	Operation AuditOperation
+	Actor     string
+	Outcome   AuditOutcome
+	// Since and Until bound the times of entries, Until exclusively
+	Since time.Time
+	Until time.Time
+	// Limit is the most entries to return at once, or a default if not set
+	Limit int
+}
+
+// AuditLog is an audit sink whose entries can be read back
+type AuditLog interface {
+	AuditSink
+	// AuditLog returns the entries matching the filter in the order they were
+	// recorded, starting after the cursor returned with the previous page. An
+	// empty cursor starts from the first entry, and an empty next cursor means
+	// there are no more entries
+	AuditLog(ctx context.Context, filter AuditFilter, cursor string) ([]AuditEntry, string, error)
+}
+
+type auditActorKey struct{}
+
+// WithAuditActor returns a context under which operations are audited as made
+// by the actor
+func WithAuditActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+// AuditActor returns the actor operations under the context are made by, or
+// the empty string if there is none
+func AuditActor(ctx context.Context) string {
+	actor, _ := ctx.Value(auditActorKey{}).(string)
+	return actor
+}
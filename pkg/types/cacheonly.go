@@ -0,0 +1,26 @@
+package types
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrCacheOnly is returned by lookups that would have to fetch from the origin
+// under a context made with WithCacheOnly
+var ErrCacheOnly = errors.New("not cached, and lookups are cache only")
+
+type cacheOnlyKey struct{}
+
+// WithCacheOnly returns a context under which lookups are answered from caches
+// alone. Nothing is fetched from IPNI or over HTTP, and what isn't cached is
+// simply not found
+func WithCacheOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheOnlyKey{}, true)
+}
+
+// IsCacheOnly returns true if lookups under the context are answered from
+// caches alone
+func IsCacheOnly(ctx context.Context) bool {
+	cacheOnly, _ := ctx.Value(cacheOnlyKey{}).(bool)
+	return cacheOnly
+}
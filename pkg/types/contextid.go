@@ -0,0 +1,123 @@
+package types
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+
+	mh "github.com/multiformats/go-multihash"
+)
+
+// ContextIDCodec is a scheme for deriving the context IDs stored in IPNI from
+// context ID data
+type ContextIDCodec interface {
+	// Encode derives the encoded context ID for the data
+	Encode(ContextID) (EncodedContextID, error)
+	// Match returns true if the candidate is the encoded context ID of the data
+	// under this scheme
+	Match(c ContextID, candidate EncodedContextID) (bool, error)
+}
+
+// DefaultContextIDCodec is the original scheme, the SHA2-256 multihash of the
+// space DID followed by the hash
+var DefaultContextIDCodec ContextIDCodec = NewMultihashContextIDCodec(mh.SHA2_256)
+
+type multihashContextIDCodec struct {
+	code uint64
+}
+
+// NewMultihashContextIDCodec returns a scheme encoding context IDs as the
+// multihash of the space DID followed by the hash, using the given hash
+// function. Context IDs without a space are the hash itself
+func NewMultihashContextIDCodec(code uint64) ContextIDCodec {
+	return multihashContextIDCodec{code}
+}
+
+func (m multihashContextIDCodec) Encode(c ContextID) (EncodedContextID, error) {
+	if c.Space == nil {
+		return EncodedContextID(c.Hash), nil
+	}
+	digest, err := mh.Sum(bytes.Join([][]byte{c.Space.Bytes(), c.Hash}, nil), m.code, -1)
+	return EncodedContextID(digest), err
+}
+
+func (m multihashContextIDCodec) Match(c ContextID, candidate EncodedContextID) (bool, error) {
+	encoded, err := m.Encode(c)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(encoded, candidate), nil
+}
+
+type keyedContextIDCodec struct {
+	keys [][]byte
+}
+
+// NewKeyedContextIDCodec returns a scheme encoding context IDs as the
+// HMAC-SHA256 of the space DID followed by the hash, keyed with a secret held
+// by the service, so that the space can't be recovered from a published
+// context ID by anyone without the key. Context IDs are encoded with the key,
+// and matched with it or any of the previous keys, so that records written
+// before the key was rotated are still recognized until the previous key is
+// dropped. Context IDs without a space are the hash itself
+func NewKeyedContextIDCodec(key []byte, previous ...[]byte) (ContextIDCodec, error) {
+	keys := append([][]byte{key}, previous...)
+	for _, k := range keys {
+		if len(k) < sha256.Size {
+			return nil, errors.New("context ID keys must be at least 32 bytes")
+		}
+	}
+	return keyedContextIDCodec{keys}, nil
+}
+
+func (k keyedContextIDCodec) Encode(c ContextID) (EncodedContextID, error) {
+	return k.encode(k.keys[0], c), nil
+}
+
+func (k keyedContextIDCodec) encode(key []byte, c ContextID) EncodedContextID {
+	if c.Space == nil {
+		return EncodedContextID(c.Hash)
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(c.Space.Bytes())
+	h.Write(c.Hash)
+	return EncodedContextID(h.Sum(nil))
+}
+
+func (k keyedContextIDCodec) Match(c ContextID, candidate EncodedContextID) (bool, error) {
+	for _, key := range k.keys {
+		if hmac.Equal(k.encode(key, c), candidate) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type multiContextIDCodec struct {
+	schemes []ContextIDCodec
+}
+
+// NewMultiContextIDCodec returns a scheme that encodes with the primary scheme,
+// and matches context IDs encoded with any of the given schemes, so that records
+// written under earlier schemes are still recognized
+func NewMultiContextIDCodec(primary ContextIDCodec, secondary ...ContextIDCodec) ContextIDCodec {
+	return multiContextIDCodec{append([]ContextIDCodec{primary}, secondary...)}
+}
+
+func (m multiContextIDCodec) Encode(c ContextID) (EncodedContextID, error) {
+	return m.schemes[0].Encode(c)
+}
+
+func (m multiContextIDCodec) Match(c ContextID, candidate EncodedContextID) (bool, error) {
+	for _, scheme := range m.schemes {
+		ok, err := scheme.Match(c, candidate)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
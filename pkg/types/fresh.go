@@ -0,0 +1,18 @@
+package types
+
+import "context"
+
+type freshKey struct{}
+
+// WithFresh returns a context under which lookups skip the short-lived
+// in-memory results of recent lookups, and read from the caches or the origin
+func WithFresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, freshKey{}, true)
+}
+
+// IsFresh returns true if lookups under the context skip the results of recent
+// lookups
+func IsFresh(ctx context.Context) bool {
+	fresh, _ := ctx.Value(freshKey{}).(bool)
+	return fresh
+}
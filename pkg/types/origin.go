@@ -0,0 +1,50 @@
+package types
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ErrOriginNotFound is returned by lookups when the origin they fetch from
+// doesn't have what was asked for
+var ErrOriginNotFound = errors.New("not found at origin")
+
+// ErrOriginUnavailable is returned by lookups when the origin they fetch from
+// can't be reached or fails to answer
+var ErrOriginUnavailable = errors.New("origin unavailable")
+
+// originError classifies an error fetching from an origin, without changing
+// its message
+type originError struct {
+	err  error
+	kind error
+}
+
+func (e originError) Error() string {
+	return e.err.Error()
+}
+
+func (e originError) Unwrap() []error {
+	return []error{e.err, e.kind}
+}
+
+// OriginStatusError classifies err, returned for a failure response from an
+// origin, as ErrOriginNotFound if the origin doesn't have what was asked for,
+// and ErrOriginUnavailable otherwise
+func OriginStatusError(status int, err error) error {
+	if status == http.StatusNotFound || status == http.StatusGone {
+		return originError{err, ErrOriginNotFound}
+	}
+	return originError{err, ErrOriginUnavailable}
+}
+
+// OriginFetchError classifies err, returned for a request to an origin that got
+// no response, as ErrOriginUnavailable, unless the request failed because the
+// context ended
+func OriginFetchError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return err
+	}
+	return originError{err, ErrOriginUnavailable}
+}
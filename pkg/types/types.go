@@ -1,12 +1,13 @@
 package types
 
 import (
-	"bytes"
 	"context"
 	"errors"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
 	mh "github.com/multiformats/go-multihash"
 	"github.com/storacha/go-ucanto/core/delegation"
 	"github.com/storacha/go-ucanto/did"
@@ -23,18 +24,17 @@ type ContextID struct {
 // in IPNI
 type EncodedContextID []byte
 
-// ToEncoded canonically encodes ContextID data
+// ToEncoded canonically encodes ContextID data, with DefaultContextIDCodec
 func (c ContextID) ToEncoded() (EncodedContextID, error) {
-	if c.Space == nil {
-		return EncodedContextID(c.Hash), nil
-	}
-	mh, err := mh.Sum(bytes.Join([][]byte{c.Space.Bytes(), c.Hash}, nil), mh.SHA2_256, -1)
-	return EncodedContextID(mh), err
+	return DefaultContextIDCodec.Encode(c)
 }
 
 // ErrKeyNotFound means the key did not exist in the cache
 var ErrKeyNotFound = errors.New("cache key not found")
 
+// ErrCorruptEntry means the value cached for a key failed its integrity check
+var ErrCorruptEntry = errors.New("corrupt cache entry")
+
 // Cache describes a generic cache interface
 type Cache[Key, Value any] interface {
 	Set(ctx context.Context, key Key, value Value, expires bool) error
@@ -42,11 +42,200 @@ type Cache[Key, Value any] interface {
 	Get(ctx context.Context, key Key) (Value, error)
 }
 
+// PrimaryReader is implemented by caches that may read from a replica, which
+// can also read from the primary that writes go to
+type PrimaryReader[Key, Value any] interface {
+	GetPrimary(ctx context.Context, key Key) (Value, error)
+}
+
+// GetForWrite reads a value from a cache to write back a change to it, reading
+// from the primary where the cache supports it. A value read from a lagging
+// replica would drop the writes it hasn't caught up with
+func GetForWrite[Key, Value any](ctx context.Context, cache Cache[Key, Value], key Key) (Value, error) {
+	if pr, ok := cache.(PrimaryReader[Key, Value]); ok {
+		return pr.GetPrimary(ctx, key)
+	}
+	return cache.Get(ctx, key)
+}
+
+// CacheMetrics is told whether each read of a cache found what it was looking
+// for, by the name of the store read
+type CacheMetrics interface {
+	CacheRead(store string, hit bool)
+}
+
+// NoopCacheMetrics is CacheMetrics that records nothing
+type NoopCacheMetrics struct{}
+
+func (NoopCacheMetrics) CacheRead(string, bool) {}
+
+// the names of the caches reported to CacheMetrics
+const (
+	ProvidersCache = "providers"
+	// RecentProvidersCache is the in-memory results of recent IPNI lookups,
+	// read before ProvidersCache
+	RecentProvidersCache = "recent_providers"
+	ClaimsCache          = "claims"
+	IndexesCache         = "indexes"
+)
+
 // ProviderStore caches queries to IPNI
 type ProviderStore Cache[mh.Multihash, []model.ProviderResult]
 
+// ExportFormat is the row format of an export of cached provider records
+type ExportFormat string
+
+const (
+	// ExportNDJSON writes a JSON object per row, one per line
+	ExportNDJSON ExportFormat = "ndjson"
+	// ExportCSV writes comma separated rows, with a header row at the start of
+	// an export
+	ExportCSV ExportFormat = "csv"
+)
+
+// ErrInvalidExportFormat is returned for an export format that isn't known
+var ErrInvalidExportFormat = errors.New("invalid export format")
+
 // ContentClaimsStore caches fetched content claims
 type ContentClaimsStore Cache[cid.Cid, delegation.Delegation]
 
 // ShardedDagIndexStore caches fetched sharded dag indexes
 type ShardedDagIndexStore Cache[EncodedContextID, blobindex.ShardedDagIndexView]
+
+// ShardFilterStore caches the shard filters of fetched sharded dag indexes
+type ShardFilterStore Cache[EncodedContextID, *blobindex.ShardFilters]
+
+// IndexBlobStore caches fetched sharded dag indexes by the digest of the index
+// blob, so an index referenced from several context IDs is held once
+type IndexBlobStore Cache[mh.Multihash, blobindex.ShardedDagIndexView]
+
+// IndexDigestStore caches the digest of the index blob of each context ID
+type IndexDigestStore Cache[EncodedContextID, mh.Multihash]
+
+// PopulationMarkerStore records the digest of the index blob of each context ID
+// whose provider records were cached for every block of the index
+type PopulationMarkerStore Cache[EncodedContextID, mh.Multihash]
+
+// SpaceClaim is a claim bound to a space, as recorded in the space index
+type SpaceClaim struct {
+	Claim cid.Cid
+	// Type is the ability of the claim, i.e. "assert/location"
+	Type string
+	// Hash is the content the claim is about
+	Hash mh.Multihash
+	// Expiration is when the claim expires, zero if it doesn't
+	Expiration time.Time
+}
+
+// ErrInvalidCursor means a page cursor could not be decoded
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// SpaceIndexStore records the claims bound to each space
+type SpaceIndexStore interface {
+	// Add records a claim bound to the space. Adding a claim again has no effect
+	Add(ctx context.Context, space did.DID, claim SpaceClaim) error
+	// List returns up to limit claims bound to the space, following the given
+	// cursor, along with the cursor of the next page. The next cursor is empty on
+	// the last page
+	List(ctx context.Context, space did.DID, cursor string, limit int) ([]SpaceClaim, string, error)
+	// Prune removes the claims bound to the space that expired before now,
+	// returning the number removed
+	Prune(ctx context.Context, space did.DID, now time.Time) (int, error)
+}
+
+// IndexRef refers to a cached index a block was found in
+type IndexRef struct {
+	// ContextID is the context ID the index is cached under
+	ContextID EncodedContextID
+	// Content is the hash of the content root the index is for
+	Content mh.Multihash
+}
+
+// ContainingIndexStore records which indexes blocks were found in, for reverse
+// lookups of the DAGs a block is part of
+type ContainingIndexStore interface {
+	// Add records that the blocks are in the index. Only the most recently added
+	// indexes of each block are kept, and each expires along with the index
+	Add(ctx context.Context, ref IndexRef, hashes []mh.Multihash) error
+	// Get returns the unexpired indexes the block is in, most recently added
+	// first. A block in no indexes has none, rather than ErrKeyNotFound
+	Get(ctx context.Context, hash mh.Multihash) ([]IndexRef, error)
+}
+
+// ProviderTombstone records the removal of every record of a provider, and how
+// far the removal got so that it can be resumed. While a tombstone exists,
+// records of the provider read from IPNI are dropped rather than cached again
+type ProviderTombstone struct {
+	Provider peer.ID
+	// Started is when the removal started, and Finished when it finished, zero
+	// until it has
+	Started  time.Time
+	Finished time.Time
+	// Cursor is where the sweep of cached records resumes from
+	Cursor uint64
+	// Adverts is the number of removal advertisements published
+	Adverts int
+	// Swept is the number of cached hashes checked for records of the provider,
+	// Hashes the number of them that had any, and Records the number removed
+	Swept   int
+	Hashes  int
+	Records int
+	// Claims is the number of cached claims evicted, that were only found
+	// through records of the provider
+	Claims int
+}
+
+// Done returns true once the removal has finished
+func (t ProviderTombstone) Done() bool {
+	return !t.Finished.IsZero()
+}
+
+// TombstoneStore keeps the tombstones of removed providers
+type TombstoneStore Cache[peer.ID, ProviderTombstone]
+
+// SpaceBinding records that a space shares a location commitment published
+// under another space, rather than the same commitment being published again
+// for it
+type SpaceBinding struct {
+	// ContextID is the context ID the commitment would have been published
+	// under for the space
+	ContextID EncodedContextID
+	// Claim is the CID of the commitment the space shares
+	Claim cid.Cid
+	// Expiration is when the shared commitment expires, zero if it never does
+	Expiration time.Time
+}
+
+// Expired returns true if the shared commitment has expired by the given time
+func (b SpaceBinding) Expired(now time.Time) bool {
+	return !b.Expiration.IsZero() && !now.Before(b.Expiration)
+}
+
+// SpaceBindingStore keeps the space bindings of location commitments, by the
+// hash the commitments are for
+type SpaceBindingStore Cache[mh.Multihash, []SpaceBinding]
+
+// Supersession records that an index claim was replaced by a newer index claim
+// for the same content, from the same issuer
+type Supersession struct {
+	// By is the CID of the claim that replaces it
+	By cid.Cid
+	// Issuer is the DID of the issuer of the claim that replaces it. Only claims
+	// from the same issuer are replaced
+	Issuer string
+	// Content is the hash of the content both claims are for
+	Content mh.Multihash
+	// Expiration is when the claim that replaces it expires, zero if it never
+	// does. Once it has, the claim it replaced is no longer superseded by it
+	Expiration time.Time
+}
+
+// Live returns true if the claim that replaces the superseded claim hasn't
+// expired by the given time
+func (s Supersession) Live(now time.Time) bool {
+	return s.Expiration.IsZero() || now.Before(s.Expiration)
+}
+
+// SupersessionStore keeps the supersessions of index claims, by the CID of the
+// claim that was superseded
+type SupersessionStore Cache[cid.Cid, Supersession]
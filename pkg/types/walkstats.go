@@ -0,0 +1,176 @@
+package types
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// the kinds of origin fetches counted by WalkCounters
+const (
+	// FetchIPNI is a find request to IPNI for the records of a hash
+	FetchIPNI = "ipni"
+	// FetchClaim is a request for a claim to the provider serving it
+	FetchClaim = "claim"
+	// FetchIndex is a request for a sharded dag index blob
+	FetchIndex = "index"
+)
+
+// countedCaches and countedFetches are the caches and fetches WalkCounters
+// keep counts of. Others aren't counted
+var (
+	countedCaches  = [...]string{ProvidersCache, RecentProvidersCache, ClaimsCache, IndexesCache}
+	countedFetches = [...]string{FetchIPNI, FetchClaim, FetchIndex}
+)
+
+// WalkCounters count the work done to answer a query: the jobs of its walk, and
+// the cache reads and origin fetches of the lookups made on its behalf, which
+// find the counters in their context. Counts are atomic, so the jobs of a
+// parallel walk count without contending. A nil WalkCounters counts nothing
+type WalkCounters struct {
+	jobs      atomic.Int64
+	hits      [len(countedCaches)]atomic.Int64
+	misses    [len(countedCaches)]atomic.Int64
+	fetches   [len(countedFetches)]atomic.Int64
+	expanded  atomic.Int64
+	truncated sync.Map
+}
+
+var _ CacheMetrics = (*WalkCounters)(nil)
+
+type walkCountersKey struct{}
+
+// WithWalkCounters returns a context under which lookups count their cache
+// reads and origin fetches in the counters
+func WithWalkCounters(ctx context.Context, c *WalkCounters) context.Context {
+	return context.WithValue(ctx, walkCountersKey{}, c)
+}
+
+// WalkCountersFrom returns the counters of the context, or nil if there are
+// none
+func WalkCountersFrom(ctx context.Context) *WalkCounters {
+	c, _ := ctx.Value(walkCountersKey{}).(*WalkCounters)
+	return c
+}
+
+// CacheRead reports a read of the named cache to the metrics, and counts it in
+// the counters of the context
+func CacheRead(ctx context.Context, m CacheMetrics, store string, hit bool) {
+	m.CacheRead(store, hit)
+	WalkCountersFrom(ctx).CacheRead(store, hit)
+}
+
+// Job counts a job of the walk
+func (c *WalkCounters) Job() {
+	if c != nil {
+		c.jobs.Add(1)
+	}
+}
+
+// CacheRead counts a read of the named cache
+func (c *WalkCounters) CacheRead(store string, hit bool) {
+	i := slices.Index(countedCaches[:], store)
+	if c == nil || i < 0 {
+		return
+	}
+	if hit {
+		c.hits[i].Add(1)
+	} else {
+		c.misses[i].Add(1)
+	}
+}
+
+// Fetched counts a fetch from an origin, of one of the Fetch kinds
+func (c *WalkCounters) Fetched(kind string) {
+	i := slices.Index(countedFetches[:], kind)
+	if c == nil || i < 0 {
+		return
+	}
+	c.fetches[i].Add(1)
+}
+
+// IndexExpanded counts an index read to follow its shards
+func (c *WalkCounters) IndexExpanded() {
+	if c != nil {
+		c.expanded.Add(1)
+	}
+}
+
+// Truncated records that the named limit left something out of the result
+func (c *WalkCounters) Truncated(limit string) {
+	if c != nil {
+		c.truncated.Store(limit, struct{}{})
+	}
+}
+
+// Jobs returns the number of jobs counted
+func (c *WalkCounters) Jobs() int {
+	if c == nil {
+		return 0
+	}
+	return int(c.jobs.Load())
+}
+
+// CacheHits returns the number of reads of each cache that found what they were
+// looking for, leaving out caches with none
+func (c *WalkCounters) CacheHits() map[string]int {
+	if c == nil {
+		return nil
+	}
+	return counts(countedCaches[:], c.hits[:])
+}
+
+// CacheMisses returns the number of reads of each cache that found nothing,
+// leaving out caches with none
+func (c *WalkCounters) CacheMisses() map[string]int {
+	if c == nil {
+		return nil
+	}
+	return counts(countedCaches[:], c.misses[:])
+}
+
+// Fetches returns the number of fetches of each kind, leaving out kinds with
+// none
+func (c *WalkCounters) Fetches() map[string]int {
+	if c == nil {
+		return nil
+	}
+	return counts(countedFetches[:], c.fetches[:])
+}
+
+// IndexesExpanded returns the number of indexes counted
+func (c *WalkCounters) IndexesExpanded() int {
+	if c == nil {
+		return 0
+	}
+	return int(c.expanded.Load())
+}
+
+// TruncatedBy returns the limits that left something out of the result, in
+// order
+func (c *WalkCounters) TruncatedBy() []string {
+	if c == nil {
+		return nil
+	}
+	var limits []string
+	c.truncated.Range(func(limit, _ any) bool {
+		limits = append(limits, limit.(string))
+		return true
+	})
+	slices.Sort(limits)
+	return limits
+}
+
+func counts(names []string, counters []atomic.Int64) map[string]int {
+	var m map[string]int
+	for i := range counters {
+		if n := counters[i].Load(); n > 0 {
+			if m == nil {
+				m = map[string]int{}
+			}
+			m[names[i]] = int(n)
+		}
+	}
+	return m
+}